@@ -0,0 +1,90 @@
+// Copyright 2021 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/kaleido-io/ethconnect/internal/errors"
+	"github.com/kaleido-io/ethconnect/pkg/client"
+	"github.com/spf13/cobra"
+)
+
+var clientGenCmdConfig struct {
+	client.ClientConf
+	client.BindingsConf
+	ABI      string
+	Contract string
+	Output   string
+}
+
+func initClientGen() (clientGenCmd *cobra.Command) {
+	clientGenCmd = &cobra.Command{
+		Use:   "clientgen",
+		Short: "Generates typed Go bindings for a contract, from its ABI in a gateway",
+		RunE: func(cmd *cobra.Command, args []string) (err error) {
+			return generateClient()
+		},
+		PreRunE: func(cmd *cobra.Command, args []string) (err error) {
+			if clientGenCmdConfig.ABI == "" && clientGenCmdConfig.Contract == "" {
+				return errors.Errorf(errors.ClientGenNoABI)
+			}
+			if clientGenCmdConfig.Package == "" {
+				return errors.Errorf(errors.ClientGenNoPackage)
+			}
+			return nil
+		},
+	}
+	clientGenCmd.Flags().StringVarP(&clientGenCmdConfig.URL, "url", "u", os.Getenv("ETHCONNECT_URL"), "Base URL of the gateway")
+	clientGenCmd.Flags().StringVarP(&clientGenCmdConfig.AccessToken, "access-token", "a", os.Getenv("ETHCONNECT_ACCESS_TOKEN"), "Bearer token for the requests to the gateway")
+	clientGenCmd.Flags().StringVarP(&clientGenCmdConfig.ABI, "abi", "i", "", "ID of an ABI uploaded to the gateway")
+	clientGenCmd.Flags().StringVarP(&clientGenCmdConfig.Contract, "contract", "c", "", "Address or registered name of a contract instance")
+	clientGenCmd.Flags().StringVarP(&clientGenCmdConfig.Package, "package", "p", "", "Go package name for the bindings")
+	clientGenCmd.Flags().StringVarP(&clientGenCmdConfig.Type, "type", "t", "Contract", "Go type name for the contract")
+	clientGenCmd.Flags().StringVarP(&clientGenCmdConfig.Output, "output", "o", "", "File to write the bindings to (default stdout)")
+	clientGenCmd.Flags().IntVarP(&clientGenCmdConfig.TimeoutSec, "timeout", "T", 30, "Timeout in seconds for the requests to the gateway")
+	return
+}
+
+func generateClient() error {
+	c, err := client.NewClient(&clientGenCmdConfig.ClientConf)
+	if err != nil {
+		return err
+	}
+	var abi client.ABI
+	if clientGenCmdConfig.ABI != "" {
+		abi, err = c.GetABI(context.Background(), clientGenCmdConfig.ABI)
+	} else {
+		abi, err = c.GetContractABI(context.Background(), clientGenCmdConfig.Contract)
+	}
+	if err != nil {
+		return err
+	}
+	src, err := client.GenerateBindings(&clientGenCmdConfig.BindingsConf, abi)
+	if err != nil {
+		return err
+	}
+	if clientGenCmdConfig.Output == "" {
+		fmt.Print(string(src))
+		return nil
+	}
+	if err := ioutil.WriteFile(clientGenCmdConfig.Output, src, 0644); err != nil {
+		return errors.Errorf(errors.ClientGenWriteFailed, clientGenCmdConfig.Output, err)
+	}
+	return nil
+}
@@ -28,6 +28,7 @@ import (
 	"github.com/kaleido-io/ethconnect/internal/errors"
 	"github.com/kaleido-io/ethconnect/internal/kafka"
 	"github.com/kaleido-io/ethconnect/internal/rest"
+	"github.com/kaleido-io/ethconnect/internal/tracing"
 	"github.com/kaleido-io/ethconnect/internal/utils"
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
@@ -44,6 +45,9 @@ type ServerConfig struct {
 	Webhooks     map[string]*rest.RESTGatewayConf  `json:"webhooks"`
 	RESTGateways map[string]*rest.RESTGatewayConf  `json:"rest"`
 	Plugins      PluginConfig                      `json:"plugins"`
+	Egress       *utils.EgressConf                 `json:"egress,omitempty"`
+	Redaction    *utils.RedactionConf              `json:"redaction,omitempty"`
+	Tracing      *tracing.Conf                     `json:"tracing,omitempty"`
 }
 
 func initLogging(debugLevel int) {
@@ -84,6 +88,8 @@ var serverCmdConfig struct {
 	Type     string
 }
 
+var replayCmdConfig rest.ReplayConf
+
 var rootCmd = &cobra.Command{
 	Use:   "ethconnect [sub]",
 	Short: "Connectivity Bridge for Ethereum permissioned chains",
@@ -123,6 +129,38 @@ func initServer() (serverCmd *cobra.Command) {
 	return
 }
 
+func initReplay() (replayCmd *cobra.Command) {
+	replayCmd = &cobra.Command{
+		Use:   "replay",
+		Short: "Replays the REST requests in a recording against a gateway, and compares the responses",
+		RunE: func(cmd *cobra.Command, args []string) (err error) {
+			report, err := rest.Replay(&replayCmdConfig)
+			if err != nil {
+				return
+			}
+			b, _ := json.MarshalIndent(report, "", "  ")
+			fmt.Println(string(b))
+			if report.Mismatched > 0 {
+				err = errors.Errorf(errors.ReplayMismatches, report.Mismatched, report.Total)
+			}
+			return
+		},
+		PreRunE: func(cmd *cobra.Command, args []string) (err error) {
+			if replayCmdConfig.File == "" {
+				err = errors.Errorf(errors.ReplayNoFile)
+			}
+			return
+		},
+	}
+	replayCmd.Flags().StringVarP(&replayCmdConfig.File, "filename", "f", os.Getenv("REPLAY_FILE"), "Recording file to replay")
+	replayCmd.Flags().StringVarP(&replayCmdConfig.TargetURL, "target-url", "u", os.Getenv("REPLAY_TARGET_URL"), "Base URL of the gateway to replay the requests against")
+	replayCmd.Flags().StringVarP(&replayCmdConfig.AccessToken, "access-token", "a", os.Getenv("REPLAY_ACCESS_TOKEN"), "Bearer token for each request, as credentials are not recorded")
+	replayCmd.Flags().BoolVarP(&replayCmdConfig.CompareBodies, "compare-bodies", "b", false, "Compare JSON response bodies, as well as status codes")
+	replayCmd.Flags().StringSliceVarP(&replayCmdConfig.IgnoreFields, "ignore-fields", "i", rest.DefaultReplayIgnoreFields, "JSON fields to ignore when comparing response bodies")
+	replayCmd.Flags().IntVarP(&replayCmdConfig.TimeoutSec, "timeout", "t", 120, "Timeout in seconds for each request")
+	return
+}
+
 func readServerConfig() (serverConfig *ServerConfig, err error) {
 	confBytes, err := ioutil.ReadFile(serverCmdConfig.Filename)
 	if err != nil {
@@ -148,7 +186,22 @@ func readServerConfig() (serverConfig *ServerConfig, err error) {
 	}
 
 	// Load any plugins
-	err = loadPlugins(&serverConfig.Plugins)
+	if err = loadPlugins(&serverConfig.Plugins); err != nil {
+		return
+	}
+
+	// The egress policy applies to the outbound HTTP calls of all the bridges
+	if err = utils.ConfigureEgress(serverConfig.Egress); err != nil {
+		return
+	}
+
+	// The redaction policy applies to the logs and stored records of all the bridges
+	if err = utils.ConfigureRedaction(serverConfig.Redaction); err != nil {
+		return
+	}
+
+	// Spans are exported for all the bridges, including the calls they make to the node
+	err = tracing.Configure(serverConfig.Tracing)
 
 	return
 }
@@ -217,6 +270,8 @@ func init() {
 
 	serverCmd := initServer()
 	rootCmd.AddCommand(serverCmd)
+	rootCmd.AddCommand(initReplay())
+	rootCmd.AddCommand(initClientGen())
 
 	kafkaBridge := kafka.NewKafkaBridge(&rootConfig.PrintYAML)
 	rootCmd.AddCommand(kafkaBridge.CobraInit())
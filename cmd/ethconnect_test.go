@@ -17,6 +17,9 @@ package cmd
 import (
 	"fmt"
 	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
 	"syscall"
 	"testing"
 
@@ -100,6 +103,70 @@ func TestExecuteServerMissingFile(t *testing.T) {
 	assert.Equal(1, osExit)
 }
 
+func TestExecuteReplayMissingArgs(t *testing.T) {
+	assert := assert.New(t)
+
+	rootCmd.SetArgs([]string{"replay"})
+	osExit := Execute()
+
+	assert.Equal(1, osExit)
+}
+
+func TestExecuteReplayEmptyRecording(t *testing.T) {
+	assert := assert.New(t)
+
+	recording, _ := ioutil.TempFile("", "testRecording")
+	defer syscall.Unlink(recording.Name())
+
+	rootCmd.SetArgs([]string{"replay", "-f", recording.Name(), "-u", "http://localhost:0"})
+	osExit := Execute()
+
+	assert.Equal(0, osExit)
+}
+
+func TestExecuteReplayMismatches(t *testing.T) {
+	assert := assert.New(t)
+
+	recording, _ := ioutil.TempFile("", "testRecording")
+	defer syscall.Unlink(recording.Name())
+	ioutil.WriteFile(recording.Name(), []byte(`{"seq":1,"type":"request","request":{"method":"GET","url":"/status"},"response":{"status":200}}`), 0644)
+
+	rootCmd.SetArgs([]string{"replay", "-f", recording.Name(), "-u", "http://localhost:0"})
+	osExit := Execute()
+
+	assert.Equal(1, osExit)
+}
+
+func TestExecuteClientGenMissingArgs(t *testing.T) {
+	assert := assert.New(t)
+
+	rootCmd.SetArgs([]string{"clientgen", "-p", "erc20"})
+	osExit := Execute()
+
+	assert.Equal(1, osExit)
+}
+
+func TestExecuteClientGenToFile(t *testing.T) {
+	assert := assert.New(t)
+
+	server := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		assert.Equal("/abis/abi1", req.URL.Path)
+		assert.Equal("true", req.URL.Query().Get("abi"))
+		res.Header().Set("Content-Type", "application/json")
+		res.Write([]byte(`[{"type":"function","name":"set","inputs":[{"name":"x","type":"uint256"}]}]`))
+	}))
+	defer server.Close()
+	output, _ := ioutil.TempFile("", "testBindings")
+	defer syscall.Unlink(output.Name())
+
+	rootCmd.SetArgs([]string{"clientgen", "-u", server.URL, "-i", "abi1", "-p", "simple", "-t", "Simple", "-o", output.Name()})
+	osExit := Execute()
+
+	assert.Equal(0, osExit)
+	src, _ := ioutil.ReadFile(output.Name())
+	assert.True(strings.Contains(string(src), "func (x *Simple) Set(ctx context.Context, xArg0 *big.Int"))
+}
+
 func TestExecuteServerInvalidYAMLContent(t *testing.T) {
 	assert := assert.New(t)
 
@@ -206,3 +273,49 @@ func TestExecuteServerWithBadYAML(t *testing.T) {
 
 	assert.Equal(1, osExit)
 }
+
+func TestExecuteServerWithBadEgress(t *testing.T) {
+	assert := assert.New(t)
+
+	exampleConfYAML, _ := ioutil.TempFile("", "testYAML")
+	defer syscall.Unlink(exampleConfYAML.Name())
+	ioutil.WriteFile(exampleConfYAML.Name(), []byte(
+		"egress:\n"+
+			"  httpsProxy: http://\n"), 0644)
+
+	rootCmd.SetArgs([]string{"server", "-f", exampleConfYAML.Name()})
+	osExit := Execute()
+
+	assert.Equal(1, osExit)
+}
+
+func TestExecuteServerWithBadRedaction(t *testing.T) {
+	assert := assert.New(t)
+
+	exampleConfYAML, _ := ioutil.TempFile("", "testYAML")
+	defer syscall.Unlink(exampleConfYAML.Name())
+	ioutil.WriteFile(exampleConfYAML.Name(), []byte(
+		"redaction:\n"+
+			"  fields: [\"data..email\"]\n"), 0644)
+
+	rootCmd.SetArgs([]string{"server", "-f", exampleConfYAML.Name()})
+	osExit := Execute()
+
+	assert.Equal(1, osExit)
+}
+
+func TestExecuteServerWithBadTracing(t *testing.T) {
+	assert := assert.New(t)
+
+	exampleConfYAML, _ := ioutil.TempFile("", "testYAML")
+	defer syscall.Unlink(exampleConfYAML.Name())
+	ioutil.WriteFile(exampleConfYAML.Name(), []byte(
+		"tracing:\n"+
+			"  enabled: true\n"+
+			"  endpoint: localhost:4318\n"), 0644)
+
+	rootCmd.SetArgs([]string{"server", "-f", exampleConfYAML.Name()})
+	osExit := Execute()
+
+	assert.Equal(1, osExit)
+}
@@ -19,19 +19,29 @@ import (
 
 	"github.com/kaleido-io/ethconnect/internal/auth"
 	"github.com/kaleido-io/ethconnect/internal/errors"
+	"github.com/kaleido-io/ethconnect/internal/kvstore"
+	"github.com/kaleido-io/ethconnect/internal/tx"
 	"github.com/kaleido-io/ethconnect/pkg/plugins"
 	log "github.com/sirupsen/logrus"
 )
 
 // PluginConfig is the JSON configuration for loading plugins
 type PluginConfig struct {
-	SecurityModulePlugin string `json:"securityModule"`
+	SecurityModulePlugin     string            `json:"securityModule"`
+	KVStoreDrivers           map[string]string `json:"kvStoreDrivers"`
+	MessageTransformerPlugin string            `json:"messageTransformer"`
 }
 
 func loadPlugins(conf *PluginConfig) error {
 	if err := loadSecurityModulePlugin(conf); err != nil {
 		return err
 	}
+	if err := loadKVStoreDriverPlugins(conf); err != nil {
+		return err
+	}
+	if err := loadMessageTransformerPlugin(conf); err != nil {
+		return err
+	}
 	return nil
 }
 
@@ -56,3 +66,45 @@ func loadSecurityModulePlugin(conf *PluginConfig) error {
 	auth.RegisterSecurityModule(*smSymbol.(*plugins.SecurityModule))
 	return nil
 }
+
+// loadKVStoreDriverPlugins registers a driver for each configured connection string scheme
+func loadKVStoreDriverPlugins(conf *PluginConfig) error {
+
+	for scheme, modulePath := range conf.KVStoreDrivers {
+		log.Debugf("Loading KVStoreDriver plugin '%s' for scheme '%s'", modulePath, scheme)
+		kvPlugin, err := plugin.Open(modulePath)
+		if err != nil {
+			return errors.Errorf(errors.KVStoreDriverPluginLoad, scheme, err)
+		}
+
+		kvSymbol, err := kvPlugin.Lookup("KVStoreDriver")
+		if err != nil || kvSymbol == nil {
+			return errors.Errorf(errors.KVStoreDriverPluginSymbol, modulePath, err)
+		}
+
+		kvstore.RegisterDriver(scheme, *kvSymbol.(*plugins.KVStoreDriver))
+	}
+	return nil
+}
+
+func loadMessageTransformerPlugin(conf *PluginConfig) error {
+
+	modulePath := conf.MessageTransformerPlugin
+	if modulePath == "" {
+		return nil
+	}
+
+	log.Debugf("Loading MessageTransformer plugin '%s'", modulePath)
+	mtPlugin, err := plugin.Open(modulePath)
+	if err != nil {
+		return errors.Errorf(errors.MessageTransformerPluginLoad, err)
+	}
+
+	mtSymbol, err := mtPlugin.Lookup("MessageTransformer")
+	if err != nil || mtSymbol == nil {
+		return errors.Errorf(errors.MessageTransformerPluginSymbol, modulePath, err)
+	}
+
+	tx.RegisterMessageTransformer(*mtSymbol.(*plugins.MessageTransformer))
+	return nil
+}
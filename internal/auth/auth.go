@@ -16,6 +16,7 @@ package auth
 
 import (
 	"context"
+	"time"
 
 	"github.com/kaleido-io/ethconnect/internal/errors"
 	"github.com/kaleido-io/ethconnect/pkg/plugins"
@@ -27,6 +28,7 @@ const (
 	ContextKeySystemAuth ContextKey = iota
 	ContextKeyAuthContext
 	ContextKeyAccessToken
+	ContextKeyPrincipal
 )
 
 var securityModule plugins.SecurityModule
@@ -36,6 +38,11 @@ func RegisterSecurityModule(sm plugins.SecurityModule) {
 	securityModule = sm
 }
 
+// IsSecurityModuleEnabled returns true if a security module has been registered
+func IsSecurityModuleEnabled() bool {
+	return securityModule != nil
+}
+
 // NewSystemAuthContext creates a system background context
 func NewSystemAuthContext() context.Context {
 	return context.WithValue(context.Background(), ContextKeySystemAuth, true)
@@ -61,6 +68,49 @@ func WithAuthContext(ctx context.Context, token string) (context.Context, error)
 	return ctx, nil
 }
 
+// WithPrincipal adds a principal authenticated by ethconnect itself to a base context, rather
+// than by a token. A registered security module must accept the principal, so that it can be
+// authorized in the same way as a token
+func WithPrincipal(ctx context.Context, principal string) (context.Context, error) {
+	if securityModule != nil {
+		sm, ok := securityModule.(plugins.SecurityModulePrincipal)
+		if !ok {
+			return nil, errors.Errorf(errors.SecurityModulePrincipalUnsupported)
+		}
+		ctxValue, err := sm.VerifyPrincipal(principal)
+		if err != nil {
+			return nil, err
+		}
+		ctx = context.WithValue(ctx, ContextKeyAuthContext, ctxValue)
+	}
+	return context.WithValue(ctx, ContextKeyPrincipal, principal), nil
+}
+
+// Detach returns a context with the values of the supplied context, such as the auth context
+// of a request, that is not cancelled when the supplied context is
+func Detach(ctx context.Context) context.Context {
+	return detachedContext{parent: ctx}
+}
+
+type detachedContext struct {
+	parent context.Context
+}
+
+func (d detachedContext) Deadline() (time.Time, bool)       { return time.Time{}, false }
+func (d detachedContext) Done() <-chan struct{}             { return nil }
+func (d detachedContext) Err() error                        { return nil }
+func (d detachedContext) Value(key interface{}) interface{} { return d.parent.Value(key) }
+
+// GetPrincipal returns a previously stored principal, or an empty string if the request was not
+// authenticated as a principal
+func GetPrincipal(ctx context.Context) string {
+	v, ok := ctx.Value(ContextKeyPrincipal).(string)
+	if ok {
+		return v
+	}
+	return ""
+}
+
 // GetAuthContext extracts a previously stored auth context from the context
 func GetAuthContext(ctx context.Context) interface{} {
 	return ctx.Value(ContextKeyAuthContext)
@@ -75,6 +125,95 @@ func GetAccessToken(ctx context.Context) string {
 	return ""
 }
 
+// GetTokenExpiry returns the expiry of the token in a previously stored auth context, if the
+// security module supports reporting expiry. The boolean is false if there is no expiry.
+func GetTokenExpiry(ctx context.Context) (time.Time, bool) {
+	if sm, ok := securityModule.(plugins.SecurityModuleTokenExpiry); ok {
+		if authCtx := GetAuthContext(ctx); authCtx != nil {
+			expiry := sm.TokenExpiry(authCtx)
+			return expiry, !expiry.IsZero()
+		}
+	}
+	return time.Time{}, false
+}
+
+// GetTenant returns the tenant of a previously stored auth context, if the security module
+// supports identifying tenants. An empty string is returned otherwise.
+func GetTenant(ctx context.Context) string {
+	if sm, ok := securityModule.(plugins.SecurityModuleTenant); ok {
+		if authCtx := GetAuthContext(ctx); authCtx != nil {
+			return sm.Tenant(authCtx)
+		}
+	}
+	return ""
+}
+
+// GetSubject returns the principal of a previously stored auth context. This is the principal
+// authenticated by ethconnect itself, or the principal the token was issued to if the security
+// module supports identifying them. An empty string is returned otherwise.
+func GetSubject(ctx context.Context) string {
+	if principal := GetPrincipal(ctx); principal != "" {
+		return principal
+	}
+	if sm, ok := securityModule.(plugins.SecurityModuleSubject); ok {
+		if authCtx := GetAuthContext(ctx); authCtx != nil {
+			return sm.Subject(authCtx)
+		}
+	}
+	return ""
+}
+
+// AuthSponsorship authorizes a transaction to use the gas of a sponsor. The boolean result is false
+// if the security module does not implement a sponsorship policy, so the caller must apply its own
+func AuthSponsorship(ctx context.Context, sponsor string) (bool, error) {
+	sm, ok := securityModule.(plugins.SecurityModuleSponsorship)
+	if !ok {
+		return false, nil
+	}
+	if IsSystemContext(ctx) {
+		return true, nil
+	}
+	authCtx := GetAuthContext(ctx)
+	if authCtx == nil {
+		return true, errors.Errorf(errors.SecurityModuleNoAuthContext)
+	}
+	return true, sm.AuthSponsorship(authCtx, sponsor)
+}
+
+// AuthAlias authorizes a transaction to be sent from the identity of an alias. The boolean result is
+// false if the security module does not implement an alias policy, so the caller must apply its own
+func AuthAlias(ctx context.Context, alias string) (bool, error) {
+	sm, ok := securityModule.(plugins.SecurityModuleAliases)
+	if !ok {
+		return false, nil
+	}
+	if IsSystemContext(ctx) {
+		return true, nil
+	}
+	authCtx := GetAuthContext(ctx)
+	if authCtx == nil {
+		return true, errors.Errorf(errors.SecurityModuleNoAuthContext)
+	}
+	return true, sm.AuthAlias(authCtx, alias)
+}
+
+// AuthAdmin authorizes an administrative operation. When a security module is configured, it must
+// implement the admin extension for any administrative operation to be allowed
+func AuthAdmin(ctx context.Context, operation string, args ...interface{}) error {
+	if securityModule == nil || IsSystemContext(ctx) {
+		return nil
+	}
+	sm, ok := securityModule.(plugins.SecurityModuleAdmin)
+	if !ok {
+		return errors.Errorf(errors.SecurityModuleNoAdminPolicy, operation)
+	}
+	authCtx := GetAuthContext(ctx)
+	if authCtx == nil {
+		return errors.Errorf(errors.SecurityModuleNoAuthContext)
+	}
+	return sm.AuthAdmin(authCtx, operation, args...)
+}
+
 // AuthRPC authorize an RPC call
 func AuthRPC(ctx context.Context, method string, args ...interface{}) error {
 	if securityModule != nil && !IsSystemContext(ctx) {
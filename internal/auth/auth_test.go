@@ -16,7 +16,9 @@ package auth
 
 import (
 	"context"
+	"fmt"
 	"testing"
+	"time"
 
 	"github.com/kaleido-io/ethconnect/internal/auth/authtest"
 	"github.com/stretchr/testify/assert"
@@ -32,6 +34,27 @@ func TestSystemContext(t *testing.T) {
 
 }
 
+func TestDetach(t *testing.T) {
+	assert := assert.New(t)
+
+	RegisterSecurityModule(&authtest.TestSecurityModule{})
+	defer RegisterSecurityModule(nil)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Minute)
+	ctx, err := WithAuthContext(ctx, "testat")
+	assert.NoError(err)
+	detached := Detach(ctx)
+	cancel()
+
+	assert.Error(ctx.Err())
+	assert.NoError(detached.Err())
+	assert.Nil(detached.Done())
+	_, hasDeadline := detached.Deadline()
+	assert.False(hasDeadline)
+	assert.Equal("verified", GetAuthContext(detached))
+	assert.Equal("testat", GetAccessToken(detached))
+}
+
 func TestAccessToken(t *testing.T) {
 	assert := assert.New(t)
 
@@ -147,3 +170,230 @@ func TestAuthReadAsyncReplyByUUID(t *testing.T) {
 	RegisterSecurityModule(nil)
 
 }
+
+type testExpiringSecurityModule struct {
+	authtest.TestSecurityModule
+}
+
+func (sm *testExpiringSecurityModule) TokenExpiry(authCtx interface{}) time.Time {
+	return time.Unix(1000000000, 0)
+}
+
+func TestGetTokenExpiry(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.False(IsSecurityModuleEnabled())
+	_, ok := GetTokenExpiry(context.Background())
+	assert.False(ok)
+
+	RegisterSecurityModule(&authtest.TestSecurityModule{})
+	assert.True(IsSecurityModuleEnabled())
+	ctx, _ := WithAuthContext(context.Background(), "testat")
+	_, ok = GetTokenExpiry(ctx)
+	assert.False(ok)
+
+	RegisterSecurityModule(&testExpiringSecurityModule{})
+	_, ok = GetTokenExpiry(context.Background())
+	assert.False(ok)
+	ctx, _ = WithAuthContext(context.Background(), "testat")
+	expiry, ok := GetTokenExpiry(ctx)
+	assert.True(ok)
+	assert.Equal(int64(1000000000), expiry.Unix())
+
+	RegisterSecurityModule(nil)
+}
+
+type testTenantSecurityModule struct {
+	authtest.TestSecurityModule
+}
+
+func (sm *testTenantSecurityModule) Tenant(authCtx interface{}) string {
+	return "tenant-" + authCtx.(string)
+}
+
+func TestGetTenant(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Equal("", GetTenant(context.Background()))
+
+	RegisterSecurityModule(&authtest.TestSecurityModule{})
+	ctx, _ := WithAuthContext(context.Background(), "testat")
+	assert.Equal("", GetTenant(ctx))
+
+	RegisterSecurityModule(&testTenantSecurityModule{})
+	assert.Equal("", GetTenant(context.Background()))
+	ctx, _ = WithAuthContext(context.Background(), "testat")
+	assert.Equal("tenant-verified", GetTenant(ctx))
+
+	RegisterSecurityModule(nil)
+}
+
+type testSubjectSecurityModule struct {
+	authtest.TestSecurityModule
+}
+
+func (sm *testSubjectSecurityModule) Subject(authCtx interface{}) string {
+	return "user-" + authCtx.(string)
+}
+
+func TestGetSubject(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Equal("", GetSubject(context.Background()))
+
+	RegisterSecurityModule(&authtest.TestSecurityModule{})
+	ctx, _ := WithAuthContext(context.Background(), "testat")
+	assert.Equal("", GetSubject(ctx))
+
+	RegisterSecurityModule(&testSubjectSecurityModule{})
+	assert.Equal("", GetSubject(context.Background()))
+	ctx, _ = WithAuthContext(context.Background(), "testat")
+	assert.Equal("user-verified", GetSubject(ctx))
+
+	RegisterSecurityModule(nil)
+	ctx, _ = WithPrincipal(context.Background(), "signer1")
+	assert.Equal("signer1", GetSubject(ctx))
+}
+
+type testSponsorshipSecurityModule struct {
+	authtest.TestSecurityModule
+}
+
+func (sm *testSponsorshipSecurityModule) AuthSponsorship(authCtx interface{}, sponsor string) error {
+	if sponsor == "gas1" {
+		return nil
+	}
+	return fmt.Errorf("badness")
+}
+
+func TestAuthSponsorship(t *testing.T) {
+	assert := assert.New(t)
+
+	hasPolicy, err := AuthSponsorship(context.Background(), "gas1")
+	assert.False(hasPolicy)
+	assert.NoError(err)
+
+	RegisterSecurityModule(&authtest.TestSecurityModule{})
+	ctx, _ := WithAuthContext(context.Background(), "testat")
+	hasPolicy, _ = AuthSponsorship(ctx, "gas1")
+	assert.False(hasPolicy)
+
+	RegisterSecurityModule(&testSponsorshipSecurityModule{})
+	hasPolicy, err = AuthSponsorship(context.Background(), "gas1")
+	assert.True(hasPolicy)
+	assert.EqualError(err, "No auth context")
+	hasPolicy, err = AuthSponsorship(NewSystemAuthContext(), "gas2")
+	assert.True(hasPolicy)
+	assert.NoError(err)
+	ctx, _ = WithAuthContext(context.Background(), "testat")
+	hasPolicy, err = AuthSponsorship(ctx, "gas1")
+	assert.True(hasPolicy)
+	assert.NoError(err)
+	_, err = AuthSponsorship(ctx, "gas2")
+	assert.EqualError(err, "badness")
+
+	RegisterSecurityModule(nil)
+}
+
+type testAliasesSecurityModule struct {
+	authtest.TestSecurityModule
+}
+
+func (sm *testAliasesSecurityModule) AuthAlias(authCtx interface{}, alias string) error {
+	if alias == "treasury-ops" {
+		return nil
+	}
+	return fmt.Errorf("badness")
+}
+
+func TestAuthAlias(t *testing.T) {
+	assert := assert.New(t)
+
+	hasPolicy, err := AuthAlias(context.Background(), "treasury-ops")
+	assert.False(hasPolicy)
+	assert.NoError(err)
+
+	RegisterSecurityModule(&testAliasesSecurityModule{})
+	hasPolicy, err = AuthAlias(context.Background(), "treasury-ops")
+	assert.True(hasPolicy)
+	assert.EqualError(err, "No auth context")
+	hasPolicy, err = AuthAlias(NewSystemAuthContext(), "payroll")
+	assert.True(hasPolicy)
+	assert.NoError(err)
+	ctx, _ := WithAuthContext(context.Background(), "testat")
+	hasPolicy, err = AuthAlias(ctx, "treasury-ops")
+	assert.True(hasPolicy)
+	assert.NoError(err)
+	_, err = AuthAlias(ctx, "payroll")
+	assert.EqualError(err, "badness")
+
+	RegisterSecurityModule(nil)
+}
+
+type testAdminSecurityModule struct {
+	authtest.TestSecurityModule
+}
+
+func (sm *testAdminSecurityModule) AuthAdmin(authCtx interface{}, operation string, args ...interface{}) error {
+	if operation == "leveldb.backup" && len(args) == 1 && args[0] == "receipts" {
+		return nil
+	}
+	return fmt.Errorf("badness")
+}
+
+func TestAuthAdmin(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.NoError(AuthAdmin(context.Background(), "leveldb.backup", "receipts"))
+
+	RegisterSecurityModule(&authtest.TestSecurityModule{})
+	ctx, _ := WithAuthContext(context.Background(), "testat")
+	err := AuthAdmin(ctx, "leveldb.backup", "receipts")
+	assert.EqualError(err, "The security module does not authorize administrative operations such as 'leveldb.backup'")
+	assert.NoError(AuthAdmin(NewSystemAuthContext(), "leveldb.backup", "receipts"))
+
+	RegisterSecurityModule(&testAdminSecurityModule{})
+	err = AuthAdmin(context.Background(), "leveldb.backup", "receipts")
+	assert.EqualError(err, "No auth context")
+	ctx, _ = WithAuthContext(context.Background(), "testat")
+	assert.NoError(AuthAdmin(ctx, "leveldb.backup", "receipts"))
+	err = AuthAdmin(ctx, "leveldb.backup", "eventstreams")
+	assert.EqualError(err, "badness")
+
+	RegisterSecurityModule(nil)
+}
+
+type testPrincipalSecurityModule struct {
+	authtest.TestSecurityModule
+}
+
+func (sm *testPrincipalSecurityModule) VerifyPrincipal(principal string) (interface{}, error) {
+	if principal == "machine1" {
+		return "verified-" + principal, nil
+	}
+	return nil, fmt.Errorf("badness")
+}
+
+func TestWithPrincipal(t *testing.T) {
+	assert := assert.New(t)
+
+	ctx, err := WithPrincipal(context.Background(), "machine1")
+	assert.NoError(err)
+	assert.Equal("machine1", GetPrincipal(ctx))
+	assert.Nil(GetAuthContext(ctx))
+	assert.Equal("", GetPrincipal(context.Background()))
+
+	RegisterSecurityModule(&authtest.TestSecurityModule{})
+	_, err = WithPrincipal(context.Background(), "machine1")
+	assert.EqualError(err, "The security module does not support authenticating principals other than by token")
+
+	RegisterSecurityModule(&testPrincipalSecurityModule{})
+	ctx, err = WithPrincipal(context.Background(), "machine1")
+	assert.NoError(err)
+	assert.Equal("verified-machine1", GetAuthContext(ctx))
+	assert.Equal("", GetAccessToken(ctx))
+	_, err = WithPrincipal(context.Background(), "machine2")
+	assert.EqualError(err, "badness")
+
+	RegisterSecurityModule(nil)
+}
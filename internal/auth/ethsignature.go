@@ -0,0 +1,267 @@
+// Copyright 2021 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package auth
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/btcsuite/btcd/btcec"
+	"github.com/kaleido-io/ethconnect/internal/errors"
+	"github.com/kaleido-io/ethconnect/internal/ethbind"
+)
+
+const (
+	// EthSignatureAuthScheme is the scheme of the Authorization header of a signed request, which
+	// has the form "EIP191 timestamp=<unix seconds>,signature=<0x hex signature>"
+	EthSignatureAuthScheme = "EIP191"
+	// DefaultEthSignatureMaxSkew is the default number of seconds the timestamp of a signed
+	// request can differ from the current time
+	DefaultEthSignatureMaxSkew = 300
+	// DefaultEthSignatureMaxBodyBytes is the default limit on the size of the body of a signed
+	// request, which is read to compute the digest before the caller is authenticated
+	DefaultEthSignatureMaxBodyBytes = 1024 * 1024
+)
+
+// EthSignatureAuthConf configures authentication of requests by an EIP-191 signature over
+// a digest of the request. Principals maps each signing address to the name of a principal
+type EthSignatureAuthConf struct {
+	Enabled       bool              `json:"enabled"`
+	Required      bool              `json:"required,omitempty"`
+	MaxSkewSec    int               `json:"maxSkew,omitempty"`
+	MaxBodyBytes  int64             `json:"maxBodyBytes,omitempty"`
+	AllowUnmapped bool              `json:"allowUnmapped,omitempty"`
+	Principals    map[string]string `json:"principals,omitempty"`
+}
+
+// EthSignatureVerifier authenticates signed requests, rejecting any signature it has already
+// accepted while the timestamp of the request is still inside the allowed skew
+type EthSignatureVerifier struct {
+	conf       *EthSignatureAuthConf
+	maxSkew    time.Duration
+	maxBody    int64
+	principals map[string]string
+	seenLock   sync.Mutex
+	seen       map[string]time.Time
+}
+
+// NewEthSignatureVerifier validates the configured principals and returns a verifier
+func NewEthSignatureVerifier(conf *EthSignatureAuthConf) (*EthSignatureVerifier, error) {
+	v := &EthSignatureVerifier{
+		conf:       conf,
+		maxSkew:    time.Duration(conf.MaxSkewSec) * time.Second,
+		maxBody:    conf.MaxBodyBytes,
+		principals: make(map[string]string),
+		seen:       make(map[string]time.Time),
+	}
+	if v.maxSkew <= 0 {
+		v.maxSkew = DefaultEthSignatureMaxSkew * time.Second
+	}
+	if v.maxBody <= 0 {
+		v.maxBody = DefaultEthSignatureMaxBodyBytes
+	}
+	for addr, principal := range conf.Principals {
+		if !ethbind.API.IsHexAddress(addr) || principal == "" {
+			return nil, errors.Errorf(errors.EthSignatureAuthBadPrincipal, addr, principal)
+		}
+		v.principals[strings.ToLower(ethbind.API.HexToAddress(addr).Hex())] = principal
+	}
+	return v, nil
+}
+
+// Required returns true if requests without a signature must be rejected
+func (v *EthSignatureVerifier) Required() bool {
+	return v.conf.Required
+}
+
+// IsSignedRequest returns true if the request has an EIP191 authorization header
+func IsSignedRequest(req *http.Request) bool {
+	hSplit := strings.SplitN(req.Header.Get("Authorization"), " ", 2)
+	return len(hSplit) == 2 && strings.EqualFold(hSplit[0], EthSignatureAuthScheme)
+}
+
+// EthSignatureRequestDigest is the digest of a request that is signed. It is the Keccak-256 hash
+// of the method, escaped path, sorted query string, timestamp and hex Keccak-256 hash of the body,
+// separated by newlines. The digest is signed as an EIP-191 personal message, as with eth_sign
+func EthSignatureRequestDigest(req *http.Request, timestamp string, body []byte) []byte {
+	canonical := strings.Join([]string{
+		strings.ToUpper(req.Method),
+		req.URL.EscapedPath(),
+		req.URL.Query().Encode(),
+		timestamp,
+		hex.EncodeToString(ethbind.Keccak256(body)),
+	}, "\n")
+	return ethbind.Keccak256([]byte(canonical))
+}
+
+// ethSignedMessageHash is the EIP-191 (version 0x45) hash of a message
+func ethSignedMessageHash(message []byte) []byte {
+	return ethbind.Keccak256([]byte(fmt.Sprintf("\x19Ethereum Signed Message:\n%d", len(message))), message)
+}
+
+// Verify checks the signature of a request, and returns the principal of the signing address.
+// The body is read to compute the digest, and replaced so it can still be read by the handler
+func (v *EthSignatureVerifier) Verify(req *http.Request) (string, error) {
+	timestamp, sig, err := parseEthSignatureHeader(req.Header.Get("Authorization"))
+	if err != nil {
+		return "", err
+	}
+	ts, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return "", errors.Errorf(errors.EthSignatureAuthBadHeader, "timestamp must be in seconds since the epoch")
+	}
+	signedAt := time.Unix(ts, 0)
+	if skew := time.Since(signedAt); skew > v.maxSkew || skew < -v.maxSkew {
+		return "", errors.Errorf(errors.EthSignatureAuthExpired, int(v.maxSkew.Seconds()))
+	}
+
+	var body []byte
+	if req.Body != nil {
+		// The caller is not yet authenticated, so only read one byte more than the limit
+		if body, err = ioutil.ReadAll(io.LimitReader(req.Body, v.maxBody+1)); err != nil {
+			return "", err
+		}
+		if int64(len(body)) > v.maxBody {
+			return "", errors.Errorf(errors.EthSignatureAuthBodyTooLarge, v.maxBody)
+		}
+		req.Body.Close()
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+	address, err := recoverAddress(ethSignedMessageHash(EthSignatureRequestDigest(req, timestamp, body)), sig)
+	if err != nil {
+		return "", err
+	}
+	principal, ok := v.principals[address]
+	if !ok {
+		if !v.conf.AllowUnmapped {
+			return "", errors.Errorf(errors.EthSignatureAuthUnknownAddress, address)
+		}
+		principal = address
+	}
+	// The replay cache is keyed on R || S, as the recovery ID can be sent as 0/1 or 27/28.
+	// Only the lower S value is accepted, so there is no other encoding of the same signature
+	if err := v.checkReplay(hex.EncodeToString(sig[0:64]), signedAt.Add(v.maxSkew)); err != nil {
+		return "", err
+	}
+	return principal, nil
+}
+
+// SignRequest adds an EIP191 authorization header to a request, signing it with a key as of a
+// time. It is the client side of signature authentication. The body is read and replaced.
+// Signatures are deterministic (RFC 6979), so the same request signed as of the same second
+// is rejected as a replay
+func SignRequest(req *http.Request, key *ecdsa.PrivateKey, signedAt time.Time) error {
+	var body []byte
+	if req.Body != nil {
+		var err error
+		if body, err = ioutil.ReadAll(req.Body); err != nil {
+			return err
+		}
+		req.Body.Close()
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+	timestamp := strconv.FormatInt(signedAt.Unix(), 10)
+	hash := ethSignedMessageHash(EthSignatureRequestDigest(req, timestamp, body))
+	// The compact signature is [V || R || S] with V as 27/28, and always has the lower S value
+	privKey, _ := btcec.PrivKeyFromBytes(btcec.S256(), ethbind.API.FromECDSA(key))
+	compact, err := btcec.SignCompact(btcec.S256(), privKey, hash, false)
+	if err != nil {
+		return errors.Errorf(errors.EthSignatureAuthInvalidSignature, err)
+	}
+	sig := append(compact[1:65], compact[0])
+	req.Header.Set("Authorization", fmt.Sprintf("%s timestamp=%s,signature=0x%x", EthSignatureAuthScheme, timestamp, sig))
+	return nil
+}
+
+// checkReplay records a signature until it expires, and fails if it was already recorded
+func (v *EthSignatureVerifier) checkReplay(sig string, expiry time.Time) error {
+	v.seenLock.Lock()
+	defer v.seenLock.Unlock()
+	now := time.Now()
+	for s, e := range v.seen {
+		if now.After(e) {
+			delete(v.seen, s)
+		}
+	}
+	if _, exists := v.seen[sig]; exists {
+		return errors.Errorf(errors.EthSignatureAuthReplayed)
+	}
+	v.seen[sig] = expiry
+	return nil
+}
+
+func parseEthSignatureHeader(header string) (timestamp string, sig []byte, err error) {
+	hSplit := strings.SplitN(header, " ", 2)
+	if len(hSplit) != 2 || !strings.EqualFold(hSplit[0], EthSignatureAuthScheme) {
+		return "", nil, errors.Errorf(errors.EthSignatureAuthBadHeader, "missing scheme")
+	}
+	for _, param := range strings.Split(hSplit[1], ",") {
+		kv := strings.SplitN(strings.TrimSpace(param), "=", 2)
+		if len(kv) != 2 {
+			return "", nil, errors.Errorf(errors.EthSignatureAuthBadHeader, param)
+		}
+		switch kv[0] {
+		case "timestamp":
+			timestamp = kv[1]
+		case "signature":
+			if sig, err = hex.DecodeString(strings.TrimPrefix(kv[1], "0x")); err != nil {
+				return "", nil, errors.Errorf(errors.EthSignatureAuthBadHeader, "signature must be hex")
+			}
+		}
+	}
+	if timestamp == "" || sig == nil {
+		return "", nil, errors.Errorf(errors.EthSignatureAuthBadHeader, "timestamp and signature are required")
+	}
+	return timestamp, sig, nil
+}
+
+// recoverAddress recovers the address of the key that produced a 65 byte [R || S || V]
+// signature of a hash, where V is 0/1 or 27/28
+func recoverAddress(hash, sig []byte) (string, error) {
+	if len(sig) != 65 {
+		return "", errors.Errorf(errors.EthSignatureAuthInvalidSignature, "must be 65 bytes")
+	}
+	recID := sig[64]
+	if recID >= 27 {
+		recID -= 27
+	}
+	// Ethereum only accepts the lower of the two valid S values (EIP-2)
+	n := btcec.S256().N
+	r := new(big.Int).SetBytes(sig[0:32])
+	s := new(big.Int).SetBytes(sig[32:64])
+	if recID > 1 || r.Sign() == 0 || s.Sign() == 0 || r.Cmp(n) >= 0 || s.Cmp(new(big.Int).Rsh(n, 1)) > 0 {
+		return "", errors.Errorf(errors.EthSignatureAuthInvalidSignature, "out of range")
+	}
+	// Recovery is the same as SigToPub in go-ethereum, which takes the signature as [V || R || S]
+	compact := make([]byte, 65)
+	compact[0] = recID + 27
+	copy(compact[1:], sig[0:64])
+	pub, _, err := btcec.RecoverCompact(btcec.S256(), compact, hash)
+	if err != nil {
+		return "", errors.Errorf(errors.EthSignatureAuthInvalidSignature, err)
+	}
+	address := ethbind.API.PubkeyToAddress(*pub.ToECDSA())
+	return strings.ToLower(address.Hex()), nil
+}
@@ -0,0 +1,148 @@
+// Copyright 2021 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package auth
+
+import (
+	"crypto/ecdsa"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kaleido-io/ethconnect/internal/ethbind"
+	"github.com/stretchr/testify/assert"
+)
+
+func signTestRequest(t *testing.T, key *ecdsa.PrivateKey, req *http.Request, signedAt time.Time) string {
+	assert.NoError(t, SignRequest(req, key, signedAt))
+	return req.Header.Get("Authorization")
+}
+
+func newTestSignedRequest(body string) *http.Request {
+	return httptest.NewRequest(http.MethodPost, "/contracts/token/transfer?fly-sync=true&fly-from=0x12", strings.NewReader(body))
+}
+
+func TestEthSignatureVerify(t *testing.T) {
+	assert := assert.New(t)
+	key, _ := ethbind.API.GenerateKey()
+	address := ethbind.API.PubkeyToAddress(key.PublicKey).Hex()
+
+	v, err := NewEthSignatureVerifier(&EthSignatureAuthConf{
+		Principals: map[string]string{address: "machine1"},
+	})
+	assert.NoError(err)
+	assert.False(v.Required())
+
+	req := newTestSignedRequest(`{"amount":10}`)
+	assert.False(IsSignedRequest(req))
+	signTestRequest(t, key, req, time.Now())
+	assert.True(IsSignedRequest(req))
+	principal, err := v.Verify(req)
+	assert.NoError(err)
+	assert.Equal("machine1", principal)
+	body, _ := ioutil.ReadAll(req.Body)
+	assert.Equal(`{"amount":10}`, string(body))
+
+	// The same signature cannot be used twice
+	req = newTestSignedRequest(`{"amount":10}`)
+	req.Header.Set("Authorization", signTestRequestHeader(t, key, time.Now().Add(-1*time.Second)))
+	_, err = v.Verify(req)
+	assert.NoError(err)
+	_, err = v.Verify(req)
+	assert.EqualError(err, "The signed request has already been received")
+
+	// Nor can it be replayed with the recovery ID encoded as 0/1 rather than 27/28
+	req = newTestSignedRequest(`{"amount":10}`)
+	header := signTestRequestHeader(t, key, time.Now().Add(-2*time.Second))
+	req.Header.Set("Authorization", header)
+	_, err = v.Verify(req)
+	assert.NoError(err)
+	recID, _ := strconv.ParseUint(header[len(header)-2:], 16, 8)
+	req = newTestSignedRequest(`{"amount":10}`)
+	req.Header.Set("Authorization", fmt.Sprintf("%s%02x", header[:len(header)-2], recID-27))
+	_, err = v.Verify(req)
+	assert.EqualError(err, "The signed request has already been received")
+
+	// A change to the body, query or path is signed by a different address
+	req = newTestSignedRequest(`{"amount":10}`)
+	signTestRequest(t, key, req, time.Now())
+	req.Body = ioutil.NopCloser(strings.NewReader(`{"amount":1000}`))
+	_, err = v.Verify(req)
+	assert.Regexp("is not mapped to a principal", err)
+	req = newTestSignedRequest("")
+	signTestRequest(t, key, req, time.Now())
+	req.URL.RawQuery = "fly-sync=false"
+	_, err = v.Verify(req)
+	assert.Regexp("is not mapped to a principal", err)
+
+	// Unmapped addresses can be allowed, with the address as the principal
+	v, _ = NewEthSignatureVerifier(&EthSignatureAuthConf{AllowUnmapped: true})
+	req = newTestSignedRequest("")
+	signTestRequest(t, key, req, time.Now())
+	principal, err = v.Verify(req)
+	assert.NoError(err)
+	assert.Equal(strings.ToLower(address), principal)
+}
+
+func signTestRequestHeader(t *testing.T, key *ecdsa.PrivateKey, signedAt time.Time) string {
+	return signTestRequest(t, key, newTestSignedRequest(`{"amount":10}`), signedAt)
+}
+
+func TestEthSignatureVerifyErrors(t *testing.T) {
+	assert := assert.New(t)
+	key, _ := ethbind.API.GenerateKey()
+
+	_, err := NewEthSignatureVerifier(&EthSignatureAuthConf{Principals: map[string]string{"bad": "machine1"}})
+	assert.EqualError(err, "Invalid address 'bad' for principal 'machine1' of signature authentication")
+
+	v, _ := NewEthSignatureVerifier(&EthSignatureAuthConf{MaxSkewSec: 60})
+	verify := func(header string) error {
+		req := newTestSignedRequest("")
+		req.Header.Set("Authorization", header)
+		_, err := v.Verify(req)
+		return err
+	}
+	assert.Regexp("missing scheme", verify("Bearer abc"))
+	assert.Regexp("Invalid EIP191 authorization header: abc", verify("EIP191 abc"))
+	assert.Regexp("timestamp and signature are required", verify("EIP191 timestamp=12345"))
+	assert.Regexp("signature must be hex", verify("EIP191 timestamp=12345,signature=zz"))
+	assert.Regexp("timestamp must be in seconds", verify("EIP191 timestamp=now,signature=0x00"))
+	assert.Regexp("more than 60 seconds from the current time", verify(signTestRequestHeader(t, key, time.Now().Add(-2*time.Minute))))
+	assert.Regexp("more than 60 seconds from the current time", verify(signTestRequestHeader(t, key, time.Now().Add(2*time.Minute))))
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+	assert.Regexp("must be 65 bytes", verify("EIP191 timestamp="+now+",signature=0x00"))
+	assert.Regexp("out of range", verify("EIP191 timestamp="+now+",signature=0x"+strings.Repeat("00", 65)))
+	assert.Regexp("not mapped to a principal", verify(signTestRequestHeader(t, key, time.Now())))
+
+	// The body is limited in size, as it is read before the caller is authenticated
+	v, _ = NewEthSignatureVerifier(&EthSignatureAuthConf{MaxBodyBytes: 5})
+	req := newTestSignedRequest(`{"amount":10}`)
+	signTestRequest(t, key, req, time.Now())
+	_, err = v.Verify(req)
+	assert.EqualError(err, "The body of the signed request is larger than the limit of 5 bytes")
+}
+
+func TestRecoverAddressNotOnCurve(t *testing.T) {
+	sig := make([]byte, 65)
+	// x = 5 is not the x-coordinate of any point on secp256k1
+	sig[31] = 5
+	sig[63] = 1
+	_, err := recoverAddress(make([]byte, 32), sig)
+	assert.Regexp(t, "Invalid request signature", err)
+}
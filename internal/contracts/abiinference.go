@@ -0,0 +1,418 @@
+// Copyright 2021 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package contracts
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"regexp"
+	"strings"
+	"time"
+
+	ethbinding "github.com/kaleido-io/ethbinding/pkg"
+	ethconnecterrors "github.com/kaleido-io/ethconnect/internal/errors"
+	"github.com/kaleido-io/ethconnect/internal/ethbind"
+	"github.com/kaleido-io/ethconnect/internal/messages"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// inferredABIPrefix is the prefix of the ID of an ABI inferred from bytecode
+	inferredABIPrefix = "inferred-"
+
+	opEQ     = 0x14
+	opPUSH1  = 0x60
+	opPUSH4  = 0x63
+	opPUSH32 = 0x7f
+	opDUP1   = 0x80
+	opDUP16  = 0x8f
+)
+
+// ABIInferenceConf configures deriving a skeleton ABI from the bytecode of contracts
+// that are not registered. The selectors file is a JSON object of 4 byte function
+// selectors, or 32 byte event topics, to text signatures. Inferred contracts are only
+// stored in the registry if Persist is set, otherwise they are inferred on each lookup
+type ABIInferenceConf struct {
+	Enabled       bool   `json:"enabled,omitempty"`
+	SelectorsFile string `json:"selectorsFile,omitempty"`
+	Persist       bool   `json:"persist,omitempty"`
+}
+
+// selectorCheck matches a function selector, which is the method of a raw call to an inferred contract
+var selectorCheck = regexp.MustCompile("^0x[0-9a-f]{8}$")
+
+// guessedWord is a 32 byte word of the output of a raw call, with the type it most likely has
+type guessedWord struct {
+	Type  string `json:"type"`
+	Value string `json:"value"`
+}
+
+type knownSignature struct {
+	signature string
+	outputs   []string
+	view      bool
+	indexed   []bool
+}
+
+// Function signatures of the common token standards, and Ownable. The outputs and mutability
+// are not part of a selector, so are only known for these built-in signatures
+var builtinFunctionSignatures = []*knownSignature{
+	{signature: "name()", outputs: []string{"string"}, view: true},
+	{signature: "symbol()", outputs: []string{"string"}, view: true},
+	{signature: "decimals()", outputs: []string{"uint8"}, view: true},
+	{signature: "totalSupply()", outputs: []string{"uint256"}, view: true},
+	{signature: "balanceOf(address)", outputs: []string{"uint256"}, view: true},
+	{signature: "allowance(address,address)", outputs: []string{"uint256"}, view: true},
+	{signature: "transfer(address,uint256)", outputs: []string{"bool"}},
+	{signature: "approve(address,uint256)", outputs: []string{"bool"}},
+	{signature: "transferFrom(address,address,uint256)", outputs: []string{"bool"}},
+	{signature: "ownerOf(uint256)", outputs: []string{"address"}, view: true},
+	{signature: "getApproved(uint256)", outputs: []string{"address"}, view: true},
+	{signature: "isApprovedForAll(address,address)", outputs: []string{"bool"}, view: true},
+	{signature: "setApprovalForAll(address,bool)"},
+	{signature: "safeTransferFrom(address,address,uint256)"},
+	{signature: "safeTransferFrom(address,address,uint256,bytes)"},
+	{signature: "tokenURI(uint256)", outputs: []string{"string"}, view: true},
+	{signature: "supportsInterface(bytes4)", outputs: []string{"bool"}, view: true},
+	{signature: "owner()", outputs: []string{"address"}, view: true},
+	{signature: "transferOwnership(address)"},
+	{signature: "renounceOwnership()"},
+}
+
+// Event signatures of the common token standards, and Ownable
+var builtinEventSignatures = []*knownSignature{
+	{signature: "Transfer(address,address,uint256)", indexed: []bool{true, true, false}},
+	{signature: "Approval(address,address,uint256)", indexed: []bool{true, true, false}},
+	{signature: "ApprovalForAll(address,address,bool)", indexed: []bool{true, true, false}},
+	{signature: "OwnershipTransferred(address,address)", indexed: []bool{true, true}},
+}
+
+// selectorDictionary maps the selectors found in bytecode to ABI elements
+type selectorDictionary struct {
+	functions map[string]*ethbinding.ABIElementMarshaling
+	events    map[string]*ethbinding.ABIElementMarshaling
+}
+
+func newSelectorDictionary(selectorsFile string) (*selectorDictionary, error) {
+	d := &selectorDictionary{
+		functions: make(map[string]*ethbinding.ABIElementMarshaling),
+		events:    make(map[string]*ethbinding.ABIElementMarshaling),
+	}
+	for _, s := range builtinFunctionSignatures {
+		if err := d.addFunction(s); err != nil {
+			return nil, err
+		}
+	}
+	for _, s := range builtinEventSignatures {
+		if err := d.addEvent(s); err != nil {
+			return nil, err
+		}
+	}
+	if selectorsFile == "" {
+		return d, nil
+	}
+	fileBytes, err := ioutil.ReadFile(selectorsFile)
+	if err != nil {
+		return nil, ethconnecterrors.Errorf(ethconnecterrors.RESTGatewayInferenceSelectorsLoad, selectorsFile, err)
+	}
+	var signatures map[string]string
+	if err := json.Unmarshal(fileBytes, &signatures); err != nil {
+		return nil, ethconnecterrors.Errorf(ethconnecterrors.RESTGatewayInferenceSelectorsLoad, selectorsFile, err)
+	}
+	for selector, signature := range signatures {
+		hash := "0x" + hex.EncodeToString(ethbind.Keccak256([]byte(signature)))
+		selector = strings.ToLower(selector)
+		switch {
+		case len(selector) == 10 && selector == hash[0:10]:
+			if _, exists := d.functions[selector]; !exists {
+				err = d.addFunction(&knownSignature{signature: signature})
+			}
+		case selector == hash:
+			if _, exists := d.events[selector]; !exists {
+				err = d.addEvent(&knownSignature{signature: signature})
+			}
+		default:
+			err = ethconnecterrors.Errorf(ethconnecterrors.RESTGatewayInferenceSelectorMismatch, selector, signature)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	log.Infof("Loaded %d function and %d event signatures for ABI inference", len(d.functions), len(d.events))
+	return d, nil
+}
+
+func (d *selectorDictionary) addFunction(s *knownSignature) error {
+	name, inputs, err := parseSignature(s.signature)
+	if err != nil {
+		return err
+	}
+	outputs := make([]ethbinding.ABIArgumentMarshaling, len(s.outputs))
+	for i, output := range s.outputs {
+		outputs[i] = ethbinding.ABIArgumentMarshaling{Type: output}
+	}
+	element := &ethbinding.ABIElementMarshaling{
+		Type:            "function",
+		Name:            name,
+		Inputs:          inputs,
+		Outputs:         outputs,
+		StateMutability: "nonpayable",
+	}
+	if s.view {
+		element.StateMutability = "view"
+	}
+	if _, err := ethbind.API.ABIElementMarshalingToABIMethod(element); err != nil {
+		return ethconnecterrors.Errorf(ethconnecterrors.RESTGatewayInferenceBadSignature, s.signature)
+	}
+	selector := "0x" + hex.EncodeToString(ethbind.Keccak256([]byte(s.signature))[0:4])
+	d.functions[selector] = element
+	return nil
+}
+
+func (d *selectorDictionary) addEvent(s *knownSignature) error {
+	name, inputs, err := parseSignature(s.signature)
+	if err != nil {
+		return err
+	}
+	for i := range inputs {
+		inputs[i].Indexed = i < len(s.indexed) && s.indexed[i]
+	}
+	element := &ethbinding.ABIElementMarshaling{
+		Type:   "event",
+		Name:   name,
+		Inputs: inputs,
+	}
+	if _, err := ethbind.API.ABIElementMarshalingToABIEvent(element); err != nil {
+		return ethconnecterrors.Errorf(ethconnecterrors.RESTGatewayInferenceBadSignature, s.signature)
+	}
+	topic := "0x" + hex.EncodeToString(ethbind.Keccak256([]byte(s.signature)))
+	d.events[topic] = element
+	return nil
+}
+
+// parseSignature parses a text signature such as "transfer(address,uint256)", where tuples are
+// in parentheses, into the name and the unnamed arguments
+func parseSignature(signature string) (string, []ethbinding.ABIArgumentMarshaling, error) {
+	open := strings.Index(signature, "(")
+	if open <= 0 || !strings.HasSuffix(signature, ")") {
+		return "", nil, ethconnecterrors.Errorf(ethconnecterrors.RESTGatewayInferenceBadSignature, signature)
+	}
+	args, ok := parseSignatureTypes(signature[open+1 : len(signature)-1])
+	if !ok {
+		return "", nil, ethconnecterrors.Errorf(ethconnecterrors.RESTGatewayInferenceBadSignature, signature)
+	}
+	return signature[0:open], args, nil
+}
+
+func parseSignatureTypes(typeList string) ([]ethbinding.ABIArgumentMarshaling, bool) {
+	args := []ethbinding.ABIArgumentMarshaling{}
+	if typeList == "" {
+		return args, true
+	}
+	depth := 0
+	start := 0
+	for i := 0; i <= len(typeList); i++ {
+		switch {
+		case i == len(typeList) || (typeList[i] == ',' && depth == 0):
+			if depth != 0 {
+				return nil, false
+			}
+			arg, ok := parseSignatureType(typeList[start:i])
+			if !ok {
+				return nil, false
+			}
+			args = append(args, arg)
+			start = i + 1
+		case typeList[i] == '(':
+			depth++
+		case typeList[i] == ')':
+			if depth--; depth < 0 {
+				return nil, false
+			}
+		}
+	}
+	return args, true
+}
+
+func parseSignatureType(typeName string) (ethbinding.ABIArgumentMarshaling, bool) {
+	if !strings.HasPrefix(typeName, "(") {
+		return ethbinding.ABIArgumentMarshaling{Type: typeName}, typeName != ""
+	}
+	close := strings.LastIndex(typeName, ")")
+	components, ok := parseSignatureTypes(typeName[1:close])
+	// Tuple components must be named, to be mapped to JSON objects
+	for i := range components {
+		components[i].Name = fmt.Sprintf("field%d", i)
+	}
+	return ethbinding.ABIArgumentMarshaling{
+		Type:       "tuple" + typeName[close+1:],
+		Components: components,
+	}, ok
+}
+
+// scanBytecode walks the opcodes of runtime bytecode, returning the 4 byte values compared by
+// the function dispatcher, and the 32 byte values that might be event topics
+func scanBytecode(code []byte) (selectors, topics []string) {
+	seen := make(map[string]bool)
+	for pc := 0; pc < len(code); pc++ {
+		op := code[pc]
+		if op < opPUSH1 || op > opPUSH32 {
+			continue
+		}
+		size := int(op-opPUSH1) + 1
+		if pc+size >= len(code) {
+			break
+		}
+		value := "0x" + hex.EncodeToString(code[pc+1:pc+1+size])
+		pc += size
+		next := pc + 1
+		switch {
+		case op == opPUSH4:
+			// The dispatcher compares the selector with EQ, sometimes after a DUP
+			if next < len(code) && code[next] >= opDUP1 && code[next] <= opDUP16 {
+				next++
+			}
+			if next < len(code) && code[next] == opEQ && !seen[value] {
+				selectors = append(selectors, value)
+				seen[value] = true
+			}
+		case op == opPUSH32 && !seen[value]:
+			topics = append(topics, value)
+			seen[value] = true
+		}
+	}
+	return selectors, topics
+}
+
+// inferABI builds a skeleton ABI from the selectors and topics in the bytecode that are in the
+// dictionary, returning the selectors of the functions that are not
+func (d *selectorDictionary) inferABI(code []byte) (abi ethbinding.ABIMarshaling, unknownSelectors []string) {
+	selectors, topics := scanBytecode(code)
+	abi = ethbinding.ABIMarshaling{}
+	for _, selector := range selectors {
+		if element, ok := d.functions[selector]; ok {
+			abi = append(abi, *element)
+		} else {
+			unknownSelectors = append(unknownSelectors, selector)
+		}
+	}
+	for _, topic := range topics {
+		if element, ok := d.events[topic]; ok {
+			abi = append(abi, *element)
+		}
+	}
+	return abi, unknownSelectors
+}
+
+// guessWords splits the output of a raw call into 32 byte words, and guesses the type of each.
+// A word with 12 leading zero bytes that does not fit in 64 bits is most likely an address, a
+// word with 16 leading 0xff bytes a negative integer, and anything else an unsigned integer.
+// Output that is not a whole number of words is not decoded
+func guessWords(output []byte) []*guessedWord {
+	words := []*guessedWord{}
+	if len(output)%32 != 0 {
+		return words
+	}
+	for i := 0; i < len(output); i += 32 {
+		word := output[i : i+32]
+		switch {
+		case bytes.Count(word[0:12], []byte{0}) == 12 && bytes.Count(word[12:24], []byte{0}) < 12:
+			words = append(words, &guessedWord{Type: "address", Value: "0x" + hex.EncodeToString(word[12:])})
+		case bytes.Count(word[0:16], []byte{0xff}) == 16:
+			v := new(big.Int).SetBytes(word)
+			v.Sub(v, new(big.Int).Lsh(big.NewInt(1), 256))
+			words = append(words, &guessedWord{Type: "int256", Value: v.String()})
+		default:
+			words = append(words, &guessedWord{Type: "uint256", Value: new(big.Int).SetBytes(word).String()})
+		}
+	}
+	return words
+}
+
+// isInferredABI is true for the ABI of a contract that was inferred from its bytecode
+func isInferredABI(deployMsg *messages.DeployContract) bool {
+	return strings.HasPrefix(deployMsg.Headers.ID, inferredABIPrefix)
+}
+
+// loadOrInferDeployMsgForInstance loads the ABI registered for a contract instance. If there is none,
+// and ABI inference is enabled, a skeleton ABI is inferred from the bytecode at the address. It is
+// only stored as an unverified contract instance if inference is configured to persist
+func (g *smartContractGW) loadOrInferDeployMsgForInstance(ctx context.Context, addrHex string) (*messages.DeployContract, *contractInfo, error) {
+	deployMsg, info, err := g.loadDeployMsgForInstance(addrHex)
+	if err == nil || g.selectors == nil || !addrCheck.MatchString(strings.ToLower(addrHex)) {
+		return deployMsg, info, err
+	}
+	return g.inferContract(ctx, strings.TrimPrefix(strings.ToLower(addrHex), "0x"), g.conf.ABIInference.Persist)
+}
+
+// inferContract builds a skeleton ABI for the contract at an address, and stores it along with an
+// unverified contract instance if persist is set
+func (g *smartContractGW) inferContract(ctx context.Context, addrHexNo0x string, persist bool) (*messages.DeployContract, *contractInfo, error) {
+	var codeHex string
+	if err := g.rpc.CallContext(ctx, &codeHex, "eth_getCode", "0x"+addrHexNo0x, "latest"); err != nil {
+		return nil, nil, ethconnecterrors.Errorf(ethconnecterrors.RESTGatewayInferenceGetCode, addrHexNo0x, err)
+	}
+	code, err := ethbind.API.HexDecode(codeHex)
+	if err != nil {
+		return nil, nil, ethconnecterrors.Errorf(ethconnecterrors.RESTGatewayInferenceGetCode, addrHexNo0x, err)
+	}
+	if len(code) == 0 {
+		return nil, nil, ethconnecterrors.Errorf(ethconnecterrors.RESTGatewayInferenceNoCode, addrHexNo0x)
+	}
+
+	abi, unknownSelectors := g.selectors.inferABI(code)
+	details := "UNVERIFIED: ABI inferred from the contract bytecode. Functions and events are matched by selector, and may not be accurate"
+	if len(unknownSelectors) > 0 {
+		details += fmt.Sprintf(". Unrecognized function selectors, which can be called as methods with raw call data: %s", strings.Join(unknownSelectors, ","))
+	}
+	devDoc, _ := json.Marshal(map[string]string{"details": details})
+	abiID := inferredABIPrefix + addrHexNo0x
+	deployMsg := &messages.DeployContract{
+		ABI:          abi,
+		DevDoc:       string(devDoc),
+		ContractName: "Unverified_" + addrHexNo0x,
+		Description:  details,
+	}
+	deployMsg.Headers.ID = abiID
+	deployMsg.Headers.MsgType = messages.MsgTypeDeployContract
+	log.Infof("Inferred ABI for 0x%s with %d elements (%d unrecognized selectors)", addrHexNo0x, len(abi), len(unknownSelectors))
+
+	info := &contractInfo{
+		Address:    addrHexNo0x,
+		ABI:        abiID,
+		Path:       "/contracts/" + addrHexNo0x,
+		SwaggerURL: g.conf.BaseURL + "/contracts/" + addrHexNo0x + "?swagger",
+		Unverified: true,
+		TimeSorted: messages.TimeSorted{
+			CreatedISO8601: time.Now().UTC().Format(time.RFC3339),
+		},
+	}
+	if !persist {
+		return deployMsg, info, nil
+	}
+	if err := g.writeAbiInfo(abiID, deployMsg); err != nil {
+		return nil, nil, err
+	}
+	g.addToABIIndex(abiID, deployMsg, time.Now().UTC())
+	if err := g.storeContractInfo(info); err != nil {
+		return nil, nil, err
+	}
+	return deployMsg, info, nil
+}
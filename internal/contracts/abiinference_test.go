@@ -0,0 +1,358 @@
+// Copyright 2021 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package contracts
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http/httptest"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/go-openapi/spec"
+	"github.com/julienschmidt/httprouter"
+	"github.com/kaleido-io/ethconnect/internal/eth"
+	"github.com/kaleido-io/ethconnect/internal/ethbind"
+	"github.com/kaleido-io/ethconnect/internal/messages"
+	"github.com/kaleido-io/ethconnect/internal/tx"
+	"github.com/stretchr/testify/assert"
+)
+
+const testTransferTopic = "ddf252ad1be2c89b69c2b068fc378daa952ba7f163c4a11628f55a4df523b3ef"
+
+// testDispatcherBytecode is a function dispatcher comparing the selector for transfer,
+// an unknown selector and balanceOf, with a binary search split (GT) that is not a
+// selector, followed by a log of the Transfer event topic, and an unknown 32 byte constant
+func testDispatcherBytecode() []byte {
+	code := "60e01c" + // PUSH1 0xe0 SHR
+		"80" + "63a9059cbb" + "14" + "610100" + "57" + // DUP1 PUSH4 transfer EQ PUSH2 JUMPI
+		"80" + "6312345678" + "14" + "610200" + "57" + // DUP1 PUSH4 unknown EQ PUSH2 JUMPI
+		"6370a08231" + "81" + "14" + "610300" + "57" + // PUSH4 balanceOf DUP2 EQ PUSH2 JUMPI
+		"6380000000" + "11" + // PUSH4 GT
+		"7f" + testTransferTopic + "a3" + // PUSH32 topic LOG3
+		"7f" + strings.Repeat("ab", 32) + // PUSH32 constant
+		"6312" // truncated PUSH4
+	b, _ := hex.DecodeString(code)
+	return b
+}
+
+func TestInferABIFromBytecode(t *testing.T) {
+	assert := assert.New(t)
+	d, err := newSelectorDictionary("")
+	assert.NoError(err)
+
+	abi, unknown := d.inferABI(testDispatcherBytecode())
+	assert.Equal([]string{"0x12345678"}, unknown)
+	assert.Equal(3, len(abi))
+	assert.Equal("transfer", abi[0].Name)
+	assert.Equal("nonpayable", abi[0].StateMutability)
+	assert.Equal("bool", abi[0].Outputs[0].Type)
+	assert.Equal("balanceOf", abi[1].Name)
+	assert.Equal("view", abi[1].StateMutability)
+	assert.Equal("address", abi[1].Inputs[0].Type)
+	assert.Equal("event", abi[2].Type)
+	assert.Equal("Transfer", abi[2].Name)
+	assert.True(abi[2].Inputs[0].Indexed)
+	assert.False(abi[2].Inputs[2].Indexed)
+
+	_, err = ethbind.API.ABIMarshalingToABIRuntime(abi)
+	assert.NoError(err)
+}
+
+func TestSelectorDictionaryFile(t *testing.T) {
+	assert := assert.New(t)
+	dir := tempdir()
+	defer cleanup(dir)
+
+	setSig := "set((uint256,string)[],bytes32)"
+	setSelector := "0x" + hex.EncodeToString(ethbind.Keccak256([]byte(setSig))[0:4])
+	eventSig := "Changed(uint256)"
+	eventTopic := "0x" + hex.EncodeToString(ethbind.Keccak256([]byte(eventSig)))
+	selectorsFile := path.Join(dir, "selectors.json")
+	ioutil.WriteFile(selectorsFile, []byte(fmt.Sprintf(`{
+		"0xA9059CBB": "transfer(address,uint256)",
+		"%s": "%s",
+		"%s": "%s"
+	}`, setSelector, setSig, eventTopic, eventSig)), 0644)
+
+	d, err := newSelectorDictionary(selectorsFile)
+	assert.NoError(err)
+	// Built-in signatures are not replaced
+	assert.Equal("bool", d.functions["0xa9059cbb"].Outputs[0].Type)
+	set := d.functions[setSelector]
+	assert.Equal("set", set.Name)
+	assert.Equal("tuple[]", set.Inputs[0].Type)
+	assert.Equal("field1", set.Inputs[0].Components[1].Name)
+	assert.Equal("string", set.Inputs[0].Components[1].Type)
+	assert.Equal("bytes32", set.Inputs[1].Type)
+	assert.Equal("Changed", d.events[eventTopic].Name)
+}
+
+func TestSelectorDictionaryFileErrors(t *testing.T) {
+	assert := assert.New(t)
+	dir := tempdir()
+	defer cleanup(dir)
+	selectorsFile := path.Join(dir, "selectors.json")
+
+	_, err := newSelectorDictionary(selectorsFile)
+	assert.Regexp("Failed to load selector dictionary", err)
+
+	ioutil.WriteFile(selectorsFile, []byte(`!json`), 0644)
+	_, err = newSelectorDictionary(selectorsFile)
+	assert.Regexp("Failed to load selector dictionary", err)
+
+	ioutil.WriteFile(selectorsFile, []byte(`{"0x12345678": "transfer(address,uint256)"}`), 0644)
+	_, err = newSelectorDictionary(selectorsFile)
+	assert.EqualError(err, "Selector 0x12345678 in selector dictionary does not match signature 'transfer(address,uint256)'")
+
+	badSig := "broken(foo)"
+	badSelector := "0x" + hex.EncodeToString(ethbind.Keccak256([]byte(badSig))[0:4])
+	ioutil.WriteFile(selectorsFile, []byte(fmt.Sprintf(`{"%s": "%s"}`, badSelector, badSig)), 0644)
+	_, err = newSelectorDictionary(selectorsFile)
+	assert.EqualError(err, "Invalid signature 'broken(foo)' in selector dictionary")
+
+	badSig = "Broken(foo)"
+	badTopic := "0x" + hex.EncodeToString(ethbind.Keccak256([]byte(badSig)))
+	ioutil.WriteFile(selectorsFile, []byte(fmt.Sprintf(`{"%s": "%s"}`, badTopic, badSig)), 0644)
+	_, err = newSelectorDictionary(selectorsFile)
+	assert.EqualError(err, "Invalid signature 'Broken(foo)' in selector dictionary")
+}
+
+func TestParseSignatureErrors(t *testing.T) {
+	assert := assert.New(t)
+	for _, sig := range []string{"noparens", "(uint256)", "f(uint256", "f(uint256))", "f((uint256)", "f(uint256,)", "f(,uint256)", "g(())x"} {
+		_, _, err := parseSignature(sig)
+		assert.Regexp("Invalid signature", err, sig)
+	}
+	name, args, err := parseSignature("f()")
+	assert.NoError(err)
+	assert.Equal("f", name)
+	assert.Empty(args)
+}
+
+func newTestInferenceGateway(t *testing.T, dir string, code string, rpcErr error, persist bool) (*smartContractGW, *httprouter.Router) {
+	rpc := eth.NewMockRPCClientForSync(rpcErr, func(method string, res interface{}, args ...interface{}) {
+		switch method {
+		case "eth_getCode":
+			*(res.(*string)) = code
+		case "eth_call":
+			*(res.(*string)) = "0x00000000000000000000000000000000000000000000000000000000000003e8"
+		}
+	})
+	receipt := &messages.TransactionReceipt{}
+	receipt.Headers.MsgType = messages.MsgTypeTransactionSuccess
+	processor := &mockProcessor{t: t, reply: receipt}
+	scgw, err := NewSmartContractGateway(
+		&SmartContractGatewayConf{
+			StoragePath:  dir,
+			BaseURL:      "http://localhost/api/v1",
+			ABIInference: ABIInferenceConf{Enabled: true, Persist: persist},
+		},
+		&tx.TxnProcessorConf{},
+		rpc, processor, nil, nil,
+	)
+	assert.NoError(t, err)
+	router := &httprouter.Router{}
+	scgw.AddRoutes(router)
+	return scgw.(*smartContractGW), router
+}
+
+func TestInferContractEndToEnd(t *testing.T) {
+	assert := assert.New(t)
+	dir := tempdir()
+	defer cleanup(dir)
+	_, router := newTestInferenceGateway(t, dir, "0x"+hex.EncodeToString(testDispatcherBytecode()), nil, true)
+	addr := "0123456789abcdef0123456789abcdef01234567"
+
+	req := httptest.NewRequest("GET", "/contracts/0x"+addr, nil)
+	res := httptest.NewRecorder()
+	router.ServeHTTP(res, req)
+	assert.Equal(200, res.Code)
+	var info contractInfo
+	json.NewDecoder(res.Body).Decode(&info)
+	assert.True(info.Unverified)
+	assert.Equal(inferredABIPrefix+addr, info.ABI)
+
+	req = httptest.NewRequest("GET", "/abis/"+info.ABI, nil)
+	res = httptest.NewRecorder()
+	router.ServeHTTP(res, req)
+	assert.Equal(200, res.Code)
+	var abi abiInfo
+	json.NewDecoder(res.Body).Decode(&abi)
+	assert.True(abi.Unverified)
+	assert.Regexp("Unrecognized function selectors, which can be called as methods with raw call data: 0x12345678", abi.Description)
+
+	req = httptest.NewRequest("GET", "/contracts/"+addr+"?swagger", nil)
+	res = httptest.NewRecorder()
+	router.ServeHTTP(res, req)
+	assert.Equal(200, res.Code)
+	var swagger spec.Swagger
+	json.NewDecoder(res.Body).Decode(&swagger)
+	assert.Regexp("^UNVERIFIED", swagger.Info.Description)
+	assert.Contains(swagger.Paths.Paths, "/balanceOf")
+
+	req = httptest.NewRequest("GET", "/contracts/"+addr+"/balanceOf?input=0x0123456789abcdef0123456789abcdef01234567", nil)
+	res = httptest.NewRecorder()
+	router.ServeHTTP(res, req)
+	assert.Equal(200, res.Code)
+	var reply map[string]interface{}
+	json.NewDecoder(res.Body).Decode(&reply)
+	assert.Equal("1000", reply["output"])
+
+	// The inferred contract is stored, so it is indexed again on restart
+	scgw2, _ := newTestInferenceGateway(t, dir, "0x", nil, true)
+	deployMsg, info2, err := scgw2.loadDeployMsgForInstance(addr)
+	assert.NoError(err)
+	assert.True(info2.Unverified)
+	assert.Equal(3, len(deployMsg.ABI))
+	assert.True(scgw2.abiIndex[inferredABIPrefix+addr].(*abiInfo).Unverified)
+}
+
+func TestInferContractNoCode(t *testing.T) {
+	assert := assert.New(t)
+	dir := tempdir()
+	defer cleanup(dir)
+	_, router := newTestInferenceGateway(t, dir, "0x", nil, false)
+
+	req := httptest.NewRequest("GET", "/contracts/0123456789abcdef0123456789abcdef01234567", nil)
+	res := httptest.NewRecorder()
+	router.ServeHTTP(res, req)
+	assert.Equal(404, res.Code)
+	var errBody map[string]interface{}
+	json.NewDecoder(res.Body).Decode(&errBody)
+	assert.Regexp("there is no contract code at the address", errBody["error"])
+
+	// Names that are not addresses are not inferred
+	req = httptest.NewRequest("POST", "/contracts/unknownname/transfer", bytes.NewReader([]byte(`{}`)))
+	res = httptest.NewRecorder()
+	router.ServeHTTP(res, req)
+	assert.Equal(404, res.Code)
+	json.NewDecoder(res.Body).Decode(&errBody)
+	assert.Regexp("Failed to find installed contract address for 'unknownname'", errBody["error"])
+}
+
+func TestInferContractGetCodeErrors(t *testing.T) {
+	assert := assert.New(t)
+	dir := tempdir()
+	defer cleanup(dir)
+
+	scgw, _ := newTestInferenceGateway(t, dir, "", fmt.Errorf("pop"), false)
+	_, _, err := scgw.loadOrInferDeployMsgForInstance(context.Background(), "0123456789abcdef0123456789abcdef01234567")
+	assert.EqualError(err, "Failed to query the contract code at address 0123456789abcdef0123456789abcdef01234567: pop")
+
+	scgw, _ = newTestInferenceGateway(t, dir, "!hex", nil, false)
+	_, _, err = scgw.loadOrInferDeployMsgForInstance(context.Background(), "0123456789abcdef0123456789abcdef01234567")
+	assert.Regexp("Failed to query the contract code", err)
+
+	scgw, _ = newTestInferenceGateway(t, path.Join(dir, "missing"), "0x6000", nil, true)
+	_, _, err = scgw.loadOrInferDeployMsgForInstance(context.Background(), "0123456789abcdef0123456789abcdef01234567")
+	assert.Regexp("Failed to write deployment details", err)
+}
+
+func TestInferContractNotPersistedByDefault(t *testing.T) {
+	assert := assert.New(t)
+	dir := tempdir()
+	defer cleanup(dir)
+	scgw, router := newTestInferenceGateway(t, dir, "0x"+hex.EncodeToString(testDispatcherBytecode()), nil, false)
+	addr := "0123456789abcdef0123456789abcdef01234567"
+
+	req := httptest.NewRequest("GET", "/contracts/"+addr+"/balanceOf?input=0x0123456789abcdef0123456789abcdef01234567", nil)
+	res := httptest.NewRecorder()
+	router.ServeHTTP(res, req)
+	assert.Equal(200, res.Code)
+
+	// A lookup does not write to the registry, unless inference is configured to persist
+	assert.NotContains(scgw.contractIndex, addr)
+	assert.NotContains(scgw.abiIndex, inferredABIPrefix+addr)
+	files, _ := ioutil.ReadDir(dir)
+	assert.Empty(files)
+}
+
+func TestInferContractRawCall(t *testing.T) {
+	assert := assert.New(t)
+	dir := tempdir()
+	defer cleanup(dir)
+	scgw, router := newTestInferenceGateway(t, dir, "0x"+hex.EncodeToString(testDispatcherBytecode()), nil, false)
+	addr := "0123456789abcdef0123456789abcdef01234567"
+
+	req := httptest.NewRequest("GET", "/contracts/"+addr+"/0x12345678?data=0x00000000000000000000000000000000000000000000000000000000000000ff", nil)
+	res := httptest.NewRecorder()
+	router.ServeHTTP(res, req)
+	assert.Equal(200, res.Code)
+	var reply struct {
+		Output string         `json:"output"`
+		Words  []*guessedWord `json:"words"`
+	}
+	json.NewDecoder(res.Body).Decode(&reply)
+	assert.Equal("0x00000000000000000000000000000000000000000000000000000000000003e8", reply.Output)
+	assert.Equal([]*guessedWord{{Type: "uint256", Value: "1000"}}, reply.Words)
+
+	// The arguments must be ABI encoded hex
+	req = httptest.NewRequest("GET", "/contracts/"+addr+"/0x12345678?data=ff", nil)
+	res = httptest.NewRecorder()
+	router.ServeHTTP(res, req)
+	assert.Equal(400, res.Code)
+	var errBody map[string]interface{}
+	json.NewDecoder(res.Body).Decode(&errBody)
+	assert.Regexp("Invalid data for a call to selector 0x12345678", errBody["error"])
+
+	// Selectors that are not in the bytecode are still not methods of a verified ABI
+	req = httptest.NewRequest("POST", "/contracts/"+addr+"/0x12345678", bytes.NewReader([]byte(`{}`)))
+	res = httptest.NewRecorder()
+	router.ServeHTTP(res, req)
+	assert.Equal(400, res.Code)
+	json.NewDecoder(res.Body).Decode(&errBody)
+	assert.Regexp("Please specify a valid address in the 'fly-from' query string parameter or x-firefly-from HTTP header", errBody["error"])
+
+	req = httptest.NewRequest("POST", "/contracts/"+addr+"/0x12345678?fly-from=0x66c5fe653e7a9ebb628a6d40f0452d1e358baee8&fly-sync", bytes.NewReader([]byte(`{"data":"0x01"}`)))
+	res = httptest.NewRecorder()
+	router.ServeHTTP(res, req)
+	assert.Equal(200, res.Code)
+	processor := scgw.r2e.processor.(*mockProcessor)
+	assert.Equal(messages.MsgTypeSendTransaction, processor.headers.MsgType)
+	assert.NoError(processor.unmarshalErr)
+}
+
+func TestGuessWords(t *testing.T) {
+	assert := assert.New(t)
+	output, _ := hex.DecodeString(
+		"0000000000000000000000000123456789abcdef0123456789abcdef01234567" +
+			"fffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffe" +
+			"0000000000000000000000000000000000000000000000000000000000000001")
+	assert.Equal([]*guessedWord{
+		{Type: "address", Value: "0x0123456789abcdef0123456789abcdef01234567"},
+		{Type: "int256", Value: "-2"},
+		{Type: "uint256", Value: "1"},
+	}, guessWords(output))
+	assert.Empty(guessWords(output[0:31]))
+	assert.Empty(guessWords(nil))
+}
+
+func TestNewSmartContractGatewayBadSelectorsFile(t *testing.T) {
+	assert := assert.New(t)
+	_, err := NewSmartContractGateway(
+		&SmartContractGatewayConf{
+			ABIInference: ABIInferenceConf{Enabled: true, SelectorsFile: "/does/not/exist.json"},
+		},
+		&tx.TxnProcessorConf{},
+		nil, nil, nil, nil,
+	)
+	assert.Regexp("Failed to load selector dictionary", err)
+}
@@ -0,0 +1,194 @@
+// Copyright 2021 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package contracts
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/julienschmidt/httprouter"
+	ethconnecterrors "github.com/kaleido-io/ethconnect/internal/errors"
+	"github.com/kaleido-io/ethconnect/internal/eth"
+	"github.com/kaleido-io/ethconnect/internal/messages"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	solidityImportMatcher = regexp.MustCompile(`(?m)^[ \t]*import\s+(?:[^;"']*?\s+from\s+)?["']([^"']+)["'][^;]*;`)
+	soliditySPDXMatcher   = regexp.MustCompile(`(?m)^[ \t]*//[ \t]*SPDX-License-Identifier:.*$`)
+	solidityPragmaMatcher = regexp.MustCompile(`(?m)^[ \t]*pragma\s+[^;]+;`)
+)
+
+// abiSourceInfo is the flattened source and solc metadata of an ABI compiled by the gateway,
+// with the details needed to submit it for verification
+type abiSourceInfo struct {
+	ID              string          `json:"id"`
+	ContractName    string          `json:"contractName"`
+	SourceFile      string          `json:"sourceFile"`
+	CompilerVersion string          `json:"compilerVersion"`
+	FlattenedSource string          `json:"flattenedSource"`
+	Metadata        json.RawMessage `json:"metadata,omitempty"`
+	messages.CompilerOptions
+}
+
+// solidityFlattener combines a Solidity file and everything it imports into a single
+// source, with each file following the files it imports
+type solidityFlattener struct {
+	dir      string
+	visited  map[string]bool
+	pragmas  map[string]bool
+	hasSPDX  bool
+	sections []string
+}
+
+// flattenSolidity flattens the source file of a contract, resolving imports in the same way as
+// solc run in the directory. Import aliases are not supported, as every file is in one scope
+func flattenSolidity(dir, sourceFile string) (string, error) {
+	f := &solidityFlattener{
+		dir:     dir,
+		visited: make(map[string]bool),
+		pragmas: make(map[string]bool),
+	}
+	if err := f.visit(path.Clean(sourceFile), sourceFile); err != nil {
+		return "", err
+	}
+	return strings.Join(f.sections, "\n\n") + "\n", nil
+}
+
+func (f *solidityFlattener) visit(file, importedFrom string) error {
+	if f.visited[file] {
+		return nil
+	}
+	f.visited[file] = true
+	if path.IsAbs(file) || file == ".." || strings.HasPrefix(file, "../") {
+		return ethconnecterrors.Errorf(ethconnecterrors.RESTGatewaySourceImportUnresolved, file, importedFrom)
+	}
+	data, err := ioutil.ReadFile(path.Join(f.dir, file))
+	if err != nil {
+		log.Errorf("Failed to read '%s' imported from '%s': %s", file, importedFrom, err)
+		return ethconnecterrors.Errorf(ethconnecterrors.RESTGatewaySourceImportUnresolved, file, importedFrom)
+	}
+	source := string(data)
+
+	for _, groups := range solidityImportMatcher.FindAllStringSubmatch(source, -1) {
+		imported := groups[1]
+		if strings.HasPrefix(imported, ".") {
+			imported = path.Join(path.Dir(file), imported)
+		}
+		if err := f.visit(path.Clean(imported), file); err != nil {
+			return err
+		}
+	}
+
+	// The imports are now earlier in the flattened source. Only the first license
+	// identifier is kept, and each distinct pragma only once
+	source = solidityImportMatcher.ReplaceAllStringFunc(source, func(stmt string) string {
+		return "// " + strings.Join(strings.Fields(stmt), " ")
+	})
+	source = soliditySPDXMatcher.ReplaceAllStringFunc(source, func(line string) string {
+		if f.hasSPDX {
+			return ""
+		}
+		f.hasSPDX = true
+		return strings.TrimSpace(line)
+	})
+	source = solidityPragmaMatcher.ReplaceAllStringFunc(source, func(stmt string) string {
+		pragma := strings.Join(strings.Fields(stmt), " ")
+		if f.pragmas[pragma] {
+			return ""
+		}
+		f.pragmas[pragma] = true
+		return pragma
+	})
+	f.sections = append(f.sections, "// File: "+file+"\n\n"+strings.TrimSpace(source))
+	return nil
+}
+
+// buildABISource flattens the source of a contract compiled from the files in the directory
+func buildABISource(dir string, compiled *eth.CompiledSolidity) (*abiSourceInfo, error) {
+	flattened, err := flattenSolidity(dir, compiled.SourceFile)
+	if err != nil {
+		return nil, err
+	}
+	info := &abiSourceInfo{
+		ContractName:    compiled.ContractName,
+		SourceFile:      compiled.SourceFile,
+		CompilerVersion: compiled.ContractInfo.CompilerVersion,
+		FlattenedSource: flattened,
+	}
+	if json.Valid([]byte(compiled.ContractInfo.Metadata)) {
+		info.Metadata = json.RawMessage(compiled.ContractInfo.Metadata)
+	}
+	return info, nil
+}
+
+func (g *smartContractGW) storeABISource(msg *messages.DeployContract, info *abiSourceInfo) error {
+	info.ID = msg.Headers.ID
+	info.CompilerOptions = msg.CompilerOptions
+	infoBytes, _ := json.MarshalIndent(info, "", "  ")
+	if err := g.store.put(registryKindSource, info.ID, infoBytes); err != nil {
+		return ethconnecterrors.Errorf(ethconnecterrors.RESTGatewaySourceStoreFailed, info.ID, err)
+	}
+	return nil
+}
+
+// getABISource returns the flattened source and metadata of an ABI on /abis/:abi/source,
+// or just the flattened source as text with ?format=sol
+func (g *smartContractGW) getABISource(res http.ResponseWriter, req *http.Request, params httprouter.Params) {
+	if params.ByName("abi") == wellKnownABIPath {
+		g.getWellKnownABI(res, req, params.ByName("address"))
+		return
+	}
+	log.Infof("--> %s %s", req.Method, req.URL)
+
+	abiID := strings.ToLower(params.ByName("abi"))
+	if resource := params.ByName("address"); resource != "source" {
+		g.gatewayErrReply(res, req, ethconnecterrors.Errorf(ethconnecterrors.RESTGatewayABIResourceNotFound, resource, abiID), 404)
+		return
+	}
+	if _, _, err := g.loadDeployMsgByID(abiID); err != nil {
+		g.gatewayErrReply(res, req, err, 404)
+		return
+	}
+	data, err := g.store.get(registryKindSource, abiID)
+	if err != nil {
+		log.Errorf("Failed to load source for ABI '%s': %s", abiID, err)
+		g.gatewayErrReply(res, req, ethconnecterrors.Errorf(ethconnecterrors.RESTGatewaySourceNotFound, abiID), 404)
+		return
+	}
+	var info abiSourceInfo
+	if err := json.Unmarshal(data, &info); err != nil {
+		g.gatewayErrReply(res, req, err, 500)
+		return
+	}
+
+	status := 200
+	log.Infof("<-- %s %s [%d]", req.Method, req.URL, status)
+	if req.FormValue("format") == "sol" {
+		res.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		res.WriteHeader(status)
+		res.Write([]byte(info.FlattenedSource))
+		return
+	}
+	res.Header().Set("Content-Type", "application/json")
+	res.WriteHeader(status)
+	enc := json.NewEncoder(res)
+	enc.SetIndent("", "  ")
+	enc.Encode(&info)
+}
@@ -0,0 +1,238 @@
+// Copyright 2021 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package contracts
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/julienschmidt/httprouter"
+	ethbinding "github.com/kaleido-io/ethbinding/pkg"
+	"github.com/kaleido-io/ethconnect/internal/eth"
+	"github.com/kaleido-io/ethconnect/internal/messages"
+	"github.com/stretchr/testify/assert"
+)
+
+func writeTestSolidity(dir string, files map[string]string) {
+	for name, content := range files {
+		os.MkdirAll(path.Dir(path.Join(dir, name)), 0755)
+		ioutil.WriteFile(path.Join(dir, name), []byte(content), 0644)
+	}
+}
+
+func TestFlattenSolidity(t *testing.T) {
+	assert := assert.New(t)
+	dir := tempdir()
+	defer cleanup(dir)
+
+	writeTestSolidity(dir, map[string]string{
+		"contracts/Token.sol": `// SPDX-License-Identifier: Apache-2.0
+pragma solidity >=0.6.0;
+import "./lib/Math.sol";
+import {
+  Ownable
+} from "access/Ownable.sol";
+
+contract Token is Ownable {}
+`,
+		"contracts/lib/Math.sol": `// SPDX-License-Identifier: MIT
+pragma solidity >=0.6.0;
+import '../../access/Ownable.sol';
+library Math {}
+`,
+		"access/Ownable.sol": `// SPDX-License-Identifier: MIT
+pragma solidity   >=0.6.0;
+pragma abicoder v2;
+contract Ownable {}
+`,
+	})
+
+	flattened, err := flattenSolidity(dir, "contracts/Token.sol")
+	assert.NoError(err)
+	assert.Equal(`// File: access/Ownable.sol
+
+// SPDX-License-Identifier: MIT
+pragma solidity >=0.6.0;
+pragma abicoder v2;
+contract Ownable {}
+
+// File: contracts/lib/Math.sol
+
+// import '../../access/Ownable.sol';
+library Math {}
+
+// File: contracts/Token.sol
+
+// import "./lib/Math.sol";
+// import { Ownable } from "access/Ownable.sol";
+
+contract Token is Ownable {}
+`, flattened)
+}
+
+func TestFlattenSolidityCircularImport(t *testing.T) {
+	assert := assert.New(t)
+	dir := tempdir()
+	defer cleanup(dir)
+
+	writeTestSolidity(dir, map[string]string{
+		"A.sol": "import \"./B.sol\";\ncontract A {}",
+		"B.sol": "import * as a from \"./A.sol\";\ncontract B {}",
+	})
+
+	flattened, err := flattenSolidity(dir, "A.sol")
+	assert.NoError(err)
+	assert.Equal("// File: B.sol\n\n// import * as a from \"./A.sol\";\ncontract B {}\n\n// File: A.sol\n\n// import \"./B.sol\";\ncontract A {}\n", flattened)
+}
+
+func TestFlattenSolidityUnresolved(t *testing.T) {
+	assert := assert.New(t)
+	dir := tempdir()
+	defer cleanup(dir)
+
+	writeTestSolidity(dir, map[string]string{
+		"A.sol":       "import \"./Missing.sol\";",
+		"Outside.sol": "import \"../../etc/passwd\";",
+	})
+
+	_, err := flattenSolidity(dir, "A.sol")
+	assert.EqualError(err, "Unable to resolve import 'Missing.sol' in 'A.sol' to flatten the source")
+	_, err = flattenSolidity(dir, "Outside.sol")
+	assert.EqualError(err, "Unable to resolve import '../../etc/passwd' in 'Outside.sol' to flatten the source")
+}
+
+func TestBuildABISource(t *testing.T) {
+	assert := assert.New(t)
+	dir := tempdir()
+	defer cleanup(dir)
+	writeTestSolidity(dir, map[string]string{"A.sol": "contract A {}"})
+
+	compiled := &eth.CompiledSolidity{
+		ContractName: "A",
+		SourceFile:   "A.sol",
+		ContractInfo: &ethbinding.ContractInfo{
+			CompilerVersion: "0.8.4",
+			Metadata:        `{"compiler":{"version":"0.8.4+commit.c7e474f2"}}`,
+		},
+	}
+	info, err := buildABISource(dir, compiled)
+	assert.NoError(err)
+	assert.Equal("0.8.4", info.CompilerVersion)
+	assert.JSONEq(`{"compiler":{"version":"0.8.4+commit.c7e474f2"}}`, string(info.Metadata))
+
+	compiled.ContractInfo.Metadata = ""
+	info, err = buildABISource(dir, compiled)
+	assert.NoError(err)
+	assert.Nil(info.Metadata)
+
+	compiled.SourceFile = "Missing.sol"
+	_, err = buildABISource(dir, compiled)
+	assert.Regexp("Unable to resolve import 'Missing.sol'", err)
+}
+
+func newTestABISourceGW(dir string) *smartContractGW {
+	scgw := &smartContractGW{
+		conf:     &SmartContractGatewayConf{},
+		store:    &fileRegistryStore{dir: dir},
+		abiIndex: make(map[string]messages.TimeSortable),
+		r2e:      &rest2eth{},
+	}
+	for _, id := range []string{"abi1", "abi2"} {
+		scgw.abiIndex[id] = &abiInfo{ID: id}
+		scgw.writeAbiInfo(id, &messages.DeployContract{ContractName: id})
+	}
+	msg := &messages.DeployContract{}
+	msg.Headers.ID = "abi1"
+	msg.CompilerOptions.EVMVersion = "london"
+	scgw.storeABISource(msg, &abiSourceInfo{
+		ContractName:    "A",
+		SourceFile:      "A.sol",
+		FlattenedSource: "// File: A.sol\n\ncontract A {}\n",
+		Metadata:        json.RawMessage(`{"language":"Solidity"}`),
+	})
+	return scgw
+}
+
+func testABISource(scgw *smartContractGW, url string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("GET", url, nil)
+	res := httptest.NewRecorder()
+	router := &httprouter.Router{}
+	scgw.AddRoutes(router)
+	router.ServeHTTP(res, req)
+	return res
+}
+
+func TestGetABISource(t *testing.T) {
+	assert := assert.New(t)
+	dir := tempdir()
+	defer cleanup(dir)
+	scgw := newTestABISourceGW(dir)
+
+	res := testABISource(scgw, "/abis/ABI1/source")
+	assert.Equal(200, res.Code)
+	var info abiSourceInfo
+	err := json.NewDecoder(res.Body).Decode(&info)
+	assert.NoError(err)
+	assert.Equal("abi1", info.ID)
+	assert.Equal("A.sol", info.SourceFile)
+	assert.Equal("london", info.EVMVersion)
+	assert.JSONEq(`{"language":"Solidity"}`, string(info.Metadata))
+
+	res = testABISource(scgw, "/abis/abi1/source?format=sol")
+	assert.Equal(200, res.Code)
+	assert.Equal("text/plain; charset=utf-8", res.Header().Get("Content-Type"))
+	assert.Equal("// File: A.sol\n\ncontract A {}\n", res.Body.String())
+}
+
+func TestGetABISourceErrors(t *testing.T) {
+	assert := assert.New(t)
+	dir := tempdir()
+	defer cleanup(dir)
+	scgw := newTestABISourceGW(dir)
+
+	res := testABISource(scgw, "/abis/abi3/source")
+	assert.Equal(404, res.Code)
+
+	var errInfo restErrMsg
+	res = testABISource(scgw, "/abis/abi1/other")
+	assert.Equal(404, res.Code)
+	json.NewDecoder(res.Body).Decode(&errInfo)
+	assert.Equal("Unknown resource 'other' for ABI 'abi1'", errInfo.Message)
+
+	res = testABISource(scgw, "/abis/abi2/source")
+	assert.Equal(404, res.Code)
+	json.NewDecoder(res.Body).Decode(&errInfo)
+	assert.Equal("No source is stored for ABI 'abi2'. Source is only stored when the gateway compiles the ABI", errInfo.Message)
+
+	ioutil.WriteFile(path.Join(dir, "source_abi2.source.json"), []byte("!json"), 0644)
+	res = testABISource(scgw, "/abis/abi2/source")
+	assert.Equal(500, res.Code)
+}
+
+func TestStoreABISourceFail(t *testing.T) {
+	assert := assert.New(t)
+	dir := tempdir()
+	cleanup(dir)
+
+	scgw := &smartContractGW{store: &fileRegistryStore{dir: dir}}
+	msg := &messages.DeployContract{}
+	msg.Headers.ID = "abi1"
+	err := scgw.storeABISource(msg, &abiSourceInfo{})
+	assert.Regexp("Failed to store the source of ABI 'abi1'", err)
+}
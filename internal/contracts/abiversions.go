@@ -0,0 +1,118 @@
+// Copyright 2021 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package contracts
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	ethconnecterrors "github.com/kaleido-io/ethconnect/internal/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// contractABIVersion is an ABI that a contract instance has been bound to, with the time it
+// was bound and the time it was replaced by the next ABI
+type contractABIVersion struct {
+	ABI             string `json:"abi"`
+	BoundISO8601    string `json:"bound"`
+	ReplacedISO8601 string `json:"replaced,omitempty"`
+}
+
+// abiVersions returns every ABI the contract has been bound to, newest first, starting with
+// the current ABI
+func (i *contractInfo) abiVersions() []*contractABIVersion {
+	bound := i.CreatedISO8601
+	if len(i.PreviousABIs) > 0 {
+		bound = i.PreviousABIs[len(i.PreviousABIs)-1].ReplacedISO8601
+	}
+	versions := []*contractABIVersion{{ABI: i.ABI, BoundISO8601: bound}}
+	for idx := len(i.PreviousABIs) - 1; idx >= 0; idx-- {
+		versions = append(versions, i.PreviousABIs[idx])
+	}
+	return versions
+}
+
+// rebindABI binds a contract instance to a new ABI, keeping the ABI it was bound to in its
+// version history. The stored entry is replaced in one write, and the index is only updated
+// once it succeeds. Must be called holding idxLock
+func (g *smartContractGW) rebindABI(info *contractInfo, abiID string) error {
+	if info.ABI == abiID {
+		return nil
+	}
+	updated := *info
+	current := info.abiVersions()[0]
+	current.ReplacedISO8601 = time.Now().UTC().Format(time.RFC3339)
+	updated.PreviousABIs = append(append([]*contractABIVersion{}, info.PreviousABIs...), current)
+	updated.ABI = abiID
+	if err := g.writeContractInfo(&updated); err != nil {
+		return err
+	}
+	log.Infof("Contract %s bound to ABI %s (previously %s)", info.Address, abiID, info.ABI)
+	info.ABI = updated.ABI
+	info.PreviousABIs = updated.PreviousABIs
+	return nil
+}
+
+// rebindContract binds a registered contract instance to a different ABI, such as after the
+// implementation behind a proxy contract is upgraded, keeping its address and friendly name
+func (g *smartContractGW) rebindContract(res http.ResponseWriter, req *http.Request, params httprouter.Params) {
+	log.Infof("--> %s %s", req.Method, req.URL)
+
+	var body struct {
+		ABI string `json:"abi"`
+	}
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		g.gatewayErrReply(res, req, ethconnecterrors.Errorf(ethconnecterrors.RESTGatewayContractRebindInvalid, err), 400)
+		return
+	}
+	if body.ABI == "" {
+		g.gatewayErrReply(res, req, ethconnecterrors.Errorf(ethconnecterrors.RESTGatewayContractRebindMissingABI), 400)
+		return
+	}
+	if _, _, err := g.loadDeployMsgByID(body.ABI); err != nil {
+		g.gatewayErrReply(res, req, err, 404)
+		return
+	}
+	_, _, info, err := g.resolveAddressOrName(req.Context(), params.ByName("address"), getFlyParam("environment", req, false))
+	if err != nil {
+		g.gatewayErrReply(res, req, err, 404)
+		return
+	}
+
+	g.idxLock.Lock()
+	// Contracts with an inferred ABI are not in the registry, so cannot be bound
+	if _, registered := g.contractIndex[info.Address]; !registered {
+		g.idxLock.Unlock()
+		g.gatewayErrReply(res, req, ethconnecterrors.Errorf(ethconnecterrors.RESTGatewayLocalStoreContractNotFound, info.Address), 404)
+		return
+	}
+	err = g.rebindABI(info, body.ABI)
+	updated := *info
+	g.idxLock.Unlock()
+	if err != nil {
+		g.gatewayErrReply(res, req, err, 500)
+		return
+	}
+
+	status := 200
+	log.Infof("<-- %s %s [%d]", req.Method, req.URL, status)
+	res.Header().Set("Content-Type", "application/json")
+	res.WriteHeader(status)
+	enc := json.NewEncoder(res)
+	enc.SetIndent("", "  ")
+	enc.Encode(&updated)
+}
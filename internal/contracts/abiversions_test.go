@@ -0,0 +1,113 @@
+// Copyright 2021 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package contracts
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/stretchr/testify/assert"
+)
+
+func testRebindRequest(router *httprouter.Router, method, path, body string) (int, string) {
+	req := httptest.NewRequest(method, path, bytes.NewReader([]byte(body)))
+	res := httptest.NewRecorder()
+	router.ServeHTTP(res, req)
+	return res.Code, res.Body.String()
+}
+
+func TestRebindContract(t *testing.T) {
+	assert := assert.New(t)
+	dir := tempdir()
+	defer cleanup(dir)
+	scgw, _, router := newTestUpgradeGW(t, dir)
+
+	status, body := testRebindRequest(router, "POST", "/contracts/proxy", `{"abi":"abi2"}`)
+	assert.Equal(200, status, body)
+	var info contractInfo
+	json.Unmarshal([]byte(body), &info)
+	assert.Equal("abi2", info.ABI)
+	assert.Equal("/contracts/proxy", info.Path)
+	assert.Len(info.PreviousABIs, 1)
+	assert.Equal("abi1", info.PreviousABIs[0].ABI)
+	assert.Equal(info.CreatedISO8601, info.PreviousABIs[0].BoundISO8601)
+	assert.NotEmpty(info.PreviousABIs[0].ReplacedISO8601)
+
+	// Binding to the current ABI does not add a version
+	status, body = testRebindRequest(router, "POST", "/contracts/0x"+testUpgradeProxy, `{"abi":"abi2"}`)
+	assert.Equal(200, status, body)
+	status, body = testRebindRequest(router, "POST", "/contracts/proxy", `{"abi":"abi1"}`)
+	assert.Equal(200, status, body)
+
+	status, body = testRebindRequest(router, "GET", "/contracts/proxy?versions", "")
+	assert.Equal(200, status, body)
+	var versions []*contractABIVersion
+	json.Unmarshal([]byte(body), &versions)
+	assert.Len(versions, 3)
+	assert.Equal("abi1", versions[0].ABI)
+	assert.Empty(versions[0].ReplacedISO8601)
+	assert.Equal("abi2", versions[1].ABI)
+	assert.Equal(versions[0].BoundISO8601, versions[1].ReplacedISO8601)
+	assert.Equal("abi1", versions[2].ABI)
+
+	stored, err := scgw.store.get(registryKindContract, testUpgradeProxy)
+	assert.NoError(err)
+	assert.Contains(string(stored), `"previousABIs"`)
+	scgw.idxLock.Lock()
+	_, indexed, _ := scgw.loadDeployMsgForInstance(testUpgradeProxy)
+	scgw.idxLock.Unlock()
+	assert.Equal("abi1", indexed.ABI)
+	assert.Len(indexed.PreviousABIs, 2)
+}
+
+func TestRebindContractErrors(t *testing.T) {
+	assert := assert.New(t)
+	dir := tempdir()
+	defer cleanup(dir)
+	_, _, router := newTestUpgradeGW(t, dir)
+
+	status, body := testRebindRequest(router, "POST", "/contracts/proxy", `!json`)
+	assert.Equal(400, status)
+	assert.Regexp("Invalid ABI binding", body)
+
+	status, body = testRebindRequest(router, "POST", "/contracts/proxy", `{}`)
+	assert.Equal(400, status)
+	assert.Regexp("Must specify the 'abi' to bind the contract to", body)
+
+	status, _ = testRebindRequest(router, "POST", "/contracts/proxy", `{"abi":"unknown"}`)
+	assert.Equal(404, status)
+
+	status, body = testRebindRequest(router, "POST", "/contracts/unknown", `{"abi":"abi2"}`)
+	assert.Equal(404, status)
+	assert.Regexp("No contract instance registered", body)
+}
+
+func TestABIVersionsNewContract(t *testing.T) {
+	assert := assert.New(t)
+	dir := tempdir()
+	defer cleanup(dir)
+	_, _, router := newTestUpgradeGW(t, dir)
+
+	status, body := testRebindRequest(router, "GET", "/contracts/proxy?versions", "")
+	assert.Equal(200, status, body)
+	var versions []*contractABIVersion
+	json.Unmarshal([]byte(body), &versions)
+	assert.Len(versions, 1)
+	assert.Equal("abi1", versions[0].ABI)
+	assert.NotEmpty(versions[0].BoundISO8601)
+}
@@ -0,0 +1,325 @@
+// Copyright 2021 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package contracts
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/julienschmidt/httprouter"
+	ethbinding "github.com/kaleido-io/ethbinding/pkg"
+	ethconnecterrors "github.com/kaleido-io/ethconnect/internal/errors"
+	"github.com/kaleido-io/ethconnect/internal/ethbind"
+	"github.com/kaleido-io/ethconnect/internal/messages"
+	"github.com/kaleido-io/ethconnect/internal/metrics"
+	"github.com/kaleido-io/ethconnect/internal/utils"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	batchPath = "/batch"
+
+	// maxBatchSize bounds the transactions in one request, as the whole batch is validated and
+	// held in memory before the first transaction is submitted
+	maxBatchSize = 1000
+
+	batchStatusInvalid   = "invalid"
+	batchStatusSkipped   = "skipped"
+	batchStatusSent      = "sent"
+	batchStatusSucceeded = "succeeded"
+	batchStatusFailed    = "failed"
+)
+
+// batchTransaction is one method invocation in a batch. The contract is an address, or a name
+// registered with the gateway, and the params are the inputs of the method by name - as in the
+// body of a POST to /contracts/:address/:method. The ID is optional, and is returned with the
+// result to correlate it
+type batchTransaction struct {
+	ID       string                 `json:"id,omitempty"`
+	Contract string                 `json:"contract"`
+	Method   string                 `json:"method"`
+	Params   map[string]interface{} `json:"params,omitempty"`
+	From     string                 `json:"from,omitempty"`
+	Value    json.Number            `json:"value,omitempty"`
+	Gas      json.Number            `json:"gas,omitempty"`
+	GasPrice json.Number            `json:"gasPrice,omitempty"`
+	Nonce    json.Number            `json:"nonce,omitempty"`
+}
+
+// batchResult is the outcome of one transaction of a batch, in the same position as the request.
+// Asynchronous batches return the ID of each request, to correlate the receipts delivered later,
+// and synchronous batches return each receipt
+type batchResult struct {
+	Index     int                       `json:"index"`
+	ID        string                    `json:"id,omitempty"`
+	Status    string                    `json:"status"`
+	RequestID string                    `json:"requestId,omitempty"`
+	Receipt   messages.ReplyWithHeaders `json:"receipt,omitempty"`
+	Error     string                    `json:"error,omitempty"`
+}
+
+// batchContract caches the ABI of each contract invoked in a batch
+type batchContract struct {
+	addr      string
+	deployMsg *messages.DeployContract
+	access    *messages.MethodAccess
+}
+
+// batchSyncResponder waits for the receipt of one transaction of a synchronous batch
+type batchSyncResponder struct {
+	receipt messages.ReplyWithHeaders
+	err     error
+	done    bool
+	waiter  *sync.Cond
+}
+
+func (b *batchSyncResponder) reply(receipt messages.ReplyWithHeaders, err error) {
+	b.waiter.L.Lock()
+	b.receipt = receipt
+	b.err = err
+	b.done = true
+	b.waiter.Broadcast()
+	b.waiter.L.Unlock()
+}
+
+func (b *batchSyncResponder) ReplyWithError(err error) {
+	b.reply(nil, err)
+}
+
+func (b *batchSyncResponder) ReplyWithReceipt(receipt messages.ReplyWithHeaders) {
+	b.reply(receipt, nil)
+}
+
+func (b *batchSyncResponder) ReplyWithReceiptAndError(receipt messages.ReplyWithHeaders, err error) {
+	b.reply(receipt, err)
+}
+
+func (b *batchSyncResponder) wait() (messages.ReplyWithHeaders, error) {
+	b.waiter.L.Lock()
+	defer b.waiter.L.Unlock()
+	for !b.done {
+		b.waiter.Wait()
+	}
+	return b.receipt, b.err
+}
+
+func (r *rest2eth) addBatchRoute(router *httprouter.Router) {
+	router.Handle(http.MethodPost, batchPath, metrics.InstrumentHandler(routeLatency, batchPath, r.batchHandler))
+}
+
+// batchHandler submits an ordered array of transactions, possibly to different contracts, in one
+// request. Every transaction is validated before any is submitted, so an invalid batch submits
+// nothing. Transactions are then submitted in order, and the first that fails stops the batch.
+// With fly-sync each receipt is waited for before the next transaction is submitted
+func (r *rest2eth) batchHandler(res http.ResponseWriter, req *http.Request, params httprouter.Params) {
+	log.Infof("--> %s %s", req.Method, req.URL)
+
+	var batch []*batchTransaction
+	if err := json.NewDecoder(req.Body).Decode(&batch); err != nil {
+		r.restErrReply(res, req, ethconnecterrors.Errorf(ethconnecterrors.RESTGatewayBatchInvalid, err), 400)
+		return
+	}
+	if len(batch) == 0 || len(batch) > maxBatchSize {
+		r.restErrReply(res, req, ethconnecterrors.Errorf(ethconnecterrors.RESTGatewayBatchSize, maxBatchSize), 400)
+		return
+	}
+
+	results := make([]*batchResult, len(batch))
+	msgs := make([]*messages.SendTransaction, len(batch))
+	contracts := make(map[string]*batchContract)
+	valid := true
+	for i, batchTx := range batch {
+		results[i] = &batchResult{Index: i, Status: batchStatusSkipped}
+		if batchTx == nil {
+			batchTx = &batchTransaction{}
+		}
+		results[i].ID = batchTx.ID
+		msg, err := r.batchTransactionMsg(req, batchTx, contracts)
+		if err != nil {
+			log.Errorf("Invalid transaction %d in batch: %s", i, err)
+			results[i].Status = batchStatusInvalid
+			results[i].Error = err.Error()
+			valid = false
+		}
+		msgs[i] = msg
+	}
+	if !valid {
+		r.batchReply(res, req, results, 400)
+		return
+	}
+
+	isSync := strings.ToLower(getFlyParam("sync", req, true)) == "true"
+	ack := (getFlyParam("noack", req, true) != "true") // turn on ack's by default
+	status := 202
+	if isSync {
+		status = 200
+	}
+	for i, msg := range msgs {
+		var ok bool
+		if isSync {
+			ok = r.sendBatchTransactionSync(req, msg, results[i])
+		} else {
+			ok = r.sendBatchTransactionAsync(req, msg, ack, results[i])
+		}
+		if !ok {
+			for _, skipped := range results[i+1:] {
+				skipped.Error = ethconnecterrors.Errorf(ethconnecterrors.RESTGatewayBatchEntryNotSubmitted, i).Error()
+			}
+			status = 500
+			break
+		}
+	}
+	r.batchReply(res, req, results, status)
+}
+
+// batchTransactionMsg validates one transaction of a batch, and builds the message to submit it.
+// The query parameters of the batch, such as fly-from and fly-confirmations, apply to every
+// transaction, and the fields of each transaction override them
+func (r *rest2eth) batchTransactionMsg(req *http.Request, batchTx *batchTransaction, contracts map[string]*batchContract) (*messages.SendTransaction, error) {
+	if batchTx.Contract == "" || batchTx.Method == "" {
+		return nil, ethconnecterrors.Errorf(ethconnecterrors.RESTGatewayBatchMissingContract)
+	}
+	contract, err := r.resolveBatchContract(req, batchTx.Contract, contracts)
+	if err != nil {
+		return nil, err
+	}
+
+	var abiMethodElem *ethbinding.ABIElementMarshaling
+	for _, element := range contract.deployMsg.ABI {
+		if element.Type == "function" && element.Name == batchTx.Method && !methodListed(contract.access.HiddenMethods, element.Name) {
+			abiMethodElem = &element
+			break
+		}
+	}
+	if abiMethodElem == nil {
+		return nil, ethconnecterrors.Errorf(ethconnecterrors.RESTGatewayMethodNotDeclared, batchTx.Method, contract.addr)
+	}
+	abiMethod, err := ethbind.API.ABIElementMarshalingToABIMethod(abiMethodElem)
+	if err != nil {
+		return nil, ethconnecterrors.Errorf(ethconnecterrors.RESTGatewayMethodABIInvalid, batchTx.Method, err)
+	}
+	if abiMethod.IsConstant() {
+		return nil, ethconnecterrors.Errorf(ethconnecterrors.RESTGatewayBatchMethodConstant, batchTx.Method)
+	}
+	if methodListed(contract.access.ReadOnlyMethods, batchTx.Method) {
+		return nil, ethconnecterrors.Errorf(ethconnecterrors.RESTGatewayMethodReadOnly, batchTx.Method)
+	}
+	msgParams, err := methodParams(abiMethod, batchTx.Params, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	fromParam := batchTx.From
+	if fromParam == "" {
+		fromParam = getFlyParam("from", req, false)
+	}
+	from, err := resolveFrom(fromParam)
+	if err != nil {
+		return nil, err
+	}
+	if from == "" && getFlyParam("sponsor", req, false) == "" {
+		return nil, ethconnecterrors.Errorf(ethconnecterrors.RESTGatewayMissingFromAddress, utils.GetenvOrDefaultLowerCase("PREFIX_SHORT", "fly"), utils.GetenvOrDefaultLowerCase("PREFIX_LONG", "firefly"))
+	}
+	value := batchTx.Value
+	if value == "" {
+		value = json.Number(getFlyParam("ethvalue", req, false))
+	}
+	msg, err := r.newSendTransactionMsg(req, from, contract.addr, value, abiMethodElem, contract.deployMsg.ABI, msgParams)
+	if err != nil {
+		return nil, err
+	}
+	if batchTx.Gas != "" {
+		msg.Gas = batchTx.Gas
+	}
+	if batchTx.GasPrice != "" {
+		msg.GasPrice = batchTx.GasPrice
+	}
+	// A nonce applies to one transaction, so is never taken from the query parameters of the batch
+	msg.Nonce = batchTx.Nonce
+	return msg, nil
+}
+
+// resolveBatchContract resolves a contract address or registered name to the ABI of the contract,
+// caching it for the other transactions of the batch to the same contract
+func (r *rest2eth) resolveBatchContract(req *http.Request, contractParam string, contracts map[string]*batchContract) (*batchContract, error) {
+	if contract, ok := contracts[contractParam]; ok {
+		return contract, nil
+	}
+	addr := strings.ToLower(strings.TrimPrefix(contractParam, "0x"))
+	if !addrCheck.MatchString(addr) {
+		var err error
+		if addr, err = r.gw.resolveContractAddr(contractParam, getFlyParam("environment", req, false)); err != nil {
+			return nil, err
+		}
+	}
+	deployMsg, info, err := r.gw.loadOrInferDeployMsgForInstance(req.Context(), addr)
+	if err != nil {
+		return nil, err
+	}
+	contract := &batchContract{
+		addr:      "0x" + strings.TrimPrefix(addr, "0x"),
+		deployMsg: deployMsg,
+		access:    methodAccessFor(deployMsg, info),
+	}
+	contracts[contractParam] = contract
+	return contract, nil
+}
+
+// sendBatchTransactionSync submits a transaction and waits for its receipt, returning false if it failed
+func (r *rest2eth) sendBatchTransactionSync(req *http.Request, msg *messages.SendTransaction, result *batchResult) bool {
+	responder := &batchSyncResponder{waiter: sync.NewCond(&sync.Mutex{})}
+	r.syncDispatcher.DispatchSendTransactionSync(req.Context(), msg, responder)
+	receipt, err := responder.wait()
+	result.Receipt = receipt
+	if err == nil && receipt != nil && receipt.ReplyHeaders().MsgType == messages.MsgTypeTransactionSuccess {
+		result.Status = batchStatusSucceeded
+		return true
+	}
+	result.Status = batchStatusFailed
+	if err != nil {
+		result.Error = err.Error()
+	} else if receipt != nil {
+		result.Error = receipt.ReplyHeaders().MsgType
+	}
+	return false
+}
+
+// sendBatchTransactionAsync dispatches a transaction, returning false if it could not be dispatched
+func (r *rest2eth) sendBatchTransactionAsync(req *http.Request, msg *messages.SendTransaction, ack bool, result *batchResult) bool {
+	// Async messages are dispatched as generic map payloads, as in sendTransaction
+	msgBytes, _ := json.Marshal(msg)
+	var mapMsg map[string]interface{}
+	json.Unmarshal(msgBytes, &mapMsg)
+	asyncResponse, err := r.asyncDispatcher.DispatchMsgAsync(req.Context(), mapMsg, ack)
+	if err != nil {
+		result.Status = batchStatusFailed
+		result.Error = err.Error()
+		return false
+	}
+	result.Status = batchStatusSent
+	result.RequestID = asyncResponse.Request
+	return true
+}
+
+func (r *rest2eth) batchReply(res http.ResponseWriter, req *http.Request, results []*batchResult, status int) {
+	resBytes, _ := json.MarshalIndent(results, "", "  ")
+	log.Infof("<-- %s %s [%d]", req.Method, req.URL, status)
+	log.Debugf("<-- %s", utils.RedactJSON(resBytes))
+	res.Header().Set("Content-Type", "application/json")
+	res.WriteHeader(status)
+	res.Write(resBytes)
+}
@@ -0,0 +1,193 @@
+// Copyright 2021 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package contracts
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	ethbinding "github.com/kaleido-io/ethbinding/pkg"
+	"github.com/kaleido-io/ethconnect/internal/messages"
+	"github.com/stretchr/testify/assert"
+)
+
+const testBatchContract = "0x567a417717cb6c59ddc1035705f02c0fd1ab1872"
+const testBatchFrom = "0x66c5fe653e7a9ebb628a6d40f0452d1e358baee8"
+
+func newTestBatchREST2Eth(t *testing.T, dispatcher *mockREST2EthDispatcher) (*mockABILoader, func(query, body string) (int, []*batchResult, string)) {
+	var abi ethbinding.ABIMarshaling
+	assert.NoError(t, json.Unmarshal([]byte(testConformanceABI), &abi))
+	abiLoader := &mockABILoader{
+		deployMsg:              &messages.DeployContract{ABI: abi},
+		contractInfo:           &contractInfo{MethodAccess: messages.MethodAccess{HiddenMethods: []string{"secret"}}},
+		registeredContractAddr: strings.TrimPrefix(testBatchContract, "0x"),
+	}
+	_, _, router := newTestREST2EthCustomAbiLoader(dispatcher, abiLoader)
+	return abiLoader, func(query, body string) (int, []*batchResult, string) {
+		req := httptest.NewRequest("POST", "/batch"+query, bytes.NewReader([]byte(body)))
+		res := httptest.NewRecorder()
+		router.ServeHTTP(res, req)
+		var results []*batchResult
+		json.Unmarshal(res.Body.Bytes(), &results)
+		return res.Code, results, res.Body.String()
+	}
+}
+
+func TestBatchAsync(t *testing.T) {
+	assert := assert.New(t)
+	dispatcher := &mockREST2EthDispatcher{
+		asyncDispatchReply: &messages.AsyncSentMsg{Sent: true, Request: "request1"},
+	}
+	abiLoader, post := newTestBatchREST2Eth(t, dispatcher)
+
+	status, results, body := post("?fly-from="+testBatchFrom+"&fly-confirmations=2", `[
+		{"id":"first","contract":"`+testBatchContract+`","method":"transfer","params":{"to":"`+testBatchFrom+`","amount":"10"}},
+		{"id":"second","contract":"token","method":"transfer","params":{"to":"`+testBatchFrom+`","amount":20},"gas":"50000","nonce":"5"}
+	]`)
+	assert.Equal(202, status, body)
+	assert.Len(results, 2)
+	assert.Equal("first", results[0].ID)
+	assert.Equal(batchStatusSent, results[0].Status)
+	assert.Equal("request1", results[0].RequestID)
+	assert.Equal(1, results[1].Index)
+	assert.Equal("second", results[1].ID)
+	assert.Equal(batchStatusSent, results[1].Status)
+	assert.Equal(strings.TrimPrefix(testBatchContract, "0x"), abiLoader.capturedAddr)
+
+	msg := dispatcher.asyncDispatchMsg
+	assert.True(dispatcher.asyncDispatchAck)
+	assert.Equal(testBatchContract, msg["to"])
+	assert.Equal(testBatchFrom, msg["from"])
+	assert.Equal(float64(50000), msg["gas"])
+	assert.Equal(float64(5), msg["nonce"])
+	assert.Equal([]interface{}{testBatchFrom, float64(20)}, msg["params"])
+	assert.Equal(float64(2), msg["headers"].(map[string]interface{})["confirmations"])
+	assert.Equal("transfer", msg["method"].(map[string]interface{})["name"])
+}
+
+func TestBatchAsyncDispatchFailure(t *testing.T) {
+	assert := assert.New(t)
+	dispatcher := &mockREST2EthDispatcher{
+		asyncDispatchError: fmt.Errorf("pop"),
+	}
+	_, post := newTestBatchREST2Eth(t, dispatcher)
+
+	status, results, body := post("?fly-noack", `[
+		{"contract":"`+testBatchContract+`","method":"transfer","from":"`+testBatchFrom+`","params":{"to":"`+testBatchFrom+`","amount":"10"}},
+		{"contract":"`+testBatchContract+`","method":"transfer","from":"`+testBatchFrom+`","params":{"to":"`+testBatchFrom+`","amount":"20"}}
+	]`)
+	assert.Equal(500, status, body)
+	assert.False(dispatcher.asyncDispatchAck)
+	assert.Equal(batchStatusFailed, results[0].Status)
+	assert.Equal("pop", results[0].Error)
+	assert.Equal(batchStatusSkipped, results[1].Status)
+	assert.Equal("Not submitted, as transaction 0 of the batch failed", results[1].Error)
+}
+
+func TestBatchSync(t *testing.T) {
+	assert := assert.New(t)
+	receipt := &messages.TransactionReceipt{}
+	receipt.Headers.MsgType = messages.MsgTypeTransactionSuccess
+	dispatcher := &mockREST2EthDispatcher{
+		sendTransactionSyncReceipt: receipt,
+	}
+	_, post := newTestBatchREST2Eth(t, dispatcher)
+	batch := `[
+		{"contract":"` + testBatchContract + `","method":"transfer","params":{"to":"` + testBatchFrom + `","amount":"10"}},
+		{"contract":"` + testBatchContract + `","method":"transfer","params":{"to":"` + testBatchFrom + `","amount":"20"}}
+	]`
+
+	status, results, body := post("?fly-sync&fly-from="+testBatchFrom, batch)
+	assert.Equal(200, status, body)
+	assert.Equal(batchStatusSucceeded, results[0].Status)
+	assert.Equal(batchStatusSucceeded, results[1].Status)
+	assert.Regexp(`"type": "TransactionSuccess"`, body)
+	assert.Equal("20", dispatcher.sendTransactionMsg.Parameters[1])
+
+	// The batch stops at the first transaction that fails
+	receipt.Headers.MsgType = messages.MsgTypeTransactionFailure
+	status, results, body = post("?fly-sync&fly-from="+testBatchFrom, batch)
+	assert.Equal(500, status, body)
+	assert.Equal(batchStatusFailed, results[0].Status)
+	assert.Equal(messages.MsgTypeTransactionFailure, results[0].Error)
+	assert.Equal(batchStatusSkipped, results[1].Status)
+	assert.Equal("10", dispatcher.sendTransactionMsg.Parameters[1])
+
+	dispatcher.sendTransactionSyncError = fmt.Errorf("pop")
+	status, results, body = post("?fly-sync&fly-from="+testBatchFrom, batch)
+	assert.Equal(500, status, body)
+	assert.Equal("pop", results[0].Error)
+	assert.Nil(results[0].Receipt)
+}
+
+func TestBatchInvalid(t *testing.T) {
+	assert := assert.New(t)
+	dispatcher := &mockREST2EthDispatcher{}
+	abiLoader, post := newTestBatchREST2Eth(t, dispatcher)
+	abiLoader.contractInfo.ReadOnlyMethods = []string{"transfer"}
+
+	status, results, body := post("?fly-from="+testBatchFrom, `[
+		{"method":"transfer"},
+		{"contract":"`+testBatchContract+`","method":"unknown"},
+		{"contract":"`+testBatchContract+`","method":"secret"},
+		{"contract":"`+testBatchContract+`","method":"name"},
+		{"contract":"`+testBatchContract+`","method":"transfer","params":{"to":"`+testBatchFrom+`","amount":"10"}},
+		null
+	]`)
+	assert.Equal(400, status, body)
+	assert.Len(results, 6)
+	assert.Equal("Each transaction in a batch must specify a 'contract' and a 'method'", results[0].Error)
+	assert.Regexp("Method or Event 'unknown' is not declared in the ABI of contract '0x567a417717cb6c59ddc1035705f02c0fd1ab1872'", results[1].Error)
+	assert.Regexp("Method or Event 'secret' is not declared", results[2].Error)
+	assert.Equal("Method 'name' does not modify state, so cannot be submitted as a transaction in a batch", results[3].Error)
+	assert.Regexp("Method 'transfer' is read-only on this gateway", results[4].Error)
+	assert.Equal(batchStatusInvalid, results[5].Status)
+	assert.Nil(dispatcher.asyncDispatchMsg)
+
+	// An invalid transaction stops the whole batch from being submitted
+	abiLoader.contractInfo.ReadOnlyMethods = nil
+	status, results, body = post("", `[
+		{"contract":"`+testBatchContract+`","method":"transfer","from":"`+testBatchFrom+`","params":{"to":"`+testBatchFrom+`","amount":"10"}},
+		{"contract":"`+testBatchContract+`","method":"transfer","from":"`+testBatchFrom+`","params":{"to":"`+testBatchFrom+`"}},
+		{"contract":"`+testBatchContract+`","method":"transfer","params":{"to":"`+testBatchFrom+`","amount":"10"}},
+		{"contract":"`+testBatchContract+`","method":"transfer","from":"bad address!","params":{"to":"`+testBatchFrom+`","amount":"10"}},
+		{"contract":"`+testBatchContract+`","method":"transfer","from":"`+testBatchFrom+`","params":{"to":"`+testBatchFrom+`","amount":"ten"}}
+	]`)
+	assert.Equal(400, status, body)
+	assert.Equal(batchStatusSkipped, results[0].Status)
+	assert.Empty(results[0].Error)
+	assert.Equal("Parameter 'amount' of method 'transfer' was not specified in body or query parameters", results[1].Error)
+	assert.Regexp("Please specify a valid address in the 'fly-from' query string parameter", results[2].Error)
+	assert.Regexp("From Address must be a 40 character hex string", results[3].Error)
+	assert.Equal(batchStatusInvalid, results[4].Status)
+	assert.Nil(dispatcher.asyncDispatchMsg)
+
+	abiLoader.resolveContractErr = fmt.Errorf("pop")
+	status, results, body = post("", `[{"contract":"token","method":"transfer"}]`)
+	assert.Equal(400, status, body)
+	assert.Equal("pop", results[0].Error)
+
+	status, _, body = post("", `[]`)
+	assert.Equal(400, status)
+	assert.Regexp("A batch must contain between 1 and 1000 transactions", body)
+
+	status, _, body = post("", `{"contract":"token"}`)
+	assert.Equal(400, status)
+	assert.Regexp("Invalid batch request", body)
+}
@@ -0,0 +1,166 @@
+// Copyright 2021 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package contracts
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	ethbinding "github.com/kaleido-io/ethbinding/pkg"
+	ethconnecterrors "github.com/kaleido-io/ethconnect/internal/errors"
+	"github.com/kaleido-io/ethconnect/internal/messages"
+	"github.com/kaleido-io/ethconnect/internal/utils"
+	log "github.com/sirupsen/logrus"
+)
+
+// compiledArtifact is the subset of the Hardhat, Truffle and Foundry artifact formats
+// needed to add an ABI. The bytecode is a hex string in Hardhat and Truffle artifacts,
+// and an object with the hex string in "object" in Foundry artifacts
+type compiledArtifact struct {
+	ContractName string                   `json:"contractName"`
+	ABI          ethbinding.ABIMarshaling `json:"abi"`
+	Bytecode     json.RawMessage          `json:"bytecode"`
+	Compiler     *struct {
+		Version string `json:"version"`
+	} `json:"compiler,omitempty"`
+}
+
+// bulkABIResult is the outcome of adding the ABI of one artifact in a bulk upload
+type bulkABIResult struct {
+	File         string   `json:"file"`
+	ContractName string   `json:"contractName"`
+	ABI          *abiInfo `json:"abi,omitempty"`
+	Error        string   `json:"error,omitempty"`
+}
+
+// findCompiledArtifacts returns the relative paths of the JSON files extracted from an upload
+// that have a top-level "abi" array. Hardhat debug files, build info, and other JSON such
+// as package.json, do not
+func findCompiledArtifacts(dir string) []string {
+	artifacts := []string{}
+	filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() || !strings.HasSuffix(p, ".json") || strings.HasSuffix(p, ".dbg.json") {
+			return nil
+		}
+		b, err := ioutil.ReadFile(p)
+		if err != nil {
+			return nil
+		}
+		var fields map[string]json.RawMessage
+		if json.Unmarshal(b, &fields) == nil && strings.HasPrefix(strings.TrimSpace(string(fields["abi"])), "[") {
+			artifacts = append(artifacts, strings.TrimPrefix(strings.TrimPrefix(p, dir), "/"))
+		}
+		return nil
+	})
+	sort.Strings(artifacts)
+	return artifacts
+}
+
+func parseArtifactBytecode(raw json.RawMessage) ([]byte, error) {
+	var bytecode string
+	if strings.HasPrefix(strings.TrimSpace(string(raw)), "{") {
+		var foundryBytecode struct {
+			Object string `json:"object"`
+		}
+		if err := json.Unmarshal(raw, &foundryBytecode); err != nil {
+			return nil, ethconnecterrors.Errorf(ethconnecterrors.RESTGatewayBulkABIInvalidArtifact, err)
+		}
+		bytecode = foundryBytecode.Object
+	} else if len(raw) > 0 {
+		if err := json.Unmarshal(raw, &bytecode); err != nil {
+			return nil, ethconnecterrors.Errorf(ethconnecterrors.RESTGatewayBulkABIInvalidArtifact, err)
+		}
+	}
+	bytecode = strings.TrimPrefix(bytecode, "0x")
+	if bytecode == "" {
+		// Interfaces and abstract contracts have an ABI, but cannot be deployed
+		return nil, nil
+	}
+	b, err := hex.DecodeString(bytecode)
+	if err != nil {
+		return nil, ethconnecterrors.Errorf(ethconnecterrors.RESTGatewayBulkABIInvalidBytecode, err)
+	}
+	return b, nil
+}
+
+// addArtifactABI stores an ABI for a single compiled artifact, named after the contract,
+// or the file if the artifact does not name the contract
+func (g *smartContractGW) addArtifactABI(dir, file string) *bulkABIResult {
+	result := &bulkABIResult{
+		File:         file,
+		ContractName: strings.TrimSuffix(filepath.Base(file), ".json"),
+	}
+	b, err := ioutil.ReadFile(filepath.Join(dir, file))
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	var artifact compiledArtifact
+	if err := json.Unmarshal(b, &artifact); err != nil {
+		result.Error = ethconnecterrors.Errorf(ethconnecterrors.RESTGatewayBulkABIInvalidArtifact, err).Error()
+		return result
+	}
+	if artifact.ContractName != "" {
+		result.ContractName = artifact.ContractName
+	}
+	msg := &messages.DeployContract{}
+	msg.Headers.MsgType = messages.MsgTypeSendTransaction
+	msg.Headers.ID = utils.UUIDv4()
+	msg.ContractName = result.ContractName
+	msg.ABI = artifact.ABI
+	if artifact.Compiler != nil {
+		msg.CompilerVersion = artifact.Compiler.Version
+	}
+	if msg.Compiled, err = parseArtifactBytecode(artifact.Bytecode); err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	if result.ABI, err = g.storeDeployableABI(msg, nil); err != nil {
+		result.Error = err.Error()
+	}
+	return result
+}
+
+// addBulkABIs adds an ABI for every compiled artifact in the files, and archives, uploaded
+// to POST /abis with the bulk option. An artifact that cannot be added does not stop the
+// others, and the result of each is returned in the order of the paths of the files
+func (g *smartContractGW) addBulkABIs(res http.ResponseWriter, req *http.Request, dir string) {
+	artifacts := findCompiledArtifacts(dir)
+	if len(artifacts) == 0 {
+		g.gatewayErrReply(res, req, ethconnecterrors.Errorf(ethconnecterrors.RESTGatewayBulkABINoArtifacts), 400)
+		return
+	}
+	results := make([]*bulkABIResult, len(artifacts))
+	failed := 0
+	for i, file := range artifacts {
+		results[i] = g.addArtifactABI(dir, file)
+		if results[i].Error != "" {
+			log.Warnf("Failed to add ABI for '%s': %s", file, results[i].Error)
+			failed++
+		}
+	}
+	log.Infof("Added %d ABIs from compiled artifacts, with %d failures", len(artifacts)-failed, failed)
+
+	log.Infof("<-- %s %s [%d]", req.Method, req.URL, 200)
+	res.Header().Set("Content-Type", "application/json")
+	res.WriteHeader(200)
+	json.NewEncoder(res).Encode(&results)
+}
@@ -0,0 +1,145 @@
+// Copyright 2021 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package contracts
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"mime/multipart"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/kaleido-io/ethconnect/internal/tx"
+	"github.com/stretchr/testify/assert"
+)
+
+const testArtifactABI = `[{"type":"function","name":"set","inputs":[{"name":"x","type":"uint256"}],"outputs":[],"stateMutability":"nonpayable"}]`
+
+func testBulkABIUpload(t *testing.T, dir string, files map[string]string) (int, []byte) {
+	s, _ := NewSmartContractGateway(
+		&SmartContractGatewayConf{
+			StoragePath: dir,
+		},
+		&tx.TxnProcessorConf{},
+		nil, nil, nil, nil,
+	)
+	scgw := s.(*smartContractGW)
+
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	part, _ := writer.CreateFormFile("files", "artifacts.zip")
+	zipWriter := zip.NewWriter(part)
+	for name, content := range files {
+		w, _ := zipWriter.Create(name)
+		w.Write([]byte(content))
+	}
+	zipWriter.Close()
+	writer.Close()
+
+	req := httptest.NewRequest("POST", "/abis?bulk", body)
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	res := httptest.NewRecorder()
+	router := &httprouter.Router{}
+	scgw.AddRoutes(router)
+	router.ServeHTTP(res, req)
+	return res.Code, res.Body.Bytes()
+}
+
+func TestAddBulkABIs(t *testing.T) {
+	assert := assert.New(t)
+	dir := tempdir()
+	defer cleanup(dir)
+
+	status, body := testBulkABIUpload(t, dir, map[string]string{
+		"artifacts/contracts/Store.sol/Store.json":     `{"_format":"hh-sol-artifact-1","contractName":"Store","abi":` + testArtifactABI + `,"bytecode":"0x6080"}`,
+		"artifacts/contracts/Store.sol/Store.dbg.json": `{"_format":"hh-sol-dbg-1","buildInfo":"../../build-info/1.json"}`,
+		"build/contracts/IStore.json":                  `{"contractName":"IStore","abi":` + testArtifactABI + `,"bytecode":"0x","compiler":{"name":"solc","version":"0.8.10+commit.fc410830"}}`,
+		"out/Counter.sol/Counter.json":                 `{"abi":` + testArtifactABI + `,"bytecode":{"object":"0x6080","linkReferences":{}}}`,
+		"out/Linked.sol/Linked.json":                   `{"abi":[],"bytecode":{"object":"0x73__$1234$__"}}`,
+		"out/Bad.sol/Bad.json":                         `{"abi":[{"type":1}],"bytecode":"0x"}`,
+		"package.json":                                 `{"name":"project"}`,
+	})
+	assert.Equal(200, status)
+	var results []*bulkABIResult
+	err := json.Unmarshal(body, &results)
+	assert.NoError(err)
+	assert.Equal(5, len(results))
+
+	assert.Equal("artifacts/contracts/Store.sol/Store.json", results[0].File)
+	assert.Equal("Store", results[0].ContractName)
+	assert.True(results[0].ABI.Deployable)
+	assert.Empty(results[0].Error)
+
+	assert.Equal("build/contracts/IStore.json", results[1].File)
+	assert.Equal("IStore", results[1].ABI.Name)
+	assert.False(results[1].ABI.Deployable)
+	assert.Equal("0.8.10+commit.fc410830", results[1].ABI.CompilerVersion)
+
+	assert.Equal("out/Bad.sol/Bad.json", results[2].File)
+	assert.Equal("Bad", results[2].ContractName)
+	assert.Nil(results[2].ABI)
+	assert.Regexp("Failed to parse compiled artifact", results[2].Error)
+
+	assert.Equal("out/Counter.sol/Counter.json", results[3].File)
+	assert.Equal("Counter", results[3].ABI.Name)
+	assert.True(results[3].ABI.Deployable)
+
+	assert.Equal("out/Linked.sol/Linked.json", results[4].File)
+	assert.Equal("Linked", results[4].ContractName)
+	assert.Regexp("Invalid bytecode in compiled artifact", results[4].Error)
+
+	// The ABIs added are in the index, and stored
+	req := httptest.NewRequest("GET", "/abis", nil)
+	res := httptest.NewRecorder()
+	s, _ := NewSmartContractGateway(&SmartContractGatewayConf{StoragePath: dir}, &tx.TxnProcessorConf{}, nil, nil, nil, nil)
+	router := &httprouter.Router{}
+	s.AddRoutes(router)
+	router.ServeHTTP(res, req)
+	var abis []*abiInfo
+	json.NewDecoder(res.Body).Decode(&abis)
+	assert.Equal(3, len(abis))
+}
+
+func TestAddBulkABIsNoArtifacts(t *testing.T) {
+	assert := assert.New(t)
+	dir := tempdir()
+	defer cleanup(dir)
+
+	status, body := testBulkABIUpload(t, dir, map[string]string{
+		"package.json":  `{"name":"project"}`,
+		"contracts.sol": `contract A {}`,
+	})
+	assert.Equal(400, status)
+	var errReply restErrMsg
+	json.Unmarshal(body, &errReply)
+	assert.Equal("No compiled contract artifacts were found in the uploaded files", errReply.Message)
+}
+
+func TestParseArtifactBytecode(t *testing.T) {
+	assert := assert.New(t)
+
+	b, err := parseArtifactBytecode(nil)
+	assert.NoError(err)
+	assert.Nil(b)
+	b, err = parseArtifactBytecode(json.RawMessage(`"6080"`))
+	assert.NoError(err)
+	assert.Equal([]byte{0x60, 0x80}, b)
+	_, err = parseArtifactBytecode(json.RawMessage(`{"object":false}`))
+	assert.Regexp("Failed to parse compiled artifact", err)
+	_, err = parseArtifactBytecode(json.RawMessage(`false`))
+	assert.Regexp("Failed to parse compiled artifact", err)
+}
@@ -0,0 +1,193 @@
+// Copyright 2021 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package contracts
+
+import (
+	"context"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	ethbinding "github.com/kaleido-io/ethbinding/pkg"
+	ethconnecterrors "github.com/kaleido-io/ethconnect/internal/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// ChainSnapshotsPath is the admin path to snapshot, and revert, the state of a development chain
+	ChainSnapshotsPath = "/admin/chain/snapshots"
+)
+
+// chainSnapshot is a snapshot taken with evm_snapshot, along with the contracts in the registry
+// and the checkpoints of the subscriptions at the time, so they can be rewound to match on revert
+type chainSnapshot struct {
+	ID          string    `json:"id"`
+	BlockNumber string    `json:"blockNumber"`
+	Created     time.Time `json:"created"`
+	block       *big.Int
+	contracts   map[string]bool
+	checkpoints map[string]*big.Int
+}
+
+// chainSnapshotRevert is the result of reverting the chain to a snapshot
+type chainSnapshotRevert struct {
+	ID                   string   `json:"id"`
+	BlockNumber          string   `json:"blockNumber"`
+	RemovedContracts     []string `json:"removedContracts"`
+	RewoundSubscriptions []string `json:"rewoundSubscriptions"`
+	Errors               []string `json:"errors,omitempty"`
+}
+
+func (g *smartContractGW) rpcCall(ctx context.Context, result interface{}, method string, args ...interface{}) error {
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	if err := g.rpc.CallContext(ctx, result, method, args...); err != nil {
+		return ethconnecterrors.Errorf(ethconnecterrors.RPCCallReturnedError, method, err)
+	}
+	return nil
+}
+
+// takeChainSnapshot asks the node to snapshot the chain, which is only supported by development
+// chains such as Hardhat, Anvil and Ganache, and records the state of the gateway to match
+func (g *smartContractGW) takeChainSnapshot(ctx context.Context) (*chainSnapshot, error) {
+	var id string
+	if err := g.rpcCall(ctx, &id, "evm_snapshot"); err != nil {
+		return nil, err
+	}
+	blockNumber := ethbinding.HexBigInt{}
+	if err := g.rpcCall(ctx, &blockNumber, "eth_blockNumber"); err != nil {
+		return nil, err
+	}
+	snapshot := &chainSnapshot{
+		ID:          id,
+		BlockNumber: blockNumber.ToInt().String(),
+		Created:     time.Now().UTC(),
+		block:       blockNumber.ToInt(),
+		contracts:   make(map[string]bool),
+		checkpoints: make(map[string]*big.Int),
+	}
+	g.idxLock.Lock()
+	for addrHexNo0x := range g.contractIndex {
+		snapshot.contracts[addrHexNo0x] = true
+	}
+	g.idxLock.Unlock()
+	if g.sm != nil {
+		snapshot.checkpoints = g.sm.SubscriptionCheckpoints(ctx)
+	}
+
+	g.snapshotsLock.Lock()
+	g.snapshots = append(g.snapshots, snapshot)
+	g.snapshotsLock.Unlock()
+	log.Infof("Took chain snapshot %s at block %s", snapshot.ID, snapshot.BlockNumber)
+	return snapshot, nil
+}
+
+// revertChainSnapshot reverts the chain to a snapshot, then removes the contracts registered
+// since, and rewinds the subscriptions that have read blocks since
+func (g *smartContractGW) revertChainSnapshot(ctx context.Context, id string) (*chainSnapshotRevert, int, error) {
+	g.snapshotsLock.Lock()
+	defer g.snapshotsLock.Unlock()
+	idx := -1
+	for i, snapshot := range g.snapshots {
+		if snapshot.ID == id {
+			idx = i
+		}
+	}
+	if idx < 0 {
+		return nil, 404, ethconnecterrors.Errorf(ethconnecterrors.ChainSnapshotNotFound, id)
+	}
+	snapshot := g.snapshots[idx]
+
+	var reverted bool
+	if err := g.rpcCall(ctx, &reverted, "evm_revert", snapshot.ID); err != nil {
+		return nil, 500, err
+	}
+	if !reverted {
+		return nil, 500, ethconnecterrors.Errorf(ethconnecterrors.ChainSnapshotRevertRejected, snapshot.ID)
+	}
+	// The node discards the snapshot reverted to, and every snapshot taken after it
+	g.snapshots = g.snapshots[0:idx]
+	log.Infof("Reverted to chain snapshot %s at block %s", snapshot.ID, snapshot.BlockNumber)
+
+	result := &chainSnapshotRevert{
+		ID:                   snapshot.ID,
+		BlockNumber:          snapshot.BlockNumber,
+		RemovedContracts:     []string{},
+		RewoundSubscriptions: []string{},
+	}
+	g.idxLock.Lock()
+	added := []string{}
+	for addrHexNo0x := range g.contractIndex {
+		if !snapshot.contracts[addrHexNo0x] {
+			added = append(added, addrHexNo0x)
+		}
+	}
+	g.idxLock.Unlock()
+	sort.Strings(added)
+	for _, addrHexNo0x := range added {
+		if err := g.removeContract(addrHexNo0x); err != nil {
+			result.Errors = append(result.Errors, err.Error())
+			continue
+		}
+		result.RemovedContracts = append(result.RemovedContracts, addrHexNo0x)
+	}
+	if g.sm != nil {
+		// Subscriptions without a checkpoint at the snapshot start from the block after it
+		nextBlock := new(big.Int).Add(snapshot.block, big.NewInt(1))
+		result.RewoundSubscriptions = g.sm.RewindSubscriptions(ctx, snapshot.checkpoints, nextBlock)
+	}
+	return result, 200, nil
+}
+
+func (g *smartContractGW) chainSnapshotReply(res http.ResponseWriter, req *http.Request, retval interface{}, status int) {
+	log.Infof("<-- %s %s [%d]", req.Method, req.URL, status)
+	res.Header().Set("Content-Type", "application/json")
+	res.WriteHeader(status)
+	json.NewEncoder(res).Encode(retval)
+}
+
+func (g *smartContractGW) createChainSnapshot(res http.ResponseWriter, req *http.Request, params httprouter.Params) {
+	log.Infof("--> %s %s", req.Method, req.URL)
+
+	snapshot, err := g.takeChainSnapshot(req.Context())
+	if err != nil {
+		g.gatewayErrReply(res, req, err, 500)
+		return
+	}
+	g.chainSnapshotReply(res, req, snapshot, 200)
+}
+
+func (g *smartContractGW) listChainSnapshots(res http.ResponseWriter, req *http.Request, params httprouter.Params) {
+	log.Infof("--> %s %s", req.Method, req.URL)
+
+	g.snapshotsLock.Lock()
+	snapshots := append([]*chainSnapshot{}, g.snapshots...)
+	g.snapshotsLock.Unlock()
+	g.chainSnapshotReply(res, req, snapshots, 200)
+}
+
+func (g *smartContractGW) revertToChainSnapshot(res http.ResponseWriter, req *http.Request, params httprouter.Params) {
+	log.Infof("--> %s %s", req.Method, req.URL)
+
+	result, status, err := g.revertChainSnapshot(req.Context(), params.ByName("id"))
+	if err != nil {
+		g.gatewayErrReply(res, req, err, status)
+		return
+	}
+	g.chainSnapshotReply(res, req, result, status)
+}
@@ -0,0 +1,167 @@
+// Copyright 2021 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package contracts
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/kaleido-io/ethconnect/internal/eth"
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	testSnapshotContractBefore = "00000000000000000000000000000000000000aa"
+	testSnapshotContractAfter  = "00000000000000000000000000000000000000bb"
+)
+
+type testChainRPC struct {
+	snapshots int
+	block     int
+	reverted  bool
+	methods   []string
+}
+
+func (r *testChainRPC) rpc() *eth.MockRPCClient {
+	return eth.NewMockRPCClientForSync(nil, func(method string, res interface{}, args ...interface{}) {
+		r.methods = append(r.methods, method)
+		switch method {
+		case "evm_snapshot":
+			r.snapshots++
+			*(res.(*string)) = fmt.Sprintf("0x%x", r.snapshots)
+		case "eth_blockNumber":
+			json.Unmarshal([]byte(fmt.Sprintf(`"0x%x"`, r.block)), res)
+		case "evm_revert":
+			*(res.(*bool)) = r.reverted
+		}
+	})
+}
+
+func testChainSnapshotRequest(router *httprouter.Router, method, path string, result interface{}) int {
+	req := httptest.NewRequest(method, path, strings.NewReader(""))
+	res := httptest.NewRecorder()
+	router.ServeHTTP(res, req)
+	json.NewDecoder(res.Body).Decode(result)
+	return res.Code
+}
+
+func TestChainSnapshotRevert(t *testing.T) {
+	assert := assert.New(t)
+	dir := tempdir()
+	defer cleanup(dir)
+	scgw, router := newTestRegistrationsGW(t, dir)
+	chain := &testChainRPC{block: 10, reverted: true}
+	scgw.rpc = chain.rpc()
+	sm := &mockSubMgr{
+		checkpoints: map[string]*big.Int{"sub1": big.NewInt(8)},
+		rewound:     []string{"sub1", "sub2"},
+	}
+	scgw.sm = sm
+
+	scgw.storeNewContractInfo(testSnapshotContractBefore, "abi1", "before", "", "", "")
+	var snapshot chainSnapshot
+	status := testChainSnapshotRequest(router, "POST", ChainSnapshotsPath, &snapshot)
+	assert.Equal(200, status)
+	assert.Equal("0x1", snapshot.ID)
+	assert.Equal("10", snapshot.BlockNumber)
+	assert.False(snapshot.Created.IsZero())
+
+	// A later snapshot is discarded by reverting to an earlier one
+	chain.block = 15
+	status = testChainSnapshotRequest(router, "POST", ChainSnapshotsPath, &snapshot)
+	assert.Equal(200, status)
+	assert.Equal("0x2", snapshot.ID)
+	var snapshots []*chainSnapshot
+	status = testChainSnapshotRequest(router, "GET", ChainSnapshotsPath, &snapshots)
+	assert.Equal(200, status)
+	assert.Equal(2, len(snapshots))
+
+	scgw.storeNewContractInfo(testSnapshotContractAfter, "abi1", "after", "after", "", "")
+	var result chainSnapshotRevert
+	status = testChainSnapshotRequest(router, "POST", ChainSnapshotsPath+"/0x1/revert", &result)
+	assert.Equal(200, status)
+	assert.Equal("0x1", result.ID)
+	assert.Equal("10", result.BlockNumber)
+	assert.Equal([]string{testSnapshotContractAfter}, result.RemovedContracts)
+	assert.Equal([]string{"sub1", "sub2"}, result.RewoundSubscriptions)
+	assert.Empty(result.Errors)
+	assert.Equal("evm_revert", chain.methods[len(chain.methods)-1])
+	assert.Equal("11", sm.capturedBlock)
+	assert.Equal(int64(8), sm.capturedCheckpoints["sub1"].Int64())
+
+	_, _, err := scgw.loadDeployMsgForInstance(testSnapshotContractBefore)
+	assert.NoError(err)
+	_, _, err = scgw.loadDeployMsgForInstance(testSnapshotContractAfter)
+	assert.Regexp("No contract instance registered", err)
+	_, err = scgw.resolveContractAddr("after", "")
+	assert.Error(err)
+
+	status = testChainSnapshotRequest(router, "GET", ChainSnapshotsPath, &snapshots)
+	assert.Equal(200, status)
+	assert.Empty(snapshots)
+}
+
+func TestChainSnapshotRevertFailures(t *testing.T) {
+	assert := assert.New(t)
+	dir := tempdir()
+	defer cleanup(dir)
+	scgw, router := newTestRegistrationsGW(t, dir)
+	chain := &testChainRPC{block: 10}
+	scgw.rpc = chain.rpc()
+
+	var errReply restErrMsg
+	status := testChainSnapshotRequest(router, "POST", ChainSnapshotsPath+"/0x1/revert", &errReply)
+	assert.Equal(404, status)
+	assert.Equal("Chain snapshot '0x1' not found", errReply.Message)
+
+	var snapshot chainSnapshot
+	status = testChainSnapshotRequest(router, "POST", ChainSnapshotsPath, &snapshot)
+	assert.Equal(200, status)
+	status = testChainSnapshotRequest(router, "POST", ChainSnapshotsPath+"/0x1/revert", &errReply)
+	assert.Equal(500, status)
+	assert.Equal("The node did not revert to chain snapshot '0x1'", errReply.Message)
+
+	// The snapshot is kept, as the node still has it
+	scgw.rpc = eth.NewMockRPCClientForSync(fmt.Errorf("pop"), nil)
+	status = testChainSnapshotRequest(router, "POST", ChainSnapshotsPath+"/0x1/revert", &errReply)
+	assert.Equal(500, status)
+	assert.Equal("evm_revert returned: pop", errReply.Message)
+
+	status = testChainSnapshotRequest(router, "POST", ChainSnapshotsPath, &errReply)
+	assert.Equal(500, status)
+	assert.Equal("evm_snapshot returned: pop", errReply.Message)
+
+	scgw.rpc = &failBlockNumberRPC{MockRPCClient: chain.rpc()}
+	status = testChainSnapshotRequest(router, "POST", ChainSnapshotsPath, &errReply)
+	assert.Equal(500, status)
+	assert.Equal("eth_blockNumber returned: pop", errReply.Message)
+}
+
+type failBlockNumberRPC struct {
+	*eth.MockRPCClient
+}
+
+func (r *failBlockNumberRPC) CallContext(ctx context.Context, result interface{}, method string, args ...interface{}) error {
+	if method == "eth_blockNumber" {
+		return fmt.Errorf("pop")
+	}
+	return r.MockRPCClient.CallContext(ctx, result, method, args...)
+}
@@ -0,0 +1,225 @@
+// Copyright 2021 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package contracts
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/julienschmidt/httprouter"
+	ethbinding "github.com/kaleido-io/ethbinding/pkg"
+	ethconnecterrors "github.com/kaleido-io/ethconnect/internal/errors"
+	"github.com/kaleido-io/ethconnect/internal/eth"
+	"github.com/kaleido-io/ethconnect/internal/openapi"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	conformanceMethod = "conformance"
+
+	conformancePassed  = "passed"
+	conformanceFailed  = "failed"
+	conformanceSkipped = "skipped"
+)
+
+// conformanceRequest is the optional body of a conformance check. Inputs replace the generated
+// inputs of a method, keyed by name or signature, for methods that revert on arbitrary inputs
+type conformanceRequest struct {
+	From        string                   `json:"from,omitempty"`
+	EstimateGas bool                     `json:"estimateGas,omitempty"`
+	Inputs      map[string][]interface{} `json:"inputs,omitempty"`
+	Skip        []string                 `json:"skip,omitempty"`
+}
+
+// conformanceResult is the outcome of calling, or estimating the gas of, one method
+type conformanceResult struct {
+	Method      string                 `json:"method"`
+	Signature   string                 `json:"signature"`
+	Check       string                 `json:"check,omitempty"`
+	Status      string                 `json:"status"`
+	Inputs      []interface{}          `json:"inputs,omitempty"`
+	Outputs     map[string]interface{} `json:"outputs,omitempty"`
+	GasEstimate string                 `json:"gasEstimate,omitempty"`
+	Error       string                 `json:"error,omitempty"`
+}
+
+// conformanceReport checks a contract on the chain against the ABI it is registered with
+type conformanceReport struct {
+	Address string               `json:"address"`
+	Passed  bool                 `json:"passed"`
+	HasCode bool                 `json:"hasCode"`
+	Total   int                  `json:"total"`
+	Failed  int                  `json:"failed"`
+	Skipped int                  `json:"skipped"`
+	Methods []*conformanceResult `json:"methods"`
+}
+
+func abiDeclaresFunction(abi ethbinding.ABIMarshaling, name string) bool {
+	for _, element := range abi {
+		if element.Type == "function" && element.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// contractConformance serves POST /contracts/:address/conformance, returning true if it handled
+// the request. As with the stats route, it shares the :method wildcard with the contract methods,
+// so a method named "conformance" in the ABI of the contract takes precedence
+func (r *rest2eth) contractConformance(res http.ResponseWriter, req *http.Request, params httprouter.Params) bool {
+	if req.Method != http.MethodPost || params.ByName("method") != conformanceMethod || params.ByName("abi") != "" ||
+		params.ByName("address") == "" || r.gw == nil {
+		return false
+	}
+	var c restCmd
+	abi, _, err := r.resolveABI(res, req, params, &c, params.ByName("address"), false)
+	if err != nil {
+		return true
+	}
+	if abiDeclaresFunction(abi, conformanceMethod) {
+		return false
+	}
+
+	var conformanceReq conformanceRequest
+	if req.ContentLength != 0 {
+		if err := json.NewDecoder(req.Body).Decode(&conformanceReq); err != nil {
+			r.restErrReply(res, req, ethconnecterrors.Errorf(ethconnecterrors.RESTGatewayConformanceInvalid, err), 400)
+			return true
+		}
+	}
+	if conformanceReq.From == "" {
+		conformanceReq.From = getFlyParam("from", req, false)
+	}
+	if conformanceReq.From, err = r.processor.ResolveAddress(req.Context(), conformanceReq.From); err != nil {
+		r.restErrReply(res, req, err, 500)
+		return true
+	}
+	runtimeABI, err := eth.RuntimeABI(abi)
+	if err != nil {
+		r.restErrReply(res, req, ethconnecterrors.Errorf(ethconnecterrors.RESTGatewayInvalidABI, err), 400)
+		return true
+	}
+	report, err := r.checkConformance(req.Context(), "0x"+c.addr, runtimeABI, c.access.HiddenMethods, c.access.ReadOnlyMethods, &conformanceReq)
+	if err != nil {
+		r.restErrReply(res, req, err, 500)
+		return true
+	}
+
+	resBytes, _ := json.MarshalIndent(report, "", "  ")
+	status := 200
+	log.Infof("<-- %s %s [%d]", req.Method, req.URL, status)
+	res.Header().Set("Content-Type", "application/json")
+	res.WriteHeader(status)
+	res.Write(resBytes)
+	return true
+}
+
+// checkConformance calls every read-only method of the ABI against the contract, with generated
+// inputs, and optionally estimates the gas of every other method. A method passes if the call
+// succeeds and returns outputs that decode against the ABI. Hidden methods are skipped, as are
+// methods marked read-only when estimating gas
+func (r *rest2eth) checkConformance(ctx context.Context, addr string, abi *ethbinding.RuntimeABI, hidden, readOnly []string, conformanceReq *conformanceRequest) (*conformanceReport, error) {
+	var code ethbinding.HexBytes
+	if err := r.rpc.CallContext(ctx, &code, "eth_getCode", addr, "latest"); err != nil {
+		return nil, err
+	}
+	report := &conformanceReport{
+		Address: addr,
+		HasCode: len(code) > 0,
+		Methods: []*conformanceResult{},
+	}
+
+	methodNames := make([]string, 0, len(abi.Methods))
+	for name := range abi.Methods {
+		methodNames = append(methodNames, name)
+	}
+	sort.Strings(methodNames)
+	for _, name := range methodNames {
+		method := abi.Methods[name]
+		result := &conformanceResult{
+			Method:    method.RawName,
+			Signature: method.Sig,
+			Status:    conformanceSkipped,
+		}
+		report.Methods = append(report.Methods, result)
+		isConstant := method.IsConstant()
+		switch {
+		case methodListed(hidden, method.RawName) || methodListed(conformanceReq.Skip, method.RawName) || methodListed(conformanceReq.Skip, method.Sig):
+		case !isConstant && (!conformanceReq.EstimateGas || methodListed(readOnly, method.RawName)):
+		default:
+			result.Inputs = conformanceInputs(&method, conformanceReq.Inputs)
+			if isConstant {
+				result.Check = "call"
+				result.Outputs, result.Error = r.conformanceCall(ctx, conformanceReq.From, addr, &method, result.Inputs)
+			} else {
+				result.Check = "estimateGas"
+				gas, err := eth.EstimateMethodGas(ctx, r.rpc, conformanceReq.From, addr, "", &method, result.Inputs)
+				if err != nil {
+					result.Error = err.Error()
+				} else {
+					result.GasEstimate = strconv.FormatUint(gas, 10)
+				}
+			}
+			result.Status = conformancePassed
+			if result.Error != "" {
+				result.Status = conformanceFailed
+			}
+		}
+		switch result.Status {
+		case conformanceFailed:
+			report.Failed++
+		case conformanceSkipped:
+			report.Skipped++
+		}
+		report.Total++
+	}
+	report.Passed = report.HasCode && report.Failed == 0
+	log.Infof("Conformance of %s: total=%d failed=%d skipped=%d hasCode=%t", addr, report.Total, report.Failed, report.Skipped, report.HasCode)
+	return report, nil
+}
+
+// conformanceInputs returns the inputs supplied for a method, or generates example inputs
+func conformanceInputs(method *ethbinding.ABIMethod, supplied map[string][]interface{}) []interface{} {
+	if inputs, ok := supplied[method.Sig]; ok {
+		return inputs
+	}
+	if inputs, ok := supplied[method.RawName]; ok {
+		return inputs
+	}
+	inputs := make([]interface{}, len(method.Inputs))
+	for i, input := range method.Inputs {
+		inputs[i] = openapi.ExampleForType(&input.Type)
+	}
+	return inputs
+}
+
+// conformanceCall calls a read-only method, checking it returns outputs that decode against the ABI
+func (r *rest2eth) conformanceCall(ctx context.Context, from, addr string, method *ethbinding.ABIMethod, inputs []interface{}) (map[string]interface{}, string) {
+	outputs, err := eth.CallMethod(ctx, r.rpc, nil, from, addr, "", method, inputs, nil, "latest")
+	if err != nil {
+		return nil, err.Error()
+	}
+	if len(method.Outputs) > 0 && outputs == nil {
+		return nil, ethconnecterrors.Errorf(ethconnecterrors.RESTGatewayConformanceNoOutput).Error()
+	}
+	if decodeErr, ok := outputs["error"].(string); ok && outputs["rlp"] != nil {
+		return outputs, strings.TrimSpace(decodeErr)
+	}
+	return outputs, ""
+}
@@ -0,0 +1,199 @@
+// Copyright 2021 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package contracts
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	ethbinding "github.com/kaleido-io/ethbinding/pkg"
+	"github.com/kaleido-io/ethconnect/internal/eth"
+	"github.com/kaleido-io/ethconnect/internal/ethbind"
+	"github.com/kaleido-io/ethconnect/internal/messages"
+	"github.com/stretchr/testify/assert"
+)
+
+const testConformanceABI = `[
+	{"type":"function","name":"name","stateMutability":"view","inputs":[],"outputs":[{"name":"","type":"string"}]},
+	{"type":"function","name":"balanceOf","stateMutability":"view","inputs":[{"name":"owner","type":"address"}],"outputs":[{"name":"","type":"uint256"}]},
+	{"type":"function","name":"missing","stateMutability":"view","inputs":[],"outputs":[{"name":"","type":"uint256"}]},
+	{"type":"function","name":"secret","stateMutability":"view","inputs":[],"outputs":[{"name":"","type":"uint256"}]},
+	{"type":"function","name":"transfer","stateMutability":"nonpayable","inputs":[{"name":"to","type":"address"},{"name":"amount","type":"uint256"}],"outputs":[{"name":"","type":"bool"}]}
+]`
+
+func testSelector(sig string) string {
+	return ethbind.API.HexEncode(ethbind.Keccak256([]byte(sig))[0:4])
+}
+
+// testConformanceChain answers calls to the test ABI by selector
+func testConformanceChain(code string, calls *[]string) *eth.MockRPCClient {
+	return eth.NewMockRPCClientForSync(nil, func(method string, res interface{}, args ...interface{}) {
+		switch method {
+		case "eth_getCode":
+			*(res.(*ethbinding.HexBytes)) = ethbind.API.FromHex(code)
+		case "eth_estimateGas":
+			*calls = append(*calls, "estimateGas:"+args[0].(*eth.SendTXArgs).Data.String()[0:10])
+			*(res.(*ethbinding.HexUint64)) = 21000
+		case "eth_call":
+			data := args[0].(*eth.SendTXArgs).Data.String()
+			*calls = append(*calls, "call:"+data)
+			switch data[0:10] {
+			case testSelector("name()"):
+				*(res.(*string)) = "0x" + fmt.Sprintf("%064x%064x", 32, 5) + fmt.Sprintf("%-64s", "546f6b656e")
+			case testSelector("balanceOf(address)"):
+				*(res.(*string)) = "0x" + fmt.Sprintf("%064x", 1000)
+			default:
+				*(res.(*string)) = "0x"
+			}
+		}
+	})
+}
+
+func newTestConformanceREST2Eth(t *testing.T, code string, calls *[]string) (*rest2eth, *mockABILoader, func(body string) (int, *conformanceReport, string)) {
+	var abi ethbinding.ABIMarshaling
+	assert.NoError(t, json.Unmarshal([]byte(testConformanceABI), &abi))
+	abiLoader := &mockABILoader{
+		deployMsg: &messages.DeployContract{ABI: abi},
+		contractInfo: &contractInfo{
+			MethodAccess: messages.MethodAccess{HiddenMethods: []string{"secret"}},
+		},
+	}
+	r, _, router := newTestREST2EthCustomAbiLoader(&mockREST2EthDispatcher{}, abiLoader)
+	r.processor = &mockProcessor{resolvedFrom: "0x66c5fe653e7a9ebb628a6d40f0452d1e358baee8"}
+	r.rpc = testConformanceChain(code, calls)
+	return r, abiLoader, func(body string) (int, *conformanceReport, string) {
+		req := httptest.NewRequest("POST", "/contracts/0x567a417717cb6c59ddc1035705f02c0fd1ab1872/conformance", bytes.NewReader([]byte(body)))
+		res := httptest.NewRecorder()
+		router.ServeHTTP(res, req)
+		var report conformanceReport
+		json.Unmarshal(res.Body.Bytes(), &report)
+		return res.Code, &report, res.Body.String()
+	}
+}
+
+func conformanceResultFor(report *conformanceReport, name string) *conformanceResult {
+	for _, result := range report.Methods {
+		if result.Method == name {
+			return result
+		}
+	}
+	return nil
+}
+
+func TestContractConformance(t *testing.T) {
+	assert := assert.New(t)
+	var calls []string
+	_, _, post := newTestConformanceREST2Eth(t, "0x6080", &calls)
+
+	status, report, body := post("")
+	assert.Equal(200, status, body)
+	assert.Equal("0x567a417717cb6c59ddc1035705f02c0fd1ab1872", report.Address)
+	assert.True(report.HasCode)
+	assert.False(report.Passed)
+	assert.Equal(5, report.Total)
+	assert.Equal(1, report.Failed)
+	assert.Equal(2, report.Skipped)
+
+	name := conformanceResultFor(report, "name")
+	assert.Equal(conformancePassed, name.Status)
+	assert.Equal("call", name.Check)
+	assert.Equal("Token", name.Outputs["output"])
+	balanceOf := conformanceResultFor(report, "balanceOf")
+	assert.Equal(conformancePassed, balanceOf.Status)
+	assert.Equal("balanceOf(address)", balanceOf.Signature)
+	assert.Len(balanceOf.Inputs, 1)
+	assert.Equal("1000", balanceOf.Outputs["output"])
+	missing := conformanceResultFor(report, "missing")
+	assert.Equal(conformanceFailed, missing.Status)
+	assert.Regexp("No data returned", missing.Error)
+	assert.Equal(conformanceSkipped, conformanceResultFor(report, "secret").Status)
+	assert.Equal(conformanceSkipped, conformanceResultFor(report, "transfer").Status)
+	for _, call := range calls {
+		assert.False(strings.HasPrefix(call, "call:"+testSelector("secret()")))
+	}
+}
+
+func TestContractConformanceEstimateGasAndInputs(t *testing.T) {
+	assert := assert.New(t)
+	var calls []string
+	_, _, post := newTestConformanceREST2Eth(t, "0x6080", &calls)
+
+	status, report, body := post(`{
+		"estimateGas": true,
+		"skip": ["missing()"],
+		"inputs": {"balanceOf": ["0x0000000000000000000000000000000000000001"]}
+	}`)
+	assert.Equal(200, status, body)
+	assert.True(report.Passed)
+	assert.Equal(0, report.Failed)
+	assert.Equal(2, report.Skipped)
+	transfer := conformanceResultFor(report, "transfer")
+	assert.Equal(conformancePassed, transfer.Status)
+	assert.Equal("estimateGas", transfer.Check)
+	assert.Equal("21000", transfer.GasEstimate)
+	assert.Contains(calls, "call:"+testSelector("balanceOf(address)")+fmt.Sprintf("%064x", 1))
+	assert.Contains(calls, "estimateGas:"+testSelector("transfer(address,uint256)"))
+}
+
+func TestContractConformanceNoCode(t *testing.T) {
+	assert := assert.New(t)
+	var calls []string
+	_, _, post := newTestConformanceREST2Eth(t, "0x", &calls)
+
+	status, report, body := post(`{"skip":["missing"]}`)
+	assert.Equal(200, status, body)
+	assert.False(report.HasCode)
+	assert.False(report.Passed)
+	assert.Equal(0, report.Failed)
+}
+
+func TestContractConformanceErrors(t *testing.T) {
+	assert := assert.New(t)
+	var calls []string
+	r, abiLoader, post := newTestConformanceREST2Eth(t, "0x6080", &calls)
+
+	status, _, body := post(`!json`)
+	assert.Equal(400, status)
+	assert.Regexp("Invalid conformance check request", body)
+
+	r.processor = &mockProcessor{err: fmt.Errorf("pop")}
+	status, _, body = post(``)
+	assert.Equal(500, status)
+	assert.Regexp("pop", body)
+
+	r.processor = &mockProcessor{}
+	r.rpc = eth.NewMockRPCClientForSync(fmt.Errorf("pop"), nil)
+	status, _, body = post(``)
+	assert.Equal(500, status)
+	assert.Regexp("pop", body)
+
+	abiLoader.loadABIError = fmt.Errorf("pop")
+	status, _, _ = post(``)
+	assert.Equal(404, status)
+
+	// A method named conformance in the ABI takes precedence
+	abiLoader.loadABIError = nil
+	abiLoader.deployMsg.ABI = append(abiLoader.deployMsg.ABI, ethbinding.ABIElementMarshaling{
+		Type: "function", Name: "conformance", StateMutability: "view",
+	})
+	r.rpc = testConformanceChain("0x6080", &calls)
+	status, _, body = post(``)
+	assert.Equal(200, status)
+	assert.NotContains(body, `"methods"`)
+}
@@ -0,0 +1,574 @@
+// Copyright 2021 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package contracts
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	log "github.com/sirupsen/logrus"
+
+	ethbinding "github.com/kaleido-io/ethbinding/pkg"
+	"github.com/kaleido-io/ethconnect/internal/auth"
+	ethconnecterrors "github.com/kaleido-io/ethconnect/internal/errors"
+	"github.com/kaleido-io/ethconnect/internal/eth"
+	"github.com/kaleido-io/ethconnect/internal/messages"
+	"github.com/kaleido-io/ethconnect/internal/utils"
+)
+
+const (
+	// DeployPlanPathPrefix is the path prefix for deploy plans
+	DeployPlanPathPrefix = "/deployplans"
+
+	deployPlanStatusRunning   = "running"
+	deployPlanStatusCompleted = "completed"
+	deployPlanStatusFailed    = "failed"
+	deployPlanStatusPending   = "pending"
+)
+
+var (
+	deployPlanStepName = regexp.MustCompile("^[a-zA-Z0-9_-]+$")
+	// deployPlanRef is a reference to the result of an earlier step, such as "${token.address}"
+	deployPlanRef = regexp.MustCompile("^\\$\\{([a-zA-Z0-9_-]+)\\.(address|transactionHash)\\}$")
+)
+
+// deployPlan is an ordered list of contract deployments and method calls, executed one
+// at a time. The progress is stored after each step, so a failed plan can be resumed
+type deployPlan struct {
+	messages.TimeSorted
+	ID          string            `json:"id"`
+	Name        string            `json:"name,omitempty"`
+	From        string            `json:"from,omitempty"`
+	Environment string            `json:"environment,omitempty"`
+	Tenant      string            `json:"tenant,omitempty"`
+	Steps       []*deployPlanStep `json:"steps"`
+	Status      string            `json:"status"`
+	Error       string            `json:"error,omitempty"`
+	Updated     string            `json:"updated,omitempty"`
+}
+
+// deployPlanStep deploys an uploaded ABI, or calls a method of a contract. String parameters,
+// and the contract, can refer to the results of earlier steps
+type deployPlanStep struct {
+	Name            string        `json:"name"`
+	ABI             string        `json:"abi,omitempty"`
+	RegisterAs      string        `json:"registerAs,omitempty"`
+	Contract        string        `json:"contract,omitempty"`
+	Method          string        `json:"method,omitempty"`
+	Params          []interface{} `json:"params,omitempty"`
+	From            string        `json:"from,omitempty"`
+	Value           json.Number   `json:"value,omitempty"`
+	Gas             json.Number   `json:"gas,omitempty"`
+	Status          string        `json:"status"`
+	ContractAddress string        `json:"contractAddress,omitempty"`
+	TransactionHash string        `json:"transactionHash,omitempty"`
+	Error           string        `json:"error,omitempty"`
+}
+
+func (p *deployPlan) GetID() string {
+	return p.ID
+}
+
+func (s *deployPlanStep) isDeploy() bool {
+	return s.ABI != ""
+}
+
+// deployPlanResponder waits for the reply to the transaction of a step
+type deployPlanResponder struct {
+	done    chan struct{}
+	receipt *messages.TransactionReceipt
+	err     error
+}
+
+func (d *deployPlanResponder) ReplyWithError(err error) {
+	d.err = err
+	close(d.done)
+}
+
+func (d *deployPlanResponder) ReplyWithReceiptAndError(receipt messages.ReplyWithHeaders, err error) {
+	d.ReplyWithError(err)
+}
+
+func (d *deployPlanResponder) ReplyWithReceipt(receipt messages.ReplyWithHeaders) {
+	d.receipt = receipt.IsReceipt()
+	if d.receipt == nil || receipt.ReplyHeaders().MsgType != messages.MsgTypeTransactionSuccess {
+		txHash := ""
+		if d.receipt != nil && d.receipt.TransactionHash != nil {
+			txHash = d.receipt.TransactionHash.Hex()
+		}
+		d.err = ethconnecterrors.Errorf(ethconnecterrors.DeployPlanTransactionFailed, txHash)
+	}
+	close(d.done)
+}
+
+// deployPlanRefs returns the references to earlier steps in a parameter, including within arrays and structs
+func deployPlanRefs(v interface{}) (refs [][]string) {
+	switch t := v.(type) {
+	case string:
+		if groups := deployPlanRef.FindStringSubmatch(t); groups != nil {
+			refs = append(refs, groups[1:])
+		}
+	case []interface{}:
+		for _, e := range t {
+			refs = append(refs, deployPlanRefs(e)...)
+		}
+	case map[string]interface{}:
+		for _, e := range t {
+			refs = append(refs, deployPlanRefs(e)...)
+		}
+	}
+	return refs
+}
+
+// resolveDeployPlanRefs replaces the references to earlier steps in a parameter with their results
+func resolveDeployPlanRefs(v interface{}, steps map[string]*deployPlanStep) interface{} {
+	switch t := v.(type) {
+	case string:
+		if groups := deployPlanRef.FindStringSubmatch(t); groups != nil {
+			if groups[2] == "address" {
+				return steps[groups[1]].ContractAddress
+			}
+			return steps[groups[1]].TransactionHash
+		}
+	case []interface{}:
+		resolved := make([]interface{}, len(t))
+		for i, e := range t {
+			resolved[i] = resolveDeployPlanRefs(e, steps)
+		}
+		return resolved
+	case map[string]interface{}:
+		resolved := make(map[string]interface{}, len(t))
+		for k, e := range t {
+			resolved[k] = resolveDeployPlanRefs(e, steps)
+		}
+		return resolved
+	}
+	return v
+}
+
+// findDeployPlanMethod returns the function with the name, preferring the overload with the number of parameters
+func findDeployPlanMethod(abi ethbinding.ABIMarshaling, name string, params int) *ethbinding.ABIElementMarshaling {
+	var found *ethbinding.ABIElementMarshaling
+	for i, element := range abi {
+		if element.Type == "function" && element.Name == name {
+			if len(element.Inputs) == params {
+				return &abi[i]
+			}
+			if found == nil {
+				found = &abi[i]
+			}
+		}
+	}
+	return found
+}
+
+// validateDeployPlan checks every step of a plan before any of them is executed. The ABIs,
+// the contracts and methods called, and the references between steps must all exist, and the
+// names to register must be available
+func (g *smartContractGW) validateDeployPlan(plan *deployPlan) error {
+	if len(plan.Steps) == 0 {
+		return ethconnecterrors.Errorf(ethconnecterrors.DeployPlanNoSteps)
+	}
+	earlier := make(map[string]*deployPlanStep)
+	registrations := make(map[string]bool)
+	for i, step := range plan.Steps {
+		if step == nil || !deployPlanStepName.MatchString(step.Name) {
+			return ethconnecterrors.Errorf(ethconnecterrors.DeployPlanStepNoName, i)
+		}
+		if _, exists := earlier[step.Name]; exists {
+			return ethconnecterrors.Errorf(ethconnecterrors.DeployPlanStepDuplicateName, step.Name)
+		}
+		if step.From == "" && plan.From == "" {
+			return ethconnecterrors.Errorf(ethconnecterrors.DeployPlanStepNoFrom, step.Name)
+		}
+		for _, ref := range deployPlanRefs(append([]interface{}{step.Contract}, step.Params...)) {
+			target, exists := earlier[ref[0]]
+			if !exists || (ref[1] == "address" && !target.isDeploy()) {
+				return ethconnecterrors.Errorf(ethconnecterrors.DeployPlanStepBadReference, step.Name, ref[0]+"."+ref[1])
+			}
+		}
+		switch {
+		case step.isDeploy():
+			if err := g.validateDeployPlanDeploy(plan, step, registrations); err != nil {
+				return err
+			}
+		case step.Contract != "" && step.Method != "":
+			abi, _, err := g.deployPlanTarget(plan, step, earlier)
+			if err != nil {
+				return err
+			}
+			if findDeployPlanMethod(abi, step.Method, len(step.Params)) == nil {
+				return ethconnecterrors.Errorf(ethconnecterrors.DeployPlanStepMethodNotFound, step.Method, step.Name)
+			}
+		default:
+			return ethconnecterrors.Errorf(ethconnecterrors.DeployPlanStepNoAction, step.Name)
+		}
+		step.Status = deployPlanStatusPending
+		earlier[step.Name] = step
+	}
+	return nil
+}
+
+func (g *smartContractGW) validateDeployPlanDeploy(plan *deployPlan, step *deployPlanStep, registrations map[string]bool) error {
+	g.idxLock.Lock()
+	defer g.idxLock.Unlock()
+	if isWellKnownABI(step.ABI) {
+		return ethconnecterrors.Errorf(ethconnecterrors.RESTGatewayWellKnownABINotDeployable, step.ABI)
+	}
+	deployMsg, _, err := g.loadDeployMsgByID(step.ABI)
+	if err != nil {
+		return err
+	}
+	if err = g.checkStaticAnalysis(deployMsg); err != nil {
+		return err
+	}
+	if step.RegisterAs != "" {
+		if registrations[step.RegisterAs] {
+			return ethconnecterrors.Errorf(ethconnecterrors.DeployPlanStepDuplicateRegistration, step.Name, step.RegisterAs)
+		}
+		registrations[step.RegisterAs] = true
+		if err = g.checkNameAvailable(step.RegisterAs, plan.Environment, false); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deployPlanTarget returns the ABI and address of the contract called by a step. The contract is
+// a reference to an earlier deploy step, an address in the local registry, or a registered name
+func (g *smartContractGW) deployPlanTarget(plan *deployPlan, step *deployPlanStep, steps map[string]*deployPlanStep) (ethbinding.ABIMarshaling, string, error) {
+	if groups := deployPlanRef.FindStringSubmatch(step.Contract); groups != nil {
+		target := steps[groups[1]]
+		g.idxLock.Lock()
+		deployMsg, _, err := g.loadDeployMsgByID(target.ABI)
+		g.idxLock.Unlock()
+		if err != nil {
+			return nil, "", err
+		}
+		return deployMsg.ABI, target.ContractAddress, nil
+	}
+	addr := strings.TrimPrefix(strings.ToLower(step.Contract), "0x")
+	if !addrCheck.MatchString(addr) {
+		resolved, err := g.resolveContractAddr(step.Contract, plan.Environment)
+		if err != nil {
+			return nil, "", err
+		}
+		addr = resolved
+	}
+	g.idxLock.Lock()
+	deployMsg, _, err := g.loadDeployMsgForInstance(addr)
+	g.idxLock.Unlock()
+	if err != nil {
+		return nil, "", err
+	}
+	return deployMsg.ABI, "0x" + addr, nil
+}
+
+// saveDeployPlan stores the definition and progress of a plan
+func (g *smartContractGW) saveDeployPlan(plan *deployPlan) error {
+	plan.Updated = time.Now().UTC().Format(time.RFC3339Nano)
+	planBytes, _ := json.MarshalIndent(plan, "", "  ")
+	if err := g.store.put(registryKindDeployPlan, plan.ID, planBytes); err != nil {
+		return ethconnecterrors.Errorf(ethconnecterrors.DeployPlanSave, plan.ID, err)
+	}
+	return nil
+}
+
+func (g *smartContractGW) loadDeployPlan(id string) (*deployPlan, error) {
+	planBytes, err := g.store.get(registryKindDeployPlan, id)
+	if err != nil {
+		return nil, ethconnecterrors.Errorf(ethconnecterrors.DeployPlanNotFound, id)
+	}
+	var plan deployPlan
+	if err = json.Unmarshal(planBytes, &plan); err != nil {
+		return nil, err
+	}
+	return &plan, nil
+}
+
+// startDeployPlan marks a plan as running in this gateway, returning false if it already is
+func (g *smartContractGW) startDeployPlan(plan *deployPlan) (bool, error) {
+	g.plansLock.Lock()
+	defer g.plansLock.Unlock()
+	if g.runningPlans[plan.ID] {
+		return false, nil
+	}
+	plan.Status = deployPlanStatusRunning
+	plan.Error = ""
+	if err := g.saveDeployPlan(plan); err != nil {
+		return false, err
+	}
+	g.runningPlans[plan.ID] = true
+	return true, nil
+}
+
+func (g *smartContractGW) isDeployPlanRunning(id string) bool {
+	g.plansLock.Lock()
+	defer g.plansLock.Unlock()
+	return g.runningPlans[id]
+}
+
+// runDeployPlan executes the steps of a plan that have not completed, in order, stopping at
+// the first failure. Resuming a failed plan retries the failed step
+func (g *smartContractGW) runDeployPlan(ctx context.Context, plan *deployPlan) {
+	defer func() {
+		g.plansLock.Lock()
+		delete(g.runningPlans, plan.ID)
+		g.plansLock.Unlock()
+	}()
+	steps := make(map[string]*deployPlanStep)
+	status := deployPlanStatusCompleted
+	for _, step := range plan.Steps {
+		steps[step.Name] = step
+		if step.Status == deployPlanStatusCompleted {
+			continue
+		}
+		log.Infof("Deploy plan %s: running step '%s'", plan.ID, step.Name)
+		step.Status = deployPlanStatusRunning
+		if err := g.runDeployPlanStep(ctx, plan, step, steps); err != nil {
+			log.Errorf("Deploy plan %s: step '%s' failed: %s", plan.ID, step.Name, err)
+			step.Status = deployPlanStatusFailed
+			step.Error = err.Error()
+			status = deployPlanStatusFailed
+			plan.Error = ethconnecterrors.Errorf(ethconnecterrors.DeployPlanStepFailed, step.Name, err).Error()
+			break
+		}
+		step.Status = deployPlanStatusCompleted
+		step.Error = ""
+		if err := g.saveDeployPlan(plan); err != nil {
+			log.Errorf("Deploy plan %s: %s", plan.ID, err)
+		}
+	}
+	plan.Status = status
+	if err := g.saveDeployPlan(plan); err != nil {
+		log.Errorf("Deploy plan %s: %s", plan.ID, err)
+	}
+	log.Infof("Deploy plan %s: %s", plan.ID, plan.Status)
+}
+
+func (g *smartContractGW) runDeployPlanStep(ctx context.Context, plan *deployPlan, step *deployPlanStep, steps map[string]*deployPlanStep) error {
+	from := step.From
+	if from == "" {
+		from = plan.From
+	}
+	params := resolveDeployPlanRefs(step.Params, steps).([]interface{})
+	responder := &deployPlanResponder{done: make(chan struct{})}
+
+	if step.isDeploy() {
+		g.idxLock.Lock()
+		deployMsg, _, err := g.loadDeployMsgByID(step.ABI)
+		g.idxLock.Unlock()
+		if err != nil {
+			return err
+		}
+		if err = g.checkContractQuota(plan.Tenant); err != nil {
+			return err
+		}
+		deployMsg.Headers.MsgType = messages.MsgTypeDeployContract
+		deployMsg.From = from
+		deployMsg.Gas = step.Gas
+		deployMsg.Value = step.Value
+		deployMsg.Parameters = params
+		deployMsg.RegisterAs = step.RegisterAs
+		deployMsg.RegisterEnvironment = plan.Environment
+		if plan.Tenant != "" {
+			if deployMsg.Headers.Context == nil {
+				deployMsg.Headers.Context = make(map[string]interface{})
+			}
+			deployMsg.Headers.Context[tenantContextKey] = plan.Tenant
+		}
+		g.r2e.syncDispatcher.DispatchDeployContractSync(ctx, deployMsg, responder)
+	} else {
+		abi, addr, err := g.deployPlanTarget(plan, step, steps)
+		if err != nil {
+			return err
+		}
+		msg := &messages.SendTransaction{}
+		msg.Headers.MsgType = messages.MsgTypeSendTransaction
+		msg.Method = findDeployPlanMethod(abi, step.Method, len(params))
+		msg.Events = abiEvents(abi)
+		msg.Errors = eth.ErrorABIs(abi)
+		msg.To = addr
+		msg.From = from
+		msg.Gas = step.Gas
+		msg.Value = step.Value
+		msg.Parameters = params
+		g.r2e.syncDispatcher.DispatchSendTransactionSync(ctx, msg, responder)
+	}
+	<-responder.done
+
+	if receipt := responder.receipt; receipt != nil && receipt.TransactionHash != nil {
+		step.TransactionHash = receipt.TransactionHash.Hex()
+	}
+	if responder.err != nil {
+		return responder.err
+	}
+	if step.isDeploy() {
+		if responder.receipt.ContractAddress == nil {
+			return ethconnecterrors.Errorf(ethconnecterrors.RESTGatewayPostDeployMissingAddress, step.TransactionHash)
+		}
+		step.ContractAddress = strings.ToLower(responder.receipt.ContractAddress.Hex())
+		return g.PostDeploy(responder.receipt)
+	}
+	return nil
+}
+
+// executeDeployPlan runs a plan, waiting for it to finish if fly-sync is set. Otherwise the
+// plan runs in the background, with the identity of the request that started it
+func (g *smartContractGW) executeDeployPlan(res http.ResponseWriter, req *http.Request, plan *deployPlan) {
+	isSync := strings.ToLower(getFlyParam("sync", req, true)) == "true"
+	ctx := req.Context()
+	if !isSync {
+		var err error
+		ctx = context.Background()
+		if auth.IsSecurityModuleEnabled() {
+			if ctx, err = auth.WithAuthContext(ctx, auth.GetAccessToken(req.Context())); err != nil {
+				g.gatewayErrReply(res, req, err, 401)
+				return
+			}
+		}
+	}
+	started, err := g.startDeployPlan(plan)
+	if err != nil {
+		g.gatewayErrReply(res, req, err, 500)
+		return
+	} else if !started {
+		g.gatewayErrReply(res, req, ethconnecterrors.Errorf(ethconnecterrors.DeployPlanRunning, plan.ID), 409)
+		return
+	}
+	status := 202
+	if isSync {
+		g.runDeployPlan(ctx, plan)
+		status = 200
+		if plan.Status == deployPlanStatusFailed {
+			status = 500
+		}
+	} else {
+		go g.runDeployPlan(ctx, plan)
+		// The plan is copied for the response, as it is updated by the goroutine
+		planBytes, _ := json.Marshal(plan)
+		plan = &deployPlan{}
+		json.Unmarshal(planBytes, plan)
+	}
+	g.deployPlanReply(res, req, plan, status)
+}
+
+func (g *smartContractGW) deployPlanReply(res http.ResponseWriter, req *http.Request, retval interface{}, status int) {
+	log.Infof("<-- %s %s [%d]", req.Method, req.URL, status)
+	res.Header().Set("Content-Type", "application/json")
+	res.WriteHeader(status)
+	enc := json.NewEncoder(res)
+	enc.SetIndent("", "  ")
+	enc.Encode(retval)
+}
+
+// createDeployPlan validates and stores a plan, then runs it
+func (g *smartContractGW) createDeployPlan(res http.ResponseWriter, req *http.Request, params httprouter.Params) {
+	log.Infof("--> %s %s", req.Method, req.URL)
+
+	var plan deployPlan
+	if err := json.NewDecoder(req.Body).Decode(&plan); err != nil {
+		g.gatewayErrReply(res, req, ethconnecterrors.Errorf(ethconnecterrors.DeployPlanInvalid, err), 400)
+		return
+	}
+	plan.ID = utils.UUIDv4()
+	plan.CreatedISO8601 = time.Now().UTC().Format(time.RFC3339)
+	plan.Tenant = auth.GetTenant(req.Context())
+	plan.Status = deployPlanStatusPending
+	plan.Error = ""
+	if err := g.validateDeployPlan(&plan); err != nil {
+		g.gatewayErrReply(res, req, err, 400)
+		return
+	}
+	g.executeDeployPlan(res, req, &plan)
+}
+
+// resumeDeployPlan runs the steps of a plan that have not completed
+func (g *smartContractGW) resumeDeployPlan(res http.ResponseWriter, req *http.Request, params httprouter.Params) {
+	log.Infof("--> %s %s", req.Method, req.URL)
+
+	plan, err := g.loadDeployPlan(params.ByName("id"))
+	if err != nil {
+		g.gatewayErrReply(res, req, err, 404)
+		return
+	}
+	if plan.Status == deployPlanStatusCompleted {
+		g.gatewayErrReply(res, req, ethconnecterrors.Errorf(ethconnecterrors.DeployPlanCompleted, plan.ID), 409)
+		return
+	}
+	g.executeDeployPlan(res, req, plan)
+}
+
+func (g *smartContractGW) listDeployPlans(res http.ResponseWriter, req *http.Request, params httprouter.Params) {
+	log.Infof("--> %s %s", req.Method, req.URL)
+
+	entries, err := g.store.list(registryKindDeployPlan)
+	if err != nil {
+		g.gatewayErrReply(res, req, err, 500)
+		return
+	}
+	plans := make([]*deployPlan, 0, len(entries))
+	for _, entry := range entries {
+		plan, err := g.loadDeployPlan(entry.ID)
+		if err != nil {
+			log.Warnf("Failed to load deploy plan %s: %s", entry.ID, err)
+			continue
+		}
+		plans = append(plans, plan)
+	}
+	sort.Slice(plans, func(i, j int) bool {
+		return plans[i].IsLessThan(plans[i], plans[j])
+	})
+	g.deployPlanReply(res, req, plans, 200)
+}
+
+func (g *smartContractGW) getDeployPlan(res http.ResponseWriter, req *http.Request, params httprouter.Params) {
+	log.Infof("--> %s %s", req.Method, req.URL)
+
+	plan, err := g.loadDeployPlan(params.ByName("id"))
+	if err != nil {
+		g.gatewayErrReply(res, req, err, 404)
+		return
+	}
+	g.deployPlanReply(res, req, plan, 200)
+}
+
+// deleteDeployPlan removes the record of a plan. The contracts it deployed are not affected
+func (g *smartContractGW) deleteDeployPlan(res http.ResponseWriter, req *http.Request, params httprouter.Params) {
+	log.Infof("--> %s %s", req.Method, req.URL)
+
+	id := params.ByName("id")
+	if _, err := g.loadDeployPlan(id); err != nil {
+		g.gatewayErrReply(res, req, err, 404)
+		return
+	}
+	if g.isDeployPlanRunning(id) {
+		g.gatewayErrReply(res, req, ethconnecterrors.Errorf(ethconnecterrors.DeployPlanRunning, id), 409)
+		return
+	}
+	if err := g.store.delete(registryKindDeployPlan, id); err != nil {
+		g.gatewayErrReply(res, req, err, 500)
+		return
+	}
+	status := 204
+	log.Infof("<-- %s %s [%d]", req.Method, req.URL, status)
+	res.WriteHeader(status)
+}
@@ -0,0 +1,296 @@
+// Copyright 2021 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package contracts
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http/httptest"
+	"path"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/kaleido-io/ethconnect/internal/ethbind"
+	"github.com/kaleido-io/ethconnect/internal/messages"
+	"github.com/kaleido-io/ethconnect/internal/tx"
+	"github.com/stretchr/testify/assert"
+)
+
+// planDispatcher mines each transaction in turn, deploying contracts at sequential
+// addresses, and fails the transactions numbered in failAt
+type planDispatcher struct {
+	lock   sync.Mutex
+	deploy []*messages.DeployContract
+	send   []*messages.SendTransaction
+	count  int
+	failAt map[int]bool
+}
+
+func (d *planDispatcher) receipt(msgID string, deploy bool) (*messages.TransactionReceipt, error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.count++
+	if d.failAt[d.count] {
+		return nil, fmt.Errorf("pop")
+	}
+	txHash := ethbind.API.HexToHash(fmt.Sprintf("0x%064x", d.count))
+	receipt := &messages.TransactionReceipt{TransactionHash: &txHash}
+	receipt.Headers.MsgType = messages.MsgTypeTransactionSuccess
+	receipt.Headers.ReqID = msgID
+	if deploy {
+		addr := ethbind.API.HexToAddress(fmt.Sprintf("0x%040x", d.count))
+		receipt.ContractAddress = &addr
+	}
+	return receipt, nil
+}
+
+func (d *planDispatcher) DispatchSendTransactionSync(ctx context.Context, msg *messages.SendTransaction, replyProcessor rest2EthReplyProcessor) {
+	d.send = append(d.send, msg)
+	if receipt, err := d.receipt(msg.Headers.ID, false); err != nil {
+		replyProcessor.ReplyWithError(err)
+	} else {
+		replyProcessor.ReplyWithReceipt(receipt)
+	}
+}
+
+func (d *planDispatcher) DispatchDeployContractSync(ctx context.Context, msg *messages.DeployContract, replyProcessor rest2EthReplyProcessor) {
+	d.deploy = append(d.deploy, msg)
+	if receipt, err := d.receipt(msg.Headers.ID, true); err != nil {
+		replyProcessor.ReplyWithError(err)
+	} else {
+		receipt.RegisterAs = msg.RegisterAs
+		receipt.RegisterEnvironment = msg.RegisterEnvironment
+		replyProcessor.ReplyWithReceipt(receipt)
+	}
+}
+
+func newTestDeployPlanGW(t *testing.T, dir string) (*smartContractGW, *planDispatcher, *httprouter.Router) {
+	deployMsg := newTestPrecompiledDeployMsg(t).DeployContract
+	deployMsg.Headers.ID = "abi1"
+	deployBytes, _ := json.Marshal(&deployMsg)
+	ioutil.WriteFile(path.Join(dir, "abi_abi1.deploy.json"), deployBytes, 0644)
+
+	s, err := NewSmartContractGateway(
+		&SmartContractGatewayConf{
+			StoragePath: dir,
+			BaseURL:     "http://localhost/api/v1",
+		},
+		&tx.TxnProcessorConf{},
+		nil, nil, nil, nil,
+	)
+	assert.NoError(t, err)
+	scgw := s.(*smartContractGW)
+	dispatcher := &planDispatcher{failAt: map[int]bool{}}
+	scgw.r2e.syncDispatcher = dispatcher
+	router := &httprouter.Router{}
+	scgw.AddRoutes(router)
+	return scgw, dispatcher, router
+}
+
+func testDeployPlanRequest(router *httprouter.Router, method, path string, body interface{}) (int, *deployPlan, string) {
+	var reqBody []byte
+	if body != nil {
+		reqBody, _ = json.Marshal(body)
+	}
+	req := httptest.NewRequest(method, path, bytes.NewReader(reqBody))
+	res := httptest.NewRecorder()
+	router.ServeHTTP(res, req)
+	var plan deployPlan
+	json.Unmarshal(res.Body.Bytes(), &plan)
+	return res.Code, &plan, res.Body.String()
+}
+
+var testDeployPlan = map[string]interface{}{
+	"name": "exchange",
+	"from": "0x66c5fe653e7a9ebb628a6d40f0452d1e358baee8",
+	"steps": []interface{}{
+		map[string]interface{}{"name": "token", "abi": "abi1", "params": []interface{}{1, "token"}, "registerAs": "token"},
+		map[string]interface{}{"name": "exchange", "abi": "abi1", "params": []interface{}{2, "${token.address}"}},
+		map[string]interface{}{"name": "link", "contract": "${exchange.address}", "method": "set", "params": []interface{}{3, "${token.transactionHash}"}},
+	},
+}
+
+func TestDeployPlanSync(t *testing.T) {
+	assert := assert.New(t)
+	dir := tempdir()
+	defer cleanup(dir)
+	scgw, dispatcher, router := newTestDeployPlanGW(t, dir)
+
+	status, plan, _ := testDeployPlanRequest(router, "POST", "/deployplans?fly-sync", testDeployPlan)
+	assert.Equal(200, status)
+	assert.Equal(deployPlanStatusCompleted, plan.Status)
+	assert.Equal("0x0000000000000000000000000000000000000001", plan.Steps[0].ContractAddress)
+	assert.Equal("0x0000000000000000000000000000000000000002", plan.Steps[1].ContractAddress)
+	assert.Equal(fmt.Sprintf("0x%064x", 3), plan.Steps[2].TransactionHash)
+
+	// The references are replaced with the results of the earlier steps
+	assert.Equal(2, len(dispatcher.deploy))
+	assert.Equal("0x0000000000000000000000000000000000000001", dispatcher.deploy[1].Parameters[1])
+	assert.Equal("token", dispatcher.deploy[0].RegisterAs)
+	send := dispatcher.send[0]
+	assert.Equal("0x0000000000000000000000000000000000000002", send.To)
+	assert.Equal("set", send.Method.Name)
+	assert.Equal(fmt.Sprintf("0x%064x", 1), send.Parameters[1])
+	assert.Equal(1, len(send.Events))
+
+	// The deployed contracts are in the registry
+	addr, err := scgw.resolveContractAddr("token", "")
+	assert.NoError(err)
+	assert.Equal("0000000000000000000000000000000000000001", addr)
+
+	// A later plan can call a registered name
+	status, plan, _ = testDeployPlanRequest(router, "POST", "/deployplans?fly-sync", map[string]interface{}{
+		"steps": []interface{}{
+			map[string]interface{}{"name": "set", "contract": "token", "method": "set", "params": []interface{}{4, "x"}, "from": "0xaa"},
+		},
+	})
+	assert.Equal(200, status)
+	assert.Equal("0x0000000000000000000000000000000000000001", dispatcher.send[1].To)
+	assert.Equal("0xaa", dispatcher.send[1].From)
+
+	var plans []*deployPlan
+	req := httptest.NewRequest("GET", "/deployplans", nil)
+	res := httptest.NewRecorder()
+	router.ServeHTTP(res, req)
+	assert.Equal(200, res.Code)
+	json.NewDecoder(res.Body).Decode(&plans)
+	assert.Equal(2, len(plans))
+
+	status, loaded, _ := testDeployPlanRequest(router, "GET", "/deployplans/"+plan.ID, nil)
+	assert.Equal(200, status)
+	assert.Equal(deployPlanStatusCompleted, loaded.Status)
+}
+
+func TestDeployPlanFailAndResume(t *testing.T) {
+	assert := assert.New(t)
+	dir := tempdir()
+	defer cleanup(dir)
+	_, dispatcher, router := newTestDeployPlanGW(t, dir)
+	dispatcher.failAt[2] = true
+
+	status, plan, _ := testDeployPlanRequest(router, "POST", "/deployplans?fly-sync", testDeployPlan)
+	assert.Equal(500, status)
+	assert.Equal(deployPlanStatusFailed, plan.Status)
+	assert.Equal("Step 'exchange' failed: pop", plan.Error)
+	assert.Equal(deployPlanStatusCompleted, plan.Steps[0].Status)
+	assert.Equal(deployPlanStatusFailed, plan.Steps[1].Status)
+	assert.Equal(deployPlanStatusPending, plan.Steps[2].Status)
+
+	// Resuming retries the failed step, without repeating the completed one
+	status, plan, _ = testDeployPlanRequest(router, "POST", "/deployplans/"+plan.ID+"/resume?fly-sync", nil)
+	assert.Equal(200, status)
+	assert.Equal(deployPlanStatusCompleted, plan.Status)
+	assert.Empty(plan.Error)
+	assert.Equal(3, len(dispatcher.deploy))
+	assert.Equal("0x0000000000000000000000000000000000000003", plan.Steps[1].ContractAddress)
+	assert.Equal("0x0000000000000000000000000000000000000003", dispatcher.send[0].To)
+
+	status, _, body := testDeployPlanRequest(router, "POST", "/deployplans/"+plan.ID+"/resume", nil)
+	assert.Equal(409, status)
+	assert.Regexp("has already completed", body)
+
+	status, _, _ = testDeployPlanRequest(router, "DELETE", "/deployplans/"+plan.ID, nil)
+	assert.Equal(204, status)
+	status, _, body = testDeployPlanRequest(router, "GET", "/deployplans/"+plan.ID, nil)
+	assert.Equal(404, status)
+	assert.Regexp("not found", body)
+	status, _, _ = testDeployPlanRequest(router, "DELETE", "/deployplans/"+plan.ID, nil)
+	assert.Equal(404, status)
+	status, _, _ = testDeployPlanRequest(router, "POST", "/deployplans/"+plan.ID+"/resume", nil)
+	assert.Equal(404, status)
+}
+
+func TestDeployPlanAsync(t *testing.T) {
+	assert := assert.New(t)
+	dir := tempdir()
+	defer cleanup(dir)
+	scgw, _, router := newTestDeployPlanGW(t, dir)
+
+	status, plan, _ := testDeployPlanRequest(router, "POST", "/deployplans", testDeployPlan)
+	assert.Equal(202, status)
+	for scgw.isDeployPlanRunning(plan.ID) {
+		time.Sleep(1 * time.Millisecond)
+	}
+	status, plan, _ = testDeployPlanRequest(router, "GET", "/deployplans/"+plan.ID, nil)
+	assert.Equal(200, status)
+	assert.Equal(deployPlanStatusCompleted, plan.Status)
+
+	// A running plan cannot be resumed or deleted
+	scgw.runningPlans[plan.ID] = true
+	status, _, _ = testDeployPlanRequest(router, "DELETE", "/deployplans/"+plan.ID, nil)
+	assert.Equal(409, status)
+	plan.Status = deployPlanStatusFailed
+	scgw.saveDeployPlan(plan)
+	status, _, body := testDeployPlanRequest(router, "POST", "/deployplans/"+plan.ID+"/resume", nil)
+	assert.Equal(409, status)
+	assert.Regexp("is running", body)
+}
+
+func TestDeployPlanValidation(t *testing.T) {
+	assert := assert.New(t)
+	dir := tempdir()
+	defer cleanup(dir)
+	_, dispatcher, router := newTestDeployPlanGW(t, dir)
+
+	deploy := func(name string) map[string]interface{} {
+		return map[string]interface{}{"name": name, "abi": "abi1", "from": "0xaa"}
+	}
+	for _, test := range []struct {
+		plan interface{}
+		err  string
+	}{
+		{"not a plan", "Invalid deploy plan"},
+		{map[string]interface{}{}, "must have at least one step"},
+		{map[string]interface{}{"steps": []interface{}{map[string]interface{}{"name": "bad name"}}}, "Step 0 of the deploy plan must have a name"},
+		{map[string]interface{}{"steps": []interface{}{deploy("a"), deploy("a")}}, "Duplicate step name 'a'"},
+		{map[string]interface{}{"steps": []interface{}{map[string]interface{}{"name": "a", "from": "0xaa"}}}, "Step 'a' must specify either an abi"},
+		{map[string]interface{}{"steps": []interface{}{map[string]interface{}{"name": "a", "abi": "abi1"}}}, "Step 'a' has no 'from' address"},
+		{map[string]interface{}{"steps": []interface{}{map[string]interface{}{"name": "a", "abi": "unknown", "from": "0xaa"}}}, "No ABI found with ID unknown"},
+		{map[string]interface{}{"steps": []interface{}{map[string]interface{}{"name": "a", "abi": "wellknown-erc20", "from": "0xaa"}}}, "has no bytecode"},
+		{map[string]interface{}{"steps": []interface{}{
+			map[string]interface{}{"name": "a", "abi": "abi1", "from": "0xaa", "params": []interface{}{[]interface{}{"${b.address}"}}},
+			deploy("b"),
+		}}, "Step 'a' refers to 'b.address'"},
+		{map[string]interface{}{"steps": []interface{}{
+			deploy("a"),
+			map[string]interface{}{"name": "b", "contract": "${a.address}", "method": "set", "from": "0xaa"},
+			map[string]interface{}{"name": "c", "contract": "${b.address}", "method": "set", "from": "0xaa"},
+		}}, "Step 'c' refers to 'b.address'"},
+		{map[string]interface{}{"steps": []interface{}{
+			deploy("a"),
+			map[string]interface{}{"name": "b", "contract": "${a.address}", "method": "unknown", "from": "0xaa"},
+		}}, "Method 'unknown' is not declared in the ABI of the contract for step 'b'"},
+		{map[string]interface{}{"steps": []interface{}{
+			map[string]interface{}{"name": "a", "contract": "unknown", "method": "set", "from": "0xaa"},
+		}}, "Failed to find installed contract address for 'unknown'"},
+		{map[string]interface{}{"steps": []interface{}{
+			map[string]interface{}{"name": "a", "contract": "0x0123456789abcdef0123456789abcdef01234567", "method": "set", "from": "0xaa"},
+		}}, "No contract instance registered with address 0123456789abcdef0123456789abcdef01234567"},
+		{map[string]interface{}{"steps": []interface{}{
+			map[string]interface{}{"name": "a", "abi": "abi1", "from": "0xaa", "registerAs": "token"},
+			map[string]interface{}{"name": "b", "abi": "abi1", "from": "0xaa", "registerAs": "token"},
+		}}, "Step 'b' registers 'token', which is already registered by an earlier step"},
+	} {
+		status, _, body := testDeployPlanRequest(router, "POST", "/deployplans?fly-sync", test.plan)
+		assert.Equal(400, status)
+		assert.Regexp(test.err, body)
+	}
+	assert.Zero(dispatcher.count)
+}
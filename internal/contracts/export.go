@@ -0,0 +1,93 @@
+// Copyright 2021 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package contracts
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/julienschmidt/httprouter"
+	ethconnecterrors "github.com/kaleido-io/ethconnect/internal/errors"
+	"github.com/kaleido-io/ethconnect/internal/ethbind"
+	"github.com/kaleido-io/ethconnect/internal/events"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	exportMethod     = "events"
+	exportSubcommand = "export"
+)
+
+// exportEvents serves GET /contracts/:address/events/export, streaming the historical events of
+// the contract decoded against its ABI. The query parameters are fromBlock, toBlock, format
+// (ndjson or csv), event to export a single event by name, and pageSize in blocks
+func (r *rest2eth) exportEvents(res http.ResponseWriter, req *http.Request, params httprouter.Params) {
+	if params.ByName("method") != exportMethod || params.ByName("subcommand") != exportSubcommand {
+		r.restErrReply(res, req, ethconnecterrors.Errorf(ethconnecterrors.RESTGatewayMethodNotDeclared, params.ByName("method")+"/"+params.ByName("subcommand"), params.ByName("address")), 404)
+		return
+	}
+	var c restCmd
+	abi, validAddress, err := r.resolveABI(res, req, params, &c, params.ByName("address"), false)
+	if err != nil {
+		return
+	}
+	if !validAddress {
+		r.restErrReply(res, req, ethconnecterrors.Errorf(ethconnecterrors.RESTGatewayInvalidToAddress), 404)
+		return
+	}
+
+	query := req.URL.Query()
+	spec := &events.EventExport{
+		Address:   ethbind.API.HexToAddress(c.addr),
+		FromBlock: query.Get("fromBlock"),
+		ToBlock:   query.Get("toBlock"),
+	}
+	if pageSize := query.Get("pageSize"); pageSize != "" {
+		spec.PageSize, _ = strconv.ParseInt(pageSize, 10, 64)
+	}
+	eventName := query.Get("event")
+	for _, element := range abi {
+		if element.Type != "event" || element.Anonymous || (eventName != "" && element.Name != eventName) {
+			continue
+		}
+		event, err := ethbind.API.ABIElementMarshalingToABIEvent(&element)
+		if err != nil {
+			r.restErrReply(res, req, ethconnecterrors.Errorf(ethconnecterrors.RESTGatewayEventABIInvalid, element.Name, err), 400)
+			return
+		}
+		spec.Events = append(spec.Events, event)
+	}
+	if len(spec.Events) == 0 {
+		r.restErrReply(res, req, ethconnecterrors.Errorf(ethconnecterrors.RESTGatewayEventNotDeclared, eventName), 404)
+		return
+	}
+
+	if err := spec.ResolveRange(req.Context(), r.rpc); err != nil {
+		r.restErrReply(res, req, err, 400)
+		return
+	}
+	w, err := events.NewEventExportWriter(query.Get("format"), res)
+	if err != nil {
+		r.restErrReply(res, req, err, 400)
+		return
+	}
+	res.Header().Set("Content-Type", w.ContentType())
+	count, err := events.ExportEvents(req.Context(), r.rpc, spec, w)
+	if err != nil && !w.Started() {
+		r.restErrReply(res, req, err, 500)
+		return
+	}
+	log.Infof("<-- %s %s [%d]: %d events", req.Method, req.URL, 200, count)
+}
@@ -0,0 +1,133 @@
+// Copyright 2021 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package contracts
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	ethbinding "github.com/kaleido-io/ethbinding/pkg"
+	"github.com/kaleido-io/ethconnect/internal/eth"
+	"github.com/kaleido-io/ethconnect/internal/messages"
+	"github.com/stretchr/testify/assert"
+)
+
+const testExportAddr = "0x14c2d07516b7678597068f81d91b3124471703e8"
+
+const testExportABI = `[
+	{"type":"event","name":"Changed","inputs":[
+		{"name":"from","type":"address","indexed":true},
+		{"name":"i","type":"int64","indexed":true},
+		{"name":"s","type":"string","indexed":true},
+		{"name":"h","type":"bytes32"},
+		{"name":"m","type":"string"}
+	]},
+	{"type":"event","name":"Other","inputs":[]},
+	{"type":"function","name":"get","stateMutability":"view","inputs":[],"outputs":[{"name":"","type":"uint256"}]}
+]`
+
+func newTestExportREST2Eth(t *testing.T, filters *[]map[string]interface{}) (*rest2eth, func(path string) (int, string, string)) {
+	var abi ethbinding.ABIMarshaling
+	assert.NoError(t, json.Unmarshal([]byte(testExportABI), &abi))
+	logsBytes, err := ioutil.ReadFile("../../test/simplevents_logs.json")
+	assert.NoError(t, err)
+	abiLoader := &mockABILoader{
+		deployMsg:              &messages.DeployContract{ABI: abi},
+		registeredContractAddr: strings.TrimPrefix(testExportAddr, "0x"),
+	}
+	r, _, router := newTestREST2EthCustomAbiLoader(&mockREST2EthDispatcher{}, abiLoader)
+	r.rpc = eth.NewMockRPCClientForSync(nil, func(method string, res interface{}, args ...interface{}) {
+		switch method {
+		case "eth_blockNumber":
+			(*(res.(*ethbinding.HexBigInt))).ToInt().SetInt64(2000)
+		case "eth_getLogs":
+			filterBytes, _ := json.Marshal(args[0])
+			var filter map[string]interface{}
+			json.Unmarshal(filterBytes, &filter)
+			*filters = append(*filters, filter)
+			if len(*filters) == 1 {
+				json.Unmarshal(logsBytes, res)
+			}
+		}
+	})
+	return r, func(path string) (int, string, string) {
+		req := httptest.NewRequest("GET", path, nil)
+		res := httptest.NewRecorder()
+		router.ServeHTTP(res, req)
+		return res.Code, res.Header().Get("Content-Type"), res.Body.String()
+	}
+}
+
+func TestExportContractEvents(t *testing.T) {
+	assert := assert.New(t)
+	var filters []map[string]interface{}
+	_, get := newTestExportREST2Eth(t, &filters)
+
+	status, contentType, body := get("/contracts/" + testExportAddr + "/events/export?fromBlock=100")
+	assert.Equal(200, status, body)
+	assert.Equal("application/x-ndjson", contentType)
+	lines := strings.Split(strings.TrimSpace(body), "\n")
+	assert.Len(lines, 3)
+	var event map[string]interface{}
+	assert.NoError(json.Unmarshal([]byte(lines[2]), &event))
+	assert.Equal("Changed(address,int64,string,bytes32,string)", event["signature"])
+
+	// Both events of the ABI are read, a page of blocks at a time up to the head of the chain
+	assert.Len(filters, 2)
+	assert.Equal("0x64", filters[0]["fromBlock"])
+	assert.Equal("0x44b", filters[0]["toBlock"])
+	assert.Equal("0x7d0", filters[1]["toBlock"])
+	assert.Len(filters[0]["topics"].([]interface{})[0], 2)
+
+	// A single event by name, as CSV, from a registered name
+	filters = nil
+	status, contentType, body = get("/contracts/mycontract/events/export?event=Changed&format=csv&fromBlock=0&toBlock=0x10")
+	assert.Equal(200, status, body)
+	assert.Equal("text/csv", contentType)
+	assert.Len(strings.Split(strings.TrimSpace(body), "\n"), 4)
+	assert.Len(filters, 1)
+	assert.Len(filters[0]["topics"].([]interface{})[0], 1)
+}
+
+func TestExportContractEventsErrors(t *testing.T) {
+	assert := assert.New(t)
+	var filters []map[string]interface{}
+	r, get := newTestExportREST2Eth(t, &filters)
+
+	status, _, body := get("/contracts/" + testExportAddr + "/events/other")
+	assert.Equal(404, status)
+	assert.Regexp("Method or Event 'events/other' is not declared", body)
+
+	status, _, body = get("/contracts/" + testExportAddr + "/events/export?event=Missing")
+	assert.Equal(404, status)
+	assert.Regexp("Event 'Missing' is not declared in the ABI", body)
+
+	status, _, body = get("/contracts/" + testExportAddr + "/events/export?fromBlock=10&toBlock=5")
+	assert.Equal(400, status)
+	assert.Regexp("Export fromBlock 10 is after toBlock 5", body)
+
+	status, _, body = get("/contracts/" + testExportAddr + "/events/export?format=xml")
+	assert.Equal(400, status)
+	assert.Regexp("Unknown export format 'xml'", body)
+
+	r.rpc = eth.NewMockRPCClientForSync(fmt.Errorf("pop"), nil)
+	status, _, body = get("/contracts/" + testExportAddr + "/events/export?toBlock=10")
+	assert.Equal(500, status)
+	assert.Regexp("pop", body)
+}
@@ -0,0 +1,492 @@
+// Copyright 2021 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package contracts
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/kaleido-io/ethconnect/internal/auth"
+	ethconnecterrors "github.com/kaleido-io/ethconnect/internal/errors"
+	"github.com/kaleido-io/ethconnect/internal/events"
+	"github.com/kaleido-io/ethconnect/internal/graphql"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// GraphQLPath is the path of the GraphQL query endpoint over the registry and event streams
+	GraphQLPath = "/graphql"
+	// GraphQLSchemaPath returns the GraphQL schema, in the schema definition language
+	GraphQLSchemaPath = "/graphql/schema"
+)
+
+// GraphQLConf enables the read-only GraphQL endpoint, that queries the contract
+// registry, event streams and subscriptions in a single round-trip
+type GraphQLConf struct {
+	Enabled bool `json:"enabled,omitempty"`
+}
+
+type graphqlArgs = map[string]interface{}
+
+// graphqlEnvironment is one entry of the environment addresses of a registered name
+type graphqlEnvironment struct {
+	Name    string
+	Address string
+}
+
+func graphqlScalar(name, typeName, description string, get func(source interface{}) interface{}) *graphql.Field {
+	return &graphql.Field{
+		Name:        name,
+		Type:        typeName,
+		Description: description,
+		Resolve: func(ctx context.Context, source interface{}, args graphqlArgs) (interface{}, error) {
+			return get(source), nil
+		},
+	}
+}
+
+// newGraphQLSchema builds the schema over the local registry, and the subscription manager.
+// Contracts link to their ABI and the subscriptions that filter on their address, and
+// subscriptions link to their stream, so a dashboard can fetch them in one request
+func (g *smartContractGW) newGraphQLSchema() *graphql.Schema {
+	contractType := &graphql.Object{Name: "Contract", Description: "A contract instance in the local registry"}
+	abiType := &graphql.Object{Name: "ABI", Description: "An ABI in the local registry"}
+	streamType := &graphql.Object{Name: "Stream", Description: "An event stream"}
+	subscriptionType := &graphql.Object{Name: "Subscription", Description: "An event subscription"}
+	environmentType := &graphql.Object{Name: "Environment", Description: "The address a registered name has in one environment"}
+
+	environmentType.Fields = []*graphql.Field{
+		graphqlScalar("name", "String!", "", func(s interface{}) interface{} { return s.(*graphqlEnvironment).Name }),
+		graphqlScalar("address", "String!", "", func(s interface{}) interface{} { return s.(*graphqlEnvironment).Address }),
+	}
+
+	contractType.Fields = []*graphql.Field{
+		graphqlScalar("address", "String!", "", func(s interface{}) interface{} { return s.(*contractInfo).Address }),
+		graphqlScalar("registeredAs", "String", "", func(s interface{}) interface{} { return s.(*contractInfo).RegisteredAs }),
+		{
+			Name:        "environments",
+			Type:        "[Environment!]!",
+			Description: "The addresses the registered name has in each environment, sorted by environment",
+			Object:      environmentType,
+			Resolve: func(ctx context.Context, source interface{}, args graphqlArgs) (interface{}, error) {
+				return graphqlEnvironments(source.(*contractInfo).Environments), nil
+			},
+		},
+		graphqlScalar("path", "String!", "", func(s interface{}) interface{} { return s.(*contractInfo).Path }),
+		graphqlScalar("openapi", "String!", "", func(s interface{}) interface{} { return s.(*contractInfo).SwaggerURL }),
+		graphqlScalar("created", "String!", "", func(s interface{}) interface{} { return s.(*contractInfo).CreatedISO8601 }),
+		{
+			Name:   "abi",
+			Type:   "ABI",
+			Object: abiType,
+			Resolve: func(ctx context.Context, source interface{}, args graphqlArgs) (interface{}, error) {
+				return g.graphqlABI(source.(*contractInfo).ABI), nil
+			},
+		},
+		{
+			Name:        "subscriptions",
+			Type:        "[Subscription!]!",
+			Description: "The subscriptions filtered to the address of the contract",
+			Object:      subscriptionType,
+			Resolve: func(ctx context.Context, source interface{}, args graphqlArgs) (interface{}, error) {
+				address := source.(*contractInfo).Address
+				return g.graphqlSubscriptions(ctx, func(sub *events.SubscriptionInfo) bool {
+					for _, addr := range sub.Filter.Addresses {
+						if normalizeAddress(addr.Hex()) == address {
+							return true
+						}
+					}
+					return false
+				})
+			},
+		},
+	}
+
+	abiType.Fields = []*graphql.Field{
+		graphqlScalar("id", "String!", "", func(s interface{}) interface{} { return s.(*abiInfo).ID }),
+		graphqlScalar("name", "String!", "", func(s interface{}) interface{} { return s.(*abiInfo).Name }),
+		graphqlScalar("description", "String", "", func(s interface{}) interface{} { return s.(*abiInfo).Description }),
+		graphqlScalar("deployable", "Boolean!", "", func(s interface{}) interface{} { return s.(*abiInfo).Deployable }),
+		graphqlScalar("compilerVersion", "String", "", func(s interface{}) interface{} { return s.(*abiInfo).CompilerVersion }),
+		graphqlScalar("path", "String!", "", func(s interface{}) interface{} { return s.(*abiInfo).Path }),
+		graphqlScalar("openapi", "String!", "", func(s interface{}) interface{} { return s.(*abiInfo).SwaggerURL }),
+		graphqlScalar("created", "String!", "", func(s interface{}) interface{} { return s.(*abiInfo).CreatedISO8601 }),
+		{
+			Name:        "methods",
+			Type:        "[String!]!",
+			Description: "The names of the functions in the ABI",
+			Resolve: func(ctx context.Context, source interface{}, args graphqlArgs) (interface{}, error) {
+				return g.graphqlABIElements(source.(*abiInfo).ID, "function")
+			},
+		},
+		{
+			Name:        "events",
+			Type:        "[String!]!",
+			Description: "The names of the events in the ABI",
+			Resolve: func(ctx context.Context, source interface{}, args graphqlArgs) (interface{}, error) {
+				return g.graphqlABIElements(source.(*abiInfo).ID, "event")
+			},
+		},
+		{
+			Name:        "contracts",
+			Type:        "[Contract!]!",
+			Description: "The contract instances deployed or registered with the ABI",
+			Object:      contractType,
+			Resolve: func(ctx context.Context, source interface{}, args graphqlArgs) (interface{}, error) {
+				return g.graphqlContracts(source.(*abiInfo).ID), nil
+			},
+		},
+	}
+
+	streamType.Fields = []*graphql.Field{
+		graphqlScalar("id", "String!", "", func(s interface{}) interface{} { return s.(*events.StreamInfo).ID }),
+		graphqlScalar("name", "String", "", func(s interface{}) interface{} { return s.(*events.StreamInfo).Name }),
+		graphqlScalar("type", "String!", "", func(s interface{}) interface{} { return s.(*events.StreamInfo).Type }),
+		graphqlScalar("suspended", "Boolean!", "", func(s interface{}) interface{} { return s.(*events.StreamInfo).Suspended }),
+		graphqlScalar("path", "String!", "", func(s interface{}) interface{} { return s.(*events.StreamInfo).Path }),
+		graphqlScalar("created", "String!", "", func(s interface{}) interface{} { return s.(*events.StreamInfo).CreatedISO8601 }),
+		{
+			Name:   "subscriptions",
+			Type:   "[Subscription!]!",
+			Object: subscriptionType,
+			Resolve: func(ctx context.Context, source interface{}, args graphqlArgs) (interface{}, error) {
+				streamID := source.(*events.StreamInfo).ID
+				return g.graphqlSubscriptions(ctx, func(sub *events.SubscriptionInfo) bool {
+					return sub.Stream == streamID
+				})
+			},
+		},
+	}
+
+	subscriptionType.Fields = []*graphql.Field{
+		graphqlScalar("id", "String!", "", func(s interface{}) interface{} { return s.(*events.SubscriptionInfo).ID }),
+		graphqlScalar("name", "String!", "", func(s interface{}) interface{} { return s.(*events.SubscriptionInfo).Name }),
+		graphqlScalar("type", "String", "", func(s interface{}) interface{} { return s.(*events.SubscriptionInfo).Type }),
+		graphqlScalar("event", "String", "The name of the event subscribed to", func(s interface{}) interface{} {
+			if event := s.(*events.SubscriptionInfo).Event; event != nil {
+				return event.Name
+			}
+			return nil
+		}),
+		graphqlScalar("fromBlock", "String", "", func(s interface{}) interface{} { return s.(*events.SubscriptionInfo).FromBlock }),
+		graphqlScalar("suspended", "Boolean!", "", func(s interface{}) interface{} { return s.(*events.SubscriptionInfo).Suspended }),
+		graphqlScalar("path", "String!", "", func(s interface{}) interface{} { return s.(*events.SubscriptionInfo).Path }),
+		graphqlScalar("created", "String!", "", func(s interface{}) interface{} { return s.(*events.SubscriptionInfo).CreatedISO8601 }),
+		graphqlScalar("addresses", "[String!]!", "The contract addresses the subscription is filtered to", func(s interface{}) interface{} {
+			addresses := []string{}
+			for _, addr := range s.(*events.SubscriptionInfo).Filter.Addresses {
+				addresses = append(addresses, normalizeAddress(addr.Hex()))
+			}
+			return addresses
+		}),
+		{
+			Name:        "contracts",
+			Type:        "[Contract!]!",
+			Description: "The contracts in the local registry the subscription is filtered to",
+			Object:      contractType,
+			Resolve: func(ctx context.Context, source interface{}, args graphqlArgs) (interface{}, error) {
+				contracts := []*contractInfo{}
+				for _, addr := range source.(*events.SubscriptionInfo).Filter.Addresses {
+					if info := g.graphqlContract(addr.Hex()); info != nil {
+						contracts = append(contracts, info)
+					}
+				}
+				return contracts, nil
+			},
+		},
+		{
+			Name:   "stream",
+			Type:   "Stream",
+			Object: streamType,
+			Resolve: func(ctx context.Context, source interface{}, args graphqlArgs) (interface{}, error) {
+				return g.graphqlStream(ctx, source.(*events.SubscriptionInfo).Stream)
+			},
+		},
+	}
+
+	return &graphql.Schema{
+		Query: &graphql.Object{
+			Name: "Query",
+			Fields: []*graphql.Field{
+				{
+					Name:        "contracts",
+					Type:        "[Contract!]!",
+					Description: "The contracts in the local registry, newest first, optionally only those with an ABI",
+					Object:      contractType,
+					Args:        []*graphql.Argument{{Name: "abi", Type: "String"}},
+					Resolve: func(ctx context.Context, source interface{}, args graphqlArgs) (interface{}, error) {
+						abiID, _ := args["abi"].(string)
+						return g.graphqlContracts(abiID), nil
+					},
+				},
+				{
+					Name:        "contract",
+					Type:        "Contract",
+					Description: "A contract by address, or by registered name",
+					Object:      contractType,
+					Args:        []*graphql.Argument{{Name: "address", Type: "String!"}},
+					Resolve: func(ctx context.Context, source interface{}, args graphqlArgs) (interface{}, error) {
+						address := args["address"].(string)
+						if info := g.graphqlContract(address); info != nil {
+							return info, nil
+						}
+						if addrHexNo0x, err := g.resolveContractAddr(address, ""); err == nil {
+							return g.graphqlContract(addrHexNo0x), nil
+						}
+						return nil, nil
+					},
+				},
+				{
+					Name:        "abis",
+					Type:        "[ABI!]!",
+					Description: "The ABIs in the local registry, newest first",
+					Object:      abiType,
+					Resolve: func(ctx context.Context, source interface{}, args graphqlArgs) (interface{}, error) {
+						return g.graphqlABIs(), nil
+					},
+				},
+				{
+					Name:   "abi",
+					Type:   "ABI",
+					Object: abiType,
+					Args:   []*graphql.Argument{{Name: "id", Type: "String!"}},
+					Resolve: func(ctx context.Context, source interface{}, args graphqlArgs) (interface{}, error) {
+						return g.graphqlABI(args["id"].(string)), nil
+					},
+				},
+				{
+					Name:   "streams",
+					Type:   "[Stream!]!",
+					Object: streamType,
+					Resolve: func(ctx context.Context, source interface{}, args graphqlArgs) (interface{}, error) {
+						if err := g.graphqlEventsAuth(ctx); err != nil {
+							return nil, err
+						}
+						streams := g.sm.Streams(ctx)
+						sort.Slice(streams, func(i, j int) bool { return streams[i].ID < streams[j].ID })
+						return streams, nil
+					},
+				},
+				{
+					Name:   "stream",
+					Type:   "Stream",
+					Object: streamType,
+					Args:   []*graphql.Argument{{Name: "id", Type: "String!"}},
+					Resolve: func(ctx context.Context, source interface{}, args graphqlArgs) (interface{}, error) {
+						return g.graphqlStream(ctx, args["id"].(string))
+					},
+				},
+				{
+					Name:        "subscriptions",
+					Type:        "[Subscription!]!",
+					Description: "The subscriptions, optionally only those on a stream",
+					Object:      subscriptionType,
+					Args:        []*graphql.Argument{{Name: "stream", Type: "String"}},
+					Resolve: func(ctx context.Context, source interface{}, args graphqlArgs) (interface{}, error) {
+						streamID, _ := args["stream"].(string)
+						return g.graphqlSubscriptions(ctx, func(sub *events.SubscriptionInfo) bool {
+							return streamID == "" || sub.Stream == streamID
+						})
+					},
+				},
+				{
+					Name:   "subscription",
+					Type:   "Subscription",
+					Object: subscriptionType,
+					Args:   []*graphql.Argument{{Name: "id", Type: "String!"}},
+					Resolve: func(ctx context.Context, source interface{}, args graphqlArgs) (interface{}, error) {
+						if err := g.graphqlEventsAuth(ctx); err != nil {
+							return nil, err
+						}
+						sub, err := g.sm.SubscriptionByID(ctx, args["id"].(string))
+						if err != nil {
+							return nil, nil
+						}
+						return sub, nil
+					},
+				},
+			},
+		},
+	}
+}
+
+func normalizeAddress(addrHex string) string {
+	return strings.TrimPrefix(strings.ToLower(addrHex), "0x")
+}
+
+// graphqlEventsAuth applies the same checks as the REST API for event streams and subscriptions
+func (g *smartContractGW) graphqlEventsAuth(ctx context.Context) error {
+	if g.sm == nil {
+		return errors.New(errEventSupportMissing)
+	}
+	if err := auth.AuthEventStreams(ctx); err != nil {
+		log.Errorf("Unauthorized: %s", err)
+		return ethconnecterrors.Errorf(ethconnecterrors.Unauthorized)
+	}
+	return nil
+}
+
+func (g *smartContractGW) graphqlContract(addrHex string) *contractInfo {
+	g.idxLock.Lock()
+	defer g.idxLock.Unlock()
+	if info, exists := g.contractIndex[normalizeAddress(addrHex)]; exists {
+		return info.(*contractInfo)
+	}
+	return nil
+}
+
+func graphqlEnvironments(environments map[string]string) []*graphqlEnvironment {
+	result := make([]*graphqlEnvironment, 0, len(environments))
+	for name, addr := range environments {
+		result = append(result, &graphqlEnvironment{Name: name, Address: addr})
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Name < result[j].Name })
+	return result
+}
+
+func (g *smartContractGW) graphqlContracts(abiID string) []*contractInfo {
+	g.idxLock.Lock()
+	contracts := make([]*contractInfo, 0, len(g.contractIndex))
+	for _, info := range g.contractIndex {
+		if abiID == "" || info.(*contractInfo).ABI == abiID {
+			contracts = append(contracts, info.(*contractInfo))
+		}
+	}
+	g.idxLock.Unlock()
+	sort.Slice(contracts, func(i, j int) bool {
+		if contracts[i].CreatedISO8601 == contracts[j].CreatedISO8601 {
+			return contracts[i].Address < contracts[j].Address
+		}
+		return contracts[i].CreatedISO8601 > contracts[j].CreatedISO8601
+	})
+	return contracts
+}
+
+func (g *smartContractGW) graphqlABI(id string) *abiInfo {
+	g.idxLock.Lock()
+	defer g.idxLock.Unlock()
+	if info, exists := g.abiIndex[id]; exists {
+		return info.(*abiInfo)
+	}
+	return nil
+}
+
+func (g *smartContractGW) graphqlABIs() []*abiInfo {
+	g.idxLock.Lock()
+	abis := make([]*abiInfo, 0, len(g.abiIndex))
+	for _, info := range g.abiIndex {
+		abis = append(abis, info.(*abiInfo))
+	}
+	g.idxLock.Unlock()
+	sort.Slice(abis, func(i, j int) bool {
+		if abis[i].CreatedISO8601 == abis[j].CreatedISO8601 {
+			return abis[i].ID < abis[j].ID
+		}
+		return abis[i].CreatedISO8601 > abis[j].CreatedISO8601
+	})
+	return abis
+}
+
+// graphqlABIElements returns the names of the functions or events in an ABI, which are
+// loaded from the registry storage as they are not held in the index
+func (g *smartContractGW) graphqlABIElements(id, elementType string) ([]string, error) {
+	g.idxLock.Lock()
+	deployMsg, _, err := g.loadDeployMsgByID(id)
+	g.idxLock.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	names := []string{}
+	for _, element := range deployMsg.ABI {
+		if element.Type == elementType {
+			names = append(names, element.Name)
+		}
+	}
+	return names, nil
+}
+
+func (g *smartContractGW) graphqlStream(ctx context.Context, id string) (*events.StreamInfo, error) {
+	if err := g.graphqlEventsAuth(ctx); err != nil {
+		return nil, err
+	}
+	stream, err := g.sm.StreamByID(ctx, id)
+	if err != nil {
+		return nil, nil
+	}
+	return stream, nil
+}
+
+func (g *smartContractGW) graphqlSubscriptions(ctx context.Context, include func(sub *events.SubscriptionInfo) bool) ([]*events.SubscriptionInfo, error) {
+	if err := g.graphqlEventsAuth(ctx); err != nil {
+		return nil, err
+	}
+	subs := []*events.SubscriptionInfo{}
+	for _, sub := range g.sm.Subscriptions(ctx) {
+		if include(sub) {
+			subs = append(subs, sub)
+		}
+	}
+	sort.Slice(subs, func(i, j int) bool { return subs[i].ID < subs[j].ID })
+	return subs, nil
+}
+
+// graphqlQuery executes a query POSTed as JSON, or passed in the query string of a GET.
+// As with other GraphQL servers, errors resolving fields are returned with a 200 alongside
+// the data, and only requests that could not be executed at all return a 400
+func (g *smartContractGW) graphqlQuery(res http.ResponseWriter, req *http.Request, params httprouter.Params) {
+	log.Infof("--> %s %s", req.Method, req.URL)
+
+	gqlReq := &graphql.Request{}
+	var result *graphql.Response
+	if req.Method == http.MethodGet {
+		query := req.URL.Query()
+		gqlReq.Query = query.Get("query")
+		gqlReq.OperationName = query.Get("operationName")
+		if variables := query.Get("variables"); variables != "" {
+			if err := json.Unmarshal([]byte(variables), &gqlReq.Variables); err != nil {
+				result = graphql.ErrorResponse(ethconnecterrors.Errorf(ethconnecterrors.GraphQLInvalidRequest, err))
+			}
+		}
+	} else if err := json.NewDecoder(req.Body).Decode(gqlReq); err != nil {
+		result = graphql.ErrorResponse(ethconnecterrors.Errorf(ethconnecterrors.GraphQLInvalidRequest, err))
+	}
+	if result == nil {
+		result = g.graphql.Execute(req.Context(), gqlReq)
+	}
+
+	status := 200
+	if result.Data == nil {
+		status = 400
+	}
+	log.Infof("<-- %s %s [%d]", req.Method, req.URL, status)
+	res.Header().Set("Content-Type", "application/json")
+	res.WriteHeader(status)
+	json.NewEncoder(res).Encode(result)
+}
+
+func (g *smartContractGW) graphqlSchema(res http.ResponseWriter, req *http.Request, params httprouter.Params) {
+	log.Infof("--> %s %s", req.Method, req.URL)
+
+	status := 200
+	log.Infof("<-- %s %s [%d]", req.Method, req.URL, status)
+	res.Header().Set("Content-Type", "text/plain")
+	res.WriteHeader(status)
+	res.Write([]byte(g.graphql.SDL()))
+}
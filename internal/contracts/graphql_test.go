@@ -0,0 +1,163 @@
+// Copyright 2021 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package contracts
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http/httptest"
+	"net/url"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/julienschmidt/httprouter"
+	ethbinding "github.com/kaleido-io/ethbinding/pkg"
+	"github.com/kaleido-io/ethconnect/internal/ethbind"
+	"github.com/kaleido-io/ethconnect/internal/events"
+	"github.com/kaleido-io/ethconnect/internal/messages"
+	"github.com/kaleido-io/ethconnect/internal/tx"
+	"github.com/stretchr/testify/assert"
+)
+
+const testGraphQLContract = "0123456789abcdef0123456789abcdef01234567"
+
+func newTestGraphQLGW(t *testing.T, dir string, enabled bool) (*smartContractGW, *httprouter.Router) {
+	deployBytes, _ := json.Marshal(&messages.DeployContract{
+		ABI: ethbinding.ABIMarshaling{
+			{Type: "function", Name: "set"},
+			{Type: "event", Name: "Changed"},
+		},
+	})
+	ioutil.WriteFile(path.Join(dir, "abi_abi1.deploy.json"), deployBytes, 0644)
+
+	s, err := NewSmartContractGateway(
+		&SmartContractGatewayConf{
+			StoragePath: dir,
+			BaseURL:     "http://localhost/api/v1",
+			GraphQL:     GraphQLConf{Enabled: enabled},
+		},
+		&tx.TxnProcessorConf{},
+		nil, nil, nil, nil,
+	)
+	assert.NoError(t, err)
+	scgw := s.(*smartContractGW)
+	router := &httprouter.Router{}
+	scgw.AddRoutes(router)
+	return scgw, router
+}
+
+func testGraphQLRequest(router *httprouter.Router, method, query string) (int, string) {
+	req := httptest.NewRequest("POST", GraphQLPath, strings.NewReader(query))
+	if method == "GET" {
+		req = httptest.NewRequest("GET", GraphQLPath+"?"+query, nil)
+	}
+	res := httptest.NewRecorder()
+	router.ServeHTTP(res, req)
+	return res.Code, strings.TrimSpace(res.Body.String())
+}
+
+func TestGraphQLContractToStream(t *testing.T) {
+	assert := assert.New(t)
+	dir := tempdir()
+	defer cleanup(dir)
+	scgw, router := newTestGraphQLGW(t, dir, true)
+	scgw.storeNewContractInfo(testGraphQLContract, "abi1", "simple", "simple", "", "")
+	addr := ethbind.API.HexToAddress("0x" + testGraphQLContract)
+	other := ethbind.API.HexToAddress("0x00000000000000000000000000000000000000aa")
+	stream := &events.StreamInfo{ID: "es-1", Name: "stream1", Type: "webhook"}
+	sub1 := &events.SubscriptionInfo{ID: "sb-1", Name: "changed", Stream: "es-1", Event: &ethbinding.ABIElementMarshaling{Name: "Changed"}}
+	sub1.Filter.Addresses = []ethbinding.Address{addr}
+	sub2 := &events.SubscriptionInfo{ID: "sb-2", Name: "other", Stream: "es-2"}
+	sub2.Filter.Addresses = []ethbinding.Address{other}
+	scgw.sm = &mockSubMgr{stream: stream, streams: []*events.StreamInfo{stream}, subs: []*events.SubscriptionInfo{sub2, sub1}}
+
+	status, body := testGraphQLRequest(router, "POST", `{
+		"query": "query ($name: String!) { contract(address: $name) { address registeredAs abi { id methods events contracts { address } } subscriptions { id event addresses stream { name type } } } }",
+		"variables": {"name": "simple"}
+	}`)
+	assert.Equal(200, status)
+	assert.Equal(`{"data":{"contract":{"address":"`+testGraphQLContract+`","registeredAs":"simple","abi":{"id":"abi1","methods":["set"],"events":["Changed"],"contracts":[{"address":"`+testGraphQLContract+`"}]},"subscriptions":[{"id":"sb-1","event":"Changed","addresses":["`+testGraphQLContract+`"],"stream":{"name":"stream1","type":"webhook"}}]}}}`, body)
+
+	status, body = testGraphQLRequest(router, "GET", "query="+url.QueryEscape(`{ contracts(abi: "abi1") { address } abis { id } streams { id subscriptions { id contracts { address } } } subscriptions(stream: "es-2") { id contracts { address } } missing: contract(address: "unknown") { address } }`))
+	assert.Equal(200, status)
+	assert.Equal(`{"data":{"contracts":[{"address":"`+testGraphQLContract+`"}],"abis":[{"id":"abi1"}],"streams":[{"id":"es-1","subscriptions":[{"id":"sb-1","contracts":[{"address":"`+testGraphQLContract+`"}]}]}],"subscriptions":[{"id":"sb-2","contracts":[]}],"missing":null}}`, body)
+
+	status, body = testGraphQLRequest(router, "GET", "query="+url.QueryEscape(`query ($id: String!) { abi(id: $id) { name } stream(id: "es-1") { id } subscription(id: "sb-1") { id } }`)+"&variables="+url.QueryEscape(`{"id":"abi1"}`))
+	assert.Equal(200, status)
+	assert.Equal(`{"data":{"abi":{"name":""},"stream":{"id":"es-1"},"subscription":null}}`, body)
+}
+
+func TestGraphQLContractEnvironments(t *testing.T) {
+	assert := assert.New(t)
+	dir := tempdir()
+	defer cleanup(dir)
+	scgw, router := newTestGraphQLGW(t, dir, true)
+	scgw.storeNewContractInfo(testGraphQLContract, "abi1", "simple", "simple", "", "")
+	scgw.storeNewContractInfo("00000000000000000000000000000000000000bb", "abi1", "simple", "simple", "prod", "")
+	scgw.storeNewContractInfo("00000000000000000000000000000000000000aa", "abi1", "simple", "simple", "dev", "")
+
+	status, body := testGraphQLRequest(router, "POST", `{"query": "{ contract(address: \"simple\") { address environments { name address } } }"}`)
+	assert.Equal(200, status)
+	assert.Equal(`{"data":{"contract":{"address":"`+testGraphQLContract+`","environments":[{"name":"dev","address":"00000000000000000000000000000000000000aa"},{"name":"prod","address":"00000000000000000000000000000000000000bb"}]}}}`, body)
+}
+
+func TestGraphQLErrors(t *testing.T) {
+	assert := assert.New(t)
+	dir := tempdir()
+	defer cleanup(dir)
+	_, router := newTestGraphQLGW(t, dir, true)
+
+	status, body := testGraphQLRequest(router, "POST", `{ "query": "{ contracts { address } streams { id } }" }`)
+	assert.Equal(200, status)
+	assert.Equal(`{"data":{"contracts":[],"streams":null},"errors":[{"message":"Event support is not configured on this gateway","path":["streams"]}]}`, body)
+
+	status, body = testGraphQLRequest(router, "POST", `{ "query": "{ contracts { address }" }`)
+	assert.Equal(400, status)
+	assert.Equal(`{"errors":[{"message":"Syntax error in GraphQL query at position 23: Expected a name, found end of query"}]}`, body)
+
+	status, body = testGraphQLRequest(router, "POST", `!json`)
+	assert.Equal(400, status)
+	assert.Regexp(`{"errors":\[{"message":"Invalid GraphQL request: invalid character`, body)
+
+	status, body = testGraphQLRequest(router, "GET", "query=x&variables=!json")
+	assert.Equal(400, status)
+	assert.Regexp(`{"errors":\[{"message":"Invalid GraphQL request: invalid character`, body)
+}
+
+func TestGraphQLSchema(t *testing.T) {
+	assert := assert.New(t)
+	dir := tempdir()
+	defer cleanup(dir)
+	_, router := newTestGraphQLGW(t, dir, true)
+
+	req := httptest.NewRequest("GET", GraphQLSchemaPath, nil)
+	res := httptest.NewRecorder()
+	router.ServeHTTP(res, req)
+	assert.Equal(200, res.Code)
+	assert.Contains(res.Body.String(), "type Query {\n")
+	assert.Contains(res.Body.String(), "  contract(address: String!): Contract\n")
+	assert.Contains(res.Body.String(), "  stream: Stream\n")
+}
+
+func TestGraphQLDisabled(t *testing.T) {
+	assert := assert.New(t)
+	dir := tempdir()
+	defer cleanup(dir)
+	_, router := newTestGraphQLGW(t, dir, false)
+
+	status, _ := testGraphQLRequest(router, "POST", `{ "query": "{ contracts { address } }" }`)
+	assert.Equal(404, status)
+}
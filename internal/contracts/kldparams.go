@@ -17,8 +17,10 @@ package contracts
 import (
 	"net/http"
 	"net/textproto"
+	"strconv"
 	"strings"
 
+	ethconnecterrors "github.com/kaleido-io/ethconnect/internal/errors"
 	"github.com/kaleido-io/ethconnect/internal/utils"
 )
 
@@ -49,6 +51,20 @@ func getFlyParam(name string, req *http.Request, isBool bool) string {
 	return valStr
 }
 
+// getFlyConfirmations returns the number of confirmations to wait for before reporting
+// a transaction as mined, which is zero if not specified
+func getFlyConfirmations(req *http.Request) (int64, error) {
+	valStr := getFlyParam("confirmations", req, false)
+	if valStr == "" {
+		return 0, nil
+	}
+	confirmations, err := strconv.ParseInt(valStr, 10, 64)
+	if err != nil || confirmations < 0 {
+		return 0, ethconnecterrors.Errorf(ethconnecterrors.RESTGatewayInvalidConfirmations, utils.GetenvOrDefaultLowerCase("PREFIX_SHORT", "fly"), valStr)
+	}
+	return confirmations, nil
+}
+
 // getFlyParamMulti returns an array parameter, or nil if none specified.
 // allows multiple query params / headers, or a single comma-separated query param / header
 func getFlyParamMulti(name string, req *http.Request) (val []string) {
@@ -0,0 +1,203 @@
+// Copyright 2021 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package contracts
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	ethconnecterrors "github.com/kaleido-io/ethconnect/internal/errors"
+	"github.com/kaleido-io/ethconnect/internal/messages"
+)
+
+const (
+	listSortCreated = "created"
+	listSortName    = "name"
+	listOrderAsc    = "asc"
+	listOrderDesc   = "desc"
+	// listTotalCountHeader is the number of entries that matched the filters of a listing,
+	// before the skip and limit were applied
+	listTotalCountHeader = "X-Total-Count"
+)
+
+// listFilter is the paging, filtering and sorting requested on a listing of
+// contracts or ABIs
+type listFilter struct {
+	limit         int
+	skip          int
+	namePrefix    string
+	abi           string
+	createdAfter  *time.Time
+	createdBefore *time.Time
+	sort          string
+	order         string
+}
+
+// listEntryName is the name a contract is registered as, or the name of an ABI
+func listEntryName(entry messages.TimeSortable) string {
+	switch info := entry.(type) {
+	case *contractInfo:
+		return info.RegisteredAs
+	case *abiInfo:
+		return info.Name
+	}
+	return ""
+}
+
+// listEntryABI is the ID of the ABI of a contract, or of an ABI itself
+func listEntryABI(entry messages.TimeSortable) string {
+	switch info := entry.(type) {
+	case *contractInfo:
+		return info.ABI
+	case *abiInfo:
+		return info.ID
+	}
+	return ""
+}
+
+func parseListInt(req *http.Request, param string) (int, error) {
+	str := req.FormValue(param)
+	if str == "" {
+		return 0, nil
+	}
+	val, err := strconv.ParseInt(str, 10, 32)
+	if err != nil || val < 0 {
+		return 0, ethconnecterrors.Errorf(ethconnecterrors.RESTGatewayListBadNumber, param, str)
+	}
+	return int(val), nil
+}
+
+func parseListTime(req *http.Request, param string) (*time.Time, error) {
+	str := req.FormValue(param)
+	if str == "" {
+		return nil, nil
+	}
+	t, err := time.Parse(time.RFC3339Nano, str)
+	if err != nil {
+		return nil, ethconnecterrors.Errorf(ethconnecterrors.RESTGatewayListBadTime, param, str)
+	}
+	return &t, nil
+}
+
+// parseListFilter reads the query parameters of a listing. The name prefix is passed
+// as registeredAs for contracts, and as name for ABIs
+func parseListFilter(req *http.Request, contracts bool) (f *listFilter, err error) {
+	f = &listFilter{
+		abi:   req.FormValue("abi"),
+		sort:  strings.ToLower(req.FormValue("sort")),
+		order: strings.ToLower(req.FormValue("order")),
+	}
+	if contracts {
+		f.namePrefix = req.FormValue("registeredAs")
+	} else {
+		f.namePrefix = req.FormValue("name")
+	}
+	if f.limit, err = parseListInt(req, "limit"); err != nil {
+		return nil, err
+	}
+	if f.skip, err = parseListInt(req, "skip"); err != nil {
+		return nil, err
+	}
+	if f.createdAfter, err = parseListTime(req, "createdAfter"); err != nil {
+		return nil, err
+	}
+	if f.createdBefore, err = parseListTime(req, "createdBefore"); err != nil {
+		return nil, err
+	}
+	switch f.sort {
+	case "":
+		f.sort = listSortCreated
+	case listSortCreated, listSortName:
+	default:
+		return nil, ethconnecterrors.Errorf(ethconnecterrors.RESTGatewayListBadSort, f.sort)
+	}
+	switch f.order {
+	case "":
+		// Newest first by default, which is the order before sorting was configurable
+		if f.sort == listSortCreated {
+			f.order = listOrderDesc
+		} else {
+			f.order = listOrderAsc
+		}
+	case listOrderAsc, listOrderDesc:
+	default:
+		return nil, ethconnecterrors.Errorf(ethconnecterrors.RESTGatewayListBadOrder, f.order)
+	}
+	return f, nil
+}
+
+func (f *listFilter) matches(entry messages.TimeSortable) bool {
+	if f.namePrefix != "" && !strings.HasPrefix(listEntryName(entry), f.namePrefix) {
+		return false
+	}
+	if f.abi != "" && listEntryABI(entry) != f.abi {
+		return false
+	}
+	if f.createdAfter != nil || f.createdBefore != nil {
+		created, err := time.Parse(time.RFC3339Nano, entry.GetISO8601())
+		if err != nil {
+			return false
+		}
+		if f.createdAfter != nil && created.Before(*f.createdAfter) {
+			return false
+		}
+		if f.createdBefore != nil && !created.Before(*f.createdBefore) {
+			return false
+		}
+	}
+	return true
+}
+
+func (f *listFilter) less(i, j messages.TimeSortable) bool {
+	var a, b string
+	if f.sort == listSortName {
+		a, b = listEntryName(i), listEntryName(j)
+	} else {
+		a, b = i.GetISO8601(), j.GetISO8601()
+	}
+	if a == b {
+		return i.GetID() < j.GetID()
+	}
+	if f.order == listOrderDesc {
+		return a > b
+	}
+	return a < b
+}
+
+// apply filters and sorts the entries, returning the requested page along with the
+// total number of entries that matched
+func (f *listFilter) apply(entries []messages.TimeSortable) ([]messages.TimeSortable, int) {
+	matched := make([]messages.TimeSortable, 0, len(entries))
+	for _, entry := range entries {
+		if f.matches(entry) {
+			matched = append(matched, entry)
+		}
+	}
+	sort.Slice(matched, func(i, j int) bool {
+		return f.less(matched[i], matched[j])
+	})
+	total := len(matched)
+	if f.skip >= total {
+		return []messages.TimeSortable{}, total
+	}
+	matched = matched[f.skip:]
+	if f.limit > 0 && f.limit < len(matched) {
+		matched = matched[:f.limit]
+	}
+	return matched, total
+}
@@ -0,0 +1,169 @@
+// Copyright 2021 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package contracts
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/kaleido-io/ethconnect/internal/messages"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestListingGW() *smartContractGW {
+	scgw := &smartContractGW{
+		contractIndex: make(map[string]messages.TimeSortable),
+		abiIndex:      make(map[string]messages.TimeSortable),
+	}
+	contracts := []*contractInfo{
+		{Address: "0000000000000000000000000000000000000001", ABI: "abi1", RegisteredAs: "token-a", TimeSorted: messages.TimeSorted{CreatedISO8601: "2021-01-01T00:00:00Z"}},
+		{Address: "0000000000000000000000000000000000000002", ABI: "abi1", RegisteredAs: "token-b", TimeSorted: messages.TimeSorted{CreatedISO8601: "2021-02-01T00:00:00Z"}},
+		{Address: "0000000000000000000000000000000000000003", ABI: "abi2", RegisteredAs: "market", TimeSorted: messages.TimeSorted{CreatedISO8601: "2021-03-01T00:00:00Z"}},
+		{Address: "0000000000000000000000000000000000000004", ABI: "abi2", TimeSorted: messages.TimeSorted{CreatedISO8601: "2021-03-01T00:00:00Z"}},
+	}
+	for _, info := range contracts {
+		scgw.contractIndex[info.Address] = info
+	}
+	scgw.abiIndex["abi1"] = &abiInfo{ID: "abi1", Name: "Token", TimeSorted: messages.TimeSorted{CreatedISO8601: "2021-01-01T00:00:00Z"}}
+	scgw.abiIndex["abi2"] = &abiInfo{ID: "abi2", Name: "Market", TimeSorted: messages.TimeSorted{CreatedISO8601: "2021-02-01T00:00:00Z"}}
+	return scgw
+}
+
+func testListing(scgw *smartContractGW, url string, result interface{}) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("GET", url, nil)
+	res := httptest.NewRecorder()
+	scgw.listContractsOrABIs(res, req, httprouter.Params{})
+	json.NewDecoder(res.Body).Decode(result)
+	return res
+}
+
+func listedAddresses(infos []*contractInfo) []string {
+	addrs := []string{}
+	for _, info := range infos {
+		addrs = append(addrs, info.Address[38:])
+	}
+	return addrs
+}
+
+func TestListContractsDefaultOrder(t *testing.T) {
+	assert := assert.New(t)
+	scgw := newTestListingGW()
+
+	var infos []*contractInfo
+	res := testListing(scgw, "/contracts", &infos)
+	assert.Equal(200, res.Code)
+	assert.Equal("4", res.Header().Get("X-Total-Count"))
+	assert.Equal([]string{"03", "04", "02", "01"}, listedAddresses(infos))
+}
+
+func TestListContractsPaging(t *testing.T) {
+	assert := assert.New(t)
+	scgw := newTestListingGW()
+
+	var infos []*contractInfo
+	res := testListing(scgw, "/contracts?skip=1&limit=2", &infos)
+	assert.Equal(200, res.Code)
+	assert.Equal("4", res.Header().Get("X-Total-Count"))
+	assert.Equal([]string{"04", "02"}, listedAddresses(infos))
+
+	res = testListing(scgw, "/contracts?skip=10", &infos)
+	assert.Equal(200, res.Code)
+	assert.Equal([]string{}, listedAddresses(infos))
+}
+
+func TestListContractsFilters(t *testing.T) {
+	assert := assert.New(t)
+	scgw := newTestListingGW()
+
+	var infos []*contractInfo
+	res := testListing(scgw, "/contracts?registeredAs=token-", &infos)
+	assert.Equal("2", res.Header().Get("X-Total-Count"))
+	assert.Equal([]string{"02", "01"}, listedAddresses(infos))
+
+	testListing(scgw, "/contracts?abi=abi2", &infos)
+	assert.Equal([]string{"03", "04"}, listedAddresses(infos))
+
+	testListing(scgw, "/contracts?createdAfter=2021-02-01T00:00:00Z&createdBefore=2021-03-01T00:00:00Z", &infos)
+	assert.Equal([]string{"02"}, listedAddresses(infos))
+
+	scgw.contractIndex["0000000000000000000000000000000000000005"] = &contractInfo{Address: "0000000000000000000000000000000000000005"}
+	testListing(scgw, "/contracts?createdAfter=2021-01-01T00:00:00Z", &infos)
+	assert.Equal([]string{"03", "04", "02", "01"}, listedAddresses(infos))
+}
+
+func TestListContractsSort(t *testing.T) {
+	assert := assert.New(t)
+	scgw := newTestListingGW()
+
+	var infos []*contractInfo
+	testListing(scgw, "/contracts?sort=name", &infos)
+	assert.Equal([]string{"04", "03", "01", "02"}, listedAddresses(infos))
+
+	testListing(scgw, "/contracts?sort=name&order=desc", &infos)
+	assert.Equal([]string{"02", "01", "03", "04"}, listedAddresses(infos))
+
+	testListing(scgw, "/contracts?sort=created&order=asc", &infos)
+	assert.Equal([]string{"01", "02", "03", "04"}, listedAddresses(infos))
+}
+
+func TestListABIsFilterAndSort(t *testing.T) {
+	assert := assert.New(t)
+	scgw := newTestListingGW()
+
+	var infos []*abiInfo
+	testListing(scgw, "/abis?sort=name", &infos)
+	assert.Equal(2, len(infos))
+	assert.Equal("abi2", infos[0].ID)
+
+	testListing(scgw, "/abis?name=Tok", &infos)
+	assert.Equal(1, len(infos))
+	assert.Equal("abi1", infos[0].ID)
+
+	testListing(scgw, "/abis?abi=abi2&registeredAs=ignored", &infos)
+	assert.Equal(1, len(infos))
+	assert.Equal("abi2", infos[0].ID)
+}
+
+func TestListContractsBadParams(t *testing.T) {
+	assert := assert.New(t)
+	scgw := newTestListingGW()
+
+	var errInfo restErrMsg
+	res := testListing(scgw, "/contracts?limit=-1", &errInfo)
+	assert.Equal(400, res.Code)
+	assert.Equal("Invalid 'limit' query parameter '-1'. Must be a non-negative integer", errInfo.Message)
+
+	res = testListing(scgw, "/contracts?skip=abc", &errInfo)
+	assert.Equal(400, res.Code)
+	assert.Equal("Invalid 'skip' query parameter 'abc'. Must be a non-negative integer", errInfo.Message)
+
+	res = testListing(scgw, "/contracts?createdAfter=yesterday", &errInfo)
+	assert.Equal(400, res.Code)
+	assert.Equal("Invalid 'createdAfter' query parameter 'yesterday'. Must be an RFC3339 timestamp", errInfo.Message)
+
+	res = testListing(scgw, "/contracts?createdBefore=tomorrow", &errInfo)
+	assert.Equal(400, res.Code)
+	assert.Equal("Invalid 'createdBefore' query parameter 'tomorrow'. Must be an RFC3339 timestamp", errInfo.Message)
+
+	res = testListing(scgw, "/contracts?sort=address", &errInfo)
+	assert.Equal(400, res.Code)
+	assert.Equal("Invalid 'sort' query parameter 'address'. Valid values are: 'created' and 'name'", errInfo.Message)
+
+	res = testListing(scgw, "/contracts?order=up", &errInfo)
+	assert.Equal(400, res.Code)
+	assert.Equal("Invalid 'order' query parameter 'up'. Valid values are: 'asc' and 'desc'", errInfo.Message)
+}
@@ -0,0 +1,155 @@
+// Copyright 2021 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package contracts
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/julienschmidt/httprouter"
+	ethbinding "github.com/kaleido-io/ethbinding/pkg"
+	ethconnecterrors "github.com/kaleido-io/ethconnect/internal/errors"
+	"github.com/kaleido-io/ethconnect/internal/messages"
+	log "github.com/sirupsen/logrus"
+)
+
+// methodAccessFor combines the method access of an ABI with that of a contract instance,
+// as a method hidden or read-only on the ABI is restricted on every instance
+func methodAccessFor(deployMsg *messages.DeployContract, info *contractInfo) *messages.MethodAccess {
+	access := &messages.MethodAccess{}
+	if deployMsg != nil {
+		access.HiddenMethods = append(access.HiddenMethods, deployMsg.HiddenMethods...)
+		access.ReadOnlyMethods = append(access.ReadOnlyMethods, deployMsg.ReadOnlyMethods...)
+	}
+	if info != nil {
+		access.HiddenMethods = append(access.HiddenMethods, info.HiddenMethods...)
+		access.ReadOnlyMethods = append(access.ReadOnlyMethods, info.ReadOnlyMethods...)
+	}
+	return access
+}
+
+func methodListed(methods []string, name string) bool {
+	for _, m := range methods {
+		if m == name {
+			return true
+		}
+	}
+	return false
+}
+
+// validateMethodAccess checks every listed method is declared in the ABI, so that a
+// mistyped name does not leave the method exposed
+func validateMethodAccess(abi ethbinding.ABIMarshaling, access *messages.MethodAccess) error {
+	declared := make(map[string]bool)
+	for _, element := range abi {
+		if element.Type == "function" {
+			declared[element.Name] = true
+		}
+	}
+	for _, name := range append(append([]string{}, access.HiddenMethods...), access.ReadOnlyMethods...) {
+		if !declared[name] {
+			return ethconnecterrors.Errorf(ethconnecterrors.RESTGatewayMethodAccessUnknownMethod, name)
+		}
+	}
+	return nil
+}
+
+// parseMethodAccess reads the comma separated method lists from the form of an ABI upload
+func (g *smartContractGW) parseMethodAccess(form url.Values) *messages.MethodAccess {
+	access := &messages.MethodAccess{}
+	for _, v := range form["hiddenmethods"] {
+		access.HiddenMethods = append(access.HiddenMethods, splitMethodList(v)...)
+	}
+	for _, v := range form["readonlymethods"] {
+		access.ReadOnlyMethods = append(access.ReadOnlyMethods, splitMethodList(v)...)
+	}
+	return access
+}
+
+func splitMethodList(v string) []string {
+	methods := []string{}
+	for _, name := range strings.Split(v, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			methods = append(methods, name)
+		}
+	}
+	return methods
+}
+
+// updateMethodAccess replaces the method access of an ABI, or of a contract instance
+func (g *smartContractGW) updateMethodAccess(res http.ResponseWriter, req *http.Request, params httprouter.Params) {
+	log.Infof("--> %s %s", req.Method, req.URL)
+
+	var access messages.MethodAccess
+	if err := json.NewDecoder(req.Body).Decode(&access); err != nil {
+		g.gatewayErrReply(res, req, ethconnecterrors.Errorf(ethconnecterrors.RESTGatewayMethodAccessInvalid, err), 400)
+		return
+	}
+
+	var updated interface{}
+	if params.ByName("abi") != "" {
+		abiID := strings.ToLower(params.ByName("abi"))
+		if isWellKnownABI(abiID) {
+			g.gatewayErrReply(res, req, ethconnecterrors.Errorf(ethconnecterrors.RESTGatewayWellKnownABIReadOnly, abiID), 403)
+			return
+		}
+		deployMsg, info, err := g.loadDeployMsgByID(abiID)
+		if err != nil {
+			g.gatewayErrReply(res, req, err, 404)
+			return
+		}
+		if err := validateMethodAccess(deployMsg.ABI, &access); err != nil {
+			g.gatewayErrReply(res, req, err, 400)
+			return
+		}
+		deployMsg.MethodAccess = access
+		if err := g.writeAbiInfo(abiID, deployMsg); err != nil {
+			g.gatewayErrReply(res, req, err, 500)
+			return
+		}
+		g.idxLock.Lock()
+		info.MethodAccess = access
+		g.idxLock.Unlock()
+		updated = info
+	} else {
+		deployMsg, _, info, err := g.resolveAddressOrName(req.Context(), params.ByName("address"), getFlyParam("environment", req, false))
+		if err != nil {
+			g.gatewayErrReply(res, req, err, 404)
+			return
+		}
+		if err := validateMethodAccess(deployMsg.ABI, &access); err != nil {
+			g.gatewayErrReply(res, req, err, 400)
+			return
+		}
+		g.idxLock.Lock()
+		info.MethodAccess = access
+		g.idxLock.Unlock()
+		if err := g.writeContractInfo(info); err != nil {
+			g.gatewayErrReply(res, req, err, 500)
+			return
+		}
+		updated = info
+	}
+
+	status := 200
+	log.Infof("<-- %s %s [%d]", req.Method, req.URL, status)
+	res.Header().Set("Content-Type", "application/json")
+	res.WriteHeader(status)
+	enc := json.NewEncoder(res)
+	enc.SetIndent("", "  ")
+	enc.Encode(updated)
+}
@@ -0,0 +1,235 @@
+// Copyright 2021 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package contracts
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/go-openapi/spec"
+	"github.com/julienschmidt/httprouter"
+	"github.com/kaleido-io/ethconnect/internal/messages"
+	"github.com/kaleido-io/ethconnect/internal/tx"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestMethodAccessGW(t *testing.T, dir string) *httprouter.Router {
+	scgw, err := NewSmartContractGateway(
+		&SmartContractGatewayConf{
+			StoragePath: dir,
+			BaseURL:     "http://localhost/api/v1",
+		},
+		&tx.TxnProcessorConf{},
+		nil, nil, nil, nil,
+	)
+	assert.NoError(t, err)
+	router := &httprouter.Router{}
+	scgw.AddRoutes(router)
+	return router
+}
+
+func publishTestMethodAccessABI(router *httprouter.Router, hidden, readOnly string) *httptest.ResponseRecorder {
+	b, _ := ioutil.ReadFile(path.Join("..", "..", "test", "simpleevents.solc.output.json"))
+	var contract SolcJson
+	json.Unmarshal(b, &contract)
+
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	fw, _ := writer.CreateFormField("abi")
+	io.Copy(fw, bytes.NewReader([]byte(contract.ABI)))
+	fw, _ = writer.CreateFormField("bytecode")
+	io.Copy(fw, bytes.NewReader([]byte(contract.Bin)))
+	fw, _ = writer.CreateFormField("hiddenmethods")
+	io.Copy(fw, strings.NewReader(hidden))
+	fw, _ = writer.CreateFormField("readonlymethods")
+	io.Copy(fw, strings.NewReader(readOnly))
+	writer.Close()
+	req, _ := http.NewRequest("POST", "/abis", bytes.NewReader(body.Bytes()))
+	req.Header.Add("Content-Type", writer.FormDataContentType())
+
+	res := httptest.NewRecorder()
+	router.ServeHTTP(res, req)
+	return res
+}
+
+func testMethodAccessRequest(router *httprouter.Router, method, path, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	res := httptest.NewRecorder()
+	router.ServeHTTP(res, req)
+	return res
+}
+
+func testMethodAccessSwagger(t *testing.T, router *httprouter.Router, path string) *spec.Swagger {
+	res := testMethodAccessRequest(router, "GET", path+"?swagger", "")
+	assert.Equal(t, 200, res.Code)
+	var swagger spec.Swagger
+	assert.NoError(t, json.NewDecoder(res.Body).Decode(&swagger))
+	return &swagger
+}
+
+func TestMethodAccessABIAndInstance(t *testing.T) {
+	assert := assert.New(t)
+	dir := tempdir()
+	defer cleanup(dir)
+	router := newTestMethodAccessGW(t, dir)
+
+	res := publishTestMethodAccessABI(router, "storedS", "set, storedI")
+	assert.Equal(200, res.Code)
+	var info abiInfo
+	assert.NoError(json.NewDecoder(res.Body).Decode(&info))
+	assert.Equal([]string{"storedS"}, info.HiddenMethods)
+	assert.Equal([]string{"set", "storedI"}, info.ReadOnlyMethods)
+
+	swagger := testMethodAccessSwagger(t, router, "/abis/"+info.ID)
+	_, exists := swagger.Paths.Paths["/{address}/storedS"]
+	assert.False(exists)
+	assert.Nil(swagger.Paths.Paths["/{address}/set"].Post)
+	assert.NotNil(swagger.Paths.Paths["/{address}/set"].Get)
+	assert.NotNil(swagger.Paths.Paths["/{address}/get"].Post)
+
+	addr := "0123456789abcdef0123456789abcdef01234567"
+	res = testMethodAccessRequest(router, "POST", "/abis/"+info.ID+"/"+addr, "")
+	assert.Equal(201, res.Code)
+
+	// The instance restricts further methods, in addition to those of the ABI
+	res = testMethodAccessRequest(router, "PATCH", "/contracts/"+addr, `{"hiddenMethods":["get"]}`)
+	assert.Equal(200, res.Code)
+	var instance contractInfo
+	assert.NoError(json.NewDecoder(res.Body).Decode(&instance))
+	assert.Equal([]string{"get"}, instance.HiddenMethods)
+
+	swagger = testMethodAccessSwagger(t, router, "/contracts/"+addr)
+	_, exists = swagger.Paths.Paths["/get"]
+	assert.False(exists)
+	_, exists = swagger.Paths.Paths["/storedS"]
+	assert.False(exists)
+	assert.Nil(swagger.Paths.Paths["/set"].Post)
+
+	// Updates to the ABI are persisted
+	res = testMethodAccessRequest(router, "PATCH", "/abis/"+info.ID, `{"hiddenMethods":["storedI"]}`)
+	assert.Equal(200, res.Code)
+	b, err := ioutil.ReadFile(path.Join(dir, "abi_"+info.ID+".deploy.json"))
+	assert.NoError(err)
+	var deployMsg messages.DeployContract
+	assert.NoError(json.Unmarshal(b, &deployMsg))
+	assert.Equal([]string{"storedI"}, deployMsg.HiddenMethods)
+	assert.Empty(deployMsg.ReadOnlyMethods)
+
+	swagger = testMethodAccessSwagger(t, router, "/contracts/"+addr)
+	assert.NotNil(swagger.Paths.Paths["/set"].Post)
+	_, exists = swagger.Paths.Paths["/storedI"]
+	assert.False(exists)
+	_, exists = swagger.Paths.Paths["/storedS"]
+	assert.True(exists)
+}
+
+func TestMethodAccessPublishUnknownMethod(t *testing.T) {
+	assert := assert.New(t)
+	dir := tempdir()
+	defer cleanup(dir)
+	router := newTestMethodAccessGW(t, dir)
+
+	res := publishTestMethodAccessABI(router, "selfdestruct", "")
+	assert.Equal(400, res.Code)
+	assert.Regexp("Method 'selfdestruct' in the method access lists is not declared in the ABI", res.Body.String())
+}
+
+func TestMethodAccessUpdateErrors(t *testing.T) {
+	assert := assert.New(t)
+	dir := tempdir()
+	defer cleanup(dir)
+	router := newTestMethodAccessGW(t, dir)
+
+	res := publishTestMethodAccessABI(router, "", "")
+	assert.Equal(200, res.Code)
+	var info abiInfo
+	assert.NoError(json.NewDecoder(res.Body).Decode(&info))
+
+	res = testMethodAccessRequest(router, "PATCH", "/abis/"+info.ID, `!json`)
+	assert.Equal(400, res.Code)
+	assert.Regexp("Invalid method access", res.Body.String())
+
+	res = testMethodAccessRequest(router, "PATCH", "/abis/"+info.ID, `{"readOnlyMethods":["upgradeTo"]}`)
+	assert.Equal(400, res.Code)
+	assert.Regexp("Method 'upgradeTo' in the method access lists is not declared in the ABI", res.Body.String())
+
+	res = testMethodAccessRequest(router, "PATCH", "/abis/unknown", `{}`)
+	assert.Equal(404, res.Code)
+
+	res = testMethodAccessRequest(router, "PATCH", "/contracts/unknown", `{}`)
+	assert.Equal(404, res.Code)
+
+	addr := "0123456789abcdef0123456789abcdef01234567"
+	res = testMethodAccessRequest(router, "POST", "/abis/"+info.ID+"/"+addr, "")
+	assert.Equal(201, res.Code)
+	res = testMethodAccessRequest(router, "PATCH", "/contracts/"+addr, `{"hiddenMethods":["upgradeTo"]}`)
+	assert.Equal(400, res.Code)
+}
+
+func newTestMethodAccessREST2Eth(t *testing.T, deployAccess, instanceAccess messages.MethodAccess) (*mockRPC, *httprouter.Router) {
+	deployMsg := newTestPrecompiledDeployMsg(t)
+	deployMsg.MethodAccess = deployAccess
+	abiLoader := &mockABILoader{
+		deployMsg:    &deployMsg.DeployContract,
+		contractInfo: &contractInfo{MethodAccess: instanceAccess},
+	}
+	_, mockRPC, router := newTestREST2EthCustomAbiLoader(&mockREST2EthDispatcher{}, abiLoader)
+	return mockRPC, router
+}
+
+func TestMethodAccessHiddenNotDeclared(t *testing.T) {
+	assert := assert.New(t)
+	to := "0x567a417717cb6c59ddc1035705f02c0fd1ab1872"
+	_, router := newTestMethodAccessREST2Eth(t, messages.MethodAccess{HiddenMethods: []string{"get"}}, messages.MethodAccess{HiddenMethods: []string{"set"}})
+
+	for _, method := range []string{"get", "set"} {
+		req := httptest.NewRequest("POST", "/contracts/"+to+"/"+method+"?fly-call", strings.NewReader(`{"i":1,"s":"one"}`))
+		req.Header.Add("x-firefly-from", "0x66c5fe653e7a9ebb628a6d40f0452d1e358baee8")
+		res := httptest.NewRecorder()
+		router.ServeHTTP(res, req)
+		assert.Equal(404, res.Code)
+		assert.Regexp("Method or Event '"+method+"' is not declared", res.Body.String())
+	}
+}
+
+func TestMethodAccessReadOnly(t *testing.T) {
+	assert := assert.New(t)
+	to := "0x567a417717cb6c59ddc1035705f02c0fd1ab1872"
+	mockRPC, router := newTestMethodAccessREST2Eth(t, messages.MethodAccess{}, messages.MethodAccess{ReadOnlyMethods: []string{"set"}})
+	mockRPC.result = "0x"
+
+	req := httptest.NewRequest("POST", "/contracts/"+to+"/set", strings.NewReader(`{"i":1,"s":"one"}`))
+	req.Header.Add("x-firefly-from", "0x66c5fe653e7a9ebb628a6d40f0452d1e358baee8")
+	res := httptest.NewRecorder()
+	router.ServeHTTP(res, req)
+	assert.Equal(403, res.Code)
+	assert.Regexp("Method 'set' is read-only on this gateway", res.Body.String())
+	assert.Empty(mockRPC.capturedMethod)
+
+	req = httptest.NewRequest("POST", "/contracts/"+to+"/set?fly-call", strings.NewReader(`{"i":1,"s":"one"}`))
+	req.Header.Add("x-firefly-from", "0x66c5fe653e7a9ebb628a6d40f0452d1e358baee8")
+	res = httptest.NewRecorder()
+	router.ServeHTTP(res, req)
+	assert.Equal(200, res.Code)
+	assert.Equal("eth_call", mockRPC.capturedMethod)
+}
@@ -0,0 +1,174 @@
+// Copyright 2021 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package contracts
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/julienschmidt/httprouter"
+	ethbinding "github.com/kaleido-io/ethbinding/pkg"
+	ethconnecterrors "github.com/kaleido-io/ethconnect/internal/errors"
+	"github.com/kaleido-io/ethconnect/internal/eth"
+	"github.com/kaleido-io/ethconnect/internal/ethbind"
+	"github.com/kaleido-io/ethconnect/internal/metrics"
+	"github.com/kaleido-io/ethconnect/internal/utils"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	multicallPath = "/multicall"
+
+	// maxMulticallSize bounds the calls in one request, as they are all made concurrently
+	maxMulticallSize = 100
+)
+
+// multicallQuery is one read-only method call of a multicall. The contract is an address, or a
+// name registered with the gateway, and the params are the inputs of the method by name. A call
+// with a from address is not aggregated, as Multicall3 would be the sender
+type multicallQuery struct {
+	ID       string                 `json:"id,omitempty"`
+	Contract string                 `json:"contract"`
+	Method   string                 `json:"method"`
+	Params   map[string]interface{} `json:"params,omitempty"`
+	From     string                 `json:"from,omitempty"`
+}
+
+// multicallResult is the output of one call of a multicall, in the same position as the request
+type multicallResult struct {
+	Index  int                    `json:"index"`
+	ID     string                 `json:"id,omitempty"`
+	Output map[string]interface{} `json:"output,omitempty"`
+	Error  string                 `json:"error,omitempty"`
+}
+
+func (r *rest2eth) addMulticallRoute(router *httprouter.Router) {
+	router.Handle(http.MethodPost, multicallPath, metrics.InstrumentHandler(routeLatency, multicallPath, r.multicallHandler))
+}
+
+// multicallHandler makes an array of read-only calls, possibly to different contracts, at the same
+// block in one request. The calls are independent, so each returns its own output or error. When the
+// RPC connection aggregates calls, they reach the node as calls to Multicall3 instead of one each
+func (r *rest2eth) multicallHandler(res http.ResponseWriter, req *http.Request, params httprouter.Params) {
+	log.Infof("--> %s %s", req.Method, req.URL)
+
+	var queries []*multicallQuery
+	if err := json.NewDecoder(req.Body).Decode(&queries); err != nil {
+		r.restErrReply(res, req, ethconnecterrors.Errorf(ethconnecterrors.RESTGatewayMulticallInvalid, err), 400)
+		return
+	}
+	if len(queries) == 0 || len(queries) > maxMulticallSize {
+		r.restErrReply(res, req, ethconnecterrors.Errorf(ethconnecterrors.RESTGatewayMulticallSize, maxMulticallSize), 400)
+		return
+	}
+
+	blocknumber, asOf, err := callBlockParams(req)
+	if err != nil {
+		r.restErrReply(res, req, err, 400)
+		return
+	}
+	if asOf != nil {
+		if blocknumber, err = eth.GetBlockNumberAt(req.Context(), r.rpc, *asOf); err != nil {
+			r.restErrReply(res, req, err, 500)
+			return
+		}
+	}
+
+	results := make([]*multicallResult, len(queries))
+	calls := make([]*eth.MulticallRequest, 0, len(queries))
+	callResults := make([]*multicallResult, 0, len(queries))
+	contracts := make(map[string]*batchContract)
+	for i, query := range queries {
+		results[i] = &multicallResult{Index: i}
+		if query == nil {
+			query = &multicallQuery{}
+		}
+		results[i].ID = query.ID
+		call, err := r.multicallRequest(req, query, contracts)
+		if err != nil {
+			log.Errorf("Invalid call %d in multicall: %s", i, err)
+			results[i].Error = err.Error()
+			continue
+		}
+		calls = append(calls, call)
+		callResults = append(callResults, results[i])
+	}
+
+	eth.Multicall(req.Context(), r.rpc, calls, blocknumber)
+	for i, call := range calls {
+		if call.Err != nil {
+			callResults[i].Error = call.Err.Error()
+		} else {
+			callResults[i].Output = call.Result
+		}
+	}
+
+	resBytes, _ := json.MarshalIndent(results, "", "  ")
+	status := 200
+	log.Infof("<-- %s %s [%d]: %d calls", req.Method, req.URL, status, len(calls))
+	log.Debugf("<-- %s", utils.RedactJSON(resBytes))
+	res.Header().Set("Content-Type", "application/json")
+	res.WriteHeader(status)
+	res.Write(resBytes)
+}
+
+// multicallRequest resolves the contract and method of one call of a multicall, and its inputs
+func (r *rest2eth) multicallRequest(req *http.Request, query *multicallQuery, contracts map[string]*batchContract) (*eth.MulticallRequest, error) {
+	if query.Contract == "" || query.Method == "" {
+		return nil, ethconnecterrors.Errorf(ethconnecterrors.RESTGatewayMulticallMissingContract)
+	}
+	contract, err := r.resolveBatchContract(req, query.Contract, contracts)
+	if err != nil {
+		return nil, err
+	}
+
+	var abiMethodElem *ethbinding.ABIElementMarshaling
+	for _, element := range contract.deployMsg.ABI {
+		if element.Type == "function" && element.Name == query.Method && !methodListed(contract.access.HiddenMethods, element.Name) {
+			abiMethodElem = &element
+			break
+		}
+	}
+	if abiMethodElem == nil {
+		return nil, ethconnecterrors.Errorf(ethconnecterrors.RESTGatewayMethodNotDeclared, query.Method, contract.addr)
+	}
+	abiMethod, err := ethbind.API.ABIElementMarshalingToABIMethod(abiMethodElem)
+	if err != nil {
+		return nil, ethconnecterrors.Errorf(ethconnecterrors.RESTGatewayMethodABIInvalid, query.Method, err)
+	}
+	msgParams, err := methodParams(abiMethod, query.Params, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	fromParam := query.From
+	if fromParam == "" {
+		fromParam = getFlyParam("from", req, false)
+	}
+	from, err := resolveFrom(fromParam)
+	if err != nil {
+		return nil, err
+	}
+	if from, err = r.processor.ResolveAddress(req.Context(), from); err != nil {
+		return nil, err
+	}
+	return &eth.MulticallRequest{
+		From:      from,
+		To:        contract.addr,
+		Method:    abiMethod,
+		Params:    msgParams,
+		ErrorABIs: eth.ErrorABIs(contract.deployMsg.ABI),
+	}, nil
+}
@@ -0,0 +1,132 @@
+// Copyright 2021 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package contracts
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	ethbinding "github.com/kaleido-io/ethbinding/pkg"
+	"github.com/kaleido-io/ethconnect/internal/eth"
+	"github.com/kaleido-io/ethconnect/internal/messages"
+	"github.com/stretchr/testify/assert"
+)
+
+// multicallTestRPC answers the read-only methods of the conformance ABI, from any goroutine
+type multicallTestRPC struct {
+	mux    sync.Mutex
+	blocks []string
+}
+
+func (m *multicallTestRPC) CallContext(ctx context.Context, result interface{}, method string, args ...interface{}) error {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	m.blocks = append(m.blocks, args[1].(string))
+	switch args[0].(*eth.SendTXArgs).Data.String()[0:10] {
+	case testSelector("name()"):
+		*(result.(*string)) = "0x" + fmt.Sprintf("%064x%064x", 32, 5) + fmt.Sprintf("%-64s", "546f6b656e")
+	case testSelector("balanceOf(address)"):
+		*(result.(*string)) = "0x" + fmt.Sprintf("%064x", 1000)
+	default:
+		return fmt.Errorf("execution reverted")
+	}
+	return nil
+}
+
+func newTestMulticallREST2Eth(t *testing.T) (*multicallTestRPC, func(query, body string) (int, []*multicallResult, string)) {
+	var abi ethbinding.ABIMarshaling
+	assert.NoError(t, json.Unmarshal([]byte(testConformanceABI), &abi))
+	abiLoader := &mockABILoader{
+		deployMsg:              &messages.DeployContract{ABI: abi},
+		contractInfo:           &contractInfo{MethodAccess: messages.MethodAccess{HiddenMethods: []string{"secret"}}},
+		registeredContractAddr: strings.TrimPrefix(testBatchContract, "0x"),
+	}
+	r, _, router := newTestREST2EthCustomAbiLoader(&mockREST2EthDispatcher{}, abiLoader)
+	rpc := &multicallTestRPC{}
+	r.rpc = rpc
+	return rpc, func(query, body string) (int, []*multicallResult, string) {
+		req := httptest.NewRequest("POST", "/multicall"+query, bytes.NewReader([]byte(body)))
+		res := httptest.NewRecorder()
+		router.ServeHTTP(res, req)
+		var results []*multicallResult
+		json.Unmarshal(res.Body.Bytes(), &results)
+		return res.Code, results, res.Body.String()
+	}
+}
+
+func TestMulticall(t *testing.T) {
+	assert := assert.New(t)
+	rpc, post := newTestMulticallREST2Eth(t)
+
+	status, results, body := post("?fly-blocknumber=12345", `[
+		{"id":"name","contract":"`+testBatchContract+`","method":"name"},
+		{"id":"balance","contract":"token","method":"balanceOf","params":{"owner":"`+testBatchFrom+`"}},
+		{"contract":"`+testBatchContract+`","method":"missing"},
+		{"contract":"`+testBatchContract+`","method":"secret"},
+		{"contract":"`+testBatchContract+`","method":"balanceOf"},
+		{"method":"name"},
+		null
+	]`)
+	assert.Equal(200, status, body)
+	assert.Len(results, 7)
+	assert.Equal("name", results[0].ID)
+	assert.Equal("Token", results[0].Output["output"])
+	assert.Equal("balance", results[1].ID)
+	assert.Equal(1, results[1].Index)
+	assert.Equal("1000", results[1].Output["output"])
+	assert.Regexp("execution reverted", results[2].Error)
+	assert.Nil(results[2].Output)
+	assert.Regexp("Method or Event 'secret' is not declared", results[3].Error)
+	assert.Equal("Parameter 'owner' of method 'balanceOf' was not specified in body or query parameters", results[4].Error)
+	assert.Equal("Each call in a multicall must specify a 'contract' and a 'method'", results[5].Error)
+	assert.Equal("Each call in a multicall must specify a 'contract' and a 'method'", results[6].Error)
+
+	// Every call is made at the same block
+	assert.Equal([]string{"0x3039", "0x3039", "0x3039"}, rpc.blocks)
+}
+
+func TestMulticallInvalid(t *testing.T) {
+	assert := assert.New(t)
+	_, post := newTestMulticallREST2Eth(t)
+
+	status, _, body := post("", `[]`)
+	assert.Equal(400, status)
+	assert.Regexp("A multicall must contain between 1 and 100 calls", body)
+
+	status, _, body = post("", `{"contract":"token"}`)
+	assert.Equal(400, status)
+	assert.Regexp("Invalid multicall request", body)
+
+	status, _, body = post("?fly-blocknumber=1&fly-asof=2021-01-01T00:00:00Z", `[{"contract":"token","method":"name"}]`)
+	assert.Equal(400, status)
+	assert.Regexp("Only one of asOf and blocknumber can be supplied", body)
+
+	status, _, body = post("?fly-blocktag=unsafe", `[{"contract":"token","method":"name"}]`)
+	assert.Equal(400, status)
+	assert.Regexp("Invalid blocktag 'unsafe'", body)
+
+	status, _, body = post("?fly-asof=yesterday", `[{"contract":"token","method":"name"}]`)
+	assert.Equal(400, status, body)
+
+	status, results, body := post("?fly-from=bad%20address!", `[{"contract":"token","method":"name"}]`)
+	assert.Equal(200, status, body)
+	assert.Regexp("From Address must be a 40 character hex string", results[0].Error)
+}
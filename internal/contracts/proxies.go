@@ -0,0 +1,260 @@
+// Copyright 2021 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package contracts
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	ethbinding "github.com/kaleido-io/ethbinding/pkg"
+	ethconnecterrors "github.com/kaleido-io/ethconnect/internal/errors"
+	"github.com/kaleido-io/ethconnect/internal/ethbind"
+)
+
+const (
+	defaultProxyPollIntervalSec = 10
+
+	// remoteImplementationABIPrefix is the prefix of the ID of an implementation ABI fetched
+	// from the remote registry
+	remoteImplementationABIPrefix = "remote-"
+)
+
+// ProxyWatchConf configures how the implementations of proxy contracts, registered with proxy
+// detection, are followed
+type ProxyWatchConf struct {
+	PollIntervalSec int `json:"pollInterval,omitempty"`
+}
+
+// proxyUpgradedLog is an Upgraded(address indexed implementation) event emitted by an EIP-1967 proxy
+type proxyUpgradedLog struct {
+	Address string   `json:"address"`
+	Topics  []string `json:"topics"`
+}
+
+func upgradedEventTopic() string {
+	return ethbind.API.HexEncode(ethbind.Keccak256([]byte("Upgraded(address)")))
+}
+
+// resolveImplementationABI finds the ABI of the implementation behind a proxy. The implementation
+// is looked up by address in the local registry, then in the remote registry, and finally its ABI
+// is inferred from its bytecode if ABI inference is enabled
+func (g *smartContractGW) resolveImplementationABI(ctx context.Context, proxy, implementation string) (string, error) {
+	addrHexNo0x := strings.TrimPrefix(implementation, "0x")
+	g.idxLock.Lock()
+	_, info, err := g.loadDeployMsgForInstance(addrHexNo0x)
+	g.idxLock.Unlock()
+	if err == nil {
+		return info.ABI, nil
+	}
+	if g.rr != nil {
+		msg, err := g.rr.loadFactoryForInstance(implementation, "", false)
+		if err != nil {
+			log.Warnf("Failed to look up implementation %s in the remote registry: %s", implementation, err)
+		} else if msg != nil {
+			abiID := remoteImplementationABIPrefix + addrHexNo0x
+			g.idxLock.Lock()
+			_, exists := g.abiIndex[abiID]
+			g.idxLock.Unlock()
+			if !exists {
+				deployMsg := msg.DeployContract
+				deployMsg.Headers.ID = abiID
+				if err := g.writeAbiInfo(abiID, &deployMsg); err != nil {
+					return "", err
+				}
+				g.addToABIIndex(abiID, &deployMsg, time.Now().UTC())
+			}
+			return abiID, nil
+		}
+	}
+	if g.selectors != nil {
+		// The proxy is bound to the ABI by its ID, so it must be stored
+		deployMsg, _, err := g.inferContract(ctx, addrHexNo0x, true)
+		if err != nil {
+			return "", err
+		}
+		return deployMsg.Headers.ID, nil
+	}
+	return "", ethconnecterrors.Errorf(ethconnecterrors.ProxyImplementationABINotFound, implementation, proxy)
+}
+
+// bindImplementation records the implementation behind a proxy, and binds the proxy to the ABI
+// of the implementation in the same write. Must be called holding idxLock
+func (g *smartContractGW) bindImplementation(info *contractInfo, implementation, abiID string) (err error) {
+	previous := info.Implementation
+	info.Implementation = implementation
+	if info.ABI == abiID {
+		err = g.writeContractInfo(info)
+	} else {
+		err = g.rebindABI(info, abiID)
+	}
+	if err != nil {
+		info.Implementation = previous
+		return err
+	}
+	log.Infof("Proxy contract %s uses implementation %s (abi=%s)", info.Address, implementation, abiID)
+	return nil
+}
+
+// trackProxy records the implementation of a newly registered proxy, and follows its upgrades
+func (g *smartContractGW) trackProxy(info *contractInfo, implementation string) error {
+	g.idxLock.Lock()
+	err := g.bindImplementation(info, implementation, info.ABI)
+	g.idxLock.Unlock()
+	if err != nil {
+		return err
+	}
+	g.startProxyWatcher()
+	return nil
+}
+
+// trackedProxies returns the implementation of each proxy registered with proxy detection
+func (g *smartContractGW) trackedProxies() map[string]string {
+	g.idxLock.Lock()
+	defer g.idxLock.Unlock()
+	proxies := make(map[string]string)
+	for addr, ts := range g.contractIndex {
+		if info := ts.(*contractInfo); info.Implementation != "" {
+			proxies[addr] = info.Implementation
+		}
+	}
+	return proxies
+}
+
+// updateProxyImplementation binds a proxy to the ABI of a new implementation. The Swagger and
+// GraphQL schema of the proxy are generated from the ABI it is bound to, so they follow
+func (g *smartContractGW) updateProxyImplementation(ctx context.Context, proxy, implementation string) error {
+	g.idxLock.Lock()
+	ts, exists := g.contractIndex[proxy]
+	unchanged := exists && ts.(*contractInfo).Implementation == implementation
+	g.idxLock.Unlock()
+	if !exists || unchanged {
+		return nil
+	}
+	abiID, err := g.resolveImplementationABI(ctx, proxy, implementation)
+	if err != nil {
+		return err
+	}
+	g.idxLock.Lock()
+	defer g.idxLock.Unlock()
+	_, info, err := g.loadDeployMsgForInstance(proxy)
+	if info == nil {
+		return err
+	}
+	return g.bindImplementation(info, implementation, abiID)
+}
+
+// pollProxyUpgrades checks for Upgraded events emitted by the tracked proxies since the last
+// poll, returning the block to poll from next time. On the first poll the implementation slot
+// of each proxy is read instead, to catch upgrades made while the gateway was stopped
+func (g *smartContractGW) pollProxyUpgrades(ctx context.Context, fromBlock uint64) uint64 {
+	proxies := g.trackedProxies()
+	if len(proxies) == 0 {
+		return fromBlock
+	}
+	var head ethbinding.HexUint64
+	if err := g.rpcCall(ctx, &head, "eth_blockNumber"); err != nil {
+		log.Warnf("Failed to poll for proxy upgrades: %s", err)
+		return fromBlock
+	}
+	if fromBlock == 0 {
+		for proxy, implementation := range proxies {
+			current, err := g.readImplementation(ctx, proxy)
+			if err == nil && current != "" && current != implementation {
+				err = g.updateProxyImplementation(ctx, proxy, current)
+			}
+			if err != nil {
+				log.Errorf("Failed to update the implementation of proxy contract %s: %s", proxy, err)
+			}
+		}
+		return uint64(head) + 1
+	}
+	if uint64(head) < fromBlock {
+		return fromBlock
+	}
+
+	addresses := make([]string, 0, len(proxies))
+	for proxy := range proxies {
+		addresses = append(addresses, "0x"+proxy)
+	}
+	var logs []*proxyUpgradedLog
+	filter := map[string]interface{}{
+		"fromBlock": ethbinding.HexUint64(fromBlock),
+		"toBlock":   head,
+		"address":   addresses,
+		"topics":    [][]string{{upgradedEventTopic()}},
+	}
+	if err := g.rpcCall(ctx, &logs, "eth_getLogs", filter); err != nil {
+		log.Warnf("Failed to poll for proxy upgrades: %s", err)
+		return fromBlock
+	}
+	// The logs are in chain order, so the last upgrade of each proxy is applied last
+	for _, upgraded := range logs {
+		if len(upgraded.Topics) < 2 {
+			continue
+		}
+		proxy := strings.TrimPrefix(strings.ToLower(upgraded.Address), "0x")
+		topic := ethbind.API.FromHex(upgraded.Topics[1])
+		if len(topic) < 20 {
+			continue
+		}
+		implementation := strings.ToLower(ethbind.API.BytesToAddress(topic[len(topic)-20:]).Hex())
+		log.Infof("Proxy contract %s upgraded to implementation %s", proxy, implementation)
+		if err := g.updateProxyImplementation(ctx, proxy, implementation); err != nil {
+			log.Errorf("Failed to update the implementation of proxy contract %s: %s", proxy, err)
+		}
+	}
+	return uint64(head) + 1
+}
+
+func (g *smartContractGW) proxyWatchLoop(done chan struct{}) {
+	interval := g.conf.Proxies.PollIntervalSec
+	if interval <= 0 {
+		interval = defaultProxyPollIntervalSec
+	}
+	ticker := time.NewTicker(time.Duration(interval) * time.Second)
+	defer ticker.Stop()
+	var fromBlock uint64
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			fromBlock = g.pollProxyUpgrades(context.Background(), fromBlock)
+		}
+	}
+}
+
+// startProxyWatcher starts following the upgrades of the tracked proxies, if it has not already
+func (g *smartContractGW) startProxyWatcher() {
+	g.proxiesLock.Lock()
+	defer g.proxiesLock.Unlock()
+	if g.proxiesDone != nil || g.rpc == nil {
+		return
+	}
+	g.proxiesDone = make(chan struct{})
+	go g.proxyWatchLoop(g.proxiesDone)
+}
+
+func (g *smartContractGW) stopProxyWatcher() {
+	g.proxiesLock.Lock()
+	defer g.proxiesLock.Unlock()
+	if g.proxiesDone != nil {
+		close(g.proxiesDone)
+		g.proxiesDone = nil
+	}
+}
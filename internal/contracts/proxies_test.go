@@ -0,0 +1,239 @@
+// Copyright 2021 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package contracts
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/julienschmidt/httprouter"
+	ethbinding "github.com/kaleido-io/ethbinding/pkg"
+	"github.com/kaleido-io/ethconnect/internal/eth"
+	"github.com/stretchr/testify/assert"
+)
+
+const testProxyAddr = "fedcba9876543210fedcba9876543210fedcba98"
+const testProxyNewImpl = "0x00000000000000000000000000000000000000bb"
+
+// proxyChain answers the calls made to detect and follow a proxy
+type proxyChain struct {
+	implementation string
+	head           uint64
+	logs           []*proxyUpgradedLog
+	filters        []map[string]interface{}
+}
+
+func (c *proxyChain) rpc() eth.RPCClient {
+	return eth.NewMockRPCClientForSync(nil, func(method string, res interface{}, args ...interface{}) {
+		switch method {
+		case "eth_getStorageAt":
+			*(res.(*string)) = "0x" + strings.Repeat("0", 24) + fmt.Sprintf("%040s", strings.TrimPrefix(c.implementation, "0x"))
+		case "eth_blockNumber":
+			*(res.(*ethbinding.HexUint64)) = ethbinding.HexUint64(c.head)
+		case "eth_getLogs":
+			c.filters = append(c.filters, args[0].(map[string]interface{}))
+			*(res.(*[]*proxyUpgradedLog)) = c.logs
+		}
+	})
+}
+
+func newTestProxyGW(t *testing.T, dir string) (*smartContractGW, *proxyChain, *httprouter.Router) {
+	scgw, _, router := newTestUpgradeGW(t, dir)
+	// The current implementation is registered with abi2, and the next with abi1
+	_, err := scgw.storeNewContractInfo(strings.TrimPrefix(testUpgradePrevious, "0x"), "abi2", "impl1", "", "", "")
+	assert.NoError(t, err)
+	_, err = scgw.storeNewContractInfo(strings.TrimPrefix(testProxyNewImpl, "0x"), "abi1", "impl2", "", "", "")
+	assert.NoError(t, err)
+	chain := &proxyChain{implementation: testUpgradePrevious, head: 100}
+	scgw.rpc = chain.rpc()
+	return scgw, chain, router
+}
+
+func testRegisterProxy(router *httprouter.Router, addr string) (int, *contractInfo, string) {
+	req := httptest.NewRequest("POST", "/abis/abi1/0x"+addr+"?fly-detectproxy", nil)
+	res := httptest.NewRecorder()
+	router.ServeHTTP(res, req)
+	var info contractInfo
+	json.Unmarshal(res.Body.Bytes(), &info)
+	return res.Code, &info, res.Body.String()
+}
+
+func TestRegisterProxyContract(t *testing.T) {
+	assert := assert.New(t)
+	dir := tempdir()
+	defer cleanup(dir)
+	scgw, chain, router := newTestProxyGW(t, dir)
+	defer scgw.stopProxyWatcher()
+
+	status, info, body := testRegisterProxy(router, testProxyAddr)
+	assert.Equal(201, status, body)
+	assert.Equal("abi2", info.ABI)
+	assert.Equal(testUpgradePrevious, info.Implementation)
+	assert.Equal(map[string]string{testProxyAddr: testUpgradePrevious}, scgw.trackedProxies())
+	assert.NotNil(scgw.proxiesDone)
+
+	// The stored entry includes the implementation, so it is followed after a restart
+	scgw2, _, _ := newTestDeployPlanGW(t, dir)
+	defer scgw2.Shutdown()
+	assert.Equal(testUpgradePrevious, scgw2.trackedProxies()[testProxyAddr])
+
+	// A contract that is not a proxy is bound to the ABI in the path
+	chain.implementation = ""
+	status, info, body = testRegisterProxy(router, "1111111111111111111111111111111111111111")
+	assert.Equal(201, status, body)
+	assert.Equal("abi1", info.ABI)
+	assert.Empty(info.Implementation)
+
+	chain.implementation = "0x00000000000000000000000000000000000000cc"
+	status, _, body = testRegisterProxy(router, "2222222222222222222222222222222222222222")
+	assert.Equal(404, status)
+	assert.Regexp("No ABI found for the implementation 0x00000000000000000000000000000000000000cc of proxy contract 2222222222222222222222222222222222222222", body)
+
+	scgw.rpc = eth.NewMockRPCClientForSync(fmt.Errorf("pop"), nil)
+	status, _, body = testRegisterProxy(router, "3333333333333333333333333333333333333333")
+	assert.Equal(500, status)
+	assert.Regexp("pop", body)
+}
+
+func TestRegisterProxyRemoteRegistryABI(t *testing.T) {
+	assert := assert.New(t)
+	dir := tempdir()
+	defer cleanup(dir)
+	scgw, chain, router := newTestProxyGW(t, dir)
+	defer scgw.stopProxyWatcher()
+
+	implABI, _, _ := scgw.loadDeployMsgByID("abi2")
+	rr := &mockRR{deployMsg: &deployContractWithAddress{DeployContract: *implABI}}
+	scgw.rr = rr
+	chain.implementation = "0x00000000000000000000000000000000000000cc"
+	status, info, body := testRegisterProxy(router, testProxyAddr)
+	assert.Equal(201, status, body)
+	assert.Equal(remoteImplementationABIPrefix+"00000000000000000000000000000000000000cc", info.ABI)
+	assert.Equal(chain.implementation, rr.addrCapture)
+	deployMsg, _, err := scgw.loadDeployMsgByID(info.ABI)
+	assert.NoError(err)
+	assert.Equal(implABI.ABI, deployMsg.ABI)
+}
+
+func TestProxyUpgradeEvents(t *testing.T) {
+	assert := assert.New(t)
+	dir := tempdir()
+	defer cleanup(dir)
+	scgw, chain, router := newTestProxyGW(t, dir)
+	defer scgw.stopProxyWatcher()
+	status, _, body := testRegisterProxy(router, testProxyAddr)
+	assert.Equal(201, status, body)
+	proxyInfo := func() contractInfo {
+		scgw.idxLock.Lock()
+		defer scgw.idxLock.Unlock()
+		return *scgw.contractIndex[testProxyAddr].(*contractInfo)
+	}
+
+	// The first poll only checks the implementation slot
+	assert.Equal(uint64(101), scgw.pollProxyUpgrades(context.Background(), 0))
+	assert.Empty(chain.filters)
+	assert.Equal("abi2", proxyInfo().ABI)
+
+	chain.head = 105
+	chain.logs = []*proxyUpgradedLog{{
+		Address: "0x" + strings.ToUpper(testProxyAddr),
+		Topics:  []string{upgradedEventTopic(), "0x" + strings.Repeat("0", 24) + strings.TrimPrefix(testProxyNewImpl, "0x")},
+	}}
+	assert.Equal(uint64(106), scgw.pollProxyUpgrades(context.Background(), 101))
+	assert.Len(chain.filters, 1)
+	assert.Equal(ethbinding.HexUint64(101), chain.filters[0]["fromBlock"])
+	assert.Equal([]string{"0x" + testProxyAddr}, chain.filters[0]["address"])
+	info := proxyInfo()
+	assert.Equal("abi1", info.ABI)
+	assert.Equal(testProxyNewImpl, info.Implementation)
+	assert.Len(info.PreviousABIs, 1)
+	assert.Equal("abi2", info.PreviousABIs[0].ABI)
+
+	// No new blocks
+	assert.Equal(uint64(106), scgw.pollProxyUpgrades(context.Background(), 106))
+	assert.Len(chain.filters, 1)
+
+	// An upgrade to an implementation with no ABI leaves the proxy as it was
+	chain.head = 110
+	chain.logs[0].Topics[1] = "0x" + strings.Repeat("0", 62) + "cc"
+	assert.Equal(uint64(111), scgw.pollProxyUpgrades(context.Background(), 106))
+	assert.Equal(testProxyNewImpl, proxyInfo().Implementation)
+
+	// After a restart, an upgrade while the gateway was stopped is found in the slot
+	assert.Equal(uint64(111), scgw.pollProxyUpgrades(context.Background(), 0))
+	info = proxyInfo()
+	assert.Equal("abi2", info.ABI)
+	assert.Equal(testUpgradePrevious, info.Implementation)
+	assert.Len(info.PreviousABIs, 2)
+
+	scgw.rpc = eth.NewMockRPCClientForSync(fmt.Errorf("pop"), nil)
+	assert.Equal(uint64(111), scgw.pollProxyUpgrades(context.Background(), 111))
+}
+
+func TestProxyUpgradedThroughGateway(t *testing.T) {
+	assert := assert.New(t)
+	dir := tempdir()
+	defer cleanup(dir)
+	scgw, _, _ := newTestProxyGW(t, dir)
+
+	scgw.idxLock.Lock()
+	info := scgw.contractIndex[testUpgradeProxy].(*contractInfo)
+	info.Implementation = testUpgradePrevious
+	scgw.idxLock.Unlock()
+	err := scgw.registerUpgrade(context.Background(), &contractUpgrade{
+		Proxy:          testUpgradeProxy,
+		ABI:            "abi2",
+		Implementation: testProxyNewImpl,
+	})
+	assert.NoError(err)
+	assert.Equal("abi2", info.ABI)
+	assert.Equal(testProxyNewImpl, info.Implementation)
+
+	// The Upgraded event of the same upgrade is then a no-op
+	assert.NoError(scgw.updateProxyImplementation(context.Background(), testUpgradeProxy, testProxyNewImpl))
+	assert.Len(info.PreviousABIs, 1)
+}
+
+func TestProxyWatcherStartStop(t *testing.T) {
+	dir := tempdir()
+	defer cleanup(dir)
+	scgw, _, _ := newTestProxyGW(t, dir)
+	scgw.conf.Proxies.PollIntervalSec = 1
+
+	scgw.startProxyWatcher()
+	done := scgw.proxiesDone
+	scgw.startProxyWatcher()
+	assert.Equal(t, done, scgw.proxiesDone)
+	scgw.Shutdown()
+	assert.Nil(t, scgw.proxiesDone)
+}
+
+func TestBindImplementationWriteFailure(t *testing.T) {
+	assert := assert.New(t)
+	dir := tempdir()
+	defer cleanup(dir)
+	scgw, _, _ := newTestProxyGW(t, dir)
+	os.RemoveAll(dir)
+
+	info := &contractInfo{Address: testProxyAddr, ABI: "abi1"}
+	err := scgw.bindImplementation(info, testProxyNewImpl, "abi1")
+	assert.Regexp("Failed to write ABI JSON", err)
+	assert.Empty(info.Implementation)
+}
@@ -0,0 +1,559 @@
+// Copyright 2021 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package contracts
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	log "github.com/sirupsen/logrus"
+
+	ethbinding "github.com/kaleido-io/ethbinding/pkg"
+	"github.com/kaleido-io/ethconnect/internal/auth"
+	ethconnecterrors "github.com/kaleido-io/ethconnect/internal/errors"
+	"github.com/kaleido-io/ethconnect/internal/eth"
+	"github.com/kaleido-io/ethconnect/internal/messages"
+	"github.com/kaleido-io/ethconnect/internal/utils"
+)
+
+const (
+	// ReactionPathPrefix is the path prefix for reaction rules
+	ReactionPathPrefix = "/reactions"
+
+	reactionStatusSubmitted = "submitted"
+	reactionStatusSkipped   = "skipped"
+	reactionStatusFailed    = "failed"
+	reactionStatusDryRun    = "dryRun"
+
+	reactionQueueSize = 1000
+)
+
+var (
+	// reactionReference is a reference to a field of the triggering event, such as ${data.amount}
+	reactionReference = regexp.MustCompile(`\$\{([A-Za-z0-9_.]+)\}`)
+	// reactionEventFields are the fields of an event, other than its data, that can be referenced
+	reactionEventFields = []string{"address", "blockNumber", "transactionHash", "transactionIndex", "logIndex", "signature", "subId", "timestamp"}
+)
+
+// reactionRule submits a transaction to a method of a registered contract for each event from a
+// subscription that matches it. Parameters are templates, which can refer to the fields of the event
+type reactionRule struct {
+	messages.TimeSorted
+	ID           string            `json:"id"`
+	Name         string            `json:"name,omitempty"`
+	Subscription string            `json:"subscription"`
+	Match        map[string]string `json:"match,omitempty"`
+	Contract     string            `json:"contract"`
+	Environment  string            `json:"environment,omitempty"`
+	Address      string            `json:"address,omitempty"`
+	Method       string            `json:"method"`
+	Params       []interface{}     `json:"params,omitempty"`
+	From         string            `json:"from"`
+	Gas          json.Number       `json:"gas,omitempty"`
+	Value        json.Number       `json:"value,omitempty"`
+	Policy       reactionPolicy    `json:"policy"`
+	Tenant       string            `json:"tenant,omitempty"`
+}
+
+// reactionPolicy limits what a rule can do, as it submits transactions without a request for each
+type reactionPolicy struct {
+	MaxPerMinute int  `json:"maxPerMinute,omitempty"` // Further events in the same minute are skipped, to stop runaway chains of reactions
+	DryRun       bool `json:"dryRun,omitempty"`       // Audit the transactions that would be submitted, without submitting them
+}
+
+// reactionRecord is the audit of an event that matched a rule, and what the rule did with it
+type reactionRecord struct {
+	ID           string            `json:"id"`
+	Rule         string            `json:"rule"`
+	Subscription string            `json:"subscription"`
+	Time         string            `json:"time"`
+	Status       string            `json:"status"`
+	Error        string            `json:"error,omitempty"`
+	Event        *reactionEventRef `json:"event"`
+	To           string            `json:"to,omitempty"`
+	Method       string            `json:"method,omitempty"`
+	Params       []interface{}     `json:"params,omitempty"`
+	Request      string            `json:"request,omitempty"` // ID of the transaction request, to look up its receipt
+}
+
+// reactionEventRef identifies the event that triggered a reaction
+type reactionEventRef struct {
+	Address         string `json:"address"`
+	BlockNumber     string `json:"blockNumber"`
+	TransactionHash string `json:"transactionHash"`
+	LogIndex        string `json:"logIndex"`
+}
+
+// reactionState is the runtime of a rule, counting the transactions in the current minute
+type reactionState struct {
+	rule        *reactionRule
+	windowStart time.Time
+	count       int
+}
+
+type reactionJob struct {
+	rule   *reactionRule
+	record *reactionRecord
+}
+
+func (r *reactionRule) GetID() string {
+	return r.ID
+}
+
+func reactionReferences(value interface{}, refs []string) []string {
+	switch v := value.(type) {
+	case string:
+		for _, groups := range reactionReference.FindAllStringSubmatch(v, -1) {
+			refs = append(refs, groups[1])
+		}
+	case []interface{}:
+		for _, entry := range v {
+			refs = reactionReferences(entry, refs)
+		}
+	}
+	return refs
+}
+
+func validateReactionReference(ref string) error {
+	if strings.HasPrefix(ref, "data.") && len(ref) > len("data.") {
+		return nil
+	}
+	for _, field := range reactionEventFields {
+		if ref == field {
+			return nil
+		}
+	}
+	return ethconnecterrors.Errorf(ethconnecterrors.ReactionBadReference, ref, strings.Join(reactionEventFields, ", "))
+}
+
+// reactionField returns the value of a field of an event, such as data.amount
+func reactionField(event map[string]interface{}, ref string) (interface{}, error) {
+	var value interface{} = event
+	for _, name := range strings.Split(ref, ".") {
+		fields, ok := value.(map[string]interface{})
+		if !ok {
+			return nil, ethconnecterrors.Errorf(ethconnecterrors.ReactionFieldNotFound, ref)
+		}
+		if value, ok = fields[name]; !ok {
+			return nil, ethconnecterrors.Errorf(ethconnecterrors.ReactionFieldNotFound, ref)
+		}
+	}
+	return value, nil
+}
+
+// renderReactionParam replaces the references in a parameter with the fields of the event. A string
+// that is a single reference is replaced with the field itself, so arrays and numbers keep their type
+func renderReactionParam(param interface{}, event map[string]interface{}) (interface{}, error) {
+	switch v := param.(type) {
+	case string:
+		if groups := reactionReference.FindStringSubmatch(v); groups != nil && groups[0] == v {
+			return reactionField(event, groups[1])
+		}
+		var err error
+		rendered := reactionReference.ReplaceAllStringFunc(v, func(ref string) string {
+			value, fieldErr := reactionField(event, reactionReference.FindStringSubmatch(ref)[1])
+			if fieldErr != nil {
+				err = fieldErr
+				return ref
+			}
+			return fmt.Sprintf("%v", value)
+		})
+		return rendered, err
+	case []interface{}:
+		rendered := make([]interface{}, len(v))
+		for i, entry := range v {
+			var err error
+			if rendered[i], err = renderReactionParam(entry, event); err != nil {
+				return nil, err
+			}
+		}
+		return rendered, nil
+	}
+	return param, nil
+}
+
+// matches checks each field in the match of the rule has the value given, ignoring case
+// so that addresses match however they are written
+func (r *reactionRule) matches(event map[string]interface{}) bool {
+	for ref, expected := range r.Match {
+		value, err := reactionField(event, ref)
+		if err != nil || !strings.EqualFold(fmt.Sprintf("%v", value), expected) {
+			return false
+		}
+	}
+	return true
+}
+
+// reactionTarget returns the method of the contract a rule invokes, checking it can be invoked in
+// a transaction. This is checked when each transaction is submitted, as well as when the rule is
+// created, as the method access of the contract can change
+func (g *smartContractGW) reactionTarget(rule *reactionRule) (*ethbinding.ABIElementMarshaling, ethbinding.ABIMarshaling, error) {
+	g.idxLock.Lock()
+	deployMsg, info, err := g.loadDeployMsgForInstance(rule.Address)
+	g.idxLock.Unlock()
+	if err != nil {
+		return nil, nil, err
+	}
+	method := findDeployPlanMethod(deployMsg.ABI, rule.Method, len(rule.Params))
+	if method == nil || len(method.Inputs) != len(rule.Params) {
+		return nil, nil, ethconnecterrors.Errorf(ethconnecterrors.ReactionMethodNotFound, rule.Method, rule.Contract)
+	}
+	access := methodAccessFor(deployMsg, info)
+	if method.Constant || method.StateMutability == "view" || method.StateMutability == "pure" ||
+		methodListed(access.HiddenMethods, method.Name) || methodListed(access.ReadOnlyMethods, method.Name) {
+		return nil, nil, ethconnecterrors.Errorf(ethconnecterrors.ReactionMethodNotAllowed, rule.Method, rule.Contract)
+	}
+	return method, deployMsg.ABI, nil
+}
+
+// reactionInputNames returns the names of the inputs of the method of a rule, to redact the
+// parameters in its audit records
+func (g *smartContractGW) reactionInputNames(rule *reactionRule) []string {
+	g.idxLock.Lock()
+	deployMsg, _, err := g.loadDeployMsgForInstance(rule.Address)
+	g.idxLock.Unlock()
+	if err != nil {
+		return nil
+	}
+	method := findDeployPlanMethod(deployMsg.ABI, rule.Method, len(rule.Params))
+	if method == nil {
+		return nil
+	}
+	names := make([]string, len(method.Inputs))
+	for i, input := range method.Inputs {
+		names[i] = input.Name
+	}
+	return names
+}
+
+// validateReactionRule checks the subscription and contract of a rule exist, the method can be
+// invoked, and the references to the fields of events are valid
+func (g *smartContractGW) validateReactionRule(rule *reactionRule) error {
+	if rule.Subscription == "" {
+		return ethconnecterrors.Errorf(ethconnecterrors.ReactionNoSubscription)
+	}
+	if rule.Contract == "" || rule.Method == "" {
+		return ethconnecterrors.Errorf(ethconnecterrors.ReactionNoMethod)
+	}
+	if rule.From == "" {
+		return ethconnecterrors.Errorf(ethconnecterrors.ReactionNoFrom)
+	}
+	if rule.Policy.MaxPerMinute < 0 {
+		return ethconnecterrors.Errorf(ethconnecterrors.ReactionBadPolicy, "maxPerMinute cannot be negative")
+	}
+	refs := reactionReferences(rule.Params, nil)
+	for ref := range rule.Match {
+		refs = append(refs, ref)
+	}
+	for _, ref := range refs {
+		if err := validateReactionReference(ref); err != nil {
+			return err
+		}
+	}
+	if _, err := g.sm.SubscriptionByID(auth.NewSystemAuthContext(), rule.Subscription); err != nil {
+		return err
+	}
+	rule.Address = strings.TrimPrefix(strings.ToLower(rule.Contract), "0x")
+	if !addrCheck.MatchString(rule.Address) {
+		addr, err := g.resolveContractAddr(rule.Contract, rule.Environment)
+		if err != nil {
+			return err
+		}
+		rule.Address = addr
+	}
+	_, _, err := g.reactionTarget(rule)
+	return err
+}
+
+// startReactions restores the rules from the registry, and starts reacting to the events
+// dispatched by the subscription manager
+func (g *smartContractGW) startReactions() {
+	g.loadReactionRules()
+	g.reactionQueue = make(chan *reactionJob, reactionQueueSize)
+	g.reactionsDone = make(chan struct{})
+	go g.reactionWorker()
+	g.sm.SetEventReactor(g)
+}
+
+func (g *smartContractGW) loadReactionRules() {
+	entries, err := g.store.list(registryKindReaction)
+	if err != nil {
+		log.Errorf("Failed to list reaction rules: %s", err)
+		return
+	}
+	for _, entry := range entries {
+		ruleBytes, err := g.store.get(registryKindReaction, entry.ID)
+		var rule reactionRule
+		if err == nil {
+			err = json.Unmarshal(ruleBytes, &rule)
+		}
+		if err != nil {
+			log.Errorf("Failed to load reaction rule %s: %s", entry.ID, err)
+			continue
+		}
+		g.reactions[rule.ID] = &reactionState{rule: &rule}
+	}
+}
+
+// ReactToEvent checks each rule for the subscription of an event, and queues a transaction
+// for those that match. Called as the event is dispatched by the subscription, so the
+// transactions are submitted by a separate worker
+func (g *smartContractGW) ReactToEvent(subID string, event map[string]interface{}) {
+	g.reactionsLock.Lock()
+	defer g.reactionsLock.Unlock()
+	for _, state := range g.reactions {
+		rule := state.rule
+		if rule.Subscription != subID || !rule.matches(event) {
+			continue
+		}
+		record := &reactionRecord{
+			ID:           rule.ID + "-" + utils.UUIDv4(),
+			Rule:         rule.ID,
+			Subscription: subID,
+			Time:         time.Now().UTC().Format(time.RFC3339Nano),
+			Event: &reactionEventRef{
+				Address:         fmt.Sprintf("%v", event["address"]),
+				BlockNumber:     fmt.Sprintf("%v", event["blockNumber"]),
+				TransactionHash: fmt.Sprintf("%v", event["transactionHash"]),
+				LogIndex:        fmt.Sprintf("%v", event["logIndex"]),
+			},
+			To:     "0x" + rule.Address,
+			Method: rule.Method,
+		}
+		params, err := renderReactionParam(rule.Params, event)
+		if err != nil {
+			record.Status = reactionStatusFailed
+			record.Error = err.Error()
+		} else {
+			record.Params = params.([]interface{})
+			if !state.allow(time.Now()) {
+				record.Status = reactionStatusSkipped
+				record.Error = ethconnecterrors.Errorf(ethconnecterrors.ReactionRateLimited, rule.Policy.MaxPerMinute).Error()
+			}
+		}
+		select {
+		case g.reactionQueue <- &reactionJob{rule: rule, record: record}:
+		default:
+			log.Warnf("%s: Reaction queue full. Skipped reaction to event in block %s", rule.ID, record.Event.BlockNumber)
+			record.Status = reactionStatusSkipped
+			record.Error = ethconnecterrors.Errorf(ethconnecterrors.ReactionQueueFull).Error()
+			g.saveReactionRecord(rule, record)
+		}
+	}
+}
+
+// allow counts a transaction against the limit of the rule for the current minute
+func (s *reactionState) allow(now time.Time) bool {
+	if s.rule.Policy.MaxPerMinute == 0 {
+		return true
+	}
+	if now.Sub(s.windowStart) >= time.Minute {
+		s.windowStart = now
+		s.count = 0
+	}
+	if s.count >= s.rule.Policy.MaxPerMinute {
+		return false
+	}
+	s.count++
+	return true
+}
+
+// reactionWorker submits the queued transactions in order, and records the audit of each
+func (g *smartContractGW) reactionWorker() {
+	defer close(g.reactionsDone)
+	for job := range g.reactionQueue {
+		if job.record.Status == "" {
+			g.submitReaction(job.rule, job.record)
+		}
+		g.saveReactionRecord(job.rule, job.record)
+	}
+}
+
+func (g *smartContractGW) submitReaction(rule *reactionRule, record *reactionRecord) {
+	method, abi, err := g.reactionTarget(rule)
+	if err != nil {
+		record.Status = reactionStatusFailed
+		record.Error = err.Error()
+		return
+	}
+	if rule.Policy.DryRun {
+		record.Status = reactionStatusDryRun
+		return
+	}
+	msg := &messages.SendTransaction{}
+	msg.Headers.MsgType = messages.MsgTypeSendTransaction
+	msg.Method = method
+	msg.Events = abiEvents(abi)
+	msg.Errors = eth.ErrorABIs(abi)
+	msg.To = record.To
+	msg.From = rule.From
+	msg.Gas = rule.Gas
+	msg.Value = rule.Value
+	msg.Parameters = record.Params
+
+	// Async messages are dispatched as generic map payloads, as from the REST API
+	msgBytes, _ := json.Marshal(msg)
+	var mapMsg map[string]interface{}
+	json.Unmarshal(msgBytes, &mapMsg)
+	sent, err := g.r2e.asyncDispatcher.DispatchMsgAsync(auth.NewSystemAuthContext(), mapMsg, true)
+	if err != nil {
+		record.Status = reactionStatusFailed
+		record.Error = err.Error()
+		return
+	}
+	record.Status = reactionStatusSubmitted
+	record.Request = sent.Request
+	log.Infof("%s: Submitted reaction %s to event in block %s: %s", rule.ID, record.ID, record.Event.BlockNumber, sent.Request)
+}
+
+func (g *smartContractGW) saveReactionRecord(rule *reactionRule, record *reactionRecord) {
+	saved := *record
+	if record.Params != nil && utils.RedactionEnabled() {
+		saved.Params = utils.RedactParams(g.reactionInputNames(rule), record.Params)
+	}
+	recordBytes, _ := json.MarshalIndent(&saved, "", "  ")
+	if err := g.store.put(registryKindReactionAudit, record.ID, recordBytes); err != nil {
+		log.Errorf("%s", ethconnecterrors.Errorf(ethconnecterrors.ReactionSave, record.ID, err))
+	}
+}
+
+// stopReactions stops queuing reactions, and waits for those already queued to be submitted
+func (g *smartContractGW) stopReactions() {
+	g.reactionsLock.Lock()
+	close(g.reactionQueue)
+	g.reactions = make(map[string]*reactionState)
+	g.reactionsLock.Unlock()
+	<-g.reactionsDone
+}
+
+func (g *smartContractGW) createReactionRule(res http.ResponseWriter, req *http.Request, params httprouter.Params) {
+	log.Infof("--> %s %s", req.Method, req.URL)
+
+	if g.sm == nil {
+		g.gatewayErrReply(res, req, errors.New(errEventSupportMissing), 405)
+		return
+	}
+	var rule reactionRule
+	if err := json.NewDecoder(req.Body).Decode(&rule); err != nil {
+		g.gatewayErrReply(res, req, ethconnecterrors.Errorf(ethconnecterrors.ReactionInvalid, err), 400)
+		return
+	}
+	if err := g.validateReactionRule(&rule); err != nil {
+		g.gatewayErrReply(res, req, err, 400)
+		return
+	}
+	rule.ID = utils.UUIDv4()
+	rule.CreatedISO8601 = time.Now().UTC().Format(time.RFC3339)
+	rule.Tenant = auth.GetTenant(req.Context())
+	ruleBytes, _ := json.MarshalIndent(&rule, "", "  ")
+	if err := g.store.put(registryKindReaction, rule.ID, ruleBytes); err != nil {
+		g.gatewayErrReply(res, req, ethconnecterrors.Errorf(ethconnecterrors.ReactionSave, rule.ID, err), 500)
+		return
+	}
+	g.reactionsLock.Lock()
+	g.reactions[rule.ID] = &reactionState{rule: &rule}
+	g.reactionsLock.Unlock()
+	g.deployPlanReply(res, req, &rule, 200)
+}
+
+func (g *smartContractGW) listReactionRules(res http.ResponseWriter, req *http.Request, params httprouter.Params) {
+	log.Infof("--> %s %s", req.Method, req.URL)
+
+	g.reactionsLock.Lock()
+	rules := make([]*reactionRule, 0, len(g.reactions))
+	for _, state := range g.reactions {
+		rules = append(rules, state.rule)
+	}
+	g.reactionsLock.Unlock()
+	sort.Slice(rules, func(i, j int) bool {
+		return rules[i].IsLessThan(rules[i], rules[j])
+	})
+	g.deployPlanReply(res, req, rules, 200)
+}
+
+func (g *smartContractGW) getReactionRule(res http.ResponseWriter, req *http.Request, params httprouter.Params) {
+	log.Infof("--> %s %s", req.Method, req.URL)
+
+	id := params.ByName("id")
+	g.reactionsLock.Lock()
+	state, exists := g.reactions[id]
+	g.reactionsLock.Unlock()
+	if !exists {
+		g.gatewayErrReply(res, req, ethconnecterrors.Errorf(ethconnecterrors.ReactionNotFound, id), 404)
+		return
+	}
+	g.deployPlanReply(res, req, state.rule, 200)
+}
+
+// deleteReactionRule stops a rule reacting to further events. Its audit is kept
+func (g *smartContractGW) deleteReactionRule(res http.ResponseWriter, req *http.Request, params httprouter.Params) {
+	log.Infof("--> %s %s", req.Method, req.URL)
+
+	id := params.ByName("id")
+	g.reactionsLock.Lock()
+	_, exists := g.reactions[id]
+	delete(g.reactions, id)
+	g.reactionsLock.Unlock()
+	if !exists {
+		g.gatewayErrReply(res, req, ethconnecterrors.Errorf(ethconnecterrors.ReactionNotFound, id), 404)
+		return
+	}
+	if err := g.store.delete(registryKindReaction, id); err != nil {
+		g.gatewayErrReply(res, req, err, 500)
+		return
+	}
+	status := 204
+	log.Infof("<-- %s %s [%d]", req.Method, req.URL, status)
+	res.WriteHeader(status)
+}
+
+// getReactionAudit lists the events that matched a rule, oldest first, with the outcome of each
+func (g *smartContractGW) getReactionAudit(res http.ResponseWriter, req *http.Request, params httprouter.Params) {
+	log.Infof("--> %s %s", req.Method, req.URL)
+
+	id := params.ByName("id")
+	entries, err := g.store.list(registryKindReactionAudit)
+	if err != nil {
+		g.gatewayErrReply(res, req, err, 500)
+		return
+	}
+	records := []*reactionRecord{}
+	for _, entry := range entries {
+		if !strings.HasPrefix(entry.ID, id+"-") {
+			continue
+		}
+		recordBytes, err := g.store.get(registryKindReactionAudit, entry.ID)
+		var record reactionRecord
+		if err == nil {
+			err = json.Unmarshal(recordBytes, &record)
+		}
+		if err != nil {
+			log.Warnf("Failed to load reaction audit %s: %s", entry.ID, err)
+			continue
+		}
+		records = append(records, &record)
+	}
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].Time < records[j].Time
+	})
+	g.deployPlanReply(res, req, records, 200)
+}
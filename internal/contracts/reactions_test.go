@@ -0,0 +1,306 @@
+// Copyright 2021 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package contracts
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/kaleido-io/ethconnect/internal/events"
+	"github.com/kaleido-io/ethconnect/internal/messages"
+	"github.com/kaleido-io/ethconnect/internal/utils"
+	"github.com/stretchr/testify/assert"
+)
+
+const testReactionTarget = "2b8c0ecc76d0759a8f50b2e14a6881367d805832"
+
+func newTestReactionGW(t *testing.T, dir string) (*smartContractGW, *mockREST2EthDispatcher, *mockSubMgr, *httprouter.Router) {
+	scgw, _, router := newTestDeployPlanGW(t, dir)
+	_, err := scgw.storeNewContractInfo(testReactionTarget, "abi1", "target", "target", "", "")
+	assert.NoError(t, err)
+	dispatcher := &mockREST2EthDispatcher{
+		asyncDispatchReply: &messages.AsyncSentMsg{Sent: true, Request: "request1"},
+	}
+	scgw.r2e.asyncDispatcher = dispatcher
+	sm := &mockSubMgr{sub: &events.SubscriptionInfo{}}
+	scgw.sm = sm
+	scgw.startReactions()
+	return scgw, dispatcher, sm, router
+}
+
+func testReactionRequest(router *httprouter.Router, method, path string, body interface{}) (int, string) {
+	var reqBody []byte
+	if body != nil {
+		reqBody, _ = json.Marshal(body)
+	}
+	req := httptest.NewRequest(method, path, bytes.NewReader(reqBody))
+	res := httptest.NewRecorder()
+	router.ServeHTTP(res, req)
+	return res.Code, res.Body.String()
+}
+
+func testReactionRule() map[string]interface{} {
+	return map[string]interface{}{
+		"subscription": "sub1",
+		"match":        map[string]string{"data.from": "0x66C5FE653E7A9EBB628A6D40F0452D1E358BAEE8"},
+		"contract":     "target",
+		"method":       "set",
+		"params":       []interface{}{"${data.i}", "block ${blockNumber}: ${data.s}"},
+		"from":         "0x66c5fe653e7a9ebb628a6d40f0452d1e358baee8",
+	}
+}
+
+func testReactionEvent(block int, from string) map[string]interface{} {
+	return map[string]interface{}{
+		"address":         "0x167f57a13a9c35ff92f0649d2be0e52b4f8ac3ca",
+		"blockNumber":     fmt.Sprintf("%d", block),
+		"transactionHash": fmt.Sprintf("0x%064x", block),
+		"logIndex":        "0",
+		"subId":           "sub1",
+		"data": map[string]interface{}{
+			"from": from,
+			"i":    "12345",
+			"s":    "hello",
+		},
+	}
+}
+
+func createTestReactionRule(t *testing.T, router *httprouter.Router, body map[string]interface{}) *reactionRule {
+	status, resBody := testReactionRequest(router, "POST", ReactionPathPrefix, body)
+	assert.Equal(t, 200, status, resBody)
+	var rule reactionRule
+	json.Unmarshal([]byte(resBody), &rule)
+	return &rule
+}
+
+func getTestReactionAudit(t *testing.T, router *httprouter.Router, id string) []*reactionRecord {
+	status, resBody := testReactionRequest(router, "GET", ReactionPathPrefix+"/"+id+"/audit", nil)
+	assert.Equal(t, 200, status, resBody)
+	var records []*reactionRecord
+	json.Unmarshal([]byte(resBody), &records)
+	return records
+}
+
+func TestReactionRuleSubmitsTransaction(t *testing.T) {
+	assert := assert.New(t)
+	dir := tempdir()
+	defer cleanup(dir)
+	scgw, dispatcher, sm, router := newTestReactionGW(t, dir)
+	assert.Equal(scgw, sm.reactor)
+
+	rule := createTestReactionRule(t, router, testReactionRule())
+	assert.NotEmpty(rule.ID)
+	assert.Equal("2b8c0ecc76d0759a8f50b2e14a6881367d805832", rule.Address)
+
+	scgw.ReactToEvent("sub1", testReactionEvent(100, "0x66c5fe653e7a9ebb628a6d40f0452d1e358baee8"))
+	scgw.ReactToEvent("sub1", testReactionEvent(101, "0x0000000000000000000000000000000000000000"))
+	scgw.ReactToEvent("sub2", testReactionEvent(102, "0x66c5fe653e7a9ebb628a6d40f0452d1e358baee8"))
+	scgw.stopReactions()
+
+	assert.Equal("SendTransaction", dispatcher.asyncDispatchMsg["headers"].(map[string]interface{})["type"])
+	assert.Equal("0x2b8c0ecc76d0759a8f50b2e14a6881367d805832", dispatcher.asyncDispatchMsg["to"])
+	assert.Equal("0x66c5fe653e7a9ebb628a6d40f0452d1e358baee8", dispatcher.asyncDispatchMsg["from"])
+	assert.Equal([]interface{}{"12345", "block 100: hello"}, dispatcher.asyncDispatchMsg["params"])
+	assert.True(dispatcher.asyncDispatchAck)
+
+	records := getTestReactionAudit(t, router, rule.ID)
+	assert.Len(records, 1)
+	assert.Equal(reactionStatusSubmitted, records[0].Status)
+	assert.Equal("request1", records[0].Request)
+	assert.Equal("100", records[0].Event.BlockNumber)
+	assert.Equal("set", records[0].Method)
+}
+
+func TestReactionRulePolicies(t *testing.T) {
+	assert := assert.New(t)
+	dir := tempdir()
+	defer cleanup(dir)
+	scgw, dispatcher, _, router := newTestReactionGW(t, dir)
+
+	limited := testReactionRule()
+	limited["policy"] = map[string]interface{}{"maxPerMinute": 1}
+	limitedRule := createTestReactionRule(t, router, limited)
+	dryRun := testReactionRule()
+	dryRun["policy"] = map[string]interface{}{"dryRun": true}
+	dryRunRule := createTestReactionRule(t, router, dryRun)
+
+	from := "0x66c5fe653e7a9ebb628a6d40f0452d1e358baee8"
+	scgw.ReactToEvent("sub1", testReactionEvent(100, from))
+	scgw.ReactToEvent("sub1", testReactionEvent(101, from))
+	scgw.stopReactions()
+
+	records := getTestReactionAudit(t, router, limitedRule.ID)
+	assert.Len(records, 2)
+	statuses := map[string]string{}
+	for _, record := range records {
+		statuses[record.Event.BlockNumber] = record.Status
+	}
+	assert.Equal(reactionStatusSubmitted, statuses["100"])
+	assert.Equal(reactionStatusSkipped, statuses["101"])
+
+	records = getTestReactionAudit(t, router, dryRunRule.ID)
+	assert.Len(records, 2)
+	for _, record := range records {
+		assert.Equal(reactionStatusDryRun, record.Status)
+		assert.Equal([]interface{}{"12345", fmt.Sprintf("block %s: hello", record.Event.BlockNumber)}, record.Params)
+	}
+	assert.Equal([]interface{}{"12345", "block 100: hello"}, dispatcher.asyncDispatchMsg["params"])
+}
+
+func TestReactionRuleRedactsAudit(t *testing.T) {
+	assert := assert.New(t)
+	dir := tempdir()
+	defer cleanup(dir)
+	err := utils.ConfigureRedaction(&utils.RedactionConf{Fields: []string{"s"}})
+	assert.NoError(err)
+	defer utils.ConfigureRedaction(nil)
+	scgw, dispatcher, _, router := newTestReactionGW(t, dir)
+
+	rule := createTestReactionRule(t, router, testReactionRule())
+	scgw.ReactToEvent("sub1", testReactionEvent(100, "0x66c5fe653e7a9ebb628a6d40f0452d1e358baee8"))
+	scgw.stopReactions()
+
+	// The transaction is submitted intact, and the audit record redacted
+	assert.Equal([]interface{}{"12345", "block 100: hello"}, dispatcher.asyncDispatchMsg["params"])
+	records := getTestReactionAudit(t, router, rule.ID)
+	assert.Len(records, 1)
+	assert.Equal(reactionStatusSubmitted, records[0].Status)
+	assert.Equal([]interface{}{"12345", "***"}, records[0].Params)
+}
+
+func TestReactionRuleFailures(t *testing.T) {
+	assert := assert.New(t)
+	dir := tempdir()
+	defer cleanup(dir)
+	scgw, dispatcher, _, router := newTestReactionGW(t, dir)
+
+	body := testReactionRule()
+	body["params"] = []interface{}{"${data.i}", "${data.missing}"}
+	missingRule := createTestReactionRule(t, router, body)
+	scgw.ReactToEvent("sub1", testReactionEvent(100, "0x66c5fe653e7a9ebb628a6d40f0452d1e358baee8"))
+
+	dispatcher.asyncDispatchError = fmt.Errorf("pop")
+	rule := createTestReactionRule(t, router, testReactionRule())
+	scgw.ReactToEvent("sub1", testReactionEvent(101, "0x66c5fe653e7a9ebb628a6d40f0452d1e358baee8"))
+	scgw.stopReactions()
+
+	records := getTestReactionAudit(t, router, missingRule.ID)
+	assert.Len(records, 2)
+	assert.Equal(reactionStatusFailed, records[0].Status)
+	assert.Regexp("Event field 'data.missing' not found", records[0].Error)
+
+	records = getTestReactionAudit(t, router, rule.ID)
+	assert.Len(records, 1)
+	assert.Equal(reactionStatusFailed, records[0].Status)
+	assert.Equal("pop", records[0].Error)
+}
+
+func TestReactionRuleQueueFull(t *testing.T) {
+	assert := assert.New(t)
+	dir := tempdir()
+	defer cleanup(dir)
+	scgw, _, _, router := newTestReactionGW(t, dir)
+	rule := createTestReactionRule(t, router, testReactionRule())
+
+	scgw.stopReactions()
+	scgw.reactionQueue = make(chan *reactionJob)
+	scgw.reactions[rule.ID] = &reactionState{rule: rule}
+	scgw.ReactToEvent("sub1", testReactionEvent(100, "0x66c5fe653e7a9ebb628a6d40f0452d1e358baee8"))
+
+	records := getTestReactionAudit(t, router, rule.ID)
+	assert.Len(records, 1)
+	assert.Equal(reactionStatusSkipped, records[0].Status)
+	assert.Regexp("queue of reactions waiting to be submitted is full", records[0].Error)
+}
+
+func TestReactionRuleLifecycle(t *testing.T) {
+	assert := assert.New(t)
+	dir := tempdir()
+	defer cleanup(dir)
+	scgw, _, _, router := newTestReactionGW(t, dir)
+	rule := createTestReactionRule(t, router, testReactionRule())
+	scgw.stopReactions()
+
+	// Rules are restored when the gateway restarts
+	scgw, _, router = newTestDeployPlanGW(t, dir)
+	scgw.sm = &mockSubMgr{}
+	scgw.startReactions()
+	defer scgw.stopReactions()
+	status, body := testReactionRequest(router, "GET", ReactionPathPrefix, nil)
+	assert.Equal(200, status)
+	var rules []*reactionRule
+	json.Unmarshal([]byte(body), &rules)
+	assert.Len(rules, 1)
+	assert.Equal(rule.ID, rules[0].ID)
+
+	status, body = testReactionRequest(router, "GET", ReactionPathPrefix+"/"+rule.ID, nil)
+	assert.Equal(200, status)
+	assert.Regexp(`"method": "set"`, body)
+
+	status, _ = testReactionRequest(router, "DELETE", ReactionPathPrefix+"/"+rule.ID, nil)
+	assert.Equal(204, status)
+	status, body = testReactionRequest(router, "DELETE", ReactionPathPrefix+"/"+rule.ID, nil)
+	assert.Equal(404, status)
+	assert.Regexp("Reaction rule '.*' not found", body)
+	status, _ = testReactionRequest(router, "GET", ReactionPathPrefix+"/"+rule.ID, nil)
+	assert.Equal(404, status)
+	assert.Empty(getTestReactionAudit(t, router, rule.ID))
+}
+
+func TestReactionRuleValidation(t *testing.T) {
+	assert := assert.New(t)
+	dir := tempdir()
+	defer cleanup(dir)
+	scgw, _, sm, router := newTestReactionGW(t, dir)
+	defer scgw.stopReactions()
+
+	for _, test := range []struct {
+		change   func(map[string]interface{})
+		expected string
+	}{
+		{func(r map[string]interface{}) { delete(r, "subscription") }, "must specify the 'subscription'"},
+		{func(r map[string]interface{}) { delete(r, "method") }, "must specify the 'contract' and 'method'"},
+		{func(r map[string]interface{}) { delete(r, "from") }, "must specify the 'from'"},
+		{func(r map[string]interface{}) { r["policy"] = map[string]interface{}{"maxPerMinute": -1} }, "maxPerMinute cannot be negative"},
+		{func(r map[string]interface{}) { r["params"] = []interface{}{"${topics}", "x"} }, "Invalid event field 'topics'"},
+		{func(r map[string]interface{}) { r["match"] = map[string]string{"data": "x"} }, "Invalid event field 'data'"},
+		{func(r map[string]interface{}) { r["contract"] = "unknown" }, "unknown"},
+		{func(r map[string]interface{}) { r["method"] = "get" }, "Method 'get' is not declared"},
+		{func(r map[string]interface{}) { r["method"] = "storedI"; r["params"] = []interface{}{} }, "cannot be invoked by a reaction rule"},
+	} {
+		body := testReactionRule()
+		test.change(body)
+		status, resBody := testReactionRequest(router, "POST", ReactionPathPrefix, body)
+		assert.Equal(400, status)
+		assert.Regexp(test.expected, resBody)
+	}
+
+	status, resBody := testReactionRequest(router, "POST", ReactionPathPrefix, "!json")
+	assert.Equal(400, status)
+	assert.Regexp("Invalid reaction rule", resBody)
+
+	sm.err = fmt.Errorf("pop")
+	status, resBody = testReactionRequest(router, "POST", ReactionPathPrefix, testReactionRule())
+	assert.Equal(400, status)
+	assert.Regexp("pop", resBody)
+
+	scgw.sm = nil
+	status, _ = testReactionRequest(router, "POST", ReactionPathPrefix, testReactionRule())
+	assert.Equal(405, status)
+}
@@ -0,0 +1,83 @@
+// Copyright 2021 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package contracts
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/julienschmidt/httprouter"
+	ethconnecterrors "github.com/kaleido-io/ethconnect/internal/errors"
+	"github.com/kaleido-io/ethconnect/internal/webhook"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// RegistryInvalidatePath is the path to drop entries from the cache of the remote registry
+	RegistryInvalidatePath = "/registry/invalidate"
+	// RegistryPushPath is the path the remote registry calls when entries change
+	RegistryPushPath = "/registry/push"
+	// RegistryPushSignatureHeader is the header containing the HMAC-SHA256 signature of a push notification
+	RegistryPushSignatureHeader = webhook.SignatureHeader
+)
+
+func (g *smartContractGW) invalidateRegistryCache(res http.ResponseWriter, req *http.Request, params httprouter.Params) {
+	log.Infof("--> %s %s", req.Method, req.URL)
+
+	var body registryInvalidation
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil && err != io.EOF {
+		g.gatewayErrReply(res, req, ethconnecterrors.Errorf(ethconnecterrors.RemoteRegistryInvalidationInvalid, err), 400)
+		return
+	}
+	reload := false
+	if vs := req.URL.Query()["reload"]; len(vs) > 0 {
+		reload = strings.ToLower(vs[0]) != "false"
+	}
+	g.replyInvalidated(res, req, g.rr.invalidate(&body, reload))
+}
+
+func (g *smartContractGW) pushRegistryChanges(res http.ResponseWriter, req *http.Request, params httprouter.Params) {
+	log.Infof("--> %s %s", req.Method, req.URL)
+
+	bodyBytes, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		g.gatewayErrReply(res, req, ethconnecterrors.Errorf(ethconnecterrors.RemoteRegistryInvalidationInvalid, err), 400)
+		return
+	}
+	if secret := g.conf.RemoteRegistry.Push.Secret; secret != "" && !webhook.Verify(secret, bodyBytes, req.Header.Get(RegistryPushSignatureHeader)) {
+		g.gatewayErrReply(res, req, ethconnecterrors.Errorf(ethconnecterrors.RemoteRegistryPushSignatureInvalid), 401)
+		return
+	}
+	var body registryInvalidation
+	if err := json.NewDecoder(bytes.NewReader(bodyBytes)).Decode(&body); err != nil && err != io.EOF {
+		g.gatewayErrReply(res, req, ethconnecterrors.Errorf(ethconnecterrors.RemoteRegistryInvalidationInvalid, err), 400)
+		return
+	}
+	// The registry names the entries that changed, so they are reloaded straight away.
+	// A notification that names nothing drops the whole cache, to be reloaded on use
+	reload := len(body.Gateways) > 0 || len(body.Instances) > 0
+	g.replyInvalidated(res, req, g.rr.invalidate(&body, reload))
+}
+
+func (g *smartContractGW) replyInvalidated(res http.ResponseWriter, req *http.Request, dropped *registryInvalidation) {
+	log.Infof("<-- %s %s [%d]", req.Method, req.URL, 200)
+	res.Header().Set("Content-Type", "application/json")
+	res.WriteHeader(200)
+	json.NewEncoder(res).Encode(dropped)
+}
@@ -0,0 +1,130 @@
+// Copyright 2021 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package contracts
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/kaleido-io/ethconnect/internal/tx"
+	"github.com/kaleido-io/ethconnect/internal/webhook"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestRegistryCacheGW(t *testing.T, dir string, push RemoteRegistryPushConf) (*mockRR, *httprouter.Router) {
+	s, err := NewSmartContractGateway(
+		&SmartContractGatewayConf{
+			StoragePath:    dir,
+			BaseURL:        "http://localhost/api/v1",
+			RemoteRegistry: RemoteRegistryConf{Push: push},
+		},
+		&tx.TxnProcessorConf{},
+		nil, nil, nil, nil,
+	)
+	assert.NoError(t, err)
+	scgw := s.(*smartContractGW)
+	rr := &mockRR{}
+	scgw.rr = rr
+	router := &httprouter.Router{}
+	scgw.AddRoutes(router)
+	return rr, router
+}
+
+func testRegistryCacheRequest(router *httprouter.Router, path, body, signature string) (int, string) {
+	req := httptest.NewRequest("POST", path, strings.NewReader(body))
+	if signature != "" {
+		req.Header.Set(RegistryPushSignatureHeader, signature)
+	}
+	res := httptest.NewRecorder()
+	router.ServeHTTP(res, req)
+	return res.Code, res.Body.String()
+}
+
+func testRegistryPushSignature(secret, body string) string {
+	return webhook.Sign(secret, []byte(body))
+}
+
+func TestRegistryInvalidate(t *testing.T) {
+	assert := assert.New(t)
+	dir := tempdir()
+	defer cleanup(dir)
+	rr, router := newTestRegistryCacheGW(t, dir, RemoteRegistryPushConf{})
+
+	status, body := testRegistryCacheRequest(router, RegistryInvalidatePath, `{"gateways":["gw1"]}`, "")
+	assert.Equal(200, status)
+	assert.Equal([]string{"gw1"}, rr.invalidCapture.Gateways)
+	assert.False(rr.reloadCapture)
+	var dropped registryInvalidation
+	json.Unmarshal([]byte(body), &dropped)
+	assert.Equal([]string{"gw1"}, dropped.Gateways)
+
+	// No body drops everything, and reload fetches the dropped entries straight away
+	status, _ = testRegistryCacheRequest(router, RegistryInvalidatePath+"?reload", "", "")
+	assert.Equal(200, status)
+	assert.Empty(rr.invalidCapture.Gateways)
+	assert.Empty(rr.invalidCapture.Instances)
+	assert.True(rr.reloadCapture)
+
+	status, body = testRegistryCacheRequest(router, RegistryInvalidatePath, "!json", "")
+	assert.Equal(400, status)
+	assert.Regexp("Invalid remote registry invalidation request", body)
+
+	// The push webhook is not enabled
+	status, _ = testRegistryCacheRequest(router, RegistryPushPath, `{}`, "")
+	assert.Equal(404, status)
+}
+
+func TestRegistryPush(t *testing.T) {
+	assert := assert.New(t)
+	dir := tempdir()
+	defer cleanup(dir)
+	rr, router := newTestRegistryCacheGW(t, dir, RemoteRegistryPushConf{Enabled: true, Secret: "s3cret"})
+
+	body := `{"instances":["inst1"]}`
+	status, _ := testRegistryCacheRequest(router, RegistryPushPath, body, testRegistryPushSignature("s3cret", body))
+	assert.Equal(200, status)
+	assert.Equal([]string{"inst1"}, rr.invalidCapture.Instances)
+	assert.True(rr.reloadCapture)
+
+	// A notification that names nothing drops everything, without reloading
+	status, _ = testRegistryCacheRequest(router, RegistryPushPath, "{}", testRegistryPushSignature("s3cret", "{}"))
+	assert.Equal(200, status)
+	assert.False(rr.reloadCapture)
+
+	status, respBody := testRegistryCacheRequest(router, RegistryPushPath, body, testRegistryPushSignature("wrong", body))
+	assert.Equal(401, status)
+	assert.Regexp("Invalid signature on remote registry push notification", respBody)
+
+	status, _ = testRegistryCacheRequest(router, RegistryPushPath, body, "")
+	assert.Equal(401, status)
+
+	status, respBody = testRegistryCacheRequest(router, RegistryPushPath, "!json", testRegistryPushSignature("s3cret", "!json"))
+	assert.Equal(400, status)
+	assert.Regexp("Invalid remote registry invalidation request", respBody)
+}
+
+func TestRegistryPushNoSecret(t *testing.T) {
+	assert := assert.New(t)
+	dir := tempdir()
+	defer cleanup(dir)
+	rr, router := newTestRegistryCacheGW(t, dir, RemoteRegistryPushConf{Enabled: true})
+
+	status, _ := testRegistryCacheRequest(router, RegistryPushPath, `{"gateways":["gw1"]}`, "")
+	assert.Equal(200, status)
+	assert.Equal([]string{"gw1"}, rr.invalidCapture.Gateways)
+}
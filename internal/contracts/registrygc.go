@@ -0,0 +1,238 @@
+// Copyright 2021 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package contracts
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/julienschmidt/httprouter"
+	ethconnecterrors "github.com/kaleido-io/ethconnect/internal/errors"
+	"github.com/kaleido-io/ethconnect/internal/messages"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// RegistryOrphansPath is the admin path that reports the orphaned entries of the local registry
+	RegistryOrphansPath = "/admin/registry/orphans"
+)
+
+const (
+	// orphanKindABI is an ABI in storage that could not be loaded into the index
+	orphanKindABI = "abi"
+	// orphanKindContract is a contract instance in storage that could not be loaded into the index
+	orphanKindContract = "contract"
+	// orphanKindSource is the Solidity source of an ABI that no longer exists
+	orphanKindSource = "source"
+	// orphanKindInstance is a contract instance registered against an ABI that no longer exists
+	orphanKindInstance = "instance"
+	// orphanKindSubscription is a subscription to the events of contracts that are not in the registry
+	orphanKindSubscription = "subscription"
+)
+
+// defaultOrphanCleanupKinds are the kinds removed by a clean-up that does not list the kinds.
+// Subscriptions can be to contracts that were never registered, so must be requested explicitly
+var defaultOrphanCleanupKinds = []string{orphanKindABI, orphanKindContract, orphanKindSource, orphanKindInstance}
+
+// registryOrphan is an inconsistent entry found in the local registry
+type registryOrphan struct {
+	Kind    string `json:"kind"`
+	ID      string `json:"id"`
+	Reason  string `json:"reason"`
+	Removed bool   `json:"removed,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+// registryOrphanCleanup is the body of a request to remove orphaned entries
+type registryOrphanCleanup struct {
+	Kinds []string `json:"kinds,omitempty"`
+}
+
+// findOrphans scans the registry storage, the index and the subscriptions for entries that
+// reference something that no longer exists, or that were left behind by a failure
+func (g *smartContractGW) findOrphans(ctx context.Context) ([]*registryOrphan, error) {
+	if g.conf.Storage.Shared() {
+		// Pick up the entries other gateways have added since the last refresh first
+		if err := g.loadIndexEntries(true); err != nil {
+			return nil, err
+		}
+	}
+	stored := make(map[registryKind][]*registryEntry)
+	for _, kind := range []registryKind{registryKindABI, registryKindContract, registryKindSource} {
+		entries, err := g.store.list(kind)
+		if err != nil {
+			return nil, err
+		}
+		stored[kind] = entries
+	}
+
+	orphans := []*registryOrphan{}
+	g.idxLock.Lock()
+	for _, entry := range stored[registryKindABI] {
+		if _, exists := g.abiIndex[entry.ID]; !exists {
+			orphans = append(orphans, g.unindexedOrphan(orphanKindABI, registryKindABI, entry.ID, &messages.DeployContract{}))
+		}
+	}
+	for _, entry := range stored[registryKindContract] {
+		if _, exists := g.contractIndex[entry.ID]; !exists {
+			orphans = append(orphans, g.unindexedOrphan(orphanKindContract, registryKindContract, entry.ID, &contractInfo{}))
+		}
+	}
+	for _, entry := range stored[registryKindSource] {
+		if _, exists := g.abiIndex[entry.ID]; !exists {
+			orphans = append(orphans, &registryOrphan{Kind: orphanKindSource, ID: entry.ID, Reason: fmt.Sprintf("ABI %s does not exist", entry.ID)})
+		}
+	}
+	for _, c := range g.contractIndex {
+		info := c.(*contractInfo)
+		if _, exists := g.abiIndex[info.ABI]; !exists && !isWellKnownABI(info.ABI) {
+			orphans = append(orphans, &registryOrphan{Kind: orphanKindInstance, ID: info.Address, Reason: fmt.Sprintf("ABI %s does not exist", info.ABI)})
+		}
+	}
+	if g.sm != nil {
+		for _, sub := range g.sm.Subscriptions(ctx) {
+			if len(sub.Filter.Addresses) == 0 {
+				continue
+			}
+			missing := []string{}
+			for _, addr := range sub.Filter.Addresses {
+				addrHexNo0x := strings.TrimPrefix(strings.ToLower(addr.String()), "0x")
+				if _, exists := g.contractIndex[addrHexNo0x]; !exists {
+					missing = append(missing, addrHexNo0x)
+				}
+			}
+			if len(missing) == len(sub.Filter.Addresses) {
+				orphans = append(orphans, &registryOrphan{Kind: orphanKindSubscription, ID: sub.ID, Reason: fmt.Sprintf("Contract %s is not registered", strings.Join(missing, ","))})
+			}
+		}
+	}
+	g.idxLock.Unlock()
+
+	sort.Slice(orphans, func(i, j int) bool {
+		if orphans[i].Kind != orphans[j].Kind {
+			return orphans[i].Kind < orphans[j].Kind
+		}
+		return orphans[i].ID < orphans[j].ID
+	})
+	return orphans, nil
+}
+
+// unindexedOrphan describes an entry in storage that is missing from the index, with the
+// reason it could not be loaded if it cannot be read now
+func (g *smartContractGW) unindexedOrphan(orphanKind string, kind registryKind, id string, parsed interface{}) *registryOrphan {
+	orphan := &registryOrphan{Kind: orphanKind, ID: id, Reason: "Not in the index"}
+	data, err := g.store.get(kind, id)
+	if err == nil {
+		err = json.Unmarshal(data, parsed)
+	}
+	if err != nil {
+		orphan.Reason = fmt.Sprintf("Failed to load: %s", err)
+	}
+	return orphan
+}
+
+// removeOrphan cleans up an orphaned entry. Instances are removed from the index as well as
+// storage, unless a subscription is listening to their events
+func (g *smartContractGW) removeOrphan(ctx context.Context, orphan *registryOrphan) error {
+	switch orphan.Kind {
+	case orphanKindABI:
+		if err := g.store.delete(registryKindABI, orphan.ID); err != nil {
+			return err
+		}
+		return g.store.delete(registryKindSource, orphan.ID)
+	case orphanKindContract:
+		return g.store.delete(registryKindContract, orphan.ID)
+	case orphanKindSource:
+		return g.store.delete(registryKindSource, orphan.ID)
+	case orphanKindInstance:
+		if err := g.checkContractUnused(ctx, orphan.ID); err != nil {
+			return err
+		}
+		return g.removeContract(orphan.ID)
+	default:
+		return g.sm.DeleteSubscription(ctx, orphan.ID)
+	}
+}
+
+func isOrphanKind(kind string) bool {
+	switch kind {
+	case orphanKindABI, orphanKindContract, orphanKindSource, orphanKindInstance, orphanKindSubscription:
+		return true
+	}
+	return false
+}
+
+func (g *smartContractGW) getRegistryOrphans(res http.ResponseWriter, req *http.Request, params httprouter.Params) {
+	log.Infof("--> %s %s", req.Method, req.URL)
+
+	orphans, err := g.findOrphans(req.Context())
+	if err != nil {
+		g.gatewayErrReply(res, req, ethconnecterrors.Errorf(ethconnecterrors.RESTGatewayRegistryOrphanScan, err), 500)
+		return
+	}
+	log.Infof("<-- %s %s [%d]", req.Method, req.URL, 200)
+	res.Header().Set("Content-Type", "application/json")
+	res.WriteHeader(200)
+	json.NewEncoder(res).Encode(orphans)
+}
+
+func (g *smartContractGW) cleanupRegistryOrphans(res http.ResponseWriter, req *http.Request, params httprouter.Params) {
+	log.Infof("--> %s %s", req.Method, req.URL)
+
+	var body registryOrphanCleanup
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil && err != io.EOF {
+		g.gatewayErrReply(res, req, ethconnecterrors.Errorf(ethconnecterrors.RESTGatewayRegistryOrphanCleanupInvalid, err), 400)
+		return
+	}
+	kinds := body.Kinds
+	if len(kinds) == 0 {
+		kinds = defaultOrphanCleanupKinds
+	}
+	selected := make(map[string]bool)
+	for _, kind := range kinds {
+		if !isOrphanKind(kind) {
+			g.gatewayErrReply(res, req, ethconnecterrors.Errorf(ethconnecterrors.RESTGatewayRegistryOrphanKindInvalid, kind), 400)
+			return
+		}
+		selected[kind] = true
+	}
+
+	orphans, err := g.findOrphans(req.Context())
+	if err != nil {
+		g.gatewayErrReply(res, req, ethconnecterrors.Errorf(ethconnecterrors.RESTGatewayRegistryOrphanScan, err), 500)
+		return
+	}
+	for _, orphan := range orphans {
+		if !selected[orphan.Kind] {
+			continue
+		}
+		if err := g.removeOrphan(req.Context(), orphan); err != nil {
+			log.Errorf("Failed to remove orphaned %s %s: %s", orphan.Kind, orphan.ID, err)
+			orphan.Error = err.Error()
+		} else {
+			log.Infof("Removed orphaned %s %s: %s", orphan.Kind, orphan.ID, orphan.Reason)
+			orphan.Removed = true
+		}
+	}
+	log.Infof("<-- %s %s [%d]", req.Method, req.URL, 200)
+	res.Header().Set("Content-Type", "application/json")
+	res.WriteHeader(200)
+	json.NewEncoder(res).Encode(orphans)
+}
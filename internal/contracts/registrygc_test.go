@@ -0,0 +1,156 @@
+// Copyright 2021 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package contracts
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/kaleido-io/ethconnect/internal/events"
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	testOrphanInstance = "00000000000000000000000000000000000000aa"
+	testOrphanBadFile  = "00000000000000000000000000000000000000bb"
+	testOrphanValid    = "00000000000000000000000000000000000000cc"
+	testOrphanMissing  = "00000000000000000000000000000000000000dd"
+)
+
+func newTestOrphansGW(t *testing.T, dir string) (*smartContractGW, *httprouter.Router) {
+	ioutil.WriteFile(path.Join(dir, "abi_bad.deploy.json"), []byte("!json"), 0644)
+	ioutil.WriteFile(path.Join(dir, "source_gone.source.json"), []byte(`{}`), 0644)
+	ioutil.WriteFile(path.Join(dir, "source_abi1.source.json"), []byte(`{}`), 0644)
+	ioutil.WriteFile(path.Join(dir, "contract_"+testOrphanBadFile+".instance.json"), []byte("!json"), 0644)
+	scgw, router := newTestRegistrationsGW(t, dir)
+	scgw.storeNewContractInfo(testOrphanInstance, "deleted", testOrphanInstance, "", "", "")
+	scgw.storeNewContractInfo(testOrphanValid, "abi1", "token", "token", "", "")
+	scgw.storeNewContractInfo("00000000000000000000000000000000000000ee", "wellknown-erc20", "coin", "coin", "", "")
+
+	var validSub, orphanSub events.SubscriptionInfo
+	json.Unmarshal([]byte(`{"id":"sb-valid","filter":{"address":["0x`+testOrphanValid+`"]}}`), &validSub)
+	json.Unmarshal([]byte(`{"id":"sb-orphan","filter":{"address":["0x`+testOrphanMissing+`"]}}`), &orphanSub)
+	scgw.sm = &mockSubMgr{subs: []*events.SubscriptionInfo{{ID: "sb-any"}, &validSub, &orphanSub}}
+	return scgw, router
+}
+
+func testOrphansRequest(router *httprouter.Router, method, path, body string) (int, []*registryOrphan) {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	res := httptest.NewRecorder()
+	router.ServeHTTP(res, req)
+	var orphans []*registryOrphan
+	json.NewDecoder(res.Body).Decode(&orphans)
+	return res.Code, orphans
+}
+
+func TestRegistryOrphansReport(t *testing.T) {
+	assert := assert.New(t)
+	dir := tempdir()
+	defer cleanup(dir)
+	_, router := newTestOrphansGW(t, dir)
+
+	status, orphans := testOrphansRequest(router, "GET", RegistryOrphansPath, "")
+	assert.Equal(200, status)
+	assert.Equal(5, len(orphans))
+	assert.Equal(orphanKindABI, orphans[0].Kind)
+	assert.Equal("bad", orphans[0].ID)
+	assert.Regexp("Failed to load", orphans[0].Reason)
+	assert.Equal(orphanKindContract, orphans[1].Kind)
+	assert.Equal(testOrphanBadFile, orphans[1].ID)
+	assert.Equal(orphanKindInstance, orphans[2].Kind)
+	assert.Equal(testOrphanInstance, orphans[2].ID)
+	assert.Equal("ABI deleted does not exist", orphans[2].Reason)
+	assert.Equal(orphanKindSource, orphans[3].Kind)
+	assert.Equal("gone", orphans[3].ID)
+	assert.Equal(orphanKindSubscription, orphans[4].Kind)
+	assert.Equal("sb-orphan", orphans[4].ID)
+	assert.Equal(fmt.Sprintf("Contract %s is not registered", testOrphanMissing), orphans[4].Reason)
+	for _, orphan := range orphans {
+		assert.False(orphan.Removed)
+	}
+}
+
+func TestRegistryOrphansCleanup(t *testing.T) {
+	assert := assert.New(t)
+	dir := tempdir()
+	defer cleanup(dir)
+	scgw, router := newTestOrphansGW(t, dir)
+
+	status, orphans := testOrphansRequest(router, "POST", RegistryOrphansPath+"/cleanup", "")
+	assert.Equal(200, status)
+	assert.Equal(5, len(orphans))
+	for _, orphan := range orphans {
+		assert.Equal(orphan.Kind != orphanKindSubscription, orphan.Removed, orphan.Kind)
+	}
+	for _, file := range []string{"abi_bad.deploy.json", "source_gone.source.json", "contract_" + testOrphanBadFile + ".instance.json", "contract_" + testOrphanInstance + ".instance.json"} {
+		_, err := os.Stat(path.Join(dir, file))
+		assert.True(os.IsNotExist(err), file)
+	}
+	_, err := os.Stat(path.Join(dir, "source_abi1.source.json"))
+	assert.NoError(err)
+	_, _, err = scgw.loadDeployMsgForInstance(testOrphanInstance)
+	assert.Regexp("No contract instance registered", err)
+	_, err = scgw.resolveContractAddr("token", "")
+	assert.NoError(err)
+
+	status, orphans = testOrphansRequest(router, "POST", RegistryOrphansPath+"/cleanup", `{"kinds":["subscription"]}`)
+	assert.Equal(200, status)
+	assert.Equal(1, len(orphans))
+	assert.True(orphans[0].Removed)
+}
+
+func TestRegistryOrphansCleanupFailures(t *testing.T) {
+	assert := assert.New(t)
+	dir := tempdir()
+	defer cleanup(dir)
+	scgw, router := newTestOrphansGW(t, dir)
+
+	req := httptest.NewRequest("POST", RegistryOrphansPath+"/cleanup", strings.NewReader("!json"))
+	res := httptest.NewRecorder()
+	router.ServeHTTP(res, req)
+	assert.Equal(400, res.Code)
+	assert.Regexp("Invalid registry clean-up request", res.Body.String())
+
+	req = httptest.NewRequest("POST", RegistryOrphansPath+"/cleanup", strings.NewReader(`{"kinds":["everything"]}`))
+	res = httptest.NewRecorder()
+	router.ServeHTTP(res, req)
+	assert.Equal(400, res.Code)
+	assert.Regexp("Unknown orphan kind 'everything'", res.Body.String())
+
+	// An instance with a subscription is left in place
+	var sub events.SubscriptionInfo
+	json.Unmarshal([]byte(`{"id":"sb-1","filter":{"address":["0x`+testOrphanInstance+`"]}}`), &sub)
+	scgw.sm = &mockSubMgr{subs: []*events.SubscriptionInfo{&sub}}
+	status, orphans := testOrphansRequest(router, "POST", RegistryOrphansPath+"/cleanup", `{"kinds":["instance"]}`)
+	assert.Equal(200, status)
+	assert.Equal(4, len(orphans))
+	assert.Equal(orphanKindInstance, orphans[2].Kind)
+	assert.False(orphans[2].Removed)
+	assert.Regexp("cannot be deleted while it is used by subscription 'sb-1'", orphans[2].Error)
+
+	os.RemoveAll(dir)
+	req = httptest.NewRequest("GET", RegistryOrphansPath, nil)
+	res = httptest.NewRecorder()
+	router.ServeHTTP(res, req)
+	assert.Equal(500, res.Code)
+	assert.Regexp("Failed to scan the registry for orphaned entries", res.Body.String())
+}
@@ -0,0 +1,123 @@
+// Copyright 2021 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package contracts
+
+import (
+	"database/sql"
+	"regexp"
+	"time"
+
+	ethconnecterrors "github.com/kaleido-io/ethconnect/internal/errors"
+	_ "github.com/lib/pq" // PostgreSQL driver
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	defaultPostgreSQLRegistryTable = "ethconnect_registry"
+)
+
+var postgreSQLTableMatcher = regexp.MustCompile("^[a-zA-Z_][a-zA-Z0-9_]*$")
+
+// PostgreSQLRegistryConf stores the registry in a table of a PostgreSQL database
+type PostgreSQLRegistryConf struct {
+	URL   string `json:"url,omitempty"`
+	Table string `json:"table,omitempty"`
+}
+
+// postgreSQLRegistryStore holds each entry as a row keyed by kind and ID. The table is created if it does not exist
+type postgreSQLRegistryStore struct {
+	conf *PostgreSQLRegistryConf
+	db   *sql.DB
+}
+
+func newPostgreSQLRegistryStore(conf *PostgreSQLRegistryConf) (*postgreSQLRegistryStore, error) {
+	if conf.Table == "" {
+		conf.Table = defaultPostgreSQLRegistryTable
+	}
+	if !postgreSQLTableMatcher.MatchString(conf.Table) {
+		return nil, ethconnecterrors.Errorf(ethconnecterrors.RegistryStorePostgreSQLInvalidTable, conf.Table)
+	}
+	db, err := sql.Open("postgres", conf.URL)
+	if err != nil {
+		return nil, ethconnecterrors.Errorf(ethconnecterrors.RegistryStorePostgreSQLConnect, err)
+	}
+	p := &postgreSQLRegistryStore{conf: conf, db: db}
+	if err = p.init(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return p, nil
+}
+
+func (p *postgreSQLRegistryStore) init() error {
+	_, err := p.db.Exec(`CREATE TABLE IF NOT EXISTS ` + p.conf.Table + ` (
+		kind    VARCHAR(16) NOT NULL,
+		id      VARCHAR(64) NOT NULL,
+		data    TEXT NOT NULL,
+		created TIMESTAMP WITH TIME ZONE NOT NULL,
+		updated TIMESTAMP WITH TIME ZONE NOT NULL,
+		PRIMARY KEY (kind, id)
+	)`)
+	if err != nil {
+		return ethconnecterrors.Errorf(ethconnecterrors.RegistryStorePostgreSQLConnect, err)
+	}
+	log.Infof("Registry stored in PostgreSQL table %s", p.conf.Table)
+	return nil
+}
+
+func (p *postgreSQLRegistryStore) put(kind registryKind, id string, data []byte) error {
+	now := time.Now().UTC()
+	_, err := p.db.Exec(`INSERT INTO `+p.conf.Table+` (kind, id, data, created, updated) VALUES ($1, $2, $3, $4, $4)
+		ON CONFLICT (kind, id) DO UPDATE SET data = EXCLUDED.data, updated = EXCLUDED.updated`,
+		string(kind), id, string(data), now)
+	return err
+}
+
+func (p *postgreSQLRegistryStore) get(kind registryKind, id string) ([]byte, error) {
+	var data string
+	err := p.db.QueryRow(`SELECT data FROM `+p.conf.Table+` WHERE kind = $1 AND id = $2`, string(kind), id).Scan(&data)
+	if err == sql.ErrNoRows {
+		return nil, ethconnecterrors.Errorf(ethconnecterrors.RegistryStoreNotFound, kind, id)
+	} else if err != nil {
+		return nil, err
+	}
+	return []byte(data), nil
+}
+
+func (p *postgreSQLRegistryStore) list(kind registryKind) ([]*registryEntry, error) {
+	rows, err := p.db.Query(`SELECT id, created FROM `+p.conf.Table+` WHERE kind = $1 ORDER BY id`, string(kind))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	entries := []*registryEntry{}
+	for rows.Next() {
+		var entry registryEntry
+		if err := rows.Scan(&entry.ID, &entry.Modified); err != nil {
+			return nil, err
+		}
+		entries = append(entries, &entry)
+	}
+	return entries, rows.Err()
+}
+
+func (p *postgreSQLRegistryStore) delete(kind registryKind, id string) error {
+	_, err := p.db.Exec(`DELETE FROM `+p.conf.Table+` WHERE kind = $1 AND id = $2`, string(kind), id)
+	return err
+}
+
+func (p *postgreSQLRegistryStore) close() {
+	p.db.Close()
+}
@@ -0,0 +1,142 @@
+// Copyright 2021 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package contracts
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestPostgreSQLRegistryStore(t *testing.T) (*postgreSQLRegistryStore, sqlmock.Sqlmock) {
+	db, mock, err := sqlmock.New()
+	assert.NoError(t, err)
+	return &postgreSQLRegistryStore{
+		conf: &PostgreSQLRegistryConf{Table: defaultPostgreSQLRegistryTable},
+		db:   db,
+	}, mock
+}
+
+func TestPostgreSQLRegistryStoreInit(t *testing.T) {
+	assert := assert.New(t)
+	store, mock := newTestPostgreSQLRegistryStore(t)
+
+	mock.ExpectExec("CREATE TABLE IF NOT EXISTS ethconnect_registry").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectClose()
+	err := store.init()
+	assert.NoError(err)
+	store.close()
+	assert.NoError(mock.ExpectationsWereMet())
+}
+
+func TestPostgreSQLRegistryStoreInitFail(t *testing.T) {
+	assert := assert.New(t)
+	store, mock := newTestPostgreSQLRegistryStore(t)
+
+	mock.ExpectExec("CREATE TABLE IF NOT EXISTS ethconnect_registry").WillReturnError(fmt.Errorf("pop"))
+	err := store.init()
+	assert.EqualError(err, "Unable to initialize the PostgreSQL registry storage: pop")
+}
+
+func TestNewPostgreSQLRegistryStoreConnectFail(t *testing.T) {
+	assert := assert.New(t)
+
+	conf := &PostgreSQLRegistryConf{URL: "postgres://localhost:0/ethconnect?sslmode=disable&connect_timeout=1"}
+	_, err := newPostgreSQLRegistryStore(conf)
+	assert.Regexp("Unable to initialize the PostgreSQL registry storage", err)
+	assert.Equal(defaultPostgreSQLRegistryTable, conf.Table)
+
+	_, err = newPostgreSQLRegistryStore(&PostgreSQLRegistryConf{Table: "registry; DROP TABLE x"})
+	assert.EqualError(err, "Invalid PostgreSQL registry table name 'registry; DROP TABLE x'")
+}
+
+func TestPostgreSQLRegistryStorePut(t *testing.T) {
+	assert := assert.New(t)
+	store, mock := newTestPostgreSQLRegistryStore(t)
+
+	mock.ExpectExec("INSERT INTO ethconnect_registry .* ON CONFLICT \\(kind, id\\) DO UPDATE").
+		WithArgs("abi", "abi1", `{"contractName":"abi1"}`, sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	err := store.put(registryKindABI, "abi1", []byte(`{"contractName":"abi1"}`))
+	assert.NoError(err)
+	assert.NoError(mock.ExpectationsWereMet())
+}
+
+func TestPostgreSQLRegistryStoreGet(t *testing.T) {
+	assert := assert.New(t)
+	store, mock := newTestPostgreSQLRegistryStore(t)
+
+	mock.ExpectQuery("SELECT data FROM ethconnect_registry WHERE kind = \\$1 AND id = \\$2").
+		WithArgs("abi", "abi1").
+		WillReturnRows(sqlmock.NewRows([]string{"data"}).AddRow(`{"contractName":"abi1"}`))
+	data, err := store.get(registryKindABI, "abi1")
+	assert.NoError(err)
+	assert.Equal(`{"contractName":"abi1"}`, string(data))
+
+	mock.ExpectQuery("SELECT data FROM ethconnect_registry").
+		WithArgs("contract", "0123456789abcdef0123456789abcdef01234567").
+		WillReturnRows(sqlmock.NewRows([]string{"data"}))
+	_, err = store.get(registryKindContract, "0123456789abcdef0123456789abcdef01234567")
+	assert.EqualError(err, "No contract with ID '0123456789abcdef0123456789abcdef01234567' in the registry storage")
+
+	mock.ExpectQuery("SELECT data FROM ethconnect_registry").WillReturnError(fmt.Errorf("pop"))
+	_, err = store.get(registryKindABI, "abi1")
+	assert.EqualError(err, "pop")
+	assert.NoError(mock.ExpectationsWereMet())
+}
+
+func TestPostgreSQLRegistryStoreList(t *testing.T) {
+	assert := assert.New(t)
+	store, mock := newTestPostgreSQLRegistryStore(t)
+
+	created := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	mock.ExpectQuery("SELECT id, created FROM ethconnect_registry WHERE kind = \\$1 ORDER BY id").
+		WithArgs("abi").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "created"}).AddRow("abi1", created).AddRow("abi2", created))
+	entries, err := store.list(registryKindABI)
+	assert.NoError(err)
+	assert.Equal(2, len(entries))
+	assert.Equal("abi2", entries[1].ID)
+	assert.Equal(created, entries[1].Modified)
+
+	mock.ExpectQuery("SELECT id, created FROM ethconnect_registry").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "created"}).AddRow("abi1", "not a time"))
+	_, err = store.list(registryKindABI)
+	assert.Error(err)
+
+	mock.ExpectQuery("SELECT id, created FROM ethconnect_registry").WillReturnError(fmt.Errorf("pop"))
+	_, err = store.list(registryKindABI)
+	assert.EqualError(err, "pop")
+	assert.NoError(mock.ExpectationsWereMet())
+}
+
+func TestPostgreSQLRegistryStoreDelete(t *testing.T) {
+	assert := assert.New(t)
+	store, mock := newTestPostgreSQLRegistryStore(t)
+
+	mock.ExpectExec("DELETE FROM ethconnect_registry WHERE kind = \\$1 AND id = \\$2").
+		WithArgs("abi", "abi1").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	err := store.delete(registryKindABI, "abi1")
+	assert.NoError(err)
+
+	mock.ExpectExec("DELETE FROM ethconnect_registry").WillReturnError(fmt.Errorf("pop"))
+	err = store.delete(registryKindABI, "abi1")
+	assert.EqualError(err, "pop")
+	assert.NoError(mock.ExpectationsWereMet())
+}
@@ -0,0 +1,199 @@
+// Copyright 2021 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package contracts
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	ethconnecterrors "github.com/kaleido-io/ethconnect/internal/errors"
+	"github.com/kaleido-io/ethconnect/internal/utils"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	defaultS3RegistryRegion         = "us-east-1"
+	defaultS3RegistryRequestTimeout = 30
+)
+
+// S3RegistryConf stores the registry as objects in an S3 bucket, or a bucket of an S3 compatible
+// object store. If no credentials are configured, those available to the process are used, as
+// for the AWS SDKs
+type S3RegistryConf struct {
+	// Endpoint of an S3 compatible store, addressed with path style URLs. AWS S3 is used if not set
+	Endpoint          string `json:"endpoint,omitempty"`
+	Region            string `json:"region,omitempty"`
+	Bucket            string `json:"bucket,omitempty"`
+	Prefix            string `json:"prefix,omitempty"`
+	AccessKeyID       string `json:"accessKeyID,omitempty"`
+	SecretAccessKey   string `json:"secretAccessKey,omitempty"`
+	SessionToken      string `json:"sessionToken,omitempty"`
+	RequestTimeoutSec uint32 `json:"requestTimeoutSec,omitempty"`
+}
+
+// s3RegistryStore holds each entry as an object, with the same name as the file it would be stored
+// in under the storage path. Requests are signed with AWS Signature Version 4
+type s3RegistryStore struct {
+	conf        *S3RegistryConf
+	baseURL     *url.URL
+	credentials *utils.AWSCredentialsProvider
+	client      *http.Client
+	now         func() time.Time
+}
+
+type s3ListBucketResult struct {
+	Contents []struct {
+		Key          string    `xml:"Key"`
+		LastModified time.Time `xml:"LastModified"`
+	} `xml:"Contents"`
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+}
+
+func newS3RegistryStore(conf *S3RegistryConf) (*s3RegistryStore, error) {
+	if conf.Region == "" {
+		conf.Region = defaultS3RegistryRegion
+	}
+	if conf.RequestTimeoutSec == 0 {
+		conf.RequestTimeoutSec = defaultS3RegistryRequestTimeout
+	}
+	credentials := utils.NewAWSCredentialsProvider(conf.AccessKeyID, conf.SecretAccessKey, conf.SessionToken)
+	if _, err := credentials.Credentials(); err != nil {
+		return nil, ethconnecterrors.Errorf(ethconnecterrors.RegistryStoreS3MissingCredentials, err)
+	}
+	// Path style addressing for a configured endpoint, virtual hosted style for AWS S3
+	rawURL := fmt.Sprintf("https://%s.s3.%s.amazonaws.com/", conf.Bucket, conf.Region)
+	if conf.Endpoint != "" {
+		rawURL = strings.TrimSuffix(conf.Endpoint, "/") + "/" + conf.Bucket + "/"
+	}
+	baseURL, err := url.Parse(rawURL)
+	if err != nil || baseURL.Host == "" {
+		return nil, ethconnecterrors.Errorf(ethconnecterrors.RegistryStoreS3InvalidEndpoint, conf.Endpoint)
+	}
+	log.Infof("Registry stored in S3 bucket %s", baseURL)
+	return &s3RegistryStore{
+		conf:        conf,
+		baseURL:     baseURL,
+		credentials: credentials,
+		client:      &http.Client{Timeout: time.Duration(conf.RequestTimeoutSec) * time.Second, Transport: utils.EgressTransport(nil)},
+		now:         time.Now,
+	}, nil
+}
+
+func (s *s3RegistryStore) objectURL(key string, query url.Values) *url.URL {
+	u := *s.baseURL
+	u.Path += key
+	u.RawQuery = strings.Replace(query.Encode(), "+", "%20", -1)
+	return &u
+}
+
+func (s *s3RegistryStore) do(method string, u *url.URL, body []byte) ([]byte, int, error) {
+	creds, err := s.credentials.Credentials()
+	if err != nil {
+		return nil, 0, err
+	}
+	req, _ := http.NewRequest(method, u.String(), bytes.NewReader(body))
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	utils.SignAWSRequest(req, body, "s3", s.conf.Region, creds, s.now())
+	res, err := s.client.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer res.Body.Close()
+	resBody, err := ioutil.ReadAll(res.Body)
+	return resBody, res.StatusCode, err
+}
+
+func (s *s3RegistryStore) put(kind registryKind, id string, data []byte) error {
+	key := s.conf.Prefix + registryEntryName(kind, id)
+	resBody, status, err := s.do(http.MethodPut, s.objectURL(key, nil), data)
+	if err != nil {
+		return err
+	}
+	if status != http.StatusOK {
+		return ethconnecterrors.Errorf(ethconnecterrors.RegistryStoreS3RequestFailed, http.MethodPut, key, status, resBody)
+	}
+	return nil
+}
+
+func (s *s3RegistryStore) get(kind registryKind, id string) ([]byte, error) {
+	key := s.conf.Prefix + registryEntryName(kind, id)
+	resBody, status, err := s.do(http.MethodGet, s.objectURL(key, nil), nil)
+	if err != nil {
+		return nil, err
+	}
+	if status == http.StatusNotFound {
+		return nil, ethconnecterrors.Errorf(ethconnecterrors.RegistryStoreNotFound, kind, id)
+	} else if status != http.StatusOK {
+		return nil, ethconnecterrors.Errorf(ethconnecterrors.RegistryStoreS3RequestFailed, http.MethodGet, key, status, resBody)
+	}
+	return resBody, nil
+}
+
+func (s *s3RegistryStore) list(kind registryKind) ([]*registryEntry, error) {
+	prefix := s.conf.Prefix + string(kind) + "_"
+	entries := []*registryEntry{}
+	continuationToken := ""
+	for {
+		query := url.Values{}
+		query.Set("list-type", "2")
+		query.Set("prefix", prefix)
+		if continuationToken != "" {
+			query.Set("continuation-token", continuationToken)
+		}
+		resBody, status, err := s.do(http.MethodGet, s.objectURL("", query), nil)
+		if err != nil {
+			return nil, err
+		}
+		if status != http.StatusOK {
+			return nil, ethconnecterrors.Errorf(ethconnecterrors.RegistryStoreS3RequestFailed, "list", prefix, status, resBody)
+		}
+		var result s3ListBucketResult
+		if err := xml.Unmarshal(resBody, &result); err != nil {
+			return nil, err
+		}
+		for _, obj := range result.Contents {
+			if id := registryEntryID(kind, strings.TrimPrefix(obj.Key, s.conf.Prefix)); id != "" {
+				entries = append(entries, &registryEntry{ID: id, Modified: obj.LastModified})
+			}
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return entries, nil
+		}
+		continuationToken = result.NextContinuationToken
+	}
+}
+
+func (s *s3RegistryStore) delete(kind registryKind, id string) error {
+	key := s.conf.Prefix + registryEntryName(kind, id)
+	resBody, status, err := s.do(http.MethodDelete, s.objectURL(key, nil), nil)
+	if err != nil {
+		return err
+	}
+	if status != http.StatusOK && status != http.StatusNoContent && status != http.StatusNotFound {
+		return ethconnecterrors.Errorf(ethconnecterrors.RegistryStoreS3RequestFailed, http.MethodDelete, key, status, resBody)
+	}
+	return nil
+}
+
+func (s *s3RegistryStore) close() {}
@@ -0,0 +1,203 @@
+// Copyright 2021 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package contracts
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// newTestS3Server is an object store holding objects in memory, returning one key for
+// each page of a listing so continuation tokens are exercised
+func newTestS3Server() (*httptest.Server, map[string][]byte) {
+	objects := make(map[string][]byte)
+	svr := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		if !strings.HasPrefix(req.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=") {
+			res.WriteHeader(403)
+			return
+		}
+		switch {
+		case req.Method == http.MethodPut:
+			objects[req.URL.Path], _ = ioutil.ReadAll(req.Body)
+		case req.Method == http.MethodDelete:
+			delete(objects, req.URL.Path)
+			res.WriteHeader(204)
+		case req.URL.Query().Get("list-type") == "2":
+			prefix := req.URL.Path + req.URL.Query().Get("prefix")
+			keys := []string{}
+			for key := range objects {
+				if strings.HasPrefix(key, prefix) && key > req.URL.Query().Get("continuation-token") {
+					keys = append(keys, key)
+				}
+			}
+			sort.Strings(keys)
+			result := "<ListBucketResult>"
+			if len(keys) > 0 {
+				result += fmt.Sprintf("<Contents><Key>%s</Key><LastModified>2021-01-01T00:00:00.000Z</LastModified></Contents>",
+					strings.TrimPrefix(keys[0], req.URL.Path))
+			}
+			if len(keys) > 1 {
+				result += fmt.Sprintf("<IsTruncated>true</IsTruncated><NextContinuationToken>%s</NextContinuationToken>", keys[0])
+			}
+			res.Write([]byte(result + "</ListBucketResult>"))
+		default:
+			data, exists := objects[req.URL.Path]
+			if !exists {
+				res.WriteHeader(404)
+				return
+			}
+			res.Write(data)
+		}
+	}))
+	return svr, objects
+}
+
+func newTestS3RegistryStore(endpoint string) *s3RegistryStore {
+	store, _ := newS3RegistryStore(&S3RegistryConf{
+		Endpoint:        endpoint,
+		Bucket:          "bucket1",
+		Prefix:          "registry/",
+		AccessKeyID:     "id1",
+		SecretAccessKey: "secret1",
+	})
+	return store
+}
+
+func TestS3RegistryStorePutGetList(t *testing.T) {
+	assert := assert.New(t)
+	svr, objects := newTestS3Server()
+	defer svr.Close()
+	store := newTestS3RegistryStore(svr.URL)
+	defer store.close()
+
+	err := store.put(registryKindABI, "abi1", []byte(`{"contractName":"abi1"}`))
+	assert.NoError(err)
+	err = store.put(registryKindABI, "abi2", []byte(`{"contractName":"abi2"}`))
+	assert.NoError(err)
+	err = store.put(registryKindContract, "0123456789abcdef0123456789abcdef01234567", []byte(`{}`))
+	assert.NoError(err)
+	assert.Equal(`{"contractName":"abi1"}`, string(objects["/bucket1/registry/abi_abi1.deploy.json"]))
+
+	data, err := store.get(registryKindABI, "abi2")
+	assert.NoError(err)
+	assert.Equal(`{"contractName":"abi2"}`, string(data))
+
+	abis, err := store.list(registryKindABI)
+	assert.NoError(err)
+	assert.Equal(2, len(abis))
+	assert.Equal("abi1", abis[0].ID)
+	assert.Equal("abi2", abis[1].ID)
+	assert.Equal(2021, abis[0].Modified.Year())
+
+	contracts, err := store.list(registryKindContract)
+	assert.NoError(err)
+	assert.Equal(1, len(contracts))
+	assert.Equal("0123456789abcdef0123456789abcdef01234567", contracts[0].ID)
+
+	err = store.delete(registryKindABI, "abi1")
+	assert.NoError(err)
+	err = store.delete(registryKindABI, "abi1")
+	assert.NoError(err)
+	abis, err = store.list(registryKindABI)
+	assert.NoError(err)
+	assert.Equal(1, len(abis))
+	assert.Equal("abi2", abis[0].ID)
+}
+
+func TestS3RegistryStoreGetNotFound(t *testing.T) {
+	assert := assert.New(t)
+	svr, _ := newTestS3Server()
+	defer svr.Close()
+	store := newTestS3RegistryStore(svr.URL)
+
+	_, err := store.get(registryKindABI, "missing")
+	assert.EqualError(err, "No abi with ID 'missing' in the registry storage")
+}
+
+func TestS3RegistryStoreRequestFailures(t *testing.T) {
+	assert := assert.New(t)
+	svr := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		res.WriteHeader(500)
+		res.Write([]byte("pop"))
+	}))
+	defer svr.Close()
+	store := newTestS3RegistryStore(svr.URL)
+
+	err := store.put(registryKindABI, "abi1", []byte(`{}`))
+	assert.EqualError(err, "S3 PUT of 'registry/abi_abi1.deploy.json' failed [500]: pop")
+	_, err = store.get(registryKindABI, "abi1")
+	assert.EqualError(err, "S3 GET of 'registry/abi_abi1.deploy.json' failed [500]: pop")
+	_, err = store.list(registryKindABI)
+	assert.EqualError(err, "S3 list of 'registry/abi_' failed [500]: pop")
+	err = store.delete(registryKindABI, "abi1")
+	assert.EqualError(err, "S3 DELETE of 'registry/abi_abi1.deploy.json' failed [500]: pop")
+}
+
+func TestS3RegistryStoreBadListResponse(t *testing.T) {
+	assert := assert.New(t)
+	svr := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		res.Write([]byte("<ListBucketResult>"))
+	}))
+	defer svr.Close()
+	store := newTestS3RegistryStore(svr.URL)
+
+	_, err := store.list(registryKindABI)
+	assert.Error(err)
+}
+
+func TestS3RegistryStoreConnectionFailures(t *testing.T) {
+	assert := assert.New(t)
+	store := newTestS3RegistryStore("http://localhost:0")
+
+	err := store.put(registryKindABI, "abi1", []byte(`{}`))
+	assert.Error(err)
+	_, err = store.get(registryKindABI, "abi1")
+	assert.Error(err)
+	_, err = store.list(registryKindABI)
+	assert.Error(err)
+	err = store.delete(registryKindABI, "abi1")
+	assert.Error(err)
+}
+
+func TestNewS3RegistryStoreConf(t *testing.T) {
+	assert := assert.New(t)
+	os.Unsetenv("AWS_ACCESS_KEY_ID")
+	os.Unsetenv("AWS_SECRET_ACCESS_KEY")
+
+	_, err := newS3RegistryStore(&S3RegistryConf{Bucket: "bucket1", AccessKeyID: "id1"})
+	assert.Regexp("No AWS credentials for the S3 registry storage", err)
+
+	os.Setenv("AWS_ACCESS_KEY_ID", "id1")
+	os.Setenv("AWS_SECRET_ACCESS_KEY", "secret1")
+	defer os.Unsetenv("AWS_ACCESS_KEY_ID")
+	defer os.Unsetenv("AWS_SECRET_ACCESS_KEY")
+	store, err := newS3RegistryStore(&S3RegistryConf{Bucket: "bucket1", Region: "eu-west-1"})
+	assert.NoError(err)
+	creds, err := store.credentials.Credentials()
+	assert.NoError(err)
+	assert.Equal("id1", creds.AccessKeyID)
+	assert.Equal("https://bucket1.s3.eu-west-1.amazonaws.com/", store.baseURL.String())
+
+	_, err = newS3RegistryStore(&S3RegistryConf{Bucket: "bucket1", Endpoint: "!badness"})
+	assert.EqualError(err, "Invalid S3 endpoint '!badness'")
+}
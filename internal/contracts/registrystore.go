@@ -0,0 +1,174 @@
+// Copyright 2021 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package contracts
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"regexp"
+	"time"
+
+	ethconnecterrors "github.com/kaleido-io/ethconnect/internal/errors"
+)
+
+const (
+	defaultRegistryRefreshIntervalSec = 30
+)
+
+// registryKind is the type of a document in the local registry
+type registryKind string
+
+const (
+	registryKindABI           registryKind = "abi"
+	registryKindContract      registryKind = "contract"
+	registryKindSource        registryKind = "source"
+	registryKindDeployPlan    registryKind = "deployplan"
+	registryKindUpgrade       registryKind = "upgrade"
+	registryKindReaction      registryKind = "reaction"
+	registryKindReactionAudit registryKind = "reactionaudit"
+)
+
+var (
+	abiEntryMatcher      = regexp.MustCompile("^abi_([0-9a-z-]+)\\.deploy.json$")
+	contractEntryMatcher = regexp.MustCompile("^contract_([0-9a-z]{40})\\.instance\\.json$")
+	sourceEntryMatcher   = regexp.MustCompile("^source_([0-9a-z-]+)\\.source\\.json$")
+	planEntryMatcher     = regexp.MustCompile("^deployplan_([0-9a-z-]+)\\.plan\\.json$")
+	upgradeEntryMatcher  = regexp.MustCompile("^upgrade_([0-9a-z-]+)\\.upgrade\\.json$")
+	reactionEntryMatcher = regexp.MustCompile("^reaction_([0-9a-z-]+)\\.reaction\\.json$")
+	auditEntryMatcher    = regexp.MustCompile("^reactionaudit_([0-9a-z-]+)\\.audit\\.json$")
+)
+
+// RegistryStorageConf selects shared storage for the local registry of ABIs and contract instances,
+// in place of files in the storage path, so it can be used by multiple gateways
+type RegistryStorageConf struct {
+	PostgreSQL PostgreSQLRegistryConf `json:"postgresql,omitempty"`
+	S3         S3RegistryConf         `json:"s3,omitempty"`
+	// RefreshIntervalSec is how often entries added by other gateways are loaded from shared storage
+	RefreshIntervalSec uint32 `json:"refreshIntervalSec,omitempty"`
+}
+
+// Shared is true if the registry is stored in PostgreSQL or S3, rather than in files
+func (c *RegistryStorageConf) Shared() bool {
+	return c.PostgreSQL.URL != "" || c.S3.Bucket != ""
+}
+
+// registryEntry is an ABI or contract instance in the registry storage
+type registryEntry struct {
+	ID       string
+	Modified time.Time
+}
+
+// registryStore persists the JSON documents of the local registry, keyed by kind and ID
+type registryStore interface {
+	put(kind registryKind, id string, data []byte) error
+	get(kind registryKind, id string) ([]byte, error)
+	list(kind registryKind) ([]*registryEntry, error)
+	delete(kind registryKind, id string) error
+	close()
+}
+
+func newRegistryStore(conf *SmartContractGatewayConf) (registryStore, error) {
+	if conf.Storage.PostgreSQL.URL != "" {
+		return newPostgreSQLRegistryStore(&conf.Storage.PostgreSQL)
+	}
+	if conf.Storage.S3.Bucket != "" {
+		return newS3RegistryStore(&conf.Storage.S3)
+	}
+	return &fileRegistryStore{dir: conf.StoragePath}, nil
+}
+
+// registryEntryName is the file name (or object key) of an entry
+func registryEntryName(kind registryKind, id string) string {
+	switch kind {
+	case registryKindABI:
+		return "abi_" + id + ".deploy.json"
+	case registryKindSource:
+		return "source_" + id + ".source.json"
+	case registryKindDeployPlan:
+		return "deployplan_" + id + ".plan.json"
+	case registryKindUpgrade:
+		return "upgrade_" + id + ".upgrade.json"
+	case registryKindReaction:
+		return "reaction_" + id + ".reaction.json"
+	case registryKindReactionAudit:
+		return "reactionaudit_" + id + ".audit.json"
+	}
+	return "contract_" + id + ".instance.json"
+}
+
+// registryEntryID extracts the ID from the file name (or object key) of an entry of the kind
+func registryEntryID(kind registryKind, name string) string {
+	matcher := contractEntryMatcher
+	switch kind {
+	case registryKindABI:
+		matcher = abiEntryMatcher
+	case registryKindSource:
+		matcher = sourceEntryMatcher
+	case registryKindDeployPlan:
+		matcher = planEntryMatcher
+	case registryKindUpgrade:
+		matcher = upgradeEntryMatcher
+	case registryKindReaction:
+		matcher = reactionEntryMatcher
+	case registryKindReactionAudit:
+		matcher = auditEntryMatcher
+	}
+	if groups := matcher.FindStringSubmatch(name); groups != nil {
+		return groups[1]
+	}
+	return ""
+}
+
+// fileRegistryStore is the default storage, with a file for each entry in the storage path
+type fileRegistryStore struct {
+	dir string
+}
+
+func (f *fileRegistryStore) put(kind registryKind, id string, data []byte) error {
+	return ioutil.WriteFile(path.Join(f.dir, registryEntryName(kind, id)), data, 0664)
+}
+
+func (f *fileRegistryStore) get(kind registryKind, id string) ([]byte, error) {
+	data, err := ioutil.ReadFile(path.Join(f.dir, registryEntryName(kind, id)))
+	if os.IsNotExist(err) {
+		return nil, ethconnecterrors.Errorf(ethconnecterrors.RegistryStoreNotFound, kind, id)
+	}
+	return data, err
+}
+
+func (f *fileRegistryStore) list(kind registryKind) ([]*registryEntry, error) {
+	files, err := ioutil.ReadDir(f.dir)
+	if err != nil {
+		return nil, err
+	}
+	entries := []*registryEntry{}
+	for _, file := range files {
+		if id := registryEntryID(kind, file.Name()); id != "" {
+			entries = append(entries, &registryEntry{ID: id, Modified: file.ModTime()})
+		}
+	}
+	return entries, nil
+}
+
+func (f *fileRegistryStore) delete(kind registryKind, id string) error {
+	err := os.Remove(path.Join(f.dir, registryEntryName(kind, id)))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func (f *fileRegistryStore) close() {}
@@ -0,0 +1,191 @@
+// Copyright 2021 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package contracts
+
+import (
+	"io/ioutil"
+	"path"
+	"testing"
+
+	"github.com/kaleido-io/ethconnect/internal/messages"
+	"github.com/kaleido-io/ethconnect/internal/tx"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRegistryEntryNames(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Equal("abi_abi1.deploy.json", registryEntryName(registryKindABI, "abi1"))
+	assert.Equal("contract_0123456789abcdef0123456789abcdef01234567.instance.json", registryEntryName(registryKindContract, "0123456789abcdef0123456789abcdef01234567"))
+	assert.Equal("abi1", registryEntryID(registryKindABI, "abi_abi1.deploy.json"))
+	assert.Equal("0123456789abcdef0123456789abcdef01234567", registryEntryID(registryKindContract, "contract_0123456789abcdef0123456789abcdef01234567.instance.json"))
+	assert.Equal("source_abi1.source.json", registryEntryName(registryKindSource, "abi1"))
+	assert.Equal("abi1", registryEntryID(registryKindSource, "source_abi1.source.json"))
+	assert.Equal("upgrade_u1.upgrade.json", registryEntryName(registryKindUpgrade, "u1"))
+	assert.Equal("u1", registryEntryID(registryKindUpgrade, "upgrade_u1.upgrade.json"))
+	assert.Equal("reaction_r1.reaction.json", registryEntryName(registryKindReaction, "r1"))
+	assert.Equal("r1", registryEntryID(registryKindReaction, "reaction_r1.reaction.json"))
+	assert.Equal("reactionaudit_r1-a1.audit.json", registryEntryName(registryKindReactionAudit, "r1-a1"))
+	assert.Equal("r1-a1", registryEntryID(registryKindReactionAudit, "reactionaudit_r1-a1.audit.json"))
+	assert.Equal("", registryEntryID(registryKindReaction, "reactionaudit_r1-a1.audit.json"))
+	assert.Equal("", registryEntryID(registryKindContract, "abi_abi1.deploy.json"))
+	assert.Equal("", registryEntryID(registryKindContract, "contract_0123456789abcdef0123456789abcdef01234567.swagger.json"))
+}
+
+func TestFileRegistryStorePutGetList(t *testing.T) {
+	assert := assert.New(t)
+	dir := tempdir()
+	defer cleanup(dir)
+
+	store, err := newRegistryStore(&SmartContractGatewayConf{StoragePath: dir})
+	assert.NoError(err)
+	defer store.close()
+
+	err = store.put(registryKindABI, "abi1", []byte(`{"contractName":"abi1"}`))
+	assert.NoError(err)
+	err = store.put(registryKindContract, "0123456789abcdef0123456789abcdef01234567", []byte(`{}`))
+	assert.NoError(err)
+	ioutil.WriteFile(path.Join(dir, "other.json"), []byte(`{}`), 0644)
+
+	data, err := ioutil.ReadFile(path.Join(dir, "abi_abi1.deploy.json"))
+	assert.NoError(err)
+	assert.Equal(`{"contractName":"abi1"}`, string(data))
+
+	data, err = store.get(registryKindABI, "abi1")
+	assert.NoError(err)
+	assert.Equal(`{"contractName":"abi1"}`, string(data))
+
+	abis, err := store.list(registryKindABI)
+	assert.NoError(err)
+	assert.Equal(1, len(abis))
+	assert.Equal("abi1", abis[0].ID)
+	assert.False(abis[0].Modified.IsZero())
+
+	contracts, err := store.list(registryKindContract)
+	assert.NoError(err)
+	assert.Equal(1, len(contracts))
+	assert.Equal("0123456789abcdef0123456789abcdef01234567", contracts[0].ID)
+
+	err = store.delete(registryKindABI, "abi1")
+	assert.NoError(err)
+	err = store.delete(registryKindABI, "abi1")
+	assert.NoError(err)
+	abis, err = store.list(registryKindABI)
+	assert.NoError(err)
+	assert.Equal(0, len(abis))
+}
+
+func TestFileRegistryStoreGetNotFound(t *testing.T) {
+	assert := assert.New(t)
+	dir := tempdir()
+	defer cleanup(dir)
+
+	store := &fileRegistryStore{dir: dir}
+	_, err := store.get(registryKindABI, "missing")
+	assert.EqualError(err, "No abi with ID 'missing' in the registry storage")
+}
+
+func TestFileRegistryStoreErrors(t *testing.T) {
+	assert := assert.New(t)
+	dir := tempdir()
+	cleanup(dir)
+
+	store := &fileRegistryStore{dir: dir}
+	err := store.put(registryKindABI, "abi1", []byte(`{}`))
+	assert.Error(err)
+	_, err = store.list(registryKindABI)
+	assert.Error(err)
+}
+
+func TestNewRegistryStoreShared(t *testing.T) {
+	assert := assert.New(t)
+
+	conf := &SmartContractGatewayConf{}
+	assert.False(conf.Enabled())
+	conf.Storage.S3 = S3RegistryConf{
+		Bucket:          "bucket1",
+		AccessKeyID:     "id1",
+		SecretAccessKey: "secret1",
+	}
+	assert.True(conf.Storage.Shared())
+	assert.True(conf.Enabled())
+	store, err := newRegistryStore(conf)
+	assert.NoError(err)
+	assert.IsType(&s3RegistryStore{}, store)
+
+	conf.Storage.PostgreSQL.Table = "bad table"
+	conf.Storage.PostgreSQL.URL = "postgres://localhost/db"
+	_, err = newRegistryStore(conf)
+	assert.EqualError(err, "Invalid PostgreSQL registry table name 'bad table'")
+}
+
+func TestSmartContractGatewaySharedStorage(t *testing.T) {
+	assert := assert.New(t)
+	svr, objects := newTestS3Server()
+	defer svr.Close()
+
+	conf := &SmartContractGatewayConf{
+		Storage: RegistryStorageConf{
+			S3: S3RegistryConf{
+				Endpoint:        svr.URL,
+				Bucket:          "bucket1",
+				AccessKeyID:     "id1",
+				SecretAccessKey: "secret1",
+			},
+		},
+	}
+	s, err := NewSmartContractGateway(conf, &tx.TxnProcessorConf{}, nil, nil, nil, nil)
+	assert.NoError(err)
+	scgw := s.(*smartContractGW)
+	defer scgw.Shutdown()
+
+	err = scgw.writeAbiInfo("abi1", &messages.DeployContract{ContractName: "abi1"})
+	assert.NoError(err)
+	_, exists := objects["/bucket1/abi_abi1.deploy.json"]
+	assert.True(exists)
+
+	// A second gateway sharing the storage loads the ABI, and then picks up the contract
+	// instance stored by the first when it refreshes
+	s2, err := NewSmartContractGateway(conf, &tx.TxnProcessorConf{}, nil, nil, nil, nil)
+	assert.NoError(err)
+	scgw2 := s2.(*smartContractGW)
+	defer scgw2.Shutdown()
+	_, exists = scgw2.abiIndex["abi1"]
+	assert.True(exists)
+
+	_, err = scgw.storeNewContractInfo("0123456789abcdef0123456789abcdef01234567", "abi1", "0123456789abcdef0123456789abcdef01234567", "contract1", "", "")
+	assert.NoError(err)
+	assert.NoError(scgw2.loadIndexEntries(true))
+	_, exists = scgw2.contractIndex["0123456789abcdef0123456789abcdef01234567"]
+	assert.True(exists)
+
+	deployMsg, _, err := scgw2.loadDeployMsgForInstance("0123456789abcdef0123456789abcdef01234567")
+	assert.NoError(err)
+	assert.Equal("abi1", deployMsg.ContractName)
+}
+
+func TestSmartContractGatewaySharedStorageBadConf(t *testing.T) {
+	assert := assert.New(t)
+
+	_, err := NewSmartContractGateway(&SmartContractGatewayConf{
+		Storage: RegistryStorageConf{
+			PostgreSQL: PostgreSQLRegistryConf{
+				URL:   "postgres://localhost/db",
+				Table: "bad table",
+			},
+		},
+	}, &tx.TxnProcessorConf{}, nil, nil, nil, nil)
+	assert.EqualError(err, "Invalid PostgreSQL registry table name 'bad table'")
+}
@@ -19,6 +19,7 @@ import (
 	"encoding/json"
 	"net/url"
 	"strings"
+	"time"
 
 	ethbinding "github.com/kaleido-io/ethbinding/pkg"
 	"github.com/kaleido-io/ethconnect/internal/errors"
@@ -30,25 +31,38 @@ import (
 )
 
 const (
-	defaultIDProp         = "id"
-	defaultNameProp       = "name"
-	defaultABIProp        = "abi"
-	defaultBytecodeProp   = "bytecode"
-	defaultDevdocProp     = "devdoc"
-	defaultDeployableProp = "deployable"
-	defaultAddressProp    = "address"
+	defaultIDProp          = "id"
+	defaultNameProp        = "name"
+	defaultABIProp         = "abi"
+	defaultBytecodeProp    = "bytecode"
+	defaultDevdocProp      = "devdoc"
+	defaultDeployableProp  = "deployable"
+	defaultAddressProp     = "address"
+	defaultEnvironmentProp = "environment"
 )
 
 type deployContractWithAddress struct {
 	messages.DeployContract
 	Address string `json:"address"`
+	Cached  int64  `json:"cached,omitempty"`
+}
+
+// registryInvalidation names the cached entries of the remote registry to drop. When no
+// gateways or instances are named, the whole cache is dropped
+type registryInvalidation struct {
+	Gateways  []string `json:"gateways"`
+	Instances []string `json:"instances"`
 }
 
 // RemoteRegistry lookup of ABI, ByteCode and DevDocs against a conformant REST API
 type RemoteRegistry interface {
 	loadFactoryForGateway(lookupStr string, refresh bool) (*messages.DeployContract, error)
-	loadFactoryForInstance(lookupStr string, refresh bool) (*deployContractWithAddress, error)
-	registerInstance(lookupStr, address string) error
+	loadFactoryForInstance(lookupStr, environment string, refresh bool) (*deployContractWithAddress, error)
+	registerInstance(lookupStr, environment, address string) error
+	reserveInstance(lookupStr, environment string) (conflict bool, err error)
+	confirmInstance(lookupStr, environment, address string) error
+	releaseInstance(lookupStr, environment string) error
+	invalidate(inv *registryInvalidation, reload bool) *registryInvalidation
 	init() error
 	close()
 }
@@ -57,20 +71,31 @@ type RemoteRegistry interface {
 type RemoteRegistryConf struct {
 	utils.HTTPRequesterConf
 	CacheDB           string                      `json:"cacheDB"`
+	CacheTTLSec       uint32                      `json:"cacheTTLSec,omitempty"`
 	GatewayURLPrefix  string                      `json:"gatewayURLPrefix"`
 	InstanceURLPrefix string                      `json:"instanceURLPrefix"`
 	PropNames         RemoteRegistryPropNamesConf `json:"propNames"`
+	TLS               utils.TLSConfig             `json:"tls"`
+	OAuth2            utils.OAuth2Conf            `json:"oauth2"`
+	Push              RemoteRegistryPushConf      `json:"push"`
+}
+
+// RemoteRegistryPushConf configures the webhook the remote registry calls when entries change
+type RemoteRegistryPushConf struct {
+	Enabled bool   `json:"enabled"`
+	Secret  string `json:"secret,omitempty"`
 }
 
 // RemoteRegistryPropNamesConf configures the JSON property names to extract from the GET response on the API
 type RemoteRegistryPropNamesConf struct {
-	ID         string `json:"id"`
-	Name       string `json:"name"`
-	ABI        string `json:"abi"`
-	Bytecode   string `json:"bytecode"`
-	Devdoc     string `json:"devdoc"`
-	Deployable string `json:"deployable"`
-	Address    string `json:"address"`
+	ID          string `json:"id"`
+	Name        string `json:"name"`
+	ABI         string `json:"abi"`
+	Bytecode    string `json:"bytecode"`
+	Devdoc      string `json:"devdoc"`
+	Deployable  string `json:"deployable"`
+	Address     string `json:"address"`
+	Environment string `json:"environment"`
 }
 
 // NewRemoteRegistry construtor
@@ -101,6 +126,9 @@ func NewRemoteRegistry(conf *RemoteRegistryConf) RemoteRegistry {
 	if propNames.Address == "" {
 		propNames.Address = defaultAddressProp
 	}
+	if propNames.Environment == "" {
+		propNames.Environment = defaultEnvironmentProp
+	}
 	if rr.conf.GatewayURLPrefix != "" && !strings.HasSuffix(rr.conf.GatewayURLPrefix, "/") {
 		rr.conf.GatewayURLPrefix += "/"
 	}
@@ -117,27 +145,65 @@ type remoteRegistry struct {
 }
 
 func (rr *remoteRegistry) init() (err error) {
+	if err = rr.hr.ConfigureAuth(&rr.conf.TLS, &rr.conf.OAuth2); err != nil {
+		return errors.Errorf(errors.RemoteRegistryAuthInit, err)
+	}
 	if rr.conf.CacheDB != "" {
-		if rr.db, err = kvstore.NewLDBKeyValueStore(rr.conf.CacheDB); err != nil {
+		if rr.db, err = kvstore.NewKeyValueStore(rr.conf.CacheDB); err != nil {
 			return errors.Errorf(errors.RemoteRegistryCacheInit, err)
 		}
+		kvstore.SetKeyPrefixes(rr.db, map[string]string{
+			"gateways":  "gateways/",
+			"instances": "instances/",
+		})
 	}
 	return nil
 }
 
-func (rr *remoteRegistry) loadFactoryFromURL(baseURL, ns, lookupStr string, refresh bool) (msg *deployContractWithAddress, err error) {
+// registryCacheKey is the key of a cached lookup. Instances looked up for an environment
+// are cached separately from the lookup without one
+func registryCacheKey(ns, lookupStr, environment string) string {
+	cacheKey := ns + "/" + url.QueryEscape(lookupStr)
+	if environment != "" {
+		cacheKey += "@" + url.QueryEscape(environment)
+	}
+	return cacheKey
+}
+
+// environmentQuery is the query string that passes the environment of a request to the registry
+func environmentQuery(environment string) string {
+	if environment == "" {
+		return ""
+	}
+	return "?environment=" + url.QueryEscape(environment)
+}
+
+func (rr *remoteRegistry) loadFactoryFromURL(baseURL, ns, lookupStr, environment string, refresh bool) (msg *deployContractWithAddress, err error) {
 	safeLookupStr := url.QueryEscape(lookupStr)
+	cacheKey := registryCacheKey(ns, lookupStr, environment)
+	var stale *deployContractWithAddress
 	if !refresh {
-		msg = rr.loadFactoryFromCacheDB(ns + "/" + safeLookupStr)
-		if msg != nil {
+		msg = rr.loadFactoryFromCacheDB(cacheKey)
+		if msg != nil && !rr.expired(msg) {
 			return msg, nil
 		}
+		stale = msg
 	}
-	queryURL := baseURL + safeLookupStr
+	queryURL := baseURL + safeLookupStr + environmentQuery(environment)
 	jsonRes, err := rr.hr.DoRequest("GET", queryURL, nil)
-	if err != nil || jsonRes == nil {
+	if err != nil && stale != nil {
+		// Better to use the expired entry than to fail while the registry is unavailable
+		log.Warnf("Using expired cache entry for %s after registry lookup failed: %s", cacheKey, err)
+		return stale, nil
+	}
+	if err != nil {
 		return nil, err
 	}
+	if jsonRes == nil {
+		// Removed from the registry, so must not be served from the cache either
+		rr.deleteFactoryFromCacheDB(cacheKey)
+		return nil, nil
+	}
 	idString, err := rr.hr.GetResponseString(jsonRes, rr.conf.PropNames.ID, false)
 	if err != nil {
 		return nil, err
@@ -185,11 +251,22 @@ func (rr *remoteRegistry) loadFactoryFromURL(baseURL, ns, lookupStr string, refr
 			Compiled: bytecode,
 		},
 		Address: strings.ToLower(strings.TrimPrefix(addr, "0x")),
+		Cached:  time.Now().UnixNano(),
 	}
-	rr.storeFactoryToCacheDB(ns+"/"+safeLookupStr, msg)
+	rr.storeFactoryToCacheDB(cacheKey, msg)
 	return msg, nil
 }
 
+// expired checks the age of a cached entry against the configured TTL. Entries cached before
+// a TTL was configured have no timestamp, so are expired as soon as one is
+func (rr *remoteRegistry) expired(msg *deployContractWithAddress) bool {
+	if rr.conf.CacheTTLSec == 0 {
+		return false
+	}
+	ttl := time.Duration(rr.conf.CacheTTLSec) * time.Second
+	return msg.Cached == 0 || time.Since(time.Unix(0, msg.Cached)) > ttl
+}
+
 func (rr *remoteRegistry) loadFactoryFromCacheDB(cacheKey string) *deployContractWithAddress {
 	if rr.db == nil {
 		return nil
@@ -218,11 +295,108 @@ func (rr *remoteRegistry) storeFactoryToCacheDB(cacheKey string, msg *deployCont
 	}
 }
 
+func (rr *remoteRegistry) deleteFactoryFromCacheDB(cacheKey string) bool {
+	if rr.db == nil {
+		return false
+	}
+	if _, err := rr.db.Get(cacheKey); err != nil {
+		return false
+	}
+	if err := rr.db.Delete(cacheKey); err != nil {
+		log.Warnf("Failed to delete cache entry for key %s: %s", cacheKey, err)
+		return false
+	}
+	return true
+}
+
+// cachedLookups lists the lookup strings of all the entries cached in a namespace
+func (rr *remoteRegistry) cachedLookups(ns string) []string {
+	lookups := []string{}
+	seen := make(map[string]bool)
+	it := rr.db.NewIteratorWithRange(&kvstore.KVRange{Start: ns + "/", Limit: ns + "0"})
+	defer it.Release()
+	for it.Next() {
+		safeLookupStr := strings.SplitN(strings.TrimPrefix(it.Key(), ns+"/"), "@", 2)[0]
+		if lookupStr, err := url.QueryUnescape(safeLookupStr); err == nil && !seen[lookupStr] {
+			seen[lookupStr] = true
+			lookups = append(lookups, lookupStr)
+		}
+	}
+	return lookups
+}
+
+// cachedEnvironments lists the environments an instance is cached for, including the
+// lookup without an environment if that is cached
+func (rr *remoteRegistry) cachedEnvironments(lookupStr string) []string {
+	environments := []string{}
+	if _, err := rr.db.Get(registryCacheKey("instances", lookupStr, "")); err == nil {
+		environments = append(environments, "")
+	}
+	prefix := registryCacheKey("instances", lookupStr, "") + "@"
+	// '@' sorts immediately before 'A', so the range covers exactly the keys with the prefix
+	it := rr.db.NewIteratorWithRange(&kvstore.KVRange{Start: prefix, Limit: strings.TrimSuffix(prefix, "@") + "A"})
+	defer it.Release()
+	for it.Next() {
+		if environment, err := url.QueryUnescape(strings.TrimPrefix(it.Key(), prefix)); err == nil {
+			environments = append(environments, environment)
+		}
+	}
+	return environments
+}
+
+// invalidate drops entries from the cache, so they are fetched from the registry on next use.
+// With reload the dropped entries are fetched straight away, so updates take effect without
+// waiting for a request to pay the cost of the lookup. Returns the entries that were dropped
+func (rr *remoteRegistry) invalidate(inv *registryInvalidation, reload bool) *registryInvalidation {
+	dropped := &registryInvalidation{Gateways: []string{}, Instances: []string{}}
+	if rr.db == nil {
+		return dropped
+	}
+	gateways, instances := inv.Gateways, inv.Instances
+	if len(gateways) == 0 && len(instances) == 0 {
+		gateways, instances = rr.cachedLookups("gateways"), rr.cachedLookups("instances")
+	}
+	for _, lookupStr := range gateways {
+		if rr.deleteFactoryFromCacheDB(registryCacheKey("gateways", lookupStr, "")) {
+			dropped.Gateways = append(dropped.Gateways, lookupStr)
+		}
+	}
+	// An instance is dropped for every environment it is cached for
+	droppedEnvironments := make(map[string][]string)
+	for _, lookupStr := range instances {
+		for _, environment := range rr.cachedEnvironments(lookupStr) {
+			if rr.deleteFactoryFromCacheDB(registryCacheKey("instances", lookupStr, environment)) {
+				droppedEnvironments[lookupStr] = append(droppedEnvironments[lookupStr], environment)
+			}
+		}
+		if len(droppedEnvironments[lookupStr]) > 0 {
+			dropped.Instances = append(dropped.Instances, lookupStr)
+		}
+	}
+	log.Infof("Invalidated %d gateways and %d instances cached from the remote registry", len(dropped.Gateways), len(dropped.Instances))
+	if reload {
+		// Failures are not fatal, as the entry is looked up again on next use
+		for _, lookupStr := range dropped.Gateways {
+			if _, err := rr.loadFactoryForGateway(lookupStr, true); err != nil {
+				log.Warnf("Failed to reload gateway %s from the remote registry: %s", lookupStr, err)
+			}
+		}
+		for _, lookupStr := range dropped.Instances {
+			for _, environment := range droppedEnvironments[lookupStr] {
+				if _, err := rr.loadFactoryForInstance(lookupStr, environment, true); err != nil {
+					log.Warnf("Failed to reload instance %s from the remote registry: %s", lookupStr, err)
+				}
+			}
+		}
+	}
+	return dropped
+}
+
 func (rr *remoteRegistry) loadFactoryForGateway(lookupStr string, refresh bool) (*messages.DeployContract, error) {
 	if rr.conf.GatewayURLPrefix == "" {
 		return nil, nil
 	}
-	msg, err := rr.loadFactoryFromURL(rr.conf.GatewayURLPrefix, "gateways", lookupStr, refresh)
+	msg, err := rr.loadFactoryFromURL(rr.conf.GatewayURLPrefix, "gateways", lookupStr, "", refresh)
 	if msg != nil {
 		// There is no address on a gateway, so we just return the DeployMsg
 		return &msg.DeployContract, err
@@ -230,21 +404,31 @@ func (rr *remoteRegistry) loadFactoryForGateway(lookupStr string, refresh bool)
 	return nil, err
 }
 
-func (rr *remoteRegistry) loadFactoryForInstance(lookupStr string, refresh bool) (*deployContractWithAddress, error) {
+// loadFactoryForInstance looks up an instance. With an environment, the registry is passed
+// the environment so it can return the address the name has in that environment
+func (rr *remoteRegistry) loadFactoryForInstance(lookupStr, environment string, refresh bool) (*deployContractWithAddress, error) {
 	if rr.conf.InstanceURLPrefix == "" {
 		return nil, nil
 	}
-	return rr.loadFactoryFromURL(rr.conf.InstanceURLPrefix, "instances", lookupStr, refresh)
+	return rr.loadFactoryFromURL(rr.conf.InstanceURLPrefix, "instances", lookupStr, environment, refresh)
+}
+
+// instanceBody builds the body of a registration request, including the environment if there is one
+func (rr *remoteRegistry) instanceBody(lookupStr, environment string) map[string]interface{} {
+	bodyMap := make(map[string]interface{})
+	bodyMap[rr.conf.PropNames.Name] = url.QueryEscape(lookupStr)
+	if environment != "" {
+		bodyMap[rr.conf.PropNames.Environment] = environment
+	}
+	return bodyMap
 }
 
-func (rr *remoteRegistry) registerInstance(lookupStr, address string) error {
+func (rr *remoteRegistry) registerInstance(lookupStr, environment, address string) error {
 	if rr.conf.InstanceURLPrefix == "" {
 		return errors.Errorf(errors.RemoteRegistryNotConfigured)
 	}
-	safeLookupStr := url.QueryEscape(lookupStr)
 	requestURL := strings.TrimSuffix(rr.conf.InstanceURLPrefix, "/")
-	bodyMap := make(map[string]interface{})
-	bodyMap[rr.conf.PropNames.Name] = safeLookupStr
+	bodyMap := rr.instanceBody(lookupStr, environment)
 	bodyMap[rr.conf.PropNames.Address] = address
 	log.Debugf("Registering contract: %+v", bodyMap)
 	_, err := rr.hr.DoRequest("POST", requestURL, bodyMap)
@@ -254,5 +438,53 @@ func (rr *remoteRegistry) registerInstance(lookupStr, address string) error {
 	return nil
 }
 
+// reserveInstance registers a name without an address, before deployment. The registry
+// rejects the reservation with a 409 if the name is already in use, so we never deploy an
+// instance that cannot be registered. conflict is only set for that rejection, and not
+// when the registry could not be reached or failed
+func (rr *remoteRegistry) reserveInstance(lookupStr, environment string) (conflict bool, err error) {
+	if rr.conf.InstanceURLPrefix == "" {
+		return false, errors.Errorf(errors.RemoteRegistryNotConfigured)
+	}
+	requestURL := strings.TrimSuffix(rr.conf.InstanceURLPrefix, "/")
+	bodyMap := rr.instanceBody(lookupStr, environment)
+	log.Debugf("Reserving contract name: %+v", bodyMap)
+	_, status, err := rr.hr.DoRequestWithStatus("POST", requestURL, bodyMap)
+	if err != nil {
+		return status == 409, errors.Errorf(errors.RemoteRegistryReservationFailed, lookupStr, err)
+	}
+	return false, nil
+}
+
+// confirmInstance sets the address on a previously reserved name, once deployed
+func (rr *remoteRegistry) confirmInstance(lookupStr, environment, address string) error {
+	if rr.conf.InstanceURLPrefix == "" {
+		return errors.Errorf(errors.RemoteRegistryNotConfigured)
+	}
+	bodyMap := rr.instanceBody(lookupStr, environment)
+	bodyMap[rr.conf.PropNames.Address] = address
+	log.Debugf("Confirming contract registration: %+v", bodyMap)
+	jsonRes, err := rr.hr.DoRequest("PUT", rr.conf.InstanceURLPrefix+url.QueryEscape(lookupStr)+environmentQuery(environment), bodyMap)
+	if err == nil && jsonRes == nil {
+		err = errors.Errorf(errors.RemoteRegistryLookupInstanceNotFound)
+	}
+	if err != nil {
+		return errors.Errorf(errors.RemoteRegistryRegistrationFailed, err)
+	}
+	return nil
+}
+
+// releaseInstance removes a reservation, when the deployment it was made for fails
+func (rr *remoteRegistry) releaseInstance(lookupStr, environment string) error {
+	if rr.conf.InstanceURLPrefix == "" {
+		return errors.Errorf(errors.RemoteRegistryNotConfigured)
+	}
+	_, err := rr.hr.DoRequest("DELETE", rr.conf.InstanceURLPrefix+url.QueryEscape(lookupStr)+environmentQuery(environment), nil)
+	if err != nil {
+		return errors.Errorf(errors.RemoteRegistryReleaseFailed, lookupStr, err)
+	}
+	return nil
+}
+
 func (rr *remoteRegistry) close() {
 }
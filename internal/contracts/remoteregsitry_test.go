@@ -22,11 +22,13 @@ import (
 	"net/http/httptest"
 	"path"
 	"testing"
+	"time"
 
 	"github.com/julienschmidt/httprouter"
 	"github.com/kaleido-io/ethconnect/internal/ethbind"
 	"github.com/kaleido-io/ethconnect/internal/kvstore"
 	"github.com/kaleido-io/ethconnect/internal/messages"
+	"github.com/kaleido-io/ethconnect/internal/utils"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -35,8 +37,16 @@ type mockRR struct {
 	addrCapture    string
 	lookupCapture  string
 	refreshCapture bool
+	reserveCapture string
+	confirmCapture string
+	releaseCapture string
+	envCapture     string
+	invalidCapture *registryInvalidation
+	reloadCapture  bool
 	deployMsg      *deployContractWithAddress
 	err            error
+	reserveErr     error
+	reserveClash   bool
 }
 
 func (rr *mockRR) loadFactoryForGateway(id string, refresh bool) (*messages.DeployContract, error) {
@@ -47,16 +57,39 @@ func (rr *mockRR) loadFactoryForGateway(id string, refresh bool) (*messages.Depl
 	}
 	return &rr.deployMsg.DeployContract, rr.err
 }
-func (rr *mockRR) loadFactoryForInstance(id string, refresh bool) (*deployContractWithAddress, error) {
+func (rr *mockRR) loadFactoryForInstance(id, environment string, refresh bool) (*deployContractWithAddress, error) {
 	rr.addrCapture = id
+	rr.envCapture = environment
 	rr.refreshCapture = refresh
 	return rr.deployMsg, rr.err
 }
-func (rr *mockRR) registerInstance(lookupStr, address string) error {
+func (rr *mockRR) registerInstance(lookupStr, environment, address string) error {
 	rr.lookupCapture = lookupStr
+	rr.envCapture = environment
 	rr.addrCapture = address
 	return rr.err
 }
+func (rr *mockRR) reserveInstance(lookupStr, environment string) (bool, error) {
+	rr.reserveCapture = lookupStr
+	rr.envCapture = environment
+	return rr.reserveClash, rr.reserveErr
+}
+func (rr *mockRR) confirmInstance(lookupStr, environment, address string) error {
+	rr.confirmCapture = lookupStr
+	rr.envCapture = environment
+	rr.addrCapture = address
+	return rr.err
+}
+func (rr *mockRR) releaseInstance(lookupStr, environment string) error {
+	rr.releaseCapture = lookupStr
+	rr.envCapture = environment
+	return rr.err
+}
+func (rr *mockRR) invalidate(inv *registryInvalidation, reload bool) *registryInvalidation {
+	rr.invalidCapture = inv
+	rr.reloadCapture = reload
+	return inv
+}
 func (rr *mockRR) close()      {}
 func (rr *mockRR) init() error { return nil }
 
@@ -77,6 +110,7 @@ func TestNewRemoteRegistryDefaultPropNames(t *testing.T) {
 	assert.Equal(defaultDevdocProp, rr.conf.PropNames.Devdoc)
 	assert.Equal(defaultDeployableProp, rr.conf.PropNames.Deployable)
 	assert.Equal(defaultAddressProp, rr.conf.PropNames.Address)
+	assert.Equal(defaultEnvironmentProp, rr.conf.PropNames.Environment)
 }
 
 func TestNewRemoteRegistryCustomPropNames(t *testing.T) {
@@ -217,6 +251,182 @@ func TestRemoteRegistryloadFactoryForGatewayCached(t *testing.T) {
 	assert.Equal(2, callCount)
 }
 
+func newTestCachedRemoteRegistry(dir string, handler httprouter.Handle) (*remoteRegistry, *httptest.Server) {
+	router := &httprouter.Router{}
+	router.GET("/gateways/:id", handler)
+	router.GET("/instances/:id", handler)
+	server := httptest.NewServer(router)
+	r := NewRemoteRegistry(&RemoteRegistryConf{
+		CacheDB:           path.Join(dir, "testdb"),
+		CacheTTLSec:       60,
+		GatewayURLPrefix:  server.URL + "/gateways",
+		InstanceURLPrefix: server.URL + "/instances",
+		PropNames: RemoteRegistryPropNamesConf{
+			Bytecode: "bin",
+		},
+	})
+	rr := r.(*remoteRegistry)
+	rr.init()
+	return rr, server
+}
+
+func TestRemoteRegistryCacheTTLExpiry(t *testing.T) {
+	dir := tempdir()
+	defer cleanup(dir)
+
+	assert := assert.New(t)
+
+	callCount := 0
+	status := 200
+	rr, server := newTestCachedRemoteRegistry(dir, func(res http.ResponseWriter, req *http.Request, parms httprouter.Params) {
+		callCount++
+		testDataBytes, _ := ioutil.ReadFile("../../test/simpleevents.solc.output.json")
+		res.WriteHeader(status)
+		if status == 200 {
+			res.Write(testDataBytes)
+		}
+	})
+	defer server.Close()
+	defer rr.close()
+
+	res1, err := rr.loadFactoryForGateway("testid", false)
+	assert.NoError(err)
+	_, err = rr.loadFactoryForGateway("testid", false)
+	assert.NoError(err)
+	assert.Equal(1, callCount)
+
+	// Age the cached entry past the TTL, so it is fetched again
+	cached := rr.loadFactoryFromCacheDB("gateways/testid")
+	cached.Cached = time.Now().Add(-61 * time.Second).UnixNano()
+	rr.storeFactoryToCacheDB("gateways/testid", cached)
+	_, err = rr.loadFactoryForGateway("testid", false)
+	assert.NoError(err)
+	assert.Equal(2, callCount)
+
+	// An expired entry is used when the registry is unavailable
+	cached = rr.loadFactoryFromCacheDB("gateways/testid")
+	cached.Cached = 0
+	rr.storeFactoryToCacheDB("gateways/testid", cached)
+	status = 500
+	res2, err := rr.loadFactoryForGateway("testid", false)
+	assert.NoError(err)
+	assert.Equal(res1.Headers.ID, res2.Headers.ID)
+	assert.Equal(3, callCount)
+
+	// An entry removed from the registry is removed from the cache
+	status = 404
+	res3, err := rr.loadFactoryForGateway("testid", true)
+	assert.NoError(err)
+	assert.Nil(res3)
+	assert.Nil(rr.loadFactoryFromCacheDB("gateways/testid"))
+}
+
+func TestRemoteRegistryInvalidate(t *testing.T) {
+	dir := tempdir()
+	defer cleanup(dir)
+
+	assert := assert.New(t)
+
+	callCount := 0
+	rr, server := newTestCachedRemoteRegistry(dir, func(res http.ResponseWriter, req *http.Request, parms httprouter.Params) {
+		callCount++
+		testDataBytes, _ := ioutil.ReadFile("../../test/simpleevents.solc.output.json")
+		res.WriteHeader(200)
+		res.Write(testDataBytes)
+	})
+	defer server.Close()
+	defer rr.close()
+
+	rr.loadFactoryForGateway("gw 1", false)
+	rr.loadFactoryForGateway("gw2", false)
+	rr.loadFactoryForInstance("inst1", "", false)
+	assert.Equal(3, callCount)
+
+	dropped := rr.invalidate(&registryInvalidation{Gateways: []string{"gw 1", "unknown"}}, false)
+	assert.Equal([]string{"gw 1"}, dropped.Gateways)
+	assert.Empty(dropped.Instances)
+	assert.Nil(rr.loadFactoryFromCacheDB("gateways/gw+1"))
+	assert.NotNil(rr.loadFactoryFromCacheDB("gateways/gw2"))
+
+	dropped = rr.invalidate(&registryInvalidation{Instances: []string{"inst1"}}, true)
+	assert.Equal([]string{"inst1"}, dropped.Instances)
+	assert.Equal(4, callCount)
+	assert.NotNil(rr.loadFactoryFromCacheDB("instances/inst1"))
+
+	// Naming nothing drops everything
+	dropped = rr.invalidate(&registryInvalidation{}, false)
+	assert.Equal([]string{"gw2"}, dropped.Gateways)
+	assert.Equal([]string{"inst1"}, dropped.Instances)
+	assert.Nil(rr.loadFactoryFromCacheDB("instances/inst1"))
+}
+
+func TestRemoteRegistryInstanceEnvironment(t *testing.T) {
+	dir := tempdir()
+	defer cleanup(dir)
+
+	assert := assert.New(t)
+
+	environments := []string{}
+	rr, server := newTestCachedRemoteRegistry(dir, func(res http.ResponseWriter, req *http.Request, parms httprouter.Params) {
+		environments = append(environments, req.URL.Query().Get("environment"))
+		testDataBytes, _ := ioutil.ReadFile("../../test/simpleevents.solc.output.json")
+		res.WriteHeader(200)
+		res.Write(testDataBytes)
+	})
+	defer server.Close()
+	defer rr.close()
+
+	// Each environment is looked up, and cached, separately
+	rr.loadFactoryForInstance("inst1", "", false)
+	rr.loadFactoryForInstance("inst1", "dev env", false)
+	rr.loadFactoryForInstance("inst1", "dev env", false)
+	rr.loadFactoryForInstance("inst1", "prod", false)
+	rr.loadFactoryForInstance("inst10", "", false)
+	assert.Equal([]string{"", "dev env", "prod", ""}, environments)
+	assert.NotNil(rr.loadFactoryFromCacheDB("instances/inst1@dev+env"))
+	assert.Equal([]string{"inst1", "inst10"}, rr.cachedLookups("instances"))
+
+	// Invalidating an instance drops it for every environment
+	dropped := rr.invalidate(&registryInvalidation{Instances: []string{"inst1"}}, true)
+	assert.Equal([]string{"inst1"}, dropped.Instances)
+	assert.Equal([]string{"", "dev env", "prod", "", "", "dev env", "prod"}, environments)
+	assert.NotNil(rr.loadFactoryFromCacheDB("instances/inst10"))
+}
+
+func TestRemoteRegistryInvalidateReloadFails(t *testing.T) {
+	dir := tempdir()
+	defer cleanup(dir)
+
+	assert := assert.New(t)
+
+	status := 200
+	rr, server := newTestCachedRemoteRegistry(dir, func(res http.ResponseWriter, req *http.Request, parms httprouter.Params) {
+		testDataBytes, _ := ioutil.ReadFile("../../test/simpleevents.solc.output.json")
+		res.WriteHeader(status)
+		res.Write(testDataBytes)
+	})
+	defer server.Close()
+	defer rr.close()
+
+	rr.loadFactoryForGateway("gw1", false)
+	rr.loadFactoryForInstance("inst1", "", false)
+	status = 500
+	dropped := rr.invalidate(&registryInvalidation{}, true)
+	assert.Equal([]string{"gw1"}, dropped.Gateways)
+	assert.Equal([]string{"inst1"}, dropped.Instances)
+	assert.Nil(rr.loadFactoryFromCacheDB("gateways/gw1"))
+}
+
+func TestRemoteRegistryInvalidateNoCache(t *testing.T) {
+	assert := assert.New(t)
+
+	r := NewRemoteRegistry(&RemoteRegistryConf{})
+	rr := r.(*remoteRegistry)
+	dropped := rr.invalidate(&registryInvalidation{Gateways: []string{"gw1"}}, true)
+	assert.Empty(dropped.Gateways)
+	assert.Empty(dropped.Instances)
+}
+
 func TestRemoteRegistryRegisterInstanceSuccess(t *testing.T) {
 	assert := assert.New(t)
 
@@ -240,7 +450,7 @@ func TestRemoteRegistryRegisterInstanceSuccess(t *testing.T) {
 	})
 	rr := r.(*remoteRegistry)
 
-	err := rr.registerInstance("testid", "12345")
+	err := rr.registerInstance("testid", "", "12345")
 	assert.NoError(err)
 }
 
@@ -262,7 +472,7 @@ func TestRemoteRegistryRegisterInstanceFail(t *testing.T) {
 	})
 	rr := r.(*remoteRegistry)
 
-	err := rr.registerInstance("testid", "12345")
+	err := rr.registerInstance("testid", "", "12345")
 	assert.Regexp("Failed to register instance in remote registry", err)
 }
 
@@ -276,7 +486,186 @@ func TestRemoteRegistryRegisterNoInstanceURL(t *testing.T) {
 	})
 	rr := r.(*remoteRegistry)
 
-	err := rr.registerInstance("testid", "12345")
+	err := rr.registerInstance("testid", "", "12345")
+	assert.EqualError(err, "No remote registry is configured")
+}
+
+func TestRemoteRegistryReserveConfirmReleaseInstance(t *testing.T) {
+	assert := assert.New(t)
+
+	router := &httprouter.Router{}
+	router.POST("/somepath", func(res http.ResponseWriter, req *http.Request, parms httprouter.Params) {
+		var bodyMap map[string]string
+		json.NewDecoder(req.Body).Decode(&bodyMap)
+		assert.Equal("test+id", bodyMap["name"])
+		_, hasAddress := bodyMap["address"]
+		assert.False(hasAddress)
+		res.WriteHeader(204)
+	})
+	router.PUT("/somepath/:name", func(res http.ResponseWriter, req *http.Request, parms httprouter.Params) {
+		var bodyMap map[string]string
+		json.NewDecoder(req.Body).Decode(&bodyMap)
+		assert.Equal("test+id", parms.ByName("name"))
+		assert.Equal("test+id", bodyMap["name"])
+		assert.Equal("12345", bodyMap["address"])
+		res.WriteHeader(204)
+	})
+	router.DELETE("/somepath/:name", func(res http.ResponseWriter, req *http.Request, parms httprouter.Params) {
+		assert.Equal("test+id", parms.ByName("name"))
+		res.WriteHeader(204)
+	})
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	r := NewRemoteRegistry(&RemoteRegistryConf{
+		InstanceURLPrefix: server.URL + "/somepath/",
+	})
+	rr := r.(*remoteRegistry)
+
+	conflict, err := rr.reserveInstance("test id", "")
+	assert.NoError(err)
+	assert.False(conflict)
+	err = rr.confirmInstance("test id", "", "12345")
+	assert.NoError(err)
+	err = rr.releaseInstance("test id", "")
+	assert.NoError(err)
+}
+
+func TestRemoteRegistryReserveConfirmReleaseInstanceEnvironment(t *testing.T) {
+	assert := assert.New(t)
+
+	router := &httprouter.Router{}
+	router.POST("/somepath", func(res http.ResponseWriter, req *http.Request, parms httprouter.Params) {
+		var bodyMap map[string]string
+		json.NewDecoder(req.Body).Decode(&bodyMap)
+		assert.Equal("testid", bodyMap["name"])
+		assert.Equal("dev", bodyMap["env"])
+		res.WriteHeader(204)
+	})
+	router.PUT("/somepath/:name", func(res http.ResponseWriter, req *http.Request, parms httprouter.Params) {
+		var bodyMap map[string]string
+		json.NewDecoder(req.Body).Decode(&bodyMap)
+		assert.Equal("dev", req.URL.Query().Get("environment"))
+		assert.Equal("dev", bodyMap["env"])
+		assert.Equal("12345", bodyMap["address"])
+		res.WriteHeader(204)
+	})
+	router.DELETE("/somepath/:name", func(res http.ResponseWriter, req *http.Request, parms httprouter.Params) {
+		assert.Equal("dev", req.URL.Query().Get("environment"))
+		res.WriteHeader(204)
+	})
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	r := NewRemoteRegistry(&RemoteRegistryConf{
+		InstanceURLPrefix: server.URL + "/somepath/",
+		PropNames: RemoteRegistryPropNamesConf{
+			Environment: "env",
+		},
+	})
+	rr := r.(*remoteRegistry)
+
+	_, err := rr.reserveInstance("testid", "dev")
+	assert.NoError(err)
+	err = rr.confirmInstance("testid", "dev", "12345")
+	assert.NoError(err)
+	err = rr.releaseInstance("testid", "dev")
+	assert.NoError(err)
+	err = rr.registerInstance("testid", "dev", "12345")
+	assert.NoError(err)
+}
+
+func TestRemoteRegistryReserveInstanceClash(t *testing.T) {
+	assert := assert.New(t)
+
+	router := &httprouter.Router{}
+	router.POST("/somepath", func(res http.ResponseWriter, req *http.Request, parms httprouter.Params) {
+		res.WriteHeader(409)
+		res.Write([]byte(`{"errorMessage":"exists"}`))
+	})
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	r := NewRemoteRegistry(&RemoteRegistryConf{
+		InstanceURLPrefix: server.URL + "/somepath/",
+	})
+	rr := r.(*remoteRegistry)
+
+	conflict, err := rr.reserveInstance("testid", "")
+	assert.Regexp("Failed to reserve name 'testid' in remote registry.*exists", err)
+	assert.True(conflict)
+}
+
+func TestRemoteRegistryReserveInstanceFail(t *testing.T) {
+	assert := assert.New(t)
+
+	router := &httprouter.Router{}
+	router.POST("/somepath", func(res http.ResponseWriter, req *http.Request, parms httprouter.Params) {
+		res.WriteHeader(500)
+		res.Write([]byte(`{"errorMessage":"pop"}`))
+	})
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	r := NewRemoteRegistry(&RemoteRegistryConf{
+		InstanceURLPrefix: server.URL + "/somepath/",
+	})
+	rr := r.(*remoteRegistry)
+
+	// A failure of the registry is not a name conflict
+	conflict, err := rr.reserveInstance("testid", "")
+	assert.Regexp("Failed to reserve name 'testid' in remote registry.*pop", err)
+	assert.False(conflict)
+}
+
+func TestRemoteRegistryConfirmInstanceNotFound(t *testing.T) {
+	assert := assert.New(t)
+
+	router := &httprouter.Router{}
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	r := NewRemoteRegistry(&RemoteRegistryConf{
+		InstanceURLPrefix: server.URL + "/somepath/",
+	})
+	rr := r.(*remoteRegistry)
+
+	err := rr.confirmInstance("testid", "", "12345")
+	assert.Regexp("Failed to register instance in remote registry", err)
+	err = rr.releaseInstance("testid", "")
+	assert.NoError(err)
+}
+
+func TestRemoteRegistryReleaseInstanceFail(t *testing.T) {
+	assert := assert.New(t)
+
+	router := &httprouter.Router{}
+	router.DELETE("/somepath/:name", func(res http.ResponseWriter, req *http.Request, parms httprouter.Params) {
+		res.WriteHeader(500)
+	})
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	r := NewRemoteRegistry(&RemoteRegistryConf{
+		InstanceURLPrefix: server.URL + "/somepath/",
+	})
+	rr := r.(*remoteRegistry)
+
+	err := rr.releaseInstance("testid", "")
+	assert.Regexp("Failed to release reserved name 'testid'", err)
+}
+
+func TestRemoteRegistryReservationNoInstanceURL(t *testing.T) {
+	assert := assert.New(t)
+
+	r := NewRemoteRegistry(&RemoteRegistryConf{})
+	rr := r.(*remoteRegistry)
+
+	_, err := rr.reserveInstance("testid", "")
+	assert.EqualError(err, "No remote registry is configured")
+	err = rr.confirmInstance("testid", "", "12345")
+	assert.EqualError(err, "No remote registry is configured")
+	err = rr.releaseInstance("testid", "")
 	assert.EqualError(err, "No remote registry is configured")
 }
 
@@ -606,7 +995,7 @@ func TestRemoteRegistryloadFactoryForInstanceSuccess(t *testing.T) {
 	})
 	rr := r.(*remoteRegistry)
 
-	res, err := rr.loadFactoryForInstance("testid", false)
+	res, err := rr.loadFactoryForInstance("testid", "", false)
 	assert.NoError(err)
 	assert.Equal(res.Address, "35344e187d669d930c9d513aac63ae204fc03c18")
 }
@@ -617,7 +1006,7 @@ func TestRemoteRegistryLoadInstanceNOOP(t *testing.T) {
 	r := NewRemoteRegistry(&RemoteRegistryConf{})
 	rr := r.(*remoteRegistry)
 
-	res, err := rr.loadFactoryForInstance("testid", false)
+	res, err := rr.loadFactoryForInstance("testid", "", false)
 	assert.NoError(err)
 	assert.Nil(res)
 }
@@ -649,3 +1038,58 @@ func TestRemoteRegistryStoreFactoryToCacheDBBadObj(t *testing.T) {
 	mockKV.StoreErr = fmt.Errorf("pop")
 	rr.storeFactoryToCacheDB("testid", nil)
 }
+
+func TestRemoteRegistryInitBadTLS(t *testing.T) {
+	assert := assert.New(t)
+
+	r := NewRemoteRegistry(&RemoteRegistryConf{
+		TLS: utils.TLSConfig{
+			Enabled:       true,
+			ClientKeyFile: "/some/key.pem",
+		},
+	})
+	rr := r.(*remoteRegistry)
+
+	err := rr.init()
+	assert.Regexp("Failed to initialize authentication for remote registry: Client private key and certificate must both be provided", err)
+}
+
+func TestRemoteRegistryloadFactoryForGatewayOAuth2(t *testing.T) {
+	assert := assert.New(t)
+
+	router := &httprouter.Router{}
+	router.POST("/oauth/token", func(res http.ResponseWriter, req *http.Request, parms httprouter.Params) {
+		res.WriteHeader(200)
+		res.Write([]byte(`{"access_token":"abcd","token_type":"Bearer","expires_in":3600}`))
+	})
+	router.GET("/somepath/:id", func(res http.ResponseWriter, req *http.Request, parms httprouter.Params) {
+		if req.Header.Get("Authorization") != "Bearer abcd" {
+			res.WriteHeader(401)
+			return
+		}
+		testDataBytes, _ := ioutil.ReadFile("../../test/simpleevents.solc.output.json")
+		res.WriteHeader(200)
+		res.Write(testDataBytes)
+	})
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	r := NewRemoteRegistry(&RemoteRegistryConf{
+		GatewayURLPrefix: server.URL + "/somepath",
+		PropNames: RemoteRegistryPropNamesConf{
+			Bytecode: "bin",
+		},
+		OAuth2: utils.OAuth2Conf{
+			TokenURL:     server.URL + "/oauth/token",
+			ClientID:     "ethconnect",
+			ClientSecret: "secret",
+		},
+	})
+	rr := r.(*remoteRegistry)
+	err := rr.init()
+	assert.NoError(err)
+
+	res, err := rr.loadFactoryForGateway("testid", false)
+	assert.NoError(err)
+	assert.NotEmpty(res.Compiled)
+}
@@ -25,6 +25,7 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/julienschmidt/httprouter"
 	ethbinding "github.com/kaleido-io/ethbinding/pkg"
@@ -34,6 +35,7 @@ import (
 	"github.com/kaleido-io/ethconnect/internal/ethbind"
 	"github.com/kaleido-io/ethconnect/internal/events"
 	"github.com/kaleido-io/ethconnect/internal/messages"
+	"github.com/kaleido-io/ethconnect/internal/metrics"
 	"github.com/kaleido-io/ethconnect/internal/tx"
 	"github.com/kaleido-io/ethconnect/internal/utils"
 
@@ -60,6 +62,12 @@ type rest2EthReplyProcessor interface {
 	ReplyWithReceiptAndError(receipt messages.ReplyWithHeaders, err error)
 }
 
+// rest2EthSubmittedReplyProcessor is implemented by reply processors that need to know an
+// error is for a transaction that was submitted, so might still be mined
+type rest2EthSubmittedReplyProcessor interface {
+	ReplyWithSubmittedError(err error, txHash string)
+}
+
 // rest2eth provides the HTTP <-> messages translation and dispatches for processing
 type rest2eth struct {
 	gw              smartContractGatewayInt
@@ -72,7 +80,9 @@ type rest2eth struct {
 }
 
 type restErrMsg struct {
-	Message string `json:"error"`
+	Message string            `json:"error"`
+	Code    string            `json:"code,omitempty"`
+	Fields  []*eth.ParamError `json:"fields,omitempty"`
 }
 
 type restAsyncMsg struct {
@@ -86,27 +96,63 @@ type restReceiptAndError struct {
 
 // rest2EthInflight is instantiated for each async reply in flight
 type rest2EthSyncResponder struct {
-	r      *rest2eth
-	res    http.ResponseWriter
-	req    *http.Request
-	done   bool
-	waiter *sync.Cond
+	r         *rest2eth
+	res       http.ResponseWriter
+	req       *http.Request
+	done      bool
+	waiter    *sync.Cond
+	onFailure func()
 }
 
+// revertedTxnsMethodParam is the path segment after a contract instance, that subscribes to
+// its reverted transactions
+const revertedTxnsMethodParam = "reverted"
+
 var addrCheck = regexp.MustCompile("^(0x)?[0-9a-z]{40}$")
 
+// routeLatency is shared by all the gateways in the process, as each has the same routes
+var routeLatency = metrics.NewHistogramVec(
+	"ethconnect_http_request_seconds",
+	"Latency of requests to the REST gateway contract routes, by route pattern and status",
+	metrics.HTTPLatencyBuckets,
+	"method", "route", "status",
+)
+
+func (i *rest2EthSyncResponder) failed() {
+	if i.onFailure != nil {
+		i.onFailure()
+	}
+}
+
 func (i *rest2EthSyncResponder) ReplyWithError(err error) {
+	i.failed()
 	i.r.restErrReply(i.res, i.req, err, 500)
 	i.done = true
 	i.waiter.Broadcast()
 	return
 }
 
+// ReplyWithSubmittedError replies with an error for a transaction that was submitted, but
+// not seen mined. Any name reserved is kept, as the contract might still be deployed
+func (i *rest2EthSyncResponder) ReplyWithSubmittedError(err error, txHash string) {
+	if i.onFailure != nil {
+		log.Warnf("Keeping the reserved name, as transaction %s might still be mined", txHash)
+	}
+	i.r.restErrReply(i.res, i.req, err, 500)
+	i.done = true
+	i.waiter.Broadcast()
+}
+
 func (i *rest2EthSyncResponder) ReplyWithReceiptAndError(receipt messages.ReplyWithHeaders, err error) {
+	i.failed()
+	i.replyReceiptAndError(receipt, err)
+}
+
+func (i *rest2EthSyncResponder) replyReceiptAndError(receipt messages.ReplyWithHeaders, err error) {
 	status := 500
 	reply, _ := json.MarshalIndent(&restReceiptAndError{err.Error(), receipt}, "", "  ")
 	log.Infof("<-- %s %s [%d]", i.req.Method, i.req.URL, status)
-	log.Debugf("<-- %s", reply)
+	log.Debugf("<-- %s", utils.RedactJSON(reply))
 	i.res.Header().Set("Content-Type", "application/json")
 	i.res.WriteHeader(status)
 	i.res.Write(reply)
@@ -120,17 +166,20 @@ func (i *rest2EthSyncResponder) ReplyWithReceipt(receipt messages.ReplyWithHeade
 	if txReceiptMsg != nil && txReceiptMsg.ContractAddress != nil {
 		if err := i.r.gw.PostDeploy(txReceiptMsg); err != nil {
 			log.Warnf("Failed to perform post-deploy processing: %s", err)
-			i.ReplyWithReceiptAndError(receipt, err)
+			// The contract is deployed, so any name reserved for it is kept, even though
+			// the registration could not be completed
+			i.replyReceiptAndError(receipt, err)
 			return
 		}
 	}
 	status := 200
 	if receipt.ReplyHeaders().MsgType != messages.MsgTypeTransactionSuccess {
+		i.failed()
 		status = 500
 	}
 	reply, _ := json.MarshalIndent(receipt, "", "  ")
 	log.Infof("<-- %s %s [%d]", i.req.Method, i.req.URL, status)
-	log.Debugf("<-- %s", reply)
+	log.Debugf("<-- %s", utils.RedactJSON(reply))
 	i.res.Header().Set("Content-Type", "application/json")
 	i.res.WriteHeader(status)
 	i.res.Write(reply)
@@ -151,35 +200,48 @@ func newREST2eth(gw smartContractGatewayInt, rpc eth.RPCClient, subMgr events.Su
 	}
 }
 
+// handle registers the REST handler for a route, observing the latency of each request
+// against the route pattern
+func (r *rest2eth) handle(router *httprouter.Router, method, route string) {
+	router.Handle(method, route, metrics.InstrumentHandler(routeLatency, route, r.restHandler))
+}
+
 func (r *rest2eth) addRoutes(router *httprouter.Router) {
 	// Built-in registry managed routes
-	router.POST("/contracts/:address/:method", r.restHandler)
-	router.GET("/contracts/:address/:method", r.restHandler)
-	router.POST("/contracts/:address/:method/:subcommand", r.restHandler)
+	r.handle(router, "POST", "/contracts/:address/:method")
+	r.handle(router, "GET", "/contracts/:address/:method")
+	r.handle(router, "POST", "/contracts/:address/:method/:subcommand")
+	r.handle(router, "GET", "/contracts/:address/:method/:subcommand")
 
-	router.POST("/abis/:abi", r.restHandler)
-	router.POST("/abis/:abi/:address/:method", r.restHandler)
-	router.GET("/abis/:abi/:address/:method", r.restHandler)
-	router.POST("/abis/:abi/:address/:method/:subcommand", r.restHandler)
+	r.handle(router, "POST", "/abis/:abi")
+	r.handle(router, "POST", "/abis/:abi/:address/:method")
+	r.handle(router, "GET", "/abis/:abi/:address/:method")
+	r.handle(router, "POST", "/abis/:abi/:address/:method/:subcommand")
 
 	// Remote registry managed address routes, with long and short names
-	router.POST("/instances/:instance_lookup/:method", r.restHandler)
-	router.GET("/instances/:instance_lookup/:method", r.restHandler)
-	router.POST("/instances/:instance_lookup/:method/:subcommand", r.restHandler)
-
-	router.POST("/i/:instance_lookup/:method", r.restHandler)
-	router.GET("/i/:instance_lookup/:method", r.restHandler)
-	router.POST("/i/:instance_lookup/:method/:subcommand", r.restHandler)
-
-	router.POST("/gateways/:gateway_lookup", r.restHandler)
-	router.POST("/gateways/:gateway_lookup/:address/:method", r.restHandler)
-	router.GET("/gateways/:gateway_lookup/:address/:method", r.restHandler)
-	router.POST("/gateways/:gateway_lookup/:address/:method/:subcommand", r.restHandler)
-
-	router.POST("/g/:gateway_lookup", r.restHandler)
-	router.POST("/g/:gateway_lookup/:address/:method", r.restHandler)
-	router.GET("/g/:gateway_lookup/:address/:method", r.restHandler)
-	router.POST("/g/:gateway_lookup/:address/:method/:subcommand", r.restHandler)
+	r.handle(router, "POST", "/instances/:instance_lookup/:method")
+	r.handle(router, "GET", "/instances/:instance_lookup/:method")
+	r.handle(router, "POST", "/instances/:instance_lookup/:method/:subcommand")
+	r.handle(router, "GET", "/instances/:instance_lookup/:method/:subcommand")
+
+	r.handle(router, "POST", "/i/:instance_lookup/:method")
+	r.handle(router, "GET", "/i/:instance_lookup/:method")
+	r.handle(router, "POST", "/i/:instance_lookup/:method/:subcommand")
+	r.handle(router, "GET", "/i/:instance_lookup/:method/:subcommand")
+
+	r.handle(router, "POST", "/gateways/:gateway_lookup")
+	r.handle(router, "POST", "/gateways/:gateway_lookup/:address/:method")
+	r.handle(router, "GET", "/gateways/:gateway_lookup/:address/:method")
+	r.handle(router, "POST", "/gateways/:gateway_lookup/:address/:method/:subcommand")
+
+	r.handle(router, "POST", "/g/:gateway_lookup")
+	r.handle(router, "POST", "/g/:gateway_lookup/:address/:method")
+	r.handle(router, "GET", "/g/:gateway_lookup/:address/:method")
+	r.handle(router, "POST", "/g/:gateway_lookup/:address/:method/:subcommand")
+
+	// Submission of many transactions, to any of the registered contracts, in one request
+	r.addBatchRoute(router)
+	r.addMulticallRoute(router)
 }
 
 type restCmd struct {
@@ -190,16 +252,22 @@ type restCmd struct {
 	abiMethodElem *ethbinding.ABIElementMarshaling
 	abiEvent      *ethbinding.ABIEvent
 	abiEventElem  *ethbinding.ABIElementMarshaling
+	rawSelector   string
+	rawData       []byte
+	revertedTxns  bool
 	isDeploy      bool
 	deployMsg     *messages.DeployContract
+	access        *messages.MethodAccess
 	body          map[string]interface{}
 	msgParams     []interface{}
 	blocknumber   string
+	asOf          *time.Time
 }
 
 func (r *rest2eth) resolveABI(res http.ResponseWriter, req *http.Request, params httprouter.Params, c *restCmd, addrParam string, refresh bool) (a ethbinding.ABIMarshaling, validAddress bool, err error) {
 	c.addr = strings.ToLower(strings.TrimPrefix(addrParam, "0x"))
 	validAddress = addrCheck.MatchString(c.addr)
+	var info *contractInfo
 
 	// There are multiple ways we resolve the path into an ABI
 	// 1. we lookup it up remotely in a REST attached contract registry (the newer option)
@@ -220,7 +288,7 @@ func (r *rest2eth) resolveABI(res http.ResponseWriter, req *http.Request, params
 		}
 	} else if strings.HasPrefix(req.URL.Path, "/instances/") || strings.HasPrefix(req.URL.Path, "/i/") {
 		var msg *deployContractWithAddress
-		msg, err = r.rr.loadFactoryForInstance(params.ByName("instance_lookup"), refresh)
+		msg, err = r.rr.loadFactoryForInstance(params.ByName("instance_lookup"), getFlyParam("environment", req, false), refresh)
 		if err != nil {
 			r.restErrReply(res, req, err, 500)
 			return
@@ -244,14 +312,14 @@ func (r *rest2eth) resolveABI(res http.ResponseWriter, req *http.Request, params
 		} else {
 			if !validAddress {
 				// Resolve the address as a registered name, to an actual contract address
-				if c.addr, err = r.gw.resolveContractAddr(addrParam); err != nil {
+				if c.addr, err = r.gw.resolveContractAddr(addrParam, getFlyParam("environment", req, false)); err != nil {
 					r.restErrReply(res, req, err, 404)
 					return
 				}
 				validAddress = true
 				addrParam = c.addr
 			}
-			c.deployMsg, _, err = r.gw.loadDeployMsgForInstance(addrParam)
+			c.deployMsg, info, err = r.gw.loadOrInferDeployMsgForInstance(req.Context(), addrParam)
 			if err != nil {
 				r.restErrReply(res, req, err, 404)
 				return
@@ -259,6 +327,7 @@ func (r *rest2eth) resolveABI(res http.ResponseWriter, req *http.Request, params
 		}
 	}
 	a = c.deployMsg.ABI
+	c.access = methodAccessFor(c.deployMsg, info)
 	return
 }
 
@@ -348,12 +417,20 @@ func (r *rest2eth) resolveParams(res http.ResponseWriter, req *http.Request, par
 		if err = r.resolveMethod(res, req, &c, a, methodParam); err != nil {
 			return
 		}
+		if c.abiMethod != nil && methodListed(c.access.HiddenMethods, methodParam) {
+			// Hidden methods are not part of the API, so are reported as not declared
+			c.abiMethod, c.abiMethodElem = nil, nil
+		}
+		// The functions of an inferred ABI that were not recognized are called by selector, with raw call data
+		if c.abiMethod == nil && isInferredABI(c.deployMsg) && selectorCheck.MatchString(methodParamLC) {
+			c.rawSelector = methodParamLC
+		}
 	}
 
 	// Then if we don't have a method in :method param, we might have
 	// an event in either the :event OR :address param (see special case above)
 	// Note solidity guarantees no overlap in method / event names
-	if c.abiMethod == nil && methodParam != "" {
+	if c.abiMethod == nil && c.rawSelector == "" && methodParam != "" {
 		if err = r.resolveEvent(res, req, &c, a, methodParam, methodParamLC, addrParam); err != nil {
 			return
 		}
@@ -366,8 +443,15 @@ func (r *rest2eth) resolveParams(res http.ResponseWriter, req *http.Request, par
 		}
 	}
 
+	// Reverted transactions to an instance are subscribed to with /contracts/ADDRESS/reverted/subscribe,
+	// unless the ABI declares a method or event named "reverted"
+	if c.abiMethod == nil && c.abiEvent == nil && methodParamLC == revertedTxnsMethodParam &&
+		req.Method == http.MethodPost && strings.ToLower(params.ByName("subcommand")) == "subscribe" {
+		c.revertedTxns = true
+	}
+
 	// If we didn't find the method or event, report to the user
-	if c.abiMethod == nil && c.abiEvent == nil {
+	if c.abiMethod == nil && c.abiEvent == nil && !c.revertedTxns && c.rawSelector == "" {
 		if methodParamLC == "subscribe" {
 			err = ethconnecterrors.Errorf(ethconnecterrors.RESTGatewayEventNotDeclared, methodParam)
 			r.restErrReply(res, req, err, 404)
@@ -390,19 +474,9 @@ func (r *rest2eth) resolveParams(res http.ResponseWriter, req *http.Request, par
 	}
 
 	// If we have a from, it needs to be a valid address
-	From := getFlyParam("from", req, false)
-	fromNo0xPrefix := strings.ToLower(strings.TrimPrefix(getFlyParam("from", req, false), "0x"))
-	if fromNo0xPrefix != "" {
-		if addrCheck.MatchString(fromNo0xPrefix) {
-			c.from = "0x" + fromNo0xPrefix
-		} else if tx.IsHDWalletRequest(fromNo0xPrefix) != nil {
-			c.from = fromNo0xPrefix
-		} else {
-			log.Errorf("Invalid from address: '%s'", From)
-			err = ethconnecterrors.Errorf(ethconnecterrors.RESTGatewayInvalidFromAddress)
-			r.restErrReply(res, req, err, 404)
-			return
-		}
+	if c.from, err = resolveFrom(getFlyParam("from", req, false)); err != nil {
+		r.restErrReply(res, req, err, 404)
+		return
 	}
 	c.value = json.Number(getFlyParam("ethvalue", req, false))
 
@@ -412,13 +486,91 @@ func (r *rest2eth) resolveParams(res http.ResponseWriter, req *http.Request, par
 		return
 	}
 
-	if c.abiEvent != nil {
+	if c.abiEvent != nil || c.revertedTxns {
+		return
+	}
+
+	if c.rawSelector != "" {
+		if c.rawData, err = rawCallData(c.rawSelector, r.fromBodyOrForm(req, c.body, "data")); err != nil {
+			r.restErrReply(res, req, err, 400)
+			return
+		}
+	} else if c.msgParams, err = methodParams(c.abiMethod, c.body, req.Form); err != nil {
+		r.restErrReply(res, req, err, 400)
 		return
 	}
 
-	c.msgParams = make([]interface{}, len(c.abiMethod.Inputs))
-	queryParams := req.Form
-	for i, abiParam := range c.abiMethod.Inputs {
+	if c.blocknumber, c.asOf, err = callBlockParams(req); err != nil {
+		r.restErrReply(res, req, err, 400)
+		return
+	}
+
+	return
+}
+
+// callBlockParams returns the block a read-only call is made at, from the blocknumber, blocktag
+// or asOf options. Only one can be supplied. A timestamp for asOf is returned to be resolved to
+// a block number, and an empty block number means the latest block
+func callBlockParams(req *http.Request) (blocknumber string, asOf *time.Time, err error) {
+	blocknumber = getFlyParam("blocknumber", req, false)
+	asOfParam := getFlyParam("asof", req, false)
+	if blockTag := getFlyParam("blocktag", req, false); blockTag != "" {
+		if blocknumber != "" || asOfParam != "" {
+			return "", nil, ethconnecterrors.Errorf(ethconnecterrors.TransactionCallBlockTagWithBlockNumber)
+		}
+		if !eth.IsBlockTag(blockTag) {
+			return "", nil, ethconnecterrors.Errorf(ethconnecterrors.TransactionCallInvalidBlockTag, blockTag)
+		}
+		return blockTag, nil, nil
+	}
+	if asOfParam != "" {
+		if blocknumber != "" {
+			return "", nil, ethconnecterrors.Errorf(ethconnecterrors.TransactionCallAsOfWithBlockNumber)
+		}
+		return eth.ParseAsOf(asOfParam)
+	}
+	return blocknumber, nil, nil
+}
+
+// resolveFrom checks the signing address of a transaction is a valid address, or the name of
+// an HD wallet, keystore or alias
+func resolveFrom(from string) (string, error) {
+	fromNo0xPrefix := strings.ToLower(strings.TrimPrefix(from, "0x"))
+	if fromNo0xPrefix == "" {
+		return "", nil
+	}
+	if addrCheck.MatchString(fromNo0xPrefix) {
+		return "0x" + fromNo0xPrefix, nil
+	}
+	if tx.IsHDWalletRequest(fromNo0xPrefix) != nil || tx.IsKeystoreRequest(fromNo0xPrefix) != nil || tx.IsAliasName(fromNo0xPrefix) {
+		return fromNo0xPrefix, nil
+	}
+	log.Errorf("Invalid from address: '%s'", from)
+	return "", ethconnecterrors.Errorf(ethconnecterrors.RESTGatewayInvalidFromAddress)
+}
+
+// rawCallData is the call data of a raw call to a selector, from the ABI encoded arguments in hex
+func rawCallData(selector, data string) ([]byte, error) {
+	args := []byte{}
+	if data != "" {
+		var err error
+		if !strings.HasPrefix(data, "0x") {
+			return nil, ethconnecterrors.Errorf(ethconnecterrors.RESTGatewayRawCallBadData, selector, "missing 0x prefix")
+		}
+		if args, err = ethbind.API.HexDecode(data); err != nil {
+			return nil, ethconnecterrors.Errorf(ethconnecterrors.RESTGatewayRawCallBadData, selector, err)
+		}
+	}
+	callData, _ := ethbind.API.HexDecode(selector)
+	return append(callData, args...), nil
+}
+
+// methodParams reads the inputs of a method by name from the body, falling back to the query
+// parameters, and checks they convert to the ABI types before dispatching - so that the caller
+// receives the details of every offending field
+func methodParams(abiMethod *ethbinding.ABIMethod, body map[string]interface{}, queryParams url.Values) ([]interface{}, error) {
+	msgParams := make([]interface{}, len(abiMethod.Inputs))
+	for i, abiParam := range abiMethod.Inputs {
 		argName := abiParam.Name
 		// If the ABI input has one or more un-named parameters, look for default names that are passed in.
 		// Unnamed Input params should be named: input, input1, input2...
@@ -428,46 +580,88 @@ func (r *rest2eth) resolveParams(res http.ResponseWriter, req *http.Request, par
 				argName += strconv.Itoa(i)
 			}
 		}
-		if bv, exists := c.body[argName]; exists {
-			c.msgParams[i] = bv
+		if bv, exists := body[argName]; exists {
+			msgParams[i] = bv
 		} else if vs := queryParams[argName]; len(vs) > 0 {
-			c.msgParams[i] = vs[0]
+			msgParams[i] = vs[0]
 		} else {
-			err = ethconnecterrors.Errorf(ethconnecterrors.RESTGatewayMissingParameter, argName, c.abiMethod.Name)
-			r.restErrReply(res, req, err, 400)
-			return
+			return nil, ethconnecterrors.Errorf(ethconnecterrors.RESTGatewayMissingParameter, argName, abiMethod.Name)
 		}
 	}
-
-	c.blocknumber = getFlyParam("blocknumber", req, false)
-
-	return
+	if err := eth.ValidateParams(abiMethod, msgParams); err != nil {
+		return nil, err
+	}
+	return msgParams, nil
 }
 
 func (r *rest2eth) restHandler(res http.ResponseWriter, req *http.Request, params httprouter.Params) {
 	log.Infof("--> %s %s", req.Method, req.URL)
 
+	if r.contractStats(res, req, params) || r.contractConformance(res, req, params) {
+		return
+	}
+	if req.Method == http.MethodGet && params.ByName("subcommand") != "" {
+		r.exportEvents(res, req, params)
+		return
+	}
+
 	c, err := r.resolveParams(res, req, params, false) // We never refresh the ABI on an execution call - you have to use ?abi or ?swagger
 	if err != nil {
 		return
 	}
 
-	if c.abiEvent != nil {
+	if c.rawSelector != "" {
+		r.rawCall(res, req, &c)
+	} else if c.abiEvent != nil {
 		r.subscribeEvent(res, req, c.addr, c.abiEventElem, c.body)
+	} else if c.revertedTxns {
+		r.subscribeRevertedTxns(res, req, c.addr, c.deployMsg.ABI, c.body)
 	} else if (req.Method == http.MethodPost && !c.abiMethod.IsConstant()) && strings.ToLower(getFlyParam("call", req, true)) != "true" {
-		if c.from == "" {
+		if !c.isDeploy && methodListed(c.access.ReadOnlyMethods, c.abiMethodElem.Name) {
+			err = ethconnecterrors.Errorf(ethconnecterrors.RESTGatewayMethodReadOnly, c.abiMethodElem.Name)
+			r.restErrReply(res, req, err, 403)
+		} else if c.from == "" && getFlyParam("sponsor", req, false) == "" {
 			err = ethconnecterrors.Errorf(ethconnecterrors.RESTGatewayMissingFromAddress, utils.GetenvOrDefaultLowerCase("PREFIX_SHORT", "fly"), utils.GetenvOrDefaultLowerCase("PREFIX_LONG", "firefly"))
 			r.restErrReply(res, req, err, 400)
 		} else if c.isDeploy {
 			r.deployContract(res, req, c.from, c.value, c.abiMethodElem, c.deployMsg, c.msgParams)
 		} else {
-			r.sendTransaction(res, req, c.from, c.addr, c.value, c.abiMethodElem, c.msgParams)
+			r.sendTransaction(res, req, c.from, c.addr, c.value, c.abiMethodElem, c.deployMsg.ABI, c.msgParams)
 		}
 	} else {
-		r.callContract(res, req, c.from, c.addr, c.value, c.abiMethod, c.msgParams, c.blocknumber)
+		r.callContract(res, req, c.from, c.addr, c.value, c.abiMethod, c.msgParams, eth.ErrorABIs(c.deployMsg.ABI), c.blocknumber, c.asOf)
 	}
 }
 
+// contractStats serves GET /contracts/:address/stats, returning true if it handled the request.
+// The route shares the :method wildcard with the contract methods, so when contract stats are
+// enabled it takes precedence over a method named "stats"
+func (r *rest2eth) contractStats(res http.ResponseWriter, req *http.Request, params httprouter.Params) bool {
+	if req.Method != http.MethodGet || params.ByName("method") != "stats" || params.ByName("abi") != "" ||
+		params.ByName("address") == "" || r.processor == nil {
+		return false
+	}
+	addrParam := params.ByName("address")
+	addr := strings.ToLower(strings.TrimPrefix(addrParam, "0x"))
+	if !addrCheck.MatchString(addr) {
+		var err error
+		if addr, err = r.gw.resolveContractAddr(addrParam, getFlyParam("environment", req, false)); err != nil {
+			return false
+		}
+	}
+	stats := r.processor.ContractStats("0x" + addr)
+	if stats == nil {
+		return false
+	}
+	resBytes, _ := json.MarshalIndent(stats, "", "  ")
+	status := 200
+	log.Infof("<-- %s %s [%d]", req.Method, req.URL, status)
+	res.Header().Set("Content-Type", "application/json")
+	res.WriteHeader(status)
+	res.Write(resBytes)
+	return true
+}
+
 func (r *rest2eth) fromBodyOrForm(req *http.Request, body map[string]interface{}, param string) string {
 	val := body[param]
 	valType := reflect.TypeOf(val)
@@ -477,7 +671,9 @@ func (r *rest2eth) fromBodyOrForm(req *http.Request, body map[string]interface{}
 	return req.FormValue(param)
 }
 
-func (r *rest2eth) subscribeEvent(res http.ResponseWriter, req *http.Request, addrStr string, abiEvent *ethbinding.ABIElementMarshaling, body map[string]interface{}) {
+// subscriptionParams checks the caller can manage event streams, and reads the stream, starting
+// block and name of a new subscription from the body or form. Returns false if it replied with an error
+func (r *rest2eth) subscriptionParams(res http.ResponseWriter, req *http.Request, body map[string]interface{}) (streamID, fromBlock, name string, ok bool) {
 
 	err := auth.AuthEventStreams(req.Context())
 	if err != nil {
@@ -490,34 +686,82 @@ func (r *rest2eth) subscribeEvent(res http.ResponseWriter, req *http.Request, ad
 		r.restErrReply(res, req, errors.New(errEventSupportMissing), 405)
 		return
 	}
-	streamID := r.fromBodyOrForm(req, body, "stream")
+	streamID = r.fromBodyOrForm(req, body, "stream")
 	if streamID == "" {
 		r.restErrReply(res, req, ethconnecterrors.Errorf(ethconnecterrors.RESTGatewaySubscribeMissingStreamParameter), 400)
 		return
 	}
-	fromBlock := r.fromBodyOrForm(req, body, "fromBlock")
+	fromBlock = r.fromBodyOrForm(req, body, "fromBlock")
+	// if the end user provided a name for the subscription, use it
+	// If not provided, it will be set to a system-generated summary
+	name = r.fromBodyOrForm(req, body, "name")
+	return streamID, fromBlock, name, true
+}
+
+func (r *rest2eth) subscribeEvent(res http.ResponseWriter, req *http.Request, addrStr string, abiEvent *ethbinding.ABIElementMarshaling, body map[string]interface{}) {
+
+	streamID, fromBlock, name, ok := r.subscriptionParams(res, req, body)
+	if !ok {
+		return
+	}
 	var addr *ethbinding.Address
 	if addrStr != "" {
 		address := ethbind.API.HexToAddress(addrStr)
 		addr = &address
 	}
-	// if the end user provided a name for the subscription, use it
-	// If not provided, it will be set to a system-generated summary
-	name := r.fromBodyOrForm(req, body, "name")
-	sub, err := r.subMgr.AddSubscription(req.Context(), addr, abiEvent, streamID, fromBlock, name)
+	// Optionally deliver summaries of the events over a window, rather than every event
+	var aggregation *events.AggregationInfo
+	if body["aggregation"] != nil {
+		aggregation = &events.AggregationInfo{}
+		aggBytes, _ := json.Marshal(body["aggregation"])
+		if err := json.Unmarshal(aggBytes, aggregation); err != nil {
+			r.restErrReply(res, req, ethconnecterrors.Errorf(ethconnecterrors.RESTGatewaySubscribeInvalidAggregation, err), 400)
+			return
+		}
+	}
+	sub, err := r.subMgr.AddSubscription(req.Context(), addr, abiEvent, streamID, fromBlock, name, aggregation)
+	r.subscribeReply(res, req, sub, err)
+}
+
+// subscribeRevertedTxns subscribes to the transactions sent to a contract instance that reverted.
+// The functions and errors of the ABI of the instance are stored with the subscription, to
+// decode the calldata and the revert reason of each transaction
+func (r *rest2eth) subscribeRevertedTxns(res http.ResponseWriter, req *http.Request, addrStr string, abi ethbinding.ABIMarshaling, body map[string]interface{}) {
+
+	streamID, fromBlock, name, ok := r.subscriptionParams(res, req, body)
+	if !ok {
+		return
+	}
+	addr := ethbind.API.HexToAddress(addrStr)
+	sub, err := r.subMgr.AddRevertedTxnSubscription(req.Context(), &addr, revertedTxnsABI(abi), streamID, fromBlock, name)
+	r.subscribeReply(res, req, sub, err)
+}
+
+func (r *rest2eth) subscribeReply(res http.ResponseWriter, req *http.Request, sub *events.SubscriptionInfo, err error) {
 	if err != nil {
-		r.restErrReply(res, req, err, 400)
+		r.restErrReply(res, req, err, quotaErrStatus(err, 400))
 		return
 	}
 	status := 200
 	resBytes, _ := json.Marshal(sub)
 	log.Infof("<-- %s %s [%d]", req.Method, req.URL, status)
-	log.Debugf("<-- %s", resBytes)
+	log.Debugf("<-- %s", utils.RedactJSON(resBytes))
 	res.Header().Set("Content-Type", "application/json")
 	res.WriteHeader(status)
 	res.Write(resBytes)
 }
 
+// revertedTxnsABI is the part of an ABI needed to decode reverted transactions
+func revertedTxnsABI(abi ethbinding.ABIMarshaling) ethbinding.ABIMarshaling {
+	revertedABI := ethbinding.ABIMarshaling{}
+	for _, element := range abi {
+		if element.Type == "function" || element.Type == "error" {
+			revertedABI = append(revertedABI, element)
+		}
+	}
+	return revertedABI
+}
+
 func (r *rest2eth) doubleURLDecode(s string) string {
 	// Due to an annoying bug in the rapidoc Swagger UI, it is double URL encoding parameters.
 	// As most constellation b64 encoded values end in "=" that's breaking the ability to use
@@ -542,24 +786,99 @@ func (r *rest2eth) addPrivateTx(msg *messages.TransactionCommon, req *http.Reque
 
 func (r *rest2eth) deployContract(res http.ResponseWriter, req *http.Request, from string, value json.Number, abiMethodElem *ethbinding.ABIElementMarshaling, deployMsg *messages.DeployContract, msgParams []interface{}) {
 
+	if isWellKnownABI(deployMsg.Headers.ID) {
+		r.restErrReply(res, req, ethconnecterrors.Errorf(ethconnecterrors.RESTGatewayWellKnownABINotDeployable, deployMsg.Headers.ID), 400)
+		return
+	}
 	deployMsg.Headers.MsgType = messages.MsgTypeDeployContract
+	deployMsg.Headers.Priority = getFlyParam("priority", req, false)
+	deployMsg.Headers.Sponsor = getFlyParam("sponsor", req, false)
 	deployMsg.From = from
 	deployMsg.Gas = json.Number(getFlyParam("gas", req, false))
 	deployMsg.GasPrice = json.Number(getFlyParam("gasprice", req, false))
+	deployMsg.MaxFeePerGas = json.Number(getFlyParam("maxfeepergas", req, false))
+	deployMsg.MaxPriorityFeePerGas = json.Number(getFlyParam("maxpriorityfeepergas", req, false))
+	deployMsg.GasPriceStrategy = getFlyParam("gaspricestrategy", req, false)
+	deployMsg.Nonce = json.Number(getFlyParam("nonce", req, false))
 	deployMsg.Value = value
 	deployMsg.Parameters = msgParams
+	if err := eth.ValidateGasPriceStrategy(deployMsg.GasPriceStrategy); err != nil {
+		r.restErrReply(res, req, err, 400)
+		return
+	}
 	if err := r.addPrivateTx(&deployMsg.TransactionCommon, req, res); err != nil {
 		r.restErrReply(res, req, err, 400)
 		return
 	}
+	confirmations, err := getFlyConfirmations(req)
+	if err != nil {
+		r.restErrReply(res, req, err, 400)
+		return
+	}
+	deployMsg.Headers.Confirmations = confirmations
+	deployMsg.Salt = getFlyParam("salt", req, false)
+	if deployMsg.Salt != "" {
+		deployMsg.Factory = getFlyParam("factory", req, false)
+	}
+	create2Address, err := eth.PreviewCREATE2Address(deployMsg)
+	if err != nil {
+		r.restErrReply(res, req, err, 400)
+		return
+	}
+	if err := r.gw.checkStaticAnalysis(deployMsg); err != nil {
+		r.restErrReply(res, req, err, 403)
+		return
+	}
+	if !isRemote(deployMsg.Headers.CommonHeaders) {
+		tenant := auth.GetTenant(req.Context())
+		if err := r.gw.checkContractQuota(tenant); err != nil {
+			r.restErrReply(res, req, err, 403)
+			return
+		}
+		if tenant != "" {
+			if deployMsg.Headers.Context == nil {
+				deployMsg.Headers.Context = make(map[string]interface{})
+			}
+			deployMsg.Headers.Context[tenantContextKey] = tenant
+		}
+	}
 	deployMsg.RegisterAs = getFlyParam("register", req, false)
 	if deployMsg.RegisterAs != "" {
-		if err := r.gw.checkNameAvailable(deployMsg.RegisterAs, isRemote(deployMsg.Headers.CommonHeaders)); err != nil {
+		deployMsg.RegisterEnvironment = getFlyParam("environment", req, false)
+	}
+	if strings.ToLower(getFlyParam("dryrun", req, true)) == "true" {
+		// Check the name is available for registration, but do not reserve it
+		if deployMsg.RegisterAs != "" {
+			if err := r.gw.checkNameAvailable(deployMsg.RegisterAs, deployMsg.RegisterEnvironment, isRemote(deployMsg.Headers.CommonHeaders)); err != nil {
+				r.restErrReply(res, req, err, 409)
+				return
+			}
+		}
+		r.dryRunDeploy(res, req, deployMsg)
+		return
+	}
+	isSync := strings.ToLower(getFlyParam("sync", req, true)) == "true"
+	reserve := isSync && deployMsg.RegisterAs != "" && isRemote(deployMsg.Headers.CommonHeaders)
+	if reserve {
+		// For synchronous deployments against the remote registry, we reserve the name
+		// before deploying, and confirm the registration in PostDeploy. This means a
+		// name clash is detected before we deploy, rather than leaving an orphaned instance
+		if conflict, err := r.rr.reserveInstance(deployMsg.RegisterAs, deployMsg.RegisterEnvironment); err != nil {
+			status := 500
+			if conflict {
+				status = 409
+			}
+			r.restErrReply(res, req, err, status)
+			return
+		}
+		deployMsg.Headers.Context[remoteRegistryReservedContextKey] = true
+	} else if deployMsg.RegisterAs != "" {
+		if err := r.gw.checkNameAvailable(deployMsg.RegisterAs, deployMsg.RegisterEnvironment, isRemote(deployMsg.Headers.CommonHeaders)); err != nil {
 			r.restErrReply(res, req, err, 409)
 			return
 		}
 	}
-	if strings.ToLower(getFlyParam("sync", req, true)) == "true" {
+	if isSync {
 		responder := &rest2EthSyncResponder{
 			r:      r,
 			res:    res,
@@ -567,6 +886,14 @@ func (r *rest2eth) deployContract(res http.ResponseWriter, req *http.Request, fr
 			done:   false,
 			waiter: sync.NewCond(&sync.Mutex{}),
 		}
+		if reserve {
+			responder.onFailure = func() {
+				// Roll back the reservation, so the name can be used again
+				if err := r.rr.releaseInstance(deployMsg.RegisterAs, deployMsg.RegisterEnvironment); err != nil {
+					log.Errorf("Failed to roll back reservation of '%s': %s", deployMsg.RegisterAs, err)
+				}
+			}
+		}
 		r.syncDispatcher.DispatchDeployContractSync(req.Context(), deployMsg, responder)
 		responder.waiter.L.Lock()
 		for !responder.done {
@@ -583,28 +910,91 @@ func (r *rest2eth) deployContract(res http.ResponseWriter, req *http.Request, fr
 		if asyncResponse, err := r.asyncDispatcher.DispatchMsgAsync(req.Context(), mapMsg, ack); err != nil {
 			r.restErrReply(res, req, err, 500)
 		} else {
+			asyncResponse.ContractAddress = create2Address
 			r.restAsyncReply(res, req, asyncResponse)
 		}
 	}
 	return
 }
 
-func (r *rest2eth) sendTransaction(res http.ResponseWriter, req *http.Request, from, addr string, value json.Number, abiMethodElem *ethbinding.ABIElementMarshaling, msgParams []interface{}) {
+// dryRunDeploy compiles the contract, and predicts the outcome of deploying it - without
+// submitting a transaction. Private transactions cannot be simulated with eth_call
+func (r *rest2eth) dryRunDeploy(res http.ResponseWriter, req *http.Request, deployMsg *messages.DeployContract) {
+	if deployMsg.PrivateFrom != "" || len(deployMsg.PrivateFor) > 0 || deployMsg.PrivacyGroupID != "" {
+		r.restErrReply(res, req, ethconnecterrors.Errorf(ethconnecterrors.RESTGatewayDryRunPrivate), 400)
+		return
+	}
+	from, err := r.processor.ResolveAddress(req.Context(), deployMsg.From)
+	if err != nil {
+		r.restErrReply(res, req, err, 500)
+		return
+	}
+	deployMsg.From = from
+	tx, err := eth.NewContractDeployTxn(deployMsg, nil)
+	if err != nil {
+		r.restErrReply(res, req, err, 400)
+		return
+	}
+	result, err := tx.DryRun(req.Context(), r.rpc)
+	if err != nil {
+		r.restErrReply(res, req, err, 500)
+		return
+	}
+	resBytes, _ := json.Marshal(result)
+	status := 200
+	log.Infof("<-- %s %s [%d]", req.Method, req.URL, status)
+	log.Debugf("<-- %s", utils.RedactJSON(resBytes))
+	res.Header().Set("Content-Type", "application/json")
+	res.WriteHeader(status)
+	res.Write(resBytes)
+}
 
+// newSendTransactionMsg builds a transaction to a method, with the gas, privacy and confirmation
+// options of the request
+func (r *rest2eth) newSendTransactionMsg(req *http.Request, from, addr string, value json.Number, abiMethodElem *ethbinding.ABIElementMarshaling, abi ethbinding.ABIMarshaling, msgParams []interface{}) (*messages.SendTransaction, error) {
 	msg := &messages.SendTransaction{}
 	msg.Headers.MsgType = messages.MsgTypeSendTransaction
+	msg.Headers.Priority = getFlyParam("priority", req, false)
+	msg.Headers.Sponsor = getFlyParam("sponsor", req, false)
 	msg.Method = abiMethodElem
+	msg.Events = abiEvents(abi)
+	msg.Errors = eth.ErrorABIs(abi)
 	msg.To = addr
 	msg.From = from
 	msg.Gas = json.Number(getFlyParam("gas", req, false))
 	msg.GasPrice = json.Number(getFlyParam("gasprice", req, false))
+	msg.MaxFeePerGas = json.Number(getFlyParam("maxfeepergas", req, false))
+	msg.MaxPriorityFeePerGas = json.Number(getFlyParam("maxpriorityfeepergas", req, false))
+	msg.GasPriceStrategy = getFlyParam("gaspricestrategy", req, false)
+	msg.Nonce = json.Number(getFlyParam("nonce", req, false))
 	msg.Value = value
 	msg.Parameters = msgParams
-	if err := r.addPrivateTx(&msg.TransactionCommon, req, res); err != nil {
+	if err := eth.ValidateGasPriceStrategy(msg.GasPriceStrategy); err != nil {
+		return nil, err
+	}
+	if err := r.addPrivateTx(&msg.TransactionCommon, req, nil); err != nil {
+		return nil, err
+	}
+	confirmations, err := getFlyConfirmations(req)
+	if err != nil {
+		return nil, err
+	}
+	msg.Headers.Confirmations = confirmations
+	return msg, nil
+}
+
+func (r *rest2eth) sendTransaction(res http.ResponseWriter, req *http.Request, from, addr string, value json.Number, abiMethodElem *ethbinding.ABIElementMarshaling, abi ethbinding.ABIMarshaling, msgParams []interface{}) {
+
+	msg, err := r.newSendTransactionMsg(req, from, addr, value, abiMethodElem, abi, msgParams)
+	if err != nil {
 		r.restErrReply(res, req, err, 400)
 		return
 	}
+	r.dispatchSendTransaction(res, req, msg)
+}
 
+// dispatchSendTransaction sends a transaction synchronously or asynchronously, as the request asks
+func (r *rest2eth) dispatchSendTransaction(res http.ResponseWriter, req *http.Request, msg *messages.SendTransaction) {
 	if strings.ToLower(getFlyParam("sync", req, true)) == "true" {
 		responder := &rest2EthSyncResponder{
 			r:      r,
@@ -635,22 +1025,89 @@ func (r *rest2eth) sendTransaction(res http.ResponseWriter, req *http.Request, f
 	return
 }
 
-func (r *rest2eth) callContract(res http.ResponseWriter, req *http.Request, from, addr string, value json.Number, abiMethod *ethbinding.ABIMethod, msgParams []interface{}, blocknumber string) {
+// abiEvents extracts the event definitions from the contract ABI, so the
+// logs in the receipt can be decoded against them
+func abiEvents(abi ethbinding.ABIMarshaling) ethbinding.ABIMarshaling {
+	var events ethbinding.ABIMarshaling
+	for _, element := range abi {
+		if element.Type == "event" {
+			events = append(events, element)
+		}
+	}
+	return events
+}
+
+func (r *rest2eth) callContract(res http.ResponseWriter, req *http.Request, from, addr string, value json.Number, abiMethod *ethbinding.ABIMethod, msgParams []interface{}, errorABIs ethbinding.ABIMarshaling, blocknumber string, asOf *time.Time) {
 	var err error
-	if from, err = r.processor.ResolveAddress(from); err != nil {
+	if from, err = r.processor.ResolveAddress(req.Context(), from); err != nil {
 		r.restErrReply(res, req, err, 500)
 		return
 	}
 
-	resBody, err := eth.CallMethod(req.Context(), r.rpc, nil, from, addr, value, abiMethod, msgParams, blocknumber)
+	// Historical queries by time are resolved to the last block mined at or before that time
+	if asOf != nil {
+		if blocknumber, err = eth.GetBlockNumberAt(req.Context(), r.rpc, *asOf); err != nil {
+			r.restErrReply(res, req, err, 500)
+			return
+		}
+	}
+
+	resBody, err := eth.CallMethod(req.Context(), r.rpc, nil, from, addr, value, abiMethod, msgParams, errorABIs, blocknumber)
 	if err != nil {
 		r.restErrReply(res, req, err, 500)
 		return
 	}
+	r.restCallReply(res, req, resBody)
+}
+
+// rawCall sends a transaction, or makes a call, to a function of an inferred ABI by its selector,
+// with the call data supplied in the request. The output of a call is returned in hex, along with
+// a guess at the value of each word, as the outputs of the function are not known
+func (r *rest2eth) rawCall(res http.ResponseWriter, req *http.Request, c *restCmd) {
+	if req.Method == http.MethodPost && strings.ToLower(getFlyParam("call", req, true)) != "true" {
+		if c.from == "" && getFlyParam("sponsor", req, false) == "" {
+			err := ethconnecterrors.Errorf(ethconnecterrors.RESTGatewayMissingFromAddress, utils.GetenvOrDefaultLowerCase("PREFIX_SHORT", "fly"), utils.GetenvOrDefaultLowerCase("PREFIX_LONG", "firefly"))
+			r.restErrReply(res, req, err, 400)
+			return
+		}
+		msg, err := r.newSendTransactionMsg(req, c.from, c.addr, c.value, nil, c.deployMsg.ABI, nil)
+		if err != nil {
+			r.restErrReply(res, req, err, 400)
+			return
+		}
+		msg.Data = ethbind.API.HexEncode(c.rawData)
+		r.dispatchSendTransaction(res, req, msg)
+		return
+	}
+
+	from, err := r.processor.ResolveAddress(req.Context(), c.from)
+	if err != nil {
+		r.restErrReply(res, req, err, 500)
+		return
+	}
+	blocknumber := c.blocknumber
+	if c.asOf != nil {
+		if blocknumber, err = eth.GetBlockNumberAt(req.Context(), r.rpc, *c.asOf); err != nil {
+			r.restErrReply(res, req, err, 500)
+			return
+		}
+	}
+	output, err := eth.CallData(req.Context(), r.rpc, from, c.addr, c.value, c.rawData, eth.ErrorABIs(c.deployMsg.ABI), blocknumber)
+	if err != nil {
+		r.restErrReply(res, req, err, 500)
+		return
+	}
+	r.restCallReply(res, req, map[string]interface{}{
+		"output": ethbind.API.HexEncode(output),
+		"words":  guessWords(output),
+	})
+}
+
+func (r *rest2eth) restCallReply(res http.ResponseWriter, req *http.Request, resBody interface{}) {
 	resBytes, _ := json.MarshalIndent(&resBody, "", "  ")
 	status := 200
 	log.Infof("<-- %s %s [%d]", req.Method, req.URL, status)
-	log.Debugf("<-- %s", resBytes)
+	log.Debugf("<-- %s", utils.RedactJSON(resBytes))
 	res.Header().Set("Content-Type", "application/json")
 	res.WriteHeader(status)
 	res.Write(resBytes)
@@ -661,7 +1118,7 @@ func (r *rest2eth) restAsyncReply(res http.ResponseWriter, req *http.Request, as
 	resBytes, _ := json.Marshal(asyncResponse)
 	status := 202 // accepted
 	log.Infof("<-- %s %s [%d]:\n%s", req.Method, req.URL, status, string(resBytes))
-	log.Debugf("<-- %s", resBytes)
+	log.Debugf("<-- %s", utils.RedactJSON(resBytes))
 	res.Header().Set("Content-Type", "application/json")
 	res.WriteHeader(status)
 	res.Write(resBytes)
@@ -669,7 +1126,12 @@ func (r *rest2eth) restAsyncReply(res http.ResponseWriter, req *http.Request, as
 
 func (r *rest2eth) restErrReply(res http.ResponseWriter, req *http.Request, err error, status int) {
 	log.Errorf("<-- %s %s [%d]: %s", req.Method, req.URL, status, err)
-	reply, _ := json.Marshal(&restErrMsg{Message: err.Error()})
+	errMsg := &restErrMsg{Message: err.Error()}
+	if validationErr, ok := err.(*eth.ParamValidationError); ok {
+		errMsg.Code = validationErr.Code()
+		errMsg.Fields = validationErr.Fields
+	}
+	reply, _ := json.Marshal(errMsg)
 	res.Header().Set("Content-Type", "application/json")
 	res.WriteHeader(status)
 	res.Write(reply)
@@ -19,11 +19,15 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"io/ioutil"
+	"math/big"
 	"net/http"
 	"net/http/httptest"
 	"reflect"
+	"strconv"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/julienschmidt/httprouter"
 	ethbinding "github.com/kaleido-io/ethbinding/pkg"
@@ -33,6 +37,8 @@ import (
 	"github.com/kaleido-io/ethconnect/internal/ethbind"
 	"github.com/kaleido-io/ethconnect/internal/events"
 	"github.com/kaleido-io/ethconnect/internal/messages"
+	"github.com/kaleido-io/ethconnect/internal/quotas"
+	"github.com/kaleido-io/ethconnect/internal/tx"
 	log "github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/assert"
 )
@@ -48,6 +54,7 @@ type mockREST2EthDispatcher struct {
 	deployContractMsg          *messages.DeployContract
 	deployContractSyncReceipt  *messages.TransactionReceipt
 	deployContractSyncError    error
+	deployContractSyncTxHash   string
 }
 
 func (m *mockREST2EthDispatcher) DispatchMsgAsync(ctx context.Context, msg map[string]interface{}, ack bool) (*messages.AsyncSentMsg, error) {
@@ -67,7 +74,10 @@ func (m *mockREST2EthDispatcher) DispatchSendTransactionSync(ctx context.Context
 
 func (m *mockREST2EthDispatcher) DispatchDeployContractSync(ctx context.Context, msg *messages.DeployContract, replyProcessor rest2EthReplyProcessor) {
 	m.deployContractMsg = msg
-	if m.deployContractSyncError != nil {
+	if m.deployContractSyncTxHash != "" {
+		inflight := &syncTxInflight{replyProcessor: replyProcessor, deployMsg: msg}
+		inflight.SendErrorReplyWithTX(408, m.deployContractSyncError, m.deployContractSyncTxHash)
+	} else if m.deployContractSyncError != nil {
 		replyProcessor.ReplyWithError(m.deployContractSyncError)
 	} else {
 		replyProcessor.ReplyWithReceipt(m.deployContractSyncReceipt)
@@ -84,6 +94,8 @@ type mockABILoader struct {
 	nameAvailableError     error
 	capturedAddr           string
 	postDeployError        error
+	contractQuotaError     error
+	staticAnalysisError    error
 }
 
 func (m *mockABILoader) SendReply(message interface{}) {
@@ -95,7 +107,11 @@ func (m *mockABILoader) loadDeployMsgForInstance(addrHexNo0x string) (*messages.
 	return m.deployMsg, m.contractInfo, m.loadABIError
 }
 
-func (m *mockABILoader) resolveContractAddr(registeredName string) (string, error) {
+func (m *mockABILoader) loadOrInferDeployMsgForInstance(ctx context.Context, addrHex string) (*messages.DeployContract, *contractInfo, error) {
+	return m.loadDeployMsgForInstance(addrHex)
+}
+
+func (m *mockABILoader) resolveContractAddr(registeredName, environment string) (string, error) {
 	return m.registeredContractAddr, m.resolveContractErr
 }
 
@@ -103,10 +119,18 @@ func (m *mockABILoader) loadDeployMsgByID(addrHexNo0x string) (*messages.DeployC
 	return m.deployMsg, m.abiInfo, m.loadABIError
 }
 
-func (m *mockABILoader) checkNameAvailable(name string, isRemote bool) error {
+func (m *mockABILoader) checkNameAvailable(name, environment string, isRemote bool) error {
 	return m.nameAvailableError
 }
 
+func (m *mockABILoader) checkContractQuota(tenant string) error {
+	return m.contractQuotaError
+}
+
+func (m *mockABILoader) checkStaticAnalysis(msg *messages.DeployContract) error {
+	return m.staticAnalysisError
+}
+
 func (m *mockABILoader) PreDeploy(msg *messages.DeployContract) error { return nil }
 func (m *mockABILoader) PostDeploy(msg *messages.TransactionReceipt) error {
 	return m.postDeployError
@@ -130,15 +154,39 @@ func (m *mockRPC) CallContext(ctx context.Context, result interface{}, method st
 }
 
 type mockSubMgr struct {
-	err             error
-	updateStreamErr error
-	sub             *events.SubscriptionInfo
-	stream          *events.StreamInfo
-	subs            []*events.SubscriptionInfo
-	streams         []*events.StreamInfo
-	suspended       bool
-	resumed         bool
-	capturedAddr    *ethbinding.Address
+	err                 error
+	updateStreamErr     error
+	sub                 *events.SubscriptionInfo
+	stream              *events.StreamInfo
+	subs                []*events.SubscriptionInfo
+	streams             []*events.StreamInfo
+	suspended           bool
+	resumed             bool
+	capturedAddr        *ethbinding.Address
+	capturedAggregation *events.AggregationInfo
+	capturedSubType     string
+	checkpoint          *events.SubscriptionCheckpoint
+	checkpointErr       error
+	capturedBlock       string
+	resumeAt            *time.Time
+	backfill            *events.BackfillInfo
+	backfills           []*events.BackfillInfo
+	deliveries          []*events.DeliveryRecord
+	capturedSkip        int
+	capturedLimit       int
+	deadLetters         []*events.DeadLetter
+	invalidationHook    *events.InvalidationHookInfo
+	invalidationHooks   []*events.InvalidationHookInfo
+	subSuspended        bool
+	subResumed          bool
+	capturedABI         ethbinding.ABIMarshaling
+	checkpoints         map[string]*big.Int
+	capturedCheckpoints map[string]*big.Int
+	rewound             []string
+	reactor             events.EventReactor
+	checkpointGroup     *events.CheckpointGroupInfo
+	checkpointGroups    []*events.CheckpointGroupInfo
+	groupCheckpoint     *events.CheckpointGroupCheckpoint
 }
 
 func (m *mockSubMgr) Init() error { return m.err }
@@ -156,13 +204,31 @@ func (m *mockSubMgr) SuspendStream(ctx context.Context, id string) error {
 	m.suspended = true
 	return m.err
 }
+func (m *mockSubMgr) SuspendStreamUntil(ctx context.Context, id string, resumeAt *time.Time) error {
+	m.suspended = true
+	m.resumeAt = resumeAt
+	return m.err
+}
 func (m *mockSubMgr) ResumeStream(ctx context.Context, id string) error {
 	m.resumed = true
 	return m.err
 }
 func (m *mockSubMgr) DeleteStream(ctx context.Context, id string) error { return m.err }
-func (m *mockSubMgr) AddSubscription(ctx context.Context, addr *ethbinding.Address, event *ethbinding.ABIElementMarshaling, streamID, initialBlock, name string) (*events.SubscriptionInfo, error) {
+func (m *mockSubMgr) AddSubscription(ctx context.Context, addr *ethbinding.Address, event *ethbinding.ABIElementMarshaling, streamID, initialBlock, name string, aggregation *events.AggregationInfo) (*events.SubscriptionInfo, error) {
+	m.capturedAddr = addr
+	m.capturedAggregation = aggregation
+	return m.sub, m.err
+}
+func (m *mockSubMgr) AddRevertedTxnSubscription(ctx context.Context, addr *ethbinding.Address, abi ethbinding.ABIMarshaling, streamID, initialBlock, name string) (*events.SubscriptionInfo, error) {
 	m.capturedAddr = addr
+	m.capturedABI = abi
+	m.capturedBlock = initialBlock
+	return m.sub, m.err
+}
+func (m *mockSubMgr) AddChainSubscription(ctx context.Context, subType string, addr *ethbinding.Address, streamID, initialBlock, name string) (*events.SubscriptionInfo, error) {
+	m.capturedAddr = addr
+	m.capturedBlock = initialBlock
+	m.capturedSubType = subType
 	return m.sub, m.err
 }
 func (m *mockSubMgr) Subscriptions(ctx context.Context) []*events.SubscriptionInfo { return m.subs }
@@ -173,10 +239,86 @@ func (m *mockSubMgr) DeleteSubscription(ctx context.Context, id string) error {
 func (m *mockSubMgr) ResetSubscription(ctx context.Context, id, initialBlock string) error {
 	return m.err
 }
-func (m *mockSubMgr) Close() {}
+func (m *mockSubMgr) SuspendSubscription(ctx context.Context, id string) error {
+	m.subSuspended = true
+	return m.err
+}
+func (m *mockSubMgr) ResumeSubscription(ctx context.Context, id string) error {
+	m.subResumed = true
+	return m.err
+}
+func (m *mockSubMgr) SubscriptionCheckpoint(ctx context.Context, id string) (*events.SubscriptionCheckpoint, error) {
+	return m.checkpoint, m.err
+}
+func (m *mockSubMgr) SetSubscriptionCheckpoint(ctx context.Context, id, block string) (*events.SubscriptionCheckpoint, error) {
+	m.capturedBlock = block
+	return m.checkpoint, m.checkpointErr
+}
+func (m *mockSubMgr) SubscriptionCheckpoints(ctx context.Context) map[string]*big.Int {
+	return m.checkpoints
+}
+func (m *mockSubMgr) RewindSubscriptions(ctx context.Context, checkpoints map[string]*big.Int, block *big.Int) []string {
+	m.capturedCheckpoints = checkpoints
+	m.capturedBlock = block.String()
+	return m.rewound
+}
+func (m *mockSubMgr) AddBackfill(ctx context.Context, spec *events.BackfillInfo) (*events.BackfillInfo, error) {
+	return spec, m.err
+}
+func (m *mockSubMgr) Backfills(ctx context.Context) []*events.BackfillInfo { return m.backfills }
+func (m *mockSubMgr) BackfillByID(ctx context.Context, id string) (*events.BackfillInfo, error) {
+	return m.backfill, m.err
+}
+func (m *mockSubMgr) ResumeBackfill(ctx context.Context, id string) (*events.BackfillInfo, error) {
+	m.resumed = true
+	return m.backfill, m.err
+}
+func (m *mockSubMgr) DeleteBackfill(ctx context.Context, id string) error { return m.err }
+func (m *mockSubMgr) StreamDeliveries(ctx context.Context, id string, skip, limit int) ([]*events.DeliveryRecord, error) {
+	m.capturedSkip = skip
+	m.capturedLimit = limit
+	return m.deliveries, m.err
+}
+func (m *mockSubMgr) StreamDeadLetters(ctx context.Context, id string) ([]*events.DeadLetter, error) {
+	return m.deadLetters, m.err
+}
+func (m *mockSubMgr) ReplayDeadLetters(ctx context.Context, id string) (int, error) {
+	return len(m.deadLetters), m.err
+}
+func (m *mockSubMgr) AddInvalidationHook(ctx context.Context, spec *events.InvalidationHookInfo) (*events.InvalidationHookInfo, error) {
+	return spec, m.err
+}
+func (m *mockSubMgr) InvalidationHooks(ctx context.Context) []*events.InvalidationHookInfo {
+	return m.invalidationHooks
+}
+func (m *mockSubMgr) InvalidationHookByID(ctx context.Context, id string) (*events.InvalidationHookInfo, error) {
+	return m.invalidationHook, m.err
+}
+func (m *mockSubMgr) DeleteInvalidationHook(ctx context.Context, id string) error { return m.err }
+func (m *mockSubMgr) AddCheckpointGroup(ctx context.Context, spec *events.CheckpointGroupInfo) (*events.CheckpointGroupInfo, error) {
+	return spec, m.err
+}
+func (m *mockSubMgr) CheckpointGroups(ctx context.Context) []*events.CheckpointGroupInfo {
+	return m.checkpointGroups
+}
+func (m *mockSubMgr) CheckpointGroupByID(ctx context.Context, id string) (*events.CheckpointGroupInfo, error) {
+	return m.checkpointGroup, m.err
+}
+func (m *mockSubMgr) CheckpointGroupCheckpoint(ctx context.Context, id string) (*events.CheckpointGroupCheckpoint, error) {
+	return m.groupCheckpoint, m.checkpointErr
+}
+func (m *mockSubMgr) ResetCheckpointGroup(ctx context.Context, id, initialBlock string) error {
+	m.capturedBlock = initialBlock
+	return m.err
+}
+func (m *mockSubMgr) DeleteCheckpointGroup(ctx context.Context, id string) error { return m.err }
+func (m *mockSubMgr) Close()                                                     {}
+func (m *mockSubMgr) SetEventReactor(reactor events.EventReactor) {
+	m.reactor = reactor
+}
 
 func newTestDeployMsg(t *testing.T, addr string) *deployContractWithAddress {
-	compiled, err := eth.CompileContract(simpleEventsSource(), "SimpleEvents", "", "")
+	compiled, err := eth.CompileContract(simpleEventsSource(), "SimpleEvents", "", &messages.CompilerOptions{})
 	assert.NoError(t, err)
 	return &deployContractWithAddress{
 		DeployContract: messages.DeployContract{ABI: compiled.ABI},
@@ -271,6 +413,50 @@ func TestSendTransactionAsyncSuccess(t *testing.T) {
 	assert.Equal("0xB92F8CebA52fFb5F08f870bd355B1d32f0fd9f7C", dispatcher.asyncDispatchMsg["privateFor"].([]interface{})[1])
 }
 
+func TestSendTransactionAsyncAliasFrom(t *testing.T) {
+	assert := assert.New(t)
+	dir := tempdir()
+	defer cleanup(dir)
+
+	bodyMap := make(map[string]interface{})
+	bodyMap["i"] = 12345
+	bodyMap["s"] = "testing"
+	to := "0x567a417717cb6c59ddc1035705f02c0fd1ab1872"
+	dispatcher := &mockREST2EthDispatcher{
+		asyncDispatchReply: &messages.AsyncSentMsg{
+			Sent:    true,
+			Request: "request1",
+		},
+	}
+	_, _, router, res, req := newTestREST2EthAndMsg(t, dispatcher, "Treasury-Ops", to, bodyMap)
+	router.ServeHTTP(res, req)
+
+	assert.Equal(202, res.Result().StatusCode)
+	assert.Equal("treasury-ops", dispatcher.asyncDispatchMsg["from"])
+}
+
+func TestSendTransactionAsyncKeystoreFrom(t *testing.T) {
+	assert := assert.New(t)
+	dir := tempdir()
+	defer cleanup(dir)
+
+	bodyMap := make(map[string]interface{})
+	bodyMap["i"] = 12345
+	bodyMap["s"] = "testing"
+	to := "0x567a417717cb6c59ddc1035705f02c0fd1ab1872"
+	dispatcher := &mockREST2EthDispatcher{
+		asyncDispatchReply: &messages.AsyncSentMsg{
+			Sent:    true,
+			Request: "request1",
+		},
+	}
+	_, _, router, res, req := newTestREST2EthAndMsg(t, dispatcher, "m/44'/60'/0'/0/3", to, bodyMap)
+	router.ServeHTTP(res, req)
+
+	assert.Equal(202, res.Result().StatusCode)
+	assert.Equal("m/44'/60'/0'/0/3", dispatcher.asyncDispatchMsg["from"])
+}
+
 func TestDeployContractAsyncSuccess(t *testing.T) {
 	assert := assert.New(t)
 	dir := tempdir()
@@ -614,6 +800,21 @@ func TestDeployContractSyncRemoteRegitryInstance404(t *testing.T) {
 	assert.Equal(404, res.Result().StatusCode)
 }
 
+func TestDeployContractSyncRemoteRegitryInstanceEnvironment(t *testing.T) {
+	assert := assert.New(t)
+
+	r, _, router := newTestREST2EthCustomAbiLoader(&mockREST2EthDispatcher{}, &mockABILoader{})
+	rr := &mockRR{}
+	r.rr = rr
+	req := httptest.NewRequest("POST", "/instances/myinstance/set?fly-sync&fly-environment=dev", bytes.NewReader([]byte(`{}`)))
+	res := httptest.NewRecorder()
+	router.ServeHTTP(res, req)
+
+	assert.Equal(404, res.Result().StatusCode)
+	assert.Equal("myinstance", rr.addrCapture)
+	assert.Equal("dev", rr.envCapture)
+}
+
 func TestDeployContractSyncRemoteRegitryGateway500(t *testing.T) {
 	assert := assert.New(t)
 	dir := tempdir()
@@ -682,326 +883,428 @@ func TestDeployContractSyncRemoteRegistryGateway(t *testing.T) {
 	assert.Equal(from, dispatcher.sendTransactionMsg.From)
 }
 
-func TestSendTransactionSyncFail(t *testing.T) {
+func newTestPrecompiledDeployMsg(t *testing.T) *deployContractWithAddress {
+	b, err := ioutil.ReadFile("../../test/simpleevents.solc.output.json")
+	assert.NoError(t, err)
+	var contract SolcJson
+	json.Unmarshal(b, &contract)
+	deployMsg := &deployContractWithAddress{}
+	err = json.Unmarshal([]byte(contract.ABI), &deployMsg.ABI)
+	assert.NoError(t, err)
+	deployMsg.Compiled, err = ethbind.API.HexDecode("0x" + contract.Bin)
+	assert.NoError(t, err)
+	return deployMsg
+}
+
+func TestSendTransactionSyncIncludesEvents(t *testing.T) {
 	assert := assert.New(t)
-	dir := tempdir()
-	defer cleanup(dir)
 
-	bodyMap := make(map[string]interface{})
-	bodyMap["i"] = 12345
-	bodyMap["s"] = "testing"
-	to := "0x567a417717cb6c59ddc1035705f02c0fd1ab1872"
-	from := "0x66c5fe653e7a9ebb628a6d40f0452d1e358baee8"
 	dispatcher := &mockREST2EthDispatcher{
-		sendTransactionSyncError: fmt.Errorf("pop"),
+		sendTransactionSyncReceipt: &messages.TransactionReceipt{
+			ReplyCommon: messages.ReplyCommon{
+				Headers: messages.ReplyHeaders{
+					CommonHeaders: messages.CommonHeaders{
+						MsgType: messages.MsgTypeTransactionSuccess,
+					},
+				},
+			},
+		},
 	}
-	_, _, router, res, req := newTestREST2EthAndMsg(t, dispatcher, from, to, bodyMap)
-	req.Header.Set("x-firefly-sync", "true")
+	abiLoader := &mockABILoader{
+		deployMsg: &newTestPrecompiledDeployMsg(t).DeployContract,
+	}
+	_, _, router := newTestREST2EthCustomAbiLoader(dispatcher, abiLoader)
+	body, _ := json.Marshal(map[string]interface{}{"i": 12345, "s": "testing"})
+	req := httptest.NewRequest("POST", "/contracts/0x567a417717cb6c59ddc1035705f02c0fd1ab1872/set?fly-sync", bytes.NewReader(body))
+	req.Header.Add("x-firefly-from", "0x66c5fe653e7a9ebb628a6d40f0452d1e358baee8")
+	res := httptest.NewRecorder()
 	router.ServeHTTP(res, req)
 
-	assert.Equal(500, res.Result().StatusCode)
-	reply := restErrMsg{}
-	err := json.NewDecoder(res.Result().Body).Decode(&reply)
-	assert.NoError(err)
-	assert.Equal("pop", reply.Message)
+	assert.Equal(200, res.Result().StatusCode)
+	assert.Len(dispatcher.sendTransactionMsg.Events, 1)
+	assert.Equal("Changed", dispatcher.sendTransactionMsg.Events[0].Name)
+	assert.Equal("event", dispatcher.sendTransactionMsg.Events[0].Type)
 }
 
-func TestSendTransactionAsyncFail(t *testing.T) {
+func TestSendTransactionSuppliedNonce(t *testing.T) {
 	assert := assert.New(t)
-	dir := tempdir()
-	defer cleanup(dir)
 
-	bodyMap := make(map[string]interface{})
-	bodyMap["i"] = 12345
-	bodyMap["s"] = "testing"
-	to := "0x567a417717cb6c59ddc1035705f02c0fd1ab1872"
-	from := "0x66c5fe653e7a9ebb628a6d40f0452d1e358baee8"
 	dispatcher := &mockREST2EthDispatcher{
-		asyncDispatchError: fmt.Errorf("pop"),
+		sendTransactionSyncReceipt: &messages.TransactionReceipt{
+			ReplyCommon: messages.ReplyCommon{
+				Headers: messages.ReplyHeaders{
+					CommonHeaders: messages.CommonHeaders{
+						MsgType: messages.MsgTypeTransactionSuccess,
+					},
+				},
+			},
+		},
 	}
-	_, _, router, res, req := newTestREST2EthAndMsg(t, dispatcher, from, to, bodyMap)
+	abiLoader := &mockABILoader{
+		deployMsg: &newTestPrecompiledDeployMsg(t).DeployContract,
+	}
+	_, _, router := newTestREST2EthCustomAbiLoader(dispatcher, abiLoader)
+	body, _ := json.Marshal(map[string]interface{}{"i": 12345, "s": "testing"})
+	req := httptest.NewRequest("POST", "/contracts/0x567a417717cb6c59ddc1035705f02c0fd1ab1872/set?fly-sync&fly-nonce=42", bytes.NewReader(body))
+	req.Header.Add("x-firefly-from", "0x66c5fe653e7a9ebb628a6d40f0452d1e358baee8")
+	res := httptest.NewRecorder()
 	router.ServeHTTP(res, req)
 
-	assert.Equal(500, res.Result().StatusCode)
-	reply := restErrMsg{}
-	err := json.NewDecoder(res.Result().Body).Decode(&reply)
-	assert.NoError(err)
-	assert.Equal("pop", reply.Message)
+	assert.Equal(200, res.Result().StatusCode)
+	assert.Equal(json.Number("42"), dispatcher.sendTransactionMsg.Nonce)
 }
 
-func TestDeployContractAsyncFail(t *testing.T) {
+func TestSendTransactionInvalidParams(t *testing.T) {
 	assert := assert.New(t)
-	dir := tempdir()
-	defer cleanup(dir)
 
-	bodyMap := make(map[string]interface{})
-	bodyMap["i"] = 12345
-	bodyMap["s"] = "testing"
-	from := "0x66c5fe653e7a9ebb628a6d40f0452d1e358baee8"
-	dispatcher := &mockREST2EthDispatcher{
-		asyncDispatchError: fmt.Errorf("pop"),
+	dispatcher := &mockREST2EthDispatcher{}
+	abiLoader := &mockABILoader{
+		deployMsg: &newTestPrecompiledDeployMsg(t).DeployContract,
 	}
-	_, _, router, res, _ := newTestREST2EthAndMsg(t, dispatcher, from, "", bodyMap)
-	body, _ := json.Marshal(&bodyMap)
-	req := httptest.NewRequest("POST", "/abis/abi1", bytes.NewReader(body))
-	req.Header.Add("x-firefly-from", from)
+	_, _, router := newTestREST2EthCustomAbiLoader(dispatcher, abiLoader)
+	body, _ := json.Marshal(map[string]interface{}{"i": "lots", "s": 12345})
+	req := httptest.NewRequest("POST", "/contracts/0x567a417717cb6c59ddc1035705f02c0fd1ab1872/set", bytes.NewReader(body))
+	req.Header.Add("x-firefly-from", "0x66c5fe653e7a9ebb628a6d40f0452d1e358baee8")
+	res := httptest.NewRecorder()
 	router.ServeHTTP(res, req)
 
-	assert.Equal(500, res.Result().StatusCode)
-	reply := restErrMsg{}
+	assert.Equal(400, res.Result().StatusCode)
+	assert.Nil(dispatcher.asyncDispatchMsg)
+	var reply map[string]interface{}
 	err := json.NewDecoder(res.Result().Body).Decode(&reply)
 	assert.NoError(err)
-	assert.Equal("pop", reply.Message)
+	assert.Equal("INVALID_PARAMETERS", reply["code"])
+	assert.Regexp("Could not be converted to a number", reply["error"])
+	fields := reply["fields"].([]interface{})
+	assert.Len(fields, 2)
+	assert.Equal(map[string]interface{}{
+		"field":   "i",
+		"type":    "int64",
+		"value":   "lots",
+		"code":    "INVALID_NUMBER",
+		"hint":    "int64 must be a decimal string or a JSON number",
+		"message": "Method 'set' param 0: Could not be converted to a number",
+	}, fields[0])
+	assert.Equal("s", fields[1].(map[string]interface{})["field"])
+	assert.Equal("INVALID_STRING", fields[1].(map[string]interface{})["code"])
+}
+
+func routeLatencyCount(method, route, status string) uint64 {
+	for _, series := range routeLatency.Snapshot() {
+		if series.Labels["method"] == method && series.Labels["route"] == route && series.Labels["status"] == status {
+			return series.Count
+		}
+	}
+	return 0
 }
 
-func TestSendTransactionAsyncBadMethod(t *testing.T) {
+func TestRouteLatencyMetrics(t *testing.T) {
 	assert := assert.New(t)
-	dir := tempdir()
-	defer cleanup(dir)
 
-	bodyMap := make(map[string]interface{})
-	bodyMap["i"] = 12345
-	bodyMap["s"] = "testing"
-	to := "0x567a417717cb6c59ddc1035705f02c0fd1ab1872"
-	from := "0x66c5fe653e7a9ebb628a6d40f0452d1e358baee8"
-	dispatcher := &mockREST2EthDispatcher{
-		asyncDispatchError: fmt.Errorf("pop"),
+	dispatcher := &mockREST2EthDispatcher{}
+	abiLoader := &mockABILoader{
+		deployMsg: &newTestPrecompiledDeployMsg(t).DeployContract,
+	}
+	_, _, router := newTestREST2EthCustomAbiLoader(dispatcher, abiLoader)
+	before := routeLatencyCount("POST", "/contracts/:address/:method", "400")
+	for _, addr := range []string{"0x567a417717cb6c59ddc1035705f02c0fd1ab1872", "0x66c5fe653e7a9ebb628a6d40f0452d1e358baee8"} {
+		req := httptest.NewRequest("POST", "/contracts/"+addr+"/set", bytes.NewReader([]byte(`{"i":"lots"}`)))
+		req.Header.Add("x-firefly-from", "0x66c5fe653e7a9ebb628a6d40f0452d1e358baee8")
+		res := httptest.NewRecorder()
+		router.ServeHTTP(res, req)
+		assert.Equal(400, res.Result().StatusCode)
 	}
-	_, _, router, res, req := newTestREST2EthAndMsg(t, dispatcher, from, to, bodyMap)
-	router.ServeHTTP(res, req)
 
-	assert.Equal(500, res.Result().StatusCode)
-	reply := restErrMsg{}
-	err := json.NewDecoder(res.Result().Body).Decode(&reply)
-	assert.NoError(err)
-	assert.Equal("pop", reply.Message)
+	assert.Equal(before+2, routeLatencyCount("POST", "/contracts/:address/:method", "400"))
 }
-func TestSendTransactionBadContract(t *testing.T) {
+
+func TestDeployContractSyncRegisterEnvironment(t *testing.T) {
 	assert := assert.New(t)
-	dir := tempdir()
-	defer cleanup(dir)
 
-	bodyMap := make(map[string]interface{})
-	bodyMap["i"] = 12345
-	bodyMap["s"] = "testing"
-	to := "badness"
-	from := "0x66c5fe653e7a9ebb628a6d40f0452d1e358baee8"
 	dispatcher := &mockREST2EthDispatcher{
-		asyncDispatchError: fmt.Errorf("pop"),
+		deployContractSyncReceipt: &messages.TransactionReceipt{
+			ReplyCommon: messages.ReplyCommon{
+				Headers: messages.ReplyHeaders{
+					CommonHeaders: messages.CommonHeaders{
+						MsgType: messages.MsgTypeTransactionSuccess,
+					},
+				},
+			},
+		},
 	}
-	_, _, router, res, req := newTestREST2EthAndMsg(t, dispatcher, from, to, bodyMap)
+	abiLoader := &mockABILoader{
+		deployMsg: &newTestPrecompiledDeployMsg(t).DeployContract,
+	}
+	_, _, router := newTestREST2EthCustomAbiLoader(dispatcher, abiLoader)
+	body, _ := json.Marshal(map[string]interface{}{"i": 12345, "s": "testing"})
+	req := httptest.NewRequest("POST", "/abis/testabi?fly-sync&fly-register=lobster&fly-environment=staging", bytes.NewReader(body))
+	req.Header.Add("x-firefly-from", "0x66c5fe653e7a9ebb628a6d40f0452d1e358baee8")
+	res := httptest.NewRecorder()
 	router.ServeHTTP(res, req)
 
-	assert.Equal(500, res.Result().StatusCode)
-	reply := restErrMsg{}
-	err := json.NewDecoder(res.Result().Body).Decode(&reply)
-	assert.NoError(err)
-	assert.Equal("pop", reply.Message)
+	assert.Equal(200, res.Result().StatusCode)
+	assert.Equal("lobster", dispatcher.deployContractMsg.RegisterAs)
+	assert.Equal("staging", dispatcher.deployContractMsg.RegisterEnvironment)
 }
 
-func TestSendTransactionUnknownRegisteredName(t *testing.T) {
-	assert := assert.New(t)
-	dir := tempdir()
-	defer cleanup(dir)
-
-	bodyMap := make(map[string]interface{})
-	bodyMap["i"] = 12345
-	bodyMap["s"] = "testing"
-	to := "random"
-	from := "0x66c5fe653e7a9ebb628a6d40f0452d1e358baee8"
-	dispatcher := &mockREST2EthDispatcher{}
-	r, _, router, res, req := newTestREST2EthAndMsg(t, dispatcher, from, to, bodyMap)
-	abiLoader := r.gw.(*mockABILoader)
-	abiLoader.resolveContractErr = fmt.Errorf("unregistered")
-	router.ServeHTTP(res, req)
+type testTenantSecurityModule struct {
+	authtest.TestSecurityModule
+}
 
-	assert.Equal(404, res.Result().StatusCode)
-	reply := restErrMsg{}
-	err := json.NewDecoder(res.Result().Body).Decode(&reply)
-	assert.NoError(err)
-	assert.Equal("unregistered", reply.Message)
+func (sm *testTenantSecurityModule) Tenant(authCtx interface{}) string {
+	return "tenant1"
 }
 
-func TestSendTransactionMissingContract(t *testing.T) {
+func TestDeployContractSyncTenant(t *testing.T) {
 	assert := assert.New(t)
-	dir := tempdir()
-	defer cleanup(dir)
 
-	bodyMap := make(map[string]interface{})
-	bodyMap["i"] = 12345
-	bodyMap["s"] = "testing"
-	to := "0x66c5fe653e7a9ebb628a6d40f0452d1e358baee8"
-	from := ""
+	auth.RegisterSecurityModule(&testTenantSecurityModule{})
+	defer auth.RegisterSecurityModule(nil)
+
 	dispatcher := &mockREST2EthDispatcher{
-		asyncDispatchError: fmt.Errorf("pop"),
+		deployContractSyncReceipt: &messages.TransactionReceipt{
+			ReplyCommon: messages.ReplyCommon{
+				Headers: messages.ReplyHeaders{
+					CommonHeaders: messages.CommonHeaders{
+						MsgType: messages.MsgTypeTransactionSuccess,
+					},
+				},
+			},
+		},
 	}
-	_, _, router, res, req := newTestREST2EthAndMsg(t, dispatcher, from, to, bodyMap)
-	router.ServeHTTP(res, req)
-
-	assert.Equal(400, res.Result().StatusCode)
-	reply := restErrMsg{}
-	err := json.NewDecoder(res.Result().Body).Decode(&reply)
-	assert.NoError(err)
-	assert.Equal("Please specify a valid address in the 'fly-from' query string parameter or x-firefly-from HTTP header", reply.Message)
+	abiLoader := &mockABILoader{
+		deployMsg: &newTestPrecompiledDeployMsg(t).DeployContract,
+	}
+	_, _, router := newTestREST2EthCustomAbiLoader(dispatcher, abiLoader)
+	body, _ := json.Marshal(map[string]interface{}{"i": 12345, "s": "testing"})
+	req := httptest.NewRequest("POST", "/abis/testabi?fly-sync", bytes.NewReader(body))
+	req.Header.Add("x-firefly-from", "0x66c5fe653e7a9ebb628a6d40f0452d1e358baee8")
+	ctx, _ := auth.WithAuthContext(req.Context(), "testat")
+	res := httptest.NewRecorder()
+	router.ServeHTTP(res, req.WithContext(ctx))
+
+	assert.Equal(200, res.Result().StatusCode)
+	assert.Equal("tenant1", dispatcher.deployContractMsg.Headers.Context[tenantContextKey])
 }
 
-func TestSendTransactionBadMethodABI(t *testing.T) {
+func TestDeployContractQuotaExceeded(t *testing.T) {
 	assert := assert.New(t)
-	dir := tempdir()
-	defer cleanup(dir)
-	dispatcher := &mockREST2EthDispatcher{
-		asyncDispatchReply: &messages.AsyncSentMsg{
-			Sent:    true,
-			Request: "request1",
-		},
-	}
+
+	dispatcher := &mockREST2EthDispatcher{}
 	abiLoader := &mockABILoader{
-		deployMsg: &messages.DeployContract{
-			ABI: ethbinding.ABIMarshaling{
-				{
-					Name: "badmethod", Type: "function", Inputs: []ethbinding.ABIArgumentMarshaling{
-						{Name: "badness", Type: "badness"},
-					},
-				},
-			},
-		},
+		deployMsg:          &newTestPrecompiledDeployMsg(t).DeployContract,
+		contractQuotaError: &quotas.ExceededError{Resource: quotas.Contracts, Limit: 1},
 	}
 	_, _, router := newTestREST2EthCustomAbiLoader(dispatcher, abiLoader)
-	req := httptest.NewRequest("GET", "/contracts/0x66c5fe653e7a9ebb628a6d40f0452d1e358baee8/badmethod", bytes.NewReader([]byte{}))
+	body, _ := json.Marshal(map[string]interface{}{"i": 12345, "s": "testing"})
+	req := httptest.NewRequest("POST", "/abis/testabi?fly-sync", bytes.NewReader(body))
 	req.Header.Add("x-firefly-from", "0x66c5fe653e7a9ebb628a6d40f0452d1e358baee8")
 	res := httptest.NewRecorder()
 	router.ServeHTTP(res, req)
-	assert.Equal(400, res.Result().StatusCode)
-	reply := restErrMsg{}
-	err := json.NewDecoder(res.Result().Body).Decode(&reply)
-	assert.NoError(err)
-	assert.Equal("Invalid method 'badmethod' in ABI: unsupported arg type: badness", reply.Message)
+
+	assert.Equal(403, res.Result().StatusCode)
+	var errInfo restErrMsg
+	json.NewDecoder(res.Body).Decode(&errInfo)
+	assert.Equal("Quota exceeded: the maximum number of contracts for tenant '' is 1", errInfo.Message)
+	assert.Nil(dispatcher.deployContractMsg)
 }
 
-func TestSendTransactionBadEventABI(t *testing.T) {
+func TestDeployContractStaticAnalysisBlocked(t *testing.T) {
 	assert := assert.New(t)
-	dir := tempdir()
-	defer cleanup(dir)
-	dispatcher := &mockREST2EthDispatcher{
-		asyncDispatchReply: &messages.AsyncSentMsg{
-			Sent:    true,
-			Request: "request1",
-		},
-	}
+
+	dispatcher := &mockREST2EthDispatcher{}
 	abiLoader := &mockABILoader{
-		deployMsg: &messages.DeployContract{
-			ABI: ethbinding.ABIMarshaling{
-				{
-					Name: "badevent", Type: "event", Inputs: []ethbinding.ABIArgumentMarshaling{
-						{Name: "badness", Type: "badness"},
-					},
-				},
-			},
-		},
+		deployMsg:           &newTestPrecompiledDeployMsg(t).DeployContract,
+		staticAnalysisError: fmt.Errorf("pop"),
 	}
 	_, _, router := newTestREST2EthCustomAbiLoader(dispatcher, abiLoader)
-	req := httptest.NewRequest("POST", "/contracts/0x66c5fe653e7a9ebb628a6d40f0452d1e358baee8/badevent/subscribe", bytes.NewReader([]byte{}))
+	body, _ := json.Marshal(map[string]interface{}{"i": 12345, "s": "testing"})
+	req := httptest.NewRequest("POST", "/abis/testabi?fly-sync", bytes.NewReader(body))
 	req.Header.Add("x-firefly-from", "0x66c5fe653e7a9ebb628a6d40f0452d1e358baee8")
 	res := httptest.NewRecorder()
 	router.ServeHTTP(res, req)
-	assert.Equal(400, res.Result().StatusCode)
-	reply := restErrMsg{}
-	err := json.NewDecoder(res.Result().Body).Decode(&reply)
-	assert.NoError(err)
-	assert.Equal("Invalid event 'badevent' in ABI: unsupported arg type: badness", reply.Message)
+
+	assert.Equal(403, res.Result().StatusCode)
+	var errInfo restErrMsg
+	json.NewDecoder(res.Body).Decode(&errInfo)
+	assert.Equal("pop", errInfo.Message)
+	assert.Nil(dispatcher.deployContractMsg)
 }
 
-func TestSendTransactionBadConstructorABI(t *testing.T) {
+func newTestREST2EthReservedDeploy(t *testing.T, dispatcher *mockREST2EthDispatcher, rr *mockRR, abiLoader *mockABILoader) (*httptest.ResponseRecorder, *http.Request, *httprouter.Router) {
+	rr.deployMsg = newTestPrecompiledDeployMsg(t)
+	rr.deployMsg.Headers.Context = map[string]interface{}{
+		remoteRegistryContextKey: true,
+	}
+	r, _, router := newTestREST2EthCustomAbiLoader(dispatcher, abiLoader)
+	r.rr = rr
+	body, _ := json.Marshal(map[string]interface{}{"i": 12345, "s": "testing"})
+	req := httptest.NewRequest("POST", "/g/mygw?fly-sync&fly-register=lobster", bytes.NewReader(body))
+	req.Header.Add("x-firefly-from", "0x66c5fe653e7a9ebb628a6d40f0452d1e358baee8")
+	return httptest.NewRecorder(), req, router
+}
+
+func TestDeployContractSyncRemoteRegistryReserved(t *testing.T) {
 	assert := assert.New(t)
-	dir := tempdir()
-	defer cleanup(dir)
+
 	dispatcher := &mockREST2EthDispatcher{
-		asyncDispatchReply: &messages.AsyncSentMsg{
-			Sent:    true,
-			Request: "request1",
-		},
-	}
-	abiLoader := &mockABILoader{
-		deployMsg: &messages.DeployContract{
-			ABI: ethbinding.ABIMarshaling{
-				{
-					Name: "badevent", Type: "constructor", Inputs: []ethbinding.ABIArgumentMarshaling{
-						{Name: "badness", Type: "badness"},
+		deployContractSyncReceipt: &messages.TransactionReceipt{
+			ReplyCommon: messages.ReplyCommon{
+				Headers: messages.ReplyHeaders{
+					CommonHeaders: messages.CommonHeaders{
+						MsgType: messages.MsgTypeTransactionSuccess,
 					},
 				},
 			},
 		},
 	}
-	_, _, router := newTestREST2EthCustomAbiLoader(dispatcher, abiLoader)
-	req := httptest.NewRequest("POST", "/abis/testabi", bytes.NewReader([]byte{}))
-	req.Header.Add("x-firefly-from", "0x66c5fe653e7a9ebb628a6d40f0452d1e358baee8")
-	res := httptest.NewRecorder()
+	rr := &mockRR{}
+	res, req, router := newTestREST2EthReservedDeploy(t, dispatcher, rr, &mockABILoader{})
 	router.ServeHTTP(res, req)
-	assert.Equal(400, res.Result().StatusCode)
-	reply := restErrMsg{}
-	err := json.NewDecoder(res.Result().Body).Decode(&reply)
-	assert.NoError(err)
-	assert.Equal("Invalid method 'constructor' in ABI: unsupported arg type: badness", reply.Message)
+
+	assert.Equal(200, res.Result().StatusCode)
+	assert.Equal("lobster", rr.reserveCapture)
+	assert.Empty(rr.releaseCapture)
+	assert.Equal("lobster", dispatcher.deployContractMsg.RegisterAs)
+	assert.Equal(true, dispatcher.deployContractMsg.Headers.Context[remoteRegistryReservedContextKey])
 }
 
-func TestSendTransactionDefaultConstructorABI(t *testing.T) {
+func TestDeployContractSyncRemoteRegistryReservedEnvironment(t *testing.T) {
 	assert := assert.New(t)
-	dir := tempdir()
-	defer cleanup(dir)
+
 	dispatcher := &mockREST2EthDispatcher{
-		asyncDispatchReply: &messages.AsyncSentMsg{
-			Sent:    true,
-			Request: "request1",
+		deployContractSyncReceipt: &messages.TransactionReceipt{
+			ReplyCommon: messages.ReplyCommon{
+				Headers: messages.ReplyHeaders{
+					CommonHeaders: messages.CommonHeaders{
+						MsgType: messages.MsgTypeTransactionSuccess,
+					},
+				},
+			},
 		},
 	}
-	abiLoader := &mockABILoader{
-		deployMsg: &messages.DeployContract{
-			ABI: ethbinding.ABIMarshaling{}, // completely empty ABI is ok
-		},
+	rr := &mockRR{}
+	res, req, router := newTestREST2EthReservedDeploy(t, dispatcher, rr, &mockABILoader{})
+	req.URL.RawQuery += "&fly-environment=dev"
+	router.ServeHTTP(res, req)
+
+	assert.Equal(200, res.Result().StatusCode)
+	assert.Equal("lobster", rr.reserveCapture)
+	assert.Equal("dev", rr.envCapture)
+	assert.Equal("dev", dispatcher.deployContractMsg.RegisterEnvironment)
+}
+
+func TestDeployContractSyncRemoteRegistryReservationClash(t *testing.T) {
+	assert := assert.New(t)
+
+	dispatcher := &mockREST2EthDispatcher{}
+	rr := &mockRR{
+		reserveErr:   fmt.Errorf("pop"),
+		reserveClash: true,
 	}
-	_, _, router := newTestREST2EthCustomAbiLoader(dispatcher, abiLoader)
-	req := httptest.NewRequest("POST", "/abis/testabi", bytes.NewReader([]byte{}))
-	req.Header.Add("x-firefly-from", "0x66c5fe653e7a9ebb628a6d40f0452d1e358baee8")
-	res := httptest.NewRecorder()
+	res, req, router := newTestREST2EthReservedDeploy(t, dispatcher, rr, &mockABILoader{})
 	router.ServeHTTP(res, req)
-	assert.Equal(202, res.Result().StatusCode)
+
+	assert.Equal(409, res.Result().StatusCode)
+	assert.Nil(dispatcher.deployContractMsg)
+	assert.Empty(rr.releaseCapture)
 }
 
-func TestSendTransactionUnnamedParamsABI(t *testing.T) {
+func TestDeployContractSyncRemoteRegistryReservationFail(t *testing.T) {
 	assert := assert.New(t)
-	dir := tempdir()
-	defer cleanup(dir)
+
+	dispatcher := &mockREST2EthDispatcher{}
+	rr := &mockRR{
+		reserveErr: fmt.Errorf("pop"),
+	}
+	res, req, router := newTestREST2EthReservedDeploy(t, dispatcher, rr, &mockABILoader{})
+	router.ServeHTTP(res, req)
+
+	// The registry failing is not a conflict on the name
+	assert.Equal(500, res.Result().StatusCode)
+	assert.Nil(dispatcher.deployContractMsg)
+}
+
+func TestDeployContractSyncRemoteRegistryReservationKeptOnConfirmFailure(t *testing.T) {
+	assert := assert.New(t)
+
+	contractAddr := ethbind.API.HexToAddress("0x0123456789AbcdeF0123456789abCdef01234567")
 	dispatcher := &mockREST2EthDispatcher{
-		asyncDispatchReply: &messages.AsyncSentMsg{
-			Sent:    true,
-			Request: "request1",
+		deployContractSyncReceipt: &messages.TransactionReceipt{
+			ReplyCommon: messages.ReplyCommon{
+				Headers: messages.ReplyHeaders{
+					CommonHeaders: messages.CommonHeaders{
+						MsgType: messages.MsgTypeTransactionSuccess,
+					},
+				},
+			},
+			ContractAddress: &contractAddr,
 		},
 	}
-	abiLoader := &mockABILoader{
-		deployMsg: &messages.DeployContract{
-			ABI: ethbinding.ABIMarshaling{
-				{
-					Name: "unnamedparamsmethod", Type: "function", Inputs: []ethbinding.ABIArgumentMarshaling{
-						{Name: "", Type: "uint256", InternalType: "uint256"},
-						{Name: "", Type: "uint256", InternalType: "uint256"},
+	rr := &mockRR{}
+	res, req, router := newTestREST2EthReservedDeploy(t, dispatcher, rr, &mockABILoader{
+		postDeployError: fmt.Errorf("pop"),
+	})
+	router.ServeHTTP(res, req)
+
+	// The contract is deployed, so the name stays reserved for it
+	assert.Equal(500, res.Result().StatusCode)
+	assert.Empty(rr.releaseCapture)
+}
+
+func TestDeployContractSyncRemoteRegistryReservationRollback(t *testing.T) {
+	assert := assert.New(t)
+
+	dispatcher := &mockREST2EthDispatcher{
+		deployContractSyncReceipt: &messages.TransactionReceipt{
+			ReplyCommon: messages.ReplyCommon{
+				Headers: messages.ReplyHeaders{
+					CommonHeaders: messages.CommonHeaders{
+						MsgType: messages.MsgTypeTransactionFailure,
 					},
 				},
 			},
 		},
 	}
-	_, _, router := newTestREST2EthCustomAbiLoader(dispatcher, abiLoader)
-	req := httptest.NewRequest("POST", "/abis/testabi/0x29fb3f4f7cc82a1456903a506e88cdd63b1d74e8/unnamedparamsmethod", bytes.NewReader([]byte{}))
-	req.Header.Add("x-firefly-from", "0x66c5fe653e7a9ebb628a6d40f0452d1e358baee8")
-	q := req.URL.Query()
-	q.Add("input", "105")
-	q.Add("input1", "106")
-	req.URL.RawQuery = q.Encode()
-	res := httptest.NewRecorder()
+	rr := &mockRR{}
+	res, req, router := newTestREST2EthReservedDeploy(t, dispatcher, rr, &mockABILoader{})
 	router.ServeHTTP(res, req)
-	assert.Equal(202, res.Result().StatusCode)
+
+	assert.Equal(500, res.Result().StatusCode)
+	assert.Equal("lobster", rr.releaseCapture)
 }
 
-func TestSendTransactionBadFrom(t *testing.T) {
+func TestDeployContractSyncRemoteRegistryReservationRollbackOnError(t *testing.T) {
+	assert := assert.New(t)
+
+	dispatcher := &mockREST2EthDispatcher{
+		deployContractSyncError: fmt.Errorf("pop"),
+	}
+	rr := &mockRR{}
+	res, req, router := newTestREST2EthReservedDeploy(t, dispatcher, rr, &mockABILoader{})
+	router.ServeHTTP(res, req)
+
+	assert.Equal(500, res.Result().StatusCode)
+	assert.Equal("lobster", rr.releaseCapture)
+}
+
+func TestDeployContractSyncRemoteRegistryReservationKeptAfterSubmit(t *testing.T) {
+	assert := assert.New(t)
+
+	dispatcher := &mockREST2EthDispatcher{
+		deployContractSyncError:  fmt.Errorf("pop"),
+		deployContractSyncTxHash: "0x7d48ae971faf089878b57e3c28e3035540d34f38af395958d2c73c36c57c83a2",
+	}
+	rr := &mockRR{}
+	res, req, router := newTestREST2EthReservedDeploy(t, dispatcher, rr, &mockABILoader{})
+	router.ServeHTTP(res, req)
+
+	// The transaction was submitted, so might still be mined after the timeout
+	assert.Equal(500, res.Result().StatusCode)
+	assert.Empty(rr.releaseCapture)
+}
+
+func TestSendTransactionSyncFail(t *testing.T) {
 	assert := assert.New(t)
 	dir := tempdir()
 	defer cleanup(dir)
@@ -1009,49 +1312,46 @@ func TestSendTransactionBadFrom(t *testing.T) {
 	bodyMap := make(map[string]interface{})
 	bodyMap["i"] = 12345
 	bodyMap["s"] = "testing"
-	to := "66C5FE653E7A9EBB628A6D40F0452D1E358BAEE8"
-	from := "badness"
+	to := "0x567a417717cb6c59ddc1035705f02c0fd1ab1872"
+	from := "0x66c5fe653e7a9ebb628a6d40f0452d1e358baee8"
 	dispatcher := &mockREST2EthDispatcher{
-		asyncDispatchError: fmt.Errorf("pop"),
+		sendTransactionSyncError: fmt.Errorf("pop"),
 	}
 	_, _, router, res, req := newTestREST2EthAndMsg(t, dispatcher, from, to, bodyMap)
+	req.Header.Set("x-firefly-sync", "true")
 	router.ServeHTTP(res, req)
 
-	assert.Equal(404, res.Result().StatusCode)
+	assert.Equal(500, res.Result().StatusCode)
 	reply := restErrMsg{}
 	err := json.NewDecoder(res.Result().Body).Decode(&reply)
 	assert.NoError(err)
-	assert.Equal("From Address must be a 40 character hex string (0x prefix is optional)", reply.Message)
+	assert.Equal("pop", reply.Message)
 }
 
-func TestSendTransactionInvalidContract(t *testing.T) {
+func TestSendTransactionBadGasPriceStrategy(t *testing.T) {
 	assert := assert.New(t)
 	dir := tempdir()
 	defer cleanup(dir)
 
 	bodyMap := make(map[string]interface{})
-	bodyMap["x"] = 12345
+	bodyMap["i"] = 12345
+	bodyMap["s"] = "testing"
 	to := "0x567a417717cb6c59ddc1035705f02c0fd1ab1872"
 	from := "0x66c5fe653e7a9ebb628a6d40f0452d1e358baee8"
-	dispatcher := &mockREST2EthDispatcher{
-		asyncDispatchReply: &messages.AsyncSentMsg{
-			Sent:    true,
-			Request: "request1",
-		},
-	}
-	r, _, router, res, req := newTestREST2EthAndMsg(t, dispatcher, from, to, bodyMap)
-	abiLoader := r.gw.(*mockABILoader)
-	abiLoader.loadABIError = fmt.Errorf("pop")
+	dispatcher := &mockREST2EthDispatcher{}
+	_, _, router, res, req := newTestREST2EthAndMsg(t, dispatcher, from, to, bodyMap)
+	req.Header.Set("x-firefly-gaspricestrategy", "cheapest")
 	router.ServeHTTP(res, req)
 
-	assert.Equal(404, res.Result().StatusCode)
+	assert.Equal(400, res.Result().StatusCode)
 	reply := restErrMsg{}
 	err := json.NewDecoder(res.Result().Body).Decode(&reply)
 	assert.NoError(err)
-	assert.Equal("pop", reply.Message)
+	assert.Equal("Unknown gas price strategy 'cheapest'", reply.Message)
+	assert.Nil(dispatcher.asyncDispatchMsg)
 }
 
-func TestDeployContractInvalidABI(t *testing.T) {
+func TestSendTransactionAsyncFail(t *testing.T) {
 	assert := assert.New(t)
 	dir := tempdir()
 	defer cleanup(dir)
@@ -1059,28 +1359,22 @@ func TestDeployContractInvalidABI(t *testing.T) {
 	bodyMap := make(map[string]interface{})
 	bodyMap["i"] = 12345
 	bodyMap["s"] = "testing"
+	to := "0x567a417717cb6c59ddc1035705f02c0fd1ab1872"
 	from := "0x66c5fe653e7a9ebb628a6d40f0452d1e358baee8"
 	dispatcher := &mockREST2EthDispatcher{
-		asyncDispatchReply: &messages.AsyncSentMsg{
-			Sent:    true,
-			Request: "request1",
-		},
+		asyncDispatchError: fmt.Errorf("pop"),
 	}
-	r, _, router, res, _ := newTestREST2EthAndMsg(t, dispatcher, from, "", bodyMap)
-	body, _ := json.Marshal(&bodyMap)
-	req := httptest.NewRequest("POST", "/abis/abi1?fly-sync", bytes.NewReader(body))
-	req.Header.Add("x-firefly-from", from)
-	abiLoader := r.gw.(*mockABILoader)
-	abiLoader.loadABIError = fmt.Errorf("pop")
+	_, _, router, res, req := newTestREST2EthAndMsg(t, dispatcher, from, to, bodyMap)
 	router.ServeHTTP(res, req)
 
-	assert.Equal(404, res.Result().StatusCode)
+	assert.Equal(500, res.Result().StatusCode)
 	reply := restErrMsg{}
 	err := json.NewDecoder(res.Result().Body).Decode(&reply)
 	assert.NoError(err)
 	assert.Equal("pop", reply.Message)
 }
-func TestSendTransactionInvalidMethod(t *testing.T) {
+
+func TestDeployContractAsyncFail(t *testing.T) {
 	assert := assert.New(t)
 	dir := tempdir()
 	defer cleanup(dir)
@@ -1088,85 +1382,103 @@ func TestSendTransactionInvalidMethod(t *testing.T) {
 	bodyMap := make(map[string]interface{})
 	bodyMap["i"] = 12345
 	bodyMap["s"] = "testing"
-	to := "0x567a417717cb6c59ddc1035705f02c0fd1ab1872"
 	from := "0x66c5fe653e7a9ebb628a6d40f0452d1e358baee8"
 	dispatcher := &mockREST2EthDispatcher{
-		asyncDispatchReply: &messages.AsyncSentMsg{
-			Sent:    true,
-			Request: "request1",
-		},
+		asyncDispatchError: fmt.Errorf("pop"),
 	}
-	_, _, router, res, _ := newTestREST2EthAndMsg(t, dispatcher, from, to, bodyMap)
-	req := httptest.NewRequest("POST", "/contracts/"+to+"/shazaam", bytes.NewReader([]byte("{}")))
-	req.Header.Set("x-firefly-from", from)
+	_, _, router, res, _ := newTestREST2EthAndMsg(t, dispatcher, from, "", bodyMap)
+	body, _ := json.Marshal(&bodyMap)
+	req := httptest.NewRequest("POST", "/abis/abi1", bytes.NewReader(body))
+	req.Header.Add("x-firefly-from", from)
 	router.ServeHTTP(res, req)
 
-	assert.Equal(404, res.Result().StatusCode)
+	assert.Equal(500, res.Result().StatusCode)
 	reply := restErrMsg{}
 	err := json.NewDecoder(res.Result().Body).Decode(&reply)
 	assert.NoError(err)
-	assert.Equal("Method or Event 'shazaam' is not declared in the ABI of contract '567a417717cb6c59ddc1035705f02c0fd1ab1872'", reply.Message)
+	assert.Equal("pop", reply.Message)
 }
 
-func TestSendTransactionParamInQuery(t *testing.T) {
+func TestSendTransactionAsyncBadMethod(t *testing.T) {
 	assert := assert.New(t)
 	dir := tempdir()
 	defer cleanup(dir)
 
 	bodyMap := make(map[string]interface{})
+	bodyMap["i"] = 12345
+	bodyMap["s"] = "testing"
 	to := "0x567a417717cb6c59ddc1035705f02c0fd1ab1872"
 	from := "0x66c5fe653e7a9ebb628a6d40f0452d1e358baee8"
 	dispatcher := &mockREST2EthDispatcher{
-		asyncDispatchReply: &messages.AsyncSentMsg{
-			Sent:    true,
-			Request: "request1",
-		},
+		asyncDispatchError: fmt.Errorf("pop"),
 	}
-	_, _, router, res, _ := newTestREST2EthAndMsg(t, dispatcher, from, to, bodyMap)
-	req := httptest.NewRequest("POST", "/contracts/"+to+"/set?i=999&s=msg&fly-ethvalue=12345", bytes.NewReader([]byte("{}")))
-	req.Header.Set("x-firefly-from", from)
+	_, _, router, res, req := newTestREST2EthAndMsg(t, dispatcher, from, to, bodyMap)
 	router.ServeHTTP(res, req)
 
-	assert.Equal(202, res.Result().StatusCode)
+	assert.Equal(500, res.Result().StatusCode)
+	reply := restErrMsg{}
+	err := json.NewDecoder(res.Result().Body).Decode(&reply)
+	assert.NoError(err)
+	assert.Equal("pop", reply.Message)
 }
-
-func TestSendTransactionRegisteredName(t *testing.T) {
+func TestSendTransactionBadContract(t *testing.T) {
 	assert := assert.New(t)
 	dir := tempdir()
 	defer cleanup(dir)
 
 	bodyMap := make(map[string]interface{})
-	to := "transponster"
+	bodyMap["i"] = 12345
+	bodyMap["s"] = "testing"
+	to := "badness"
 	from := "0x66c5fe653e7a9ebb628a6d40f0452d1e358baee8"
 	dispatcher := &mockREST2EthDispatcher{
-		asyncDispatchReply: &messages.AsyncSentMsg{
-			Sent:    true,
-			Request: "request1",
-		},
+		asyncDispatchError: fmt.Errorf("pop"),
 	}
-	r, _, router, res, _ := newTestREST2EthAndMsg(t, dispatcher, from, to, bodyMap)
-	abiLoader := r.gw.(*mockABILoader)
-	abiLoader.registeredContractAddr = "c6c572a18d31ff36d661d680c0060307e038dc47"
-	req := httptest.NewRequest("POST", "/contracts/"+to+"/set?i=999&s=msg&fly-ethvalue=12345", bytes.NewReader([]byte("{}")))
-	req.Header.Set("x-firefly-from", from)
+	_, _, router, res, req := newTestREST2EthAndMsg(t, dispatcher, from, to, bodyMap)
 	router.ServeHTTP(res, req)
 
-	assert.Equal("c6c572a18d31ff36d661d680c0060307e038dc47", abiLoader.capturedAddr)
-	assert.Equal(202, res.Result().StatusCode)
+	assert.Equal(500, res.Result().StatusCode)
+	reply := restErrMsg{}
+	err := json.NewDecoder(res.Result().Body).Decode(&reply)
+	assert.NoError(err)
+	assert.Equal("pop", reply.Message)
 }
-func TestSendTransactionMissingParam(t *testing.T) {
+
+func TestSendTransactionUnknownRegisteredName(t *testing.T) {
 	assert := assert.New(t)
 	dir := tempdir()
 	defer cleanup(dir)
 
 	bodyMap := make(map[string]interface{})
-	to := "0x567a417717cb6c59ddc1035705f02c0fd1ab1872"
+	bodyMap["i"] = 12345
+	bodyMap["s"] = "testing"
+	to := "random"
 	from := "0x66c5fe653e7a9ebb628a6d40f0452d1e358baee8"
+	dispatcher := &mockREST2EthDispatcher{}
+	r, _, router, res, req := newTestREST2EthAndMsg(t, dispatcher, from, to, bodyMap)
+	abiLoader := r.gw.(*mockABILoader)
+	abiLoader.resolveContractErr = fmt.Errorf("unregistered")
+	router.ServeHTTP(res, req)
+
+	assert.Equal(404, res.Result().StatusCode)
+	reply := restErrMsg{}
+	err := json.NewDecoder(res.Result().Body).Decode(&reply)
+	assert.NoError(err)
+	assert.Equal("unregistered", reply.Message)
+}
+
+func TestSendTransactionMissingContract(t *testing.T) {
+	assert := assert.New(t)
+	dir := tempdir()
+	defer cleanup(dir)
+
+	bodyMap := make(map[string]interface{})
+	bodyMap["i"] = 12345
+	bodyMap["s"] = "testing"
+	to := "0x66c5fe653e7a9ebb628a6d40f0452d1e358baee8"
+	from := ""
 	dispatcher := &mockREST2EthDispatcher{
-		asyncDispatchReply: &messages.AsyncSentMsg{
-			Sent:    true,
-			Request: "request1",
-		},
+		asyncDispatchError: fmt.Errorf("pop"),
 	}
 	_, _, router, res, req := newTestREST2EthAndMsg(t, dispatcher, from, to, bodyMap)
 	router.ServeHTTP(res, req)
@@ -1175,277 +1487,1101 @@ func TestSendTransactionMissingParam(t *testing.T) {
 	reply := restErrMsg{}
 	err := json.NewDecoder(res.Result().Body).Decode(&reply)
 	assert.NoError(err)
-	assert.Equal("Parameter 'i' of method 'set' was not specified in body or query parameters", reply.Message)
+	assert.Equal("Please specify a valid address in the 'fly-from' query string parameter or x-firefly-from HTTP header", reply.Message)
 }
 
-func TestSendTransactionBadBody(t *testing.T) {
+func TestSendTransactionBadMethodABI(t *testing.T) {
 	assert := assert.New(t)
 	dir := tempdir()
 	defer cleanup(dir)
-
-	bodyMap := make(map[string]interface{})
-	to := "0x567a417717cb6c59ddc1035705f02c0fd1ab1872"
-	from := "0x66c5fe653e7a9ebb628a6d40f0452d1e358baee8"
 	dispatcher := &mockREST2EthDispatcher{
 		asyncDispatchReply: &messages.AsyncSentMsg{
 			Sent:    true,
 			Request: "request1",
 		},
 	}
-	_, _, router, res, _ := newTestREST2EthAndMsg(t, dispatcher, from, to, bodyMap)
-	req := httptest.NewRequest("POST", "/contracts/"+to+"/set?x=999", bytes.NewReader([]byte(":not json or yaml")))
-	req.Header.Set("x-firefly-from", from)
+	abiLoader := &mockABILoader{
+		deployMsg: &messages.DeployContract{
+			ABI: ethbinding.ABIMarshaling{
+				{
+					Name: "badmethod", Type: "function", Inputs: []ethbinding.ABIArgumentMarshaling{
+						{Name: "badness", Type: "badness"},
+					},
+				},
+			},
+		},
+	}
+	_, _, router := newTestREST2EthCustomAbiLoader(dispatcher, abiLoader)
+	req := httptest.NewRequest("GET", "/contracts/0x66c5fe653e7a9ebb628a6d40f0452d1e358baee8/badmethod", bytes.NewReader([]byte{}))
+	req.Header.Add("x-firefly-from", "0x66c5fe653e7a9ebb628a6d40f0452d1e358baee8")
+	res := httptest.NewRecorder()
 	router.ServeHTTP(res, req)
-
 	assert.Equal(400, res.Result().StatusCode)
 	reply := restErrMsg{}
 	err := json.NewDecoder(res.Result().Body).Decode(&reply)
 	assert.NoError(err)
-	assert.Regexp("Unable to parse as YAML or JSON", reply.Message)
+	assert.Equal("Invalid method 'badmethod' in ABI: unsupported arg type: badness", reply.Message)
 }
 
-func TestCallMethodSuccess(t *testing.T) {
-	log.SetLevel(log.DebugLevel)
+func TestSendTransactionBadEventABI(t *testing.T) {
 	assert := assert.New(t)
 	dir := tempdir()
 	defer cleanup(dir)
-
-	to := "0x567a417717cb6c59ddc1035705f02c0fd1ab1872"
-	dispatcher := &mockREST2EthDispatcher{}
-	_, mockRPC, router, res, _ := newTestREST2EthAndMsg(t, dispatcher, "", to, map[string]interface{}{})
-	req := httptest.NewRequest("GET", "/contracts/"+to+"/get", bytes.NewReader([]byte{}))
-	mockRPC.result = "0x000000000000000000000000000000000000000000000000000000000001e2400000000000000000000000000000000000000000000000000000000000000040000000000000000000000000000000000000000000000000000000000000000774657374696e6700000000000000000000000000000000000000000000000000"
+	dispatcher := &mockREST2EthDispatcher{
+		asyncDispatchReply: &messages.AsyncSentMsg{
+			Sent:    true,
+			Request: "request1",
+		},
+	}
+	abiLoader := &mockABILoader{
+		deployMsg: &messages.DeployContract{
+			ABI: ethbinding.ABIMarshaling{
+				{
+					Name: "badevent", Type: "event", Inputs: []ethbinding.ABIArgumentMarshaling{
+						{Name: "badness", Type: "badness"},
+					},
+				},
+			},
+		},
+	}
+	_, _, router := newTestREST2EthCustomAbiLoader(dispatcher, abiLoader)
+	req := httptest.NewRequest("POST", "/contracts/0x66c5fe653e7a9ebb628a6d40f0452d1e358baee8/badevent/subscribe", bytes.NewReader([]byte{}))
+	req.Header.Add("x-firefly-from", "0x66c5fe653e7a9ebb628a6d40f0452d1e358baee8")
+	res := httptest.NewRecorder()
 	router.ServeHTTP(res, req)
-
-	assert.Equal(200, res.Result().StatusCode)
-	assert.Equal("eth_call", mockRPC.capturedMethod)
-	assert.Equal("latest", mockRPC.capturedArgs[1])
-	var reply map[string]interface{}
+	assert.Equal(400, res.Result().StatusCode)
+	reply := restErrMsg{}
 	err := json.NewDecoder(res.Result().Body).Decode(&reply)
 	assert.NoError(err)
-	log.Infof("Reply: %+v", reply)
-	assert.Nil(reply["error"])
-	assert.Equal("123456", reply["i"])
-	assert.Equal("testing", reply["s"])
+	assert.Equal("Invalid event 'badevent' in ABI: unsupported arg type: badness", reply.Message)
 }
 
-func TestCallMethodHDWalletSuccess(t *testing.T) {
-	log.SetLevel(log.DebugLevel)
+func TestSendTransactionBadConstructorABI(t *testing.T) {
 	assert := assert.New(t)
 	dir := tempdir()
 	defer cleanup(dir)
-
-	to := "0x567a417717cb6c59ddc1035705f02c0fd1ab1872"
-	dispatcher := &mockREST2EthDispatcher{}
-	from := "HD-u01234abcd-u01234abcd-12345"
-	r, mockRPC, router, res, _ := newTestREST2EthAndMsg(t, dispatcher, "", to, map[string]interface{}{})
-	r.processor.(*mockProcessor).resolvedFrom = "0x66c5fe653e7a9ebb628a6d40f0452d1e358baee8"
-	req := httptest.NewRequest("GET", "/contracts/"+to+"/get?fly-from="+from, bytes.NewReader([]byte{}))
-	mockRPC.result = "0x000000000000000000000000000000000000000000000000000000000001e2400000000000000000000000000000000000000000000000000000000000000040000000000000000000000000000000000000000000000000000000000000000774657374696e6700000000000000000000000000000000000000000000000000"
+	dispatcher := &mockREST2EthDispatcher{
+		asyncDispatchReply: &messages.AsyncSentMsg{
+			Sent:    true,
+			Request: "request1",
+		},
+	}
+	abiLoader := &mockABILoader{
+		deployMsg: &messages.DeployContract{
+			ABI: ethbinding.ABIMarshaling{
+				{
+					Name: "badevent", Type: "constructor", Inputs: []ethbinding.ABIArgumentMarshaling{
+						{Name: "badness", Type: "badness"},
+					},
+				},
+			},
+		},
+	}
+	_, _, router := newTestREST2EthCustomAbiLoader(dispatcher, abiLoader)
+	req := httptest.NewRequest("POST", "/abis/testabi", bytes.NewReader([]byte{}))
+	req.Header.Add("x-firefly-from", "0x66c5fe653e7a9ebb628a6d40f0452d1e358baee8")
+	res := httptest.NewRecorder()
 	router.ServeHTTP(res, req)
-
-	assert.Equal(200, res.Result().StatusCode)
-	assert.Equal("eth_call", mockRPC.capturedMethod)
-	assert.Equal("latest", mockRPC.capturedArgs[1])
-	var reply map[string]interface{}
+	assert.Equal(400, res.Result().StatusCode)
+	reply := restErrMsg{}
 	err := json.NewDecoder(res.Result().Body).Decode(&reply)
 	assert.NoError(err)
-	log.Infof("Reply: %+v", reply)
-	assert.Nil(reply["error"])
-	assert.Equal("123456", reply["i"])
-	assert.Equal("testing", reply["s"])
+	assert.Equal("Invalid method 'constructor' in ABI: unsupported arg type: badness", reply.Message)
 }
 
-func TestCallMethodHDWalletFail(t *testing.T) {
-	log.SetLevel(log.DebugLevel)
+func TestSendTransactionDefaultConstructorABI(t *testing.T) {
 	assert := assert.New(t)
 	dir := tempdir()
 	defer cleanup(dir)
-
-	to := "0x567a417717cb6c59ddc1035705f02c0fd1ab1872"
-	dispatcher := &mockREST2EthDispatcher{}
-	from := "HD-u01234abcd-u01234abcd-12345"
-	r, mockRPC, router, res, _ := newTestREST2EthAndMsg(t, dispatcher, "", to, map[string]interface{}{})
-	r.processor.(*mockProcessor).resolvedFrom = "0x66c5fe653e7a9ebb628a6d40f0452d1e358baee8"
-	r.processor.(*mockProcessor).err = fmt.Errorf("pop")
-	req := httptest.NewRequest("GET", "/contracts/"+to+"/get?fly-from="+from, bytes.NewReader([]byte{}))
-	mockRPC.result = "0x000000000000000000000000000000000000000000000000000000000001e2400000000000000000000000000000000000000000000000000000000000000040000000000000000000000000000000000000000000000000000000000000000774657374696e6700000000000000000000000000000000000000000000000000"
+	dispatcher := &mockREST2EthDispatcher{
+		asyncDispatchReply: &messages.AsyncSentMsg{
+			Sent:    true,
+			Request: "request1",
+		},
+	}
+	abiLoader := &mockABILoader{
+		deployMsg: &messages.DeployContract{
+			ABI: ethbinding.ABIMarshaling{}, // completely empty ABI is ok
+		},
+	}
+	_, _, router := newTestREST2EthCustomAbiLoader(dispatcher, abiLoader)
+	req := httptest.NewRequest("POST", "/abis/testabi", bytes.NewReader([]byte{}))
+	req.Header.Add("x-firefly-from", "0x66c5fe653e7a9ebb628a6d40f0452d1e358baee8")
+	res := httptest.NewRecorder()
 	router.ServeHTTP(res, req)
-
-	assert.Equal(500, res.Result().StatusCode)
-	var reply map[string]interface{}
-	json.NewDecoder(res.Result().Body).Decode(&reply)
-	assert.Equal("pop", reply["error"])
+	assert.Equal(202, res.Result().StatusCode)
 }
 
-func TestCallReadOnlyMethodViaPOSTSuccess(t *testing.T) {
-	log.SetLevel(log.DebugLevel)
+func TestSendTransactionUnnamedParamsABI(t *testing.T) {
 	assert := assert.New(t)
 	dir := tempdir()
 	defer cleanup(dir)
-
-	to := "0x567a417717cb6c59ddc1035705f02c0fd1ab1872"
-	dispatcher := &mockREST2EthDispatcher{}
-	_, mockRPC, router, res, _ := newTestREST2EthAndMsg(t, dispatcher, "", to, map[string]interface{}{})
-	req := httptest.NewRequest("POST", "/contracts/"+to+"/get?fly-blocknumber=12345", bytes.NewReader([]byte{}))
-	mockRPC.result = "0x000000000000000000000000000000000000000000000000000000000001e2400000000000000000000000000000000000000000000000000000000000000040000000000000000000000000000000000000000000000000000000000000000774657374696e6700000000000000000000000000000000000000000000000000"
+	dispatcher := &mockREST2EthDispatcher{
+		asyncDispatchReply: &messages.AsyncSentMsg{
+			Sent:    true,
+			Request: "request1",
+		},
+	}
+	abiLoader := &mockABILoader{
+		deployMsg: &messages.DeployContract{
+			ABI: ethbinding.ABIMarshaling{
+				{
+					Name: "unnamedparamsmethod", Type: "function", Inputs: []ethbinding.ABIArgumentMarshaling{
+						{Name: "", Type: "uint256", InternalType: "uint256"},
+						{Name: "", Type: "uint256", InternalType: "uint256"},
+					},
+				},
+			},
+		},
+	}
+	_, _, router := newTestREST2EthCustomAbiLoader(dispatcher, abiLoader)
+	req := httptest.NewRequest("POST", "/abis/testabi/0x29fb3f4f7cc82a1456903a506e88cdd63b1d74e8/unnamedparamsmethod", bytes.NewReader([]byte{}))
+	req.Header.Add("x-firefly-from", "0x66c5fe653e7a9ebb628a6d40f0452d1e358baee8")
+	q := req.URL.Query()
+	q.Add("input", "105")
+	q.Add("input1", "106")
+	req.URL.RawQuery = q.Encode()
+	res := httptest.NewRecorder()
+	router.ServeHTTP(res, req)
+	assert.Equal(202, res.Result().StatusCode)
+}
+
+func TestSendTransactionBadFrom(t *testing.T) {
+	assert := assert.New(t)
+	dir := tempdir()
+	defer cleanup(dir)
+
+	bodyMap := make(map[string]interface{})
+	bodyMap["i"] = 12345
+	bodyMap["s"] = "testing"
+	to := "66C5FE653E7A9EBB628A6D40F0452D1E358BAEE8"
+	from := "bad ness"
+	dispatcher := &mockREST2EthDispatcher{
+		asyncDispatchError: fmt.Errorf("pop"),
+	}
+	_, _, router, res, req := newTestREST2EthAndMsg(t, dispatcher, from, to, bodyMap)
+	router.ServeHTTP(res, req)
+
+	assert.Equal(404, res.Result().StatusCode)
+	reply := restErrMsg{}
+	err := json.NewDecoder(res.Result().Body).Decode(&reply)
+	assert.NoError(err)
+	assert.Equal("From Address must be a 40 character hex string (0x prefix is optional)", reply.Message)
+}
+
+func TestSendTransactionInvalidContract(t *testing.T) {
+	assert := assert.New(t)
+	dir := tempdir()
+	defer cleanup(dir)
+
+	bodyMap := make(map[string]interface{})
+	bodyMap["x"] = 12345
+	to := "0x567a417717cb6c59ddc1035705f02c0fd1ab1872"
+	from := "0x66c5fe653e7a9ebb628a6d40f0452d1e358baee8"
+	dispatcher := &mockREST2EthDispatcher{
+		asyncDispatchReply: &messages.AsyncSentMsg{
+			Sent:    true,
+			Request: "request1",
+		},
+	}
+	r, _, router, res, req := newTestREST2EthAndMsg(t, dispatcher, from, to, bodyMap)
+	abiLoader := r.gw.(*mockABILoader)
+	abiLoader.loadABIError = fmt.Errorf("pop")
+	router.ServeHTTP(res, req)
+
+	assert.Equal(404, res.Result().StatusCode)
+	reply := restErrMsg{}
+	err := json.NewDecoder(res.Result().Body).Decode(&reply)
+	assert.NoError(err)
+	assert.Equal("pop", reply.Message)
+}
+
+func TestDeployContractInvalidABI(t *testing.T) {
+	assert := assert.New(t)
+	dir := tempdir()
+	defer cleanup(dir)
+
+	bodyMap := make(map[string]interface{})
+	bodyMap["i"] = 12345
+	bodyMap["s"] = "testing"
+	from := "0x66c5fe653e7a9ebb628a6d40f0452d1e358baee8"
+	dispatcher := &mockREST2EthDispatcher{
+		asyncDispatchReply: &messages.AsyncSentMsg{
+			Sent:    true,
+			Request: "request1",
+		},
+	}
+	r, _, router, res, _ := newTestREST2EthAndMsg(t, dispatcher, from, "", bodyMap)
+	body, _ := json.Marshal(&bodyMap)
+	req := httptest.NewRequest("POST", "/abis/abi1?fly-sync", bytes.NewReader(body))
+	req.Header.Add("x-firefly-from", from)
+	abiLoader := r.gw.(*mockABILoader)
+	abiLoader.loadABIError = fmt.Errorf("pop")
+	router.ServeHTTP(res, req)
+
+	assert.Equal(404, res.Result().StatusCode)
+	reply := restErrMsg{}
+	err := json.NewDecoder(res.Result().Body).Decode(&reply)
+	assert.NoError(err)
+	assert.Equal("pop", reply.Message)
+}
+func TestSendTransactionInvalidMethod(t *testing.T) {
+	assert := assert.New(t)
+	dir := tempdir()
+	defer cleanup(dir)
+
+	bodyMap := make(map[string]interface{})
+	bodyMap["i"] = 12345
+	bodyMap["s"] = "testing"
+	to := "0x567a417717cb6c59ddc1035705f02c0fd1ab1872"
+	from := "0x66c5fe653e7a9ebb628a6d40f0452d1e358baee8"
+	dispatcher := &mockREST2EthDispatcher{
+		asyncDispatchReply: &messages.AsyncSentMsg{
+			Sent:    true,
+			Request: "request1",
+		},
+	}
+	_, _, router, res, _ := newTestREST2EthAndMsg(t, dispatcher, from, to, bodyMap)
+	req := httptest.NewRequest("POST", "/contracts/"+to+"/shazaam", bytes.NewReader([]byte("{}")))
+	req.Header.Set("x-firefly-from", from)
+	router.ServeHTTP(res, req)
+
+	assert.Equal(404, res.Result().StatusCode)
+	reply := restErrMsg{}
+	err := json.NewDecoder(res.Result().Body).Decode(&reply)
+	assert.NoError(err)
+	assert.Equal("Method or Event 'shazaam' is not declared in the ABI of contract '567a417717cb6c59ddc1035705f02c0fd1ab1872'", reply.Message)
+}
+
+func TestSendTransactionParamInQuery(t *testing.T) {
+	assert := assert.New(t)
+	dir := tempdir()
+	defer cleanup(dir)
+
+	bodyMap := make(map[string]interface{})
+	to := "0x567a417717cb6c59ddc1035705f02c0fd1ab1872"
+	from := "0x66c5fe653e7a9ebb628a6d40f0452d1e358baee8"
+	dispatcher := &mockREST2EthDispatcher{
+		asyncDispatchReply: &messages.AsyncSentMsg{
+			Sent:    true,
+			Request: "request1",
+		},
+	}
+	_, _, router, res, _ := newTestREST2EthAndMsg(t, dispatcher, from, to, bodyMap)
+	req := httptest.NewRequest("POST", "/contracts/"+to+"/set?i=999&s=msg&fly-ethvalue=12345", bytes.NewReader([]byte("{}")))
+	req.Header.Set("x-firefly-from", from)
+	router.ServeHTTP(res, req)
+
+	assert.Equal(202, res.Result().StatusCode)
+}
+
+func TestSendTransactionRegisteredName(t *testing.T) {
+	assert := assert.New(t)
+	dir := tempdir()
+	defer cleanup(dir)
+
+	bodyMap := make(map[string]interface{})
+	to := "transponster"
+	from := "0x66c5fe653e7a9ebb628a6d40f0452d1e358baee8"
+	dispatcher := &mockREST2EthDispatcher{
+		asyncDispatchReply: &messages.AsyncSentMsg{
+			Sent:    true,
+			Request: "request1",
+		},
+	}
+	r, _, router, res, _ := newTestREST2EthAndMsg(t, dispatcher, from, to, bodyMap)
+	abiLoader := r.gw.(*mockABILoader)
+	abiLoader.registeredContractAddr = "c6c572a18d31ff36d661d680c0060307e038dc47"
+	req := httptest.NewRequest("POST", "/contracts/"+to+"/set?i=999&s=msg&fly-ethvalue=12345", bytes.NewReader([]byte("{}")))
+	req.Header.Set("x-firefly-from", from)
+	router.ServeHTTP(res, req)
+
+	assert.Equal("c6c572a18d31ff36d661d680c0060307e038dc47", abiLoader.capturedAddr)
+	assert.Equal(202, res.Result().StatusCode)
+}
+func TestSendTransactionMissingParam(t *testing.T) {
+	assert := assert.New(t)
+	dir := tempdir()
+	defer cleanup(dir)
+
+	bodyMap := make(map[string]interface{})
+	to := "0x567a417717cb6c59ddc1035705f02c0fd1ab1872"
+	from := "0x66c5fe653e7a9ebb628a6d40f0452d1e358baee8"
+	dispatcher := &mockREST2EthDispatcher{
+		asyncDispatchReply: &messages.AsyncSentMsg{
+			Sent:    true,
+			Request: "request1",
+		},
+	}
+	_, _, router, res, req := newTestREST2EthAndMsg(t, dispatcher, from, to, bodyMap)
+	router.ServeHTTP(res, req)
+
+	assert.Equal(400, res.Result().StatusCode)
+	reply := restErrMsg{}
+	err := json.NewDecoder(res.Result().Body).Decode(&reply)
+	assert.NoError(err)
+	assert.Equal("Parameter 'i' of method 'set' was not specified in body or query parameters", reply.Message)
+}
+
+func TestSendTransactionBadBody(t *testing.T) {
+	assert := assert.New(t)
+	dir := tempdir()
+	defer cleanup(dir)
+
+	bodyMap := make(map[string]interface{})
+	to := "0x567a417717cb6c59ddc1035705f02c0fd1ab1872"
+	from := "0x66c5fe653e7a9ebb628a6d40f0452d1e358baee8"
+	dispatcher := &mockREST2EthDispatcher{
+		asyncDispatchReply: &messages.AsyncSentMsg{
+			Sent:    true,
+			Request: "request1",
+		},
+	}
+	_, _, router, res, _ := newTestREST2EthAndMsg(t, dispatcher, from, to, bodyMap)
+	req := httptest.NewRequest("POST", "/contracts/"+to+"/set?x=999", bytes.NewReader([]byte(":not json or yaml")))
+	req.Header.Set("x-firefly-from", from)
+	router.ServeHTTP(res, req)
+
+	assert.Equal(400, res.Result().StatusCode)
+	reply := restErrMsg{}
+	err := json.NewDecoder(res.Result().Body).Decode(&reply)
+	assert.NoError(err)
+	assert.Regexp("Unable to parse as YAML or JSON", reply.Message)
+}
+
+func TestCallMethodSuccess(t *testing.T) {
+	log.SetLevel(log.DebugLevel)
+	assert := assert.New(t)
+	dir := tempdir()
+	defer cleanup(dir)
+
+	to := "0x567a417717cb6c59ddc1035705f02c0fd1ab1872"
+	dispatcher := &mockREST2EthDispatcher{}
+	_, mockRPC, router, res, _ := newTestREST2EthAndMsg(t, dispatcher, "", to, map[string]interface{}{})
+	req := httptest.NewRequest("GET", "/contracts/"+to+"/get", bytes.NewReader([]byte{}))
+	mockRPC.result = "0x000000000000000000000000000000000000000000000000000000000001e2400000000000000000000000000000000000000000000000000000000000000040000000000000000000000000000000000000000000000000000000000000000774657374696e6700000000000000000000000000000000000000000000000000"
+	router.ServeHTTP(res, req)
+
+	assert.Equal(200, res.Result().StatusCode)
+	assert.Equal("eth_call", mockRPC.capturedMethod)
+	assert.Equal("latest", mockRPC.capturedArgs[1])
+	var reply map[string]interface{}
+	err := json.NewDecoder(res.Result().Body).Decode(&reply)
+	assert.NoError(err)
+	log.Infof("Reply: %+v", reply)
+	assert.Nil(reply["error"])
+	assert.Equal("123456", reply["i"])
+	assert.Equal("testing", reply["s"])
+}
+
+func TestCallMethodHDWalletSuccess(t *testing.T) {
+	log.SetLevel(log.DebugLevel)
+	assert := assert.New(t)
+	dir := tempdir()
+	defer cleanup(dir)
+
+	to := "0x567a417717cb6c59ddc1035705f02c0fd1ab1872"
+	dispatcher := &mockREST2EthDispatcher{}
+	from := "HD-u01234abcd-u01234abcd-12345"
+	r, mockRPC, router, res, _ := newTestREST2EthAndMsg(t, dispatcher, "", to, map[string]interface{}{})
+	r.processor.(*mockProcessor).resolvedFrom = "0x66c5fe653e7a9ebb628a6d40f0452d1e358baee8"
+	req := httptest.NewRequest("GET", "/contracts/"+to+"/get?fly-from="+from, bytes.NewReader([]byte{}))
+	mockRPC.result = "0x000000000000000000000000000000000000000000000000000000000001e2400000000000000000000000000000000000000000000000000000000000000040000000000000000000000000000000000000000000000000000000000000000774657374696e6700000000000000000000000000000000000000000000000000"
+	router.ServeHTTP(res, req)
+
+	assert.Equal(200, res.Result().StatusCode)
+	assert.Equal("eth_call", mockRPC.capturedMethod)
+	assert.Equal("latest", mockRPC.capturedArgs[1])
+	var reply map[string]interface{}
+	err := json.NewDecoder(res.Result().Body).Decode(&reply)
+	assert.NoError(err)
+	log.Infof("Reply: %+v", reply)
+	assert.Nil(reply["error"])
+	assert.Equal("123456", reply["i"])
+	assert.Equal("testing", reply["s"])
+}
+
+func TestCallMethodHDWalletFail(t *testing.T) {
+	log.SetLevel(log.DebugLevel)
+	assert := assert.New(t)
+	dir := tempdir()
+	defer cleanup(dir)
+
+	to := "0x567a417717cb6c59ddc1035705f02c0fd1ab1872"
+	dispatcher := &mockREST2EthDispatcher{}
+	from := "HD-u01234abcd-u01234abcd-12345"
+	r, mockRPC, router, res, _ := newTestREST2EthAndMsg(t, dispatcher, "", to, map[string]interface{}{})
+	r.processor.(*mockProcessor).resolvedFrom = "0x66c5fe653e7a9ebb628a6d40f0452d1e358baee8"
+	r.processor.(*mockProcessor).err = fmt.Errorf("pop")
+	req := httptest.NewRequest("GET", "/contracts/"+to+"/get?fly-from="+from, bytes.NewReader([]byte{}))
+	mockRPC.result = "0x000000000000000000000000000000000000000000000000000000000001e2400000000000000000000000000000000000000000000000000000000000000040000000000000000000000000000000000000000000000000000000000000000774657374696e6700000000000000000000000000000000000000000000000000"
+	router.ServeHTTP(res, req)
+
+	assert.Equal(500, res.Result().StatusCode)
+	var reply map[string]interface{}
+	json.NewDecoder(res.Result().Body).Decode(&reply)
+	assert.Equal("pop", reply["error"])
+}
+
+func TestCallReadOnlyMethodViaPOSTSuccess(t *testing.T) {
+	log.SetLevel(log.DebugLevel)
+	assert := assert.New(t)
+	dir := tempdir()
+	defer cleanup(dir)
+
+	to := "0x567a417717cb6c59ddc1035705f02c0fd1ab1872"
+	dispatcher := &mockREST2EthDispatcher{}
+	_, mockRPC, router, res, _ := newTestREST2EthAndMsg(t, dispatcher, "", to, map[string]interface{}{})
+	req := httptest.NewRequest("POST", "/contracts/"+to+"/get?fly-blocknumber=12345", bytes.NewReader([]byte{}))
+	mockRPC.result = "0x000000000000000000000000000000000000000000000000000000000001e2400000000000000000000000000000000000000000000000000000000000000040000000000000000000000000000000000000000000000000000000000000000774657374696e6700000000000000000000000000000000000000000000000000"
+	router.ServeHTTP(res, req)
+
+	assert.Equal(200, res.Result().StatusCode)
+	assert.Equal("eth_call", mockRPC.capturedMethod)
+	assert.Equal("0x3039", mockRPC.capturedArgs[1])
+	var reply map[string]interface{}
+	err := json.NewDecoder(res.Result().Body).Decode(&reply)
+	assert.NoError(err)
+	log.Infof("Reply: %+v", reply)
+	assert.Nil(reply["error"])
+	assert.Equal("123456", reply["i"])
+	assert.Equal("testing", reply["s"])
+
+	to = "0x567a417717cb6c59ddc1035705f02c0fd1ab1872"
+	dispatcher = &mockREST2EthDispatcher{}
+	_, mockRPC, router, res, _ = newTestREST2EthAndMsg(t, dispatcher, "", to, map[string]interface{}{})
+	req = httptest.NewRequest("POST", "/contracts/"+to+"/get?fly-blocknumber=0xab1234", bytes.NewReader([]byte{}))
+	mockRPC.result = "0x000000000000000000000000000000000000000000000000000000000001e2400000000000000000000000000000000000000000000000000000000000000040000000000000000000000000000000000000000000000000000000000000000774657374696e6700000000000000000000000000000000000000000000000000"
+	router.ServeHTTP(res, req)
+	assert.Equal(200, res.Result().StatusCode)
+	assert.Equal("eth_call", mockRPC.capturedMethod)
+	assert.Equal("0xab1234", mockRPC.capturedArgs[1])
+
+	to = "0x567a417717cb6c59ddc1035705f02c0fd1ab1872"
+	dispatcher = &mockREST2EthDispatcher{}
+	_, mockRPC, router, res, _ = newTestREST2EthAndMsg(t, dispatcher, "", to, map[string]interface{}{})
+	req = httptest.NewRequest("POST", "/contracts/"+to+"/get?fly-blocknumber=pending", bytes.NewReader([]byte{}))
+	mockRPC.result = "0x000000000000000000000000000000000000000000000000000000000001e2400000000000000000000000000000000000000000000000000000000000000040000000000000000000000000000000000000000000000000000000000000000774657374696e6700000000000000000000000000000000000000000000000000"
+	router.ServeHTTP(res, req)
+	assert.Equal(200, res.Result().StatusCode)
+	assert.Equal("eth_call", mockRPC.capturedMethod)
+	assert.Equal("pending", mockRPC.capturedArgs[1])
+}
+
+func TestCallMethodFail(t *testing.T) {
+	assert := assert.New(t)
+	dir := tempdir()
+	defer cleanup(dir)
+
+	to := "0x567a417717cb6c59ddc1035705f02c0fd1ab1872"
+	dispatcher := &mockREST2EthDispatcher{}
+	_, mockRPC, router, res, _ := newTestREST2EthAndMsg(t, dispatcher, "", to, map[string]interface{}{})
+	mockRPC.result = ""
+	mockRPC.mockError = fmt.Errorf("pop")
+	req := httptest.NewRequest("GET", "/contracts/"+to+"/get", bytes.NewReader([]byte{}))
+	router.ServeHTTP(res, req)
+
+	assert.Equal(500, res.Result().StatusCode)
+	reply := restErrMsg{}
+	err := json.NewDecoder(res.Result().Body).Decode(&reply)
+	assert.NoError(err)
+	assert.Regexp("Call failed: pop", reply.Message)
+
+	to = "0x567a417717cb6c59ddc1035705f02c0fd1ab1872"
+	dispatcher = &mockREST2EthDispatcher{}
+	_, mockRPC, router, res, _ = newTestREST2EthAndMsg(t, dispatcher, "", to, map[string]interface{}{})
+	req = httptest.NewRequest("POST", "/contracts/"+to+"/get?fly-blocknumber=ab1234", bytes.NewReader([]byte{}))
+	mockRPC.result = "0x000000000000000000000000000000000000000000000000000000000001e2400000000000000000000000000000000000000000000000000000000000000040000000000000000000000000000000000000000000000000000000000000000774657374696e6700000000000000000000000000000000000000000000000000"
+	router.ServeHTTP(res, req)
+	assert.Equal(500, res.Result().StatusCode)
+}
+
+func TestCallMethodViaABIBadAddress(t *testing.T) {
+	assert := assert.New(t)
+	dir := tempdir()
+	defer cleanup(dir)
+
+	to := "badness"
+	dispatcher := &mockREST2EthDispatcher{}
+	_, _, router, res, _ := newTestREST2EthAndMsg(t, dispatcher, "", to, map[string]interface{}{})
+	req := httptest.NewRequest("GET", "/abis/ABI1/badaddress/get", bytes.NewReader([]byte{}))
+	router.ServeHTTP(res, req)
+
+	assert.Equal(404, res.Result().StatusCode)
+	reply := restErrMsg{}
+	err := json.NewDecoder(res.Result().Body).Decode(&reply)
+	assert.NoError(err)
+	assert.Equal("To Address must be a 40 character hex string (0x prefix is optional)", reply.Message)
+}
+
+func TestSubscribeNoAddressNoSubMgr(t *testing.T) {
+	assert := assert.New(t)
+	dir := tempdir()
+	defer cleanup(dir)
+
+	dispatcher := &mockREST2EthDispatcher{}
+	_, _, router := newTestREST2Eth(t, dispatcher)
+	bodyBytes, _ := json.Marshal(&map[string]string{
+		"stream": "stream1",
+	})
+	req := httptest.NewRequest("POST", "/abis/ABI1/Changed/SuBsCrIbE", bytes.NewReader(bodyBytes))
+	res := httptest.NewRecorder()
+	router.ServeHTTP(res, req)
+
+	assert.Equal(405, res.Result().StatusCode)
+	reply := restErrMsg{}
+	err := json.NewDecoder(res.Result().Body).Decode(&reply)
+	assert.NoError(err)
+	assert.Equal("Event support is not configured on this gateway", reply.Message)
+}
+
+func TestSubscribeNoAddressUnknownEvent(t *testing.T) {
+	assert := assert.New(t)
+	dir := tempdir()
+	defer cleanup(dir)
+
+	dispatcher := &mockREST2EthDispatcher{}
+	_, _, router := newTestREST2Eth(t, dispatcher)
+	bodyBytes, _ := json.Marshal(&map[string]string{
+		"stream": "stream1",
+	})
+	req := httptest.NewRequest("POST", "/abis/ABI1/lobster/subscribe", bytes.NewReader(bodyBytes))
+	res := httptest.NewRecorder()
+	router.ServeHTTP(res, req)
+
+	assert.Equal(404, res.Result().StatusCode)
+	reply := restErrMsg{}
+	err := json.NewDecoder(res.Result().Body).Decode(&reply)
+	assert.NoError(err)
+	assert.Equal("Event 'subscribe' is not declared in the ABI", reply.Message)
+}
+
+func TestSubscribeUnauthorized(t *testing.T) {
+	assert := assert.New(t)
+	dir := tempdir()
+	defer cleanup(dir)
+
+	auth.RegisterSecurityModule(&authtest.TestSecurityModule{})
+
+	dispatcher := &mockREST2EthDispatcher{}
+	_, _, router := newTestREST2Eth(t, dispatcher)
+	bodyBytes, _ := json.Marshal(&map[string]string{
+		"stream": "stream1",
+	})
+	req := httptest.NewRequest("POST", "/abis/ABI1/Changed/subscribe", bytes.NewReader(bodyBytes))
+	res := httptest.NewRecorder()
+	router.ServeHTTP(res, req)
+
+	assert.Equal(401, res.Result().StatusCode)
+	reply := restErrMsg{}
+	err := json.NewDecoder(res.Result().Body).Decode(&reply)
+	assert.NoError(err)
+	assert.Equal("Unauthorized", reply.Message)
+
+	auth.RegisterSecurityModule(nil)
+}
+
+func TestSubscribeNoAddressMissingStream(t *testing.T) {
+	assert := assert.New(t)
+	dir := tempdir()
+	defer cleanup(dir)
+
+	dispatcher := &mockREST2EthDispatcher{}
+	r, _, router := newTestREST2Eth(t, dispatcher)
+	r.subMgr = &mockSubMgr{}
+	bodyBytes, _ := json.Marshal(&map[string]string{})
+	req := httptest.NewRequest("POST", "/abis/ABI1/Changed/subscribe", bytes.NewReader(bodyBytes))
+	res := httptest.NewRecorder()
+	router.ServeHTTP(res, req)
+
+	assert.Equal(400, res.Result().StatusCode)
+	reply := restErrMsg{}
+	err := json.NewDecoder(res.Result().Body).Decode(&reply)
+	assert.NoError(err)
+	assert.Equal("Must supply a 'stream' parameter in the body or query", reply.Message)
+}
+
+func TestSubscribeNoAddressSuccess(t *testing.T) {
+	assert := assert.New(t)
+	dir := tempdir()
+	defer cleanup(dir)
+
+	dispatcher := &mockREST2EthDispatcher{}
+	r, _, router := newTestREST2Eth(t, dispatcher)
+	sm := &mockSubMgr{
+		sub: &events.SubscriptionInfo{ID: "sub1", Name: "stream-without-address"},
+	}
+	r.subMgr = sm
+	bodyBytes, _ := json.Marshal(&map[string]string{
+		"stream": "stream1",
+	})
+	req := httptest.NewRequest("POST", "/abis/ABI1/Changed/subscribe", bytes.NewReader(bodyBytes))
+	res := httptest.NewRecorder()
+	router.ServeHTTP(res, req)
+
+	assert.Equal(200, res.Result().StatusCode)
+	reply := events.SubscriptionInfo{}
+	err := json.NewDecoder(res.Result().Body).Decode(&reply)
+	assert.NoError(err)
+	assert.Equal("sub1", reply.ID)
+	assert.Equal("stream-without-address", reply.Name)
+	assert.Nil(sm.capturedAddr)
+}
+
+func TestSubscribeWithAddressSuccess(t *testing.T) {
+	assert := assert.New(t)
+	dir := tempdir()
+	defer cleanup(dir)
+
+	dispatcher := &mockREST2EthDispatcher{}
+	r, _, router := newTestREST2Eth(t, dispatcher)
+	sm := &mockSubMgr{
+		sub: &events.SubscriptionInfo{ID: "sub1"},
+	}
+	r.subMgr = sm
+	bodyBytes, _ := json.Marshal(&map[string]string{
+		"stream": "stream1",
+	})
+	req := httptest.NewRequest("POST", "/contracts/0x66c5fe653e7a9ebb628a6d40f0452d1e358baee8/Changed/subscribe", bytes.NewReader(bodyBytes))
+	res := httptest.NewRecorder()
+	router.ServeHTTP(res, req)
+
+	assert.Equal(200, res.Result().StatusCode)
+	reply := events.SubscriptionInfo{}
+	err := json.NewDecoder(res.Result().Body).Decode(&reply)
+	assert.NoError(err)
+	assert.Equal("sub1", reply.ID)
+	assert.Equal("0x66C5fE653e7A9EBB628a6D40f0452d1e358BaEE8", sm.capturedAddr.Hex())
+}
+
+func TestSubscribeWithAddressBadAddress(t *testing.T) {
+	assert := assert.New(t)
+	dir := tempdir()
+	defer cleanup(dir)
+
+	dispatcher := &mockREST2EthDispatcher{}
+	r, _, router := newTestREST2Eth(t, dispatcher)
+	abiLoader := r.gw.(*mockABILoader)
+	abiLoader.resolveContractErr = fmt.Errorf("unregistered")
+	r.subMgr = &mockSubMgr{
+		sub: &events.SubscriptionInfo{ID: "sub1"},
+	}
+	bodyBytes, _ := json.Marshal(&map[string]string{
+		"stream": "stream1",
+	})
+	req := httptest.NewRequest("POST", "/contracts/badness/Changed/subscribe", bytes.NewReader(bodyBytes))
+	res := httptest.NewRecorder()
+	router.ServeHTTP(res, req)
+
+	assert.Equal(404, res.Result().StatusCode)
+	reply := restErrMsg{}
+	err := json.NewDecoder(res.Result().Body).Decode(&reply)
+	assert.NoError(err)
+	assert.Equal("unregistered", reply.Message)
+}
+
+func TestSubscribeWithAddressSubmgrFailure(t *testing.T) {
+	assert := assert.New(t)
+	dir := tempdir()
+	defer cleanup(dir)
+
+	dispatcher := &mockREST2EthDispatcher{}
+	r, _, router := newTestREST2Eth(t, dispatcher)
+	r.subMgr = &mockSubMgr{
+		err: fmt.Errorf("pop"),
+	}
+	bodyBytes, _ := json.Marshal(&map[string]string{
+		"stream": "stream1",
+	})
+	req := httptest.NewRequest("POST", "/contracts/0x66c5fe653e7a9ebb628a6d40f0452d1e358baee8/Changed/subscribe", bytes.NewReader(bodyBytes))
+	res := httptest.NewRecorder()
+	router.ServeHTTP(res, req)
+
+	assert.Equal(400, res.Result().StatusCode)
+	reply := restErrMsg{}
+	err := json.NewDecoder(res.Result().Body).Decode(&reply)
+	assert.NoError(err)
+	assert.Equal("pop", reply.Message)
+}
+
+func TestSubscribeWithAggregation(t *testing.T) {
+	assert := assert.New(t)
+	dir := tempdir()
+	defer cleanup(dir)
+
+	dispatcher := &mockREST2EthDispatcher{}
+	r, _, router := newTestREST2Eth(t, dispatcher)
+	sm := &mockSubMgr{
+		sub: &events.SubscriptionInfo{ID: "sub1"},
+	}
+	r.subMgr = sm
+	bodyBytes := []byte(`{"stream":"stream1","aggregation":{"windowSec":60,"sumField":"x"}}`)
+	req := httptest.NewRequest("POST", "/contracts/0x66c5fe653e7a9ebb628a6d40f0452d1e358baee8/Changed/subscribe", bytes.NewReader(bodyBytes))
+	res := httptest.NewRecorder()
+	router.ServeHTTP(res, req)
+
+	assert.Equal(200, res.Result().StatusCode)
+	assert.Equal(uint64(60), sm.capturedAggregation.WindowSec)
+	assert.Equal("x", sm.capturedAggregation.SumField)
+}
+
+func TestSubscribeWithBadAggregation(t *testing.T) {
+	assert := assert.New(t)
+	dir := tempdir()
+	defer cleanup(dir)
+
+	dispatcher := &mockREST2EthDispatcher{}
+	r, _, router := newTestREST2Eth(t, dispatcher)
+	r.subMgr = &mockSubMgr{
+		sub: &events.SubscriptionInfo{ID: "sub1"},
+	}
+	bodyBytes := []byte(`{"stream":"stream1","aggregation":"60s"}`)
+	req := httptest.NewRequest("POST", "/contracts/0x66c5fe653e7a9ebb628a6d40f0452d1e358baee8/Changed/subscribe", bytes.NewReader(bodyBytes))
+	res := httptest.NewRecorder()
+	router.ServeHTTP(res, req)
+
+	assert.Equal(400, res.Result().StatusCode)
+	reply := restErrMsg{}
+	err := json.NewDecoder(res.Result().Body).Decode(&reply)
+	assert.NoError(err)
+	assert.Regexp("Invalid 'aggregation' parameter", reply.Message)
+}
+
+func TestSubscribeRevertedTxnsSuccess(t *testing.T) {
+	assert := assert.New(t)
+	r, _, router := newTestREST2EthCustomAbiLoader(&mockREST2EthDispatcher{}, &mockABILoader{
+		deployMsg: newTestCustomErrorDeployMsg(t),
+	})
+	sm := &mockSubMgr{
+		sub: &events.SubscriptionInfo{ID: "sub1", Type: events.SubscriptionTypeRevertedTransactions},
+	}
+	r.subMgr = sm
+	bodyBytes := []byte(`{"stream":"stream1","fromBlock":"12345"}`)
+	req := httptest.NewRequest("POST", "/contracts/0x66c5fe653e7a9ebb628a6d40f0452d1e358baee8/reverted/subscribe", bytes.NewReader(bodyBytes))
+	res := httptest.NewRecorder()
+	router.ServeHTTP(res, req)
+
+	assert.Equal(200, res.Result().StatusCode)
+	reply := events.SubscriptionInfo{}
+	err := json.NewDecoder(res.Result().Body).Decode(&reply)
+	assert.NoError(err)
+	assert.Equal("sub1", reply.ID)
+	assert.Equal(events.SubscriptionTypeRevertedTransactions, reply.Type)
+	assert.Equal("0x66C5fE653e7A9EBB628a6D40f0452d1e358BaEE8", sm.capturedAddr.Hex())
+	assert.Equal("12345", sm.capturedBlock)
+	assert.NotEmpty(sm.capturedABI)
+	for _, element := range sm.capturedABI {
+		assert.Contains([]string{"function", "error"}, element.Type)
+	}
+	assert.Equal("NotAllowed", sm.capturedABI[len(sm.capturedABI)-1].Name)
+}
+
+func TestSubscribeRevertedTxnsFailures(t *testing.T) {
+	assert := assert.New(t)
+	r, _, router := newTestREST2EthCustomAbiLoader(&mockREST2EthDispatcher{}, &mockABILoader{
+		deployMsg: newTestCustomErrorDeployMsg(t),
+	})
+	r.subMgr = &mockSubMgr{err: fmt.Errorf("pop")}
+	bodyBytes := []byte(`{"stream":"stream1"}`)
+	req := httptest.NewRequest("POST", "/contracts/0x66c5fe653e7a9ebb628a6d40f0452d1e358baee8/reverted/subscribe", bytes.NewReader(bodyBytes))
+	res := httptest.NewRecorder()
+	router.ServeHTTP(res, req)
+	assert.Equal(400, res.Result().StatusCode)
+	assert.Regexp("pop", res.Body.String())
+
+	req = httptest.NewRequest("POST", "/contracts/0x66c5fe653e7a9ebb628a6d40f0452d1e358baee8/reverted/subscribe", bytes.NewReader([]byte(`{}`)))
+	res = httptest.NewRecorder()
+	router.ServeHTTP(res, req)
+	assert.Equal(400, res.Result().StatusCode)
+	assert.Regexp("Must supply a 'stream' parameter", res.Body.String())
+
+	// Only a POST to the subscribe sub-command is a subscription to reverted transactions
+	req = httptest.NewRequest("POST", "/contracts/0x66c5fe653e7a9ebb628a6d40f0452d1e358baee8/reverted", bytes.NewReader(bodyBytes))
+	res = httptest.NewRecorder()
+	router.ServeHTTP(res, req)
+	assert.Equal(404, res.Result().StatusCode)
+	assert.Regexp("Method or Event 'reverted' is not declared", res.Body.String())
+
+	r.subMgr = nil
+	req = httptest.NewRequest("POST", "/contracts/0x66c5fe653e7a9ebb628a6d40f0452d1e358baee8/reverted/subscribe", bytes.NewReader(bodyBytes))
+	res = httptest.NewRecorder()
+	router.ServeHTTP(res, req)
+	assert.Equal(405, res.Result().StatusCode)
+}
+
+func TestRevertedTxnsABI(t *testing.T) {
+	assert := assert.New(t)
+	var abi ethbinding.ABIMarshaling
+	json.Unmarshal([]byte(`[{"type":"function","name":"a"},{"type":"event","name":"b"},{"type":"error","name":"c"},{"type":"constructor"}]`), &abi)
+	reverted := revertedTxnsABI(abi)
+	assert.Equal(2, len(reverted))
+	assert.Equal("a", reverted[0].Name)
+	assert.Equal("c", reverted[1].Name)
+}
+
+type mockBlocksRPC struct {
+	calls []string
+}
+
+func (m *mockBlocksRPC) CallContext(ctx context.Context, result interface{}, method string, args ...interface{}) error {
+	m.calls = append(m.calls, method)
+	switch method {
+	case "eth_blockNumber":
+		return json.Unmarshal([]byte(`"0x2"`), result)
+	case "eth_getBlockByNumber":
+		// A block every 10 seconds from 2021-06-01T12:00:00Z
+		n, _ := strconv.ParseUint(strings.TrimPrefix(args[0].(string), "0x"), 16, 64)
+		return json.Unmarshal([]byte(fmt.Sprintf(`{"number":"%s","timestamp":"0x%x"}`, args[0], 1622548800+n*10)), result)
+	case "eth_call":
+		m.calls = append(m.calls, args[1].(string))
+		return json.Unmarshal([]byte(`"0x0000000000000000000000000000000000000000000000000000000000003039"`), result)
+	}
+	return fmt.Errorf("unexpected")
+}
+
+func TestCallMethodAsOf(t *testing.T) {
+	assert := assert.New(t)
+
+	abiLoader := &mockABILoader{
+		deployMsg: &newTestPrecompiledDeployMsg(t).DeployContract,
+	}
+	rpc := &mockBlocksRPC{}
+	r := newREST2eth(abiLoader, rpc, nil, nil, &mockProcessor{}, &mockREST2EthDispatcher{}, &mockREST2EthDispatcher{})
+	router := &httprouter.Router{}
+	r.addRoutes(router)
+
+	req := httptest.NewRequest("GET", "/contracts/0x567a417717cb6c59ddc1035705f02c0fd1ab1872/storedI?fly-asof=2021-06-01T12:00:15Z", nil)
+	res := httptest.NewRecorder()
+	router.ServeHTTP(res, req)
+	assert.Equal(200, res.Result().StatusCode)
+	assert.Equal("0x1", rpc.calls[len(rpc.calls)-1])
+
+	rpc.calls = nil
+	req = httptest.NewRequest("GET", "/contracts/0x567a417717cb6c59ddc1035705f02c0fd1ab1872/storedI", nil)
+	req.Header.Set("x-firefly-asof", "0x10")
+	res = httptest.NewRecorder()
+	router.ServeHTTP(res, req)
+	assert.Equal(200, res.Result().StatusCode)
+	assert.Equal([]string{"eth_call", "0x10"}, rpc.calls)
+
+	req = httptest.NewRequest("GET", "/contracts/0x567a417717cb6c59ddc1035705f02c0fd1ab1872/storedI?fly-asof=2021-06-01T11:00:00Z", nil)
+	res = httptest.NewRecorder()
+	router.ServeHTTP(res, req)
+	assert.Equal(500, res.Result().StatusCode)
+
+	req = httptest.NewRequest("GET", "/contracts/0x567a417717cb6c59ddc1035705f02c0fd1ab1872/storedI?fly-asof=yesterday", nil)
+	res = httptest.NewRecorder()
+	router.ServeHTTP(res, req)
+	assert.Equal(400, res.Result().StatusCode)
+
+	req = httptest.NewRequest("GET", "/contracts/0x567a417717cb6c59ddc1035705f02c0fd1ab1872/storedI?fly-asof=12&fly-blocknumber=12", nil)
+	res = httptest.NewRecorder()
 	router.ServeHTTP(res, req)
+	assert.Equal(400, res.Result().StatusCode)
+	var reply restErrMsg
+	json.NewDecoder(res.Result().Body).Decode(&reply)
+	assert.Equal("Only one of asOf and blocknumber can be supplied", reply.Message)
+}
 
-	assert.Equal(200, res.Result().StatusCode)
-	assert.Equal("eth_call", mockRPC.capturedMethod)
-	assert.Equal("0x3039", mockRPC.capturedArgs[1])
-	var reply map[string]interface{}
-	err := json.NewDecoder(res.Result().Body).Decode(&reply)
-	assert.NoError(err)
-	log.Infof("Reply: %+v", reply)
-	assert.Nil(reply["error"])
-	assert.Equal("123456", reply["i"])
-	assert.Equal("testing", reply["s"])
+func TestCallMethodBlockTag(t *testing.T) {
+	assert := assert.New(t)
 
-	to = "0x567a417717cb6c59ddc1035705f02c0fd1ab1872"
-	dispatcher = &mockREST2EthDispatcher{}
-	_, mockRPC, router, res, _ = newTestREST2EthAndMsg(t, dispatcher, "", to, map[string]interface{}{})
-	req = httptest.NewRequest("POST", "/contracts/"+to+"/get?fly-blocknumber=0xab1234", bytes.NewReader([]byte{}))
-	mockRPC.result = "0x000000000000000000000000000000000000000000000000000000000001e2400000000000000000000000000000000000000000000000000000000000000040000000000000000000000000000000000000000000000000000000000000000774657374696e6700000000000000000000000000000000000000000000000000"
+	abiLoader := &mockABILoader{
+		deployMsg: &newTestPrecompiledDeployMsg(t).DeployContract,
+	}
+	rpc := &mockBlocksRPC{}
+	r := newREST2eth(abiLoader, rpc, nil, nil, &mockProcessor{}, &mockREST2EthDispatcher{}, &mockREST2EthDispatcher{})
+	router := &httprouter.Router{}
+	r.addRoutes(router)
+
+	req := httptest.NewRequest("GET", "/contracts/0x567a417717cb6c59ddc1035705f02c0fd1ab1872/storedI?fly-blocktag=finalized", nil)
+	res := httptest.NewRecorder()
 	router.ServeHTTP(res, req)
 	assert.Equal(200, res.Result().StatusCode)
-	assert.Equal("eth_call", mockRPC.capturedMethod)
-	assert.Equal("0xab1234", mockRPC.capturedArgs[1])
+	assert.Equal([]string{"eth_call", "finalized"}, rpc.calls)
 
-	to = "0x567a417717cb6c59ddc1035705f02c0fd1ab1872"
-	dispatcher = &mockREST2EthDispatcher{}
-	_, mockRPC, router, res, _ = newTestREST2EthAndMsg(t, dispatcher, "", to, map[string]interface{}{})
-	req = httptest.NewRequest("POST", "/contracts/"+to+"/get?fly-blocknumber=pending", bytes.NewReader([]byte{}))
-	mockRPC.result = "0x000000000000000000000000000000000000000000000000000000000001e2400000000000000000000000000000000000000000000000000000000000000040000000000000000000000000000000000000000000000000000000000000000774657374696e6700000000000000000000000000000000000000000000000000"
+	rpc.calls = nil
+	req = httptest.NewRequest("POST", "/contracts/0x567a417717cb6c59ddc1035705f02c0fd1ab1872/storedI?fly-call", nil)
+	req.Header.Set("x-firefly-blocktag", "safe")
+	res = httptest.NewRecorder()
 	router.ServeHTTP(res, req)
 	assert.Equal(200, res.Result().StatusCode)
-	assert.Equal("eth_call", mockRPC.capturedMethod)
-	assert.Equal("pending", mockRPC.capturedArgs[1])
+	assert.Equal([]string{"eth_call", "safe"}, rpc.calls)
+
+	req = httptest.NewRequest("GET", "/contracts/0x567a417717cb6c59ddc1035705f02c0fd1ab1872/storedI?fly-blocktag=justified", nil)
+	res = httptest.NewRecorder()
+	router.ServeHTTP(res, req)
+	assert.Equal(400, res.Result().StatusCode)
+	var reply restErrMsg
+	json.NewDecoder(res.Result().Body).Decode(&reply)
+	assert.Equal("Invalid blocktag 'justified'. Must be one of earliest, latest, safe, finalized or pending", reply.Message)
+
+	for _, query := range []string{"fly-blocknumber=12&fly-blocktag=latest", "fly-asof=12&fly-blocktag=latest"} {
+		req = httptest.NewRequest("GET", "/contracts/0x567a417717cb6c59ddc1035705f02c0fd1ab1872/storedI?"+query, nil)
+		res = httptest.NewRecorder()
+		router.ServeHTTP(res, req)
+		assert.Equal(400, res.Result().StatusCode)
+		json.NewDecoder(res.Result().Body).Decode(&reply)
+		assert.Equal("Only one of blocktag, blocknumber and asOf can be supplied", reply.Message)
+	}
 }
 
-func TestCallMethodFail(t *testing.T) {
-	assert := assert.New(t)
-	dir := tempdir()
-	defer cleanup(dir)
+func newTestCustomErrorDeployMsg(t *testing.T) *messages.DeployContract {
+	deployMsg := &newTestPrecompiledDeployMsg(t).DeployContract
+	var errorABI ethbinding.ABIMarshaling
+	err := json.Unmarshal([]byte(`[{"type":"error","name":"NotAllowed","inputs":[{"name":"caller","type":"address"}]}]`), &errorABI)
+	assert.NoError(t, err)
+	deployMsg.ABI = append(deployMsg.ABI, errorABI...)
+	return deployMsg
+}
 
-	to := "0x567a417717cb6c59ddc1035705f02c0fd1ab1872"
-	dispatcher := &mockREST2EthDispatcher{}
-	_, mockRPC, router, res, _ := newTestREST2EthAndMsg(t, dispatcher, "", to, map[string]interface{}{})
-	mockRPC.result = ""
-	mockRPC.mockError = fmt.Errorf("pop")
-	req := httptest.NewRequest("GET", "/contracts/"+to+"/get", bytes.NewReader([]byte{}))
-	router.ServeHTTP(res, req)
+func TestCallMethodCustomError(t *testing.T) {
+	assert := assert.New(t)
 
-	assert.Equal(500, res.Result().StatusCode)
-	reply := restErrMsg{}
-	err := json.NewDecoder(res.Result().Body).Decode(&reply)
-	assert.NoError(err)
-	assert.Regexp("Call failed: pop", reply.Message)
+	abiLoader := &mockABILoader{
+		deployMsg: newTestCustomErrorDeployMsg(t),
+	}
+	selector := ethbind.Keccak256([]byte("NotAllowed(address)"))[0:4]
+	rpc := &mockRPC{
+		result: ethbind.API.HexEncode(selector) + "00000000000000000000000066c5fe653e7a9ebb628a6d40f0452d1e358baee8",
+	}
+	r := newREST2eth(abiLoader, rpc, nil, nil, &mockProcessor{}, &mockREST2EthDispatcher{}, &mockREST2EthDispatcher{})
+	router := &httprouter.Router{}
+	r.addRoutes(router)
 
-	to = "0x567a417717cb6c59ddc1035705f02c0fd1ab1872"
-	dispatcher = &mockREST2EthDispatcher{}
-	_, mockRPC, router, res, _ = newTestREST2EthAndMsg(t, dispatcher, "", to, map[string]interface{}{})
-	req = httptest.NewRequest("POST", "/contracts/"+to+"/get?fly-blocknumber=ab1234", bytes.NewReader([]byte{}))
-	mockRPC.result = "0x000000000000000000000000000000000000000000000000000000000001e2400000000000000000000000000000000000000000000000000000000000000040000000000000000000000000000000000000000000000000000000000000000774657374696e6700000000000000000000000000000000000000000000000000"
+	req := httptest.NewRequest("GET", "/contracts/0x567a417717cb6c59ddc1035705f02c0fd1ab1872/storedI", nil)
+	res := httptest.NewRecorder()
 	router.ServeHTTP(res, req)
 	assert.Equal(500, res.Result().StatusCode)
+	var reply restErrMsg
+	json.NewDecoder(res.Result().Body).Decode(&reply)
+	assert.Equal(`NotAllowed({"caller":"0x66c5fe653e7a9ebb628a6d40f0452d1e358baee8"})`, reply.Message)
 }
 
-func TestCallMethodViaABIBadAddress(t *testing.T) {
+func TestSendTransactionSyncIncludesErrors(t *testing.T) {
 	assert := assert.New(t)
-	dir := tempdir()
-	defer cleanup(dir)
 
-	to := "badness"
-	dispatcher := &mockREST2EthDispatcher{}
-	_, _, router, res, _ := newTestREST2EthAndMsg(t, dispatcher, "", to, map[string]interface{}{})
-	req := httptest.NewRequest("GET", "/abis/ABI1/badaddress/get", bytes.NewReader([]byte{}))
+	dispatcher := &mockREST2EthDispatcher{
+		sendTransactionSyncReceipt: &messages.TransactionReceipt{
+			ReplyCommon: messages.ReplyCommon{
+				Headers: messages.ReplyHeaders{
+					CommonHeaders: messages.CommonHeaders{
+						MsgType: messages.MsgTypeTransactionSuccess,
+					},
+				},
+			},
+		},
+	}
+	abiLoader := &mockABILoader{
+		deployMsg: newTestCustomErrorDeployMsg(t),
+	}
+	_, _, router := newTestREST2EthCustomAbiLoader(dispatcher, abiLoader)
+	body, _ := json.Marshal(map[string]interface{}{"i": 12345, "s": "testing"})
+	req := httptest.NewRequest("POST", "/contracts/0x567a417717cb6c59ddc1035705f02c0fd1ab1872/set?fly-sync", bytes.NewReader(body))
+	req.Header.Add("x-firefly-from", "0x66c5fe653e7a9ebb628a6d40f0452d1e358baee8")
+	res := httptest.NewRecorder()
 	router.ServeHTTP(res, req)
 
-	assert.Equal(404, res.Result().StatusCode)
-	reply := restErrMsg{}
-	err := json.NewDecoder(res.Result().Body).Decode(&reply)
-	assert.NoError(err)
-	assert.Equal("To Address must be a 40 character hex string (0x prefix is optional)", reply.Message)
+	assert.Equal(200, res.Result().StatusCode)
+	assert.Len(dispatcher.sendTransactionMsg.Errors, 1)
+	assert.Equal("NotAllowed", dispatcher.sendTransactionMsg.Errors[0].Name)
 }
 
-func TestSubscribeNoAddressNoSubMgr(t *testing.T) {
-	assert := assert.New(t)
-	dir := tempdir()
-	defer cleanup(dir)
+type mockDryRunRPC struct {
+	estimateErr error
+}
+
+func (m *mockDryRunRPC) CallContext(ctx context.Context, result interface{}, method string, args ...interface{}) error {
+	switch method {
+	case "eth_getTransactionCount":
+		return json.Unmarshal([]byte(`"0x1"`), result)
+	case "eth_call":
+		return json.Unmarshal([]byte(`"0x6080"`), result)
+	case "eth_estimateGas":
+		if m.estimateErr != nil {
+			return m.estimateErr
+		}
+		return json.Unmarshal([]byte(`"0x1d4c0"`), result)
+	}
+	return fmt.Errorf("unexpected")
+}
 
+func newTestDryRunREST2Eth(from string, rpc eth.RPCClient) (*rest2eth, *mockREST2EthDispatcher, *httprouter.Router) {
 	dispatcher := &mockREST2EthDispatcher{}
-	_, _, router := newTestREST2Eth(t, dispatcher)
-	bodyBytes, _ := json.Marshal(&map[string]string{
-		"stream": "stream1",
-	})
-	req := httptest.NewRequest("POST", "/abis/ABI1/Changed/SuBsCrIbE", bytes.NewReader(bodyBytes))
+	abiLoader := &mockABILoader{
+		deployMsg: &messages.DeployContract{
+			Compiled: []byte{0x60, 0x80, 0x60, 0x40},
+			ABI: ethbinding.ABIMarshaling{
+				{Type: "constructor", Inputs: []ethbinding.ABIArgumentMarshaling{{Name: "i", Type: "uint256"}}},
+			},
+		},
+	}
+	r, _, router := newTestREST2EthCustomAbiLoader(dispatcher, abiLoader)
+	r.rpc = rpc
+	r.processor = &mockProcessor{resolvedFrom: from}
+	return r, dispatcher, router
+}
+
+func TestDeployContractDryRun(t *testing.T) {
+	assert := assert.New(t)
+
+	from := "0x6ac7ea33f8831ea9dcc53393aaa88b25a785dbf0"
+	_, dispatcher, router := newTestDryRunREST2Eth(from, &mockDryRunRPC{})
+	req := httptest.NewRequest("POST", "/abis/abi1?fly-dryrun", bytes.NewReader([]byte(`{"i":12345}`)))
+	req.Header.Add("x-firefly-from", from)
 	res := httptest.NewRecorder()
 	router.ServeHTTP(res, req)
 
-	assert.Equal(405, res.Result().StatusCode)
-	reply := restErrMsg{}
+	assert.Equal(200, res.Result().StatusCode)
+	var reply eth.DryRunResult
 	err := json.NewDecoder(res.Result().Body).Decode(&reply)
 	assert.NoError(err)
-	assert.Equal("Event support is not configured on this gateway", reply.Message)
+	assert.False(reply.Reverted)
+	assert.Equal("1", reply.Nonce)
+	assert.Equal("0x343c43A37D37dfF08AE8C4A11544c718AbB4fCF8", reply.ContractAddress)
+	assert.Equal("120000", reply.GasEstimate)
+	assert.Nil(dispatcher.asyncDispatchMsg)
+	assert.Nil(dispatcher.deployContractMsg)
 }
 
-func TestSubscribeNoAddressUnknownEvent(t *testing.T) {
+func TestDeployContractDryRunReverted(t *testing.T) {
 	assert := assert.New(t)
-	dir := tempdir()
-	defer cleanup(dir)
 
-	dispatcher := &mockREST2EthDispatcher{}
-	_, _, router := newTestREST2Eth(t, dispatcher)
-	bodyBytes, _ := json.Marshal(&map[string]string{
-		"stream": "stream1",
-	})
-	req := httptest.NewRequest("POST", "/abis/ABI1/lobster/subscribe", bytes.NewReader(bodyBytes))
+	from := "0x6ac7ea33f8831ea9dcc53393aaa88b25a785dbf0"
+	_, _, router := newTestDryRunREST2Eth(from, &mockDryRunRPC{estimateErr: fmt.Errorf("execution reverted")})
+	req := httptest.NewRequest("POST", "/abis/abi1?fly-dryrun=true", bytes.NewReader([]byte(`{"i":12345}`)))
+	req.Header.Add("x-firefly-from", from)
 	res := httptest.NewRecorder()
 	router.ServeHTTP(res, req)
 
-	assert.Equal(404, res.Result().StatusCode)
-	reply := restErrMsg{}
+	assert.Equal(200, res.Result().StatusCode)
+	var reply eth.DryRunResult
 	err := json.NewDecoder(res.Result().Body).Decode(&reply)
 	assert.NoError(err)
-	assert.Equal("Event 'subscribe' is not declared in the ABI", reply.Message)
+	assert.True(reply.Reverted)
+	assert.Regexp("execution reverted", reply.Error)
 }
 
-func TestSubscribeUnauthorized(t *testing.T) {
+func TestDeployContractDryRunBadParams(t *testing.T) {
 	assert := assert.New(t)
-	dir := tempdir()
-	defer cleanup(dir)
-
-	auth.RegisterSecurityModule(&authtest.TestSecurityModule{})
 
-	dispatcher := &mockREST2EthDispatcher{}
-	_, _, router := newTestREST2Eth(t, dispatcher)
-	bodyBytes, _ := json.Marshal(&map[string]string{
-		"stream": "stream1",
-	})
-	req := httptest.NewRequest("POST", "/abis/ABI1/Changed/subscribe", bytes.NewReader(bodyBytes))
+	from := "0x6ac7ea33f8831ea9dcc53393aaa88b25a785dbf0"
+	_, _, router := newTestDryRunREST2Eth(from, &mockDryRunRPC{})
+	req := httptest.NewRequest("POST", "/abis/abi1?fly-dryrun=true", bytes.NewReader([]byte(`{"i":"not a number"}`)))
+	req.Header.Add("x-firefly-from", from)
 	res := httptest.NewRecorder()
 	router.ServeHTTP(res, req)
 
-	assert.Equal(401, res.Result().StatusCode)
-	reply := restErrMsg{}
-	err := json.NewDecoder(res.Result().Body).Decode(&reply)
-	assert.NoError(err)
-	assert.Equal("Unauthorized", reply.Message)
-
-	auth.RegisterSecurityModule(nil)
+	assert.Equal(400, res.Result().StatusCode)
 }
 
-func TestSubscribeNoAddressMissingStream(t *testing.T) {
+func TestDeployContractDryRunPrivate(t *testing.T) {
 	assert := assert.New(t)
-	dir := tempdir()
-	defer cleanup(dir)
 
-	dispatcher := &mockREST2EthDispatcher{}
-	r, _, router := newTestREST2Eth(t, dispatcher)
-	r.subMgr = &mockSubMgr{}
-	bodyBytes, _ := json.Marshal(&map[string]string{})
-	req := httptest.NewRequest("POST", "/abis/ABI1/Changed/subscribe", bytes.NewReader(bodyBytes))
+	from := "0x6ac7ea33f8831ea9dcc53393aaa88b25a785dbf0"
+	_, _, router := newTestDryRunREST2Eth(from, &mockDryRunRPC{})
+	req := httptest.NewRequest("POST", "/abis/abi1?fly-dryrun=true&fly-privateFrom=0xdC416B907857Fa8c0e0d55ec21766Ee3546D5f90", bytes.NewReader([]byte(`{"i":12345}`)))
+	req.Header.Add("x-firefly-from", from)
 	res := httptest.NewRecorder()
 	router.ServeHTTP(res, req)
 
@@ -1453,108 +2589,113 @@ func TestSubscribeNoAddressMissingStream(t *testing.T) {
 	reply := restErrMsg{}
 	err := json.NewDecoder(res.Result().Body).Decode(&reply)
 	assert.NoError(err)
-	assert.Equal("Must supply a 'stream' parameter in the body or query", reply.Message)
+	assert.Equal("Dry-run is not supported for private transactions", reply.Message)
 }
 
-func TestSubscribeNoAddressSuccess(t *testing.T) {
+func TestDeployContractDryRunResolveFail(t *testing.T) {
 	assert := assert.New(t)
-	dir := tempdir()
-	defer cleanup(dir)
 
-	dispatcher := &mockREST2EthDispatcher{}
-	r, _, router := newTestREST2Eth(t, dispatcher)
-	sm := &mockSubMgr{
-		sub: &events.SubscriptionInfo{ID: "sub1", Name: "stream-without-address"},
-	}
-	r.subMgr = sm
-	bodyBytes, _ := json.Marshal(&map[string]string{
-		"stream": "stream1",
-	})
-	req := httptest.NewRequest("POST", "/abis/ABI1/Changed/subscribe", bytes.NewReader(bodyBytes))
+	from := "0x6ac7ea33f8831ea9dcc53393aaa88b25a785dbf0"
+	r, _, router := newTestDryRunREST2Eth(from, &mockDryRunRPC{})
+	r.processor = &mockProcessor{err: fmt.Errorf("pop")}
+	req := httptest.NewRequest("POST", "/abis/abi1?fly-dryrun=true", bytes.NewReader([]byte(`{"i":12345}`)))
+	req.Header.Add("x-firefly-from", from)
 	res := httptest.NewRecorder()
 	router.ServeHTTP(res, req)
 
-	assert.Equal(200, res.Result().StatusCode)
-	reply := events.SubscriptionInfo{}
-	err := json.NewDecoder(res.Result().Body).Decode(&reply)
-	assert.NoError(err)
-	assert.Equal("sub1", reply.ID)
-	assert.Equal("stream-without-address", reply.Name)
-	assert.Nil(sm.capturedAddr)
+	assert.Equal(500, res.Result().StatusCode)
 }
 
-func TestSubscribeWithAddressSuccess(t *testing.T) {
+func TestDeployContractSponsoredWithoutFrom(t *testing.T) {
 	assert := assert.New(t)
-	dir := tempdir()
-	defer cleanup(dir)
 
-	dispatcher := &mockREST2EthDispatcher{}
-	r, _, router := newTestREST2Eth(t, dispatcher)
-	sm := &mockSubMgr{
-		sub: &events.SubscriptionInfo{ID: "sub1"},
-	}
-	r.subMgr = sm
-	bodyBytes, _ := json.Marshal(&map[string]string{
-		"stream": "stream1",
-	})
-	req := httptest.NewRequest("POST", "/contracts/0x66c5fe653e7a9ebb628a6d40f0452d1e358baee8/Changed/subscribe", bytes.NewReader(bodyBytes))
+	_, dispatcher, router := newTestDryRunREST2Eth("", &mockDryRunRPC{})
+	dispatcher.deployContractSyncReceipt = &messages.TransactionReceipt{}
+	dispatcher.deployContractSyncReceipt.Headers.MsgType = messages.MsgTypeTransactionSuccess
+	req := httptest.NewRequest("POST", "/abis/abi1?fly-sync&fly-sponsor=gas1", bytes.NewReader([]byte(`{"i":12345}`)))
 	res := httptest.NewRecorder()
 	router.ServeHTTP(res, req)
 
 	assert.Equal(200, res.Result().StatusCode)
-	reply := events.SubscriptionInfo{}
-	err := json.NewDecoder(res.Result().Body).Decode(&reply)
-	assert.NoError(err)
-	assert.Equal("sub1", reply.ID)
-	assert.Equal("0x66C5fE653e7A9EBB628a6D40f0452d1e358BaEE8", sm.capturedAddr.Hex())
+	assert.Equal("gas1", dispatcher.deployContractMsg.Headers.Sponsor)
+	assert.Empty(dispatcher.deployContractMsg.From)
 }
 
-func TestSubscribeWithAddressBadAddress(t *testing.T) {
+func TestDeployContractMissingFromNotSponsored(t *testing.T) {
 	assert := assert.New(t)
-	dir := tempdir()
-	defer cleanup(dir)
 
-	dispatcher := &mockREST2EthDispatcher{}
-	r, _, router := newTestREST2Eth(t, dispatcher)
-	abiLoader := r.gw.(*mockABILoader)
-	abiLoader.resolveContractErr = fmt.Errorf("unregistered")
-	r.subMgr = &mockSubMgr{
-		sub: &events.SubscriptionInfo{ID: "sub1"},
-	}
-	bodyBytes, _ := json.Marshal(&map[string]string{
-		"stream": "stream1",
-	})
-	req := httptest.NewRequest("POST", "/contracts/badness/Changed/subscribe", bytes.NewReader(bodyBytes))
+	_, dispatcher, router := newTestDryRunREST2Eth("", &mockDryRunRPC{})
+	req := httptest.NewRequest("POST", "/abis/abi1?fly-sync", bytes.NewReader([]byte(`{"i":12345}`)))
 	res := httptest.NewRecorder()
 	router.ServeHTTP(res, req)
 
-	assert.Equal(404, res.Result().StatusCode)
-	reply := restErrMsg{}
-	err := json.NewDecoder(res.Result().Body).Decode(&reply)
-	assert.NoError(err)
-	assert.Equal("unregistered", reply.Message)
+	assert.Equal(400, res.Result().StatusCode)
+	assert.Nil(dispatcher.deployContractMsg)
 }
 
-func TestSubscribeWithAddressSubmgrFailure(t *testing.T) {
+func TestContractStats(t *testing.T) {
 	assert := assert.New(t)
-	dir := tempdir()
-	defer cleanup(dir)
 
-	dispatcher := &mockREST2EthDispatcher{}
-	r, _, router := newTestREST2Eth(t, dispatcher)
-	r.subMgr = &mockSubMgr{
-		err: fmt.Errorf("pop"),
+	stats := &tx.ContractStats{
+		Address:   "0x567a417717cb6c59ddc1035705f02c0fd1ab1872",
+		WindowSec: 3600,
+		Methods: map[string]*tx.ContractMethodStats{
+			"set": {Invocations: 2, Succeeded: 1, Reverted: 1, SuccessRatio: 0.5},
+		},
 	}
-	bodyBytes, _ := json.Marshal(&map[string]string{
-		"stream": "stream1",
-	})
-	req := httptest.NewRequest("POST", "/contracts/0x66c5fe653e7a9ebb628a6d40f0452d1e358baee8/Changed/subscribe", bytes.NewReader(bodyBytes))
+	abiLoader := &mockABILoader{
+		deployMsg:              &newTestPrecompiledDeployMsg(t).DeployContract,
+		registeredContractAddr: "567a417717cb6c59ddc1035705f02c0fd1ab1872",
+	}
+	r, _, router := newTestREST2EthCustomAbiLoader(&mockREST2EthDispatcher{}, abiLoader)
+	r.processor = &mockProcessor{contractStats: stats}
+
+	for _, path := range []string{"/contracts/0x567a417717cb6c59ddc1035705f02c0fd1ab1872/stats", "/contracts/myContract/stats"} {
+		req := httptest.NewRequest("GET", path, bytes.NewReader([]byte{}))
+		res := httptest.NewRecorder()
+		router.ServeHTTP(res, req)
+		assert.Equal(200, res.Code)
+		var reply tx.ContractStats
+		assert.NoError(json.NewDecoder(res.Body).Decode(&reply))
+		assert.Equal(*stats.Methods["set"], *reply.Methods["set"])
+	}
+
+	// An unknown name is reported as by any other contract route
+	abiLoader.resolveContractErr = fmt.Errorf("pop")
+	req := httptest.NewRequest("GET", "/contracts/unknown/stats", bytes.NewReader([]byte{}))
 	res := httptest.NewRecorder()
 	router.ServeHTTP(res, req)
+	assert.Equal(404, res.Code)
 
-	assert.Equal(400, res.Result().StatusCode)
-	reply := restErrMsg{}
-	err := json.NewDecoder(res.Result().Body).Decode(&reply)
+	// When contract stats are disabled, stats is looked up as a method of the contract
+	r.processor = &mockProcessor{}
+	req = httptest.NewRequest("GET", "/contracts/0x567a417717cb6c59ddc1035705f02c0fd1ab1872/stats", bytes.NewReader([]byte{}))
+	res = httptest.NewRecorder()
+	router.ServeHTTP(res, req)
+	assert.Equal(404, res.Code)
+	assert.Regexp("Method or Event 'stats' is not declared", res.Body.String())
+}
+
+func TestGetFlyConfirmations(t *testing.T) {
+	assert := assert.New(t)
+
+	req := httptest.NewRequest("POST", "/contracts/0x567a417717cb6c59ddc1035705f02c0fd1ab1872/set?fly-confirmations=12", bytes.NewReader([]byte{}))
+	confirmations, err := getFlyConfirmations(req)
 	assert.NoError(err)
-	assert.Equal("pop", reply.Message)
+	assert.Equal(int64(12), confirmations)
+
+	req = httptest.NewRequest("POST", "/contracts/0x567a417717cb6c59ddc1035705f02c0fd1ab1872/set", bytes.NewReader([]byte{}))
+	req.Header.Set("x-firefly-confirmations", "3")
+	confirmations, err = getFlyConfirmations(req)
+	assert.NoError(err)
+	assert.Equal(int64(3), confirmations)
+
+	req = httptest.NewRequest("POST", "/contracts/0x567a417717cb6c59ddc1035705f02c0fd1ab1872/set", bytes.NewReader([]byte{}))
+	confirmations, err = getFlyConfirmations(req)
+	assert.NoError(err)
+	assert.Equal(int64(0), confirmations)
+
+	req = httptest.NewRequest("POST", "/contracts/0x567a417717cb6c59ddc1035705f02c0fd1ab1872/set?fly-confirmations=-1", bytes.NewReader([]byte{}))
+	_, err = getFlyConfirmations(req)
+	assert.EqualError(err, "Invalid 'fly-confirmations' value '-1': must be a non-negative integer")
 }
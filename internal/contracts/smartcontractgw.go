@@ -17,11 +17,13 @@ package contracts
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"io"
 	"io/ioutil"
+	"math/big"
 	"mime/multipart"
 	"net/http"
 	"net/url"
@@ -31,6 +33,7 @@ import (
 	"path/filepath"
 	"regexp"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -47,8 +50,11 @@ import (
 	"github.com/kaleido-io/ethconnect/internal/eth"
 	"github.com/kaleido-io/ethconnect/internal/ethbind"
 	"github.com/kaleido-io/ethconnect/internal/events"
+	"github.com/kaleido-io/ethconnect/internal/graphql"
 	"github.com/kaleido-io/ethconnect/internal/messages"
 	"github.com/kaleido-io/ethconnect/internal/openapi"
+	"github.com/kaleido-io/ethconnect/internal/opsevents"
+	"github.com/kaleido-io/ethconnect/internal/quotas"
 	"github.com/kaleido-io/ethconnect/internal/tx"
 	"github.com/kaleido-io/ethconnect/internal/utils"
 	"github.com/kaleido-io/ethconnect/internal/ws"
@@ -58,6 +64,11 @@ const (
 	maxFormParsingMemory     = 32 << 20 // 32 MB
 	errEventSupportMissing   = "Event support is not configured on this gateway"
 	remoteRegistryContextKey = "isRemoteRegistry"
+	// remoteRegistryReservedContextKey is set when the registered name was reserved in
+	// the remote registry before deployment, so the registration must be confirmed
+	remoteRegistryReservedContextKey = "isRemoteRegistryReserved"
+	// tenantContextKey records the tenant that deployed a contract, for its quota
+	tenantContextKey = "tenant"
 )
 
 // SmartContractGateway provides gateway functions for OpenAPI 2.0 processing of Solidity contracts
@@ -71,18 +82,32 @@ type SmartContractGateway interface {
 
 type smartContractGatewayInt interface {
 	SmartContractGateway
-	resolveContractAddr(registeredName string) (string, error)
+	resolveContractAddr(registeredName, environment string) (string, error)
 	loadDeployMsgForInstance(addrHexNo0x string) (*messages.DeployContract, *contractInfo, error)
 	loadDeployMsgByID(abi string) (*messages.DeployContract, *abiInfo, error)
-	checkNameAvailable(name string, isRemote bool) error
+	checkNameAvailable(name, environment string, isRemote bool) error
+	checkContractQuota(tenant string) error
+	loadOrInferDeployMsgForInstance(ctx context.Context, addrHex string) (*messages.DeployContract, *contractInfo, error)
+	checkStaticAnalysis(msg *messages.DeployContract) error
 }
 
 // SmartContractGatewayConf configuration
 type SmartContractGatewayConf struct {
 	events.SubscriptionManagerConf
-	StoragePath    string             `json:"storagePath"`
-	BaseURL        string             `json:"baseURL"`
-	RemoteRegistry RemoteRegistryConf `json:"registry,omitempty"` // JSON only config - no commandline
+	StoragePath    string              `json:"storagePath"`
+	BaseURL        string              `json:"baseURL"`
+	RemoteRegistry RemoteRegistryConf  `json:"registry,omitempty"` // JSON only config - no commandline
+	Environment    string              `json:"environment,omitempty"`
+	ABIInference   ABIInferenceConf    `json:"abiInference,omitempty"`
+	Storage        RegistryStorageConf `json:"storage,omitempty"` // JSON only config - no commandline
+	StaticAnalysis StaticAnalysisConf  `json:"staticAnalysis,omitempty"`
+	GraphQL        GraphQLConf         `json:"graphql,omitempty"`
+	Proxies        ProxyWatchConf      `json:"proxies,omitempty"`
+}
+
+// Enabled is true if the local registry is stored in the storage path, or in shared storage
+func (c *SmartContractGatewayConf) Enabled() bool {
+	return c.StoragePath != "" || c.Storage.Shared()
 }
 
 // CobraInitContractGateway standard naming for contract gateway command params
@@ -108,10 +133,18 @@ func (g *smartContractGW) AddRoutes(router *httprouter.Router) {
 	g.r2e.addRoutes(router)
 	router.GET("/contracts", g.listContractsOrABIs)
 	router.GET("/contracts/:address", g.getContractOrABI)
+	router.PATCH("/contracts/:address", g.updateMethodAccess)
+	router.POST("/contracts/:address", g.rebindContract)
 	router.POST("/abis", g.addABI)
 	router.GET("/abis", g.listContractsOrABIs)
 	router.GET("/abis/:abi", g.getContractOrABI)
+	// The wildcard shares its name with the /abis/:abi/:address/:method routes, and only 'source' is served
+	router.GET("/abis/:abi/:address", g.getABISource)
+	router.PATCH("/abis/:abi", g.updateMethodAccess)
+	router.DELETE("/abis/:abi", g.deleteABI)
 	router.POST("/abis/:abi/:address", g.registerContract)
+	router.PUT("/contracts/registrations/:name", g.moveRegistration)
+	router.DELETE("/contracts/*path", g.deleteContractOrRegistration)
 	router.GET("/instances/:instance_lookup", g.getRemoteRegistrySwaggerOrABI)
 	router.GET("/i/:instance_lookup", g.getRemoteRegistrySwaggerOrABI)
 	router.GET("/gateways/:gateway_lookup", g.getRemoteRegistrySwaggerOrABI)
@@ -120,13 +153,63 @@ func (g *smartContractGW) AddRoutes(router *httprouter.Router) {
 	router.PATCH(events.StreamPathPrefix+"/:id", g.withEventsAuth(g.updateStream))
 	router.GET(events.StreamPathPrefix, g.withEventsAuth(g.listStreamsOrSubs))
 	router.GET(events.SubPathPrefix, g.withEventsAuth(g.listStreamsOrSubs))
+	router.POST(events.SubPathPrefix, g.withEventsAuth(g.createChainSubscription))
 	router.GET(events.StreamPathPrefix+"/:id", g.withEventsAuth(g.getStreamOrSub))
 	router.GET(events.SubPathPrefix+"/:id", g.withEventsAuth(g.getStreamOrSub))
 	router.DELETE(events.StreamPathPrefix+"/:id", g.withEventsAuth(g.deleteStreamOrSub))
 	router.DELETE(events.SubPathPrefix+"/:id", g.withEventsAuth(g.deleteStreamOrSub))
 	router.POST(events.SubPathPrefix+"/:id/reset", g.withEventsAuth(g.resetSub))
+	router.POST(events.SubPathPrefix+"/:id/suspend", g.withEventsAuth(g.suspendOrResumeSub))
+	router.POST(events.SubPathPrefix+"/:id/resume", g.withEventsAuth(g.suspendOrResumeSub))
+	router.GET(events.SubPathPrefix+"/:id/checkpoint", g.withEventsAuth(g.getSubCheckpoint))
+	router.PATCH(events.SubPathPrefix+"/:id/checkpoint", g.withEventsAuth(g.setSubCheckpoint))
 	router.POST(events.StreamPathPrefix+"/:id/suspend", g.withEventsAuth(g.suspendOrResumeStream))
 	router.POST(events.StreamPathPrefix+"/:id/resume", g.withEventsAuth(g.suspendOrResumeStream))
+	router.GET(events.StreamPathPrefix+"/:id/deliveries", g.withEventsAuth(g.getStreamDeliveries))
+	router.GET(events.StreamPathPrefix+"/:id/deadletters", g.withEventsAuth(g.getStreamDeadLetters))
+	router.POST(events.StreamPathPrefix+"/:id/deadletters/replay", g.withEventsAuth(g.replayStreamDeadLetters))
+	router.POST(events.BackfillPathPrefix, g.withEventsAuth(g.createBackfill))
+	router.GET(events.BackfillPathPrefix, g.withEventsAuth(g.listStreamsOrSubs))
+	router.GET(events.BackfillPathPrefix+"/:id", g.withEventsAuth(g.getStreamOrSub))
+	router.DELETE(events.BackfillPathPrefix+"/:id", g.withEventsAuth(g.deleteStreamOrSub))
+	router.POST(events.BackfillPathPrefix+"/:id/resume", g.withEventsAuth(g.resumeBackfill))
+	router.POST(events.InvalidationPathPrefix, g.withEventsAuth(g.createInvalidationHook))
+	router.GET(events.InvalidationPathPrefix, g.withEventsAuth(g.listStreamsOrSubs))
+	router.GET(events.InvalidationPathPrefix+"/:id", g.withEventsAuth(g.getStreamOrSub))
+	router.DELETE(events.InvalidationPathPrefix+"/:id", g.withEventsAuth(g.deleteStreamOrSub))
+	router.POST(events.CheckpointGroupPathPrefix, g.withEventsAuth(g.createCheckpointGroup))
+	router.GET(events.CheckpointGroupPathPrefix, g.withEventsAuth(g.listStreamsOrSubs))
+	router.GET(events.CheckpointGroupPathPrefix+"/:id", g.withEventsAuth(g.getStreamOrSub))
+	router.DELETE(events.CheckpointGroupPathPrefix+"/:id", g.withEventsAuth(g.deleteStreamOrSub))
+	router.GET(events.CheckpointGroupPathPrefix+"/:id/checkpoint", g.withEventsAuth(g.getCheckpointGroupCheckpoint))
+	router.POST(events.CheckpointGroupPathPrefix+"/:id/reset", g.withEventsAuth(g.resetCheckpointGroup))
+	router.POST(DeployPlanPathPrefix, g.createDeployPlan)
+	router.GET(DeployPlanPathPrefix, g.listDeployPlans)
+	router.GET(DeployPlanPathPrefix+"/:id", g.getDeployPlan)
+	router.DELETE(DeployPlanPathPrefix+"/:id", g.deleteDeployPlan)
+	router.POST(DeployPlanPathPrefix+"/:id/resume", g.resumeDeployPlan)
+	router.POST(UpgradePathPrefix, g.createContractUpgrade)
+	router.GET(UpgradePathPrefix, g.listContractUpgrades)
+	router.GET(UpgradePathPrefix+"/:id", g.getContractUpgrade)
+	router.POST(ReactionPathPrefix, g.withEventsAuth(g.createReactionRule))
+	router.GET(ReactionPathPrefix, g.withEventsAuth(g.listReactionRules))
+	router.GET(ReactionPathPrefix+"/:id", g.withEventsAuth(g.getReactionRule))
+	router.DELETE(ReactionPathPrefix+"/:id", g.withEventsAuth(g.deleteReactionRule))
+	router.GET(ReactionPathPrefix+"/:id/audit", g.withEventsAuth(g.getReactionAudit))
+	router.GET(RegistryOrphansPath, g.getRegistryOrphans)
+	router.POST(RegistryOrphansPath+"/cleanup", g.cleanupRegistryOrphans)
+	router.POST(RegistryInvalidatePath, g.invalidateRegistryCache)
+	if g.conf.RemoteRegistry.Push.Enabled {
+		router.POST(RegistryPushPath, g.pushRegistryChanges)
+	}
+	router.POST(ChainSnapshotsPath, g.createChainSnapshot)
+	router.GET(ChainSnapshotsPath, g.listChainSnapshots)
+	router.POST(ChainSnapshotsPath+"/:id/revert", g.revertToChainSnapshot)
+	if g.graphql != nil {
+		router.GET(GraphQLPath, g.graphqlQuery)
+		router.POST(GraphQLPath, g.graphqlQuery)
+		router.GET(GraphQLSchemaPath, g.graphqlSchema)
+	}
 }
 
 func (g *smartContractGW) SendReply(message interface{}) {
@@ -152,6 +235,9 @@ func NewSmartContractGateway(conf *SmartContractGatewayConf, txnConf *tx.TxnProc
 		contractIndex:         make(map[string]messages.TimeSortable),
 		contractRegistrations: make(map[string]*contractInfo),
 		abiIndex:              make(map[string]messages.TimeSortable),
+		runningPlans:          make(map[string]bool),
+		runningUpgrades:       make(map[string]bool),
+		reactions:             make(map[string]*reactionState),
 		baseSwaggerConf: &openapi.ABI2SwaggerConf{
 			ExternalHost:     baseURL.Host,
 			ExternalRootPath: baseURL.Path,
@@ -159,11 +245,20 @@ func NewSmartContractGateway(conf *SmartContractGatewayConf, txnConf *tx.TxnProc
 			OrionPrivateAPI:  txnConf.OrionPrivateAPIS,
 			BasicAuth:        true,
 		},
-		ws: ws,
+		ws:  ws,
+		rpc: rpc,
 	}
 	if err = gw.rr.init(); err != nil {
 		return nil, err
 	}
+	if conf.ABIInference.Enabled {
+		if gw.selectors, err = newSelectorDictionary(conf.ABIInference.SelectorsFile); err != nil {
+			return nil, err
+		}
+	}
+	if gw.analyzer, err = newStaticAnalyzer(&conf.StaticAnalysis); err != nil {
+		return nil, err
+	}
 	syncDispatcher := newSyncDispatcher(processor)
 	if conf.EventLevelDBPath != "" {
 		gw.sm = events.NewSubscriptionManager(&conf.SubscriptionManagerConf, rpc, gw.ws)
@@ -172,8 +267,27 @@ func NewSmartContractGateway(conf *SmartContractGatewayConf, txnConf *tx.TxnProc
 			return nil, ethconnecterrors.Errorf(ethconnecterrors.RESTGatewayEventManagerInitFailed, err)
 		}
 	}
+	if conf.GraphQL.Enabled {
+		gw.graphql = gw.newGraphQLSchema()
+	}
 	gw.r2e = newREST2eth(gw, rpc, gw.sm, gw.rr, processor, asyncDispatcher, syncDispatcher)
+	if gw.store, err = newRegistryStore(conf); err != nil {
+		return nil, err
+	}
 	gw.buildIndex()
+	if gw.sm != nil {
+		gw.startReactions()
+	}
+	if len(gw.trackedProxies()) > 0 {
+		gw.startProxyWatcher()
+	}
+	if conf.Storage.Shared() {
+		gw.refreshDone = make(chan struct{})
+		go gw.refreshIndexLoop()
+	}
+	if processor != nil {
+		processor.SetEventABIResolver(gw)
+	}
 	return gw, nil
 }
 
@@ -188,29 +302,56 @@ type smartContractGW struct {
 	idxLock               sync.Mutex
 	abiIndex              map[string]messages.TimeSortable
 	baseSwaggerConf       *openapi.ABI2SwaggerConf
+	rpc                   eth.RPCClient
+	selectors             *selectorDictionary
+	analyzer              *staticAnalyzer
+	store                 registryStore
+	refreshDone           chan struct{}
+	plansLock             sync.Mutex
+	runningPlans          map[string]bool
+	runningUpgrades       map[string]bool
+	reactionsLock         sync.Mutex
+	reactions             map[string]*reactionState
+	reactionQueue         chan *reactionJob
+	reactionsDone         chan struct{}
+	snapshotsLock         sync.Mutex
+	snapshots             []*chainSnapshot
+	graphql               *graphql.Schema
+	proxiesLock           sync.Mutex
+	proxiesDone           chan struct{}
 }
 
 // contractInfo is the minimal data structure we keep in memory, indexed by address
 // ONLY used for local registry. Remote registry handles its own storage/caching
 type contractInfo struct {
 	messages.TimeSorted
-	Address      string `json:"address"`
-	Path         string `json:"path"`
-	ABI          string `json:"abi"`
-	SwaggerURL   string `json:"openapi"`
-	RegisteredAs string `json:"registeredAs"`
+	Address        string                `json:"address"`
+	Path           string                `json:"path"`
+	ABI            string                `json:"abi"`
+	SwaggerURL     string                `json:"openapi"`
+	RegisteredAs   string                `json:"registeredAs"`
+	Environments   map[string]string     `json:"environments,omitempty"`
+	Tenant         string                `json:"tenant,omitempty"`
+	Unverified     bool                  `json:"unverified,omitempty"`
+	PreviousABIs   []*contractABIVersion `json:"previousABIs,omitempty"`
+	Implementation string                `json:"implementation,omitempty"`
+	messages.MethodAccess
 }
 
 // abiInfo is the minimal data structure we keep in memory, indexed by our own UUID
 type abiInfo struct {
 	messages.TimeSorted
-	ID              string `json:"id"`
-	Name            string `json:"name"`
-	Description     string `json:"description"`
-	Path            string `json:"path"`
-	Deployable      bool   `json:"deployable"`
-	SwaggerURL      string `json:"openapi"`
-	CompilerVersion string `json:"compilerVersion"`
+	ID              string                   `json:"id"`
+	Name            string                   `json:"name"`
+	Description     string                   `json:"description"`
+	Path            string                   `json:"path"`
+	Deployable      bool                     `json:"deployable"`
+	SwaggerURL      string                   `json:"openapi"`
+	CompilerVersion string                   `json:"compilerVersion"`
+	Unverified      bool                     `json:"unverified,omitempty"`
+	StaticAnalysis  *messages.StaticAnalysis `json:"staticAnalysis,omitempty"`
+	messages.CompilerOptions
+	messages.MethodAccess
 }
 
 // remoteContractInfo is the ABI raw data back out of the REST API gateway with bytecode
@@ -228,13 +369,17 @@ func (i *abiInfo) GetID() string {
 	return i.ID
 }
 
-func (g *smartContractGW) storeNewContractInfo(addrHexNo0x, abiID, pathName, registerAs string) (*contractInfo, error) {
+func (g *smartContractGW) storeNewContractInfo(addrHexNo0x, abiID, pathName, registerAs, environment, tenant string) (*contractInfo, error) {
+	if registerAs != "" && environment != "" {
+		return g.storeEnvironmentContractInfo(addrHexNo0x, abiID, registerAs, environment, tenant)
+	}
 	contractInfo := &contractInfo{
 		Address:      addrHexNo0x,
 		ABI:          abiID,
 		Path:         "/contracts/" + pathName,
 		SwaggerURL:   g.conf.BaseURL + "/contracts/" + pathName + "?swagger",
 		RegisteredAs: registerAs,
+		Tenant:       tenant,
 		TimeSorted: messages.TimeSorted{
 			CreatedISO8601: time.Now().UTC().Format(time.RFC3339),
 		},
@@ -245,16 +390,115 @@ func (g *smartContractGW) storeNewContractInfo(addrHexNo0x, abiID, pathName, reg
 	return contractInfo, nil
 }
 
+// storeEnvironmentContractInfo stores a contract instance registered with a friendly name for one
+// environment. There is a single registration for each name, which holds the address to use in
+// each environment. If the name is not registered yet, the new instance is registered with it, and
+// also used for any environment without an address of its own. Returns the stored instance
+func (g *smartContractGW) storeEnvironmentContractInfo(addrHexNo0x, abiID, registerAs, environment, tenant string) (*contractInfo, error) {
+	g.idxLock.Lock()
+	defer g.idxLock.Unlock()
+	if err := g.checkNameAvailable(registerAs, environment, false); err != nil {
+		return nil, err
+	}
+	info := &contractInfo{
+		Address: addrHexNo0x,
+		ABI:     abiID,
+		Tenant:  tenant,
+		TimeSorted: messages.TimeSorted{
+			CreatedISO8601: time.Now().UTC().Format(time.RFC3339),
+		},
+	}
+	registered, exists := g.contractRegistrations[registerAs]
+	if !exists {
+		info = g.withRegistration(info, registerAs, map[string]string{environment: addrHexNo0x})
+		if err := g.writeContractInfo(info); err != nil {
+			return nil, err
+		}
+		log.Infof("Registering %s as '%s' in environment '%s'", info.Address, registerAs, environment)
+		g.contractRegistrations[registerAs] = info
+		g.contractIndex[info.Address] = info
+		return info, nil
+	}
+	if existing, known := g.contractIndex[addrHexNo0x]; known && existing.(*contractInfo).RegisteredAs != "" && addrHexNo0x != registered.Address {
+		return nil, ethconnecterrors.Errorf(ethconnecterrors.RESTGatewayRegistrationTargetRegistered, addrHexNo0x, existing.(*contractInfo).RegisteredAs)
+	}
+	if registered.Address != addrHexNo0x {
+		info = g.withRegistration(info, "", nil)
+		if err := g.writeContractInfo(info); err != nil {
+			return nil, err
+		}
+		g.contractIndex[info.Address] = info
+	}
+	updated := g.withRegistration(registered, registerAs, environmentsWith(registered.Environments, environment, addrHexNo0x))
+	if err := g.writeContractInfo(updated); err != nil {
+		return nil, err
+	}
+	log.Infof("Registering %s as '%s' in environment '%s'", addrHexNo0x, registerAs, environment)
+	g.setRegistration(registered, updated)
+	if registered.Address == addrHexNo0x {
+		return updated, nil
+	}
+	return info, nil
+}
+
+// environmentsWith returns a copy of the environment addresses of a registration, with
+// the address for one environment set
+func environmentsWith(environments map[string]string, environment, addrHexNo0x string) map[string]string {
+	updated := make(map[string]string, len(environments)+1)
+	for env, addr := range environments {
+		updated[env] = addr
+	}
+	updated[environment] = addrHexNo0x
+	return updated
+}
+
+// environmentsWithout returns a copy of the environment addresses of a registration, with
+// the address for one environment removed
+func environmentsWithout(environments map[string]string, environment string) map[string]string {
+	updated := make(map[string]string, len(environments))
+	for env, addr := range environments {
+		if env != environment {
+			updated[env] = addr
+		}
+	}
+	if len(updated) == 0 {
+		return nil
+	}
+	return updated
+}
+
 func isRemote(msg messages.CommonHeaders) bool {
+	return contextFlag(msg, remoteRegistryContextKey)
+}
+
+func isReserved(msg messages.CommonHeaders) bool {
+	return contextFlag(msg, remoteRegistryReservedContextKey)
+}
+
+func contextFlag(msg messages.CommonHeaders, key string) bool {
 	ctxMap := msg.Context
-	if isRemoteGeneric, ok := ctxMap[remoteRegistryContextKey]; ok {
-		if isRemote, ok := isRemoteGeneric.(bool); ok {
-			return isRemote
+	if flagGeneric, ok := ctxMap[key]; ok {
+		if flag, ok := flagGeneric.(bool); ok {
+			return flag
 		}
 	}
 	return false
 }
 
+func tenantOf(msg messages.CommonHeaders) string {
+	tenant, _ := msg.Context[tenantContextKey].(string)
+	return tenant
+}
+
+// quotaErrStatus returns 403 if the error is because a tenant quota has been reached,
+// otherwise the supplied status
+func quotaErrStatus(err error, status int) int {
+	if _, ok := err.(*quotas.ExceededError); ok {
+		return 403
+	}
+	return status
+}
+
 // PostDeploy callback processes the transaction receipt and generates the Swagger
 func (g *smartContractGW) PostDeploy(msg *messages.TransactionReceipt) error {
 
@@ -284,11 +528,13 @@ func (g *smartContractGW) PostDeploy(msg *messages.TransactionReceipt) error {
 
 		var err error
 		if isRemote {
-			if msg.RegisterAs != "" {
-				err = g.rr.registerInstance(msg.RegisterAs, "0x"+addrHexNo0x)
+			if msg.RegisterAs != "" && isReserved(msg.Headers.CommonHeaders) {
+				err = g.rr.confirmInstance(msg.RegisterAs, msg.RegisterEnvironment, "0x"+addrHexNo0x)
+			} else if msg.RegisterAs != "" {
+				err = g.rr.registerInstance(msg.RegisterAs, msg.RegisterEnvironment, "0x"+addrHexNo0x)
 			}
 		} else {
-			_, err = g.storeNewContractInfo(addrHexNo0x, requestID, registeredName, msg.RegisterAs)
+			_, err = g.storeNewContractInfo(addrHexNo0x, requestID, registeredName, msg.RegisterAs, msg.RegisterEnvironment, tenantOf(msg.Headers.CommonHeaders))
 		}
 		return err
 	}
@@ -337,23 +583,47 @@ func (g *smartContractGW) storeContractInfo(info *contractInfo) error {
 	if err := g.addToContractIndex(info); err != nil {
 		return err
 	}
-	infoFile := path.Join(g.conf.StoragePath, "contract_"+info.Address+".instance.json")
+	return g.writeContractInfo(info)
+}
+
+func (g *smartContractGW) writeContractInfo(info *contractInfo) error {
 	instanceBytes, _ := json.MarshalIndent(info, "", "  ")
-	log.Infof("%s: Storing contract instance JSON to '%s'", info.ABI, infoFile)
-	if err := ioutil.WriteFile(infoFile, instanceBytes, 0664); err != nil {
+	log.Infof("%s: Storing contract instance JSON for '%s'", info.ABI, info.Address)
+	if err := g.store.put(registryKindContract, info.Address, instanceBytes); err != nil {
 		return ethconnecterrors.Errorf(ethconnecterrors.RESTGatewayLocalStoreContractSave, err)
 	}
+	opsevents.Publish(opsevents.RegistryChanged, map[string]interface{}{
+		"action":       "contractStored",
+		"address":      info.Address,
+		"abi":          info.ABI,
+		"registeredAs": info.RegisteredAs,
+	})
 	return nil
 }
 
-func (g *smartContractGW) resolveContractAddr(registeredName string) (string, error) {
+// resolveContractAddr looks up a registered name. A registration can hold a different
+// address for each environment, in which case the address for the environment of the request
+// (or the configured environment of this gateway) is used in preference to the default
+func (g *smartContractGW) resolveContractAddr(registeredName, environment string) (string, error) {
 	nameUnescaped, _ := url.QueryUnescape(registeredName)
+	if environment == "" {
+		environment = g.conf.Environment
+	}
+	g.idxLock.Lock()
 	info, exists := g.contractRegistrations[nameUnescaped]
+	addr := ""
+	if exists {
+		addr = info.Address
+		if envAddr, ok := info.Environments[environment]; ok && environment != "" {
+			addr = envAddr
+		}
+	}
+	g.idxLock.Unlock()
 	if !exists {
 		return "", ethconnecterrors.Errorf(ethconnecterrors.RESTGatewayLocalStoreContractLoad, registeredName)
 	}
-	log.Infof("%s -> 0x%s", registeredName, info.Address)
-	return info.Address, nil
+	log.Infof("%s [%s] -> 0x%s", registeredName, environment, addr)
+	return addr, nil
 }
 
 func (g *smartContractGW) loadDeployMsgForInstance(addrHex string) (*messages.DeployContract, *contractInfo, error) {
@@ -366,16 +636,48 @@ func (g *smartContractGW) loadDeployMsgForInstance(addrHex string) (*messages.De
 	return deployMsg, info.(*contractInfo), err
 }
 
+// ResolveEventABIs returns the events of the ABI registered locally for a contract instance,
+// so the processor can decode logs emitted by that contract into receipts
+func (g *smartContractGW) ResolveEventABIs(addr *ethbinding.Address) []*ethbinding.ABIEvent {
+	g.idxLock.Lock()
+	deployMsg, _, err := g.loadDeployMsgForInstance(addr.Hex())
+	g.idxLock.Unlock()
+	if err != nil {
+		log.Debugf("No ABI to decode events from %s: %s", addr.Hex(), err)
+		return nil
+	}
+	events, err := eth.EventABIs(deployMsg.ABI)
+	if err != nil {
+		log.Warnf("Failed to parse events in ABI of %s: %s", addr.Hex(), err)
+	}
+	return events
+}
+
+// ResolveErrorABIs returns the custom errors of the ABI registered locally for a contract
+// instance, so the processor can decode the reason a transaction to that contract reverted
+func (g *smartContractGW) ResolveErrorABIs(addr *ethbinding.Address) ethbinding.ABIMarshaling {
+	g.idxLock.Lock()
+	deployMsg, _, err := g.loadDeployMsgForInstance(addr.Hex())
+	g.idxLock.Unlock()
+	if err != nil {
+		log.Debugf("No ABI to decode errors from %s: %s", addr.Hex(), err)
+		return nil
+	}
+	return eth.ErrorABIs(deployMsg.ABI)
+}
+
 func (g *smartContractGW) loadDeployMsgByID(id string) (*messages.DeployContract, *abiInfo, error) {
 	var info *abiInfo
 	var msg *messages.DeployContract
 	ts, exists := g.abiIndex[id]
 	if !exists {
+		if msg, info, ok := g.loadWellKnownABI(id); ok {
+			return msg, info, nil
+		}
 		log.Infof("ABI with ID %s not found locally", id)
 		return nil, nil, ethconnecterrors.Errorf(ethconnecterrors.RESTGatewayLocalStoreABINotFound, id)
 	}
-	deployFile := path.Join(g.conf.StoragePath, "abi_"+id+".deploy.json")
-	deployBytes, err := ioutil.ReadFile(deployFile)
+	deployBytes, err := g.store.get(registryKindABI, id)
 	if err != nil {
 		return nil, nil, ethconnecterrors.Errorf(ethconnecterrors.RESTGatewayLocalStoreABILoad, id, err)
 	}
@@ -396,7 +698,14 @@ func (g *smartContractGW) PreDeploy(msg *messages.DeployContract) (err error) {
 	solidity := msg.Solidity
 	var compiled *eth.CompiledSolidity
 	if solidity != "" {
-		if compiled, err = eth.CompileContract(solidity, msg.ContractName, msg.CompilerVersion, msg.EVMVersion); err != nil {
+		if compiled, err = eth.CompileContract(solidity, msg.ContractName, msg.CompilerVersion, &msg.CompilerOptions); err != nil {
+			return err
+		}
+		msg.ContractName = compiled.ContractName
+		if err = g.analyzeSolidity(msg); err != nil {
+			return err
+		}
+		if err = g.checkStaticAnalysis(msg); err != nil {
 			return err
 		}
 	}
@@ -414,11 +723,13 @@ func (g *smartContractGW) storeDeployableABI(msg *messages.DeployContract, compi
 		msg.DevDoc = compiled.DevDoc
 		msg.ContractName = compiled.ContractName
 		msg.CompilerVersion = compiled.ContractInfo.CompilerVersion
+		// Record the exact options passed to solc, so the build can be reproduced
+		msg.CompilerOptions = *eth.CompilerOptionsWithDefaults(&msg.CompilerOptions)
 	} else if msg.ABI == nil {
 		return nil, ethconnecterrors.Errorf(ethconnecterrors.RESTGatewayLocalStoreMissingABI)
 	}
 
-	runtimeABI, err := ethbind.API.ABIMarshalingToABIRuntime(msg.ABI)
+	runtimeABI, err := eth.RuntimeABI(msg.ABI)
 	if err != nil {
 		return nil, ethconnecterrors.Errorf(ethconnecterrors.RESTGatewayInvalidABI, err)
 	}
@@ -427,7 +738,9 @@ func (g *smartContractGW) storeDeployableABI(msg *messages.DeployContract, compi
 	// We store the swagger in a generic format that can be used to deploy
 	// additional instances, or generically call other instances
 	// Generate and store the swagger
-	swagger := g.swaggerForABI(openapi.NewABI2Swagger(g.baseSwaggerConf), requestID, msg.ContractName, false, runtimeABI, msg.DevDoc, "", "")
+	swaggerGen := openapi.NewABI2Swagger(g.baseSwaggerConf)
+	swaggerGen.SetCustomErrors(eth.ErrorABIs(msg.ABI))
+	swagger := g.swaggerForABI(swaggerGen, requestID, msg.ContractName, false, runtimeABI, msg.DevDoc, "", "")
 	msg.Description = swagger.Info.Description // Swagger generation parses the devdoc
 	info := g.addToABIIndex(requestID, msg, time.Now().UTC())
 
@@ -453,21 +766,84 @@ func (g *smartContractGW) gatewayErrReply(res http.ResponseWriter, req *http.Req
 
 func (g *smartContractGW) writeAbiInfo(requestID string, msg *messages.DeployContract) error {
 	// We store all the details from our compile, or the user-supplied
-	// details, in a file under the message ID.
-	infoFile := path.Join(g.conf.StoragePath, "abi_"+requestID+".deploy.json")
+	// details, in the registry storage under the message ID.
 	infoBytes, _ := json.MarshalIndent(msg, "", "  ")
-	log.Infof("%s: Stashing deployment details to '%s'", requestID, infoFile)
-	if err := ioutil.WriteFile(infoFile, infoBytes, 0664); err != nil {
+	log.Infof("%s: Stashing deployment details", requestID)
+	if err := g.store.put(registryKindABI, requestID, infoBytes); err != nil {
 		return ethconnecterrors.Errorf(ethconnecterrors.RESTGatewayLocalStoreContractSavePostDeploy, requestID, err)
 	}
+	opsevents.Publish(opsevents.RegistryChanged, map[string]interface{}{
+		"action": "abiStored",
+		"abi":    requestID,
+	})
 	return nil
 }
 
 func (g *smartContractGW) buildIndex() {
 	log.Infof("Building installed smart contract index")
+	if err := g.loadIndexEntries(false); err != nil {
+		log.Errorf("Failed to list the registry storage: %s", err)
+		return
+	}
+	if _, isFileStore := g.store.(*fileRegistryStore); isFileStore {
+		g.migrateLegacyContracts()
+	}
+	log.Infof("Smart contract index built. %d entries", len(g.contractIndex))
+}
+
+// loadIndexEntries adds the ABIs, then the contract instances, from the registry storage to the
+// index. When onlyNew is set, entries already in the index are not reloaded
+func (g *smartContractGW) loadIndexEntries(onlyNew bool) error {
+	abis, err := g.store.list(registryKindABI)
+	if err != nil {
+		return err
+	}
+	for _, entry := range abis {
+		g.idxLock.Lock()
+		_, exists := g.abiIndex[entry.ID]
+		g.idxLock.Unlock()
+		if !onlyNew || !exists {
+			g.addStoredABIToIndex(entry.ID, entry.Modified)
+		}
+	}
+	contracts, err := g.store.list(registryKindContract)
+	if err != nil {
+		return err
+	}
+	for _, entry := range contracts {
+		g.idxLock.Lock()
+		_, exists := g.contractIndex[entry.ID]
+		g.idxLock.Unlock()
+		if !onlyNew || !exists {
+			g.addStoredContractToIndex(entry.ID)
+		}
+	}
+	return nil
+}
+
+// refreshIndexLoop periodically loads entries added to shared storage by other gateways
+func (g *smartContractGW) refreshIndexLoop() {
+	interval := g.conf.Storage.RefreshIntervalSec
+	if interval == 0 {
+		interval = defaultRegistryRefreshIntervalSec
+	}
+	ticker := time.NewTicker(time.Duration(interval) * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-g.refreshDone:
+			return
+		case <-ticker.C:
+			if err := g.loadIndexEntries(true); err != nil {
+				log.Warnf("Failed to refresh the smart contract index: %s", err)
+			}
+		}
+	}
+}
+
+// migrateLegacyContracts converts Swagger files written by earlier versions into contract instances
+func (g *smartContractGW) migrateLegacyContracts() {
 	legacyContractMatcher, _ := regexp.Compile("^contract_([0-9a-z]{40})\\.swagger\\.json$")
-	instanceMatcher, _ := regexp.Compile("^contract_([0-9a-z]{40})\\.instance\\.json$")
-	abiMatcher, _ := regexp.Compile("^abi_([0-9a-z-]+)\\.deploy.json$")
 	files, err := ioutil.ReadDir(g.conf.StoragePath)
 	if err != nil {
 		log.Errorf("Failed to read directory %s: %s", g.conf.StoragePath, err)
@@ -475,18 +851,10 @@ func (g *smartContractGW) buildIndex() {
 	}
 	for _, file := range files {
 		fileName := file.Name()
-		legacyContractGroups := legacyContractMatcher.FindStringSubmatch(fileName)
-		abiGroups := abiMatcher.FindStringSubmatch(fileName)
-		instanceGroups := instanceMatcher.FindStringSubmatch(fileName)
-		if legacyContractGroups != nil {
+		if legacyContractGroups := legacyContractMatcher.FindStringSubmatch(fileName); legacyContractGroups != nil {
 			g.migrateLegacyContract(legacyContractGroups[1], path.Join(g.conf.StoragePath, fileName), file.ModTime())
-		} else if instanceGroups != nil {
-			g.addFileToContractIndex(instanceGroups[1], path.Join(g.conf.StoragePath, fileName))
-		} else if abiGroups != nil {
-			g.addFileToABIIndex(abiGroups[1], path.Join(g.conf.StoragePath, fileName), file.ModTime())
 		}
 	}
-	log.Infof("Smart contract index built. %d entries", len(g.contractIndex))
 }
 
 func (g *smartContractGW) migrateLegacyContract(address, fileName string, createdTime time.Time) {
@@ -511,7 +879,7 @@ func (g *smartContractGW) migrateLegacyContract(address, fileName string, create
 		registeredAs = ext.(string)
 	}
 	if ext, exists := swagger.Info.Extensions["x-firefly-deployment-id"]; exists {
-		_, err := g.storeNewContractInfo(address, ext.(string), address, registeredAs)
+		_, err := g.storeNewContractInfo(address, ext.(string), address, registeredAs, "", "")
 		if err != nil {
 			log.Errorf("Failed to write migrated instance file: %s", err)
 			return
@@ -527,60 +895,80 @@ func (g *smartContractGW) migrateLegacyContract(address, fileName string, create
 
 }
 
-func (g *smartContractGW) addFileToContractIndex(address, fileName string) {
-	contractFile, err := os.OpenFile(fileName, os.O_RDONLY, 0)
+func (g *smartContractGW) addStoredContractToIndex(address string) {
+	contractBytes, err := g.store.get(registryKindContract, address)
 	if err != nil {
-		log.Errorf("Failed to load contract instance file %s: %s", fileName, err)
+		log.Errorf("Failed to load contract instance %s: %s", address, err)
 		return
 	}
-	defer contractFile.Close()
 	var contractInfo contractInfo
-	err = json.NewDecoder(bufio.NewReader(contractFile)).Decode(&contractInfo)
+	err = json.Unmarshal(contractBytes, &contractInfo)
 	if err != nil {
-		log.Errorf("Failed to parse contract instnace deployment file %s: %s", fileName, err)
+		log.Errorf("Failed to parse contract instance deployment %s: %s", address, err)
 		return
 	}
 	g.addToContractIndex(&contractInfo)
 }
 
-func (g *smartContractGW) addFileToABIIndex(id, fileName string, createdTime time.Time) {
-	deployFile, err := os.OpenFile(fileName, os.O_RDONLY, 0)
+func (g *smartContractGW) addStoredABIToIndex(id string, createdTime time.Time) {
+	deployBytes, err := g.store.get(registryKindABI, id)
 	if err != nil {
-		log.Errorf("Failed to load ABI deployment file %s: %s", fileName, err)
+		log.Errorf("Failed to load ABI deployment %s: %s", id, err)
 		return
 	}
-	defer deployFile.Close()
 	var deployMsg messages.DeployContract
-	err = json.NewDecoder(bufio.NewReader(deployFile)).Decode(&deployMsg)
+	err = json.Unmarshal(deployBytes, &deployMsg)
 	if err != nil {
-		log.Errorf("Failed to parse ABI deployment file %s: %s", fileName, err)
+		log.Errorf("Failed to parse ABI deployment %s: %s", id, err)
 		return
 	}
 	g.addToABIIndex(id, &deployMsg, createdTime)
 }
 
-func (g *smartContractGW) checkNameAvailable(registerAs string, isRemote bool) error {
+func (g *smartContractGW) checkNameAvailable(registerAs, environment string, isRemote bool) error {
 	if isRemote {
-		msg, err := g.rr.loadFactoryForInstance(registerAs, false)
+		msg, err := g.rr.loadFactoryForInstance(registerAs, environment, false)
 		if err != nil {
 			return err
+		} else if msg != nil && environment != "" {
+			return ethconnecterrors.Errorf(ethconnecterrors.RESTGatewayFriendlyNameEnvironmentClash, msg.Address, registerAs, environment)
 		} else if msg != nil {
 			return ethconnecterrors.Errorf(ethconnecterrors.RESTGatewayFriendlyNameClash, msg.Address, registerAs)
 		}
 		return nil
 	}
-	if existing, exists := g.contractRegistrations[registerAs]; exists {
+	existing, exists := g.contractRegistrations[registerAs]
+	if exists && environment != "" {
+		if addr, mapped := existing.Environments[environment]; mapped {
+			return ethconnecterrors.Errorf(ethconnecterrors.RESTGatewayFriendlyNameEnvironmentClash, addr, registerAs, environment)
+		}
+		return nil
+	}
+	if exists {
 		return ethconnecterrors.Errorf(ethconnecterrors.RESTGatewayFriendlyNameClash, existing.Address, registerAs)
 	}
 	return nil
 }
 
+// checkContractQuota checks the tenant can register another contract instance
+func (g *smartContractGW) checkContractQuota(tenant string) error {
+	g.idxLock.Lock()
+	defer g.idxLock.Unlock()
+	count := 0
+	for _, c := range g.contractIndex {
+		if info, ok := c.(*contractInfo); ok && info.Tenant == tenant {
+			count++
+		}
+	}
+	return g.conf.Quotas.Check(tenant, quotas.Contracts, count)
+}
+
 func (g *smartContractGW) addToContractIndex(info *contractInfo) error {
 	g.idxLock.Lock()
 	defer g.idxLock.Unlock()
 	if info.RegisteredAs != "" {
 		// Protect against overwrite
-		if err := g.checkNameAvailable(info.RegisteredAs, false); err != nil {
+		if err := g.checkNameAvailable(info.RegisteredAs, "", false); err != nil {
 			return err
 		}
 		log.Infof("Registering %s as '%s'", info.Address, info.RegisteredAs)
@@ -590,6 +978,239 @@ func (g *smartContractGW) addToContractIndex(info *contractInfo) error {
 	return nil
 }
 
+// lookupRegistration finds the contract registered with a friendly name, checking it holds an
+// address for the specified environment if there is one. Must be called holding the idxLock
+func (g *smartContractGW) lookupRegistration(name, environment string) (*contractInfo, error) {
+	info, exists := g.contractRegistrations[name]
+	if environment == "" {
+		if !exists {
+			return nil, ethconnecterrors.Errorf(ethconnecterrors.RESTGatewayRegistrationNotFound, name)
+		}
+		return info, nil
+	}
+	if _, mapped := info.Environments[environment]; !exists || !mapped {
+		return nil, ethconnecterrors.Errorf(ethconnecterrors.RESTGatewayRegistrationNotFoundInEnvironment, name, environment)
+	}
+	return info, nil
+}
+
+// withRegistration returns a copy of the contract info registered with the supplied friendly name
+// and environment addresses, or with no friendly name (so only addressable by its address) if
+// registerAs is empty
+func (g *smartContractGW) withRegistration(info *contractInfo, registerAs string, environments map[string]string) *contractInfo {
+	pathName := registerAs
+	if pathName == "" {
+		pathName = info.Address
+		environments = nil
+	}
+	updated := *info
+	updated.RegisteredAs = registerAs
+	updated.Environments = environments
+	updated.Path = "/contracts/" + pathName
+	updated.SwaggerURL = g.conf.BaseURL + "/contracts/" + pathName + "?swagger"
+	return &updated
+}
+
+// setRegistration updates the indexes for a contract after its registration has changed.
+// Must be called holding the idxLock
+func (g *smartContractGW) setRegistration(previous, updated *contractInfo) {
+	if previous.RegisteredAs != "" {
+		delete(g.contractRegistrations, previous.RegisteredAs)
+	}
+	if updated.RegisteredAs != "" {
+		g.contractRegistrations[updated.RegisteredAs] = updated
+	}
+	g.contractIndex[updated.Address] = updated
+}
+
+// removeRegistration removes the friendly name alias for a contract instance, leaving
+// the instance itself available by its address. With an environment, only the address
+// for that environment is removed from the registration
+func (g *smartContractGW) removeRegistration(name, environment string) (*contractInfo, error) {
+	g.idxLock.Lock()
+	defer g.idxLock.Unlock()
+	info, err := g.lookupRegistration(name, environment)
+	if err != nil {
+		return nil, err
+	}
+	var updated *contractInfo
+	if environment != "" {
+		updated = g.withRegistration(info, name, environmentsWithout(info.Environments, environment))
+	} else {
+		updated = g.withRegistration(info, "", nil)
+	}
+	if err := g.writeContractInfo(updated); err != nil {
+		return nil, err
+	}
+	if environment != "" {
+		log.Infof("Removed environment '%s' from registration '%s'", environment, name)
+	} else {
+		log.Infof("Removed registration of %s as '%s'", info.Address, name)
+	}
+	g.setRegistration(info, updated)
+	return updated, nil
+}
+
+// renameRegistration atomically moves a friendly name from the contract instance it is
+// currently registered to, to a different contract instance, along with the addresses it
+// holds for each environment. With an environment, only the address for that environment
+// is changed
+func (g *smartContractGW) renameRegistration(name, environment, toAddrHexNo0x string) (*contractInfo, int, error) {
+	g.idxLock.Lock()
+	defer g.idxLock.Unlock()
+	from, err := g.lookupRegistration(name, environment)
+	if err != nil {
+		return nil, 404, err
+	}
+	toIdx, exists := g.contractIndex[toAddrHexNo0x]
+	if !exists {
+		return nil, 409, ethconnecterrors.Errorf(ethconnecterrors.RESTGatewayLocalStoreContractNotFound, toAddrHexNo0x)
+	}
+	to := toIdx.(*contractInfo)
+	if environment != "" {
+		return g.renameEnvironmentRegistration(from, environment, to)
+	}
+	if to.Address == from.Address {
+		return from, 200, nil
+	}
+	if to.RegisteredAs != "" {
+		return nil, 409, ethconnecterrors.Errorf(ethconnecterrors.RESTGatewayRegistrationTargetRegistered, to.Address, to.RegisteredAs)
+	}
+	updatedFrom := g.withRegistration(from, "", nil)
+	updatedTo := g.withRegistration(to, from.RegisteredAs, from.Environments)
+	if err := g.writeContractInfo(updatedTo); err != nil {
+		return nil, 500, err
+	}
+	if err := g.writeContractInfo(updatedFrom); err != nil {
+		// Restore the target, so the name is not left registered to both instances on disk
+		if restoreErr := g.writeContractInfo(to); restoreErr != nil {
+			log.Errorf("Failed to restore contract instance %s: %s", to.Address, restoreErr)
+		}
+		return nil, 500, err
+	}
+	log.Infof("Moved registration '%s' from %s to %s", name, from.Address, to.Address)
+	g.setRegistration(from, updatedFrom)
+	g.setRegistration(to, updatedTo)
+	return updatedTo, 200, nil
+}
+
+// renameEnvironmentRegistration changes the address a registration holds for one environment.
+// Must be called holding the idxLock
+func (g *smartContractGW) renameEnvironmentRegistration(registration *contractInfo, environment string, to *contractInfo) (*contractInfo, int, error) {
+	if registration.Environments[environment] == to.Address {
+		return registration, 200, nil
+	}
+	if to.RegisteredAs != "" && to.Address != registration.Address {
+		return nil, 409, ethconnecterrors.Errorf(ethconnecterrors.RESTGatewayRegistrationTargetRegistered, to.Address, to.RegisteredAs)
+	}
+	updated := g.withRegistration(registration, registration.RegisteredAs, environmentsWith(registration.Environments, environment, to.Address))
+	if err := g.writeContractInfo(updated); err != nil {
+		return nil, 500, err
+	}
+	log.Infof("Moved registration '%s' in environment '%s' from %s to %s", registration.RegisteredAs, environment, registration.Environments[environment], to.Address)
+	g.setRegistration(registration, updated)
+	return updated, 200, nil
+}
+
+// checkContractUnused checks no subscription is listening to the events of a contract instance
+func (g *smartContractGW) checkContractUnused(ctx context.Context, addrHexNo0x string) error {
+	if g.sm == nil {
+		return nil
+	}
+	for _, sub := range g.sm.Subscriptions(ctx) {
+		for _, addr := range sub.Filter.Addresses {
+			if strings.TrimPrefix(strings.ToLower(addr.String()), "0x") == addrHexNo0x {
+				return ethconnecterrors.Errorf(ethconnecterrors.RESTGatewayContractInUse, addrHexNo0x, sub.ID)
+			}
+		}
+	}
+	return nil
+}
+
+// removeContract deletes a contract instance from the registry storage, and removes it from
+// the index along with any friendly name it is registered with
+func (g *smartContractGW) removeContract(addrHexNo0x string) error {
+	g.idxLock.Lock()
+	defer g.idxLock.Unlock()
+	idx, exists := g.contractIndex[addrHexNo0x]
+	if !exists {
+		return ethconnecterrors.Errorf(ethconnecterrors.RESTGatewayLocalStoreContractNotFound, addrHexNo0x)
+	}
+	info := idx.(*contractInfo)
+	if err := g.store.delete(registryKindContract, addrHexNo0x); err != nil {
+		return ethconnecterrors.Errorf(ethconnecterrors.RESTGatewayLocalStoreContractDelete, addrHexNo0x, err)
+	}
+	if info.RegisteredAs != "" {
+		delete(g.contractRegistrations, info.RegisteredAs)
+	}
+	delete(g.contractIndex, addrHexNo0x)
+	g.removeEnvironmentAddress(addrHexNo0x)
+	log.Infof("Deleted contract instance %s", addrHexNo0x)
+	opsevents.Publish(opsevents.RegistryChanged, map[string]interface{}{
+		"action":  "contractDeleted",
+		"address": addrHexNo0x,
+	})
+	return nil
+}
+
+// removeEnvironmentAddress removes a deleted contract instance from the environments of any
+// registration that holds its address. Must be called holding the idxLock
+func (g *smartContractGW) removeEnvironmentAddress(addrHexNo0x string) {
+	for name, registration := range g.contractRegistrations {
+		environments := registration.Environments
+		for env, addr := range registration.Environments {
+			if addr == addrHexNo0x {
+				environments = environmentsWithout(environments, env)
+			}
+		}
+		if len(environments) == len(registration.Environments) {
+			continue
+		}
+		updated := g.withRegistration(registration, name, environments)
+		if err := g.writeContractInfo(updated); err != nil {
+			log.Errorf("Failed to remove %s from the environments of registration '%s': %s", addrHexNo0x, name, err)
+			continue
+		}
+		g.setRegistration(registration, updated)
+	}
+}
+
+// checkABIUnused checks no contract instances are registered against an ABI. Must be called
+// holding the idxLock
+func (g *smartContractGW) checkABIUnused(id string) error {
+	for _, c := range g.contractIndex {
+		if info, ok := c.(*contractInfo); ok && info.ABI == id {
+			return ethconnecterrors.Errorf(ethconnecterrors.RESTGatewayABIInUse, id, info.Address)
+		}
+	}
+	return nil
+}
+
+// removeABI deletes an ABI, and its source if it has one, from the registry storage and the index
+func (g *smartContractGW) removeABI(id string) error {
+	g.idxLock.Lock()
+	defer g.idxLock.Unlock()
+	if _, exists := g.abiIndex[id]; !exists {
+		return ethconnecterrors.Errorf(ethconnecterrors.RESTGatewayLocalStoreABINotFound, id)
+	}
+	if err := g.checkABIUnused(id); err != nil {
+		return err
+	}
+	if err := g.store.delete(registryKindABI, id); err != nil {
+		return ethconnecterrors.Errorf(ethconnecterrors.RESTGatewayLocalStoreABIDelete, id, err)
+	}
+	if err := g.store.delete(registryKindSource, id); err != nil {
+		log.Warnf("Failed to delete source of ABI %s: %s", id, err)
+	}
+	delete(g.abiIndex, id)
+	log.Infof("Deleted ABI %s", id)
+	opsevents.Publish(opsevents.RegistryChanged, map[string]interface{}{
+		"action": "abiDeleted",
+		"abi":    id,
+	})
+	return nil
+}
+
 func (g *smartContractGW) addToABIIndex(id string, deployMsg *messages.DeployContract, createdTime time.Time) *abiInfo {
 	g.idxLock.Lock()
 	info := &abiInfo{
@@ -598,6 +1219,10 @@ func (g *smartContractGW) addToABIIndex(id string, deployMsg *messages.DeployCon
 		Description:     deployMsg.Description,
 		Deployable:      len(deployMsg.Compiled) > 0,
 		CompilerVersion: deployMsg.CompilerVersion,
+		CompilerOptions: deployMsg.CompilerOptions,
+		MethodAccess:    deployMsg.MethodAccess,
+		StaticAnalysis:  deployMsg.StaticAnalysis,
+		Unverified:      strings.HasPrefix(id, inferredABIPrefix),
 		Path:            "/abis/" + id,
 		SwaggerURL:      g.conf.BaseURL + "/abis/" + id + "?swagger",
 		TimeSorted: messages.TimeSorted{
@@ -614,12 +1239,19 @@ func (g *smartContractGW) listContractsOrABIs(res http.ResponseWriter, req *http
 	log.Infof("--> %s %s", req.Method, req.URL)
 
 	var index map[string]messages.TimeSortable
-	if strings.HasSuffix(req.URL.Path, "contracts") {
+	isContracts := strings.HasSuffix(req.URL.Path, "contracts")
+	if isContracts {
 		index = g.contractIndex
 	} else {
 		index = g.abiIndex
 	}
 
+	filter, err := parseListFilter(req, isContracts)
+	if err != nil {
+		g.gatewayErrReply(res, req, err, 400)
+		return
+	}
+
 	// Get an array copy of the current list
 	g.idxLock.Lock()
 	retval := make([]messages.TimeSortable, 0, len(index))
@@ -628,14 +1260,13 @@ func (g *smartContractGW) listContractsOrABIs(res http.ResponseWriter, req *http
 	}
 	g.idxLock.Unlock()
 
-	// Do the sort by Title then Address
-	sort.Slice(retval, func(i, j int) bool {
-		return retval[i].IsLessThan(retval[i], retval[j])
-	})
+	// Filter, sort (newest first by default) and page the results
+	retval, total := filter.apply(retval)
 
 	status := 200
 	log.Infof("<-- %s %s [%d]", req.Method, req.URL, status)
 	res.Header().Set("Content-Type", "application/json")
+	res.Header().Set(listTotalCountHeader, strconv.Itoa(total))
 	res.WriteHeader(status)
 	enc := json.NewEncoder(res)
 	enc.SetIndent("", "  ")
@@ -656,24 +1287,451 @@ func (g *smartContractGW) createStream(res http.ResponseWriter, req *http.Reques
 		g.gatewayErrReply(res, req, ethconnecterrors.Errorf(ethconnecterrors.RESTGatewayEventStreamInvalid, err), 400)
 		return
 	}
-
-	newSpec, err := g.sm.AddStream(req.Context(), &spec)
+
+	newSpec, err := g.sm.AddStream(req.Context(), &spec)
+	if err != nil {
+		g.gatewayErrReply(res, req, err, quotaErrStatus(err, 400))
+		return
+	}
+
+	status := 200
+	log.Infof("<-- %s %s [%d]", req.Method, req.URL, status)
+	res.Header().Set("Content-Type", "application/json")
+	res.WriteHeader(status)
+	enc := json.NewEncoder(res)
+	enc.SetIndent("", "  ")
+	enc.Encode(&newSpec)
+}
+
+// updateStream updates a stream
+func (g *smartContractGW) updateStream(res http.ResponseWriter, req *http.Request, params httprouter.Params) {
+	log.Infof("--> %s %s", req.Method, req.URL)
+
+	if g.sm == nil {
+		g.gatewayErrReply(res, req, errors.New(errEventSupportMissing), 405)
+		return
+	}
+
+	streamID := params.ByName("id")
+	_, err := g.sm.StreamByID(req.Context(), streamID)
+	if err != nil {
+		g.gatewayErrReply(res, req, err, 404)
+		return
+	}
+	var spec events.StreamInfo
+	if err := json.NewDecoder(req.Body).Decode(&spec); err != nil {
+		g.gatewayErrReply(res, req, ethconnecterrors.Errorf(ethconnecterrors.RESTGatewayEventStreamInvalid, err), 400)
+		return
+	}
+	newSpec, err := g.sm.UpdateStream(req.Context(), streamID, &spec)
+	if err != nil {
+		g.gatewayErrReply(res, req, err, 500)
+		return
+	}
+
+	status := 200
+	log.Infof("<-- %s %s [%d]", req.Method, req.URL, status)
+	res.Header().Set("Content-Type", "application/json")
+	res.WriteHeader(status)
+	enc := json.NewEncoder(res)
+	enc.SetIndent("", "  ")
+	enc.Encode(&newSpec)
+}
+
+// listStreamsOrSubs sorts by Title then Address and returns an array
+func (g *smartContractGW) listStreamsOrSubs(res http.ResponseWriter, req *http.Request, params httprouter.Params) {
+	log.Infof("--> %s %s", req.Method, req.URL)
+
+	if g.sm == nil {
+		g.gatewayErrReply(res, req, errors.New(errEventSupportMissing), 405)
+		return
+	}
+
+	var results []messages.TimeSortable
+	if strings.HasPrefix(req.URL.Path, events.SubPathPrefix) {
+		subs := g.sm.Subscriptions(req.Context())
+		results = make([]messages.TimeSortable, len(subs))
+		for i := range subs {
+			results[i] = subs[i]
+		}
+	} else if strings.HasPrefix(req.URL.Path, events.BackfillPathPrefix) {
+		backfills := g.sm.Backfills(req.Context())
+		results = make([]messages.TimeSortable, len(backfills))
+		for i := range backfills {
+			results[i] = backfills[i]
+		}
+	} else if strings.HasPrefix(req.URL.Path, events.InvalidationPathPrefix) {
+		hooks := g.sm.InvalidationHooks(req.Context())
+		results = make([]messages.TimeSortable, len(hooks))
+		for i := range hooks {
+			results[i] = hooks[i]
+		}
+	} else if strings.HasPrefix(req.URL.Path, events.CheckpointGroupPathPrefix) {
+		groups := g.sm.CheckpointGroups(req.Context())
+		results = make([]messages.TimeSortable, len(groups))
+		for i := range groups {
+			results[i] = groups[i]
+		}
+	} else {
+		streams := g.sm.Streams(req.Context())
+		results = make([]messages.TimeSortable, len(streams))
+		for i := range streams {
+			results[i] = streams[i]
+		}
+	}
+
+	// Do the sort
+	sort.Slice(results, func(i, j int) bool {
+		return results[i].IsLessThan(results[i], results[j])
+	})
+
+	status := 200
+	log.Infof("<-- %s %s [%d]", req.Method, req.URL, status)
+	res.Header().Set("Content-Type", "application/json")
+	res.WriteHeader(status)
+	enc := json.NewEncoder(res)
+	enc.SetIndent("", "  ")
+	enc.Encode(&results)
+}
+
+// getStreamOrSub returns stream over REST
+func (g *smartContractGW) getStreamOrSub(res http.ResponseWriter, req *http.Request, params httprouter.Params) {
+	log.Infof("--> %s %s", req.Method, req.URL)
+
+	if g.sm == nil {
+		g.gatewayErrReply(res, req, errors.New(errEventSupportMissing), 405)
+		return
+	}
+
+	var retval interface{}
+	var err error
+	if strings.HasPrefix(req.URL.Path, events.SubPathPrefix) {
+		retval, err = g.sm.SubscriptionByID(req.Context(), params.ByName("id"))
+	} else if strings.HasPrefix(req.URL.Path, events.BackfillPathPrefix) {
+		retval, err = g.sm.BackfillByID(req.Context(), params.ByName("id"))
+	} else if strings.HasPrefix(req.URL.Path, events.InvalidationPathPrefix) {
+		retval, err = g.sm.InvalidationHookByID(req.Context(), params.ByName("id"))
+	} else if strings.HasPrefix(req.URL.Path, events.CheckpointGroupPathPrefix) {
+		retval, err = g.sm.CheckpointGroupByID(req.Context(), params.ByName("id"))
+	} else {
+		retval, err = g.sm.StreamByID(req.Context(), params.ByName("id"))
+	}
+	if err != nil {
+		g.gatewayErrReply(res, req, err, 404)
+		return
+	}
+
+	status := 200
+	log.Infof("<-- %s %s [%d]", req.Method, req.URL, status)
+	res.Header().Set("Content-Type", "application/json")
+	res.WriteHeader(status)
+	enc := json.NewEncoder(res)
+	enc.SetIndent("", "  ")
+	enc.Encode(retval)
+}
+
+// deleteStreamOrSub deletes stream over REST
+func (g *smartContractGW) deleteStreamOrSub(res http.ResponseWriter, req *http.Request, params httprouter.Params) {
+	log.Infof("--> %s %s", req.Method, req.URL)
+
+	if g.sm == nil {
+		g.gatewayErrReply(res, req, errors.New(errEventSupportMissing), 405)
+		return
+	}
+
+	var err error
+	if strings.HasPrefix(req.URL.Path, events.SubPathPrefix) {
+		err = g.sm.DeleteSubscription(req.Context(), params.ByName("id"))
+	} else if strings.HasPrefix(req.URL.Path, events.BackfillPathPrefix) {
+		err = g.sm.DeleteBackfill(req.Context(), params.ByName("id"))
+	} else if strings.HasPrefix(req.URL.Path, events.InvalidationPathPrefix) {
+		err = g.sm.DeleteInvalidationHook(req.Context(), params.ByName("id"))
+	} else if strings.HasPrefix(req.URL.Path, events.CheckpointGroupPathPrefix) {
+		err = g.sm.DeleteCheckpointGroup(req.Context(), params.ByName("id"))
+	} else {
+		err = g.sm.DeleteStream(req.Context(), params.ByName("id"))
+	}
+	if err != nil {
+		g.gatewayErrReply(res, req, err, 500)
+		return
+	}
+
+	status := 204
+	log.Infof("<-- %s %s [%d]", req.Method, req.URL, status)
+	res.Header().Set("Content-Type", "application/json")
+	res.WriteHeader(status)
+}
+
+// createBackfill starts a one-time job to deliver historical events
+func (g *smartContractGW) createBackfill(res http.ResponseWriter, req *http.Request, params httprouter.Params) {
+	log.Infof("--> %s %s", req.Method, req.URL)
+
+	if g.sm == nil {
+		g.gatewayErrReply(res, req, errors.New(errEventSupportMissing), 405)
+		return
+	}
+
+	var spec events.BackfillInfo
+	if err := json.NewDecoder(req.Body).Decode(&spec); err != nil {
+		g.gatewayErrReply(res, req, ethconnecterrors.Errorf(ethconnecterrors.RESTGatewayBackfillInvalid, err), 400)
+		return
+	}
+
+	newSpec, err := g.sm.AddBackfill(req.Context(), &spec)
+	if err != nil {
+		g.gatewayErrReply(res, req, err, 400)
+		return
+	}
+
+	status := 202
+	log.Infof("<-- %s %s [%d]", req.Method, req.URL, status)
+	res.Header().Set("Content-Type", "application/json")
+	res.WriteHeader(status)
+	enc := json.NewEncoder(res)
+	enc.SetIndent("", "  ")
+	enc.Encode(&newSpec)
+}
+
+// createInvalidationHook registers a webhook to ping for each event from a set of contracts
+func (g *smartContractGW) createInvalidationHook(res http.ResponseWriter, req *http.Request, params httprouter.Params) {
+	log.Infof("--> %s %s", req.Method, req.URL)
+
+	if g.sm == nil {
+		g.gatewayErrReply(res, req, errors.New(errEventSupportMissing), 405)
+		return
+	}
+
+	var spec events.InvalidationHookInfo
+	if err := json.NewDecoder(req.Body).Decode(&spec); err != nil {
+		g.gatewayErrReply(res, req, ethconnecterrors.Errorf(ethconnecterrors.RESTGatewayInvalidationHookInvalid, err), 400)
+		return
+	}
+
+	newSpec, err := g.sm.AddInvalidationHook(req.Context(), &spec)
+	if err != nil {
+		g.gatewayErrReply(res, req, err, 400)
+		return
+	}
+
+	status := 200
+	log.Infof("<-- %s %s [%d]", req.Method, req.URL, status)
+	res.Header().Set("Content-Type", "application/json")
+	res.WriteHeader(status)
+	enc := json.NewEncoder(res)
+	enc.SetIndent("", "  ")
+	enc.Encode(&newSpec)
+}
+
+// createCheckpointGroup creates a named checkpoint shared by a set of subscriptions
+func (g *smartContractGW) createCheckpointGroup(res http.ResponseWriter, req *http.Request, params httprouter.Params) {
+	log.Infof("--> %s %s", req.Method, req.URL)
+
+	if g.sm == nil {
+		g.gatewayErrReply(res, req, errors.New(errEventSupportMissing), 405)
+		return
+	}
+
+	var spec events.CheckpointGroupInfo
+	if err := json.NewDecoder(req.Body).Decode(&spec); err != nil {
+		g.gatewayErrReply(res, req, ethconnecterrors.Errorf(ethconnecterrors.RESTGatewayCheckpointGroupInvalid, err), 400)
+		return
+	}
+
+	newSpec, err := g.sm.AddCheckpointGroup(req.Context(), &spec)
+	if err != nil {
+		g.gatewayErrReply(res, req, err, 400)
+		return
+	}
+
+	status := 200
+	log.Infof("<-- %s %s [%d]", req.Method, req.URL, status)
+	res.Header().Set("Content-Type", "application/json")
+	res.WriteHeader(status)
+	enc := json.NewEncoder(res)
+	enc.SetIndent("", "  ")
+	enc.Encode(&newSpec)
+}
+
+// getCheckpointGroupCheckpoint returns the block all the subscriptions of a group have reached
+func (g *smartContractGW) getCheckpointGroupCheckpoint(res http.ResponseWriter, req *http.Request, params httprouter.Params) {
+	log.Infof("--> %s %s", req.Method, req.URL)
+
+	if g.sm == nil {
+		g.gatewayErrReply(res, req, errors.New(errEventSupportMissing), 405)
+		return
+	}
+
+	checkpoint, err := g.sm.CheckpointGroupCheckpoint(req.Context(), params.ByName("id"))
+	if err != nil {
+		g.gatewayErrReply(res, req, err, 404)
+		return
+	}
+
+	status := 200
+	log.Infof("<-- %s %s [%d]", req.Method, req.URL, status)
+	res.Header().Set("Content-Type", "application/json")
+	res.WriteHeader(status)
+	enc := json.NewEncoder(res)
+	enc.SetIndent("", "  ")
+	enc.Encode(checkpoint)
+}
+
+// resetCheckpointGroup restarts all the subscriptions of a group from the same block
+func (g *smartContractGW) resetCheckpointGroup(res http.ResponseWriter, req *http.Request, params httprouter.Params) {
+	log.Infof("--> %s %s", req.Method, req.URL)
+
+	if g.sm == nil {
+		g.gatewayErrReply(res, req, errors.New(errEventSupportMissing), 405)
+		return
+	}
+
+	var body struct {
+		FromBlock string `json:"fromBlock"`
+	}
+	err := json.NewDecoder(req.Body).Decode(&body)
+	if err == nil {
+		err = g.sm.ResetCheckpointGroup(req.Context(), params.ByName("id"), body.FromBlock)
+	}
+	if err != nil {
+		g.gatewayErrReply(res, req, err, 500)
+		return
+	}
+
+	status := 204
+	log.Infof("<-- %s %s [%d]", req.Method, req.URL, status)
+	res.Header().Set("Content-Type", "application/json")
+	res.WriteHeader(status)
+}
+
+// createChainSubscription subscribes to the blocks, or the pending transactions, of the chain.
+// Subscriptions to events are created on the contract that emits them
+func (g *smartContractGW) createChainSubscription(res http.ResponseWriter, req *http.Request, params httprouter.Params) {
+	log.Infof("--> %s %s", req.Method, req.URL)
+
+	if g.sm == nil {
+		g.gatewayErrReply(res, req, errors.New(errEventSupportMissing), 405)
+		return
+	}
+
+	var spec struct {
+		Type      string `json:"type"`
+		Stream    string `json:"stream"`
+		FromBlock string `json:"fromBlock"`
+		Name      string `json:"name"`
+		Address   string `json:"address"`
+	}
+	if err := json.NewDecoder(req.Body).Decode(&spec); err != nil {
+		g.gatewayErrReply(res, req, ethconnecterrors.Errorf(ethconnecterrors.RESTGatewayChainSubInvalid, err), 400)
+		return
+	}
+	if spec.Stream == "" {
+		g.gatewayErrReply(res, req, ethconnecterrors.Errorf(ethconnecterrors.RESTGatewaySubscribeMissingStreamParameter), 400)
+		return
+	}
+	var addr *ethbinding.Address
+	if spec.Address != "" {
+		if !addrCheck.MatchString(strings.ToLower(spec.Address)) {
+			g.gatewayErrReply(res, req, ethconnecterrors.Errorf(ethconnecterrors.RESTGatewayChainSubInvalid, "invalid address "+spec.Address), 400)
+			return
+		}
+		address := ethbind.API.HexToAddress(spec.Address)
+		addr = &address
+	}
+
+	sub, err := g.sm.AddChainSubscription(req.Context(), spec.Type, addr, spec.Stream, spec.FromBlock, spec.Name)
+	if err != nil {
+		g.gatewayErrReply(res, req, err, quotaErrStatus(err, 400))
+		return
+	}
+
+	status := 200
+	log.Infof("<-- %s %s [%d]", req.Method, req.URL, status)
+	res.Header().Set("Content-Type", "application/json")
+	res.WriteHeader(status)
+	enc := json.NewEncoder(res)
+	enc.SetIndent("", "  ")
+	enc.Encode(sub)
+}
+
+// resumeBackfill restarts a failed backfill from the block it reached
+func (g *smartContractGW) resumeBackfill(res http.ResponseWriter, req *http.Request, params httprouter.Params) {
+	log.Infof("--> %s %s", req.Method, req.URL)
+
+	if g.sm == nil {
+		g.gatewayErrReply(res, req, errors.New(errEventSupportMissing), 405)
+		return
+	}
+
+	info, err := g.sm.ResumeBackfill(req.Context(), params.ByName("id"))
+	if err != nil {
+		g.gatewayErrReply(res, req, err, 500)
+		return
+	}
+
+	status := 202
+	log.Infof("<-- %s %s [%d]", req.Method, req.URL, status)
+	res.Header().Set("Content-Type", "application/json")
+	res.WriteHeader(status)
+	enc := json.NewEncoder(res)
+	enc.SetIndent("", "  ")
+	enc.Encode(&info)
+}
+
+// resetSub resets subscription over REST
+func (g *smartContractGW) resetSub(res http.ResponseWriter, req *http.Request, params httprouter.Params) {
+	log.Infof("--> %s %s", req.Method, req.URL)
+
+	if g.sm == nil {
+		g.gatewayErrReply(res, req, errors.New(errEventSupportMissing), 405)
+		return
+	}
+
+	var body struct {
+		FromBlock string `json:"fromBlock"`
+	}
+	err := json.NewDecoder(req.Body).Decode(&body)
+	if err == nil {
+		err = g.sm.ResetSubscription(req.Context(), params.ByName("id"), body.FromBlock)
+	}
+	if err != nil {
+		g.gatewayErrReply(res, req, err, 500)
+		return
+	}
+
+	status := 204
+	log.Infof("<-- %s %s [%d]", req.Method, req.URL, status)
+	res.Header().Set("Content-Type", "application/json")
+	res.WriteHeader(status)
+}
+
+// suspendOrResumeSub suspends or resumes a single subscription over REST
+func (g *smartContractGW) suspendOrResumeSub(res http.ResponseWriter, req *http.Request, params httprouter.Params) {
+	log.Infof("--> %s %s", req.Method, req.URL)
+
+	if g.sm == nil {
+		g.gatewayErrReply(res, req, errors.New(errEventSupportMissing), 405)
+		return
+	}
+
+	var err error
+	if strings.HasSuffix(req.URL.Path, "resume") {
+		err = g.sm.ResumeSubscription(req.Context(), params.ByName("id"))
+	} else {
+		err = g.sm.SuspendSubscription(req.Context(), params.ByName("id"))
+	}
 	if err != nil {
-		g.gatewayErrReply(res, req, err, 400)
+		g.gatewayErrReply(res, req, err, 500)
 		return
 	}
 
-	status := 200
+	status := 204
 	log.Infof("<-- %s %s [%d]", req.Method, req.URL, status)
 	res.Header().Set("Content-Type", "application/json")
 	res.WriteHeader(status)
-	enc := json.NewEncoder(res)
-	enc.SetIndent("", "  ")
-	enc.Encode(&newSpec)
 }
 
-// updateStream updates a stream
-func (g *smartContractGW) updateStream(res http.ResponseWriter, req *http.Request, params httprouter.Params) {
+// getSubCheckpoint returns the position of a subscription over REST
+func (g *smartContractGW) getSubCheckpoint(res http.ResponseWriter, req *http.Request, params httprouter.Params) {
 	log.Infof("--> %s %s", req.Method, req.URL)
 
 	if g.sm == nil {
@@ -681,22 +1739,11 @@ func (g *smartContractGW) updateStream(res http.ResponseWriter, req *http.Reques
 		return
 	}
 
-	streamID := params.ByName("id")
-	_, err := g.sm.StreamByID(req.Context(), streamID)
+	checkpoint, err := g.sm.SubscriptionCheckpoint(req.Context(), params.ByName("id"))
 	if err != nil {
 		g.gatewayErrReply(res, req, err, 404)
 		return
 	}
-	var spec events.StreamInfo
-	if err := json.NewDecoder(req.Body).Decode(&spec); err != nil {
-		g.gatewayErrReply(res, req, ethconnecterrors.Errorf(ethconnecterrors.RESTGatewayEventStreamInvalid, err), 400)
-		return
-	}
-	newSpec, err := g.sm.UpdateStream(req.Context(), streamID, &spec)
-	if err != nil {
-		g.gatewayErrReply(res, req, err, 500)
-		return
-	}
 
 	status := 200
 	log.Infof("<-- %s %s [%d]", req.Method, req.URL, status)
@@ -704,11 +1751,11 @@ func (g *smartContractGW) updateStream(res http.ResponseWriter, req *http.Reques
 	res.WriteHeader(status)
 	enc := json.NewEncoder(res)
 	enc.SetIndent("", "  ")
-	enc.Encode(&newSpec)
+	enc.Encode(checkpoint)
 }
 
-// listStreamsOrSubs sorts by Title then Address and returns an array
-func (g *smartContractGW) listStreamsOrSubs(res http.ResponseWriter, req *http.Request, params httprouter.Params) {
+// getStreamDeliveries returns the delivery history of a stream over REST, newest first
+func (g *smartContractGW) getStreamDeliveries(res http.ResponseWriter, req *http.Request, params httprouter.Params) {
 	log.Infof("--> %s %s", req.Method, req.URL)
 
 	if g.sm == nil {
@@ -716,25 +1763,21 @@ func (g *smartContractGW) listStreamsOrSubs(res http.ResponseWriter, req *http.R
 		return
 	}
 
-	var results []messages.TimeSortable
-	if strings.HasPrefix(req.URL.Path, events.SubPathPrefix) {
-		subs := g.sm.Subscriptions(req.Context())
-		results = make([]messages.TimeSortable, len(subs))
-		for i := range subs {
-			results[i] = subs[i]
-		}
-	} else {
-		streams := g.sm.Streams(req.Context())
-		results = make([]messages.TimeSortable, len(streams))
-		for i := range streams {
-			results[i] = streams[i]
-		}
+	skip, err := parseListInt(req, "skip")
+	if err != nil {
+		g.gatewayErrReply(res, req, err, 400)
+		return
+	}
+	limit, err := parseListInt(req, "limit")
+	if err != nil {
+		g.gatewayErrReply(res, req, err, 400)
+		return
+	}
+	deliveries, err := g.sm.StreamDeliveries(req.Context(), params.ByName("id"), skip, limit)
+	if err != nil {
+		g.gatewayErrReply(res, req, err, 404)
+		return
 	}
-
-	// Do the sort
-	sort.Slice(results, func(i, j int) bool {
-		return results[i].IsLessThan(results[i], results[j])
-	})
 
 	status := 200
 	log.Infof("<-- %s %s [%d]", req.Method, req.URL, status)
@@ -742,11 +1785,11 @@ func (g *smartContractGW) listStreamsOrSubs(res http.ResponseWriter, req *http.R
 	res.WriteHeader(status)
 	enc := json.NewEncoder(res)
 	enc.SetIndent("", "  ")
-	enc.Encode(&results)
+	enc.Encode(deliveries)
 }
 
-// getStreamOrSub returns stream over REST
-func (g *smartContractGW) getStreamOrSub(res http.ResponseWriter, req *http.Request, params httprouter.Params) {
+// getStreamDeadLetters returns the batches a stream could not deliver over REST, when they are stored in a file
+func (g *smartContractGW) getStreamDeadLetters(res http.ResponseWriter, req *http.Request, params httprouter.Params) {
 	log.Infof("--> %s %s", req.Method, req.URL)
 
 	if g.sm == nil {
@@ -754,15 +1797,9 @@ func (g *smartContractGW) getStreamOrSub(res http.ResponseWriter, req *http.Requ
 		return
 	}
 
-	var retval interface{}
-	var err error
-	if strings.HasPrefix(req.URL.Path, events.SubPathPrefix) {
-		retval, err = g.sm.SubscriptionByID(req.Context(), params.ByName("id"))
-	} else {
-		retval, err = g.sm.StreamByID(req.Context(), params.ByName("id"))
-	}
+	deadLetters, err := g.sm.StreamDeadLetters(req.Context(), params.ByName("id"))
 	if err != nil {
-		g.gatewayErrReply(res, req, err, 404)
+		g.gatewayErrReply(res, req, err, 400)
 		return
 	}
 
@@ -772,11 +1809,11 @@ func (g *smartContractGW) getStreamOrSub(res http.ResponseWriter, req *http.Requ
 	res.WriteHeader(status)
 	enc := json.NewEncoder(res)
 	enc.SetIndent("", "  ")
-	enc.Encode(retval)
+	enc.Encode(deadLetters)
 }
 
-// deleteStreamOrSub deletes stream over REST
-func (g *smartContractGW) deleteStreamOrSub(res http.ResponseWriter, req *http.Request, params httprouter.Params) {
+// replayStreamDeadLetters queues the dead letters of a stream for delivery again over REST
+func (g *smartContractGW) replayStreamDeadLetters(res http.ResponseWriter, req *http.Request, params httprouter.Params) {
 	log.Infof("--> %s %s", req.Method, req.URL)
 
 	if g.sm == nil {
@@ -784,25 +1821,23 @@ func (g *smartContractGW) deleteStreamOrSub(res http.ResponseWriter, req *http.R
 		return
 	}
 
-	var err error
-	if strings.HasPrefix(req.URL.Path, events.SubPathPrefix) {
-		err = g.sm.DeleteSubscription(req.Context(), params.ByName("id"))
-	} else {
-		err = g.sm.DeleteStream(req.Context(), params.ByName("id"))
-	}
+	replayed, err := g.sm.ReplayDeadLetters(req.Context(), params.ByName("id"))
 	if err != nil {
-		g.gatewayErrReply(res, req, err, 500)
+		g.gatewayErrReply(res, req, err, 400)
 		return
 	}
 
-	status := 204
+	status := 200
 	log.Infof("<-- %s %s [%d]", req.Method, req.URL, status)
 	res.Header().Set("Content-Type", "application/json")
 	res.WriteHeader(status)
+	enc := json.NewEncoder(res)
+	enc.SetIndent("", "  ")
+	enc.Encode(map[string]int{"replayed": replayed})
 }
 
-// resetSub resets subscription over REST
-func (g *smartContractGW) resetSub(res http.ResponseWriter, req *http.Request, params httprouter.Params) {
+// setSubCheckpoint moves a subscription on a suspended stream to an explicit block over REST
+func (g *smartContractGW) setSubCheckpoint(res http.ResponseWriter, req *http.Request, params httprouter.Params) {
 	log.Infof("--> %s %s", req.Method, req.URL)
 
 	if g.sm == nil {
@@ -811,24 +1846,37 @@ func (g *smartContractGW) resetSub(res http.ResponseWriter, req *http.Request, p
 	}
 
 	var body struct {
-		FromBlock string `json:"fromBlock"`
+		Block json.Number `json:"block"`
 	}
-	err := json.NewDecoder(req.Body).Decode(&body)
-	if err == nil {
-		err = g.sm.ResetSubscription(req.Context(), params.ByName("id"), body.FromBlock)
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		g.gatewayErrReply(res, req, ethconnecterrors.Errorf(ethconnecterrors.RESTGatewayCheckpointInvalid, err), 400)
+		return
+	}
+	if block, ok := new(big.Int).SetString(body.Block.String(), 10); !ok || block.Sign() <= 0 {
+		g.gatewayErrReply(res, req, ethconnecterrors.Errorf(ethconnecterrors.EventStreamsCheckpointBadBlock, body.Block), 400)
+		return
+	}
+	if _, err := g.sm.SubscriptionByID(req.Context(), params.ByName("id")); err != nil {
+		g.gatewayErrReply(res, req, err, 404)
+		return
 	}
+	checkpoint, err := g.sm.SetSubscriptionCheckpoint(req.Context(), params.ByName("id"), body.Block.String())
 	if err != nil {
-		g.gatewayErrReply(res, req, err, 500)
+		g.gatewayErrReply(res, req, err, 409)
 		return
 	}
 
-	status := 204
+	status := 200
 	log.Infof("<-- %s %s [%d]", req.Method, req.URL, status)
 	res.Header().Set("Content-Type", "application/json")
 	res.WriteHeader(status)
+	enc := json.NewEncoder(res)
+	enc.SetIndent("", "  ")
+	enc.Encode(checkpoint)
 }
 
-// suspendOrResumeStream suspends or resumes a stream
+// suspendOrResumeStream suspends or resumes a stream. A suspend can include a resumeAt
+// time, as a query parameter or in a JSON body, for the stream to resume automatically
 func (g *smartContractGW) suspendOrResumeStream(res http.ResponseWriter, req *http.Request, params httprouter.Params) {
 	log.Infof("--> %s %s", req.Method, req.URL)
 
@@ -841,7 +1889,12 @@ func (g *smartContractGW) suspendOrResumeStream(res http.ResponseWriter, req *ht
 	if strings.HasSuffix(req.URL.Path, "resume") {
 		err = g.sm.ResumeStream(req.Context(), params.ByName("id"))
 	} else {
-		err = g.sm.SuspendStream(req.Context(), params.ByName("id"))
+		var resumeAt *time.Time
+		if resumeAt, err = g.parseResumeAt(req); err != nil {
+			g.gatewayErrReply(res, req, err, 400)
+			return
+		}
+		err = g.sm.SuspendStreamUntil(req.Context(), params.ByName("id"), resumeAt)
 	}
 	if err != nil {
 		g.gatewayErrReply(res, req, err, 500)
@@ -854,13 +1907,40 @@ func (g *smartContractGW) suspendOrResumeStream(res http.ResponseWriter, req *ht
 	res.WriteHeader(status)
 }
 
-func (g *smartContractGW) resolveAddressOrName(id string) (deployMsg *messages.DeployContract, registeredName string, info *contractInfo, err error) {
+func (g *smartContractGW) parseResumeAt(req *http.Request) (*time.Time, error) {
+	var body struct {
+		ResumeAt string `json:"resumeAt"`
+	}
+	body.ResumeAt = req.URL.Query().Get("resumeAt")
+	if body.ResumeAt == "" && req.ContentLength != 0 {
+		if err := json.NewDecoder(req.Body).Decode(&body); err != nil && err != io.EOF {
+			return nil, ethconnecterrors.Errorf(ethconnecterrors.RESTGatewayResumeAtInvalid, err)
+		}
+	}
+	if body.ResumeAt == "" {
+		return nil, nil
+	}
+	resumeAt, err := time.Parse(time.RFC3339, body.ResumeAt)
+	if err != nil {
+		return nil, ethconnecterrors.Errorf(ethconnecterrors.RESTGatewayResumeAtInvalid, err)
+	}
+	if !resumeAt.After(time.Now()) {
+		return nil, ethconnecterrors.Errorf(ethconnecterrors.EventStreamsResumeAtInPast, body.ResumeAt)
+	}
+	return &resumeAt, nil
+}
+
+func (g *smartContractGW) resolveAddressOrName(ctx context.Context, id, environment string) (deployMsg *messages.DeployContract, registeredName string, info *contractInfo, err error) {
 	deployMsg, info, err = g.loadDeployMsgForInstance(id)
 	if err != nil {
 		var origErr = err
 		registeredName = id
-		if id, err = g.resolveContractAddr(registeredName); err != nil {
+		if id, err = g.resolveContractAddr(registeredName, environment); err != nil {
 			log.Infof("%s is not a friendly name: %s", registeredName, err)
+			if g.selectors != nil && addrCheck.MatchString(strings.ToLower(registeredName)) {
+				deployMsg, info, err = g.inferContract(ctx, strings.TrimPrefix(strings.ToLower(registeredName), "0x"), g.conf.ABIInference.Persist)
+				return deployMsg, "", info, err
+			}
 			return nil, "", nil, origErr
 		}
 		if deployMsg, info, err = g.loadDeployMsgForInstance(id); err != nil {
@@ -935,6 +2015,10 @@ func (g *smartContractGW) replyWithSwagger(res http.ResponseWriter, req *http.Re
 }
 
 func (g *smartContractGW) getContractOrABI(res http.ResponseWriter, req *http.Request, params httprouter.Params) {
+	if params.ByName("abi") == wellKnownABIPath {
+		g.listWellKnownABIs(res, req)
+		return
+	}
 	log.Infof("--> %s %s", req.Method, req.URL)
 	swaggerGen, uiRequest, factoryOnly, abiRequest, _, from := g.isSwaggerRequest(req)
 	id := strings.TrimPrefix(strings.ToLower(params.ByName("address")), "0x")
@@ -948,12 +2032,14 @@ func (g *smartContractGW) getContractOrABI(res http.ResponseWriter, req *http.Re
 	var err error
 	var deployMsg *messages.DeployContract
 	var info messages.TimeSortable
+	var instance *contractInfo
 	var abiID string
 	if prefix == "contract" {
-		if deployMsg, registeredName, info, err = g.resolveAddressOrName(params.ByName("address")); err != nil {
+		if deployMsg, registeredName, instance, err = g.resolveAddressOrName(req.Context(), params.ByName("address"), getFlyParam("environment", req, false)); err != nil {
 			g.gatewayErrReply(res, req, err, 404)
 			return
 		}
+		info = instance
 	} else {
 		abiID = id
 		deployMsg, info, err = g.loadDeployMsgByID(abiID)
@@ -966,11 +2052,14 @@ func (g *smartContractGW) getContractOrABI(res http.ResponseWriter, req *http.Re
 		g.writeHTMLForUI(prefix, id, from, (prefix == "abi"), factoryOnly, res)
 	} else if swaggerGen != nil {
 		addr := params.ByName("address")
-		runtimeABI, err := ethbind.API.ABIMarshalingToABIRuntime(deployMsg.ABI)
+		runtimeABI, err := eth.RuntimeABI(deployMsg.ABI)
 		if err != nil {
 			g.gatewayErrReply(res, req, ethconnecterrors.Errorf(ethconnecterrors.RESTGatewayInvalidABI, err), 404)
 			return
 		}
+		access := methodAccessFor(deployMsg, instance)
+		swaggerGen.RestrictMethods(access.HiddenMethods, access.ReadOnlyMethods)
+		swaggerGen.SetCustomErrors(eth.ErrorABIs(deployMsg.ABI))
 		swagger := g.swaggerForABI(swaggerGen, abiID, deployMsg.ContractName, factoryOnly, runtimeABI, deployMsg.DevDoc, addr, registeredName)
 		g.replyWithSwagger(res, req, swagger, id, from)
 	} else if abiRequest {
@@ -980,6 +2069,16 @@ func (g *smartContractGW) getContractOrABI(res http.ResponseWriter, req *http.Re
 		enc := json.NewEncoder(res)
 		enc.SetIndent("", "  ")
 		enc.Encode(deployMsg.ABI)
+	} else if _, versionsRequest := req.Form["versions"]; versionsRequest && instance != nil {
+		g.idxLock.Lock()
+		versions := instance.abiVersions()
+		g.idxLock.Unlock()
+		log.Infof("<-- %s %s [%d]", req.Method, req.URL, 200)
+		res.Header().Set("Content-Type", "application/json")
+		res.WriteHeader(200)
+		enc := json.NewEncoder(res)
+		enc.SetIndent("", "  ")
+		enc.Encode(versions)
 	} else {
 		log.Infof("<-- %s %s [%d]", req.Method, req.URL, 200)
 		res.Header().Set("Content-Type", "application/json")
@@ -1016,7 +2115,7 @@ func (g *smartContractGW) getRemoteRegistrySwaggerOrABI(res http.ResponseWriter,
 		prefix = "instance"
 		id = params.ByName("instance_lookup")
 		var msg *deployContractWithAddress
-		msg, err = g.rr.loadFactoryForInstance(id, refreshABI)
+		msg, err = g.rr.loadFactoryForInstance(id, getFlyParam("environment", req, false), refreshABI)
 		if err != nil {
 			g.gatewayErrReply(res, req, err, 500)
 			return
@@ -1032,11 +2131,12 @@ func (g *smartContractGW) getRemoteRegistrySwaggerOrABI(res http.ResponseWriter,
 	if uiRequest {
 		g.writeHTMLForUI(prefix, id, from, isGateway, factoryOnly, res)
 	} else if swaggerGen != nil {
-		runtimeABI, err := ethbind.API.ABIMarshalingToABIRuntime(deployMsg.ABI)
+		runtimeABI, err := eth.RuntimeABI(deployMsg.ABI)
 		if err != nil {
 			g.gatewayErrReply(res, req, ethconnecterrors.Errorf(ethconnecterrors.RESTGatewayInvalidABI, err), 400)
 			return
 		}
+		swaggerGen.SetCustomErrors(eth.ErrorABIs(deployMsg.ABI))
 		swagger := g.swaggerForRemoteRegistry(swaggerGen, id, addr, factoryOnly, runtimeABI, deployMsg.DevDoc, req.URL.Path)
 		g.replyWithSwagger(res, req, swagger, id, from)
 	} else if abiRequest {
@@ -1062,6 +2162,10 @@ func (g *smartContractGW) getRemoteRegistrySwaggerOrABI(res http.ResponseWriter,
 }
 
 func (g *smartContractGW) registerContract(res http.ResponseWriter, req *http.Request, params httprouter.Params) {
+	if params.ByName("abi") == wellKnownABIPath {
+		g.registerWellKnownContract(res, req, params.ByName("address"))
+		return
+	}
 	log.Infof("--> %s %s", req.Method, req.URL)
 
 	addrHexNo0x := strings.ToLower(strings.TrimPrefix(params.ByName("address"), "0x"))
@@ -1080,17 +2184,44 @@ func (g *smartContractGW) registerContract(res http.ResponseWriter, req *http.Re
 		return
 	}
 
+	tenant := auth.GetTenant(req.Context())
+	if err := g.checkContractQuota(tenant); err != nil {
+		g.gatewayErrReply(res, req, err, 403)
+		return
+	}
+
+	// A proxy contract is bound to the ABI of its implementation, rather than the ABI in the path
+	implementation := ""
+	if strings.ToLower(getFlyParam("detectproxy", req, true)) == "true" {
+		if implementation, err = g.readImplementation(req.Context(), addrHexNo0x); err != nil {
+			g.gatewayErrReply(res, req, err, 500)
+			return
+		}
+		if implementation != "" {
+			if abiID, err = g.resolveImplementationABI(req.Context(), addrHexNo0x, implementation); err != nil {
+				g.gatewayErrReply(res, req, err, 404)
+				return
+			}
+		}
+	}
+
 	registerAs := getFlyParam("register", req, false)
 	registeredName := registerAs
 	if registeredName == "" {
 		registeredName = addrHexNo0x
 	}
 
-	contractInfo, err := g.storeNewContractInfo(addrHexNo0x, abiID, registeredName, registerAs)
+	contractInfo, err := g.storeNewContractInfo(addrHexNo0x, abiID, registeredName, registerAs, getFlyParam("environment", req, false), tenant)
 	if err != nil {
 		g.gatewayErrReply(res, req, err, 409)
 		return
 	}
+	if implementation != "" {
+		if err = g.trackProxy(contractInfo, implementation); err != nil {
+			g.gatewayErrReply(res, req, err, 500)
+			return
+		}
+	}
 
 	status := 201
 	log.Infof("<-- %s %s [%d]", req.Method, req.URL, status)
@@ -1099,6 +2230,122 @@ func (g *smartContractGW) registerContract(res http.ResponseWriter, req *http.Re
 	json.NewEncoder(res).Encode(&contractInfo)
 }
 
+// deleteRegistration removes the friendly name for a contract instance, keeping the instance
+func (g *smartContractGW) deleteRegistration(res http.ResponseWriter, req *http.Request, params httprouter.Params) {
+	log.Infof("--> %s %s", req.Method, req.URL)
+
+	name, _ := url.QueryUnescape(params.ByName("name"))
+	if _, err := g.removeRegistration(name, getFlyParam("environment", req, false)); err != nil {
+		g.gatewayErrReply(res, req, err, 404)
+		return
+	}
+
+	status := 204
+	log.Infof("<-- %s %s [%d]", req.Method, req.URL, status)
+	res.Header().Set("Content-Type", "application/json")
+	res.WriteHeader(status)
+}
+
+// deleteContractOrRegistration routes DELETE requests under /contracts, as the router does not
+// allow /contracts/:address alongside /contracts/registrations/:name for the same method
+func (g *smartContractGW) deleteContractOrRegistration(res http.ResponseWriter, req *http.Request, params httprouter.Params) {
+	subPath := strings.TrimPrefix(params.ByName("path"), "/")
+	if strings.HasPrefix(subPath, "registrations/") {
+		g.deleteRegistration(res, req, httprouter.Params{{Key: "name", Value: strings.TrimPrefix(subPath, "registrations/")}})
+	} else {
+		g.deleteContract(res, req, httprouter.Params{{Key: "address", Value: subPath}})
+	}
+}
+
+// deleteContract removes a contract instance, by address or friendly name, from the local registry
+func (g *smartContractGW) deleteContract(res http.ResponseWriter, req *http.Request, params httprouter.Params) {
+	log.Infof("--> %s %s", req.Method, req.URL)
+
+	id := params.ByName("address")
+	addrHexNo0x := strings.TrimPrefix(strings.ToLower(id), "0x")
+	g.idxLock.Lock()
+	_, exists := g.contractIndex[addrHexNo0x]
+	g.idxLock.Unlock()
+	if !exists {
+		var err error
+		if addrHexNo0x, err = g.resolveContractAddr(id, getFlyParam("environment", req, false)); err != nil {
+			g.gatewayErrReply(res, req, err, 404)
+			return
+		}
+	}
+	if err := g.checkContractUnused(req.Context(), addrHexNo0x); err != nil {
+		g.gatewayErrReply(res, req, err, 409)
+		return
+	}
+	if err := g.removeContract(addrHexNo0x); err != nil {
+		g.gatewayErrReply(res, req, err, 500)
+		return
+	}
+
+	status := 204
+	log.Infof("<-- %s %s [%d]", req.Method, req.URL, status)
+	res.Header().Set("Content-Type", "application/json")
+	res.WriteHeader(status)
+}
+
+// deleteABI removes an ABI that no contract instances are registered against from the local registry
+func (g *smartContractGW) deleteABI(res http.ResponseWriter, req *http.Request, params httprouter.Params) {
+	log.Infof("--> %s %s", req.Method, req.URL)
+
+	id := strings.ToLower(params.ByName("abi"))
+	g.idxLock.Lock()
+	_, exists := g.abiIndex[id]
+	inUseErr := g.checkABIUnused(id)
+	g.idxLock.Unlock()
+	if !exists {
+		g.gatewayErrReply(res, req, ethconnecterrors.Errorf(ethconnecterrors.RESTGatewayLocalStoreABINotFound, id), 404)
+		return
+	}
+	if inUseErr != nil {
+		g.gatewayErrReply(res, req, inUseErr, 409)
+		return
+	}
+	if err := g.removeABI(id); err != nil {
+		g.gatewayErrReply(res, req, err, 500)
+		return
+	}
+
+	status := 204
+	log.Infof("<-- %s %s [%d]", req.Method, req.URL, status)
+	res.Header().Set("Content-Type", "application/json")
+	res.WriteHeader(status)
+}
+
+// moveRegistration moves a friendly name to the contract instance with the address in the body
+func (g *smartContractGW) moveRegistration(res http.ResponseWriter, req *http.Request, params httprouter.Params) {
+	log.Infof("--> %s %s", req.Method, req.URL)
+
+	body, err := utils.YAMLorJSONPayload(req)
+	if err != nil {
+		g.gatewayErrReply(res, req, err, 400)
+		return
+	}
+	addr, _ := body["address"].(string)
+	addrHexNo0x := strings.ToLower(strings.TrimPrefix(addr, "0x"))
+	addrHexNo0xCheck, _ := regexp.Compile("^[0-9a-z]{40}$")
+	if !addrHexNo0xCheck.MatchString(addrHexNo0x) {
+		g.gatewayErrReply(res, req, ethconnecterrors.Errorf(ethconnecterrors.RESTGatewayRegistrationSuppliedInvalidAddress), 400)
+		return
+	}
+
+	name, _ := url.QueryUnescape(params.ByName("name"))
+	contractInfo, status, err := g.renameRegistration(name, getFlyParam("environment", req, false), addrHexNo0x)
+	if err != nil {
+		g.gatewayErrReply(res, req, err, status)
+		return
+	}
+
+	log.Infof("<-- %s %s [%d]", req.Method, req.URL, status)
+	res.Header().Set("Content-Type", "application/json")
+	res.WriteHeader(status)
+	json.NewEncoder(res).Encode(&contractInfo)
+}
+
 func tempdir() string {
 	dir, _ := ioutil.TempDir("", "fly")
 	log.Infof("tmpdir/create: %s", dir)
@@ -1147,6 +2394,11 @@ func (g *smartContractGW) addABI(res http.ResponseWriter, req *http.Request, par
 		return
 	}
 
+	if vs := req.Form["bulk"]; len(vs) > 0 {
+		g.addBulkABIs(res, req, tempdir)
+		return
+	}
+
 	abi, err := g.parseABI(req.Form)
 	if err != nil {
 		g.gatewayErrReply(res, req, ethconnecterrors.Errorf(ethconnecterrors.RESTGatewayCompileContractInvalidFormData, err), 400)
@@ -1159,10 +2411,18 @@ func (g *smartContractGW) addABI(res http.ResponseWriter, req *http.Request, par
 		return
 	}
 
+	compilerOpts, err := g.parseCompilerOptions(req.Form)
+	if err != nil {
+		g.gatewayErrReply(res, req, ethconnecterrors.Errorf(ethconnecterrors.RESTGatewayCompileContractInvalidFormData, err), 400)
+		return
+	}
+
+	access := g.parseMethodAccess(req.Form)
+
 	var preCompiled map[string]*ethbinding.Contract
 	if bytecode == nil {
 		var err error
-		preCompiled, err = g.compileMultipartFormSolidity(tempdir, req)
+		preCompiled, err = g.compileMultipartFormSolidity(tempdir, req, compilerOpts)
 		if err != nil {
 			g.gatewayErrReply(res, req, ethconnecterrors.Errorf(ethconnecterrors.RESTGatewayCompileContractCompileFailed, err), 400)
 			return
@@ -1186,6 +2446,7 @@ func (g *smartContractGW) addABI(res http.ResponseWriter, req *http.Request, par
 	msg.Headers.ID = utils.UUIDv4()
 	var compiled *eth.CompiledSolidity
 	if bytecode == nil && abi == nil {
+		msg.CompilerOptions = *compilerOpts
 		var err error
 		compiled, err = eth.ProcessCompiled(preCompiled, req.FormValue("contract"), false)
 		if err != nil {
@@ -1197,11 +2458,42 @@ func (g *smartContractGW) addABI(res http.ResponseWriter, req *http.Request, par
 		msg.Compiled = bytecode
 	}
 
+	msg.MethodAccess = *access
+	if compiled != nil {
+		err = validateMethodAccess(compiled.ABI, access)
+	} else {
+		err = validateMethodAccess(abi, access)
+	}
+	if err != nil {
+		g.gatewayErrReply(res, req, ethconnecterrors.Errorf(ethconnecterrors.RESTGatewayCompileContractInvalidFormData, err), 400)
+		return
+	}
+
+	// Keep the flattened source and metadata of a contract we compiled, for verification
+	var source *abiSourceInfo
+	if compiled != nil && compiled.SourceFile != "" {
+		if source, err = buildABISource(tempdir, compiled); err != nil {
+			g.gatewayErrReply(res, req, err, 400)
+			return
+		}
+		msg.ContractName = compiled.ContractName
+		if err = g.analyzeSource(msg, tempdir, compiled.SourceFile, source.FlattenedSource); err != nil {
+			g.gatewayErrReply(res, req, err, 502)
+			return
+		}
+	}
+
 	info, err := g.storeDeployableABI(msg, compiled)
 	if err != nil {
 		g.gatewayErrReply(res, req, err, 500)
 		return
 	}
+	if source != nil {
+		if err = g.storeABISource(msg, source); err != nil {
+			g.gatewayErrReply(res, req, err, 500)
+			return
+		}
+	}
 
 	log.Infof("<-- %s %s [%d]", req.Method, req.URL, 200)
 	res.Header().Set("Content-Type", "application/json")
@@ -1238,7 +2530,35 @@ func (g *smartContractGW) parseABI(form url.Values) (ethbinding.ABIMarshaling, e
 	return nil, nil
 }
 
-func (g *smartContractGW) compileMultipartFormSolidity(dir string, req *http.Request) (map[string]*ethbinding.Contract, error) {
+func (g *smartContractGW) parseCompilerOptions(form url.Values) (*messages.CompilerOptions, error) {
+	opts := &messages.CompilerOptions{
+		EVMVersion: form.Get("evm"),
+	}
+	if v := form.Get("optimizer"); v != "" {
+		optimizerEnabled, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, ethconnecterrors.Errorf(ethconnecterrors.RESTGatewayCompileContractInvalidFormField, "optimizer", err)
+		}
+		opts.OptimizerEnabled = &optimizerEnabled
+	}
+	if v := form.Get("optimizerruns"); v != "" {
+		optimizerRuns, err := strconv.Atoi(v)
+		if err != nil || optimizerRuns <= 0 {
+			return nil, ethconnecterrors.Errorf(ethconnecterrors.RESTGatewayCompileContractInvalidFormField, "optimizerruns", v)
+		}
+		opts.OptimizerRuns = optimizerRuns
+	}
+	if v := form.Get("viair"); v != "" {
+		viaIR, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, ethconnecterrors.Errorf(ethconnecterrors.RESTGatewayCompileContractInvalidFormField, "viair", err)
+		}
+		opts.ViaIR = viaIR
+	}
+	return opts, nil
+}
+
+func (g *smartContractGW) compileMultipartFormSolidity(dir string, req *http.Request, opts *messages.CompilerOptions) (map[string]*ethbinding.Contract, error) {
 	solFiles := []string{}
 	rootFiles, err := ioutil.ReadDir(dir)
 	if err != nil {
@@ -1252,8 +2572,7 @@ func (g *smartContractGW) compileMultipartFormSolidity(dir string, req *http.Req
 		}
 	}
 
-	evmVersion := req.FormValue("evm")
-	solcArgs := eth.GetSolcArgs(evmVersion)
+	solcArgs := eth.GetSolcArgs(opts)
 	if sourceFiles := req.Form["source"]; len(sourceFiles) > 0 {
 		solcArgs = append(solcArgs, sourceFiles...)
 	} else if len(solFiles) > 0 {
@@ -1438,7 +2757,17 @@ func (g *smartContractGW) Shutdown() {
 	if g.sm != nil {
 		g.sm.Close()
 	}
+	if g.reactionQueue != nil {
+		g.stopReactions()
+	}
+	g.stopProxyWatcher()
 	if g.rr != nil {
 		g.rr.close()
 	}
+	if g.refreshDone != nil {
+		close(g.refreshDone)
+	}
+	if g.store != nil {
+		g.store.close()
+	}
 }
@@ -24,8 +24,10 @@ import (
 	"mime/multipart"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"os"
 	"path"
+	"strings"
 	"testing"
 	"time"
 
@@ -34,9 +36,11 @@ import (
 	ethbinding "github.com/kaleido-io/ethbinding/pkg"
 	"github.com/kaleido-io/ethconnect/internal/auth"
 	"github.com/kaleido-io/ethconnect/internal/auth/authtest"
+	"github.com/kaleido-io/ethconnect/internal/eth"
 	"github.com/kaleido-io/ethconnect/internal/ethbind"
 	"github.com/kaleido-io/ethconnect/internal/events"
 	"github.com/kaleido-io/ethconnect/internal/messages"
+	"github.com/kaleido-io/ethconnect/internal/quotas"
 	"github.com/kaleido-io/ethconnect/internal/tx"
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
@@ -132,6 +136,21 @@ func TestNewSmartContractGatewayWithEventsFail(t *testing.T) {
 	assert.Regexp("Event-stream subscription manager", err.Error())
 }
 
+func TestNewSmartContractGatewayBadStaticAnalysis(t *testing.T) {
+	assert := assert.New(t)
+	_, err := NewSmartContractGateway(
+		&SmartContractGatewayConf{
+			StaticAnalysis: StaticAnalysisConf{
+				Command:       []string{"slither", "{{file}}", "--json", "-"},
+				BlockSeverity: "critical",
+			},
+		},
+		&tx.TxnProcessorConf{},
+		nil, nil, nil, nil,
+	)
+	assert.Regexp("Invalid static analysis blockSeverity 'critical'", err)
+}
+
 func TestPreDeployCompileAndPostDeploy(t *testing.T) {
 	// writes real files and tests end to end
 	assert := assert.New(t)
@@ -758,6 +777,42 @@ func TestPostDeployNoRegisteredName(t *testing.T) {
 	assert.Equal("/contracts/0123456789abcdef0123456789abcdef01234567", contractInfo.Path)
 }
 
+func TestPostDeployTenant(t *testing.T) {
+	assert := assert.New(t)
+	dir := tempdir()
+	defer cleanup(dir)
+	s, _ := NewSmartContractGateway(
+		&SmartContractGatewayConf{
+			StoragePath: dir,
+			BaseURL:     "http://localhost/api/v1",
+		},
+		&tx.TxnProcessorConf{},
+		nil, nil, nil, nil,
+	)
+	contractAddr := ethbind.API.HexToAddress("0x0123456789AbcdeF0123456789abCdef01234567")
+	scgw := s.(*smartContractGW)
+	replyMsg := &messages.TransactionReceipt{
+		ReplyCommon: messages.ReplyCommon{
+			Headers: messages.ReplyHeaders{
+				CommonHeaders: messages.CommonHeaders{
+					MsgType: messages.MsgTypeTransactionSuccess,
+					Context: map[string]interface{}{tenantContextKey: "tenant1"},
+				},
+				ReqID: "message1",
+			},
+		},
+		ContractAddress: &contractAddr,
+	}
+	err := scgw.PostDeploy(replyMsg)
+	assert.NoError(err)
+
+	contractInfo := scgw.contractIndex["0123456789abcdef0123456789abcdef01234567"].(*contractInfo)
+	assert.Equal("tenant1", contractInfo.Tenant)
+	scgw.conf.Quotas.Tenants = map[string]*quotas.Limits{"tenant1": {MaxContracts: 1}}
+	assert.EqualError(scgw.checkContractQuota("tenant1"), "Quota exceeded: the maximum number of contracts for tenant 'tenant1' is 1")
+	assert.NoError(scgw.checkContractQuota(""))
+}
+
 func TestPostDeployRemoteRegisteredName(t *testing.T) {
 	assert := assert.New(t)
 	dir := tempdir()
@@ -804,6 +859,51 @@ func TestPostDeployRemoteRegisteredName(t *testing.T) {
 	assert.Equal("http://localhost/api/v1/instances/lobster?openapi", replyMsg.ContractSwagger)
 }
 
+func TestPostDeployRemoteReservedName(t *testing.T) {
+	assert := assert.New(t)
+	dir := tempdir()
+	defer cleanup(dir)
+	s, _ := NewSmartContractGateway(
+		&SmartContractGatewayConf{
+			StoragePath: dir,
+			BaseURL:     "http://localhost/api/v1",
+		},
+		&tx.TxnProcessorConf{
+			OrionPrivateAPIS: false,
+		},
+		nil, nil, nil, nil,
+	)
+	rr := &mockRR{}
+	s.(*smartContractGW).rr = rr
+
+	contractAddr := ethbind.API.HexToAddress("0x0123456789AbcdeF0123456789abCdef01234567")
+	scgw := s.(*smartContractGW)
+	replyMsg := &messages.TransactionReceipt{
+		ReplyCommon: messages.ReplyCommon{
+			Headers: messages.ReplyHeaders{
+				CommonHeaders: messages.CommonHeaders{
+					Context: map[string]interface{}{
+						remoteRegistryContextKey:         true,
+						remoteRegistryReservedContextKey: true,
+					},
+					MsgType: messages.MsgTypeTransactionSuccess,
+				},
+				ReqID: "message1",
+			},
+		},
+		ContractAddress: &contractAddr,
+		RegisterAs:      "lobster",
+	}
+
+	err := scgw.PostDeploy(replyMsg)
+	assert.NoError(err)
+
+	assert.Equal("lobster", rr.confirmCapture)
+	assert.Empty(rr.lookupCapture)
+	assert.Equal("0x0123456789abcdef0123456789abcdef01234567", rr.addrCapture)
+	assert.Equal("http://localhost/api/v1/instances/lobster?openapi", replyMsg.ContractSwagger)
+}
+
 func TestPostDeployRemoteRegisteredNameNotSuccess(t *testing.T) {
 	assert := assert.New(t)
 	dir := tempdir()
@@ -918,6 +1018,37 @@ func TestLoadABIForInstanceUnknown(t *testing.T) {
 	assert.Regexp("No contract instance registered with address invalid", err.Error())
 }
 
+func TestResolveEventABIs(t *testing.T) {
+	assert := assert.New(t)
+	dir := tempdir()
+	defer cleanup(dir)
+	processor := &mockProcessor{}
+	s, _ := NewSmartContractGateway(
+		&SmartContractGatewayConf{
+			StoragePath: dir,
+		},
+		&tx.TxnProcessorConf{},
+		nil, processor, nil, nil,
+	)
+	scgw := s.(*smartContractGW)
+	assert.Equal(scgw, processor.eventABIResolver)
+
+	deployMsg := newTestPrecompiledDeployMsg(t)
+	deployMsg.Headers.ID = "abi1"
+	_, err := scgw.storeDeployableABI(&deployMsg.DeployContract, nil)
+	assert.NoError(err)
+	_, err = scgw.storeNewContractInfo("0123456789abcdef0123456789abcdef01234567", "abi1", "0123456789abcdef0123456789abcdef01234567", "", "", "")
+	assert.NoError(err)
+
+	addr := ethbind.API.HexToAddress("0x0123456789AbcdeF0123456789abCdef01234567")
+	events := scgw.ResolveEventABIs(&addr)
+	assert.Len(events, 1)
+	assert.Equal("Changed", events[0].Name)
+
+	addr = ethbind.API.HexToAddress("0x3924d1D6423F88148A4fcc0417A33B27a61d595f")
+	assert.Nil(scgw.ResolveEventABIs(&addr))
+}
+
 func TestLoadABIBadData(t *testing.T) {
 	assert := assert.New(t)
 	dir := tempdir()
@@ -1041,11 +1172,11 @@ func TestBuildIndex(t *testing.T) {
 	assert.Equal("456789abcdef0123456789abcdef012345678901", contractInfos[2].Address)
 	assert.Equal("56789abcdef0123456789abcdef0123456789012", contractInfos[3].Address)
 
-	somecontractAddr, err := scgw.resolveContractAddr("somecontract")
+	somecontractAddr, err := scgw.resolveContractAddr("somecontract", "")
 	assert.NoError(err)
 	assert.Equal("56789abcdef0123456789abcdef0123456789012", somecontractAddr)
 
-	migratedcontractAddr, err := scgw.resolveContractAddr("migratedcontract")
+	migratedcontractAddr, err := scgw.resolveContractAddr("migratedcontract", "")
 	assert.NoError(err)
 	assert.Equal("23456789abcdef0123456789abcdef0123456789", migratedcontractAddr)
 
@@ -1257,6 +1388,17 @@ func TestAddABIZipNested(t *testing.T) {
 	err := json.NewDecoder(res.Body).Decode(info)
 	assert.NoError(err)
 	assert.Equal("SimpleEvents", info.Name)
+
+	req = httptest.NewRequest("GET", "/abis/"+info.ID+"/source", nil)
+	res = httptest.NewRecorder()
+	router.ServeHTTP(res, req)
+	assert.Equal(200, res.Result().StatusCode)
+	source := &abiSourceInfo{}
+	err = json.NewDecoder(res.Body).Decode(source)
+	assert.NoError(err)
+	assert.Equal("solfiles/SimpleEvents.sol", source.SourceFile)
+	assert.Regexp("contract SimpleEvents", source.FlattenedSource)
+	assert.NotEmpty(source.Metadata)
 }
 
 func TestAddABIZipNestedListSolidity(t *testing.T) {
@@ -1467,7 +1609,7 @@ func TestCompileMultipartFormSolidityBadDir(t *testing.T) {
 	)
 	scgw := s.(*smartContractGW)
 
-	_, err := scgw.compileMultipartFormSolidity(path.Join(dir, "baddir"), nil)
+	_, err := scgw.compileMultipartFormSolidity(path.Join(dir, "baddir"), nil, &messages.CompilerOptions{})
 	assert.EqualError(err, "Failed to read extracted multi-part form data")
 }
 
@@ -1491,7 +1633,7 @@ func TestCompileMultipartFormSolidityBadSolc(t *testing.T) {
 
 	ioutil.WriteFile(path.Join(dir, "solidity.sol"), []byte(simpleEventsSource()), 0644)
 	req := httptest.NewRequest("POST", "/abis?compiler=0.99", bytes.NewReader([]byte{}))
-	_, err := scgw.compileMultipartFormSolidity(dir, req)
+	_, err := scgw.compileMultipartFormSolidity(dir, req, &messages.CompilerOptions{})
 	assert.Regexp("Failed checking solc version", err.Error())
 	os.Unsetenv("FLY_SOLC_0_99")
 }
@@ -1515,7 +1657,7 @@ func TestCompileMultipartFormSolidityBadCompilerVerReq(t *testing.T) {
 
 	ioutil.WriteFile(path.Join(dir, "solidity.sol"), []byte(simpleEventsSource()), 0644)
 	req := httptest.NewRequest("POST", "/abis?compiler=0.99", bytes.NewReader([]byte{}))
-	_, err := scgw.compileMultipartFormSolidity(dir, req)
+	_, err := scgw.compileMultipartFormSolidity(dir, req, &messages.CompilerOptions{})
 	assert.EqualError(err, "Failed checking solc version: Could not find a configured compiler for requested Solidity major version 0.99")
 }
 
@@ -1538,7 +1680,7 @@ func TestCompileMultipartFormSolidityBadSolidity(t *testing.T) {
 
 	ioutil.WriteFile(path.Join(dir, "solidity.sol"), []byte("this is not the solidity you are looking for"), 0644)
 	req := httptest.NewRequest("POST", "/abis", bytes.NewReader([]byte{}))
-	_, err := scgw.compileMultipartFormSolidity(dir, req)
+	_, err := scgw.compileMultipartFormSolidity(dir, req, &messages.CompilerOptions{})
 	assert.Regexp("Failed to compile", err.Error())
 }
 
@@ -1609,7 +1751,7 @@ func TestStoreDeployableABIMissingABI(t *testing.T) {
 	assert.EqualError(err, "Must supply ABI to install an existing ABI into the REST Gateway")
 }
 
-func TestAddFileToContractIndexBadFileSwallowsError(t *testing.T) {
+func TestAddStoredContractToIndexBadFileSwallowsError(t *testing.T) {
 	dir := tempdir()
 	defer cleanup(dir)
 
@@ -1624,10 +1766,10 @@ func TestAddFileToContractIndexBadFileSwallowsError(t *testing.T) {
 	)
 	scgw := s.(*smartContractGW)
 
-	scgw.addFileToContractIndex("", "badness")
+	scgw.addStoredContractToIndex("badness")
 }
 
-func TestAddFileToContractIndexBadDataSwallowsError(t *testing.T) {
+func TestAddStoredContractToIndexBadDataSwallowsError(t *testing.T) {
 	dir := tempdir()
 	defer cleanup(dir)
 
@@ -1642,12 +1784,12 @@ func TestAddFileToContractIndexBadDataSwallowsError(t *testing.T) {
 	)
 	scgw := s.(*smartContractGW)
 
-	fileName := path.Join(dir, "badness")
+	fileName := path.Join(dir, "contract_badness.instance.json")
 	ioutil.WriteFile(fileName, []byte("!JSON"), 0644)
-	scgw.addFileToContractIndex("", fileName)
+	scgw.addStoredContractToIndex("badness")
 }
 
-func TestAddFileToABIIndexBadFileSwallowsError(t *testing.T) {
+func TestAddStoredABIToIndexBadFileSwallowsError(t *testing.T) {
 	dir := tempdir()
 	defer cleanup(dir)
 
@@ -1662,7 +1804,7 @@ func TestAddFileToABIIndexBadFileSwallowsError(t *testing.T) {
 	)
 	scgw := s.(*smartContractGW)
 
-	scgw.addFileToABIIndex("", "badness", time.Now().UTC())
+	scgw.addStoredABIToIndex("badness", time.Now().UTC())
 }
 
 func testGWPath(method, path string, results interface{}, sm *mockSubMgr) (res *httptest.ResponseRecorder) {
@@ -1981,6 +2123,163 @@ func TestResetSubNoManager(t *testing.T) {
 	assert.Equal(405, res.Result().StatusCode)
 }
 
+func TestGetSubCheckpoint(t *testing.T) {
+	assert := assert.New(t)
+
+	mockSubMgr := &mockSubMgr{
+		checkpoint: &events.SubscriptionCheckpoint{ID: "123", Block: "10", ChainHead: "19", Lag: 10},
+	}
+	var checkpoint events.SubscriptionCheckpoint
+	res := testGWPath("GET", events.SubPathPrefix+"/123/checkpoint", &checkpoint, mockSubMgr)
+	assert.Equal(200, res.Result().StatusCode)
+	assert.Equal("10", checkpoint.Block)
+	assert.Equal(int64(10), checkpoint.Lag)
+}
+
+func TestGetSubCheckpointNotFound(t *testing.T) {
+	assert := assert.New(t)
+
+	mockSubMgr := &mockSubMgr{
+		err: fmt.Errorf("pop"),
+	}
+	res := testGWPath("GET", events.SubPathPrefix+"/123/checkpoint", nil, mockSubMgr)
+	assert.Equal(404, res.Result().StatusCode)
+}
+
+func TestGetSubCheckpointNoManager(t *testing.T) {
+	assert := assert.New(t)
+	res := testGWPath("GET", events.SubPathPrefix+"/123/checkpoint", nil, nil)
+	assert.Equal(405, res.Result().StatusCode)
+}
+
+func TestGetStreamDeliveries(t *testing.T) {
+	assert := assert.New(t)
+
+	mockSubMgr := &mockSubMgr{
+		deliveries: []*events.DeliveryRecord{
+			{Stream: "es-123", BatchNumber: 2, Status: events.DeliveryStatusDelivered, ResponseCode: 200},
+		},
+	}
+	var deliveries []*events.DeliveryRecord
+	res := testGWPath("GET", events.StreamPathPrefix+"/es-123/deliveries?skip=10&limit=5", &deliveries, mockSubMgr)
+	assert.Equal(200, res.Result().StatusCode)
+	assert.Equal(1, len(deliveries))
+	assert.Equal(uint64(2), deliveries[0].BatchNumber)
+	assert.Equal(200, deliveries[0].ResponseCode)
+	assert.Equal(10, mockSubMgr.capturedSkip)
+	assert.Equal(5, mockSubMgr.capturedLimit)
+}
+
+func TestGetStreamDeliveriesBadParams(t *testing.T) {
+	assert := assert.New(t)
+
+	res := testGWPath("GET", events.StreamPathPrefix+"/es-123/deliveries?skip=-1", nil, &mockSubMgr{})
+	assert.Equal(400, res.Result().StatusCode)
+	res = testGWPath("GET", events.StreamPathPrefix+"/es-123/deliveries?limit=abc", nil, &mockSubMgr{})
+	assert.Equal(400, res.Result().StatusCode)
+}
+
+func TestGetStreamDeliveriesNotFound(t *testing.T) {
+	assert := assert.New(t)
+
+	res := testGWPath("GET", events.StreamPathPrefix+"/es-123/deliveries", nil, &mockSubMgr{err: fmt.Errorf("pop")})
+	assert.Equal(404, res.Result().StatusCode)
+	res = testGWPath("GET", events.StreamPathPrefix+"/es-123/deliveries", nil, nil)
+	assert.Equal(405, res.Result().StatusCode)
+}
+
+func TestGetStreamDeadLetters(t *testing.T) {
+	assert := assert.New(t)
+
+	sm := &mockSubMgr{
+		deadLetters: []*events.DeadLetter{{Stream: "es-123", BatchNumber: 3, Attempts: 5, Error: "pop"}},
+	}
+	var deadLetters []*events.DeadLetter
+	res := testGWPath("GET", events.StreamPathPrefix+"/es-123/deadletters", &deadLetters, sm)
+	assert.Equal(200, res.Result().StatusCode)
+	assert.Equal(1, len(deadLetters))
+	assert.Equal(uint64(3), deadLetters[0].BatchNumber)
+	assert.Equal("pop", deadLetters[0].Error)
+
+	res = testGWPath("GET", events.StreamPathPrefix+"/es-123/deadletters", nil, &mockSubMgr{err: fmt.Errorf("pop")})
+	assert.Equal(400, res.Result().StatusCode)
+	res = testGWPath("GET", events.StreamPathPrefix+"/es-123/deadletters", nil, nil)
+	assert.Equal(405, res.Result().StatusCode)
+}
+
+func TestReplayStreamDeadLetters(t *testing.T) {
+	assert := assert.New(t)
+
+	sm := &mockSubMgr{
+		deadLetters: []*events.DeadLetter{{Stream: "es-123", BatchNumber: 3}, {Stream: "es-123", BatchNumber: 4}},
+	}
+	var reply map[string]int
+	res := testGWPath("POST", events.StreamPathPrefix+"/es-123/deadletters/replay", &reply, sm)
+	assert.Equal(200, res.Result().StatusCode)
+	assert.Equal(2, reply["replayed"])
+
+	res = testGWPath("POST", events.StreamPathPrefix+"/es-123/deadletters/replay", nil, &mockSubMgr{err: fmt.Errorf("pop")})
+	assert.Equal(400, res.Result().StatusCode)
+	res = testGWPath("POST", events.StreamPathPrefix+"/es-123/deadletters/replay", nil, nil)
+	assert.Equal(405, res.Result().StatusCode)
+}
+
+func TestSetSubCheckpoint(t *testing.T) {
+	assert := assert.New(t)
+
+	mockSubMgr := &mockSubMgr{
+		checkpoint: &events.SubscriptionCheckpoint{ID: "123", Block: "12345"},
+	}
+	var checkpoint events.SubscriptionCheckpoint
+	res := testGWPathBody("PATCH", events.SubPathPrefix+"/123/checkpoint", &checkpoint, mockSubMgr, strings.NewReader(`{"block": 12345}`))
+	assert.Equal(200, res.Result().StatusCode)
+	assert.Equal("12345", mockSubMgr.capturedBlock)
+	assert.Equal("12345", checkpoint.Block)
+
+	res = testGWPathBody("PATCH", events.SubPathPrefix+"/123/checkpoint", nil, mockSubMgr, strings.NewReader(`{"block": "678"}`))
+	assert.Equal(200, res.Result().StatusCode)
+	assert.Equal("678", mockSubMgr.capturedBlock)
+}
+
+func TestSetSubCheckpointBadBody(t *testing.T) {
+	assert := assert.New(t)
+
+	mockSubMgr := &mockSubMgr{}
+	res := testGWPathBody("PATCH", events.SubPathPrefix+"/123/checkpoint", nil, mockSubMgr, strings.NewReader(`!json`))
+	assert.Equal(400, res.Result().StatusCode)
+
+	var errBody map[string]string
+	res = testGWPathBody("PATCH", events.SubPathPrefix+"/123/checkpoint", &errBody, mockSubMgr, strings.NewReader(`{"block": 0}`))
+	assert.Equal(400, res.Result().StatusCode)
+	assert.Equal("Checkpoint block '0' must be a positive integer", errBody["error"])
+}
+
+func TestSetSubCheckpointNotFound(t *testing.T) {
+	assert := assert.New(t)
+
+	mockSubMgr := &mockSubMgr{
+		err: fmt.Errorf("pop"),
+	}
+	res := testGWPathBody("PATCH", events.SubPathPrefix+"/123/checkpoint", nil, mockSubMgr, strings.NewReader(`{"block": 1}`))
+	assert.Equal(404, res.Result().StatusCode)
+}
+
+func TestSetSubCheckpointStreamActive(t *testing.T) {
+	assert := assert.New(t)
+
+	mockSubMgr := &mockSubMgr{
+		checkpointErr: fmt.Errorf("pop"),
+	}
+	res := testGWPathBody("PATCH", events.SubPathPrefix+"/123/checkpoint", nil, mockSubMgr, strings.NewReader(`{"block": 1}`))
+	assert.Equal(409, res.Result().StatusCode)
+}
+
+func TestSetSubCheckpointNoManager(t *testing.T) {
+	assert := assert.New(t)
+	res := testGWPathBody("PATCH", events.SubPathPrefix+"/123/checkpoint", nil, nil, strings.NewReader(`{"block": 1}`))
+	assert.Equal(405, res.Result().StatusCode)
+}
+
 func TestDeleteStream(t *testing.T) {
 	assert := assert.New(t)
 
@@ -2006,6 +2305,16 @@ func TestDeleteSubError(t *testing.T) {
 	assert.Equal("not found", errInfo.Message)
 }
 
+func TestCreateStreamQuotaExceeded(t *testing.T) {
+	assert := assert.New(t)
+
+	mockSubMgr := &mockSubMgr{err: &quotas.ExceededError{Tenant: "tenant1", Resource: quotas.Streams, Limit: 5}}
+	var errInfo = restErrMsg{}
+	res := testGWPathBody("POST", events.StreamPathPrefix, &errInfo, mockSubMgr, strings.NewReader(`{"type":"webhook"}`))
+	assert.Equal(403, res.Result().StatusCode)
+	assert.Equal("Quota exceeded: the maximum number of streams for tenant 'tenant1' is 5", errInfo.Message)
+}
+
 func TestSuspendStream(t *testing.T) {
 	assert := assert.New(t)
 
@@ -2015,6 +2324,59 @@ func TestSuspendStream(t *testing.T) {
 	assert.True(mockSubMgr.suspended)
 }
 
+func TestSuspendStreamResumeAtQuery(t *testing.T) {
+	assert := assert.New(t)
+
+	resumeAt := time.Now().Add(1 * time.Hour).UTC().Truncate(time.Second)
+	mockSubMgr := &mockSubMgr{}
+	res := testGWPath("POST", events.StreamPathPrefix+"/123/suspend?resumeAt="+resumeAt.Format(time.RFC3339), nil, mockSubMgr)
+	assert.Equal(204, res.Result().StatusCode)
+	assert.True(mockSubMgr.suspended)
+	assert.True(resumeAt.Equal(*mockSubMgr.resumeAt))
+}
+
+func TestSuspendStreamResumeAtBody(t *testing.T) {
+	assert := assert.New(t)
+
+	resumeAt := time.Now().Add(1 * time.Hour).UTC().Truncate(time.Second)
+	mockSubMgr := &mockSubMgr{}
+	body := `{"resumeAt":"` + resumeAt.Format(time.RFC3339) + `"}`
+	res := testGWPathBody("POST", events.StreamPathPrefix+"/123/suspend", nil, mockSubMgr, strings.NewReader(body))
+	assert.Equal(204, res.Result().StatusCode)
+	assert.True(resumeAt.Equal(*mockSubMgr.resumeAt))
+}
+
+func TestSuspendStreamResumeAtBadBody(t *testing.T) {
+	assert := assert.New(t)
+
+	mockSubMgr := &mockSubMgr{}
+	var errInfo = restErrMsg{}
+	res := testGWPathBody("POST", events.StreamPathPrefix+"/123/suspend", &errInfo, mockSubMgr, strings.NewReader("!json"))
+	assert.Equal(400, res.Result().StatusCode)
+	assert.Regexp("Invalid resumeAt", errInfo.Message)
+	assert.False(mockSubMgr.suspended)
+}
+
+func TestSuspendStreamResumeAtBadFormat(t *testing.T) {
+	assert := assert.New(t)
+
+	mockSubMgr := &mockSubMgr{}
+	var errInfo = restErrMsg{}
+	res := testGWPath("POST", events.StreamPathPrefix+"/123/suspend?resumeAt=tomorrow", &errInfo, mockSubMgr)
+	assert.Equal(400, res.Result().StatusCode)
+	assert.Regexp("Invalid resumeAt", errInfo.Message)
+}
+
+func TestSuspendStreamResumeAtInPast(t *testing.T) {
+	assert := assert.New(t)
+
+	mockSubMgr := &mockSubMgr{}
+	var errInfo = restErrMsg{}
+	res := testGWPath("POST", events.StreamPathPrefix+"/123/suspend?resumeAt=2020-01-01T00:00:00Z", &errInfo, mockSubMgr)
+	assert.Equal(400, res.Result().StatusCode)
+	assert.Equal("resumeAt '2020-01-01T00:00:00Z' must be in the future", errInfo.Message)
+}
+
 func TestResumeStream(t *testing.T) {
 	assert := assert.New(t)
 
@@ -2034,6 +2396,43 @@ func TestResumeStreamFail(t *testing.T) {
 	assert.Equal("pop", errInfo.Message)
 }
 
+func TestSuspendSubscription(t *testing.T) {
+	assert := assert.New(t)
+
+	mockSubMgr := &mockSubMgr{}
+	res := testGWPath("POST", events.SubPathPrefix+"/123/suspend", nil, mockSubMgr)
+	assert.Equal(204, res.Result().StatusCode)
+	assert.True(mockSubMgr.subSuspended)
+	assert.False(mockSubMgr.subResumed)
+}
+
+func TestResumeSubscription(t *testing.T) {
+	assert := assert.New(t)
+
+	mockSubMgr := &mockSubMgr{}
+	res := testGWPath("POST", events.SubPathPrefix+"/123/resume", nil, mockSubMgr)
+	assert.Equal(204, res.Result().StatusCode)
+	assert.True(mockSubMgr.subResumed)
+	assert.False(mockSubMgr.subSuspended)
+}
+
+func TestResumeSubscriptionFail(t *testing.T) {
+	assert := assert.New(t)
+
+	mockSubMgr := &mockSubMgr{err: fmt.Errorf("pop")}
+	var errInfo = restErrMsg{}
+	res := testGWPath("POST", events.SubPathPrefix+"/123/resume", &errInfo, mockSubMgr)
+	assert.Equal(500, res.Result().StatusCode)
+	assert.Equal("pop", errInfo.Message)
+}
+
+func TestResumeSubscriptionNoSubMgr(t *testing.T) {
+	assert := assert.New(t)
+
+	res := testGWPath("POST", events.SubPathPrefix+"/123/resume", nil, nil)
+	assert.Equal(405, res.Result().StatusCode)
+}
+
 func TestSuspendNoSubMgr(t *testing.T) {
 	assert := assert.New(t)
 
@@ -2059,7 +2458,7 @@ func TestCheckNameAvailableRRDuplicate(t *testing.T) {
 	s := scgw.(*smartContractGW)
 	s.rr = rr
 
-	err := s.checkNameAvailable("lobster", true)
+	err := s.checkNameAvailable("lobster", "", true)
 	assert.EqualError(err, "Contract address 12345 is already registered for name 'lobster'")
 }
 
@@ -2081,7 +2480,7 @@ func TestCheckNameAvailableRRFail(t *testing.T) {
 	s := scgw.(*smartContractGW)
 	s.rr = rr
 
-	err := s.checkNameAvailable("lobster", true)
+	err := s.checkNameAvailable("lobster", "", true)
 	assert.EqualError(err, "pop")
 }
 
@@ -2256,3 +2655,1020 @@ func TestPublishPreCompiled(t *testing.T) {
 	assert.NotEmpty(deployStash.ABI)
 	assert.NotEmpty(deployStash.Compiled)
 }
+
+func TestPublishPreCompiledCustomErrors(t *testing.T) {
+	assert := assert.New(t)
+	dir := tempdir()
+	defer cleanup(dir)
+
+	scgw, _ := NewSmartContractGateway(
+		&SmartContractGatewayConf{
+			StoragePath: dir,
+			BaseURL:     "http://localhost/api/v1",
+		},
+		&tx.TxnProcessorConf{
+			OrionPrivateAPIS: false,
+		},
+		nil, nil, nil, nil,
+	)
+	router := &httprouter.Router{}
+	scgw.AddRoutes(router)
+
+	b, _ := ioutil.ReadFile(path.Join("..", "..", "test", "simpleevents.solc.output.json"))
+	var contract SolcJson
+	json.Unmarshal(b, &contract)
+	var abi []interface{}
+	json.Unmarshal([]byte(contract.ABI), &abi)
+	abi = append(abi, map[string]interface{}{
+		"type":   "error",
+		"name":   "NotAllowed",
+		"inputs": []interface{}{map[string]interface{}{"name": "caller", "type": "address"}},
+	})
+	abiJSON, _ := json.Marshal(abi)
+
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	fw, _ := writer.CreateFormField("abi")
+	io.Copy(fw, bytes.NewReader(abiJSON))
+	fw, _ = writer.CreateFormField("bytecode")
+	io.Copy(fw, bytes.NewReader([]byte(contract.Bin)))
+	writer.Close()
+	req, _ := http.NewRequest("POST", "/abis", bytes.NewReader(body.Bytes()))
+	req.Header.Add("Content-Type", writer.FormDataContentType())
+	res := httptest.NewRecorder()
+	router.ServeHTTP(res, req)
+	assert.Equal(200, res.Code)
+	var info abiInfo
+	json.NewDecoder(res.Body).Decode(&info)
+
+	deployMsg, _, err := scgw.(*smartContractGW).loadDeployMsgByID(info.ID)
+	assert.NoError(err)
+	assert.Equal("NotAllowed", eth.ErrorABIs(deployMsg.ABI)[0].Name)
+
+	req = httptest.NewRequest("GET", "/abis/"+info.ID+"?swagger", nil)
+	res = httptest.NewRecorder()
+	router.ServeHTTP(res, req)
+	assert.Equal(200, res.Code)
+	var swagger spec.Swagger
+	json.NewDecoder(res.Body).Decode(&swagger)
+	assert.Equal("NotAllowed(address)", swagger.Definitions["NotAllowed_error"].Description)
+	assert.Regexp("NotAllowed", swagger.Paths.Paths["/{address}/set"].Post.Responses.StatusCodeResponses[500].Description)
+}
+
+func TestPublishBadCompilerOptions(t *testing.T) {
+	assert := assert.New(t)
+	dir := tempdir()
+	defer cleanup(dir)
+
+	scgw, _ := NewSmartContractGateway(
+		&SmartContractGatewayConf{
+			StoragePath: dir,
+			BaseURL:     "http://localhost/api/v1",
+		},
+		&tx.TxnProcessorConf{
+			OrionPrivateAPIS: false,
+		},
+		nil, nil, nil, nil,
+	)
+	router := &httprouter.Router{}
+	scgw.AddRoutes(router)
+
+	for field, expected := range map[string]string{
+		"optimizer":     "Could not parse supplied multi-part form data: Invalid value for 'optimizer': strconv.ParseBool: parsing \"maybe\": invalid syntax",
+		"optimizerruns": "Could not parse supplied multi-part form data: Invalid value for 'optimizerruns': maybe",
+		"viair":         "Could not parse supplied multi-part form data: Invalid value for 'viair': strconv.ParseBool: parsing \"maybe\": invalid syntax",
+	} {
+		body := &bytes.Buffer{}
+		writer := multipart.NewWriter(body)
+		fw, _ := writer.CreateFormField(field)
+		io.Copy(fw, bytes.NewReader([]byte("maybe")))
+		writer.Close()
+		req, _ := http.NewRequest("POST", "/abis", bytes.NewReader(body.Bytes()))
+		req.Header.Add("Content-Type", writer.FormDataContentType())
+
+		res := httptest.NewRecorder()
+		router.ServeHTTP(res, req)
+		assert.Equal(400, res.Code)
+		var resBody map[string]interface{}
+		json.NewDecoder(res.Body).Decode(&resBody)
+		assert.Equal(expected, resBody["error"])
+	}
+}
+
+func TestParseCompilerOptions(t *testing.T) {
+	assert := assert.New(t)
+
+	g := &smartContractGW{}
+	opts, err := g.parseCompilerOptions(url.Values{
+		"evm":           []string{"london"},
+		"optimizer":     []string{"true"},
+		"optimizerruns": []string{"1000"},
+		"viair":         []string{"true"},
+	})
+	assert.NoError(err)
+	assert.Equal("london", opts.EVMVersion)
+	assert.True(*opts.OptimizerEnabled)
+	assert.Equal(1000, opts.OptimizerRuns)
+	assert.True(opts.ViaIR)
+
+	opts, err = g.parseCompilerOptions(url.Values{})
+	assert.NoError(err)
+	assert.Nil(opts.OptimizerEnabled)
+
+	_, err = g.parseCompilerOptions(url.Values{
+		"optimizerruns": []string{"0"},
+	})
+	assert.Regexp("Invalid value for 'optimizerruns'", err)
+}
+
+func TestAddToABIIndexCompilerOptions(t *testing.T) {
+	assert := assert.New(t)
+
+	g := &smartContractGW{
+		conf:     &SmartContractGatewayConf{},
+		abiIndex: make(map[string]messages.TimeSortable),
+	}
+	msg := &messages.DeployContract{}
+	msg.CompilerOptions = *eth.CompilerOptionsWithDefaults(&messages.CompilerOptions{ViaIR: true})
+	info := g.addToABIIndex("abi1", msg, time.Now())
+	assert.Equal("byzantium", info.EVMVersion)
+	assert.True(*info.OptimizerEnabled)
+	assert.Equal(200, info.OptimizerRuns)
+	assert.True(info.ViaIR)
+}
+
+func TestRegisterContractQuota(t *testing.T) {
+	assert := assert.New(t)
+	dir := tempdir()
+	defer cleanup(dir)
+
+	deployBytes, _ := json.Marshal(&messages.DeployContract{})
+	ioutil.WriteFile(path.Join(dir, "abi_abi1.deploy.json"), deployBytes, 0644)
+
+	conf := &SmartContractGatewayConf{
+		StoragePath: dir,
+		BaseURL:     "http://localhost/api/v1",
+	}
+	conf.Quotas.Default.MaxContracts = 1
+	s, _ := NewSmartContractGateway(conf, &tx.TxnProcessorConf{}, nil, nil, nil, nil)
+	scgw := s.(*smartContractGW)
+	router := &httprouter.Router{}
+	scgw.AddRoutes(router)
+
+	req := httptest.NewRequest("POST", "/abis/abi1/0x0123456789abcdef0123456789abcdef01234567", bytes.NewReader([]byte{}))
+	res := httptest.NewRecorder()
+	router.ServeHTTP(res, req)
+	assert.Equal(201, res.Code)
+
+	req = httptest.NewRequest("POST", "/abis/abi1/0x123456789abcdef0123456789abcdef012345678", bytes.NewReader([]byte{}))
+	res = httptest.NewRecorder()
+	router.ServeHTTP(res, req)
+	assert.Equal(403, res.Code)
+	var errInfo restErrMsg
+	json.NewDecoder(res.Body).Decode(&errInfo)
+	assert.Equal("Quota exceeded: the maximum number of contracts for tenant '' is 1", errInfo.Message)
+}
+
+func TestRegisterContractPerEnvironment(t *testing.T) {
+	assert := assert.New(t)
+	dir := tempdir()
+	defer cleanup(dir)
+
+	deployBytes, _ := json.Marshal(&messages.DeployContract{})
+	ioutil.WriteFile(path.Join(dir, "abi_abi1.deploy.json"), deployBytes, 0644)
+
+	s, _ := NewSmartContractGateway(
+		&SmartContractGatewayConf{
+			StoragePath: dir,
+			BaseURL:     "http://localhost/api/v1",
+			Environment: "prod",
+		},
+		&tx.TxnProcessorConf{},
+		nil, nil, nil, nil,
+	)
+	scgw := s.(*smartContractGW)
+	router := &httprouter.Router{}
+	scgw.AddRoutes(router)
+
+	register := func(addr, environment string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/abis/abi1/"+addr+"?fly-register=token&fly-environment="+environment, bytes.NewReader([]byte{}))
+		res := httptest.NewRecorder()
+		router.ServeHTTP(res, req)
+		return res
+	}
+	res := register("0x23456789abcdef0123456789abcdef0123456789", "")
+	assert.Equal(201, res.Code)
+	res = register("0x0123456789abcdef0123456789abcdef01234567", "dev")
+	assert.Equal(201, res.Code)
+	var info contractInfo
+	json.NewDecoder(res.Body).Decode(&info)
+	assert.Equal("0123456789abcdef0123456789abcdef01234567", info.Address)
+	assert.Equal("/contracts/0123456789abcdef0123456789abcdef01234567", info.Path)
+	res = register("0x123456789abcdef0123456789abcdef012345678", "prod")
+	assert.Equal(201, res.Code)
+
+	res = register("0x3456789abcdef0123456789abcdef01234567890", "dev")
+	assert.Equal(409, res.Code)
+	var errInfo restErrMsg
+	json.NewDecoder(res.Body).Decode(&errInfo)
+	assert.Equal("Contract address 0123456789abcdef0123456789abcdef01234567 is already registered for name 'token' in environment 'dev'", errInfo.Message)
+	res = register("0x3456789abcdef0123456789abcdef01234567890", "")
+	assert.Equal(409, res.Code)
+	// A contract registered with another name cannot be used for an environment
+	req := httptest.NewRequest("POST", "/abis/abi1/0x3456789abcdef0123456789abcdef01234567890?fly-register=other", bytes.NewReader([]byte{}))
+	res = httptest.NewRecorder()
+	router.ServeHTTP(res, req)
+	assert.Equal(201, res.Code)
+	res = register("0x3456789abcdef0123456789abcdef01234567890", "staging")
+	assert.Equal(409, res.Code)
+	json.NewDecoder(res.Body).Decode(&errInfo)
+	assert.Regexp("already registered as 'other'", errInfo.Message)
+
+	// There is a single registration for the name, holding the address for each environment
+	registered := 0
+	for _, c := range scgw.contractIndex {
+		if c.(*contractInfo).RegisteredAs == "token" {
+			registered++
+		}
+	}
+	assert.Equal(1, registered)
+	assert.Equal(map[string]string{
+		"dev":  "0123456789abcdef0123456789abcdef01234567",
+		"prod": "123456789abcdef0123456789abcdef012345678",
+	}, scgw.contractRegistrations["token"].Environments)
+	_, envInstance, err := scgw.loadDeployMsgForInstance("0123456789abcdef0123456789abcdef01234567")
+	assert.NoError(err)
+	assert.Equal("", envInstance.RegisteredAs)
+
+	addr, err := scgw.resolveContractAddr("token", "dev")
+	assert.NoError(err)
+	assert.Equal("0123456789abcdef0123456789abcdef01234567", addr)
+	// The configured environment applies when the request does not specify one
+	addr, err = scgw.resolveContractAddr("token", "")
+	assert.NoError(err)
+	assert.Equal("123456789abcdef0123456789abcdef012345678", addr)
+	// Environments without a mapping use the default registration
+	addr, err = scgw.resolveContractAddr("token", "staging")
+	assert.NoError(err)
+	assert.Equal("23456789abcdef0123456789abcdef0123456789", addr)
+
+	req = httptest.NewRequest("GET", "/contracts/token", nil)
+	req.Header.Set("x-firefly-environment", "dev")
+	res = httptest.NewRecorder()
+	router.ServeHTTP(res, req)
+	assert.Equal(200, res.Code)
+	json.NewDecoder(res.Body).Decode(&info)
+	assert.Equal("0123456789abcdef0123456789abcdef01234567", info.Address)
+
+	// The mappings are restored from storage
+	s, _ = NewSmartContractGateway(
+		&SmartContractGatewayConf{
+			StoragePath: dir,
+		},
+		&tx.TxnProcessorConf{},
+		nil, nil, nil, nil,
+	)
+	scgw = s.(*smartContractGW)
+	addr, err = scgw.resolveContractAddr("token", "dev")
+	assert.NoError(err)
+	assert.Equal("0123456789abcdef0123456789abcdef01234567", addr)
+	addr, err = scgw.resolveContractAddr("token", "")
+	assert.NoError(err)
+	assert.Equal("23456789abcdef0123456789abcdef0123456789", addr)
+}
+
+func TestPostDeployRegisteredNameEnvironment(t *testing.T) {
+	assert := assert.New(t)
+	dir := tempdir()
+	defer cleanup(dir)
+	s, _ := NewSmartContractGateway(
+		&SmartContractGatewayConf{
+			StoragePath: dir,
+			BaseURL:     "http://localhost/api/v1",
+		},
+		&tx.TxnProcessorConf{},
+		nil, nil, nil, nil,
+	)
+	contractAddr := ethbind.API.HexToAddress("0x0123456789AbcdeF0123456789abCdef01234567")
+	scgw := s.(*smartContractGW)
+	replyMsg := &messages.TransactionReceipt{
+		ReplyCommon: messages.ReplyCommon{
+			Headers: messages.ReplyHeaders{
+				CommonHeaders: messages.CommonHeaders{
+					MsgType: messages.MsgTypeTransactionSuccess,
+				},
+				ReqID: "message1",
+			},
+		},
+		ContractAddress:     &contractAddr,
+		RegisterAs:          "lobster",
+		RegisterEnvironment: "staging",
+	}
+	err := scgw.PostDeploy(replyMsg)
+	assert.NoError(err)
+
+	assert.Equal("http://localhost/api/v1/contracts/lobster?openapi", replyMsg.ContractSwagger)
+	assert.Regexp("already registered for name 'lobster'", scgw.checkNameAvailable("lobster", "", false))
+	assert.Regexp("already registered for name 'lobster' in environment 'staging'", scgw.checkNameAvailable("lobster", "staging", false))
+	assert.NoError(scgw.checkNameAvailable("lobster", "dev", false))
+	// The first address registered with the name is used in other environments
+	addr, err := scgw.resolveContractAddr("lobster", "dev")
+	assert.NoError(err)
+	assert.Equal("0123456789abcdef0123456789abcdef01234567", addr)
+}
+
+func newTestRegistrationsGW(t *testing.T, dir string) (*smartContractGW, *httprouter.Router) {
+	deployBytes, _ := json.Marshal(&messages.DeployContract{})
+	ioutil.WriteFile(path.Join(dir, "abi_abi1.deploy.json"), deployBytes, 0644)
+
+	s, _ := NewSmartContractGateway(
+		&SmartContractGatewayConf{
+			StoragePath: dir,
+			BaseURL:     "http://localhost/api/v1",
+		},
+		&tx.TxnProcessorConf{},
+		nil, nil, nil, nil,
+	)
+	scgw := s.(*smartContractGW)
+	router := &httprouter.Router{}
+	scgw.AddRoutes(router)
+	return scgw, router
+}
+
+func TestDeleteRegistration(t *testing.T) {
+	assert := assert.New(t)
+	dir := tempdir()
+	defer cleanup(dir)
+
+	scgw, router := newTestRegistrationsGW(t, dir)
+	req := httptest.NewRequest("POST", "/abis/abi1/0x0123456789abcdef0123456789abcdef01234567?fly-register=token", bytes.NewReader([]byte{}))
+	res := httptest.NewRecorder()
+	router.ServeHTTP(res, req)
+	assert.Equal(201, res.Code)
+
+	req = httptest.NewRequest("DELETE", "/contracts/registrations/token", nil)
+	res = httptest.NewRecorder()
+	router.ServeHTTP(res, req)
+	assert.Equal(204, res.Code)
+
+	_, err := scgw.resolveContractAddr("token", "")
+	assert.Regexp("Failed to find installed contract address for 'token'", err)
+	_, info, err := scgw.loadDeployMsgForInstance("0123456789abcdef0123456789abcdef01234567")
+	assert.NoError(err)
+	assert.Equal("", info.RegisteredAs)
+	assert.Equal("/contracts/0123456789abcdef0123456789abcdef01234567", info.Path)
+
+	// The change is persisted, and the name can be re-used
+	scgw, router = newTestRegistrationsGW(t, dir)
+	_, info, err = scgw.loadDeployMsgForInstance("0123456789abcdef0123456789abcdef01234567")
+	assert.NoError(err)
+	assert.Equal("", info.RegisteredAs)
+	req = httptest.NewRequest("POST", "/abis/abi1/0x123456789abcdef0123456789abcdef012345678?fly-register=token", bytes.NewReader([]byte{}))
+	res = httptest.NewRecorder()
+	router.ServeHTTP(res, req)
+	assert.Equal(201, res.Code)
+
+	req = httptest.NewRequest("DELETE", "/contracts/registrations/token?fly-environment=dev", nil)
+	res = httptest.NewRecorder()
+	router.ServeHTTP(res, req)
+	assert.Equal(404, res.Code)
+	var errInfo restErrMsg
+	json.NewDecoder(res.Body).Decode(&errInfo)
+	assert.Equal("No contract registered with name 'token' in environment 'dev'", errInfo.Message)
+}
+
+func TestDeleteRegistrationEnvironment(t *testing.T) {
+	assert := assert.New(t)
+	dir := tempdir()
+	defer cleanup(dir)
+
+	scgw, router := newTestRegistrationsGW(t, dir)
+	_, err := scgw.storeNewContractInfo("0123456789abcdef0123456789abcdef01234567", "abi1", "token", "token", "", "")
+	assert.NoError(err)
+	_, err = scgw.storeNewContractInfo("123456789abcdef0123456789abcdef012345678", "abi1", "token", "token", "dev", "")
+	assert.NoError(err)
+	_, err = scgw.storeNewContractInfo("23456789abcdef0123456789abcdef0123456789", "abi1", "token", "token", "prod", "")
+	assert.NoError(err)
+
+	// Removing the name in one environment leaves the registration in place
+	req := httptest.NewRequest("DELETE", "/contracts/registrations/token?fly-environment=dev", nil)
+	res := httptest.NewRecorder()
+	router.ServeHTTP(res, req)
+	assert.Equal(204, res.Code)
+	addr, err := scgw.resolveContractAddr("token", "dev")
+	assert.NoError(err)
+	assert.Equal("0123456789abcdef0123456789abcdef01234567", addr)
+	assert.Equal(map[string]string{"prod": "23456789abcdef0123456789abcdef0123456789"}, scgw.contractRegistrations["token"].Environments)
+
+	// Deleting the contract for an environment removes it from the registration
+	req = httptest.NewRequest("DELETE", "/contracts/23456789abcdef0123456789abcdef0123456789", nil)
+	res = httptest.NewRecorder()
+	router.ServeHTTP(res, req)
+	assert.Equal(204, res.Code)
+	assert.Nil(scgw.contractRegistrations["token"].Environments)
+
+	// Persisted across a restart
+	scgw, _ = newTestRegistrationsGW(t, dir)
+	addr, err = scgw.resolveContractAddr("token", "prod")
+	assert.NoError(err)
+	assert.Equal("0123456789abcdef0123456789abcdef01234567", addr)
+	assert.Nil(scgw.contractRegistrations["token"].Environments)
+}
+
+func TestDeleteRegistrationWriteFail(t *testing.T) {
+	assert := assert.New(t)
+	dir := tempdir()
+	defer cleanup(dir)
+
+	scgw, router := newTestRegistrationsGW(t, dir)
+	_, err := scgw.storeNewContractInfo("0123456789abcdef0123456789abcdef01234567", "abi1", "token", "token", "", "")
+	assert.NoError(err)
+	scgw.store = &fileRegistryStore{dir: path.Join(dir, "badpath")}
+
+	req := httptest.NewRequest("DELETE", "/contracts/registrations/token", nil)
+	res := httptest.NewRecorder()
+	router.ServeHTTP(res, req)
+	assert.Equal(404, res.Code)
+	addr, err := scgw.resolveContractAddr("token", "")
+	assert.NoError(err)
+	assert.Equal("0123456789abcdef0123456789abcdef01234567", addr)
+}
+
+func TestDeleteContractAndABI(t *testing.T) {
+	assert := assert.New(t)
+	dir := tempdir()
+	defer cleanup(dir)
+
+	scgw, router := newTestRegistrationsGW(t, dir)
+	ioutil.WriteFile(path.Join(dir, "source_abi1.source.json"), []byte(`{}`), 0644)
+	_, err := scgw.storeNewContractInfo("0123456789abcdef0123456789abcdef01234567", "abi1", "token", "token", "", "")
+	assert.NoError(err)
+	_, err = scgw.storeNewContractInfo("123456789abcdef0123456789abcdef012345678", "abi1", "123456789abcdef0123456789abcdef012345678", "", "", "")
+	assert.NoError(err)
+
+	// The ABI cannot be deleted while contract instances use it
+	req := httptest.NewRequest("DELETE", "/abis/abi1", nil)
+	res := httptest.NewRecorder()
+	router.ServeHTTP(res, req)
+	assert.Equal(409, res.Code)
+	var errInfo restErrMsg
+	json.NewDecoder(res.Body).Decode(&errInfo)
+	assert.Regexp("ABI abi1 cannot be deleted while it is used by contract instance", errInfo.Message)
+
+	// Delete one instance by its friendly name, and the other by its address
+	req = httptest.NewRequest("DELETE", "/contracts/token", nil)
+	res = httptest.NewRecorder()
+	router.ServeHTTP(res, req)
+	assert.Equal(204, res.Code)
+	_, err = scgw.resolveContractAddr("token", "")
+	assert.Error(err)
+	_, err = os.Stat(path.Join(dir, "contract_0123456789abcdef0123456789abcdef01234567.instance.json"))
+	assert.True(os.IsNotExist(err))
+
+	req = httptest.NewRequest("DELETE", "/contracts/0x123456789ABCDEF0123456789abcdef012345678", nil)
+	res = httptest.NewRecorder()
+	router.ServeHTTP(res, req)
+	assert.Equal(204, res.Code)
+	assert.Equal(0, len(scgw.contractIndex))
+
+	req = httptest.NewRequest("DELETE", "/abis/abi1", nil)
+	res = httptest.NewRecorder()
+	router.ServeHTTP(res, req)
+	assert.Equal(204, res.Code)
+	assert.Equal(0, len(scgw.abiIndex))
+	_, err = os.Stat(path.Join(dir, "abi_abi1.deploy.json"))
+	assert.True(os.IsNotExist(err))
+	_, err = os.Stat(path.Join(dir, "source_abi1.source.json"))
+	assert.True(os.IsNotExist(err))
+
+	// Both are gone after a restart
+	scgw, router = newTestRegistrationsGW(t, dir)
+	assert.Equal(0, len(scgw.contractIndex))
+
+	req = httptest.NewRequest("DELETE", "/contracts/token", nil)
+	res = httptest.NewRecorder()
+	router.ServeHTTP(res, req)
+	assert.Equal(404, res.Code)
+
+	req = httptest.NewRequest("DELETE", "/abis/abi2", nil)
+	res = httptest.NewRecorder()
+	router.ServeHTTP(res, req)
+	assert.Equal(404, res.Code)
+	json.NewDecoder(res.Body).Decode(&errInfo)
+	assert.Equal("No ABI found with ID abi2", errInfo.Message)
+}
+
+func TestDeleteContractInUse(t *testing.T) {
+	assert := assert.New(t)
+	dir := tempdir()
+	defer cleanup(dir)
+
+	scgw, router := newTestRegistrationsGW(t, dir)
+	_, err := scgw.storeNewContractInfo("0123456789abcdef0123456789abcdef01234567", "abi1", "token", "token", "", "")
+	assert.NoError(err)
+	var sub events.SubscriptionInfo
+	json.Unmarshal([]byte(`{"id":"sb-1","filter":{"address":["0x0123456789ABCDEF0123456789abcdef01234567"]}}`), &sub)
+	scgw.sm = &mockSubMgr{subs: []*events.SubscriptionInfo{{ID: "sb-0"}, &sub}}
+
+	req := httptest.NewRequest("DELETE", "/contracts/token", nil)
+	res := httptest.NewRecorder()
+	router.ServeHTTP(res, req)
+	assert.Equal(409, res.Code)
+	var errInfo restErrMsg
+	json.NewDecoder(res.Body).Decode(&errInfo)
+	assert.Equal("Contract instance 0123456789abcdef0123456789abcdef01234567 cannot be deleted while it is used by subscription 'sb-1'", errInfo.Message)
+	_, err = scgw.resolveContractAddr("token", "")
+	assert.NoError(err)
+}
+
+func TestDeleteContractAndABIStoreFail(t *testing.T) {
+	assert := assert.New(t)
+	dir := tempdir()
+	defer cleanup(dir)
+
+	scgw, router := newTestRegistrationsGW(t, dir)
+	_, err := scgw.storeNewContractInfo("0123456789abcdef0123456789abcdef01234567", "abi2", "token", "token", "dev", "")
+	assert.NoError(err)
+	// Entries that are non-empty directories cannot be removed
+	for _, name := range []string{"contract_0123456789abcdef0123456789abcdef01234567.instance.json", "abi_abi1.deploy.json"} {
+		os.Remove(path.Join(dir, name))
+		os.MkdirAll(path.Join(dir, name, "child"), 0755)
+	}
+
+	req := httptest.NewRequest("DELETE", "/contracts/token?fly-environment=dev", nil)
+	res := httptest.NewRecorder()
+	router.ServeHTTP(res, req)
+	assert.Equal(500, res.Code)
+	var errInfo restErrMsg
+	json.NewDecoder(res.Body).Decode(&errInfo)
+	assert.Regexp("Failed to delete contract instance 0123456789abcdef0123456789abcdef01234567", errInfo.Message)
+	addr, err := scgw.resolveContractAddr("token", "dev")
+	assert.NoError(err)
+	assert.Equal("0123456789abcdef0123456789abcdef01234567", addr)
+
+	req = httptest.NewRequest("DELETE", "/abis/abi1", nil)
+	res = httptest.NewRecorder()
+	router.ServeHTTP(res, req)
+	assert.Equal(500, res.Code)
+	json.NewDecoder(res.Body).Decode(&errInfo)
+	assert.Regexp("Failed to delete ABI abi1", errInfo.Message)
+	assert.Equal(1, len(scgw.abiIndex))
+}
+
+func TestMoveRegistration(t *testing.T) {
+	assert := assert.New(t)
+	dir := tempdir()
+	defer cleanup(dir)
+
+	scgw, router := newTestRegistrationsGW(t, dir)
+	_, err := scgw.storeNewContractInfo("0123456789abcdef0123456789abcdef01234567", "abi1", "token", "token", "dev", "")
+	assert.NoError(err)
+	_, err = scgw.storeNewContractInfo("123456789abcdef0123456789abcdef012345678", "abi1", "123456789abcdef0123456789abcdef012345678", "", "", "")
+	assert.NoError(err)
+	_, err = scgw.storeNewContractInfo("23456789abcdef0123456789abcdef0123456789", "abi1", "other", "other", "", "")
+	assert.NoError(err)
+
+	move := func(name, query, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("PUT", "/contracts/registrations/"+name+query, bytes.NewReader([]byte(body)))
+		req.Header.Set("Content-Type", "application/json")
+		res := httptest.NewRecorder()
+		router.ServeHTTP(res, req)
+		return res
+	}
+
+	// Moving the name in an environment only changes the address for that environment
+	res := move("token", "?fly-environment=dev", `{"address":"0x123456789ABCDEF0123456789abcdef012345678"}`)
+	assert.Equal(200, res.Code)
+	var info contractInfo
+	json.NewDecoder(res.Body).Decode(&info)
+	assert.Equal("0123456789abcdef0123456789abcdef01234567", info.Address)
+	assert.Equal("token", info.RegisteredAs)
+	assert.Equal(map[string]string{"dev": "123456789abcdef0123456789abcdef012345678"}, info.Environments)
+	assert.Equal("/contracts/token", info.Path)
+
+	addr, err := scgw.resolveContractAddr("token", "dev")
+	assert.NoError(err)
+	assert.Equal("123456789abcdef0123456789abcdef012345678", addr)
+	addr, err = scgw.resolveContractAddr("token", "")
+	assert.NoError(err)
+	assert.Equal("0123456789abcdef0123456789abcdef01234567", addr)
+	_, target, err := scgw.loadDeployMsgForInstance("123456789abcdef0123456789abcdef012345678")
+	assert.NoError(err)
+	assert.Equal("", target.RegisteredAs)
+
+	// Persisted across a restart
+	scgw, router = newTestRegistrationsGW(t, dir)
+	addr, err = scgw.resolveContractAddr("token", "dev")
+	assert.NoError(err)
+	assert.Equal("123456789abcdef0123456789abcdef012345678", addr)
+
+	// Moving to the same address is a no-op
+	res = move("token", "?fly-environment=dev", `{"address":"123456789abcdef0123456789abcdef012345678"}`)
+	assert.Equal(200, res.Code)
+
+	// Cannot move to a contract that has its own name
+	res = move("token", "?fly-environment=dev", `{"address":"23456789abcdef0123456789abcdef0123456789"}`)
+	assert.Equal(409, res.Code)
+	var errInfo restErrMsg
+	json.NewDecoder(res.Body).Decode(&errInfo)
+	assert.Regexp("already registered as 'other'", errInfo.Message)
+
+	res = move("token", "?fly-environment=dev", `{"address":"3456789abcdef0123456789abcdef01234567890"}`)
+	assert.Equal(409, res.Code)
+	res = move("token", "?fly-environment=staging", `{"address":"0123456789abcdef0123456789abcdef01234567"}`)
+	assert.Equal(404, res.Code)
+	res = move("unknown", "", `{"address":"0123456789abcdef0123456789abcdef01234567"}`)
+	assert.Equal(404, res.Code)
+
+	// Moving the name itself takes the environment addresses with it
+	res = move("token", "", `{"address":"123456789abcdef0123456789abcdef012345678"}`)
+	assert.Equal(200, res.Code)
+	json.NewDecoder(res.Body).Decode(&info)
+	assert.Equal("123456789abcdef0123456789abcdef012345678", info.Address)
+	assert.Equal(map[string]string{"dev": "123456789abcdef0123456789abcdef012345678"}, info.Environments)
+	_, prev, err := scgw.loadDeployMsgForInstance("0123456789abcdef0123456789abcdef01234567")
+	assert.NoError(err)
+	assert.Equal("", prev.RegisteredAs)
+	assert.Nil(prev.Environments)
+	res = move("token", "?fly-environment=dev", `{"address":"bad"}`)
+	assert.Equal(400, res.Code)
+	res = move("token", "?fly-environment=dev", `!bad json`)
+	assert.Equal(400, res.Code)
+}
+
+func TestMoveRegistrationWriteFail(t *testing.T) {
+	assert := assert.New(t)
+	dir := tempdir()
+	defer cleanup(dir)
+
+	scgw, _ := newTestRegistrationsGW(t, dir)
+	_, err := scgw.storeNewContractInfo("0123456789abcdef0123456789abcdef01234567", "abi1", "token", "token", "", "")
+	assert.NoError(err)
+	_, err = scgw.storeNewContractInfo("123456789abcdef0123456789abcdef012345678", "abi1", "123456789abcdef0123456789abcdef012345678", "", "", "")
+	assert.NoError(err)
+	scgw.store = &fileRegistryStore{dir: path.Join(dir, "badpath")}
+
+	_, status, err := scgw.renameRegistration("token", "", "123456789abcdef0123456789abcdef012345678")
+	assert.Regexp("Failed to write ABI JSON", err)
+	assert.Equal(500, status)
+	addr, err := scgw.resolveContractAddr("token", "")
+	assert.NoError(err)
+	assert.Equal("0123456789abcdef0123456789abcdef01234567", addr)
+}
+
+func TestAddBackfill(t *testing.T) {
+	assert := assert.New(t)
+
+	mockSubMgr := &mockSubMgr{}
+	var result events.BackfillInfo
+	res := testGWPathBody("POST", events.BackfillPathPrefix, &result, mockSubMgr, bytes.NewReader([]byte(`{
+		"type": "kafka",
+		"fromBlock": "100",
+		"event": {"name": "Changed"}
+	}`)))
+	assert.Equal(202, res.Result().StatusCode)
+	assert.Equal("kafka", result.Type)
+	assert.Equal("100", result.FromBlock)
+}
+
+func TestAddBackfillBadData(t *testing.T) {
+	assert := assert.New(t)
+
+	var errInfo = restErrMsg{}
+	res := testGWPathBody("POST", events.BackfillPathPrefix, &errInfo, &mockSubMgr{}, bytes.NewReader([]byte(":bad json")))
+	assert.Equal(400, res.Result().StatusCode)
+	assert.Regexp("Invalid backfill specification", errInfo.Message)
+}
+
+func TestAddBackfillFail(t *testing.T) {
+	assert := assert.New(t)
+
+	var errInfo = restErrMsg{}
+	res := testGWPathBody("POST", events.BackfillPathPrefix, &errInfo, &mockSubMgr{err: fmt.Errorf("pop")}, bytes.NewReader([]byte("{}")))
+	assert.Equal(400, res.Result().StatusCode)
+	assert.Equal("pop", errInfo.Message)
+}
+
+func TestAddBackfillNoSubMgr(t *testing.T) {
+	assert := assert.New(t)
+	res := testGWPath("POST", events.BackfillPathPrefix, nil, nil)
+	assert.Equal(405, res.Result().StatusCode)
+}
+
+func TestListBackfills(t *testing.T) {
+	assert := assert.New(t)
+
+	mockSubMgr := &mockSubMgr{
+		backfills: []*events.BackfillInfo{
+			{
+				TimeSorted: messages.TimeSorted{
+					CreatedISO8601: time.Now().UTC().Format(time.RFC3339),
+				}, ID: "earlier",
+			},
+			{
+				TimeSorted: messages.TimeSorted{
+					CreatedISO8601: time.Now().UTC().Add(1 * time.Hour).Format(time.RFC3339),
+				}, ID: "later",
+			},
+		},
+	}
+	var results []*events.BackfillInfo
+	res := testGWPath("GET", events.BackfillPathPrefix, &results, mockSubMgr)
+	assert.Equal(200, res.Result().StatusCode)
+	assert.Equal(2, len(results))
+	assert.Equal("later", results[0].ID)
+	assert.Equal("earlier", results[1].ID)
+}
+
+func TestGetBackfill(t *testing.T) {
+	assert := assert.New(t)
+
+	mockSubMgr := &mockSubMgr{
+		backfill: &events.BackfillInfo{ID: "bf-123", Progress: events.BackfillProgress{PercentComplete: 50}},
+	}
+	var result events.BackfillInfo
+	res := testGWPath("GET", events.BackfillPathPrefix+"/bf-123", &result, mockSubMgr)
+	assert.Equal(200, res.Result().StatusCode)
+	assert.Equal("bf-123", result.ID)
+	assert.Equal(50, result.Progress.PercentComplete)
+}
+
+func TestDeleteBackfill(t *testing.T) {
+	assert := assert.New(t)
+
+	res := testGWPath("DELETE", events.BackfillPathPrefix+"/bf-123", nil, &mockSubMgr{})
+	assert.Equal(204, res.Result().StatusCode)
+}
+
+func TestResumeBackfill(t *testing.T) {
+	assert := assert.New(t)
+
+	mockSubMgr := &mockSubMgr{
+		backfill: &events.BackfillInfo{ID: "bf-123", Status: events.BackfillStatusRunning},
+	}
+	var result events.BackfillInfo
+	res := testGWPath("POST", events.BackfillPathPrefix+"/bf-123/resume", &result, mockSubMgr)
+	assert.Equal(202, res.Result().StatusCode)
+	assert.True(mockSubMgr.resumed)
+	assert.Equal(events.BackfillStatusRunning, result.Status)
+}
+
+func TestResumeBackfillFail(t *testing.T) {
+	assert := assert.New(t)
+
+	var errInfo = restErrMsg{}
+	res := testGWPath("POST", events.BackfillPathPrefix+"/bf-123/resume", &errInfo, &mockSubMgr{err: fmt.Errorf("pop")})
+	assert.Equal(500, res.Result().StatusCode)
+	assert.Equal("pop", errInfo.Message)
+}
+
+func TestResumeBackfillNoSubMgr(t *testing.T) {
+	assert := assert.New(t)
+
+	res := testGWPath("POST", events.BackfillPathPrefix+"/bf-123/resume", nil, nil)
+	assert.Equal(405, res.Result().StatusCode)
+}
+
+func TestAddInvalidationHook(t *testing.T) {
+	assert := assert.New(t)
+
+	sm := &mockSubMgr{}
+	var result events.InvalidationHookInfo
+	res := testGWPathBody("POST", events.InvalidationPathPrefix, &result, sm, bytes.NewReader([]byte(`{
+		"addresses": ["0x0123456789abcDEF0123456789abCDef01234567"],
+		"events": ["Changed"],
+		"webhook": {"url": "http://cache.example.com/invalidate"}
+	}`)))
+	assert.Equal(200, res.Result().StatusCode)
+	assert.Equal(1, len(result.Addresses))
+	assert.Equal([]string{"Changed"}, result.Events)
+}
+
+func TestAddInvalidationHookBadData(t *testing.T) {
+	assert := assert.New(t)
+
+	var errInfo = restErrMsg{}
+	res := testGWPathBody("POST", events.InvalidationPathPrefix, &errInfo, &mockSubMgr{}, bytes.NewReader([]byte(":bad json")))
+	assert.Equal(400, res.Result().StatusCode)
+	assert.Regexp("Invalid cache invalidation hook specification", errInfo.Message)
+}
+
+func TestAddInvalidationHookFail(t *testing.T) {
+	assert := assert.New(t)
+
+	var errInfo = restErrMsg{}
+	res := testGWPathBody("POST", events.InvalidationPathPrefix, &errInfo, &mockSubMgr{err: fmt.Errorf("pop")}, bytes.NewReader([]byte("{}")))
+	assert.Equal(400, res.Result().StatusCode)
+	assert.Equal("pop", errInfo.Message)
+}
+
+func TestAddInvalidationHookNoSubMgr(t *testing.T) {
+	assert := assert.New(t)
+	res := testGWPath("POST", events.InvalidationPathPrefix, nil, nil)
+	assert.Equal(405, res.Result().StatusCode)
+}
+
+func TestListInvalidationHooks(t *testing.T) {
+	assert := assert.New(t)
+
+	sm := &mockSubMgr{
+		invalidationHooks: []*events.InvalidationHookInfo{
+			{
+				TimeSorted: messages.TimeSorted{
+					CreatedISO8601: time.Now().UTC().Format(time.RFC3339),
+				}, ID: "earlier",
+			},
+			{
+				TimeSorted: messages.TimeSorted{
+					CreatedISO8601: time.Now().UTC().Add(1 * time.Hour).Format(time.RFC3339),
+				}, ID: "later",
+			},
+		},
+	}
+	var results []*events.InvalidationHookInfo
+	res := testGWPath("GET", events.InvalidationPathPrefix, &results, sm)
+	assert.Equal(200, res.Result().StatusCode)
+	assert.Equal(2, len(results))
+	assert.Equal("later", results[0].ID)
+	assert.Equal("earlier", results[1].ID)
+}
+
+func TestGetInvalidationHook(t *testing.T) {
+	assert := assert.New(t)
+
+	sm := &mockSubMgr{
+		invalidationHook: &events.InvalidationHookInfo{ID: "ih-123"},
+	}
+	var result events.InvalidationHookInfo
+	res := testGWPath("GET", events.InvalidationPathPrefix+"/ih-123", &result, sm)
+	assert.Equal(200, res.Result().StatusCode)
+	assert.Equal("ih-123", result.ID)
+}
+
+func TestDeleteInvalidationHook(t *testing.T) {
+	assert := assert.New(t)
+
+	res := testGWPath("DELETE", events.InvalidationPathPrefix+"/ih-123", nil, &mockSubMgr{})
+	assert.Equal(204, res.Result().StatusCode)
+}
+
+func TestAddChainSubscription(t *testing.T) {
+	assert := assert.New(t)
+
+	mockSubMgr := &mockSubMgr{sub: &events.SubscriptionInfo{ID: "sb-123", Type: events.SubscriptionTypePendingTransactions}}
+	var result events.SubscriptionInfo
+	res := testGWPathBody("POST", events.SubPathPrefix, &result, mockSubMgr, bytes.NewReader([]byte(`{
+		"type": "pendingTransactions",
+		"stream": "es-123",
+		"fromBlock": "100",
+		"address": "0x2b8c0ECc76d0759a8F50b2E14A6881367D805832"
+	}`)))
+	assert.Equal(200, res.Result().StatusCode)
+	assert.Equal("sb-123", result.ID)
+	assert.Equal(events.SubscriptionTypePendingTransactions, mockSubMgr.capturedSubType)
+	assert.Equal("100", mockSubMgr.capturedBlock)
+	assert.Equal("0x2b8c0ECc76d0759a8F50b2E14A6881367D805832", mockSubMgr.capturedAddr.String())
+}
+
+func TestAddChainSubscriptionBadData(t *testing.T) {
+	assert := assert.New(t)
+
+	var errInfo = restErrMsg{}
+	res := testGWPathBody("POST", events.SubPathPrefix, &errInfo, &mockSubMgr{}, bytes.NewReader([]byte(":bad json")))
+	assert.Equal(400, res.Result().StatusCode)
+	assert.Regexp("Invalid subscription specification", errInfo.Message)
+
+	res = testGWPathBody("POST", events.SubPathPrefix, &errInfo, &mockSubMgr{}, bytes.NewReader([]byte(`{"type":"blocks"}`)))
+	assert.Equal(400, res.Result().StatusCode)
+	assert.Regexp("Must supply a 'stream' parameter", errInfo.Message)
+
+	res = testGWPathBody("POST", events.SubPathPrefix, &errInfo, &mockSubMgr{}, bytes.NewReader([]byte(`{"type":"pendingTransactions","stream":"es-123","address":"badness"}`)))
+	assert.Equal(400, res.Result().StatusCode)
+	assert.Regexp("invalid address badness", errInfo.Message)
+}
+
+func TestAddChainSubscriptionFail(t *testing.T) {
+	assert := assert.New(t)
+
+	var errInfo = restErrMsg{}
+	res := testGWPathBody("POST", events.SubPathPrefix, &errInfo, &mockSubMgr{err: fmt.Errorf("pop")}, bytes.NewReader([]byte(`{"type":"blocks","stream":"es-123"}`)))
+	assert.Equal(400, res.Result().StatusCode)
+	assert.Equal("pop", errInfo.Message)
+
+	res = testGWPath("POST", events.SubPathPrefix, nil, nil)
+	assert.Equal(405, res.Result().StatusCode)
+}
+
+func TestAddCheckpointGroup(t *testing.T) {
+	assert := assert.New(t)
+
+	sm := &mockSubMgr{}
+	var result events.CheckpointGroupInfo
+	res := testGWPathBody("POST", events.CheckpointGroupPathPrefix, &result, sm, bytes.NewReader([]byte(`{
+		"name": "orders",
+		"stream": "es-123",
+		"subscriptions": ["sb-1", "sb-2"]
+	}`)))
+	assert.Equal(200, res.Result().StatusCode)
+	assert.Equal("orders", result.Name)
+	assert.Equal([]string{"sb-1", "sb-2"}, result.Subscriptions)
+}
+
+func TestAddCheckpointGroupBadData(t *testing.T) {
+	assert := assert.New(t)
+
+	var errInfo = restErrMsg{}
+	res := testGWPathBody("POST", events.CheckpointGroupPathPrefix, &errInfo, &mockSubMgr{}, bytes.NewReader([]byte(":bad json")))
+	assert.Equal(400, res.Result().StatusCode)
+	assert.Regexp("Invalid checkpoint group specification", errInfo.Message)
+}
+
+func TestAddCheckpointGroupFail(t *testing.T) {
+	assert := assert.New(t)
+
+	var errInfo = restErrMsg{}
+	res := testGWPathBody("POST", events.CheckpointGroupPathPrefix, &errInfo, &mockSubMgr{err: fmt.Errorf("pop")}, bytes.NewReader([]byte("{}")))
+	assert.Equal(400, res.Result().StatusCode)
+	assert.Equal("pop", errInfo.Message)
+}
+
+func TestCheckpointGroupsNoSubMgr(t *testing.T) {
+	assert := assert.New(t)
+	res := testGWPath("POST", events.CheckpointGroupPathPrefix, nil, nil)
+	assert.Equal(405, res.Result().StatusCode)
+	res = testGWPath("GET", events.CheckpointGroupPathPrefix+"/orders/checkpoint", nil, nil)
+	assert.Equal(405, res.Result().StatusCode)
+	res = testGWPath("POST", events.CheckpointGroupPathPrefix+"/orders/reset", nil, nil)
+	assert.Equal(405, res.Result().StatusCode)
+}
+
+func TestListCheckpointGroups(t *testing.T) {
+	assert := assert.New(t)
+
+	sm := &mockSubMgr{
+		checkpointGroups: []*events.CheckpointGroupInfo{
+			{
+				TimeSorted: messages.TimeSorted{
+					CreatedISO8601: time.Now().UTC().Format(time.RFC3339),
+				}, Name: "earlier",
+			},
+			{
+				TimeSorted: messages.TimeSorted{
+					CreatedISO8601: time.Now().UTC().Add(1 * time.Hour).Format(time.RFC3339),
+				}, Name: "later",
+			},
+		},
+	}
+	var results []*events.CheckpointGroupInfo
+	res := testGWPath("GET", events.CheckpointGroupPathPrefix, &results, sm)
+	assert.Equal(200, res.Result().StatusCode)
+	assert.Equal(2, len(results))
+	assert.Equal("later", results[0].Name)
+	assert.Equal("earlier", results[1].Name)
+}
+
+func TestGetAndDeleteCheckpointGroup(t *testing.T) {
+	assert := assert.New(t)
+
+	sm := &mockSubMgr{
+		checkpointGroup: &events.CheckpointGroupInfo{Name: "orders"},
+	}
+	var result events.CheckpointGroupInfo
+	res := testGWPath("GET", events.CheckpointGroupPathPrefix+"/orders", &result, sm)
+	assert.Equal(200, res.Result().StatusCode)
+	assert.Equal("orders", result.Name)
+
+	res = testGWPath("DELETE", events.CheckpointGroupPathPrefix+"/orders", nil, sm)
+	assert.Equal(204, res.Result().StatusCode)
+}
+
+func TestGetCheckpointGroupCheckpoint(t *testing.T) {
+	assert := assert.New(t)
+
+	sm := &mockSubMgr{
+		groupCheckpoint: &events.CheckpointGroupCheckpoint{Name: "orders", Block: "100"},
+	}
+	var result events.CheckpointGroupCheckpoint
+	res := testGWPath("GET", events.CheckpointGroupPathPrefix+"/orders/checkpoint", &result, sm)
+	assert.Equal(200, res.Result().StatusCode)
+	assert.Equal("100", result.Block)
+
+	var errInfo = restErrMsg{}
+	res = testGWPath("GET", events.CheckpointGroupPathPrefix+"/missing/checkpoint", &errInfo, &mockSubMgr{checkpointErr: fmt.Errorf("pop")})
+	assert.Equal(404, res.Result().StatusCode)
+	assert.Equal("pop", errInfo.Message)
+}
+
+func TestResetCheckpointGroup(t *testing.T) {
+	assert := assert.New(t)
+
+	sm := &mockSubMgr{}
+	res := testGWPathBody("POST", events.CheckpointGroupPathPrefix+"/orders/reset", nil, sm, bytes.NewReader([]byte(`{"fromBlock": "12345"}`)))
+	assert.Equal(204, res.Result().StatusCode)
+	assert.Equal("12345", sm.capturedBlock)
+
+	var errInfo = restErrMsg{}
+	res = testGWPathBody("POST", events.CheckpointGroupPathPrefix+"/orders/reset", &errInfo, &mockSubMgr{err: fmt.Errorf("pop")}, bytes.NewReader([]byte(`{}`)))
+	assert.Equal(500, res.Result().StatusCode)
+	assert.Equal("pop", errInfo.Message)
+}
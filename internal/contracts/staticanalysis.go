@@ -0,0 +1,265 @@
+// Copyright 2021 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package contracts
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os/exec"
+	"path"
+	"strings"
+	"time"
+
+	ethconnecterrors "github.com/kaleido-io/ethconnect/internal/errors"
+	"github.com/kaleido-io/ethconnect/internal/messages"
+	"github.com/kaleido-io/ethconnect/internal/utils"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	defaultStaticAnalysisTimeoutSec = 120
+	// staticAnalysisFileArg is replaced in the analyzer command by the source file of the contract
+	staticAnalysisFileArg = "{{file}}"
+	// staticAnalysisSourceFile is the file the Solidity of a deploy message is analyzed in
+	staticAnalysisSourceFile = "contract.sol"
+)
+
+// staticAnalysisSeverities ranks the severities of findings. Slither reports optimizations
+// with an impact of "Optimization", which never block deployment
+var staticAnalysisSeverities = map[string]int{
+	"informational": 1,
+	"low":           2,
+	"medium":        3,
+	"high":          4,
+}
+
+// StaticAnalysisConf configures a static analyzer, such as slither, that is run on Solidity
+// as it is compiled. Either the command is run in the directory of the uploaded sources,
+// with {{file}} replaced by the source file of the contract, or the flattened source is
+// posted to the URL. The output must be JSON, either in the format of the slither --json
+// output, or as {"findings":[{"check","severity","confidence","description"}]}.
+// If BlockSeverity is set, contracts with findings of that severity or higher cannot be deployed
+type StaticAnalysisConf struct {
+	Command       []string          `json:"command,omitempty"`
+	URL           string            `json:"url,omitempty"`
+	Headers       map[string]string `json:"headers,omitempty"`
+	TimeoutSec    int               `json:"timeoutSec,omitempty"`
+	BlockSeverity string            `json:"blockSeverity,omitempty"`
+}
+
+type staticAnalyzer struct {
+	conf      *StaticAnalysisConf
+	client    *http.Client
+	blockRank int
+}
+
+// staticAnalysisOutput accepts both our own format, and that of slither
+type staticAnalysisOutput struct {
+	Findings []*messages.StaticAnalysisFinding `json:"findings"`
+	Success  *bool                             `json:"success"`
+	Error    string                            `json:"error"`
+	Results  *struct {
+		Detectors []struct {
+			Check       string `json:"check"`
+			Impact      string `json:"impact"`
+			Confidence  string `json:"confidence"`
+			Description string `json:"description"`
+		} `json:"detectors"`
+	} `json:"results"`
+}
+
+// newStaticAnalyzer returns nil if no analyzer is configured
+func newStaticAnalyzer(conf *StaticAnalysisConf) (*staticAnalyzer, error) {
+	if len(conf.Command) == 0 && conf.URL == "" {
+		return nil, nil
+	}
+	if conf.TimeoutSec <= 0 {
+		conf.TimeoutSec = defaultStaticAnalysisTimeoutSec
+	}
+	a := &staticAnalyzer{
+		conf: conf,
+		client: &http.Client{
+			Timeout:   time.Duration(conf.TimeoutSec) * time.Second,
+			Transport: utils.EgressTransport(nil),
+		},
+	}
+	if conf.BlockSeverity != "" {
+		rank, known := staticAnalysisSeverities[strings.ToLower(conf.BlockSeverity)]
+		if !known {
+			return nil, ethconnecterrors.Errorf(ethconnecterrors.RESTGatewayStaticAnalysisBadSeverity, conf.BlockSeverity)
+		}
+		a.blockRank = rank
+	}
+	return a, nil
+}
+
+// analyze runs the analyzer over the source file of a contract, in the directory it was
+// extracted or compiled in
+func (a *staticAnalyzer) analyze(dir, contractName, sourceFile, flattened string) (*messages.StaticAnalysis, error) {
+	var output []byte
+	var err error
+	report := &messages.StaticAnalysis{}
+	if len(a.conf.Command) > 0 {
+		report.Analyzer = path.Base(a.conf.Command[0])
+		output, err = a.runCommand(dir, sourceFile)
+	} else {
+		report.Analyzer = a.conf.URL
+		output, err = a.callAnalyzer(contractName, sourceFile, flattened)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if report.Findings, err = parseStaticAnalysisOutput(output); err != nil {
+		return nil, err
+	}
+	report.AnalyzedISO8601 = time.Now().UTC().Format(time.RFC3339)
+	log.Infof("Static analysis of %s by %s reported %d findings", sourceFile, report.Analyzer, len(report.Findings))
+	return report, nil
+}
+
+func (a *staticAnalyzer) runCommand(dir, sourceFile string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(a.conf.TimeoutSec)*time.Second)
+	defer cancel()
+	args := make([]string, len(a.conf.Command)-1)
+	for i, arg := range a.conf.Command[1:] {
+		args[i] = strings.ReplaceAll(arg, staticAnalysisFileArg, sourceFile)
+	}
+	log.Infof("Analyzing: %s %s", a.conf.Command[0], strings.Join(args, " "))
+	cmd := exec.CommandContext(ctx, a.conf.Command[0], args...)
+	var stderr, stdout bytes.Buffer
+	cmd.Stderr = &stderr
+	cmd.Stdout = &stdout
+	cmd.Dir = dir
+	// Analyzers such as slither exit with an error when they report findings, so
+	// the output is used if there is any
+	if err := cmd.Run(); err != nil && !json.Valid(stdout.Bytes()) {
+		return nil, ethconnecterrors.Errorf(ethconnecterrors.RESTGatewayStaticAnalysisFailed, fmt.Sprintf("%s: %s", err, stderr.String()))
+	}
+	return stdout.Bytes(), nil
+}
+
+func (a *staticAnalyzer) callAnalyzer(contractName, sourceFile, flattened string) ([]byte, error) {
+	body, _ := json.Marshal(map[string]string{
+		"contractName": contractName,
+		"sourceFile":   sourceFile,
+		"source":       flattened,
+	})
+	req, err := http.NewRequest(http.MethodPost, a.conf.URL, bytes.NewReader(body))
+	if err != nil {
+		return nil, ethconnecterrors.Errorf(ethconnecterrors.RESTGatewayStaticAnalysisFailed, err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for name, value := range a.conf.Headers {
+		req.Header.Set(name, value)
+	}
+	res, err := a.client.Do(req)
+	if err != nil {
+		return nil, ethconnecterrors.Errorf(ethconnecterrors.RESTGatewayStaticAnalysisFailed, err)
+	}
+	defer res.Body.Close()
+	resBody, _ := ioutil.ReadAll(res.Body)
+	if res.StatusCode != 200 {
+		return nil, ethconnecterrors.Errorf(ethconnecterrors.RESTGatewayStaticAnalysisFailed, fmt.Sprintf("[%d] %s", res.StatusCode, resBody))
+	}
+	return resBody, nil
+}
+
+func parseStaticAnalysisOutput(output []byte) ([]*messages.StaticAnalysisFinding, error) {
+	var parsed staticAnalysisOutput
+	if err := json.Unmarshal(output, &parsed); err != nil {
+		return nil, ethconnecterrors.Errorf(ethconnecterrors.RESTGatewayStaticAnalysisFailed, err)
+	}
+	if parsed.Success != nil && !*parsed.Success {
+		return nil, ethconnecterrors.Errorf(ethconnecterrors.RESTGatewayStaticAnalysisFailed, parsed.Error)
+	}
+	findings := []*messages.StaticAnalysisFinding{}
+	for _, f := range parsed.Findings {
+		f.Severity = strings.ToLower(f.Severity)
+		findings = append(findings, f)
+	}
+	if parsed.Results != nil {
+		for _, d := range parsed.Results.Detectors {
+			findings = append(findings, &messages.StaticAnalysisFinding{
+				Check:       d.Check,
+				Severity:    strings.ToLower(d.Impact),
+				Confidence:  strings.ToLower(d.Confidence),
+				Description: strings.TrimSpace(d.Description),
+			})
+		}
+	}
+	return findings, nil
+}
+
+// check returns an error if the report has findings that block deployment
+func (a *staticAnalyzer) check(report *messages.StaticAnalysis) error {
+	if a.blockRank == 0 || report == nil {
+		return nil
+	}
+	var blocking []string
+	for _, f := range report.Findings {
+		if staticAnalysisSeverities[f.Severity] >= a.blockRank {
+			blocking = append(blocking, f.Check)
+		}
+	}
+	if len(blocking) > 0 {
+		return ethconnecterrors.Errorf(ethconnecterrors.RESTGatewayStaticAnalysisBlocked, len(blocking), strings.ToLower(a.conf.BlockSeverity), strings.Join(blocking, ", "))
+	}
+	return nil
+}
+
+// analyzeSource attaches the report of the static analyzer to the deploy message, if one is
+// configured. If the analyzer fails, the contract is only rejected if findings can block its
+// deployment, as otherwise nothing relies on the report
+func (g *smartContractGW) analyzeSource(msg *messages.DeployContract, dir, sourceFile, flattened string) error {
+	if g.analyzer == nil {
+		return nil
+	}
+	report, err := g.analyzer.analyze(dir, msg.ContractName, sourceFile, flattened)
+	if err != nil {
+		if g.analyzer.blockRank > 0 {
+			return err
+		}
+		log.Warnf("Storing %s without static analysis: %s", msg.ContractName, err)
+		return nil
+	}
+	msg.StaticAnalysis = report
+	return nil
+}
+
+// analyzeSolidity analyzes the Solidity of a deploy message, which is a single source file
+func (g *smartContractGW) analyzeSolidity(msg *messages.DeployContract) error {
+	if g.analyzer == nil {
+		return nil
+	}
+	dir := tempdir()
+	defer cleanup(dir)
+	if err := ioutil.WriteFile(path.Join(dir, staticAnalysisSourceFile), []byte(msg.Solidity), 0644); err != nil {
+		return ethconnecterrors.Errorf(ethconnecterrors.RESTGatewayStaticAnalysisFailed, err)
+	}
+	return g.analyzeSource(msg, dir, staticAnalysisSourceFile, msg.Solidity)
+}
+
+// checkStaticAnalysis returns an error if the static analysis of the contract has findings
+// that block its deployment
+func (g *smartContractGW) checkStaticAnalysis(msg *messages.DeployContract) error {
+	if g.analyzer == nil {
+		return nil
+	}
+	return g.analyzer.check(msg.StaticAnalysis)
+}
@@ -0,0 +1,218 @@
+// Copyright 2021 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package contracts
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/kaleido-io/ethconnect/internal/messages"
+	"github.com/stretchr/testify/assert"
+)
+
+const testSlitherOutput = `{
+  "success": true,
+  "error": null,
+  "results": {
+    "detectors": [
+      {
+        "check": "reentrancy-eth",
+        "impact": "High",
+        "confidence": "Medium",
+        "description": "Reentrancy in Bank.withdraw()\n"
+      },
+      {
+        "check": "solc-version",
+        "impact": "Informational",
+        "confidence": "High",
+        "description": "Pragma version allows old versions\n"
+      }
+    ]
+  }
+}`
+
+func TestNewStaticAnalyzer(t *testing.T) {
+	assert := assert.New(t)
+
+	a, err := newStaticAnalyzer(&StaticAnalysisConf{})
+	assert.NoError(err)
+	assert.Nil(a)
+
+	_, err = newStaticAnalyzer(&StaticAnalysisConf{Command: []string{"slither"}, BlockSeverity: "severe"})
+	assert.Regexp("Invalid static analysis blockSeverity 'severe'", err)
+
+	a, err = newStaticAnalyzer(&StaticAnalysisConf{URL: "http://localhost", BlockSeverity: "High"})
+	assert.NoError(err)
+	assert.Equal(defaultStaticAnalysisTimeoutSec, a.conf.TimeoutSec)
+	assert.Equal(4, a.blockRank)
+}
+
+func TestStaticAnalysisCommandSlitherOutput(t *testing.T) {
+	assert := assert.New(t)
+
+	dir := tempdir()
+	defer cleanup(dir)
+	ioutil.WriteFile(path.Join(dir, "Bank.sol"), []byte("pragma solidity >=0.5.0;"), 0644)
+
+	// Slither exits with an error when it reports findings
+	a, err := newStaticAnalyzer(&StaticAnalysisConf{
+		Command:       []string{"sh", "-c", "test -f {{file}} && printf '%s' '" + testSlitherOutput + "' && exit 255"},
+		BlockSeverity: "medium",
+	})
+	assert.NoError(err)
+	report, err := a.analyze(dir, "Bank", "Bank.sol", "")
+	assert.NoError(err)
+	assert.Equal("sh", report.Analyzer)
+	assert.NotEmpty(report.AnalyzedISO8601)
+	assert.Equal(2, len(report.Findings))
+	assert.Equal("reentrancy-eth", report.Findings[0].Check)
+	assert.Equal("high", report.Findings[0].Severity)
+	assert.Equal("medium", report.Findings[0].Confidence)
+	assert.Equal("Reentrancy in Bank.withdraw()", report.Findings[0].Description)
+	assert.Equal("informational", report.Findings[1].Severity)
+
+	err = a.check(report)
+	assert.EqualError(err, "Deployment blocked by 1 static analysis finding(s) of severity 'medium' or higher: reentrancy-eth")
+
+	a.blockRank = 0
+	assert.NoError(a.check(report))
+}
+
+func TestStaticAnalysisCommandFail(t *testing.T) {
+	assert := assert.New(t)
+
+	a, _ := newStaticAnalyzer(&StaticAnalysisConf{
+		Command: []string{"sh", "-c", "echo boom >&2; exit 1"},
+	})
+	_, err := a.analyze(".", "Bank", "Bank.sol", "")
+	assert.Regexp("Static analysis failed: exit status 1: boom", err)
+}
+
+func TestStaticAnalysisCommandReportsError(t *testing.T) {
+	assert := assert.New(t)
+
+	a, _ := newStaticAnalyzer(&StaticAnalysisConf{
+		Command: []string{"sh", "-c", `echo '{"success":false,"error":"Invalid compilation"}'; exit 1`},
+	})
+	_, err := a.analyze(".", "Bank", "Bank.sol", "")
+	assert.EqualError(err, "Static analysis failed: Invalid compilation")
+}
+
+func TestStaticAnalysisURL(t *testing.T) {
+	assert := assert.New(t)
+
+	var posted map[string]string
+	svr := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		assert.Equal("secret", req.Header.Get("x-api-key"))
+		json.NewDecoder(req.Body).Decode(&posted)
+		res.Write([]byte(`{"findings":[{"check":"tx-origin","severity":"Medium"}]}`))
+	}))
+	defer svr.Close()
+
+	a, _ := newStaticAnalyzer(&StaticAnalysisConf{
+		URL:           svr.URL,
+		Headers:       map[string]string{"x-api-key": "secret"},
+		BlockSeverity: "high",
+	})
+	report, err := a.analyze(".", "Bank", "Bank.sol", "contract Bank {}")
+	assert.NoError(err)
+	assert.Equal(map[string]string{
+		"contractName": "Bank",
+		"sourceFile":   "Bank.sol",
+		"source":       "contract Bank {}",
+	}, posted)
+	assert.Equal(svr.URL, report.Analyzer)
+	assert.Equal([]*messages.StaticAnalysisFinding{{Check: "tx-origin", Severity: "medium"}}, report.Findings)
+	assert.NoError(a.check(report))
+}
+
+func TestStaticAnalysisURLFail(t *testing.T) {
+	assert := assert.New(t)
+
+	status := 500
+	svr := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		res.WriteHeader(status)
+		res.Write([]byte(`!json`))
+	}))
+	defer svr.Close()
+
+	a, _ := newStaticAnalyzer(&StaticAnalysisConf{URL: svr.URL})
+	_, err := a.analyze(".", "Bank", "Bank.sol", "")
+	assert.Regexp(`Static analysis failed: \[500\] !json`, err)
+
+	status = 200
+	_, err = a.analyze(".", "Bank", "Bank.sol", "")
+	assert.Regexp("Static analysis failed: invalid character", err)
+
+	a.conf.URL = ":badurl"
+	_, err = a.analyze(".", "Bank", "Bank.sol", "")
+	assert.Regexp("Static analysis failed", err)
+
+	svr.Close()
+	a.conf.URL = svr.URL
+	_, err = a.analyze(".", "Bank", "Bank.sol", "")
+	assert.Regexp("Static analysis failed", err)
+}
+
+func TestAnalyzeSourceFailure(t *testing.T) {
+	assert := assert.New(t)
+
+	g := &smartContractGW{}
+	msg := &messages.DeployContract{ContractName: "Bank"}
+	assert.NoError(g.analyzeSource(msg, ".", "Bank.sol", ""))
+	assert.NoError(g.analyzeSolidity(msg))
+	assert.NoError(g.checkStaticAnalysis(msg))
+
+	// The contract is stored without a report, unless findings can block deployment
+	g.analyzer, _ = newStaticAnalyzer(&StaticAnalysisConf{
+		Command: []string{"sh", "-c", "exit 1"},
+	})
+	assert.NoError(g.analyzeSource(msg, ".", "Bank.sol", ""))
+	assert.Nil(msg.StaticAnalysis)
+
+	g.analyzer.blockRank = 4
+	err := g.analyzeSource(msg, ".", "Bank.sol", "")
+	assert.Regexp("Static analysis failed", err)
+}
+
+func TestAnalyzeSolidity(t *testing.T) {
+	assert := assert.New(t)
+
+	g := &smartContractGW{}
+	g.analyzer, _ = newStaticAnalyzer(&StaticAnalysisConf{
+		Command:       []string{"sh", "-c", `grep -q 'contract Bank' {{file}} && echo '{"findings":[{"check":"tx-origin","severity":"high"}]}'`},
+		BlockSeverity: "high",
+	})
+	msg := &messages.DeployContract{
+		ContractName: "Bank",
+		Solidity:     "pragma solidity >=0.5.0; contract Bank {}",
+	}
+	err := g.analyzeSolidity(msg)
+	assert.NoError(err)
+	assert.Equal(1, len(msg.StaticAnalysis.Findings))
+	assert.Regexp("Deployment blocked by 1 static analysis finding", g.checkStaticAnalysis(msg))
+
+	// The report is listed with the ABI
+	info := (&smartContractGW{
+		conf:     &SmartContractGatewayConf{},
+		abiIndex: make(map[string]messages.TimeSortable),
+	}).addToABIIndex("abi1", msg, time.Now())
+	assert.Equal(msg.StaticAnalysis, info.StaticAnalysis)
+}
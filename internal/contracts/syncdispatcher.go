@@ -58,6 +58,10 @@ func (t *syncTxInflight) Headers() *messages.CommonHeaders {
 	return &t.sendMsg.Headers.CommonHeaders
 }
 
+func (t *syncTxInflight) TimeReceived() time.Time {
+	return t.timeReceived
+}
+
 func (t *syncTxInflight) Unmarshal(msg interface{}) error {
 	var retMsg interface{}
 	if t.deployMsg != nil {
@@ -82,7 +86,12 @@ func (t *syncTxInflight) SendErrorReplyWithGapFill(status int, err error, gapFil
 }
 
 func (t *syncTxInflight) SendErrorReplyWithTX(status int, err error, txHash string) {
-	t.SendErrorReply(status, errors.Errorf(errors.RESTGatewaySyncWrapErrorWithTXDetail, txHash, err))
+	err = errors.Errorf(errors.RESTGatewaySyncWrapErrorWithTXDetail, txHash, err)
+	if rp, ok := t.replyProcessor.(rest2EthSubmittedReplyProcessor); ok && txHash != "" {
+		rp.ReplyWithSubmittedError(err, txHash)
+		return
+	}
+	t.SendErrorReply(status, err)
 }
 
 func (t *syncTxInflight) Reply(replyMessage messages.ReplyWithHeaders) {
@@ -19,6 +19,7 @@ import (
 	"fmt"
 	"testing"
 
+	"github.com/julienschmidt/httprouter"
 	"github.com/kaleido-io/ethconnect/internal/eth"
 	"github.com/kaleido-io/ethconnect/internal/messages"
 	"github.com/kaleido-io/ethconnect/internal/tx"
@@ -26,16 +27,28 @@ import (
 )
 
 type mockProcessor struct {
-	t            *testing.T
-	headers      *messages.CommonHeaders
-	err          error
-	reply        messages.ReplyWithHeaders
-	unmarshalErr error
-	badUnmarshal bool
-	resolvedFrom string
+	t                *testing.T
+	headers          *messages.CommonHeaders
+	err              error
+	reply            messages.ReplyWithHeaders
+	unmarshalErr     error
+	badUnmarshal     bool
+	resolvedFrom     string
+	eventABIResolver eth.EventABIResolver
+	contractStats    *tx.ContractStats
 }
 
-func (p *mockProcessor) ResolveAddress(from string) (resolvedFrom string, err error) {
+func (p *mockProcessor) SetEventABIResolver(resolver eth.EventABIResolver) {
+	p.eventABIResolver = resolver
+}
+
+func (p *mockProcessor) ContractStats(address string) *tx.ContractStats {
+	return p.contractStats
+}
+
+func (p *mockProcessor) AddRoutes(router *httprouter.Router) {}
+
+func (p *mockProcessor) ResolveAddress(ctx context.Context, from string) (resolvedFrom string, err error) {
 	return p.resolvedFrom, p.err
 }
 
@@ -76,6 +89,16 @@ func (p *mockReplyProcessor) ReplyWithReceiptAndError(receipt messages.ReplyWith
 	p.receipt = receipt
 }
 
+type mockSubmittedReplyProcessor struct {
+	mockReplyProcessor
+	txHash string
+}
+
+func (p *mockSubmittedReplyProcessor) ReplyWithSubmittedError(err error, txHash string) {
+	p.err = err
+	p.txHash = txHash
+}
+
 func TestDispatchSendTransactionSync(t *testing.T) {
 	assert := assert.New(t)
 
@@ -143,3 +166,21 @@ func TestDispatchSendTransactionError(t *testing.T) {
 
 	assert.EqualError(r.err, "TX hash1: pop")
 }
+
+func TestDispatchDeployContractSubmittedError(t *testing.T) {
+	assert := assert.New(t)
+
+	processor := &mockProcessor{
+		t:     t,
+		reply: &messages.TransactionReceipt{},
+		err:   fmt.Errorf("pop"),
+	}
+	d := newSyncDispatcher(processor)
+	deployTx := &messages.DeployContract{}
+	deployTx.Headers.ID = "request1"
+	r := &mockSubmittedReplyProcessor{}
+	d.DispatchDeployContractSync(context.Background(), deployTx, r)
+
+	assert.EqualError(r.err, "TX hash1: pop")
+	assert.Equal("hash1", r.txHash)
+}
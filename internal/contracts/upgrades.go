@@ -0,0 +1,517 @@
+// Copyright 2021 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package contracts
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	log "github.com/sirupsen/logrus"
+
+	ethbinding "github.com/kaleido-io/ethbinding/pkg"
+	"github.com/kaleido-io/ethconnect/internal/auth"
+	ethconnecterrors "github.com/kaleido-io/ethconnect/internal/errors"
+	"github.com/kaleido-io/ethconnect/internal/eth"
+	"github.com/kaleido-io/ethconnect/internal/ethbind"
+	"github.com/kaleido-io/ethconnect/internal/messages"
+	"github.com/kaleido-io/ethconnect/internal/utils"
+)
+
+const (
+	// UpgradePathPrefix is the path prefix for proxy contract upgrades
+	UpgradePathPrefix = "/upgrades"
+
+	upgradeStatusRolledBack = "rolledBack"
+
+	upgradeStageDeploy   = "deploy"
+	upgradeStageUpgrade  = "upgrade"
+	upgradeStageVerify   = "verify"
+	upgradeStageRegister = "register"
+	upgradeStageRollback = "rollback"
+
+	// eip1967ImplementationSlot is the storage slot of the implementation address in an
+	// EIP-1967 proxy: bytes32(uint256(keccak256("eip1967.proxy.implementation")) - 1)
+	eip1967ImplementationSlot = "0x360894a13ba1a3210667c828492db98dca3e2076cc3735a920a3ca505d382bbc"
+)
+
+var (
+	// The upgrade functions of UUPS proxies, and of transparent proxies called by their admin
+	upgradeToMethod        = upgradeMethod("upgradeTo", "newImplementation")
+	upgradeToAndCallMethod = upgradeMethod("upgradeToAndCall", "newImplementation", "data")
+	// The upgrade functions of a ProxyAdmin contract, which owns transparent proxies
+	adminUpgradeMethod        = upgradeMethod("upgrade", "proxy", "implementation")
+	adminUpgradeAndCallMethod = upgradeMethod("upgradeAndCall", "proxy", "implementation", "data")
+)
+
+// contractUpgrade deploys a new implementation for a proxy contract in the local registry,
+// upgrades the proxy to it, verifies the proxy uses it, and then switches the ABI registered
+// for the proxy. If the proxy has been upgraded when a later stage fails, it is upgraded
+// back to the previous implementation
+type contractUpgrade struct {
+	messages.TimeSorted
+	ID                      string               `json:"id"`
+	Contract                string               `json:"contract"`
+	Environment             string               `json:"environment,omitempty"`
+	ABI                     string               `json:"abi"`
+	Params                  []interface{}        `json:"params,omitempty"`
+	Call                    *contractUpgradeCall `json:"call,omitempty"`
+	Admin                   string               `json:"admin,omitempty"`
+	ExpectedCodeHash        string               `json:"expectedCodeHash,omitempty"`
+	From                    string               `json:"from"`
+	Gas                     json.Number          `json:"gas,omitempty"`
+	Tenant                  string               `json:"tenant,omitempty"`
+	Status                  string               `json:"status"`
+	Stage                   string               `json:"stage,omitempty"`
+	Error                   string               `json:"error,omitempty"`
+	Updated                 string               `json:"updated,omitempty"`
+	Proxy                   string               `json:"proxy,omitempty"`
+	PreviousABI             string               `json:"previousABI,omitempty"`
+	PreviousImplementation  string               `json:"previousImplementation,omitempty"`
+	Implementation          string               `json:"implementation,omitempty"`
+	CodeHash                string               `json:"codeHash,omitempty"`
+	DeployTransactionHash   string               `json:"deployTransactionHash,omitempty"`
+	UpgradeTransactionHash  string               `json:"upgradeTransactionHash,omitempty"`
+	RollbackTransactionHash string               `json:"rollbackTransactionHash,omitempty"`
+}
+
+// contractUpgradeCall is a method of the new implementation called by the proxy as part of
+// the upgrade, such as to initialize the state it adds
+type contractUpgradeCall struct {
+	Method string        `json:"method"`
+	Params []interface{} `json:"params,omitempty"`
+}
+
+func (u *contractUpgrade) GetID() string {
+	return u.ID
+}
+
+func upgradeMethod(name string, inputs ...string) *ethbinding.ABIElementMarshaling {
+	method := &ethbinding.ABIElementMarshaling{
+		Type:            "function",
+		Name:            name,
+		StateMutability: "nonpayable",
+	}
+	for _, input := range inputs {
+		inputType := "address"
+		if input == "data" {
+			inputType = "bytes"
+			method.StateMutability = "payable"
+		}
+		method.Inputs = append(method.Inputs, ethbinding.ABIArgumentMarshaling{Name: input, Type: inputType})
+	}
+	return method
+}
+
+// validateContractUpgrade checks the proxy is in the local registry, and the new implementation
+// can be deployed and initialized, before anything is sent to the chain
+func (g *smartContractGW) validateContractUpgrade(upgrade *contractUpgrade) error {
+	if upgrade.Contract == "" || upgrade.ABI == "" {
+		return ethconnecterrors.Errorf(ethconnecterrors.ContractUpgradeNoContract)
+	}
+	if upgrade.From == "" {
+		return ethconnecterrors.Errorf(ethconnecterrors.ContractUpgradeNoFrom)
+	}
+	if upgrade.Admin != "" && !addrCheck.MatchString(strings.ToLower(upgrade.Admin)) {
+		return ethconnecterrors.Errorf(ethconnecterrors.RESTGatewayRegistrationSuppliedInvalidAddress)
+	}
+	addr := strings.TrimPrefix(strings.ToLower(upgrade.Contract), "0x")
+	if !addrCheck.MatchString(addr) {
+		resolved, err := g.resolveContractAddr(upgrade.Contract, upgrade.Environment)
+		if err != nil {
+			return err
+		}
+		addr = resolved
+	}
+	g.idxLock.Lock()
+	defer g.idxLock.Unlock()
+	_, info, err := g.loadDeployMsgForInstance(addr)
+	if info == nil {
+		return err
+	}
+	upgrade.Proxy = info.Address
+	upgrade.PreviousABI = info.ABI
+	if isWellKnownABI(upgrade.ABI) {
+		return ethconnecterrors.Errorf(ethconnecterrors.RESTGatewayWellKnownABINotDeployable, upgrade.ABI)
+	}
+	deployMsg, _, err := g.loadDeployMsgByID(upgrade.ABI)
+	if err != nil {
+		return err
+	}
+	if err = g.checkStaticAnalysis(deployMsg); err != nil {
+		return err
+	}
+	if upgrade.Call != nil && findDeployPlanMethod(deployMsg.ABI, upgrade.Call.Method, len(upgrade.Call.Params)) == nil {
+		return ethconnecterrors.Errorf(ethconnecterrors.ContractUpgradeMethodNotFound, upgrade.Call.Method, upgrade.ABI)
+	}
+	return nil
+}
+
+// saveContractUpgrade stores the definition and progress of an upgrade
+func (g *smartContractGW) saveContractUpgrade(upgrade *contractUpgrade) error {
+	upgrade.Updated = time.Now().UTC().Format(time.RFC3339Nano)
+	upgradeBytes, _ := json.MarshalIndent(upgrade, "", "  ")
+	if err := g.store.put(registryKindUpgrade, upgrade.ID, upgradeBytes); err != nil {
+		return ethconnecterrors.Errorf(ethconnecterrors.ContractUpgradeSave, upgrade.ID, err)
+	}
+	return nil
+}
+
+func (g *smartContractGW) loadContractUpgrade(id string) (*contractUpgrade, error) {
+	upgradeBytes, err := g.store.get(registryKindUpgrade, id)
+	if err != nil {
+		return nil, ethconnecterrors.Errorf(ethconnecterrors.ContractUpgradeNotFound, id)
+	}
+	var upgrade contractUpgrade
+	if err = json.Unmarshal(upgradeBytes, &upgrade); err != nil {
+		return nil, err
+	}
+	return &upgrade, nil
+}
+
+// startContractUpgrade marks the proxy as being upgraded by this gateway, returning false
+// if it already is
+func (g *smartContractGW) startContractUpgrade(upgrade *contractUpgrade) (bool, error) {
+	g.plansLock.Lock()
+	defer g.plansLock.Unlock()
+	if g.runningUpgrades[upgrade.Proxy] {
+		return false, nil
+	}
+	upgrade.Status = deployPlanStatusRunning
+	if err := g.saveContractUpgrade(upgrade); err != nil {
+		return false, err
+	}
+	g.runningUpgrades[upgrade.Proxy] = true
+	return true, nil
+}
+
+// runContractUpgrade executes the stages of an upgrade in order, stopping at the first failure
+func (g *smartContractGW) runContractUpgrade(ctx context.Context, upgrade *contractUpgrade) {
+	defer func() {
+		g.plansLock.Lock()
+		delete(g.runningUpgrades, upgrade.Proxy)
+		g.plansLock.Unlock()
+	}()
+	stages := []struct {
+		name string
+		run  func(context.Context, *contractUpgrade) error
+	}{
+		{upgradeStageDeploy, g.deployUpgradeImplementation},
+		{upgradeStageUpgrade, g.upgradeProxy},
+		{upgradeStageVerify, g.verifyUpgrade},
+		{upgradeStageRegister, g.registerUpgrade},
+	}
+	upgrade.Status = deployPlanStatusCompleted
+	for _, stage := range stages {
+		log.Infof("Contract upgrade %s: %s", upgrade.ID, stage.name)
+		upgrade.Stage = stage.name
+		if err := stage.run(ctx, upgrade); err != nil {
+			log.Errorf("Contract upgrade %s: %s failed: %s", upgrade.ID, stage.name, err)
+			upgrade.Status = deployPlanStatusFailed
+			upgrade.Error = ethconnecterrors.Errorf(ethconnecterrors.ContractUpgradeStageFailed, stage.name, err).Error()
+			if upgrade.UpgradeTransactionHash != "" {
+				g.rollbackUpgrade(ctx, upgrade)
+			}
+			break
+		}
+		if err := g.saveContractUpgrade(upgrade); err != nil {
+			log.Errorf("Contract upgrade %s: %s", upgrade.ID, err)
+		}
+	}
+	if err := g.saveContractUpgrade(upgrade); err != nil {
+		log.Errorf("Contract upgrade %s: %s", upgrade.ID, err)
+	}
+	log.Infof("Contract upgrade %s: %s", upgrade.ID, upgrade.Status)
+}
+
+// readImplementation returns the address in the EIP-1967 implementation slot of the proxy,
+// or an empty string if it is not set
+func (g *smartContractGW) readImplementation(ctx context.Context, proxy string) (string, error) {
+	var slot string
+	if err := g.rpcCall(ctx, &slot, "eth_getStorageAt", "0x"+proxy, eip1967ImplementationSlot, "latest"); err != nil {
+		return "", err
+	}
+	value := ethbind.API.FromHex(slot)
+	if len(value) < 20 {
+		return "", nil
+	}
+	implementation := ethbind.API.BytesToAddress(value[len(value)-20:])
+	if implementation == (ethbinding.Address{}) {
+		return "", nil
+	}
+	return strings.ToLower(implementation.Hex()), nil
+}
+
+func (g *smartContractGW) deployUpgradeImplementation(ctx context.Context, upgrade *contractUpgrade) error {
+	previous, err := g.readImplementation(ctx, upgrade.Proxy)
+	if err != nil {
+		return err
+	}
+	upgrade.PreviousImplementation = previous
+
+	g.idxLock.Lock()
+	deployMsg, _, err := g.loadDeployMsgByID(upgrade.ABI)
+	g.idxLock.Unlock()
+	if err != nil {
+		return err
+	}
+	deployMsg.Headers.MsgType = messages.MsgTypeDeployContract
+	deployMsg.From = upgrade.From
+	deployMsg.Gas = upgrade.Gas
+	deployMsg.Parameters = upgrade.Params
+	if upgrade.Tenant != "" {
+		if deployMsg.Headers.Context == nil {
+			deployMsg.Headers.Context = make(map[string]interface{})
+		}
+		deployMsg.Headers.Context[tenantContextKey] = upgrade.Tenant
+	}
+	responder := &deployPlanResponder{done: make(chan struct{})}
+	g.r2e.syncDispatcher.DispatchDeployContractSync(ctx, deployMsg, responder)
+	<-responder.done
+	if receipt := responder.receipt; receipt != nil && receipt.TransactionHash != nil {
+		upgrade.DeployTransactionHash = receipt.TransactionHash.Hex()
+	}
+	if responder.err != nil {
+		return responder.err
+	}
+	if responder.receipt.ContractAddress == nil {
+		return ethconnecterrors.Errorf(ethconnecterrors.RESTGatewayPostDeployMissingAddress, upgrade.DeployTransactionHash)
+	}
+	upgrade.Implementation = strings.ToLower(responder.receipt.ContractAddress.Hex())
+	return g.PostDeploy(responder.receipt)
+}
+
+// sendUpgrade points the proxy at an implementation, calling the proxy itself, or its admin
+func (g *smartContractGW) sendUpgrade(ctx context.Context, upgrade *contractUpgrade, implementation string, data []byte) (string, error) {
+	msg := &messages.SendTransaction{}
+	msg.Headers.MsgType = messages.MsgTypeSendTransaction
+	msg.From = upgrade.From
+	msg.Gas = upgrade.Gas
+	params := []interface{}{implementation}
+	if upgrade.Admin != "" {
+		msg.To = upgrade.Admin
+		params = append([]interface{}{"0x" + upgrade.Proxy}, params...)
+	} else {
+		msg.To = "0x" + upgrade.Proxy
+	}
+	switch {
+	case upgrade.Admin != "" && data != nil:
+		msg.Method = adminUpgradeAndCallMethod
+	case upgrade.Admin != "":
+		msg.Method = adminUpgradeMethod
+	case data != nil:
+		msg.Method = upgradeToAndCallMethod
+	default:
+		msg.Method = upgradeToMethod
+	}
+	if data != nil {
+		params = append(params, ethbind.API.HexEncode(data))
+	}
+	msg.Parameters = params
+	responder := &deployPlanResponder{done: make(chan struct{})}
+	g.r2e.syncDispatcher.DispatchSendTransactionSync(ctx, msg, responder)
+	<-responder.done
+	txHash := ""
+	if receipt := responder.receipt; receipt != nil && receipt.TransactionHash != nil {
+		txHash = receipt.TransactionHash.Hex()
+	}
+	return txHash, responder.err
+}
+
+func (g *smartContractGW) upgradeProxy(ctx context.Context, upgrade *contractUpgrade) error {
+	var data []byte
+	if upgrade.Call != nil {
+		g.idxLock.Lock()
+		deployMsg, _, err := g.loadDeployMsgByID(upgrade.ABI)
+		g.idxLock.Unlock()
+		if err != nil {
+			return err
+		}
+		method := findDeployPlanMethod(deployMsg.ABI, upgrade.Call.Method, len(upgrade.Call.Params))
+		if method == nil {
+			return ethconnecterrors.Errorf(ethconnecterrors.ContractUpgradeMethodNotFound, upgrade.Call.Method, upgrade.ABI)
+		}
+		if data, err = eth.EncodeMethodCall(method, upgrade.Call.Params); err != nil {
+			return err
+		}
+	}
+	txHash, err := g.sendUpgrade(ctx, upgrade, upgrade.Implementation, data)
+	if txHash != "" && err == nil {
+		upgrade.UpgradeTransactionHash = txHash
+	}
+	return err
+}
+
+// verifyUpgrade checks the proxy now uses the new implementation, and the code deployed
+// for it is the code expected
+func (g *smartContractGW) verifyUpgrade(ctx context.Context, upgrade *contractUpgrade) error {
+	implementation, err := g.readImplementation(ctx, upgrade.Proxy)
+	if err != nil {
+		return err
+	}
+	if implementation != upgrade.Implementation {
+		return ethconnecterrors.Errorf(ethconnecterrors.ContractUpgradeWrongImplementation, upgrade.Proxy, implementation, upgrade.Implementation)
+	}
+	var code string
+	if err := g.rpcCall(ctx, &code, "eth_getCode", upgrade.Implementation, "latest"); err != nil {
+		return err
+	}
+	codeBytes := ethbind.API.FromHex(code)
+	if len(codeBytes) == 0 {
+		return ethconnecterrors.Errorf(ethconnecterrors.ContractUpgradeNoCode, upgrade.Implementation)
+	}
+	upgrade.CodeHash = ethbind.API.HexEncode(ethbind.Keccak256(codeBytes))
+	if upgrade.ExpectedCodeHash != "" && !strings.EqualFold(upgrade.ExpectedCodeHash, upgrade.CodeHash) {
+		return ethconnecterrors.Errorf(ethconnecterrors.ContractUpgradeCodeHashMismatch, upgrade.Implementation, upgrade.CodeHash, upgrade.ExpectedCodeHash)
+	}
+	return nil
+}
+
+// registerUpgrade switches the ABI of the proxy in the registry to the new implementation,
+// recording the previous ABI in the version history of the proxy
+func (g *smartContractGW) registerUpgrade(ctx context.Context, upgrade *contractUpgrade) error {
+	g.idxLock.Lock()
+	defer g.idxLock.Unlock()
+	_, info, err := g.loadDeployMsgForInstance(upgrade.Proxy)
+	if info == nil {
+		return err
+	}
+	if info.Implementation != "" {
+		return g.bindImplementation(info, upgrade.Implementation, upgrade.ABI)
+	}
+	return g.rebindABI(info, upgrade.ABI)
+}
+
+// rollbackUpgrade points the proxy back at the implementation it had before the upgrade,
+// after a failure in a later stage. The registry still has the previous ABI
+func (g *smartContractGW) rollbackUpgrade(ctx context.Context, upgrade *contractUpgrade) {
+	if upgrade.PreviousImplementation == "" {
+		upgrade.Error = ethconnecterrors.Errorf(ethconnecterrors.ContractUpgradeNoRollback, upgrade.Error).Error()
+		return
+	}
+	log.Infof("Contract upgrade %s: rolling back to implementation %s", upgrade.ID, upgrade.PreviousImplementation)
+	txHash, err := g.sendUpgrade(ctx, upgrade, upgrade.PreviousImplementation, nil)
+	upgrade.RollbackTransactionHash = txHash
+	if err == nil {
+		var implementation string
+		if implementation, err = g.readImplementation(ctx, upgrade.Proxy); err == nil && implementation != upgrade.PreviousImplementation {
+			err = fmt.Errorf("implementation is %s", implementation)
+		}
+	}
+	if err != nil {
+		log.Errorf("Contract upgrade %s: rollback failed: %s", upgrade.ID, err)
+		upgrade.Error = ethconnecterrors.Errorf(ethconnecterrors.ContractUpgradeRollbackFailed, upgrade.Error, upgrade.PreviousImplementation, err).Error()
+		return
+	}
+	upgrade.Status = upgradeStatusRolledBack
+}
+
+// createContractUpgrade validates and stores an upgrade, then runs it. As with deploy plans, it runs
+// in the background unless fly-sync is set
+func (g *smartContractGW) createContractUpgrade(res http.ResponseWriter, req *http.Request, params httprouter.Params) {
+	log.Infof("--> %s %s", req.Method, req.URL)
+
+	var upgrade contractUpgrade
+	if err := json.NewDecoder(req.Body).Decode(&upgrade); err != nil {
+		g.gatewayErrReply(res, req, ethconnecterrors.Errorf(ethconnecterrors.ContractUpgradeInvalid, err), 400)
+		return
+	}
+	upgrade.ID = utils.UUIDv4()
+	upgrade.CreatedISO8601 = time.Now().UTC().Format(time.RFC3339)
+	upgrade.Tenant = auth.GetTenant(req.Context())
+	upgrade.Status = deployPlanStatusPending
+	upgrade.Stage = ""
+	upgrade.Error = ""
+	if err := g.validateContractUpgrade(&upgrade); err != nil {
+		g.gatewayErrReply(res, req, err, 400)
+		return
+	}
+
+	isSync := strings.ToLower(getFlyParam("sync", req, true)) == "true"
+	ctx := req.Context()
+	if !isSync {
+		var err error
+		ctx = context.Background()
+		if auth.IsSecurityModuleEnabled() {
+			if ctx, err = auth.WithAuthContext(ctx, auth.GetAccessToken(req.Context())); err != nil {
+				g.gatewayErrReply(res, req, err, 401)
+				return
+			}
+		}
+	}
+	started, err := g.startContractUpgrade(&upgrade)
+	if err != nil {
+		g.gatewayErrReply(res, req, err, 500)
+		return
+	} else if !started {
+		g.gatewayErrReply(res, req, ethconnecterrors.Errorf(ethconnecterrors.ContractUpgradeRunning, upgrade.Contract), 409)
+		return
+	}
+	status := 202
+	reply := &upgrade
+	if isSync {
+		g.runContractUpgrade(ctx, &upgrade)
+		status = 200
+		if upgrade.Status != deployPlanStatusCompleted {
+			status = 500
+		}
+	} else {
+		// The upgrade is copied for the response, as it is updated by the goroutine
+		upgradeBytes, _ := json.Marshal(&upgrade)
+		reply = &contractUpgrade{}
+		json.Unmarshal(upgradeBytes, reply)
+		go g.runContractUpgrade(ctx, &upgrade)
+	}
+	g.deployPlanReply(res, req, reply, status)
+}
+
+func (g *smartContractGW) listContractUpgrades(res http.ResponseWriter, req *http.Request, params httprouter.Params) {
+	log.Infof("--> %s %s", req.Method, req.URL)
+
+	entries, err := g.store.list(registryKindUpgrade)
+	if err != nil {
+		g.gatewayErrReply(res, req, err, 500)
+		return
+	}
+	upgrades := make([]*contractUpgrade, 0, len(entries))
+	for _, entry := range entries {
+		upgrade, err := g.loadContractUpgrade(entry.ID)
+		if err != nil {
+			log.Warnf("Failed to load contract upgrade %s: %s", entry.ID, err)
+			continue
+		}
+		upgrades = append(upgrades, upgrade)
+	}
+	sort.Slice(upgrades, func(i, j int) bool {
+		return upgrades[i].IsLessThan(upgrades[i], upgrades[j])
+	})
+	g.deployPlanReply(res, req, upgrades, 200)
+}
+
+func (g *smartContractGW) getContractUpgrade(res http.ResponseWriter, req *http.Request, params httprouter.Params) {
+	log.Infof("--> %s %s", req.Method, req.URL)
+
+	upgrade, err := g.loadContractUpgrade(params.ByName("id"))
+	if err != nil {
+		g.gatewayErrReply(res, req, err, 404)
+		return
+	}
+	g.deployPlanReply(res, req, upgrade, 200)
+}
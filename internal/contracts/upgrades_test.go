@@ -0,0 +1,343 @@
+// Copyright 2021 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package contracts
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http/httptest"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/kaleido-io/ethconnect/internal/eth"
+	"github.com/kaleido-io/ethconnect/internal/ethbind"
+	"github.com/kaleido-io/ethconnect/internal/messages"
+	"github.com/stretchr/testify/assert"
+)
+
+const testUpgradeProxy = "0123456789abcdef0123456789abcdef01234567"
+const testUpgradePrevious = "0x00000000000000000000000000000000000000aa"
+const testUpgradeCode = "0x6080604052"
+
+// upgradeChain is a planDispatcher that points the proxy at the implementation in each
+// upgrade transaction it mines, unless ignoreUpgrades is set
+type upgradeChain struct {
+	*planDispatcher
+	implementation string
+	code           string
+	ignoreUpgrades bool
+}
+
+func (c *upgradeChain) DispatchSendTransactionSync(ctx context.Context, msg *messages.SendTransaction, replyProcessor rest2EthReplyProcessor) {
+	c.planDispatcher.DispatchSendTransactionSync(ctx, msg, replyProcessor)
+	if !c.failAt[c.count] && !c.ignoreUpgrades {
+		implementation := msg.Parameters[0]
+		if len(msg.Method.Inputs) > 1 && msg.Method.Inputs[1].Name == "implementation" {
+			implementation = msg.Parameters[1]
+		}
+		c.implementation = implementation.(string)
+	}
+}
+
+func (c *upgradeChain) rpc() eth.RPCClient {
+	return eth.NewMockRPCClientForSync(nil, func(method string, res interface{}, args ...interface{}) {
+		switch method {
+		case "eth_getStorageAt":
+			slot := "0x" + strings.Repeat("0", 64)
+			if c.implementation != "" {
+				slot = "0x" + strings.Repeat("0", 24) + strings.TrimPrefix(c.implementation, "0x")
+			}
+			*(res.(*string)) = slot
+		case "eth_getCode":
+			*(res.(*string)) = c.code
+		}
+	})
+}
+
+func newTestUpgradeGW(t *testing.T, dir string) (*smartContractGW, *upgradeChain, *httprouter.Router) {
+	deployMsg := newTestPrecompiledDeployMsg(t).DeployContract
+	deployMsg.Headers.ID = "abi2"
+	deployBytes, _ := json.Marshal(&deployMsg)
+	ioutil.WriteFile(path.Join(dir, "abi_abi2.deploy.json"), deployBytes, 0644)
+
+	scgw, dispatcher, router := newTestDeployPlanGW(t, dir)
+	_, err := scgw.storeNewContractInfo(testUpgradeProxy, "abi1", "proxy", "proxy", "", "")
+	assert.NoError(t, err)
+	chain := &upgradeChain{planDispatcher: dispatcher, implementation: testUpgradePrevious, code: testUpgradeCode}
+	scgw.r2e.syncDispatcher = chain
+	scgw.rpc = chain.rpc()
+	return scgw, chain, router
+}
+
+func testUpgradeRequest(router *httprouter.Router, method, path string, body interface{}) (int, *contractUpgrade, string) {
+	var reqBody []byte
+	if body != nil {
+		reqBody, _ = json.Marshal(body)
+	}
+	req := httptest.NewRequest(method, path, bytes.NewReader(reqBody))
+	res := httptest.NewRecorder()
+	router.ServeHTTP(res, req)
+	var upgrade contractUpgrade
+	json.Unmarshal(res.Body.Bytes(), &upgrade)
+	return res.Code, &upgrade, res.Body.String()
+}
+
+func testUpgrade() map[string]interface{} {
+	return map[string]interface{}{
+		"contract": "proxy",
+		"abi":      "abi2",
+		"params":   []interface{}{1, "v2"},
+		"from":     "0x66c5fe653e7a9ebb628a6d40f0452d1e358baee8",
+	}
+}
+
+func TestContractUpgradeSync(t *testing.T) {
+	assert := assert.New(t)
+	dir := tempdir()
+	defer cleanup(dir)
+	scgw, chain, router := newTestUpgradeGW(t, dir)
+
+	upgradeReq := testUpgrade()
+	upgradeReq["expectedCodeHash"] = ethbind.API.HexEncode(ethbind.Keccak256(ethbind.API.FromHex(testUpgradeCode)))
+	status, upgrade, body := testUpgradeRequest(router, "POST", "/upgrades?fly-sync", upgradeReq)
+	assert.Equal(200, status, body)
+	assert.Equal(deployPlanStatusCompleted, upgrade.Status)
+	assert.Equal(testUpgradeProxy, upgrade.Proxy)
+	assert.Equal("abi1", upgrade.PreviousABI)
+	assert.Equal(testUpgradePrevious, upgrade.PreviousImplementation)
+	assert.Equal("0x0000000000000000000000000000000000000001", upgrade.Implementation)
+	assert.Equal(fmt.Sprintf("0x%064x", 1), upgrade.DeployTransactionHash)
+	assert.Equal(fmt.Sprintf("0x%064x", 2), upgrade.UpgradeTransactionHash)
+	assert.Equal(upgradeReq["expectedCodeHash"], upgrade.CodeHash)
+	assert.Empty(upgrade.Error)
+
+	assert.Len(chain.deploy, 1)
+	assert.Equal([]interface{}{float64(1), "v2"}, chain.deploy[0].Parameters)
+	assert.Len(chain.send, 1)
+	assert.Equal("upgradeTo", chain.send[0].Method.Name)
+	assert.Equal("0x"+testUpgradeProxy, chain.send[0].To)
+
+	scgw.idxLock.Lock()
+	_, info, err := scgw.loadDeployMsgForInstance(testUpgradeProxy)
+	scgw.idxLock.Unlock()
+	assert.NoError(err)
+	assert.Equal("abi2", info.ABI)
+	assert.Len(info.PreviousABIs, 1)
+	assert.Equal("abi1", info.PreviousABIs[0].ABI)
+	stored, err := scgw.store.get(registryKindContract, testUpgradeProxy)
+	assert.NoError(err)
+	assert.Contains(string(stored), `"abi": "abi2"`)
+
+	status, loaded, _ := testUpgradeRequest(router, "GET", "/upgrades/"+upgrade.ID, nil)
+	assert.Equal(200, status)
+	assert.Equal(deployPlanStatusCompleted, loaded.Status)
+	assert.Equal(upgradeStageRegister, loaded.Stage)
+}
+
+func TestContractUpgradeAndCallViaAdmin(t *testing.T) {
+	assert := assert.New(t)
+	dir := tempdir()
+	defer cleanup(dir)
+	_, chain, router := newTestUpgradeGW(t, dir)
+
+	upgradeReq := testUpgrade()
+	upgradeReq["contract"] = "0x" + testUpgradeProxy
+	upgradeReq["admin"] = "0x00000000000000000000000000000000000000ad"
+	upgradeReq["call"] = map[string]interface{}{"method": "set", "params": []interface{}{42, "hello"}}
+	status, upgrade, body := testUpgradeRequest(router, "POST", "/upgrades?fly-sync", upgradeReq)
+	assert.Equal(200, status, body)
+	assert.Equal(deployPlanStatusCompleted, upgrade.Status)
+
+	assert.Len(chain.send, 1)
+	msg := chain.send[0]
+	assert.Equal("upgradeAndCall", msg.Method.Name)
+	assert.Equal("payable", msg.Method.StateMutability)
+	assert.Equal("0x00000000000000000000000000000000000000ad", msg.To)
+	assert.Equal("0x"+testUpgradeProxy, msg.Parameters[0])
+	assert.Equal("0x0000000000000000000000000000000000000001", msg.Parameters[1])
+	assert.Regexp("^0x", msg.Parameters[2])
+	assert.Greater(len(msg.Parameters[2].(string)), 10)
+}
+
+func TestContractUpgradeVerifyFailRollback(t *testing.T) {
+	assert := assert.New(t)
+	dir := tempdir()
+	defer cleanup(dir)
+	scgw, chain, router := newTestUpgradeGW(t, dir)
+
+	upgradeReq := testUpgrade()
+	upgradeReq["expectedCodeHash"] = "0x1234"
+	status, upgrade, body := testUpgradeRequest(router, "POST", "/upgrades?fly-sync", upgradeReq)
+	assert.Equal(500, status, body)
+	assert.Equal(upgradeStatusRolledBack, upgrade.Status)
+	assert.Equal(upgradeStageVerify, upgrade.Stage)
+	assert.Regexp("Contract upgrade failed in stage 'verify'.*rather than the expected 0x1234", upgrade.Error)
+	assert.Equal(fmt.Sprintf("0x%064x", 3), upgrade.RollbackTransactionHash)
+	assert.Equal(testUpgradePrevious, chain.implementation)
+	assert.Len(chain.send, 2)
+	assert.Equal([]interface{}{testUpgradePrevious}, chain.send[1].Parameters)
+
+	scgw.idxLock.Lock()
+	_, info, _ := scgw.loadDeployMsgForInstance(testUpgradeProxy)
+	scgw.idxLock.Unlock()
+	assert.Equal("abi1", info.ABI)
+}
+
+func TestContractUpgradeWrongImplementationNoRollback(t *testing.T) {
+	assert := assert.New(t)
+	dir := tempdir()
+	defer cleanup(dir)
+	_, chain, router := newTestUpgradeGW(t, dir)
+	chain.implementation = ""
+	chain.ignoreUpgrades = true
+
+	status, upgrade, _ := testUpgradeRequest(router, "POST", "/upgrades?fly-sync", testUpgrade())
+	assert.Equal(500, status)
+	assert.Equal(deployPlanStatusFailed, upgrade.Status)
+	assert.Regexp("The implementation of proxy 0x"+testUpgradeProxy+" is  after the upgrade.*The proxy could not be rolled back", upgrade.Error)
+	assert.Empty(upgrade.RollbackTransactionHash)
+}
+
+func TestContractUpgradeRollbackFailed(t *testing.T) {
+	assert := assert.New(t)
+	dir := tempdir()
+	defer cleanup(dir)
+	_, chain, router := newTestUpgradeGW(t, dir)
+	chain.code = "0x"
+	chain.failAt[3] = true
+
+	status, upgrade, _ := testUpgradeRequest(router, "POST", "/upgrades?fly-sync", testUpgrade())
+	assert.Equal(500, status)
+	assert.Equal(deployPlanStatusFailed, upgrade.Status)
+	assert.Regexp("There is no code at the new implementation.*Rolling back to implementation "+testUpgradePrevious+" also failed: pop", upgrade.Error)
+}
+
+func TestContractUpgradeTransactionFailed(t *testing.T) {
+	assert := assert.New(t)
+	dir := tempdir()
+	defer cleanup(dir)
+	scgw, chain, router := newTestUpgradeGW(t, dir)
+	chain.failAt[2] = true
+
+	status, upgrade, _ := testUpgradeRequest(router, "POST", "/upgrades?fly-sync", testUpgrade())
+	assert.Equal(500, status)
+	assert.Equal(deployPlanStatusFailed, upgrade.Status)
+	assert.Equal(upgradeStageUpgrade, upgrade.Stage)
+	assert.Equal("Contract upgrade failed in stage 'upgrade': pop", upgrade.Error)
+	assert.Empty(upgrade.UpgradeTransactionHash)
+	assert.Len(chain.send, 1)
+	assert.Equal(testUpgradePrevious, chain.implementation)
+
+	scgw.idxLock.Lock()
+	_, info, _ := scgw.loadDeployMsgForInstance(testUpgradeProxy)
+	scgw.idxLock.Unlock()
+	assert.Equal("abi1", info.ABI)
+}
+
+func TestContractUpgradeDeployFailed(t *testing.T) {
+	assert := assert.New(t)
+	dir := tempdir()
+	defer cleanup(dir)
+	scgw, chain, router := newTestUpgradeGW(t, dir)
+	chain.failAt[1] = true
+
+	status, upgrade, _ := testUpgradeRequest(router, "POST", "/upgrades?fly-sync", testUpgrade())
+	assert.Equal(500, status)
+	assert.Equal(upgradeStageDeploy, upgrade.Stage)
+	assert.Equal("Contract upgrade failed in stage 'deploy': pop", upgrade.Error)
+	assert.Empty(chain.send)
+
+	scgw.rpc = eth.NewMockRPCClientForSync(fmt.Errorf("pop"), nil)
+	status, upgrade, _ = testUpgradeRequest(router, "POST", "/upgrades?fly-sync", testUpgrade())
+	assert.Equal(500, status)
+	assert.Regexp("stage 'deploy': eth_getStorageAt returned: pop", upgrade.Error)
+}
+
+func TestContractUpgradeAsync(t *testing.T) {
+	assert := assert.New(t)
+	dir := tempdir()
+	defer cleanup(dir)
+	_, _, router := newTestUpgradeGW(t, dir)
+
+	status, upgrade, _ := testUpgradeRequest(router, "POST", "/upgrades", testUpgrade())
+	assert.Equal(202, status)
+	assert.Equal(deployPlanStatusRunning, upgrade.Status)
+
+	for i := 0; i < 100; i++ {
+		_, loaded, _ := testUpgradeRequest(router, "GET", "/upgrades/"+upgrade.ID, nil)
+		if loaded.Status == deployPlanStatusCompleted {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	req := httptest.NewRequest("GET", "/upgrades", nil)
+	res := httptest.NewRecorder()
+	router.ServeHTTP(res, req)
+	assert.Equal(200, res.Code)
+	var upgrades []*contractUpgrade
+	json.Unmarshal(res.Body.Bytes(), &upgrades)
+	assert.Len(upgrades, 1)
+	assert.Equal(deployPlanStatusCompleted, upgrades[0].Status)
+
+	status, _, body := testUpgradeRequest(router, "GET", "/upgrades/unknown", nil)
+	assert.Equal(404, status)
+	assert.Regexp("Contract upgrade 'unknown' not found", body)
+}
+
+func TestContractUpgradeRunning(t *testing.T) {
+	assert := assert.New(t)
+	dir := tempdir()
+	defer cleanup(dir)
+	scgw, _, router := newTestUpgradeGW(t, dir)
+	scgw.runningUpgrades[testUpgradeProxy] = true
+
+	status, _, body := testUpgradeRequest(router, "POST", "/upgrades?fly-sync", testUpgrade())
+	assert.Equal(409, status)
+	assert.Regexp("An upgrade of contract 'proxy' is already running", body)
+}
+
+func TestContractUpgradeValidation(t *testing.T) {
+	assert := assert.New(t)
+	dir := tempdir()
+	defer cleanup(dir)
+	_, chain, router := newTestUpgradeGW(t, dir)
+
+	from := "0xaa"
+	for _, test := range []struct {
+		upgrade interface{}
+		err     string
+	}{
+		{"not an upgrade", "Invalid contract upgrade"},
+		{map[string]interface{}{"abi": "abi2", "from": from}, "The 'contract' to upgrade and the 'abi' of the new implementation are required"},
+		{map[string]interface{}{"contract": "proxy", "abi": "abi2"}, "A 'from' address is required"},
+		{map[string]interface{}{"contract": "proxy", "abi": "abi2", "from": from, "admin": "bad"}, "Invalid address"},
+		{map[string]interface{}{"contract": "unknown", "abi": "abi2", "from": from}, "Failed to find installed contract address for 'unknown'"},
+		{map[string]interface{}{"contract": "0x0000000000000000000000000000000000000001", "abi": "abi2", "from": from}, "No contract instance registered with address"},
+		{map[string]interface{}{"contract": "proxy", "abi": "unknown", "from": from}, "No ABI found with ID unknown"},
+		{map[string]interface{}{"contract": "proxy", "abi": "wellknown-erc20", "from": from}, "has no bytecode"},
+		{map[string]interface{}{"contract": "proxy", "abi": "abi2", "from": from, "call": map[string]interface{}{"method": "unknown"}}, "Method 'unknown' is not declared in the ABI 'abi2'"},
+	} {
+		status, _, body := testUpgradeRequest(router, "POST", "/upgrades?fly-sync", test.upgrade)
+		assert.Equal(400, status)
+		assert.Regexp(test.err, body)
+	}
+	assert.Zero(chain.count)
+}
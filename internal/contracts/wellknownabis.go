@@ -0,0 +1,182 @@
+// Copyright 2021 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package contracts
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/julienschmidt/httprouter"
+	ethbinding "github.com/kaleido-io/ethbinding/pkg"
+	ethconnecterrors "github.com/kaleido-io/ethconnect/internal/errors"
+	"github.com/kaleido-io/ethconnect/internal/messages"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// wellKnownABIPath is the path segment under /abis that serves the built-in ABIs
+	wellKnownABIPath = "wellknown"
+	// wellKnownABIPrefix is the prefix of the ID of a built-in ABI, such as "wellknown-erc20"
+	wellKnownABIPrefix = "wellknown-"
+)
+
+type wellKnownABI struct {
+	name        string
+	description string
+	abi         string
+}
+
+// The built-in ABIs of the common token standards, including the optional metadata
+// extensions, so contracts can be registered without uploading Solidity or an ABI
+var wellKnownABIs = map[string]*wellKnownABI{
+	"erc20": {
+		name:        "ERC20",
+		description: "ERC-20 fungible token, with the optional name, symbol and decimals",
+		abi: `[
+			{"type":"function","name":"name","inputs":[],"outputs":[{"name":"","type":"string"}],"stateMutability":"view"},
+			{"type":"function","name":"symbol","inputs":[],"outputs":[{"name":"","type":"string"}],"stateMutability":"view"},
+			{"type":"function","name":"decimals","inputs":[],"outputs":[{"name":"","type":"uint8"}],"stateMutability":"view"},
+			{"type":"function","name":"totalSupply","inputs":[],"outputs":[{"name":"","type":"uint256"}],"stateMutability":"view"},
+			{"type":"function","name":"balanceOf","inputs":[{"name":"account","type":"address"}],"outputs":[{"name":"","type":"uint256"}],"stateMutability":"view"},
+			{"type":"function","name":"allowance","inputs":[{"name":"owner","type":"address"},{"name":"spender","type":"address"}],"outputs":[{"name":"","type":"uint256"}],"stateMutability":"view"},
+			{"type":"function","name":"transfer","inputs":[{"name":"to","type":"address"},{"name":"amount","type":"uint256"}],"outputs":[{"name":"","type":"bool"}],"stateMutability":"nonpayable"},
+			{"type":"function","name":"approve","inputs":[{"name":"spender","type":"address"},{"name":"amount","type":"uint256"}],"outputs":[{"name":"","type":"bool"}],"stateMutability":"nonpayable"},
+			{"type":"function","name":"transferFrom","inputs":[{"name":"from","type":"address"},{"name":"to","type":"address"},{"name":"amount","type":"uint256"}],"outputs":[{"name":"","type":"bool"}],"stateMutability":"nonpayable"},
+			{"type":"event","name":"Transfer","inputs":[{"name":"from","type":"address","indexed":true},{"name":"to","type":"address","indexed":true},{"name":"value","type":"uint256"}],"anonymous":false},
+			{"type":"event","name":"Approval","inputs":[{"name":"owner","type":"address","indexed":true},{"name":"spender","type":"address","indexed":true},{"name":"value","type":"uint256"}],"anonymous":false}
+		]`,
+	},
+	"erc721": {
+		name:        "ERC721",
+		description: "ERC-721 non-fungible token, with the optional name, symbol and tokenURI",
+		abi: `[
+			{"type":"function","name":"supportsInterface","inputs":[{"name":"interfaceId","type":"bytes4"}],"outputs":[{"name":"","type":"bool"}],"stateMutability":"view"},
+			{"type":"function","name":"name","inputs":[],"outputs":[{"name":"","type":"string"}],"stateMutability":"view"},
+			{"type":"function","name":"symbol","inputs":[],"outputs":[{"name":"","type":"string"}],"stateMutability":"view"},
+			{"type":"function","name":"tokenURI","inputs":[{"name":"tokenId","type":"uint256"}],"outputs":[{"name":"","type":"string"}],"stateMutability":"view"},
+			{"type":"function","name":"balanceOf","inputs":[{"name":"owner","type":"address"}],"outputs":[{"name":"","type":"uint256"}],"stateMutability":"view"},
+			{"type":"function","name":"ownerOf","inputs":[{"name":"tokenId","type":"uint256"}],"outputs":[{"name":"","type":"address"}],"stateMutability":"view"},
+			{"type":"function","name":"getApproved","inputs":[{"name":"tokenId","type":"uint256"}],"outputs":[{"name":"","type":"address"}],"stateMutability":"view"},
+			{"type":"function","name":"isApprovedForAll","inputs":[{"name":"owner","type":"address"},{"name":"operator","type":"address"}],"outputs":[{"name":"","type":"bool"}],"stateMutability":"view"},
+			{"type":"function","name":"approve","inputs":[{"name":"to","type":"address"},{"name":"tokenId","type":"uint256"}],"outputs":[],"stateMutability":"nonpayable"},
+			{"type":"function","name":"setApprovalForAll","inputs":[{"name":"operator","type":"address"},{"name":"approved","type":"bool"}],"outputs":[],"stateMutability":"nonpayable"},
+			{"type":"function","name":"transferFrom","inputs":[{"name":"from","type":"address"},{"name":"to","type":"address"},{"name":"tokenId","type":"uint256"}],"outputs":[],"stateMutability":"nonpayable"},
+			{"type":"function","name":"safeTransferFrom","inputs":[{"name":"from","type":"address"},{"name":"to","type":"address"},{"name":"tokenId","type":"uint256"}],"outputs":[],"stateMutability":"nonpayable"},
+			{"type":"function","name":"safeTransferFrom","inputs":[{"name":"from","type":"address"},{"name":"to","type":"address"},{"name":"tokenId","type":"uint256"},{"name":"data","type":"bytes"}],"outputs":[],"stateMutability":"nonpayable"},
+			{"type":"event","name":"Transfer","inputs":[{"name":"from","type":"address","indexed":true},{"name":"to","type":"address","indexed":true},{"name":"tokenId","type":"uint256","indexed":true}],"anonymous":false},
+			{"type":"event","name":"Approval","inputs":[{"name":"owner","type":"address","indexed":true},{"name":"approved","type":"address","indexed":true},{"name":"tokenId","type":"uint256","indexed":true}],"anonymous":false},
+			{"type":"event","name":"ApprovalForAll","inputs":[{"name":"owner","type":"address","indexed":true},{"name":"operator","type":"address","indexed":true},{"name":"approved","type":"bool"}],"anonymous":false}
+		]`,
+	},
+	"erc1155": {
+		name:        "ERC1155",
+		description: "ERC-1155 multi token, with the optional uri",
+		abi: `[
+			{"type":"function","name":"supportsInterface","inputs":[{"name":"interfaceId","type":"bytes4"}],"outputs":[{"name":"","type":"bool"}],"stateMutability":"view"},
+			{"type":"function","name":"uri","inputs":[{"name":"id","type":"uint256"}],"outputs":[{"name":"","type":"string"}],"stateMutability":"view"},
+			{"type":"function","name":"balanceOf","inputs":[{"name":"account","type":"address"},{"name":"id","type":"uint256"}],"outputs":[{"name":"","type":"uint256"}],"stateMutability":"view"},
+			{"type":"function","name":"balanceOfBatch","inputs":[{"name":"accounts","type":"address[]"},{"name":"ids","type":"uint256[]"}],"outputs":[{"name":"","type":"uint256[]"}],"stateMutability":"view"},
+			{"type":"function","name":"isApprovedForAll","inputs":[{"name":"account","type":"address"},{"name":"operator","type":"address"}],"outputs":[{"name":"","type":"bool"}],"stateMutability":"view"},
+			{"type":"function","name":"setApprovalForAll","inputs":[{"name":"operator","type":"address"},{"name":"approved","type":"bool"}],"outputs":[],"stateMutability":"nonpayable"},
+			{"type":"function","name":"safeTransferFrom","inputs":[{"name":"from","type":"address"},{"name":"to","type":"address"},{"name":"id","type":"uint256"},{"name":"amount","type":"uint256"},{"name":"data","type":"bytes"}],"outputs":[],"stateMutability":"nonpayable"},
+			{"type":"function","name":"safeBatchTransferFrom","inputs":[{"name":"from","type":"address"},{"name":"to","type":"address"},{"name":"ids","type":"uint256[]"},{"name":"amounts","type":"uint256[]"},{"name":"data","type":"bytes"}],"outputs":[],"stateMutability":"nonpayable"},
+			{"type":"event","name":"TransferSingle","inputs":[{"name":"operator","type":"address","indexed":true},{"name":"from","type":"address","indexed":true},{"name":"to","type":"address","indexed":true},{"name":"id","type":"uint256"},{"name":"value","type":"uint256"}],"anonymous":false},
+			{"type":"event","name":"TransferBatch","inputs":[{"name":"operator","type":"address","indexed":true},{"name":"from","type":"address","indexed":true},{"name":"to","type":"address","indexed":true},{"name":"ids","type":"uint256[]"},{"name":"values","type":"uint256[]"}],"anonymous":false},
+			{"type":"event","name":"ApprovalForAll","inputs":[{"name":"account","type":"address","indexed":true},{"name":"operator","type":"address","indexed":true},{"name":"approved","type":"bool"}],"anonymous":false},
+			{"type":"event","name":"URI","inputs":[{"name":"value","type":"string"},{"name":"id","type":"uint256","indexed":true}],"anonymous":false}
+		]`,
+	},
+}
+
+// isWellKnownABI returns true for the ID of a built-in ABI
+func isWellKnownABI(id string) bool {
+	_, exists := wellKnownABIs[strings.TrimPrefix(id, wellKnownABIPrefix)]
+	return exists && strings.HasPrefix(id, wellKnownABIPrefix)
+}
+
+// loadWellKnownABI returns a new copy of the deploy message and info of a built-in ABI,
+// which has no bytecode so cannot be used to deploy a contract
+func (g *smartContractGW) loadWellKnownABI(id string) (*messages.DeployContract, *abiInfo, bool) {
+	if !isWellKnownABI(id) {
+		return nil, nil, false
+	}
+	standard := strings.TrimPrefix(id, wellKnownABIPrefix)
+	wk := wellKnownABIs[standard]
+	var abi ethbinding.ABIMarshaling
+	if err := json.Unmarshal([]byte(wk.abi), &abi); err != nil {
+		log.Errorf("Invalid built-in ABI %s: %s", id, err)
+		return nil, nil, false
+	}
+	msg := &messages.DeployContract{
+		ContractName: wk.name,
+		ABI:          abi,
+	}
+	msg.Headers.ID = id
+	info := &abiInfo{
+		ID:          id,
+		Name:        wk.name,
+		Description: wk.description,
+		Path:        "/abis/" + wellKnownABIPath + "/" + standard,
+		SwaggerURL:  g.conf.BaseURL + "/abis/" + wellKnownABIPath + "/" + standard + "?swagger",
+	}
+	return msg, info, true
+}
+
+// listWellKnownABIs serves GET /abis/wellknown, which shares its route with /abis/:abi
+func (g *smartContractGW) listWellKnownABIs(res http.ResponseWriter, req *http.Request) {
+	log.Infof("--> %s %s", req.Method, req.URL)
+
+	retval := make([]*abiInfo, 0, len(wellKnownABIs))
+	for standard := range wellKnownABIs {
+		_, info, _ := g.loadWellKnownABI(wellKnownABIPrefix + standard)
+		retval = append(retval, info)
+	}
+	sort.Slice(retval, func(i, j int) bool { return retval[i].ID < retval[j].ID })
+
+	status := 200
+	log.Infof("<-- %s %s [%d]", req.Method, req.URL, status)
+	res.Header().Set("Content-Type", "application/json")
+	res.WriteHeader(status)
+	enc := json.NewEncoder(res)
+	enc.SetIndent("", "  ")
+	enc.Encode(&retval)
+}
+
+// getWellKnownABI serves GET /abis/wellknown/:standard, which shares its route with
+// /abis/:abi/source, returning the info, ABI, Swagger or UI in the same way as /abis/:abi
+func (g *smartContractGW) getWellKnownABI(res http.ResponseWriter, req *http.Request, standard string) {
+	g.getContractOrABI(res, req, httprouter.Params{{Key: "abi", Value: wellKnownABIPrefix + standard}})
+}
+
+type wellKnownRegistration struct {
+	Address string `json:"address"`
+}
+
+// registerWellKnownContract serves POST /abis/wellknown/:standard, which shares its route
+// with /abis/:abi/:address. The address of the contract is in the body, and the name and
+// environment to register are set in the same way as /abis/:abi/:address
+func (g *smartContractGW) registerWellKnownContract(res http.ResponseWriter, req *http.Request, standard string) {
+	var body wellKnownRegistration
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		g.gatewayErrReply(res, req, ethconnecterrors.Errorf(ethconnecterrors.RESTGatewayWellKnownRegistrationInvalid, err), 400)
+		return
+	}
+	g.registerContract(res, req, httprouter.Params{
+		{Key: "abi", Value: wellKnownABIPrefix + standard},
+		{Key: "address", Value: body.Address},
+	})
+}
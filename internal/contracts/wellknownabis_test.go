@@ -0,0 +1,156 @@
+// Copyright 2021 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package contracts
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/go-openapi/spec"
+	"github.com/kaleido-io/ethconnect/internal/ethbind"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWellKnownABIsValid(t *testing.T) {
+	assert := assert.New(t)
+	scgw := &smartContractGW{conf: &SmartContractGatewayConf{}}
+
+	for standard := range wellKnownABIs {
+		deployMsg, info, ok := scgw.loadWellKnownABI(wellKnownABIPrefix + standard)
+		assert.True(ok)
+		assert.Equal("/abis/wellknown/"+standard, info.Path)
+		assert.False(info.Deployable)
+		runtimeABI, err := ethbind.API.ABIMarshalingToABIRuntime(deployMsg.ABI)
+		assert.NoError(err)
+		assert.NotEmpty(runtimeABI.Events)
+	}
+	assert.False(isWellKnownABI("erc20"))
+	assert.False(isWellKnownABI("wellknown-erc777"))
+	_, _, ok := scgw.loadWellKnownABI("wellknown-erc777")
+	assert.False(ok)
+}
+
+func TestListAndGetWellKnownABIs(t *testing.T) {
+	assert := assert.New(t)
+	dir := tempdir()
+	defer cleanup(dir)
+	_, router := newTestRegistrationsGW(t, dir)
+
+	req := httptest.NewRequest("GET", "/abis/wellknown", nil)
+	res := httptest.NewRecorder()
+	router.ServeHTTP(res, req)
+	assert.Equal(200, res.Code)
+	var infos []*abiInfo
+	json.NewDecoder(res.Body).Decode(&infos)
+	assert.Equal(3, len(infos))
+	assert.Equal("wellknown-erc1155", infos[0].ID)
+	assert.Equal("wellknown-erc20", infos[1].ID)
+	assert.Equal("http://localhost/api/v1/abis/wellknown/erc20?swagger", infos[1].SwaggerURL)
+	assert.Equal("wellknown-erc721", infos[2].ID)
+
+	req = httptest.NewRequest("GET", "/abis/wellknown/erc20?swagger", nil)
+	res = httptest.NewRecorder()
+	router.ServeHTTP(res, req)
+	assert.Equal(200, res.Code)
+	var swagger spec.Swagger
+	json.NewDecoder(res.Body).Decode(&swagger)
+	assert.Equal("ERC20", swagger.Info.Title)
+	assert.Contains(swagger.Paths.Paths, "/Transfer/subscribe")
+	assert.Contains(swagger.Paths.Paths, "/{address}/transfer")
+
+	req = httptest.NewRequest("GET", "/abis/wellknown-erc1155?abi", nil)
+	res = httptest.NewRecorder()
+	router.ServeHTTP(res, req)
+	assert.Equal(200, res.Code)
+	assert.Regexp("TransferBatch", res.Body.String())
+
+	req = httptest.NewRequest("GET", "/abis/wellknown/erc777", nil)
+	res = httptest.NewRecorder()
+	router.ServeHTTP(res, req)
+	assert.Equal(404, res.Code)
+}
+
+func TestRegisterWellKnownContract(t *testing.T) {
+	assert := assert.New(t)
+	dir := tempdir()
+	defer cleanup(dir)
+	scgw, router := newTestRegistrationsGW(t, dir)
+
+	body := `{"address":"0x0123456789abcdef0123456789abcdef01234567"}`
+	req := httptest.NewRequest("POST", "/abis/wellknown/erc721?fly-register=nft", strings.NewReader(body))
+	res := httptest.NewRecorder()
+	router.ServeHTTP(res, req)
+	assert.Equal(201, res.Code)
+	var info contractInfo
+	json.NewDecoder(res.Body).Decode(&info)
+	assert.Equal("wellknown-erc721", info.ABI)
+	assert.Equal("nft", info.RegisteredAs)
+
+	// The instance resolves to the built-in ABI, with its events available to subscribe
+	deployMsg, _, err := scgw.loadDeployMsgForInstance("0123456789abcdef0123456789abcdef01234567")
+	assert.NoError(err)
+	assert.Equal("ERC721", deployMsg.ContractName)
+	req = httptest.NewRequest("GET", "/contracts/nft?swagger", nil)
+	res = httptest.NewRecorder()
+	router.ServeHTTP(res, req)
+	assert.Equal(200, res.Code)
+	var swagger spec.Swagger
+	json.NewDecoder(res.Body).Decode(&swagger)
+	assert.Contains(swagger.Paths.Paths, "/ApprovalForAll/subscribe")
+
+	req = httptest.NewRequest("POST", "/abis/wellknown/erc20", strings.NewReader("!json"))
+	res = httptest.NewRecorder()
+	router.ServeHTTP(res, req)
+	assert.Equal(400, res.Code)
+	assert.Regexp("Invalid registration", res.Body.String())
+
+	req = httptest.NewRequest("POST", "/abis/wellknown/erc20", strings.NewReader(`{"address":"bad"}`))
+	res = httptest.NewRecorder()
+	router.ServeHTTP(res, req)
+	assert.Equal(404, res.Code)
+
+	req = httptest.NewRequest("POST", "/abis/wellknown/erc777", strings.NewReader(body))
+	res = httptest.NewRecorder()
+	router.ServeHTTP(res, req)
+	assert.Equal(404, res.Code)
+	assert.Regexp("No ABI found with ID wellknown-erc777", res.Body.String())
+}
+
+func TestWellKnownABIReadOnlyAndNotDeployable(t *testing.T) {
+	assert := assert.New(t)
+	dir := tempdir()
+	defer cleanup(dir)
+	_, router := newTestRegistrationsGW(t, dir)
+
+	req := httptest.NewRequest("PATCH", "/abis/wellknown-erc20", bytes.NewReader([]byte(`{"hiddenMethods":["approve"]}`)))
+	res := httptest.NewRecorder()
+	router.ServeHTTP(res, req)
+	assert.Equal(403, res.Code)
+	assert.Regexp("cannot be modified", res.Body.String())
+
+	req = httptest.NewRequest("POST", "/abis/wellknown-erc20?fly-from=0x66c5fe653e7a9ebb628a6d40f0452d1e358baee8", bytes.NewReader([]byte(`{}`)))
+	res = httptest.NewRecorder()
+	router.ServeHTTP(res, req)
+	assert.Equal(400, res.Code)
+	assert.Regexp("cannot be used to deploy a contract", res.Body.String())
+
+	req = httptest.NewRequest("DELETE", "/abis/wellknown-erc20", nil)
+	res = httptest.NewRecorder()
+	router.ServeHTTP(res, req)
+	assert.Equal(404, res.Code)
+}
@@ -70,6 +70,10 @@ const (
 	ConfigRESTGatewayRequiredReceiptStore = "MongoDB URL, Database and Collection name must be specified to enable the receipt store"
 	// ConfigRESTGatewayRequiredRPC and RPC stuff
 	ConfigRESTGatewayRequiredRPC = "RPC URL and Storage Path must be supplied to enable the Open API REST Gateway"
+	// ConfigRESTGatewayRequiredRPCForJSONRPC the JSON-RPC facade submits transactions directly to the node
+	ConfigRESTGatewayRequiredRPCForJSONRPC = "RPC URL must be supplied to enable the JSON-RPC listener"
+	// ConfigRESTGatewayRequiredRPCForJSONRPCProxy the JSON-RPC proxy passes requests through to the node
+	ConfigRESTGatewayRequiredRPCForJSONRPCProxy = "RPC URL must be supplied to enable the JSON-RPC proxy"
 	// ConfigWebhooksDirectRPC for webhooks direct
 	ConfigWebhooksDirectRPC = "No JSON/RPC URL set for ethereum node"
 	// ConfigTLSCertOrKey incomplete TLS config
@@ -99,16 +103,44 @@ const (
 	EventStreamsWebhookResumeActive = "Event processor is already active. Suspending:%t"
 	// EventStreamsWebhookProhibitedAddress some IP ranges can be restricted
 	EventStreamsWebhookProhibitedAddress = "Cannot send Webhook POST to address: %s"
-	// EventStreamsWebhookFailedHTTPStatus server at the other end of a webhook returned a non-OK response
-	EventStreamsWebhookFailedHTTPStatus = "%s: Failed with status=%d"
+	// WebhookFailedHTTPStatus server at the other end of a webhook returned a non-OK response
+	WebhookFailedHTTPStatus = "%s: Failed with status=%d"
 	// EventStreamsSubscribeBadBlock the starting block for a subscription request is invalid
 	EventStreamsSubscribeBadBlock = "FromBlock cannot be parsed as a BigInt"
 	// EventStreamsSubscribeStoreFailed problem saving a subscription to our DB
 	EventStreamsSubscribeStoreFailed = "Failed to store subscription: %s"
 	// EventStreamsSubscribeNoEvent missing event
 	EventStreamsSubscribeNoEvent = "Solidity event name must be specified"
+	// EventStreamsAggregationNoWindow aggregation requested without a time or count window
+	EventStreamsAggregationNoWindow = "Aggregation requires a windowSec, a maxCount, or both"
+	// EventStreamsAggregationUnknownField aggregation field is not an input of the event
+	EventStreamsAggregationUnknownField = "Aggregation field '%s' is not a field of event '%s'"
+	// EventStreamsAggregationSumNotNumeric aggregation sum field is not an integer type
+	EventStreamsAggregationSumNotNumeric = "Aggregation sum field '%s' must be an integer type, not '%s'"
 	// EventStreamsSubscriptionNotFound sub not found
 	EventStreamsSubscriptionNotFound = "Subscription with ID '%s' not found"
+	// EventStreamsCheckpointBadBlock the block for a subscription checkpoint is not a positive integer
+	EventStreamsCheckpointBadBlock = "Checkpoint block '%s' must be a positive integer"
+	// EventStreamsCheckpointStreamActive the checkpoint can only be set while the stream is suspended
+	EventStreamsCheckpointStreamActive = "Stream '%s' must be suspended before setting the checkpoint"
+	// EventStreamsCheckpointStoreFailed problem saving a checkpoint to our DB
+	EventStreamsCheckpointStoreFailed = "Failed to store checkpoint: %s"
+	// EventStreamsResumeAtInPast the time to resume a suspended stream has already passed
+	EventStreamsResumeAtInPast = "resumeAt '%s' must be in the future"
+	// EventStreamsMaintenanceWindowBadSchedule the cron-style schedule for a maintenance window is invalid
+	EventStreamsMaintenanceWindowBadSchedule = "Invalid maintenance window schedule '%s': %s"
+	// EventStreamsMaintenanceWindowNoDuration a maintenance window was configured without a duration
+	EventStreamsMaintenanceWindowNoDuration = "Maintenance window '%s' must have a durationSec"
+	// EventStreamsMaintenanceWindowBadTimezone the timezone for a maintenance window could not be loaded
+	EventStreamsMaintenanceWindowBadTimezone = "Invalid maintenance window timezone '%s': %s"
+	// EventStreamsBatchSigningKeyLoad the key for signing event batches could not be loaded
+	EventStreamsBatchSigningKeyLoad = "Failed to load event batch signing key '%s': %s"
+	// EventStreamsBatchSigningKeyType the key for signing event batches is of an unsupported type
+	EventStreamsBatchSigningKeyType = "Unsupported event batch signing key type '%s'. ECDSA P-256 and Ed25519 keys are supported"
+	// EventStreamsBatchSigningNotConfigured a stream requested signed batches, but no signing key is configured
+	EventStreamsBatchSigningNotConfigured = "Signed batches cannot be enabled on the event stream, as no batch signing key is configured"
+	// EventStreamsBatchSigningFailed signing a batch of events failed
+	EventStreamsBatchSigningFailed = "Failed to sign event batch: %s"
 	// EventStreamsCreateStreamStoreFailed problem saving a subscription to our DB
 	EventStreamsCreateStreamStoreFailed = "Failed to store stream: %s"
 	// EventStreamsCreateStreamResourceErr problem creating a resource required by the eventstream
@@ -117,8 +149,10 @@ const (
 	EventStreamsStreamNotFound = "Stream with ID '%s' not found"
 	// EventStreamsLogDecode problem decoding the logs for an event emitted on the chain
 	EventStreamsLogDecode = "%s: Failed to decode data: %s"
-	// EventStreamsLogDecodeInsufficientTopics ran out of topics according to the indexed fields described on the ABI event
-	EventStreamsLogDecodeInsufficientTopics = "%s: Ran out of topics for indexed fields at field %d of %s"
+	// EventLogDecodeInsufficientTopics ran out of topics according to the indexed fields described on the ABI event
+	EventLogDecodeInsufficientTopics = "Ran out of topics for indexed fields at field %d of %s"
+	// EventStreamsLogDecodeEvent failed to decode the fields of the event from the log
+	EventStreamsLogDecodeEvent = "%s: %s"
 	// EventStreamsLogDecodeData RLP decoding of the data section of the logs failed
 	EventStreamsLogDecodeData = "%s: Failed to parse RLP data from event: %s"
 	// EventStreamsWebSocketNotConfigured WebSocket not configured
@@ -133,6 +167,10 @@ const (
 	EventStreamsCannotUpdateType = "The type of an event stream cannot be changed"
 	// EventStreamsInvalidDistributionMode unknown distribution mode
 	EventStreamsInvalidDistributionMode = "Invalid distribution mode '%s'. Valid distribution modes are: 'workloadDistribution' and 'broadcast'."
+	// EventStreamsWebSocketInvalidMaxInFlight the maximum in-flight batches of a WebSocket stream is negative
+	EventStreamsWebSocketInvalidMaxInFlight = "Invalid websocket.maxInFlightBatches %d - must be zero (unlimited) or greater"
+	// EventStreamsWebSocketInvalidRateLimit the rate limit of a WebSocket stream is negative
+	EventStreamsWebSocketInvalidRateLimit = "Invalid websocket.maxBatchesPerSec %g - must be zero (unlimited) or greater"
 
 	// KakfaProducerConfirmMsgUnknown we received a confirmation callback, but we aren't expecting it
 	KakfaProducerConfirmMsgUnknown = "Received confirmation for message not in in-flight map: %s"
@@ -141,6 +179,10 @@ const (
 	KVStoreDBLoad = "Failed to open DB at %s: %s"
 	// KVStoreMemFilteringUnsupported memory db is really just for testing. No filtering support
 	KVStoreMemFilteringUnsupported = "Memory receipts do not support filtering"
+	// KVStoreInvalidConnectionString failed to parse a KV store connection string
+	KVStoreInvalidConnectionString = "Invalid KV store connection string: %s"
+	// KVStoreUnknownDriver no driver registered for the connection string scheme
+	KVStoreUnknownDriver = "No KV store driver registered for scheme '%s'"
 
 	// HDWalletSigningFailed problem returned from remote HDWallet API
 	HDWalletSigningFailed = "HDWallet signing failed"
@@ -174,6 +216,16 @@ const (
 	HTTPRequesterResponseMissingField = "'%s' missing in %s response"
 	// HTTPRequesterResponseNonStringField common HTTP request utility for extensions, expected string for field in response
 	HTTPRequesterResponseNonStringField = "'%s' not a string in %s response"
+	// OAuth2TokenRequestFailed failed to send the client credentials request to the OAuth2 token endpoint
+	OAuth2TokenRequestFailed = "Failed to obtain OAuth2 token from %s: %s"
+	// OAuth2TokenResponseInvalid the OAuth2 token endpoint did not return an access token
+	OAuth2TokenResponseInvalid = "No OAuth2 access token returned by %s [%d]"
+	// AWSCredentialsUnavailable no AWS credentials are configured, or available to the process
+	AWSCredentialsUnavailable = "No AWS credentials are configured, or available from the environment, a credentials file, a web identity token or the instance role"
+	// AWSCredentialsRequestFailed temporary AWS credentials could not be obtained
+	AWSCredentialsRequestFailed = "Failed to obtain AWS credentials from %s: %s"
+	// AWSCredentialsResponseInvalid the response with temporary AWS credentials could not be parsed
+	AWSCredentialsResponseInvalid = "No AWS credentials returned by %s"
 	// HTTPRequesterResponseNullField common HTTP request utility for extensions, expected non-empty response field
 	HTTPRequesterResponseNullField = "'%s' empty (or null) in %s response"
 
@@ -208,17 +260,29 @@ const (
 
 	// RemoteRegistryCacheInit initialzation issue for remote contract registry
 	RemoteRegistryCacheInit = "Failed to initialize cache for remote registry: %s"
+	// RemoteRegistryAuthInit the TLS or OAuth2 configuration for the remote contract registry is invalid
+	RemoteRegistryAuthInit = "Failed to initialize authentication for remote registry: %s"
 	// RemoteRegistryNotConfigured cannot register as a remote registry is not configured
 	RemoteRegistryNotConfigured = "No remote registry is configured"
 	// RemoteRegistryRegistrationFailed error during registration with remote contract registry
 	RemoteRegistryRegistrationFailed = "Failed to register instance in remote registry: %s"
+	// RemoteRegistryReservationFailed the remote registry rejected the reservation of a name prior to deployment
+	RemoteRegistryReservationFailed = "Failed to reserve name '%s' in remote registry: %s"
+	// RemoteRegistryReleaseFailed failed to remove a reservation after a failed deployment
+	RemoteRegistryReleaseFailed = "Failed to release reserved name '%s' in remote registry: %s"
 	// RemoteRegistryLookupGatewayNotFound did not find the requested ID in the remote registry for a gateway/factory
 	RemoteRegistryLookupGatewayNotFound = "Gateway not found"
 	// RemoteRegistryLookupInstanceNotFound did not find the requested ID in the remote registry for a contract instance
 	RemoteRegistryLookupInstanceNotFound = "Instance not found"
 	// RemoteRegistryLookupGenericProcessingFailed we don't return the full original error over the REST API after logging
 	RemoteRegistryLookupGenericProcessingFailed = "Error processing contract registry response"
+	// RemoteRegistryInvalidationInvalid the body of a request to invalidate the remote registry cache could not be parsed
+	RemoteRegistryInvalidationInvalid = "Invalid remote registry invalidation request: %s"
+	// RemoteRegistryPushSignatureInvalid the signature of a push notification from the remote registry does not match the body
+	RemoteRegistryPushSignatureInvalid = "Invalid signature on remote registry push notification"
 
+	// QuotaExceeded a tenant has reached the maximum number of a type of object it can create
+	QuotaExceeded = "Quota exceeded: the maximum number of %s for tenant '%s' is %d"
 	// RESTGatewayGatewayNotFound the gateway REST API interface (the 'factory' / ABI generic interface) was not found
 	RESTGatewayGatewayNotFound = "Gateway not found"
 	// RESTGatewayInstanceNotFound the instance REST API interface (an individual registered address) was not found
@@ -237,10 +301,18 @@ const (
 	RESTGatewayMissingFromAddress = "Please specify a valid address in the '%[1]s-from' query string parameter or x-%[2]s-from HTTP header"
 	// RESTGatewaySubscribeMissingStreamParameter missed the ID of the stream when registering
 	RESTGatewaySubscribeMissingStreamParameter = "Must supply a 'stream' parameter in the body or query"
+	// RESTGatewayDryRunPrivate dry-run requested for a private transaction
+	RESTGatewayDryRunPrivate = "Dry-run is not supported for private transactions"
+	// RESTGatewaySubscribeInvalidAggregation the aggregation options of a subscription could not be parsed
+	RESTGatewaySubscribeInvalidAggregation = "Invalid 'aggregation' parameter: %s"
 	// RESTGatewayMixedPrivateForAndGroupID confused privacy group info, using simple/Tessera style as well as pre-defined/Orion style
 	RESTGatewayMixedPrivateForAndGroupID = "%[1]s-privatefor and %[1]s-privacygroupid are mutually exclusive"
 	// RESTGatewayEventManagerInitFailed constructor failure for event manager
 	RESTGatewayEventManagerInitFailed = "Event-stream subscription manager: %s"
+	// RESTGatewayCheckpointInvalid the body for a subscription checkpoint update could not be parsed
+	RESTGatewayCheckpointInvalid = "Invalid checkpoint: %s"
+	// RESTGatewayResumeAtInvalid the time to resume a suspended stream could not be parsed
+	RESTGatewayResumeAtInvalid = "Invalid resumeAt: %s"
 	// RESTGatewayEventStreamInvalid attempt to create an event stream with invalid parameters
 	RESTGatewayEventStreamInvalid = "Invalid event stream specification: %s"
 	// RESTGatewayPostDeployMissingAddress after deployment the receipt did not contain a contract address
@@ -260,6 +332,8 @@ const (
 
 	// RESTGatewayCompileContractInvalidFormData invalid form data when requesting a compilation to generate an ABI/bytecode
 	RESTGatewayCompileContractInvalidFormData = "Could not parse supplied multi-part form data: %s"
+	// RESTGatewayCompileContractInvalidFormField invalid value for a compiler option in the form data
+	RESTGatewayCompileContractInvalidFormField = "Invalid value for '%s': %s"
 	// RESTGatewayCompileContractCompileFailed failed to perform compile
 	RESTGatewayCompileContractCompileFailed = "Failed to compile solidity: %s"
 	// RESTGatewayCompileContractPostCompileFailed failed to process output of compilation
@@ -305,23 +379,83 @@ const (
 	RESTGatewayLocalStoreContractSavePostDeploy = "%s: Failed to write deployment details: %s"
 	// RESTGatewayFriendlyNameClash duplicate friendly name when reigstering
 	RESTGatewayFriendlyNameClash = "Contract address %s is already registered for name '%s'"
+	// RESTGatewayRegistrationNotFound no contract is registered with the friendly name
+	RESTGatewayRegistrationNotFound = "No contract registered with name '%s'"
+	// RESTGatewayRegistrationNotFoundInEnvironment no contract is registered with the friendly name in the environment
+	RESTGatewayRegistrationNotFoundInEnvironment = "No contract registered with name '%s' in environment '%s'"
+	// RESTGatewayRegistrationTargetRegistered the contract a registration is being moved to already has a friendly name
+	RESTGatewayRegistrationTargetRegistered = "Contract address %s is already registered as '%s' - remove that registration first"
+	// RESTGatewayFriendlyNameEnvironmentClash duplicate friendly name within the same environment when registering
+	RESTGatewayFriendlyNameEnvironmentClash = "Contract address %s is already registered for name '%s' in environment '%s'"
+	// RESTGatewayInferenceNoCode ABI inference was attempted for an address with no contract code
+	RESTGatewayInferenceNoCode = "No contract instance registered with address %s, and there is no contract code at the address"
+	// RESTGatewayRawCallBadData the call data of a raw call to a selector of an inferred ABI is not hex
+	RESTGatewayRawCallBadData = "Invalid data for a call to selector %s. Supply the ABI encoded arguments as 0x prefixed hex: %s"
+	// RESTGatewayInferenceGetCode querying the code of a contract for ABI inference failed
+	RESTGatewayInferenceGetCode = "Failed to query the contract code at address %s: %s"
+	// RESTGatewayInferenceSelectorsLoad the selector dictionary for ABI inference could not be loaded
+	RESTGatewayInferenceSelectorsLoad = "Failed to load selector dictionary '%s': %s"
+	// RESTGatewayInferenceBadSignature a signature in the selector dictionary could not be parsed
+	RESTGatewayInferenceBadSignature = "Invalid signature '%s' in selector dictionary"
+	// RESTGatewayInferenceSelectorMismatch a selector in the dictionary is not the hash of its signature
+	RESTGatewayInferenceSelectorMismatch = "Selector %s in selector dictionary does not match signature '%s'"
 
 	// RPCCallReturnedError specified RPC call returned error
 	RPCCallReturnedError = "%s returned: %s"
 	// RPCConnectFailed error connecting to back-end server over JSON/RPC
 	RPCConnectFailed = "JSON/RPC connection to %s failed: %s"
+	// RPCProxyInvalidURL the proxy for JSON/RPC connections is not a SOCKS5 or HTTP URL
+	RPCProxyInvalidURL = "Invalid JSON/RPC proxy URL '%s'. Must be a socks5:// or http:// URL"
+	// RPCProxyUnsupportedScheme a JSON/RPC node URL with a scheme that cannot be tunnelled
+	RPCProxyUnsupportedScheme = "JSON/RPC connections over '%s' cannot be tunnelled through a proxy"
+	// RPCMulticallBadAddress the configured Multicall3 contract address is invalid
+	RPCMulticallBadAddress = "Invalid Multicall3 contract address '%s'"
+	// RPCMulticallBadResult the result of an aggregated call could not be decoded
+	RPCMulticallBadResult = "Multicall3 did not return a result for each of the %d calls"
 
 	// SecurityModulePluginLoad failed to load .so
 	SecurityModulePluginLoad = "Failed to load plugin: %s"
 	// SecurityModulePluginSymbol missing symbol in plugin
 	SecurityModulePluginSymbol = "Failed to load 'SecurityModule' symbol from '%s': %s"
+	// KVStoreDriverPluginLoad failed to load .so
+	KVStoreDriverPluginLoad = "Failed to load KV store driver plugin for scheme '%s': %s"
+	// KVStoreDriverPluginSymbol missing symbol in plugin
+	KVStoreDriverPluginSymbol = "Failed to load 'KVStoreDriver' symbol from '%s': %s"
+	// MessageTransformerPluginLoad failed to load .so
+	MessageTransformerPluginLoad = "Failed to load message transformer plugin: %s"
+	// MessageTransformerPluginSymbol missing symbol in plugin
+	MessageTransformerPluginSymbol = "Failed to load 'MessageTransformer' symbol from '%s': %s"
 	// SecurityModuleNoAuthContext missing auth context in context object at point security module is invoked
 	SecurityModuleNoAuthContext = "No auth context"
+	// SecurityModulePrincipalUnsupported the security module cannot map a principal authenticated by ethconnect to an auth context
+	SecurityModulePrincipalUnsupported = "The security module does not support authenticating principals other than by token"
+	// SecurityModuleNoAdminPolicy the security module does not implement the admin extension, so administrative operations are rejected
+	SecurityModuleNoAdminPolicy = "The security module does not authorize administrative operations such as '%s'"
+	// EthSignatureAuthBadHeader the authorization header of a signed request could not be parsed
+	EthSignatureAuthBadHeader = "Invalid EIP191 authorization header: %s"
+	// EthSignatureAuthBadPrincipal the principals of signature authentication are keyed by address
+	EthSignatureAuthBadPrincipal = "Invalid address '%s' for principal '%s' of signature authentication"
+	// EthSignatureAuthExpired the timestamp of a signed request is outside the allowed skew
+	EthSignatureAuthExpired = "The timestamp of the signed request is more than %d seconds from the current time"
+	// EthSignatureAuthInvalidSignature the signature of a request could not be recovered to an address
+	EthSignatureAuthInvalidSignature = "Invalid request signature: %s"
+	// EthSignatureAuthUnknownAddress the address that signed a request is not mapped to a principal
+	EthSignatureAuthUnknownAddress = "Address %s is not mapped to a principal"
+	// EthSignatureAuthBodyTooLarge the body of a signed request is larger than the configured limit
+	EthSignatureAuthBodyTooLarge = "The body of the signed request is larger than the limit of %d bytes"
+	// EthSignatureAuthReplayed a signed request was received more than once
+	EthSignatureAuthReplayed = "The signed request has already been received"
+	// EthSignatureAuthRequired signature authentication is required, and the request is not signed
+	EthSignatureAuthRequired = "Requests must be signed with an EIP191 authorization header"
 
 	// TransactionSendConstructorPackArgs RLP encoding failure for a constructor
 	TransactionSendConstructorPackArgs = "Packing arguments for constructor: %s"
+	// TransactionSendEventABIInvalid an event definition supplied for decoding receipt logs is invalid
+	TransactionSendEventABIInvalid = "Invalid event '%s' in ABI: %s"
 	// TransactionSendMethodPackArgs RLP encoding failure for a method
 	TransactionSendMethodPackArgs = "Packing arguments for method '%s': %s"
+	// TransactionSendBadData pre-encoded call data supplied for a transaction is not valid hex
+	TransactionSendBadData = "Invalid call data: %s"
 	// TransactionSendInputTypeUnknown there is a type in the ABI inputs that we don't understand
 	TransactionSendInputTypeUnknown = "ABI input %d: Unable to map %s to etherueum type: %s"
 	// TransactionSendOutputTypeUnknown there is a type in the ABI outputs that we don't understand
@@ -400,6 +534,18 @@ const (
 
 	// TransactionCallInvalidBlockNumber on "eth_call" the optional parameter for the target blocknumber failed to parse to a big integer
 	TransactionCallInvalidBlockNumber = "Invalid blocknumber. Failed to parse into big integer"
+	// TransactionCallInvalidAsOf the asOf option for a historical query was neither a block number nor a timestamp
+	TransactionCallInvalidAsOf = "Invalid asOf '%s'. Must be a block number, or an RFC3339 timestamp"
+	// TransactionCallAsOfBeforeFirstBlock the asOf timestamp for a historical query is before the first block of the chain
+	TransactionCallAsOfBeforeFirstBlock = "No block exists at or before %s"
+	// TransactionCallAsOfBlockNotFound the node did not return a block while resolving an asOf timestamp
+	TransactionCallAsOfBlockNotFound = "Block %d not found while resolving asOf timestamp"
+	// TransactionCallAsOfWithBlockNumber both the asOf and blocknumber options were supplied for a query
+	TransactionCallAsOfWithBlockNumber = "Only one of asOf and blocknumber can be supplied"
+	// TransactionCallInvalidBlockTag the blocktag option for a query was not one of the named blocks
+	TransactionCallInvalidBlockTag = "Invalid blocktag '%s'. Must be one of earliest, latest, safe, finalized or pending"
+	// TransactionCallBlockTagWithBlockNumber the blocktag option was supplied with the blocknumber or asOf option for a query
+	TransactionCallBlockTagWithBlockNumber = "Only one of blocktag, blocknumber and asOf can be supplied"
 
 	// UnpackOutputsFailed RLP decoding of outputs, logs, or events failed
 	UnpackOutputsFailed = "Failed to unpack values: %s"
@@ -438,15 +584,654 @@ const (
 	// WebhooksKafkaErr wrapper on detailed error from Kafka itself
 	WebhooksKafkaErr = "Failed to deliver message to Kafka: %s"
 
+	// WebSocketAuthRequired a command was received on a WebSocket before the "auth" message
+	WebSocketAuthRequired = "Authentication required before '%s' message"
+	// WebSocketAuthFailed the token supplied in an "auth" message was rejected
+	WebSocketAuthFailed = "Authentication failed: %s"
+	// WebSocketAuthIdentityChanged a token refreshing the authentication of a WebSocket was for a different principal or tenant
+	WebSocketAuthIdentityChanged = "Token is for a different principal or tenant than the connection"
+	// WebSocketAuthTimeout no "auth" message was received after connecting
+	WebSocketAuthTimeout = "No authentication received within %.2f seconds"
+	// WebSocketAuthExpired the token used to authenticate expired, and was not refreshed
+	WebSocketAuthExpired = "Authentication token expired"
+	// WebSocketIdleTimeout no messages were sent or received on a WebSocket within the idle timeout
+	WebSocketIdleTimeout = "Connection idle for %.2f seconds"
+	// WebSocketMsgPackEncodeFailed failed to encode a payload for a binary WebSocket connection
+	WebSocketMsgPackEncodeFailed = "Failed to encode MessagePack payload: %s"
+	// WebSocketNoMessageInflight an ack or error was received on a subscribed topic with no message awaiting a response
+	WebSocketNoMessageInflight = "No message awaiting acknowledgment on topic '%s'"
+	// WebSocketAckSequenceMismatch the sequence in an ack or error does not match the message awaiting a response
+	WebSocketAckSequenceMismatch = "Sequence %d does not match sequence %d awaiting acknowledgment on topic '%s'"
+	// WebSocketUnsubscribedInflight a subscribed topic was unsubscribed while a message was awaiting acknowledgment
+	WebSocketUnsubscribedInflight = "Unsubscribed from topic '%s' before acknowledging the message in flight"
+
+	// PrivacyInvalidRequest the body of a request to the privacy key management API could not be parsed
+	PrivacyInvalidRequest = "Invalid enclave key request: %s"
+	// PrivacyKeyMissingFields a name and public key are required to register an enclave key
+	PrivacyKeyMissingFields = "A name and key must be supplied"
+	// PrivacyKeyInvalid enclave public keys for Orion/Tessera are base64 encoded 32 byte keys
+	PrivacyKeyInvalid = "Invalid enclave public key '%s' - must be a base64 encoded 32 byte key"
+	// PrivacyKeyExists an enclave key is already registered with the name
+	PrivacyKeyExists = "Enclave key '%s' is already registered"
+	// PrivacyKeyNotFound no enclave key is registered with the name
+	PrivacyKeyNotFound = "No enclave key registered with name '%s'"
+	// PrivacyKeyStoreFailed failed to persist an enclave key
+	PrivacyKeyStoreFailed = "Failed to store enclave key '%s': %s"
+	// PrivacyPTMUnreachable the upcheck of the private transaction manager failed
+	PrivacyPTMUnreachable = "Private transaction manager at %s is unreachable: %s"
+	// PrivacyPTMBadStatus the private transaction manager returned a failure status
+	PrivacyPTMBadStatus = "Private transaction manager returned status %d"
+	// TransactionSendPTMUnavailable a private transaction failed to send, and the private transaction manager is down
+	TransactionSendPTMUnavailable = "%s (%s)"
+	// JSONRPCFacadeParseError the body of a request to the JSON-RPC listener could not be parsed
+	JSONRPCFacadeParseError = "Invalid JSON-RPC request: %s"
+	// JSONRPCFacadeRequestTooLarge the body of a request to the JSON-RPC listener exceeded the size limit
+	JSONRPCFacadeRequestTooLarge = "JSON-RPC request exceeds the maximum size of %d bytes"
+	// JSONRPCFacadeEmptyBatch a JSON-RPC batch request contained no requests
+	JSONRPCFacadeEmptyBatch = "Empty JSON-RPC batch"
+	// JSONRPCFacadeMissingMethod a JSON-RPC request did not include a method
+	JSONRPCFacadeMissingMethod = "Missing method in JSON-RPC request"
+	// JSONRPCFacadeMethodNotSupported the JSON-RPC method is not handled by ethconnect, or passed through to the node
+	JSONRPCFacadeMethodNotSupported = "Method '%s' is not supported"
+	// JSONRPCFacadeInvalidParams the params of a JSON-RPC request could not be parsed
+	JSONRPCFacadeInvalidParams = "Invalid params for %s: %s"
+	// JSONRPCFacadeInvalidQuantity a hex encoded quantity in a JSON-RPC request could not be parsed
+	JSONRPCFacadeInvalidQuantity = "Invalid hex quantity '%s' for %s"
+	// JSONRPCFacadeMissingDeployData a contract deployment was submitted without any bytecode
+	JSONRPCFacadeMissingDeployData = "Data must be supplied to deploy a contract"
+	// JSONRPCFacadeSubmitInterrupted the client request ended before the transaction was submitted to the node
+	JSONRPCFacadeSubmitInterrupted = "Request ended before the transaction was submitted: %s"
 	// WebhooksDirectTooManyInflight when we're not using a buffered store (Kafka) we have to reject
 	WebhooksDirectTooManyInflight = "Too many in-flight transactions"
 	// WebhooksDirectBadHeaders problem processing for in-memory operation
 	WebhooksDirectBadHeaders = "Failed to process headers in message"
+	// WebhooksDirectWorkQueueOpen failed to open the LevelDB work queue
+	WebhooksDirectWorkQueueOpen = "Failed to open work queue: %s"
+	// WebhooksDirectWorkQueuePersist failed to persist a message before acknowledging it
+	WebhooksDirectWorkQueuePersist = "Failed to persist message to work queue: %s"
+	// WebhooksDirectWorkQueueRetriesExceeded a message did not complete after being re-dispatched on restart the maximum number of times
+	WebhooksDirectWorkQueueRetriesExceeded = "Message did not complete after %d dispatch attempts"
+	// ReceiptWebhookNoURL a receipt webhook destination was configured without a URL
+	ReceiptWebhookNoURL = "No URL configured for receipt webhook '%s'"
+	// ReceiptWebhookInvalidURL the URL of a receipt webhook destination could not be parsed
+	ReceiptWebhookInvalidURL = "Invalid URL configured for receipt webhook '%s'"
+	// ReceiptWebhookDuplicateName two receipt webhook destinations have the same name
+	ReceiptWebhookDuplicateName = "Duplicate receipt webhook name '%s'"
+	// ReceiptWebhookDLQOpen failed to open the receipt webhook dead letter queue
+	ReceiptWebhookDLQOpen = "Failed to open receipt webhook dead letter queue: %s"
+	// ReceiptWebhookQueueFull the delivery queue for a receipt webhook is full
+	ReceiptWebhookQueueFull = "%s: Delivery queue full (%d receipts)"
+	// ReceiptWebhookNotFound no receipt webhook destination with the requested name
+	ReceiptWebhookNotFound = "Receipt webhook '%s' not found"
+	// OpsEventsWebhookInvalidURL the URL of the operational events webhook could not be parsed
+	OpsEventsWebhookInvalidURL = "Invalid URL configured for the operational events webhook: %s"
+	// WebhooksCircuitBreakerOpen the circuit breaker in front of the asynchronous dispatcher is open
+	WebhooksCircuitBreakerOpen = "Asynchronous dispatch is unavailable: the circuit breaker is open"
+	// WebhooksCircuitBreakerInvalidOverride unknown value supplied to override the circuit breaker
+	WebhooksCircuitBreakerInvalidOverride = "Invalid circuit breaker override '%s': must be 'open', 'closed', or empty for automatic control"
 
 	// LevelDBFailedRetriveOriginalKey problem retrieving entry - original key
 	LevelDBFailedRetriveOriginalKey = "Failed to retrieve the entry for the original key: %s. %s"
 	// LevelDBFailedRetriveGeneratedID problem retrieving entry - generated ID
 	LevelDBFailedRetriveGeneratedID = "Failed to retrieve the entry for the generated ID: %s. %s"
+	// LevelDBAdminInvalidRequest the request body could not be parsed
+	LevelDBAdminInvalidRequest = "Invalid LevelDB admin request: %s"
+	// LevelDBAdminUnknownStore no open LevelDB store with the requested name
+	LevelDBAdminUnknownStore = "Unknown LevelDB store '%s'"
+	// LevelDBAdminCompactFailed compaction of a LevelDB store failed
+	LevelDBAdminCompactFailed = "Compaction of LevelDB store '%s' failed: %s"
+	// LevelDBAdminBackupFailed snapshot backup of a LevelDB store failed
+	LevelDBAdminBackupFailed = "Backup of LevelDB store '%s' failed: %s"
+	// LevelDBAdminBackupExists we never overwrite an existing backup
+	LevelDBAdminBackupExists = "Backup target '%s' already exists"
+	// LevelDBAdminBackupTargetMissing a backup was requested without a target
+	LevelDBAdminBackupTargetMissing = "Backup target must be a file name, or an http(s) URL to upload to"
+	// LevelDBAdminBackupPathNotConfigured backups to file require a configured directory
+	LevelDBAdminBackupPathNotConfigured = "No backup path is configured for LevelDB file backups"
+	// LevelDBAdminBackupInvalidName file backups must be a simple name within the backup path
+	LevelDBAdminBackupInvalidName = "Invalid backup name '%s'"
+	// LevelDBAdminBackupUploadFailed upload of a backup archive failed
+	LevelDBAdminBackupUploadFailed = "Failed to upload backup: %s"
+	// LevelDBAdminBackupURLNotAllowed uploads are only permitted to configured destinations
+	LevelDBAdminBackupURLNotAllowed = "Backup uploads to '%s' are not allowed. Destinations must be configured in leveldbAdmin.uploadURLs"
+	// RESTGatewayRecordingOpen the file to record requests to could not be opened
+	RESTGatewayRecordingOpen = "Failed to open recording file '%s': %s"
+	// ReplayNoFile a replay needs a recording file
+	ReplayNoFile = "No recording file specified"
+	// ReplayNoTarget a replay needs a gateway to send the requests to
+	ReplayNoTarget = "A target URL is required to replay a recording"
+	// ReplayReadFailed the recording file could not be read
+	ReplayReadFailed = "Failed to read recording '%s': %s"
+	// ReplayBadEntry a line in the recording could not be parsed
+	ReplayBadEntry = "Invalid entry at line %d of the recording: %s"
+	// ReplayStatusMismatch the replayed request returned a different status to the recording
+	ReplayStatusMismatch = "Expected status %d, received %d"
+	// ReplayBodyMismatch the replayed request returned a different body to the recording
+	ReplayBodyMismatch = "Response body does not match the recording"
+	// ReplayMismatches some replayed requests did not match the recording
+	ReplayMismatches = "%d of %d replayed requests did not match the recording"
+	// TransformRequestRejected a transformation hook rejected a message
+	TransformRequestRejected = "Message rejected by transformation hook: %s"
+	// TransformWebhookFailed a transformation webhook could not be called
+	TransformWebhookFailed = "Transformation webhook '%s' failed: %s"
+	// TransformWebhookRejected a transformation webhook returned an error
+	TransformWebhookRejected = "Transformation webhook '%s' rejected the message [%d]: %s"
+	// TransactionQueueNotFound no transaction with the ID is in-flight for the address
+	TransactionQueueNotFound = "No transaction with ID '%s' is in-flight for address '%s'"
+	// TransactionQueueInvalidRequest the body of a request to the transaction queue API could not be parsed
+	TransactionQueueInvalidRequest = "Invalid transaction queue request: %s"
+	// TransactionQueueBadGasPrice the gas price for a replacement transaction is not an integer
+	TransactionQueueBadGasPrice = "Invalid gas price '%s'"
+	// TransactionQueueNotSubmitted the transaction has not yet been accepted by the node, so cannot be replaced
+	TransactionQueueNotSubmitted = "Transaction %d has not yet been submitted to the node"
+	// TransactionQueueNodeAssignedNonce the nonce was assigned by the node, so the transaction cannot be replaced
+	TransactionQueueNodeAssignedNonce = "Transaction %d was assigned a nonce by the node, so cannot be replaced"
+	// TransactionQueuePrivate private transactions cannot be replaced
+	TransactionQueuePrivate = "Transaction %d is a private transaction, so cannot be replaced"
+	// TransactionQueueBumpGasPrice the replacement gas price must exceed the current one
+	TransactionQueueBumpGasPrice = "Gas price of the replacement transaction must be higher than %s"
+	// TransactionQueueDropped the transaction was dropped from the queue by an operator before a receipt was obtained
+	TransactionQueueDropped = "Transaction was dropped from the queue before a receipt was obtained"
+	// EventStreamsSchemaRegistryBadFormat unknown format for published event schemas
+	EventStreamsSchemaRegistryBadFormat = "Invalid schema registry format '%s'. Valid formats are: 'json', 'avro' and 'protobuf'"
+	// EventStreamsSchemaRegistryFailed the schema registry could not be called
+	EventStreamsSchemaRegistryFailed = "Failed to publish the schema for subject '%s' to the schema registry: %s"
+	// EventStreamsSchemaRegistryRejected the schema registry returned an error
+	EventStreamsSchemaRegistryRejected = "Schema registry rejected the schema for subject '%s' [%d]: %s"
+	// EventStreamsSchemaAvroInvalidName a name in the event ABI cannot be used in an Avro schema
+	EventStreamsSchemaAvroInvalidName = "'%s' in event '%s' is not a valid Avro name"
+	// EventStreamsSchemaProtobufInvalidName a name in the event ABI cannot be used in a Protobuf schema
+	EventStreamsSchemaProtobufInvalidName = "'%s' in event '%s' is not a valid Protobuf name"
+	// EventStreamsSchemaProtobufNestedArray Protobuf has no repeated field of repeated values
+	EventStreamsSchemaProtobufNestedArray = "'%s' in event '%s' is an array of arrays, which cannot be described in a Protobuf schema"
+	// SponsorshipInvalidSponsor a configured sponsor is missing its name or from address
+	SponsorshipInvalidSponsor = "Each sponsor must be configured with a name and a from address"
+	// SponsorshipUnknownSponsor the requested sponsor is not configured
+	SponsorshipUnknownSponsor = "Unknown sponsor '%s'"
+	// SponsorshipNotEntitled the security module did not entitle the caller to the sponsor
+	SponsorshipNotEntitled = "Not entitled to use the gas of sponsor '%s': %s"
+	// SponsorshipTenantNotEntitled the tenant of the caller is not configured on the sponsor
+	SponsorshipTenantNotEntitled = "Tenant '%s' is not entitled to use the gas of sponsor '%s'"
+	// RESTGatewayMethodReadOnly a transaction was submitted to a method restricted to queries
+	RESTGatewayMethodReadOnly = "Method '%s' is read-only on this gateway, and cannot be invoked as a transaction"
+	// RESTGatewayMethodAccessUnknownMethod a method access list names a method that is not in the ABI
+	RESTGatewayMethodAccessUnknownMethod = "Method '%s' in the method access lists is not declared in the ABI"
+	// RESTGatewayMethodAccessInvalid the body of a method access update could not be parsed
+	RESTGatewayMethodAccessInvalid = "Invalid method access: %s"
+	// RESTGatewayContractRebindInvalid the body of a request to bind a contract to a new ABI could not be parsed
+	RESTGatewayContractRebindInvalid = "Invalid ABI binding: %s"
+	// RESTGatewayContractRebindMissingABI a request to bind a contract to a new ABI did not specify the ABI
+	RESTGatewayContractRebindMissingABI = "Must specify the 'abi' to bind the contract to"
+	// RESTGatewayConformanceInvalid the body of a conformance check could not be parsed
+	RESTGatewayConformanceInvalid = "Invalid conformance check request: %s"
+	// RESTGatewayConformanceNoOutput a read-only method returned no data, so is not implemented by the contract
+	RESTGatewayConformanceNoOutput = "No data returned. The method might not be implemented by the contract"
+	// RESTGatewayBatchInvalid the body of a batch submission could not be parsed
+	RESTGatewayBatchInvalid = "Invalid batch request: %s"
+	// RESTGatewayBatchSize a batch submission was empty, or larger than the maximum
+	RESTGatewayBatchSize = "A batch must contain between 1 and %d transactions"
+	// RESTGatewayBatchMissingContract an entry in a batch did not specify the contract or method to invoke
+	RESTGatewayBatchMissingContract = "Each transaction in a batch must specify a 'contract' and a 'method'"
+	// RESTGatewayBatchMethodConstant an entry in a batch invoked a method that does not modify state
+	RESTGatewayBatchMethodConstant = "Method '%s' does not modify state, so cannot be submitted as a transaction in a batch"
+	// RESTGatewayBatchEntryNotSubmitted an entry in a batch was not submitted, because an earlier entry failed
+	RESTGatewayBatchEntryNotSubmitted = "Not submitted, as transaction %d of the batch failed"
+	// RESTGatewayMulticallInvalid the body of a multicall is not an array of calls
+	RESTGatewayMulticallInvalid = "Invalid multicall request: %s"
+	// RESTGatewayMulticallSize a multicall is empty, or too large
+	RESTGatewayMulticallSize = "A multicall must contain between 1 and %d calls"
+	// RESTGatewayMulticallMissingContract a call in a multicall did not specify the contract or method to call
+	RESTGatewayMulticallMissingContract = "Each call in a multicall must specify a 'contract' and a 'method'"
+	// ReceiptReconcilerDBOpen the store of pending receipts could not be opened
+	ReceiptReconcilerDBOpen = "Failed to open the pending receipts store: %s"
+	// ReceiptReconcilerReplaced the nonce of a transaction that was never mined has been used by another transaction
+	ReceiptReconcilerReplaced = "Transaction %s was not mined, and nonce %d of %s has been used by another transaction"
+	// RegistryStoreNotFound an ABI or contract instance is not in the registry storage
+	RegistryStoreNotFound = "No %s with ID '%s' in the registry storage"
+	// RegistryStorePostgreSQLInvalidTable the configured table name cannot be used safely in SQL
+	RegistryStorePostgreSQLInvalidTable = "Invalid PostgreSQL registry table name '%s'"
+	// RegistryStorePostgreSQLConnect failed to connect to, or create the table in, the PostgreSQL database
+	RegistryStorePostgreSQLConnect = "Unable to initialize the PostgreSQL registry storage: %s"
+	// RegistryStoreS3MissingCredentials no access key was configured or available to the process
+	RegistryStoreS3MissingCredentials = "No AWS credentials for the S3 registry storage: %s"
+	// RegistryStoreS3InvalidEndpoint the configured S3 endpoint is not a valid URL
+	RegistryStoreS3InvalidEndpoint = "Invalid S3 endpoint '%s'"
+	// RegistryStoreS3RequestFailed an S3 request returned a failure status
+	RegistryStoreS3RequestFailed = "S3 %s of '%s' failed [%d]: %s"
+	// BackfillNotFound the backfill does not exist
+	BackfillNotFound = "Backfill with ID '%s' not found"
+	// BackfillBadBlock the fromBlock or toBlock of a backfill is not a block number
+	BackfillBadBlock = "Backfill %s '%s' must be a block number"
+	// BackfillBadRange the fromBlock of a backfill is after the toBlock
+	BackfillBadRange = "Backfill fromBlock %s is after toBlock %s"
+	// ExportBadBlock the fromBlock or toBlock of an event export is not a block number
+	ExportBadBlock = "Export %s '%s' must be a block number"
+	// ExportBadRange the fromBlock of an event export is after the toBlock
+	ExportBadRange = "Export fromBlock %s is after toBlock %s"
+	// ExportInvalidFormat the format of an event export is not supported
+	ExportInvalidFormat = "Unknown export format '%s'. Valid formats are: 'ndjson' and 'csv'"
+	// BackfillInvalidType the target type of a backfill is not supported
+	BackfillInvalidType = "Unknown backfill type '%s'. Valid types are: 'kafka' and 'webhook'"
+	// BackfillKafkaNoTopic no topic was specified for a backfill to Kafka
+	BackfillKafkaNoTopic = "Must specify kafka.topic for backfill type 'kafka'"
+	// BackfillKafkaNotConfigured no Kafka brokers are configured for backfills
+	BackfillKafkaNotConfigured = "Kafka brokers must be configured in the backfills configuration for backfill type 'kafka'"
+	// BackfillKafkaConnect failed to create a producer to deliver a backfill to Kafka
+	BackfillKafkaConnect = "Failed to connect to Kafka for backfill: %s"
+	// BackfillStoreFailed failed to persist a backfill
+	BackfillStoreFailed = "Failed to store backfill: %s"
+	// BackfillNotFailed only a failed backfill can be resumed
+	BackfillNotFailed = "Backfill '%s' is %s. Only a failed backfill can be resumed"
+	// RESTGatewayBackfillInvalid attempt to create a backfill with invalid parameters
+	RESTGatewayBackfillInvalid = "Invalid backfill specification: %s"
+	// RESTGatewayListBadNumber a paging parameter of a listing is not a non-negative integer
+	RESTGatewayListBadNumber = "Invalid '%s' query parameter '%s'. Must be a non-negative integer"
+	// RESTGatewayListBadTime a time filter of a listing is not an RFC3339 timestamp
+	RESTGatewayListBadTime = "Invalid '%s' query parameter '%s'. Must be an RFC3339 timestamp"
+	// RESTGatewayListBadSort unknown sort field for a listing
+	RESTGatewayListBadSort = "Invalid 'sort' query parameter '%s'. Valid values are: 'created' and 'name'"
+	// RESTGatewayListBadOrder unknown sort order for a listing
+	RESTGatewayListBadOrder = "Invalid 'order' query parameter '%s'. Valid values are: 'asc' and 'desc'"
+	// RESTGatewaySourceImportUnresolved an import in an uploaded Solidity file could not be found when flattening
+	RESTGatewaySourceImportUnresolved = "Unable to resolve import '%s' in '%s' to flatten the source"
+	// RESTGatewaySourceNotFound no source is stored for an ABI that was not compiled by the gateway
+	RESTGatewaySourceNotFound = "No source is stored for ABI '%s'. Source is only stored when the gateway compiles the ABI"
+	// RESTGatewaySourceStoreFailed failed to store the flattened source and metadata of an ABI
+	RESTGatewaySourceStoreFailed = "Failed to store the source of ABI '%s': %s"
+	// RESTGatewayABIResourceNotFound a path under an ABI that is not a method call was not recognized
+	RESTGatewayABIResourceNotFound = "Unknown resource '%s' for ABI '%s'"
+	// TransactionSendBadFee a user-supplied EIP-1559 fee cannot be processed
+	TransactionSendBadFee = "Invalid '%s' value '%s'. Must be a non-negative integer"
+	// TransactionSendGasPriceAndDynamicFees a gas price and EIP-1559 fees were both supplied
+	TransactionSendGasPriceAndDynamicFees = "Cannot specify both 'gasPrice' and 'maxFeePerGas'/'maxPriorityFeePerGas'"
+	// TransactionSendUnknownGasPriceStrategy the gas price strategy of a request is not one of the built-in strategies
+	TransactionSendUnknownGasPriceStrategy = "Unknown gas price strategy '%s'"
+	// TransactionSendGasPriceStrategyConflict a gas price strategy was requested along with the gas price or fees
+	TransactionSendGasPriceStrategyConflict = "Cannot specify a gas price strategy with 'gasPrice', 'maxFeePerGas' or 'maxPriorityFeePerGas'"
+	// TransactionSendGasPriceFailed the gas price strategy failed to return a gas price
+	TransactionSendGasPriceFailed = "Failed to get the gas price with the '%s' strategy: %s"
+	// TransactionSendGasOracleBadResponse the response of the gas price oracle does not contain a gas price
+	TransactionSendGasOracleBadResponse = "No gas price at '%s' in the response of the gas price oracle"
+	// TransactionSendCREATE2BadSalt the salt of a CREATE2 deployment is not hex, or longer than 32 bytes
+	TransactionSendCREATE2BadSalt = "Invalid salt '%s' - must be hex of up to 32 bytes"
+	// TransactionSendDynamicFeeWithSigner EIP-1559 transactions cannot be signed by ethconnect
+	TransactionSendDynamicFeeWithSigner = "EIP-1559 dynamic fee transactions are not supported with the '%s' signer"
+	// TransactionSendLondonCheckFailed failed to query the latest block, to check for EIP-1559 support
+	TransactionSendLondonCheckFailed = "Failed to check the chain for EIP-1559 support: %s"
+	// TransactionSendFeeHistoryFailed eth_feeHistory failed while estimating EIP-1559 fees
+	TransactionSendFeeHistoryFailed = "Failed to estimate fees with eth_feeHistory: %s"
+	// IdentityAliasInvalidName an alias name must not be confused with an address or HD wallet reference
+	IdentityAliasInvalidName = "Invalid alias name '%s' - must start with a letter, contain only letters, numbers, '.', '_' and '-', and be at most 64 characters"
+	// IdentityAliasInvalidTarget an alias must map to exactly one of an address or a signer
+	IdentityAliasInvalidTarget = "Alias '%s' must have exactly one of an 'address' or a 'signer'"
+	// IdentityAliasInvalidAddress the address of an alias is not a valid ethereum address
+	IdentityAliasInvalidAddress = "Invalid address '%s' for alias '%s'"
+	// IdentityAliasInvalidSigner the signer of an alias is not a supported external signer reference
+	IdentityAliasInvalidSigner = "Invalid signer '%s' for alias '%s' - must be an HD wallet reference of the form 'hd-<instance>-<wallet>-<index>', or a local keystore account of the form 'local-<index>' or 'm/<path>'"
+	// IdentityAliasNotFound no alias is registered with the name
+	IdentityAliasNotFound = "No alias registered with name '%s'"
+	// IdentityAliasExists an alias is already registered with the name
+	IdentityAliasExists = "Alias '%s' is already registered"
+	// IdentityAliasNotEntitled the security module did not entitle the caller to the alias
+	IdentityAliasNotEntitled = "Not entitled to send transactions from alias '%s': %s"
+	// IdentityAliasTenantNotEntitled the tenant of the caller does not own, and is not configured on, the alias
+	IdentityAliasTenantNotEntitled = "Tenant '%s' is not entitled to send transactions from alias '%s'"
+	// IdentityAliasNotOwner only the tenant that registered an alias can change it
+	IdentityAliasNotOwner = "Tenant '%s' is not the owner of alias '%s'"
+	// IdentityAliasStoreFailed failed to persist an alias
+	IdentityAliasStoreFailed = "Failed to store alias '%s': %s"
+	// IdentityAliasInvalidRequest the alias request body could not be parsed
+	IdentityAliasInvalidRequest = "Invalid alias request: %s"
+	// EventStreamsInvalidRetryPolicy the retry policy of a stream has an invalid factor or jitter
+	EventStreamsInvalidRetryPolicy = "Invalid retry policy - the factor must be at least 1, and the jitter between 0 and 1"
+	// EventStreamsInvalidCatchupPolicy the catch-up policy of a stream has a negative limit
+	EventStreamsInvalidCatchupPolicy = "Invalid catchup policy - the limits must be zero (unlimited) or greater"
+	// EventStreamsDeadLetterInvalidType the dead letter type of a stream is not supported
+	EventStreamsDeadLetterInvalidType = "Unknown dead letter type '%s'. Valid types are: 'file', 'kafka' and 'webhook'"
+	// EventStreamsDeadLetterNoDirectory no directory is configured for dead letter files
+	EventStreamsDeadLetterNoDirectory = "A directory must be configured in the deadLetters configuration for dead letter type 'file'"
+	// EventStreamsDeadLetterKafkaNoTopic no topic was specified for dead letters to Kafka
+	EventStreamsDeadLetterKafkaNoTopic = "Must specify kafka.topic for dead letter type 'kafka'"
+	// EventStreamsDeadLetterKafkaNotConfigured no Kafka brokers are configured for dead letters
+	EventStreamsDeadLetterKafkaNotConfigured = "Kafka brokers must be configured in the deadLetters configuration for dead letter type 'kafka'"
+	// EventStreamsDeadLetterKafkaConnect failed to create a producer to send dead letters to Kafka
+	EventStreamsDeadLetterKafkaConnect = "Failed to connect to Kafka for dead letters: %s"
+	// EventStreamsDeadLetterWriteFailed failed to append a dead letter to the file of a stream
+	EventStreamsDeadLetterWriteFailed = "Failed to write dead letter to '%s': %s"
+	// EventStreamsDeadLetterReadFailed failed to read the dead letter file of a stream
+	EventStreamsDeadLetterReadFailed = "Failed to read dead letters from '%s': %s"
+	// EventStreamsDeadLetterNotFile only dead letters stored in a file can be listed and replayed by the gateway
+	EventStreamsDeadLetterNotFile = "Dead letters of stream '%s' are not stored in a file, so cannot be listed or replayed"
+	// EventStreamsDeadLetterReplaySuspended dead letters cannot be queued on a suspended stream
+	EventStreamsDeadLetterReplaySuspended = "Dead letters cannot be replayed while stream '%s' is suspended"
+	// InvalidationHookNoAddress a cache invalidation hook must be tied to at least one contract
+	InvalidationHookNoAddress = "Must specify at least one contract address for a cache invalidation hook"
+	// InvalidationHookNotFound the cache invalidation hook does not exist
+	InvalidationHookNotFound = "Cache invalidation hook with ID '%s' not found"
+	// InvalidationHookStoreFailed failed to persist a cache invalidation hook
+	InvalidationHookStoreFailed = "Failed to store cache invalidation hook: %s"
+	// RESTGatewayInvalidationHookInvalid attempt to create a cache invalidation hook with invalid parameters
+	RESTGatewayInvalidationHookInvalid = "Invalid cache invalidation hook specification: %s"
+	// RESTGatewayContractInUse a contract instance cannot be deleted while a subscription listens to its events
+	RESTGatewayContractInUse = "Contract instance %s cannot be deleted while it is used by subscription '%s'"
+	// RESTGatewayABIInUse an ABI cannot be deleted while a contract instance is registered against it
+	RESTGatewayABIInUse = "ABI %s cannot be deleted while it is used by contract instance %s"
+	// RESTGatewayLocalStoreContractDelete failed to delete a contract instance from the registry storage
+	RESTGatewayLocalStoreContractDelete = "Failed to delete contract instance %s: %s"
+	// RESTGatewayLocalStoreABIDelete failed to delete an ABI from the registry storage
+	RESTGatewayLocalStoreABIDelete = "Failed to delete ABI %s: %s"
+	// EventStreamsLogDecodePanic decoding an event from the logs crashed
+	EventStreamsLogDecodePanic = "%s: Crashed decoding event: %v"
+	// TransactionNonceStateNotFound the nonce manager is not tracking any nonces for the address
+	TransactionNonceStateNotFound = "No nonces are being managed for address %s"
+	// RESTGatewayStaticAnalysisBadSeverity the configured severity to block deployment is not known
+	RESTGatewayStaticAnalysisBadSeverity = "Invalid static analysis blockSeverity '%s'. Must be one of: high, medium, low, informational"
+	// RESTGatewayStaticAnalysisFailed the static analyzer could not be run, or its output could not be parsed
+	RESTGatewayStaticAnalysisFailed = "Static analysis failed: %s"
+	// RESTGatewayStaticAnalysisBlocked deployment is blocked by findings of the static analyzer
+	RESTGatewayStaticAnalysisBlocked = "Deployment blocked by %d static analysis finding(s) of severity '%s' or higher: %s"
+	// TransactionReceiptFeesNoGasUsed the receipt does not include the gas used, so the fees cannot be calculated
+	TransactionReceiptFeesNoGasUsed = "Receipt for transaction %s does not include the gas used"
+	// TransactionReceiptFeesNoGasPrice the node did not return the gas price of the transaction
+	TransactionReceiptFeesNoGasPrice = "Gas price of transaction %s not available from the node"
+	// TransactionStuckCancelled the transaction was not mined, and was cancelled by a transaction at the same nonce
+	TransactionStuckCancelled = "Transaction was not mined after %d gas price bumps, and was cancelled"
+	// TransactionStuckBadMaxGasPrice the maximum gas price for replacing stuck transactions is invalid
+	TransactionStuckBadMaxGasPrice = "Invalid stuck transactions maxGasPrice '%s'"
+	// TransactionChainProfileUnknown the configured chain profile is not one of the built-in profiles
+	TransactionChainProfileUnknown = "Unknown chain profile '%s'. Valid profiles are publicL1, privateIBFT and l2Rollup"
+	// TransactionChainProfileBadPolling the minimum receipt polling interval of the chain profile is above the maximum
+	TransactionChainProfileBadPolling = "The minimum receipt polling interval %dms is greater than the maximum %dms"
+	// EventStreamsKafkaNoTopic attempt to create a Kafka event stream without a topic
+	EventStreamsKafkaNoTopic = "Must specify kafka.topic for action type 'kafka'"
+	// EventStreamsKafkaNoBrokers attempt to create a Kafka event stream without brokers
+	EventStreamsKafkaNoBrokers = "Must specify kafka.brokers for action type 'kafka'"
+	// EventStreamsKafkaInvalidPartitionKey unknown partition key strategy for a Kafka event stream
+	EventStreamsKafkaInvalidPartitionKey = "Invalid kafka.partitionKey '%s'. Valid keys are: 'address', 'subscription', 'transaction', 'none' and 'arg:<name>'"
+	// EventStreamsKafkaConnect failed to create a producer to deliver events to Kafka
+	EventStreamsKafkaConnect = "Failed to connect to Kafka for event stream: %s"
+	// EventStreamsKafkaInvalidSerialization unknown serialization of the events delivered to Kafka
+	EventStreamsKafkaInvalidSerialization = "Invalid kafka.serialization '%s'. Valid serializations are: 'json', 'avro' and 'protobuf'"
+	// EventStreamsKafkaSerializationNoRegistry Avro and Protobuf serialization need the schema registry
+	EventStreamsKafkaSerializationNoRegistry = "kafka.serialization '%s' requires a schema registry configured with format '%s'"
+	// EventStreamsKafkaNoSchema the event is not described by a schema in the registry
+	EventStreamsKafkaNoSchema = "No schema is available to serialize the events of subscription '%s'. Only unaggregated events of a subscription to a contract event can be serialized"
+	// DeployPlanInvalid the body of a request to create a deploy plan could not be parsed
+	DeployPlanInvalid = "Invalid deploy plan: %s"
+	// DeployPlanNoSteps a deploy plan has no steps
+	DeployPlanNoSteps = "A deploy plan must have at least one step"
+	// DeployPlanStepNoName a step of a deploy plan has no name, or an invalid name
+	DeployPlanStepNoName = "Step %d of the deploy plan must have a name of letters, numbers, '_' and '-'"
+	// DeployPlanStepDuplicateName two steps of a deploy plan have the same name
+	DeployPlanStepDuplicateName = "Duplicate step name '%s' in the deploy plan"
+	// DeployPlanStepNoAction a step of a deploy plan neither deploys a contract nor calls a method
+	DeployPlanStepNoAction = "Step '%s' must specify either an abi to deploy, or a contract and method to call"
+	// DeployPlanStepNoFrom a step of a deploy plan has no signing address
+	DeployPlanStepNoFrom = "Step '%s' has no 'from' address, and the deploy plan has no default"
+	// DeployPlanStepBadReference a step of a deploy plan refers to a step that is not before it
+	DeployPlanStepBadReference = "Step '%s' refers to '%s', which is not the address or transactionHash of an earlier step"
+	// DeployPlanStepMethodNotFound the method called by a step of a deploy plan is not in the ABI of the contract
+	DeployPlanStepMethodNotFound = "Method '%s' is not declared in the ABI of the contract for step '%s'"
+	// DeployPlanStepDuplicateRegistration two steps of a deploy plan register the same name
+	DeployPlanStepDuplicateRegistration = "Step '%s' registers '%s', which is already registered by an earlier step"
+	// DeployPlanStepFailed a step of a deploy plan failed
+	DeployPlanStepFailed = "Step '%s' failed: %s"
+	// DeployPlanTransactionFailed the transaction of a step of a deploy plan was mined, but failed
+	DeployPlanTransactionFailed = "Transaction %s failed"
+	// DeployPlanNotFound the deploy plan does not exist
+	DeployPlanNotFound = "Deploy plan '%s' not found"
+	// DeployPlanRunning attempt to resume or delete a deploy plan that is running
+	DeployPlanRunning = "Deploy plan '%s' is running"
+	// DeployPlanCompleted attempt to resume a deploy plan that has completed
+	DeployPlanCompleted = "Deploy plan '%s' has already completed"
+	// DeployPlanSave failed to save the progress of a deploy plan
+	DeployPlanSave = "Failed to save deploy plan '%s': %s"
+	// RESTGatewayWellKnownRegistrationInvalid the body to register a contract against a built-in ABI could not be parsed
+	RESTGatewayWellKnownRegistrationInvalid = "Invalid registration. Expected a JSON object with the address of the contract: %s"
+	// RESTGatewayWellKnownABIReadOnly the built-in ABIs cannot be modified
+	RESTGatewayWellKnownABIReadOnly = "The built-in ABI '%s' cannot be modified. Set the method access of each contract instead"
+	// RESTGatewayWellKnownABINotDeployable the built-in ABIs have no bytecode
+	RESTGatewayWellKnownABINotDeployable = "The built-in ABI '%s' has no bytecode, so cannot be used to deploy a contract"
+	// JSONRPCProxyMethodNotAllowed the JSON-RPC method is not in the allow-list of the proxy
+	JSONRPCProxyMethodNotAllowed = "Method '%s' is not allowed"
+	// RESTGatewayRegistryOrphanScan failed to scan the local registry for orphaned entries
+	RESTGatewayRegistryOrphanScan = "Failed to scan the registry for orphaned entries: %s"
+	// RESTGatewayRegistryOrphanCleanupInvalid the body of a registry clean-up request could not be parsed
+	RESTGatewayRegistryOrphanCleanupInvalid = "Invalid registry clean-up request: %s"
+	// RESTGatewayRegistryOrphanKindInvalid unknown kind of orphaned registry entry
+	RESTGatewayRegistryOrphanKindInvalid = "Unknown orphan kind '%s'. Valid kinds are: 'abi', 'contract', 'source', 'instance' and 'subscription'"
+	// EventStreamsRevertedTxnsNoAddress a subscription to reverted transactions must watch a contract
+	EventStreamsRevertedTxnsNoAddress = "A contract address must be specified to subscribe to reverted transactions"
+	// EventStreamsScanBlockNotFound the node did not return a block being scanned by a subscription
+	EventStreamsScanBlockNotFound = "%s: Block %s was not found"
+	// TransactionSendNonceInFlight a user-supplied nonce is already assigned to a transaction in-flight
+	TransactionSendNonceInFlight = "Nonce %d is already in-flight for %s. Use the queue API to replace a pending transaction"
+	// TransactionSendNonceUsed a user-supplied nonce is below the next nonce of the address, and is not a gap
+	TransactionSendNonceUsed = "Nonce %d has already been used by %s. The next nonce is %d"
+	// TransactionSendNonceGap a user-supplied nonce is above the next nonce of the address
+	TransactionSendNonceGap = "Nonce %d would leave a gap for %s. The next nonce is %d"
+	// TransactionNonceFillGapsInvalid the body of a request to fill nonce gaps could not be parsed
+	TransactionNonceFillGapsInvalid = "Invalid gap-fill request: %s"
+	// TransactionNonceFillGapsMined a nonce requested to be filled has already been mined
+	TransactionNonceFillGapsMined = "Nonce %d has already been mined"
+	// ChainSnapshotNotFound the chain snapshot is unknown, or was discarded by reverting to an earlier one
+	ChainSnapshotNotFound = "Chain snapshot '%s' not found"
+	// ChainSnapshotRevertRejected the node returned false from evm_revert
+	ChainSnapshotRevertRejected = "The node did not revert to chain snapshot '%s'"
+	// GraphQLMissingQuery no query was supplied in a GraphQL request
+	GraphQLMissingQuery = "No GraphQL query was supplied"
+	// GraphQLInvalidRequest the body of a GraphQL request could not be parsed
+	GraphQLInvalidRequest = "Invalid GraphQL request: %s"
+	// GraphQLSyntaxError the GraphQL query could not be parsed
+	GraphQLSyntaxError = "Syntax error in GraphQL query at position %d: %s"
+	// GraphQLUnsupportedOperation mutations and subscriptions are not supported
+	GraphQLUnsupportedOperation = "GraphQL %s operations are not supported, only queries"
+	// GraphQLOperationNotFound the operationName does not match an operation in the query
+	GraphQLOperationNotFound = "GraphQL operation '%s' not found"
+	// GraphQLOperationNameRequired the query contains multiple operations, and no operationName was supplied
+	GraphQLOperationNameRequired = "An operationName is required, as the GraphQL query contains multiple operations"
+	// GraphQLUnknownField a field was selected that does not exist on the type
+	GraphQLUnknownField = "Cannot query field '%s' on type '%s'"
+	// GraphQLUnknownArgument an argument was supplied that the field does not accept
+	GraphQLUnknownArgument = "Unknown argument '%s' on field '%s'"
+	// GraphQLMissingArgument a required argument was not supplied
+	GraphQLMissingArgument = "Field '%s' requires argument '%s' of type '%s'"
+	// GraphQLInvalidArgument an argument value is not of the type of the argument
+	GraphQLInvalidArgument = "Argument '%s' on field '%s' must be of type '%s'"
+	// GraphQLUnknownFragment a fragment spread names a fragment that is not in the query
+	GraphQLUnknownFragment = "Unknown fragment '%s'"
+	// GraphQLUndefinedVariable a variable is used that is not declared by the operation
+	GraphQLUndefinedVariable = "Variable '$%s' is not defined"
+	// GraphQLMissingVariable a required variable was not supplied
+	GraphQLMissingVariable = "Variable '$%s' of required type '%s' was not provided"
+	// GraphQLSelectionRequired a field of an object type was selected without any subfields
+	GraphQLSelectionRequired = "Field '%s' of type '%s' must have a selection of subfields"
+	// GraphQLSelectionNotAllowed subfields were selected on a scalar field
+	GraphQLSelectionNotAllowed = "Field '%s' of type '%s' cannot have a selection of subfields"
+	// RESTGatewayBulkABINoArtifacts no compiled artifacts were found in a bulk ABI upload
+	RESTGatewayBulkABINoArtifacts = "No compiled contract artifacts were found in the uploaded files"
+	// RESTGatewayBulkABIInvalidArtifact a compiled artifact in a bulk ABI upload could not be parsed
+	RESTGatewayBulkABIInvalidArtifact = "Failed to parse compiled artifact: %s"
+	// RESTGatewayBulkABIInvalidBytecode the bytecode of a compiled artifact is not valid hex, such as when it has unlinked libraries
+	RESTGatewayBulkABIInvalidBytecode = "Invalid bytecode in compiled artifact: %s"
+	// KeystoreNotConfigured a local account was requested, but no mnemonic is configured for the keystore
+	KeystoreNotConfigured = "The local HD wallet keystore is not configured"
+	// KeystoreLoadFailed the mnemonic or passphrase file of the keystore could not be read
+	KeystoreLoadFailed = "Failed to load the keystore mnemonic: %s"
+	// KeystoreInvalidMnemonic the keystore mnemonic cannot be converted to a seed
+	KeystoreInvalidMnemonic = "Invalid keystore mnemonic: %s"
+	// KeystoreInvalidPath a derivation path is not of the form m/44'/60'/0'/0/0
+	KeystoreInvalidPath = "Invalid derivation path '%s'"
+	// KeystoreDerivationFailed a path derives an invalid key, which BIP-32 gives a tiny probability of
+	KeystoreDerivationFailed = "Failed to derive a key for '%s': %s"
+	// KeystoreAccountExists an account has already been created for the derivation path
+	KeystoreAccountExists = "An account already exists for derivation path '%s'"
+	// KeystoreAccountNotFound no account has been created with the address
+	KeystoreAccountNotFound = "No keystore account with address '%s'"
+	// KeystoreAccountMismatch an account stored by the keystore was derived from a different mnemonic
+	KeystoreAccountMismatch = "Keystore account '%s' derives %s with the configured mnemonic, not %s"
+	// KeystoreStoreFailed failed to persist a keystore account
+	KeystoreStoreFailed = "Failed to store keystore account '%s': %s"
+	// KeystoreInvalidRequest the keystore account request body could not be parsed
+	KeystoreInvalidRequest = "Invalid keystore account request: %s"
+	// RemoteSignerInvalidPattern the from pattern of a remote signer is not a valid regular expression
+	RemoteSignerInvalidPattern = "Invalid from pattern '%s' for remote signer: %s"
+	// RemoteSignerInvalidConfig a remote signer must be one of the supported services
+	RemoteSignerInvalidConfig = "Remote signer for '%s' must configure exactly one of 'vault' or 'kms'"
+	// RemoteSignerTokenLoad the Vault token file could not be read
+	RemoteSignerTokenLoad = "Failed to load the Vault token from '%s': %s"
+	// RemoteSignerMissingCredentials no AWS credentials are configured, or available to the process
+	RemoteSignerMissingCredentials = "No AWS credentials for KMS key '%s': %s"
+	// RemoteSignerPublicKeyFailed the public key of a remote key could not be retrieved
+	RemoteSignerPublicKeyFailed = "Failed to get the public key of %s key '%s': %s"
+	// RemoteSignerInvalidPublicKey the public key of a remote key is not a secp256k1 key
+	RemoteSignerInvalidPublicKey = "The public key of %s key '%s' is not a secp256k1 key: %s"
+	// RemoteSignerAddressMismatch the key configured for a from address has a different address
+	RemoteSignerAddressMismatch = "%s key '%s' has address %s, which does not match %s"
+	// RemoteSignerSignFailed the remote service failed to sign
+	RemoteSignerSignFailed = "Failed to sign with %s key '%s': %s"
+	// RemoteSignerInvalidSignature the signature returned by the remote service does not recover to the address of the key
+	RemoteSignerInvalidSignature = "Invalid signature from %s key '%s': %s"
+	// EgressInvalidProxy the configured outbound proxy is not a valid URL
+	EgressInvalidProxy = "Invalid egress proxy URL '%s': %s"
+	// EgressInvalidHostPattern a host in the egress configuration is not a host name, IP address, CIDR range or wildcard
+	EgressInvalidHostPattern = "Invalid egress host pattern '%s'"
+	// EgressCACertsLoadFailed the CA certificates for a destination could not be loaded
+	EgressCACertsLoadFailed = "Failed to load the CA certificates for '%s' from '%s': %s"
+	// EgressHostNotAllowed an outbound request was blocked by the egress allowlist
+	EgressHostNotAllowed = "Outbound requests to '%s' are not permitted by the egress allowlist"
+	// RESTGatewayInvalidConfirmations the number of confirmations requested is not a non-negative integer
+	RESTGatewayInvalidConfirmations = "Invalid '%s-confirmations' value '%s': must be a non-negative integer"
+	// TransactionConfirmationTimeout the transaction was mined, but the block did not reach the confirmations requested before the timeout
+	TransactionConfirmationTimeout = "Transaction mined in block %s did not reach %d confirmations before the timeout"
+	// TransactionReorgedOut the transaction was removed from the chain by a re-org while waiting for confirmations, and was not mined again
+	TransactionReorgedOut = "Transaction was removed from block %s by a chain re-org, and not mined again before the timeout"
+	// ContractUpgradeInvalid the body of a request to upgrade a contract could not be parsed
+	ContractUpgradeInvalid = "Invalid contract upgrade: %s"
+	// ContractUpgradeNoFrom a contract upgrade has no signing address
+	ContractUpgradeNoFrom = "A 'from' address is required to upgrade a contract"
+	// ContractUpgradeNoContract a contract upgrade does not specify the proxy to upgrade
+	ContractUpgradeNoContract = "The 'contract' to upgrade and the 'abi' of the new implementation are required"
+	// ContractUpgradeMethodNotFound the initializer called by a contract upgrade is not in the ABI of the new implementation
+	ContractUpgradeMethodNotFound = "Method '%s' is not declared in the ABI '%s' of the new implementation"
+	// ContractUpgradeRunning attempt to upgrade a contract while another upgrade of it is running
+	ContractUpgradeRunning = "An upgrade of contract '%s' is already running"
+	// ContractUpgradeNotFound the contract upgrade does not exist
+	ContractUpgradeNotFound = "Contract upgrade '%s' not found"
+	// ContractUpgradeSave failed to save the progress of a contract upgrade
+	ContractUpgradeSave = "Failed to save contract upgrade '%s': %s"
+	// ContractUpgradeStageFailed a stage of a contract upgrade failed
+	ContractUpgradeStageFailed = "Contract upgrade failed in stage '%s': %s"
+	// ContractUpgradeWrongImplementation the EIP-1967 implementation slot of the proxy does not hold the new implementation after the upgrade
+	ContractUpgradeWrongImplementation = "The implementation of proxy 0x%s is %s after the upgrade, rather than %s"
+	// ContractUpgradeNoCode there is no code at the address of the new implementation
+	ContractUpgradeNoCode = "There is no code at the new implementation address %s"
+	// ContractUpgradeCodeHashMismatch the code of the new implementation does not have the expected hash
+	ContractUpgradeCodeHashMismatch = "The code hash of the new implementation %s is %s, rather than the expected %s"
+	// ContractUpgradeRollbackFailed the proxy could not be returned to its previous implementation after a failed upgrade
+	ContractUpgradeRollbackFailed = "%s. Rolling back to implementation %s also failed: %s"
+	// ContractUpgradeNoRollback the proxy could not be returned to its previous implementation, as it was not known
+	ContractUpgradeNoRollback = "%s. The proxy could not be rolled back, as its previous implementation is not known"
+	// ProxyImplementationABINotFound the ABI of the implementation behind a proxy contract could not be resolved
+	ProxyImplementationABINotFound = "No ABI found for the implementation %s of proxy contract %s. Register the implementation, or enable ABI inference"
+	// ReactionInvalid attempt to create a reaction rule with an invalid body
+	ReactionInvalid = "Invalid reaction rule: %s"
+	// ReactionNoSubscription a reaction rule must be triggered by the events of a subscription
+	ReactionNoSubscription = "A reaction rule must specify the 'subscription' whose events trigger it"
+	// ReactionNoMethod a reaction rule must invoke a method of a contract
+	ReactionNoMethod = "A reaction rule must specify the 'contract' and 'method' to invoke"
+	// ReactionNoFrom a reaction rule has no signing address
+	ReactionNoFrom = "A reaction rule must specify the 'from' address to sign its transactions"
+	// ReactionMethodNotFound the method of a reaction rule is not in the ABI of its contract
+	ReactionMethodNotFound = "Method '%s' is not declared in the ABI of contract '%s'"
+	// ReactionMethodNotAllowed the method of a reaction rule cannot be invoked in a transaction
+	ReactionMethodNotAllowed = "Method '%s' of contract '%s' cannot be invoked by a reaction rule, as it is hidden, read-only or does not modify state"
+	// ReactionBadReference a parameter or match of a reaction rule refers to a field that events do not have
+	ReactionBadReference = "Invalid event field '%s' in reaction rule. Fields are 'data.<name>' or one of: %s"
+	// ReactionFieldNotFound an event did not have a field referred to by a reaction rule
+	ReactionFieldNotFound = "Event field '%s' not found"
+	// ReactionNotFound the reaction rule does not exist
+	ReactionNotFound = "Reaction rule '%s' not found"
+	// ReactionSave failed to store a reaction rule, or the audit record of a reaction
+	ReactionSave = "Failed to save reaction '%s': %s"
+	// ReactionRateLimited a reaction rule has triggered as many transactions as its policy allows for now
+	ReactionRateLimited = "Reaction rule exceeded its limit of %d transactions per minute"
+	// ReactionQueueFull a reaction was triggered while the queue of reactions to submit was full
+	ReactionQueueFull = "The queue of reactions waiting to be submitted is full"
+	// ReactionBadPolicy the policy of a reaction rule is not valid
+	ReactionBadPolicy = "Invalid reaction rule policy: %s"
+	// EventStreamsChainSubBadType a subscription without an event must be to blocks or pending transactions
+	EventStreamsChainSubBadType = "Invalid subscription type '%s'. Valid types are: 'blocks' and 'pendingTransactions'. Subscriptions to events are created on a contract"
+	// EventStreamsBlocksSubAddress a subscription to blocks cannot be limited to a contract
+	EventStreamsBlocksSubAddress = "A subscription to blocks cannot specify a contract address"
+	// RESTGatewayChainSubInvalid attempt to create a subscription to blocks or pending transactions with invalid parameters
+	RESTGatewayChainSubInvalid = "Invalid subscription specification: %s"
+	// RedactionInvalidField a field configured for redaction has an empty name in its path
+	RedactionInvalidField = "Invalid redaction field '%s'"
+	// TracingInvalidEndpoint the OTLP endpoint that spans are exported to is not a valid HTTP URL
+	TracingInvalidEndpoint = "Invalid tracing endpoint '%s'"
+	// TracingInvalidSampleRatio the ratio of traces to sample is not between 0 and 1
+	TracingInvalidSampleRatio = "Invalid tracing sample ratio %v. Must be between 0 and 1"
+	// TracingExportFailed a batch of spans could not be sent to the OTLP endpoint
+	TracingExportFailed = "Failed to export %d spans: %s"
+	// CheckpointGroupBadName the name of a checkpoint group is empty or contains invalid characters
+	CheckpointGroupBadName = "Invalid checkpoint group name '%s'. Names can contain letters, numbers, '.', '_' and '-'"
+	// CheckpointGroupExists a checkpoint group with the name already exists
+	CheckpointGroupExists = "Checkpoint group '%s' already exists"
+	// CheckpointGroupNoSubscriptions a checkpoint group must have at least one subscription
+	CheckpointGroupNoSubscriptions = "Must specify at least one subscription for a checkpoint group"
+	// CheckpointGroupWrongStream a subscription in a checkpoint group is on a different stream to the group
+	CheckpointGroupWrongStream = "Subscription %s is not on stream %s"
+	// CheckpointGroupSubInGroup a subscription can only be in one checkpoint group
+	CheckpointGroupSubInGroup = "Subscription %s is already in checkpoint group '%s'"
+	// CheckpointGroupDuplicateSub a subscription is listed more than once in a checkpoint group
+	CheckpointGroupDuplicateSub = "Subscription %s is listed more than once"
+	// CheckpointGroupNotFound the checkpoint group does not exist
+	CheckpointGroupNotFound = "Checkpoint group '%s' not found"
+	// CheckpointGroupStoreFailed failed to persist a checkpoint group
+	CheckpointGroupStoreFailed = "Failed to store checkpoint group: %s"
+	// RESTGatewayCheckpointGroupInvalid attempt to create a checkpoint group with invalid parameters
+	RESTGatewayCheckpointGroupInvalid = "Invalid checkpoint group specification: %s"
+	// ClientNoURL the Go client needs the URL of a gateway
+	ClientNoURL = "No URL specified for the ethconnect gateway"
+	// ClientBadURL the URL of the gateway for the Go client could not be parsed
+	ClientBadURL = "Invalid URL for the ethconnect gateway '%s'"
+	// ClientRequestSerialize the Go client could not build a request
+	ClientRequestSerialize = "Failed to build request: %s"
+	// ClientRequestError the Go client could not send a request, or read the response
+	ClientRequestError = "%s %s failed: %s"
+	// ClientRequestFailed the gateway responded to a request from the Go client with an error status
+	ClientRequestFailed = "Request failed with status %d: %s"
+	// ClientResponseParse the gateway responded to the Go client with an unexpected body
+	ClientResponseParse = "Invalid response to %s %s: %s"
+	// ClientTransactionFailed the receipt of a transaction submitted by the Go client was not a success
+	ClientTransactionFailed = "Transaction %s failed: %s"
+	// ClientReceiptWaitTimeout the context was done before the receipt for a transaction was available
+	ClientReceiptWaitTimeout = "Timed out waiting for the receipt of request %s"
+	// ClientGenBadIdentifier the package or type name for generated bindings is not a Go identifier
+	ClientGenBadIdentifier = "Invalid %s name '%s' for generated bindings"
+	// ClientGenFormat the generated bindings were not valid Go source
+	ClientGenFormat = "Failed to format generated bindings: %s"
+	// ClientGenNoABI the ABI to generate bindings for must be specified
+	ClientGenNoABI = "Specify the ID of an ABI, or the address or registered name of a contract, to generate bindings for"
+	// ClientGenNoPackage the package name for generated bindings is required
+	ClientGenNoPackage = "Specify the package name for the generated bindings"
+	// ClientGenWriteFailed the generated bindings could not be written
+	ClientGenWriteFailed = "Failed to write bindings to %s: %s"
+	// RESTGatewayIdempotencyDBOpen the store of idempotency keys could not be opened
+	RESTGatewayIdempotencyDBOpen = "Failed to open the idempotency key store: %s"
+	// RESTGatewayIdempotencyKeyInvalid the idempotency key supplied on a request is not valid
+	RESTGatewayIdempotencyKeyInvalid = "Idempotency keys must be at most %d characters, and cannot contain '/'"
+	// RESTGatewayIdempotencyKeyInFlight a request with the same idempotency key is still being processed
+	RESTGatewayIdempotencyKeyInFlight = "A request with idempotency key '%s' is already being processed"
+	// RESTGatewayIdempotencyBodyRead the body of a request with an idempotency key could not be read
+	RESTGatewayIdempotencyBodyRead = "Failed to read the body of the request: %s"
+	// RESTGatewayIdempotencyKeyReused an idempotency key was supplied with a different request to the one it was first used for
+	RESTGatewayIdempotencyKeyReused = "Idempotency key '%s' was previously used for a different request"
+	// RESTGatewayRateLimited the caller has exceeded the rate limit for the class of request
+	RESTGatewayRateLimited = "Rate limit exceeded for %s requests. Retry after %d seconds"
+	// TransactionReceiptPollerStopped the shared receipt poller stopped while a transaction was waiting for a poll
+	TransactionReceiptPollerStopped = "The receipt poller stopped before the receipt was checked"
 )
 
 type Error string
@@ -0,0 +1,108 @@
+// Copyright 2021 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package eth
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"time"
+
+	ethbinding "github.com/kaleido-io/ethbinding/pkg"
+	"github.com/kaleido-io/ethconnect/internal/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+var asOfBlockNumber = regexp.MustCompile(`^([0-9]+|0x[0-9a-fA-F]+|earliest|latest|safe|finalized|pending)$`)
+
+// IsBlockTag returns true for the named blocks a node accepts in place of a block number.
+// The safe and finalized tags are only understood by nodes following a proof-of-stake chain
+func IsBlockTag(tag string) bool {
+	switch tag {
+	case "earliest", "latest", "safe", "finalized", "pending":
+		return true
+	}
+	return false
+}
+
+// blockHeader is the subset of the block returned by eth_getBlockByNumber we need to resolve times
+type blockHeader struct {
+	Number    ethbinding.HexUint64 `json:"number"`
+	Timestamp ethbinding.HexUint64 `json:"timestamp"`
+}
+
+// ParseAsOf parses an asOf option for historical state queries against an archive node.
+// The option is either a block number (decimal or hex, or one of the block tags) which is
+// returned unchanged, or an RFC3339 timestamp that needs to be resolved to a block
+func ParseAsOf(asOf string) (blocknumber string, timestamp *time.Time, err error) {
+	if asOfBlockNumber.MatchString(asOf) {
+		return asOf, nil, nil
+	}
+	t, err := time.Parse(time.RFC3339Nano, asOf)
+	if err != nil {
+		return "", nil, errors.Errorf(errors.TransactionCallInvalidAsOf, asOf)
+	}
+	return "", &t, nil
+}
+
+// GetBlockNumberAt finds the last block mined at or before the supplied time, using
+// a binary search over the block timestamps, and returns it as a hex block number
+func GetBlockNumberAt(ctx context.Context, rpc RPCClient, t time.Time) (string, error) {
+	start := time.Now().UTC()
+
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	var latest ethbinding.HexUint64
+	if err := rpc.CallContext(ctx, &latest, "eth_blockNumber"); err != nil {
+		return "", errors.Errorf(errors.RPCCallReturnedError, "eth_blockNumber", err)
+	}
+	target := uint64(t.Unix())
+	low, high := uint64(0), uint64(latest)
+	found := false
+	for low <= high {
+		mid := low + (high-low)/2
+		block, err := getBlockHeader(ctx, rpc, mid)
+		if err != nil {
+			return "", err
+		}
+		if uint64(block.Timestamp) <= target {
+			found = true
+			low = mid + 1
+		} else if mid == 0 {
+			break
+		} else {
+			high = mid - 1
+		}
+	}
+	if !found {
+		return "", errors.Errorf(errors.TransactionCallAsOfBeforeFirstBlock, t.UTC().Format(time.RFC3339))
+	}
+	// high is now the last block with a timestamp at or before the target
+	callTime := time.Now().UTC().Sub(start)
+	log.Infof("Block at %s is %d [%.2fs]", t.UTC().Format(time.RFC3339), high, callTime.Seconds())
+	return fmt.Sprintf("0x%x", high), nil
+}
+
+func getBlockHeader(ctx context.Context, rpc RPCClient, number uint64) (*blockHeader, error) {
+	var block *blockHeader
+	if err := rpc.CallContext(ctx, &block, "eth_getBlockByNumber", fmt.Sprintf("0x%x", number), false); err != nil {
+		return nil, errors.Errorf(errors.RPCCallReturnedError, "eth_getBlockByNumber", err)
+	}
+	if block == nil {
+		return nil, errors.Errorf(errors.TransactionCallAsOfBlockNotFound, number)
+	}
+	return block, nil
+}
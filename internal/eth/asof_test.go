@@ -0,0 +1,123 @@
+// Copyright 2021 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package eth
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	ethbinding "github.com/kaleido-io/ethbinding/pkg"
+	"github.com/stretchr/testify/assert"
+)
+
+// testBlocksRPC simulates a chain with a block every 10 seconds
+type testBlocksRPC struct {
+	genesis      int64
+	latest       uint64
+	calls        int
+	mockError    error
+	missingBlock bool
+}
+
+func (r *testBlocksRPC) CallContext(ctx context.Context, result interface{}, method string, args ...interface{}) error {
+	r.calls++
+	if r.mockError != nil {
+		return r.mockError
+	}
+	switch method {
+	case "eth_blockNumber":
+		*(result.(*ethbinding.HexUint64)) = ethbinding.HexUint64(r.latest)
+	case "eth_getBlockByNumber":
+		if r.missingBlock {
+			return nil
+		}
+		number, _ := strconv.ParseUint(strings.TrimPrefix(args[0].(string), "0x"), 16, 64)
+		*(result.(**blockHeader)) = &blockHeader{
+			Number:    ethbinding.HexUint64(number),
+			Timestamp: ethbinding.HexUint64(uint64(r.genesis) + number*10),
+		}
+	default:
+		return fmt.Errorf("unexpected method %s", method)
+	}
+	return nil
+}
+
+func TestParseAsOf(t *testing.T) {
+	assert := assert.New(t)
+
+	for _, blocknumber := range []string{"12345", "0xab12", "earliest", "latest", "safe", "finalized", "pending"} {
+		b, ts, err := ParseAsOf(blocknumber)
+		assert.NoError(err)
+		assert.Equal(blocknumber, b)
+		assert.Nil(ts)
+	}
+
+	b, ts, err := ParseAsOf("2021-06-01T12:00:00Z")
+	assert.NoError(err)
+	assert.Equal("", b)
+	assert.Equal(int64(1622548800), ts.Unix())
+
+	_, _, err = ParseAsOf("yesterday")
+	assert.Regexp("Invalid asOf 'yesterday'", err)
+}
+
+func TestIsBlockTag(t *testing.T) {
+	assert := assert.New(t)
+	assert.True(IsBlockTag("finalized"))
+	assert.True(IsBlockTag("safe"))
+	assert.False(IsBlockTag("0x1"))
+	assert.False(IsBlockTag(""))
+}
+
+func TestGetBlockNumberAt(t *testing.T) {
+	assert := assert.New(t)
+
+	rpc := &testBlocksRPC{genesis: 1622548800, latest: 1000}
+	genesis := time.Unix(rpc.genesis, 0)
+
+	b, err := GetBlockNumberAt(context.Background(), rpc, genesis.Add(5005*time.Second))
+	assert.NoError(err)
+	assert.Equal("0x1f4", b) // block 500
+	assert.True(rpc.calls < 20)
+
+	b, err = GetBlockNumberAt(context.Background(), rpc, genesis)
+	assert.NoError(err)
+	assert.Equal("0x0", b)
+
+	b, err = GetBlockNumberAt(context.Background(), rpc, genesis.Add(24*time.Hour))
+	assert.NoError(err)
+	assert.Equal("0x3e8", b) // latest
+
+	_, err = GetBlockNumberAt(context.Background(), rpc, genesis.Add(-1*time.Second))
+	assert.Regexp("No block exists at or before 2021-06-01T11:59:59Z", err)
+}
+
+func TestGetBlockNumberAtBlockNumberFail(t *testing.T) {
+	assert := assert.New(t)
+	rpc := &testBlocksRPC{mockError: fmt.Errorf("pop")}
+	_, err := GetBlockNumberAt(context.Background(), rpc, time.Now())
+	assert.Regexp("eth_blockNumber returned: pop", err)
+}
+
+func TestGetBlockNumberAtGetBlockFail(t *testing.T) {
+	assert := assert.New(t)
+	rpc := &testBlocksRPC{latest: 10, missingBlock: true}
+	_, err := GetBlockNumberAt(context.Background(), rpc, time.Now())
+	assert.Regexp("Block 5 not found", err)
+}
@@ -0,0 +1,193 @@
+// Copyright 2021 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package eth
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"sync"
+	"time"
+
+	lru "github.com/hashicorp/golang-lru"
+	ethbinding "github.com/kaleido-io/ethbinding/pkg"
+	"github.com/kaleido-io/ethconnect/internal/auth"
+	"github.com/kaleido-io/ethconnect/internal/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	defaultChainHeadMaxAgeMS                = 1000
+	defaultChainHeadBlockCacheSize          = 1000
+	defaultChainHeadBlockCacheConfirmations = 12
+)
+
+// ChainHeadConf configures the chain head tracker shared by everything using an RPC connection.
+// The cache of blocks is only used if BlockCache is set, and only holds blocks that are at least
+// BlockCacheConfirmations behind the head, so blocks that can still be replaced by a re-org are
+// always read from the node
+type ChainHeadConf struct {
+	Disabled                bool `json:"disabled,omitempty"`
+	MaxAgeMS                int  `json:"maxAge,omitempty"`
+	BlockCache              bool `json:"blockCache,omitempty"`
+	BlockCacheSize          int  `json:"blockCacheSize,omitempty"`
+	BlockCacheConfirmations int  `json:"blockCacheConfirmations,omitempty"`
+}
+
+// chainHead sits in front of an RPC connection, so that event polling, historical
+// queries, checkpoint reporting and JSON-RPC clients share a single view of the chain head.
+// The block number is queried at most once every maxAge, however many subsystems ask for it,
+// and if enabled, confirmed blocks fetched by number are kept in an in-memory cache.
+// All other calls are passed straight through.
+type chainHead struct {
+	rpc           RPCClientAll
+	maxAge        time.Duration
+	mux           sync.Mutex
+	head          json.RawMessage
+	headTime      time.Time
+	blockCache    *lru.Cache
+	confirmations int64
+}
+
+func newChainHead(conf *ChainHeadConf, rpc RPCClientAll) (*chainHead, error) {
+	if conf.MaxAgeMS <= 0 {
+		conf.MaxAgeMS = defaultChainHeadMaxAgeMS
+	}
+	c := &chainHead{
+		rpc:    rpc,
+		maxAge: time.Duration(conf.MaxAgeMS) * time.Millisecond,
+	}
+	if conf.BlockCache {
+		if conf.BlockCacheSize <= 0 {
+			conf.BlockCacheSize = defaultChainHeadBlockCacheSize
+		}
+		if conf.BlockCacheConfirmations <= 0 {
+			conf.BlockCacheConfirmations = defaultChainHeadBlockCacheConfirmations
+		}
+		blockCache, err := lru.New(conf.BlockCacheSize)
+		if err != nil {
+			return nil, err
+		}
+		c.blockCache = blockCache
+		c.confirmations = int64(conf.BlockCacheConfirmations)
+	}
+	return c, nil
+}
+
+// blockCacheKey returns the cache key and block number for an eth_getBlockByNumber call for
+// a specific block number, or false for block tags such as "latest" that cannot be cached
+func blockCacheKey(args []interface{}) (string, *big.Int, bool) {
+	if len(args) != 2 {
+		return "", nil, false
+	}
+	numberStr, ok := args[0].(string)
+	if !ok {
+		return "", nil, false
+	}
+	fullTxns, ok := args[1].(bool)
+	if !ok {
+		return "", nil, false
+	}
+	number, ok := new(big.Int).SetString(numberStr, 0)
+	if !ok {
+		return "", nil, false
+	}
+	return fmt.Sprintf("0x%s/%t", number.Text(16), fullTxns), number, true
+}
+
+func (c *chainHead) blockNumber(ctx context.Context) (json.RawMessage, error) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	if c.head != nil && time.Since(c.headTime) < c.maxAge {
+		return c.head, nil
+	}
+	var head json.RawMessage
+	if err := c.rpc.CallContext(ctx, &head, "eth_blockNumber"); err != nil {
+		return nil, err
+	}
+	log.Debugf("Chain head: %s", head)
+	c.head = head
+	c.headTime = time.Now()
+	return head, nil
+}
+
+// confirmed returns true if a block is at least the configured number of confirmations behind
+// the head. Blocks are treated as unconfirmed if the head cannot be read
+func (c *chainHead) confirmed(ctx context.Context, number *big.Int) bool {
+	head, err := c.blockNumber(ctx)
+	if err != nil {
+		return false
+	}
+	var headNumber ethbinding.HexBigInt
+	if err := json.Unmarshal(head, &headNumber); err != nil {
+		return false
+	}
+	return new(big.Int).Sub(headNumber.ToInt(), number).Cmp(big.NewInt(c.confirmations)) >= 0
+}
+
+func (c *chainHead) block(ctx context.Context, key string, number *big.Int, args []interface{}) (json.RawMessage, error) {
+	if cached, ok := c.blockCache.Get(key); ok {
+		return cached.(json.RawMessage), nil
+	}
+	var block json.RawMessage
+	if err := c.rpc.CallContext(ctx, &block, "eth_getBlockByNumber", args...); err != nil {
+		return nil, err
+	}
+	// Blocks that are not yet mined, or could still be replaced by a re-org, are not cached
+	if len(block) > 0 && string(block) != "null" && c.confirmed(ctx, number) {
+		c.blockCache.Add(key, block)
+	}
+	return block, nil
+}
+
+func (c *chainHead) CallContext(ctx context.Context, result interface{}, method string, args ...interface{}) error {
+	var key string
+	var number *big.Int
+	switch method {
+	case "eth_blockNumber":
+	case "eth_getBlockByNumber":
+		var cacheable bool
+		if key, number, cacheable = blockCacheKey(args); !cacheable || c.blockCache == nil {
+			return c.rpc.CallContext(ctx, result, method, args...)
+		}
+	default:
+		return c.rpc.CallContext(ctx, result, method, args...)
+	}
+	// Cached results must be authorized for each caller, as they do not reach the RPC connection
+	if err := auth.AuthRPC(ctx, method, args...); err != nil {
+		log.Errorf("JSON/RPC %s - not authorized: %s", method, err)
+		return errors.Errorf(errors.Unauthorized)
+	}
+	var res json.RawMessage
+	var err error
+	if method == "eth_blockNumber" {
+		res, err = c.blockNumber(ctx)
+	} else {
+		res, err = c.block(ctx, key, number, args)
+	}
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(res, result)
+}
+
+func (c *chainHead) Subscribe(ctx context.Context, namespace string, channel interface{}, args ...interface{}) (RPCClientSubscription, error) {
+	return c.rpc.Subscribe(ctx, namespace, channel, args...)
+}
+
+func (c *chainHead) Close() {
+	c.rpc.Close()
+}
@@ -0,0 +1,193 @@
+// Copyright 2021 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package eth
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	ethbinding "github.com/kaleido-io/ethbinding/pkg"
+	"github.com/kaleido-io/ethconnect/internal/auth"
+	"github.com/kaleido-io/ethconnect/internal/auth/authtest"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestChainHead(t *testing.T, conf *ChainHeadConf, callErr error) (*chainHead, map[string]int) {
+	calls := make(map[string]int)
+	rpc := NewMockRPCClientForSync(callErr, func(method string, res interface{}, args ...interface{}) {
+		calls[method]++
+		switch method {
+		case "eth_blockNumber":
+			*(res.(*json.RawMessage)) = json.RawMessage(fmt.Sprintf(`"0x%x"`, 100+calls[method]))
+		case "eth_getBlockByNumber":
+			if args[0] == "latest" {
+				json.Unmarshal([]byte(`{"number":"0x64","timestamp":"0x5f5e100"}`), res)
+			} else if args[0] == "0xffff" {
+				*(res.(*json.RawMessage)) = json.RawMessage(`null`)
+			} else {
+				json.Unmarshal([]byte(fmt.Sprintf(`{"number":"%s","timestamp":"0x5f5e100"}`, args[0])), res)
+			}
+		case "eth_gasPrice":
+			*(res.(*string)) = "0x1"
+		}
+	})
+	ch, err := newChainHead(conf, rpc)
+	assert.NoError(t, err)
+	return ch, calls
+}
+
+func TestChainHeadBlockNumberShared(t *testing.T) {
+	assert := assert.New(t)
+	ch, calls := newTestChainHead(t, &ChainHeadConf{MaxAgeMS: 50}, nil)
+
+	for i := 0; i < 5; i++ {
+		var head ethbinding.HexUint64
+		err := ch.CallContext(context.Background(), &head, "eth_blockNumber")
+		assert.NoError(err)
+		assert.Equal(uint64(101), uint64(head))
+	}
+	assert.Equal(1, calls["eth_blockNumber"])
+
+	time.Sleep(60 * time.Millisecond)
+	var head ethbinding.HexBigInt
+	err := ch.CallContext(context.Background(), &head, "eth_blockNumber")
+	assert.NoError(err)
+	assert.Equal(int64(102), head.ToInt().Int64())
+	assert.Equal(2, calls["eth_blockNumber"])
+}
+
+func TestChainHeadBlockCache(t *testing.T) {
+	assert := assert.New(t)
+	ch, calls := newTestChainHead(t, &ChainHeadConf{BlockCache: true}, nil)
+	assert.Equal(defaultChainHeadMaxAgeMS, int(ch.maxAge/time.Millisecond))
+	assert.Equal(int64(defaultChainHeadBlockCacheConfirmations), ch.confirmations)
+
+	var block1 blockHeader
+	err := ch.CallContext(context.Background(), &block1, "eth_getBlockByNumber", "0x10", false)
+	assert.NoError(err)
+	assert.Equal(uint64(16), uint64(block1.Number))
+	var block2 blockHeader
+	err = ch.CallContext(context.Background(), &block2, "eth_getBlockByNumber", "16", false)
+	assert.NoError(err)
+	assert.Equal(uint64(100000000), uint64(block2.Timestamp))
+	assert.Equal(1, calls["eth_getBlockByNumber"])
+
+	// Full transactions are cached separately
+	err = ch.CallContext(context.Background(), &block1, "eth_getBlockByNumber", "0x10", true)
+	assert.NoError(err)
+	assert.Equal(2, calls["eth_getBlockByNumber"])
+
+	// Tags are never cached
+	for i := 0; i < 2; i++ {
+		err = ch.CallContext(context.Background(), &block1, "eth_getBlockByNumber", "latest", false)
+		assert.NoError(err)
+	}
+	assert.Equal(4, calls["eth_getBlockByNumber"])
+
+	// Blocks that do not exist yet are not cached
+	var missing *blockHeader
+	for i := 0; i < 2; i++ {
+		err = ch.CallContext(context.Background(), &missing, "eth_getBlockByNumber", "0xffff", false)
+		assert.NoError(err)
+		assert.Nil(missing)
+	}
+	assert.Equal(6, calls["eth_getBlockByNumber"])
+
+	// Blocks within the confirmations of the head (0x65) are not cached, as a re-org could replace them
+	for i := 0; i < 2; i++ {
+		err = ch.CallContext(context.Background(), &block1, "eth_getBlockByNumber", "0x5a", false)
+		assert.NoError(err)
+	}
+	assert.Equal(8, calls["eth_getBlockByNumber"])
+	for i := 0; i < 2; i++ {
+		err = ch.CallContext(context.Background(), &block1, "eth_getBlockByNumber", "0x59", false)
+		assert.NoError(err)
+	}
+	assert.Equal(9, calls["eth_getBlockByNumber"])
+	assert.Equal(1, calls["eth_blockNumber"])
+}
+
+func TestChainHeadBlockCacheDisabled(t *testing.T) {
+	assert := assert.New(t)
+	ch, calls := newTestChainHead(t, &ChainHeadConf{}, nil)
+	assert.Nil(ch.blockCache)
+
+	for i := 0; i < 2; i++ {
+		var block blockHeader
+		err := ch.CallContext(context.Background(), &block, "eth_getBlockByNumber", "0x10", false)
+		assert.NoError(err)
+		assert.Equal(uint64(16), uint64(block.Number))
+	}
+	assert.Equal(2, calls["eth_getBlockByNumber"])
+	assert.Equal(0, calls["eth_blockNumber"])
+}
+
+func TestChainHeadPassThrough(t *testing.T) {
+	assert := assert.New(t)
+	ch, calls := newTestChainHead(t, &ChainHeadConf{}, nil)
+
+	var gasPrice string
+	err := ch.CallContext(context.Background(), &gasPrice, "eth_gasPrice")
+	assert.NoError(err)
+	assert.Equal("0x1", gasPrice)
+	assert.Equal(1, calls["eth_gasPrice"])
+
+	ch.rpc.(*MockRPCClient).SubResult = &MockRPCSubscription{}
+	_, err = ch.Subscribe(context.Background(), "eth", make(chan interface{}), "newHeads")
+	assert.NoError(err)
+	assert.Equal("eth", ch.rpc.(*MockRPCClient).SubResult.Namespace)
+	ch.Close()
+	assert.True(ch.rpc.(*MockRPCClient).Closed)
+}
+
+func TestChainHeadErrors(t *testing.T) {
+	assert := assert.New(t)
+	ch, _ := newTestChainHead(t, &ChainHeadConf{BlockCache: true}, fmt.Errorf("pop"))
+
+	var head ethbinding.HexUint64
+	err := ch.CallContext(context.Background(), &head, "eth_blockNumber")
+	assert.EqualError(err, "pop")
+	var block blockHeader
+	err = ch.CallContext(context.Background(), &block, "eth_getBlockByNumber", "0x10", false)
+	assert.EqualError(err, "pop")
+}
+
+func TestChainHeadUnauthorized(t *testing.T) {
+	assert := assert.New(t)
+	auth.RegisterSecurityModule(&authtest.TestSecurityModule{})
+	defer auth.RegisterSecurityModule(nil)
+	ch, calls := newTestChainHead(t, &ChainHeadConf{}, nil)
+
+	var head ethbinding.HexUint64
+	err := ch.CallContext(context.Background(), &head, "eth_blockNumber")
+	assert.Regexp("Unauthorized", err)
+	assert.Equal(0, calls["eth_blockNumber"])
+}
+
+func TestRPCConnectChainHeadDisabled(t *testing.T) {
+	assert := assert.New(t)
+	rpc, err := RPCConnect(&RPCConnOpts{URL: "http://localhost:8545", ChainHead: ChainHeadConf{Disabled: true}})
+	assert.NoError(err)
+	_, ok := rpc.(*rpcWrapper)
+	assert.True(ok)
+
+	rpc, err = RPCConnect(&RPCConnOpts{URL: "http://localhost:8545"})
+	assert.NoError(err)
+	_, ok = rpc.(*chainHead)
+	assert.True(ok)
+}
@@ -21,11 +21,13 @@ import (
 	"os/exec"
 	"reflect"
 	"regexp"
+	"strconv"
 	"strings"
 
 	ethbinding "github.com/kaleido-io/ethbinding/pkg"
 	"github.com/kaleido-io/ethconnect/internal/errors"
 	"github.com/kaleido-io/ethconnect/internal/ethbind"
+	"github.com/kaleido-io/ethconnect/internal/messages"
 	"github.com/kaleido-io/ethconnect/internal/utils"
 	log "github.com/sirupsen/logrus"
 )
@@ -33,11 +35,14 @@ import (
 const (
 	// DefaultEVMVersion is the EVMVersion to be used when not specified explicitly
 	defaultEVMVersion = "byzantium"
+	// defaultOptimizerRuns is the solc default number of optimizer runs
+	defaultOptimizerRuns = 200
 )
 
 // CompiledSolidity wraps solc compilation of solidity and ABI generation
 type CompiledSolidity struct {
 	ContractName string
+	SourceFile   string
 	Compiled     []byte
 	DevDoc       string
 	ABI          ethbinding.ABIMarshaling
@@ -78,28 +83,52 @@ func GetSolc(requestedVersion string) (*ethbinding.Solidity, error) {
 	return ethbind.API.SolidityVersion(solc)
 }
 
-// GetSolcArgs get the correct solc args
-func GetSolcArgs(evmVersion string) []string {
-	if evmVersion == "" {
-		evmVersion = defaultEVMVersion
+// CompilerOptionsWithDefaults returns a copy of the supplied options, with the defaults
+// applied for any options not specified. This is the set of options passed to solc
+func CompilerOptionsWithDefaults(opts *messages.CompilerOptions) *messages.CompilerOptions {
+	withDefaults := *opts
+	if withDefaults.EVMVersion == "" {
+		withDefaults.EVMVersion = defaultEVMVersion
+	}
+	if withDefaults.OptimizerEnabled == nil {
+		optimizerEnabled := true
+		withDefaults.OptimizerEnabled = &optimizerEnabled
+	}
+	if !*withDefaults.OptimizerEnabled {
+		withDefaults.OptimizerRuns = 0
+	} else if withDefaults.OptimizerRuns <= 0 {
+		withDefaults.OptimizerRuns = defaultOptimizerRuns
 	}
-	return []string{
+	return &withDefaults
+}
+
+// GetSolcArgs get the correct solc args
+func GetSolcArgs(opts *messages.CompilerOptions) []string {
+	opts = CompilerOptionsWithDefaults(opts)
+	args := []string{
 		"--combined-json", "bin,bin-runtime,srcmap,srcmap-runtime,abi,userdoc,devdoc,metadata",
-		"--optimize",
-		"--evm-version", evmVersion,
-		"--allow-paths", ".",
 	}
+	if *opts.OptimizerEnabled {
+		args = append(args, "--optimize", "--optimize-runs", strconv.Itoa(opts.OptimizerRuns))
+	}
+	if opts.ViaIR {
+		args = append(args, "--via-ir")
+	}
+	return append(args,
+		"--evm-version", opts.EVMVersion,
+		"--allow-paths", ".",
+	)
 }
 
 // CompileContract uses solc to compile the Solidity source and
-func CompileContract(soliditySource, contractName, requestedVersion, evmVersion string) (*CompiledSolidity, error) {
+func CompileContract(soliditySource, contractName, requestedVersion string, opts *messages.CompilerOptions) (*CompiledSolidity, error) {
 	// Compile the solidity
 	s, err := GetSolc(requestedVersion)
 	if err != nil {
 		return nil, err
 	}
 
-	solcArgs := GetSolcArgs(evmVersion)
+	solcArgs := GetSolcArgs(opts)
 	cmd := exec.Command(s.Path, append(solcArgs, "--", "-")...)
 	cmd.Stdin = strings.NewReader(soliditySource)
 	var stderr, stdout bytes.Buffer
@@ -136,13 +165,16 @@ func ProcessCompiled(compiled map[string]*ethbinding.Contract, contractName stri
 
 func packContract(contractName string, contract *ethbinding.Contract) (c *CompiledSolidity, err error) {
 
+	var sourceFile string
 	firstColon := strings.LastIndex(contractName, ":")
 	if firstColon >= 0 && firstColon < (len(contractName)-1) {
+		sourceFile = contractName[:firstColon]
 		contractName = contractName[firstColon+1:]
 	}
 
 	c = &CompiledSolidity{
 		ContractName: contractName,
+		SourceFile:   sourceFile,
 		ContractInfo: &contract.Info,
 	}
 	c.Compiled, err = ethbind.API.HexDecode(contract.Code)
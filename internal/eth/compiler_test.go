@@ -19,6 +19,7 @@ import (
 	"testing"
 
 	ethbinding "github.com/kaleido-io/ethbinding/pkg"
+	"github.com/kaleido-io/ethconnect/internal/messages"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -30,6 +31,7 @@ func TestPackContractRemovePrefix(t *testing.T) {
 	compiled, err := packContract("<stdin>:stuff:watsit", contract)
 	assert.NoError(err)
 	assert.Equal("watsit", compiled.ContractName)
+	assert.Equal("<stdin>:stuff", compiled.SourceFile)
 }
 
 func TestPackContractNoPrefix(t *testing.T) {
@@ -40,6 +42,7 @@ func TestPackContractNoPrefix(t *testing.T) {
 	compiled, err := packContract("thingymobob", contract)
 	assert.NoError(err)
 	assert.Equal("thingymobob", compiled.ContractName)
+	assert.Equal("", compiled.SourceFile)
 }
 
 func TestPackContractFailBadHexCode(t *testing.T) {
@@ -153,6 +156,48 @@ func TestSolcCustomVersionInvalid(t *testing.T) {
 func TestSolcCompileInvalidVersion(t *testing.T) {
 	assert := assert.New(t)
 	defaultSolc = ""
-	_, err := CompileContract("", "", "zero.four", "")
+	_, err := CompileContract("", "", "zero.four", &messages.CompilerOptions{})
 	assert.EqualError(err, "Invalid Solidity version requested for compiler. Ensure the string starts with two dot separated numbers, such as 0.5")
 }
+
+func TestGetSolcArgsDefaults(t *testing.T) {
+	assert := assert.New(t)
+	assert.Equal([]string{
+		"--combined-json", "bin,bin-runtime,srcmap,srcmap-runtime,abi,userdoc,devdoc,metadata",
+		"--optimize", "--optimize-runs", "200",
+		"--evm-version", "byzantium",
+		"--allow-paths", ".",
+	}, GetSolcArgs(&messages.CompilerOptions{}))
+}
+
+func TestGetSolcArgsOptimizerRunsViaIR(t *testing.T) {
+	assert := assert.New(t)
+	assert.Equal([]string{
+		"--combined-json", "bin,bin-runtime,srcmap,srcmap-runtime,abi,userdoc,devdoc,metadata",
+		"--optimize", "--optimize-runs", "1000",
+		"--via-ir",
+		"--evm-version", "london",
+		"--allow-paths", ".",
+	}, GetSolcArgs(&messages.CompilerOptions{
+		EVMVersion:    "london",
+		OptimizerRuns: 1000,
+		ViaIR:         true,
+	}))
+}
+
+func TestGetSolcArgsOptimizerDisabled(t *testing.T) {
+	assert := assert.New(t)
+	optimizerEnabled := false
+	opts := &messages.CompilerOptions{
+		OptimizerEnabled: &optimizerEnabled,
+		OptimizerRuns:    1000,
+	}
+	assert.Equal([]string{
+		"--combined-json", "bin,bin-runtime,srcmap,srcmap-runtime,abi,userdoc,devdoc,metadata",
+		"--evm-version", "byzantium",
+		"--allow-paths", ".",
+	}, GetSolcArgs(opts))
+	withDefaults := CompilerOptionsWithDefaults(opts)
+	assert.Equal(0, withDefaults.OptimizerRuns)
+	assert.Equal(1000, opts.OptimizerRuns)
+}
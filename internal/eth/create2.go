@@ -0,0 +1,86 @@
+// Copyright 2021 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package eth
+
+import (
+	"encoding/hex"
+	"strings"
+
+	ethbinding "github.com/kaleido-io/ethbinding/pkg"
+	"github.com/kaleido-io/ethconnect/internal/errors"
+	"github.com/kaleido-io/ethconnect/internal/ethbind"
+	"github.com/kaleido-io/ethconnect/internal/messages"
+	"github.com/kaleido-io/ethconnect/internal/utils"
+)
+
+// DefaultCREATE2Factory is the deterministic deployment proxy, which is at the same address on
+// most chains. Like any factory used for a CREATE2 deployment, it takes the 32 byte salt followed
+// by the init code of the contract as its call data, and reverts if the contract cannot be created
+const DefaultCREATE2Factory = "0x4e59b44847b379578588920ca78fbf26c0b4956c"
+
+// parseSalt decodes a hex salt of up to 32 bytes, which is padded on the left with zeros
+func parseSalt(salt string) (b [32]byte, err error) {
+	saltBytes, err := hex.DecodeString(strings.TrimPrefix(salt, "0x"))
+	if err != nil || len(saltBytes) == 0 || len(saltBytes) > 32 {
+		return b, errors.Errorf(errors.TransactionSendCREATE2BadSalt, salt)
+	}
+	copy(b[32-len(saltBytes):], saltBytes)
+	return b, nil
+}
+
+// create2Address calculates the address of a contract created by the factory with CREATE2, which
+// is the last 20 bytes of the keccak256 hash of 0xff, the factory, the salt and the hash of the init code
+func create2Address(factory ethbinding.Address, salt [32]byte, initCode []byte) ethbinding.Address {
+	payload := append([]byte{0xff}, factory[:]...)
+	payload = append(payload, salt[:]...)
+	payload = append(payload, ethbind.Keccak256(initCode)...)
+	return ethbind.API.BytesToAddress(ethbind.Keccak256(payload)[12:])
+}
+
+// create2Deploy turns the init code of a deployment into a call to the CREATE2 factory, and
+// records the address the contract will be deployed to
+func (tx *Txn) create2Deploy(msg *messages.DeployContract, initCode []byte) (data []byte, to string, err error) {
+	salt, err := parseSalt(msg.Salt)
+	if err != nil {
+		return nil, "", err
+	}
+	to = msg.Factory
+	if to == "" {
+		to = DefaultCREATE2Factory
+	}
+	factory, err := utils.StrToAddress("factory", to)
+	if err != nil {
+		return nil, "", err
+	}
+	addr := create2Address(factory, salt, initCode)
+	tx.CREATE2Address = &addr
+	return append(salt[:], initCode...), factory.Hex(), nil
+}
+
+// PreviewCREATE2Address returns the address a CREATE2 deployment will create the contract at,
+// before it is sent. An empty string is returned if the deployment does not have a salt
+func PreviewCREATE2Address(msg *messages.DeployContract) (string, error) {
+	if msg.Salt == "" {
+		return "", nil
+	}
+	// The address does not depend on the sender, which might be resolved later
+	preview := *msg
+	preview.From = ""
+	tx, err := NewContractDeployTxn(&preview, nil)
+	if err != nil {
+		return "", err
+	}
+	return tx.CREATE2Address.Hex(), nil
+}
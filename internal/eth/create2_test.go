@@ -0,0 +1,118 @@
+// Copyright 2021 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package eth
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	ethbinding "github.com/kaleido-io/ethbinding/pkg"
+	"github.com/kaleido-io/ethconnect/internal/ethbind"
+	"github.com/kaleido-io/ethconnect/internal/messages"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestCREATE2Msg(salt, factory string) *messages.DeployContract {
+	msg := &messages.DeployContract{
+		Compiled: []byte{0x00},
+		ABI:      ethbinding.ABIMarshaling{},
+		Salt:     salt,
+		Factory:  factory,
+	}
+	msg.From = "0x6ac7ea33f8831ea9dcc53393aaa88b25a785dbf0"
+	return msg
+}
+
+func TestCREATE2Address(t *testing.T) {
+	assert := assert.New(t)
+	// Examples from EIP-1014
+	salt, err := parseSalt("0x00")
+	assert.NoError(err)
+	assert.Equal("0x4D1A2e2bB4F88F0250f26Ffff098B0b30B26BF38",
+		create2Address(ethbind.API.HexToAddress("0x0000000000000000000000000000000000000000"), salt, []byte{0x00}).Hex())
+	assert.Equal("0xB928f69Bb1D91Cd65274e3c79d8986362984fDA3",
+		create2Address(ethbind.API.HexToAddress("0xdeadbeef00000000000000000000000000000000"), salt, []byte{0x00}).Hex())
+	salt, err = parseSalt("cafebabe")
+	assert.NoError(err)
+	assert.Equal("0x60f3f640a8508fC6a86d45DF051962668E1e8AC7",
+		create2Address(ethbind.API.HexToAddress("0x00000000000000000000000000000000deadbeef"), salt, []byte{0xde, 0xad, 0xbe, 0xef}).Hex())
+}
+
+func TestParseSaltBad(t *testing.T) {
+	for _, salt := range []string{"0x", "not hex", "0x" + strings.Repeat("00", 33)} {
+		_, err := parseSalt(salt)
+		assert.Regexp(t, "Invalid salt", err)
+	}
+}
+
+func TestNewContractDeployTxnCREATE2(t *testing.T) {
+	assert := assert.New(t)
+	tx, err := NewContractDeployTxn(newTestCREATE2Msg("0x00", "0x0000000000000000000000000000000000000000"), nil)
+	assert.NoError(err)
+	assert.Equal("0x4D1A2e2bB4F88F0250f26Ffff098B0b30B26BF38", tx.CREATE2Address.Hex())
+
+	rpc := testRPCClient{}
+	tx.Send(context.Background(), &rpc)
+	jsonBytesSent, _ := json.Marshal(rpc.capturedArgs[0])
+	var jsonSent map[string]interface{}
+	json.Unmarshal(jsonBytesSent, &jsonSent)
+	// The factory is sent the salt, followed by the init code
+	assert.Equal("0x0000000000000000000000000000000000000000", strings.ToLower(jsonSent["to"].(string)))
+	assert.Equal("0x"+strings.Repeat("00", 33), jsonSent["data"])
+
+	tx, err = NewContractDeployTxn(newTestCREATE2Msg("0x00", ""), nil)
+	assert.NoError(err)
+	assert.Equal(DefaultCREATE2Factory, strings.ToLower(tx.EthTX.To().Hex()))
+
+	_, err = NewContractDeployTxn(newTestCREATE2Msg("0x00", "bad"), nil)
+	assert.Regexp("factory", err)
+	_, err = NewContractDeployTxn(newTestCREATE2Msg("bad", ""), nil)
+	assert.Regexp("Invalid salt", err)
+}
+
+func TestPreviewCREATE2Address(t *testing.T) {
+	assert := assert.New(t)
+	msg := newTestCREATE2Msg("0x00", "0x0000000000000000000000000000000000000000")
+	msg.From = "hd-testinst-testwallet-1234"
+	addr, err := PreviewCREATE2Address(msg)
+	assert.NoError(err)
+	assert.Equal("0x4D1A2e2bB4F88F0250f26Ffff098B0b30B26BF38", addr)
+	assert.Equal("hd-testinst-testwallet-1234", msg.From)
+
+	addr, err = PreviewCREATE2Address(newTestCREATE2Msg("", ""))
+	assert.NoError(err)
+	assert.Empty(addr)
+
+	_, err = PreviewCREATE2Address(newTestCREATE2Msg("0x00", "bad"))
+	assert.Regexp("factory", err)
+}
+
+func TestDryRunDeployCREATE2(t *testing.T) {
+	assert := assert.New(t)
+	tx, err := NewContractDeployTxn(newTestCREATE2Msg("0x00", "0x0000000000000000000000000000000000000000"), nil)
+	assert.NoError(err)
+	rpc := &testDryRunRPC{
+		results: map[string]string{
+			"eth_getTransactionCount": `"0x2"`,
+			"eth_call":                `"0x6080"`,
+			"eth_estimateGas":         `"0x1d4c0"`,
+		},
+	}
+	result, err := tx.DryRun(context.Background(), rpc)
+	assert.NoError(err)
+	assert.Equal("0x4D1A2e2bB4F88F0250f26Ffff098B0b30B26BF38", result.ContractAddress)
+}
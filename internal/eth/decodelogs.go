@@ -0,0 +1,180 @@
+// Copyright 2021 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package eth
+
+import (
+	"strconv"
+	"strings"
+
+	ethbinding "github.com/kaleido-io/ethbinding/pkg"
+	"github.com/kaleido-io/ethconnect/internal/errors"
+	"github.com/kaleido-io/ethconnect/internal/ethbind"
+	"github.com/kaleido-io/ethconnect/internal/messages"
+	log "github.com/sirupsen/logrus"
+)
+
+// TxnLog is a log entry emitted by a transaction, as returned in the receipt
+type TxnLog struct {
+	Address  *ethbinding.Address `json:"address"`
+	Topics   []*ethbinding.Hash  `json:"topics"`
+	Data     string              `json:"data"`
+	LogIndex *ethbinding.HexUint `json:"logIndex"`
+}
+
+// EventABIResolver looks up the events of the ABI registered for a contract address,
+// so that logs emitted by contracts other than the one invoked can be decoded
+type EventABIResolver interface {
+	ResolveEventABIs(addr *ethbinding.Address) []*ethbinding.ABIEvent
+}
+
+// EventABIs returns the event definitions from an ABI, for decoding logs
+func EventABIs(abi ethbinding.ABIMarshaling) (events []*ethbinding.ABIEvent, err error) {
+	for i := range abi {
+		if abi[i].Type == "event" {
+			event, err := ethbind.API.ABIElementMarshalingToABIEvent(&abi[i])
+			if err != nil {
+				return nil, errors.Errorf(errors.TransactionSendEventABIInvalid, abi[i].Name, err)
+			}
+			events = append(events, event)
+		}
+	}
+	return events, nil
+}
+
+// DecodeEventLog decodes the indexed fields of an event from the topics, and the
+// remaining fields from the data of the log
+func DecodeEventLog(event *ethbinding.ABIEvent, topics []*ethbinding.Hash, data []byte) (map[string]interface{}, error) {
+	result := make(map[string]interface{})
+	topicIdx := 0
+	if !event.Anonymous {
+		topicIdx++ // first index is the hash of the event description
+	}
+
+	// We need split out the indexed args that we parse out of the topic, from the data args
+	var dataArgs ethbinding.ABIArguments
+	dataArgs = make([]ethbinding.ABIArgument, 0, len(event.Inputs))
+	for idx, input := range event.Inputs {
+		var val interface{}
+		if input.Indexed {
+			if topicIdx >= len(topics) {
+				return nil, errors.Errorf(errors.EventLogDecodeInsufficientTopics, idx, ethbind.API.ABIEventSignature(event))
+			}
+			topic := topics[topicIdx]
+			topicIdx++
+			if topic != nil {
+				val = TopicToValue(topic, &input)
+			} else {
+				val = nil
+			}
+			result[input.Name] = val
+		} else {
+			dataArgs = append(dataArgs, input)
+		}
+	}
+
+	// Retrieve the data args from the RLP and merge the results
+	if len(dataArgs) > 0 {
+		dataMap := ProcessRLPBytes(dataArgs, data)
+		for k, v := range dataMap {
+			result[k] = v
+		}
+	}
+	return result, nil
+}
+
+// TopicToValue converts an indexed event field from its topic
+func TopicToValue(topic *ethbinding.Hash, input *ethbinding.ABIArgument) interface{} {
+	switch input.Type.T {
+	case ethbinding.IntTy, ethbinding.UintTy, ethbinding.BoolTy:
+		h := ethbinding.HexBigInt{}
+		h.UnmarshalText([]byte(topic.Hex()))
+		bI, _ := ethbind.API.ParseBig256(topic.Hex())
+		if input.Type.T == ethbinding.IntTy {
+			// It will be a two's complement number, so needs to be interpretted
+			bI = ethbind.API.S256(bI)
+			return bI.String()
+		} else if input.Type.T == ethbinding.BoolTy {
+			return (bI.Uint64() != 0)
+		}
+		return bI.String()
+	case ethbinding.AddressTy:
+		topicBytes := topic.Bytes()
+		addrBytes := topicBytes[len(topicBytes)-20:]
+		return ethbind.API.BytesToAddress(addrBytes)
+	default:
+		// For all other types it is just a hash of the output for indexing, so we can only
+		// logically return it as a hex string. The Solidity developer has to include
+		// the same data a second type non-indexed to get the real value.
+		return topic.String()
+	}
+}
+
+func matchEvent(events []*ethbinding.ABIEvent, topic0 *ethbinding.Hash) *ethbinding.ABIEvent {
+	for _, event := range events {
+		if !event.Anonymous && event.ID == *topic0 {
+			return event
+		}
+	}
+	return nil
+}
+
+// DecodeLogs decodes the logs in the receipt against the events of the ABI used to submit
+// the transaction, falling back to the resolver for logs emitted by other contracts.
+// Logs that cannot be matched to an event are omitted
+func (tx *Txn) DecodeLogs(resolver EventABIResolver) []*messages.DecodedEvent {
+	var decoded []*messages.DecodedEvent
+	resolved := make(map[ethbinding.Address][]*ethbinding.ABIEvent)
+	for i, l := range tx.Receipt.Logs {
+		if l == nil || len(l.Topics) == 0 || l.Topics[0] == nil {
+			continue
+		}
+		event := matchEvent(tx.Events, l.Topics[0])
+		if event == nil && resolver != nil && l.Address != nil {
+			events, cached := resolved[*l.Address]
+			if !cached {
+				events = resolver.ResolveEventABIs(l.Address)
+				resolved[*l.Address] = events
+			}
+			event = matchEvent(events, l.Topics[0])
+		}
+		if event == nil {
+			continue
+		}
+		var data []byte
+		if strings.HasPrefix(l.Data, "0x") {
+			data, _ = ethbind.API.HexDecode(l.Data)
+		}
+		values, err := DecodeEventLog(event, l.Topics, data)
+		if err != nil {
+			log.Warnf("Failed to decode log %d of %s: %s", i, tx.Hash, err)
+			continue
+		}
+		logIndex := strconv.Itoa(i)
+		if l.LogIndex != nil {
+			logIndex = strconv.FormatUint(uint64(*l.LogIndex), 10)
+		}
+		de := &messages.DecodedEvent{
+			Event:     event.RawName,
+			Signature: ethbind.API.ABIEventSignature(event),
+			LogIndex:  logIndex,
+			Data:      values,
+		}
+		if l.Address != nil {
+			de.Address = l.Address.String()
+		}
+		decoded = append(decoded, de)
+	}
+	return decoded
+}
@@ -0,0 +1,237 @@
+// Copyright 2021 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package eth
+
+import (
+	"encoding/json"
+	"testing"
+
+	ethbinding "github.com/kaleido-io/ethbinding/pkg"
+	"github.com/kaleido-io/ethconnect/internal/ethbind"
+	"github.com/kaleido-io/ethconnect/internal/messages"
+	"github.com/stretchr/testify/assert"
+)
+
+const testDecodeLogsABI = `[
+  {
+    "anonymous": false,
+    "inputs": [
+      {"indexed": true, "name": "from", "type": "address"},
+      {"indexed": false, "name": "value", "type": "uint256"}
+    ],
+    "name": "Changed",
+    "type": "event"
+  },
+  {
+    "inputs": [{"name": "value", "type": "uint256"}],
+    "name": "set",
+    "outputs": [],
+    "type": "function"
+  }
+]`
+
+const testDecodeLogsOtherABI = `[
+  {
+    "anonymous": false,
+    "inputs": [
+      {"indexed": true, "name": "id", "type": "uint256"}
+    ],
+    "name": "Other",
+    "type": "event"
+  }
+]`
+
+type testEventABIResolver struct {
+	abi     ethbinding.ABIMarshaling
+	lookups int
+}
+
+func (r *testEventABIResolver) ResolveEventABIs(addr *ethbinding.Address) []*ethbinding.ABIEvent {
+	r.lookups++
+	events, _ := EventABIs(r.abi)
+	return events
+}
+
+func testParseABI(t *testing.T, abiJSON string) ethbinding.ABIMarshaling {
+	var abi ethbinding.ABIMarshaling
+	err := json.Unmarshal([]byte(abiJSON), &abi)
+	assert.NoError(t, err)
+	return abi
+}
+
+func newTestDecodeLogsTxn(t *testing.T) *Txn {
+	var msg messages.SendTransaction
+	msg.MethodName = "set"
+	msg.To = "0x2b8c0ECc76d0759a8F50b2E14A6881367D805832"
+	msg.From = "0xAA983AD2a0e0eD8ac639277F37be42F2A5d2618c"
+	msg.Nonce = "123"
+	msg.Value = "0"
+	msg.Gas = "456"
+	msg.GasPrice = "789"
+	msg.Events = testParseABI(t, testDecodeLogsABI)
+	tx, err := NewSendTxn(&msg, nil)
+	assert.NoError(t, err)
+	return tx
+}
+
+func TestTopicToValue(t *testing.T) {
+	assert := assert.New(t)
+
+	h := ethbind.API.HexToHash("0xffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffcfc7")
+	v := TopicToValue(&h, &ethbinding.ABIArgument{Type: ethbind.API.ABITypeKnown("int64")})
+	assert.Equal("-12345", v)
+
+	h = ethbind.API.HexToHash("0x000000000000000000000000000000000000000001d2d490d572353317a01f8d")
+	v = TopicToValue(&h, &ethbinding.ABIArgument{Type: ethbind.API.ABITypeKnown("uint256")})
+	assert.Equal("564363245346346345353453453", v)
+
+	h = ethbind.API.HexToHash("0x0000000000000000000000003924d1d6423f88148a4fcc0417a33b27a61d595f")
+	v = TopicToValue(&h, &ethbinding.ABIArgument{Type: ethbind.API.ABITypeKnown("address")})
+	assert.Equal(ethbind.API.HexToAddress("0x3924d1D6423F88148A4fcc0417A33B27a61d595f"), v)
+
+	h = ethbind.API.HexToHash("0xdc47fb175244491f21a29733a67d2e07647d59d2f36f2603d339299587182f19")
+	v = TopicToValue(&h, &ethbinding.ABIArgument{Type: ethbind.API.ABITypeKnown("string")})
+	assert.Equal("0xdc47fb175244491f21a29733a67d2e07647d59d2f36f2603d339299587182f19", v)
+
+	h = ethbind.API.HexToHash("0x0000000000000000000000000000000000000000000000000000000000000000")
+	v = TopicToValue(&h, &ethbinding.ABIArgument{Type: ethbind.API.ABITypeKnown("bool")})
+	assert.Equal(false, v)
+
+	h = ethbind.API.HexToHash("0x0000000000000000000000000000000000000000000000000000000000000001")
+	v = TopicToValue(&h, &ethbinding.ABIArgument{Type: ethbind.API.ABITypeKnown("bool")})
+	assert.Equal(true, v)
+
+}
+
+func TestDecodeLogsFromCallABI(t *testing.T) {
+	assert := assert.New(t)
+
+	tx := newTestDecodeLogsTxn(t)
+	assert.Len(tx.Events, 1)
+
+	receiptJSON := `{
+		"logs": [
+			{
+				"address": "0x2b8c0ecc76d0759a8f50b2e14a6881367d805832",
+				"topics": [
+					"` + tx.Events[0].ID.Hex() + `",
+					"0x000000000000000000000000aa983ad2a0e0ed8ac639277f37be42f2a5d2618c"
+				],
+				"data": "0x000000000000000000000000000000000000000000000000000000000000002a",
+				"logIndex": "0x3"
+			},
+			{
+				"address": "0x2b8c0ecc76d0759a8f50b2e14a6881367d805832",
+				"topics": ["0x0000000000000000000000000000000000000000000000000000000000000001"],
+				"data": "0x"
+			},
+			{
+				"address": "0x2b8c0ecc76d0759a8f50b2e14a6881367d805832",
+				"topics": [],
+				"data": "0x"
+			}
+		]
+	}`
+	err := json.Unmarshal([]byte(receiptJSON), &tx.Receipt)
+	assert.NoError(err)
+
+	decoded := tx.DecodeLogs(nil)
+	assert.Len(decoded, 1)
+	assert.Equal("0x2b8c0ECc76d0759a8F50b2E14A6881367D805832", decoded[0].Address)
+	assert.Equal("Changed", decoded[0].Event)
+	assert.Equal("Changed(address,uint256)", decoded[0].Signature)
+	assert.Equal("3", decoded[0].LogIndex)
+	assert.Equal(ethbind.API.HexToAddress("0xAA983AD2a0e0eD8ac639277F37be42F2A5d2618c"), decoded[0].Data["from"])
+	assert.Equal("42", decoded[0].Data["value"])
+}
+
+func TestDecodeLogsFromResolver(t *testing.T) {
+	assert := assert.New(t)
+
+	tx := newTestDecodeLogsTxn(t)
+	resolver := &testEventABIResolver{abi: testParseABI(t, testDecodeLogsOtherABI)}
+	otherEvents, _ := EventABIs(resolver.abi)
+
+	otherLog := `{
+		"address": "0x3924d1d6423f88148a4fcc0417a33b27a61d595f",
+		"topics": [
+			"` + otherEvents[0].ID.Hex() + `",
+			"0x0000000000000000000000000000000000000000000000000000000000000007"
+		],
+		"data": "0x"
+	}`
+	err := json.Unmarshal([]byte(`{"logs": [`+otherLog+`,`+otherLog+`]}`), &tx.Receipt)
+	assert.NoError(err)
+
+	decoded := tx.DecodeLogs(resolver)
+	assert.Len(decoded, 2)
+	assert.Equal(1, resolver.lookups)
+	assert.Equal("Other", decoded[0].Event)
+	assert.Equal("0", decoded[0].LogIndex)
+	assert.Equal("1", decoded[1].LogIndex)
+	assert.Equal("7", decoded[1].Data["id"])
+}
+
+func TestDecodeLogsInsufficientTopics(t *testing.T) {
+	assert := assert.New(t)
+
+	tx := newTestDecodeLogsTxn(t)
+	err := json.Unmarshal([]byte(`{
+		"logs": [
+			{
+				"address": "0x2b8c0ecc76d0759a8f50b2e14a6881367d805832",
+				"topics": ["`+tx.Events[0].ID.Hex()+`"],
+				"data": "0x"
+			}
+		]
+	}`), &tx.Receipt)
+	assert.NoError(err)
+
+	decoded := tx.DecodeLogs(nil)
+	assert.Empty(decoded)
+
+	_, err = DecodeEventLog(tx.Events[0], tx.Receipt.Logs[0].Topics, []byte{})
+	assert.EqualError(err, "Ran out of topics for indexed fields at field 0 of Changed(address,uint256)")
+}
+
+func TestEventABIsBadEvent(t *testing.T) {
+	assert := assert.New(t)
+
+	_, err := EventABIs(ethbinding.ABIMarshaling{
+		{
+			Type: "event",
+			Name: "Bad",
+			Inputs: []ethbinding.ABIArgumentMarshaling{
+				{Name: "a", Type: "badness"},
+			},
+		},
+	})
+	assert.Regexp("Invalid event 'Bad' in ABI", err)
+}
+
+func TestNewSendTxnBadEvents(t *testing.T) {
+	assert := assert.New(t)
+
+	var msg messages.SendTransaction
+	msg.MethodName = "set"
+	msg.To = "0x2b8c0ECc76d0759a8F50b2E14A6881367D805832"
+	msg.From = "0xAA983AD2a0e0eD8ac639277F37be42F2A5d2618c"
+	msg.Gas = "456"
+	msg.Events = ethbinding.ABIMarshaling{
+		{Type: "event", Name: "Bad", Inputs: []ethbinding.ABIArgumentMarshaling{{Name: "a", Type: "badness"}}},
+	}
+	_, err := NewSendTxn(&msg, nil)
+	assert.Regexp("Invalid event 'Bad' in ABI", err)
+}
@@ -0,0 +1,112 @@
+// Copyright 2021 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package eth
+
+import (
+	"context"
+	"encoding/json"
+	"math/big"
+	"strconv"
+	"time"
+
+	ethbinding "github.com/kaleido-io/ethbinding/pkg"
+	"github.com/kaleido-io/ethconnect/internal/errors"
+	"github.com/kaleido-io/ethconnect/internal/ethbind"
+	log "github.com/sirupsen/logrus"
+)
+
+// DryRunResult is the predicted outcome of a transaction, obtained without submitting it
+type DryRunResult struct {
+	From            string `json:"from"`
+	Nonce           string `json:"nonce"`
+	ContractAddress string `json:"contractAddress,omitempty"`
+	GasEstimate     string `json:"gasEstimate,omitempty"`
+	Reverted        bool   `json:"reverted"`
+	Error           string `json:"error,omitempty"`
+}
+
+// DryRun simulates the transaction with eth_call against the latest block, and estimates the
+// gas it requires, without broadcasting it. For a contract deployment the address is predicted
+// from the next nonce of the sender, so it only holds if no other transaction is sent first,
+// unless it is a CREATE2 deployment where the address does not depend on the nonce.
+// A revert is reported in the result, rather than as an error.
+func (tx *Txn) DryRun(ctx context.Context, rpc RPCClient) (*DryRunResult, error) {
+	nonce, err := GetTransactionCount(ctx, rpc, &tx.From, "pending")
+	if err != nil {
+		return nil, err
+	}
+	result := &DryRunResult{
+		From:  tx.From.Hex(),
+		Nonce: strconv.FormatInt(nonce, 10),
+	}
+	if tx.CREATE2Address != nil {
+		result.ContractAddress = tx.CREATE2Address.Hex()
+	} else if tx.EthTX.To() == nil {
+		result.ContractAddress = contractAddress(tx.From, uint64(nonce)).Hex()
+	}
+
+	if _, err := tx.Call(ctx, rpc, "latest"); err != nil {
+		log.Warnf("Dry-run of %s reverted: %s", tx.MethodName, err)
+		result.Reverted = true
+		result.Error = err.Error()
+		return result, nil
+	}
+
+	txArgs := tx.sendTXArgs()
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	var gas ethbinding.HexUint64
+	if err := rpc.CallContext(ctx, &gas, "eth_estimateGas", txArgs); err != nil {
+		result.Reverted = true
+		result.Error = errors.Errorf(errors.TransactionSendGasEstimateFailed, err).Error()
+		return result, nil
+	}
+	result.GasEstimate = strconv.FormatUint(uint64(gas), 10)
+	return result, nil
+}
+
+// EstimateMethodGas estimates the gas a transaction calling a contract method would use,
+// without sending it
+func EstimateMethodGas(ctx context.Context, rpc RPCClient, from, addr string, value json.Number, methodABI *ethbinding.ABIMethod, msgParams []interface{}) (uint64, error) {
+	tx, err := buildTX(nil, from, addr, "", value, "", "", methodABI, msgParams)
+	if err != nil {
+		return 0, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	var gas ethbinding.HexUint64
+	if err := rpc.CallContext(ctx, &gas, "eth_estimateGas", tx.sendTXArgs()); err != nil {
+		return 0, errors.Errorf(errors.TransactionSendGasEstimateFailed, err)
+	}
+	return uint64(gas), nil
+}
+
+// contractAddress calculates the address of a contract created by the sender with the nonce,
+// which is the last 20 bytes of the keccak256 hash of the RLP encoding of [sender, nonce]
+func contractAddress(from ethbinding.Address, nonce uint64) ethbinding.Address {
+	var nonceRLP []byte
+	if nonce == 0 {
+		nonceRLP = []byte{0x80}
+	} else if nonce < 0x80 {
+		nonceRLP = []byte{byte(nonce)}
+	} else {
+		nonceBytes := new(big.Int).SetUint64(nonce).Bytes()
+		nonceRLP = append([]byte{0x80 + byte(len(nonceBytes))}, nonceBytes...)
+	}
+	payload := append([]byte{0x80 + byte(len(from))}, from[:]...)
+	payload = append(payload, nonceRLP...)
+	encoded := append([]byte{0xc0 + byte(len(payload))}, payload...)
+	return ethbind.API.BytesToAddress(ethbind.Keccak256(encoded)[12:])
+}
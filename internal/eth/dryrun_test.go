@@ -0,0 +1,145 @@
+// Copyright 2021 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package eth
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	ethbinding "github.com/kaleido-io/ethbinding/pkg"
+	"github.com/kaleido-io/ethconnect/internal/ethbind"
+	"github.com/kaleido-io/ethconnect/internal/messages"
+	"github.com/stretchr/testify/assert"
+)
+
+type testDryRunRPC struct {
+	results map[string]string
+	errors  map[string]error
+	methods []string
+}
+
+func (r *testDryRunRPC) CallContext(ctx context.Context, result interface{}, method string, args ...interface{}) error {
+	r.methods = append(r.methods, method)
+	if err := r.errors[method]; err != nil {
+		return err
+	}
+	return json.Unmarshal([]byte(r.results[method]), result)
+}
+
+func newTestDryRunDeployTxn(t *testing.T) *Txn {
+	msg := &messages.DeployContract{
+		Compiled: []byte{0x60, 0x80, 0x60, 0x40},
+		ABI:      ethbinding.ABIMarshaling{},
+	}
+	msg.From = "0x6ac7ea33f8831ea9dcc53393aaa88b25a785dbf0"
+	tx, err := NewContractDeployTxn(msg, nil)
+	assert.NoError(t, err)
+	return tx
+}
+
+func TestContractAddress(t *testing.T) {
+	assert := assert.New(t)
+	from := ethbind.API.HexToAddress("0x6ac7ea33f8831ea9dcc53393aaa88b25a785dbf0")
+	assert.Equal("cd234a471b72ba2f1ccf0a70fcaba648a5eecd8d", fmt.Sprintf("%x", contractAddress(from, 0)))
+	assert.Equal("343c43a37d37dff08ae8c4a11544c718abb4fcf8", fmt.Sprintf("%x", contractAddress(from, 1)))
+	assert.Equal("f778b86fa74e846c4f0a1fbd1335fe81c00a0c91", fmt.Sprintf("%x", contractAddress(from, 2)))
+	assert.Equal("fffd933a0bc612844eaf0c6fe3e5b8e9b6c1d19c", fmt.Sprintf("%x", contractAddress(from, 3)))
+	assert.NotEqual(contractAddress(from, 0x7f), contractAddress(from, 0x80))
+}
+
+func TestDryRunDeploySuccess(t *testing.T) {
+	assert := assert.New(t)
+	tx := newTestDryRunDeployTxn(t)
+	rpc := &testDryRunRPC{
+		results: map[string]string{
+			"eth_getTransactionCount": `"0x2"`,
+			"eth_call":                `"0x6080"`,
+			"eth_estimateGas":         `"0x1d4c0"`,
+		},
+	}
+	result, err := tx.DryRun(context.Background(), rpc)
+	assert.NoError(err)
+	assert.Equal([]string{"eth_getTransactionCount", "eth_call", "eth_estimateGas"}, rpc.methods)
+	assert.False(result.Reverted)
+	assert.Equal("2", result.Nonce)
+	assert.Equal("0xf778B86FA74E846c4f0a1fBd1335FE81c00a0C91", result.ContractAddress)
+	assert.Equal("120000", result.GasEstimate)
+	assert.Empty(result.Error)
+}
+
+func TestDryRunDeployReverted(t *testing.T) {
+	assert := assert.New(t)
+	tx := newTestDryRunDeployTxn(t)
+	rpc := &testDryRunRPC{
+		results: map[string]string{
+			"eth_getTransactionCount": `"0x0"`,
+			"eth_call":                `"0x08c379a00000000000000000000000000000000000000000000000000000000000000020000000000000000000000000000000000000000000000000000000000000000b6e6f7420616c6c6f776564000000000000000000000000000000000000000000"`,
+		},
+	}
+	result, err := tx.DryRun(context.Background(), rpc)
+	assert.NoError(err)
+	assert.True(result.Reverted)
+	assert.Equal("not allowed", result.Error)
+	assert.Equal("0xcd234A471b72ba2F1Ccf0A70FCABA648a5eeCD8d", result.ContractAddress)
+	assert.Empty(result.GasEstimate)
+}
+
+func TestDryRunEstimateFailed(t *testing.T) {
+	assert := assert.New(t)
+	tx := newTestDryRunDeployTxn(t)
+	rpc := &testDryRunRPC{
+		results: map[string]string{
+			"eth_getTransactionCount": `"0x0"`,
+			"eth_call":                `"0x"`,
+		},
+		errors: map[string]error{
+			"eth_estimateGas": fmt.Errorf("out of gas"),
+		},
+	}
+	result, err := tx.DryRun(context.Background(), rpc)
+	assert.NoError(err)
+	assert.True(result.Reverted)
+	assert.Regexp("out of gas", result.Error)
+}
+
+func TestDryRunNonceFailed(t *testing.T) {
+	assert := assert.New(t)
+	tx := newTestDryRunDeployTxn(t)
+	rpc := &testDryRunRPC{
+		errors: map[string]error{
+			"eth_getTransactionCount": fmt.Errorf("pop"),
+		},
+	}
+	_, err := tx.DryRun(context.Background(), rpc)
+	assert.EqualError(err, "eth_getTransactionCount returned: pop")
+}
+
+func TestDryRunSendTxn(t *testing.T) {
+	assert := assert.New(t)
+	tx := newTestGasTxn(t, nil)
+	rpc := &testDryRunRPC{
+		results: map[string]string{
+			"eth_getTransactionCount": `"0x5"`,
+			"eth_call":                `"0x"`,
+			"eth_estimateGas":         `"0x5208"`,
+		},
+	}
+	result, err := tx.DryRun(context.Background(), rpc)
+	assert.NoError(err)
+	assert.Empty(result.ContractAddress)
+	assert.Equal("21000", result.GasEstimate)
+}
@@ -0,0 +1,204 @@
+// Copyright 2021 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package eth
+
+import (
+	"context"
+	"encoding/json"
+	"math/big"
+	"sync"
+	"time"
+
+	ethbinding "github.com/kaleido-io/ethbinding/pkg"
+	"github.com/kaleido-io/ethconnect/internal/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	defaultFeeHistoryBlocks      = 10
+	defaultFeeRewardPercentile   = 50
+	defaultFeeBaseFeeMultiplier  = 2
+	londonSupportRecheckInterval = 1 * time.Minute
+)
+
+// FeeEstimationConf configures EIP-1559 (type 2) dynamic fee transactions
+type FeeEstimationConf struct {
+	// DynamicFees sends transactions without a gasPrice as dynamic fee transactions,
+	// once the chain supports London. Otherwise only transactions with a maxFeePerGas
+	// or maxPriorityFeePerGas are dynamic fee transactions
+	DynamicFees bool `json:"dynamicFees"`
+	// HistoryBlocks is the number of recent blocks passed to eth_feeHistory
+	HistoryBlocks int `json:"historyBlocks"`
+	// RewardPercentile of the priority fees paid in each block, averaged for the estimate
+	RewardPercentile float64 `json:"rewardPercentile"`
+	// BaseFeeMultiplier of the next base fee is added to the priority fee for the maxFeePerGas,
+	// so the transaction remains valid as the base fee rises over several blocks
+	BaseFeeMultiplier float64 `json:"baseFeeMultiplier"`
+	// MinPriorityFeePerGas and MaxPriorityFeePerGas bound the estimated priority fee (tip),
+	// such as to pay a minimum tip on a public chain, or to cap the tip on a rollup
+	MinPriorityFeePerGas json.Number `json:"minPriorityFeePerGas,omitempty"`
+	MaxPriorityFeePerGas json.Number `json:"maxPriorityFeePerGas,omitempty"`
+}
+
+// FeeEstimator fills in the fees of dynamic fee transactions from eth_feeHistory,
+// and records whether the chain supports London
+type FeeEstimator struct {
+	conf        *FeeEstimationConf
+	minTip      *big.Int
+	maxTip      *big.Int
+	lock        sync.Mutex
+	london      bool
+	londonCheck time.Time
+}
+
+// NewFeeEstimator constructor
+func NewFeeEstimator(conf *FeeEstimationConf) *FeeEstimator {
+	if conf.HistoryBlocks <= 0 {
+		conf.HistoryBlocks = defaultFeeHistoryBlocks
+	}
+	if conf.RewardPercentile <= 0 {
+		conf.RewardPercentile = defaultFeeRewardPercentile
+	}
+	if conf.BaseFeeMultiplier <= 0 {
+		conf.BaseFeeMultiplier = defaultFeeBaseFeeMultiplier
+	}
+	f := &FeeEstimator{conf: conf}
+	var err error
+	if f.minTip, err = parseFee("minPriorityFeePerGas", conf.MinPriorityFeePerGas); err != nil {
+		log.Errorf("Ignoring the configured minimum priority fee: %s", err)
+	}
+	if f.maxTip, err = parseFee("maxPriorityFeePerGas", conf.MaxPriorityFeePerGas); err != nil {
+		log.Errorf("Ignoring the configured maximum priority fee: %s", err)
+	}
+	return f
+}
+
+type feeHistory struct {
+	BaseFeePerGas []*ethbinding.HexBigInt   `json:"baseFeePerGas"`
+	Reward        [][]*ethbinding.HexBigInt `json:"reward"`
+}
+
+// londonSupported checks for a base fee in the latest block. Once found it is not checked
+// again, and a chain without one is checked again periodically in case it is upgraded
+func (f *FeeEstimator) londonSupported(ctx context.Context, rpc RPCClient) (bool, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.london || time.Since(f.londonCheck) < londonSupportRecheckInterval {
+		return f.london, nil
+	}
+	var block struct {
+		BaseFeePerGas *ethbinding.HexBigInt `json:"baseFeePerGas"`
+	}
+	if err := rpc.CallContext(ctx, &block, "eth_getBlockByNumber", "latest", false); err != nil {
+		return false, errors.Errorf(errors.TransactionSendLondonCheckFailed, err)
+	}
+	f.london = block.BaseFeePerGas != nil
+	f.londonCheck = time.Now()
+	log.Infof("Chain supports London (EIP-1559): %t", f.london)
+	return f.london, nil
+}
+
+// estimate uses eth_feeHistory to calculate the priority fee from the rewards paid in recent
+// blocks, and the max fee from the base fee of the next block
+func (f *FeeEstimator) estimate(ctx context.Context, rpc RPCClient) (maxFee, maxPriorityFee *big.Int, err error) {
+	var history feeHistory
+	blocks := ethbinding.HexUint64(f.conf.HistoryBlocks)
+	if err := rpc.CallContext(ctx, &history, "eth_feeHistory", blocks, "latest", []float64{f.conf.RewardPercentile}); err != nil {
+		return nil, nil, errors.Errorf(errors.TransactionSendFeeHistoryFailed, err)
+	}
+	if len(history.BaseFeePerGas) == 0 || history.BaseFeePerGas[len(history.BaseFeePerGas)-1] == nil {
+		return nil, nil, errors.Errorf(errors.TransactionSendFeeHistoryFailed, "no base fee returned")
+	}
+	baseFee := history.BaseFeePerGas[len(history.BaseFeePerGas)-1].ToInt()
+
+	maxPriorityFee = big.NewInt(0)
+	count := int64(0)
+	for _, rewards := range history.Reward {
+		if len(rewards) > 0 && rewards[0] != nil {
+			maxPriorityFee.Add(maxPriorityFee, rewards[0].ToInt())
+			count++
+		}
+	}
+	if count > 0 {
+		maxPriorityFee.Div(maxPriorityFee, big.NewInt(count))
+	}
+	if f.minTip != nil && maxPriorityFee.Cmp(f.minTip) < 0 {
+		maxPriorityFee.Set(f.minTip)
+	}
+	if f.maxTip != nil && maxPriorityFee.Cmp(f.maxTip) > 0 {
+		maxPriorityFee.Set(f.maxTip)
+	}
+
+	maxFee, _ = new(big.Float).Mul(new(big.Float).SetInt(baseFee), big.NewFloat(f.conf.BaseFeeMultiplier)).Int(nil)
+	maxFee.Add(maxFee, maxPriorityFee)
+	return maxFee, maxPriorityFee, nil
+}
+
+// applyDynamicFees decides whether the transaction is a dynamic fee transaction, and
+// estimates any fees that were not supplied
+func (f *FeeEstimator) applyDynamicFees(ctx context.Context, rpc RPCClient, tx *Txn) error {
+	explicit := tx.MaxFeePerGas != nil || tx.MaxPriorityFeePerGas != nil
+	if !explicit {
+		if f == nil || !f.conf.DynamicFees || tx.gasPriceSupplied || tx.GasPriceStrategy != "" || tx.Signer != nil {
+			return nil
+		}
+		if london, err := f.londonSupported(ctx, rpc); err != nil || !london {
+			return err
+		}
+	}
+	if tx.Signer != nil {
+		// The transaction types of the bound go-ethereum release cannot be signed as type 2
+		return errors.Errorf(errors.TransactionSendDynamicFeeWithSigner, tx.Signer.Type())
+	}
+	if tx.MaxFeePerGas != nil && tx.MaxPriorityFeePerGas != nil {
+		return nil
+	}
+
+	estimator := f
+	if estimator == nil {
+		estimator = NewFeeEstimator(&FeeEstimationConf{})
+	}
+	maxFee, maxPriorityFee, err := estimator.estimate(ctx, rpc)
+	if err != nil {
+		return err
+	}
+	if tx.MaxPriorityFeePerGas == nil {
+		tx.MaxPriorityFeePerGas = maxPriorityFee
+		// A priority fee above the max fee would be rejected by the node
+		if tx.MaxFeePerGas != nil && tx.MaxPriorityFeePerGas.Cmp(tx.MaxFeePerGas) > 0 {
+			tx.MaxPriorityFeePerGas = new(big.Int).Set(tx.MaxFeePerGas)
+		}
+	}
+	if tx.MaxFeePerGas == nil {
+		tx.MaxFeePerGas = maxFee
+		if tx.MaxFeePerGas.Cmp(tx.MaxPriorityFeePerGas) < 0 {
+			tx.MaxFeePerGas = new(big.Int).Set(tx.MaxPriorityFeePerGas)
+		}
+	}
+	log.Debugf("Dynamic fees maxFeePerGas=%s maxPriorityFeePerGas=%s", tx.MaxFeePerGas, tx.MaxPriorityFeePerGas)
+	return nil
+}
+
+// parseFee parses an optional fee supplied as a decimal string
+func parseFee(name string, fee json.Number) (*big.Int, error) {
+	if fee.String() == "" {
+		return nil, nil
+	}
+	i, ok := new(big.Int).SetString(fee.String(), 10)
+	if !ok || i.Sign() < 0 {
+		return nil, errors.Errorf(errors.TransactionSendBadFee, name, fee)
+	}
+	return i, nil
+}
@@ -0,0 +1,261 @@
+// Copyright 2021 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package eth
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"testing"
+	"time"
+
+	ethbinding "github.com/kaleido-io/ethbinding/pkg"
+	"github.com/kaleido-io/ethconnect/internal/messages"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestFeeRPC(callErr error, block string, calls map[string]int) *MockRPCClient {
+	return NewMockRPCClientForSync(callErr, func(method string, res interface{}, args ...interface{}) {
+		calls[method]++
+		switch method {
+		case "eth_getBlockByNumber":
+			json.Unmarshal([]byte(block), res)
+		case "eth_feeHistory":
+			json.Unmarshal([]byte(`{
+				"oldestBlock": "0x63",
+				"baseFeePerGas": ["0x64", "0x6e", "0x78"],
+				"reward": [["0xa"], ["0x1e"]]
+			}`), res)
+		}
+	})
+}
+
+func TestNewFeeEstimatorDefaults(t *testing.T) {
+	assert := assert.New(t)
+	conf := &FeeEstimationConf{}
+	NewFeeEstimator(conf)
+	assert.Equal(10, conf.HistoryBlocks)
+	assert.Equal(float64(50), conf.RewardPercentile)
+	assert.Equal(float64(2), conf.BaseFeeMultiplier)
+}
+
+func TestFeeEstimate(t *testing.T) {
+	assert := assert.New(t)
+	calls := make(map[string]int)
+	rpc := newTestFeeRPC(nil, `{}`, calls)
+	f := NewFeeEstimator(&FeeEstimationConf{HistoryBlocks: 5, RewardPercentile: 25})
+
+	maxFee, maxPriorityFee, err := f.estimate(context.Background(), rpc)
+	assert.NoError(err)
+	assert.Equal("eth_feeHistory", rpc.MethodCapture)
+	assert.Equal([]interface{}{ethbinding.HexUint64(5), "latest", []float64{25}}, rpc.ArgsCapture)
+	// Average reward of 20, plus twice the next base fee of 120
+	assert.Equal(int64(20), maxPriorityFee.Int64())
+	assert.Equal(int64(260), maxFee.Int64())
+}
+
+func TestFeeEstimatePriorityFeeBounds(t *testing.T) {
+	assert := assert.New(t)
+	calls := make(map[string]int)
+	rpc := newTestFeeRPC(nil, `{}`, calls)
+
+	f := NewFeeEstimator(&FeeEstimationConf{MinPriorityFeePerGas: "30"})
+	maxFee, maxPriorityFee, err := f.estimate(context.Background(), rpc)
+	assert.NoError(err)
+	assert.Equal(int64(30), maxPriorityFee.Int64())
+	assert.Equal(int64(270), maxFee.Int64())
+
+	f = NewFeeEstimator(&FeeEstimationConf{MaxPriorityFeePerGas: "5"})
+	maxFee, maxPriorityFee, err = f.estimate(context.Background(), rpc)
+	assert.NoError(err)
+	assert.Equal(int64(5), maxPriorityFee.Int64())
+	assert.Equal(int64(245), maxFee.Int64())
+
+	// Invalid bounds are ignored
+	f = NewFeeEstimator(&FeeEstimationConf{MinPriorityFeePerGas: "lots", MaxPriorityFeePerGas: "-1"})
+	assert.Nil(f.minTip)
+	assert.Nil(f.maxTip)
+}
+
+func TestFeeEstimateNoRewards(t *testing.T) {
+	assert := assert.New(t)
+	rpc := NewMockRPCClientForSync(nil, func(method string, res interface{}, args ...interface{}) {
+		json.Unmarshal([]byte(`{"baseFeePerGas": ["0x64"], "reward": [[]]}`), res)
+	})
+	f := NewFeeEstimator(&FeeEstimationConf{BaseFeeMultiplier: 1.5})
+
+	maxFee, maxPriorityFee, err := f.estimate(context.Background(), rpc)
+	assert.NoError(err)
+	assert.Equal(int64(0), maxPriorityFee.Int64())
+	assert.Equal(int64(150), maxFee.Int64())
+}
+
+func TestFeeEstimateFail(t *testing.T) {
+	assert := assert.New(t)
+	f := NewFeeEstimator(&FeeEstimationConf{})
+
+	_, _, err := f.estimate(context.Background(), NewMockRPCClientForSync(fmt.Errorf("pop"), nil))
+	assert.EqualError(err, "Failed to estimate fees with eth_feeHistory: pop")
+
+	_, _, err = f.estimate(context.Background(), NewMockRPCClientForSync(nil, nil))
+	assert.EqualError(err, "Failed to estimate fees with eth_feeHistory: no base fee returned")
+}
+
+func TestLondonSupportedCached(t *testing.T) {
+	assert := assert.New(t)
+	calls := make(map[string]int)
+	f := NewFeeEstimator(&FeeEstimationConf{})
+
+	london, err := f.londonSupported(context.Background(), newTestFeeRPC(nil, `{"baseFeePerGas":"0x64"}`, calls))
+	assert.NoError(err)
+	assert.True(london)
+	london, err = f.londonSupported(context.Background(), newTestFeeRPC(nil, `{}`, calls))
+	assert.NoError(err)
+	assert.True(london)
+	assert.Equal(1, calls["eth_getBlockByNumber"])
+}
+
+func TestLondonNotSupportedRechecked(t *testing.T) {
+	assert := assert.New(t)
+	calls := make(map[string]int)
+	f := NewFeeEstimator(&FeeEstimationConf{})
+
+	london, err := f.londonSupported(context.Background(), newTestFeeRPC(nil, `{}`, calls))
+	assert.NoError(err)
+	assert.False(london)
+	london, _ = f.londonSupported(context.Background(), newTestFeeRPC(nil, `{"baseFeePerGas":"0x64"}`, calls))
+	assert.False(london)
+	assert.Equal(1, calls["eth_getBlockByNumber"])
+
+	f.londonCheck = time.Now().Add(-londonSupportRecheckInterval)
+	london, _ = f.londonSupported(context.Background(), newTestFeeRPC(nil, `{"baseFeePerGas":"0x64"}`, calls))
+	assert.True(london)
+	assert.Equal(2, calls["eth_getBlockByNumber"])
+}
+
+func TestLondonSupportedFail(t *testing.T) {
+	assert := assert.New(t)
+	f := NewFeeEstimator(&FeeEstimationConf{})
+
+	_, err := f.londonSupported(context.Background(), NewMockRPCClientForSync(fmt.Errorf("pop"), nil))
+	assert.EqualError(err, "Failed to check the chain for EIP-1559 support: pop")
+}
+
+func TestApplyDynamicFeesExplicit(t *testing.T) {
+	assert := assert.New(t)
+	calls := make(map[string]int)
+	rpc := newTestFeeRPC(nil, `{}`, calls)
+
+	var f *FeeEstimator
+	tx := &Txn{MaxFeePerGas: big.NewInt(1000), MaxPriorityFeePerGas: big.NewInt(2)}
+	err := f.applyDynamicFees(context.Background(), rpc, tx)
+	assert.NoError(err)
+	assert.Equal(int64(1000), tx.MaxFeePerGas.Int64())
+	assert.Equal(int64(2), tx.MaxPriorityFeePerGas.Int64())
+	assert.Empty(calls)
+
+	tx = &Txn{MaxFeePerGas: big.NewInt(10)}
+	err = f.applyDynamicFees(context.Background(), rpc, tx)
+	assert.NoError(err)
+	assert.Equal(int64(10), tx.MaxFeePerGas.Int64())
+	assert.Equal(int64(10), tx.MaxPriorityFeePerGas.Int64())
+
+	tx = &Txn{MaxPriorityFeePerGas: big.NewInt(500)}
+	err = f.applyDynamicFees(context.Background(), rpc, tx)
+	assert.NoError(err)
+	assert.Equal(int64(500), tx.MaxFeePerGas.Int64())
+	assert.Equal(int64(500), tx.MaxPriorityFeePerGas.Int64())
+	assert.Equal(2, calls["eth_feeHistory"])
+	assert.Equal(0, calls["eth_getBlockByNumber"])
+}
+
+func TestApplyDynamicFeesAuto(t *testing.T) {
+	assert := assert.New(t)
+	calls := make(map[string]int)
+	rpc := newTestFeeRPC(nil, `{"baseFeePerGas":"0x64"}`, calls)
+	f := NewFeeEstimator(&FeeEstimationConf{DynamicFees: true})
+
+	tx := &Txn{}
+	err := f.applyDynamicFees(context.Background(), rpc, tx)
+	assert.NoError(err)
+	assert.Equal(int64(260), tx.MaxFeePerGas.Int64())
+	assert.Equal(int64(20), tx.MaxPriorityFeePerGas.Int64())
+
+	tx = &Txn{gasPriceSupplied: true}
+	err = f.applyDynamicFees(context.Background(), rpc, tx)
+	assert.NoError(err)
+	assert.Nil(tx.MaxFeePerGas)
+
+	tx = &Txn{Signer: &mockTXSigner{}}
+	err = f.applyDynamicFees(context.Background(), rpc, tx)
+	assert.NoError(err)
+	assert.Nil(tx.MaxFeePerGas)
+	assert.Equal(1, calls["eth_feeHistory"])
+}
+
+func TestApplyDynamicFeesAutoNotLondon(t *testing.T) {
+	assert := assert.New(t)
+	calls := make(map[string]int)
+	f := NewFeeEstimator(&FeeEstimationConf{DynamicFees: true})
+
+	tx := &Txn{}
+	err := f.applyDynamicFees(context.Background(), newTestFeeRPC(nil, `{}`, calls), tx)
+	assert.NoError(err)
+	assert.Nil(tx.MaxFeePerGas)
+	assert.Equal(0, calls["eth_feeHistory"])
+
+	f = NewFeeEstimator(&FeeEstimationConf{DynamicFees: true})
+	err = f.applyDynamicFees(context.Background(), NewMockRPCClientForSync(fmt.Errorf("pop"), nil), tx)
+	assert.EqualError(err, "Failed to check the chain for EIP-1559 support: pop")
+}
+
+func TestApplyDynamicFeesSignerFail(t *testing.T) {
+	assert := assert.New(t)
+	f := NewFeeEstimator(&FeeEstimationConf{})
+
+	tx := &Txn{Signer: &mockTXSigner{}, MaxFeePerGas: big.NewInt(10)}
+	err := f.applyDynamicFees(context.Background(), NewMockRPCClientForSync(nil, nil), tx)
+	assert.EqualError(err, "EIP-1559 dynamic fee transactions are not supported with the 'mock signer' signer")
+}
+
+func TestApplyDynamicFeesEstimateFail(t *testing.T) {
+	assert := assert.New(t)
+	f := NewFeeEstimator(&FeeEstimationConf{})
+
+	tx := &Txn{MaxFeePerGas: big.NewInt(10)}
+	err := f.applyDynamicFees(context.Background(), NewMockRPCClientForSync(fmt.Errorf("pop"), nil), tx)
+	assert.EqualError(err, "Failed to estimate fees with eth_feeHistory: pop")
+}
+
+func TestSetDynamicFees(t *testing.T) {
+	assert := assert.New(t)
+
+	tx := &Txn{}
+	err := tx.setDynamicFees(&messages.TransactionCommon{MaxFeePerGas: "200", MaxPriorityFeePerGas: "2"})
+	assert.NoError(err)
+	assert.Equal(int64(200), tx.MaxFeePerGas.Int64())
+	assert.Equal(int64(2), tx.MaxPriorityFeePerGas.Int64())
+
+	err = tx.setDynamicFees(&messages.TransactionCommon{MaxFeePerGas: "-1"})
+	assert.EqualError(err, "Invalid 'maxFeePerGas' value '-1'. Must be a non-negative integer")
+
+	err = tx.setDynamicFees(&messages.TransactionCommon{MaxPriorityFeePerGas: "0x10"})
+	assert.EqualError(err, "Invalid 'maxPriorityFeePerGas' value '0x10'. Must be a non-negative integer")
+
+	tx = &Txn{gasPriceSupplied: true}
+	err = tx.setDynamicFees(&messages.TransactionCommon{MaxPriorityFeePerGas: "2"})
+	assert.EqualError(err, "Cannot specify both 'gasPrice' and 'maxFeePerGas'/'maxPriorityFeePerGas'")
+}
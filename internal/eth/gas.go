@@ -0,0 +1,101 @@
+// Copyright 2021 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package eth
+
+import (
+	"strings"
+
+	ethbinding "github.com/kaleido-io/ethbinding/pkg"
+)
+
+const (
+	defaultGasPaddingPercent = 20
+	// constructorMethodName is the method name matched by gas rules for contract deployments
+	constructorMethodName = "constructor"
+)
+
+// GasEstimationConf configures how the gas limit is calculated, for transactions
+// submitted without an explicit gas value
+type GasEstimationConf struct {
+	// PaddingPercent is added to the estimate, to allow for variation as the chain changes
+	// between estimation and submission. Zero means the default of 20%, negative means no padding
+	PaddingPercent int `json:"paddingPercent"`
+	// FallbackGasLimit is used in place of the estimate when estimation fails
+	FallbackGasLimit uint64        `json:"fallbackGasLimit"`
+	Rules            []GasRuleConf `json:"rules"`
+}
+
+// GasRuleConf sets a minimum gas floor and/or a fallback limit for a contract address
+// and/or method name. Empty Contract/Method values match any contract/method, and
+// "constructor" matches contract deployments. The most specific matching rule applies
+type GasRuleConf struct {
+	Contract         string `json:"contract"`
+	Method           string `json:"method"`
+	MinGas           uint64 `json:"minGas"`
+	FallbackGasLimit uint64 `json:"fallbackGasLimit"`
+}
+
+func (c *GasEstimationConf) ruleFor(to *ethbinding.Address, method string) *GasRuleConf {
+	if c == nil {
+		return nil
+	}
+	var best *GasRuleConf
+	bestScore := -1
+	for i := range c.Rules {
+		rule := &c.Rules[i]
+		score := 0
+		if rule.Contract != "" {
+			if to == nil || !strings.EqualFold(strings.TrimPrefix(rule.Contract, "0x"), strings.TrimPrefix(to.Hex(), "0x")) {
+				continue
+			}
+			score += 2
+		}
+		if rule.Method != "" {
+			if rule.Method != method {
+				continue
+			}
+			score++
+		}
+		if score > bestScore {
+			best = rule
+			bestScore = score
+		}
+	}
+	return best
+}
+
+func (c *GasEstimationConf) fallbackGasLimit(rule *GasRuleConf) uint64 {
+	if rule != nil && rule.FallbackGasLimit > 0 {
+		return rule.FallbackGasLimit
+	}
+	if c == nil {
+		return 0
+	}
+	return c.FallbackGasLimit
+}
+
+func (c *GasEstimationConf) applyPadding(gas ethbinding.HexUint64, rule *GasRuleConf) ethbinding.HexUint64 {
+	paddingPercent := defaultGasPaddingPercent
+	if c != nil && c.PaddingPercent != 0 {
+		paddingPercent = c.PaddingPercent
+	}
+	if paddingPercent > 0 {
+		gas = ethbinding.HexUint64(float64(gas) * (1 + float64(paddingPercent)/100))
+	}
+	if rule != nil && uint64(gas) < rule.MinGas {
+		gas = ethbinding.HexUint64(rule.MinGas)
+	}
+	return gas
+}
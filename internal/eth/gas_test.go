@@ -0,0 +1,162 @@
+// Copyright 2021 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package eth
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	ethbinding "github.com/kaleido-io/ethbinding/pkg"
+	"github.com/kaleido-io/ethconnect/internal/ethbind"
+	"github.com/kaleido-io/ethconnect/internal/messages"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestGasTxn(t *testing.T, conf *GasEstimationConf) *Txn {
+	var msg messages.SendTransaction
+	msg.MethodName = "testFunc"
+	msg.To = "0x2b8c0ECc76d0759a8F50b2E14A6881367D805832"
+	msg.From = "0xAA983AD2a0e0eD8ac639277F37be42F2A5d2618c"
+	msg.Nonce = "123"
+	msg.Value = "0"
+	msg.GasPrice = "789"
+	tx, err := NewSendTxn(&msg, nil)
+	assert.NoError(t, err)
+	tx.GasEstimation = conf
+	return tx
+}
+
+func estimateGasResult(estimate uint64) func(interface{}) {
+	return func(result interface{}) {
+		if gas, ok := result.(**ethbinding.HexUint64); ok {
+			**gas = ethbinding.HexUint64(estimate)
+		}
+	}
+}
+
+func sentGas(rpc *testRPCClient) interface{} {
+	jsonBytesSent, _ := json.Marshal(rpc.capturedArgs2[0])
+	var jsonSent map[string]interface{}
+	json.Unmarshal(jsonBytesSent, &jsonSent)
+	return jsonSent["gas"]
+}
+
+func TestGasEstimationDefaultPadding(t *testing.T) {
+	assert := assert.New(t)
+
+	tx := newTestGasTxn(t, nil)
+	rpc := &testRPCClient{resultWrangler: estimateGasResult(100000)}
+	err := tx.Send(context.Background(), rpc)
+	assert.NoError(err)
+	assert.Equal("eth_estimateGas", rpc.capturedMethod)
+	assert.Equal("0x1d4c0", sentGas(rpc)) // 120000
+}
+
+func TestGasEstimationCustomPadding(t *testing.T) {
+	assert := assert.New(t)
+
+	tx := newTestGasTxn(t, &GasEstimationConf{PaddingPercent: 50})
+	rpc := &testRPCClient{resultWrangler: estimateGasResult(100000)}
+	err := tx.Send(context.Background(), rpc)
+	assert.NoError(err)
+	assert.Equal("0x249f0", sentGas(rpc)) // 150000
+}
+
+func TestGasEstimationNoPadding(t *testing.T) {
+	assert := assert.New(t)
+
+	tx := newTestGasTxn(t, &GasEstimationConf{PaddingPercent: -1})
+	rpc := &testRPCClient{resultWrangler: estimateGasResult(100000)}
+	err := tx.Send(context.Background(), rpc)
+	assert.NoError(err)
+	assert.Equal("0x186a0", sentGas(rpc)) // 100000
+}
+
+func TestGasEstimationMinGasFloor(t *testing.T) {
+	assert := assert.New(t)
+
+	tx := newTestGasTxn(t, &GasEstimationConf{
+		Rules: []GasRuleConf{
+			{MinGas: 130000},
+			{Contract: "2b8c0ecc76d0759a8f50b2e14a6881367d805832", Method: "testFunc", MinGas: 200000},
+			{Method: "otherFunc", MinGas: 300000},
+		},
+	})
+	rpc := &testRPCClient{resultWrangler: estimateGasResult(100000)}
+	err := tx.Send(context.Background(), rpc)
+	assert.NoError(err)
+	assert.Equal("0x30d40", sentGas(rpc)) // 200000
+}
+
+func TestGasEstimationFallbackGasLimit(t *testing.T) {
+	assert := assert.New(t)
+
+	tx := newTestGasTxn(t, &GasEstimationConf{
+		FallbackGasLimit: 500000,
+	})
+	rpc := &testRPCClient{mockError: fmt.Errorf("pop")}
+	err := tx.Send(context.Background(), rpc)
+	assert.NoError(err)
+	assert.Equal("eth_estimateGas", rpc.capturedMethod)
+	assert.Equal("eth_sendTransaction", rpc.capturedMethod2)
+	assert.Equal("0x7a120", sentGas(rpc)) // 500000
+}
+
+func TestGasEstimationFallbackGasLimitPerMethod(t *testing.T) {
+	assert := assert.New(t)
+
+	tx := newTestGasTxn(t, &GasEstimationConf{
+		FallbackGasLimit: 500000,
+		Rules: []GasRuleConf{
+			{Method: "testFunc", FallbackGasLimit: 250000},
+		},
+	})
+	rpc := &testRPCClient{mockError: fmt.Errorf("pop")}
+	err := tx.Send(context.Background(), rpc)
+	assert.NoError(err)
+	assert.Equal("0x3d090", sentGas(rpc)) // 250000
+}
+
+func TestGasEstimationNoFallbackForOtherContract(t *testing.T) {
+	assert := assert.New(t)
+
+	tx := newTestGasTxn(t, &GasEstimationConf{
+		Rules: []GasRuleConf{
+			{Contract: "0x0123456789AbcdeF0123456789abCdef01234567", FallbackGasLimit: 250000},
+		},
+	})
+	rpc := &testRPCClient{mockError: fmt.Errorf("pop")}
+	err := tx.Send(context.Background(), rpc)
+	assert.EqualError(err, "Failed to calculate gas for transaction: pop")
+}
+
+func TestGasRuleForConstructor(t *testing.T) {
+	assert := assert.New(t)
+
+	conf := &GasEstimationConf{
+		Rules: []GasRuleConf{
+			{Contract: "0x2b8c0ECc76d0759a8F50b2E14A6881367D805832", MinGas: 1},
+			{Method: "constructor", MinGas: 2},
+		},
+	}
+	rule := conf.ruleFor(nil, constructorMethodName)
+	assert.Equal(uint64(2), rule.MinGas)
+
+	addr := ethbind.API.HexToAddress("0x2b8c0ECc76d0759a8F50b2E14A6881367D805832")
+	rule = conf.ruleFor(&addr, "set")
+	assert.Equal(uint64(1), rule.MinGas)
+}
@@ -0,0 +1,273 @@
+// Copyright 2021 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package eth
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	ethbinding "github.com/kaleido-io/ethbinding/pkg"
+	"github.com/kaleido-io/ethconnect/internal/errors"
+	"github.com/kaleido-io/ethconnect/internal/ethbind"
+	"github.com/kaleido-io/ethconnect/internal/utils"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// GasPriceStrategyNone sends transactions without a gasPrice at a gas price of zero, as on
+	// chains with free gas
+	GasPriceStrategyNone = "none"
+	// GasPriceStrategyNode uses the gas price suggested by the node with eth_gasPrice
+	GasPriceStrategyNode = "node"
+	// GasPriceStrategyFeeHistory adds a percentile of the priority fees paid in recent blocks to the
+	// base fee of the next block, using eth_feeHistory
+	GasPriceStrategyFeeHistory = "feeHistory"
+	// GasPriceStrategyFixed uses the configured ceiling as the gas price
+	GasPriceStrategyFixed = "fixed"
+	// GasPriceStrategyOracle uses the gas price returned by an external HTTP oracle
+	GasPriceStrategyOracle = "oracle"
+
+	defaultGasPriceHistoryBlocks = 20
+	defaultGasPricePercentile    = 60
+)
+
+var gasPriceStrategies = map[string]bool{
+	GasPriceStrategyNone:       true,
+	GasPriceStrategyNode:       true,
+	GasPriceStrategyFeeHistory: true,
+	GasPriceStrategyFixed:      true,
+	GasPriceStrategyOracle:     true,
+}
+
+// GasPriceConf configures how the gas price is chosen for transactions sent without a gasPrice,
+// that are not dynamic fee transactions. The strategy can be overridden on each request
+type GasPriceConf struct {
+	// Strategy is the default strategy. Empty is the same as "none"
+	Strategy string `json:"strategy,omitempty"`
+	// HistoryBlocks and Percentile configure the feeHistory strategy
+	HistoryBlocks int     `json:"historyBlocks"`
+	Percentile    float64 `json:"percentile"`
+	// Ceiling caps the gas price of every strategy, and is the gas price of the fixed strategy
+	Ceiling json.Number `json:"ceiling,omitempty"`
+	// CacheSeconds re-uses a gas price for that long, rather than querying for every transaction
+	CacheSeconds int           `json:"cacheSeconds"`
+	Oracle       GasOracleConf `json:"oracle"`
+}
+
+// GasOracleConf configures an external HTTP gas price oracle
+type GasOracleConf struct {
+	URL    string `json:"url"`
+	Method string `json:"method,omitempty"`
+	// ResultPath is the dot separated path of the gas price in the JSON response, such as "fast"
+	// or "result.ProposeGasPrice". The value can be a number or a string
+	ResultPath string `json:"resultPath"`
+	// Units of the returned gas price, "wei" (the default) or "gwei"
+	Units string `json:"units,omitempty"`
+	utils.HTTPRequesterConf
+}
+
+type cachedGasPrice struct {
+	price   *big.Int
+	expires time.Time
+}
+
+// GasPriceOracle chooses the gas price of legacy transactions with a pluggable strategy
+type GasPriceOracle struct {
+	conf    *GasPriceConf
+	ceiling *big.Int
+	oracle  *utils.HTTPRequester
+	lock    sync.Mutex
+	cache   map[string]*cachedGasPrice
+}
+
+// NewGasPriceOracle constructor
+func NewGasPriceOracle(conf *GasPriceConf) *GasPriceOracle {
+	if conf.HistoryBlocks <= 0 {
+		conf.HistoryBlocks = defaultGasPriceHistoryBlocks
+	}
+	if conf.Percentile <= 0 {
+		conf.Percentile = defaultGasPricePercentile
+	}
+	if conf.Oracle.Method == "" {
+		conf.Oracle.Method = http.MethodGet
+	}
+	g := &GasPriceOracle{
+		conf:   conf,
+		oracle: utils.NewHTTPRequester("Gas price oracle", &conf.Oracle.HTTPRequesterConf),
+		cache:  make(map[string]*cachedGasPrice),
+	}
+	var err error
+	if g.ceiling, err = parseFee("ceiling", conf.Ceiling); err != nil {
+		log.Errorf("Ignoring the configured gas price ceiling: %s", err)
+	}
+	if conf.Strategy != "" && !gasPriceStrategies[conf.Strategy] {
+		log.Errorf("Ignoring unknown gas price strategy '%s'", conf.Strategy)
+		conf.Strategy = ""
+	}
+	return g
+}
+
+// ValidateGasPriceStrategy checks a strategy requested for a transaction is known
+func ValidateGasPriceStrategy(strategy string) error {
+	if strategy != "" && !gasPriceStrategies[strategy] {
+		return errors.Errorf(errors.TransactionSendUnknownGasPriceStrategy, strategy)
+	}
+	return nil
+}
+
+// gasPrice returns the gas price for the strategy, capped at the ceiling
+func (g *GasPriceOracle) gasPrice(ctx context.Context, rpc RPCClient, strategy string) (*big.Int, error) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	if cached := g.cache[strategy]; cached != nil && time.Now().Before(cached.expires) {
+		return cached.price, nil
+	}
+
+	var price *big.Int
+	var err error
+	switch strategy {
+	case GasPriceStrategyNode:
+		price, err = g.nodeGasPrice(ctx, rpc)
+	case GasPriceStrategyFeeHistory:
+		price, err = g.feeHistoryGasPrice(ctx, rpc)
+	case GasPriceStrategyFixed:
+		if g.ceiling == nil {
+			err = fmt.Errorf("no ceiling is configured")
+		}
+		price = g.ceiling
+	case GasPriceStrategyOracle:
+		price, err = g.oracleGasPrice()
+	default:
+		return big.NewInt(0), nil
+	}
+	if err != nil {
+		return nil, errors.Errorf(errors.TransactionSendGasPriceFailed, strategy, err)
+	}
+	if g.ceiling != nil && price.Cmp(g.ceiling) > 0 {
+		log.Warnf("Gas price %s from the '%s' strategy is above the ceiling %s", price, strategy, g.ceiling)
+		price = g.ceiling
+	}
+	if g.conf.CacheSeconds > 0 {
+		g.cache[strategy] = &cachedGasPrice{
+			price:   price,
+			expires: time.Now().Add(time.Duration(g.conf.CacheSeconds) * time.Second),
+		}
+	}
+	return price, nil
+}
+
+func (g *GasPriceOracle) nodeGasPrice(ctx context.Context, rpc RPCClient) (*big.Int, error) {
+	var price ethbinding.HexBigInt
+	if err := rpc.CallContext(ctx, &price, "eth_gasPrice"); err != nil {
+		return nil, err
+	}
+	return price.ToInt(), nil
+}
+
+// feeHistoryGasPrice is the base fee of the next block, plus the average of a percentile of the
+// priority fees paid in recent blocks
+func (g *GasPriceOracle) feeHistoryGasPrice(ctx context.Context, rpc RPCClient) (*big.Int, error) {
+	var history feeHistory
+	blocks := ethbinding.HexUint64(g.conf.HistoryBlocks)
+	if err := rpc.CallContext(ctx, &history, "eth_feeHistory", blocks, "latest", []float64{g.conf.Percentile}); err != nil {
+		return nil, err
+	}
+	if len(history.BaseFeePerGas) == 0 || history.BaseFeePerGas[len(history.BaseFeePerGas)-1] == nil {
+		return nil, fmt.Errorf("no base fee returned")
+	}
+	tip := big.NewInt(0)
+	count := int64(0)
+	for _, rewards := range history.Reward {
+		if len(rewards) > 0 && rewards[0] != nil {
+			tip.Add(tip, rewards[0].ToInt())
+			count++
+		}
+	}
+	if count > 0 {
+		tip.Div(tip, big.NewInt(count))
+	}
+	return tip.Add(tip, history.BaseFeePerGas[len(history.BaseFeePerGas)-1].ToInt()), nil
+}
+
+// oracleGasPrice calls the external oracle, and reads the gas price at the result path
+func (g *GasPriceOracle) oracleGasPrice() (*big.Int, error) {
+	if g.conf.Oracle.URL == "" {
+		return nil, fmt.Errorf("no oracle URL is configured")
+	}
+	res, err := g.oracle.DoRequest(g.conf.Oracle.Method, g.conf.Oracle.URL, nil)
+	if err != nil {
+		return nil, err
+	}
+	var value interface{} = res
+	for _, segment := range strings.Split(g.conf.Oracle.ResultPath, ".") {
+		if m, ok := value.(map[string]interface{}); ok {
+			value = m[segment]
+		} else {
+			value = nil
+		}
+	}
+	var price *big.Float
+	switch v := value.(type) {
+	case float64:
+		price = big.NewFloat(v)
+	case string:
+		price, _ = new(big.Float).SetString(v)
+	}
+	if price == nil || price.Sign() < 0 {
+		return nil, errors.Errorf(errors.TransactionSendGasOracleBadResponse, g.conf.Oracle.ResultPath)
+	}
+	if strings.EqualFold(g.conf.Oracle.Units, "gwei") {
+		price.Mul(price, big.NewFloat(1e9))
+	}
+	wei, _ := price.Int(nil)
+	return wei, nil
+}
+
+// applyGasPrice sets the gas price of a legacy transaction that was sent without one, using
+// the strategy of the request or the default strategy
+func (g *GasPriceOracle) applyGasPrice(ctx context.Context, rpc RPCClient, tx *Txn) error {
+	if tx.gasPriceSupplied || tx.MaxFeePerGas != nil || tx.MaxPriorityFeePerGas != nil {
+		return nil
+	}
+	strategy := tx.GasPriceStrategy
+	if strategy == "" && g != nil {
+		strategy = g.conf.Strategy
+	}
+	if strategy == "" || strategy == GasPriceStrategyNone {
+		return nil
+	}
+	oracle := g
+	if oracle == nil {
+		oracle = NewGasPriceOracle(&GasPriceConf{})
+	}
+	price, err := oracle.gasPrice(ctx, rpc, strategy)
+	if err != nil {
+		return err
+	}
+	etx := tx.EthTX
+	if to := etx.To(); to != nil {
+		tx.EthTX = ethbind.API.NewTransaction(etx.Nonce(), *to, etx.Value(), etx.Gas(), price, etx.Data())
+	} else {
+		tx.EthTX = ethbind.API.NewContractCreation(etx.Nonce(), etx.Value(), etx.Gas(), price, etx.Data())
+	}
+	log.Debugf("Gas price from the '%s' strategy: %s", strategy, price)
+	return nil
+}
@@ -0,0 +1,229 @@
+// Copyright 2021 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package eth
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/kaleido-io/ethconnect/internal/messages"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestGasPriceRPC(calls map[string]int, sent *SendTXArgs) *MockRPCClient {
+	return NewMockRPCClientForSync(nil, func(method string, res interface{}, args ...interface{}) {
+		calls[method]++
+		switch method {
+		case "eth_gasPrice":
+			json.Unmarshal([]byte(`"0x3b9aca00"`), res)
+		case "eth_feeHistory":
+			json.Unmarshal([]byte(`{
+				"oldestBlock": "0x63",
+				"baseFeePerGas": ["0x64", "0x6e", "0x78"],
+				"reward": [["0xa"], ["0x1e"]]
+			}`), res)
+		case "eth_sendTransaction":
+			*sent = *args[0].(*SendTXArgs)
+		}
+	})
+}
+
+func newTestGasPriceTxn(t *testing.T, strategy, gasPrice string) *Txn {
+	var msg messages.SendTransaction
+	msg.Data = "0xfeedbeef"
+	msg.To = "0x2b8c0ECc76d0759a8F50b2E14A6881367D805832"
+	msg.From = "0xAA983AD2a0e0eD8ac639277F37be42F2A5d2618c"
+	msg.Gas = "456"
+	msg.GasPrice = json.Number(gasPrice)
+	msg.GasPriceStrategy = strategy
+	tx, err := NewSendTxn(&msg, nil)
+	assert.NoError(t, err)
+	tx.NodeAssignNonce = true
+	return tx
+}
+
+func TestNewGasPriceOracleDefaults(t *testing.T) {
+	assert := assert.New(t)
+	conf := &GasPriceConf{Strategy: "cheapest", Ceiling: "bad"}
+	g := NewGasPriceOracle(conf)
+	assert.Equal(20, conf.HistoryBlocks)
+	assert.Equal(float64(60), conf.Percentile)
+	assert.Equal(http.MethodGet, conf.Oracle.Method)
+	assert.Empty(conf.Strategy)
+	assert.Nil(g.ceiling)
+}
+
+func TestGasPriceStrategies(t *testing.T) {
+	assert := assert.New(t)
+	calls := make(map[string]int)
+	rpc := newTestGasPriceRPC(calls, &SendTXArgs{})
+	g := NewGasPriceOracle(&GasPriceConf{Percentile: 25, Ceiling: "2000000000"})
+
+	price, err := g.gasPrice(context.Background(), rpc, GasPriceStrategyNode)
+	assert.NoError(err)
+	assert.Equal(big.NewInt(1000000000), price)
+
+	// The base fee of the next block, plus the average of the rewards
+	price, err = g.gasPrice(context.Background(), rpc, GasPriceStrategyFeeHistory)
+	assert.NoError(err)
+	assert.Equal(big.NewInt(140), price)
+	assert.Equal([]float64{25}, rpc.ArgsCapture[2])
+
+	price, err = g.gasPrice(context.Background(), rpc, GasPriceStrategyFixed)
+	assert.NoError(err)
+	assert.Equal(big.NewInt(2000000000), price)
+
+	price, err = g.gasPrice(context.Background(), rpc, GasPriceStrategyNone)
+	assert.NoError(err)
+	assert.Equal(int64(0), price.Int64())
+
+	_, err = NewGasPriceOracle(&GasPriceConf{}).gasPrice(context.Background(), rpc, GasPriceStrategyFixed)
+	assert.EqualError(err, "Failed to get the gas price with the 'fixed' strategy: no ceiling is configured")
+}
+
+func TestGasPriceCeilingAndCache(t *testing.T) {
+	assert := assert.New(t)
+	calls := make(map[string]int)
+	rpc := newTestGasPriceRPC(calls, &SendTXArgs{})
+	g := NewGasPriceOracle(&GasPriceConf{Ceiling: "500000000", CacheSeconds: 60})
+
+	for i := 0; i < 3; i++ {
+		price, err := g.gasPrice(context.Background(), rpc, GasPriceStrategyNode)
+		assert.NoError(err)
+		assert.Equal(big.NewInt(500000000), price)
+	}
+	assert.Equal(1, calls["eth_gasPrice"])
+}
+
+func TestGasPriceNodeFailure(t *testing.T) {
+	rpc := NewMockRPCClientForSync(fmt.Errorf("pop"), nil)
+	g := NewGasPriceOracle(&GasPriceConf{})
+	_, err := g.gasPrice(context.Background(), rpc, GasPriceStrategyNode)
+	assert.EqualError(t, err, "Failed to get the gas price with the 'node' strategy: pop")
+	_, err = g.gasPrice(context.Background(), rpc, GasPriceStrategyFeeHistory)
+	assert.EqualError(t, err, "Failed to get the gas price with the 'feeHistory' strategy: pop")
+}
+
+func TestGasPriceOracle(t *testing.T) {
+	assert := assert.New(t)
+	svr := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		assert.Equal("secret", req.Header.Get("x-api-key"))
+		res.WriteHeader(200)
+		res.Write([]byte(`{"result": {"fast": "25.5", "slow": 12, "bad": true}}`))
+	}))
+	defer svr.Close()
+
+	conf := &GasPriceConf{
+		Oracle: GasOracleConf{
+			URL:        svr.URL,
+			ResultPath: "result.fast",
+			Units:      "gwei",
+		},
+	}
+	conf.Oracle.Headers = map[string][]string{"x-api-key": {"secret"}}
+	g := NewGasPriceOracle(conf)
+	price, err := g.gasPrice(context.Background(), nil, GasPriceStrategyOracle)
+	assert.NoError(err)
+	assert.Equal(big.NewInt(25500000000), price)
+
+	conf.Oracle.ResultPath = "result.slow"
+	conf.Oracle.Units = ""
+	price, err = g.gasPrice(context.Background(), nil, GasPriceStrategyOracle)
+	assert.NoError(err)
+	assert.Equal(big.NewInt(12), price)
+
+	conf.Oracle.ResultPath = "result.bad"
+	_, err = g.gasPrice(context.Background(), nil, GasPriceStrategyOracle)
+	assert.EqualError(err, "Failed to get the gas price with the 'oracle' strategy: No gas price at 'result.bad' in the response of the gas price oracle")
+
+	conf.Oracle.ResultPath = "result.fast.missing"
+	_, err = g.gasPrice(context.Background(), nil, GasPriceStrategyOracle)
+	assert.Regexp("No gas price at 'result.fast.missing'", err)
+
+	_, err = NewGasPriceOracle(&GasPriceConf{}).gasPrice(context.Background(), nil, GasPriceStrategyOracle)
+	assert.Regexp("no oracle URL is configured", err)
+}
+
+func TestSendTxnGasPriceStrategy(t *testing.T) {
+	assert := assert.New(t)
+	calls := make(map[string]int)
+	var sent SendTXArgs
+	rpc := newTestGasPriceRPC(calls, &sent)
+
+	// The strategy of the request overrides the default
+	tx := newTestGasPriceTxn(t, GasPriceStrategyNode, "")
+	tx.GasPrices = NewGasPriceOracle(&GasPriceConf{Strategy: GasPriceStrategyFeeHistory})
+	assert.NoError(tx.Send(context.Background(), rpc))
+	assert.Equal(big.NewInt(1000000000), sent.GasPrice.ToInt())
+	assert.Equal(uint64(456), uint64(*sent.Gas))
+	assert.Equal(0, calls["eth_feeHistory"])
+
+	tx = newTestGasPriceTxn(t, "", "")
+	tx.GasPrices = NewGasPriceOracle(&GasPriceConf{Strategy: GasPriceStrategyFeeHistory})
+	assert.NoError(tx.Send(context.Background(), rpc))
+	assert.Equal(big.NewInt(140), sent.GasPrice.ToInt())
+
+	// With no strategy the gas price is left at zero
+	tx = newTestGasPriceTxn(t, "", "")
+	assert.NoError(tx.Send(context.Background(), rpc))
+	assert.Equal(int64(0), sent.GasPrice.ToInt().Int64())
+
+	// A supplied gas price is used as is
+	tx = newTestGasPriceTxn(t, "", "42")
+	tx.GasPrices = NewGasPriceOracle(&GasPriceConf{Strategy: GasPriceStrategyNode})
+	assert.NoError(tx.Send(context.Background(), rpc))
+	assert.Equal(big.NewInt(42), sent.GasPrice.ToInt())
+	assert.Equal(1, calls["eth_gasPrice"])
+
+	tx = newTestGasPriceTxn(t, GasPriceStrategyFixed, "")
+	err := tx.Send(context.Background(), rpc)
+	assert.Regexp("no ceiling is configured", err)
+}
+
+func TestSendTxnGasPriceStrategyBadRequest(t *testing.T) {
+	assert := assert.New(t)
+
+	var msg messages.SendTransaction
+	msg.Data = "0xfeedbeef"
+	msg.To = "0x2b8c0ECc76d0759a8F50b2E14A6881367D805832"
+	msg.From = "0xAA983AD2a0e0eD8ac639277F37be42F2A5d2618c"
+	msg.GasPriceStrategy = "cheapest"
+	_, err := NewSendTxn(&msg, nil)
+	assert.EqualError(err, "Unknown gas price strategy 'cheapest'")
+
+	msg.GasPriceStrategy = GasPriceStrategyNode
+	msg.MaxFeePerGas = "789"
+	_, err = NewSendTxn(&msg, nil)
+	assert.EqualError(err, "Cannot specify a gas price strategy with 'gasPrice', 'maxFeePerGas' or 'maxPriorityFeePerGas'")
+}
+
+func TestSendTxnGasPriceStrategySkipsDynamicFees(t *testing.T) {
+	assert := assert.New(t)
+	calls := make(map[string]int)
+	var sent SendTXArgs
+	rpc := newTestGasPriceRPC(calls, &sent)
+
+	tx := newTestGasPriceTxn(t, GasPriceStrategyNode, "")
+	tx.Fees = NewFeeEstimator(&FeeEstimationConf{DynamicFees: true})
+	assert.NoError(tx.Send(context.Background(), rpc))
+	assert.Nil(sent.MaxFeePerGas)
+	assert.Equal(big.NewInt(1000000000), sent.GasPrice.ToInt())
+	assert.Equal(0, calls["eth_getBlockByNumber"])
+}
@@ -0,0 +1,281 @@
+// Copyright 2021 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package eth
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"time"
+
+	ethbinding "github.com/kaleido-io/ethbinding/pkg"
+	"github.com/kaleido-io/ethconnect/internal/auth"
+	"github.com/kaleido-io/ethconnect/internal/errors"
+	"github.com/kaleido-io/ethconnect/internal/ethbind"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// DefaultMulticall3Address is the address Multicall3 is deployed at on most public chains
+	DefaultMulticall3Address = "0xcA11bde05977b3631167028862bE2a173976CA11"
+
+	defaultMulticallWindowMS = 5
+	defaultMulticallMaxCalls = 50
+)
+
+var multicall3Aggregate3ABI = &ethbinding.ABIElementMarshaling{
+	Type: "function",
+	Name: "aggregate3",
+	Inputs: []ethbinding.ABIArgumentMarshaling{
+		{Name: "calls", Type: "tuple[]", Components: []ethbinding.ABIArgumentMarshaling{
+			{Name: "target", Type: "address"},
+			{Name: "allowFailure", Type: "bool"},
+			{Name: "callData", Type: "bytes"},
+		}},
+	},
+	Outputs: []ethbinding.ABIArgumentMarshaling{
+		{Name: "returnData", Type: "tuple[]", Components: []ethbinding.ABIArgumentMarshaling{
+			{Name: "success", Type: "bool"},
+			{Name: "returnData", Type: "bytes"},
+		}},
+	},
+	StateMutability: "payable",
+}
+
+// MulticallConf configures the aggregation of concurrent eth_call requests into a single call to
+// a Multicall3 contract, reducing the round trips to the node. Calls are collected for the window
+// (in milliseconds), or until maxCalls are waiting, before being sent
+type MulticallConf struct {
+	Enabled  bool   `json:"enabled,omitempty"`
+	Address  string `json:"address,omitempty"`
+	WindowMS int    `json:"window,omitempty"`
+	MaxCalls int    `json:"maxCalls,omitempty"`
+}
+
+// multicallRPC sits in front of an RPC connection, and aggregates eth_call requests for the same
+// block that do not depend on the sender or value. Multicall3 is the sender of each aggregated
+// call, so calls from a specific address are passed straight through - as are all other methods.
+// A call that fails inside the aggregate, or an aggregate that fails as a whole (such as on a
+// chain without Multicall3), is retried on its own so that the caller sees the node's own error
+type multicallRPC struct {
+	rpc      RPCClientAll
+	address  string
+	window   time.Duration
+	maxCalls int
+	mux      sync.Mutex
+	pending  map[string]*multicallBatch
+}
+
+type multicallBatch struct {
+	blockTag string
+	calls    []*multicallCall
+	timer    *time.Timer
+}
+
+type multicallCall struct {
+	ctx    context.Context
+	args   *SendTXArgs
+	result string
+	err    error
+	done   chan struct{}
+}
+
+func newMulticallRPC(conf *MulticallConf, rpc RPCClientAll) (*multicallRPC, error) {
+	if conf.Address == "" {
+		conf.Address = DefaultMulticall3Address
+	}
+	if !ethbind.API.IsHexAddress(conf.Address) {
+		return nil, errors.Errorf(errors.RPCMulticallBadAddress, conf.Address)
+	}
+	if conf.WindowMS <= 0 {
+		conf.WindowMS = defaultMulticallWindowMS
+	}
+	if conf.MaxCalls <= 0 {
+		conf.MaxCalls = defaultMulticallMaxCalls
+	}
+	return &multicallRPC{
+		rpc:      rpc,
+		address:  ethbind.API.HexToAddress(conf.Address).Hex(),
+		window:   time.Duration(conf.WindowMS) * time.Millisecond,
+		maxCalls: conf.MaxCalls,
+		pending:  make(map[string]*multicallBatch),
+	}, nil
+}
+
+// aggregatableCall returns the arguments of an eth_call that can be made from Multicall3
+func aggregatableCall(result interface{}, method string, args []interface{}) (*SendTXArgs, string, bool) {
+	if method != "eth_call" || len(args) != 2 {
+		return nil, "", false
+	}
+	if _, ok := result.(*string); !ok {
+		return nil, "", false
+	}
+	txArgs, ok := args[0].(*SendTXArgs)
+	blockTag, tagOK := args[1].(string)
+	if !ok || !tagOK || txArgs.To == "" || txArgs.Data == nil || txArgs.PrivateFor != nil || txArgs.PrivacyGroupID != "" {
+		return nil, "", false
+	}
+	if txArgs.From != "" && ethbind.API.HexToAddress(txArgs.From) != (ethbinding.Address{}) {
+		return nil, "", false
+	}
+	return txArgs, blockTag, txArgs.Value.ToInt().Sign() == 0
+}
+
+func (m *multicallRPC) CallContext(ctx context.Context, result interface{}, method string, args ...interface{}) error {
+	txArgs, blockTag, ok := aggregatableCall(result, method, args)
+	if !ok {
+		return m.rpc.CallContext(ctx, result, method, args...)
+	}
+	// Aggregated calls must be authorized for each caller, as they reach the RPC connection as one call
+	if err := auth.AuthRPC(ctx, method, args...); err != nil {
+		log.Errorf("JSON/RPC %s - not authorized: %s", method, err)
+		return errors.Errorf(errors.Unauthorized)
+	}
+	call := &multicallCall{ctx: ctx, args: txArgs, done: make(chan struct{})}
+	m.enqueue(blockTag, call)
+	select {
+	case <-call.done:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	if call.err != nil {
+		return call.err
+	}
+	*(result.(*string)) = call.result
+	return nil
+}
+
+func (m *multicallRPC) enqueue(blockTag string, call *multicallCall) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	batch := m.pending[blockTag]
+	if batch == nil {
+		batch = &multicallBatch{blockTag: blockTag}
+		batch.timer = time.AfterFunc(m.window, func() { m.flush(batch) })
+		m.pending[blockTag] = batch
+	}
+	batch.calls = append(batch.calls, call)
+	if len(batch.calls) >= m.maxCalls {
+		batch.timer.Stop()
+		delete(m.pending, blockTag)
+		go m.execute(batch)
+	}
+}
+
+func (m *multicallRPC) flush(batch *multicallBatch) {
+	m.mux.Lock()
+	if m.pending[batch.blockTag] != batch {
+		// Already sent, as it was full
+		m.mux.Unlock()
+		return
+	}
+	delete(m.pending, batch.blockTag)
+	m.mux.Unlock()
+	m.execute(batch)
+}
+
+// execute sends the calls of a batch as one aggregate3 call, retrying any that fail on their own
+func (m *multicallRPC) execute(batch *multicallBatch) {
+	var retry []*multicallCall
+	if len(batch.calls) == 1 {
+		retry = batch.calls
+	} else {
+		results, err := m.aggregate3(batch)
+		if err != nil {
+			log.Warnf("Multicall of %d calls failed, calling individually: %s", len(batch.calls), err)
+			retry = batch.calls
+		} else {
+			log.Debugf("Multicall of %d calls at block '%s'", len(batch.calls), batch.blockTag)
+			for i, call := range batch.calls {
+				result, _ := results[i].(map[string]interface{})
+				if success, _ := result["success"].(bool); success {
+					call.result, _ = result["returnData"].(string)
+					close(call.done)
+				} else {
+					retry = append(retry, call)
+				}
+			}
+		}
+	}
+	for _, call := range retry {
+		go func(call *multicallCall) {
+			call.err = m.rpc.CallContext(call.ctx, &call.result, "eth_call", call.args, batch.blockTag)
+			close(call.done)
+		}(call)
+	}
+}
+
+func (m *multicallRPC) aggregate3(batch *multicallBatch) ([]interface{}, error) {
+	calls := make([]interface{}, len(batch.calls))
+	for i, call := range batch.calls {
+		calls[i] = map[string]interface{}{
+			"target":       call.args.To,
+			"allowFailure": true,
+			"callData":     ethbind.API.HexEncode(*call.args.Data),
+		}
+	}
+	callData, err := EncodeMethodCall(multicall3Aggregate3ABI, []interface{}{calls})
+	if err != nil {
+		return nil, err
+	}
+	data := ethbinding.HexBytes(callData)
+	ctx, cancel := context.WithTimeout(auth.NewSystemAuthContext(), 30*time.Second)
+	defer cancel()
+	var hexString string
+	if err := m.rpc.CallContext(ctx, &hexString, "eth_call", &SendTXArgs{To: m.address, Data: &data}, batch.blockTag); err != nil {
+		return nil, err
+	}
+	aggregate3, _ := ethbind.API.ABIElementMarshalingToABIMethod(multicall3Aggregate3ABI)
+	decoded := ProcessRLPBytes(aggregate3.Outputs, ethbind.API.FromHex(hexString))
+	results, ok := decoded["returnData"].([]interface{})
+	if !ok || len(results) != len(batch.calls) {
+		return nil, errors.Errorf(errors.RPCMulticallBadResult, len(batch.calls))
+	}
+	return results, nil
+}
+
+func (m *multicallRPC) Subscribe(ctx context.Context, namespace string, channel interface{}, args ...interface{}) (RPCClientSubscription, error) {
+	return m.rpc.Subscribe(ctx, namespace, channel, args...)
+}
+
+func (m *multicallRPC) Close() {
+	m.rpc.Close()
+}
+
+// MulticallRequest is one read-only call made with Multicall
+type MulticallRequest struct {
+	From      string
+	To        string
+	Method    *ethbinding.ABIMethod
+	Params    []interface{}
+	ErrorABIs ethbinding.ABIMarshaling
+	Result    map[string]interface{}
+	Err       error
+}
+
+// Multicall makes a set of read-only calls at a block concurrently. Over an RPC connection with
+// multicall enabled they are aggregated into calls to Multicall3, and otherwise each is sent
+// to the node. The result or error of each call is set on its request
+func Multicall(ctx context.Context, rpc RPCClient, calls []*MulticallRequest, blocknumber string) {
+	var wg sync.WaitGroup
+	for _, call := range calls {
+		wg.Add(1)
+		go func(call *MulticallRequest) {
+			defer wg.Done()
+			call.Result, call.Err = CallMethod(ctx, rpc, nil, call.From, call.To, json.Number(""), call.Method, call.Params, call.ErrorABIs, blocknumber)
+		}(call)
+	}
+	wg.Wait()
+}
@@ -0,0 +1,204 @@
+// Copyright 2021 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package eth
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+
+	ethbinding "github.com/kaleido-io/ethbinding/pkg"
+	"github.com/kaleido-io/ethconnect/internal/ethbind"
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	testMulticallTarget  = "0x2b8c0ECc76d0759a8F50b2E14A6881367D805832"
+	testMulticallFailing = "0x66c5fe653e7a9ebb628a6d40f0452d1e358baee8"
+)
+
+// multicallTestRPC answers calls to Multicall3 by decoding the aggregated calls, and answers
+// each call to the failing address with an error
+type multicallTestRPC struct {
+	MockRPCClient
+	mux        sync.Mutex
+	aggregates []int
+	direct     int
+	aggErr     error
+}
+
+func (m *multicallTestRPC) CallContext(ctx context.Context, result interface{}, method string, args ...interface{}) error {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	txArgs := args[0].(*SendTXArgs)
+	if strings.EqualFold(txArgs.To, DefaultMulticall3Address) {
+		if m.aggErr != nil {
+			return m.aggErr
+		}
+		aggregate3, _ := ethbind.API.ABIElementMarshalingToABIMethod(multicall3Aggregate3ABI)
+		calls := ProcessRLPBytes(aggregate3.Inputs, (*txArgs.Data)[4:])["calls"].([]interface{})
+		type callResult struct {
+			Success    bool
+			ReturnData []byte
+		}
+		results := make([]callResult, len(calls))
+		for i, call := range calls {
+			target := call.(map[string]interface{})["target"].(string)
+			results[i].Success = !strings.EqualFold(target, testMulticallFailing)
+			results[i].ReturnData = ethbind.API.FromHex(testMulticallResult(i))
+		}
+		packed, err := aggregate3.Outputs.Pack(results)
+		if err != nil {
+			return err
+		}
+		m.aggregates = append(m.aggregates, len(calls))
+		*(result.(*string)) = ethbind.API.HexEncode(packed)
+		return nil
+	}
+	m.direct++
+	if strings.EqualFold(txArgs.To, testMulticallFailing) {
+		return fmt.Errorf("execution reverted")
+	}
+	*(result.(*string)) = testMulticallResult(99)
+	return nil
+}
+
+func testMulticallResult(i int) string {
+	return fmt.Sprintf("0x%064x", i)
+}
+
+func testMulticallArgs(to, from string) *SendTXArgs {
+	data := ethbinding.HexBytes([]byte{0x6d, 0x4c, 0xe6, 0x3c})
+	return &SendTXArgs{To: to, From: from, Data: &data}
+}
+
+func callConcurrently(m *multicallRPC, argsList []*SendTXArgs) ([]string, []error) {
+	results := make([]string, len(argsList))
+	errs := make([]error, len(argsList))
+	var wg sync.WaitGroup
+	for i, args := range argsList {
+		wg.Add(1)
+		go func(i int, args *SendTXArgs) {
+			defer wg.Done()
+			errs[i] = m.CallContext(context.Background(), &results[i], "eth_call", args, "latest")
+		}(i, args)
+	}
+	wg.Wait()
+	return results, errs
+}
+
+func TestMulticallAggregates(t *testing.T) {
+	assert := assert.New(t)
+	rpc := &multicallTestRPC{}
+	m, err := newMulticallRPC(&MulticallConf{WindowMS: 50}, rpc)
+	assert.NoError(err)
+
+	zeroFrom := ethbinding.Address{}.Hex()
+	results, errs := callConcurrently(m, []*SendTXArgs{
+		testMulticallArgs(testMulticallTarget, ""),
+		testMulticallArgs(testMulticallTarget, zeroFrom),
+		testMulticallArgs(testMulticallTarget, ""),
+	})
+	for i := range results {
+		assert.NoError(errs[i])
+	}
+	assert.Equal([]int{3}, rpc.aggregates)
+	assert.Equal(0, rpc.direct)
+	assert.ElementsMatch([]string{testMulticallResult(0), testMulticallResult(1), testMulticallResult(2)}, results)
+
+	// A call that fails inside the aggregate is retried on its own, to return the error of the node
+	_, errs = callConcurrently(m, []*SendTXArgs{
+		testMulticallArgs(testMulticallTarget, ""),
+		testMulticallArgs(testMulticallFailing, ""),
+	})
+	assert.Len(rpc.aggregates, 2)
+	assert.Equal(1, rpc.direct)
+	assert.Equal(1, len(errs)-countNil(errs))
+
+	// Calls from an address, and other methods, are passed straight through
+	var result string
+	err = m.CallContext(context.Background(), &result, "eth_call", testMulticallArgs(testMulticallTarget, testMulticallFailing), "latest")
+	assert.NoError(err)
+	assert.Equal(testMulticallResult(99), result)
+	err = m.CallContext(context.Background(), &result, "eth_estimateGas", testMulticallArgs(testMulticallTarget, ""))
+	assert.NoError(err)
+	assert.Equal(3, rpc.direct)
+	assert.Len(rpc.aggregates, 2)
+}
+
+func countNil(errs []error) (n int) {
+	for _, err := range errs {
+		if err == nil {
+			n++
+		}
+	}
+	return n
+}
+
+func TestMulticallFallbackAndMaxCalls(t *testing.T) {
+	assert := assert.New(t)
+	rpc := &multicallTestRPC{aggErr: fmt.Errorf("no code at address")}
+	m, err := newMulticallRPC(&MulticallConf{WindowMS: 60000, MaxCalls: 2}, rpc)
+	assert.NoError(err)
+
+	// A full batch is sent without waiting for the window, and is called individually on failure
+	results, errs := callConcurrently(m, []*SendTXArgs{
+		testMulticallArgs(testMulticallTarget, ""),
+		testMulticallArgs(testMulticallTarget, ""),
+	})
+	assert.Equal([]error{nil, nil}, errs)
+	assert.Equal([]string{testMulticallResult(99), testMulticallResult(99)}, results)
+	assert.Equal(2, rpc.direct)
+
+	// A cancelled caller stops waiting
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	var result string
+	err = m.CallContext(ctx, &result, "eth_call", testMulticallArgs(testMulticallTarget, ""), "latest")
+	assert.Equal(context.Canceled, err)
+
+	_, err = newMulticallRPC(&MulticallConf{Address: "bad"}, rpc)
+	assert.EqualError(err, "Invalid Multicall3 contract address 'bad'")
+
+	m.Close()
+	assert.True(rpc.Closed)
+}
+
+func TestMulticallMethods(t *testing.T) {
+	assert := assert.New(t)
+	rpc := &multicallTestRPC{}
+	m, _ := newMulticallRPC(&MulticallConf{}, rpc)
+	method, _ := ethbind.API.ABIElementMarshalingToABIMethod(&ethbinding.ABIElementMarshaling{
+		Type: "function", Name: "get", StateMutability: "view",
+		Outputs: []ethbinding.ABIArgumentMarshaling{{Name: "value", Type: "uint256"}},
+	})
+
+	calls := []*MulticallRequest{
+		{To: testMulticallTarget, Method: method},
+		{To: testMulticallTarget, Method: method},
+		{To: testMulticallFailing, Method: method},
+	}
+	Multicall(context.Background(), m, calls, "")
+	assert.Equal([]int{3}, rpc.aggregates)
+	assert.NotNil(calls[0].Result["value"])
+	assert.NotNil(calls[1].Result["value"])
+	assert.Regexp("execution reverted", calls[2].Err)
+
+	calls = []*MulticallRequest{{To: testMulticallTarget, Method: method}}
+	Multicall(context.Background(), m, calls, "badblock")
+	assert.Regexp("Invalid blocknumber", calls[0].Err)
+}
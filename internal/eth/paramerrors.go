@@ -0,0 +1,127 @@
+// Copyright 2021 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package eth
+
+import (
+	"fmt"
+	"strings"
+
+	ethbinding "github.com/kaleido-io/ethbinding/pkg"
+)
+
+// Stable machine-readable codes for parameters that fail conversion to their ABI type
+const (
+	ParamErrorInvalidParameters = "INVALID_PARAMETERS"
+	ParamErrorNullValue         = "NULL_VALUE"
+	ParamErrorInvalidNumber     = "INVALID_NUMBER"
+	ParamErrorInvalidBoolean    = "INVALID_BOOLEAN"
+	ParamErrorInvalidString     = "INVALID_STRING"
+	ParamErrorInvalidAddress    = "INVALID_ADDRESS"
+	ParamErrorInvalidBytes      = "INVALID_BYTES"
+	ParamErrorInvalidArray      = "INVALID_ARRAY"
+	ParamErrorInvalidTuple      = "INVALID_TUPLE"
+	ParamErrorUnsupportedType   = "UNSUPPORTED_TYPE"
+)
+
+// ParamError describes a single parameter that could not be converted to its Solidity type
+type ParamError struct {
+	Field   string      `json:"field"`
+	Type    string      `json:"type"`
+	Value   interface{} `json:"value"`
+	Code    string      `json:"code"`
+	Hint    string      `json:"hint"`
+	Message string      `json:"message"`
+}
+
+func (e *ParamError) Error() string {
+	return e.Message
+}
+
+// ParamValidationError lists every parameter that failed conversion for a method
+type ParamValidationError struct {
+	Method string
+	Fields []*ParamError
+}
+
+// Code is the machine-readable code for the overall failure
+func (e *ParamValidationError) Code() string {
+	return ParamErrorInvalidParameters
+}
+
+func (e *ParamValidationError) Error() string {
+	msgs := make([]string, len(e.Fields))
+	for i, f := range e.Fields {
+		msgs[i] = f.Message
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// ValidateParams checks the supplied parameters can be converted to the inputs of the method,
+// returning a ParamValidationError listing each offending field if they cannot
+func ValidateParams(method *ethbinding.ABIMethod, params []interface{}) error {
+	// Take a copy of the method, as inline types in the parameters update the inputs
+	methodCopy := *method
+	methodCopy.Inputs = append(ethbinding.ABIArguments{}, method.Inputs...)
+	tx := &Txn{}
+	_, err := tx.generateTypedArgs(params, &methodCopy)
+	return err
+}
+
+// newParamError wraps a conversion failure with the details of the offending field
+func newParamError(requiredType *ethbinding.ABIType, param interface{}, path string, err error) *ParamError {
+	typeName := requiredType.String()
+	pe := &ParamError{
+		Field:   path,
+		Type:    typeName,
+		Value:   param,
+		Message: err.Error(),
+	}
+	if param == nil {
+		pe.Code = ParamErrorNullValue
+		pe.Hint = fmt.Sprintf("%s cannot be null", typeName)
+		return pe
+	}
+	switch requiredType.T {
+	case ethbinding.IntTy, ethbinding.UintTy:
+		pe.Code = ParamErrorInvalidNumber
+		pe.Hint = fmt.Sprintf("%s must be a decimal string or a JSON number", typeName)
+	case ethbinding.BoolTy:
+		pe.Code = ParamErrorInvalidBoolean
+		pe.Hint = fmt.Sprintf("%s must be a JSON boolean or the string \"true\" or \"false\"", typeName)
+	case ethbinding.StringTy:
+		pe.Code = ParamErrorInvalidString
+		pe.Hint = fmt.Sprintf("%s must be a JSON string", typeName)
+	case ethbinding.AddressTy:
+		pe.Code = ParamErrorInvalidAddress
+		pe.Hint = fmt.Sprintf("%s must be a 0x prefixed hex string of 20 bytes (40 hex characters), such as 0x%s", typeName, strings.Repeat("0", 40))
+	case ethbinding.FixedBytesTy:
+		pe.Code = ParamErrorInvalidBytes
+		pe.Hint = fmt.Sprintf("%s must be a 0x prefixed hex string of up to %d bytes (%d hex characters), such as 0x%s, or an array of numbers from 0 to 255",
+			typeName, requiredType.Size, requiredType.Size*2, strings.Repeat("00", requiredType.Size))
+	case ethbinding.BytesTy:
+		pe.Code = ParamErrorInvalidBytes
+		pe.Hint = fmt.Sprintf("%s must be a 0x prefixed hex string with two hex characters per byte, such as 0x0102ff, or an array of numbers from 0 to 255", typeName)
+	case ethbinding.SliceTy, ethbinding.ArrayTy:
+		pe.Code = ParamErrorInvalidArray
+		pe.Hint = fmt.Sprintf("%s must be a JSON array", typeName)
+	case ethbinding.TupleTy:
+		pe.Code = ParamErrorInvalidTuple
+		pe.Hint = fmt.Sprintf("%s must be a JSON object with the fields: %s", typeName, strings.Join(requiredType.TupleRawNames, ", "))
+	default:
+		pe.Code = ParamErrorUnsupportedType
+		pe.Hint = fmt.Sprintf("%s is not supported", typeName)
+	}
+	return pe
+}
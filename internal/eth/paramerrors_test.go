@@ -0,0 +1,151 @@
+// Copyright 2021 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package eth
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	ethbinding "github.com/kaleido-io/ethbinding/pkg"
+	"github.com/kaleido-io/ethconnect/internal/ethbind"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestValidationMethod(t *testing.T) *ethbinding.ABIMethod {
+	method, err := ethbind.API.ABIElementMarshalingToABIMethod(&ethbinding.ABIElementMarshaling{
+		Name: "testFunc",
+		Type: "function",
+		Inputs: []ethbinding.ABIArgumentMarshaling{
+			{Name: "amount", Type: "uint256"},
+			{Name: "", Type: "address"},
+			{Name: "flag", Type: "bool"},
+			{Name: "widget", Type: "tuple", Components: []ethbinding.ABIArgumentMarshaling{
+				{Name: "id", Type: "bytes32"},
+				{Name: "tags", Type: "string[]"},
+			}},
+		},
+	})
+	assert.NoError(t, err)
+	return method
+}
+
+func TestValidateParamsOK(t *testing.T) {
+	assert := assert.New(t)
+	method := newTestValidationMethod(t)
+	err := ValidateParams(method, []interface{}{
+		"12345",
+		"0x2b8c0ECc76d0759a8F50b2E14A6881367D805832",
+		true,
+		map[string]interface{}{
+			"id":   "0x0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef",
+			"tags": []interface{}{"a", "b"},
+		},
+	})
+	assert.NoError(err)
+}
+
+func TestValidateParamsListsEachField(t *testing.T) {
+	assert := assert.New(t)
+	method := newTestValidationMethod(t)
+	err := ValidateParams(method, []interface{}{
+		"12.5",
+		"not an address",
+		true,
+		map[string]interface{}{
+			"id":   "0x0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef",
+			"tags": []interface{}{"a", nil},
+		},
+	})
+	assert.IsType(&ParamValidationError{}, err)
+	validationErr := err.(*ParamValidationError)
+	assert.Equal("testFunc", validationErr.Method)
+	assert.Equal(ParamErrorInvalidParameters, validationErr.Code())
+	assert.Len(validationErr.Fields, 3)
+
+	f := validationErr.Fields[0]
+	assert.Equal("amount", f.Field)
+	assert.Equal("uint256", f.Type)
+	assert.Equal("12.5", f.Value)
+	assert.Equal(ParamErrorInvalidNumber, f.Code)
+	assert.Equal("uint256 must be a decimal string or a JSON number", f.Hint)
+	assert.Equal("Method 'testFunc' param 0: Could not be converted to a number", f.Message)
+
+	f = validationErr.Fields[1]
+	assert.Equal("input1", f.Field)
+	assert.Equal("address", f.Type)
+	assert.Equal(ParamErrorInvalidAddress, f.Code)
+	assert.Equal("address must be a 0x prefixed hex string of 20 bytes (40 hex characters), such as 0x0000000000000000000000000000000000000000", f.Hint)
+
+	f = validationErr.Fields[2]
+	assert.Equal("widget.tags[1]", f.Field)
+	assert.Equal("string", f.Type)
+	assert.Nil(f.Value)
+	assert.Equal(ParamErrorNullValue, f.Code)
+	assert.Equal("string cannot be null", f.Hint)
+
+	assert.Regexp("param 0: Could not be converted to a number; .*param 1: Could not be converted to a hex address.*; .*param 3.tags\\[1\\]: Cannot supply a null value", err.Error())
+}
+
+func TestValidateParamsWrongJSONTypes(t *testing.T) {
+	assert := assert.New(t)
+	method := newTestValidationMethod(t)
+	err := ValidateParams(method, []interface{}{
+		true,
+		"0x2b8c0ECc76d0759a8F50b2E14A6881367D805832",
+		12345.0,
+		"not an object",
+	})
+	validationErr := err.(*ParamValidationError)
+	assert.Len(validationErr.Fields, 3)
+	assert.Equal(ParamErrorInvalidNumber, validationErr.Fields[0].Code)
+	assert.Equal(ParamErrorInvalidBoolean, validationErr.Fields[1].Code)
+	assert.Equal("flag", validationErr.Fields[1].Field)
+	assert.Equal(ParamErrorInvalidTuple, validationErr.Fields[2].Code)
+	assert.Equal("(bytes32,string[]) must be a JSON object with the fields: id, tags", validationErr.Fields[2].Hint)
+}
+
+func TestValidateParamsCountMismatch(t *testing.T) {
+	assert := assert.New(t)
+	method := newTestValidationMethod(t)
+	err := ValidateParams(method, []interface{}{"12345"})
+	assert.Regexp("Requires 4 args", err)
+	assert.Len(method.Inputs, 4)
+}
+
+func TestValidateParamsBytesHints(t *testing.T) {
+	assert := assert.New(t)
+	method := newTestValidationMethod(t)
+	err := ValidateParams(method, []interface{}{
+		"12345",
+		"0x2b8c0ECc76d0759a8F50b2E14A6881367D805832",
+		true,
+		map[string]interface{}{
+			"id":   12345.0,
+			"tags": []interface{}{},
+		},
+	})
+	validationErr := err.(*ParamValidationError)
+	assert.Len(validationErr.Fields, 1)
+	assert.Equal("widget.id", validationErr.Fields[0].Field)
+	assert.Equal(ParamErrorInvalidBytes, validationErr.Fields[0].Code)
+	assert.Equal("bytes32 must be a 0x prefixed hex string of up to 32 bytes (64 hex characters), such as 0x"+strings.Repeat("00", 32)+", or an array of numbers from 0 to 255", validationErr.Fields[0].Hint)
+
+	bytesType, err := ethbind.API.NewType("bytes", "")
+	assert.NoError(err)
+	pe := newParamError(&bytesType, true, "data", fmt.Errorf("pop"))
+	assert.Equal(ParamErrorInvalidBytes, pe.Code)
+	assert.Equal("bytes must be a 0x prefixed hex string with two hex characters per byte, such as 0x0102ff, or an array of numbers from 0 to 255", pe.Hint)
+}
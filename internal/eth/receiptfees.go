@@ -0,0 +1,87 @@
+// Copyright 2021 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package eth
+
+import (
+	"context"
+	"math/big"
+	"time"
+
+	ethbinding "github.com/kaleido-io/ethbinding/pkg"
+	"github.com/kaleido-io/ethconnect/internal/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// TxnFees is what a mined transaction paid. On a chain that supports London (EIP-1559)
+// the fee is split into the base fee, which is burnt, and the priority fee paid to the
+// miner. Otherwise the base fee fields are nil.
+type TxnFees struct {
+	EffectiveGasPrice *big.Int
+	Fee               *big.Int
+	BaseFeePerGas     *big.Int
+	BaseFee           *big.Int
+	PriorityFee       *big.Int
+}
+
+// GetFees calculates the fees of the transaction from its receipt. Nodes that do not
+// return the effectiveGasPrice in the receipt are asked for the gas price of the
+// transaction, and the base fee comes from the block the transaction was mined in
+func (tx *Txn) GetFees(ctx context.Context, rpc RPCClient) (*TxnFees, error) {
+	start := time.Now().UTC()
+
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	receipt := &tx.Receipt
+	if receipt.GasUsed == nil {
+		return nil, errors.Errorf(errors.TransactionReceiptFeesNoGasUsed, tx.Hash)
+	}
+	gasUsed := receipt.GasUsed.ToInt()
+
+	fees := &TxnFees{}
+	if receipt.EffectiveGasPrice != nil {
+		fees.EffectiveGasPrice = receipt.EffectiveGasPrice.ToInt()
+	} else {
+		var txInfo struct {
+			GasPrice *ethbinding.HexBigInt `json:"gasPrice"`
+		}
+		if err := rpc.CallContext(ctx, &txInfo, "eth_getTransactionByHash", tx.Hash); err != nil {
+			return nil, errors.Errorf(errors.RPCCallReturnedError, "eth_getTransactionByHash", err)
+		}
+		if txInfo.GasPrice == nil {
+			return nil, errors.Errorf(errors.TransactionReceiptFeesNoGasPrice, tx.Hash)
+		}
+		fees.EffectiveGasPrice = txInfo.GasPrice.ToInt()
+	}
+	fees.Fee = new(big.Int).Mul(gasUsed, fees.EffectiveGasPrice)
+
+	if receipt.BlockHash != nil {
+		var block struct {
+			BaseFeePerGas *ethbinding.HexBigInt `json:"baseFeePerGas"`
+		}
+		if err := rpc.CallContext(ctx, &block, "eth_getBlockByHash", receipt.BlockHash, false); err != nil {
+			return nil, errors.Errorf(errors.RPCCallReturnedError, "eth_getBlockByHash", err)
+		}
+		if block.BaseFeePerGas != nil {
+			fees.BaseFeePerGas = block.BaseFeePerGas.ToInt()
+			fees.BaseFee = new(big.Int).Mul(gasUsed, fees.BaseFeePerGas)
+			fees.PriorityFee = new(big.Int).Sub(fees.Fee, fees.BaseFee)
+		}
+	}
+
+	callTime := time.Now().UTC().Sub(start)
+	log.Debugf("Fees for %s: effectiveGasPrice=%s fee=%s [%.2fs]", tx.Hash, fees.EffectiveGasPrice, fees.Fee, callTime.Seconds())
+	return fees, nil
+}
@@ -0,0 +1,111 @@
+// Copyright 2021 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package eth
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"testing"
+
+	ethbinding "github.com/kaleido-io/ethbinding/pkg"
+	"github.com/kaleido-io/ethconnect/internal/ethbind"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestFeesTxn(gasUsed int64, effectiveGasPrice *big.Int) *Txn {
+	blockHash := ethbind.API.HexToHash("0x6e710868fd2d0ac1f141ba3f0cd569e38ce1999d8f39518ee7633d2b9a7122af")
+	tx := &Txn{Hash: "0xe2215336b09f9b5b82e36e1144ed64f40a42e61b68fdaca82549fd98b8531a89"}
+	tx.Receipt.BlockHash = &blockHash
+	tx.Receipt.GasUsed = (*ethbinding.HexBigInt)(big.NewInt(gasUsed))
+	if effectiveGasPrice != nil {
+		tx.Receipt.EffectiveGasPrice = (*ethbinding.HexBigInt)(effectiveGasPrice)
+	}
+	return tx
+}
+
+func newTestFeesRPC(callErr error, results map[string]string) *MockRPCClient {
+	return NewMockRPCClientForSync(callErr, func(method string, res interface{}, args ...interface{}) {
+		if result, ok := results[method]; ok {
+			json.Unmarshal([]byte(result), res)
+		}
+	})
+}
+
+func TestGetFeesLondon(t *testing.T) {
+	assert := assert.New(t)
+
+	tx := newTestFeesTxn(21000, big.NewInt(1500000000))
+	rpc := newTestFeesRPC(nil, map[string]string{
+		"eth_getBlockByHash": `{"baseFeePerGas":"0x3b9aca00"}`,
+	})
+	fees, err := tx.GetFees(context.Background(), rpc)
+	assert.NoError(err)
+	assert.Equal("eth_getBlockByHash", rpc.MethodCapture)
+	assert.Equal(false, rpc.ArgsCapture[1])
+	assert.Equal("1500000000", fees.EffectiveGasPrice.String())
+	assert.Equal("31500000000000", fees.Fee.String())
+	assert.Equal("1000000000", fees.BaseFeePerGas.String())
+	assert.Equal("21000000000000", fees.BaseFee.String())
+	assert.Equal("10500000000000", fees.PriorityFee.String())
+}
+
+func TestGetFeesLegacyNode(t *testing.T) {
+	assert := assert.New(t)
+
+	// No effectiveGasPrice in the receipt, and no base fee in the block
+	tx := newTestFeesTxn(50000, nil)
+	rpc := newTestFeesRPC(nil, map[string]string{
+		"eth_getTransactionByHash": `{"gasPrice":"0x3e8"}`,
+		"eth_getBlockByHash":       `{"number":"0x1"}`,
+	})
+	fees, err := tx.GetFees(context.Background(), rpc)
+	assert.NoError(err)
+	assert.Equal("1000", fees.EffectiveGasPrice.String())
+	assert.Equal("50000000", fees.Fee.String())
+	assert.Nil(fees.BaseFeePerGas)
+	assert.Nil(fees.BaseFee)
+	assert.Nil(fees.PriorityFee)
+
+	// Without a block hash, there is no breakdown
+	tx.Receipt.BlockHash = nil
+	fees, err = tx.GetFees(context.Background(), rpc)
+	assert.NoError(err)
+	assert.Equal("eth_getTransactionByHash", rpc.MethodCapture)
+	assert.Nil(fees.BaseFee)
+}
+
+func TestGetFeesErrors(t *testing.T) {
+	assert := assert.New(t)
+
+	tx := newTestFeesTxn(21000, nil)
+	tx.Receipt.GasUsed = nil
+	_, err := tx.GetFees(context.Background(), newTestFeesRPC(nil, nil))
+	assert.Regexp("does not include the gas used", err)
+
+	tx = newTestFeesTxn(21000, nil)
+	_, err = tx.GetFees(context.Background(), newTestFeesRPC(fmt.Errorf("pop"), nil))
+	assert.Regexp("eth_getTransactionByHash.*pop", err)
+
+	_, err = tx.GetFees(context.Background(), newTestFeesRPC(nil, map[string]string{
+		"eth_getTransactionByHash": `{}`,
+	}))
+	assert.Regexp("Gas price of transaction 0xe22153.* not available", err)
+
+	tx = newTestFeesTxn(21000, big.NewInt(1))
+	_, err = tx.GetFees(context.Background(), newTestFeesRPC(fmt.Errorf("pop"), nil))
+	assert.Regexp("eth_getBlockByHash.*pop", err)
+}
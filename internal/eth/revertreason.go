@@ -0,0 +1,208 @@
+// Copyright 2021 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package eth
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+
+	ethbinding "github.com/kaleido-io/ethbinding/pkg"
+	"github.com/kaleido-io/ethconnect/internal/ethbind"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	panicFunctionSelector = "0x4e487b71" // the signature of Panic(uint256), raised by failed asserts and checks in Solidity ^0.8
+)
+
+// panicReasons describes the codes of Panic(uint256), from the Solidity documentation
+var panicReasons = map[uint64]string{
+	0x00: "Generic compiler panic",
+	0x01: "Assertion failed",
+	0x11: "Arithmetic overflow or underflow",
+	0x12: "Division or modulo by zero",
+	0x21: "Invalid enum value",
+	0x22: "Invalid encoding of storage byte array",
+	0x31: "Pop from an empty array",
+	0x32: "Array index out of bounds",
+	0x41: "Out of memory",
+	0x51: "Call to an uninitialized internal function",
+}
+
+// ErrorABIResolver looks up the custom errors of the ABI registered for a contract address,
+// so that the revert reason of a transaction can be decoded
+type ErrorABIResolver interface {
+	ResolveErrorABIs(addr *ethbinding.Address) ethbinding.ABIMarshaling
+}
+
+// rpcDataError is implemented by JSON/RPC errors that carry data, which is where nodes
+// such as geth return the output of a reverted eth_call
+type rpcDataError interface {
+	ErrorData() interface{}
+}
+
+// ErrorABIs returns the custom error definitions from an ABI
+func ErrorABIs(abi ethbinding.ABIMarshaling) ethbinding.ABIMarshaling {
+	var errorABIs ethbinding.ABIMarshaling
+	for _, element := range abi {
+		if element.Type == "error" {
+			errorABIs = append(errorABIs, element)
+		}
+	}
+	return errorABIs
+}
+
+// RuntimeABI parses an ABI for use at runtime. The custom errors are left out, as the ABI
+// parser does not support them - they are decoded separately when a call reverts
+func RuntimeABI(abi ethbinding.ABIMarshaling) (*ethbinding.RuntimeABI, error) {
+	runtimeElements := make(ethbinding.ABIMarshaling, 0, len(abi))
+	for _, element := range abi {
+		if element.Type != "error" {
+			runtimeElements = append(runtimeElements, element)
+		}
+	}
+	return ethbind.API.ABIMarshalingToABIRuntime(runtimeElements)
+}
+
+// errorSelector is the first 4 bytes of the hash of the signature of a custom error
+func errorSelector(name string, inputs ethbinding.ABIArguments) []byte {
+	types := make([]string, len(inputs))
+	for i, input := range inputs {
+		types[i] = input.Type.String()
+	}
+	return ethbind.Keccak256([]byte(name + "(" + strings.Join(types, ",") + ")"))[0:4]
+}
+
+// DecodeRevertReason decodes the data returned by a reverted call. Error(string) is decoded
+// to its message, Panic(uint256) to a description of the code, and custom errors of the ABI
+// to their name and arguments. Data that cannot be decoded is returned as hex
+func DecodeRevertReason(data []byte, errorABIs ethbinding.ABIMarshaling) string {
+	if reason, ok := decodeRevertReason(data, errorABIs); ok {
+		return reason
+	}
+	if len(data) == 0 {
+		return ""
+	}
+	return ethbind.API.HexEncode(data)
+}
+
+func decodeRevertReason(data []byte, errorABIs ethbinding.ABIMarshaling) (string, bool) {
+	if len(data) < 4 {
+		return "", false
+	}
+	selector := ethbind.API.HexEncode(data[0:4])
+	switch selector {
+	case errorFunctionSelector:
+		args := ethbinding.ABIArguments{{Name: "message", Type: ethbind.API.ABITypeKnown("string")}}
+		if values, err := args.UnpackValues(data[4:]); err == nil && len(values) == 1 {
+			return values[0].(string), true
+		}
+	case panicFunctionSelector:
+		args := ethbinding.ABIArguments{{Name: "code", Type: ethbind.API.ABITypeKnown("uint256")}}
+		if values, err := args.UnpackValues(data[4:]); err == nil && len(values) == 1 {
+			code := values[0].(*big.Int)
+			if reason, ok := panicReasons[code.Uint64()]; code.IsUint64() && ok {
+				return fmt.Sprintf("Panic(0x%x): %s", code, reason), true
+			}
+			return fmt.Sprintf("Panic(0x%x)", code), true
+		}
+	default:
+		for i := range errorABIs {
+			inputs, err := ethbind.API.ABIArgumentsMarshalingToABIArguments(errorABIs[i].Inputs)
+			if err != nil {
+				log.Warnf("Invalid custom error '%s' in ABI: %s", errorABIs[i].Name, err)
+				continue
+			}
+			if bytes.Equal(errorSelector(errorABIs[i].Name, inputs), data[0:4]) {
+				if len(inputs) == 0 {
+					return errorABIs[i].Name + "()", true
+				}
+				values, _ := json.Marshal(ProcessRLPBytes(inputs, data[4:]))
+				return fmt.Sprintf("%s(%s)", errorABIs[i].Name, values), true
+			}
+		}
+	}
+	return "", false
+}
+
+// revertData extracts the output of a reverted eth_call, which depending on the node is
+// either the result of the call, or the data of the error
+func revertData(result string, err error) []byte {
+	if err != nil {
+		if dataErr, ok := err.(rpcDataError); ok {
+			if hexData, ok := dataErr.ErrorData().(string); ok {
+				result = hexData
+			}
+		}
+	}
+	data, _ := ethbind.API.HexDecode(result)
+	return data
+}
+
+// RevertReason replays a mined transaction that failed with eth_call at the block it was
+// mined in, and decodes the reason it reverted. Custom errors are decoded against the ABI
+// supplied with the transaction, then the ABI the resolver finds for the contract.
+// An empty string is returned if the reason cannot be found, for example when the node
+// no longer holds the state of the block
+func (tx *Txn) RevertReason(ctx context.Context, rpc RPCClient, resolver ErrorABIResolver) string {
+	if tx.Receipt.BlockNumber == nil {
+		return ""
+	}
+	txArgs := tx.sendTXArgs()
+	gas := ethbinding.HexUint64(tx.EthTX.Gas())
+	txArgs.Gas = &gas
+
+	errorABIs := append(ethbinding.ABIMarshaling{}, tx.Errors...)
+	if to := tx.EthTX.To(); resolver != nil && to != nil {
+		errorABIs = append(errorABIs, resolver.ResolveErrorABIs(to)...)
+	}
+	return ReplayRevertReason(ctx, rpc, tx.Hash, txArgs, tx.Receipt.BlockNumber.ToInt(), errorABIs)
+}
+
+// ReplayRevertReason replays the arguments of a transaction with eth_call at a block, and
+// decodes the reason the replay reverted. An empty string is returned if the replay fails
+// without data, or succeeds
+func ReplayRevertReason(ctx context.Context, rpc RPCClient, hash string, txArgs *SendTXArgs, blockNumber *big.Int, errorABIs ethbinding.ABIMarshaling) string {
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	var result string
+	err := rpc.CallContext(ctx, &result, "eth_call", txArgs, ethbind.API.EncodeBig(blockNumber))
+	data := revertData(result, err)
+	if len(data) == 0 {
+		if err != nil {
+			log.Warnf("Failed to replay %s to find the revert reason: %s", hash, err)
+		}
+		return ""
+	}
+
+	reason, ok := decodeRevertReason(data, errorABIs)
+	if !ok {
+		if err == nil {
+			// Some nodes return the revert data as the result, but here the replay succeeded,
+			// as the state at the end of the block differs from when the transaction ran
+			log.Warnf("Replay of %s did not revert, so the revert reason is not known", hash)
+			return ""
+		}
+		reason = ethbind.API.HexEncode(data)
+	}
+	log.Infof("Transaction %s reverted: %s", hash, reason)
+	return reason
+}
@@ -0,0 +1,249 @@
+// Copyright 2021 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package eth
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"testing"
+
+	ethbinding "github.com/kaleido-io/ethbinding/pkg"
+	"github.com/kaleido-io/ethconnect/internal/ethbind"
+	"github.com/kaleido-io/ethconnect/internal/messages"
+	"github.com/stretchr/testify/assert"
+)
+
+const testErrorABI = `[
+	{"type":"function","name":"transfer","inputs":[{"name":"amount","type":"uint256"}]},
+	{"type":"error","name":"InsufficientBalance","inputs":[{"name":"available","type":"uint256"},{"name":"required","type":"uint256"}]}
+]`
+
+type testRevertRPCError struct {
+	data interface{}
+}
+
+func (e *testRevertRPCError) Error() string {
+	return "execution reverted"
+}
+
+func (e *testRevertRPCError) ErrorData() interface{} {
+	return e.data
+}
+
+type testErrorABIResolver struct {
+	errors ethbinding.ABIMarshaling
+}
+
+func (r *testErrorABIResolver) ResolveErrorABIs(addr *ethbinding.Address) ethbinding.ABIMarshaling {
+	return r.errors
+}
+
+func testErrorABIs(t *testing.T) ethbinding.ABIMarshaling {
+	var abi ethbinding.ABIMarshaling
+	assert.NoError(t, json.Unmarshal([]byte(testErrorABI), &abi))
+	return ErrorABIs(abi)
+}
+
+func testRevertData(t *testing.T, selector string, argTypes []string, values ...interface{}) []byte {
+	args := ethbinding.ABIArguments{}
+	for _, argType := range argTypes {
+		args = append(args, ethbinding.ABIArgument{Type: ethbind.API.ABITypeKnown(argType)})
+	}
+	packed, err := args.Pack(values...)
+	assert.NoError(t, err)
+	data, err := ethbind.API.HexDecode(selector)
+	assert.NoError(t, err)
+	return append(data, packed...)
+}
+
+func newTestRevertedTxn(t *testing.T) *Txn {
+	var msg messages.SendTransaction
+	msg.MethodName = "testFunc"
+	msg.To = "0x2b8c0ECc76d0759a8F50b2E14A6881367D805832"
+	msg.From = "0xAA983AD2a0e0eD8ac639277F37be42F2A5d2618c"
+	msg.Nonce = "123"
+	msg.Value = "0"
+	msg.Gas = "456"
+	msg.GasPrice = "789"
+	tx, err := NewSendTxn(&msg, nil)
+	assert.NoError(t, err)
+	blockNumber := ethbinding.HexBigInt(*big.NewInt(12345))
+	tx.Receipt.BlockNumber = &blockNumber
+	return tx
+}
+
+func TestErrorABIs(t *testing.T) {
+	assert := assert.New(t)
+	errorABIs := testErrorABIs(t)
+	assert.Equal(1, len(errorABIs))
+	assert.Equal("InsufficientBalance", errorABIs[0].Name)
+
+	inputs, err := ethbind.API.ABIArgumentsMarshalingToABIArguments(errorABIs[0].Inputs)
+	assert.NoError(err)
+	assert.Equal("0xcf479181", ethbind.API.HexEncode(errorSelector(errorABIs[0].Name, inputs)))
+}
+
+func TestDecodeRevertReasonErrorString(t *testing.T) {
+	assert := assert.New(t)
+	data := testRevertData(t, errorFunctionSelector, []string{"string"}, "Not enough funds")
+	assert.Equal("Not enough funds", DecodeRevertReason(data, nil))
+}
+
+func TestDecodeRevertReasonPanic(t *testing.T) {
+	assert := assert.New(t)
+	data := testRevertData(t, panicFunctionSelector, []string{"uint256"}, big.NewInt(0x11))
+	assert.Equal("Panic(0x11): Arithmetic overflow or underflow", DecodeRevertReason(data, nil))
+	data = testRevertData(t, panicFunctionSelector, []string{"uint256"}, big.NewInt(0x99))
+	assert.Equal("Panic(0x99)", DecodeRevertReason(data, nil))
+}
+
+func TestDecodeRevertReasonCustomError(t *testing.T) {
+	assert := assert.New(t)
+	data := testRevertData(t, "0xcf479181", []string{"uint256", "uint256"}, big.NewInt(10), big.NewInt(20))
+	assert.Equal(`InsufficientBalance({"available":"10","required":"20"})`, DecodeRevertReason(data, testErrorABIs(t)))
+	assert.Equal(ethbind.API.HexEncode(data), DecodeRevertReason(data, nil))
+}
+
+func TestDecodeRevertReasonUndecodable(t *testing.T) {
+	assert := assert.New(t)
+	assert.Equal("", DecodeRevertReason([]byte{}, nil))
+	assert.Equal("0x0102", DecodeRevertReason([]byte{0x01, 0x02}, nil))
+
+	// A truncated Error(string) is returned as hex
+	data := testRevertData(t, errorFunctionSelector, []string{"string"}, "Not enough funds")[0:40]
+	assert.Equal(ethbind.API.HexEncode(data), DecodeRevertReason(data, nil))
+
+	var badABI ethbinding.ABIMarshaling
+	json.Unmarshal([]byte(`[{"type":"error","name":"Bad","inputs":[{"name":"x","type":"badness"}]}]`), &badABI)
+	assert.Equal("0x01020304", DecodeRevertReason([]byte{0x01, 0x02, 0x03, 0x04}, badABI))
+}
+
+func TestRevertReasonFromErrorData(t *testing.T) {
+	assert := assert.New(t)
+	tx := newTestRevertedTxn(t)
+	data := testRevertData(t, "0xcf479181", []string{"uint256", "uint256"}, big.NewInt(10), big.NewInt(20))
+	rpc := &testRPCClient{
+		mockError: &testRevertRPCError{data: ethbind.API.HexEncode(data)},
+	}
+	reason := tx.RevertReason(context.Background(), rpc, &testErrorABIResolver{errors: testErrorABIs(t)})
+	assert.Equal(`InsufficientBalance({"available":"10","required":"20"})`, reason)
+	assert.Equal("eth_call", rpc.capturedMethod)
+	assert.Equal("0x3039", rpc.capturedArgs[1])
+	txArgs := rpc.capturedArgs[0].(*SendTXArgs)
+	assert.Equal("0x2b8c0ECc76d0759a8F50b2E14A6881367D805832", txArgs.To)
+	assert.Equal(uint64(456), uint64(*txArgs.Gas))
+}
+
+func TestRevertReasonFromResult(t *testing.T) {
+	assert := assert.New(t)
+	tx := newTestRevertedTxn(t)
+	data := testRevertData(t, errorFunctionSelector, []string{"string"}, "Not enough funds")
+	rpc := &testRPCClient{
+		resultWrangler: func(result interface{}) {
+			*(result.(*string)) = ethbind.API.HexEncode(data)
+		},
+	}
+	assert.Equal("Not enough funds", tx.RevertReason(context.Background(), rpc, nil))
+}
+
+func TestRevertReasonReplaySucceeded(t *testing.T) {
+	assert := assert.New(t)
+	tx := newTestRevertedTxn(t)
+	rpc := &testRPCClient{
+		resultWrangler: func(result interface{}) {
+			*(result.(*string)) = "0x0000000000000000000000000000000000000000000000000000000000000001"
+		},
+	}
+	assert.Equal("", tx.RevertReason(context.Background(), rpc, nil))
+}
+
+func TestRevertReasonUndecodableErrorData(t *testing.T) {
+	assert := assert.New(t)
+	tx := newTestRevertedTxn(t)
+	rpc := &testRPCClient{
+		mockError: &testRevertRPCError{data: "0x01020304"},
+	}
+	assert.Equal("0x01020304", tx.RevertReason(context.Background(), rpc, &testErrorABIResolver{}))
+}
+
+func TestRevertReasonReplayFailed(t *testing.T) {
+	assert := assert.New(t)
+	tx := newTestRevertedTxn(t)
+	rpc := &testRPCClient{
+		mockError: fmt.Errorf("missing trie node"),
+	}
+	assert.Equal("", tx.RevertReason(context.Background(), rpc, nil))
+
+	tx.Receipt.BlockNumber = nil
+	rpc = &testRPCClient{}
+	assert.Equal("", tx.RevertReason(context.Background(), rpc, nil))
+	assert.Equal("", rpc.capturedMethod)
+}
+
+func TestRuntimeABIIgnoresErrors(t *testing.T) {
+	assert := assert.New(t)
+	var abi ethbinding.ABIMarshaling
+	assert.NoError(json.Unmarshal([]byte(testErrorABI), &abi))
+	_, err := ethbind.API.ABIMarshalingToABIRuntime(abi)
+	assert.Error(err)
+	runtimeABI, err := RuntimeABI(abi)
+	assert.NoError(err)
+	assert.Contains(runtimeABI.Methods, "transfer")
+	assert.Equal(2, len(abi))
+}
+
+func TestCallRevertCustomErrorData(t *testing.T) {
+	assert := assert.New(t)
+	tx := newTestRevertedTxn(t)
+	tx.Errors = testErrorABIs(t)
+	data := testRevertData(t, "0xcf479181", []string{"uint256", "uint256"}, big.NewInt(10), big.NewInt(20))
+	rpc := &testRPCClient{
+		mockError: &testRevertRPCError{data: ethbind.API.HexEncode(data)},
+	}
+	_, err := tx.Call(context.Background(), rpc, "latest")
+	assert.EqualError(err, `InsufficientBalance({"available":"10","required":"20"})`)
+
+	rpc = &testRPCClient{
+		mockError: &testRevertRPCError{data: "0x"},
+	}
+	_, err = tx.Call(context.Background(), rpc, "latest")
+	assert.EqualError(err, "Call failed: execution reverted")
+}
+
+func TestCallRevertCustomErrorResult(t *testing.T) {
+	assert := assert.New(t)
+	tx := newTestRevertedTxn(t)
+	tx.Errors = testErrorABIs(t)
+	data := testRevertData(t, "0xcf479181", []string{"uint256", "uint256"}, big.NewInt(10), big.NewInt(20))
+	rpc := &testRPCClient{
+		resultWrangler: func(result interface{}) {
+			*(result.(*string)) = ethbind.API.HexEncode(data)
+		},
+	}
+	_, err := tx.Call(context.Background(), rpc, "latest")
+	assert.EqualError(err, `InsufficientBalance({"available":"10","required":"20"})`)
+
+	// Outputs that happen to start with the selector are not mistaken for an error
+	rpc = &testRPCClient{
+		resultWrangler: func(result interface{}) {
+			*(result.(*string)) = ethbind.API.HexEncode(data[0:64])
+		},
+	}
+	res, err := tx.Call(context.Background(), rpc, "latest")
+	assert.NoError(err)
+	assert.Equal(data[0:64], res)
+}
@@ -22,7 +22,6 @@ import (
 	ethbinding "github.com/kaleido-io/ethbinding/pkg"
 	"github.com/kaleido-io/ethconnect/internal/auth"
 	"github.com/kaleido-io/ethconnect/internal/errors"
-	"github.com/kaleido-io/ethconnect/internal/ethbind"
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 )
@@ -36,29 +35,70 @@ type RPCConf struct {
 	RPC RPCConnOpts `json:"rpc"`
 }
 
-// RPCConnOpts configuration params
+// RPCConnOpts configuration params. Additional URLs are other nodes of the same chain,
+// that calls fail over to if the connection to a node fails
 type RPCConnOpts struct {
-	URL string `json:"url"`
+	URL       string          `json:"url"`
+	URLs      []string        `json:"urls,omitempty"`
+	Failover  RPCFailoverConf `json:"failover,omitempty"`
+	ChainHead ChainHeadConf   `json:"chainHead,omitempty"`
+	Proxy     RPCProxyConf    `json:"proxy,omitempty"`
+	Multicall MulticallConf   `json:"multicall,omitempty"`
 }
 
 // RPCConnect wraps rpc.Dial with useful logging, avoiding logging username/password
 func RPCConnect(conf *RPCConnOpts) (RPCClientAll, error) {
+	if len(conf.URLs) > 0 {
+		pool, err := newRPCPool(conf)
+		if err != nil {
+			return nil, err
+		}
+		return withTracing(withMulticall(conf, pool))
+	}
 	u, _ := url.Parse(conf.URL)
 	if u.User != nil {
 		u.User = url.UserPassword(u.User.Username(), "xxxxxx")
 	}
-	rpcClient, err := ethbind.API.Dial(conf.URL)
+	rpcClient, err := dialRPC(conf, conf.URL)
 	if err != nil {
 		return nil, errors.Errorf(errors.RPCConnectFailed, u, err)
 	}
 	log.Infof("New JSON/RPC connection established")
 	log.Debugf("JSON/RPC connected to %s", u)
-	return &rpcWrapper{rpc: rpcClient}, nil
+	return withTracing(withMulticall(conf, &rpcWrapper{rpc: rpcClient}))
+}
+
+// withMulticall adds the chain head tracker, and the aggregation of calls if enabled, in front of the connection
+func withMulticall(conf *RPCConnOpts, rpc RPCClientAll) (RPCClientAll, error) {
+	rpc, err := withChainHead(conf, rpc)
+	if err != nil || !conf.Multicall.Enabled {
+		return rpc, err
+	}
+	mc, err := newMulticallRPC(&conf.Multicall, rpc)
+	if err != nil {
+		rpc.Close()
+		return nil, err
+	}
+	return mc, nil
+}
+
+func withChainHead(conf *RPCConnOpts, rpc RPCClientAll) (RPCClientAll, error) {
+	if conf.ChainHead.Disabled {
+		return rpc, nil
+	}
+	ch, err := newChainHead(&conf.ChainHead, rpc)
+	if err != nil {
+		rpc.Close()
+		return nil, err
+	}
+	return ch, nil
 }
 
 // CobraInitRPC sets the standard command-line parameters for RPC
 func CobraInitRPC(cmd *cobra.Command, rconf *RPCConf) {
 	cmd.Flags().StringVarP(&rconf.RPC.URL, "rpc-url", "r", os.Getenv("ETH_RPC_URL"), "JSON/RPC URL for Ethereum node")
+	cmd.Flags().StringSliceVar(&rconf.RPC.URLs, "rpc-failover-urls", nil, "JSON/RPC URLs of other nodes of the same chain, to fail over to")
+	cmd.Flags().StringVar(&rconf.RPC.Proxy.URL, "rpc-proxy-url", os.Getenv("ETH_RPC_PROXY_URL"), "SOCKS5 or HTTP CONNECT proxy to tunnel JSON/RPC connections through")
 	return
 }
 
@@ -59,8 +59,12 @@ func TestCobraInitTxnProcessor(t *testing.T) {
 	CobraInitRPC(cmd, rconf)
 	cmd.ParseFlags([]string{
 		"-r", "http://localhost:8545",
+		"--rpc-failover-urls", "http://node2:8545,http://node3:8545",
+		"--rpc-proxy-url", "socks5://localhost:1080",
 	})
 	assert.Equal("http://localhost:8545", rconf.RPC.URL)
+	assert.Equal([]string{"http://node2:8545", "http://node3:8545"}, rconf.RPC.URLs)
+	assert.Equal("socks5://localhost:1080", rconf.RPC.Proxy.URL)
 }
 
 func TestRPCConnectOK(t *testing.T) {
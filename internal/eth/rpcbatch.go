@@ -0,0 +1,157 @@
+// Copyright 2021 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package eth
+
+import (
+	"context"
+	"reflect"
+
+	"github.com/kaleido-io/ethconnect/internal/auth"
+	"github.com/kaleido-io/ethconnect/internal/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// RPCBatchElem is a single call in a JSON/RPC batch. Result must be a pointer, and
+// Error is set if the node returned an error for this call
+type RPCBatchElem struct {
+	Method string
+	Args   []interface{}
+	Result interface{}
+	Error  error
+}
+
+// RPCClientBatch is implemented by connections that can send a set of calls to the
+// node in a single JSON/RPC batch request
+type RPCClientBatch interface {
+	BatchCallContext(ctx context.Context, batch []*RPCBatchElem) error
+}
+
+// BatchCall sends the calls in a single JSON/RPC batch if the connection supports it, or
+// one at a time if not. The outcome of each call is set on its element, and an error is
+// only returned if the batch as a whole could not be sent
+func BatchCall(ctx context.Context, rpc RPCClient, batch []*RPCBatchElem) error {
+	if len(batch) == 0 {
+		return nil
+	}
+	if b, ok := rpc.(RPCClientBatch); ok {
+		return b.BatchCallContext(ctx, batch)
+	}
+	for _, elem := range batch {
+		elem.Error = rpc.CallContext(ctx, elem.Result, elem.Method, elem.Args...)
+	}
+	return nil
+}
+
+func authRPCBatch(ctx context.Context, batch []*RPCBatchElem) error {
+	for _, elem := range batch {
+		if err := auth.AuthRPC(ctx, elem.Method, elem.Args...); err != nil {
+			log.Errorf("JSON/RPC %s - not authorized: %s", elem.Method, err)
+			return errors.Errorf(errors.Unauthorized)
+		}
+	}
+	return nil
+}
+
+// batchCallClient sends a batch over a connection to a node. The batch element type of the
+// go-ethereum RPC client is not part of the ethbinding API, so the batch is built with
+// reflection against the BatchCallContext method of the connection
+func batchCallClient(ctx context.Context, client rcpClient, batch []*RPCBatchElem) error {
+	if t, ok := client.(*tunnelledRPC); ok {
+		client = t.rcpClient
+	}
+	if sent, err := reflectBatchCall(ctx, client, batch); sent {
+		return err
+	}
+	for _, elem := range batch {
+		elem.Error = client.CallContext(ctx, elem.Result, elem.Method, elem.Args...)
+	}
+	return nil
+}
+
+// reflectBatchCall calls a method with the signature BatchCallContext(context.Context, []T) error,
+// where T is a struct with Method, Args, Result and Error fields. It returns false if the client
+// has no such method
+func reflectBatchCall(ctx context.Context, client interface{}, batch []*RPCBatchElem) (bool, error) {
+	method := reflect.ValueOf(client).MethodByName("BatchCallContext")
+	if !method.IsValid() {
+		return false, nil
+	}
+	mType := method.Type()
+	if mType.NumIn() != 2 || mType.NumOut() != 1 || mType.In(1).Kind() != reflect.Slice || mType.In(1).Elem().Kind() != reflect.Struct {
+		return false, nil
+	}
+	elemType := mType.In(1).Elem()
+	for _, field := range []string{"Method", "Args", "Result", "Error"} {
+		if _, ok := elemType.FieldByName(field); !ok {
+			return false, nil
+		}
+	}
+	elems := reflect.MakeSlice(mType.In(1), len(batch), len(batch))
+	for i, b := range batch {
+		elem := elems.Index(i)
+		elem.FieldByName("Method").SetString(b.Method)
+		elem.FieldByName("Args").Set(reflect.ValueOf(b.Args))
+		if b.Result != nil {
+			elem.FieldByName("Result").Set(reflect.ValueOf(b.Result))
+		}
+	}
+	out := method.Call([]reflect.Value{reflect.ValueOf(ctx), elems})
+	for i, b := range batch {
+		if errVal := elems.Index(i).FieldByName("Error"); !errVal.IsNil() {
+			b.Error = errVal.Interface().(error)
+		}
+	}
+	if errVal := out[0]; !errVal.IsNil() {
+		return true, errVal.Interface().(error)
+	}
+	return true, nil
+}
+
+func (w *rpcWrapper) BatchCallContext(ctx context.Context, batch []*RPCBatchElem) error {
+	if err := authRPCBatch(ctx, batch); err != nil {
+		return err
+	}
+	log.Tracef("RPC batch of %d calls -->", len(batch))
+	return batchCallClient(ctx, w.rpc, batch)
+}
+
+func (c *chainHead) BatchCallContext(ctx context.Context, batch []*RPCBatchElem) error {
+	return BatchCall(ctx, c.rpc, batch)
+}
+
+func (m *multicallRPC) BatchCallContext(ctx context.Context, batch []*RPCBatchElem) error {
+	return BatchCall(ctx, m.rpc, batch)
+}
+
+// BatchCallContext sends the batch to the first healthy node that is not pinned for sends,
+// failing over like any other call that only reads the chain
+func (p *rpcPool) BatchCallContext(ctx context.Context, batch []*RPCBatchElem) error {
+	if err := authRPCBatch(ctx, batch); err != nil {
+		return err
+	}
+	var err error
+	for _, node := range p.candidates(false) {
+		log.Tracef("RPC batch of %d calls --> %s", len(batch), node.url)
+		err = batchCallClient(ctx, node.rpc, batch)
+		if !isConnectionError(ctx, err) {
+			if ctx.Err() == nil {
+				p.setHealth(node, true, nil)
+			}
+			return err
+		}
+		p.setHealth(node, false, err)
+	}
+	return err
+}
@@ -0,0 +1,188 @@
+// Copyright 2021 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package eth
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	ethbinding "github.com/kaleido-io/ethbinding/pkg"
+	"github.com/kaleido-io/ethconnect/internal/auth"
+	"github.com/kaleido-io/ethconnect/internal/auth/authtest"
+	"github.com/stretchr/testify/assert"
+)
+
+// newTestBatchServer replies to each call in a JSON/RPC batch with the method name, or an
+// error for eth_fail, and counts the HTTP requests
+func newTestBatchServer(requests *int) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		*requests++
+		var batch []map[string]interface{}
+		json.NewDecoder(req.Body).Decode(&batch)
+		replies := make([]map[string]interface{}, len(batch))
+		for i, call := range batch {
+			replies[i] = map[string]interface{}{"jsonrpc": "2.0", "id": call["id"]}
+			if call["method"] == "eth_fail" {
+				replies[i]["error"] = map[string]interface{}{"code": -32000, "message": "pop"}
+			} else {
+				replies[i]["result"] = call["method"]
+			}
+		}
+		res.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(res).Encode(replies)
+	}))
+}
+
+func TestBatchCallSingleRequest(t *testing.T) {
+	assert := assert.New(t)
+	var requests int
+	svr := newTestBatchServer(&requests)
+	defer svr.Close()
+
+	rpc, err := RPCConnect(&RPCConnOpts{URL: svr.URL})
+	assert.NoError(err)
+	defer rpc.Close()
+
+	var r1, r2, r3 string
+	batch := []*RPCBatchElem{
+		{Method: "eth_getTransactionReceipt", Args: []interface{}{"0x11"}, Result: &r1},
+		{Method: "eth_fail", Result: &r2},
+		{Method: "eth_getTransactionReceipt", Args: []interface{}{"0x22"}, Result: &r3},
+	}
+	assert.NoError(BatchCall(context.Background(), rpc, batch))
+	assert.Equal(1, requests)
+	assert.Equal("eth_getTransactionReceipt", r1)
+	assert.NoError(batch[0].Error)
+	assert.Regexp("pop", batch[1].Error)
+	assert.Equal("eth_getTransactionReceipt", r3)
+}
+
+func TestBatchCallPool(t *testing.T) {
+	assert := assert.New(t)
+	var requests int
+	svr := newTestBatchServer(&requests)
+	defer svr.Close()
+
+	rpc, err := RPCConnect(&RPCConnOpts{URL: "http://localhost:1", URLs: []string{svr.URL}, ChainHead: ChainHeadConf{Disabled: true}})
+	assert.NoError(err)
+	defer rpc.Close()
+
+	var r1 string
+	batch := []*RPCBatchElem{{Method: "eth_blockNumber", Result: &r1}}
+	assert.NoError(BatchCall(context.Background(), rpc, batch))
+	assert.Equal("eth_blockNumber", r1)
+	assert.Equal(1, requests)
+}
+
+func TestBatchCallPoolAllFail(t *testing.T) {
+	rpc, err := RPCConnect(&RPCConnOpts{URL: "http://localhost:1", URLs: []string{"http://localhost:2"}, Multicall: MulticallConf{Enabled: true}})
+	assert.NoError(t, err)
+	defer rpc.Close()
+
+	var r1 string
+	err = BatchCall(context.Background(), rpc, []*RPCBatchElem{{Method: "eth_blockNumber", Result: &r1}})
+	assert.Error(t, err)
+}
+
+func TestBatchCallUnauthorized(t *testing.T) {
+	auth.RegisterSecurityModule(&authtest.TestSecurityModule{})
+	defer auth.RegisterSecurityModule(nil)
+
+	batch := []*RPCBatchElem{{Method: "eth_getTransactionReceipt"}}
+	w := &rpcWrapper{rpc: &mockEthClient{}}
+	assert.Regexp(t, "Unauthorized", w.BatchCallContext(context.Background(), batch))
+	p := &rpcPool{}
+	assert.Regexp(t, "Unauthorized", p.BatchCallContext(context.Background(), batch))
+}
+
+func TestBatchCallFallbackToSingleCalls(t *testing.T) {
+	assert := assert.New(t)
+	calls := 0
+	rpc := NewMockRPCClientForSync(fmt.Errorf("pop"), func(method string, res interface{}, args ...interface{}) {
+		calls++
+	})
+	// Only the CallContext of the mock is visible
+	var single RPCClient = struct{ RPCClient }{rpc}
+	batch := []*RPCBatchElem{{Method: "eth_a"}, {Method: "eth_b"}}
+	assert.NoError(BatchCall(context.Background(), single, batch))
+	assert.Equal(2, calls)
+	assert.Regexp("pop", batch[1].Error)
+	assert.Equal(0, rpc.BatchCount)
+
+	// The wrapper falls back too, if the connection cannot send batches
+	w := &rpcWrapper{rpc: &mockEthClient{}}
+	assert.NoError(w.BatchCallContext(context.Background(), batch))
+	assert.Nil(batch[0].Error)
+
+	assert.NoError(BatchCall(context.Background(), rpc, nil))
+}
+
+type testBatchElemMissingField struct {
+	Method string
+}
+
+type testBadBatchClient struct{}
+
+func (c *testBadBatchClient) BatchCallContext(ctx context.Context, b []testBatchElemMissingField) error {
+	return nil
+}
+
+type testBatchElem struct {
+	Method string
+	Args   []interface{}
+	Result interface{}
+	Error  error
+}
+
+type testBatchClient struct {
+	err error
+}
+
+func (c *testBatchClient) BatchCallContext(ctx context.Context, b []testBatchElem) error {
+	for i := range b {
+		if b[i].Result == nil {
+			b[i].Error = fmt.Errorf("no result")
+		} else {
+			*(b[i].Result.(*ethbinding.HexUint64)) = ethbinding.HexUint64(len(b[i].Args))
+		}
+	}
+	return c.err
+}
+
+func TestReflectBatchCall(t *testing.T) {
+	assert := assert.New(t)
+
+	var r1 ethbinding.HexUint64
+	batch := []*RPCBatchElem{{Method: "eth_a", Args: []interface{}{1, 2}, Result: &r1}, {Method: "eth_b"}}
+	sent, err := reflectBatchCall(context.Background(), &testBatchClient{}, batch)
+	assert.True(sent)
+	assert.NoError(err)
+	assert.Equal(ethbinding.HexUint64(2), r1)
+	assert.NoError(batch[0].Error)
+	assert.Regexp("no result", batch[1].Error)
+
+	sent, err = reflectBatchCall(context.Background(), &testBatchClient{err: fmt.Errorf("pop")}, batch)
+	assert.True(sent)
+	assert.Regexp("pop", err)
+
+	sent, _ = reflectBatchCall(context.Background(), &testBadBatchClient{}, batch)
+	assert.False(sent)
+	sent, _ = reflectBatchCall(context.Background(), &mockEthClient{}, batch)
+	assert.False(sent)
+}
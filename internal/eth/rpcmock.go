@@ -47,6 +47,7 @@ type MockRPCClient struct {
 	SubResult     *MockRPCSubscription
 	MethodCapture string
 	ArgsCapture   []interface{}
+	BatchCount    int
 	Closed        bool
 }
 
@@ -81,6 +82,15 @@ func (m *MockRPCClient) CallContext(ctx context.Context, result interface{}, met
 	return m.callError
 }
 
+// BatchCallContext invokes the supplied result wranger for each call, and counts the batches
+func (m *MockRPCClient) BatchCallContext(ctx context.Context, batch []*RPCBatchElem) error {
+	m.BatchCount++
+	for _, elem := range batch {
+		elem.Error = m.CallContext(ctx, elem.Result, elem.Method, elem.Args...)
+	}
+	return nil
+}
+
 // Subscribe returns the subscription already configured in the mock
 func (m *MockRPCClient) Subscribe(ctx context.Context, namespace string, channel interface{}, args ...interface{}) (RPCClientSubscription, error) {
 	m.SubResult.Namespace = namespace
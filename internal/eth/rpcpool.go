@@ -0,0 +1,277 @@
+// Copyright 2021 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package eth
+
+import (
+	"context"
+	goerrors "errors"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kaleido-io/ethconnect/internal/auth"
+	"github.com/kaleido-io/ethconnect/internal/errors"
+	"github.com/kaleido-io/ethconnect/internal/opsevents"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	defaultRPCHealthCheckIntervalMS = 5000
+)
+
+// RPCFailoverConf configures how calls are spread across the nodes of a connection with
+// more than one JSON/RPC URL
+type RPCFailoverConf struct {
+	HealthCheckIntervalMS int  `json:"healthCheckInterval,omitempty"`
+	ReadWriteSplit        bool `json:"readWriteSplit,omitempty"`
+}
+
+// rpcNode is one of the nodes of a pool, with the health from its last call or health check
+type rpcNode struct {
+	url     string // password masked for logging
+	rpc     rcpClient
+	healthy bool
+}
+
+// rpcPool spreads the calls of a connection across a set of nodes of the same chain.
+// Calls go to the first healthy node, starting from the node that sends are pinned to, and
+// move to the next node if the connection to a node fails. With the read/write split, calls
+// that only read the chain are round-robined across the healthy nodes instead.
+// Nodes that fail are skipped until a background health check finds they have recovered.
+// Sends are only retried on another node if the request could not have reached the node,
+// as it is not known whether a send that failed part way through was accepted
+type rpcPool struct {
+	nodes               []*rpcNode
+	readWriteSplit      bool
+	healthCheckInterval time.Duration
+	mux                 sync.Mutex
+	writer              int
+	next                int
+	closed              chan struct{}
+	done                chan struct{}
+}
+
+// pinnedRPCMethodPrefixes are the calls that depend on state held by the node, such as
+// filters, the transaction pool and the accounts it manages, which must always go to the same node
+var pinnedRPCMethodPrefixes = []string{
+	"eth_send", "eth_sign", "eth_newFilter", "eth_newBlockFilter", "eth_newPendingTransactionFilter",
+	"eth_getFilter", "eth_uninstallFilter", "eth_getTransactionCount", "eth_accounts",
+	"eea_", "priv_", "personal_", "txpool_",
+}
+
+// sendRPCMethodPrefixes are the calls that submit transactions
+var sendRPCMethodPrefixes = []string{
+	"eth_send", "eea_send", "priv_distributeRawTransaction",
+}
+
+func rpcMethodMatches(method string, prefixes []string) bool {
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(method, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// maskRPCURL returns a URL that is safe to log, with any password masked
+func maskRPCURL(rpcURL string) string {
+	u, err := url.Parse(rpcURL)
+	if err != nil {
+		return ""
+	}
+	if u.User != nil {
+		u.User = url.UserPassword(u.User.Username(), "xxxxxx")
+	}
+	return u.String()
+}
+
+func newRPCPool(conf *RPCConnOpts) (*rpcPool, error) {
+	if conf.Failover.HealthCheckIntervalMS <= 0 {
+		conf.Failover.HealthCheckIntervalMS = defaultRPCHealthCheckIntervalMS
+	}
+	p := &rpcPool{
+		readWriteSplit:      conf.Failover.ReadWriteSplit,
+		healthCheckInterval: time.Duration(conf.Failover.HealthCheckIntervalMS) * time.Millisecond,
+		closed:              make(chan struct{}),
+		done:                make(chan struct{}),
+	}
+	for _, rpcURL := range append([]string{conf.URL}, conf.URLs...) {
+		masked := maskRPCURL(rpcURL)
+		rpcClient, err := dialRPC(conf, rpcURL)
+		if err != nil {
+			for _, node := range p.nodes {
+				node.rpc.Close()
+			}
+			return nil, errors.Errorf(errors.RPCConnectFailed, masked, err)
+		}
+		log.Debugf("JSON/RPC connected to %s", masked)
+		p.nodes = append(p.nodes, &rpcNode{url: masked, rpc: rpcClient, healthy: true})
+	}
+	log.Infof("New JSON/RPC connection established to %d nodes (read/write split=%t)", len(p.nodes), p.readWriteSplit)
+	go p.healthCheckLoop()
+	return p, nil
+}
+
+// isConnectionError returns true for errors from the connection to a node, rather than
+// errors returned by the node itself, or the cancellation of the call
+func isConnectionError(ctx context.Context, err error) bool {
+	if err == nil || ctx.Err() != nil {
+		return false
+	}
+	if _, isNodeError := err.(interface{ ErrorCode() int }); isNodeError {
+		return false
+	}
+	return true
+}
+
+// isNotDelivered returns true for connection errors where the request cannot have reached
+// the node, as the connection was never established
+func isNotDelivered(err error) bool {
+	var opErr *net.OpError
+	return goerrors.As(err, &opErr) && opErr.Op == "dial"
+}
+
+// candidates returns the nodes to try for a call, in order. Healthy nodes are tried first,
+// but unhealthy nodes are still tried as a last resort
+func (p *rpcPool) candidates(pinned bool) []*rpcNode {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+	start := p.writer
+	if !pinned && p.readWriteSplit {
+		start = p.next
+		p.next = (p.next + 1) % len(p.nodes)
+	}
+	healthy := make([]*rpcNode, 0, len(p.nodes))
+	var unhealthy []*rpcNode
+	for i := 0; i < len(p.nodes); i++ {
+		node := p.nodes[(start+i)%len(p.nodes)]
+		if node.healthy {
+			healthy = append(healthy, node)
+		} else {
+			unhealthy = append(unhealthy, node)
+		}
+	}
+	return append(healthy, unhealthy...)
+}
+
+// setHealth records the health of a node. If the node sends are pinned to fails, sends
+// move to the next healthy node, and stay there until that node fails in turn
+func (p *rpcPool) setHealth(node *rpcNode, healthy bool, err error) {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+	if node.healthy == healthy {
+		return
+	}
+	node.healthy = healthy
+	if healthy {
+		log.Infof("JSON/RPC node %s is available again", node.url)
+		opsevents.Publish(opsevents.RPCNodeAvailable, map[string]interface{}{"node": node.url})
+		return
+	}
+	log.Warnf("JSON/RPC node %s is unavailable: %s", node.url, err)
+	opsevents.Publish(opsevents.RPCNodeUnavailable, map[string]interface{}{"node": node.url, "error": err.Error()})
+	if p.nodes[p.writer] != node {
+		return
+	}
+	for i := 1; i < len(p.nodes); i++ {
+		idx := (p.writer + i) % len(p.nodes)
+		if p.nodes[idx].healthy {
+			log.Warnf("JSON/RPC sends moved from %s to %s", node.url, p.nodes[idx].url)
+			opsevents.Publish(opsevents.RPCFailover, map[string]interface{}{"from": node.url, "to": p.nodes[idx].url})
+			p.writer = idx
+			return
+		}
+	}
+}
+
+func (p *rpcPool) CallContext(ctx context.Context, result interface{}, method string, args ...interface{}) error {
+	if err := auth.AuthRPC(ctx, method, args...); err != nil {
+		log.Errorf("JSON/RPC %s - not authorized: %s", method, err)
+		return errors.Errorf(errors.Unauthorized)
+	}
+	isSend := rpcMethodMatches(method, sendRPCMethodPrefixes)
+	var err error
+	for _, node := range p.candidates(rpcMethodMatches(method, pinnedRPCMethodPrefixes)) {
+		log.Tracef("RPC [%s] --> %s %+v", method, node.url, args)
+		err = node.rpc.CallContext(ctx, result, method, args...)
+		log.Tracef("RPC [%s] <-- %s %+v", method, node.url, result)
+		if !isConnectionError(ctx, err) {
+			if ctx.Err() == nil {
+				p.setHealth(node, true, nil)
+			}
+			return err
+		}
+		p.setHealth(node, false, err)
+		if isSend && !isNotDelivered(err) {
+			return err
+		}
+	}
+	return err
+}
+
+func (p *rpcPool) Subscribe(ctx context.Context, namespace string, channel interface{}, args ...interface{}) (RPCClientSubscription, error) {
+	if err := auth.AuthRPCSubscribe(ctx, namespace, channel, args...); err != nil {
+		log.Errorf("JSON/RPC Subscribe - not authorized: %s", err)
+		return nil, errors.Errorf(errors.Unauthorized)
+	}
+	var err error
+	for _, node := range p.candidates(true) {
+		tSub, subErr := node.rpc.Subscribe(ctx, namespace, channel, args...)
+		if err = subErr; err == nil {
+			return &subWrapper{s: tSub}, nil
+		}
+		if !isConnectionError(ctx, err) {
+			return nil, err
+		}
+		p.setHealth(node, false, err)
+	}
+	return nil, err
+}
+
+// healthCheckLoop checks each node with eth_blockNumber, so that failed nodes are used
+// again once they recover
+func (p *rpcPool) healthCheckLoop() {
+	defer close(p.done)
+	ticker := time.NewTicker(p.healthCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.closed:
+			return
+		case <-ticker.C:
+			p.checkHealth()
+		}
+	}
+}
+
+func (p *rpcPool) checkHealth() {
+	for _, node := range p.nodes {
+		ctx, cancel := context.WithTimeout(context.Background(), p.healthCheckInterval)
+		var blockNumber interface{}
+		err := node.rpc.CallContext(ctx, &blockNumber, "eth_blockNumber")
+		cancel()
+		p.setHealth(node, err == nil || !isConnectionError(context.Background(), err), err)
+	}
+}
+
+func (p *rpcPool) Close() {
+	close(p.closed)
+	<-p.done
+	for _, node := range p.nodes {
+		node.rpc.Close()
+	}
+}
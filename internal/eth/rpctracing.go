@@ -0,0 +1,61 @@
+// Copyright 2021 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package eth
+
+import (
+	"context"
+
+	"github.com/kaleido-io/ethconnect/internal/tracing"
+)
+
+// tracedRPC emits a client span for each call to the node, as a child of the span of the
+// context of the call, such as the processing of a transaction
+type tracedRPC struct {
+	rpc RPCClientAll
+}
+
+// withTracing wraps the connection to trace calls, if tracing is enabled
+func withTracing(rpc RPCClientAll, err error) (RPCClientAll, error) {
+	if err != nil || !tracing.Enabled() {
+		return rpc, err
+	}
+	return &tracedRPC{rpc: rpc}, nil
+}
+
+func (t *tracedRPC) CallContext(ctx context.Context, result interface{}, method string, args ...interface{}) error {
+	ctx, span := tracing.Start(ctx, method, tracing.SpanKindClient)
+	span.SetAttribute("rpc.system", "jsonrpc")
+	span.SetAttribute("rpc.method", method)
+	err := t.rpc.CallContext(ctx, result, method, args...)
+	span.End(err)
+	return err
+}
+
+func (t *tracedRPC) BatchCallContext(ctx context.Context, batch []*RPCBatchElem) error {
+	ctx, span := tracing.Start(ctx, "batch", tracing.SpanKindClient)
+	span.SetAttribute("rpc.system", "jsonrpc")
+	span.SetAttribute("rpc.batch_size", len(batch))
+	err := BatchCall(ctx, t.rpc, batch)
+	span.End(err)
+	return err
+}
+
+func (t *tracedRPC) Subscribe(ctx context.Context, namespace string, channel interface{}, args ...interface{}) (RPCClientSubscription, error) {
+	return t.rpc.Subscribe(ctx, namespace, channel, args...)
+}
+
+func (t *tracedRPC) Close() {
+	t.rpc.Close()
+}
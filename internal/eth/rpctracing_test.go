@@ -0,0 +1,77 @@
+// Copyright 2021 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package eth
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/kaleido-io/ethconnect/internal/tracing"
+	"github.com/stretchr/testify/assert"
+)
+
+// spanCapturingRPC records the active span of the context of each call
+type spanCapturingRPC struct {
+	*MockRPCClient
+	spans []*tracing.Span
+}
+
+func (s *spanCapturingRPC) CallContext(ctx context.Context, result interface{}, method string, args ...interface{}) error {
+	s.spans = append(s.spans, tracing.SpanFromContext(ctx))
+	return s.MockRPCClient.CallContext(ctx, result, method, args...)
+}
+
+func (s *spanCapturingRPC) BatchCallContext(ctx context.Context, batch []*RPCBatchElem) error {
+	s.spans = append(s.spans, tracing.SpanFromContext(ctx))
+	return s.MockRPCClient.BatchCallContext(ctx, batch)
+}
+
+func TestWithTracingDisabled(t *testing.T) {
+	assert := assert.New(t)
+	assert.NoError(tracing.Configure(nil))
+	rpc := NewMockRPCClientForSync(nil, nil)
+	wrapped, err := withTracing(rpc, nil)
+	assert.NoError(err)
+	assert.Equal(rpc, wrapped)
+	_, err = withTracing(nil, fmt.Errorf("pop"))
+	assert.EqualError(err, "pop")
+}
+
+func TestTracedRPCCallsAreChildSpans(t *testing.T) {
+	assert := assert.New(t)
+	assert.NoError(tracing.Configure(&tracing.Conf{Enabled: true, Endpoint: "http://localhost:4318/v1/traces"}))
+	defer tracing.Configure(nil)
+
+	rpc := &spanCapturingRPC{MockRPCClient: NewMockRPCClientForAsync(nil)}
+	wrapped, err := withTracing(rpc, nil)
+	assert.NoError(err)
+
+	ctx, parent := tracing.Start(context.Background(), "txn", tracing.SpanKindInternal)
+	assert.NoError(wrapped.CallContext(ctx, nil, "eth_getTransactionCount"))
+	assert.NoError(BatchCall(ctx, wrapped, []*RPCBatchElem{{Method: "eth_getTransactionReceipt"}}))
+	assert.Equal(1, rpc.BatchCount)
+	assert.Len(rpc.spans, 2)
+	for _, s := range rpc.spans {
+		assert.NotNil(s)
+		assert.Equal(parent.Context().TraceID, s.Context().TraceID)
+		assert.NotEqual(parent.Context().SpanID, s.Context().SpanID)
+	}
+
+	_, err = wrapped.Subscribe(ctx, "eth", make(chan interface{}))
+	assert.NoError(err)
+	wrapped.Close()
+	assert.True(rpc.Closed)
+}
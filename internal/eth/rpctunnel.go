@@ -0,0 +1,320 @@
+// Copyright 2021 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package eth
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/kaleido-io/ethconnect/internal/errors"
+	"github.com/kaleido-io/ethconnect/internal/ethbind"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/proxy"
+)
+
+const (
+	defaultRPCProxyKeepAliveMS   = 30000
+	defaultRPCProxyDialTimeoutMS = 10000
+	defaultRPCProxyDialRetries   = 3
+	defaultRPCProxyRetryDelayMS  = 1000
+)
+
+// RPCProxyConf configures a proxy that the connections to the JSON/RPC nodes are tunnelled
+// through, for nodes that are only reachable through a bastion. The URL is a SOCKS5 proxy,
+// such as the dynamic forwarding of an SSH tunnel (socks5://localhost:1080), or an HTTP
+// proxy that supports CONNECT (http://proxy:3128). Credentials can be included in the URL
+type RPCProxyConf struct {
+	URL           string `json:"url,omitempty"`
+	KeepAliveMS   int    `json:"keepAlive,omitempty"`
+	DialTimeoutMS int    `json:"dialTimeout,omitempty"`
+	DialRetries   int    `json:"dialRetries,omitempty"`
+	RetryDelayMS  int    `json:"retryDelay,omitempty"`
+}
+
+// rpcTunnel listens on a local port, and forwards each connection to a JSON/RPC node through
+// the proxy. The node is dialed again for each new connection, so when a connection through
+// the proxy drops the RPC client reconnects through a new one. TLS to the node is originated
+// by the tunnel, so the RPC client connects to the local port without TLS
+type rpcTunnel struct {
+	listener   net.Listener
+	dialer     proxy.Dialer
+	target     string
+	tlsConfig  *tls.Config
+	retries    int
+	retryDelay time.Duration
+	nodeURL    string // password masked for logging
+	localURL   string
+	mux        sync.Mutex
+	conns      map[net.Conn]bool
+	done       chan struct{}
+}
+
+// httpConnectDialer dials through an HTTP proxy with the CONNECT method
+type httpConnectDialer struct {
+	proxyAddr string
+	auth      string
+	forward   proxy.Dialer
+}
+
+func (d *httpConnectDialer) Dial(network, addr string) (net.Conn, error) {
+	conn, err := d.forward.Dial(network, d.proxyAddr)
+	if err != nil {
+		return nil, err
+	}
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if d.auth != "" {
+		req.Header.Set("Proxy-Authorization", "Basic "+d.auth)
+	}
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	// The proxy does not send anything after the response until the node does, so it is
+	// safe to read the response through a buffer that is then discarded
+	res, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("proxy CONNECT to %s returned %s", addr, res.Status)
+	}
+	return conn, nil
+}
+
+func newRPCProxyDialer(conf *RPCProxyConf) (proxy.Dialer, error) {
+	u, err := url.Parse(conf.URL)
+	if err != nil || u.Host == "" {
+		return nil, errors.Errorf(errors.RPCProxyInvalidURL, maskRPCURL(conf.URL))
+	}
+	forward := &net.Dialer{
+		Timeout:   time.Duration(conf.DialTimeoutMS) * time.Millisecond,
+		KeepAlive: time.Duration(conf.KeepAliveMS) * time.Millisecond,
+	}
+	switch u.Scheme {
+	case "socks5", "socks5h":
+		var auth *proxy.Auth
+		if u.User != nil {
+			password, _ := u.User.Password()
+			auth = &proxy.Auth{User: u.User.Username(), Password: password}
+		}
+		return proxy.SOCKS5("tcp", u.Host, auth, forward)
+	case "http":
+		d := &httpConnectDialer{proxyAddr: u.Host, forward: forward}
+		if u.User != nil {
+			password, _ := u.User.Password()
+			d.auth = base64.StdEncoding.EncodeToString([]byte(u.User.Username() + ":" + password))
+		}
+		return d, nil
+	default:
+		return nil, errors.Errorf(errors.RPCProxyInvalidURL, maskRPCURL(conf.URL))
+	}
+}
+
+func newRPCTunnel(conf *RPCProxyConf, rpcURL string) (*rpcTunnel, error) {
+	if conf.KeepAliveMS <= 0 {
+		conf.KeepAliveMS = defaultRPCProxyKeepAliveMS
+	}
+	if conf.DialTimeoutMS <= 0 {
+		conf.DialTimeoutMS = defaultRPCProxyDialTimeoutMS
+	}
+	if conf.DialRetries <= 0 {
+		conf.DialRetries = defaultRPCProxyDialRetries
+	}
+	if conf.RetryDelayMS <= 0 {
+		conf.RetryDelayMS = defaultRPCProxyRetryDelayMS
+	}
+	dialer, err := newRPCProxyDialer(conf)
+	if err != nil {
+		return nil, err
+	}
+	t := &rpcTunnel{
+		dialer:     dialer,
+		retries:    conf.DialRetries,
+		retryDelay: time.Duration(conf.RetryDelayMS) * time.Millisecond,
+		nodeURL:    maskRPCURL(rpcURL),
+		conns:      make(map[net.Conn]bool),
+		done:       make(chan struct{}),
+	}
+	u, err := url.Parse(rpcURL)
+	if err != nil {
+		return nil, err
+	}
+	port := u.Port()
+	switch u.Scheme {
+	case "https", "wss":
+		t.tlsConfig = &tls.Config{ServerName: u.Hostname()}
+		if port == "" {
+			port = "443"
+		}
+		u.Scheme = map[string]string{"https": "http", "wss": "ws"}[u.Scheme]
+	case "http", "ws":
+		if port == "" {
+			port = "80"
+		}
+	default:
+		return nil, errors.Errorf(errors.RPCProxyUnsupportedScheme, u.Scheme)
+	}
+	t.target = net.JoinHostPort(u.Hostname(), port)
+	if t.listener, err = net.Listen("tcp", "127.0.0.1:0"); err != nil {
+		return nil, err
+	}
+	u.Host = t.listener.Addr().String()
+	t.localURL = u.String()
+	log.Infof("JSON/RPC connections to %s tunnelled through proxy %s", t.nodeURL, maskRPCURL(conf.URL))
+	go t.acceptLoop()
+	return t, nil
+}
+
+func (t *rpcTunnel) acceptLoop() {
+	defer close(t.done)
+	for {
+		conn, err := t.listener.Accept()
+		if err != nil {
+			log.Debugf("JSON/RPC tunnel to %s closed: %s", t.nodeURL, err)
+			return
+		}
+		go t.forward(conn)
+	}
+}
+
+// dialNode connects to the node through the proxy, retrying if the proxy cannot be reached
+// or fails to connect to the node
+func (t *rpcTunnel) dialNode() (conn net.Conn, err error) {
+	for attempt := 0; attempt <= t.retries; attempt++ {
+		if attempt > 0 {
+			log.Warnf("JSON/RPC tunnel to %s failed (attempt=%d): %s", t.nodeURL, attempt, err)
+			time.Sleep(t.retryDelay)
+		}
+		if conn, err = t.dialer.Dial("tcp", t.target); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if t.tlsConfig != nil {
+		tlsConn := tls.Client(conn, t.tlsConfig)
+		if err = tlsConn.Handshake(); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn = tlsConn
+	}
+	return conn, nil
+}
+
+func (t *rpcTunnel) track(conn net.Conn, active bool) bool {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	if t.conns == nil {
+		return false
+	}
+	if active {
+		t.conns[conn] = true
+	} else {
+		delete(t.conns, conn)
+	}
+	return true
+}
+
+func (t *rpcTunnel) forward(local net.Conn) {
+	defer local.Close()
+	if !t.track(local, true) {
+		return
+	}
+	defer t.track(local, false)
+	node, err := t.dialNode()
+	if err != nil {
+		log.Errorf("JSON/RPC tunnel to %s failed: %s", t.nodeURL, err)
+		return
+	}
+	defer node.Close()
+	if !t.track(node, true) {
+		return
+	}
+	defer t.track(node, false)
+	copied := make(chan struct{}, 2)
+	go func() {
+		io.Copy(node, local)
+		copied <- struct{}{}
+	}()
+	go func() {
+		io.Copy(local, node)
+		copied <- struct{}{}
+	}()
+	// When either side closes, close both so the other copy completes
+	<-copied
+}
+
+// Close stops the tunnel and closes its connections
+func (t *rpcTunnel) Close() {
+	t.listener.Close()
+	<-t.done
+	t.mux.Lock()
+	conns := t.conns
+	t.conns = nil
+	t.mux.Unlock()
+	for conn := range conns {
+		conn.Close()
+	}
+}
+
+// tunnelledRPC is an RPC client connected through a tunnel, that closes the tunnel with the client
+type tunnelledRPC struct {
+	rcpClient
+	tunnel *rpcTunnel
+}
+
+func (r *tunnelledRPC) Close() {
+	r.rcpClient.Close()
+	r.tunnel.Close()
+}
+
+// dialRPC connects to a JSON/RPC node, through the proxy if one is configured
+func dialRPC(conf *RPCConnOpts, rpcURL string) (rcpClient, error) {
+	if conf.Proxy.URL == "" {
+		rpcClient, err := ethbind.API.Dial(rpcURL)
+		if err != nil {
+			return nil, err
+		}
+		return rpcClient, nil
+	}
+	tunnel, err := newRPCTunnel(&conf.Proxy, rpcURL)
+	if err != nil {
+		return nil, err
+	}
+	rpcClient, err := ethbind.API.Dial(tunnel.localURL)
+	if err != nil {
+		tunnel.Close()
+		return nil, err
+	}
+	return &tunnelledRPC{rcpClient: rpcClient, tunnel: tunnel}, nil
+}
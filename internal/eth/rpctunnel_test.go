@@ -0,0 +1,280 @@
+// Copyright 2021 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package eth
+
+import (
+	"bufio"
+	"crypto/x509"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// testProxy is a minimal HTTP CONNECT or SOCKS5 proxy, that records the targets it connects to
+type testProxy struct {
+	listener net.Listener
+	mux      sync.Mutex
+	targets  []string
+	auth     []string
+	conns    []net.Conn
+	reject   bool
+}
+
+func newTestProxy(t *testing.T, socks bool) *testProxy {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	p := &testProxy{listener: l}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			p.mux.Lock()
+			p.conns = append(p.conns, conn)
+			p.mux.Unlock()
+			if socks {
+				go p.serveSOCKS(conn)
+			} else {
+				go p.serveCONNECT(conn)
+			}
+		}
+	}()
+	return p
+}
+
+func (p *testProxy) connect(client net.Conn, target, auth string) net.Conn {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+	p.targets = append(p.targets, target)
+	p.auth = append(p.auth, auth)
+	if p.reject {
+		return nil
+	}
+	node, err := net.Dial("tcp", target)
+	if err != nil {
+		return nil
+	}
+	p.conns = append(p.conns, node)
+	return node
+}
+
+func (p *testProxy) pipe(client, node net.Conn) {
+	go io.Copy(node, client)
+	io.Copy(client, node)
+	client.Close()
+	node.Close()
+}
+
+func (p *testProxy) serveCONNECT(client net.Conn) {
+	r := bufio.NewReader(client)
+	req, err := http.ReadRequest(r)
+	if err != nil {
+		client.Close()
+		return
+	}
+	node := p.connect(client, req.Host, req.Header.Get("Proxy-Authorization"))
+	if node == nil {
+		client.Write([]byte("HTTP/1.1 403 Forbidden\r\n\r\n"))
+		client.Close()
+		return
+	}
+	client.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+	p.pipe(client, node)
+}
+
+func (p *testProxy) serveSOCKS(client net.Conn) {
+	buf := make([]byte, 256)
+	// Greeting, accepting no authentication
+	io.ReadFull(client, buf[:2])
+	io.ReadFull(client, buf[:buf[1]])
+	client.Write([]byte{5, 0})
+	// Connect request, with an IPv4 address or a domain name
+	io.ReadFull(client, buf[:4])
+	var host string
+	switch buf[3] {
+	case 1:
+		io.ReadFull(client, buf[:4])
+		host = net.IP(buf[:4]).String()
+	case 3:
+		io.ReadFull(client, buf[:1])
+		l := int(buf[0])
+		io.ReadFull(client, buf[:l])
+		host = string(buf[:l])
+	}
+	io.ReadFull(client, buf[:2])
+	target := net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(buf[:2]))))
+	node := p.connect(client, target, "")
+	if node == nil {
+		client.Write([]byte{5, 5, 0, 1, 0, 0, 0, 0, 0, 0})
+		client.Close()
+		return
+	}
+	client.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+	p.pipe(client, node)
+}
+
+func (p *testProxy) url(scheme string) string {
+	return scheme + "://" + p.listener.Addr().String()
+}
+
+func (p *testProxy) connected() ([]string, []string) {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+	return append([]string{}, p.targets...), append([]string{}, p.auth...)
+}
+
+// dropAll closes every connection through the proxy, as if the tunnel had failed
+func (p *testProxy) dropAll() {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+	for _, conn := range p.conns {
+		conn.Close()
+	}
+	p.conns = nil
+}
+
+func (p *testProxy) close() {
+	p.listener.Close()
+	p.dropAll()
+}
+
+func TestRPCProxyHTTPConnect(t *testing.T) {
+	assert := assert.New(t)
+	node := newTestRPCNode("node1")
+	defer node.server.Close()
+	p := newTestProxy(t, false)
+	defer p.close()
+
+	proxyURL := strings.Replace(p.url("http"), "http://", "http://user:pass@", 1)
+	rpc, err := RPCConnect(&RPCConnOpts{
+		URL:       node.server.URL,
+		Proxy:     RPCProxyConf{URL: proxyURL},
+		ChainHead: ChainHeadConf{Disabled: true},
+	})
+	assert.NoError(err)
+	defer rpc.Close()
+
+	result, err := testPoolCall(t, rpc, "eth_blockNumber")
+	assert.NoError(err)
+	assert.Equal("node1", result)
+	targets, auth := p.connected()
+	assert.Equal([]string{strings.TrimPrefix(node.server.URL, "http://")}, targets)
+	assert.Equal([]string{"Basic dXNlcjpwYXNz"}, auth)
+
+	// When the connections through the proxy drop, the next call is tunnelled through a new one
+	p.dropAll()
+	time.Sleep(50 * time.Millisecond)
+	result, err = testPoolCall(t, rpc, "eth_blockNumber")
+	assert.NoError(err)
+	assert.Equal("node1", result)
+	targets, _ = p.connected()
+	assert.Len(targets, 2)
+}
+
+func TestRPCProxySOCKS5(t *testing.T) {
+	assert := assert.New(t)
+	node1 := newTestRPCNode("node1")
+	defer node1.server.Close()
+	node2 := newTestRPCNode("node2")
+	defer node2.server.Close()
+	p := newTestProxy(t, true)
+	defer p.close()
+
+	rpc, err := RPCConnect(&RPCConnOpts{
+		URL:       node1.server.URL,
+		URLs:      []string{node2.server.URL},
+		Proxy:     RPCProxyConf{URL: p.url("socks5")},
+		ChainHead: ChainHeadConf{Disabled: true},
+	})
+	assert.NoError(err)
+	defer rpc.Close()
+
+	result, err := testPoolCall(t, rpc, "eth_blockNumber")
+	assert.NoError(err)
+	assert.Equal("node1", result)
+	targets, _ := p.connected()
+	assert.Equal([]string{strings.TrimPrefix(node1.server.URL, "http://")}, targets)
+}
+
+func TestRPCProxyTLS(t *testing.T) {
+	assert := assert.New(t)
+	node := newTestRPCNode("node1")
+	node.server.Close()
+	svr := httptest.NewTLSServer(node.server.Config.Handler)
+	defer svr.Close()
+	p := newTestProxy(t, false)
+	defer p.close()
+
+	tunnel, err := newRPCTunnel(&RPCProxyConf{URL: p.url("http")}, svr.URL+"/rpc")
+	assert.NoError(err)
+	defer tunnel.Close()
+	assert.Regexp("^http://127.0.0.1:[0-9]+/rpc$", tunnel.localURL)
+	tunnel.tlsConfig.RootCAs = x509.NewCertPool()
+	tunnel.tlsConfig.RootCAs.AddCert(svr.Certificate())
+
+	res, err := http.Post(tunnel.localURL, "application/json", strings.NewReader(`{"jsonrpc":"2.0","id":1,"method":"eth_blockNumber"}`))
+	assert.NoError(err)
+	defer res.Body.Close()
+	body, _ := io.ReadAll(res.Body)
+	assert.Contains(string(body), `"result":"node1"`)
+}
+
+func TestRPCProxyDialRetries(t *testing.T) {
+	assert := assert.New(t)
+	node := newTestRPCNode("node1")
+	defer node.server.Close()
+	p := newTestProxy(t, false)
+	defer p.close()
+	p.reject = true
+
+	rpc, err := RPCConnect(&RPCConnOpts{
+		URL:       node.server.URL,
+		Proxy:     RPCProxyConf{URL: p.url("http"), DialRetries: 2, RetryDelayMS: 1},
+		ChainHead: ChainHeadConf{Disabled: true},
+	})
+	assert.NoError(err)
+	defer rpc.Close()
+
+	_, err = testPoolCall(t, rpc, "eth_blockNumber")
+	assert.Error(err)
+	targets, _ := p.connected()
+	assert.Len(targets, 3)
+}
+
+func TestRPCProxyBadConfig(t *testing.T) {
+	assert := assert.New(t)
+
+	_, err := RPCConnect(&RPCConnOpts{URL: "http://localhost:8545", Proxy: RPCProxyConf{URL: "ftp://proxy:21"}})
+	assert.Regexp("Invalid JSON/RPC proxy URL 'ftp://proxy:21'", err)
+
+	_, err = RPCConnect(&RPCConnOpts{URL: "http://localhost:8545", Proxy: RPCProxyConf{URL: ":::"}})
+	assert.Regexp("Invalid JSON/RPC proxy URL", err)
+
+	_, err = RPCConnect(&RPCConnOpts{URL: "ipc:///tmp/geth.ipc", Proxy: RPCProxyConf{URL: "socks5://localhost:1080"}})
+	assert.Regexp("JSON/RPC connections over 'ipc' cannot be tunnelled through a proxy", err)
+
+	_, err = newRPCTunnel(&RPCProxyConf{URL: "socks5://localhost:1080"}, ":::")
+	assert.Regexp("missing protocol scheme", err)
+}
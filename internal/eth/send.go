@@ -33,44 +33,68 @@ const (
 )
 
 // calculateGas uses eth_estimateGas to estimate the gas required, providing a buffer
-// of 20% for variation as the chain changes between estimation and submission.
+// (20% by default) for variation as the chain changes between estimation and submission.
+// A configured minimum floor is applied to the padded estimate, and a configured fallback
+// limit is used if estimation fails - for methods that revert during estimation by design.
 func (tx *Txn) calculateGas(ctx context.Context, rpc RPCClient, txArgs *SendTXArgs, gas *ethbinding.HexUint64) (err error) {
 	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
 	defer cancel()
 
+	rule := tx.GasEstimation.ruleFor(tx.EthTX.To(), tx.MethodName)
 	if err := rpc.CallContext(ctx, &gas, "eth_estimateGas", txArgs); err != nil {
 		// Now we attempt a call of the transaction, because that will return us a useful error in the case, of a revert.
 		estError := errors.Errorf(errors.TransactionSendGasEstimateFailed, err)
 		log.Errorf(estError.Error())
+		if fallback := tx.GasEstimation.fallbackGasLimit(rule); fallback > 0 {
+			log.Warnf("Using fallback gas limit %d for method '%s'", fallback, tx.MethodName)
+			*gas = ethbinding.HexUint64(fallback)
+			return nil
+		}
 		if _, err := tx.Call(ctx, rpc, "latest"); err != nil {
 			return err
 		}
 		// If the call succeeds, after estimate completed - we still need to fail with the estimate error
 		return estError
 	}
-	*gas = ethbinding.HexUint64(float64(*gas) * 1.2)
+	*gas = tx.GasEstimation.applyPadding(*gas, rule)
 	return nil
 }
 
-// Call synchronously calls the method, without mining a transaction, and returns the result as RLP encoded bytes or nil
-func (tx *Txn) Call(ctx context.Context, rpc RPCClient, blocknumber string) (res []byte, err error) {
+// sendTXArgs builds the JSON/RPC arguments of the transaction, with either the gas price,
+// or the fees of a dynamic fee transaction
+func (tx *Txn) sendTXArgs() *SendTXArgs {
 	data := ethbinding.HexBytes(tx.EthTX.Data())
 	txArgs := &SendTXArgs{
-		From:     tx.From.Hex(),
-		GasPrice: ethbinding.HexBigInt(*tx.EthTX.GasPrice()),
-		Value:    ethbinding.HexBigInt(*tx.EthTX.Value()),
-		Data:     &data,
+		From:  tx.From.Hex(),
+		Value: ethbinding.HexBigInt(*tx.EthTX.Value()),
+		Data:  &data,
 	}
-	var to = tx.EthTX.To()
-	if to != nil {
+	if tx.MaxFeePerGas != nil || tx.MaxPriorityFeePerGas != nil {
+		txArgs.MaxFeePerGas = (*ethbinding.HexBigInt)(tx.MaxFeePerGas)
+		txArgs.MaxPriorityFeePerGas = (*ethbinding.HexBigInt)(tx.MaxPriorityFeePerGas)
+	} else {
+		txArgs.GasPrice = (*ethbinding.HexBigInt)(tx.EthTX.GasPrice())
+	}
+	if to := tx.EthTX.To(); to != nil {
 		txArgs.To = to.Hex()
 	}
+	return txArgs
+}
+
+// Call synchronously calls the method, without mining a transaction, and returns the result as RLP encoded bytes or nil
+func (tx *Txn) Call(ctx context.Context, rpc RPCClient, blocknumber string) (res []byte, err error) {
+	txArgs := tx.sendTXArgs()
 
 	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
 	defer cancel()
 
 	var hexString string
 	if err = rpc.CallContext(ctx, &hexString, "eth_call", txArgs, blocknumber); err != nil {
+		// Nodes such as geth return the output of a reverted call in the data of the error
+		if reason, ok := decodeRevertReason(revertData("", err), tx.Errors); ok {
+			log.Warnf("EVM Reverted. Message='%s'", reason)
+			return nil, errors.Errorf(errors.TransactionSendCallFailedRevertMessage, reason)
+		}
 		return nil, errors.Errorf(errors.TransactionSendCallFailedNoRevert, err)
 	}
 	if len(hexString) == 0 || hexString == "0x" {
@@ -97,6 +121,14 @@ func (tx *Txn) Call(ctx context.Context, rpc RPCClient, blocknumber string) (res
 	}
 	log.Debugf("eth_call response: %s", hexString)
 	res = ethbind.API.FromHex(hexString)
+	if len(res)%32 == 4 {
+		// A selector followed by ABI encoded arguments is a panic or custom error, which
+		// cannot be the ABI encoded outputs of a successful call
+		if reason, ok := decodeRevertReason(res, tx.Errors); ok {
+			log.Warnf("EVM Reverted. Message='%s'", reason)
+			return nil, errors.Errorf(errors.TransactionSendCallFailedRevertMessage, reason)
+		}
+	}
 	return
 }
 
@@ -104,18 +136,16 @@ func (tx *Txn) Call(ctx context.Context, rpc RPCClient, blocknumber string) (res
 func (tx *Txn) Send(ctx context.Context, rpc RPCClient) (err error) {
 	start := time.Now().UTC()
 
-	gas := ethbinding.HexUint64(tx.EthTX.Gas())
-	data := ethbinding.HexBytes(tx.EthTX.Data())
-	txArgs := &SendTXArgs{
-		From:     tx.From.Hex(),
-		GasPrice: ethbinding.HexBigInt(*tx.EthTX.GasPrice()),
-		Value:    ethbinding.HexBigInt(*tx.EthTX.Value()),
-		Data:     &data,
+	if err = tx.Fees.applyDynamicFees(ctx, rpc, tx); err != nil {
+		return err
 	}
-	var to = tx.EthTX.To()
-	if to != nil {
-		txArgs.To = to.Hex()
+	if err = tx.GasPrices.applyGasPrice(ctx, rpc, tx); err != nil {
+		return err
 	}
+
+	gas := ethbinding.HexUint64(tx.EthTX.Gas())
+	txArgs := tx.sendTXArgs()
+	var to = tx.EthTX.To()
 	if uint64(gas) == uint64(0) {
 		if err = tx.calculateGas(ctx, rpc, txArgs, &gas); err != nil {
 			return err
@@ -150,9 +180,12 @@ type SendTXArgs struct {
 	From     string                `json:"from"`
 	To       string                `json:"to,omitempty"`
 	Gas      *ethbinding.HexUint64 `json:"gas,omitempty"`
-	GasPrice ethbinding.HexBigInt  `json:"gasPrice,omitempty"`
+	GasPrice *ethbinding.HexBigInt `json:"gasPrice,omitempty"`
 	Value    ethbinding.HexBigInt  `json:"value,omitempty"`
 	Data     *ethbinding.HexBytes  `json:"data"`
+	// EIP-1559 dynamic fee transactions
+	MaxFeePerGas         *ethbinding.HexBigInt `json:"maxFeePerGas,omitempty"`
+	MaxPriorityFeePerGas *ethbinding.HexBigInt `json:"maxPriorityFeePerGas,omitempty"`
 	// EEA spec extensions
 	PrivateFrom    string   `json:"privateFrom,omitempty"`
 	PrivateFor     []string `json:"privateFor,omitempty"`
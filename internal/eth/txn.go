@@ -47,6 +47,23 @@ type Txn struct {
 	PrivateFor       []string
 	PrivacyGroupID   string
 	Signer           TXSigner
+	MethodName       string
+	GasEstimation    *GasEstimationConf
+	Events           []*ethbinding.ABIEvent
+	Errors           ethbinding.ABIMarshaling
+	// MaxFeePerGas and MaxPriorityFeePerGas are set for an EIP-1559 dynamic fee transaction,
+	// in place of the gas price
+	MaxFeePerGas         *big.Int
+	MaxPriorityFeePerGas *big.Int
+	Fees                 *FeeEstimator
+	// GasPriceStrategy chooses the gas price of a legacy transaction sent without one,
+	// in place of the default strategy of GasPrices
+	GasPriceStrategy string
+	GasPrices        *GasPriceOracle
+	// CREATE2Address is set for a deployment through a CREATE2 factory, as the receipt
+	// does not have the address of the contract
+	CREATE2Address   *ethbinding.Address
+	gasPriceSupplied bool
 }
 
 // TxnReceipt is the receipt obtained over JSON/RPC from the ethereum client
@@ -61,13 +78,15 @@ type TxnReceipt struct {
 	Status            *ethbinding.HexBigInt `json:"status"`
 	To                *ethbinding.Address   `json:"to"`
 	TransactionIndex  *ethbinding.HexUint   `json:"transactionIndex"`
+	EffectiveGasPrice *ethbinding.HexBigInt `json:"effectiveGasPrice"`
+	Logs              []*TxnLog             `json:"logs"`
 }
 
 // NewContractDeployTxn builds a new ethereum transaction from the supplied
 // SendTranasction message
 func NewContractDeployTxn(msg *messages.DeployContract, signer TXSigner) (tx *Txn, err error) {
 
-	tx = &Txn{Signer: signer}
+	tx = &Txn{Signer: signer, MethodName: constructorMethodName}
 
 	var compiled *CompiledSolidity
 
@@ -78,7 +97,7 @@ func NewContractDeployTxn(msg *messages.DeployContract, signer TXSigner) (tx *Tx
 		}
 	} else if msg.Solidity != "" {
 		// Compile the solidity contract
-		if compiled, err = CompileContract(msg.Solidity, msg.ContractName, msg.CompilerVersion, msg.EVMVersion); err != nil {
+		if compiled, err = CompileContract(msg.Solidity, msg.ContractName, msg.CompilerVersion, &msg.CompilerOptions); err != nil {
 			return
 		}
 	} else {
@@ -88,11 +107,15 @@ func NewContractDeployTxn(msg *messages.DeployContract, signer TXSigner) (tx *Tx
 
 	// Build a runtime ABI from the serialized one
 	var typedArgs []interface{}
-	abi, err := ethbind.API.ABIMarshalingToABIRuntime(compiled.ABI)
+	abi, err := RuntimeABI(compiled.ABI)
 	if err == nil {
 		// Build correctly typed args for the ethereum call
 		typedArgs, err = tx.generateTypedArgs(msg.Parameters, &abi.Constructor)
 	}
+	if err == nil {
+		tx.Events, err = EventABIs(compiled.ABI)
+		tx.Errors = ErrorABIs(compiled.ABI)
+	}
 	if err != nil {
 		return
 	}
@@ -107,13 +130,24 @@ func NewContractDeployTxn(msg *messages.DeployContract, signer TXSigner) (tx *Tx
 	// Join the EVM bytecode with the packed call
 	data := append(compiled.Compiled, packedCall...)
 
+	// A deployment with a salt is sent to a CREATE2 factory, rather than creating the contract itself
+	to := ""
+	if msg.Salt != "" {
+		if data, to, err = tx.create2Deploy(msg, data); err != nil {
+			return
+		}
+	}
+
 	from := msg.From
 	if tx.Signer != nil {
 		from = tx.Signer.Address()
 	}
 
 	// Generate the ethereum transaction
-	if err = tx.genEthTransaction(from, "", msg.Nonce, msg.Value, msg.Gas, msg.GasPrice, data); err != nil {
+	if err = tx.genEthTransaction(from, to, msg.Nonce, msg.Value, msg.Gas, msg.GasPrice, data); err != nil {
+		return
+	}
+	if err = tx.setDynamicFees(&msg.TransactionCommon); err != nil {
 		return
 	}
 
@@ -124,28 +158,18 @@ func NewContractDeployTxn(msg *messages.DeployContract, signer TXSigner) (tx *Tx
 	return
 }
 
-// CallMethod performs eth_call to return data from the chain
-func CallMethod(ctx context.Context, rpc RPCClient, signer TXSigner, from, addr string, value json.Number, methodABI *ethbinding.ABIMethod, msgParams []interface{}, blocknumber string) (map[string]interface{}, error) {
-	log.Debugf("Calling method. ABI: %+v Params: %+v", methodABI, msgParams)
+// CallMethod performs eth_call to return data from the chain. If the call reverts, the
+// error is decoded against the custom errors of the ABI
+func CallMethod(ctx context.Context, rpc RPCClient, signer TXSigner, from, addr string, value json.Number, methodABI *ethbinding.ABIMethod, msgParams []interface{}, errorABIs ethbinding.ABIMarshaling, blocknumber string) (map[string]interface{}, error) {
+	log.Debugf("Calling method. ABI: %+v Params: %+v", methodABI, utils.RedactParams(inputNames(methodABI), msgParams))
 	tx, err := buildTX(signer, from, addr, "", value, "", "", methodABI, msgParams)
 	if err != nil {
 		return nil, err
 	}
-	callOption := "latest"
-	// only allowed values are "earliest/latest/pending", "", a number string "12345" or a hex number "0xab23"
-	// "latest" and "" (no fly-blocknumber given) are equivalent
-	if blocknumber != "" && blocknumber != "latest" {
-		isHex, _ := regexp.MatchString(`^0x[0-9a-fA-F]+$`, blocknumber)
-		if isHex || blocknumber == "earliest" || blocknumber == "pending" {
-			callOption = blocknumber
-		} else {
-			n := new(big.Int)
-			n, ok := n.SetString(blocknumber, 10)
-			if !ok {
-				return nil, errors.Errorf(errors.TransactionCallInvalidBlockNumber)
-			}
-			callOption = ethbind.API.EncodeBig(n)
-		}
+	tx.Errors = errorABIs
+	callOption, err := callBlockOption(blocknumber)
+	if err != nil {
+		return nil, err
 	}
 
 	retBytes, err := tx.Call(ctx, rpc, callOption)
@@ -155,6 +179,39 @@ func CallMethod(ctx context.Context, rpc RPCClient, signer TXSigner, from, addr
 	return ProcessRLPBytes(methodABI.Outputs, retBytes), nil
 }
 
+// CallData calls a contract with pre-encoded call data, rather than an ABI method and parameters,
+// and returns the output without decoding it
+func CallData(ctx context.Context, rpc RPCClient, from, addr string, value json.Number, data []byte, errorABIs ethbinding.ABIMarshaling, blocknumber string) ([]byte, error) {
+	tx := &Txn{}
+	if err := tx.genEthTransaction(from, addr, "", value, "", "", data); err != nil {
+		return nil, err
+	}
+	tx.Errors = errorABIs
+	callOption, err := callBlockOption(blocknumber)
+	if err != nil {
+		return nil, err
+	}
+	return tx.Call(ctx, rpc, callOption)
+}
+
+// callBlockOption converts the block number of a call to the block parameter of eth_call
+func callBlockOption(blocknumber string) (string, error) {
+	// only allowed values are "earliest/latest/safe/finalized/pending", "", a number string "12345" or a hex number "0xab23"
+	// "latest" and "" (no fly-blocknumber given) are equivalent
+	if blocknumber == "" || blocknumber == "latest" {
+		return "latest", nil
+	}
+	isHex, _ := regexp.MatchString(`^0x[0-9a-fA-F]+$`, blocknumber)
+	if isHex || IsBlockTag(blocknumber) {
+		return blocknumber, nil
+	}
+	n, ok := new(big.Int).SetString(blocknumber, 10)
+	if !ok {
+		return "", errors.Errorf(errors.TransactionCallInvalidBlockNumber)
+	}
+	return ethbind.API.EncodeBig(n), nil
+}
+
 func addErrorToRetval(retval map[string]interface{}, retBytes []byte, rawRetval interface{}, err error) {
 	log.Warnf(err.Error())
 	retval["rlp"] = hex.EncodeToString(retBytes)
@@ -256,7 +313,7 @@ func mapOutput(argName, argType string, t *ethbinding.ABIType, rawValue interfac
 		}
 		return ethbind.API.HexEncode(arrayVal), nil
 	case ethbinding.SliceTy, ethbinding.ArrayTy:
-		if rawType.Kind() != reflect.Slice {
+		if rawType.Kind() != reflect.Slice && rawType.Kind() != reflect.Array {
 			return nil, errors.Errorf(errors.UnpackOutputsMismatchType, "slice",
 				argName, argType, rawType.Kind())
 		}
@@ -302,6 +359,10 @@ func genTupleMapOutput(argName, argType string, t *ethbinding.ABIType, rawValue
 // SendTranasction message
 func NewSendTxn(msg *messages.SendTransaction, signer TXSigner) (tx *Txn, err error) {
 
+	if msg.Data != "" {
+		return newRawSendTxn(msg, signer)
+	}
+
 	var methodABI *ethbinding.ABIMethod
 	if msg.Method == nil || msg.Method.Name == "" {
 		if msg.MethodName == "" {
@@ -327,6 +388,43 @@ func NewSendTxn(msg *messages.SendTransaction, signer TXSigner) (tx *Txn, err er
 	if tx, err = buildTX(signer, msg.From, msg.To, msg.Nonce, msg.Value, msg.Gas, msg.GasPrice, methodABI, msg.Parameters); err != nil {
 		return
 	}
+	if err = tx.setDynamicFees(&msg.TransactionCommon); err != nil {
+		return
+	}
+	if tx.Events, err = EventABIs(msg.Events); err != nil {
+		return
+	}
+	tx.Errors = msg.Errors
+
+	// retain private transaction fields
+	tx.PrivateFrom = msg.PrivateFrom
+	tx.PrivateFor = msg.PrivateFor
+	return
+}
+
+// newRawSendTxn builds a transaction from pre-encoded call data, rather than an ABI method and parameters
+func newRawSendTxn(msg *messages.SendTransaction, signer TXSigner) (tx *Txn, err error) {
+	data, err := ethbind.API.HexDecode(msg.Data)
+	if err != nil {
+		err = errors.Errorf(errors.TransactionSendBadData, err)
+		return
+	}
+
+	tx = &Txn{Signer: signer}
+	from := msg.From
+	if tx.Signer != nil {
+		from = signer.Address()
+	}
+	if err = tx.genEthTransaction(from, msg.To, msg.Nonce, msg.Value, msg.Gas, msg.GasPrice, data); err != nil {
+		return
+	}
+	if err = tx.setDynamicFees(&msg.TransactionCommon); err != nil {
+		return
+	}
+	if tx.Events, err = EventABIs(msg.Events); err != nil {
+		return
+	}
+	tx.Errors = msg.Errors
 
 	// retain private transaction fields
 	tx.PrivateFrom = msg.PrivateFrom
@@ -349,7 +447,7 @@ func NewNilTX(from string, nonce int64, signer TXSigner) (tx *Txn, err error) {
 }
 
 func buildTX(signer TXSigner, msgFrom, msgTo string, msgNonce, msgValue, msgGas, msgGasPrice json.Number, methodABI *ethbinding.ABIMethod, params []interface{}) (tx *Txn, err error) {
-	tx = &Txn{Signer: signer}
+	tx = &Txn{Signer: signer, MethodName: methodABI.RawName}
 
 	// Build correctly typed args for the ethereum call
 	typedArgs, err := tx.generateTypedArgs(params, methodABI)
@@ -378,6 +476,25 @@ func buildTX(signer TXSigner, msgFrom, msgTo string, msgNonce, msgValue, msgGas,
 	return
 }
 
+// EncodeMethodCall returns the call data for a method with its parameters, for calls
+// that are passed to another contract rather than sent as a transaction
+func EncodeMethodCall(method *ethbinding.ABIElementMarshaling, params []interface{}) ([]byte, error) {
+	methodABI, err := ethbind.API.ABIElementMarshalingToABIMethod(method)
+	if err != nil {
+		return nil, err
+	}
+	tx := &Txn{MethodName: methodABI.RawName}
+	typedArgs, err := tx.generateTypedArgs(params, methodABI)
+	if err != nil {
+		return nil, err
+	}
+	packedArgs, err := methodABI.Inputs.Pack(typedArgs...)
+	if err != nil {
+		return nil, errors.Errorf(errors.TransactionSendMethodPackArgs, methodABI.RawName, err)
+	}
+	return append(methodABI.ID, packedArgs...), nil
+}
+
 func (tx *Txn) genEthTransaction(msgFrom, msgTo string, msgNonce, msgValue, msgGas, msgGasPrice json.Number, data []byte) (err error) {
 
 	if msgFrom != "" {
@@ -414,7 +531,8 @@ func (tx *Txn) genEthTransaction(msgFrom, msgTo string, msgNonce, msgValue, msgG
 	}
 
 	gasPrice := big.NewInt(0)
-	if msgGasPrice.String() != "" {
+	tx.gasPriceSupplied = msgGasPrice.String() != ""
+	if tx.gasPriceSupplied {
 		if _, ok := gasPrice.SetString(msgGasPrice.String(), 10); !ok {
 			err = errors.Errorf(errors.TransactionSendBadGasPrice)
 			return
@@ -439,6 +557,30 @@ func (tx *Txn) genEthTransaction(msgFrom, msgTo string, msgNonce, msgValue, msgG
 	return
 }
 
+// setDynamicFees records the fees of an EIP-1559 dynamic fee transaction, which cannot
+// also have a gas price, and the strategy for choosing the gas price of a legacy transaction
+func (tx *Txn) setDynamicFees(msg *messages.TransactionCommon) (err error) {
+	if tx.MaxFeePerGas, err = parseFee("maxFeePerGas", msg.MaxFeePerGas); err != nil {
+		return err
+	}
+	if tx.MaxPriorityFeePerGas, err = parseFee("maxPriorityFeePerGas", msg.MaxPriorityFeePerGas); err != nil {
+		return err
+	}
+	if tx.gasPriceSupplied && (tx.MaxFeePerGas != nil || tx.MaxPriorityFeePerGas != nil) {
+		return errors.Errorf(errors.TransactionSendGasPriceAndDynamicFees)
+	}
+	if msg.GasPriceStrategy != "" {
+		if err = ValidateGasPriceStrategy(msg.GasPriceStrategy); err != nil {
+			return err
+		}
+		if tx.gasPriceSupplied || tx.MaxFeePerGas != nil || tx.MaxPriorityFeePerGas != nil {
+			return errors.Errorf(errors.TransactionSendGasPriceStrategyConflict)
+		}
+		tx.GasPriceStrategy = msg.GasPriceStrategy
+	}
+	return nil
+}
+
 func (tx *Txn) getInteger(methodName string, path string, requiredType *ethbinding.ABIType, suppliedType reflect.Type, param interface{}) (val int64, err error) {
 	if suppliedType.Kind() == reflect.String {
 		if val, err = strconv.ParseInt(param.(string), 10, 64); err != nil {
@@ -506,6 +648,18 @@ func (tx *Txn) generateTypedArrayOrSlice(methodName string, path string, require
 	return genericSlice.Interface(), nil
 }
 
+// decodeJSONStringParam decodes an array or struct parameter that is supplied as a JSON
+// string, such as in a query parameter. Any other value is returned unchanged
+func decodeJSONStringParam(param interface{}) interface{} {
+	if s, ok := param.(string); ok {
+		var decoded interface{}
+		if err := json.Unmarshal([]byte(s), &decoded); err == nil && decoded != nil {
+			return decoded
+		}
+	}
+	return param
+}
+
 func (tx *Txn) generateTupleFromMap(methodName string, path string, requiredType *ethbinding.ABIType, param map[string]interface{}) (v interface{}, err error) {
 	tuple := reflect.New(requiredType.TupleType).Elem()
 	for i, inputElemName := range requiredType.TupleRawNames {
@@ -532,7 +686,20 @@ func (tx *Txn) generateTupleFromMap(methodName string, path string, requiredType
 	return tuple.Interface(), nil
 }
 
+// generateTypedArg converts a single parameter, returning a ParamError for the innermost
+// field that could not be converted
 func (tx *Txn) generateTypedArg(requiredType *ethbinding.ABIType, param interface{}, methodName string, path string) (interface{}, error) {
+	v, err := tx.convertTypedArg(requiredType, param, methodName, path)
+	if err != nil {
+		if _, isParamErr := err.(*ParamError); !isParamErr {
+			err = newParamError(requiredType, param, path, err)
+		}
+		return nil, err
+	}
+	return v, nil
+}
+
+func (tx *Txn) convertTypedArg(requiredType *ethbinding.ABIType, param interface{}, methodName string, path string) (interface{}, error) {
 	suppliedType := reflect.TypeOf(param)
 	if suppliedType == nil {
 		return nil, errors.Errorf(errors.TransactionSendInputTypeBadNull, methodName, path)
@@ -630,8 +797,11 @@ func (tx *Txn) generateTypedArg(requiredType *ethbinding.ABIType, param interfac
 		}
 		return bSlice, nil
 	case ethbinding.SliceTy, ethbinding.ArrayTy:
-		return tx.generateTypedArrayOrSlice(methodName, path, requiredType, suppliedType, param)
+		param = decodeJSONStringParam(param)
+		return tx.generateTypedArrayOrSlice(methodName, path, requiredType, reflect.TypeOf(param), param)
 	case ethbinding.TupleTy:
+		param = decodeJSONStringParam(param)
+		suppliedType = reflect.TypeOf(param)
 		if suppliedType.Kind() != reflect.Map || suppliedType.Key().Kind() != reflect.String {
 			return nil, errors.Errorf(errors.TransactionSendInputTypeBadJSONTypeForTuple, methodName, path, requiredType, suppliedType)
 		}
@@ -655,6 +825,7 @@ func (tx *Txn) generateTypedArgs(origParams []interface{}, method *ethbinding.AB
 	}
 	log.Debug("Parsing args for function: ", method)
 	var typedArgs []interface{}
+	var paramErrs []*ParamError
 	for idx, inputArg := range method.Inputs {
 		if idx >= len(params) {
 			err = errors.Errorf(errors.TransactionSendInputCountMismatch, methodName, len(method.Inputs), len(params))
@@ -663,17 +834,53 @@ func (tx *Txn) generateTypedArgs(origParams []interface{}, method *ethbinding.AB
 		param := params[idx]
 		requiredType := &inputArg.Type
 		log.Debugf("Arg %d requiredType: %s", idx, requiredType)
-		arg, err := tx.generateTypedArg(requiredType, param, methodName, fmt.Sprintf("%d", idx))
+		path := fmt.Sprintf("%d", idx)
+		arg, err := tx.generateTypedArg(requiredType, param, methodName, path)
 		if err != nil {
-			log.Errorf("%s [Required=%s Supplied=%s Value=%+v]", err, requiredType, reflect.TypeOf(param), param)
-			return nil, err
+			log.Errorf("%s [Required=%s Supplied=%s Value=%+v]", err, requiredType, reflect.TypeOf(param), utils.RedactParam(inputArg.Name, param))
+			paramErr, isParamErr := err.(*ParamError)
+			if !isParamErr {
+				return nil, err
+			}
+			// Report the field using the name of the argument, so it can be matched to the request.
+			// We carry on, so that every offending field is reported together
+			paramErr.Field = paramFieldName(inputArg.Name, idx) + strings.TrimPrefix(paramErr.Field, path)
+			paramErrs = append(paramErrs, paramErr)
+			continue
 		}
-		log.Debugf("Arg %d value: %+v (type=%s)", idx, arg, reflect.TypeOf(arg))
+		log.Debugf("Arg %d value: %+v (type=%s)", idx, utils.RedactParam(inputArg.Name, arg), reflect.TypeOf(arg))
 		typedArgs = append(typedArgs, arg)
 	}
+	if len(paramErrs) > 0 {
+		return nil, &ParamValidationError{Method: methodName, Fields: paramErrs}
+	}
 	return typedArgs, nil
 }
 
+// paramFieldName is the name of an argument in a request, where un-named
+// arguments are named input, input1, input2...
+// inputNames returns the names of the inputs of a method, to match its parameters for redaction
+func inputNames(method *ethbinding.ABIMethod) []string {
+	if method == nil {
+		return nil
+	}
+	names := make([]string, len(method.Inputs))
+	for i, input := range method.Inputs {
+		names[i] = input.Name
+	}
+	return names
+}
+
+func paramFieldName(name string, idx int) string {
+	if name != "" {
+		return name
+	}
+	if idx == 0 {
+		return "input"
+	}
+	return fmt.Sprintf("input%d", idx)
+}
+
 // flattenParams flattens an array of parameters of the form
 // [{"value":"val1","type":"uint256"},{"value":"val2","type":"uint256"}]
 // into ["val1","val2"], and updates the ethbinding.ABIMethod declaration with any
@@ -262,7 +262,7 @@ func TestNewContractDeployMissingCompiledOrSolidity(t *testing.T) {
 func TestNewContractDeployPrecompiledSimpleStorage(t *testing.T) {
 	assert := assert.New(t)
 
-	c, err := CompileContract(simpleStorage, "simplestorage", "", "")
+	c, err := CompileContract(simpleStorage, "simplestorage", "", &messages.CompilerOptions{})
 	assert.NoError(err)
 
 	var msg messages.DeployContract
@@ -734,6 +734,29 @@ func TestNewSendTxnMissingParamTypes(t *testing.T) {
 	assert.EqualError(err, "Param 0: supplied as an object must have 'type' and 'value' fields")
 }
 
+func TestEncodeMethodCall(t *testing.T) {
+	assert := assert.New(t)
+
+	method := &ethbinding.ABIElementMarshaling{
+		Type:   "function",
+		Name:   "initialize",
+		Inputs: []ethbinding.ABIArgumentMarshaling{{Name: "value", Type: "uint256"}},
+	}
+	data, err := EncodeMethodCall(method, []interface{}{"42"})
+	assert.NoError(err)
+	assert.Equal("0xfe4b84df000000000000000000000000000000000000000000000000000000000000002a", ethbind.API.HexEncode(data))
+
+	_, err = EncodeMethodCall(method, []interface{}{"abc"})
+	assert.Regexp("Could not be converted to a number", err)
+
+	_, err = EncodeMethodCall(&ethbinding.ABIElementMarshaling{
+		Type:   "function",
+		Name:   "bad",
+		Inputs: []ethbinding.ABIArgumentMarshaling{{Name: "value", Type: "badness"}},
+	}, []interface{}{})
+	assert.Error(err)
+}
+
 func TestCallMethod(t *testing.T) {
 	assert := assert.New(t)
 
@@ -783,7 +806,7 @@ func TestCallMethod(t *testing.T) {
 	res, err := CallMethod(context.Background(), rpc, nil,
 		"0xAA983AD2a0e0eD8ac639277F37be42F2A5d2618c",
 		"0x2b8c0ECc76d0759a8F50b2E14A6881367D805832",
-		json.Number("12345"), genMethod(params), params, "")
+		json.Number("12345"), genMethod(params), params, nil, "")
 	assert.NoError(err)
 	assert.Equal(map[string]interface{}{
 		"retval1": "1",
@@ -804,7 +827,7 @@ func TestCallMethod(t *testing.T) {
 	_, err = CallMethod(context.Background(), rpc, nil,
 		"0xAA983AD2a0e0eD8ac639277F37be42F2A5d2618c",
 		"0x2b8c0ECc76d0759a8F50b2E14A6881367D805832",
-		json.Number("12345"), genMethod(params), params, "pending")
+		json.Number("12345"), genMethod(params), params, nil, "pending")
 	assert.NoError(err)
 	assert.Equal("eth_call", rpc.capturedMethod2)
 	assert.Equal("pending", rpc.capturedArgs2[1])
@@ -812,7 +835,7 @@ func TestCallMethod(t *testing.T) {
 	_, err = CallMethod(context.Background(), rpc, nil,
 		"0xAA983AD2a0e0eD8ac639277F37be42F2A5d2618c",
 		"0x2b8c0ECc76d0759a8F50b2E14A6881367D805832",
-		json.Number("12345"), genMethod(params), params, "earliest")
+		json.Number("12345"), genMethod(params), params, nil, "earliest")
 	assert.NoError(err)
 	assert.Equal("eth_call", rpc.capturedMethod2)
 	assert.Equal("earliest", rpc.capturedArgs2[1])
@@ -820,7 +843,7 @@ func TestCallMethod(t *testing.T) {
 	_, err = CallMethod(context.Background(), rpc, nil,
 		"0xAA983AD2a0e0eD8ac639277F37be42F2A5d2618c",
 		"0x2b8c0ECc76d0759a8F50b2E14A6881367D805832",
-		json.Number("12345"), genMethod(params), params, "0x1234")
+		json.Number("12345"), genMethod(params), params, nil, "0x1234")
 	assert.NoError(err)
 	assert.Equal("eth_call", rpc.capturedMethod2)
 	assert.Equal("0x1234", rpc.capturedArgs2[1])
@@ -828,7 +851,7 @@ func TestCallMethod(t *testing.T) {
 	_, err = CallMethod(context.Background(), rpc, nil,
 		"0xAA983AD2a0e0eD8ac639277F37be42F2A5d2618c",
 		"0x2b8c0ECc76d0759a8F50b2E14A6881367D805832",
-		json.Number("12345"), genMethod(params), params, "12345")
+		json.Number("12345"), genMethod(params), params, nil, "12345")
 	assert.NoError(err)
 	assert.Equal("eth_call", rpc.capturedMethod2)
 	assert.Equal("0x3039", rpc.capturedArgs2[1])
@@ -836,7 +859,7 @@ func TestCallMethod(t *testing.T) {
 	_, err = CallMethod(context.Background(), rpc, nil,
 		"0xAA983AD2a0e0eD8ac639277F37be42F2A5d2618c",
 		"0x2b8c0ECc76d0759a8F50b2E14A6881367D805832",
-		json.Number("12345"), genMethod(params), params, "0")
+		json.Number("12345"), genMethod(params), params, nil, "0")
 	assert.NoError(err)
 	assert.Equal("eth_call", rpc.capturedMethod2)
 	assert.Equal("0x0", rpc.capturedArgs2[1])
@@ -857,7 +880,7 @@ func TestCallMethodFail(t *testing.T) {
 	_, err := CallMethod(context.Background(), rpc, nil,
 		"0xAA983AD2a0e0eD8ac639277F37be42F2A5d2618c",
 		"0x2b8c0ECc76d0759a8F50b2E14A6881367D805832",
-		json.Number("12345"), method, params, "")
+		json.Number("12345"), method, params, nil, "")
 
 	assert.Equal("eth_call", rpc.capturedMethod)
 	assert.EqualError(err, "Call failed: pop")
@@ -865,7 +888,36 @@ func TestCallMethodFail(t *testing.T) {
 	_, err = CallMethod(context.Background(), rpc, nil,
 		"0xAA983AD2a0e0eD8ac639277F37be42F2A5d2618c",
 		"0x2b8c0ECc76d0759a8F50b2E14A6881367D805832",
-		json.Number("12345"), method, params, "ab2345")
+		json.Number("12345"), method, params, nil, "ab2345")
+	assert.EqualError(err, "Invalid blocknumber. Failed to parse into big integer")
+}
+
+func TestCallData(t *testing.T) {
+	assert := assert.New(t)
+
+	rpc := &testRPCClient{
+		resultWrangler: func(retString interface{}) {
+			retVal := "0x00000000000000000000000000000000000000000000000000000000000003e8"
+			reflect.ValueOf(retString).Elem().Set(reflect.ValueOf(retVal))
+		},
+	}
+
+	res, err := CallData(context.Background(), rpc,
+		"0xAA983AD2a0e0eD8ac639277F37be42F2A5d2618c",
+		"0x2b8c0ECc76d0759a8F50b2E14A6881367D805832",
+		json.Number("0"), []byte{0x12, 0x34, 0x56, 0x78}, nil, "12345")
+	assert.NoError(err)
+	assert.Equal("eth_call", rpc.capturedMethod)
+	assert.Equal("0x3039", rpc.capturedArgs[1])
+	txArgs := rpc.capturedArgs[0].(*SendTXArgs)
+	assert.Equal("0x12345678", txArgs.Data.String())
+	assert.Equal(32, len(res))
+	assert.Equal(byte(0xe8), res[31])
+
+	_, err = CallData(context.Background(), rpc,
+		"0xAA983AD2a0e0eD8ac639277F37be42F2A5d2618c",
+		"0x2b8c0ECc76d0759a8F50b2E14A6881367D805832",
+		json.Number("0"), []byte{0x12, 0x34, 0x56, 0x78}, nil, "ab2345")
 	assert.EqualError(err, "Invalid blocknumber. Failed to parse into big integer")
 }
 
@@ -887,7 +939,7 @@ func TestCallMethodRevert(t *testing.T) {
 	_, err := CallMethod(context.Background(), rpc, nil,
 		"0xAA983AD2a0e0eD8ac639277F37be42F2A5d2618c",
 		"0x2b8c0ECc76d0759a8F50b2E14A6881367D805832",
-		json.Number("12345"), method, params, "")
+		json.Number("12345"), method, params, nil, "")
 
 	assert.Equal("eth_call", rpc.capturedMethod)
 	assert.EqualError(err, "Muppetry detected")
@@ -911,7 +963,7 @@ func TestCallMethodRevertBadStrLen(t *testing.T) {
 	_, err := CallMethod(context.Background(), rpc, nil,
 		"0xAA983AD2a0e0eD8ac639277F37be42F2A5d2618c",
 		"0x2b8c0ECc76d0759a8F50b2E14A6881367D805832",
-		json.Number("12345"), method, params, "")
+		json.Number("12345"), method, params, nil, "")
 
 	assert.Equal("eth_call", rpc.capturedMethod)
 	// Should read up to the end of the padding, and not panic
@@ -936,7 +988,7 @@ func TestCallMethodRevertBadBytes(t *testing.T) {
 	_, err := CallMethod(context.Background(), rpc, nil,
 		"0xAA983AD2a0e0eD8ac639277F37be42F2A5d2618c",
 		"0x2b8c0ECc76d0759a8F50b2E14A6881367D805832",
-		json.Number("12345"), method, params, "")
+		json.Number("12345"), method, params, nil, "")
 
 	assert.Equal("eth_call", rpc.capturedMethod)
 	assert.EqualError(err, "EVM reverted. Failed to decode error message")
@@ -949,7 +1001,7 @@ func TestCallMethodBadArgs(t *testing.T) {
 		mockError: fmt.Errorf("pop"),
 	}
 
-	_, err := CallMethod(context.Background(), rpc, nil, "badness", "", json.Number(""), &ethbinding.ABIMethod{}, []interface{}{}, "")
+	_, err := CallMethod(context.Background(), rpc, nil, "badness", "", json.Number(""), &ethbinding.ABIMethod{}, []interface{}{}, nil, "")
 
 	assert.EqualError(err, "Supplied value for 'from' is not a valid hex address")
 }
@@ -1007,6 +1059,68 @@ func TestSendTxnNodeAssignNonce(t *testing.T) {
 	assert.Regexp("0xe5537abb000000000000000000000000000000000000000000000000000000000000007b000000000000000000000000000000000000000000000000000000000000007b0000000000000000000000000000000000000000000000000000000000000080000000000000000000000000aa983ad2a0e0ed8ac639277f37be42f2a5d2618c00000000000000000000000000000000000000000000000000000000000000036162630000000000000000000000000000000000000000000000000000000000", jsonSent["data"])
 }
 
+func TestSendTxnDynamicFees(t *testing.T) {
+	assert := assert.New(t)
+
+	var msg messages.SendTransaction
+	msg.Data = "0xfeedbeef"
+	msg.To = "0x2b8c0ECc76d0759a8F50b2E14A6881367D805832"
+	msg.From = "0xAA983AD2a0e0eD8ac639277F37be42F2A5d2618c"
+	msg.Gas = "456"
+	msg.MaxFeePerGas = "789"
+	msg.MaxPriorityFeePerGas = "12"
+	tx, err := NewSendTxn(&msg, nil)
+	assert.NoError(err)
+
+	rpc := testRPCClient{}
+
+	tx.NodeAssignNonce = true
+	err = tx.Send(context.Background(), &rpc)
+	assert.NoError(err)
+	assert.Equal("eth_sendTransaction", rpc.capturedMethod)
+	jsonBytesSent, _ := json.Marshal(rpc.capturedArgs[0])
+	var jsonSent map[string]interface{}
+	json.Unmarshal(jsonBytesSent, &jsonSent)
+	assert.Equal(nil, jsonSent["gasPrice"])
+	assert.Equal("0x315", jsonSent["maxFeePerGas"])
+	assert.Equal("0xc", jsonSent["maxPriorityFeePerGas"])
+}
+
+func TestSendTxnGasPriceAndDynamicFees(t *testing.T) {
+	assert := assert.New(t)
+
+	var msg messages.SendTransaction
+	msg.Data = "0xfeedbeef"
+	msg.To = "0x2b8c0ECc76d0759a8F50b2E14A6881367D805832"
+	msg.From = "0xAA983AD2a0e0eD8ac639277F37be42F2A5d2618c"
+	msg.GasPrice = "789"
+	msg.MaxFeePerGas = "789"
+	_, err := NewSendTxn(&msg, nil)
+	assert.EqualError(err, "Cannot specify both 'gasPrice' and 'maxFeePerGas'/'maxPriorityFeePerGas'")
+}
+
+func TestSendTxnDynamicFeesWithSigner(t *testing.T) {
+	assert := assert.New(t)
+
+	var msg messages.SendTransaction
+	msg.Data = "0xfeedbeef"
+	msg.To = "0x2b8c0ECc76d0759a8F50b2E14A6881367D805832"
+	msg.From = "hd-u0abcd1234-u0bcde9876-12345"
+	msg.Gas = "456"
+	msg.MaxFeePerGas = "789"
+	signer := &mockTXSigner{
+		signed: []byte("testbytes"),
+		from:   "0xAA983AD2a0e0eD8ac639277F37be42F2A5d2618c",
+	}
+	tx, err := NewSendTxn(&msg, signer)
+	assert.NoError(err)
+
+	rpc := testRPCClient{}
+	err = tx.Send(context.Background(), &rpc)
+	assert.EqualError(err, "EIP-1559 dynamic fee transactions are not supported with the 'mock signer' signer")
+	assert.Equal("", rpc.capturedMethod)
+}
+
 func TestSendWithTXSignerContractOK(t *testing.T) {
 	assert := assert.New(t)
 
@@ -1339,6 +1453,35 @@ func TestSendTxnMissingMethod(t *testing.T) {
 	_, err := NewSendTxn(&msg, nil)
 	assert.Regexp("Method missing", err.Error())
 }
+
+func TestSendTxnRawData(t *testing.T) {
+	assert := assert.New(t)
+
+	var msg messages.SendTransaction
+	msg.Data = "0xfeedbeef"
+	msg.To = "0x2b8c0ECc76d0759a8F50b2E14A6881367D805832"
+	msg.From = "0xAA983AD2a0e0eD8ac639277F37be42F2A5d2618c"
+	msg.Nonce = "123"
+	msg.Value = "10"
+	msg.Gas = "456"
+	msg.GasPrice = "789"
+	tx, err := NewSendTxn(&msg, nil)
+	assert.NoError(err)
+	assert.Equal("0xfeedbeef", ethbind.API.HexEncode(tx.EthTX.Data()))
+	assert.Equal("0x2b8c0ECc76d0759a8F50b2E14A6881367D805832", tx.EthTX.To().Hex())
+	assert.Equal(uint64(123), tx.EthTX.Nonce())
+	assert.Equal(int64(10), tx.EthTX.Value().Int64())
+}
+
+func TestSendTxnRawDataBadHex(t *testing.T) {
+	assert := assert.New(t)
+
+	var msg messages.SendTransaction
+	msg.Data = "not hex"
+	msg.To = "0x2b8c0ECc76d0759a8F50b2E14A6881367D805832"
+	_, err := NewSendTxn(&msg, nil)
+	assert.Regexp("Invalid call data", err.Error())
+}
 func TestSendTxnBadFrom(t *testing.T) {
 	assert := assert.New(t)
 
@@ -1575,6 +1718,76 @@ func TestProcessRLPV2ABIEncodedStructs(t *testing.T) {
 	assert.Equal(input1Map, res["out1"])
 }
 
+func TestProcessRLPV2ABIEncodedStructsFromJSONString(t *testing.T) {
+	assert := assert.New(t)
+
+	var v2abi ethbinding.ABI
+	testABIInput, err := ioutil.ReadFile("../../test/abicoderv2_example.abi.json")
+	assert.NoError(err)
+	err = json.Unmarshal(testABIInput, &v2abi)
+	assert.NoError(err)
+	abiMethod := v2abi.Methods["inOutType1"]
+
+	// As supplied in a query parameter
+	input1 := `{
+		"str1": "test1",
+		"val1": "12345",
+		"nested": {"str1": "test2", "str2": "test3", "addr1": "0x1212121212121212121212121212121212121212", "bytearray": "0xfeedbeef"},
+		"nestarray": [
+			{"str1": "test4", "str2": "test5", "addr1": "0x2121212121212121212121212121212121212121", "bytearray": "0x01010101"}
+		]
+	}`
+
+	tx := Txn{}
+	typedArgs, err := tx.generateTypedArgs([]interface{}{input1}, &abiMethod)
+	assert.NoError(err)
+
+	rlp, err := abiMethod.Inputs.Pack(typedArgs...)
+	assert.NoError(err)
+	res := ProcessRLPBytes(abiMethod.Outputs, rlp)
+	assert.Nil(res["error"])
+	out1 := res["out1"].(map[string]interface{})
+	assert.Equal("12345", out1["val1"])
+	assert.Equal("0xfeedbeef", out1["nested"].(map[string]interface{})["bytearray"])
+	assert.Equal("test4", out1["nestarray"].([]interface{})[0].(map[string]interface{})["str1"])
+
+	_, err = tx.generateTypedArgs([]interface{}{"not json"}, &abiMethod)
+	assert.Regexp("Must supply an object", err)
+}
+
+func TestProcessRLPFixedArrayOfStructs(t *testing.T) {
+	assert := assert.New(t)
+
+	var structABI ethbinding.ABI
+	err := json.Unmarshal([]byte(`[{
+		"type": "function",
+		"name": "points",
+		"inputs": [{"name": "in", "type": "tuple[2]", "components": [
+			{"name": "x", "type": "uint256"},
+			{"name": "y", "type": "int32[2]"}
+		]}],
+		"outputs": [{"name": "out", "type": "tuple[2]", "components": [
+			{"name": "x", "type": "uint256"},
+			{"name": "y", "type": "int32[2]"}
+		]}]
+	}]`), &structABI)
+	assert.NoError(err)
+	abiMethod := structABI.Methods["points"]
+
+	tx := Txn{}
+	typedArgs, err := tx.generateTypedArgs([]interface{}{`[{"x":"1","y":[2,3]},{"x":4,"y":["-5","6"]}]`}, &abiMethod)
+	assert.NoError(err)
+
+	rlp, err := abiMethod.Inputs.Pack(typedArgs...)
+	assert.NoError(err)
+	res := ProcessRLPBytes(abiMethod.Outputs, rlp)
+	assert.Nil(res["error"])
+	assert.Equal([]interface{}{
+		map[string]interface{}{"x": "1", "y": []interface{}{"2", "3"}},
+		map[string]interface{}{"x": "4", "y": []interface{}{"-5", "6"}},
+	}, res["out"])
+}
+
 func TestProcessRLPV2ABIEncodedStructsUnasignableVal(t *testing.T) {
 	assert := assert.New(t)
 
@@ -0,0 +1,149 @@
+// Copyright 2021 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package events
+
+import (
+	"fmt"
+	"math/big"
+	"strconv"
+	"time"
+
+	ethbinding "github.com/kaleido-io/ethbinding/pkg"
+	"github.com/kaleido-io/ethconnect/internal/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// AggregationInfo configures a subscription to deliver a single summary of the events
+// received in each window, rather than every event. A window closes after WindowSec
+// seconds, or once MaxCount events have been received - whichever comes first.
+type AggregationInfo struct {
+	WindowSec     uint64 `json:"windowSec,omitempty"`
+	MaxCount      uint64 `json:"maxCount,omitempty"`
+	SumField      string `json:"sumField,omitempty"`
+	DistinctField string `json:"distinctField,omitempty"`
+}
+
+// aggregator accumulates the events of a subscription for the current window.
+// It is only used from the event poller thread of the stream, so needs no locking.
+type aggregator struct {
+	info     *AggregationInfo
+	window   time.Duration
+	start    time.Time
+	count    uint64
+	sum      *big.Int
+	distinct map[string]bool
+	first    *eventData
+	last     *eventData
+}
+
+func validateAggregation(info *AggregationInfo, event *ethbinding.ABIEvent) error {
+	if info == nil {
+		return nil
+	}
+	if info.WindowSec == 0 && info.MaxCount == 0 {
+		return errors.Errorf(errors.EventStreamsAggregationNoWindow)
+	}
+	if info.SumField != "" {
+		input := eventInput(event, info.SumField)
+		if input == nil {
+			return errors.Errorf(errors.EventStreamsAggregationUnknownField, info.SumField, event.Name)
+		}
+		if input.Type.T != ethbinding.IntTy && input.Type.T != ethbinding.UintTy {
+			return errors.Errorf(errors.EventStreamsAggregationSumNotNumeric, info.SumField, input.Type.String())
+		}
+	}
+	if info.DistinctField != "" && eventInput(event, info.DistinctField) == nil {
+		return errors.Errorf(errors.EventStreamsAggregationUnknownField, info.DistinctField, event.Name)
+	}
+	return nil
+}
+
+func eventInput(event *ethbinding.ABIEvent, name string) *ethbinding.ABIArgument {
+	for i := range event.Inputs {
+		if event.Inputs[i].Name == name {
+			return &event.Inputs[i]
+		}
+	}
+	return nil
+}
+
+func newAggregator(info *AggregationInfo) *aggregator {
+	if info == nil {
+		return nil
+	}
+	a := &aggregator{
+		info:   info,
+		window: time.Duration(info.WindowSec) * time.Second,
+	}
+	a.reset()
+	return a
+}
+
+func (a *aggregator) reset() {
+	a.count = 0
+	a.sum = new(big.Int)
+	a.distinct = make(map[string]bool)
+	a.first = nil
+	a.last = nil
+}
+
+// add includes an event in the current window, and returns true if the window is now full
+func (a *aggregator) add(event *eventData, now time.Time) bool {
+	if a.count == 0 {
+		a.start = now
+		a.first = event
+	}
+	a.last = event
+	a.count++
+	if a.info.SumField != "" {
+		if v, ok := new(big.Int).SetString(fmt.Sprintf("%v", event.Data[a.info.SumField]), 10); ok {
+			a.sum.Add(a.sum, v)
+		} else {
+			log.Warnf("%s: Unable to sum non-numeric value of '%s': %v", event.SubID, a.info.SumField, event.Data[a.info.SumField])
+		}
+	}
+	if a.info.DistinctField != "" {
+		a.distinct[fmt.Sprintf("%v", event.Data[a.info.DistinctField])] = true
+	} else {
+		a.distinct[event.Address] = true
+	}
+	return a.info.MaxCount > 0 && a.count >= a.info.MaxCount
+}
+
+// expired returns true if there are events in a window that has closed
+func (a *aggregator) expired(now time.Time) bool {
+	return a.count > 0 && a.window > 0 && !now.Before(a.start.Add(a.window))
+}
+
+// summarize builds the single event that is delivered for the current window, and starts a new one.
+// The position of the summary is that of the newest event in the window, so the checkpoint of
+// the subscription only moves past the events once the summary has been delivered.
+func (a *aggregator) summarize(now time.Time) *eventData {
+	summary := *a.last
+	summary.Aggregate = true
+	summary.Data = map[string]interface{}{
+		"count":         strconv.FormatUint(a.count, 10),
+		"distinctCount": strconv.Itoa(len(a.distinct)),
+		"firstBlock":    a.first.BlockNumber,
+		"lastBlock":     a.last.BlockNumber,
+		"windowStart":   a.start.UTC().Format(time.RFC3339Nano),
+		"windowEnd":     now.UTC().Format(time.RFC3339Nano),
+	}
+	if a.info.SumField != "" {
+		summary.Data["sum"] = a.sum.String()
+	}
+	a.reset()
+	return &summary
+}
@@ -0,0 +1,166 @@
+// Copyright 2021 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package events
+
+import (
+	"encoding/json"
+	"math/big"
+	"testing"
+	"time"
+
+	ethbinding "github.com/kaleido-io/ethbinding/pkg"
+	"github.com/kaleido-io/ethconnect/internal/ethbind"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestAggregatingLogProcessor(t *testing.T, info *AggregationInfo) *logProcessor {
+	var marshaling ethbinding.ABIElementMarshaling
+	json.Unmarshal([]byte(sampleEventABIAllIndexedNoData), &marshaling)
+	event, _ := ethbind.API.ABIElementMarshalingToABIEvent(&marshaling)
+	assert.NoError(t, validateAggregation(info, event))
+	lp := newLogProcessor("sub1", event, &eventStream{
+		sm:          &mockSubMgr{},
+		spec:        &StreamInfo{},
+		eventStream: make(chan *eventData, 1),
+	})
+	lp.aggregator = newAggregator(info)
+	return lp
+}
+
+func processTestLogEntry(t *testing.T, lp *logProcessor, blockNumber int64) {
+	var l logEntry
+	err := json.Unmarshal([]byte(sampleEventLogAllIndexedNoData), &l)
+	assert.NoError(t, err)
+	l.BlockNumber.ToInt().SetInt64(blockNumber)
+	err = lp.processLogEntry(t.Name(), &l, 0)
+	assert.NoError(t, err)
+}
+
+func TestValidateAggregation(t *testing.T) {
+	assert := assert.New(t)
+
+	var marshaling ethbinding.ABIElementMarshaling
+	json.Unmarshal([]byte(sampleEventABIAllIndexedNoData), &marshaling)
+	event, _ := ethbind.API.ABIElementMarshalingToABIEvent(&marshaling)
+
+	assert.NoError(validateAggregation(nil, event))
+	assert.NoError(validateAggregation(&AggregationInfo{MaxCount: 10, SumField: "data2", DistinctField: "data1"}, event))
+
+	err := validateAggregation(&AggregationInfo{SumField: "data2"}, event)
+	assert.EqualError(err, "Aggregation requires a windowSec, a maxCount, or both")
+	err = validateAggregation(&AggregationInfo{WindowSec: 1, SumField: "data3"}, event)
+	assert.EqualError(err, "Aggregation field 'data3' is not a field of event 'SampleEvent'")
+	err = validateAggregation(&AggregationInfo{WindowSec: 1, SumField: "data1"}, event)
+	assert.EqualError(err, "Aggregation sum field 'data1' must be an integer type, not 'string'")
+	err = validateAggregation(&AggregationInfo{WindowSec: 1, DistinctField: "data3"}, event)
+	assert.EqualError(err, "Aggregation field 'data3' is not a field of event 'SampleEvent'")
+}
+
+func TestAggregationMaxCount(t *testing.T) {
+	assert := assert.New(t)
+
+	lp := newTestAggregatingLogProcessor(t, &AggregationInfo{MaxCount: 3, SumField: "data2"})
+	processTestLogEntry(t, lp, 10)
+	processTestLogEntry(t, lp, 11)
+	assert.Equal(0, len(lp.stream.eventStream))
+	// The events are in-flight, so the HWM must not move past them
+	lp.markNoEvents(big.NewInt(20))
+	hwm := lp.getBlockHWM()
+	assert.Equal(int64(0), hwm.Int64())
+
+	processTestLogEntry(t, lp, 12)
+	summary := <-lp.stream.eventStream
+	assert.True(summary.Aggregate)
+	assert.Equal("sub1", summary.SubID)
+	assert.Equal("12", summary.BlockNumber)
+	assert.Equal("3", summary.Data["count"])
+	assert.Equal("3000", summary.Data["sum"])
+	assert.Equal("1", summary.Data["distinctCount"])
+	assert.Equal("10", summary.Data["firstBlock"])
+	assert.Equal("12", summary.Data["lastBlock"])
+
+	summary.batchComplete(summary)
+	hwm = lp.getBlockHWM()
+	assert.Equal(int64(13), hwm.Int64())
+	assert.Equal(uint64(0), lp.aggregator.count)
+}
+
+func TestAggregationTimeWindow(t *testing.T) {
+	assert := assert.New(t)
+
+	lp := newTestAggregatingLogProcessor(t, &AggregationInfo{WindowSec: 60, DistinctField: "data1"})
+	lp.checkAggregation(t.Name())
+	assert.Equal(0, len(lp.stream.eventStream))
+
+	processTestLogEntry(t, lp, 10)
+	processTestLogEntry(t, lp, 11)
+	lp.checkAggregation(t.Name())
+	assert.Equal(0, len(lp.stream.eventStream))
+
+	lp.aggregator.start = time.Now().Add(-61 * time.Second)
+	lp.checkAggregation(t.Name())
+	summary := <-lp.stream.eventStream
+	assert.Equal("2", summary.Data["count"])
+	assert.Equal("1", summary.Data["distinctCount"])
+	_, hasSum := summary.Data["sum"]
+	assert.False(hasSum)
+	assert.Equal("11", summary.BlockNumber)
+}
+
+func TestAggregationNonNumericSum(t *testing.T) {
+	assert := assert.New(t)
+
+	a := newAggregator(&AggregationInfo{MaxCount: 2, SumField: "value"})
+	assert.False(a.add(&eventData{Address: "0x1", Data: map[string]interface{}{"value": "5"}}, time.Now()))
+	assert.True(a.add(&eventData{Address: "0x2", Data: map[string]interface{}{"value": "abc"}}, time.Now()))
+	summary := a.summarize(time.Now())
+	assert.Equal("5", summary.Data["sum"])
+	assert.Equal("2", summary.Data["distinctCount"])
+}
+
+func TestCreateSubscriptionBadAggregation(t *testing.T) {
+	assert := assert.New(t)
+	event := &ethbinding.ABIElementMarshaling{
+		Name:   "devcon",
+		Inputs: []ethbinding.ABIArgumentMarshaling{{Name: "x", Type: "uint256"}},
+	}
+	m := &mockSubMgr{stream: newTestStream()}
+	i := testSubInfo(event)
+	i.Aggregation = &AggregationInfo{}
+	_, err := newSubscription(m, nil, nil, i)
+	assert.EqualError(err, "Aggregation requires a windowSec, a maxCount, or both")
+
+	i.Aggregation = &AggregationInfo{WindowSec: 10, SumField: "x"}
+	s, err := newSubscription(m, nil, nil, i)
+	assert.NoError(err)
+	assert.NotNil(s.lp.aggregator)
+
+	s, err = restoreSubscription(m, nil, i)
+	assert.NoError(err)
+	assert.NotNil(s.lp.aggregator)
+}
+
+func TestResetAggregation(t *testing.T) {
+	assert := assert.New(t)
+
+	lp := newTestAggregatingLogProcessor(t, &AggregationInfo{MaxCount: 10})
+	processTestLogEntry(t, lp, 10)
+	assert.Equal(uint64(1), lp.aggregator.count)
+	lp.resetAggregation()
+	assert.Equal(uint64(0), lp.aggregator.count)
+
+	lp.aggregator = nil
+	lp.resetAggregation()
+}
@@ -0,0 +1,428 @@
+// Copyright 2021 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package events
+
+import (
+	"context"
+	"encoding/json"
+	"math/big"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Shopify/sarama"
+	ethbinding "github.com/kaleido-io/ethbinding/pkg"
+	"github.com/kaleido-io/ethconnect/internal/errors"
+	"github.com/kaleido-io/ethconnect/internal/ethbind"
+	"github.com/kaleido-io/ethconnect/internal/messages"
+	"github.com/kaleido-io/ethconnect/internal/utils"
+	"github.com/kaleido-io/ethconnect/internal/webhook"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// BackfillPathPrefix is the path prefix for backfills
+	BackfillPathPrefix = "/backfills"
+	backfillIDPrefix   = "bf-"
+
+	// BackfillStatusRunning the backfill is reading and delivering events
+	BackfillStatusRunning = "running"
+	// BackfillStatusCompleted all the events in the block range have been delivered
+	BackfillStatusCompleted = "completed"
+	// BackfillStatusFailed delivery failed after the maximum number of attempts
+	BackfillStatusFailed = "failed"
+
+	defaultBackfillBatchSize   = 100
+	defaultBackfillMaxAttempts = 5
+)
+
+// BackfillConf configures the backfill jobs. Connection details for Kafka are configured
+// here, so a backfill request only names the topic
+type BackfillConf struct {
+	Kafka       BackfillKafkaConf `json:"kafka,omitempty"`
+	PageSize    int64             `json:"pageSize,omitempty"`
+	MaxAttempts int               `json:"maxAttempts,omitempty"`
+}
+
+// BackfillKafkaConf is the Kafka cluster backfills can deliver to
+type BackfillKafkaConf struct {
+	Brokers  []string `json:"brokers,omitempty"`
+	ClientID string   `json:"clientID,omitempty"`
+	SASL     struct {
+		Username string `json:"username,omitempty"`
+		Password string `json:"password,omitempty"`
+	} `json:"sasl,omitempty"`
+	TLS utils.TLSConfig `json:"tls,omitempty"`
+}
+
+// BackfillInfo is the persisted definition and progress of a one-time job, that delivers
+// the historical events in a block range to a Kafka topic or a webhook
+type BackfillInfo struct {
+	messages.TimeSorted
+	ID        string                           `json:"id"`
+	Name      string                           `json:"name,omitempty"`
+	Path      string                           `json:"path"`
+	Tenant    string                           `json:"tenant,omitempty"`
+	Address   *ethbinding.Address              `json:"address,omitempty"`
+	Event     *ethbinding.ABIElementMarshaling `json:"event"`
+	FromBlock string                           `json:"fromBlock"`
+	ToBlock   string                           `json:"toBlock"`
+	Type      string                           `json:"type"`
+	BatchSize uint64                           `json:"batchSize,omitempty"`
+	Kafka     *backfillKafkaInfo               `json:"kafka,omitempty"`
+	Webhook   *webhookActionInfo               `json:"webhook,omitempty"`
+	Status    string                           `json:"status"`
+	Progress  BackfillProgress                 `json:"progress"`
+}
+
+// BackfillProgress is updated as each page of blocks is delivered. NextBlock is the
+// block the backfill resumes from after a restart
+type BackfillProgress struct {
+	NextBlock       string `json:"nextBlock"`
+	PercentComplete int    `json:"percentComplete"`
+	EventsDelivered uint64 `json:"eventsDelivered"`
+	LastError       string `json:"lastError,omitempty"`
+	UpdatedISO8601  string `json:"updated,omitempty"`
+}
+
+type backfillKafkaInfo struct {
+	Topic string `json:"topic,omitempty"`
+}
+
+// GetID returns the ID (for sorting)
+func (info *BackfillInfo) GetID() string {
+	return info.ID
+}
+
+// backfillTarget delivers a batch of events from a backfill
+type backfillTarget interface {
+	deliver(events []*eventData) error
+	close()
+}
+
+// backfill is the runtime that reads the logs for a backfill, a page of blocks at a time,
+// separately from the subscriptions and event streams
+type backfill struct {
+	sm         *subscriptionMGR
+	info       *BackfillInfo
+	event      *ethbinding.ABIEvent
+	lock       sync.Mutex
+	stop       chan struct{}
+	done       chan struct{}
+	retryDelay time.Duration
+}
+
+func newBackfill(sm *subscriptionMGR, info *BackfillInfo) (*backfill, error) {
+	event, err := parseBackfillEvent(info.Event)
+	if err != nil {
+		return nil, err
+	}
+	return &backfill{
+		sm:         sm,
+		info:       info,
+		event:      event,
+		retryDelay: DefaultExponentialBackoffInitial,
+	}, nil
+}
+
+// snapshot returns a copy of the info, as the progress is updated while the backfill runs
+func (b *backfill) snapshot() *BackfillInfo {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	info := *b.info
+	return &info
+}
+
+func (b *backfill) start() {
+	b.stop = make(chan struct{})
+	b.done = make(chan struct{})
+	go b.run()
+}
+
+// halt stops the backfill, and waits for it to store its progress
+func (b *backfill) halt() {
+	if b.stop != nil {
+		close(b.stop)
+		<-b.done
+		b.stop = nil
+	}
+}
+
+// update applies a change to the info under the lock, and persists it
+func (b *backfill) update(change func(info *BackfillInfo)) {
+	b.lock.Lock()
+	change(b.info)
+	b.info.Progress.UpdatedISO8601 = time.Now().UTC().Format(time.RFC3339)
+	info := *b.info
+	b.lock.Unlock()
+	if _, err := b.sm.storeBackfill(&info); err != nil {
+		log.Errorf("%s: %s", info.ID, err)
+	}
+}
+
+func (b *backfill) position() (next, to *big.Int) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	next, _ = new(big.Int).SetString(b.info.Progress.NextBlock, 10)
+	to, _ = new(big.Int).SetString(b.info.ToBlock, 10)
+	return next, to
+}
+
+func (b *backfill) run() {
+	defer close(b.done)
+	info := b.snapshot()
+	target, err := b.sm.newBackfillTarget(info)
+	if err != nil {
+		b.fail(err)
+		return
+	}
+	defer target.close()
+	log.Infof("%s: Backfill of %s from block %s to %s started", info.ID, info.Type, info.Progress.NextBlock, info.ToBlock)
+
+	attempt := 0
+	delay := b.retryDelay
+	for {
+		next, to := b.position()
+		if next.Cmp(to) > 0 {
+			b.update(func(info *BackfillInfo) {
+				info.Status = BackfillStatusCompleted
+				info.Progress.PercentComplete = 100
+				info.Progress.LastError = ""
+			})
+			log.Infof("%s: Backfill completed", info.ID)
+			return
+		}
+		end := new(big.Int).Add(next, big.NewInt(b.sm.conf.Backfills.PageSize-1))
+		if end.Cmp(to) > 0 {
+			end.Set(to)
+		}
+		delivered, err := b.processPage(target, next, end)
+		if err != nil {
+			attempt++
+			log.Errorf("%s: Backfill of blocks %s -> %s failed (attempt=%d): %s", info.ID, next, end, attempt, err)
+			if attempt >= b.sm.conf.Backfills.MaxAttempts {
+				b.fail(err)
+				return
+			}
+			b.update(func(info *BackfillInfo) {
+				info.Progress.LastError = err.Error()
+			})
+			select {
+			case <-b.stop:
+				return
+			case <-time.After(delay):
+			}
+			delay = time.Duration(float64(delay) * DefaultExponentialBackoffFactor)
+			continue
+		}
+		attempt = 0
+		delay = b.retryDelay
+		b.update(func(info *BackfillInfo) {
+			from, _ := new(big.Int).SetString(info.FromBlock, 10)
+			info.Progress.NextBlock = new(big.Int).Add(end, big.NewInt(1)).String()
+			info.Progress.EventsDelivered += delivered
+			info.Progress.LastError = ""
+			done := new(big.Int).Sub(end, from)
+			total := new(big.Int).Sub(to, from)
+			if total.Sign() > 0 {
+				info.Progress.PercentComplete = int(new(big.Int).Div(new(big.Int).Mul(done, big.NewInt(100)), total).Int64())
+			}
+		})
+		select {
+		case <-b.stop:
+			return
+		default:
+		}
+	}
+}
+
+func (b *backfill) fail(err error) {
+	b.update(func(info *BackfillInfo) {
+		info.Status = BackfillStatusFailed
+		info.Progress.LastError = err.Error()
+	})
+	log.Errorf("%s: Backfill failed: %s", b.info.ID, err)
+}
+
+// processPage reads the logs in a range of blocks, and delivers them in batches
+func (b *backfill) processPage(target backfillTarget, from, to *big.Int) (uint64, error) {
+	info := b.snapshot()
+	f := &ethFilter{}
+	if info.Address != nil {
+		f.Addresses = []ethbinding.Address{*info.Address}
+	}
+	f.Topics = [][]ethbinding.Hash{{b.event.ID}}
+	f.FromBlock.ToInt().Set(from)
+	f.ToBlock = "0x" + to.Text(16)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	var logs []*logEntry
+	if err := b.sm.rpc.CallContext(ctx, &logs, "eth_getLogs", f); err != nil {
+		return 0, errors.Errorf(errors.RPCCallReturnedError, "eth_getLogs", err)
+	}
+	log.Debugf("%s: Backfill blocks %s -> %s: %d events", info.ID, from, to, len(logs))
+
+	events := make([]*eventData, 0, len(logs))
+	for idx, entry := range logs {
+		event, err := decodeLogEntry(info.ID, info.ID, b.event, entry, idx, false)
+		if err != nil {
+			log.Errorf("Failed to process event: %s", err)
+			continue
+		}
+		events = append(events, event)
+	}
+	for i := 0; i < len(events); i += int(info.BatchSize) {
+		end := i + int(info.BatchSize)
+		if end > len(events) {
+			end = len(events)
+		}
+		if err := target.deliver(events[i:end]); err != nil {
+			return 0, err
+		}
+	}
+	return uint64(len(events)), nil
+}
+
+// kafkaBackfillTarget sends each event as a message to a topic, keyed by the contract address
+type kafkaBackfillTarget struct {
+	producer sarama.SyncProducer
+	topic    string
+}
+
+func (k *kafkaBackfillTarget) deliver(events []*eventData) error {
+	msgs := make([]*sarama.ProducerMessage, len(events))
+	for i, event := range events {
+		eventBytes, _ := json.Marshal(event)
+		msgs[i] = &sarama.ProducerMessage{
+			Topic: k.topic,
+			Key:   sarama.StringEncoder(event.Address),
+			Value: sarama.ByteEncoder(eventBytes),
+		}
+	}
+	return k.producer.SendMessages(msgs)
+}
+
+func (k *kafkaBackfillTarget) close() {
+	k.producer.Close()
+}
+
+// webhookBackfillTarget posts each batch of events as a JSON array
+type webhookBackfillTarget struct {
+	spec            *webhookActionInfo
+	allowPrivateIPs bool
+	sender          *webhook.Sender
+}
+
+func newWebhookBackfillTarget(spec *webhookActionInfo, allowPrivateIPs bool) *webhookBackfillTarget {
+	return &webhookBackfillTarget{
+		spec:            spec,
+		allowPrivateIPs: allowPrivateIPs,
+		sender:          webhook.NewSender(spec.URL, spec.URL, spec.Headers, "", spec.TLSkipHostVerify, time.Duration(spec.RequestTimeoutSec)*time.Second),
+	}
+}
+
+func (w *webhookBackfillTarget) deliver(events []*eventData) error {
+	return w.post(events)
+}
+
+// post sends a JSON payload to the webhook, checking the address is permitted
+func (w *webhookBackfillTarget) post(payload interface{}) error {
+	u, _ := url.Parse(w.spec.URL)
+	addr, err := net.ResolveIPAddr("ip4", u.Hostname())
+	if err != nil {
+		return err
+	}
+	if !w.allowPrivateIPs && isPrivateAddress(addr) {
+		return errors.Errorf(errors.EventStreamsWebhookProhibitedAddress, u.Hostname())
+	}
+	reqBytes, _ := json.Marshal(payload)
+	_, err = w.sender.Post(context.Background(), reqBytes, nil)
+	return err
+}
+
+func (w *webhookBackfillTarget) close() {}
+
+// validateBackfillTarget checks the target of a new backfill, without connecting to it
+func (s *subscriptionMGR) validateBackfillTarget(info *BackfillInfo) error {
+	info.Type = strings.ToLower(info.Type)
+	switch info.Type {
+	case "kafka":
+		if info.Kafka == nil || info.Kafka.Topic == "" {
+			return errors.Errorf(errors.BackfillKafkaNoTopic)
+		}
+		if len(s.conf.Backfills.Kafka.Brokers) == 0 {
+			return errors.Errorf(errors.BackfillKafkaNotConfigured)
+		}
+	case "webhook":
+		if info.Webhook == nil || info.Webhook.URL == "" {
+			return errors.Errorf(errors.EventStreamsWebhookNoURL)
+		}
+		if _, err := url.Parse(info.Webhook.URL); err != nil {
+			return errors.Errorf(errors.EventStreamsWebhookInvalidURL)
+		}
+		if info.Webhook.RequestTimeoutSec == 0 {
+			info.Webhook.RequestTimeoutSec = 120
+		}
+	default:
+		return errors.Errorf(errors.BackfillInvalidType, info.Type)
+	}
+	return nil
+}
+
+func (s *subscriptionMGR) newBackfillTarget(info *BackfillInfo) (backfillTarget, error) {
+	if info.Type == "webhook" {
+		return newWebhookBackfillTarget(info.Webhook, s.conf.WebhooksAllowPrivateIPs), nil
+	}
+	producer, err := s.newKafkaProducer(&s.conf.Backfills.Kafka)
+	if err != nil {
+		return nil, errors.Errorf(errors.BackfillKafkaConnect, err)
+	}
+	return &kafkaBackfillTarget{producer: producer, topic: info.Kafka.Topic}, nil
+}
+
+// newKafkaProducer connects a producer to a Kafka cluster, that waits for each message to be stored
+func (s *subscriptionMGR) newKafkaProducer(kconf *BackfillKafkaConf) (sarama.SyncProducer, error) {
+	clientConf := sarama.NewConfig()
+	tlsConfig, err := utils.CreateTLSConfiguration(&kconf.TLS)
+	if err != nil {
+		return nil, err
+	}
+	clientConf.Net.TLS.Enable = (tlsConfig != nil)
+	clientConf.Net.TLS.Config = tlsConfig
+	if kconf.SASL.Username != "" && kconf.SASL.Password != "" {
+		clientConf.Net.SASL.Enable = true
+		clientConf.Net.SASL.User = kconf.SASL.Username
+		clientConf.Net.SASL.Password = kconf.SASL.Password
+	}
+	clientConf.Producer.Return.Successes = true
+	clientConf.Producer.RequiredAcks = sarama.WaitForLocal
+	clientConf.Version = sarama.V2_0_0_0
+	clientConf.ClientID = kconf.ClientID
+	if clientConf.ClientID == "" {
+		clientConf.ClientID = utils.UUIDv4()
+	}
+	return s.kafkaProducer(kconf.Brokers, clientConf)
+}
+
+// parseBackfillEvent parses the ABI of the event of a backfill
+func parseBackfillEvent(event *ethbinding.ABIElementMarshaling) (*ethbinding.ABIEvent, error) {
+	if event == nil || event.Name == "" {
+		return nil, errors.Errorf(errors.EventStreamsSubscribeNoEvent)
+	}
+	return ethbind.API.ABIElementMarshalingToABIEvent(event)
+}
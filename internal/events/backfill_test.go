@@ -0,0 +1,383 @@
+// Copyright 2021 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package events
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/Shopify/sarama/mocks"
+	ethbinding "github.com/kaleido-io/ethbinding/pkg"
+	"github.com/kaleido-io/ethconnect/internal/eth"
+	"github.com/kaleido-io/ethconnect/internal/ethbind"
+	"github.com/kaleido-io/ethconnect/internal/kvstore"
+	"github.com/stretchr/testify/assert"
+)
+
+func testBackfillEvent() *ethbinding.ABIElementMarshaling {
+	return &ethbinding.ABIElementMarshaling{
+		Name: "Changed",
+		Inputs: []ethbinding.ABIArgumentMarshaling{
+			{Name: "from", Type: "address", Indexed: true},
+			{Name: "i", Type: "int64", Indexed: true},
+			{Name: "s", Type: "string", Indexed: true},
+			{Name: "h", Type: "bytes32"},
+			{Name: "m", Type: "string"},
+		},
+	}
+}
+
+// newTestBackfillManager returns the three test logs for the first page of blocks read
+// (including when it is read again after a failure), and none for the rest. The head of
+// the chain is block 999
+func newTestBackfillManager(t *testing.T) (*subscriptionMGR, *[][]interface{}) {
+	testDataBytes, err := ioutil.ReadFile("../../test/simplevents_logs.json")
+	assert.NoError(t, err)
+	var testData []*logEntry
+	json.Unmarshal(testDataBytes, &testData)
+
+	sm := newTestSubscriptionManager()
+	sm.conf.Backfills.PageSize = 500
+	sm.conf.Backfills.MaxAttempts = 2
+	filters := [][]interface{}{}
+	sm.rpc = eth.NewMockRPCClientForSync(nil, func(method string, res interface{}, args ...interface{}) {
+		switch method {
+		case "eth_blockNumber":
+			(*(res.(*ethbinding.HexBigInt))).ToInt().SetInt64(999)
+		case "eth_getLogs":
+			filters = append(filters, args)
+			if args[0].(*ethFilter).FromBlock.ToInt().Cmp(filters[0][0].(*ethFilter).FromBlock.ToInt()) == 0 {
+				*(res.(*[]*logEntry)) = testData
+			} else {
+				*(res.(*[]*logEntry)) = []*logEntry{}
+			}
+		}
+	})
+	return sm, &filters
+}
+
+func waitForBackfill(sm *subscriptionMGR, id string) *BackfillInfo {
+	for {
+		info, _ := sm.BackfillByID(context.Background(), id)
+		if info.Status != BackfillStatusRunning {
+			return info
+		}
+		time.Sleep(1 * time.Millisecond)
+	}
+}
+
+func TestBackfillToWebhook(t *testing.T) {
+	assert := assert.New(t)
+	batches := make(chan []*eventData, 2)
+	svr := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		var events []*eventData
+		json.NewDecoder(req.Body).Decode(&events)
+		assert.Equal("value1", req.Header.Get("x-header1"))
+		batches <- events
+	}))
+	defer svr.Close()
+	sm, filters := newTestBackfillManager(t)
+
+	addr := ethbind.API.HexToAddress("0x167f57a13a9c35ff92f0649d2be0e52b4f8ac3ca")
+	info, err := sm.AddBackfill(context.Background(), &BackfillInfo{
+		Address:   &addr,
+		Event:     testBackfillEvent(),
+		FromBlock: "100",
+		Type:      "Webhook",
+		BatchSize: 2,
+		Webhook: &webhookActionInfo{
+			URL:     svr.URL,
+			Headers: map[string]string{"x-header1": "value1"},
+		},
+	})
+	assert.NoError(err)
+	assert.Regexp("^bf-", info.ID)
+	assert.Equal("/backfills/"+info.ID, info.Path)
+	assert.Equal("100", info.FromBlock)
+	assert.Equal("999", info.ToBlock)
+	assert.Equal("webhook", info.Type)
+
+	info = waitForBackfill(sm, info.ID)
+	assert.Equal(BackfillStatusCompleted, info.Status)
+	assert.Equal("1000", info.Progress.NextBlock)
+	assert.Equal(100, info.Progress.PercentComplete)
+	assert.Equal(uint64(3), info.Progress.EventsDelivered)
+
+	batch1 := <-batches
+	batch2 := <-batches
+	assert.Equal(2, len(batch1))
+	assert.Equal(1, len(batch2))
+	assert.Equal(info.ID, batch1[0].SubID)
+	assert.Equal("42", batch1[0].Data["i"])
+
+	assert.Equal(2, len(*filters))
+	f := (*filters)[1][0].(*ethFilter)
+	assert.Equal("0x3e7", f.ToBlock)
+	assert.Equal(int64(600), f.FromBlock.ToInt().Int64())
+	assert.Equal(addr, f.Addresses[0])
+
+	var stored BackfillInfo
+	storedBytes, err := sm.db.Get(info.ID)
+	assert.NoError(err)
+	json.Unmarshal(storedBytes, &stored)
+	assert.Equal(BackfillStatusCompleted, stored.Status)
+
+	assert.Equal(1, len(sm.Backfills(context.Background())))
+	err = sm.DeleteBackfill(context.Background(), info.ID)
+	assert.NoError(err)
+	_, err = sm.BackfillByID(context.Background(), info.ID)
+	assert.Regexp("Backfill with ID 'bf-.*' not found", err)
+	err = sm.DeleteBackfill(context.Background(), info.ID)
+	assert.Regexp("Backfill with ID 'bf-.*' not found", err)
+}
+
+func TestBackfillToKafka(t *testing.T) {
+	assert := assert.New(t)
+	sm, _ := newTestBackfillManager(t)
+	sm.conf.Backfills.Kafka.Brokers = []string{"broker1"}
+	sm.conf.Backfills.Kafka.SASL.Username = "user1"
+	sm.conf.Backfills.Kafka.SASL.Password = "pass1"
+	producer := mocks.NewSyncProducer(t, nil)
+	producer.ExpectSendMessageAndSucceed()
+	producer.ExpectSendMessageAndSucceed()
+	producer.ExpectSendMessageAndSucceed()
+	var capturedConf *sarama.Config
+	sm.kafkaProducer = func(brokers []string, conf *sarama.Config) (sarama.SyncProducer, error) {
+		assert.Equal([]string{"broker1"}, brokers)
+		capturedConf = conf
+		return producer, nil
+	}
+
+	info, err := sm.AddBackfill(context.Background(), &BackfillInfo{
+		Event:     testBackfillEvent(),
+		FromBlock: "0x0",
+		ToBlock:   "999",
+		Type:      "kafka",
+		Kafka:     &backfillKafkaInfo{Topic: "topic1"},
+	})
+	assert.NoError(err)
+	info = waitForBackfill(sm, info.ID)
+	assert.Equal(BackfillStatusCompleted, info.Status)
+	assert.Equal(uint64(3), info.Progress.EventsDelivered)
+	assert.True(capturedConf.Net.SASL.Enable)
+	assert.NotEmpty(capturedConf.ClientID)
+}
+
+func TestBackfillKafkaConnectFail(t *testing.T) {
+	assert := assert.New(t)
+	sm, _ := newTestBackfillManager(t)
+	sm.conf.Backfills.Kafka.Brokers = []string{"broker1"}
+	sm.kafkaProducer = func(brokers []string, conf *sarama.Config) (sarama.SyncProducer, error) {
+		return nil, fmt.Errorf("pop")
+	}
+
+	info, err := sm.AddBackfill(context.Background(), &BackfillInfo{
+		Event: testBackfillEvent(),
+		Type:  "kafka",
+		Kafka: &backfillKafkaInfo{Topic: "topic1"},
+	})
+	assert.NoError(err)
+	info = waitForBackfill(sm, info.ID)
+	assert.Equal(BackfillStatusFailed, info.Status)
+	assert.Equal("Failed to connect to Kafka for backfill: pop", info.Progress.LastError)
+}
+
+func TestBackfillKafkaBadTLS(t *testing.T) {
+	assert := assert.New(t)
+	sm, _ := newTestBackfillManager(t)
+	sm.conf.Backfills.Kafka.TLS.Enabled = true
+	sm.conf.Backfills.Kafka.TLS.ClientCertsFile = "/does/not/exist"
+	sm.conf.Backfills.Kafka.TLS.ClientKeyFile = "/does/not/exist"
+
+	_, err := sm.newBackfillTarget(&BackfillInfo{Type: "kafka", Kafka: &backfillKafkaInfo{Topic: "topic1"}})
+	assert.Regexp("Failed to connect to Kafka for backfill", err)
+}
+
+func TestBackfillFailAndResume(t *testing.T) {
+	assert := assert.New(t)
+	status := 500
+	svr := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		res.WriteHeader(status)
+	}))
+	defer svr.Close()
+	sm, _ := newTestBackfillManager(t)
+
+	info, err := sm.AddBackfill(context.Background(), &BackfillInfo{
+		Event:   testBackfillEvent(),
+		Type:    "webhook",
+		Webhook: &webhookActionInfo{URL: svr.URL},
+	})
+	assert.NoError(err)
+	sm.backfills[info.ID].retryDelay = 1 * time.Millisecond
+	info = waitForBackfill(sm, info.ID)
+	assert.Equal(BackfillStatusFailed, info.Status)
+	assert.Regexp("Failed with status=500", info.Progress.LastError)
+	assert.Equal("0", info.Progress.NextBlock)
+
+	status = 200
+	info, err = sm.ResumeBackfill(context.Background(), info.ID)
+	assert.NoError(err)
+	info = waitForBackfill(sm, info.ID)
+	assert.Equal(BackfillStatusCompleted, info.Status)
+	assert.Equal("", info.Progress.LastError)
+
+	_, err = sm.ResumeBackfill(context.Background(), info.ID)
+	assert.Regexp("Backfill 'bf-.*' is completed. Only a failed backfill can be resumed", err)
+	_, err = sm.ResumeBackfill(context.Background(), "bf-unknown")
+	assert.Regexp("Backfill with ID 'bf-unknown' not found", err)
+}
+
+func TestBackfillGetLogsFail(t *testing.T) {
+	assert := assert.New(t)
+	sm, _ := newTestBackfillManager(t)
+	sm.conf.Backfills.MaxAttempts = 1
+
+	info, err := sm.AddBackfill(context.Background(), &BackfillInfo{
+		Event:   testBackfillEvent(),
+		Type:    "webhook",
+		Webhook: &webhookActionInfo{URL: "http://localhost:0"},
+		ToBlock: "10",
+	})
+	assert.NoError(err)
+	sm.rpc = eth.NewMockRPCClientForSync(fmt.Errorf("pop"), nil)
+	info = waitForBackfill(sm, info.ID)
+	assert.Equal(BackfillStatusFailed, info.Status)
+}
+
+func TestBackfillStopWhileRetrying(t *testing.T) {
+	assert := assert.New(t)
+	svr := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		res.WriteHeader(500)
+	}))
+	defer svr.Close()
+	sm, _ := newTestBackfillManager(t)
+	sm.conf.Backfills.MaxAttempts = 100
+
+	info, err := sm.AddBackfill(context.Background(), &BackfillInfo{
+		Event:   testBackfillEvent(),
+		Type:    "webhook",
+		Webhook: &webhookActionInfo{URL: svr.URL},
+	})
+	assert.NoError(err)
+	for info.Progress.LastError == "" {
+		time.Sleep(1 * time.Millisecond)
+		info, _ = sm.BackfillByID(context.Background(), info.ID)
+	}
+	sm.Close()
+	info, _ = sm.BackfillByID(context.Background(), info.ID)
+	assert.Equal(BackfillStatusRunning, info.Status)
+}
+
+func TestBackfillWebhookPrivateIP(t *testing.T) {
+	assert := assert.New(t)
+	w := newWebhookBackfillTarget(&webhookActionInfo{URL: "http://127.0.0.1:0"}, false)
+	err := w.deliver([]*eventData{})
+	assert.EqualError(err, "Cannot send Webhook POST to address: 127.0.0.1")
+
+	w.spec.URL = "http://badness.invalid"
+	err = w.deliver([]*eventData{})
+	assert.Error(err)
+}
+
+func TestAddBackfillValidation(t *testing.T) {
+	assert := assert.New(t)
+	sm, _ := newTestBackfillManager(t)
+	ctx := context.Background()
+	webhook := &webhookActionInfo{URL: "http://example.com"}
+
+	_, err := sm.AddBackfill(ctx, &BackfillInfo{Type: "webhook", Webhook: webhook})
+	assert.EqualError(err, "Solidity event name must be specified")
+	_, err = sm.AddBackfill(ctx, &BackfillInfo{Event: testBackfillEvent(), Type: "websocket"})
+	assert.EqualError(err, "Unknown backfill type 'websocket'. Valid types are: 'kafka' and 'webhook'")
+	_, err = sm.AddBackfill(ctx, &BackfillInfo{Event: testBackfillEvent(), Type: "kafka"})
+	assert.EqualError(err, "Must specify kafka.topic for backfill type 'kafka'")
+	_, err = sm.AddBackfill(ctx, &BackfillInfo{Event: testBackfillEvent(), Type: "kafka", Kafka: &backfillKafkaInfo{Topic: "topic1"}})
+	assert.EqualError(err, "Kafka brokers must be configured in the backfills configuration for backfill type 'kafka'")
+	_, err = sm.AddBackfill(ctx, &BackfillInfo{Event: testBackfillEvent(), Type: "webhook"})
+	assert.EqualError(err, "Must specify webhook.url for action type 'webhook'")
+	_, err = sm.AddBackfill(ctx, &BackfillInfo{Event: testBackfillEvent(), Type: "webhook", Webhook: &webhookActionInfo{URL: ":badurl"}})
+	assert.EqualError(err, "Invalid URL in webhook action")
+	_, err = sm.AddBackfill(ctx, &BackfillInfo{Event: testBackfillEvent(), Type: "webhook", Webhook: webhook, FromBlock: "-1"})
+	assert.EqualError(err, "Backfill fromBlock '-1' must be a block number")
+	_, err = sm.AddBackfill(ctx, &BackfillInfo{Event: testBackfillEvent(), Type: "webhook", Webhook: webhook, ToBlock: "head"})
+	assert.EqualError(err, "Backfill toBlock 'head' must be a block number")
+	_, err = sm.AddBackfill(ctx, &BackfillInfo{Event: testBackfillEvent(), Type: "webhook", Webhook: webhook, FromBlock: "1000"})
+	assert.EqualError(err, "Backfill fromBlock 1000 is after toBlock 999")
+
+	sm.rpc = eth.NewMockRPCClientForSync(fmt.Errorf("pop"), nil)
+	_, err = sm.AddBackfill(ctx, &BackfillInfo{Event: testBackfillEvent(), Type: "webhook", Webhook: webhook})
+	assert.EqualError(err, "eth_blockNumber returned: pop")
+
+	sm.db = kvstore.NewMockKV(fmt.Errorf("pop"))
+	_, err = sm.AddBackfill(ctx, &BackfillInfo{Event: testBackfillEvent(), Type: "webhook", Webhook: webhook, ToBlock: "10", BatchSize: 5000})
+	assert.EqualError(err, "Failed to store backfill: pop")
+}
+
+func TestRecoverBackfills(t *testing.T) {
+	assert := assert.New(t)
+	dir := tempdir(t)
+	defer cleanup(t, dir)
+	received := make(chan []*eventData, 1)
+	svr := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		var events []*eventData
+		json.NewDecoder(req.Body).Decode(&events)
+		received <- events
+	}))
+	defer svr.Close()
+
+	sm, filters := newTestBackfillManager(t)
+	sm.conf.EventLevelDBPath = path.Join(dir, "db")
+	db, _ := kvstore.NewLDBKeyValueStore(sm.conf.EventLevelDBPath)
+	running, _ := json.Marshal(&BackfillInfo{
+		ID:        "bf-running",
+		Event:     testBackfillEvent(),
+		FromBlock: "0",
+		ToBlock:   "999",
+		Type:      "webhook",
+		BatchSize: 10,
+		Webhook:   &webhookActionInfo{URL: svr.URL, RequestTimeoutSec: 10},
+		Status:    BackfillStatusRunning,
+		Progress:  BackfillProgress{NextBlock: "500"},
+	})
+	db.Put("bf-running", running)
+	completed, _ := json.Marshal(&BackfillInfo{
+		ID:     "bf-completed",
+		Event:  testBackfillEvent(),
+		Status: BackfillStatusCompleted,
+	})
+	db.Put("bf-completed", completed)
+	db.Put("bf-badjson", []byte("!json"))
+	noEvent, _ := json.Marshal(&BackfillInfo{ID: "bf-noevent"})
+	db.Put("bf-noevent", noEvent)
+	db.Close()
+
+	err := sm.Init()
+	assert.NoError(err)
+	defer sm.Close()
+	assert.Equal(2, len(sm.Backfills(context.Background())))
+
+	info := waitForBackfill(sm, "bf-running")
+	assert.Equal(BackfillStatusCompleted, info.Status)
+	assert.Equal(3, len(<-received))
+	assert.Equal(int64(500), (*filters)[0][0].(*ethFilter).FromBlock.ToInt().Int64())
+}
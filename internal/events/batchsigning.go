@@ -0,0 +1,176 @@
+// Copyright 2021 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package events
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+
+	"github.com/kaleido-io/ethconnect/internal/errors"
+)
+
+const (
+	// BatchSignatureAlgES256 is an ECDSA P-256 signature over the SHA-256 digest, ASN.1 encoded
+	BatchSignatureAlgES256 = "ES256"
+	// BatchSignatureAlgEdDSA is an Ed25519 signature
+	BatchSignatureAlgEdDSA = "EdDSA"
+
+	// BatchNumberHeader is the webhook header containing the batch number of a signed batch
+	BatchNumberHeader = "X-Ethconnect-Batch-Number"
+	// BatchSignatureHeader is the webhook header containing the base64 signature of the body
+	BatchSignatureHeader = "X-Ethconnect-Batch-Signature"
+	// BatchSignatureAlgHeader is the webhook header containing the signature algorithm
+	BatchSignatureAlgHeader = "X-Ethconnect-Batch-Signature-Alg"
+	// BatchKeyIDHeader is the webhook header containing the ID of the gateway key
+	BatchKeyIDHeader = "X-Ethconnect-Batch-Key-Id"
+	// BatchDigestHeader is the webhook header containing the hex SHA-256 digest of the body
+	BatchDigestHeader = "X-Ethconnect-Batch-Digest"
+)
+
+// BatchSigningConf configures the gateway key used to sign the batches delivered by
+// event streams that have signBatches set
+type BatchSigningConf struct {
+	KeyFile string `json:"keyFile,omitempty"`
+	KeyID   string `json:"keyId,omitempty"`
+}
+
+// BatchSignature is the detached signature of the JSON array of events in a batch
+type BatchSignature struct {
+	Algorithm string `json:"alg"`
+	KeyID     string `json:"keyId,omitempty"`
+	Digest    string `json:"digest"`
+	Signature string `json:"signature"`
+}
+
+// signedBatch is delivered over WebSockets in place of the array of events, when the stream
+// signs its batches. The events are the exact bytes that were signed
+type signedBatch struct {
+	BatchNumber uint64          `json:"batchNumber"`
+	Events      json.RawMessage `json:"events"`
+	Signature   *BatchSignature `json:"signature"`
+}
+
+// JSONOnly keeps a signed batch as JSON on MessagePack connections, so the events are sent as
+// the exact bytes that were signed
+func (b *signedBatch) JSONOnly() bool {
+	return true
+}
+
+type batchSigner struct {
+	keyID  string
+	alg    string
+	signer crypto.Signer
+}
+
+// newBatchSigner loads a PEM encoded PKCS#8 or SEC1 private key, returning nil if no key is configured
+func newBatchSigner(conf *BatchSigningConf) (*batchSigner, error) {
+	if conf.KeyFile == "" {
+		return nil, nil
+	}
+	pemBytes, err := ioutil.ReadFile(conf.KeyFile)
+	if err != nil {
+		return nil, errors.Errorf(errors.EventStreamsBatchSigningKeyLoad, conf.KeyFile, err)
+	}
+	block, _ := pem.Decode(pemBytes)
+	if block == nil {
+		return nil, errors.Errorf(errors.EventStreamsBatchSigningKeyLoad, conf.KeyFile, "no PEM data found")
+	}
+	var key interface{}
+	if block.Type == "EC PRIVATE KEY" {
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	} else {
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	}
+	if err != nil {
+		return nil, errors.Errorf(errors.EventStreamsBatchSigningKeyLoad, conf.KeyFile, err)
+	}
+	s := &batchSigner{keyID: conf.KeyID}
+	switch k := key.(type) {
+	case *ecdsa.PrivateKey:
+		if k.Curve != elliptic.P256() {
+			return nil, errors.Errorf(errors.EventStreamsBatchSigningKeyType, "ECDSA "+k.Curve.Params().Name)
+		}
+		s.alg = BatchSignatureAlgES256
+		s.signer = k
+	case ed25519.PrivateKey:
+		s.alg = BatchSignatureAlgEdDSA
+		s.signer = k
+	default:
+		return nil, errors.Errorf(errors.EventStreamsBatchSigningKeyType, fmt.Sprintf("%T", key))
+	}
+	return s, nil
+}
+
+// sign returns the detached signature of the serialized events
+func (s *batchSigner) sign(eventsBytes []byte) (*BatchSignature, error) {
+	digest := sha256.Sum256(eventsBytes)
+	var sig []byte
+	var err error
+	if s.alg == BatchSignatureAlgEdDSA {
+		sig, err = s.signer.Sign(rand.Reader, eventsBytes, crypto.Hash(0))
+	} else {
+		sig, err = s.signer.Sign(rand.Reader, digest[:], crypto.SHA256)
+	}
+	if err != nil {
+		return nil, errors.Errorf(errors.EventStreamsBatchSigningFailed, err)
+	}
+	return &BatchSignature{
+		Algorithm: s.alg,
+		KeyID:     s.keyID,
+		Digest:    hex.EncodeToString(digest[:]),
+		Signature: base64.StdEncoding.EncodeToString(sig),
+	}, nil
+}
+
+// headers returns the webhook headers carrying the signature of a batch
+func (sig *BatchSignature) headers(batchNumber uint64) map[string]string {
+	h := map[string]string{
+		BatchNumberHeader:       strconv.FormatUint(batchNumber, 10),
+		BatchSignatureHeader:    sig.Signature,
+		BatchSignatureAlgHeader: sig.Algorithm,
+		BatchDigestHeader:       sig.Digest,
+	}
+	if sig.KeyID != "" {
+		h[BatchKeyIDHeader] = sig.KeyID
+	}
+	return h
+}
+
+// signBatch serializes the events in a batch, and signs them if the stream signs its batches.
+// The signature is nil for streams that do not
+func (a *eventStream) signBatch(events []*eventData) ([]byte, *BatchSignature, error) {
+	eventsBytes, err := json.Marshal(&events)
+	if err != nil || !a.spec.SignBatches {
+		return eventsBytes, nil, err
+	}
+	signer := a.sm.batchSigner()
+	if signer == nil {
+		return nil, nil, errors.Errorf(errors.EventStreamsBatchSigningNotConfigured)
+	}
+	sig, err := signer.sign(eventsBytes)
+	return eventsBytes, sig, err
+}
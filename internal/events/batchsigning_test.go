@@ -0,0 +1,255 @@
+// Copyright 2021 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package events
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func writeTestKey(t *testing.T, dir, pemType string, der []byte) string {
+	keyFile := path.Join(dir, "key.pem")
+	err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: pemType, Bytes: der}), 0600)
+	assert.NoError(t, err)
+	return keyFile
+}
+
+func newTestECDSASigner(t *testing.T, dir string) (*batchSigner, *ecdsa.PrivateKey) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	der, _ := x509.MarshalPKCS8PrivateKey(key)
+	signer, err := newBatchSigner(&BatchSigningConf{
+		KeyFile: writeTestKey(t, dir, "PRIVATE KEY", der),
+		KeyID:   "gateway1",
+	})
+	assert.NoError(t, err)
+	return signer, key
+}
+
+func verifyTestSignature(t *testing.T, key *ecdsa.PrivateKey, eventsBytes []byte, sig *BatchSignature) {
+	assert := assert.New(t)
+	digest := sha256.Sum256(eventsBytes)
+	assert.Equal(hex.EncodeToString(digest[:]), sig.Digest)
+	sigBytes, err := base64.StdEncoding.DecodeString(sig.Signature)
+	assert.NoError(err)
+	assert.True(ecdsa.VerifyASN1(&key.PublicKey, digest[:], sigBytes))
+}
+
+func TestBatchSignerNotConfigured(t *testing.T) {
+	assert := assert.New(t)
+	signer, err := newBatchSigner(&BatchSigningConf{})
+	assert.NoError(err)
+	assert.Nil(signer)
+}
+
+func TestBatchSignerEd25519(t *testing.T) {
+	assert := assert.New(t)
+	dir := tempdir(t)
+	defer cleanup(t, dir)
+
+	pub, key, _ := ed25519.GenerateKey(rand.Reader)
+	der, _ := x509.MarshalPKCS8PrivateKey(key)
+	signer, err := newBatchSigner(&BatchSigningConf{KeyFile: writeTestKey(t, dir, "PRIVATE KEY", der)})
+	assert.NoError(err)
+
+	sig, err := signer.sign([]byte(`[]`))
+	assert.NoError(err)
+	assert.Equal(BatchSignatureAlgEdDSA, sig.Algorithm)
+	sigBytes, _ := base64.StdEncoding.DecodeString(sig.Signature)
+	assert.True(ed25519.Verify(pub, []byte(`[]`), sigBytes))
+	headers := sig.headers(5)
+	assert.Equal("5", headers[BatchNumberHeader])
+	_, hasKeyID := headers[BatchKeyIDHeader]
+	assert.False(hasKeyID)
+}
+
+func TestBatchSignerSEC1(t *testing.T) {
+	assert := assert.New(t)
+	dir := tempdir(t)
+	defer cleanup(t, dir)
+
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	der, _ := x509.MarshalECPrivateKey(key)
+	signer, err := newBatchSigner(&BatchSigningConf{KeyFile: writeTestKey(t, dir, "EC PRIVATE KEY", der)})
+	assert.NoError(err)
+
+	sig, err := signer.sign([]byte(`[]`))
+	assert.NoError(err)
+	assert.Equal(BatchSignatureAlgES256, sig.Algorithm)
+	verifyTestSignature(t, key, []byte(`[]`), sig)
+}
+
+func TestBatchSignerBadKeys(t *testing.T) {
+	assert := assert.New(t)
+	dir := tempdir(t)
+	defer cleanup(t, dir)
+
+	_, err := newBatchSigner(&BatchSigningConf{KeyFile: path.Join(dir, "missing.pem")})
+	assert.Regexp("Failed to load event batch signing key", err)
+
+	keyFile := path.Join(dir, "notpem.pem")
+	ioutil.WriteFile(keyFile, []byte("not a key"), 0600)
+	_, err = newBatchSigner(&BatchSigningConf{KeyFile: keyFile})
+	assert.Regexp("no PEM data found", err)
+
+	_, err = newBatchSigner(&BatchSigningConf{KeyFile: writeTestKey(t, dir, "PRIVATE KEY", []byte("garbage"))})
+	assert.Regexp("Failed to load event batch signing key", err)
+
+	p384Key, _ := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	der, _ := x509.MarshalPKCS8PrivateKey(p384Key)
+	_, err = newBatchSigner(&BatchSigningConf{KeyFile: writeTestKey(t, dir, "PRIVATE KEY", der)})
+	assert.EqualError(err, "Unsupported event batch signing key type 'ECDSA P-384'. ECDSA P-256 and Ed25519 keys are supported")
+
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	der, _ = x509.MarshalPKCS8PrivateKey(rsaKey)
+	_, err = newBatchSigner(&BatchSigningConf{KeyFile: writeTestKey(t, dir, "PRIVATE KEY", der)})
+	assert.Regexp("Unsupported event batch signing key type '\\*rsa.PrivateKey'", err)
+}
+
+func TestInitBatchSigningKeyFail(t *testing.T) {
+	assert := assert.New(t)
+	dir := tempdir(t)
+	defer cleanup(t, dir)
+
+	sm := newTestSubscriptionManager()
+	sm.config().EventLevelDBPath = path.Join(dir, "db")
+	sm.config().BatchSigning.KeyFile = path.Join(dir, "missing.pem")
+	err := sm.Init()
+	assert.Regexp("Failed to load event batch signing key", err)
+	sm.Close()
+}
+
+func TestSignBatchesNotConfigured(t *testing.T) {
+	assert := assert.New(t)
+	sm := newTestSubscriptionManager()
+	_, err := sm.AddStream(context.Background(), &StreamInfo{
+		Type:        "webhook",
+		Webhook:     &webhookActionInfo{URL: "http://test.invalid"},
+		SignBatches: true,
+	})
+	assert.EqualError(err, "Signed batches cannot be enabled on the event stream, as no batch signing key is configured")
+
+	stream, err := sm.AddStream(context.Background(), &StreamInfo{
+		Type:    "webhook",
+		Webhook: &webhookActionInfo{URL: "http://test.invalid"},
+	})
+	assert.NoError(err)
+	defer sm.Close()
+	_, err = sm.UpdateStream(context.Background(), stream.ID, &StreamInfo{SignBatches: true})
+	assert.EqualError(err, "Signed batches cannot be enabled on the event stream, as no batch signing key is configured")
+}
+
+func TestSignBatchesWebhook(t *testing.T) {
+	assert := assert.New(t)
+	dir := tempdir(t)
+	defer cleanup(t, dir)
+
+	var body []byte
+	var headers http.Header
+	svr := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		body, _ = ioutil.ReadAll(req.Body)
+		headers = req.Header
+		res.WriteHeader(200)
+	}))
+	defer svr.Close()
+
+	sm := newTestSubscriptionManager()
+	var key *ecdsa.PrivateKey
+	sm.signer, key = newTestECDSASigner(t, dir)
+	spec, err := sm.AddStream(context.Background(), &StreamInfo{
+		Type:        "webhook",
+		Webhook:     &webhookActionInfo{URL: svr.URL},
+		SignBatches: true,
+	})
+	assert.NoError(err)
+	defer sm.Close()
+
+	stream := sm.streams[spec.ID]
+	err = stream.action.attemptBatch(12, 1, []*eventData{testEvent("sub1"), testEvent("sub2")})
+	assert.NoError(err)
+
+	var events []*eventData
+	assert.NoError(json.Unmarshal(body, &events))
+	assert.Equal(2, len(events))
+	assert.Equal("12", headers.Get(BatchNumberHeader))
+	assert.Equal("gateway1", headers.Get(BatchKeyIDHeader))
+	assert.Equal(BatchSignatureAlgES256, headers.Get(BatchSignatureAlgHeader))
+	verifyTestSignature(t, key, body, &BatchSignature{
+		Digest:    headers.Get(BatchDigestHeader),
+		Signature: headers.Get(BatchSignatureHeader),
+	})
+}
+
+func TestSignBatchesWebSocket(t *testing.T) {
+	assert := assert.New(t)
+	dir := tempdir(t)
+	defer cleanup(t, dir)
+
+	sm := newTestSubscriptionManager()
+	var key *ecdsa.PrivateKey
+	sm.signer, key = newTestECDSASigner(t, dir)
+	spec, err := sm.AddStream(context.Background(), &StreamInfo{
+		Type: "websocket",
+		WebSocket: &webSocketActionInfo{
+			DistributionMode: DistributionModeBroadcast,
+		},
+		SignBatches: true,
+	})
+	assert.NoError(err)
+	defer sm.Close()
+
+	stream := sm.streams[spec.ID]
+	mws := stream.wsChannels.(*mockWebSocket)
+	done := make(chan error)
+	go func() {
+		done <- stream.action.attemptBatch(3, 1, []*eventData{testEvent("sub1")})
+	}()
+	sent := <-mws.broadcast
+	assert.NoError(<-done)
+
+	// Verify what the client receives
+	sentBytes, _ := json.Marshal(sent)
+	var batch signedBatch
+	assert.NoError(json.Unmarshal(sentBytes, &batch))
+	assert.Equal(uint64(3), batch.BatchNumber)
+	assert.Equal("gateway1", batch.Signature.KeyID)
+	verifyTestSignature(t, key, batch.Events, batch.Signature)
+}
+
+func TestSignBatchNoSigner(t *testing.T) {
+	assert := assert.New(t)
+	stream := &eventStream{
+		sm:   &mockSubMgr{},
+		spec: &StreamInfo{SignBatches: true},
+	}
+	_, _, err := stream.signBatch([]*eventData{})
+	assert.Regexp("no batch signing key is configured", err)
+}
@@ -0,0 +1,138 @@
+// Copyright 2021 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package events
+
+import (
+	"strings"
+
+	"github.com/kaleido-io/ethconnect/internal/errors"
+	"github.com/kaleido-io/ethconnect/internal/quotas"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// catchupRangeGrowAfter is the number of eth_getLogs queries that must succeed in a row,
+	// before a block range that was shrunk is doubled again
+	catchupRangeGrowAfter = 10
+)
+
+// tooManyResultsErrors are the errors nodes return when the logs for a block range cannot
+// be returned in a single eth_getLogs response
+var tooManyResultsErrors = []string{
+	"query returned more than",
+	"log response size exceeded",
+}
+
+// CatchupPolicy limits the load the subscriptions of a stream put on the node in catch-up
+// mode, when reading the events of old blocks with eth_getLogs
+type CatchupPolicy struct {
+	// MaxBlockRange is the largest range of blocks read by a single query, instead of the
+	// catchupModePageSize of the gateway
+	MaxBlockRange int64 `json:"maxBlockRange,omitempty"`
+	// MaxLogsPerBatch re-reads a range in smaller pieces if it returns more events than this
+	MaxLogsPerBatch int `json:"maxLogsPerBatch,omitempty"`
+	// MaxRequestsPerSec is shared by all the subscriptions of the stream
+	MaxRequestsPerSec int `json:"maxRequestsPerSec,omitempty"`
+}
+
+func validateCatchupPolicy(policy *CatchupPolicy) error {
+	if policy != nil && (policy.MaxBlockRange < 0 || policy.MaxLogsPerBatch < 0 || policy.MaxRequestsPerSec < 0) {
+		return errors.Errorf(errors.EventStreamsInvalidCatchupPolicy)
+	}
+	return nil
+}
+
+// applyCatchupPolicy creates the request rate limit of the stream from its catch-up policy
+func (a *eventStream) applyCatchupPolicy() {
+	a.catchupLimiter = nil
+	if policy := a.spec.Catchup; policy != nil && policy.MaxRequestsPerSec > 0 {
+		a.catchupLimiter = quotas.NewBurstThrottle(policy.MaxRequestsPerSec, policy.MaxRequestsPerSec)
+	}
+}
+
+func isTooManyResultsError(err error) bool {
+	msg := strings.ToLower(err.Error())
+	for _, tooMany := range tooManyResultsErrors {
+		if strings.Contains(msg, tooMany) {
+			return true
+		}
+	}
+	return false
+}
+
+// catchupPolicy returns the policy of the stream of the subscription, and its request rate limit
+func (s *subscription) catchupPolicy() (*CatchupPolicy, *quotas.Throttle) {
+	if s.lp == nil || s.lp.stream == nil || s.lp.stream.spec.Catchup == nil {
+		return &CatchupPolicy{}, nil
+	}
+	return s.lp.stream.spec.Catchup, s.lp.stream.catchupLimiter
+}
+
+// catchupMaxRange is the largest range of blocks read by an eth_getLogs query in catch-up mode
+func (s *subscription) catchupMaxRange() int64 {
+	if policy, _ := s.catchupPolicy(); policy.MaxBlockRange > 0 {
+		return policy.MaxBlockRange
+	}
+	return s.catchupModePageSize
+}
+
+// catchupPageSize is the range of blocks for the next eth_getLogs query in catch-up mode,
+// which is smaller than the maximum while the range is shrunk
+func (s *subscription) catchupPageSize() int64 {
+	pageSize := s.catchupMaxRange()
+	if s.catchupRange > 0 && s.catchupRange < pageSize {
+		pageSize = s.catchupRange
+	}
+	return pageSize
+}
+
+// catchupBlockGap is the number of blocks behind the head of the chain at which a subscription
+// goes into catch-up mode, rather than creating a filter that reads all of them in one query
+func (s *subscription) catchupBlockGap() int64 {
+	policy, _ := s.catchupPolicy()
+	if policy.MaxBlockRange > 0 && (s.catchupModeBlockGap <= 0 || policy.MaxBlockRange < s.catchupModeBlockGap) {
+		return policy.MaxBlockRange
+	}
+	return s.catchupModeBlockGap
+}
+
+// shrinkCatchupRange halves the block range of the following queries, and returns false if
+// the range is already a single block
+func (s *subscription) shrinkCatchupRange(pageSize int64, reason string) bool {
+	if pageSize <= 1 {
+		return false
+	}
+	s.catchupRange = pageSize / 2
+	s.catchupSuccesses = 0
+	log.Warnf("%s: catchup mode. Reducing block range from %d to %d: %s", s.logName, pageSize, s.catchupRange, reason)
+	return true
+}
+
+// catchupQuerySucceeded grows a range that was shrunk back towards the maximum, once enough
+// queries in a row have succeeded
+func (s *subscription) catchupQuerySucceeded() {
+	if s.catchupRange <= 0 {
+		return
+	}
+	s.catchupSuccesses++
+	if s.catchupSuccesses >= catchupRangeGrowAfter {
+		s.catchupRange *= 2
+		s.catchupSuccesses = 0
+		if s.catchupRange >= s.catchupMaxRange() {
+			s.catchupRange = 0
+		}
+		log.Infof("%s: catchup mode. Increasing block range to %d", s.logName, s.catchupPageSize())
+	}
+}
@@ -0,0 +1,164 @@
+// Copyright 2021 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package events
+
+import (
+	"context"
+	"fmt"
+	"math/big"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// testCatchupRPC records the block range of each eth_getLogs query. Ranges larger than
+// tooManyAbove fail as a node does when there are too many results, and ranges larger
+// than logsAbove return two events
+type testCatchupRPC struct {
+	ranges       []int64
+	tooManyAbove int64
+	logsAbove    int64
+}
+
+func (r *testCatchupRPC) CallContext(ctx context.Context, result interface{}, method string, args ...interface{}) error {
+	if method != "eth_getLogs" {
+		return nil
+	}
+	f := args[0].(*ethFilter)
+	to, _ := strconv.ParseInt(f.ToBlock[2:], 16, 64)
+	size := to - f.FromBlock.ToInt().Int64() + 1
+	r.ranges = append(r.ranges, size)
+	if size > r.tooManyAbove {
+		return fmt.Errorf("query returned more than 10000 results")
+	}
+	if size > r.logsAbove {
+		*(result.(*[]*logEntry)) = []*logEntry{{}, {}}
+	}
+	return nil
+}
+
+func newTestCatchupSub(rpc *testCatchupRPC, policy *CatchupPolicy) *subscription {
+	s := newTestReorgSub(0, &testReorgChain{})
+	s.rpc = rpc
+	s.info = &SubscriptionInfo{}
+	s.catchupBlock = big.NewInt(0)
+	s.catchupModePageSize = 250
+	s.lp.stream.spec.Catchup = policy
+	s.lp.stream.applyCatchupPolicy()
+	return s
+}
+
+func TestCatchupRangeShrinksOnTooManyResults(t *testing.T) {
+	assert := assert.New(t)
+	rpc := &testCatchupRPC{tooManyAbove: 100, logsAbove: 1000}
+	s := newTestCatchupSub(rpc, &CatchupPolicy{MaxBlockRange: 1000})
+
+	for i := 0; i < 4; i++ {
+		assert.NoError(s.processCatchupBlocks(context.Background()))
+	}
+	assert.Equal([]int64{1000, 500, 250, 125}, rpc.ranges)
+	assert.Equal(int64(0), s.catchupBlock.Int64())
+	assert.NoError(s.processCatchupBlocks(context.Background()))
+	assert.Equal(int64(62), s.catchupBlock.Int64())
+
+	// The range is doubled after enough queries succeed, and shrunk again when it is too large
+	for i := 1; i < catchupRangeGrowAfter; i++ {
+		assert.NoError(s.processCatchupBlocks(context.Background()))
+	}
+	assert.Equal(int64(124), s.catchupPageSize())
+	rpc.ranges = nil
+	assert.NoError(s.processCatchupBlocks(context.Background()))
+	assert.Equal([]int64{124}, rpc.ranges)
+	assert.Equal(int64(62), s.catchupPageSize())
+}
+
+func TestCatchupRangeGrowsBackToMax(t *testing.T) {
+	assert := assert.New(t)
+	s := newTestCatchupSub(&testCatchupRPC{tooManyAbove: 1000, logsAbove: 1000}, nil)
+	s.catchupRange = 200
+	for i := 0; i < catchupRangeGrowAfter; i++ {
+		assert.NoError(s.processCatchupBlocks(context.Background()))
+	}
+	assert.Equal(int64(0), s.catchupRange)
+	assert.Equal(int64(250), s.catchupPageSize())
+}
+
+func TestCatchupSingleBlockTooManyResults(t *testing.T) {
+	assert := assert.New(t)
+	s := newTestCatchupSub(&testCatchupRPC{}, &CatchupPolicy{MaxBlockRange: 2})
+	assert.NoError(s.processCatchupBlocks(context.Background()))
+	err := s.processCatchupBlocks(context.Background())
+	assert.EqualError(err, "eth_getLogs returned: query returned more than 10000 results")
+	assert.Equal(int64(0), s.catchupBlock.Int64())
+}
+
+func TestCatchupMaxLogsPerBatch(t *testing.T) {
+	assert := assert.New(t)
+	rpc := &testCatchupRPC{tooManyAbove: 1000, logsAbove: 10}
+	s := newTestCatchupSub(rpc, &CatchupPolicy{MaxBlockRange: 20, MaxLogsPerBatch: 1})
+	assert.NoError(s.processCatchupBlocks(context.Background()))
+	assert.Equal(int64(0), s.catchupBlock.Int64())
+	assert.NoError(s.processCatchupBlocks(context.Background()))
+	assert.Equal(int64(10), s.catchupBlock.Int64())
+	assert.Equal([]int64{20, 10}, rpc.ranges)
+}
+
+func TestCatchupMaxRequestsPerSec(t *testing.T) {
+	assert := assert.New(t)
+	rpc := &testCatchupRPC{tooManyAbove: 1000, logsAbove: 1000}
+	s := newTestCatchupSub(rpc, &CatchupPolicy{MaxRequestsPerSec: 1})
+	assert.NoError(s.processCatchupBlocks(context.Background()))
+	// The next page waits for a later poll, without calling the node
+	assert.NoError(s.processCatchupBlocks(context.Background()))
+	assert.Equal(1, len(rpc.ranges))
+	assert.Equal(int64(250), s.catchupBlock.Int64())
+}
+
+func TestCatchupBlockGap(t *testing.T) {
+	assert := assert.New(t)
+	s := newTestCatchupSub(&testCatchupRPC{}, nil)
+	s.catchupModeBlockGap = 250
+	assert.Equal(int64(250), s.catchupBlockGap())
+	s.lp.stream.spec.Catchup = &CatchupPolicy{MaxBlockRange: 100}
+	assert.Equal(int64(100), s.catchupBlockGap())
+	s.lp.stream.spec.Catchup = &CatchupPolicy{MaxBlockRange: 1000}
+	assert.Equal(int64(250), s.catchupBlockGap())
+	s.catchupModeBlockGap = 0
+	assert.Equal(int64(1000), s.catchupBlockGap())
+}
+
+func TestStreamCatchupPolicy(t *testing.T) {
+	assert := assert.New(t)
+	sm := newTestSubscriptionManager()
+	webhook := &webhookActionInfo{URL: "http://test.invalid"}
+
+	_, err := sm.AddStream(context.Background(), &StreamInfo{Type: "webhook", Webhook: webhook, Catchup: &CatchupPolicy{MaxBlockRange: -1}})
+	assert.EqualError(err, "Invalid catchup policy - the limits must be zero (unlimited) or greater")
+
+	spec, err := sm.AddStream(context.Background(), &StreamInfo{Type: "webhook", Webhook: webhook})
+	assert.NoError(err)
+	stream := sm.streams[spec.ID]
+	defer stream.stop()
+	assert.Nil(stream.catchupLimiter)
+
+	_, err = sm.UpdateStream(context.Background(), spec.ID, &StreamInfo{Catchup: &CatchupPolicy{MaxRequestsPerSec: 10}})
+	assert.NoError(err)
+	assert.NotNil(stream.catchupLimiter)
+	assert.Equal(10, stream.spec.Catchup.MaxRequestsPerSec)
+
+	_, err = sm.UpdateStream(context.Background(), spec.ID, &StreamInfo{Catchup: &CatchupPolicy{MaxLogsPerBatch: -1}})
+	assert.Regexp("Invalid catchup policy", err)
+}
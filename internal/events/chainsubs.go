@@ -0,0 +1,242 @@
+// Copyright 2021 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package events
+
+import (
+	"context"
+	"encoding/json"
+	"math/big"
+	"strconv"
+	"strings"
+	"time"
+
+	ethbinding "github.com/kaleido-io/ethbinding/pkg"
+	"github.com/kaleido-io/ethconnect/internal/errors"
+	"github.com/kaleido-io/ethconnect/internal/eth"
+	"github.com/kaleido-io/ethconnect/internal/ethbind"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// SubscriptionTypeBlocks is a subscription to the header of each new block in the chain
+	SubscriptionTypeBlocks = "blocks"
+	// SubscriptionTypePendingTransactions is a subscription to the transactions that arrive in
+	// the transaction pool of the node, before they are mined
+	SubscriptionTypePendingTransactions = "pendingTransactions"
+	// blockSignature is the signature of the events delivered for blocks
+	blockSignature = "Block"
+	// pendingTxnSignature is the signature of the events delivered for pending transactions
+	pendingTxnSignature = "PendingTransaction"
+)
+
+// chainBlock is a block from eth_getBlockByNumber, with the hashes of its transactions
+type chainBlock struct {
+	Number        ethbinding.HexBigInt  `json:"number"`
+	Hash          ethbinding.Hash       `json:"hash"`
+	ParentHash    ethbinding.Hash       `json:"parentHash"`
+	Miner         ethbinding.Address    `json:"miner"`
+	Timestamp     ethbinding.HexUint64  `json:"timestamp"`
+	GasUsed       ethbinding.HexUint64  `json:"gasUsed"`
+	GasLimit      ethbinding.HexUint64  `json:"gasLimit"`
+	BaseFeePerGas *ethbinding.HexBigInt `json:"baseFeePerGas"` // Only on chains with EIP-1559
+	Transactions  []json.RawMessage     `json:"transactions"`
+}
+
+// pendingTxn is a transaction from eth_getTransactionByHash, that is yet to be mined
+type pendingTxn struct {
+	Hash                 ethbinding.Hash       `json:"hash"`
+	From                 ethbinding.Address    `json:"from"`
+	To                   *ethbinding.Address   `json:"to"`
+	Nonce                ethbinding.HexUint64  `json:"nonce"`
+	Value                ethbinding.HexBigInt  `json:"value"`
+	Gas                  ethbinding.HexUint64  `json:"gas"`
+	GasPrice             *ethbinding.HexBigInt `json:"gasPrice"`
+	MaxFeePerGas         *ethbinding.HexBigInt `json:"maxFeePerGas"`
+	MaxPriorityFeePerGas *ethbinding.HexBigInt `json:"maxPriorityFeePerGas"`
+	Input                ethbinding.HexBytes   `json:"input"`
+}
+
+func chainSubscriptionSignature(subType string) string {
+	if subType == SubscriptionTypeBlocks {
+		return blockSignature
+	}
+	return pendingTxnSignature
+}
+
+// newChainSubscription creates a subscription to blocks, or to pending transactions. Pending
+// transactions can be limited to those sent to a contract
+func newChainSubscription(sm subscriptionManager, rpc eth.RPCClient, stream *eventStream, addr *ethbinding.Address, i *SubscriptionInfo) (*subscription, error) {
+	addrStr := "*"
+	if addr != nil {
+		if i.Type == SubscriptionTypeBlocks {
+			return nil, errors.Errorf(errors.EventStreamsBlocksSubAddress)
+		}
+		i.Filter.Addresses = []ethbinding.Address{*addr}
+		addrStr = addr.String()
+	}
+	s := restoreChainSubscription(sm, rpc, stream, i)
+	i.Summary = addrStr + ":" + chainSubscriptionSignature(i.Type)
+	if i.Name == "" {
+		log.Debugf("No name provided for subscription, using auto-generated summary:%s", i.Summary)
+		i.Name = i.Summary
+	}
+	log.Infof("Created subscription ID:%s name:%s to %s", i.ID, i.Name, i.Type)
+	return s, nil
+}
+
+func restoreChainSubscription(sm subscriptionManager, rpc eth.RPCClient, stream *eventStream, i *SubscriptionInfo) *subscription {
+	return &subscription{
+		info:                i,
+		rpc:                 rpc,
+		lp:                  newLogProcessor(i.ID, nil, stream),
+		logName:             i.ID + ":" + chainSubscriptionSignature(i.Type),
+		kind:                i.Type,
+		filterStale:         true,
+		catchupModeBlockGap: sm.config().CatchupModeBlockGap,
+		catchupModePageSize: sm.config().CatchupModePageSize,
+		catchupThrottle:     sm.catchupThrottle(i.Tenant),
+	}
+}
+
+// processBlocks delivers the header of each block from the position of the subscription, once
+// the block has the confirmations required by the stream
+func (s *subscription) processBlocks(ctx context.Context) error {
+	return s.scanBlocks(ctx, "headers", s.lp.stream.spec.Confirmations, s.processBlock)
+}
+
+func (s *subscription) processBlock(ctx context.Context, number *big.Int) error {
+	var block *chainBlock
+	if err := s.rpcCall(ctx, &block, "eth_getBlockByNumber", ethbind.API.EncodeBig(number), false); err != nil {
+		return err
+	}
+	if block == nil {
+		return errors.Errorf(errors.EventStreamsScanBlockNotFound, s.logName, number.String())
+	}
+	result := &eventData{
+		BlockNumber: block.Number.ToInt().String(),
+		Signature:   blockSignature,
+		Data: map[string]interface{}{
+			"hash":             block.Hash.String(),
+			"parentHash":       block.ParentHash.String(),
+			"miner":            block.Miner.String(),
+			"timestamp":        strconv.FormatUint(uint64(block.Timestamp), 10),
+			"gasUsed":          strconv.FormatUint(uint64(block.GasUsed), 10),
+			"gasLimit":         strconv.FormatUint(uint64(block.GasLimit), 10),
+			"transactionCount": strconv.Itoa(len(block.Transactions)),
+		},
+		SubID:    s.info.ID,
+		LogIndex: "0",
+	}
+	if block.BaseFeePerGas != nil {
+		result.Data["baseFee"] = block.BaseFeePerGas.ToInt().String()
+	}
+	if s.lp.stream.spec.Timestamps {
+		result.Timestamp = strconv.FormatUint(uint64(block.Timestamp), 10)
+	}
+	s.lp.dispatchScanned(s.logName, result, number)
+	return nil
+}
+
+// createPendingTxnFilter installs a filter on the node for new pending transactions. Transactions
+// that arrive while there is no filter, such as when the connector is restarted, are not delivered
+func (s *subscription) createPendingTxnFilter(ctx context.Context) error {
+	if err := s.rpcCall(ctx, &s.filterID, "eth_newPendingTransactionFilter"); err != nil {
+		return err
+	}
+	s.catchupBlock = nil
+	s.filteredOnce = false
+	s.markFilterStale(ctx, false)
+	log.Infof("%s: created pending transaction filter: %s", s.logName, s.filterID.String())
+	return nil
+}
+
+// processPendingTxns delivers the transactions that arrived in the transaction pool of the node
+// since the last poll. Transactions that were dropped before they are read are skipped.
+// The checkpoint of the subscription follows the head of the chain, as there is nothing to read again
+func (s *subscription) processPendingTxns(ctx context.Context) error {
+	var hashes []ethbinding.Hash
+	if err := s.rpcCall(ctx, &hashes, "eth_getFilterChanges", s.filterID); err != nil {
+		if strings.Contains(err.Error(), "filter not found") {
+			s.markFilterStale(ctx, true)
+		}
+		return err
+	}
+	s.filteredOnce = true
+	idx := 0
+	for _, hash := range hashes {
+		var txn *pendingTxn
+		if err := s.rpcCall(ctx, &txn, "eth_getTransactionByHash", hash); err != nil {
+			return err
+		}
+		if txn == nil || (len(s.info.Filter.Addresses) > 0 && (txn.To == nil || !s.watchesAddress(txn.To))) {
+			continue
+		}
+		s.lp.dispatchScanned(s.logName, s.pendingTxnEvent(txn, idx), nil)
+		idx++
+	}
+	blockNumber := ethbinding.HexBigInt{}
+	if err := s.rpcCall(ctx, &blockNumber, "eth_blockNumber"); err != nil {
+		return err
+	}
+	s.lp.markNoEvents(new(big.Int).Add(blockNumber.ToInt(), big.NewInt(1)))
+	s.lp.markPolled()
+	return nil
+}
+
+func (s *subscription) pendingTxnEvent(txn *pendingTxn, idx int) *eventData {
+	result := &eventData{
+		TransactionHash: txn.Hash.String(),
+		Signature:       pendingTxnSignature,
+		Data: map[string]interface{}{
+			"from":  txn.From.String(),
+			"nonce": strconv.FormatUint(uint64(txn.Nonce), 10),
+			"value": txn.Value.ToInt().String(),
+			"gas":   strconv.FormatUint(uint64(txn.Gas), 10),
+			"input": ethbind.API.HexEncode(txn.Input),
+		},
+		SubID:         s.info.ID,
+		LogIndex:      strconv.Itoa(idx),
+		batchComplete: s.lp.pendingTxnBatchComplete,
+	}
+	if txn.To != nil {
+		result.Address = txn.To.String()
+		result.Data["to"] = txn.To.String()
+	}
+	for name, fee := range map[string]*ethbinding.HexBigInt{
+		"gasPrice":             txn.GasPrice,
+		"maxFeePerGas":         txn.MaxFeePerGas,
+		"maxPriorityFeePerGas": txn.MaxPriorityFeePerGas,
+	} {
+		if fee != nil {
+			result.Data[name] = fee.ToInt().String()
+		}
+	}
+	if s.lp.stream.spec.Timestamps {
+		result.Timestamp = strconv.FormatInt(time.Now().Unix(), 10)
+	}
+	return result
+}
+
+// pendingTxnBatchComplete records the delivery of pending transactions, which have no block
+// to move the HWM to
+func (lp *logProcessor) pendingTxnBatchComplete(newestEvent *eventData) {
+	lp.hwnSync.Lock()
+	defer lp.hwnSync.Unlock()
+	lp.lastDelivered = &DeliveredPosition{
+		LogIndex: newestEvent.LogIndex,
+		Time:     time.Now().UTC(),
+	}
+	lp.lastProgress = time.Now()
+}
@@ -0,0 +1,281 @@
+// Copyright 2021 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package events
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"path"
+	"testing"
+
+	ethbinding "github.com/kaleido-io/ethbinding/pkg"
+	"github.com/kaleido-io/ethconnect/internal/eth"
+	"github.com/kaleido-io/ethconnect/internal/ethbind"
+	"github.com/kaleido-io/ethconnect/internal/kvstore"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestChainSub(t *testing.T, subType string, addr *ethbinding.Address, spec *StreamInfo, wrangler func(string, interface{}, ...interface{})) (*subscription, *eth.MockRPCClient, chan *eventData) {
+	events := make(chan *eventData, 10)
+	stream := &eventStream{
+		spec:        spec,
+		eventStream: events,
+	}
+	rpc := eth.NewMockRPCClientForSync(nil, wrangler)
+	s, err := newSubscription(&mockSubMgr{stream: stream, conf: &SubscriptionManagerConf{CatchupModePageSize: 250}}, rpc, addr, &SubscriptionInfo{ID: "test", Stream: "streamID", Type: subType})
+	assert.NoError(t, err)
+	return s, rpc, events
+}
+
+func TestChainSubscriptionCreate(t *testing.T) {
+	assert := assert.New(t)
+	m := &mockSubMgr{stream: newTestStream()}
+	rpc := eth.NewMockRPCClientForSync(nil, nil)
+	addr := ethbind.API.HexToAddress(testRevertedTxnsContract)
+
+	_, err := newSubscription(m, rpc, &addr, &SubscriptionInfo{ID: "test", Type: SubscriptionTypeBlocks})
+	assert.EqualError(err, "A subscription to blocks cannot specify a contract address")
+
+	i := &SubscriptionInfo{ID: "test", Type: SubscriptionTypeBlocks}
+	s, err := newSubscription(m, rpc, nil, i)
+	assert.NoError(err)
+	assert.Equal("*:Block", i.Name)
+	assert.True(s.scansBlocks())
+
+	i = &SubscriptionInfo{ID: "test", Type: SubscriptionTypePendingTransactions}
+	s, err = newSubscription(m, rpc, &addr, i)
+	assert.NoError(err)
+	assert.Equal(testRevertedTxnsContract+":PendingTransaction", i.Name)
+	assert.Equal([]ethbinding.Address{addr}, i.Filter.Addresses)
+	assert.False(s.scansBlocks())
+
+	s, err = restoreSubscription(m, rpc, i)
+	assert.NoError(err)
+	assert.Equal(SubscriptionTypePendingTransactions, s.kind)
+	assert.Equal("test:PendingTransaction", s.logName)
+}
+
+func TestProcessBlocks(t *testing.T) {
+	assert := assert.New(t)
+	var requested []string
+	s, _, events := newTestChainSub(t, SubscriptionTypeBlocks, nil, &StreamInfo{Confirmations: 3, Timestamps: true}, func(method string, res interface{}, args ...interface{}) {
+		switch method {
+		case "eth_blockNumber":
+			json.Unmarshal([]byte(`"0x12"`), res)
+		case "eth_getBlockByNumber":
+			requested = append(requested, args[0].(string))
+			baseFee := ""
+			if args[0].(string) == "0x10" {
+				baseFee = `"baseFeePerGas": "0x7",`
+			}
+			json.Unmarshal([]byte(fmt.Sprintf(`{
+				"number": "%s",
+				"hash": "0x%064x",
+				"parentHash": "0x%064x",
+				"miner": "%s",
+				"timestamp": "0x5f5e100",
+				"gasUsed": "0x5208",
+				"gasLimit": "0x1c9c380",
+				%s
+				"transactions": ["0x%064x", "0x%064x"]
+			}`, args[0], 1, 2, testRevertedTxnsFrom, baseFee, 3, 4)), res)
+		}
+	})
+
+	ctx := context.Background()
+	s.setCheckpointBlockHeight(big.NewInt(0xf))
+	assert.NoError(s.restartFilter(ctx, big.NewInt(0xf)))
+	assert.NoError(s.processNewEvents(ctx))
+	// Block 0x11 and 0x12 do not have 3 confirmations yet
+	assert.Equal([]string{"0xf", "0x10"}, requested)
+	assert.Equal(int64(0x11), s.catchupBlock.Int64())
+
+	event := <-events
+	assert.Equal("15", event.BlockNumber)
+	assert.Equal("Block", event.Signature)
+	assert.Equal("test", event.SubID)
+	assert.Equal("100000000", event.Timestamp)
+	assert.Equal(fmt.Sprintf("0x%064x", 1), event.Data["hash"])
+	assert.Equal(fmt.Sprintf("0x%064x", 2), event.Data["parentHash"])
+	assert.Equal(testRevertedTxnsFrom, event.Data["miner"])
+	assert.Equal("21000", event.Data["gasUsed"])
+	assert.Equal("30000000", event.Data["gasLimit"])
+	assert.Equal("2", event.Data["transactionCount"])
+	assert.Nil(event.Data["baseFee"])
+	event.batchComplete(event)
+
+	event = <-events
+	assert.Equal("16", event.BlockNumber)
+	assert.Equal("7", event.Data["baseFee"])
+	event.batchComplete(event)
+	hwm := s.blockHWM()
+	assert.Equal(int64(0x11), hwm.Int64())
+
+	// There is no filter to uninstall
+	s.markFilterStale(ctx, true)
+	assert.Nil(s.catchupBlock)
+
+	s.catchupBlock = big.NewInt(0x13)
+	s.rpc = eth.NewMockRPCClientForSync(nil, func(method string, res interface{}, args ...interface{}) {
+		if method == "eth_blockNumber" {
+			json.Unmarshal([]byte(`"0x20"`), res)
+		}
+	})
+	assert.EqualError(s.processNewEvents(ctx), "test:Block: Block 19 was not found")
+}
+
+func TestProcessPendingTxns(t *testing.T) {
+	assert := assert.New(t)
+	addr := ethbind.API.HexToAddress(testRevertedTxnsContract)
+	s, rpc, events := newTestChainSub(t, SubscriptionTypePendingTransactions, &addr, &StreamInfo{Timestamps: true}, func(method string, res interface{}, args ...interface{}) {
+		switch method {
+		case "eth_newPendingTransactionFilter":
+			json.Unmarshal([]byte(`"0x99"`), res)
+		case "eth_getFilterChanges":
+			json.Unmarshal([]byte(fmt.Sprintf(`["0x%064x","0x%064x","0x%064x","0x%064x"]`, 1, 2, 3, 4)), res)
+		case "eth_getTransactionByHash":
+			switch args[0].(ethbinding.Hash).String() {
+			case fmt.Sprintf("0x%064x", 1):
+				json.Unmarshal([]byte(fmt.Sprintf(`{
+					"hash": "0x%064x", "from": "%s", "to": "%s", "nonce": "0x5", "value": "0x64", "gas": "0x5208",
+					"maxFeePerGas": "0x10", "maxPriorityFeePerGas": "0x2", "input": "0xfeedbeef"
+				}`, 1, testRevertedTxnsFrom, testRevertedTxnsContract)), res)
+			case fmt.Sprintf("0x%064x", 2):
+				json.Unmarshal([]byte(fmt.Sprintf(`{"hash": "0x%064x", "from": "%s", "to": "%s", "value": "0x0"}`, 2, testRevertedTxnsFrom, testRevertedTxnsOther)), res)
+			case fmt.Sprintf("0x%064x", 3):
+				json.Unmarshal([]byte(`null`), res)
+			default:
+				json.Unmarshal([]byte(fmt.Sprintf(`{"hash": "0x%064x", "from": "%s", "to": "%s", "value": "0x0", "gasPrice": "0x3"}`, 4, testRevertedTxnsFrom, testRevertedTxnsContract)), res)
+			}
+		case "eth_blockNumber":
+			json.Unmarshal([]byte(`"0x20"`), res)
+		}
+	})
+
+	ctx := context.Background()
+	s.setCheckpointBlockHeight(big.NewInt(0x10))
+	assert.NoError(s.restartFilter(ctx, big.NewInt(0x10)))
+	assert.Equal("eth_newPendingTransactionFilter", rpc.MethodCapture)
+	assert.Equal(int64(0x99), s.filterID.ToInt().Int64())
+	assert.False(s.filterStale)
+
+	assert.NoError(s.processNewEvents(ctx))
+	assert.True(s.filteredOnce)
+	assert.Len(events, 2)
+
+	event := <-events
+	assert.Equal(fmt.Sprintf("0x%064x", 1), event.TransactionHash)
+	assert.Equal(testRevertedTxnsContract, event.Address)
+	assert.Equal("PendingTransaction", event.Signature)
+	assert.Empty(event.BlockNumber)
+	assert.Equal("0", event.LogIndex)
+	assert.NotEmpty(event.Timestamp)
+	assert.Equal(testRevertedTxnsFrom, event.Data["from"])
+	assert.Equal(testRevertedTxnsContract, event.Data["to"])
+	assert.Equal("5", event.Data["nonce"])
+	assert.Equal("100", event.Data["value"])
+	assert.Equal("21000", event.Data["gas"])
+	assert.Equal("16", event.Data["maxFeePerGas"])
+	assert.Equal("2", event.Data["maxPriorityFeePerGas"])
+	assert.Nil(event.Data["gasPrice"])
+	assert.Equal("0xfeedbeef", event.Data["input"])
+
+	event = <-events
+	assert.Equal(fmt.Sprintf("0x%064x", 4), event.TransactionHash)
+	assert.Equal("1", event.LogIndex)
+	assert.Equal("3", event.Data["gasPrice"])
+	event.batchComplete(event)
+	assert.Equal("1", s.lp.getLastDelivered().LogIndex)
+
+	// The checkpoint follows the head of the chain
+	hwm := s.blockHWM()
+	assert.Equal(int64(0x21), hwm.Int64())
+
+	s.markFilterStale(ctx, true)
+	assert.Equal("eth_uninstallFilter", rpc.MethodCapture)
+	assert.True(s.filterStale)
+}
+
+func TestProcessPendingTxnsFailures(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+
+	s, _, _ := newTestChainSub(t, SubscriptionTypePendingTransactions, nil, &StreamInfo{}, nil)
+	s.rpc = eth.NewMockRPCClientForSync(fmt.Errorf("pop"), nil)
+	assert.EqualError(s.restartFilter(ctx, big.NewInt(0)), "eth_newPendingTransactionFilter returned: pop")
+
+	s.filterStale = false
+	s.rpc = eth.NewMockRPCClientForSync(fmt.Errorf("filter not found"), nil)
+	assert.EqualError(s.processNewEvents(ctx), "eth_getFilterChanges returned: filter not found")
+	assert.True(s.filterStale)
+
+	s.rpc = &testFailingRPC{
+		MockRPCClient: eth.NewMockRPCClientForSync(nil, func(method string, res interface{}, args ...interface{}) {
+			if method == "eth_getFilterChanges" {
+				json.Unmarshal([]byte(fmt.Sprintf(`["0x%064x"]`, 1)), res)
+			}
+		}),
+		failMethod: "eth_getTransactionByHash",
+	}
+	assert.EqualError(s.processNewEvents(ctx), "eth_getTransactionByHash returned: pop")
+
+	s.rpc = &testFailingRPC{
+		MockRPCClient: eth.NewMockRPCClientForSync(nil, nil),
+		failMethod:    "eth_blockNumber",
+	}
+	assert.EqualError(s.processNewEvents(ctx), "eth_blockNumber returned: pop")
+}
+
+func TestAddChainSubscription(t *testing.T) {
+	assert := assert.New(t)
+	dir := tempdir(t)
+	defer cleanup(t, dir)
+	sm := newTestSubscriptionManager()
+	sm.db, _ = kvstore.NewLDBKeyValueStore(path.Join(dir, "db"))
+	defer sm.db.Close()
+
+	ctx := context.Background()
+	stream, err := sm.AddStream(ctx, &StreamInfo{
+		Type:      "webhook",
+		Webhook:   &webhookActionInfo{URL: "http://test.invalid"},
+		Suspended: true,
+	})
+	assert.NoError(err)
+
+	sub, err := sm.AddChainSubscription(ctx, SubscriptionTypeBlocks, nil, stream.ID, "12345", "blocks")
+	assert.NoError(err)
+	assert.Equal(SubscriptionTypeBlocks, sub.Type)
+	assert.Equal("blocks", sub.Name)
+	assert.Equal("12345", sub.FromBlock)
+	assert.Nil(sub.Event)
+
+	_, err = sm.AddChainSubscription(ctx, SubscriptionTypeRevertedTransactions, nil, stream.ID, "", "")
+	assert.Regexp("Invalid subscription type 'revertedTransactions'", err)
+	_, err = sm.AddChainSubscription(ctx, SubscriptionTypePendingTransactions, nil, stream.ID, "badness", "")
+	assert.EqualError(err, "FromBlock cannot be parsed as a BigInt")
+	_, err = sm.AddChainSubscription(ctx, SubscriptionTypePendingTransactions, nil, "es-unknown", "", "")
+	assert.Regexp("not found", err)
+
+	// The subscription is restored with its type on restart
+	sm.subscriptions = map[string]*subscription{}
+	sm.recoverSubscriptions()
+	restored, err := sm.subscriptionByID(sub.ID)
+	assert.NoError(err)
+	assert.Equal(SubscriptionTypeBlocks, restored.kind)
+
+	sm.Close()
+}
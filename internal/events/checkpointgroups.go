@@ -0,0 +1,296 @@
+// Copyright 2021 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package events
+
+import (
+	"context"
+	"encoding/json"
+	"math/big"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/kaleido-io/ethconnect/internal/auth"
+	"github.com/kaleido-io/ethconnect/internal/errors"
+	"github.com/kaleido-io/ethconnect/internal/messages"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// CheckpointGroupPathPrefix is the path prefix for checkpoint groups
+	CheckpointGroupPathPrefix = "/checkpointgroups"
+	checkpointGroupIDPrefix   = "cg-"
+)
+
+var checkpointGroupNameRegex = regexp.MustCompile(`^[a-zA-Z0-9._-]+$`)
+
+// CheckpointGroupInfo is the persisted definition of a named checkpoint, shared by a set of
+// subscriptions on the same stream. The checkpoint of the group is the block that all of them
+// have delivered up to, so after a restart or a reset they all resume from the same block,
+// giving a consistent cut across the contracts they subscribe to
+type CheckpointGroupInfo struct {
+	messages.TimeSorted
+	Name          string   `json:"name"`
+	Path          string   `json:"path"`
+	Tenant        string   `json:"tenant,omitempty"`
+	Stream        string   `json:"stream"`
+	Subscriptions []string `json:"subscriptions"`
+}
+
+// CheckpointGroupCheckpoint is the current position of a checkpoint group, with the positions
+// of each of its subscriptions
+type CheckpointGroupCheckpoint struct {
+	Name           string                    `json:"name"`
+	Stream         string                    `json:"stream"`
+	Suspended      bool                      `json:"suspended"`
+	Block          string                    `json:"block,omitempty"`
+	ChainHead      string                    `json:"chainHead,omitempty"`
+	ChainHeadError string                    `json:"chainHeadError,omitempty"`
+	Lag            int64                     `json:"lag"`
+	Subscriptions  []*SubscriptionCheckpoint `json:"subscriptions"`
+}
+
+// GetID returns the ID (for sorting)
+func (info *CheckpointGroupInfo) GetID() string {
+	return info.Name
+}
+
+func (s *subscriptionMGR) validateCheckpointGroup(spec *CheckpointGroupInfo) error {
+	if !checkpointGroupNameRegex.MatchString(spec.Name) {
+		return errors.Errorf(errors.CheckpointGroupBadName, spec.Name)
+	}
+	if _, exists := s.checkpointGroups[spec.Name]; exists {
+		return errors.Errorf(errors.CheckpointGroupExists, spec.Name)
+	}
+	if _, err := s.streamByID(spec.Stream); err != nil {
+		return err
+	}
+	if len(spec.Subscriptions) == 0 {
+		return errors.Errorf(errors.CheckpointGroupNoSubscriptions)
+	}
+	members := make(map[string]bool)
+	for _, subID := range spec.Subscriptions {
+		sub, err := s.subscriptionByID(subID)
+		if err != nil {
+			return err
+		}
+		if sub.info.Stream != spec.Stream {
+			return errors.Errorf(errors.CheckpointGroupWrongStream, subID, spec.Stream)
+		}
+		if group := s.checkpointGroupOf(subID); group != nil {
+			return errors.Errorf(errors.CheckpointGroupSubInGroup, subID, group.Name)
+		}
+		if members[subID] {
+			return errors.Errorf(errors.CheckpointGroupDuplicateSub, subID)
+		}
+		members[subID] = true
+	}
+	return nil
+}
+
+// AddCheckpointGroup creates a named checkpoint group. The subscriptions are aligned to the
+// block they have all reached on the next poll of their stream
+func (s *subscriptionMGR) AddCheckpointGroup(ctx context.Context, spec *CheckpointGroupInfo) (*CheckpointGroupInfo, error) {
+	s.checkpointGroupLock.Lock()
+	defer s.checkpointGroupLock.Unlock()
+	if err := s.validateCheckpointGroup(spec); err != nil {
+		return nil, err
+	}
+	spec.Tenant = auth.GetTenant(ctx)
+	spec.CreatedISO8601 = time.Now().UTC().Format(time.RFC3339)
+	spec.Path = CheckpointGroupPathPrefix + "/" + spec.Name
+	if err := s.storeCheckpointGroup(spec); err != nil {
+		return nil, err
+	}
+	s.checkpointGroups[spec.Name] = spec
+	log.Infof("Created checkpoint group %s on stream %s for subscriptions %s", spec.Name, spec.Stream, strings.Join(spec.Subscriptions, ","))
+	return spec, nil
+}
+
+// CheckpointGroups used externally to list the checkpoint groups
+func (s *subscriptionMGR) CheckpointGroups(ctx context.Context) []*CheckpointGroupInfo {
+	s.checkpointGroupLock.RLock()
+	defer s.checkpointGroupLock.RUnlock()
+	l := make([]*CheckpointGroupInfo, 0, len(s.checkpointGroups))
+	for _, group := range s.checkpointGroups {
+		l = append(l, group)
+	}
+	return l
+}
+
+// CheckpointGroupByID used externally to get a checkpoint group
+func (s *subscriptionMGR) CheckpointGroupByID(ctx context.Context, id string) (*CheckpointGroupInfo, error) {
+	s.checkpointGroupLock.RLock()
+	defer s.checkpointGroupLock.RUnlock()
+	return s.checkpointGroupByID(id)
+}
+
+func (s *subscriptionMGR) checkpointGroupByID(id string) (*CheckpointGroupInfo, error) {
+	group, exists := s.checkpointGroups[id]
+	if !exists {
+		return nil, errors.Errorf(errors.CheckpointGroupNotFound, id)
+	}
+	return group, nil
+}
+
+// CheckpointGroupCheckpoint returns the block that all the subscriptions of a group have
+// reached, with the position of each subscription
+func (s *subscriptionMGR) CheckpointGroupCheckpoint(ctx context.Context, id string) (*CheckpointGroupCheckpoint, error) {
+	group, err := s.CheckpointGroupByID(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	cp := &CheckpointGroupCheckpoint{
+		Name:          group.Name,
+		Stream:        group.Stream,
+		Subscriptions: make([]*SubscriptionCheckpoint, 0, len(group.Subscriptions)),
+	}
+	var block, chainHead *big.Int
+	for _, subID := range group.Subscriptions {
+		subCP, err := s.SubscriptionCheckpoint(ctx, subID)
+		if err != nil {
+			return nil, err
+		}
+		cp.Subscriptions = append(cp.Subscriptions, subCP)
+		cp.Suspended = subCP.Suspended
+		cp.ChainHead = subCP.ChainHead
+		cp.ChainHeadError = subCP.ChainHeadError
+		if subBlock, ok := new(big.Int).SetString(subCP.Block, 10); ok && (block == nil || subBlock.Cmp(block) < 0) {
+			block = subBlock
+		}
+		chainHead, _ = new(big.Int).SetString(subCP.ChainHead, 10)
+	}
+	if block != nil {
+		cp.Block = block.String()
+		if chainHead != nil {
+			cp.Lag = blockLag(chainHead, block)
+		}
+	}
+	return cp, nil
+}
+
+// ResetCheckpointGroup restarts all the subscriptions of a group from the same block
+func (s *subscriptionMGR) ResetCheckpointGroup(ctx context.Context, id, initialBlock string) error {
+	group, err := s.CheckpointGroupByID(ctx, id)
+	if err != nil {
+		return err
+	}
+	for _, subID := range group.Subscriptions {
+		sub, err := s.subscriptionByID(subID)
+		if err != nil {
+			return err
+		}
+		if err := s.resetSubscription(ctx, sub, initialBlock); err != nil {
+			return err
+		}
+	}
+	log.Infof("Reset checkpoint group %s to block '%s'", group.Name, initialBlock)
+	return nil
+}
+
+// DeleteCheckpointGroup deletes a checkpoint group. Its subscriptions carry on from their
+// own positions
+func (s *subscriptionMGR) DeleteCheckpointGroup(ctx context.Context, id string) error {
+	s.checkpointGroupLock.Lock()
+	defer s.checkpointGroupLock.Unlock()
+	if _, err := s.checkpointGroupByID(id); err != nil {
+		return err
+	}
+	delete(s.checkpointGroups, id)
+	return s.db.Delete(checkpointGroupIDPrefix + id)
+}
+
+func (s *subscriptionMGR) storeCheckpointGroup(info *CheckpointGroupInfo) error {
+	infoBytes, _ := json.MarshalIndent(info, "", "  ")
+	if err := s.db.Put(checkpointGroupIDPrefix+info.Name, infoBytes); err != nil {
+		return errors.Errorf(errors.CheckpointGroupStoreFailed, err)
+	}
+	return nil
+}
+
+// checkpointGroupOf returns the group of a subscription, if it has one
+func (s *subscriptionMGR) checkpointGroupOf(subID string) *CheckpointGroupInfo {
+	for _, group := range s.checkpointGroups {
+		for _, member := range group.Subscriptions {
+			if member == subID {
+				return group
+			}
+		}
+	}
+	return nil
+}
+
+// leaveCheckpointGroup removes a deleted subscription from its group
+func (s *subscriptionMGR) leaveCheckpointGroup(subID string) {
+	s.checkpointGroupLock.Lock()
+	defer s.checkpointGroupLock.Unlock()
+	group := s.checkpointGroupOf(subID)
+	if group == nil {
+		return
+	}
+	members := make([]string, 0, len(group.Subscriptions))
+	for _, member := range group.Subscriptions {
+		if member != subID {
+			members = append(members, member)
+		}
+	}
+	group.Subscriptions = members
+	if err := s.storeCheckpointGroup(group); err != nil {
+		log.Errorf("Failed to remove subscription %s from checkpoint group %s: %s", subID, group.Name, err)
+	}
+}
+
+// alignCheckpointGroups moves the checkpoint of each subscription in a group back to the
+// block the whole group has reached, before the checkpoint of a stream is stored.
+// Subscriptions that are yet to start are not counted
+func (s *subscriptionMGR) alignCheckpointGroups(streamID string, checkpoint map[string]*big.Int) {
+	s.checkpointGroupLock.RLock()
+	defer s.checkpointGroupLock.RUnlock()
+	for _, group := range s.checkpointGroups {
+		if group.Stream != streamID {
+			continue
+		}
+		var groupBlock *big.Int
+		for _, subID := range group.Subscriptions {
+			if block := checkpoint[subID]; block != nil && block.Sign() > 0 && (groupBlock == nil || block.Cmp(groupBlock) < 0) {
+				groupBlock = block
+			}
+		}
+		if groupBlock == nil {
+			continue
+		}
+		for _, subID := range group.Subscriptions {
+			if block := checkpoint[subID]; block != nil && block.Sign() > 0 {
+				checkpoint[subID] = new(big.Int).Set(groupBlock)
+			}
+		}
+	}
+}
+
+func (s *subscriptionMGR) recoverCheckpointGroups() {
+	iGroup := s.db.NewIterator()
+	defer iGroup.Release()
+	for iGroup.Next() {
+		k := iGroup.Key()
+		if strings.HasPrefix(k, checkpointGroupIDPrefix) {
+			var info CheckpointGroupInfo
+			if err := json.Unmarshal(iGroup.Value(), &info); err != nil {
+				log.Errorf("Failed to recover checkpoint group '%s': %s", string(iGroup.Value()), err)
+				continue
+			}
+			s.checkpointGroups[info.Name] = &info
+		}
+	}
+}
@@ -0,0 +1,200 @@
+// Copyright 2021 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package events
+
+import (
+	"context"
+	"fmt"
+	"math/big"
+	"path"
+	"testing"
+	"time"
+
+	ethbinding "github.com/kaleido-io/ethbinding/pkg"
+	"github.com/kaleido-io/ethconnect/internal/eth"
+	"github.com/kaleido-io/ethconnect/internal/kvstore"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestCheckpointGroupSubs(t *testing.T, db kvstore.KVStore) (*subscriptionMGR, *eventStream, []*SubscriptionInfo, func()) {
+	sm, stream, svr, eventStream := newTestStreamForBatching(&StreamInfo{
+		Webhook: &webhookActionInfo{},
+	}, db, 200)
+	stream.suspend(nil)
+	for !stream.isSuspendedAndIdle() {
+		time.Sleep(1 * time.Millisecond)
+	}
+	sm.rpc = eth.NewMockRPCClientForSync(nil, func(method string, res interface{}, args ...interface{}) {
+		if method == "eth_blockNumber" {
+			res.(*ethbinding.HexBigInt).ToInt().SetInt64(1000)
+		}
+	})
+	ctx := context.Background()
+	var subs []*SubscriptionInfo
+	for _, name := range []string{"sub1", "sub2", "sub3"} {
+		sub, err := sm.AddChainSubscription(ctx, SubscriptionTypeBlocks, nil, stream.spec.ID, "", name)
+		assert.NoError(t, err)
+		subs = append(subs, sub)
+	}
+	return sm, stream, subs, func() {
+		stream.stop()
+		svr.Close()
+		close(eventStream)
+	}
+}
+
+func TestCheckpointGroupLifecycle(t *testing.T) {
+	assert := assert.New(t)
+	dir := tempdir(t)
+	defer cleanup(t, dir)
+	db, _ := kvstore.NewLDBKeyValueStore(path.Join(dir, "db"))
+	defer db.Close()
+	sm, stream, subs, done := newTestCheckpointGroupSubs(t, db)
+	defer done()
+	ctx := context.Background()
+
+	group, err := sm.AddCheckpointGroup(ctx, &CheckpointGroupInfo{
+		Name:          "orders",
+		Stream:        stream.spec.ID,
+		Subscriptions: []string{subs[0].ID, subs[1].ID},
+	})
+	assert.NoError(err)
+	assert.Equal("/checkpointgroups/orders", group.Path)
+	assert.NotEmpty(group.CreatedISO8601)
+	assert.Len(sm.CheckpointGroups(ctx), 1)
+
+	sm.subscriptions[subs[0].ID].setCheckpointBlockHeight(big.NewInt(900))
+	sm.subscriptions[subs[1].ID].setCheckpointBlockHeight(big.NewInt(850))
+	cp, err := sm.CheckpointGroupCheckpoint(ctx, "orders")
+	assert.NoError(err)
+	assert.Equal("orders", cp.Name)
+	assert.True(cp.Suspended)
+	assert.Equal("850", cp.Block)
+	assert.Equal("1000", cp.ChainHead)
+	assert.Equal(int64(151), cp.Lag)
+	assert.Len(cp.Subscriptions, 2)
+	assert.Equal("900", cp.Subscriptions[0].Block)
+
+	// The stored checkpoint of every subscription in the group is the block they have all reached
+	checkpoint := map[string]*big.Int{
+		subs[0].ID: big.NewInt(900),
+		subs[1].ID: big.NewInt(850),
+		subs[2].ID: big.NewInt(950),
+	}
+	sm.alignCheckpointGroups(stream.spec.ID, checkpoint)
+	assert.Equal(int64(850), checkpoint[subs[0].ID].Int64())
+	assert.Equal(int64(850), checkpoint[subs[1].ID].Int64())
+	assert.Equal(int64(950), checkpoint[subs[2].ID].Int64())
+	checkpoint = map[string]*big.Int{subs[0].ID: big.NewInt(900), subs[1].ID: big.NewInt(0)}
+	sm.alignCheckpointGroups(stream.spec.ID, checkpoint)
+	assert.Equal(int64(900), checkpoint[subs[0].ID].Int64())
+	assert.Equal(int64(0), checkpoint[subs[1].ID].Int64())
+	sm.alignCheckpointGroups("other", checkpoint)
+
+	err = sm.ResetCheckpointGroup(ctx, "orders", "100")
+	assert.NoError(err)
+	for _, sub := range subs[0:2] {
+		assert.True(sm.subscriptions[sub.ID].resetRequested)
+		assert.Equal("100", sub.FromBlock)
+	}
+	assert.False(sm.subscriptions[subs[2].ID].resetRequested)
+
+	// Recover from the DB
+	sm.checkpointGroups = make(map[string]*CheckpointGroupInfo)
+	sm.recoverCheckpointGroups()
+	retrieved, err := sm.CheckpointGroupByID(ctx, "orders")
+	assert.NoError(err)
+	assert.Equal([]string{subs[0].ID, subs[1].ID}, retrieved.Subscriptions)
+
+	// Deleted subscriptions leave the group
+	err = sm.DeleteSubscription(ctx, subs[0].ID)
+	assert.NoError(err)
+	retrieved, err = sm.CheckpointGroupByID(ctx, "orders")
+	assert.NoError(err)
+	assert.Equal([]string{subs[1].ID}, retrieved.Subscriptions)
+
+	err = sm.DeleteCheckpointGroup(ctx, "orders")
+	assert.NoError(err)
+	_, err = sm.CheckpointGroupByID(ctx, "orders")
+	assert.EqualError(err, "Checkpoint group 'orders' not found")
+	err = sm.DeleteCheckpointGroup(ctx, "orders")
+	assert.EqualError(err, "Checkpoint group 'orders' not found")
+	_, err = sm.CheckpointGroupCheckpoint(ctx, "orders")
+	assert.EqualError(err, "Checkpoint group 'orders' not found")
+	err = sm.ResetCheckpointGroup(ctx, "orders", "0")
+	assert.EqualError(err, "Checkpoint group 'orders' not found")
+}
+
+func TestCheckpointGroupValidation(t *testing.T) {
+	assert := assert.New(t)
+	sm, stream, subs, done := newTestCheckpointGroupSubs(t, nil)
+	defer done()
+	ctx := context.Background()
+
+	other, err := sm.AddStream(ctx, &StreamInfo{Type: "websocket", WebSocket: &webSocketActionInfo{}})
+	assert.NoError(err)
+	otherSub, err := sm.AddChainSubscription(ctx, SubscriptionTypeBlocks, nil, other.ID, "", "other")
+	assert.NoError(err)
+	defer sm.streams[other.ID].stop()
+
+	_, err = sm.AddCheckpointGroup(ctx, &CheckpointGroupInfo{Name: "bad name", Stream: stream.spec.ID})
+	assert.Regexp("Invalid checkpoint group name 'bad name'", err)
+	_, err = sm.AddCheckpointGroup(ctx, &CheckpointGroupInfo{Name: "orders", Stream: "nope"})
+	assert.Regexp("Stream with ID 'nope' not found", err)
+	_, err = sm.AddCheckpointGroup(ctx, &CheckpointGroupInfo{Name: "orders", Stream: stream.spec.ID})
+	assert.EqualError(err, "Must specify at least one subscription for a checkpoint group")
+	_, err = sm.AddCheckpointGroup(ctx, &CheckpointGroupInfo{Name: "orders", Stream: stream.spec.ID, Subscriptions: []string{"nope"}})
+	assert.EqualError(err, "Subscription with ID 'nope' not found")
+	_, err = sm.AddCheckpointGroup(ctx, &CheckpointGroupInfo{Name: "orders", Stream: stream.spec.ID, Subscriptions: []string{otherSub.ID}})
+	assert.EqualError(err, "Subscription "+otherSub.ID+" is not on stream "+stream.spec.ID)
+	_, err = sm.AddCheckpointGroup(ctx, &CheckpointGroupInfo{Name: "orders", Stream: stream.spec.ID, Subscriptions: []string{subs[0].ID, subs[0].ID}})
+	assert.EqualError(err, "Subscription "+subs[0].ID+" is listed more than once")
+
+	_, err = sm.AddCheckpointGroup(ctx, &CheckpointGroupInfo{Name: "orders", Stream: stream.spec.ID, Subscriptions: []string{subs[0].ID}})
+	assert.NoError(err)
+	_, err = sm.AddCheckpointGroup(ctx, &CheckpointGroupInfo{Name: "orders", Stream: stream.spec.ID, Subscriptions: []string{subs[1].ID}})
+	assert.EqualError(err, "Checkpoint group 'orders' already exists")
+	_, err = sm.AddCheckpointGroup(ctx, &CheckpointGroupInfo{Name: "payments", Stream: stream.spec.ID, Subscriptions: []string{subs[0].ID}})
+	assert.EqualError(err, "Subscription "+subs[0].ID+" is already in checkpoint group 'orders'")
+}
+
+func TestCheckpointGroupStoreFailure(t *testing.T) {
+	assert := assert.New(t)
+	db := kvstore.NewMockKV(nil)
+	sm, stream, subs, done := newTestCheckpointGroupSubs(t, db)
+	defer done()
+	ctx := context.Background()
+
+	db.StoreErr = fmt.Errorf("pop")
+	_, err := sm.AddCheckpointGroup(ctx, &CheckpointGroupInfo{Name: "orders", Stream: stream.spec.ID, Subscriptions: []string{subs[0].ID}})
+	assert.EqualError(err, "Failed to store checkpoint group: pop")
+}
+
+func TestRecoverCheckpointGroupErrors(t *testing.T) {
+	assert := assert.New(t)
+	dir := tempdir(t)
+	defer cleanup(t, dir)
+	sm := newTestSubscriptionManager()
+	sm.db, _ = kvstore.NewLDBKeyValueStore(path.Join(dir, "db"))
+	defer sm.db.Close()
+
+	sm.db.Put(checkpointGroupIDPrefix+"orders", []byte(":bad json"))
+	sm.db.Put(checkpointGroupIDPrefix+"payments", []byte(`{"name":"payments"}`))
+
+	sm.recoverCheckpointGroups()
+
+	assert.Equal(1, len(sm.checkpointGroups))
+	assert.NotNil(sm.checkpointGroups["payments"])
+}
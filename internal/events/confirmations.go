@@ -0,0 +1,176 @@
+// Copyright 2021 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package events
+
+import (
+	"context"
+	"math/big"
+
+	ethbinding "github.com/kaleido-io/ethbinding/pkg"
+	"github.com/kaleido-io/ethconnect/internal/ethbind"
+	log "github.com/sirupsen/logrus"
+)
+
+// pendingEvent is an event held by the log processor until its block has
+// the number of confirmations configured on the stream
+type pendingEvent struct {
+	key         string
+	blockNumber *big.Int
+	blockHash   string
+	event       *eventData
+}
+
+// blockHeader is the part of a block from eth_getBlockByNumber we need to check
+// it is still the block at that height
+type blockHeader struct {
+	Hash ethbinding.Hash `json:"hash"`
+}
+
+func pendingEventKey(entry *logEntry) string {
+	return entry.BlockHash.String() + "/" + entry.TransactionHash.String() + "/" + string(entry.LogIndex)
+}
+
+// addPending holds an event until it is confirmed
+func (lp *logProcessor) addPending(subInfo string, entry *logEntry, result *eventData) {
+	log.Debugf("%s: Holding event for %d confirmations. BlockNumber=%s TxIndex=%s", subInfo, lp.stream.spec.Confirmations, result.BlockNumber, result.TransactionIndex)
+	lp.hwnSync.Lock()
+	defer lp.hwnSync.Unlock()
+	lp.pending = append(lp.pending, &pendingEvent{
+		key:         pendingEventKey(entry),
+		blockNumber: new(big.Int).Set(entry.BlockNumber.ToInt()),
+		blockHash:   entry.BlockHash.String(),
+		event:       result,
+	})
+}
+
+// removePending drops an event that is waiting for confirmations, when the node tells us
+// its log was removed by a re-org. Returns false if the event is not pending, in which
+// case it might have been delivered already
+func (lp *logProcessor) removePending(entry *logEntry) bool {
+	key := pendingEventKey(entry)
+	lp.hwnSync.Lock()
+	defer lp.hwnSync.Unlock()
+	for i, pe := range lp.pending {
+		if pe.key == key {
+			lp.pending = append(lp.pending[:i], lp.pending[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// readyPending returns the events that have reached the required confirmations,
+// without removing them
+func (lp *logProcessor) readyPending(head *big.Int) []*pendingEvent {
+	confirmations := new(big.Int).SetUint64(lp.stream.spec.Confirmations)
+	lp.hwnSync.Lock()
+	defer lp.hwnSync.Unlock()
+	var ready []*pendingEvent
+	for _, pe := range lp.pending {
+		depth := new(big.Int).Sub(head, pe.blockNumber)
+		if depth.Add(depth, big.NewInt(1)).Cmp(confirmations) >= 0 {
+			ready = append(ready, pe)
+		}
+	}
+	return ready
+}
+
+// lowestPending returns the lowest block of the events waiting for confirmations,
+// which the checkpoint must not pass. Called with the lock held
+func (lp *logProcessor) lowestPending() *big.Int {
+	var lowest *big.Int
+	for _, pe := range lp.pending {
+		if lowest == nil || pe.blockNumber.Cmp(lowest) < 0 {
+			lowest = pe.blockNumber
+		}
+	}
+	return lowest
+}
+
+// resetPending discards the events waiting for confirmations, which are read again
+// from the checkpoint when the filter is recreated
+func (lp *logProcessor) resetPending() {
+	lp.hwnSync.Lock()
+	defer lp.hwnSync.Unlock()
+	lp.pending = nil
+}
+
+// releasePending dispatches the confirmed events that are still in the canonical chain,
+// and drops those whose block has been replaced by a re-org
+func (lp *logProcessor) releasePending(subInfo string, ready []*pendingEvent, canonical map[string]string) {
+	released := make(map[*pendingEvent]bool, len(ready))
+	for _, pe := range ready {
+		released[pe] = true
+	}
+	lp.hwnSync.Lock()
+	remaining := make([]*pendingEvent, 0, len(lp.pending))
+	for _, pe := range lp.pending {
+		if !released[pe] {
+			remaining = append(remaining, pe)
+		}
+	}
+	lp.pending = remaining
+	lp.hwnSync.Unlock()
+
+	for _, pe := range ready {
+		if canonical[pe.blockNumber.String()] != pe.blockHash {
+			log.Warnf("%s: Dropping event in block %s (%s) replaced by a chain re-org. TxHash=%s", subInfo, pe.event.BlockNumber, pe.blockHash, pe.event.TransactionHash)
+			continue
+		}
+		lp.trackEvent(pe.key, pe.blockNumber, pe.blockHash, pe.event)
+		lp.dispatch(subInfo, pe.event, pe.blockNumber)
+	}
+}
+
+// confirmEvents dispatches the events held for the confirmations configured on the stream,
+// once their blocks are deep enough in the chain. Each block is checked against the block
+// at that height in the chain now, so events from blocks that were re-orged out without the
+// node reporting the removed logs are not delivered
+func (s *subscription) confirmEvents(ctx context.Context) error {
+	if !s.lp.hasPending() {
+		return nil
+	}
+	var head ethbinding.HexBigInt
+	if err := s.rpcCall(ctx, &head, "eth_blockNumber"); err != nil {
+		return err
+	}
+	ready := s.lp.readyPending(head.ToInt())
+	canonical := make(map[string]string)
+	for _, pe := range ready {
+		blockNumber := pe.blockNumber.String()
+		if _, ok := canonical[blockNumber]; ok {
+			continue
+		}
+		var block *blockHeader
+		if err := s.rpcCall(ctx, &block, "eth_getBlockByNumber", ethbind.API.EncodeBig(pe.blockNumber), false); err != nil {
+			return err
+		}
+		if block != nil {
+			canonical[blockNumber] = block.Hash.String()
+		} else {
+			canonical[blockNumber] = ""
+		}
+	}
+	if len(ready) > 0 {
+		s.lp.releasePending(s.logName, ready, canonical)
+	}
+	return nil
+}
+
+func (lp *logProcessor) hasPending() bool {
+	lp.hwnSync.Lock()
+	defer lp.hwnSync.Unlock()
+	return len(lp.pending) > 0
+}
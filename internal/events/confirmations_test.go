@@ -0,0 +1,213 @@
+// Copyright 2021 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package events
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"testing"
+
+	ethbinding "github.com/kaleido-io/ethbinding/pkg"
+	"github.com/kaleido-io/ethconnect/internal/eth"
+	"github.com/kaleido-io/ethconnect/internal/ethbind"
+	"github.com/stretchr/testify/assert"
+)
+
+const testCanonicalBlockHash = "0xb6d8a38a89ac35a04ee6ebd5789a4a805dfa26c1b753c311db523ec9bf204384"
+
+type testConfirmationsChain struct {
+	head       int64
+	blockHash  string
+	blockCalls int
+}
+
+func newTestConfirmationsSub(confirmations uint64, chain *testConfirmationsChain) *subscription {
+	stream := &eventStream{
+		sm:          &mockSubMgr{},
+		spec:        &StreamInfo{Confirmations: confirmations},
+		eventStream: make(chan *eventData, 10),
+	}
+	var marshaling ethbinding.ABIElementMarshaling
+	json.Unmarshal([]byte(sampleEventABIAllIndexedNoData), &marshaling)
+	event, _ := ethbind.API.ABIElementMarshalingToABIEvent(&marshaling)
+	return &subscription{
+		logName: "ut",
+		lp:      newLogProcessor("sub1", event, stream),
+		rpc: eth.NewMockRPCClientForSync(nil, func(method string, res interface{}, args ...interface{}) {
+			switch method {
+			case "eth_blockNumber":
+				json.Unmarshal([]byte(fmt.Sprintf(`"0x%x"`, chain.head)), res)
+			case "eth_getBlockByNumber":
+				chain.blockCalls++
+				if chain.blockHash == "" {
+					json.Unmarshal([]byte(`null`), res)
+				} else {
+					json.Unmarshal([]byte(fmt.Sprintf(`{"hash":"%s"}`, chain.blockHash)), res)
+				}
+			}
+		}),
+	}
+}
+
+func testConfirmationsLog(removed bool) *logEntry {
+	var l logEntry
+	json.Unmarshal([]byte(sampleEventLogAllIndexedNoData), &l)
+	l.Removed = removed
+	return &l
+}
+
+func TestConfirmEventsDelivered(t *testing.T) {
+	assert := assert.New(t)
+	chain := &testConfirmationsChain{head: 0x74082, blockHash: testCanonicalBlockHash}
+	s := newTestConfirmationsSub(3, chain)
+
+	err := s.lp.processLogEntry(s.logName, testConfirmationsLog(false), 0)
+	assert.NoError(err)
+	err = s.lp.processLogEntry(s.logName, testConfirmationsLog(false), 1)
+	assert.NoError(err)
+	assert.Len(s.lp.pending, 2)
+
+	err = s.confirmEvents(context.Background())
+	assert.NoError(err)
+	assert.Len(s.lp.pending, 2)
+	assert.Equal(0, chain.blockCalls)
+
+	chain.head = 0x74084
+	err = s.confirmEvents(context.Background())
+	assert.NoError(err)
+	assert.Empty(s.lp.pending)
+	assert.Equal(1, chain.blockCalls)
+	assert.Len(s.lp.stream.eventStream, 2)
+	ev := <-s.lp.stream.eventStream
+	assert.Equal("475266", ev.BlockNumber)
+	assert.False(ev.Removed)
+	assert.Equal(int64(0x74082), s.lp.highestDispatched.Int64())
+}
+
+func TestConfirmEventsReorgedBlock(t *testing.T) {
+	assert := assert.New(t)
+	chain := &testConfirmationsChain{head: 0x74090, blockHash: "0x1e5ea8cf3ab1bb8a3e5cc2e1cd1c7f4b0b8e6b8b4f0d2a1e84a4f5a0fd1e1b2c"}
+	s := newTestConfirmationsSub(3, chain)
+
+	err := s.lp.processLogEntry(s.logName, testConfirmationsLog(false), 0)
+	assert.NoError(err)
+	err = s.confirmEvents(context.Background())
+	assert.NoError(err)
+	assert.Empty(s.lp.pending)
+	assert.Empty(s.lp.stream.eventStream)
+
+	chain.blockHash = ""
+	err = s.lp.processLogEntry(s.logName, testConfirmationsLog(false), 0)
+	assert.NoError(err)
+	err = s.confirmEvents(context.Background())
+	assert.NoError(err)
+	assert.Empty(s.lp.pending)
+	assert.Empty(s.lp.stream.eventStream)
+}
+
+func TestConfirmEventsRemovedPending(t *testing.T) {
+	assert := assert.New(t)
+	chain := &testConfirmationsChain{head: 0x74082}
+	s := newTestConfirmationsSub(3, chain)
+
+	err := s.lp.processLogEntry(s.logName, testConfirmationsLog(false), 0)
+	assert.NoError(err)
+	assert.Len(s.lp.pending, 1)
+	err = s.lp.processLogEntry(s.logName, testConfirmationsLog(true), 0)
+	assert.NoError(err)
+	assert.Empty(s.lp.pending)
+	assert.Empty(s.lp.stream.eventStream)
+}
+
+func TestConfirmEventsRemovedDelivered(t *testing.T) {
+	assert := assert.New(t)
+	s := newTestConfirmationsSub(0, &testConfirmationsChain{})
+	s.lp.aggregator = newAggregator(&AggregationInfo{MaxCount: 10})
+
+	err := s.lp.processLogEntry(s.logName, testConfirmationsLog(true), 0)
+	assert.NoError(err)
+	ev := <-s.lp.stream.eventStream
+	assert.True(ev.Removed)
+	b, _ := json.Marshal(ev)
+	assert.Contains(string(b), `"removed":true`)
+}
+
+func TestConfirmEventsRPCErrors(t *testing.T) {
+	assert := assert.New(t)
+	s := newTestConfirmationsSub(3, &testConfirmationsChain{})
+	err := s.lp.processLogEntry(s.logName, testConfirmationsLog(false), 0)
+	assert.NoError(err)
+
+	s.rpc = eth.NewMockRPCClientForSync(fmt.Errorf("pop"), nil)
+	err = s.confirmEvents(context.Background())
+	assert.EqualError(err, "eth_blockNumber returned: pop")
+
+	s.rpc = eth.NewMockRPCClientForSync(nil, func(method string, res interface{}, args ...interface{}) {
+		if method == "eth_blockNumber" {
+			json.Unmarshal([]byte(`"0x74090"`), res)
+		}
+	})
+	err = s.confirmEvents(context.Background())
+	assert.NoError(err)
+	assert.Empty(s.lp.pending)
+}
+
+func TestConfirmEventsBlockRPCError(t *testing.T) {
+	assert := assert.New(t)
+	s := newTestConfirmationsSub(3, &testConfirmationsChain{})
+	err := s.lp.processLogEntry(s.logName, testConfirmationsLog(false), 0)
+	assert.NoError(err)
+
+	s.rpc = &testFailingRPC{
+		MockRPCClient: eth.NewMockRPCClientForSync(nil, func(method string, res interface{}, args ...interface{}) {
+			json.Unmarshal([]byte(`"0x74090"`), res)
+		}),
+		failMethod: "eth_getBlockByNumber",
+	}
+	err = s.confirmEvents(context.Background())
+	assert.EqualError(err, "eth_getBlockByNumber returned: pop")
+	assert.Len(s.lp.pending, 1)
+}
+
+type testFailingRPC struct {
+	*eth.MockRPCClient
+	failMethod string
+}
+
+func (r *testFailingRPC) CallContext(ctx context.Context, result interface{}, method string, args ...interface{}) error {
+	if method == r.failMethod {
+		return fmt.Errorf("pop")
+	}
+	return r.MockRPCClient.CallContext(ctx, result, method, args...)
+}
+
+func TestMarkNoEventsPending(t *testing.T) {
+	assert := assert.New(t)
+	s := newTestConfirmationsSub(3, &testConfirmationsChain{})
+	s.lp.initBlockHWM(big.NewInt(100))
+
+	err := s.lp.processLogEntry(s.logName, testConfirmationsLog(false), 0)
+	assert.NoError(err)
+	s.lp.markNoEvents(big.NewInt(0x74100))
+	hwm := s.lp.getBlockHWM()
+	assert.Equal(int64(0x74082), hwm.Int64())
+
+	s.lp.resetPending()
+	s.lp.markNoEvents(big.NewInt(0x74100))
+	hwm = s.lp.getBlockHWM()
+	assert.Equal(int64(0x74100), hwm.Int64())
+}
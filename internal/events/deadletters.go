@@ -0,0 +1,314 @@
+// Copyright 2021 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package events
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/kaleido-io/ethconnect/internal/errors"
+	"github.com/kaleido-io/ethconnect/internal/webhook"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	deadLetterFileSuffix = ".jsonl"
+)
+
+// RetryPolicy configures the exponential backoff between the attempts to deliver a batch,
+// within the retryTimeoutSec of the stream
+type RetryPolicy struct {
+	InitialDelayMS uint64  `json:"initialDelayMS,omitempty"`
+	MaxDelayMS     uint64  `json:"maxDelayMS,omitempty"`
+	Factor         float64 `json:"factor,omitempty"`
+	// Jitter is the fraction of each delay that is randomized, so a receiver recovering
+	// from an outage is not sent the retries of every stream at once
+	Jitter float64 `json:"jitter,omitempty"`
+	// MaxRetries gives up on a batch after this many retries, even within the retry timeout.
+	// Zero limits the retries only by the timeout
+	MaxRetries uint64 `json:"maxRetries,omitempty"`
+}
+
+// DeadLetterConf configures the destinations available for batches that could not be delivered
+type DeadLetterConf struct {
+	// Directory holds a file of dead letters for each stream with the 'file' type
+	Directory string            `json:"directory,omitempty"`
+	Kafka     BackfillKafkaConf `json:"kafka,omitempty"`
+}
+
+// DeadLetterInfo is where the batches of a stream are sent when they cannot be delivered,
+// rather than blocking the stream or being skipped
+type DeadLetterInfo struct {
+	Type    string             `json:"type"`
+	Kafka   *backfillKafkaInfo `json:"kafka,omitempty"`
+	Webhook *webhookActionInfo `json:"webhook,omitempty"`
+}
+
+// DeadLetter is a batch that could not be delivered, with the error of the last attempt
+type DeadLetter struct {
+	Stream      string       `json:"stream"`
+	BatchNumber uint64       `json:"batchNumber"`
+	Attempts    uint64       `json:"attempts"`
+	Error       string       `json:"error"`
+	Timestamp   time.Time    `json:"timestamp"`
+	Events      []*eventData `json:"events"`
+}
+
+// deadLetterTarget sends dead letters to the destination of a stream
+type deadLetterTarget interface {
+	send(dl *DeadLetter) error
+	close()
+}
+
+// fileDeadLetterTarget appends each dead letter to a file as a line of JSON
+type fileDeadLetterTarget struct {
+	file string
+}
+
+func (f *fileDeadLetterTarget) send(dl *DeadLetter) error {
+	fd, err := os.OpenFile(f.file, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return errors.Errorf(errors.EventStreamsDeadLetterWriteFailed, f.file, err)
+	}
+	defer fd.Close()
+	b, _ := json.Marshal(dl)
+	if _, err := fd.Write(append(b, '\n')); err != nil {
+		return errors.Errorf(errors.EventStreamsDeadLetterWriteFailed, f.file, err)
+	}
+	return nil
+}
+
+func (f *fileDeadLetterTarget) close() {}
+
+// kafkaDeadLetterTarget sends each dead letter as a message to a topic, keyed by the stream
+type kafkaDeadLetterTarget struct {
+	producer sarama.SyncProducer
+	topic    string
+}
+
+func (k *kafkaDeadLetterTarget) send(dl *DeadLetter) error {
+	b, _ := json.Marshal(dl)
+	_, _, err := k.producer.SendMessage(&sarama.ProducerMessage{
+		Topic: k.topic,
+		Key:   sarama.StringEncoder(dl.Stream),
+		Value: sarama.ByteEncoder(b),
+	})
+	return err
+}
+
+func (k *kafkaDeadLetterTarget) close() {
+	k.producer.Close()
+}
+
+// webhookDeadLetterTarget posts each dead letter to a secondary webhook
+type webhookDeadLetterTarget struct {
+	*webhookBackfillTarget
+}
+
+func (w *webhookDeadLetterTarget) send(dl *DeadLetter) error {
+	return w.post(dl)
+}
+
+func validateRetryPolicy(policy *RetryPolicy) error {
+	if policy != nil && ((policy.Factor != 0 && policy.Factor < 1) || policy.Jitter < 0 || policy.Jitter > 1) {
+		return errors.Errorf(errors.EventStreamsInvalidRetryPolicy)
+	}
+	return nil
+}
+
+// validateDeadLetter checks the dead letter destination of a stream, without connecting to it
+func validateDeadLetter(conf *SubscriptionManagerConf, info *DeadLetterInfo) error {
+	if info == nil {
+		return nil
+	}
+	info.Type = strings.ToLower(info.Type)
+	switch info.Type {
+	case "file":
+		if conf.DeadLetters.Directory == "" {
+			return errors.Errorf(errors.EventStreamsDeadLetterNoDirectory)
+		}
+	case "kafka":
+		if info.Kafka == nil || info.Kafka.Topic == "" {
+			return errors.Errorf(errors.EventStreamsDeadLetterKafkaNoTopic)
+		}
+		if len(conf.DeadLetters.Kafka.Brokers) == 0 {
+			return errors.Errorf(errors.EventStreamsDeadLetterKafkaNotConfigured)
+		}
+	case "webhook":
+		if info.Webhook == nil || info.Webhook.URL == "" {
+			return errors.Errorf(errors.EventStreamsWebhookNoURL)
+		}
+		if _, err := url.Parse(info.Webhook.URL); err != nil {
+			return errors.Errorf(errors.EventStreamsWebhookInvalidURL)
+		}
+		if info.Webhook.RequestTimeoutSec == 0 {
+			info.Webhook.RequestTimeoutSec = 120
+		}
+	default:
+		return errors.Errorf(errors.EventStreamsDeadLetterInvalidType, info.Type)
+	}
+	return nil
+}
+
+// applyRetryPolicy sets the backoff of the stream from its retry policy, or the defaults
+func (a *eventStream) applyRetryPolicy() {
+	backoff := &webhook.Backoff{
+		InitialDelay: DefaultExponentialBackoffInitial,
+		Factor:       DefaultExponentialBackoffFactor,
+	}
+	if policy := a.spec.Retry; policy != nil {
+		if policy.InitialDelayMS > 0 {
+			backoff.InitialDelay = time.Duration(policy.InitialDelayMS) * time.Millisecond
+		}
+		if policy.Factor > 0 {
+			backoff.Factor = policy.Factor
+		}
+		backoff.MaxDelay = time.Duration(policy.MaxDelayMS) * time.Millisecond
+		backoff.Jitter = policy.Jitter
+		backoff.MaxRetries = policy.MaxRetries
+	}
+	a.backoff = backoff
+}
+
+func (a *eventStream) deadLetterFile() string {
+	return path.Join(a.sm.config().DeadLetters.Directory, a.spec.ID+deadLetterFileSuffix)
+}
+
+func (a *eventStream) newDeadLetterTarget() (deadLetterTarget, error) {
+	info := a.spec.DeadLetter
+	switch info.Type {
+	case "kafka":
+		producer, err := a.sm.newKafkaProducer(&a.sm.config().DeadLetters.Kafka)
+		if err != nil {
+			return nil, errors.Errorf(errors.EventStreamsDeadLetterKafkaConnect, err)
+		}
+		return &kafkaDeadLetterTarget{producer: producer, topic: info.Kafka.Topic}, nil
+	case "webhook":
+		return &webhookDeadLetterTarget{newWebhookBackfillTarget(info.Webhook, a.allowPrivateIPs)}, nil
+	default:
+		return &fileDeadLetterTarget{file: a.deadLetterFile()}, nil
+	}
+}
+
+// deadLetter sends a batch that could not be delivered to the dead letter destination of the
+// stream. The destination is connected on first use, and kept until the stream is updated or stopped
+func (a *eventStream) deadLetter(batchNumber uint64, events []*eventData, attempts uint64, deliveryErr error) (err error) {
+	a.deadLetterLock.Lock()
+	defer a.deadLetterLock.Unlock()
+	if a.deadLetters == nil {
+		if a.deadLetters, err = a.newDeadLetterTarget(); err != nil {
+			return err
+		}
+	}
+	dl := &DeadLetter{
+		Stream:      a.spec.ID,
+		BatchNumber: batchNumber,
+		Attempts:    attempts,
+		Error:       deliveryErr.Error(),
+		Timestamp:   time.Now().UTC(),
+		Events:      events,
+	}
+	if err = a.deadLetters.send(dl); err != nil {
+		return err
+	}
+	log.Warnf("%s: Batch %d with %d events sent to the '%s' dead letter destination", a.spec.ID, batchNumber, len(events), a.spec.DeadLetter.Type)
+	return nil
+}
+
+func (a *eventStream) closeDeadLetters() {
+	a.deadLetterLock.Lock()
+	defer a.deadLetterLock.Unlock()
+	if a.deadLetters != nil {
+		a.deadLetters.close()
+		a.deadLetters = nil
+	}
+}
+
+// readDeadLetters returns the dead letters in the file of the stream, and optionally
+// removes the file so they are not returned again
+func (a *eventStream) readDeadLetters(remove bool) ([]*DeadLetter, error) {
+	if a.spec.DeadLetter == nil || a.spec.DeadLetter.Type != "file" {
+		return nil, errors.Errorf(errors.EventStreamsDeadLetterNotFile, a.spec.ID)
+	}
+	a.deadLetterLock.Lock()
+	defer a.deadLetterLock.Unlock()
+	file := a.deadLetterFile()
+	dls := []*DeadLetter{}
+	fd, err := os.Open(file)
+	if os.IsNotExist(err) {
+		return dls, nil
+	} else if err != nil {
+		return nil, errors.Errorf(errors.EventStreamsDeadLetterReadFailed, file, err)
+	}
+	defer fd.Close()
+	decoder := json.NewDecoder(fd)
+	for {
+		var dl DeadLetter
+		if err := decoder.Decode(&dl); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, errors.Errorf(errors.EventStreamsDeadLetterReadFailed, file, err)
+		}
+		dls = append(dls, &dl)
+	}
+	if remove {
+		if err := os.Remove(file); err != nil {
+			return nil, errors.Errorf(errors.EventStreamsDeadLetterReadFailed, file, err)
+		}
+	}
+	return dls, nil
+}
+
+// StreamDeadLetters returns the dead letters of a stream with the 'file' type, oldest first
+func (s *subscriptionMGR) StreamDeadLetters(ctx context.Context, id string) ([]*DeadLetter, error) {
+	stream, err := s.streamByID(id)
+	if err != nil {
+		return nil, err
+	}
+	return stream.readDeadLetters(false)
+}
+
+// ReplayDeadLetters queues the events of the dead letters of a stream with the 'file' type for
+// delivery again, in their original order, and returns the number of batches replayed. Batches
+// that fail again are sent back to the dead letter file. The checkpoints of the subscriptions
+// are not affected
+func (s *subscriptionMGR) ReplayDeadLetters(ctx context.Context, id string) (int, error) {
+	stream, err := s.streamByID(id)
+	if err != nil {
+		return 0, err
+	}
+	if stream.suspendOrStop() {
+		return 0, errors.Errorf(errors.EventStreamsDeadLetterReplaySuspended, id)
+	}
+	dls, err := stream.readDeadLetters(true)
+	if err != nil {
+		return 0, err
+	}
+	for _, dl := range dls {
+		for _, event := range dl.Events {
+			event.batchComplete = func(*eventData) {}
+			stream.handleEvent(event)
+		}
+	}
+	log.Infof("%s: Replayed %d dead letters", id, len(dls))
+	return len(dls), nil
+}
@@ -0,0 +1,285 @@
+// Copyright 2021 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package events
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/Shopify/sarama/mocks"
+	"github.com/kaleido-io/ethconnect/internal/kvstore"
+	"github.com/stretchr/testify/assert"
+)
+
+// newTestStreamForDeadLetters creates a webhook stream, with a receiver that returns the
+// supplied statuses in turn, and passes each batch it receives to the returned channel
+func newTestStreamForDeadLetters(t *testing.T, dir string, deadLetter *DeadLetterInfo, status ...int) (*subscriptionMGR, *eventStream, *httptest.Server, chan []*eventData) {
+	batches := make(chan []*eventData, 10)
+	count := 0
+	svr := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		var events []*eventData
+		json.NewDecoder(req.Body).Decode(&events)
+		batches <- events
+		idx := count
+		if idx >= len(status) {
+			idx = len(status) - 1
+		}
+		res.WriteHeader(status[idx])
+		count++
+	}))
+	sm := newTestSubscriptionManager()
+	sm.db = kvstore.NewMemoryKeyValueStore()
+	sm.conf.DeadLetters.Directory = dir
+	spec, err := sm.AddStream(context.Background(), &StreamInfo{
+		Type:            "webhook",
+		Webhook:         &webhookActionInfo{URL: svr.URL},
+		BatchSize:       2,
+		ErrorHandling:   ErrorHandlingBlock,
+		RetryTimeoutSec: 10,
+		Retry:           &RetryPolicy{InitialDelayMS: 1, MaxRetries: 1},
+		DeadLetter:      deadLetter,
+	})
+	assert.NoError(t, err)
+	return sm, sm.streams[spec.ID], svr, batches
+}
+
+func testDeadLetterEvents(stream *eventStream, complete chan bool) {
+	for _, block := range []string{"10", "11"} {
+		stream.handleEvent(&eventData{
+			SubID:         "sub1",
+			BlockNumber:   block,
+			batchComplete: func(*eventData) { complete <- true },
+		})
+	}
+}
+
+func TestRetryPolicyBackoff(t *testing.T) {
+	assert := assert.New(t)
+	a := &eventStream{spec: &StreamInfo{}}
+	a.applyRetryPolicy()
+	assert.Equal(DefaultExponentialBackoffInitial, a.backoff.InitialDelay)
+	assert.Equal(2*time.Second, a.backoff.Next(1*time.Second))
+	assert.Equal(1*time.Second, a.backoff.Wait(1*time.Second))
+	assert.False(a.backoff.Exhausted(100))
+
+	a.spec.Retry = &RetryPolicy{InitialDelayMS: 10, MaxDelayMS: 25, Factor: 3, Jitter: 0.5, MaxRetries: 2}
+	a.applyRetryPolicy()
+	assert.Equal(10*time.Millisecond, a.backoff.InitialDelay)
+	assert.Equal(float64(3), a.backoff.Factor)
+	assert.Equal(25*time.Millisecond, a.backoff.Next(10*time.Millisecond))
+	for i := 0; i < 10; i++ {
+		wait := a.backoff.Wait(10 * time.Millisecond)
+		assert.True(wait >= 5*time.Millisecond && wait <= 10*time.Millisecond)
+	}
+	assert.False(a.backoff.Exhausted(2))
+	assert.True(a.backoff.Exhausted(3))
+}
+
+func TestStreamInvalidRetryOrDeadLetter(t *testing.T) {
+	assert := assert.New(t)
+	sm := newTestSubscriptionManager()
+	webhook := &webhookActionInfo{URL: "http://test.invalid"}
+
+	_, err := sm.AddStream(context.Background(), &StreamInfo{Type: "webhook", Webhook: webhook, Retry: &RetryPolicy{Jitter: 1.5}})
+	assert.EqualError(err, "Invalid retry policy - the factor must be at least 1, and the jitter between 0 and 1")
+	_, err = sm.AddStream(context.Background(), &StreamInfo{Type: "webhook", Webhook: webhook, Retry: &RetryPolicy{Factor: 0.5}})
+	assert.Regexp("Invalid retry policy", err)
+
+	for _, test := range []struct {
+		info *DeadLetterInfo
+		err  string
+	}{
+		{&DeadLetterInfo{Type: "queue"}, "Unknown dead letter type 'queue'. Valid types are: 'file', 'kafka' and 'webhook'"},
+		{&DeadLetterInfo{Type: "File"}, "A directory must be configured in the deadLetters configuration for dead letter type 'file'"},
+		{&DeadLetterInfo{Type: "kafka"}, "Must specify kafka.topic for dead letter type 'kafka'"},
+		{&DeadLetterInfo{Type: "kafka", Kafka: &backfillKafkaInfo{Topic: "dlq"}}, "Kafka brokers must be configured in the deadLetters configuration for dead letter type 'kafka'"},
+		{&DeadLetterInfo{Type: "webhook"}, "Must specify webhook.url for action type 'webhook'"},
+		{&DeadLetterInfo{Type: "webhook", Webhook: &webhookActionInfo{URL: ":badurl"}}, "Invalid URL in webhook action"},
+	} {
+		_, err = sm.AddStream(context.Background(), &StreamInfo{Type: "webhook", Webhook: webhook, DeadLetter: test.info})
+		assert.EqualError(err, test.err)
+	}
+}
+
+func TestDeadLetterFileAndReplay(t *testing.T) {
+	assert := assert.New(t)
+	dir := tempdir(t)
+	defer cleanup(t, dir)
+	sm, stream, svr, batches := newTestStreamForDeadLetters(t, dir, &DeadLetterInfo{Type: "file"}, 500, 500, 200)
+	defer svr.Close()
+	defer stream.stop()
+
+	complete := make(chan bool, 2)
+	testDeadLetterEvents(stream, complete)
+	<-complete
+
+	deadLetters, err := sm.StreamDeadLetters(context.Background(), stream.spec.ID)
+	assert.NoError(err)
+	assert.Equal(1, len(deadLetters))
+	assert.Equal(uint64(2), deadLetters[0].Attempts)
+	assert.Regexp("Failed with status=500", deadLetters[0].Error)
+	assert.Equal(2, len(deadLetters[0].Events))
+	assert.Equal("11", deadLetters[0].Events[1].BlockNumber)
+
+	deliveries, _ := sm.StreamDeliveries(context.Background(), stream.spec.ID, 0, 0)
+	assert.Equal(1, len(deliveries))
+	assert.Equal(DeliveryStatusDeadLettered, deliveries[0].Status)
+	assert.Regexp("Failed with status=500", deliveries[0].Error)
+
+	replayed, err := sm.ReplayDeadLetters(context.Background(), stream.spec.ID)
+	assert.NoError(err)
+	assert.Equal(1, replayed)
+	<-batches
+	<-batches
+	replayedBatch := <-batches
+	assert.Equal(2, len(replayedBatch))
+	assert.Equal("10", replayedBatch[0].BlockNumber)
+
+	deadLetters, err = sm.StreamDeadLetters(context.Background(), stream.spec.ID)
+	assert.NoError(err)
+	assert.Empty(deadLetters)
+}
+
+func TestDeadLetterFileBadContent(t *testing.T) {
+	assert := assert.New(t)
+	dir := tempdir(t)
+	defer cleanup(t, dir)
+	sm, stream, svr, _ := newTestStreamForDeadLetters(t, dir, &DeadLetterInfo{Type: "file"}, 200)
+	defer svr.Close()
+	defer stream.stop()
+	ioutil.WriteFile(stream.deadLetterFile(), []byte("!json"), 0644)
+
+	_, err := sm.StreamDeadLetters(context.Background(), stream.spec.ID)
+	assert.Regexp("Failed to read dead letters from", err)
+	_, err = sm.ReplayDeadLetters(context.Background(), stream.spec.ID)
+	assert.Regexp("Failed to read dead letters from", err)
+
+	os.Remove(stream.deadLetterFile())
+	os.Mkdir(stream.deadLetterFile(), 0755)
+	_, err = sm.StreamDeadLetters(context.Background(), stream.spec.ID)
+	assert.Regexp("Failed to read dead letters from", err)
+	err = stream.deadLetter(1, []*eventData{}, 1, fmt.Errorf("pop"))
+	assert.Regexp("Failed to write dead letter to", err)
+}
+
+func TestDeadLettersNotFileOrSuspended(t *testing.T) {
+	assert := assert.New(t)
+	sm, stream, svr, _ := newTestStreamForDeadLetters(t, "", nil, 200)
+	defer svr.Close()
+	defer stream.stop()
+
+	_, err := sm.StreamDeadLetters(context.Background(), stream.spec.ID)
+	assert.EqualError(err, fmt.Sprintf("Dead letters of stream '%s' are not stored in a file, so cannot be listed or replayed", stream.spec.ID))
+	_, err = sm.StreamDeadLetters(context.Background(), "es-unknown")
+	assert.Regexp("not found", err)
+	_, err = sm.ReplayDeadLetters(context.Background(), "es-unknown")
+	assert.Regexp("not found", err)
+
+	stream.suspend(nil)
+	_, err = sm.ReplayDeadLetters(context.Background(), stream.spec.ID)
+	assert.EqualError(err, fmt.Sprintf("Dead letters cannot be replayed while stream '%s' is suspended", stream.spec.ID))
+}
+
+func TestDeadLetterToKafka(t *testing.T) {
+	assert := assert.New(t)
+	dir := tempdir(t)
+	defer cleanup(t, dir)
+	producer := mocks.NewSyncProducer(t, nil)
+	producer.ExpectSendMessageWithCheckerFunctionAndSucceed(func(val []byte) error {
+		var dl DeadLetter
+		json.Unmarshal(val, &dl)
+		if dl.BatchNumber != 1 || len(dl.Events) != 2 {
+			return fmt.Errorf("unexpected dead letter: %s", val)
+		}
+		return nil
+	})
+	sm := newTestSubscriptionManager()
+	sm.conf.DeadLetters.Kafka.Brokers = []string{"broker1"}
+	sm.kafkaProducer = func(brokers []string, conf *sarama.Config) (sarama.SyncProducer, error) {
+		assert.Equal([]string{"broker1"}, brokers)
+		return producer, nil
+	}
+	_, err := sm.AddStream(context.Background(), &StreamInfo{
+		Type:       "webhook",
+		Webhook:    &webhookActionInfo{URL: "http://test.invalid"},
+		DeadLetter: &DeadLetterInfo{Type: "kafka", Kafka: &backfillKafkaInfo{Topic: "dlq"}},
+	})
+	assert.NoError(err)
+	for _, stream := range sm.streams {
+		err = stream.deadLetter(1, []*eventData{{}, {}}, 3, fmt.Errorf("pop"))
+		assert.NoError(err)
+		stream.stop()
+	}
+}
+
+func TestDeadLetterKafkaConnectFail(t *testing.T) {
+	assert := assert.New(t)
+	sm := newTestSubscriptionManager()
+	sm.conf.DeadLetters.Kafka.Brokers = []string{"broker1"}
+	sm.kafkaProducer = func(brokers []string, conf *sarama.Config) (sarama.SyncProducer, error) {
+		return nil, fmt.Errorf("pop")
+	}
+	spec, err := sm.AddStream(context.Background(), &StreamInfo{
+		Type:       "webhook",
+		Webhook:    &webhookActionInfo{URL: "http://test.invalid"},
+		DeadLetter: &DeadLetterInfo{Type: "kafka", Kafka: &backfillKafkaInfo{Topic: "dlq"}},
+	})
+	assert.NoError(err)
+	stream := sm.streams[spec.ID]
+	defer stream.stop()
+	err = stream.deadLetter(1, []*eventData{}, 1, fmt.Errorf("pop"))
+	assert.EqualError(err, "Failed to connect to Kafka for dead letters: pop")
+}
+
+func TestDeadLetterToWebhook(t *testing.T) {
+	assert := assert.New(t)
+	received := make(chan *DeadLetter, 1)
+	dlq := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		var dl DeadLetter
+		json.NewDecoder(req.Body).Decode(&dl)
+		received <- &dl
+	}))
+	defer dlq.Close()
+	sm, stream, svr, _ := newTestStreamForDeadLetters(t, "", &DeadLetterInfo{Type: "webhook", Webhook: &webhookActionInfo{URL: dlq.URL}}, 503)
+	defer svr.Close()
+	defer stream.stop()
+
+	complete := make(chan bool, 2)
+	testDeadLetterEvents(stream, complete)
+	<-complete
+	dl := <-received
+	assert.Equal(stream.spec.ID, dl.Stream)
+	assert.Equal(2, len(dl.Events))
+
+	// Updating the destination replaces the connected target
+	_, err := sm.UpdateStream(context.Background(), stream.spec.ID, &StreamInfo{
+		DeadLetter: &DeadLetterInfo{Type: "webhook", Webhook: &webhookActionInfo{URL: dlq.URL + "/other"}},
+		Retry:      &RetryPolicy{MaxRetries: 5},
+	})
+	assert.NoError(err)
+	assert.Nil(stream.deadLetters)
+	assert.Equal(uint64(5), stream.spec.Retry.MaxRetries)
+
+	_, err = sm.UpdateStream(context.Background(), stream.spec.ID, &StreamInfo{Retry: &RetryPolicy{Jitter: -1}})
+	assert.Regexp("Invalid retry policy", err)
+}
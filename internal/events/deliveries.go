@@ -0,0 +1,209 @@
+// Copyright 2021 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package events
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+
+	"github.com/kaleido-io/ethconnect/internal/kvstore"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// DeliveryStatusDelivered the action accepted the batch
+	DeliveryStatusDelivered = "delivered"
+	// DeliveryStatusFailed the action did not accept the batch before the retry timeout
+	DeliveryStatusFailed = "failed"
+	// DeliveryStatusDeadLettered the action did not accept the batch, so it was sent to the dead letter destination
+	DeliveryStatusDeadLettered = "deadlettered"
+)
+
+const (
+	deliveryIDPrefix           = "dl-"
+	defaultDeliveryMaxRecords  = 1000
+	deliveryKeySeparator       = "/"
+	deliveryKeySeparatorLimit  = "0" // the character after the separator, to bound the keys of a stream
+	deliveryKeyTimestampFormat = "%020d"
+)
+
+// batchSizeBuckets are the upper bounds of the batch size histogram, up to the largest batch size of a stream
+var batchSizeBuckets = []float64{1, 2, 5, 10, 20, 50, 100, 200, 500, 1000}
+
+// deliveryLatencyBuckets are the upper bounds in seconds of the delivery latency histogram.
+// Retries are included, so a failing action can take up to the retry timeout of the stream
+var deliveryLatencyBuckets = []float64{0.01, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 300}
+
+// DeliveryAuditConf configures the history of batch deliveries kept for each stream
+type DeliveryAuditConf struct {
+	MaxRecords int `json:"maxRecords,omitempty"`
+}
+
+// DeliveryRecord is the outcome of an attempt to deliver a batch of events to the action
+// of a stream, including all the retries within the retry timeout of the stream
+type DeliveryRecord struct {
+	Stream       string    `json:"stream"`
+	BatchNumber  uint64    `json:"batchNumber"`
+	FirstBlock   string    `json:"firstBlock"`
+	LastBlock    string    `json:"lastBlock"`
+	Events       int       `json:"events"`
+	Status       string    `json:"status"`
+	ResponseCode int       `json:"responseCode,omitempty"`
+	LatencyMS    int64     `json:"latencyMS"`
+	Retries      uint64    `json:"retries"`
+	Error        string    `json:"error,omitempty"`
+	Timestamp    time.Time `json:"timestamp"`
+}
+
+// deliveryResponder is implemented by actions that receive a response code from
+// the target of the last attempt
+type deliveryResponder interface {
+	responseCode() int
+}
+
+func deliveryKeyPrefix(streamID string) string {
+	return deliveryIDPrefix + streamID + deliveryKeySeparator
+}
+
+// deliveryRange is all the records of a stream, in the order they were recorded
+func deliveryRange(streamID string) *kvstore.KVRange {
+	return &kvstore.KVRange{
+		Start: deliveryKeyPrefix(streamID),
+		Limit: deliveryIDPrefix + streamID + deliveryKeySeparatorLimit,
+	}
+}
+
+// newDeliveryRecord builds the record of a batch from the result of performActionWithRetry
+func (a *eventStream) newDeliveryRecord(batchNumber uint64, events []*eventData, attempts uint64, started time.Time, err error) *DeliveryRecord {
+	rec := &DeliveryRecord{
+		Stream:      a.spec.ID,
+		BatchNumber: batchNumber,
+		Events:      len(events),
+		Status:      DeliveryStatusDelivered,
+		LatencyMS:   time.Since(started).Milliseconds(),
+		Timestamp:   time.Now().UTC(),
+	}
+	if attempts > 0 {
+		rec.Retries = attempts - 1
+	}
+	if err != nil {
+		rec.Status = DeliveryStatusFailed
+		rec.Error = err.Error()
+	}
+	if responder, ok := a.action.(deliveryResponder); ok {
+		rec.ResponseCode = responder.responseCode()
+	}
+	// A batch can contain events from several subscriptions, so the blocks are not
+	// necessarily in order
+	var first, last *big.Int
+	for _, event := range events {
+		block, ok := new(big.Int).SetString(event.BlockNumber, 10)
+		if !ok {
+			continue
+		}
+		if first == nil || block.Cmp(first) < 0 {
+			first = block
+		}
+		if last == nil || block.Cmp(last) > 0 {
+			last = block
+		}
+	}
+	if first != nil {
+		rec.FirstBlock = first.String()
+		rec.LastBlock = last.String()
+	}
+	return rec
+}
+
+// recordDelivery stores a delivery record, and removes the oldest records of the stream
+// beyond the maximum. Failures are logged, as they must not block the delivery of events
+func (s *subscriptionMGR) recordDelivery(rec *DeliveryRecord) {
+	s.batchSizes.Observe(float64(rec.Events), rec.Stream)
+	s.deliveryLatency.Observe(float64(rec.LatencyMS)/1000, rec.Stream, rec.Status)
+
+	key := deliveryKeyPrefix(rec.Stream) + fmt.Sprintf(deliveryKeyTimestampFormat, rec.Timestamp.UnixNano())
+	b, _ := json.Marshal(rec)
+	if err := s.db.Put(key, b); err != nil {
+		log.Errorf("%s: Failed to record delivery of batch %d: %s", rec.Stream, rec.BatchNumber, err)
+		return
+	}
+
+	s.deliveryLock.Lock()
+	defer s.deliveryLock.Unlock()
+	s.deliveryCounts[rec.Stream]++
+	if excess := s.deliveryCounts[rec.Stream] - s.conf.Deliveries.MaxRecords; excess > 0 {
+		s.deliveryCounts[rec.Stream] -= s.deleteDeliveries(rec.Stream, excess)
+	}
+}
+
+// deleteDeliveries removes up to max of the oldest records of a stream, or all the
+// records if max is zero, and returns the number removed
+func (s *subscriptionMGR) deleteDeliveries(streamID string, max int) int {
+	it := s.db.NewIteratorWithRange(deliveryRange(streamID))
+	keys := []string{}
+	for it.Next() && (max == 0 || len(keys) < max) {
+		keys = append(keys, it.Key())
+	}
+	it.Release()
+	for _, key := range keys {
+		if err := s.db.Delete(key); err != nil {
+			log.Errorf("%s: Failed to delete delivery record '%s': %s", streamID, key, err)
+		}
+	}
+	return len(keys)
+}
+
+// recoverDeliveryCounts counts the records stored for each stream, so the oldest
+// are removed once the maximum is reached
+func (s *subscriptionMGR) recoverDeliveryCounts() {
+	it := s.db.NewIteratorWithRange(&kvstore.KVRange{Start: deliveryIDPrefix})
+	defer it.Release()
+	for it.Next() {
+		k := it.Key()
+		if !strings.HasPrefix(k, deliveryIDPrefix) {
+			break
+		}
+		if sep := strings.LastIndex(k, deliveryKeySeparator); sep > len(deliveryIDPrefix) {
+			s.deliveryCounts[k[len(deliveryIDPrefix):sep]]++
+		}
+	}
+}
+
+// StreamDeliveries returns the delivery records of a stream, newest first
+func (s *subscriptionMGR) StreamDeliveries(ctx context.Context, id string, skip, limit int) ([]*DeliveryRecord, error) {
+	if _, err := s.streamByID(id); err != nil {
+		return nil, err
+	}
+	records := []*DeliveryRecord{}
+	it := s.db.NewIteratorWithRange(deliveryRange(id))
+	defer it.Release()
+	index := 0
+	for valid := it.Last(); valid && (limit <= 0 || len(records) < limit); valid = it.Prev() {
+		if index >= skip {
+			var rec DeliveryRecord
+			if err := json.Unmarshal(it.Value(), &rec); err != nil {
+				log.Errorf("%s: Failed to decode delivery record '%s': %s", id, it.Key(), err)
+				continue
+			}
+			records = append(records, &rec)
+		}
+		index++
+	}
+	return records, nil
+}
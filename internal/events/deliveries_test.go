@@ -0,0 +1,205 @@
+// Copyright 2021 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package events
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/kaleido-io/ethconnect/internal/kvstore"
+	"github.com/stretchr/testify/assert"
+)
+
+func testDeliveryRecord(stream string, batchNumber uint64) *DeliveryRecord {
+	return &DeliveryRecord{
+		Stream:      stream,
+		BatchNumber: batchNumber,
+		Status:      DeliveryStatusDelivered,
+		Timestamp:   time.Unix(1600000000, int64(batchNumber)),
+	}
+}
+
+func TestDeliveryRecordedForWebhook(t *testing.T) {
+	assert := assert.New(t)
+	sm, stream, svr, eventStream := newTestStreamForBatching(
+		&StreamInfo{
+			BatchSize:       2,
+			BatchTimeoutMS:  50,
+			Webhook:         &webhookActionInfo{},
+			ErrorHandling:   ErrorHandlingBlock,
+			RetryTimeoutSec: 1,
+		}, kvstore.NewMemoryKeyValueStore(), 503, 200)
+	defer close(eventStream)
+	defer svr.Close()
+	defer stream.stop()
+	stream.backoff.InitialDelay = 1 * time.Millisecond
+
+	complete := make(chan bool, 2)
+	go func() {
+		<-eventStream
+		<-eventStream
+	}()
+	for _, block := range []string{"12", "10"} {
+		stream.handleEvent(&eventData{
+			SubID:         "sub1",
+			BlockNumber:   block,
+			batchComplete: func(*eventData) { complete <- true },
+		})
+	}
+	<-complete
+
+	deliveries, err := sm.StreamDeliveries(context.Background(), stream.spec.ID, 0, 0)
+	assert.NoError(err)
+	assert.Equal(1, len(deliveries))
+	rec := deliveries[0]
+	assert.Equal(stream.spec.ID, rec.Stream)
+	assert.Equal(uint64(1), rec.BatchNumber)
+	assert.Equal(DeliveryStatusDelivered, rec.Status)
+	assert.Equal(200, rec.ResponseCode)
+	assert.Equal(uint64(1), rec.Retries)
+	assert.Equal(2, rec.Events)
+	assert.Equal("10", rec.FirstBlock)
+	assert.Equal("12", rec.LastBlock)
+	assert.Empty(rec.Error)
+}
+
+func TestNewDeliveryRecordFailed(t *testing.T) {
+	assert := assert.New(t)
+	_, stream, _ := newTestStreamForWebSocket(&StreamInfo{Type: "websocket", WebSocket: &webSocketActionInfo{}}, nil)
+	defer stream.stop()
+
+	rec := stream.newDeliveryRecord(5, []*eventData{{BlockNumber: "pending"}}, 3, time.Now(), fmt.Errorf("pop"))
+	assert.Equal(DeliveryStatusFailed, rec.Status)
+	assert.Equal("pop", rec.Error)
+	assert.Equal(uint64(2), rec.Retries)
+	assert.Equal(0, rec.ResponseCode)
+	assert.Empty(rec.FirstBlock)
+	assert.Empty(rec.LastBlock)
+}
+
+func TestStreamDeliveriesPaging(t *testing.T) {
+	assert := assert.New(t)
+	sm := newTestSubscriptionManager()
+	sm.db = kvstore.NewMemoryKeyValueStore()
+	sm.streams["es-1"] = &eventStream{}
+	sm.streams["es-10"] = &eventStream{}
+	for i := uint64(1); i <= 5; i++ {
+		sm.recordDelivery(testDeliveryRecord("es-1", i))
+	}
+	sm.recordDelivery(testDeliveryRecord("es-10", 99))
+	sm.db.Put(deliveryKeyPrefix("es-1")+"0", []byte("!json"))
+
+	deliveries, err := sm.StreamDeliveries(context.Background(), "es-1", 0, 0)
+	assert.NoError(err)
+	assert.Equal(5, len(deliveries))
+	assert.Equal(uint64(5), deliveries[0].BatchNumber)
+
+	deliveries, err = sm.StreamDeliveries(context.Background(), "es-1", 1, 2)
+	assert.NoError(err)
+	assert.Equal(2, len(deliveries))
+	assert.Equal(uint64(4), deliveries[0].BatchNumber)
+	assert.Equal(uint64(3), deliveries[1].BatchNumber)
+
+	deliveries, err = sm.StreamDeliveries(context.Background(), "es-1", 10, 0)
+	assert.NoError(err)
+	assert.Empty(deliveries)
+
+	_, err = sm.StreamDeliveries(context.Background(), "es-2", 0, 0)
+	assert.EqualError(err, "Stream with ID 'es-2' not found")
+}
+
+func TestRecordDeliveryPrunesOldest(t *testing.T) {
+	assert := assert.New(t)
+	sm := newTestSubscriptionManager()
+	sm.db = kvstore.NewMemoryKeyValueStore()
+	sm.conf.Deliveries.MaxRecords = 3
+	sm.streams["es-1"] = &eventStream{}
+	for i := uint64(1); i <= 5; i++ {
+		sm.recordDelivery(testDeliveryRecord("es-1", i))
+	}
+
+	deliveries, _ := sm.StreamDeliveries(context.Background(), "es-1", 0, 0)
+	assert.Equal(3, len(deliveries))
+	assert.Equal(uint64(3), deliveries[2].BatchNumber)
+	assert.Equal(3, sm.deliveryCounts["es-1"])
+}
+
+func TestRecoverDeliveryCounts(t *testing.T) {
+	assert := assert.New(t)
+	sm := newTestSubscriptionManager()
+	sm.db = kvstore.NewMemoryKeyValueStore()
+	for i := uint64(1); i <= 3; i++ {
+		sm.recordDelivery(testDeliveryRecord("es-1", i))
+	}
+	sm.recordDelivery(testDeliveryRecord("es-2", 1))
+	sm.db.Put("sb-1", []byte("{}"))
+
+	sm.deliveryCounts = make(map[string]int)
+	sm.recoverDeliveryCounts()
+	assert.Equal(map[string]int{"es-1": 3, "es-2": 1}, sm.deliveryCounts)
+}
+
+func TestRecordDeliveryStoreFail(t *testing.T) {
+	assert := assert.New(t)
+	sm := newTestSubscriptionManager()
+	sm.db = kvstore.NewMockKV(fmt.Errorf("pop"))
+
+	sm.recordDelivery(testDeliveryRecord("es-1", 1))
+	assert.Equal(0, sm.deliveryCounts["es-1"])
+}
+
+func TestDeleteStreamDeletesDeliveries(t *testing.T) {
+	assert := assert.New(t)
+	db := kvstore.NewMemoryKeyValueStore()
+	sm, stream, svr, eventStream := newTestStreamForBatching(&StreamInfo{Webhook: &webhookActionInfo{}}, db, 200)
+	defer close(eventStream)
+	defer svr.Close()
+	sm.recordDelivery(testDeliveryRecord(stream.spec.ID, 1))
+	sm.recordDelivery(testDeliveryRecord("es-other", 1))
+
+	err := sm.DeleteStream(context.Background(), stream.spec.ID)
+	assert.NoError(err)
+	_, exists := sm.deliveryCounts[stream.spec.ID]
+	assert.False(exists)
+	it := db.NewIteratorWithRange(&kvstore.KVRange{Start: deliveryIDPrefix})
+	defer it.Release()
+	assert.True(it.Next())
+	assert.Regexp("^dl-es-other/", it.Key())
+	assert.False(it.Next())
+}
+
+func TestRecordDeliveryObservesMetrics(t *testing.T) {
+	assert := assert.New(t)
+	sm := newTestSubscriptionManager()
+	sm.db = kvstore.NewMockKV(fmt.Errorf("pop"))
+
+	rec := testDeliveryRecord("es-1", 1)
+	rec.Events = 20
+	rec.LatencyMS = 1500
+	sm.recordDelivery(rec)
+	rec = testDeliveryRecord("es-1", 2)
+	rec.Events = 1
+	rec.Status = DeliveryStatusFailed
+	sm.recordDelivery(rec)
+
+	batchSizes := sm.batchSizes.Aggregate("stream")["es-1"]
+	assert.Equal(uint64(2), batchSizes.Count)
+	assert.Equal(21.0, batchSizes.Sum)
+	byStatus := sm.deliveryLatency.Aggregate("status")
+	assert.Equal(1.5, byStatus[DeliveryStatusDelivered].Sum)
+	assert.Equal(uint64(1), byStatus[DeliveryStatusFailed].Count)
+}
@@ -17,6 +17,7 @@ package events
 import (
 	"container/list"
 	"context"
+	"fmt"
 	"math/big"
 	"net"
 	"net/url"
@@ -27,6 +28,9 @@ import (
 	"github.com/kaleido-io/ethconnect/internal/auth"
 	"github.com/kaleido-io/ethconnect/internal/errors"
 	"github.com/kaleido-io/ethconnect/internal/messages"
+	"github.com/kaleido-io/ethconnect/internal/opsevents"
+	"github.com/kaleido-io/ethconnect/internal/quotas"
+	"github.com/kaleido-io/ethconnect/internal/webhook"
 	"github.com/kaleido-io/ethconnect/internal/ws"
 
 	lru "github.com/hashicorp/golang-lru"
@@ -63,7 +67,9 @@ type StreamInfo struct {
 	ID                   string               `json:"id"`
 	Name                 string               `json:"name,omitempty"`
 	Path                 string               `json:"path"`
+	Tenant               string               `json:"tenant,omitempty"`
 	Suspended            bool                 `json:"suspended"`
+	ResumeAt             *time.Time           `json:"resumeAt,omitempty"`
 	Type                 string               `json:"type,omitempty"`
 	BatchSize            uint64               `json:"batchSize,omitempty"`
 	BatchTimeoutMS       uint64               `json:"batchTimeoutMS,omitempty"`
@@ -72,8 +78,16 @@ type StreamInfo struct {
 	BlockedRetryDelaySec uint64               `json:"blockedReryDelaySec,omitempty"`
 	Webhook              *webhookActionInfo   `json:"webhook,omitempty"`
 	WebSocket            *webSocketActionInfo `json:"websocket,omitempty"`
+	Kafka                *kafkaActionInfo     `json:"kafka,omitempty"`
 	Timestamps           bool                 `json:"timestamps,omitempty"` // Include block timestamps in the events generated
 	TimestampCacheSize   int                  `json:"timestampCacheSize,omitempty"`
+	Confirmations        uint64               `json:"confirmations,omitempty"` // Blocks on top of the block of an event, including it, before it is delivered
+	ReorgDepth           uint64               `json:"reorgDepth,omitempty"`    // Blocks behind the newest delivered event that are checked for re-orgs
+	MaintenanceWindows   []*MaintenanceWindow `json:"maintenanceWindows,omitempty"`
+	SignBatches          bool                 `json:"signBatches,omitempty"` // Sign each batch with the gateway key
+	Retry                *RetryPolicy         `json:"retry,omitempty"`
+	DeadLetter           *DeadLetterInfo      `json:"deadLetter,omitempty"`
+	Catchup              *CatchupPolicy       `json:"catchup,omitempty"`
 }
 
 type webhookActionInfo struct {
@@ -84,8 +98,10 @@ type webhookActionInfo struct {
 }
 
 type webSocketActionInfo struct {
-	Topic            string           `json:"topic,omitempty"`
-	DistributionMode DistributionMode `json:"distributionMode,omitempty"`
+	Topic              string           `json:"topic,omitempty"`
+	DistributionMode   DistributionMode `json:"distributionMode,omitempty"`
+	MaxInFlightBatches int              `json:"maxInFlightBatches,omitempty"` // Batches held in memory, before buffering to disk
+	MaxBatchesPerSec   float64          `json:"maxBatchesPerSec,omitempty"`   // Rate limit of batches sent to the consumers of the topic
 }
 
 type eventStream struct {
@@ -101,14 +117,22 @@ type eventStream struct {
 	batchCond           *sync.Cond
 	batchQueue          *list.List
 	batchCount          uint64
-	initialRetryDelay   time.Duration
-	backoffFactor       float64
+	spilledBatches      int
+	spillSequence       uint64
+	backoff             *webhook.Backoff
 	updateInProgress    bool
 	updateInterrupt     chan struct{}   // a zero-sized struct used only for signaling (hand rolled alternative to context)
 	updateWG            *sync.WaitGroup // Wait group for the go routines to reply back after they have stopped
 	blockTimestampCache *lru.Cache
 	action              eventStreamAction
 	wsChannels          ws.WebSocketChannels
+	windows             []*maintenanceWindow
+	windowStart         time.Time // start of the last maintenance window the scheduler acted on
+	deadLetterLock      sync.Mutex
+	deadLetters         deadLetterTarget
+	catchupLimiter      *quotas.Throttle
+	healthLock          sync.Mutex
+	lastDeliveryStatus  string
 }
 
 type eventStreamAction interface {
@@ -119,6 +143,12 @@ func validateWebSocket(w *webSocketActionInfo) error {
 	if w.DistributionMode != "" && w.DistributionMode != DistributionModeBroadcast && w.DistributionMode != DistributionModeWLD {
 		return errors.Errorf(errors.EventStreamsInvalidDistributionMode, w.DistributionMode)
 	}
+	if w.MaxInFlightBatches < 0 {
+		return errors.Errorf(errors.EventStreamsWebSocketInvalidMaxInFlight, w.MaxInFlightBatches)
+	}
+	if w.MaxBatchesPerSec < 0 {
+		return errors.Errorf(errors.EventStreamsWebSocketInvalidRateLimit, w.MaxBatchesPerSec)
+	}
 	return nil
 }
 
@@ -150,20 +180,38 @@ func newEventStream(sm subscriptionManager, spec *StreamInfo, wsChannels ws.WebS
 	if spec.TimestampCacheSize == 0 {
 		spec.TimestampCacheSize = DefaultTimestampCacheSize
 	}
+	windows, err := newMaintenanceWindows(spec.MaintenanceWindows)
+	if err != nil {
+		return nil, err
+	}
+	if spec.SignBatches && sm.batchSigner() == nil {
+		return nil, errors.Errorf(errors.EventStreamsBatchSigningNotConfigured)
+	}
+	if err := validateRetryPolicy(spec.Retry); err != nil {
+		return nil, err
+	}
+	if err := validateDeadLetter(sm.config(), spec.DeadLetter); err != nil {
+		return nil, err
+	}
+	if err := validateCatchupPolicy(spec.Catchup); err != nil {
+		return nil, err
+	}
 
 	a = &eventStream{
-		sm:                sm,
-		spec:              spec,
-		allowPrivateIPs:   sm.config().WebhooksAllowPrivateIPs,
-		eventStream:       make(chan *eventData),
-		batchCond:         sync.NewCond(&sync.Mutex{}),
-		batchQueue:        list.New(),
-		initialRetryDelay: DefaultExponentialBackoffInitial,
-		backoffFactor:     DefaultExponentialBackoffFactor,
-		pollingInterval:   time.Duration(sm.config().EventPollingIntervalSec) * time.Second,
-		wsChannels:        wsChannels,
+		sm:              sm,
+		spec:            spec,
+		allowPrivateIPs: sm.config().WebhooksAllowPrivateIPs,
+		eventStream:     make(chan *eventData),
+		batchCond:       sync.NewCond(&sync.Mutex{}),
+		batchQueue:      list.New(),
+		pollingInterval: time.Duration(sm.config().EventPollingIntervalSec) * time.Second,
+		wsChannels:      wsChannels,
+		windows:         windows,
 	}
 
+	a.applyRetryPolicy()
+	a.applyCatchupPolicy()
+
 	if a.blockTimestampCache, err = lru.New(spec.TimestampCacheSize); err != nil {
 		return nil, errors.Errorf(errors.EventStreamsCreateStreamResourceErr, err)
 	}
@@ -189,6 +237,10 @@ func newEventStream(sm subscriptionManager, spec *StreamInfo, wsChannels ws.WebS
 		if a.action, err = newWebSocketAction(a, spec.WebSocket); err != nil {
 			return nil, err
 		}
+	case "kafka":
+		if a.action, err = newKafkaAction(a, spec.Kafka); err != nil {
+			return nil, err
+		}
 	default:
 		return nil, errors.Errorf(errors.EventStreamsInvalidActionType, spec.Type)
 	}
@@ -239,6 +291,29 @@ func (a *eventStream) postUpdateStream() {
 // update modifies an existing eventStream
 func (a *eventStream) update(newSpec *StreamInfo) (spec *StreamInfo, err error) {
 	log.Infof("%s: Update event stream", a.spec.ID)
+	var windows []*maintenanceWindow
+	if newSpec.MaintenanceWindows != nil {
+		if windows, err = newMaintenanceWindows(newSpec.MaintenanceWindows); err != nil {
+			return nil, err
+		}
+	}
+	if newSpec.SignBatches && a.sm.batchSigner() == nil {
+		return nil, errors.Errorf(errors.EventStreamsBatchSigningNotConfigured)
+	}
+	if err = validateRetryPolicy(newSpec.Retry); err != nil {
+		return nil, err
+	}
+	if err = validateDeadLetter(a.sm.config(), newSpec.DeadLetter); err != nil {
+		return nil, err
+	}
+	if err = validateCatchupPolicy(newSpec.Catchup); err != nil {
+		return nil, err
+	}
+	if a.spec.Type == "kafka" && newSpec.Kafka != nil {
+		if err = validateKafka(a.sm.config(), newSpec.Kafka); err != nil {
+			return nil, err
+		}
+	}
 	// set a flag to indicate updateInProgress
 	// For any go routines that are Wait() ing on the eventListener, wake them up
 	a.preUpdateStream()
@@ -271,6 +346,14 @@ func (a *eventStream) update(newSpec *StreamInfo) (spec *StreamInfo, err error)
 			return nil, err
 		}
 		a.spec.WebSocket.DistributionMode = newSpec.WebSocket.DistributionMode
+		a.spec.WebSocket.MaxInFlightBatches = newSpec.WebSocket.MaxInFlightBatches
+		a.spec.WebSocket.MaxBatchesPerSec = newSpec.WebSocket.MaxBatchesPerSec
+	}
+	if a.spec.Type == "kafka" && newSpec.Kafka != nil {
+		a.spec.Kafka = newSpec.Kafka
+		if k, ok := a.action.(*kafkaAction); ok {
+			k.update(newSpec.Kafka)
+		}
 	}
 
 	if a.spec.BatchSize != newSpec.BatchSize && newSpec.BatchSize != 0 && newSpec.BatchSize < MaxBatchSize {
@@ -293,6 +376,33 @@ func (a *eventStream) update(newSpec *StreamInfo) (spec *StreamInfo, err error)
 	if a.spec.Timestamps != newSpec.Timestamps {
 		a.spec.Timestamps = newSpec.Timestamps
 	}
+	if a.spec.Confirmations != newSpec.Confirmations {
+		a.spec.Confirmations = newSpec.Confirmations
+	}
+	if a.spec.ReorgDepth != newSpec.ReorgDepth {
+		a.spec.ReorgDepth = newSpec.ReorgDepth
+	}
+	if a.spec.SignBatches != newSpec.SignBatches {
+		a.spec.SignBatches = newSpec.SignBatches
+	}
+	if newSpec.MaintenanceWindows != nil {
+		a.batchCond.L.Lock()
+		a.spec.MaintenanceWindows = newSpec.MaintenanceWindows
+		a.windows = windows
+		a.batchCond.L.Unlock()
+	}
+	if newSpec.Retry != nil {
+		a.spec.Retry = newSpec.Retry
+		a.applyRetryPolicy()
+	}
+	if newSpec.DeadLetter != nil {
+		a.spec.DeadLetter = newSpec.DeadLetter
+		a.closeDeadLetters()
+	}
+	if newSpec.Catchup != nil {
+		a.spec.Catchup = newSpec.Catchup
+		a.applyCatchupPolicy()
+	}
 	a.postUpdateStream()
 	return a.spec, nil
 }
@@ -311,16 +421,53 @@ func (a *eventStream) stop() {
 	close(a.eventStream)
 	a.batchCond.Broadcast()
 	a.batchCond.L.Unlock()
+	a.closeDeadLetters()
+	if c, ok := a.action.(closableAction); ok {
+		c.close()
+	}
 }
 
-// suspend only stops the dispatcher, pushing back as if we're in blocking mode
-func (a *eventStream) suspend() {
+// suspend only stops the dispatcher, pushing back as if we're in blocking mode.
+// The stream is resumed automatically at resumeAt, if it is non-nil
+func (a *eventStream) suspend(resumeAt *time.Time) {
 	a.batchCond.L.Lock()
 	a.spec.Suspended = true
+	a.spec.ResumeAt = resumeAt
 	a.batchCond.Broadcast()
 	a.batchCond.L.Unlock()
 }
 
+// activeMaintenanceWindow returns the start and end of the maintenance window covering
+// the supplied time. If windows overlap, the one that ends last is returned.
+func (a *eventStream) activeMaintenanceWindow(now time.Time) (start, end time.Time, active bool) {
+	for _, w := range a.windows {
+		if wStart, wActive := w.activeAt(now); wActive {
+			if wEnd := wStart.Add(w.duration); !active || wEnd.After(end) {
+				start, end, active = wStart, wEnd, true
+			}
+		}
+	}
+	return start, end, active
+}
+
+// scheduledAction decides under the lock of the stream whether the scheduler should suspend
+// it until the end of a maintenance window that has just started, or resume it as its
+// resumeAt time has passed
+func (a *eventStream) scheduledAction(now time.Time) (suspendUntil *time.Time, resume bool) {
+	a.batchCond.L.Lock()
+	defer a.batchCond.L.Unlock()
+	if start, end, active := a.activeMaintenanceWindow(now); active {
+		if !start.Equal(a.windowStart) {
+			a.windowStart = start
+			if !a.spec.Suspended {
+				return &end, false
+			}
+		}
+		return nil, false
+	}
+	return nil, a.spec.Suspended && a.spec.ResumeAt != nil && !now.Before(*a.spec.ResumeAt)
+}
+
 // resume resumes the dispatcher
 func (a *eventStream) resume() error {
 	a.batchCond.L.Lock()
@@ -329,6 +476,7 @@ func (a *eventStream) resume() error {
 		return errors.Errorf(errors.EventStreamsWebhookResumeActive, a.spec.Suspended)
 	}
 	a.spec.Suspended = false
+	a.spec.ResumeAt = nil
 	a.processorDone = false
 	a.pollerDone = false
 
@@ -337,6 +485,13 @@ func (a *eventStream) resume() error {
 	return nil
 }
 
+// isSuspendedAndIdle is true once a suspended stream has stopped polling for events
+func (a *eventStream) isSuspendedAndIdle() bool {
+	a.batchCond.L.Lock()
+	defer a.batchCond.L.Unlock()
+	return a.spec.Suspended && a.pollerDone
+}
+
 // isBlocked protect us from polling for more events when the stream is blocked.
 // Can happen regardless of whether the error handling is
 // block or skip. It's just with skip we eventually move onto new messages
@@ -367,7 +522,11 @@ func (a *eventStream) eventPoller() {
 
 	ctx := auth.NewSystemAuthContext()
 
-	defer func() { a.pollerDone = true }()
+	defer func() {
+		a.batchCond.L.Lock()
+		a.pollerDone = true
+		a.batchCond.L.Unlock()
+	}()
 	var checkpoint map[string]*big.Int
 	for !a.suspendOrStop() {
 		var err error
@@ -379,6 +538,7 @@ func (a *eventStream) eventPoller() {
 		}
 		// If we're not blocked, then grab some more events
 		subs := a.sm.subscriptionsForStream(a.spec.ID)
+		rewound := false
 		if err == nil && !a.isBlocked() {
 			for _, sub := range subs {
 				// We do the reset on the event processing thread, to avoid any concurrency issue.
@@ -388,7 +548,17 @@ func (a *eventStream) eventPoller() {
 					// Clear any checkpoint
 					delete(checkpoint, sub.info.ID)
 				}
+				// A rewind after the chain is reverted is also done on this thread
+				if sub.rewind(ctx, checkpoint) {
+					rewound = true
+				}
+				if sub.info.Suspended {
+					continue
+				}
 				if sub.filterStale && !sub.deleting {
+					// Any events held for aggregation or confirmations are read again from the checkpoint
+					sub.lp.resetAggregation()
+					sub.lp.resetPending()
 					blockHeight, exists := checkpoint[sub.info.ID]
 					if !exists || blockHeight.Cmp(big.NewInt(0)) <= 0 {
 						blockHeight, err = sub.setInitialBlockHeight(ctx)
@@ -402,21 +572,28 @@ func (a *eventStream) eventPoller() {
 				if err == nil {
 					err = sub.processNewEvents(ctx)
 				}
+				sub.lp.checkAggregation(sub.logName)
 				if err != nil {
 					log.Errorf("%s: subscription error: %s", a.spec.ID, err)
 					err = nil
 				}
+				a.checkDecodeErrors(ctx, sub)
 			}
 		}
 		// Record a new checkpoint if needed
 		if checkpoint != nil {
-			changed := false
+			changed := rewound
+			newCheckpoint := make(map[string]*big.Int, len(subs))
 			for _, sub := range subs {
-				i1 := checkpoint[sub.info.ID]
 				i2 := sub.blockHWM()
-
-				changed = changed || i1 == nil || i1.Cmp(&i2) != 0
-				checkpoint[sub.info.ID] = new(big.Int).Set(&i2)
+				newCheckpoint[sub.info.ID] = new(big.Int).Set(&i2)
+			}
+			// Subscriptions that share a checkpoint group are recorded at the block they have all reached
+			a.sm.alignCheckpointGroups(a.spec.ID, newCheckpoint)
+			for subID, i2 := range newCheckpoint {
+				i1 := checkpoint[subID]
+				changed = changed || i1 == nil || i1.Cmp(i2) != 0
+				checkpoint[subID] = i2
 			}
 			if changed {
 				if err = a.sm.storeCheckpoint(a.spec.ID, checkpoint); err != nil {
@@ -440,6 +617,27 @@ func (a *eventStream) eventPoller() {
 
 }
 
+// checkDecodeErrors suspends a subscription once the configured number of consecutive
+// events have failed to decode, so it does not fail on every poll until someone notices
+func (a *eventStream) checkDecodeErrors(ctx context.Context, sub *subscription) {
+	maxErrors := a.sm.config().Health.MaxDecodeErrors
+	if maxErrors <= 0 {
+		return
+	}
+	if count, lastErr := sub.getDecodeErrors(); count >= maxErrors {
+		log.Errorf("%s: Suspending subscription %s after %d consecutive events failed to decode. Last error: %s", a.spec.ID, sub.info.ID, count, lastErr)
+		opsevents.Publish(opsevents.SubscriptionSuspended, map[string]interface{}{
+			"subscription": sub.info.ID,
+			"stream":       a.spec.ID,
+			"decodeErrors": count,
+			"lastError":    lastErr,
+		})
+		if err := a.sm.suspendSubscription(ctx, sub); err != nil {
+			log.Errorf("%s: Failed to store suspended subscription %s: %s", a.spec.ID, sub.info.ID, err)
+		}
+	}
+}
+
 // batchDispatcher is the goroutine that is always available to read new
 // events and form them into batches. Because we can't be sure how many
 // events we'll be dispatched from blocks before the IsBlocked() feedback
@@ -498,7 +696,13 @@ func (a *eventStream) batchDispatcher() {
 			if !timeout {
 				a.inFlight++
 			}
-			a.batchQueue.PushBack(currentBatch)
+			// A slow WebSocket consumer can leave many batches queued, so beyond the limit
+			// of the stream they are buffered to disk rather than held in memory
+			var queued interface{} = currentBatch
+			if a.shouldSpill() {
+				queued = a.spillBatch(currentBatch)
+			}
+			a.batchQueue.PushBack(queued)
 			a.batchCond.Broadcast()
 			a.batchCond.L.Unlock()
 			currentBatch = []*eventData{}
@@ -511,20 +715,42 @@ func (a *eventStream) batchDispatcher() {
 	}
 }
 
+// suspendOrStop is true once the stream has been suspended or stopped
 func (a *eventStream) suspendOrStop() bool {
+	a.batchCond.L.Lock()
+	defer a.batchCond.L.Unlock()
+	return a.suspendedOrStopped()
+}
+
+// suspendedOrStopped is suspendOrStop, for callers that hold the lock of the stream
+func (a *eventStream) suspendedOrStopped() bool {
 	return a.spec.Suspended || a.stopped
 }
 
+// updateInterrupted is true once the handlers have been notified of an update to the stream
+func (a *eventStream) updateInterrupted() bool {
+	select {
+	case <-a.updateInterrupt:
+		return true
+	default:
+		return false
+	}
+}
+
 // batchProcessor picks up batches from the batchDispatcher, and performs the blocking
 // actions required to perform the action itself.
 // We use a sync.Cond rather than a channel to communicate with this goroutine, as
 // it might be blocked for very large periods of time
 func (a *eventStream) batchProcessor() {
-	defer func() { a.processorDone = true }()
+	defer func() {
+		a.batchCond.L.Lock()
+		a.processorDone = true
+		a.batchCond.L.Unlock()
+	}()
 	for {
 		// Wait for the next batch, or to be stopped
 		a.batchCond.L.Lock()
-		for !a.suspendOrStop() && a.batchQueue.Len() == 0 {
+		for !a.suspendedOrStopped() && a.batchQueue.Len() == 0 {
 			if a.updateInProgress {
 				<-a.updateInterrupt
 				// we were notified by the caller about an ongoing update, return
@@ -536,7 +762,7 @@ func (a *eventStream) batchProcessor() {
 				a.batchCond.Wait()
 			}
 		}
-		if a.suspendOrStop() {
+		if a.suspendedOrStopped() {
 			log.Infof("%s: Suspended, returning exiting batch processor", a.spec.ID)
 			a.batchCond.L.Unlock()
 			return
@@ -546,11 +772,23 @@ func (a *eventStream) batchProcessor() {
 		batchNumber := a.batchCount
 		a.batchQueue.Remove(batchElem)
 		a.batchCond.L.Unlock()
+		events, inMemory := batchElem.Value.([]*eventData)
+		if !inMemory {
+			spilled := batchElem.Value.(*spilledBatch)
+			var err error
+			if events, err = a.restoreBatch(spilled); err != nil {
+				log.Errorf("%s: Failed to load batch %d from disk, %d events will not be delivered: %s", a.spec.ID, batchNumber, len(spilled.callbacks), err)
+				a.batchCond.L.Lock()
+				a.inFlight -= uint64(len(spilled.callbacks))
+				a.batchCond.L.Unlock()
+				continue
+			}
+		}
 		// Process the batch - could block for a very long time, particularly if
 		// ErrorHandlingBlock is configured.
 		// Track this as an item in the update wait group
 		a.updateWG.Add(1)
-		a.processBatch(batchNumber, batchElem.Value.([]*eventData))
+		a.processBatch(batchNumber, events)
 	}
 }
 
@@ -577,7 +815,23 @@ func (a *eventStream) processBatch(batchNumber uint64, events []*eventData) {
 		attempt++
 		log.Infof("%s: Batch %d initiated with %d events. FirstBlock=%s LastBlock=%s", a.spec.ID, batchNumber, len(events), events[0].BlockNumber, events[len(events)-1].BlockNumber)
 		a.updateWG.Add(1)
-		err := a.performActionWithRetry(batchNumber, events)
+		started := time.Now()
+		attempts, err := a.performActionWithRetry(batchNumber, events)
+		if attempts > 0 {
+			rec := a.newDeliveryRecord(batchNumber, events, attempts, started, err)
+			// A batch that could not be delivered is sent to the dead letter destination of the
+			// stream if it has one, rather than blocking the stream or being skipped
+			if err != nil && a.spec.DeadLetter != nil && !a.suspendOrStop() && !a.updateInterrupted() {
+				if dlErr := a.deadLetter(batchNumber, events, attempts, err); dlErr != nil {
+					log.Errorf("%s: Failed to send batch %d to the dead letter destination: %s", a.spec.ID, batchNumber, dlErr)
+				} else {
+					rec.Status = DeliveryStatusDeadLettered
+					err = nil
+				}
+			}
+			a.setLastDeliveryStatus(rec.Status)
+			a.sm.recordDelivery(rec)
+		}
 		// If we got an error after all of the internal retries within the event
 		// handler failed, then the ErrorHandling strategy kicks in
 		processed = (err == nil)
@@ -613,42 +867,29 @@ func (a *eventStream) processBatch(batchNumber uint64, events []*eventData) {
 }
 
 // performActionWithRetry performs an action, with exponential backoff retry up
-// to a given threshold
-func (a *eventStream) performActionWithRetry(batchNumber uint64, events []*eventData) (err error) {
-	startTime := time.Now()
-	endTime := startTime.Add(time.Duration(a.spec.RetryTimeoutSec) * time.Second)
-	delay := a.initialRetryDelay
-	var attempt uint64
-	complete := false
+// to a given threshold, and returns the number of attempts made
+func (a *eventStream) performActionWithRetry(batchNumber uint64, events []*eventData) (attempt uint64, err error) {
 	defer a.updateWG.Done()
-
-	for !a.suspendOrStop() && !complete {
-		if attempt > 0 {
-			log.Infof("%s: Waiting %.2fs before re-attempting batch %d", a.spec.ID, delay.Seconds(), batchNumber)
-			select {
-			case <-a.updateInterrupt:
-				// we were notified by the caller about an ongoing update, no need to continue
-				log.Infof("%s: Notified of an ongoing stream update, terminating perform action for batch number: %d", a.spec.ID, batchNumber)
-				return
-			case <-time.After(delay): //fall through and continue
-			}
-			delay = time.Duration(float64(delay) * a.backoffFactor)
-		}
-		attempt++
-		err = a.action.attemptBatch(batchNumber, attempt, events)
-		complete = err == nil || time.Until(endTime) < 0
-	}
-	return err
+	// The wait for a retry is interrupted by an update of the stream, and no further attempts are
+	// made once the stream is suspended or stopped
+	name := fmt.Sprintf("%s batch %d", a.spec.ID, batchNumber)
+	return a.backoff.Retry(name, time.Duration(a.spec.RetryTimeoutSec)*time.Second, a.updateInterrupt, a.suspendOrStop, func(attempt uint64) error {
+		return a.action.attemptBatch(batchNumber, attempt, events)
+	})
 }
 
 // isAddressSafe checks for local IPs
 func (a *eventStream) isAddressUnsafe(ip *net.IPAddr) bool {
+	return !a.allowPrivateIPs && isPrivateAddress(ip)
+}
+
+// isPrivateAddress is true for private, loopback and multicast IPv4 addresses
+func isPrivateAddress(ip *net.IPAddr) bool {
 	ip4 := ip.IP.To4()
-	return !a.allowPrivateIPs &&
-		(ip4[0] == 0 ||
-			ip4[0] >= 224 ||
-			ip4[0] == 127 ||
-			ip4[0] == 10 ||
-			(ip4[0] == 172 && ip4[1] >= 16 && ip4[1] < 32) ||
-			(ip4[0] == 192 && ip4[1] == 168))
+	return ip4[0] == 0 ||
+		ip4[0] >= 224 ||
+		ip4[0] == 127 ||
+		ip4[0] == 10 ||
+		(ip4[0] == 172 && ip4[1] >= 16 && ip4[1] < 32) ||
+		(ip4[0] == 192 && ip4[1] == 168)
 }
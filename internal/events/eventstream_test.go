@@ -31,6 +31,7 @@ import (
 	"github.com/kaleido-io/ethconnect/internal/eth"
 	"github.com/kaleido-io/ethconnect/internal/ethbind"
 	"github.com/kaleido-io/ethconnect/internal/kvstore"
+	"github.com/kaleido-io/ethconnect/internal/tracing"
 	log "github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/assert"
 )
@@ -293,8 +294,8 @@ func TestBackoffRetry(t *testing.T) {
 	defer close(eventStream)
 	defer svr.Close()
 	defer stream.stop()
-	stream.initialRetryDelay = 1 * time.Millisecond
-	stream.backoffFactor = 1.1
+	stream.backoff.InitialDelay = 1 * time.Millisecond
+	stream.backoff.Factor = 1.1
 
 	complete := false
 	thrown := false
@@ -480,7 +481,7 @@ func setupTestSubscription(assert *assert.Assertions, sm *subscriptionMGR, strea
 	}
 	addr := ethbind.API.HexToAddress("0x167f57a13a9c35ff92f0649d2be0e52b4f8ac3ca")
 	ctx := context.Background()
-	s, _ := sm.AddSubscription(ctx, &addr, event, stream.spec.ID, "", subscriptionName)
+	s, _ := sm.AddSubscription(ctx, &addr, event, stream.spec.ID, "", subscriptionName, nil)
 	return s
 }
 
@@ -557,7 +558,7 @@ func setupCatchupTestSubscription(assert *assert.Assertions, sm *subscriptionMGR
 	}
 	addr := ethbind.API.HexToAddress("0x167f57a13a9c35ff92f0649d2be0e52b4f8ac3ca")
 	ctx := context.Background()
-	s, _ := sm.AddSubscription(ctx, &addr, event, stream.spec.ID, "0", subscriptionName)
+	s, _ := sm.AddSubscription(ctx, &addr, event, stream.spec.ID, "0", subscriptionName, nil)
 	return s
 }
 
@@ -610,6 +611,31 @@ func TestProcessEventsEnd2EndWebhook(t *testing.T) {
 	sm.Close()
 }
 
+func TestWebhookBatchTraced(t *testing.T) {
+	assert := assert.New(t)
+	assert.NoError(tracing.Configure(&tracing.Conf{Enabled: true, Endpoint: "http://localhost:4318/v1/traces"}))
+	defer tracing.Configure(nil)
+
+	var traceParent string
+	svr := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		traceParent = req.Header.Get("traceparent")
+		res.WriteHeader(200)
+	}))
+	defer svr.Close()
+
+	sm := newTestSubscriptionManager()
+	spec, err := sm.AddStream(context.Background(), &StreamInfo{
+		Type:    "webhook",
+		Webhook: &webhookActionInfo{URL: svr.URL},
+	})
+	assert.NoError(err)
+	defer sm.Close()
+
+	err = sm.streams[spec.ID].action.attemptBatch(1, 1, []*eventData{testEvent("sub1")})
+	assert.NoError(err)
+	assert.Regexp("^00-[0-9a-f]{32}-[0-9a-f]{16}-01$", traceParent)
+}
+
 func TestProcessEventsEnd2EndCatchupWebhook(t *testing.T) {
 	assert := assert.New(t)
 	dir := tempdir(t)
@@ -932,7 +958,7 @@ func TestCheckpointRecovery(t *testing.T) {
 			}
 		}
 	}
-	stream.suspend()
+	stream.suspend(nil)
 	for !stream.pollerDone {
 		time.Sleep(1 * time.Millisecond)
 	}
@@ -963,6 +989,152 @@ func TestCheckpointRecovery(t *testing.T) {
 
 }
 
+func TestSubscriptionCheckpointInspectAndSet(t *testing.T) {
+	assert := assert.New(t)
+	sm, stream, svr, eventStream := newTestStreamForBatching(
+		&StreamInfo{
+			ErrorHandling: ErrorHandlingBlock,
+			Webhook:       &webhookActionInfo{},
+		}, nil, 200)
+	defer close(eventStream)
+	defer svr.Close()
+	defer stream.stop()
+
+	wg := &sync.WaitGroup{}
+	wg.Add(1)
+	go func() {
+		for i := 0; i < 3; i++ {
+			<-eventStream
+		}
+		wg.Done()
+	}()
+
+	s := setupTestSubscription(assert, sm, stream, "myTestSub")
+	sm.rpc = eth.NewMockRPCClientForSync(nil, func(method string, res interface{}, args ...interface{}) {
+		if method == "eth_blockNumber" {
+			res.(*ethbinding.HexBigInt).ToInt().SetInt64(150730)
+		}
+	})
+	ctx := context.Background()
+
+	for {
+		time.Sleep(1 * time.Millisecond)
+		cp, err := sm.loadCheckpoint(stream.spec.ID)
+		if err == nil {
+			v := cp[s.ID]
+			if v != nil && big.NewInt(150722).Cmp(v) == 0 {
+				break
+			}
+		}
+	}
+	wg.Wait()
+
+	checkpoint, err := sm.SubscriptionCheckpoint(ctx, s.ID)
+	assert.NoError(err)
+	assert.Equal(s.ID, checkpoint.ID)
+	assert.Equal(stream.spec.ID, checkpoint.Stream)
+	assert.False(checkpoint.Suspended)
+	assert.Equal("150722", checkpoint.Block)
+	assert.Equal("150730", checkpoint.ChainHead)
+	assert.Equal(int64(9), checkpoint.Lag)
+	assert.Equal("150721", checkpoint.LastDelivered.BlockNumber)
+	assert.False(checkpoint.LastDelivered.Time.IsZero())
+
+	_, err = sm.SetSubscriptionCheckpoint(ctx, s.ID, "150000")
+	assert.EqualError(err, fmt.Sprintf("Stream '%s' must be suspended before setting the checkpoint", stream.spec.ID))
+
+	stream.suspend(nil)
+	for !stream.isSuspendedAndIdle() {
+		time.Sleep(1 * time.Millisecond)
+	}
+
+	_, err = sm.SetSubscriptionCheckpoint(ctx, s.ID, "0")
+	assert.EqualError(err, "Checkpoint block '0' must be a positive integer")
+	_, err = sm.SetSubscriptionCheckpoint(ctx, "nope", "150000")
+	assert.EqualError(err, "Subscription with ID 'nope' not found")
+
+	checkpoint, err = sm.SetSubscriptionCheckpoint(ctx, s.ID, "150000")
+	assert.NoError(err)
+	assert.True(checkpoint.Suspended)
+	assert.Equal("150000", checkpoint.Block)
+	assert.Equal(int64(731), checkpoint.Lag)
+	cp, err := sm.loadCheckpoint(stream.spec.ID)
+	assert.NoError(err)
+	assert.Equal(int64(150000), cp[s.ID].Int64())
+
+	// On resume, the filter restarts from the new checkpoint
+	var newFilterBlock uint64
+	sub := sm.subscriptions[s.ID]
+	sub.rpc = eth.NewMockRPCClientForSync(nil, func(method string, res interface{}, args ...interface{}) {
+		if method == "eth_blockNumber" {
+			res.(*ethbinding.HexBigInt).ToInt().SetInt64(150000)
+		} else if method == "eth_newFilter" {
+			newFilterBlock = args[0].(*ethFilter).FromBlock.ToInt().Uint64()
+		} else if method == "eth_getFilterLogs" || method == "eth_getFilterChanges" {
+			*(res.(*[]*logEntry)) = []*logEntry{}
+		}
+	})
+	stream.resume()
+	for uint64(150000) != newFilterBlock {
+		time.Sleep(1 * time.Millisecond)
+	}
+}
+
+func TestSubscriptionCheckpointChainHeadError(t *testing.T) {
+	assert := assert.New(t)
+	sm, stream, svr, eventStream := newTestStreamForBatching(
+		&StreamInfo{
+			Webhook: &webhookActionInfo{},
+		}, nil, 200)
+	defer close(eventStream)
+	defer svr.Close()
+	defer stream.stop()
+	stream.suspend(nil)
+
+	s := setupTestSubscription(assert, sm, stream, "myTestSub")
+	sm.rpc = eth.NewMockRPCClientForSync(fmt.Errorf("pop"), nil)
+	ctx := context.Background()
+
+	checkpoint, err := sm.SubscriptionCheckpoint(ctx, s.ID)
+	assert.NoError(err)
+	assert.Empty(checkpoint.Block)
+	assert.Empty(checkpoint.ChainHead)
+	assert.Regexp("pop", checkpoint.ChainHeadError)
+	assert.Nil(checkpoint.LastDelivered)
+
+	_, err = sm.SubscriptionCheckpoint(ctx, "nope")
+	assert.EqualError(err, "Subscription with ID 'nope' not found")
+}
+
+func TestSubscriptionCheckpointStoreFailures(t *testing.T) {
+	assert := assert.New(t)
+	db := kvstore.NewMockKV(nil)
+	sm, stream, svr, eventStream := newTestStreamForBatching(
+		&StreamInfo{
+			Webhook: &webhookActionInfo{},
+		}, db, 200)
+	defer close(eventStream)
+	defer svr.Close()
+	defer stream.stop()
+	stream.suspend(nil)
+	for !stream.isSuspendedAndIdle() {
+		time.Sleep(1 * time.Millisecond)
+	}
+
+	s := setupTestSubscription(assert, sm, stream, "myTestSub")
+	ctx := context.Background()
+
+	db.StoreErr = fmt.Errorf("pop")
+	_, err := sm.SetSubscriptionCheckpoint(ctx, s.ID, "1")
+	assert.EqualError(err, "Failed to store checkpoint: pop")
+
+	db.LoadErr = fmt.Errorf("pop")
+	_, err = sm.SetSubscriptionCheckpoint(ctx, s.ID, "1")
+	assert.EqualError(err, "pop")
+	_, err = sm.SubscriptionCheckpoint(ctx, s.ID)
+	assert.EqualError(err, "pop")
+}
+
 func TestWithoutCheckpointRecovery(t *testing.T) {
 	assert := assert.New(t)
 	sm, stream, svr, eventStream := newTestStreamForBatching(
@@ -974,7 +1146,7 @@ func TestWithoutCheckpointRecovery(t *testing.T) {
 	defer svr.Close()
 	defer stream.stop()
 
-	stream.suspend()
+	stream.suspend(nil)
 	for !stream.pollerDone {
 		time.Sleep(1 * time.Millisecond)
 	}
@@ -1017,7 +1189,7 @@ func TestMarkStaleOnError(t *testing.T) {
 	defer svr.Close()
 	defer stream.stop()
 
-	stream.suspend()
+	stream.suspend(nil)
 	for !stream.pollerDone {
 		time.Sleep(1 * time.Millisecond)
 	}
@@ -1050,7 +1222,7 @@ func TestStoreCheckpointLoadError(t *testing.T) {
 	defer svr.Close()
 	defer stream.stop()
 
-	stream.suspend()
+	stream.suspend(nil)
 	for !stream.pollerDone {
 		time.Sleep(1 * time.Millisecond)
 	}
@@ -1084,7 +1256,7 @@ func TestStoreCheckpointStoreError(t *testing.T) {
 	setupTestSubscription(assert, sm, stream, "")
 	wg.Wait()
 
-	stream.suspend()
+	stream.suspend(nil)
 	for !stream.pollerDone {
 		time.Sleep(1 * time.Millisecond)
 	}
@@ -1241,11 +1413,15 @@ func TestUpdateWebSocket(t *testing.T) {
 	ctx := context.Background()
 	updateSpec := &StreamInfo{
 		WebSocket: &webSocketActionInfo{
-			Topic: "test2",
+			Topic:              "test2",
+			MaxInFlightBatches: 10,
+			MaxBatchesPerSec:   2.5,
 		},
 	}
 	updatedStream, err := sm.UpdateStream(ctx, stream.spec.ID, updateSpec)
 	assert.Equal("test2", updatedStream.WebSocket.Topic)
+	assert.Equal(10, updatedStream.WebSocket.MaxInFlightBatches)
+	assert.Equal(2.5, updatedStream.WebSocket.MaxBatchesPerSec)
 	assert.Equal("websocket-stream", updatedStream.Name)
 	assert.NoError(err)
 }
@@ -0,0 +1,276 @@
+// Copyright 2021 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package events
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"math/big"
+	"net/http"
+	"strconv"
+	"strings"
+
+	ethbinding "github.com/kaleido-io/ethbinding/pkg"
+	"github.com/kaleido-io/ethconnect/internal/errors"
+	"github.com/kaleido-io/ethconnect/internal/eth"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// ExportFormatNDJSON exports each event as a line of JSON
+	ExportFormatNDJSON = "ndjson"
+	// ExportFormatCSV exports each event as a row of CSV, with the decoded data as a JSON column
+	ExportFormatCSV = "csv"
+
+	// DefaultExportPageSize is the number of blocks read with each eth_getLogs call of an export
+	DefaultExportPageSize = 1000
+	// MaxExportPageSize bounds the blocks read in one call, as nodes limit the logs returned
+	MaxExportPageSize = 10000
+)
+
+var exportCSVColumns = []string{"address", "blockNumber", "transactionIndex", "transactionHash", "logIndex", "signature", "data"}
+
+// EventExport is a one-off export of the historical events emitted by a contract in a range of
+// blocks. The toBlock is the head of the chain if it is not specified
+type EventExport struct {
+	Address   ethbinding.Address
+	Events    []*ethbinding.ABIEvent
+	FromBlock string
+	ToBlock   string
+	PageSize  int64
+}
+
+// EventExportWriter writes the decoded events of an export in a streaming format
+type EventExportWriter interface {
+	ContentType() string
+	// Started returns true once any output has been written, after which an error can
+	// only be reported in the stream itself
+	Started() bool
+	writeEvent(event *eventData) error
+	writeError(err error)
+	flush() error
+}
+
+// NewEventExportWriter returns a writer for the format, which is ndjson if not specified
+func NewEventExportWriter(format string, w io.Writer) (EventExportWriter, error) {
+	switch strings.ToLower(format) {
+	case "", ExportFormatNDJSON:
+		return &ndjsonExportWriter{exportOutput: exportOutput{w: w}}, nil
+	case ExportFormatCSV:
+		return &csvExportWriter{exportOutput: exportOutput{w: w}, csv: csv.NewWriter(w)}, nil
+	default:
+		return nil, errors.Errorf(errors.ExportInvalidFormat, format)
+	}
+}
+
+type exportOutput struct {
+	w       io.Writer
+	started bool
+}
+
+func (o *exportOutput) Started() bool {
+	return o.started
+}
+
+// flushOutput pushes what has been written to the client, if the output is an HTTP response.
+// Writes block while the client is slow to read, so the next page is not read from the node
+// until the client has consumed the previous one
+func (o *exportOutput) flushOutput() {
+	if flusher, ok := o.w.(http.Flusher); ok && o.started {
+		flusher.Flush()
+	}
+}
+
+type ndjsonExportWriter struct {
+	exportOutput
+}
+
+func (n *ndjsonExportWriter) ContentType() string {
+	return "application/x-ndjson"
+}
+
+func (n *ndjsonExportWriter) writeLine(v interface{}) error {
+	n.started = true
+	b, _ := json.Marshal(v)
+	_, err := n.w.Write(append(b, '\n'))
+	return err
+}
+
+func (n *ndjsonExportWriter) writeEvent(event *eventData) error {
+	return n.writeLine(event)
+}
+
+func (n *ndjsonExportWriter) writeError(err error) {
+	n.writeLine(map[string]string{"error": err.Error()})
+	n.flushOutput()
+}
+
+func (n *ndjsonExportWriter) flush() error {
+	n.flushOutput()
+	return nil
+}
+
+type csvExportWriter struct {
+	exportOutput
+	csv *csv.Writer
+}
+
+func (c *csvExportWriter) ContentType() string {
+	return "text/csv"
+}
+
+func (c *csvExportWriter) writeHeader() {
+	if !c.started {
+		c.started = true
+		c.csv.Write(exportCSVColumns)
+	}
+}
+
+func (c *csvExportWriter) writeEvent(event *eventData) error {
+	c.writeHeader()
+	data, _ := json.Marshal(event.Data)
+	return c.csv.Write([]string{
+		event.Address,
+		event.BlockNumber,
+		event.TransactionIndex,
+		event.TransactionHash,
+		event.LogIndex,
+		event.Signature,
+		string(data),
+	})
+}
+
+func (c *csvExportWriter) writeError(err error) {
+	c.writeHeader()
+	c.csv.Write([]string{"error", err.Error()})
+	c.flush()
+}
+
+func (c *csvExportWriter) flush() error {
+	c.writeHeader()
+	c.csv.Flush()
+	c.flushOutput()
+	return c.csv.Error()
+}
+
+// ResolveRange validates the block range of the export, resolving an unspecified toBlock to the
+// head of the chain. The range is stored as decimal block numbers
+func (spec *EventExport) ResolveRange(ctx context.Context, rpc eth.RPCClient) error {
+	from := big.NewInt(0)
+	if spec.FromBlock != "" {
+		if _, ok := from.SetString(spec.FromBlock, 0); !ok || from.Sign() < 0 {
+			return errors.Errorf(errors.ExportBadBlock, "fromBlock", spec.FromBlock)
+		}
+	}
+	to := new(big.Int)
+	if spec.ToBlock == "" || spec.ToBlock == FromBlockLatest {
+		blockNumber := ethbinding.HexBigInt{}
+		if err := rpc.CallContext(ctx, &blockNumber, "eth_blockNumber"); err != nil {
+			return errors.Errorf(errors.RPCCallReturnedError, "eth_blockNumber", err)
+		}
+		to.Set(blockNumber.ToInt())
+	} else if _, ok := to.SetString(spec.ToBlock, 0); !ok {
+		return errors.Errorf(errors.ExportBadBlock, "toBlock", spec.ToBlock)
+	}
+	if from.Cmp(to) > 0 {
+		return errors.Errorf(errors.ExportBadRange, from, to)
+	}
+	spec.FromBlock = from.String()
+	spec.ToBlock = to.String()
+	return nil
+}
+
+// ExportEvents reads the events of a contract a page of blocks at a time, and writes each
+// decoded event to the writer - flushing after each page. The range must have been resolved
+// with ResolveRange. An error after the export has started is written as the last record,
+// and returned. The export stops if the context is cancelled, such as by the client disconnecting
+func ExportEvents(ctx context.Context, rpc eth.RPCClient, spec *EventExport, w EventExportWriter) (uint64, error) {
+	from, _ := new(big.Int).SetString(spec.FromBlock, 10)
+	to, _ := new(big.Int).SetString(spec.ToBlock, 10)
+	if from == nil || to == nil {
+		return 0, errors.Errorf(errors.ExportBadRange, spec.FromBlock, spec.ToBlock)
+	}
+	pageSize := spec.PageSize
+	if pageSize <= 0 {
+		pageSize = DefaultExportPageSize
+	} else if pageSize > MaxExportPageSize {
+		pageSize = MaxExportPageSize
+	}
+	eventsByID := make(map[ethbinding.Hash]*ethbinding.ABIEvent)
+	topics := make([]ethbinding.Hash, 0, len(spec.Events))
+	for _, event := range spec.Events {
+		eventsByID[event.ID] = event
+		topics = append(topics, event.ID)
+	}
+	log.Infof("Exporting %d event types from %s, blocks %s -> %s", len(topics), spec.Address.String(), from, to)
+
+	var exported uint64
+	next := new(big.Int).Set(from)
+	for next.Cmp(to) <= 0 {
+		end := new(big.Int).Add(next, big.NewInt(pageSize-1))
+		if end.Cmp(to) > 0 {
+			end.Set(to)
+		}
+		f := &ethFilter{}
+		f.Addresses = []ethbinding.Address{spec.Address}
+		f.Topics = [][]ethbinding.Hash{topics}
+		f.FromBlock.ToInt().Set(next)
+		f.ToBlock = "0x" + end.Text(16)
+		var logs []*logEntry
+		if err := rpc.CallContext(ctx, &logs, "eth_getLogs", f); err != nil {
+			err = errors.Errorf(errors.RPCCallReturnedError, "eth_getLogs", err)
+			return exported, exportFailed(ctx, w, err)
+		}
+		for idx, entry := range logs {
+			if len(entry.Topics) == 0 || entry.Topics[0] == nil || eventsByID[*entry.Topics[0]] == nil {
+				continue
+			}
+			event, err := decodeLogEntry(spec.Address.String(), "", eventsByID[*entry.Topics[0]], entry, idx, false)
+			if err != nil {
+				log.Errorf("Failed to export event: %s", err)
+				continue
+			}
+			// The position of the log in the block identifies it, rather than its position in the page
+			var logIndex ethbinding.HexUint
+			if json.Unmarshal(entry.LogIndex, &logIndex) == nil {
+				event.LogIndex = strconv.FormatUint(uint64(logIndex), 10)
+			}
+			if err := w.writeEvent(event); err != nil {
+				return exported, err
+			}
+			exported++
+		}
+		if err := w.flush(); err != nil {
+			return exported, err
+		}
+		if ctx.Err() != nil {
+			return exported, ctx.Err()
+		}
+		next = end.Add(end, big.NewInt(1))
+	}
+	log.Infof("Exported %d events from %s", exported, spec.Address.String())
+	return exported, nil
+}
+
+// exportFailed writes the error into the stream, if the export has started
+func exportFailed(ctx context.Context, w EventExportWriter, err error) error {
+	log.Errorf("Event export failed: %s", err)
+	if w.Started() && ctx.Err() == nil {
+		w.writeError(err)
+	}
+	return err
+}
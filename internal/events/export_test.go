@@ -0,0 +1,154 @@
+// Copyright 2021 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package events
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	ethbinding "github.com/kaleido-io/ethbinding/pkg"
+	"github.com/kaleido-io/ethconnect/internal/eth"
+	"github.com/kaleido-io/ethconnect/internal/ethbind"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestEventExport(t *testing.T, fromBlock, toBlock string) *EventExport {
+	event, err := ethbind.API.ABIElementMarshalingToABIEvent(testBackfillEvent())
+	assert.NoError(t, err)
+	return &EventExport{
+		Address:   ethbind.API.HexToAddress("0x14c2d07516b7678597068f81d91b3124471703e8"),
+		Events:    []*ethbinding.ABIEvent{event},
+		FromBlock: fromBlock,
+		ToBlock:   toBlock,
+	}
+}
+
+func TestExportEventsNDJSON(t *testing.T) {
+	assert := assert.New(t)
+	sm, filters := newTestBackfillManager(t)
+	spec := newTestEventExport(t, "0", "")
+	spec.PageSize = 400
+
+	assert.NoError(spec.ResolveRange(context.Background(), sm.rpc))
+	assert.Equal("999", spec.ToBlock)
+	res := httptest.NewRecorder()
+	w, err := NewEventExportWriter("", res)
+	assert.NoError(err)
+	assert.Equal("application/x-ndjson", w.ContentType())
+	count, err := ExportEvents(context.Background(), sm.rpc, spec, w)
+	assert.NoError(err)
+	assert.Equal(uint64(3), count)
+	assert.True(res.Flushed)
+
+	// Three pages of blocks are read, and each of the logs is a line
+	assert.Len(*filters, 3)
+	lastFilter := (*filters)[2][0].(*ethFilter)
+	assert.Equal(int64(800), lastFilter.FromBlock.ToInt().Int64())
+	assert.Equal("0x3e7", lastFilter.ToBlock)
+	lines := strings.Split(strings.TrimSpace(res.Body.String()), "\n")
+	assert.Len(lines, 3)
+	var event map[string]interface{}
+	assert.NoError(json.Unmarshal([]byte(lines[1]), &event))
+	assert.Equal("Changed(address,int64,string,bytes32,string)", event["signature"])
+	assert.Equal("150665", event["blockNumber"])
+	assert.Equal("1977", event["data"].(map[string]interface{})["i"])
+}
+
+func TestExportEventsCSV(t *testing.T) {
+	assert := assert.New(t)
+	sm, _ := newTestBackfillManager(t)
+	spec := newTestEventExport(t, "0x0", "0x10")
+
+	assert.NoError(spec.ResolveRange(context.Background(), sm.rpc))
+	var buf bytes.Buffer
+	w, err := NewEventExportWriter("CSV", &buf)
+	assert.NoError(err)
+	assert.Equal("text/csv", w.ContentType())
+	count, err := ExportEvents(context.Background(), sm.rpc, spec, w)
+	assert.NoError(err)
+	assert.Equal(uint64(3), count)
+
+	records, err := csv.NewReader(&buf).ReadAll()
+	assert.NoError(err)
+	assert.Len(records, 4)
+	assert.Equal(exportCSVColumns, records[0])
+	assert.Equal("0x14c2D07516b7678597068F81d91b3124471703E8", records[1][0])
+	assert.Equal("0", records[1][4])
+	var data map[string]interface{}
+	assert.NoError(json.Unmarshal([]byte(records[1][6]), &data))
+	assert.Equal("42", data["i"])
+}
+
+// pageFailingRPC returns no logs for the first pages read, then fails
+type pageFailingRPC struct {
+	okPages int
+}
+
+func (p *pageFailingRPC) CallContext(ctx context.Context, result interface{}, method string, args ...interface{}) error {
+	if p.okPages <= 0 {
+		return fmt.Errorf("pop")
+	}
+	p.okPages--
+	return nil
+}
+
+func TestExportEventsFailure(t *testing.T) {
+	assert := assert.New(t)
+	spec := newTestEventExport(t, "0", "2500")
+	assert.NoError(spec.ResolveRange(context.Background(), &pageFailingRPC{}))
+
+	// Failure before anything is written is returned, for the caller to report
+	var buf bytes.Buffer
+	w, _ := NewEventExportWriter(ExportFormatNDJSON, &buf)
+	_, err := ExportEvents(context.Background(), &pageFailingRPC{}, spec, w)
+	assert.Regexp("pop", err)
+	assert.False(w.Started())
+	assert.Empty(buf.String())
+
+	// Failure part way through is written into the stream
+	w, _ = NewEventExportWriter(ExportFormatCSV, &buf)
+	_, err = ExportEvents(context.Background(), &pageFailingRPC{okPages: 1}, spec, w)
+	assert.Regexp("pop", err)
+	assert.True(w.Started())
+	assert.Regexp("error,.*pop", buf.String())
+
+	// A cancelled export stops after the page it is reading
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = ExportEvents(ctx, &pageFailingRPC{okPages: 5}, spec, w)
+	assert.Equal(context.Canceled, err)
+
+	_, err = NewEventExportWriter("parquet", &buf)
+	assert.EqualError(err, "Unknown export format 'parquet'. Valid formats are: 'ndjson' and 'csv'")
+}
+
+func TestExportEventsResolveRange(t *testing.T) {
+	assert := assert.New(t)
+	rpc := eth.NewMockRPCClientForSync(fmt.Errorf("pop"), nil)
+
+	assert.Regexp("Export fromBlock 'abc' must be a block number", newTestEventExport(t, "abc", "").ResolveRange(context.Background(), rpc))
+	assert.Regexp("Export toBlock 'abc' must be a block number", newTestEventExport(t, "", "abc").ResolveRange(context.Background(), rpc))
+	assert.Regexp("Export fromBlock 10 is after toBlock 5", newTestEventExport(t, "10", "5").ResolveRange(context.Background(), rpc))
+	assert.Regexp("pop", newTestEventExport(t, "", "latest").ResolveRange(context.Background(), rpc))
+
+	_, err := ExportEvents(context.Background(), rpc, newTestEventExport(t, "", ""), nil)
+	assert.Regexp("Export fromBlock", err)
+}
@@ -0,0 +1,269 @@
+// Copyright 2021 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package events
+
+import (
+	"context"
+	"encoding/json"
+	"net/url"
+	"strings"
+	"time"
+
+	ethbinding "github.com/kaleido-io/ethbinding/pkg"
+	"github.com/kaleido-io/ethconnect/internal/auth"
+	"github.com/kaleido-io/ethconnect/internal/errors"
+	"github.com/kaleido-io/ethconnect/internal/messages"
+	"github.com/kaleido-io/ethconnect/internal/utils"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// InvalidationPathPrefix is the path prefix for cache invalidation hooks
+	InvalidationPathPrefix = "/invalidations"
+	invalidationIDPrefix   = "ih-"
+
+	defaultInvalidationWorkers    = 10
+	defaultInvalidationQueueSize  = 1000
+	defaultInvalidationTimeoutSec = 5
+)
+
+// InvalidationConf configures the delivery of cache invalidation pings. Pings are queued
+// as events are read, and posted by a pool of workers. When the queue is full, pings are
+// dropped rather than delaying the delivery of events to the streams
+type InvalidationConf struct {
+	Workers   int `json:"workers,omitempty"`
+	QueueSize int `json:"queueSize,omitempty"`
+}
+
+// InvalidationHookInfo is the persisted definition of a cache invalidation hook, which pings
+// a webhook for each event emitted by a set of contracts. The events of interest can be
+// restricted by name
+type InvalidationHookInfo struct {
+	messages.TimeSorted
+	ID        string               `json:"id"`
+	Name      string               `json:"name,omitempty"`
+	Path      string               `json:"path"`
+	Tenant    string               `json:"tenant,omitempty"`
+	Addresses []ethbinding.Address `json:"addresses"`
+	Events    []string             `json:"events,omitempty"`
+	Webhook   *webhookActionInfo   `json:"webhook"`
+}
+
+// CacheInvalidation is the body of a ping. It carries no event data, only enough
+// to decide which cached reads are stale
+type CacheInvalidation struct {
+	Address     string `json:"address"`
+	Event       string `json:"event"`
+	BlockNumber string `json:"blockNumber"`
+}
+
+// GetID returns the ID (for sorting)
+func (info *InvalidationHookInfo) GetID() string {
+	return info.ID
+}
+
+// invalidationHook is the runtime of a hook, with its addresses and events indexed
+// for matching each event read by the subscriptions
+type invalidationHook struct {
+	info      *InvalidationHookInfo
+	addresses map[string]bool
+	events    map[string]bool
+	target    *webhookBackfillTarget
+}
+
+type invalidationPing struct {
+	hook    *invalidationHook
+	payload *CacheInvalidation
+}
+
+func (s *subscriptionMGR) newInvalidationHook(info *InvalidationHookInfo) *invalidationHook {
+	hook := &invalidationHook{
+		info:      info,
+		addresses: make(map[string]bool),
+		events:    make(map[string]bool),
+		target:    newWebhookBackfillTarget(info.Webhook, s.conf.WebhooksAllowPrivateIPs),
+	}
+	for _, addr := range info.Addresses {
+		hook.addresses[strings.ToLower(addr.String())] = true
+	}
+	for _, event := range info.Events {
+		hook.events[event] = true
+	}
+	return hook
+}
+
+func (h *invalidationHook) matches(address, event string) bool {
+	if !h.addresses[strings.ToLower(address)] {
+		return false
+	}
+	return len(h.events) == 0 || h.events[event]
+}
+
+func validateInvalidationHook(info *InvalidationHookInfo) error {
+	if len(info.Addresses) == 0 {
+		return errors.Errorf(errors.InvalidationHookNoAddress)
+	}
+	if info.Webhook == nil || info.Webhook.URL == "" {
+		return errors.Errorf(errors.EventStreamsWebhookNoURL)
+	}
+	if _, err := url.Parse(info.Webhook.URL); err != nil {
+		return errors.Errorf(errors.EventStreamsWebhookInvalidURL)
+	}
+	if info.Webhook.RequestTimeoutSec == 0 {
+		info.Webhook.RequestTimeoutSec = defaultInvalidationTimeoutSec
+	}
+	return nil
+}
+
+// AddInvalidationHook validates and registers a new cache invalidation hook
+func (s *subscriptionMGR) AddInvalidationHook(ctx context.Context, spec *InvalidationHookInfo) (*InvalidationHookInfo, error) {
+	if err := validateInvalidationHook(spec); err != nil {
+		return nil, err
+	}
+	spec.Tenant = auth.GetTenant(ctx)
+	spec.ID = invalidationIDPrefix + utils.UUIDv4()
+	spec.CreatedISO8601 = time.Now().UTC().Format(time.RFC3339)
+	spec.Path = InvalidationPathPrefix + "/" + spec.ID
+	if _, err := s.storeInvalidationHook(spec); err != nil {
+		return nil, err
+	}
+	hook := s.newInvalidationHook(spec)
+	s.invalidationLock.Lock()
+	s.invalidationHooks[spec.ID] = hook
+	s.invalidationLock.Unlock()
+	return spec, nil
+}
+
+// InvalidationHooks used externally to list the cache invalidation hooks
+func (s *subscriptionMGR) InvalidationHooks(ctx context.Context) []*InvalidationHookInfo {
+	s.invalidationLock.RLock()
+	defer s.invalidationLock.RUnlock()
+	l := make([]*InvalidationHookInfo, 0, len(s.invalidationHooks))
+	for _, hook := range s.invalidationHooks {
+		l = append(l, hook.info)
+	}
+	return l
+}
+
+// InvalidationHookByID used externally to get a cache invalidation hook
+func (s *subscriptionMGR) InvalidationHookByID(ctx context.Context, id string) (*InvalidationHookInfo, error) {
+	s.invalidationLock.RLock()
+	defer s.invalidationLock.RUnlock()
+	hook, exists := s.invalidationHooks[id]
+	if !exists {
+		return nil, errors.Errorf(errors.InvalidationHookNotFound, id)
+	}
+	return hook.info, nil
+}
+
+// DeleteInvalidationHook deletes a cache invalidation hook. Pings that are already
+// queued are still delivered
+func (s *subscriptionMGR) DeleteInvalidationHook(ctx context.Context, id string) error {
+	s.invalidationLock.Lock()
+	_, exists := s.invalidationHooks[id]
+	delete(s.invalidationHooks, id)
+	s.invalidationLock.Unlock()
+	if !exists {
+		return errors.Errorf(errors.InvalidationHookNotFound, id)
+	}
+	return s.db.Delete(id)
+}
+
+func (s *subscriptionMGR) storeInvalidationHook(info *InvalidationHookInfo) (*InvalidationHookInfo, error) {
+	infoBytes, _ := json.MarshalIndent(info, "", "  ")
+	if err := s.db.Put(info.ID, infoBytes); err != nil {
+		return nil, errors.Errorf(errors.InvalidationHookStoreFailed, err)
+	}
+	return info, nil
+}
+
+// invalidateCaches queues a ping to each hook that matches an event, as soon as it is read
+// from the chain. This is ahead of the batching and delivery of the event by its stream
+func (s *subscriptionMGR) invalidateCaches(address, event, blockNumber string) {
+	s.invalidationLock.RLock()
+	defer s.invalidationLock.RUnlock()
+	if s.invalidations == nil {
+		return
+	}
+	for _, hook := range s.invalidationHooks {
+		if !hook.matches(address, event) {
+			continue
+		}
+		ping := &invalidationPing{
+			hook: hook,
+			payload: &CacheInvalidation{
+				Address:     address,
+				Event:       event,
+				BlockNumber: blockNumber,
+			},
+		}
+		select {
+		case s.invalidations <- ping:
+		default:
+			log.Warnf("%s: Cache invalidation queue full. Dropped ping for %s event from %s", hook.info.ID, event, address)
+		}
+	}
+}
+
+// startInvalidations starts the workers that post the queued pings
+func (s *subscriptionMGR) startInvalidations() {
+	s.invalidations = make(chan *invalidationPing, s.conf.Invalidations.QueueSize)
+	for i := 0; i < s.conf.Invalidations.Workers; i++ {
+		s.invalidationWorkers.Add(1)
+		go s.invalidationWorker(s.invalidations)
+	}
+}
+
+// stopInvalidations stops queuing pings, and waits for the workers to post those already queued
+func (s *subscriptionMGR) stopInvalidations() {
+	s.invalidationLock.Lock()
+	if s.invalidations != nil {
+		close(s.invalidations)
+		s.invalidations = nil
+	}
+	s.invalidationLock.Unlock()
+	s.invalidationWorkers.Wait()
+}
+
+func (s *subscriptionMGR) invalidationWorker(queue chan *invalidationPing) {
+	defer s.invalidationWorkers.Done()
+	for ping := range queue {
+		if err := ping.hook.target.post(ping.payload); err != nil {
+			log.Errorf("%s: Cache invalidation ping for %s event from %s failed: %s", ping.hook.info.ID, ping.payload.Event, ping.payload.Address, err)
+		} else {
+			log.Debugf("%s: Cache invalidation ping for %s event from %s", ping.hook.info.ID, ping.payload.Event, ping.payload.Address)
+		}
+	}
+}
+
+func (s *subscriptionMGR) recoverInvalidationHooks() {
+	iHook := s.db.NewIterator()
+	defer iHook.Release()
+	for iHook.Next() {
+		k := iHook.Key()
+		if strings.HasPrefix(k, invalidationIDPrefix) {
+			var info InvalidationHookInfo
+			err := json.Unmarshal(iHook.Value(), &info)
+			if err == nil {
+				err = validateInvalidationHook(&info)
+			}
+			if err != nil {
+				log.Errorf("Failed to recover cache invalidation hook '%s': %s", string(iHook.Value()), err)
+				continue
+			}
+			s.invalidationHooks[info.ID] = s.newInvalidationHook(&info)
+		}
+	}
+}
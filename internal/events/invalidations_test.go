@@ -0,0 +1,247 @@
+// Copyright 2021 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package events
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"testing"
+
+	ethbinding "github.com/kaleido-io/ethbinding/pkg"
+	"github.com/kaleido-io/ethconnect/internal/ethbind"
+	"github.com/kaleido-io/ethconnect/internal/kvstore"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInvalidationHookLifecycle(t *testing.T) {
+	assert := assert.New(t)
+	dir := tempdir(t)
+	defer cleanup(t, dir)
+
+	pings := make(chan *CacheInvalidation, 2)
+	svr := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		var ping CacheInvalidation
+		json.NewDecoder(req.Body).Decode(&ping)
+		assert.Equal("value1", req.Header.Get("x-header1"))
+		pings <- &ping
+	}))
+	defer svr.Close()
+
+	sm := newTestSubscriptionManager()
+	sm.conf.EventLevelDBPath = path.Join(dir, "db")
+	err := sm.Init()
+	assert.NoError(err)
+
+	ctx := context.Background()
+	addr := ethbind.API.HexToAddress("0x167f57a13a9c35ff92f0649d2be0e52b4f8ac3ca")
+	info, err := sm.AddInvalidationHook(ctx, &InvalidationHookInfo{
+		Addresses: []ethbinding.Address{addr},
+		Events:    []string{"Changed"},
+		Webhook: &webhookActionInfo{
+			URL:     svr.URL,
+			Headers: map[string]string{"x-header1": "value1"},
+		},
+	})
+	assert.NoError(err)
+	assert.Regexp("^ih-", info.ID)
+	assert.Equal("/invalidations/"+info.ID, info.Path)
+	assert.Equal(uint32(defaultInvalidationTimeoutSec), info.Webhook.RequestTimeoutSec)
+
+	sm.invalidateCaches("0x167F57A13A9C35FF92F0649D2BE0E52B4F8AC3CA", "Changed", "100")
+	sm.invalidateCaches("0x167f57a13a9c35ff92f0649d2be0e52b4f8ac3ca", "Other", "101")
+	sm.invalidateCaches("0x0123456789abcdef0123456789abcdef01234567", "Changed", "102")
+	ping := <-pings
+	assert.Equal("0x167F57A13A9C35FF92F0649D2BE0E52B4F8AC3CA", ping.Address)
+	assert.Equal("Changed", ping.Event)
+	assert.Equal("100", ping.BlockNumber)
+
+	hooks := sm.InvalidationHooks(ctx)
+	assert.Equal(1, len(hooks))
+
+	// Reload
+	sm.Close()
+	assert.Equal(0, len(pings))
+	sm = newTestSubscriptionManager()
+	sm.conf.EventLevelDBPath = path.Join(dir, "db")
+	err = sm.Init()
+	assert.NoError(err)
+
+	retrieved, err := sm.InvalidationHookByID(ctx, info.ID)
+	assert.NoError(err)
+	assert.Equal([]string{"Changed"}, retrieved.Events)
+
+	err = sm.DeleteInvalidationHook(ctx, info.ID)
+	assert.NoError(err)
+	_, err = sm.InvalidationHookByID(ctx, info.ID)
+	assert.EqualError(err, fmt.Sprintf("Cache invalidation hook with ID '%s' not found", info.ID))
+	err = sm.DeleteInvalidationHook(ctx, info.ID)
+	assert.EqualError(err, fmt.Sprintf("Cache invalidation hook with ID '%s' not found", info.ID))
+
+	sm.Close()
+}
+
+func TestInvalidationHookAllEvents(t *testing.T) {
+	assert := assert.New(t)
+
+	addr := ethbind.API.HexToAddress("0x167f57a13a9c35ff92f0649d2be0e52b4f8ac3ca")
+	sm := newTestSubscriptionManager()
+	hook := sm.newInvalidationHook(&InvalidationHookInfo{
+		Addresses: []ethbinding.Address{addr},
+		Webhook:   &webhookActionInfo{URL: "http://cache.example.com"},
+	})
+	assert.True(hook.matches(addr.String(), "Changed"))
+	assert.True(hook.matches(addr.String(), "Other"))
+	assert.False(hook.matches("0x0123456789abcdef0123456789abcdef01234567", "Changed"))
+}
+
+func TestInvalidationHookValidation(t *testing.T) {
+	assert := assert.New(t)
+
+	sm := newTestSubscriptionManager()
+	ctx := context.Background()
+	addr := ethbind.API.HexToAddress("0x167f57a13a9c35ff92f0649d2be0e52b4f8ac3ca")
+
+	_, err := sm.AddInvalidationHook(ctx, &InvalidationHookInfo{
+		Webhook: &webhookActionInfo{URL: "http://cache.example.com"},
+	})
+	assert.EqualError(err, "Must specify at least one contract address for a cache invalidation hook")
+
+	_, err = sm.AddInvalidationHook(ctx, &InvalidationHookInfo{
+		Addresses: []ethbinding.Address{addr},
+	})
+	assert.EqualError(err, "Must specify webhook.url for action type 'webhook'")
+
+	_, err = sm.AddInvalidationHook(ctx, &InvalidationHookInfo{
+		Addresses: []ethbinding.Address{addr},
+		Webhook:   &webhookActionInfo{URL: ":badurl"},
+	})
+	assert.EqualError(err, "Invalid URL in webhook action")
+}
+
+func TestInvalidationHookStoreFail(t *testing.T) {
+	assert := assert.New(t)
+
+	sm := newTestSubscriptionManager()
+	sm.db = kvstore.NewMockKV(fmt.Errorf("pop"))
+	addr := ethbind.API.HexToAddress("0x167f57a13a9c35ff92f0649d2be0e52b4f8ac3ca")
+	_, err := sm.AddInvalidationHook(context.Background(), &InvalidationHookInfo{
+		Addresses: []ethbinding.Address{addr},
+		Webhook:   &webhookActionInfo{URL: "http://cache.example.com"},
+	})
+	assert.EqualError(err, "Failed to store cache invalidation hook: pop")
+	assert.Equal(0, len(sm.invalidationHooks))
+}
+
+func TestInvalidationQueueFull(t *testing.T) {
+	assert := assert.New(t)
+
+	addr := ethbind.API.HexToAddress("0x167f57a13a9c35ff92f0649d2be0e52b4f8ac3ca")
+	sm := newTestSubscriptionManager()
+	sm.invalidationHooks["ih-1"] = sm.newInvalidationHook(&InvalidationHookInfo{
+		ID:        "ih-1",
+		Addresses: []ethbinding.Address{addr},
+		Webhook:   &webhookActionInfo{URL: "http://cache.example.com"},
+	})
+
+	// Not started, so nothing is queued
+	sm.invalidateCaches(addr.String(), "Changed", "1")
+
+	sm.invalidations = make(chan *invalidationPing, 1)
+	sm.invalidateCaches(addr.String(), "Changed", "1")
+	sm.invalidateCaches(addr.String(), "Changed", "2")
+	assert.Equal(1, len(sm.invalidations))
+	ping := <-sm.invalidations
+	assert.Equal("1", ping.payload.BlockNumber)
+}
+
+func TestInvalidationPingFailure(t *testing.T) {
+	assert := assert.New(t)
+
+	called := make(chan bool, 1)
+	svr := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		res.WriteHeader(500)
+		called <- true
+	}))
+	defer svr.Close()
+
+	addr := ethbind.API.HexToAddress("0x167f57a13a9c35ff92f0649d2be0e52b4f8ac3ca")
+	sm := newTestSubscriptionManager()
+	sm.conf.Invalidations.Workers = 1
+	sm.invalidationHooks["ih-1"] = sm.newInvalidationHook(&InvalidationHookInfo{
+		ID:        "ih-1",
+		Addresses: []ethbinding.Address{addr},
+		Webhook:   &webhookActionInfo{URL: svr.URL, RequestTimeoutSec: 1},
+	})
+	sm.startInvalidations()
+	sm.invalidateCaches(addr.String(), "Changed", "1")
+	assert.True(<-called)
+	sm.stopInvalidations()
+	assert.Nil(sm.invalidations)
+}
+
+func TestRecoverInvalidationHookErrors(t *testing.T) {
+	assert := assert.New(t)
+	dir := tempdir(t)
+	defer cleanup(t, dir)
+	sm := newTestSubscriptionManager()
+	sm.db, _ = kvstore.NewLDBKeyValueStore(path.Join(dir, "db"))
+	defer sm.db.Close()
+
+	sm.db.Put(invalidationIDPrefix+"ihid1", []byte(":bad json"))
+	sm.db.Put(invalidationIDPrefix+"ihid2", []byte("{}"))
+
+	sm.recoverInvalidationHooks()
+
+	assert.Equal(0, len(sm.invalidationHooks))
+}
+
+func TestProcessLogEntryInvalidatesCaches(t *testing.T) {
+	assert := assert.New(t)
+
+	sm := &mockSubMgr{}
+	stream := &eventStream{
+		sm:          sm,
+		spec:        &StreamInfo{},
+		eventStream: make(chan *eventData, 1),
+	}
+	eventABI := `{
+    "name": "Changed",
+    "inputs": [
+      {"name": "one", "type": "uint256"}
+    ]
+  }`
+	var marshaling ethbinding.ABIElementMarshaling
+	json.Unmarshal([]byte(eventABI), &marshaling)
+	event, err := ethbind.API.ABIElementMarshalingToABIEvent(&marshaling)
+	assert.NoError(err)
+
+	lp := &logProcessor{
+		event:  event,
+		stream: stream,
+	}
+	addr := ethbind.API.HexToAddress("0x167f57a13a9c35ff92f0649d2be0e52b4f8ac3ca")
+	err = lp.processLogEntry(t.Name(), &logEntry{
+		Address: addr,
+		Data:    "0x000000000000000000000000000000000000000000000000000000000000000a",
+	}, 0)
+	assert.NoError(err)
+	assert.Equal(1, len(sm.invalidations))
+	assert.Equal("Changed", sm.invalidations[0].Event)
+	assert.Equal(addr.String(), sm.invalidations[0].Address)
+}
@@ -0,0 +1,210 @@
+// Copyright 2021 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package events
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/Shopify/sarama"
+	"github.com/kaleido-io/ethconnect/internal/errors"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// KafkaPartitionKeyAddress keys each event by the address of the contract that emitted it
+	KafkaPartitionKeyAddress = "address"
+	// KafkaPartitionKeySubscription keys each event by the subscription that matched it
+	KafkaPartitionKeySubscription = "subscription"
+	// KafkaPartitionKeyTransaction keys each event by the hash of the transaction that emitted it
+	KafkaPartitionKeyTransaction = "transaction"
+	// KafkaPartitionKeyNone sends events without a key, to be spread across the partitions
+	KafkaPartitionKeyNone = "none"
+	// KafkaPartitionKeyArgPrefix keys each event by the value of one of its arguments, as "arg:<name>"
+	KafkaPartitionKeyArgPrefix = "arg:"
+)
+
+// kafkaActionInfo is the connection and topic of a stream of type "kafka".
+// Serialization is json by default, or avro or protobuf using the schemas in the registry
+type kafkaActionInfo struct {
+	BackfillKafkaConf
+	Topic         string `json:"topic,omitempty"`
+	PartitionKey  string `json:"partitionKey,omitempty"`
+	Serialization string `json:"serialization,omitempty"`
+}
+
+// closableAction is implemented by actions that hold a connection to the target,
+// which must be closed when the stream stops
+type closableAction interface {
+	close()
+}
+
+// kafkaAction sends each event of a batch as a message to a topic. The batch only
+// completes once every message is acknowledged, so the checkpoints of the subscriptions
+// give at-least-once delivery
+type kafkaAction struct {
+	es         *eventStream
+	spec       *kafkaActionInfo
+	lock       sync.Mutex
+	producer   sarama.SyncProducer
+	serializer *kafkaSerializer
+}
+
+func validateKafka(conf *SubscriptionManagerConf, spec *kafkaActionInfo) error {
+	if spec == nil || spec.Topic == "" {
+		return errors.Errorf(errors.EventStreamsKafkaNoTopic)
+	}
+	if len(spec.Brokers) == 0 {
+		return errors.Errorf(errors.EventStreamsKafkaNoBrokers)
+	}
+	switch spec.PartitionKey {
+	case "":
+		spec.PartitionKey = KafkaPartitionKeyAddress
+	case KafkaPartitionKeyAddress, KafkaPartitionKeySubscription, KafkaPartitionKeyTransaction, KafkaPartitionKeyNone:
+	default:
+		if !strings.HasPrefix(spec.PartitionKey, KafkaPartitionKeyArgPrefix) || len(spec.PartitionKey) == len(KafkaPartitionKeyArgPrefix) {
+			return errors.Errorf(errors.EventStreamsKafkaInvalidPartitionKey, spec.PartitionKey)
+		}
+	}
+	switch spec.Serialization {
+	case "":
+		spec.Serialization = KafkaSerializationJSON
+	case KafkaSerializationJSON:
+	case KafkaSerializationAvro, KafkaSerializationProtobuf:
+		registryFormat := conf.SchemaRegistry.Format
+		if registryFormat == "" {
+			registryFormat = SchemaFormatJSON
+		}
+		if conf.SchemaRegistry.URL == "" || registryFormat != spec.Serialization {
+			return errors.Errorf(errors.EventStreamsKafkaSerializationNoRegistry, spec.Serialization, spec.Serialization)
+		}
+	default:
+		return errors.Errorf(errors.EventStreamsKafkaInvalidSerialization, spec.Serialization)
+	}
+	return nil
+}
+
+func newKafkaAction(es *eventStream, spec *kafkaActionInfo) (*kafkaAction, error) {
+	if err := validateKafka(es.sm.config(), spec); err != nil {
+		return nil, err
+	}
+	return &kafkaAction{
+		es:         es,
+		spec:       spec,
+		serializer: newKafkaActionSerializer(es.sm, spec),
+	}, nil
+}
+
+// newKafkaActionSerializer returns nil for events delivered as JSON
+func newKafkaActionSerializer(sm subscriptionManager, spec *kafkaActionInfo) *kafkaSerializer {
+	if spec.Serialization == KafkaSerializationJSON {
+		return nil
+	}
+	return newKafkaSerializer(sm, spec.Serialization)
+}
+
+// connect creates the producer on the first attempt, so a stream can be created
+// while the brokers are unavailable
+func (k *kafkaAction) connect() (sarama.SyncProducer, error) {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	if k.producer == nil {
+		producer, err := k.es.sm.newKafkaProducer(&k.spec.BackfillKafkaConf)
+		if err != nil {
+			return nil, errors.Errorf(errors.EventStreamsKafkaConnect, err)
+		}
+		k.producer = producer
+	}
+	return k.producer, nil
+}
+
+// partitionKey returns the key of the message for an event, or nil for no key.
+// Events without the configured argument are keyed by address
+func (k *kafkaAction) partitionKey(event *eventData) sarama.Encoder {
+	key := event.Address
+	switch k.spec.PartitionKey {
+	case KafkaPartitionKeyAddress:
+	case KafkaPartitionKeySubscription:
+		key = event.SubID
+	case KafkaPartitionKeyTransaction:
+		key = event.TransactionHash
+	case KafkaPartitionKeyNone:
+		return nil
+	default:
+		argName := strings.TrimPrefix(k.spec.PartitionKey, KafkaPartitionKeyArgPrefix)
+		if arg, ok := event.Data[argName]; ok {
+			key = fmt.Sprintf("%v", arg)
+		}
+	}
+	return sarama.StringEncoder(key)
+}
+
+// attemptBatch sends the events of a batch to the topic, waiting for all to be acknowledged
+func (k *kafkaAction) attemptBatch(batchNumber, attempt uint64, events []*eventData) error {
+	esID := k.es.spec.ID
+	producer, err := k.connect()
+	if err != nil {
+		log.Errorf("%s: Kafka %s failed (attempt=%d): %s", esID, k.spec.Topic, attempt, err)
+		return err
+	}
+	msgs := make([]*sarama.ProducerMessage, len(events))
+	for i, event := range events {
+		msgs[i] = &sarama.ProducerMessage{
+			Topic: k.spec.Topic,
+			Key:   k.partitionKey(event),
+		}
+		if k.serializer == nil {
+			eventBytes, _ := json.Marshal(event)
+			msgs[i].Value = sarama.ByteEncoder(eventBytes)
+			continue
+		}
+		eventBytes, err := k.serializer.serialize(event)
+		if err != nil {
+			log.Errorf("%s: Kafka %s failed to serialize event (attempt=%d): %s", esID, k.spec.Topic, attempt, err)
+			return err
+		}
+		msgs[i].Value = sarama.ByteEncoder(eventBytes)
+		if event.Removed {
+			// The schemas have no field to mark an event removed by a chain re-org
+			msgs[i].Headers = []sarama.RecordHeader{{Key: []byte("removed"), Value: []byte("true")}}
+		}
+	}
+	log.Infof("%s: Kafka --> %s batch=%d events=%d (attempt=%d)", esID, k.spec.Topic, batchNumber, len(events), attempt)
+	if err = producer.SendMessages(msgs); err != nil {
+		log.Errorf("%s: Kafka %s failed (attempt=%d): %s", esID, k.spec.Topic, attempt, err)
+	}
+	return err
+}
+
+// update switches to a new connection, topic and serialization, reconnecting on the next attempt
+func (k *kafkaAction) update(spec *kafkaActionInfo) {
+	k.close()
+	k.lock.Lock()
+	k.spec = spec
+	k.serializer = newKafkaActionSerializer(k.es.sm, spec)
+	k.lock.Unlock()
+}
+
+func (k *kafkaAction) close() {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	if k.producer != nil {
+		k.producer.Close()
+		k.producer = nil
+	}
+}
@@ -0,0 +1,358 @@
+// Copyright 2021 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package events
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	ethbinding "github.com/kaleido-io/ethbinding/pkg"
+	"github.com/stretchr/testify/assert"
+)
+
+// capturingProducer records the messages of each call to SendMessages, failing the
+// first sendErrors calls
+type capturingProducer struct {
+	lock       sync.Mutex
+	batches    [][]*sarama.ProducerMessage
+	sendErrors int
+	closed     bool
+}
+
+func (p *capturingProducer) SendMessage(msg *sarama.ProducerMessage) (int32, int64, error) {
+	return 0, 0, p.SendMessages([]*sarama.ProducerMessage{msg})
+}
+
+func (p *capturingProducer) SendMessages(msgs []*sarama.ProducerMessage) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.batches = append(p.batches, msgs)
+	if len(p.batches) <= p.sendErrors {
+		return fmt.Errorf("pop")
+	}
+	return nil
+}
+
+func (p *capturingProducer) Close() error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.closed = true
+	return nil
+}
+
+func testKafkaEvent(subID string, done chan *eventData) *eventData {
+	return &eventData{
+		Address:         "0x167f57a13a9c35ff92f0649d2be0e52b4f8ac3ca",
+		TransactionHash: "0x0c1f0ae0e20be1a4bd5b3cd3e4ae6a1ea2f4c0f5e9b4fd3a52e2d5b2c06b8c7e",
+		SubID:           subID,
+		Data:            map[string]interface{}{"from": "0xaa", "value": "10"},
+		batchComplete:   func(e *eventData) { done <- e },
+	}
+}
+
+func TestKafkaStreamValidation(t *testing.T) {
+	assert := assert.New(t)
+	sm := newTestSubscriptionManager()
+	brokers := BackfillKafkaConf{Brokers: []string{"broker1"}}
+
+	for _, test := range []struct {
+		kafka *kafkaActionInfo
+		err   string
+	}{
+		{nil, "Must specify kafka.topic for action type 'kafka'"},
+		{&kafkaActionInfo{Topic: "events"}, "Must specify kafka.brokers for action type 'kafka'"},
+		{&kafkaActionInfo{BackfillKafkaConf: brokers, Topic: "events", PartitionKey: "block"}, "Invalid kafka.partitionKey 'block'"},
+		{&kafkaActionInfo{BackfillKafkaConf: brokers, Topic: "events", PartitionKey: "arg:"}, "Invalid kafka.partitionKey 'arg:'"},
+		{&kafkaActionInfo{BackfillKafkaConf: brokers, Topic: "events", Serialization: "xml"}, "Invalid kafka.serialization 'xml'"},
+		{&kafkaActionInfo{BackfillKafkaConf: brokers, Topic: "events", Serialization: "avro"}, "kafka.serialization 'avro' requires a schema registry configured with format 'avro'"},
+	} {
+		_, err := sm.AddStream(context.Background(), &StreamInfo{Type: "kafka", Kafka: test.kafka})
+		assert.Regexp(test.err, err)
+	}
+
+	spec, err := sm.AddStream(context.Background(), &StreamInfo{
+		Type:  "Kafka",
+		Kafka: &kafkaActionInfo{BackfillKafkaConf: brokers, Topic: "events"},
+	})
+	assert.NoError(err)
+	assert.Equal("kafka", spec.Type)
+	assert.Equal(KafkaPartitionKeyAddress, spec.Kafka.PartitionKey)
+	assert.Equal(KafkaSerializationJSON, spec.Kafka.Serialization)
+	sm.streams[spec.ID].stop()
+
+	sm.config().SchemaRegistry = SchemaRegistryConf{URL: "http://localhost:8081"}
+	_, err = sm.AddStream(context.Background(), &StreamInfo{
+		Type:  "kafka",
+		Kafka: &kafkaActionInfo{BackfillKafkaConf: brokers, Topic: "events", Serialization: "protobuf"},
+	})
+	assert.Regexp("kafka.serialization 'protobuf' requires a schema registry configured with format 'protobuf'", err)
+}
+
+func TestKafkaStreamPartitionKeys(t *testing.T) {
+	assert := assert.New(t)
+	event := testKafkaEvent("sub1", nil)
+
+	for _, test := range []struct {
+		partitionKey string
+		key          sarama.Encoder
+	}{
+		{KafkaPartitionKeyAddress, sarama.StringEncoder(event.Address)},
+		{KafkaPartitionKeySubscription, sarama.StringEncoder("sub1")},
+		{KafkaPartitionKeyTransaction, sarama.StringEncoder(event.TransactionHash)},
+		{KafkaPartitionKeyNone, nil},
+		{"arg:from", sarama.StringEncoder("0xaa")},
+		{"arg:missing", sarama.StringEncoder(event.Address)},
+	} {
+		k := &kafkaAction{spec: &kafkaActionInfo{PartitionKey: test.partitionKey}}
+		assert.Equal(test.key, k.partitionKey(event))
+	}
+}
+
+func TestProcessEventsKafka(t *testing.T) {
+	assert := assert.New(t)
+	producer := &capturingProducer{sendErrors: 1}
+	sm := newTestSubscriptionManager()
+	connects := 0
+	sm.kafkaProducer = func(brokers []string, conf *sarama.Config) (sarama.SyncProducer, error) {
+		connects++
+		if connects == 1 {
+			return nil, fmt.Errorf("pop")
+		}
+		assert.Equal([]string{"broker1"}, brokers)
+		assert.Equal("ethconnect-events", conf.ClientID)
+		assert.True(conf.Net.SASL.Enable)
+		return producer, nil
+	}
+	kafka := &kafkaActionInfo{Topic: "events", PartitionKey: "arg:from"}
+	kafka.Brokers = []string{"broker1"}
+	kafka.ClientID = "ethconnect-events"
+	kafka.SASL.Username = "user1"
+	kafka.SASL.Password = "pass1"
+	spec, err := sm.AddStream(context.Background(), &StreamInfo{
+		Type:            "kafka",
+		BatchSize:       2,
+		ErrorHandling:   ErrorHandlingBlock,
+		RetryTimeoutSec: 1,
+		Kafka:           kafka,
+	})
+	assert.NoError(err)
+	stream := sm.streams[spec.ID]
+	stream.backoff.InitialDelay = 1 * time.Millisecond
+	defer stream.stop()
+
+	// The batch is retried after failures to connect and send, and completes once sent
+	done := make(chan *eventData, 2)
+	stream.handleEvent(testKafkaEvent("sub1", done))
+	stream.handleEvent(testKafkaEvent("sub2", done))
+	<-done
+	<-done
+	assert.Equal(2, connects)
+	assert.Equal(2, len(producer.batches))
+	msgs := producer.batches[1]
+	assert.Equal(2, len(msgs))
+	assert.Equal("events", msgs[0].Topic)
+	assert.Equal(sarama.StringEncoder("0xaa"), msgs[0].Key)
+	b, _ := msgs[1].Value.Encode()
+	var event eventData
+	json.Unmarshal(b, &event)
+	assert.Equal("sub2", event.SubID)
+}
+
+func TestUpdateKafkaStream(t *testing.T) {
+	assert := assert.New(t)
+	producer := &capturingProducer{}
+	sm := newTestSubscriptionManager()
+	sm.kafkaProducer = func(brokers []string, conf *sarama.Config) (sarama.SyncProducer, error) {
+		return producer, nil
+	}
+	kafka := &kafkaActionInfo{Topic: "events"}
+	kafka.Brokers = []string{"broker1"}
+	spec, err := sm.AddStream(context.Background(), &StreamInfo{Type: "kafka", Kafka: kafka})
+	assert.NoError(err)
+	stream := sm.streams[spec.ID]
+	done := make(chan *eventData, 1)
+	stream.handleEvent(testKafkaEvent("sub1", done))
+	<-done
+
+	updated := &kafkaActionInfo{Topic: "events2", PartitionKey: KafkaPartitionKeyNone}
+	_, err = sm.UpdateStream(context.Background(), spec.ID, &StreamInfo{Kafka: updated})
+	assert.Regexp("Must specify kafka.brokers", err)
+
+	updated.Brokers = []string{"broker2"}
+	spec, err = sm.UpdateStream(context.Background(), spec.ID, &StreamInfo{Kafka: updated})
+	assert.NoError(err)
+	assert.Equal("events2", spec.Kafka.Topic)
+	assert.True(producer.closed)
+
+	producer.closed = false
+	stream.handleEvent(testKafkaEvent("sub1", done))
+	<-done
+	assert.Equal("events2", producer.batches[1][0].Topic)
+	assert.Nil(producer.batches[1][0].Key)
+
+	stream.stop()
+	assert.True(producer.closed)
+}
+
+const testKafkaSchemaEventABI = `{
+	"name": "Changed",
+	"type": "event",
+	"inputs": [
+		{"name": "from", "type": "address"},
+		{"name": "value", "type": "uint256"},
+		{"name": "flags", "type": "bool[]"},
+		{"name": "ok", "type": "bool"}
+	]
+}`
+
+func newTestKafkaSchemaSubscription(t *testing.T, sm *subscriptionMGR, streamID string) *SubscriptionInfo {
+	var marshaling ethbinding.ABIElementMarshaling
+	assert.NoError(t, json.Unmarshal([]byte(testKafkaSchemaEventABI), &marshaling))
+	sub, err := sm.AddSubscription(context.Background(), nil, &marshaling, streamID, "", "", nil)
+	assert.NoError(t, err)
+	return sub
+}
+
+func testKafkaSchemaEvent(subID string, done chan *eventData) *eventData {
+	return &eventData{
+		Address:          "0x01",
+		BlockNumber:      "10",
+		TransactionIndex: "0",
+		TransactionHash:  "0x02",
+		Data:             map[string]interface{}{"from": "0xaa", "value": "10", "flags": []interface{}{true, false}, "ok": true},
+		SubID:            subID,
+		Signature:        "Changed(address,uint256,bool[],bool)",
+		LogIndex:         "1",
+		batchComplete:    func(e *eventData) { done <- e },
+	}
+}
+
+// testLenPrefixed prefixes a short value with its length, which is a single byte varint in
+// Protobuf, and doubled by the zigzag encoding of a single byte varint in Avro
+func testLenPrefixed(prefix func(int) byte, values ...string) []byte {
+	var b []byte
+	for _, v := range values {
+		b = append(b, prefix(len(v)))
+		b = append(b, v...)
+	}
+	return b
+}
+
+func TestProcessEventsKafkaAvro(t *testing.T) {
+	assert := assert.New(t)
+	registry := newTestSchemaRegistry(t, 200, `{"id": 5}`)
+	defer registry.server.Close()
+
+	producer := &capturingProducer{}
+	sm := newTestSubscriptionManager()
+	sm.config().SchemaRegistry = SchemaRegistryConf{URL: registry.server.URL, Format: SchemaFormatAvro}
+	sm.kafkaProducer = func(brokers []string, conf *sarama.Config) (sarama.SyncProducer, error) {
+		return producer, nil
+	}
+	kafka := &kafkaActionInfo{Topic: "events", Serialization: KafkaSerializationAvro}
+	kafka.Brokers = []string{"broker1"}
+	spec, err := sm.AddStream(context.Background(), &StreamInfo{Type: "kafka", Kafka: kafka})
+	assert.NoError(err)
+	stream := sm.streams[spec.ID]
+	defer stream.stop()
+
+	// The subscription was created without a schema, so it is published on the first event
+	sub := newTestKafkaSchemaSubscription(t, sm, spec.ID)
+	assert.Nil(sub.Schema)
+	done := make(chan *eventData, 2)
+	stream.handleEvent(testKafkaSchemaEvent(sub.ID, done))
+	removed := testKafkaSchemaEvent(sub.ID, done)
+	removed.Removed = true
+	removed.Timestamp = "1620000000"
+	stream.handleEvent(removed)
+	<-done
+	<-done
+	assert.Equal("/subjects/ethconnect-Changed/versions", registry.path)
+
+	avroString := func(l int) byte { return byte(l * 2) }
+	expected := []byte{0, 0, 0, 0, 5}
+	expected = append(expected, testLenPrefixed(avroString, "0x01", "10", "0", "0x02", "0xaa", "10")...)
+	expected = append(expected, 4, 1, 0, 0, 1)
+	expected = append(expected, testLenPrefixed(avroString, sub.ID, "Changed(address,uint256,bool[],bool)", "1")...)
+	var msgs []*sarama.ProducerMessage
+	for _, batch := range producer.batches {
+		msgs = append(msgs, batch...)
+	}
+	assert.Equal(2, len(msgs))
+	b, _ := msgs[0].Value.Encode()
+	assert.Equal(append(expected, 0), b)
+	assert.Empty(msgs[0].Headers)
+	b, _ = msgs[1].Value.Encode()
+	assert.Equal(append(append(expected, 2), testLenPrefixed(avroString, "1620000000")...), b)
+	assert.Equal([]sarama.RecordHeader{{Key: []byte("removed"), Value: []byte("true")}}, msgs[1].Headers)
+}
+
+func TestKafkaSerializerProtobuf(t *testing.T) {
+	assert := assert.New(t)
+	registry := newTestSchemaRegistry(t, 200, `{"id": 300}`)
+	defer registry.server.Close()
+
+	sm := newTestSubscriptionManager()
+	sm.config().SchemaRegistry = SchemaRegistryConf{URL: registry.server.URL, Format: SchemaFormatProtobuf}
+	sm.schemas, _ = newSchemaRegistry(&sm.config().SchemaRegistry)
+	ctx := context.Background()
+	stream, err := sm.AddStream(ctx, &StreamInfo{
+		Type:    "webhook",
+		Webhook: &webhookActionInfo{URL: "http://test.invalid"},
+	})
+	assert.NoError(err)
+	defer sm.DeleteStream(ctx, stream.ID)
+
+	// The schema published when the subscription was created is used
+	sub := newTestKafkaSchemaSubscription(t, sm, stream.ID)
+	assert.Equal(300, sub.Schema.ID)
+	registry.path = ""
+	s := newKafkaSerializer(sm, KafkaSerializationProtobuf)
+	b, err := s.serialize(testKafkaSchemaEvent(sub.ID, nil))
+	assert.NoError(err)
+	assert.Empty(registry.path)
+
+	protoString := func(l int) byte { return byte(l) }
+	expected := []byte{0, 0, 0, 1, 44, 0}
+	for i, v := range []string{"0x01", "10", "0", "0x02"} {
+		expected = append(expected, byte((i+1)<<3|2))
+		expected = append(expected, testLenPrefixed(protoString, v)...)
+	}
+	data := []byte{0x0a}
+	data = append(data, testLenPrefixed(protoString, "0xaa")...)
+	data = append(data, 0x12)
+	data = append(data, testLenPrefixed(protoString, "10")...)
+	data = append(data, 0x1a, 2, 1, 0, 0x20, 1)
+	expected = append(expected, 0x2a, byte(len(data)))
+	expected = append(expected, data...)
+	for i, v := range []string{sub.ID, "Changed(address,uint256,bool[],bool)", "1"} {
+		expected = append(expected, byte((i+6)<<3|2))
+		expected = append(expected, testLenPrefixed(protoString, v)...)
+	}
+	assert.Equal(expected, b)
+
+	aggregate := testKafkaSchemaEvent(sub.ID, nil)
+	aggregate.Aggregate = true
+	_, err = s.serialize(aggregate)
+	assert.Regexp("No schema is available to serialize the events of subscription", err)
+
+	_, err = s.serialize(testKafkaSchemaEvent("missing", nil))
+	assert.Regexp("Subscription with ID 'missing' not found", err)
+}
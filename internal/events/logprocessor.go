@@ -15,10 +15,12 @@
 package events
 
 import (
+	"encoding/json"
 	"math/big"
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	ethbinding "github.com/kaleido-io/ethbinding/pkg"
 	"github.com/kaleido-io/ethconnect/internal/errors"
@@ -30,11 +32,14 @@ import (
 type logEntry struct {
 	Address          ethbinding.Address   `json:"address"`
 	BlockNumber      ethbinding.HexBigInt `json:"blockNumber"`
+	BlockHash        ethbinding.Hash      `json:"blockHash"`
 	TransactionIndex ethbinding.HexUint   `json:"transactionIndex"`
 	TransactionHash  ethbinding.Hash      `json:"transactionHash"`
+	LogIndex         json.RawMessage      `json:"logIndex,omitempty"` // Only used to identify a removed log, so not decoded
 	Data             string               `json:"data"`
 	Topics           []*ethbinding.Hash   `json:"topics"`
 	Timestamp        uint64               `json:"timestamp,omitempty"`
+	Removed          bool                 `json:"removed,omitempty"`
 }
 
 type eventData struct {
@@ -47,6 +52,8 @@ type eventData struct {
 	Signature        string                 `json:"signature"`
 	LogIndex         string                 `json:"logIndex"`
 	Timestamp        string                 `json:"timestamp,omitempty"`
+	Aggregate        bool                   `json:"aggregate,omitempty"`
+	Removed          bool                   `json:"removed,omitempty"` // A previously delivered event removed by a chain re-org
 	// Used for callback handling
 	batchComplete func(*eventData)
 }
@@ -57,14 +64,20 @@ type logProcessor struct {
 	stream            *eventStream
 	blockHWM          big.Int
 	highestDispatched big.Int
+	lastDelivered     *DeliveredPosition
+	lastProgress      time.Time
 	hwnSync           sync.Mutex
+	aggregator        *aggregator
+	pending           []*pendingEvent
+	tracked           []*trackedBlock
 }
 
 func newLogProcessor(subID string, event *ethbinding.ABIEvent, stream *eventStream) *logProcessor {
 	return &logProcessor{
-		subID:  subID,
-		event:  event,
-		stream: stream,
+		subID:        subID,
+		event:        event,
+		stream:       stream,
+		lastProgress: time.Now(),
 	}
 }
 
@@ -76,6 +89,12 @@ func (lp *logProcessor) batchComplete(newestEvent *eventData) {
 	if i.Cmp(&lp.blockHWM) > 0 {
 		lp.blockHWM.Set(i)
 	}
+	lp.lastDelivered = &DeliveredPosition{
+		BlockNumber: newestEvent.BlockNumber,
+		LogIndex:    newestEvent.LogIndex,
+		Time:        time.Now().UTC(),
+	}
+	lp.lastProgress = time.Now()
 	lp.hwnSync.Unlock()
 	log.Debugf("%s: HWM: %s", lp.subID, lp.blockHWM.String())
 }
@@ -87,16 +106,43 @@ func (lp *logProcessor) getBlockHWM() big.Int {
 	return v
 }
 
+func (lp *logProcessor) getLastDelivered() *DeliveredPosition {
+	lp.hwnSync.Lock()
+	defer lp.hwnSync.Unlock()
+	return lp.lastDelivered
+}
+
 func (lp *logProcessor) markNoEvents(blockNumber *big.Int) {
 	lp.hwnSync.Lock()
 	if lp.highestDispatched.Cmp(&lp.blockHWM) < 0 {
-		// Nothing in-flight, its safe to update the HWM
+		// Nothing in-flight, its safe to update the HWM - up to any events waiting for confirmations
+		if lowest := lp.lowestPending(); lowest != nil && lowest.Cmp(blockNumber) < 0 {
+			blockNumber = lowest
+		}
 		lp.blockHWM.Set(blockNumber)
+		lp.lastProgress = time.Now()
 		log.Debugf("%s: HWM: %s", lp.subID, lp.blockHWM.String())
 	}
 	lp.hwnSync.Unlock()
 }
 
+// markPolled records progress after a successful poll of the node, if no events are
+// waiting to be delivered. A subscription with nothing to read is not stalled, even
+// though its HWM only moves when events are delivered
+func (lp *logProcessor) markPolled() {
+	lp.hwnSync.Lock()
+	if lp.highestDispatched.Cmp(&lp.blockHWM) < 0 {
+		lp.lastProgress = time.Now()
+	}
+	lp.hwnSync.Unlock()
+}
+
+func (lp *logProcessor) getLastProgress() time.Time {
+	lp.hwnSync.Lock()
+	defer lp.hwnSync.Unlock()
+	return lp.lastProgress
+}
+
 func (lp *logProcessor) initBlockHWM(intVal *big.Int) {
 	lp.hwnSync.Lock()
 	lp.blockHWM = *intVal
@@ -105,97 +151,103 @@ func (lp *logProcessor) initBlockHWM(intVal *big.Int) {
 
 func (lp *logProcessor) processLogEntry(subInfo string, entry *logEntry, idx int) (err error) {
 
+	result, err := decodeLogEntry(subInfo, lp.subID, lp.event, entry, idx, lp.stream.spec.Timestamps)
+	if err != nil {
+		return err
+	}
+	result.batchComplete = lp.batchComplete
+	blockNumber := entry.BlockNumber.ToInt()
+
+	if entry.Removed {
+		// The node reports the logs removed by a re-org. If we have not delivered the event
+		// yet we simply drop it, otherwise we let the application know it is no longer valid
+		if lp.removePending(entry) {
+			log.Warnf("%s: Dropping event removed by a chain re-org. BlockNumber=%s TxHash=%s", subInfo, result.BlockNumber, result.TransactionHash)
+			return nil
+		}
+		lp.untrackEvent(pendingEventKey(entry))
+		result.Removed = true
+	} else if lp.stream.spec.Confirmations > 1 {
+		lp.addPending(subInfo, entry, result)
+		return nil
+	} else {
+		lp.trackEvent(pendingEventKey(entry), blockNumber, entry.BlockHash.String(), result)
+	}
+	lp.dispatch(subInfo, result, blockNumber)
+	return nil
+}
+
+func (lp *logProcessor) dispatch(subInfo string, result *eventData, blockNumber *big.Int) {
+	// Ok, now we have the full event in a friendly map output. Pass it down to the event processor
+	log.Infof("%s: Dispatching event. Address=%s BlockNumber=%s TxIndex=%s Removed=%t", subInfo, result.Address, result.BlockNumber, result.TransactionIndex, result.Removed)
+	lp.hwnSync.Lock()
+	if blockNumber.Cmp(&lp.highestDispatched) > 0 {
+		lp.highestDispatched.Set(blockNumber)
+	}
+	lp.hwnSync.Unlock()
+	lp.stream.sm.invalidateCaches(result.Address, lp.event.Name, result.BlockNumber)
+	if !result.Removed {
+		lp.stream.sm.react(result)
+	}
+	if lp.aggregator != nil && !result.Removed {
+		if lp.aggregator.add(result, time.Now()) {
+			lp.flushAggregation(subInfo)
+		}
+		return
+	}
+	lp.stream.handleEvent(result)
+}
+
+// checkAggregation delivers the summary of the current aggregation window, if it has closed.
+// Called on each polling cycle, so windows close even when no further events arrive.
+func (lp *logProcessor) checkAggregation(subInfo string) {
+	if lp.aggregator != nil && lp.aggregator.expired(time.Now()) {
+		lp.flushAggregation(subInfo)
+	}
+}
+
+func (lp *logProcessor) resetAggregation() {
+	if lp.aggregator != nil {
+		lp.aggregator.reset()
+	}
+}
+
+func (lp *logProcessor) flushAggregation(subInfo string) {
+	summary := lp.aggregator.summarize(time.Now())
+	log.Infof("%s: Dispatching aggregate of %s events. BlockNumber=%s", subInfo, summary.Data["count"], summary.BlockNumber)
+	lp.stream.handleEvent(summary)
+}
+
+// decodeLogEntry decodes the data and topics of a log into an event, using the ABI of the event
+func decodeLogEntry(subInfo, subID string, event *ethbinding.ABIEvent, entry *logEntry, idx int, timestamps bool) (*eventData, error) {
 	var data []byte
+	var err error
 	if strings.HasPrefix(entry.Data, "0x") {
 		data, err = ethbind.API.HexDecode(entry.Data)
 		if err != nil {
-			return errors.Errorf(errors.EventStreamsLogDecode, subInfo, err)
+			return nil, errors.Errorf(errors.EventStreamsLogDecode, subInfo, err)
 		}
 	}
 
-	blockNumber := entry.BlockNumber.ToInt()
 	result := &eventData{
 		Address:          entry.Address.String(),
-		BlockNumber:      blockNumber.String(),
+		BlockNumber:      entry.BlockNumber.ToInt().String(),
 		TransactionIndex: entry.TransactionIndex.String(),
 		TransactionHash:  entry.TransactionHash.String(),
-		Signature:        ethbind.API.ABIEventSignature(lp.event),
+		Signature:        ethbind.API.ABIEventSignature(event),
 		Data:             make(map[string]interface{}),
-		SubID:            lp.subID,
+		SubID:            subID,
 		LogIndex:         strconv.Itoa(idx),
-		batchComplete:    lp.batchComplete,
 	}
-	if lp.stream.spec.Timestamps {
+	if timestamps {
 		result.Timestamp = strconv.FormatUint(entry.Timestamp, 10)
 	}
-	topicIdx := 0
-	if !lp.event.Anonymous {
-		topicIdx++ // first index is the hash of the event description
-	}
-
-	// We need split out the indexed args that we parse out of the topic, from the data args
-	var dataArgs ethbinding.ABIArguments
-	dataArgs = make([]ethbinding.ABIArgument, 0, len(lp.event.Inputs))
-	for idx, input := range lp.event.Inputs {
-		var val interface{}
-		if input.Indexed {
-			if topicIdx >= len(entry.Topics) {
-				return errors.Errorf(errors.EventStreamsLogDecodeInsufficientTopics, subInfo, idx, ethbind.API.ABIEventSignature(lp.event))
-			}
-			topic := entry.Topics[topicIdx]
-			topicIdx++
-			if topic != nil {
-				val = topicToValue(topic, &input)
-			} else {
-				val = nil
-			}
-			result.Data[input.Name] = val
-		} else {
-			dataArgs = append(dataArgs, input)
-		}
+	values, err := eth.DecodeEventLog(event, entry.Topics, data)
+	if err != nil {
+		return nil, errors.Errorf(errors.EventStreamsLogDecodeEvent, subInfo, err)
 	}
-
-	// Retrieve the data args from the RLP and merge the results
-	if len(dataArgs) > 0 {
-		dataMap := eth.ProcessRLPBytes(dataArgs, data)
-		for k, v := range dataMap {
-			result.Data[k] = v
-		}
-	}
-
-	// Ok, now we have the full event in a friendly map output. Pass it down to the event processor
-	log.Infof("%s: Dispatching event. Address=%s BlockNumber=%s TxIndex=%s", subInfo, result.Address, result.BlockNumber, result.TransactionIndex)
-	lp.hwnSync.Lock()
-	if blockNumber.Cmp(&lp.highestDispatched) > 0 {
-		lp.highestDispatched.Set(blockNumber)
-	}
-	lp.hwnSync.Unlock()
-	lp.stream.handleEvent(result)
-	return nil
-}
-
-func topicToValue(topic *ethbinding.Hash, input *ethbinding.ABIArgument) interface{} {
-	switch input.Type.T {
-	case ethbinding.IntTy, ethbinding.UintTy, ethbinding.BoolTy:
-		h := ethbinding.HexBigInt{}
-		h.UnmarshalText([]byte(topic.Hex()))
-		bI, _ := ethbind.API.ParseBig256(topic.Hex())
-		if input.Type.T == ethbinding.IntTy {
-			// It will be a two's complement number, so needs to be interpretted
-			bI = ethbind.API.S256(bI)
-			return bI.String()
-		} else if input.Type.T == ethbinding.BoolTy {
-			return (bI.Uint64() != 0)
-		}
-		return bI.String()
-	case ethbinding.AddressTy:
-		topicBytes := topic.Bytes()
-		addrBytes := topicBytes[len(topicBytes)-20:]
-		return ethbind.API.BytesToAddress(addrBytes)
-	default:
-		// For all other types it is just a hash of the output for indexing, so we can only
-		// logically return it as a hex string. The Solidity developer has to include
-		// the same data a second type non-indexed to get the real value.
-		return topic.String()
+	for k, v := range values {
+		result.Data[k] = v
 	}
+	return result, nil
 }
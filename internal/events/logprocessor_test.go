@@ -57,35 +57,6 @@ const sampleEventABIAllIndexedNoData = `
 }
 `
 
-func TestTopicToValue(t *testing.T) {
-	assert := assert.New(t)
-
-	h := ethbind.API.HexToHash("0xffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffcfc7")
-	v := topicToValue(&h, &ethbinding.ABIArgument{Type: ethbind.API.ABITypeKnown("int64")})
-	assert.Equal("-12345", v)
-
-	h = ethbind.API.HexToHash("0x000000000000000000000000000000000000000001d2d490d572353317a01f8d")
-	v = topicToValue(&h, &ethbinding.ABIArgument{Type: ethbind.API.ABITypeKnown("uint256")})
-	assert.Equal("564363245346346345353453453", v)
-
-	h = ethbind.API.HexToHash("0x0000000000000000000000003924d1d6423f88148a4fcc0417a33b27a61d595f")
-	v = topicToValue(&h, &ethbinding.ABIArgument{Type: ethbind.API.ABITypeKnown("address")})
-	assert.Equal(ethbind.API.HexToAddress("0x3924d1D6423F88148A4fcc0417A33B27a61d595f"), v)
-
-	h = ethbind.API.HexToHash("0xdc47fb175244491f21a29733a67d2e07647d59d2f36f2603d339299587182f19")
-	v = topicToValue(&h, &ethbinding.ABIArgument{Type: ethbind.API.ABITypeKnown("string")})
-	assert.Equal("0xdc47fb175244491f21a29733a67d2e07647d59d2f36f2603d339299587182f19", v)
-
-	h = ethbind.API.HexToHash("0x0000000000000000000000000000000000000000000000000000000000000000")
-	v = topicToValue(&h, &ethbinding.ABIArgument{Type: ethbind.API.ABITypeKnown("bool")})
-	assert.Equal(false, v)
-
-	h = ethbind.API.HexToHash("0x0000000000000000000000000000000000000000000000000000000000000001")
-	v = topicToValue(&h, &ethbinding.ABIArgument{Type: ethbind.API.ABITypeKnown("bool")})
-	assert.Equal(true, v)
-
-}
-
 func TestProcessLogEntryNillAndTooFewFields(t *testing.T) {
 	assert := assert.New(t)
 
@@ -127,6 +98,7 @@ func TestProcessLogBadRLPData(t *testing.T) {
 		Timestamps: false,
 	}
 	stream := &eventStream{
+		sm:          &mockSubMgr{},
 		spec:        spec,
 		eventStream: make(chan *eventData, 1),
 	}
@@ -161,6 +133,7 @@ func TestProcessLogSampleEvent(t *testing.T) {
 		Timestamps: false,
 	}
 	stream := &eventStream{
+		sm:          &mockSubMgr{},
 		spec:        spec,
 		eventStream: make(chan *eventData, 1),
 	}
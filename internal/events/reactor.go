@@ -0,0 +1,48 @@
+// Copyright 2021 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package events
+
+import (
+	"encoding/json"
+)
+
+// EventReactor is passed each event dispatched by a subscription, once it has the confirmations
+// required by its stream, so transactions can be triggered by events. The event is passed in the
+// JSON form that is delivered to the stream. Events retracted after a re-org are not passed
+type EventReactor interface {
+	ReactToEvent(subID string, event map[string]interface{})
+}
+
+// SetEventReactor sets the reactor passed each event, replacing any set before
+func (s *subscriptionMGR) SetEventReactor(reactor EventReactor) {
+	s.reactorLock.Lock()
+	defer s.reactorLock.Unlock()
+	s.reactor = reactor
+}
+
+// react passes an event to the reactor, if there is one. Called as each event is dispatched,
+// ahead of its batching and delivery by the stream, so the reactor must not block
+func (s *subscriptionMGR) react(event *eventData) {
+	s.reactorLock.RLock()
+	reactor := s.reactor
+	s.reactorLock.RUnlock()
+	if reactor == nil {
+		return
+	}
+	eventBytes, _ := json.Marshal(event)
+	var eventMap map[string]interface{}
+	json.Unmarshal(eventBytes, &eventMap)
+	reactor.ReactToEvent(event.SubID, eventMap)
+}
@@ -0,0 +1,50 @@
+// Copyright 2021 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package events
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type testReactor struct {
+	subIDs []string
+	events []map[string]interface{}
+}
+
+func (r *testReactor) ReactToEvent(subID string, event map[string]interface{}) {
+	r.subIDs = append(r.subIDs, subID)
+	r.events = append(r.events, event)
+}
+
+func TestReactToEvent(t *testing.T) {
+	assert := assert.New(t)
+	sm := newTestSubscriptionManager()
+
+	// No reactor set
+	sm.react(&eventData{SubID: "sub1"})
+
+	reactor := &testReactor{}
+	sm.SetEventReactor(reactor)
+	sm.react(&eventData{
+		SubID:       "sub1",
+		BlockNumber: "100",
+		Data:        map[string]interface{}{"amount": "10"},
+	})
+	assert.Equal([]string{"sub1"}, reactor.subIDs)
+	assert.Equal("100", reactor.events[0]["blockNumber"])
+	assert.Equal(map[string]interface{}{"amount": "10"}, reactor.events[0]["data"])
+}
@@ -0,0 +1,178 @@
+// Copyright 2021 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package events
+
+import (
+	"context"
+	"math/big"
+
+	"github.com/kaleido-io/ethconnect/internal/ethbind"
+	log "github.com/sirupsen/logrus"
+)
+
+// trackedBlock is a block that events have been delivered from, with its hash at the
+// time, so the events can be retracted if the block is replaced by a re-org
+type trackedBlock struct {
+	number *big.Int
+	hash   string
+	events []*trackedEvent
+}
+
+type trackedEvent struct {
+	key   string
+	event *eventData
+}
+
+// trackEvent records the block of an event being delivered, when the stream checks for
+// re-orgs. Blocks more than the re-org depth behind the newest are no longer tracked
+func (lp *logProcessor) trackEvent(key string, blockNumber *big.Int, blockHash string, event *eventData) {
+	depth := lp.stream.spec.ReorgDepth
+	if depth == 0 {
+		return
+	}
+	lp.hwnSync.Lock()
+	defer lp.hwnSync.Unlock()
+	var block *trackedBlock
+	for _, tb := range lp.tracked {
+		if tb.number.Cmp(blockNumber) == 0 && tb.hash == blockHash {
+			block = tb
+			break
+		}
+	}
+	if block == nil {
+		block = &trackedBlock{number: new(big.Int).Set(blockNumber), hash: blockHash}
+		// Insert in block order, which is the order events are normally delivered in
+		i := len(lp.tracked)
+		for i > 0 && lp.tracked[i-1].number.Cmp(blockNumber) > 0 {
+			i--
+		}
+		lp.tracked = append(lp.tracked, nil)
+		copy(lp.tracked[i+1:], lp.tracked[i:])
+		lp.tracked[i] = block
+	}
+	for _, te := range block.events {
+		if te.key == key {
+			te.event = event
+			return
+		}
+	}
+	block.events = append(block.events, &trackedEvent{key: key, event: event})
+
+	oldest := new(big.Int).Sub(lp.tracked[len(lp.tracked)-1].number, new(big.Int).SetUint64(depth))
+	for len(lp.tracked) > 0 && lp.tracked[0].number.Cmp(oldest) < 0 {
+		lp.tracked = lp.tracked[1:]
+	}
+}
+
+// untrackEvent stops tracking an event the node has reported as removed, as it has
+// been retracted already
+func (lp *logProcessor) untrackEvent(key string) {
+	lp.hwnSync.Lock()
+	defer lp.hwnSync.Unlock()
+	for _, tb := range lp.tracked {
+		for i, te := range tb.events {
+			if te.key == key {
+				tb.events = append(tb.events[:i], tb.events[i+1:]...)
+				return
+			}
+		}
+	}
+}
+
+func (lp *logProcessor) trackedBlocks() []*trackedBlock {
+	lp.hwnSync.Lock()
+	defer lp.hwnSync.Unlock()
+	return append([]*trackedBlock{}, lp.tracked...)
+}
+
+// removeTracked stops tracking the blocks from the index supplied, which have been orphaned
+func (lp *logProcessor) removeTracked(from int) {
+	lp.hwnSync.Lock()
+	defer lp.hwnSync.Unlock()
+	if from < len(lp.tracked) {
+		lp.tracked = lp.tracked[:from]
+	}
+}
+
+// retract delivers an event again, flagged as removed. The HWM does not move when the
+// batch is acknowledged, as it is being moved back to re-read the chain
+func (lp *logProcessor) retract(subInfo string, event *eventData) {
+	removed := *event
+	removed.Removed = true
+	removed.batchComplete = func(*eventData) {}
+	log.Infof("%s: Retracting event. Address=%s BlockNumber=%s TxIndex=%s", subInfo, removed.Address, removed.BlockNumber, removed.TransactionIndex)
+	lp.stream.sm.invalidateCaches(removed.Address, lp.event.Name, removed.BlockNumber)
+	lp.stream.handleEvent(&removed)
+}
+
+// rewindBlockHWM moves the HWM back to a block, so the blocks from it are read again
+func (lp *logProcessor) rewindBlockHWM(blockNumber *big.Int) {
+	lp.hwnSync.Lock()
+	defer lp.hwnSync.Unlock()
+	if lp.blockHWM.Cmp(blockNumber) > 0 {
+		lp.blockHWM.Set(blockNumber)
+	}
+	if lp.highestDispatched.Cmp(blockNumber) >= 0 {
+		lp.highestDispatched.Sub(blockNumber, big.NewInt(1))
+	}
+	lp.lastDelivered = nil
+}
+
+// checkReorg checks the newest block events were delivered from is still in the chain.
+// If it has been replaced by a re-org, the tracked blocks are checked newest first to find
+// the common ancestor of the old and new chains. The events from the orphaned blocks are
+// retracted, and the subscription reads the chain again from the block after the ancestor.
+// Returns true if a re-org was found
+func (s *subscription) checkReorg(ctx context.Context) (bool, error) {
+	tracked := s.lp.trackedBlocks()
+	if len(tracked) == 0 {
+		return false, nil
+	}
+	ancestor := -1
+	for i := len(tracked) - 1; i >= 0; i-- {
+		var block *blockHeader
+		if err := s.rpcCall(ctx, &block, "eth_getBlockByNumber", ethbind.API.EncodeBig(tracked[i].number), false); err != nil {
+			return false, err
+		}
+		if block != nil && block.Hash.String() == tracked[i].hash {
+			ancestor = i
+			break
+		}
+	}
+	if ancestor == len(tracked)-1 {
+		return false, nil
+	}
+
+	var from *big.Int
+	if ancestor >= 0 {
+		from = new(big.Int).Add(tracked[ancestor].number, big.NewInt(1))
+		log.Warnf("%s: Chain re-org detected. Common ancestor block %s (%s)", s.logName, tracked[ancestor].number.String(), tracked[ancestor].hash)
+	} else {
+		// The re-org is deeper than the blocks we track, so we read again from the oldest one
+		from = new(big.Int).Set(tracked[0].number)
+		log.Warnf("%s: Chain re-org detected deeper than the tracked blocks. Reading again from block %s", s.logName, from.String())
+	}
+	// The events are retracted newest first, undoing them in the reverse order they were delivered
+	for i := len(tracked) - 1; i > ancestor; i-- {
+		events := tracked[i].events
+		for j := len(events) - 1; j >= 0; j-- {
+			s.lp.retract(s.logName, events[j].event)
+		}
+	}
+	s.lp.removeTracked(ancestor + 1)
+	s.lp.rewindBlockHWM(from)
+	s.markFilterStale(ctx, true)
+	return true, nil
+}
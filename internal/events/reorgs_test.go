@@ -0,0 +1,240 @@
+// Copyright 2021 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package events
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"testing"
+
+	ethbinding "github.com/kaleido-io/ethbinding/pkg"
+	"github.com/kaleido-io/ethconnect/internal/eth"
+	"github.com/kaleido-io/ethconnect/internal/ethbind"
+	"github.com/stretchr/testify/assert"
+)
+
+// testReorgChain returns the hash of each block from hashes, and null for blocks it does not have
+type testReorgChain struct {
+	hashes     map[int64]string
+	blockCalls int
+	methods    []string
+}
+
+func newTestReorgSub(depth uint64, chain *testReorgChain) *subscription {
+	stream := &eventStream{
+		sm:          &mockSubMgr{},
+		spec:        &StreamInfo{ReorgDepth: depth},
+		eventStream: make(chan *eventData, 10),
+	}
+	var marshaling ethbinding.ABIElementMarshaling
+	json.Unmarshal([]byte(sampleEventABIAllIndexedNoData), &marshaling)
+	event, _ := ethbind.API.ABIElementMarshalingToABIEvent(&marshaling)
+	return &subscription{
+		logName:     "ut",
+		lp:          newLogProcessor("sub1", event, stream),
+		filterStale: true,
+		rpc: eth.NewMockRPCClientForSync(nil, func(method string, res interface{}, args ...interface{}) {
+			chain.methods = append(chain.methods, method)
+			if method == "eth_getBlockByNumber" {
+				chain.blockCalls++
+				n, _ := new(big.Int).SetString(args[0].(string)[2:], 16)
+				if hash, ok := chain.hashes[n.Int64()]; ok {
+					json.Unmarshal([]byte(fmt.Sprintf(`{"hash":"%s"}`, hash)), res)
+				} else {
+					json.Unmarshal([]byte(`null`), res)
+				}
+			}
+		}),
+	}
+}
+
+func testReorgHash(i int) string {
+	return fmt.Sprintf("0x%064x", i)
+}
+
+func testReorgLog(block int64, hash string, txIndex uint, removed bool) *logEntry {
+	l := testConfirmationsLog(removed)
+	l.BlockNumber.ToInt().SetInt64(block)
+	l.BlockHash = ethbind.API.HexToHash(hash)
+	l.TransactionIndex = ethbinding.HexUint(txIndex)
+	l.LogIndex = json.RawMessage(fmt.Sprintf(`"0x%x"`, txIndex))
+	return l
+}
+
+func TestCheckReorgNoReorg(t *testing.T) {
+	assert := assert.New(t)
+	chain := &testReorgChain{hashes: map[int64]string{100: testReorgHash(1)}}
+	s := newTestReorgSub(10, chain)
+
+	reorged, err := s.checkReorg(context.Background())
+	assert.NoError(err)
+	assert.False(reorged)
+	assert.Zero(chain.blockCalls)
+
+	err = s.lp.processLogEntry(s.logName, testReorgLog(100, testReorgHash(1), 0, false), 0)
+	assert.NoError(err)
+	<-s.lp.stream.eventStream
+	reorged, err = s.checkReorg(context.Background())
+	assert.NoError(err)
+	assert.False(reorged)
+	assert.Equal(1, chain.blockCalls)
+	assert.Len(s.lp.tracked, 1)
+}
+
+func TestCheckReorgRetractsOrphanedEvents(t *testing.T) {
+	assert := assert.New(t)
+	chain := &testReorgChain{hashes: map[int64]string{100: testReorgHash(1), 102: testReorgHash(2), 103: testReorgHash(3)}}
+	s := newTestReorgSub(10, chain)
+	s.lp.initBlockHWM(big.NewInt(99))
+
+	for _, l := range []*logEntry{
+		testReorgLog(100, testReorgHash(1), 0, false),
+		testReorgLog(102, testReorgHash(2), 1, false),
+		testReorgLog(102, testReorgHash(2), 2, false),
+		testReorgLog(103, testReorgHash(3), 3, false),
+	} {
+		err := s.lp.processLogEntry(s.logName, l, 0)
+		assert.NoError(err)
+	}
+	for i := 0; i < 4; i++ {
+		ev := <-s.lp.stream.eventStream
+		assert.False(ev.Removed)
+		ev.batchComplete(ev)
+	}
+	hwm := s.lp.getBlockHWM()
+	assert.Equal(int64(104), hwm.Int64())
+
+	// Blocks 102 and 103 are replaced
+	chain.hashes[102] = testReorgHash(12)
+	chain.hashes[103] = testReorgHash(13)
+	s.filterStale = false
+	reorged, err := s.checkReorg(context.Background())
+	assert.NoError(err)
+	assert.True(reorged)
+	assert.Equal(3, chain.blockCalls)
+	assert.True(s.filterStale)
+
+	assert.Len(s.lp.stream.eventStream, 3)
+	for _, txIndex := range []string{"0x3", "0x2", "0x1"} {
+		ev := <-s.lp.stream.eventStream
+		assert.True(ev.Removed)
+		assert.Equal(txIndex, ev.TransactionIndex)
+		ev.batchComplete(ev)
+	}
+	hwm = s.lp.getBlockHWM()
+	assert.Equal(int64(101), hwm.Int64())
+	assert.Nil(s.lp.getLastDelivered())
+	assert.Len(s.lp.tracked, 1)
+
+	s.lp.markNoEvents(big.NewInt(101))
+	hwm = s.lp.getBlockHWM()
+	assert.Equal(int64(101), hwm.Int64())
+}
+
+func TestCheckReorgDeeperThanTracked(t *testing.T) {
+	assert := assert.New(t)
+	chain := &testReorgChain{hashes: map[int64]string{}}
+	s := newTestReorgSub(10, chain)
+	s.lp.initBlockHWM(big.NewInt(102))
+
+	err := s.lp.processLogEntry(s.logName, testReorgLog(100, testReorgHash(1), 0, false), 0)
+	assert.NoError(err)
+	err = s.lp.processLogEntry(s.logName, testReorgLog(101, testReorgHash(2), 0, false), 0)
+	assert.NoError(err)
+	<-s.lp.stream.eventStream
+	<-s.lp.stream.eventStream
+
+	reorged, err := s.checkReorg(context.Background())
+	assert.NoError(err)
+	assert.True(reorged)
+	assert.Len(s.lp.stream.eventStream, 2)
+	assert.Empty(s.lp.tracked)
+	hwm := s.lp.getBlockHWM()
+	assert.Equal(int64(100), hwm.Int64())
+}
+
+func TestCheckReorgRPCError(t *testing.T) {
+	assert := assert.New(t)
+	s := newTestReorgSub(10, &testReorgChain{})
+	err := s.lp.processLogEntry(s.logName, testReorgLog(100, testReorgHash(1), 0, false), 0)
+	assert.NoError(err)
+
+	s.rpc = eth.NewMockRPCClientForSync(fmt.Errorf("pop"), nil)
+	reorged, err := s.checkReorg(context.Background())
+	assert.EqualError(err, "eth_getBlockByNumber returned: pop")
+	assert.False(reorged)
+	assert.Len(s.lp.tracked, 1)
+
+	s.rpc = &testFailingRPC{
+		MockRPCClient: eth.NewMockRPCClientForSync(nil, nil),
+		failMethod:    "eth_getBlockByNumber",
+	}
+	err = s.processNewEvents(context.Background())
+	assert.EqualError(err, "eth_getBlockByNumber returned: pop")
+	assert.False(s.filteredOnce)
+}
+
+func TestTrackEventDepthAndDisabled(t *testing.T) {
+	assert := assert.New(t)
+	s := newTestReorgSub(5, &testReorgChain{})
+
+	for _, block := range []int64{100, 103, 102, 106, 106} {
+		err := s.lp.processLogEntry(s.logName, testReorgLog(block, testReorgHash(int(block)), 0, false), 0)
+		assert.NoError(err)
+	}
+	assert.Len(s.lp.tracked, 3)
+	assert.Equal(int64(102), s.lp.tracked[0].number.Int64())
+	assert.Equal(int64(103), s.lp.tracked[1].number.Int64())
+	assert.Equal(int64(106), s.lp.tracked[2].number.Int64())
+	assert.Len(s.lp.tracked[2].events, 1)
+
+	// A removed log reported by the node is retracted straight away, so is no longer tracked
+	err := s.lp.processLogEntry(s.logName, testReorgLog(106, testReorgHash(106), 0, true), 0)
+	assert.NoError(err)
+	assert.Empty(s.lp.tracked[2].events)
+
+	s.lp.stream.spec.ReorgDepth = 0
+	s.lp.tracked = nil
+	err = s.lp.processLogEntry(s.logName, testReorgLog(107, testReorgHash(107), 0, false), 0)
+	assert.NoError(err)
+	assert.Empty(s.lp.tracked)
+}
+
+func TestProcessNewEventsReorg(t *testing.T) {
+	assert := assert.New(t)
+	chain := &testReorgChain{hashes: map[int64]string{}}
+	s := newTestReorgSub(10, chain)
+	err := s.lp.processLogEntry(s.logName, testReorgLog(100, testReorgHash(1), 0, false), 0)
+	assert.NoError(err)
+	s.filterStale = false
+
+	err = s.processNewEvents(context.Background())
+	assert.NoError(err)
+	assert.Equal([]string{"eth_getFilterLogs", "eth_getBlockByNumber", "eth_uninstallFilter"}, chain.methods)
+	assert.True(s.filterStale)
+	assert.False(s.filteredOnce)
+
+	chain.methods = nil
+	s.info = &SubscriptionInfo{}
+	s.catchupBlock = big.NewInt(100)
+	s.catchupModePageSize = 10
+	s.lp.trackEvent("key", big.NewInt(100), testReorgHash(1), &eventData{})
+	err = s.processNewEvents(context.Background())
+	assert.NoError(err)
+	assert.Equal([]string{"eth_getLogs", "eth_getBlockByNumber"}, chain.methods)
+	assert.Equal(int64(100), s.catchupBlock.Int64())
+}
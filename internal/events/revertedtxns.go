@@ -0,0 +1,266 @@
+// Copyright 2021 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package events
+
+import (
+	"context"
+	"math/big"
+	"strconv"
+	"time"
+
+	ethbinding "github.com/kaleido-io/ethbinding/pkg"
+	"github.com/kaleido-io/ethconnect/internal/errors"
+	"github.com/kaleido-io/ethconnect/internal/eth"
+	"github.com/kaleido-io/ethconnect/internal/ethbind"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// SubscriptionTypeRevertedTransactions is a subscription to the transactions sent to a contract
+	// that were mined, but reverted. Subscriptions without a type are to the events of a contract
+	SubscriptionTypeRevertedTransactions = "revertedTransactions"
+	// revertedTxnSignature is the signature of the events delivered for reverted transactions
+	revertedTxnSignature = "RevertedTransaction"
+)
+
+// blockTxn is the part of a transaction in a block from eth_getBlockByNumber we need
+// to find and decode the transactions sent to a contract
+type blockTxn struct {
+	Hash             ethbinding.Hash      `json:"hash"`
+	From             ethbinding.Address   `json:"from"`
+	To               *ethbinding.Address  `json:"to"`
+	Input            ethbinding.HexBytes  `json:"input"`
+	Value            ethbinding.HexBigInt `json:"value"`
+	Gas              ethbinding.HexUint64 `json:"gas"`
+	TransactionIndex ethbinding.HexUint   `json:"transactionIndex"`
+}
+
+// txnBlock is a block from eth_getBlockByNumber, with the full transactions
+type txnBlock struct {
+	Number       ethbinding.HexBigInt `json:"number"`
+	Timestamp    ethbinding.HexUint64 `json:"timestamp"`
+	Transactions []*blockTxn          `json:"transactions"`
+}
+
+// revertedTxnDecoder decodes the calldata of reverted transactions against the functions of
+// the ABI of the subscription, and the revert reason against its custom errors
+type revertedTxnDecoder struct {
+	methods map[string]*ethbinding.ABIMethod
+	errors  ethbinding.ABIMarshaling
+}
+
+func newRevertedTxnDecoder(abi ethbinding.ABIMarshaling) *revertedTxnDecoder {
+	d := &revertedTxnDecoder{
+		methods: make(map[string]*ethbinding.ABIMethod),
+		errors:  eth.ErrorABIs(abi),
+	}
+	for i := range abi {
+		if abi[i].Type != "function" {
+			continue
+		}
+		method, err := ethbind.API.ABIElementMarshalingToABIMethod(&abi[i])
+		if err != nil {
+			log.Warnf("Invalid method '%s' in ABI: %s", abi[i].Name, err)
+			continue
+		}
+		d.methods[ethbind.API.HexEncode(method.ID)] = method
+	}
+	return d
+}
+
+// decodeInput finds the method called by the calldata of a transaction, and decodes its inputs
+func (d *revertedTxnDecoder) decodeInput(input []byte) (*ethbinding.ABIMethod, map[string]interface{}) {
+	if len(input) < 4 {
+		return nil, nil
+	}
+	method, ok := d.methods[ethbind.API.HexEncode(input[0:4])]
+	if !ok {
+		return nil, nil
+	}
+	return method, eth.ProcessRLPBytes(method.Inputs, input[4:])
+}
+
+func newRevertedTxnSubscription(sm subscriptionManager, rpc eth.RPCClient, stream *eventStream, addr *ethbinding.Address, i *SubscriptionInfo) (*subscription, error) {
+	if addr == nil {
+		return nil, errors.Errorf(errors.EventStreamsRevertedTxnsNoAddress)
+	}
+	s := restoreRevertedTxnSubscription(sm, rpc, stream, i)
+	i.Filter.Addresses = []ethbinding.Address{*addr}
+	i.Summary = addr.String() + ":" + revertedTxnSignature
+	if i.Name == "" {
+		log.Debugf("No name provided for subscription, using auto-generated summary:%s", i.Summary)
+		i.Name = i.Summary
+	}
+	log.Infof("Created subscription ID:%s name:%s to reverted transactions", i.ID, i.Name)
+	return s, nil
+}
+
+func restoreRevertedTxnSubscription(sm subscriptionManager, rpc eth.RPCClient, stream *eventStream, i *SubscriptionInfo) *subscription {
+	return &subscription{
+		info:                i,
+		rpc:                 rpc,
+		lp:                  newLogProcessor(i.ID, nil, stream),
+		logName:             i.ID + ":" + revertedTxnSignature,
+		reverted:            newRevertedTxnDecoder(i.ABI),
+		filterStale:         true,
+		catchupModeBlockGap: sm.config().CatchupModeBlockGap,
+		catchupModePageSize: sm.config().CatchupModePageSize,
+		catchupThrottle:     sm.catchupThrottle(i.Tenant),
+	}
+}
+
+// processRevertedTxns scans the blocks from the position of the subscription up to the head of
+// the chain, a page at a time, for transactions to the contract that reverted. There is no
+// filter on the node for failed transactions, so the scan always works like catchup mode
+func (s *subscription) processRevertedTxns(ctx context.Context) error {
+	return s.scanBlocks(ctx, "reverted transactions", 0, s.processRevertedTxnBlock)
+}
+
+// scanBlocks passes each block from the position of the subscription up to the head of the
+// chain to processBlock, a page at a time. The newest blocks are left until they have the
+// confirmations given
+func (s *subscription) scanBlocks(ctx context.Context, scanning string, confirmations uint64, processBlock func(context.Context, *big.Int) error) error {
+	blockNumber := ethbinding.HexBigInt{}
+	if err := s.rpcCall(ctx, &blockNumber, "eth_blockNumber"); err != nil {
+		return err
+	}
+	head := blockNumber.ToInt()
+	if confirmations > 1 {
+		head = new(big.Int).Sub(head, new(big.Int).SetUint64(confirmations-1))
+	}
+	endBlock := new(big.Int).Add(s.catchupBlock, big.NewInt(s.catchupModePageSize-1))
+	if endBlock.Cmp(head) > 0 {
+		endBlock.Set(head)
+	}
+	if s.catchupBlock.Cmp(endBlock) <= 0 {
+		log.Debugf("%s: scanning blocks %s -> %s for %s", s.logName, s.catchupBlock.String(), endBlock.String(), scanning)
+	}
+	for s.catchupBlock.Cmp(endBlock) <= 0 {
+		if err := processBlock(ctx, s.catchupBlock); err != nil {
+			return err
+		}
+		s.catchupBlock = new(big.Int).Add(s.catchupBlock, big.NewInt(1))
+		s.lp.markNoEvents(s.catchupBlock)
+	}
+	s.lp.markPolled()
+	return nil
+}
+
+func (s *subscription) processRevertedTxnBlock(ctx context.Context, number *big.Int) error {
+	var block *txnBlock
+	if err := s.rpcCall(ctx, &block, "eth_getBlockByNumber", ethbind.API.EncodeBig(number), true); err != nil {
+		return err
+	}
+	if block == nil {
+		return errors.Errorf(errors.EventStreamsScanBlockNotFound, s.logName, number.String())
+	}
+	idx := 0
+	for _, txn := range block.Transactions {
+		if txn.To == nil || !s.watchesAddress(txn.To) {
+			continue
+		}
+		var receipt eth.TxnReceipt
+		if err := s.rpcCall(ctx, &receipt, "eth_getTransactionReceipt", txn.Hash); err != nil {
+			return err
+		}
+		if receipt.Status == nil || receipt.Status.ToInt().Sign() != 0 {
+			continue
+		}
+		result := s.decodeRevertedTxn(ctx, block, txn, &receipt, idx)
+		s.lp.dispatchScanned(s.logName, result, number)
+		idx++
+	}
+	return nil
+}
+
+func (s *subscription) watchesAddress(addr *ethbinding.Address) bool {
+	for _, watched := range s.info.Filter.Addresses {
+		if watched == *addr {
+			return true
+		}
+	}
+	return false
+}
+
+// decodeRevertedTxn builds the event for a reverted transaction, with the decoded calldata,
+// and the revert reason if the node can replay the transaction
+func (s *subscription) decodeRevertedTxn(ctx context.Context, block *txnBlock, txn *blockTxn, receipt *eth.TxnReceipt, idx int) *eventData {
+	result := &eventData{
+		Address:          txn.To.String(),
+		BlockNumber:      block.Number.ToInt().String(),
+		TransactionIndex: txn.TransactionIndex.String(),
+		TransactionHash:  txn.Hash.String(),
+		Signature:        revertedTxnSignature,
+		Data: map[string]interface{}{
+			"from":  txn.From.String(),
+			"value": txn.Value.ToInt().String(),
+		},
+		SubID:    s.info.ID,
+		LogIndex: strconv.Itoa(idx),
+	}
+	if s.lp.stream.spec.Timestamps {
+		result.Timestamp = strconv.FormatUint(uint64(block.Timestamp), 10)
+	}
+	if receipt.GasUsed != nil {
+		result.Data["gasUsed"] = receipt.GasUsed.ToInt().String()
+	}
+	if method, inputs := s.reverted.decodeInput(txn.Input); method != nil {
+		result.Data["method"] = method.Name
+		result.Data["methodSignature"] = method.Sig
+		result.Data["inputs"] = inputs
+	} else {
+		result.Data["input"] = ethbind.API.HexEncode(txn.Input)
+	}
+
+	data := txn.Input
+	gas := txn.Gas
+	txArgs := &eth.SendTXArgs{
+		From:  txn.From.Hex(),
+		To:    txn.To.Hex(),
+		Gas:   &gas,
+		Value: txn.Value,
+		Data:  &data,
+	}
+	if reason := eth.ReplayRevertReason(ctx, s.rpc, txn.Hash.String(), txArgs, block.Number.ToInt(), s.reverted.errors); reason != "" {
+		result.Data["revertReason"] = reason
+	}
+	return result
+}
+
+func (s *subscription) rpcCall(ctx context.Context, result interface{}, method string, args ...interface{}) error {
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	if err := s.rpc.CallContext(ctx, result, method, args...); err != nil {
+		return errors.Errorf(errors.RPCCallReturnedError, method, err)
+	}
+	return nil
+}
+
+// dispatchScanned passes an event found by scanning the chain to the stream, rather than read
+// from a log. Events with no block, such as pending transactions, do not move the HWM
+func (lp *logProcessor) dispatchScanned(subInfo string, result *eventData, blockNumber *big.Int) {
+	if result.batchComplete == nil {
+		result.batchComplete = lp.batchComplete
+	}
+	log.Infof("%s: Dispatching %s. Address=%s BlockNumber=%s TxHash=%s", subInfo, result.Signature, result.Address, result.BlockNumber, result.TransactionHash)
+	if blockNumber != nil {
+		lp.hwnSync.Lock()
+		if blockNumber.Cmp(&lp.highestDispatched) > 0 {
+			lp.highestDispatched.Set(blockNumber)
+		}
+		lp.hwnSync.Unlock()
+	}
+	lp.stream.handleEvent(result)
+}
@@ -0,0 +1,250 @@
+// Copyright 2021 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package events
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"path"
+	"testing"
+
+	ethbinding "github.com/kaleido-io/ethbinding/pkg"
+	"github.com/kaleido-io/ethconnect/internal/eth"
+	"github.com/kaleido-io/ethconnect/internal/ethbind"
+	"github.com/kaleido-io/ethconnect/internal/kvstore"
+	"github.com/stretchr/testify/assert"
+)
+
+const testRevertedTxnsABI = `[
+	{"type":"function","name":"transfer","inputs":[{"name":"amount","type":"uint256"}]},
+	{"type":"error","name":"InsufficientBalance","inputs":[{"name":"available","type":"uint256"},{"name":"required","type":"uint256"}]},
+	{"type":"function","name":"bad","inputs":[{"name":"x","type":"badness"}]}
+]`
+
+const (
+	testRevertedTxnsContract = "0x2b8c0ECc76d0759a8F50b2E14A6881367D805832"
+	testRevertedTxnsOther    = "0x0000000000000000000000000000000000000001"
+	testRevertedTxnsFrom     = "0xAA983AD2a0e0eD8ac639277F37be42F2A5d2618c"
+	testRevertedTxnHash      = "0x0000000000000000000000000000000000000000000000000000000000000002"
+)
+
+func testRevertedTxnsSubInfo(t *testing.T) *SubscriptionInfo {
+	var abi ethbinding.ABIMarshaling
+	assert.NoError(t, json.Unmarshal([]byte(testRevertedTxnsABI), &abi))
+	return &SubscriptionInfo{ID: "test", Stream: "streamID", Type: SubscriptionTypeRevertedTransactions, ABI: abi}
+}
+
+func testRevertedTxnsInput(t *testing.T, s *subscription) string {
+	for _, method := range s.reverted.methods {
+		packed, err := method.Inputs.Pack(big.NewInt(5))
+		assert.NoError(t, err)
+		return ethbind.API.HexEncode(append(method.ID, packed...))
+	}
+	return ""
+}
+
+func testRevertedTxnsBlock(input string) string {
+	return fmt.Sprintf(`{
+		"number": "0x10",
+		"timestamp": "0x5f5e100",
+		"transactions": [
+			{"hash": "0x0000000000000000000000000000000000000000000000000000000000000001", "from": "%[1]s", "to": "%[2]s", "input": "%[4]s", "value": "0x0", "gas": "0x5208", "transactionIndex": "0x0"},
+			{"hash": "0x0000000000000000000000000000000000000000000000000000000000000003", "from": "%[1]s", "to": null, "input": "0x", "value": "0x0", "gas": "0x5208", "transactionIndex": "0x1"},
+			{"hash": "0x0000000000000000000000000000000000000000000000000000000000000004", "from": "%[1]s", "to": "%[3]s", "input": "%[4]s", "value": "0x0", "gas": "0x5208", "transactionIndex": "0x2"},
+			{"hash": "%[5]s", "from": "%[1]s", "to": "%[3]s", "input": "%[4]s", "value": "0x64", "gas": "0x5208", "transactionIndex": "0x3"},
+			{"hash": "0x0000000000000000000000000000000000000000000000000000000000000005", "from": "%[1]s", "to": "%[3]s", "input": "0xfeedbeef", "value": "0x0", "gas": "0x5208", "transactionIndex": "0x4"}
+		]
+	}`, testRevertedTxnsFrom, testRevertedTxnsOther, testRevertedTxnsContract, input, testRevertedTxnHash)
+}
+
+func newTestRevertedTxnsSub(t *testing.T, wrangler func(string, interface{}, ...interface{})) (*subscription, *eth.MockRPCClient, chan *eventData) {
+	events := make(chan *eventData, 10)
+	stream := &eventStream{
+		spec:        &StreamInfo{Timestamps: true},
+		eventStream: events,
+	}
+	rpc := eth.NewMockRPCClientForSync(nil, wrangler)
+	addr := ethbind.API.HexToAddress(testRevertedTxnsContract)
+	s, err := newSubscription(&mockSubMgr{stream: stream, conf: &SubscriptionManagerConf{CatchupModePageSize: 250}}, rpc, &addr, testRevertedTxnsSubInfo(t))
+	assert.NoError(t, err)
+	return s, rpc, events
+}
+
+func TestRevertedTxnSubscriptionCreate(t *testing.T) {
+	assert := assert.New(t)
+	m := &mockSubMgr{stream: newTestStream()}
+	rpc := eth.NewMockRPCClientForSync(nil, nil)
+
+	_, err := newSubscription(m, rpc, nil, testRevertedTxnsSubInfo(t))
+	assert.EqualError(err, "A contract address must be specified to subscribe to reverted transactions")
+
+	addr := ethbind.API.HexToAddress(testRevertedTxnsContract)
+	i := testRevertedTxnsSubInfo(t)
+	s, err := newSubscription(m, rpc, &addr, i)
+	assert.NoError(err)
+	assert.Equal(testRevertedTxnsContract+":RevertedTransaction", i.Summary)
+	assert.Equal(i.Summary, i.Name)
+	assert.Equal([]ethbinding.Address{addr}, i.Filter.Addresses)
+	assert.Empty(i.Filter.Topics)
+	assert.Equal(1, len(s.reverted.methods))
+	assert.Equal(1, len(s.reverted.errors))
+
+	s1, err := restoreSubscription(m, rpc, i)
+	assert.NoError(err)
+	assert.NotNil(s1.reverted)
+	assert.Equal("test:RevertedTransaction", s1.logName)
+}
+
+func TestProcessRevertedTxns(t *testing.T) {
+	assert := assert.New(t)
+	var s *subscription
+	revertData := ethbind.API.HexEncode(append(ethbind.Keccak256([]byte("InsufficientBalance(uint256,uint256)"))[0:4], make([]byte, 64)...))
+	s, rpc, events := newTestRevertedTxnsSub(t, func(method string, res interface{}, args ...interface{}) {
+		switch method {
+		case "eth_blockNumber":
+			json.Unmarshal([]byte(`"0x10"`), res)
+		case "eth_getBlockByNumber":
+			json.Unmarshal([]byte(testRevertedTxnsBlock(testRevertedTxnsInput(t, s))), res)
+		case "eth_getTransactionReceipt":
+			status := "0x1"
+			if hash := args[0].(ethbinding.Hash); hash.String() == testRevertedTxnHash || hash.String() == "0x0000000000000000000000000000000000000000000000000000000000000005" {
+				status = "0x0"
+			}
+			json.Unmarshal([]byte(`{"status":"`+status+`","gasUsed":"0x5000"}`), res)
+		case "eth_call":
+			*(res.(*string)) = revertData
+		}
+	})
+
+	ctx := context.Background()
+	s.setCheckpointBlockHeight(big.NewInt(0x10))
+	assert.NoError(s.restartFilter(ctx, big.NewInt(0x10)))
+	assert.False(s.filterStale)
+	assert.NoError(s.processNewEvents(ctx))
+	assert.Equal(int64(0x11), s.catchupBlock.Int64())
+
+	event := <-events
+	assert.Equal(testRevertedTxnsContract, event.Address)
+	assert.Equal("16", event.BlockNumber)
+	assert.Equal("0x3", event.TransactionIndex)
+	assert.Equal(testRevertedTxnHash, event.TransactionHash)
+	assert.Equal("RevertedTransaction", event.Signature)
+	assert.Equal("0", event.LogIndex)
+	assert.Equal("100000000", event.Timestamp)
+	assert.Equal(testRevertedTxnsFrom, event.Data["from"])
+	assert.Equal("100", event.Data["value"])
+	assert.Equal("20480", event.Data["gasUsed"])
+	assert.Equal("transfer", event.Data["method"])
+	assert.Equal("transfer(uint256)", event.Data["methodSignature"])
+	assert.Equal(map[string]interface{}{"amount": "5"}, event.Data["inputs"])
+	assert.Equal(`InsufficientBalance({"available":"0","required":"0"})`, event.Data["revertReason"])
+	event.batchComplete(event)
+
+	event = <-events
+	assert.Equal("1", event.LogIndex)
+	assert.Equal("0xfeedbeef", event.Data["input"])
+	assert.Nil(event.Data["method"])
+	assert.Len(events, 0)
+	hwm := s.blockHWM()
+	assert.Equal(int64(0x11), hwm.Int64())
+
+	// Nothing more to scan until the head moves
+	assert.NoError(s.processNewEvents(ctx))
+	assert.Equal("eth_blockNumber", rpc.MethodCapture)
+
+	// There is no filter to uninstall, so the scan restarts from the checkpoint
+	s.markFilterStale(ctx, true)
+	assert.True(s.filterStale)
+	assert.Nil(s.catchupBlock)
+	assert.Equal("eth_blockNumber", rpc.MethodCapture)
+}
+
+func TestProcessRevertedTxnsFailures(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+
+	s, _, _ := newTestRevertedTxnsSub(t, nil)
+	s.rpc = eth.NewMockRPCClientForSync(fmt.Errorf("pop"), nil)
+	s.catchupBlock = big.NewInt(0)
+	assert.EqualError(s.processNewEvents(ctx), "eth_blockNumber returned: pop")
+
+	s, _, _ = newTestRevertedTxnsSub(t, nil)
+	s.catchupBlock = big.NewInt(0)
+	assert.EqualError(s.processNewEvents(ctx), "test:RevertedTransaction: Block 0 was not found")
+	assert.Equal(int64(0), s.catchupBlock.Int64())
+
+	s, rpc, _ := newTestRevertedTxnsSub(t, func(method string, res interface{}, args ...interface{}) {
+		if method == "eth_getBlockByNumber" {
+			json.Unmarshal([]byte(testRevertedTxnsBlock("0x")), res)
+		}
+	})
+	s.catchupBlock = big.NewInt(0)
+	s.rpc = &failingReceiptRPC{MockRPCClient: rpc}
+	assert.EqualError(s.processNewEvents(ctx), "eth_getTransactionReceipt returned: pop")
+}
+
+type failingReceiptRPC struct {
+	*eth.MockRPCClient
+}
+
+func (f *failingReceiptRPC) CallContext(ctx context.Context, result interface{}, method string, args ...interface{}) error {
+	if method == "eth_getTransactionReceipt" {
+		return fmt.Errorf("pop")
+	}
+	return f.MockRPCClient.CallContext(ctx, result, method, args...)
+}
+
+func TestAddRevertedTxnSubscription(t *testing.T) {
+	assert := assert.New(t)
+	dir := tempdir(t)
+	defer cleanup(t, dir)
+	sm := newTestSubscriptionManager()
+	sm.db, _ = kvstore.NewLDBKeyValueStore(path.Join(dir, "db"))
+	defer sm.db.Close()
+
+	ctx := context.Background()
+	stream, err := sm.AddStream(ctx, &StreamInfo{
+		Type:      "webhook",
+		Webhook:   &webhookActionInfo{URL: "http://test.invalid"},
+		Suspended: true,
+	})
+	assert.NoError(err)
+
+	info := testRevertedTxnsSubInfo(t)
+	addr := ethbind.API.HexToAddress(testRevertedTxnsContract)
+	sub, err := sm.AddRevertedTxnSubscription(ctx, &addr, info.ABI, stream.ID, "12345", "failures")
+	assert.NoError(err)
+	assert.Equal(SubscriptionTypeRevertedTransactions, sub.Type)
+	assert.Equal("failures", sub.Name)
+	assert.Equal("12345", sub.FromBlock)
+	assert.Nil(sub.Event)
+
+	_, err = sm.AddRevertedTxnSubscription(ctx, nil, info.ABI, stream.ID, "", "")
+	assert.EqualError(err, "A contract address must be specified to subscribe to reverted transactions")
+	_, err = sm.AddRevertedTxnSubscription(ctx, &addr, info.ABI, stream.ID, "badness", "")
+	assert.EqualError(err, "FromBlock cannot be parsed as a BigInt")
+
+	// The subscription is restored with its type on restart
+	sm.subscriptions = map[string]*subscription{}
+	sm.recoverSubscriptions()
+	restored, err := sm.subscriptionByID(sub.ID)
+	assert.NoError(err)
+	assert.NotNil(restored.reverted)
+	assert.Equal(1, len(restored.reverted.methods))
+
+	sm.Close()
+}
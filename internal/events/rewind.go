@@ -0,0 +1,90 @@
+// Copyright 2021 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package events
+
+import (
+	"context"
+	"math/big"
+	"sort"
+
+	"github.com/kaleido-io/ethconnect/internal/opsevents"
+	log "github.com/sirupsen/logrus"
+)
+
+// SubscriptionCheckpoints returns the block each subscription will read from next, by ID.
+// Subscriptions that have not read any blocks yet are left out
+func (s *subscriptionMGR) SubscriptionCheckpoints(ctx context.Context) map[string]*big.Int {
+	checkpoints := make(map[string]*big.Int)
+	for _, sub := range s.subscriptionList() {
+		hwm := sub.blockHWM()
+		if hwm.Sign() > 0 {
+			checkpoints[sub.info.ID] = &hwm
+		}
+	}
+	return checkpoints
+}
+
+// RewindSubscriptions moves subscriptions back to the checkpoints supplied, after the chain
+// has been reverted to an earlier state. Subscriptions without a checkpoint are moved back to
+// the block supplied. Only subscriptions ahead of their target move, and the rewind is done by
+// the event poller of the stream, so a suspended stream is rewound when resumed.
+// The IDs of the subscriptions a rewind was requested for are returned
+func (s *subscriptionMGR) RewindSubscriptions(ctx context.Context, checkpoints map[string]*big.Int, block *big.Int) []string {
+	ids := []string{}
+	for _, sub := range s.subscriptionList() {
+		target, exists := checkpoints[sub.info.ID]
+		if !exists {
+			target = block
+		}
+		hwm := sub.blockHWM()
+		if hwm.Cmp(target) <= 0 {
+			continue
+		}
+		sub.requestRewind(target)
+		ids = append(ids, sub.info.ID)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+func (s *subscription) requestRewind(block *big.Int) {
+	// As with a reset, the flag is picked up by the event stream thread on the next polling cycle
+	log.Infof("%s: Requested rewind to block %s", s.logName, block.String())
+	s.rewindTo = new(big.Int).Set(block)
+}
+
+// rewind applies a requested rewind to the checkpoint of the stream, if the subscription
+// is ahead of it. Called on the event poller thread. Returns true if the checkpoint changed
+func (s *subscription) rewind(ctx context.Context, checkpoint map[string]*big.Int) bool {
+	rewindTo := s.rewindTo
+	if rewindTo == nil {
+		return false
+	}
+	s.rewindTo = nil
+	if blockHeight, exists := checkpoint[s.info.ID]; !exists || blockHeight.Cmp(rewindTo) <= 0 {
+		return false
+	}
+	log.Infof("%s: Rewinding from block %s to %s", s.logName, checkpoint[s.info.ID].String(), rewindTo.String())
+	opsevents.Publish(opsevents.CheckpointRewound, map[string]interface{}{
+		"subscription": s.info.ID,
+		"stream":       s.info.Stream,
+		"fromBlock":    checkpoint[s.info.ID].String(),
+		"toBlock":      rewindTo.String(),
+	})
+	checkpoint[s.info.ID] = rewindTo
+	s.setCheckpointBlockHeight(rewindTo)
+	s.unsubscribe(ctx, false)
+	return true
+}
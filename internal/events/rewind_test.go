@@ -0,0 +1,87 @@
+// Copyright 2021 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package events
+
+import (
+	"context"
+	"math/big"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestRewindSub(sm *subscriptionMGR, id string, hwm int64) *subscription {
+	sub := &subscription{
+		info:        &SubscriptionInfo{ID: id, Stream: "stream1"},
+		lp:          newLogProcessor(id, nil, newTestStream()),
+		logName:     id,
+		filterStale: true,
+	}
+	sub.lp.initBlockHWM(big.NewInt(hwm))
+	sm.subscriptions[id] = sub
+	return sub
+}
+
+func TestSubscriptionCheckpointsAndRewind(t *testing.T) {
+	assert := assert.New(t)
+	sm := newTestSubscriptionManager()
+	ctx := context.Background()
+
+	sub1 := newTestRewindSub(sm, "sub1", 20)
+	sub2 := newTestRewindSub(sm, "sub2", 8)
+	sub3 := newTestRewindSub(sm, "sub3", 0)
+	sub4 := newTestRewindSub(sm, "sub4", 30)
+
+	checkpoints := sm.SubscriptionCheckpoints(ctx)
+	assert.Equal(3, len(checkpoints))
+	assert.Equal(int64(20), checkpoints["sub1"].Int64())
+	assert.Nil(checkpoints["sub3"])
+
+	// sub4 was created after the snapshot, so moves back to the block after it
+	ids := sm.RewindSubscriptions(ctx, map[string]*big.Int{"sub1": big.NewInt(5), "sub2": big.NewInt(8)}, big.NewInt(11))
+	assert.Equal([]string{"sub1", "sub4"}, ids)
+	assert.Equal(int64(5), sub1.rewindTo.Int64())
+	assert.Nil(sub2.rewindTo)
+	assert.Nil(sub3.rewindTo)
+	assert.Equal(int64(11), sub4.rewindTo.Int64())
+}
+
+func TestSubscriptionRewind(t *testing.T) {
+	assert := assert.New(t)
+	sm := newTestSubscriptionManager()
+	ctx := context.Background()
+	sub := newTestRewindSub(sm, "sub1", 20)
+	checkpoint := map[string]*big.Int{"sub1": big.NewInt(20)}
+
+	assert.False(sub.rewind(ctx, checkpoint))
+
+	sub.requestRewind(big.NewInt(5))
+	sub.resetRequested = true
+	assert.True(sub.rewind(ctx, checkpoint))
+	assert.Nil(sub.rewindTo)
+	assert.Equal(int64(5), checkpoint["sub1"].Int64())
+	hwm := sub.blockHWM()
+	assert.Equal(int64(5), hwm.Int64())
+	assert.True(sub.filterStale)
+	assert.False(sub.resetRequested)
+
+	// The checkpoint already moved back further, or was cleared by a reset
+	sub.requestRewind(big.NewInt(10))
+	assert.False(sub.rewind(ctx, checkpoint))
+	assert.Equal(int64(5), checkpoint["sub1"].Int64())
+	sub.requestRewind(big.NewInt(10))
+	assert.False(sub.rewind(ctx, map[string]*big.Int{}))
+	assert.Nil(sub.rewindTo)
+}
@@ -0,0 +1,193 @@
+// Copyright 2021 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package events
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/kaleido-io/ethconnect/internal/errors"
+)
+
+// MaintenanceWindow suspends a stream for DurationSec each time the cron-style
+// Schedule fires, in the Timezone given (UTC if not set). The schedule has the
+// standard five fields: minute hour day-of-month month day-of-week
+type MaintenanceWindow struct {
+	Schedule    string `json:"schedule"`
+	DurationSec uint64 `json:"durationSec"`
+	Timezone    string `json:"timezone,omitempty"`
+}
+
+type cronField struct {
+	name     string
+	min, max int
+	names    map[string]int
+}
+
+var cronFields = []cronField{
+	{name: "minute", min: 0, max: 59},
+	{name: "hour", min: 0, max: 23},
+	{name: "day-of-month", min: 1, max: 31},
+	{name: "month", min: 1, max: 12, names: map[string]int{
+		"jan": 1, "feb": 2, "mar": 3, "apr": 4, "may": 5, "jun": 6,
+		"jul": 7, "aug": 8, "sep": 9, "oct": 10, "nov": 11, "dec": 12,
+	}},
+	// 7 is accepted as an alias for Sunday
+	{name: "day-of-week", min: 0, max: 7, names: map[string]int{
+		"sun": 0, "mon": 1, "tue": 2, "wed": 3, "thu": 4, "fri": 5, "sat": 6,
+	}},
+}
+
+// cronSchedule is a parsed schedule, with the set of matching values for each field
+type cronSchedule struct {
+	minutes, hours, doms, months, dows map[int]bool
+	domRestricted, dowRestricted       bool
+}
+
+// maintenanceWindow is the runtime form of a MaintenanceWindow
+type maintenanceWindow struct {
+	schedule *cronSchedule
+	duration time.Duration
+	location *time.Location
+}
+
+func parseCronValue(f *cronField, s string) (int, bool) {
+	if v, ok := f.names[strings.ToLower(s)]; ok {
+		return v, true
+	}
+	v, err := strconv.Atoi(s)
+	return v, err == nil && v >= f.min && v <= f.max
+}
+
+// parseCronField parses a comma separated list of values, ranges ("a-b") and steps ("*/n" or "a-b/n")
+func parseCronField(f *cronField, spec string) (map[int]bool, bool) {
+	values := make(map[int]bool)
+	for _, part := range strings.Split(spec, ",") {
+		step := 1
+		if idx := strings.Index(part, "/"); idx >= 0 {
+			var err error
+			if step, err = strconv.Atoi(part[idx+1:]); err != nil || step <= 0 {
+				return nil, false
+			}
+			part = part[0:idx]
+		}
+		start, end := f.min, f.max
+		if part != "*" {
+			bounds := strings.SplitN(part, "-", 2)
+			var ok bool
+			if start, ok = parseCronValue(f, bounds[0]); !ok {
+				return nil, false
+			}
+			end = start
+			if len(bounds) > 1 {
+				if end, ok = parseCronValue(f, bounds[1]); !ok || end < start {
+					return nil, false
+				}
+			} else if step > 1 {
+				end = f.max
+			}
+		}
+		for v := start; v <= end; v += step {
+			values[v] = true
+		}
+	}
+	return values, true
+}
+
+func parseCronSchedule(spec string) (*cronSchedule, error) {
+	fields := strings.Fields(spec)
+	if len(fields) != len(cronFields) {
+		return nil, errors.Errorf(errors.EventStreamsMaintenanceWindowBadSchedule, spec, "expected 5 fields")
+	}
+	parsed := make([]map[int]bool, len(fields))
+	for i, field := range fields {
+		var ok bool
+		if parsed[i], ok = parseCronField(&cronFields[i], field); !ok {
+			return nil, errors.Errorf(errors.EventStreamsMaintenanceWindowBadSchedule, spec, cronFields[i].name)
+		}
+	}
+	if parsed[4][7] {
+		parsed[4][0] = true
+	}
+	return &cronSchedule{
+		minutes:       parsed[0],
+		hours:         parsed[1],
+		doms:          parsed[2],
+		months:        parsed[3],
+		dows:          parsed[4],
+		domRestricted: fields[2] != "*",
+		dowRestricted: fields[4] != "*",
+	}, nil
+}
+
+// matches checks if the schedule fires in the minute of the supplied time.
+// As with cron, when both the day-of-month and day-of-week are restricted, either can match.
+func (c *cronSchedule) matches(t time.Time) bool {
+	if !c.minutes[t.Minute()] || !c.hours[t.Hour()] || !c.months[int(t.Month())] {
+		return false
+	}
+	domMatch := c.doms[t.Day()]
+	dowMatch := c.dows[int(t.Weekday())]
+	if c.domRestricted && c.dowRestricted {
+		return domMatch || dowMatch
+	}
+	return domMatch && dowMatch
+}
+
+func newMaintenanceWindow(w *MaintenanceWindow) (*maintenanceWindow, error) {
+	schedule, err := parseCronSchedule(w.Schedule)
+	if err != nil {
+		return nil, err
+	}
+	if w.DurationSec == 0 {
+		return nil, errors.Errorf(errors.EventStreamsMaintenanceWindowNoDuration, w.Schedule)
+	}
+	location := time.UTC
+	if w.Timezone != "" {
+		if location, err = time.LoadLocation(w.Timezone); err != nil {
+			return nil, errors.Errorf(errors.EventStreamsMaintenanceWindowBadTimezone, w.Timezone, err)
+		}
+	}
+	return &maintenanceWindow{
+		schedule: schedule,
+		duration: time.Duration(w.DurationSec) * time.Second,
+		location: location,
+	}, nil
+}
+
+func newMaintenanceWindows(windows []*MaintenanceWindow) ([]*maintenanceWindow, error) {
+	compiled := make([]*maintenanceWindow, len(windows))
+	for i, w := range windows {
+		var err error
+		if compiled[i], err = newMaintenanceWindow(w); err != nil {
+			return nil, err
+		}
+	}
+	return compiled, nil
+}
+
+// activeAt returns the start of the window that covers the supplied time, if
+// there is one, by searching back through each minute for the duration of the window
+func (w *maintenanceWindow) activeAt(now time.Time) (start time.Time, active bool) {
+	now = now.In(w.location)
+	earliest := now.Add(-w.duration)
+	for t := now.Truncate(time.Minute); t.After(earliest); t = t.Add(-time.Minute) {
+		if w.schedule.matches(t) {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
@@ -0,0 +1,99 @@
+// Copyright 2021 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package events
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCronScheduleMatches(t *testing.T) {
+	assert := assert.New(t)
+
+	c, err := parseCronSchedule("*/15 2-4 * jan,jun sat,sun")
+	assert.NoError(err)
+	// Saturday 5th June 2021
+	assert.True(c.matches(time.Date(2021, 6, 5, 2, 0, 0, 0, time.UTC)))
+	assert.True(c.matches(time.Date(2021, 6, 5, 4, 45, 0, 0, time.UTC)))
+	assert.False(c.matches(time.Date(2021, 6, 5, 4, 50, 0, 0, time.UTC)))
+	assert.False(c.matches(time.Date(2021, 6, 5, 5, 0, 0, 0, time.UTC)))
+	assert.False(c.matches(time.Date(2021, 7, 3, 2, 0, 0, 0, time.UTC)))
+	assert.False(c.matches(time.Date(2021, 6, 7, 2, 0, 0, 0, time.UTC)))
+
+	// 7 is Sunday, and day-of-month or day-of-week can match when both are set
+	c, err = parseCronSchedule("30 1 1 * 7")
+	assert.NoError(err)
+	assert.True(c.matches(time.Date(2021, 6, 1, 1, 30, 0, 0, time.UTC)))
+	assert.True(c.matches(time.Date(2021, 6, 6, 1, 30, 0, 0, time.UTC)))
+	assert.False(c.matches(time.Date(2021, 6, 7, 1, 30, 0, 0, time.UTC)))
+
+	c, err = parseCronSchedule("5/20 0 * * *")
+	assert.NoError(err)
+	assert.Equal(map[int]bool{5: true, 25: true, 45: true}, c.minutes)
+}
+
+func TestCronScheduleBad(t *testing.T) {
+	assert := assert.New(t)
+
+	_, err := parseCronSchedule("* * * *")
+	assert.EqualError(err, "Invalid maintenance window schedule '* * * *': expected 5 fields")
+	_, err = parseCronSchedule("60 * * * *")
+	assert.EqualError(err, "Invalid maintenance window schedule '60 * * * *': minute")
+	_, err = parseCronSchedule("* 5-2 * * *")
+	assert.EqualError(err, "Invalid maintenance window schedule '* 5-2 * * *': hour")
+	_, err = parseCronSchedule("* * 0 * *")
+	assert.EqualError(err, "Invalid maintenance window schedule '* * 0 * *': day-of-month")
+	_, err = parseCronSchedule("* * * foo *")
+	assert.EqualError(err, "Invalid maintenance window schedule '* * * foo *': month")
+	_, err = parseCronSchedule("* * * * */0")
+	assert.EqualError(err, "Invalid maintenance window schedule '* * * * */0': day-of-week")
+}
+
+func TestMaintenanceWindowActiveAt(t *testing.T) {
+	assert := assert.New(t)
+
+	w, err := newMaintenanceWindow(&MaintenanceWindow{
+		Schedule:    "0 22 * * *",
+		DurationSec: 7200,
+		Timezone:    "America/New_York",
+	})
+	assert.NoError(err)
+
+	ny, _ := time.LoadLocation("America/New_York")
+	start, active := w.activeAt(time.Date(2021, 6, 5, 23, 30, 0, 0, ny))
+	assert.True(active)
+	assert.True(time.Date(2021, 6, 5, 22, 0, 0, 0, ny).Equal(start))
+
+	_, active = w.activeAt(time.Date(2021, 6, 6, 0, 0, 0, 0, ny))
+	assert.False(active)
+	_, active = w.activeAt(time.Date(2021, 6, 5, 21, 59, 0, 0, ny))
+	assert.False(active)
+	// 02:30 UTC is 22:30 in New York
+	_, active = w.activeAt(time.Date(2021, 6, 6, 2, 30, 0, 0, time.UTC))
+	assert.True(active)
+}
+
+func TestMaintenanceWindowBadConfig(t *testing.T) {
+	assert := assert.New(t)
+
+	_, err := newMaintenanceWindows([]*MaintenanceWindow{{Schedule: "0 2 * * *"}})
+	assert.EqualError(err, "Maintenance window '0 2 * * *' must have a durationSec")
+	_, err = newMaintenanceWindows([]*MaintenanceWindow{{Schedule: "0 2 * * *", DurationSec: 60, Timezone: "Not/AZone"}})
+	assert.Regexp("Invalid maintenance window timezone 'Not/AZone'", err)
+	_, err = newMaintenanceWindows([]*MaintenanceWindow{{Schedule: "bad"}})
+	assert.Regexp("Invalid maintenance window schedule", err)
+}
@@ -0,0 +1,454 @@
+// Copyright 2021 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package events
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	ethbinding "github.com/kaleido-io/ethbinding/pkg"
+	"github.com/kaleido-io/ethconnect/internal/errors"
+	"github.com/kaleido-io/ethconnect/internal/utils"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// SchemaFormatJSON publishes a JSON Schema (draft-07) of the event payload
+	SchemaFormatJSON = "json"
+	// SchemaFormatAvro publishes an Avro record schema of the event payload
+	SchemaFormatAvro = "avro"
+	// SchemaFormatProtobuf publishes a proto3 message schema of the event payload
+	SchemaFormatProtobuf = "protobuf"
+
+	defaultSchemaSubjectPrefix     = "ethconnect-"
+	defaultSchemaRegistryTimeoutMS = 10000
+	schemaRegistryContentType      = "application/vnd.schemaregistry.v1+json"
+	avroEventNamespace             = "io.kaleido.ethconnect.events"
+	protoEventPackage              = "io.kaleido.ethconnect.events"
+	jsonSchemaIntegerPattern       = "^-?[0-9]+$"
+)
+
+var avroNameRegex = regexp.MustCompile("^[A-Za-z_][A-Za-z0-9_]*$")
+
+// SchemaRegistryConf configures a Confluent compatible schema registry, to which the schema
+// of the decoded event payload is published when each subscription is created
+type SchemaRegistryConf struct {
+	URL           string            `json:"url,omitempty"`
+	Format        string            `json:"format,omitempty"`
+	SubjectPrefix string            `json:"subjectPrefix,omitempty"`
+	Username      string            `json:"username,omitempty"`
+	Password      string            `json:"password,omitempty"`
+	Headers       map[string]string `json:"headers,omitempty"`
+	TimeoutMS     int               `json:"timeout,omitempty"`
+}
+
+// SchemaInfo records the schema published to the registry for a subscription
+type SchemaInfo struct {
+	Subject string `json:"subject"`
+	ID      int    `json:"id"`
+	Format  string `json:"format"`
+	ABIHash string `json:"abiHash"`
+}
+
+type schemaRegistry struct {
+	conf   *SchemaRegistryConf
+	client *http.Client
+}
+
+// newSchemaRegistry returns nil if no registry is configured
+func newSchemaRegistry(conf *SchemaRegistryConf) (*schemaRegistry, error) {
+	if conf.URL == "" {
+		return nil, nil
+	}
+	switch conf.Format {
+	case "":
+		conf.Format = SchemaFormatJSON
+	case SchemaFormatJSON, SchemaFormatAvro, SchemaFormatProtobuf:
+	default:
+		return nil, errors.Errorf(errors.EventStreamsSchemaRegistryBadFormat, conf.Format)
+	}
+	if conf.SubjectPrefix == "" {
+		conf.SubjectPrefix = defaultSchemaSubjectPrefix
+	}
+	if conf.TimeoutMS <= 0 {
+		conf.TimeoutMS = defaultSchemaRegistryTimeoutMS
+	}
+	return &schemaRegistry{
+		conf: conf,
+		client: &http.Client{
+			Timeout:   time.Duration(conf.TimeoutMS) * time.Millisecond,
+			Transport: utils.EgressTransport(nil),
+		},
+	}, nil
+}
+
+// abiHash is the SHA-256 digest of the JSON ABI definition of the event, which identifies
+// the version of the schema within the subject for the event
+func abiHash(event *ethbinding.ABIElementMarshaling) string {
+	b, _ := json.Marshal(event)
+	h := sha256.Sum256(b)
+	return hex.EncodeToString(h[:])
+}
+
+// publish registers the schema for the event under the subject for the name of the event.
+// The registry returns the existing ID if the same schema is already registered, so a new
+// version is only created when the ABI of the event changes.
+func (r *schemaRegistry) publish(ctx context.Context, marshaling *ethbinding.ABIElementMarshaling, event *ethbinding.ABIEvent) (*SchemaInfo, error) {
+	info := &SchemaInfo{
+		Subject: r.conf.SubjectPrefix + event.Name,
+		Format:  r.conf.Format,
+		ABIHash: abiHash(marshaling),
+	}
+	// Avro is the default schemaType of the registry
+	reqBody := make(map[string]interface{})
+	switch r.conf.Format {
+	case SchemaFormatAvro:
+		schema, err := avroEventSchema(event, info.ABIHash)
+		if err != nil {
+			return nil, err
+		}
+		schemaBytes, _ := json.Marshal(schema)
+		reqBody["schema"] = string(schemaBytes)
+	case SchemaFormatProtobuf:
+		schema, err := protoEventSchema(event, info.ABIHash)
+		if err != nil {
+			return nil, err
+		}
+		reqBody["schemaType"] = "PROTOBUF"
+		reqBody["schema"] = schema
+	default:
+		reqBody["schemaType"] = "JSON"
+		schemaBytes, _ := json.Marshal(jsonEventSchema(event, info.ABIHash))
+		reqBody["schema"] = string(schemaBytes)
+	}
+	body, _ := json.Marshal(reqBody)
+
+	u := strings.TrimSuffix(r.conf.URL, "/") + "/subjects/" + url.PathEscape(info.Subject) + "/versions"
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u, bytes.NewReader(body))
+	if err != nil {
+		return nil, errors.Errorf(errors.EventStreamsSchemaRegistryFailed, info.Subject, err)
+	}
+	req.Header.Set("Content-Type", schemaRegistryContentType)
+	if r.conf.Username != "" {
+		req.SetBasicAuth(r.conf.Username, r.conf.Password)
+	}
+	for name, value := range r.conf.Headers {
+		req.Header.Set(name, value)
+	}
+	res, err := r.client.Do(req)
+	if err != nil {
+		return nil, errors.Errorf(errors.EventStreamsSchemaRegistryFailed, info.Subject, err)
+	}
+	defer res.Body.Close()
+	resBody, _ := ioutil.ReadAll(res.Body)
+	if res.StatusCode != 200 {
+		var errBody struct {
+			Message string `json:"message"`
+		}
+		if json.Unmarshal(resBody, &errBody); errBody.Message == "" {
+			errBody.Message = string(resBody)
+		}
+		return nil, errors.Errorf(errors.EventStreamsSchemaRegistryRejected, info.Subject, res.StatusCode, errBody.Message)
+	}
+	var registered struct {
+		ID int `json:"id"`
+	}
+	if err := json.Unmarshal(resBody, &registered); err != nil {
+		return nil, errors.Errorf(errors.EventStreamsSchemaRegistryFailed, info.Subject, err)
+	}
+	info.ID = registered.ID
+	log.Infof("Published %s schema for event %s to subject %s ID=%d ABIHash=%s", info.Format, event.Name, info.Subject, info.ID, info.ABIHash)
+	return info, nil
+}
+
+// jsonEventSchema describes the events delivered for a subscription as a JSON Schema.
+// Numbers are delivered as strings, to avoid loss of precision on large integers
+func jsonEventSchema(event *ethbinding.ABIEvent, abiHash string) map[string]interface{} {
+	stringType := map[string]interface{}{"type": "string"}
+	integerType := map[string]interface{}{"type": "string", "pattern": jsonSchemaIntegerPattern}
+	dataProps := make(map[string]interface{})
+	for _, input := range event.Inputs {
+		dataProps[input.Name] = jsonInputSchema(&input.Type, input.Indexed)
+	}
+	return map[string]interface{}{
+		"$schema":     "http://json-schema.org/draft-07/schema#",
+		"$id":         "urn:ethconnect:events:" + abiHash,
+		"title":       event.Name,
+		"description": event.Sig,
+		"type":        "object",
+		"properties": map[string]interface{}{
+			"address":          stringType,
+			"blockNumber":      integerType,
+			"transactionIndex": integerType,
+			"transactionHash":  stringType,
+			"data": map[string]interface{}{
+				"type":       "object",
+				"properties": dataProps,
+			},
+			"subId":     stringType,
+			"signature": stringType,
+			"logIndex":  integerType,
+			"timestamp": integerType,
+		},
+		"required": []string{"address", "blockNumber", "transactionIndex", "transactionHash", "data", "subId", "signature", "logIndex"},
+	}
+}
+
+func jsonInputSchema(t *ethbinding.ABIType, indexed bool) map[string]interface{} {
+	switch t.T {
+	case ethbinding.IntTy, ethbinding.UintTy:
+		return map[string]interface{}{"type": "string", "pattern": jsonSchemaIntegerPattern}
+	case ethbinding.BoolTy:
+		return map[string]interface{}{"type": "boolean"}
+	case ethbinding.StringTy, ethbinding.BytesTy, ethbinding.FixedBytesTy, ethbinding.AddressTy:
+		return map[string]interface{}{"type": "string"}
+	}
+	if indexed {
+		// Only the hash of a complex indexed field is available, from the topic
+		return map[string]interface{}{"type": "string"}
+	}
+	switch t.T {
+	case ethbinding.SliceTy, ethbinding.ArrayTy:
+		return map[string]interface{}{
+			"type":  "array",
+			"items": jsonInputSchema(t.Elem, false),
+		}
+	case ethbinding.TupleTy:
+		props := make(map[string]interface{})
+		for i, name := range t.TupleRawNames {
+			props[name] = jsonInputSchema(t.TupleElems[i], false)
+		}
+		return map[string]interface{}{
+			"type":       "object",
+			"properties": props,
+		}
+	default:
+		return map[string]interface{}{}
+	}
+}
+
+// avroEventSchema describes the events delivered for a subscription as an Avro record.
+// The ABI hash is recorded in the doc of the record, so each new ABI is a new version of the schema
+func avroEventSchema(event *ethbinding.ABIEvent, abiHash string) (map[string]interface{}, error) {
+	if !avroNameRegex.MatchString(event.Name) {
+		return nil, errors.Errorf(errors.EventStreamsSchemaAvroInvalidName, event.Name, event.Name)
+	}
+	dataFields := make([]interface{}, 0, len(event.Inputs))
+	for _, input := range event.Inputs {
+		fieldType, err := avroInputSchema(event.Name, event.Name+"_"+input.Name, input.Name, &input.Type, input.Indexed)
+		if err != nil {
+			return nil, err
+		}
+		dataFields = append(dataFields, map[string]interface{}{"name": input.Name, "type": fieldType})
+	}
+	return map[string]interface{}{
+		"type":      "record",
+		"name":      event.Name,
+		"namespace": avroEventNamespace,
+		"doc":       "ABI hash: " + abiHash,
+		"fields": []interface{}{
+			map[string]interface{}{"name": "address", "type": "string"},
+			map[string]interface{}{"name": "blockNumber", "type": "string"},
+			map[string]interface{}{"name": "transactionIndex", "type": "string"},
+			map[string]interface{}{"name": "transactionHash", "type": "string"},
+			map[string]interface{}{"name": "data", "type": map[string]interface{}{
+				"type":   "record",
+				"name":   event.Name + "Data",
+				"fields": dataFields,
+			}},
+			map[string]interface{}{"name": "subId", "type": "string"},
+			map[string]interface{}{"name": "signature", "type": "string"},
+			map[string]interface{}{"name": "logIndex", "type": "string"},
+			map[string]interface{}{"name": "timestamp", "type": []string{"null", "string"}, "default": nil},
+		},
+	}, nil
+}
+
+func avroInputSchema(eventName, recordName, fieldName string, t *ethbinding.ABIType, indexed bool) (interface{}, error) {
+	if !avroNameRegex.MatchString(fieldName) {
+		return nil, errors.Errorf(errors.EventStreamsSchemaAvroInvalidName, fieldName, eventName)
+	}
+	switch t.T {
+	case ethbinding.BoolTy:
+		return "boolean", nil
+	case ethbinding.IntTy, ethbinding.UintTy, ethbinding.StringTy, ethbinding.BytesTy, ethbinding.FixedBytesTy, ethbinding.AddressTy:
+		return "string", nil
+	}
+	if indexed {
+		return "string", nil
+	}
+	switch t.T {
+	case ethbinding.SliceTy, ethbinding.ArrayTy:
+		items, err := avroInputSchema(eventName, recordName, fieldName, t.Elem, false)
+		if err != nil {
+			return nil, err
+		}
+		return map[string]interface{}{"type": "array", "items": items}, nil
+	case ethbinding.TupleTy:
+		fields := make([]interface{}, 0, len(t.TupleRawNames))
+		for i, name := range t.TupleRawNames {
+			fieldType, err := avroInputSchema(eventName, recordName+"_"+name, name, t.TupleElems[i], false)
+			if err != nil {
+				return nil, err
+			}
+			fields = append(fields, map[string]interface{}{"name": name, "type": fieldType})
+		}
+		return map[string]interface{}{"type": "record", "name": recordName, "fields": fields}, nil
+	default:
+		return "string", nil
+	}
+}
+
+const (
+	payloadString = iota
+	payloadOptionalString
+	payloadBool
+	payloadArray
+	payloadRecord
+)
+
+// payloadType is the shape of a value in the events delivered for a subscription, matching
+// the Avro and Protobuf schemas, from which the binary encoding of each event is written
+type payloadType struct {
+	kind   int
+	name   string
+	elem   *payloadType
+	fields []*payloadField
+}
+
+type payloadField struct {
+	name string
+	t    *payloadType
+}
+
+func eventPayloadType(event *ethbinding.ABIEvent) *payloadType {
+	stringType := &payloadType{kind: payloadString}
+	data := &payloadType{kind: payloadRecord, name: event.Name + "Data"}
+	for _, input := range event.Inputs {
+		data.fields = append(data.fields, &payloadField{
+			name: input.Name,
+			t:    inputPayloadType(event.Name+"_"+input.Name, &input.Type, input.Indexed),
+		})
+	}
+	return &payloadType{kind: payloadRecord, name: event.Name, fields: []*payloadField{
+		{name: "address", t: stringType},
+		{name: "blockNumber", t: stringType},
+		{name: "transactionIndex", t: stringType},
+		{name: "transactionHash", t: stringType},
+		{name: "data", t: data},
+		{name: "subId", t: stringType},
+		{name: "signature", t: stringType},
+		{name: "logIndex", t: stringType},
+		{name: "timestamp", t: &payloadType{kind: payloadOptionalString}},
+	}}
+}
+
+func inputPayloadType(recordName string, t *ethbinding.ABIType, indexed bool) *payloadType {
+	switch t.T {
+	case ethbinding.BoolTy:
+		return &payloadType{kind: payloadBool}
+	case ethbinding.IntTy, ethbinding.UintTy, ethbinding.StringTy, ethbinding.BytesTy, ethbinding.FixedBytesTy, ethbinding.AddressTy:
+		return &payloadType{kind: payloadString}
+	}
+	if indexed {
+		return &payloadType{kind: payloadString}
+	}
+	switch t.T {
+	case ethbinding.SliceTy, ethbinding.ArrayTy:
+		return &payloadType{kind: payloadArray, elem: inputPayloadType(recordName, t.Elem, false)}
+	case ethbinding.TupleTy:
+		record := &payloadType{kind: payloadRecord, name: recordName}
+		for i, name := range t.TupleRawNames {
+			record.fields = append(record.fields, &payloadField{
+				name: name,
+				t:    inputPayloadType(recordName+"_"+name, t.TupleElems[i], false),
+			})
+		}
+		return record
+	default:
+		return &payloadType{kind: payloadString}
+	}
+}
+
+// protoEventSchema describes the events delivered for a subscription as proto3 messages.
+// The message for the event is first in the file, followed by the messages for its data
+// and each tuple, so the event is message index 0 in the Confluent wire format
+func protoEventSchema(event *ethbinding.ABIEvent, abiHash string) (string, error) {
+	if !avroNameRegex.MatchString(event.Name) {
+		return "", errors.Errorf(errors.EventStreamsSchemaProtobufInvalidName, event.Name, event.Name)
+	}
+	var messages []*payloadType
+	if err := protoMessages(event.Name, eventPayloadType(event), &messages); err != nil {
+		return "", err
+	}
+	var schema strings.Builder
+	schema.WriteString("syntax = \"proto3\";\n\npackage " + protoEventPackage + ";\n")
+	for i, message := range messages {
+		schema.WriteString("\n")
+		if i == 0 {
+			schema.WriteString("// ABI hash: " + abiHash + "\n")
+		}
+		schema.WriteString("message " + message.name + " {\n")
+		for j, field := range message.fields {
+			fmt.Fprintf(&schema, "  %s %s = %d;\n", protoFieldType(field.t), field.name, j+1)
+		}
+		schema.WriteString("}\n")
+	}
+	return schema.String(), nil
+}
+
+func protoMessages(eventName string, t *payloadType, messages *[]*payloadType) error {
+	switch t.kind {
+	case payloadArray:
+		return protoMessages(eventName, t.elem, messages)
+	case payloadRecord:
+		*messages = append(*messages, t)
+		for _, field := range t.fields {
+			if !avroNameRegex.MatchString(field.name) {
+				return errors.Errorf(errors.EventStreamsSchemaProtobufInvalidName, field.name, eventName)
+			}
+			if field.t.kind == payloadArray && field.t.elem.kind == payloadArray {
+				return errors.Errorf(errors.EventStreamsSchemaProtobufNestedArray, field.name, eventName)
+			}
+			if err := protoMessages(eventName, field.t, messages); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func protoFieldType(t *payloadType) string {
+	switch t.kind {
+	case payloadBool:
+		return "bool"
+	case payloadArray:
+		return "repeated " + protoFieldType(t.elem)
+	case payloadRecord:
+		return t.name
+	default:
+		return "string"
+	}
+}
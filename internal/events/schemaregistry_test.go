@@ -0,0 +1,350 @@
+// Copyright 2021 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package events
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"testing"
+
+	ethbinding "github.com/kaleido-io/ethbinding/pkg"
+	"github.com/kaleido-io/ethconnect/internal/ethbind"
+	"github.com/stretchr/testify/assert"
+)
+
+type testSchemaRegistry struct {
+	server   *httptest.Server
+	path     string
+	username string
+	header   string
+	request  map[string]interface{}
+	schema   map[string]interface{}
+}
+
+func newTestSchemaRegistry(t *testing.T, status int, reply string) *testSchemaRegistry {
+	r := &testSchemaRegistry{}
+	r.server = httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		r.path = req.URL.EscapedPath()
+		r.username, _, _ = req.BasicAuth()
+		r.header = req.Header.Get("X-Test")
+		assert.Equal(t, "application/vnd.schemaregistry.v1+json", req.Header.Get("Content-Type"))
+		body, _ := ioutil.ReadAll(req.Body)
+		assert.NoError(t, json.Unmarshal(body, &r.request))
+		if r.request["schemaType"] != "PROTOBUF" {
+			assert.NoError(t, json.Unmarshal([]byte(r.request["schema"].(string)), &r.schema))
+		}
+		res.WriteHeader(status)
+		res.Write([]byte(reply))
+	}))
+	return r
+}
+
+func testSchemaEvent(t *testing.T, abiJSON string) (*ethbinding.ABIElementMarshaling, *ethbinding.ABIEvent) {
+	var marshaling ethbinding.ABIElementMarshaling
+	assert.NoError(t, json.Unmarshal([]byte(abiJSON), &marshaling))
+	event, err := ethbind.API.ABIElementMarshalingToABIEvent(&marshaling)
+	assert.NoError(t, err)
+	return &marshaling, event
+}
+
+const testSchemaEventABI = `{
+	"name": "Changed",
+	"type": "event",
+	"inputs": [
+		{"name": "from", "type": "address", "indexed": true},
+		{"name": "tags", "type": "string[]", "indexed": true},
+		{"name": "amount", "type": "uint256"},
+		{"name": "approved", "type": "bool"},
+		{"name": "values", "type": "int64[]"},
+		{"name": "detail", "type": "tuple", "components": [
+			{"name": "id", "type": "bytes32"},
+			{"name": "note", "type": "string"}
+		]}
+	]
+}`
+
+func TestNewSchemaRegistry(t *testing.T) {
+	assert := assert.New(t)
+
+	r, err := newSchemaRegistry(&SchemaRegistryConf{})
+	assert.NoError(err)
+	assert.Nil(r)
+
+	r, err = newSchemaRegistry(&SchemaRegistryConf{URL: "http://localhost:8081"})
+	assert.NoError(err)
+	assert.Equal(SchemaFormatJSON, r.conf.Format)
+	assert.Equal("ethconnect-", r.conf.SubjectPrefix)
+	assert.Equal(10000, r.conf.TimeoutMS)
+
+	r, err = newSchemaRegistry(&SchemaRegistryConf{URL: "http://localhost:8081", Format: "protobuf"})
+	assert.NoError(err)
+	assert.Equal(SchemaFormatProtobuf, r.conf.Format)
+
+	_, err = newSchemaRegistry(&SchemaRegistryConf{URL: "http://localhost:8081", Format: "thrift"})
+	assert.EqualError(err, "Invalid schema registry format 'thrift'. Valid formats are: 'json', 'avro' and 'protobuf'")
+}
+
+func TestPublishJSONSchema(t *testing.T) {
+	assert := assert.New(t)
+	registry := newTestSchemaRegistry(t, 200, `{"id": 7}`)
+	defer registry.server.Close()
+
+	r, err := newSchemaRegistry(&SchemaRegistryConf{
+		URL:      registry.server.URL + "/",
+		Username: "user1",
+		Password: "pass1",
+		Headers:  map[string]string{"X-Test": "value1"},
+	})
+	assert.NoError(err)
+	marshaling, event := testSchemaEvent(t, testSchemaEventABI)
+	info, err := r.publish(context.Background(), marshaling, event)
+	assert.NoError(err)
+	assert.Equal("ethconnect-Changed", info.Subject)
+	assert.Equal(7, info.ID)
+	assert.Equal(SchemaFormatJSON, info.Format)
+	assert.Equal(abiHash(marshaling), info.ABIHash)
+	assert.Len(info.ABIHash, 64)
+
+	assert.Equal("/subjects/ethconnect-Changed/versions", registry.path)
+	assert.Equal("user1", registry.username)
+	assert.Equal("value1", registry.header)
+	assert.Equal("JSON", registry.request["schemaType"])
+
+	schema := registry.schema
+	assert.Equal("urn:ethconnect:events:"+info.ABIHash, schema["$id"])
+	assert.Equal("Changed", schema["title"])
+	data := schema["properties"].(map[string]interface{})["data"].(map[string]interface{})
+	props := data["properties"].(map[string]interface{})
+	assert.Equal(map[string]interface{}{"type": "string"}, props["from"])
+	assert.Equal(map[string]interface{}{"type": "string"}, props["tags"])
+	assert.Equal(map[string]interface{}{"type": "string", "pattern": "^-?[0-9]+$"}, props["amount"])
+	assert.Equal(map[string]interface{}{"type": "boolean"}, props["approved"])
+	assert.Equal("array", props["values"].(map[string]interface{})["type"])
+	detail := props["detail"].(map[string]interface{})
+	assert.Equal("object", detail["type"])
+	assert.Equal(map[string]interface{}{"type": "string"}, detail["properties"].(map[string]interface{})["note"])
+}
+
+func TestPublishAvroSchema(t *testing.T) {
+	assert := assert.New(t)
+	registry := newTestSchemaRegistry(t, 200, `{"id": 12}`)
+	defer registry.server.Close()
+
+	r, err := newSchemaRegistry(&SchemaRegistryConf{
+		URL:           registry.server.URL,
+		Format:        SchemaFormatAvro,
+		SubjectPrefix: "chain1.",
+	})
+	assert.NoError(err)
+	marshaling, event := testSchemaEvent(t, testSchemaEventABI)
+	info, err := r.publish(context.Background(), marshaling, event)
+	assert.NoError(err)
+	assert.Equal("chain1.Changed", info.Subject)
+	assert.Equal(12, info.ID)
+
+	_, hasSchemaType := registry.request["schemaType"]
+	assert.False(hasSchemaType)
+	schema := registry.schema
+	assert.Equal("record", schema["type"])
+	assert.Equal("Changed", schema["name"])
+	assert.Equal("io.kaleido.ethconnect.events", schema["namespace"])
+	assert.Equal("ABI hash: "+info.ABIHash, schema["doc"])
+
+	var dataType map[string]interface{}
+	for _, f := range schema["fields"].([]interface{}) {
+		if f.(map[string]interface{})["name"] == "data" {
+			dataType = f.(map[string]interface{})["type"].(map[string]interface{})
+		}
+	}
+	assert.Equal("ChangedData", dataType["name"])
+	fields := dataType["fields"].([]interface{})
+	assert.Equal(6, len(fields))
+	assert.Equal(map[string]interface{}{"name": "tags", "type": "string"}, fields[1])
+	assert.Equal(map[string]interface{}{"name": "approved", "type": "boolean"}, fields[3])
+	assert.Equal(map[string]interface{}{
+		"name": "values",
+		"type": map[string]interface{}{"type": "array", "items": "string"},
+	}, fields[4])
+	detailType := fields[5].(map[string]interface{})["type"].(map[string]interface{})
+	assert.Equal("record", detailType["type"])
+	assert.Equal("Changed_detail", detailType["name"])
+}
+
+func TestPublishAvroSchemaInvalidName(t *testing.T) {
+	assert := assert.New(t)
+	r, _ := newSchemaRegistry(&SchemaRegistryConf{URL: "http://localhost:8081", Format: SchemaFormatAvro})
+	marshaling, event := testSchemaEvent(t, `{"name": "Changed", "type": "event", "inputs": [{"name": "$amount", "type": "uint256"}]}`)
+	_, err := r.publish(context.Background(), marshaling, event)
+	assert.EqualError(err, "'$amount' in event 'Changed' is not a valid Avro name")
+}
+
+func TestPublishProtobufSchema(t *testing.T) {
+	assert := assert.New(t)
+	registry := newTestSchemaRegistry(t, 200, `{"id": 21}`)
+	defer registry.server.Close()
+
+	r, err := newSchemaRegistry(&SchemaRegistryConf{URL: registry.server.URL, Format: SchemaFormatProtobuf})
+	assert.NoError(err)
+	marshaling, event := testSchemaEvent(t, testSchemaEventABI)
+	info, err := r.publish(context.Background(), marshaling, event)
+	assert.NoError(err)
+	assert.Equal(21, info.ID)
+	assert.Equal(SchemaFormatProtobuf, info.Format)
+
+	assert.Equal("PROTOBUF", registry.request["schemaType"])
+	assert.Equal(`syntax = "proto3";
+
+package io.kaleido.ethconnect.events;
+
+// ABI hash: `+info.ABIHash+`
+message Changed {
+  string address = 1;
+  string blockNumber = 2;
+  string transactionIndex = 3;
+  string transactionHash = 4;
+  ChangedData data = 5;
+  string subId = 6;
+  string signature = 7;
+  string logIndex = 8;
+  string timestamp = 9;
+}
+
+message ChangedData {
+  string from = 1;
+  string tags = 2;
+  string amount = 3;
+  bool approved = 4;
+  repeated string values = 5;
+  Changed_detail detail = 6;
+}
+
+message Changed_detail {
+  string id = 1;
+  string note = 2;
+}
+`, registry.request["schema"])
+}
+
+func TestPublishProtobufSchemaUnsupported(t *testing.T) {
+	assert := assert.New(t)
+	r, _ := newSchemaRegistry(&SchemaRegistryConf{URL: "http://localhost:8081", Format: SchemaFormatProtobuf})
+
+	marshaling, event := testSchemaEvent(t, `{"name": "Changed", "type": "event", "inputs": [{"name": "grid", "type": "uint8[][]"}]}`)
+	_, err := r.publish(context.Background(), marshaling, event)
+	assert.EqualError(err, "'grid' in event 'Changed' is an array of arrays, which cannot be described in a Protobuf schema")
+
+	marshaling, event = testSchemaEvent(t, `{"name": "Changed", "type": "event", "inputs": [{"name": "$value", "type": "uint256"}]}`)
+	_, err = r.publish(context.Background(), marshaling, event)
+	assert.EqualError(err, "'$value' in event 'Changed' is not a valid Protobuf name")
+
+	marshaling, event = testSchemaEvent(t, `{"name": "$Changed", "type": "event", "inputs": []}`)
+	_, err = r.publish(context.Background(), marshaling, event)
+	assert.EqualError(err, "'$Changed' in event '$Changed' is not a valid Protobuf name")
+}
+
+func TestPublishSchemaRejected(t *testing.T) {
+	assert := assert.New(t)
+	registry := newTestSchemaRegistry(t, 409, `{"error_code": 409, "message": "Schema being registered is incompatible"}`)
+	defer registry.server.Close()
+
+	r, _ := newSchemaRegistry(&SchemaRegistryConf{URL: registry.server.URL})
+	marshaling, event := testSchemaEvent(t, testSchemaEventABI)
+	_, err := r.publish(context.Background(), marshaling, event)
+	assert.EqualError(err, "Schema registry rejected the schema for subject 'ethconnect-Changed' [409]: Schema being registered is incompatible")
+}
+
+func TestPublishSchemaBadReply(t *testing.T) {
+	assert := assert.New(t)
+	registry := newTestSchemaRegistry(t, 200, `!json`)
+	defer registry.server.Close()
+
+	r, _ := newSchemaRegistry(&SchemaRegistryConf{URL: registry.server.URL})
+	marshaling, event := testSchemaEvent(t, testSchemaEventABI)
+	_, err := r.publish(context.Background(), marshaling, event)
+	assert.Regexp("Failed to publish the schema for subject 'ethconnect-Changed'", err)
+}
+
+func TestPublishSchemaUnavailable(t *testing.T) {
+	assert := assert.New(t)
+	registry := newTestSchemaRegistry(t, 200, `{}`)
+	registry.server.Close()
+
+	r, _ := newSchemaRegistry(&SchemaRegistryConf{URL: registry.server.URL})
+	marshaling, event := testSchemaEvent(t, testSchemaEventABI)
+	_, err := r.publish(context.Background(), marshaling, event)
+	assert.Regexp("Failed to publish the schema for subject 'ethconnect-Changed'", err)
+
+	r, _ = newSchemaRegistry(&SchemaRegistryConf{URL: "http://localhost:8081\x7f"})
+	_, err = r.publish(context.Background(), marshaling, event)
+	assert.Regexp("Failed to publish the schema", err)
+}
+
+func TestAddSubscriptionPublishesSchema(t *testing.T) {
+	assert := assert.New(t)
+	registry := newTestSchemaRegistry(t, 200, `{"id": 3}`)
+	defer registry.server.Close()
+
+	sm := newTestSubscriptionManager()
+	sm.schemas, _ = newSchemaRegistry(&SchemaRegistryConf{URL: registry.server.URL})
+	ctx := context.Background()
+	stream, err := sm.AddStream(ctx, &StreamInfo{
+		Type:    "webhook",
+		Webhook: &webhookActionInfo{URL: "http://test.invalid"},
+	})
+	assert.NoError(err)
+	defer sm.DeleteStream(ctx, stream.ID)
+
+	sub, err := sm.AddSubscription(ctx, nil, &ethbinding.ABIElementMarshaling{Name: "ping"}, stream.ID, "", "", nil)
+	assert.NoError(err)
+	assert.Equal("ethconnect-ping", sub.Schema.Subject)
+	assert.Equal(3, sub.Schema.ID)
+}
+
+func TestAddSubscriptionSchemaRejected(t *testing.T) {
+	assert := assert.New(t)
+	registry := newTestSchemaRegistry(t, 422, `{"error_code": 42201, "message": "Invalid schema"}`)
+	defer registry.server.Close()
+
+	sm := newTestSubscriptionManager()
+	sm.schemas, _ = newSchemaRegistry(&SchemaRegistryConf{URL: registry.server.URL})
+	ctx := context.Background()
+	stream, err := sm.AddStream(ctx, &StreamInfo{
+		Type:    "webhook",
+		Webhook: &webhookActionInfo{URL: "http://test.invalid"},
+	})
+	assert.NoError(err)
+	defer sm.DeleteStream(ctx, stream.ID)
+
+	_, err = sm.AddSubscription(ctx, nil, &ethbinding.ABIElementMarshaling{Name: "ping"}, stream.ID, "", "", nil)
+	assert.Regexp("Invalid schema", err)
+	assert.Empty(sm.Subscriptions(ctx))
+}
+
+func TestInitSchemaRegistryBadFormat(t *testing.T) {
+	assert := assert.New(t)
+	dir := tempdir(t)
+	defer cleanup(t, dir)
+
+	sm := newTestSubscriptionManager()
+	sm.config().EventLevelDBPath = path.Join(dir, "db")
+	sm.config().SchemaRegistry = SchemaRegistryConf{URL: "http://localhost:8081", Format: "xml"}
+	err := sm.Init()
+	assert.Regexp("Invalid schema registry format 'xml'", err)
+	sm.Close()
+}
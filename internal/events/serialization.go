@@ -0,0 +1,243 @@
+// Copyright 2021 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package events
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"sync"
+
+	"github.com/kaleido-io/ethconnect/internal/errors"
+)
+
+const (
+	// KafkaSerializationJSON delivers each event as JSON, which is the default
+	KafkaSerializationJSON = "json"
+	// KafkaSerializationAvro delivers each event as Avro binary, in the Confluent wire format
+	KafkaSerializationAvro = "avro"
+	// KafkaSerializationProtobuf delivers each event as Protobuf binary, in the Confluent wire format
+	KafkaSerializationProtobuf = "protobuf"
+
+	confluentMagicByte = 0
+)
+
+// kafkaSerializer writes events in the Confluent wire format, prefixed with the ID in the
+// registry of the schema of the subscription that matched each event. The schema of a
+// subscription created before the registry was configured is published on its first event
+type kafkaSerializer struct {
+	format   string
+	sm       subscriptionManager
+	registry *schemaRegistry
+	lock     sync.Mutex
+	schemas  map[string]*kafkaSchema
+}
+
+type kafkaSchema struct {
+	id      int
+	payload *payloadType
+}
+
+// newKafkaSerializer relies on validateKafka having checked the schema registry is
+// configured with the format of the serialization
+func newKafkaSerializer(sm subscriptionManager, format string) *kafkaSerializer {
+	registry, _ := newSchemaRegistry(&sm.config().SchemaRegistry)
+	return &kafkaSerializer{
+		format:   format,
+		sm:       sm,
+		registry: registry,
+		schemas:  make(map[string]*kafkaSchema),
+	}
+}
+
+func (s *kafkaSerializer) schemaFor(subID string) (*kafkaSchema, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if schema, ok := s.schemas[subID]; ok {
+		return schema, nil
+	}
+	sub, err := s.sm.subscriptionByID(subID)
+	if err != nil {
+		return nil, err
+	}
+	if sub.info.Event == nil || sub.lp == nil || sub.lp.event == nil || sub.info.Aggregation != nil {
+		return nil, errors.Errorf(errors.EventStreamsKafkaNoSchema, subID)
+	}
+	info := sub.info.Schema
+	if info == nil || info.Format != s.format || info.ABIHash != abiHash(sub.info.Event) {
+		if info, err = s.registry.publish(context.Background(), sub.info.Event, sub.lp.event); err != nil {
+			return nil, err
+		}
+	}
+	schema := &kafkaSchema{
+		id:      info.ID,
+		payload: eventPayloadType(sub.lp.event),
+	}
+	s.schemas[subID] = schema
+	return schema, nil
+}
+
+func (s *kafkaSerializer) serialize(event *eventData) ([]byte, error) {
+	if event.Aggregate {
+		return nil, errors.Errorf(errors.EventStreamsKafkaNoSchema, event.SubID)
+	}
+	schema, err := s.schemaFor(event.SubID)
+	if err != nil {
+		return nil, err
+	}
+	// The decoded data of the event has the same representation as the JSON delivered
+	// to other types of stream
+	var value map[string]interface{}
+	eventBytes, _ := json.Marshal(event)
+	_ = json.Unmarshal(eventBytes, &value)
+
+	var buff bytes.Buffer
+	buff.WriteByte(confluentMagicByte)
+	_ = binary.Write(&buff, binary.BigEndian, uint32(schema.id))
+	if s.format == KafkaSerializationAvro {
+		avroEncode(&buff, schema.payload, value)
+	} else {
+		// The message indexes of the first message in the schema are written as a single zero
+		buff.WriteByte(0)
+		protoEncodeMessage(&buff, schema.payload, value)
+	}
+	return buff.Bytes(), nil
+}
+
+func payloadStringValue(v interface{}) string {
+	switch vt := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return vt
+	default:
+		b, _ := json.Marshal(vt)
+		return string(b)
+	}
+}
+
+func avroLong(buff *bytes.Buffer, n int64) {
+	b := make([]byte, binary.MaxVarintLen64)
+	buff.Write(b[:binary.PutVarint(b, n)])
+}
+
+func avroString(buff *bytes.Buffer, s string) {
+	avroLong(buff, int64(len(s)))
+	buff.WriteString(s)
+}
+
+// avroEncode writes a value in the Avro binary encoding. Missing values are written as
+// the zero value of their type, as every field of an Avro record is required
+func avroEncode(buff *bytes.Buffer, t *payloadType, v interface{}) {
+	switch t.kind {
+	case payloadBool:
+		if b, _ := v.(bool); b {
+			buff.WriteByte(1)
+		} else {
+			buff.WriteByte(0)
+		}
+	case payloadOptionalString:
+		// The union is ["null","string"]
+		if s := payloadStringValue(v); s == "" {
+			avroLong(buff, 0)
+		} else {
+			avroLong(buff, 1)
+			avroString(buff, s)
+		}
+	case payloadArray:
+		items, _ := v.([]interface{})
+		if len(items) > 0 {
+			avroLong(buff, int64(len(items)))
+			for _, item := range items {
+				avroEncode(buff, t.elem, item)
+			}
+		}
+		avroLong(buff, 0)
+	case payloadRecord:
+		m, _ := v.(map[string]interface{})
+		for _, field := range t.fields {
+			avroEncode(buff, field.t, m[field.name])
+		}
+	default:
+		avroString(buff, payloadStringValue(v))
+	}
+}
+
+func protoUvarint(buff *bytes.Buffer, n uint64) {
+	b := make([]byte, binary.MaxVarintLen64)
+	buff.Write(b[:binary.PutUvarint(b, n)])
+}
+
+func protoTag(buff *bytes.Buffer, fieldNumber int, wireType uint64) {
+	protoUvarint(buff, uint64(fieldNumber)<<3|wireType)
+}
+
+func protoBytes(buff *bytes.Buffer, fieldNumber int, b []byte) {
+	protoTag(buff, fieldNumber, 2)
+	protoUvarint(buff, uint64(len(b)))
+	buff.Write(b)
+}
+
+// protoEncodeMessage writes a message in the Protobuf binary encoding. As in proto3 the
+// default values of singular strings and bools are omitted, and repeated bools are packed
+func protoEncodeMessage(buff *bytes.Buffer, t *payloadType, m map[string]interface{}) {
+	for i, field := range t.fields {
+		fieldNumber := i + 1
+		v := m[field.name]
+		switch field.t.kind {
+		case payloadBool:
+			if b, _ := v.(bool); b {
+				protoTag(buff, fieldNumber, 0)
+				buff.WriteByte(1)
+			}
+		case payloadArray:
+			items, _ := v.([]interface{})
+			if field.t.elem.kind == payloadBool {
+				if len(items) > 0 {
+					packed := make([]byte, len(items))
+					for j, item := range items {
+						if b, _ := item.(bool); b {
+							packed[j] = 1
+						}
+					}
+					protoBytes(buff, fieldNumber, packed)
+				}
+			} else {
+				for _, item := range items {
+					protoEncodeValue(buff, fieldNumber, field.t.elem, item)
+				}
+			}
+		case payloadRecord:
+			protoEncodeValue(buff, fieldNumber, field.t, v)
+		default:
+			if s := payloadStringValue(v); s != "" {
+				protoBytes(buff, fieldNumber, []byte(s))
+			}
+		}
+	}
+}
+
+// protoEncodeValue writes a message or string, including an empty string within a repeated field
+func protoEncodeValue(buff *bytes.Buffer, fieldNumber int, t *payloadType, v interface{}) {
+	if t.kind == payloadRecord {
+		var message bytes.Buffer
+		m, _ := v.(map[string]interface{})
+		protoEncodeMessage(&message, t, m)
+		protoBytes(buff, fieldNumber, message.Bytes())
+	} else {
+		protoBytes(buff, fieldNumber, []byte(payloadStringValue(v)))
+	}
+}
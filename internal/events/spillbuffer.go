@@ -0,0 +1,144 @@
+// Copyright 2021 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package events
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/kaleido-io/ethconnect/internal/kvstore"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	spillIDPrefix          = "bb-"
+	spillKeySeparator      = "/"
+	spillKeySeparatorLimit = "0" // the character after the separator, to bound the keys of a stream
+	spillKeySequenceFormat = "%020d"
+)
+
+// spilledBatch holds the place of a batch in the queue of a stream, while its events are
+// buffered in LevelDB. The callbacks of the events cannot be stored, so they stay in memory
+type spilledBatch struct {
+	key       string
+	callbacks []func(*eventData)
+}
+
+func spillKeyPrefix(streamID string) string {
+	return spillIDPrefix + streamID + spillKeySeparator
+}
+
+// spillRange is all the buffered batches of a stream, in the order they were queued
+func spillRange(streamID string) *kvstore.KVRange {
+	return &kvstore.KVRange{
+		Start: spillKeyPrefix(streamID),
+		Limit: spillIDPrefix + streamID + spillKeySeparatorLimit,
+	}
+}
+
+// shouldSpill is true when a WebSocket stream already holds its maximum of batches in memory.
+// Once a batch has been spilled, all later batches are spilled until the queue drains, so
+// they are delivered in order. Must be called holding the batch lock
+func (a *eventStream) shouldSpill() bool {
+	if a.spec.WebSocket == nil || a.spec.WebSocket.MaxInFlightBatches <= 0 {
+		return false
+	}
+	return a.spilledBatches > 0 || a.batchQueue.Len() >= a.spec.WebSocket.MaxInFlightBatches
+}
+
+// spillBatch stores the events of a batch in LevelDB, and returns the entry that holds its
+// place in the queue. If the batch cannot be stored, it is kept in memory.
+// Must be called holding the batch lock
+func (a *eventStream) spillBatch(events []*eventData) interface{} {
+	a.spillSequence++
+	key := spillKeyPrefix(a.spec.ID) + fmt.Sprintf(spillKeySequenceFormat, a.spillSequence)
+	if err := a.sm.storeSpilledBatch(key, events); err != nil {
+		log.Errorf("%s: Failed to buffer batch to disk, holding it in memory: %s", a.spec.ID, err)
+		return events
+	}
+	callbacks := make([]func(*eventData), len(events))
+	for i, event := range events {
+		callbacks[i] = event.batchComplete
+	}
+	a.spilledBatches++
+	log.Debugf("%s: Buffered batch of %d events to disk. Buffered=%d", a.spec.ID, len(events), a.spilledBatches)
+	return &spilledBatch{key: key, callbacks: callbacks}
+}
+
+// restoreBatch loads the events of a spilled batch back from LevelDB
+func (a *eventStream) restoreBatch(spilled *spilledBatch) ([]*eventData, error) {
+	events, err := a.sm.loadSpilledBatch(spilled.key)
+	a.batchCond.L.Lock()
+	a.spilledBatches--
+	a.batchCond.L.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	for i, event := range events {
+		if i < len(spilled.callbacks) {
+			event.batchComplete = spilled.callbacks[i]
+		}
+	}
+	return events, nil
+}
+
+// storeSpilledBatch writes the events of a batch buffered by a slow WebSocket stream
+func (s *subscriptionMGR) storeSpilledBatch(key string, events []*eventData) error {
+	b, _ := json.Marshal(events)
+	return s.db.Put(key, b)
+}
+
+// loadSpilledBatch reads back, and removes, the events of a buffered batch
+func (s *subscriptionMGR) loadSpilledBatch(key string) ([]*eventData, error) {
+	b, err := s.db.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	var events []*eventData
+	if err = json.Unmarshal(b, &events); err != nil {
+		return nil, err
+	}
+	if err = s.db.Delete(key); err != nil {
+		log.Warnf("Failed to remove buffered batch '%s': %s", key, err)
+	}
+	return events, nil
+}
+
+// deleteSpilledBatches removes the buffered batches of a stream, or of all streams if the
+// ID is empty. The checkpoints only move once a batch is delivered, so the events of any
+// batches left over after a restart are detected again from the checkpoints
+func (s *subscriptionMGR) deleteSpilledBatches(streamID string) {
+	var it kvstore.KVIterator
+	if streamID == "" {
+		it = s.db.NewIteratorWithRange(&kvstore.KVRange{Start: spillIDPrefix})
+	} else {
+		it = s.db.NewIteratorWithRange(spillRange(streamID))
+	}
+	keys := []string{}
+	for it.Next() {
+		k := it.Key()
+		if !strings.HasPrefix(k, spillIDPrefix) {
+			break
+		}
+		keys = append(keys, k)
+	}
+	it.Release()
+	for _, key := range keys {
+		if err := s.db.Delete(key); err != nil {
+			log.Errorf("Failed to remove buffered batch '%s': %s", key, err)
+		}
+	}
+}
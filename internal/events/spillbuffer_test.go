@@ -0,0 +1,187 @@
+// Copyright 2021 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package events
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/kaleido-io/ethconnect/internal/kvstore"
+	"github.com/stretchr/testify/assert"
+)
+
+func countSpilledBatches(sm *subscriptionMGR, streamID string) int {
+	it := sm.db.NewIteratorWithRange(spillRange(streamID))
+	defer it.Release()
+	count := 0
+	for it.Next() {
+		count++
+	}
+	return count
+}
+
+func TestConstructorBadWebSocketQoS(t *testing.T) {
+	assert := assert.New(t)
+	_, err := newEventStream(newTestSubscriptionManager(), &StreamInfo{
+		ID:        "123",
+		Type:      "websocket",
+		WebSocket: &webSocketActionInfo{MaxInFlightBatches: -1},
+	}, newMockWebSocket())
+	assert.EqualError(err, "Invalid websocket.maxInFlightBatches -1 - must be zero (unlimited) or greater")
+	_, err = newEventStream(newTestSubscriptionManager(), &StreamInfo{
+		ID:        "123",
+		Type:      "websocket",
+		WebSocket: &webSocketActionInfo{MaxBatchesPerSec: -0.5},
+	}, newMockWebSocket())
+	assert.EqualError(err, "Invalid websocket.maxBatchesPerSec -0.5 - must be zero (unlimited) or greater")
+}
+
+func TestWebSocketSlowConsumerSpillsToDisk(t *testing.T) {
+	assert := assert.New(t)
+	dir := tempdir(t)
+	defer cleanup(t, dir)
+
+	db, _ := kvstore.NewLDBKeyValueStore(dir)
+	sm, stream, mockWebSocket := newTestStreamForWebSocket(
+		&StreamInfo{
+			BatchSize: 1,
+			Type:      "websocket",
+			WebSocket: &webSocketActionInfo{MaxInFlightBatches: 1},
+		}, db)
+	defer sm.Close()
+
+	completeLock := sync.Mutex{}
+	completed := []string{}
+	for i := 1; i <= 4; i++ {
+		event := testEvent("sub1")
+		event.BlockNumber = fmt.Sprintf("%d", i)
+		event.batchComplete = func(e *eventData) {
+			completeLock.Lock()
+			completed = append(completed, e.BlockNumber)
+			completeLock.Unlock()
+		}
+		stream.handleEvent(event)
+	}
+
+	// The consumer has not acknowledged the first batch, so at least the third is on disk
+	batch := (<-mockWebSocket.sender).([]*eventData)
+	assert.Equal("1", batch[0].BlockNumber)
+	assert.GreaterOrEqual(countSpilledBatches(sm, stream.spec.ID), 1)
+	mockWebSocket.receiver <- nil
+
+	for i := 2; i <= 4; i++ {
+		batch = (<-mockWebSocket.sender).([]*eventData)
+		assert.Equal(fmt.Sprintf("%d", i), batch[0].BlockNumber)
+		mockWebSocket.receiver <- nil
+	}
+	for i := 0; i < 100; i++ {
+		completeLock.Lock()
+		done := len(completed) == 4
+		completeLock.Unlock()
+		if done {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal([]string{"1", "2", "3", "4"}, completed)
+	assert.Equal(0, countSpilledBatches(sm, stream.spec.ID))
+	assert.Equal(0, stream.spilledBatches)
+
+	assert.NoError(sm.DeleteStream(context.Background(), stream.spec.ID))
+}
+
+func TestWebSocketSpillFailures(t *testing.T) {
+	assert := assert.New(t)
+
+	sm := &mockSubMgr{err: fmt.Errorf("pop")}
+	stream := &eventStream{
+		sm:        sm,
+		spec:      &StreamInfo{ID: "123"},
+		batchCond: sync.NewCond(&sync.Mutex{}),
+	}
+	events := []*eventData{testEvent("sub1")}
+	queued := stream.spillBatch(events)
+	assert.Equal(events, queued)
+	assert.Equal(0, stream.spilledBatches)
+
+	stream.spilledBatches = 1
+	_, err := stream.restoreBatch(&spilledBatch{key: "bb-123/1"})
+	assert.EqualError(err, "pop")
+	assert.Equal(0, stream.spilledBatches)
+}
+
+func TestDeleteSpilledBatches(t *testing.T) {
+	assert := assert.New(t)
+	dir := tempdir(t)
+	defer cleanup(t, dir)
+
+	sm := newTestSubscriptionManager()
+	sm.db, _ = kvstore.NewLDBKeyValueStore(dir)
+	defer sm.db.Close()
+
+	events := []*eventData{testEvent("sub1")}
+	for _, streamID := range []string{"es-1", "es-10", "es-2"} {
+		assert.NoError(sm.storeSpilledBatch(spillKeyPrefix(streamID)+fmt.Sprintf(spillKeySequenceFormat, 1), events))
+		assert.NoError(sm.storeSpilledBatch(spillKeyPrefix(streamID)+fmt.Sprintf(spillKeySequenceFormat, 2), events))
+	}
+	loaded, err := sm.loadSpilledBatch(spillKeyPrefix("es-2") + fmt.Sprintf(spillKeySequenceFormat, 1))
+	assert.NoError(err)
+	assert.Equal("sub1", loaded[0].SubID)
+	assert.Equal(1, countSpilledBatches(sm, "es-2"))
+
+	sm.deleteSpilledBatches("es-1")
+	assert.Equal(0, countSpilledBatches(sm, "es-1"))
+	assert.Equal(2, countSpilledBatches(sm, "es-10"))
+
+	sm.deleteSpilledBatches("")
+	assert.Equal(0, countSpilledBatches(sm, "es-10"))
+	assert.Equal(0, countSpilledBatches(sm, "es-2"))
+
+	_, err = sm.loadSpilledBatch(spillKeyPrefix("es-2") + fmt.Sprintf(spillKeySequenceFormat, 2))
+	assert.Error(err)
+}
+
+func TestWebSocketRateLimit(t *testing.T) {
+	assert := assert.New(t)
+	wsChannels := newMockWebSocket()
+	es := &eventStream{
+		wsChannels:      wsChannels,
+		updateInterrupt: make(chan struct{}),
+	}
+	sio, _ := newWebSocketAction(es, &webSocketActionInfo{
+		DistributionMode: DistributionModeBroadcast,
+		MaxBatchesPerSec: 20,
+	})
+	go func() {
+		for range wsChannels.broadcast {
+		}
+	}()
+	defer close(wsChannels.broadcast)
+
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		assert.NoError(sio.attemptBatch(uint64(i), 1, []*eventData{}))
+	}
+	assert.GreaterOrEqual(int64(time.Since(start)), int64(100*time.Millisecond))
+
+	// An update to the stream interrupts the wait
+	sio.spec.MaxBatchesPerSec = 0.01
+	close(es.updateInterrupt)
+	err := sio.attemptBatch(3, 1, []*eventData{})
+	assert.EqualError(err, "Interrupted waiting for WebSocket connection to send event")
+}
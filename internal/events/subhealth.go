@@ -0,0 +1,248 @@
+// Copyright 2021 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package events
+
+import (
+	"context"
+	"math/big"
+	"time"
+
+	ethbinding "github.com/kaleido-io/ethbinding/pkg"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// SubscriptionHealthOK the subscription is keeping up with the chain, and delivering its events
+	SubscriptionHealthOK = "ok"
+	// SubscriptionHealthLagging the subscription is further behind the head of the chain than the configured lag
+	SubscriptionHealthLagging = "lagging"
+	// SubscriptionHealthStalled the subscription has not made any progress within the configured time
+	SubscriptionHealthStalled = "stalled"
+	// SubscriptionHealthErroring events are failing to decode or deliver, or the subscription is suspended
+	SubscriptionHealthErroring = "erroring"
+)
+
+const (
+	defaultHealthLagBlocks        = 100
+	defaultHealthStalledSec       = 300
+	defaultHealthCheckIntervalSec = 30
+)
+
+var subscriptionHealthStatuses = []string{
+	SubscriptionHealthOK,
+	SubscriptionHealthLagging,
+	SubscriptionHealthStalled,
+	SubscriptionHealthErroring,
+}
+
+// HealthConf configures how the health of each subscription is scored. The health is
+// checked periodically, so it is available on listings and metrics without querying the
+// node each time. If MaxDecodeErrors is set, a subscription is suspended once that many
+// consecutive events have failed to decode, rather than failing on every poll
+type HealthConf struct {
+	LagBlocks        int64 `json:"lagBlocks,omitempty"`
+	StalledSec       int   `json:"stalledSec,omitempty"`
+	CheckIntervalSec int   `json:"checkIntervalSec,omitempty"`
+	MaxDecodeErrors  int   `json:"maxDecodeErrors,omitempty"`
+}
+
+// SubscriptionHealth is the health of a subscription at the last check. Lag is the number of
+// blocks the subscription has yet to read up to the head of the chain, and LastProgress is the
+// last time it moved forwards, or polled the node with nothing waiting to be delivered
+type SubscriptionHealth struct {
+	Status       string    `json:"status"`
+	Lag          int64     `json:"lag"`
+	LastProgress time.Time `json:"lastProgress"`
+	DecodeErrors int       `json:"decodeErrors,omitempty"`
+	LastError    string    `json:"lastError,omitempty"`
+	LastDelivery string    `json:"lastDelivery,omitempty"`
+	Checked      time.Time `json:"checked"`
+}
+
+// setLastDeliveryStatus records the outcome of the latest batch, which applies to all the
+// subscriptions of the stream
+func (a *eventStream) setLastDeliveryStatus(status string) {
+	a.healthLock.Lock()
+	defer a.healthLock.Unlock()
+	a.lastDeliveryStatus = status
+}
+
+func (a *eventStream) getLastDeliveryStatus() string {
+	a.healthLock.Lock()
+	defer a.healthLock.Unlock()
+	return a.lastDeliveryStatus
+}
+
+// blockLag is the number of blocks between a checkpoint and the head of the chain. The checkpoint
+// is the next block to read, so it is one ahead of the chain head when up to date
+func blockLag(chainHead, block *big.Int) int64 {
+	lag := new(big.Int).Sub(chainHead, block)
+	lag.Add(lag, big.NewInt(1))
+	if lag.Sign() < 0 {
+		return 0
+	}
+	return lag.Int64()
+}
+
+// checkpointBlock is the next block a subscription will read. The in-memory position is ahead
+// of the persisted checkpoint while the stream is running. Before the stream has polled, only
+// the persisted checkpoint is available.
+func (s *subscriptionMGR) checkpointBlock(sub *subscription) (*big.Int, error) {
+	block := sub.blockHWM()
+	if block.Sign() <= 0 {
+		checkpoint, err := s.loadCheckpoint(sub.info.Stream)
+		if err != nil {
+			return nil, err
+		}
+		if persisted, exists := checkpoint[sub.info.ID]; exists {
+			block.Set(persisted)
+		}
+	}
+	return &block, nil
+}
+
+// scoreHealth builds the health of a subscription. Errors take precedence over a lack of
+// progress, which takes precedence over lag. The chain head is nil if it is not available,
+// in which case the lag is not known.
+func (s *subscriptionMGR) scoreHealth(sub *subscription, chainHead *big.Int, now time.Time) *SubscriptionHealth {
+	h := &SubscriptionHealth{
+		Status:       SubscriptionHealthOK,
+		LastProgress: sub.lp.getLastProgress().UTC(),
+		Checked:      now.UTC(),
+	}
+	h.DecodeErrors, h.LastError = sub.getDecodeErrors()
+	streamSuspended := false
+	if stream, err := s.streamByID(sub.info.Stream); err == nil {
+		h.LastDelivery = stream.getLastDeliveryStatus()
+		streamSuspended = stream.spec.Suspended
+	}
+	if chainHead != nil {
+		if block, err := s.checkpointBlock(sub); err != nil {
+			log.Warnf("%s: Failed to load checkpoint for health check: %s", sub.info.ID, err)
+		} else if block.Sign() > 0 {
+			h.Lag = blockLag(chainHead, block)
+		}
+	}
+	conf := &s.conf.Health
+	switch {
+	case sub.info.Suspended || h.DecodeErrors > 0 ||
+		h.LastDelivery == DeliveryStatusFailed || h.LastDelivery == DeliveryStatusDeadLettered:
+		h.Status = SubscriptionHealthErroring
+	case !streamSuspended && now.Sub(h.LastProgress) > time.Duration(conf.StalledSec)*time.Second:
+		// A suspended stream is not expected to make progress
+		h.Status = SubscriptionHealthStalled
+	case h.Lag > conf.LagBlocks:
+		h.Status = SubscriptionHealthLagging
+	}
+	return h
+}
+
+// checkHealth scores every subscription against the current head of the chain, and
+// refreshes the health metrics. The gauges are rebuilt each time, so deleted
+// subscriptions are removed from them.
+func (s *subscriptionMGR) checkHealth(now time.Time) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	var chainHead *big.Int
+	blockNumber := ethbinding.HexBigInt{}
+	if err := s.rpc.CallContext(ctx, &blockNumber, "eth_blockNumber"); err != nil {
+		log.Warnf("Failed to query the head of the chain for subscription health: %s", err)
+	} else {
+		chainHead = blockNumber.ToInt()
+	}
+
+	subs := s.subscriptionList()
+	health := make(map[string]*SubscriptionHealth, len(subs))
+	s.healthStatus.Reset()
+	s.healthLag.Reset()
+	for _, sub := range subs {
+		id := sub.info.ID
+		h := s.scoreHealth(sub, chainHead, now)
+		health[id] = h
+		for _, status := range subscriptionHealthStatuses {
+			v := float64(0)
+			if status == h.Status {
+				v = 1
+			}
+			s.healthStatus.Set(v, id, sub.info.Stream, status)
+		}
+		s.healthLag.Set(float64(h.Lag), id, sub.info.Stream)
+		if h.Status != SubscriptionHealthOK {
+			log.Debugf("%s: Subscription health %s (lag=%d decodeErrors=%d lastDelivery=%s)", id, h.Status, h.Lag, h.DecodeErrors, h.LastDelivery)
+		}
+	}
+	s.healthLock.Lock()
+	s.health = health
+	s.healthLock.Unlock()
+}
+
+func (s *subscriptionMGR) healthMonitor(interval time.Duration) {
+	for {
+		select {
+		case <-s.schedulerStop:
+			return
+		case <-time.After(interval):
+			s.checkHealth(time.Now())
+		}
+	}
+}
+
+// withHealth returns a copy of the info of a subscription with its health from the last
+// check, or the info itself if it has not been checked yet
+func (s *subscriptionMGR) withHealth(info *SubscriptionInfo) *SubscriptionInfo {
+	s.healthLock.Lock()
+	h, checked := s.health[info.ID]
+	s.healthLock.Unlock()
+	if !checked {
+		return info
+	}
+	withHealth := *info
+	withHealth.Health = h
+	return &withHealth
+}
+
+// suspendSubscription stops a subscription from polling for events, without affecting the
+// other subscriptions of its stream. Its checkpoint is kept, so it resumes from the same block
+func (s *subscriptionMGR) suspendSubscription(ctx context.Context, sub *subscription) error {
+	sub.info.Suspended = true
+	sub.markFilterStale(ctx, true)
+	_, err := s.storeSubscription(sub.info)
+	return err
+}
+
+// SuspendSubscription suspends a subscription
+func (s *subscriptionMGR) SuspendSubscription(ctx context.Context, id string) error {
+	sub, err := s.subscriptionByID(id)
+	if err != nil {
+		return err
+	}
+	return s.suspendSubscription(ctx, sub)
+}
+
+// ResumeSubscription restarts a subscription that was suspended, including those suspended
+// automatically after failing to decode events, from its checkpoint
+func (s *subscriptionMGR) ResumeSubscription(ctx context.Context, id string) error {
+	sub, err := s.subscriptionByID(id)
+	if err != nil {
+		return err
+	}
+	if !sub.info.Suspended {
+		return nil
+	}
+	sub.clearDecodeErrors()
+	sub.info.Suspended = false
+	_, err = s.storeSubscription(sub.info)
+	return err
+}
@@ -0,0 +1,294 @@
+// Copyright 2021 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package events
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"testing"
+	"time"
+
+	ethbinding "github.com/kaleido-io/ethbinding/pkg"
+	"github.com/kaleido-io/ethconnect/internal/eth"
+	"github.com/kaleido-io/ethconnect/internal/ethbind"
+	"github.com/kaleido-io/ethconnect/internal/kvstore"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSubscriptionHealthScoring(t *testing.T) {
+	assert := assert.New(t)
+	sm, stream, svr, eventStream := newTestStreamForBatching(
+		&StreamInfo{
+			Webhook: &webhookActionInfo{},
+		}, nil, 200)
+	defer close(eventStream)
+	defer svr.Close()
+	defer stream.stop()
+	stream.suspend(nil)
+	for !stream.isSuspendedAndIdle() {
+		time.Sleep(1 * time.Millisecond)
+	}
+
+	s := setupTestSubscription(assert, sm, stream, "myTestSub")
+	sm.rpc = eth.NewMockRPCClientForSync(nil, func(method string, res interface{}, args ...interface{}) {
+		if method == "eth_blockNumber" {
+			res.(*ethbinding.HexBigInt).ToInt().SetInt64(1000)
+		}
+	})
+	sub := sm.subscriptions[s.ID]
+	ctx := context.Background()
+
+	// Not checked yet
+	assert.Nil(sm.Subscriptions(ctx)[0].Health)
+
+	sub.lp.initBlockHWM(big.NewInt(990))
+	sm.checkHealth(time.Now())
+	info, err := sm.SubscriptionByID(ctx, s.ID)
+	assert.NoError(err)
+	assert.Equal(SubscriptionHealthOK, info.Health.Status)
+	assert.Equal(int64(11), info.Health.Lag)
+	assert.Equal(float64(1), sm.healthStatus.Value(s.ID, stream.spec.ID, SubscriptionHealthOK))
+	assert.Equal(float64(0), sm.healthStatus.Value(s.ID, stream.spec.ID, SubscriptionHealthLagging))
+	assert.Equal(float64(11), sm.healthLag.Value(s.ID, stream.spec.ID))
+	// The health is only set on a copy, so it is not persisted
+	assert.Nil(sub.info.Health)
+
+	sub.lp.initBlockHWM(big.NewInt(800))
+	sm.checkHealth(time.Now())
+	assert.Equal(SubscriptionHealthLagging, sm.Subscriptions(ctx)[0].Health.Status)
+	assert.Equal(float64(1), sm.healthStatus.Value(s.ID, stream.spec.ID, SubscriptionHealthLagging))
+	assert.Equal(float64(0), sm.healthStatus.Value(s.ID, stream.spec.ID, SubscriptionHealthOK))
+
+	// The stream is suspended, so no progress is expected
+	sm.checkHealth(time.Now().Add(1 * time.Hour))
+	assert.Equal(SubscriptionHealthLagging, sm.Subscriptions(ctx)[0].Health.Status)
+	stream.batchCond.L.Lock()
+	stream.spec.Suspended = false
+	stream.batchCond.L.Unlock()
+	sm.checkHealth(time.Now().Add(1 * time.Hour))
+	assert.Equal(SubscriptionHealthStalled, sm.Subscriptions(ctx)[0].Health.Status)
+	stream.suspend(nil)
+
+	stream.setLastDeliveryStatus(DeliveryStatusDeadLettered)
+	sm.checkHealth(time.Now())
+	info, _ = sm.SubscriptionByID(ctx, s.ID)
+	assert.Equal(SubscriptionHealthErroring, info.Health.Status)
+	assert.Equal(DeliveryStatusDeadLettered, info.Health.LastDelivery)
+
+	stream.setLastDeliveryStatus(DeliveryStatusDelivered)
+	sub.recordDecodeResult(fmt.Errorf("pop"))
+	sm.checkHealth(time.Now())
+	info, _ = sm.SubscriptionByID(ctx, s.ID)
+	assert.Equal(SubscriptionHealthErroring, info.Health.Status)
+	assert.Equal(1, info.Health.DecodeErrors)
+	assert.Equal("pop", info.Health.LastError)
+
+	// Deleted subscriptions are removed from the metrics
+	err = sm.DeleteSubscription(ctx, s.ID)
+	assert.NoError(err)
+	sm.checkHealth(time.Now())
+	assert.Equal(float64(0), sm.healthStatus.Value(s.ID, stream.spec.ID, SubscriptionHealthErroring))
+}
+
+func TestSubscriptionHealthChainHeadError(t *testing.T) {
+	assert := assert.New(t)
+	sm, stream, svr, eventStream := newTestStreamForBatching(
+		&StreamInfo{
+			Webhook: &webhookActionInfo{},
+		}, nil, 200)
+	defer close(eventStream)
+	defer svr.Close()
+	defer stream.stop()
+	stream.suspend(nil)
+
+	s := setupTestSubscription(assert, sm, stream, "myTestSub")
+	sm.rpc = eth.NewMockRPCClientForSync(fmt.Errorf("pop"), nil)
+	sm.subscriptions[s.ID].lp.initBlockHWM(big.NewInt(1))
+
+	sm.checkHealth(time.Now())
+	info, err := sm.SubscriptionByID(context.Background(), s.ID)
+	assert.NoError(err)
+	assert.Equal(SubscriptionHealthOK, info.Health.Status)
+	assert.Equal(int64(0), info.Health.Lag)
+}
+
+func TestSubscriptionHealthCheckpointLoadFail(t *testing.T) {
+	assert := assert.New(t)
+	db := kvstore.NewMockKV(nil)
+	sm, stream, svr, eventStream := newTestStreamForBatching(
+		&StreamInfo{
+			Webhook: &webhookActionInfo{},
+		}, db, 200)
+	defer close(eventStream)
+	defer svr.Close()
+	defer stream.stop()
+	stream.suspend(nil)
+
+	s := setupTestSubscription(assert, sm, stream, "myTestSub")
+	db.LoadErr = fmt.Errorf("pop")
+
+	sm.checkHealth(time.Now())
+	info, err := sm.SubscriptionByID(context.Background(), s.ID)
+	assert.NoError(err)
+	assert.Equal(int64(0), info.Health.Lag)
+}
+
+func TestSuspendResumeSubscription(t *testing.T) {
+	assert := assert.New(t)
+	sm, stream, svr, eventStream := newTestStreamForBatching(
+		&StreamInfo{
+			Webhook: &webhookActionInfo{},
+		}, nil, 200)
+	defer close(eventStream)
+	defer svr.Close()
+	defer stream.stop()
+	stream.suspend(nil)
+
+	s := setupTestSubscription(assert, sm, stream, "myTestSub")
+	sub := sm.subscriptions[s.ID]
+	ctx := context.Background()
+
+	err := sm.ResumeSubscription(ctx, s.ID)
+	assert.NoError(err)
+	assert.False(sub.info.Suspended)
+
+	err = sm.SuspendSubscription(ctx, s.ID)
+	assert.NoError(err)
+	assert.True(sub.info.Suspended)
+	assert.True(sub.filterStale)
+	b, _ := sm.db.Get(s.ID)
+	var stored SubscriptionInfo
+	json.Unmarshal(b, &stored)
+	assert.True(stored.Suspended)
+	assert.Nil(stored.Health)
+
+	sub.recordDecodeResult(fmt.Errorf("pop"))
+	err = sm.ResumeSubscription(ctx, s.ID)
+	assert.NoError(err)
+	assert.False(sub.info.Suspended)
+	count, lastErr := sub.getDecodeErrors()
+	assert.Equal(0, count)
+	assert.Empty(lastErr)
+	b, _ = sm.db.Get(s.ID)
+	var resumed SubscriptionInfo
+	json.Unmarshal(b, &resumed)
+	assert.False(resumed.Suspended)
+
+	err = sm.SuspendSubscription(ctx, "nope")
+	assert.EqualError(err, "Subscription with ID 'nope' not found")
+	err = sm.ResumeSubscription(ctx, "nope")
+	assert.EqualError(err, "Subscription with ID 'nope' not found")
+}
+
+func TestAutoSuspendOnDecodeErrors(t *testing.T) {
+	assert := assert.New(t)
+
+	m := &mockSubMgr{conf: &SubscriptionManagerConf{Health: HealthConf{MaxDecodeErrors: 2}}}
+	stream := &eventStream{
+		sm:   m,
+		spec: &StreamInfo{ID: "es-1"},
+	}
+	sub := &subscription{
+		info: &SubscriptionInfo{ID: "sb-1"},
+		lp:   newLogProcessor("sb-1", nil, stream),
+	}
+	ctx := context.Background()
+
+	sub.recordDecodeResult(fmt.Errorf("pop"))
+	stream.checkDecodeErrors(ctx, sub)
+	assert.False(sub.info.Suspended)
+
+	sub.recordDecodeResult(nil)
+	sub.recordDecodeResult(fmt.Errorf("pop"))
+	stream.checkDecodeErrors(ctx, sub)
+	assert.False(sub.info.Suspended)
+
+	sub.recordDecodeResult(fmt.Errorf("pop"))
+	stream.checkDecodeErrors(ctx, sub)
+	assert.True(sub.info.Suspended)
+	assert.Equal(1, len(m.suspendedSubs))
+
+	// Disabled by default
+	m = &mockSubMgr{}
+	stream.sm = m
+	stream.checkDecodeErrors(ctx, sub)
+	assert.Equal(0, len(m.suspendedSubs))
+}
+
+func TestProcessLogsCountsDecodeErrors(t *testing.T) {
+	assert := assert.New(t)
+
+	stream := &eventStream{
+		sm:          &mockSubMgr{},
+		spec:        &StreamInfo{},
+		eventStream: make(chan *eventData, 1),
+	}
+	eventABI := `{
+    "name": "Changed",
+    "inputs": [
+      {"name": "one", "type": "uint256"}
+    ]
+  }`
+	var marshaling ethbinding.ABIElementMarshaling
+	json.Unmarshal([]byte(eventABI), &marshaling)
+	event, err := ethbind.API.ABIElementMarshalingToABIEvent(&marshaling)
+	assert.NoError(err)
+
+	sub := &subscription{
+		info:    &SubscriptionInfo{ID: "sb-1"},
+		logName: "sb-1:Changed",
+		lp:      newLogProcessor("sb-1", event, stream),
+	}
+	ctx := context.Background()
+
+	sub.processLogs(ctx, "eth_getFilterChanges", []*logEntry{{Data: "0xzz"}, {Data: "0xzz"}})
+	count, lastErr := sub.getDecodeErrors()
+	assert.Equal(2, count)
+	assert.Regexp("sb-1:Changed: Failed to decode data", lastErr)
+
+	sub.processLogs(ctx, "eth_getFilterChanges", []*logEntry{{
+		Data: "0x000000000000000000000000000000000000000000000000000000000000000a",
+	}})
+	count, _ = sub.getDecodeErrors()
+	assert.Equal(0, count)
+
+	// A crash decoding the event is counted as an error
+	sub.lp.event = nil
+	sub.processLogs(ctx, "eth_getFilterChanges", []*logEntry{{Data: "0x00"}})
+	count, lastErr = sub.getDecodeErrors()
+	assert.Equal(1, count)
+	assert.Regexp("sb-1:Changed: Crashed decoding event", lastErr)
+}
+
+func TestMarkPolledRecordsProgress(t *testing.T) {
+	assert := assert.New(t)
+
+	lp := newLogProcessor("sb-1", nil, nil)
+	lp.lastProgress = time.Time{}
+	lp.initBlockHWM(big.NewInt(10))
+	lp.markPolled()
+	assert.False(lp.getLastProgress().IsZero())
+
+	// Events waiting to be delivered
+	lp.lastProgress = time.Time{}
+	lp.highestDispatched.SetInt64(10)
+	lp.markPolled()
+	assert.True(lp.getLastProgress().IsZero())
+
+	lp.batchComplete(&eventData{BlockNumber: "10"})
+	assert.False(lp.getLastProgress().IsZero())
+}
@@ -19,19 +19,24 @@ import (
 	"encoding/json"
 	"math/big"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/Shopify/sarama"
 	"github.com/spf13/cobra"
 
 	ethbinding "github.com/kaleido-io/ethbinding/pkg"
+	"github.com/kaleido-io/ethconnect/internal/auth"
 	"github.com/kaleido-io/ethconnect/internal/errors"
 	"github.com/kaleido-io/ethconnect/internal/eth"
 	"github.com/kaleido-io/ethconnect/internal/kvstore"
 	"github.com/kaleido-io/ethconnect/internal/messages"
+	"github.com/kaleido-io/ethconnect/internal/metrics"
+	"github.com/kaleido-io/ethconnect/internal/opsevents"
+	"github.com/kaleido-io/ethconnect/internal/quotas"
 	"github.com/kaleido-io/ethconnect/internal/utils"
 	"github.com/kaleido-io/ethconnect/internal/ws"
 	log "github.com/sirupsen/logrus"
-	"github.com/syndtr/goleveldb/leveldb"
 )
 
 const (
@@ -45,6 +50,7 @@ const (
 
 	defaultCatchupModeBlockGap = int64(250)
 	defaultCatchupModePageSize = int64(250)
+	streamSchedulerInterval    = 10 * time.Second
 )
 
 // SubscriptionManager provides REST APIs for managing events
@@ -55,13 +61,41 @@ type SubscriptionManager interface {
 	StreamByID(ctx context.Context, id string) (*StreamInfo, error)
 	UpdateStream(ctx context.Context, id string, spec *StreamInfo) (*StreamInfo, error)
 	SuspendStream(ctx context.Context, id string) error
+	SuspendStreamUntil(ctx context.Context, id string, resumeAt *time.Time) error
 	ResumeStream(ctx context.Context, id string) error
 	DeleteStream(ctx context.Context, id string) error
-	AddSubscription(ctx context.Context, addr *ethbinding.Address, event *ethbinding.ABIElementMarshaling, streamID, initialBlock, name string) (*SubscriptionInfo, error)
+	AddSubscription(ctx context.Context, addr *ethbinding.Address, event *ethbinding.ABIElementMarshaling, streamID, initialBlock, name string, aggregation *AggregationInfo) (*SubscriptionInfo, error)
+	AddRevertedTxnSubscription(ctx context.Context, addr *ethbinding.Address, abi ethbinding.ABIMarshaling, streamID, initialBlock, name string) (*SubscriptionInfo, error)
+	AddChainSubscription(ctx context.Context, subType string, addr *ethbinding.Address, streamID, initialBlock, name string) (*SubscriptionInfo, error)
 	Subscriptions(ctx context.Context) []*SubscriptionInfo
 	SubscriptionByID(ctx context.Context, id string) (*SubscriptionInfo, error)
 	ResetSubscription(ctx context.Context, id, initialBlock string) error
+	SuspendSubscription(ctx context.Context, id string) error
+	ResumeSubscription(ctx context.Context, id string) error
+	SubscriptionCheckpoint(ctx context.Context, id string) (*SubscriptionCheckpoint, error)
+	SetSubscriptionCheckpoint(ctx context.Context, id, block string) (*SubscriptionCheckpoint, error)
+	SubscriptionCheckpoints(ctx context.Context) map[string]*big.Int
+	RewindSubscriptions(ctx context.Context, checkpoints map[string]*big.Int, block *big.Int) []string
 	DeleteSubscription(ctx context.Context, id string) error
+	AddBackfill(ctx context.Context, spec *BackfillInfo) (*BackfillInfo, error)
+	Backfills(ctx context.Context) []*BackfillInfo
+	BackfillByID(ctx context.Context, id string) (*BackfillInfo, error)
+	ResumeBackfill(ctx context.Context, id string) (*BackfillInfo, error)
+	DeleteBackfill(ctx context.Context, id string) error
+	StreamDeliveries(ctx context.Context, id string, skip, limit int) ([]*DeliveryRecord, error)
+	StreamDeadLetters(ctx context.Context, id string) ([]*DeadLetter, error)
+	ReplayDeadLetters(ctx context.Context, id string) (int, error)
+	AddInvalidationHook(ctx context.Context, spec *InvalidationHookInfo) (*InvalidationHookInfo, error)
+	InvalidationHooks(ctx context.Context) []*InvalidationHookInfo
+	InvalidationHookByID(ctx context.Context, id string) (*InvalidationHookInfo, error)
+	DeleteInvalidationHook(ctx context.Context, id string) error
+	AddCheckpointGroup(ctx context.Context, spec *CheckpointGroupInfo) (*CheckpointGroupInfo, error)
+	CheckpointGroups(ctx context.Context) []*CheckpointGroupInfo
+	CheckpointGroupByID(ctx context.Context, id string) (*CheckpointGroupInfo, error)
+	CheckpointGroupCheckpoint(ctx context.Context, id string) (*CheckpointGroupCheckpoint, error)
+	ResetCheckpointGroup(ctx context.Context, id, initialBlock string) error
+	DeleteCheckpointGroup(ctx context.Context, id string) error
+	SetEventReactor(reactor EventReactor)
 	Close()
 }
 
@@ -72,31 +106,73 @@ type subscriptionManager interface {
 	subscriptionsForStream(string) []*subscription
 	loadCheckpoint(string) (map[string]*big.Int, error)
 	storeCheckpoint(string, map[string]*big.Int) error
+	alignCheckpointGroups(string, map[string]*big.Int)
+	catchupThrottle(tenant string) *quotas.Throttle
+	batchSigner() *batchSigner
+	recordDelivery(*DeliveryRecord)
+	storeSpilledBatch(string, []*eventData) error
+	loadSpilledBatch(string) ([]*eventData, error)
+	newKafkaProducer(*BackfillKafkaConf) (sarama.SyncProducer, error)
+	invalidateCaches(address, event, blockNumber string)
+	react(event *eventData)
+	suspendSubscription(context.Context, *subscription) error
 }
 
 // SubscriptionManagerConf configuration
 type SubscriptionManagerConf struct {
-	EventLevelDBPath        string `json:"eventsDB"`
-	EventPollingIntervalSec uint64 `json:"eventPollingIntervalSec,omitempty"`
-	CatchupModeBlockGap     int64  `json:"catchupModeBlockGap,omitempty"`
-	CatchupModePageSize     int64  `json:"catchupModePageSize,omitempty"`
-	WebhooksAllowPrivateIPs bool   `json:"webhooksAllowPrivateIPs,omitempty"`
+	EventLevelDBPath        string             `json:"eventsDB"`
+	EventPollingIntervalSec uint64             `json:"eventPollingIntervalSec,omitempty"`
+	CatchupModeBlockGap     int64              `json:"catchupModeBlockGap,omitempty"`
+	CatchupModePageSize     int64              `json:"catchupModePageSize,omitempty"`
+	WebhooksAllowPrivateIPs bool               `json:"webhooksAllowPrivateIPs,omitempty"`
+	Quotas                  quotas.Conf        `json:"quotas,omitempty"`
+	BatchSigning            BatchSigningConf   `json:"batchSigning,omitempty"`
+	SchemaRegistry          SchemaRegistryConf `json:"schemaRegistry,omitempty"`
+	Backfills               BackfillConf       `json:"backfills,omitempty"`
+	Deliveries              DeliveryAuditConf  `json:"deliveries,omitempty"`
+	DeadLetters             DeadLetterConf     `json:"deadLetters,omitempty"`
+	Invalidations           InvalidationConf   `json:"invalidations,omitempty"`
+	Health                  HealthConf         `json:"health,omitempty"`
 }
 
 type subscriptionMGR struct {
-	conf          *SubscriptionManagerConf
-	rpcConf       *eth.RPCConnOpts
-	db            kvstore.KVStore
-	rpc           eth.RPCClient
-	subscriptions map[string]*subscription
-	streams       map[string]*eventStream
-	closed        bool
-	wsChannels    ws.WebSocketChannels
+	conf                *SubscriptionManagerConf
+	rpcConf             *eth.RPCConnOpts
+	db                  kvstore.KVStore
+	rpc                 eth.RPCClient
+	entriesLock         sync.RWMutex
+	subscriptions       map[string]*subscription
+	streams             map[string]*eventStream
+	closed              bool
+	wsChannels          ws.WebSocketChannels
+	schedulerStop       chan struct{}
+	throttleLock        sync.Mutex
+	throttles           map[string]*quotas.Throttle
+	signer              *batchSigner
+	schemas             *schemaRegistry
+	backfills           map[string]*backfill
+	kafkaProducer       func(brokers []string, conf *sarama.Config) (sarama.SyncProducer, error)
+	deliveryLock        sync.Mutex
+	deliveryCounts      map[string]int
+	invalidationLock    sync.RWMutex
+	invalidationHooks   map[string]*invalidationHook
+	invalidations       chan *invalidationPing
+	invalidationWorkers sync.WaitGroup
+	checkpointGroupLock sync.RWMutex
+	checkpointGroups    map[string]*CheckpointGroupInfo
+	reactorLock         sync.RWMutex
+	reactor             EventReactor
+	batchSizes          *metrics.HistogramVec
+	deliveryLatency     *metrics.HistogramVec
+	healthLock          sync.Mutex
+	health              map[string]*SubscriptionHealth
+	healthStatus        *metrics.GaugeVec
+	healthLag           *metrics.GaugeVec
 }
 
 // CobraInitSubscriptionManager standard naming for cobra command params
 func CobraInitSubscriptionManager(cmd *cobra.Command, conf *SubscriptionManagerConf) {
-	cmd.Flags().StringVarP(&conf.EventLevelDBPath, "events-db", "E", "", "Level DB location for subscription management")
+	cmd.Flags().StringVarP(&conf.EventLevelDBPath, "events-db", "E", "", "Level DB location, or KV store connection string (such as memory://), for subscription management")
 	cmd.Flags().Uint64VarP(&conf.EventPollingIntervalSec, "events-polling-int", "j", 10, "Event polling interval (ms)")
 	cmd.Flags().BoolVarP(&conf.WebhooksAllowPrivateIPs, "events-privips", "J", false, "Allow private IPs in Webhooks")
 }
@@ -104,11 +180,40 @@ func CobraInitSubscriptionManager(cmd *cobra.Command, conf *SubscriptionManagerC
 // NewSubscriptionManager constructor
 func NewSubscriptionManager(conf *SubscriptionManagerConf, rpc eth.RPCClient, wsChannels ws.WebSocketChannels) SubscriptionManager {
 	sm := &subscriptionMGR{
-		conf:          conf,
-		rpc:           rpc,
-		subscriptions: make(map[string]*subscription),
-		streams:       make(map[string]*eventStream),
-		wsChannels:    wsChannels,
+		conf:              conf,
+		rpc:               rpc,
+		subscriptions:     make(map[string]*subscription),
+		streams:           make(map[string]*eventStream),
+		wsChannels:        wsChannels,
+		throttles:         make(map[string]*quotas.Throttle),
+		backfills:         make(map[string]*backfill),
+		kafkaProducer:     sarama.NewSyncProducer,
+		deliveryCounts:    make(map[string]int),
+		invalidationHooks: make(map[string]*invalidationHook),
+		checkpointGroups:  make(map[string]*CheckpointGroupInfo),
+		batchSizes: metrics.NewHistogramVec(
+			"ethconnect_eventstream_batch_size",
+			"Number of events in each batch delivered by an event stream",
+			batchSizeBuckets,
+			"stream",
+		),
+		deliveryLatency: metrics.NewHistogramVec(
+			"ethconnect_eventstream_delivery_seconds",
+			"Time to deliver a batch to the action of an event stream, including retries, by outcome",
+			deliveryLatencyBuckets,
+			"stream", "status",
+		),
+		health: make(map[string]*SubscriptionHealth),
+		healthStatus: metrics.NewGaugeVec(
+			"ethconnect_subscription_health",
+			"Health of each subscription, set to 1 for its current status and 0 for the others",
+			"subscription", "stream", "status",
+		),
+		healthLag: metrics.NewGaugeVec(
+			"ethconnect_subscription_lag_blocks",
+			"Number of blocks each subscription has yet to read up to the head of the chain",
+			"subscription", "stream",
+		),
 	}
 	if conf.EventPollingIntervalSec <= 0 {
 		conf.EventPollingIntervalSec = 1
@@ -119,6 +224,30 @@ func NewSubscriptionManager(conf *SubscriptionManagerConf, rpc eth.RPCClient, ws
 	if conf.CatchupModePageSize <= 0 {
 		conf.CatchupModePageSize = defaultCatchupModePageSize
 	}
+	if conf.Backfills.PageSize <= 0 {
+		conf.Backfills.PageSize = conf.CatchupModePageSize
+	}
+	if conf.Backfills.MaxAttempts <= 0 {
+		conf.Backfills.MaxAttempts = defaultBackfillMaxAttempts
+	}
+	if conf.Deliveries.MaxRecords <= 0 {
+		conf.Deliveries.MaxRecords = defaultDeliveryMaxRecords
+	}
+	if conf.Invalidations.Workers <= 0 {
+		conf.Invalidations.Workers = defaultInvalidationWorkers
+	}
+	if conf.Invalidations.QueueSize <= 0 {
+		conf.Invalidations.QueueSize = defaultInvalidationQueueSize
+	}
+	if conf.Health.LagBlocks <= 0 {
+		conf.Health.LagBlocks = defaultHealthLagBlocks
+	}
+	if conf.Health.StalledSec <= 0 {
+		conf.Health.StalledSec = defaultHealthStalledSec
+	}
+	if conf.Health.CheckIntervalSec <= 0 {
+		conf.Health.CheckIntervalSec = defaultHealthCheckIntervalSec
+	}
 	return sm
 }
 
@@ -128,14 +257,15 @@ func (s *subscriptionMGR) SubscriptionByID(ctx context.Context, id string) (*Sub
 	if err != nil {
 		return nil, err
 	}
-	return sub.info, err
+	return s.withHealth(sub.info), err
 }
 
 // Subscriptions used externally to get list subscriptions
 func (s *subscriptionMGR) Subscriptions(ctx context.Context) []*SubscriptionInfo {
-	l := make([]*SubscriptionInfo, 0, len(s.subscriptions))
-	for _, sub := range s.subscriptions {
-		l = append(l, sub.info)
+	subs := s.subscriptionList()
+	l := make([]*SubscriptionInfo, 0, len(subs))
+	for _, sub := range subs {
+		l = append(l, s.withHealth(sub.info))
 	}
 	return l
 }
@@ -155,14 +285,127 @@ func (s *subscriptionMGR) setInitialBlock(i *SubscriptionInfo, initialBlock stri
 }
 
 // AddSubscription adds a new subscription
-func (s *subscriptionMGR) AddSubscription(ctx context.Context, addr *ethbinding.Address, event *ethbinding.ABIElementMarshaling, streamID, initialBlock, name string) (*SubscriptionInfo, error) {
+func (s *subscriptionMGR) AddSubscription(ctx context.Context, addr *ethbinding.Address, event *ethbinding.ABIElementMarshaling, streamID, initialBlock, name string, aggregation *AggregationInfo) (*SubscriptionInfo, error) {
+	i, err := s.newSubscriptionInfo(ctx, streamID, initialBlock, name)
+	if err != nil {
+		return nil, err
+	}
+	i.Event = event
+	i.Aggregation = aggregation
+	// Create it
+	sub, err := newSubscription(s, s.rpc, addr, i)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.addSubscriptionEntry(sub); err != nil {
+		return nil, err
+	}
+	// Publish the schema of the events, before any are delivered
+	if s.schemas != nil {
+		if i.Schema, err = s.schemas.publish(ctx, event, sub.lp.event); err != nil {
+			s.removeSubscriptionEntry(sub.info.ID)
+			return nil, err
+		}
+	}
+	return s.storeSubscription(sub.info)
+}
+
+// AddRevertedTxnSubscription adds a subscription to the transactions sent to a contract that
+// reverted. The functions and errors of the ABI are used to decode the calldata and revert reason
+func (s *subscriptionMGR) AddRevertedTxnSubscription(ctx context.Context, addr *ethbinding.Address, abi ethbinding.ABIMarshaling, streamID, initialBlock, name string) (*SubscriptionInfo, error) {
+	i, err := s.newSubscriptionInfo(ctx, streamID, initialBlock, name)
+	if err != nil {
+		return nil, err
+	}
+	i.Type = SubscriptionTypeRevertedTransactions
+	i.ABI = abi
+	sub, err := newSubscription(s, s.rpc, addr, i)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.addSubscriptionEntry(sub); err != nil {
+		return nil, err
+	}
+	return s.storeSubscription(sub.info)
+}
+
+// AddChainSubscription adds a subscription to the blocks of the chain, or to its pending
+// transactions, which are delivered through the same streams as events
+func (s *subscriptionMGR) AddChainSubscription(ctx context.Context, subType string, addr *ethbinding.Address, streamID, initialBlock, name string) (*SubscriptionInfo, error) {
+	if subType != SubscriptionTypeBlocks && subType != SubscriptionTypePendingTransactions {
+		return nil, errors.Errorf(errors.EventStreamsChainSubBadType, subType)
+	}
+	i, err := s.newSubscriptionInfo(ctx, streamID, initialBlock, name)
+	if err != nil {
+		return nil, err
+	}
+	i.Type = subType
+	sub, err := newSubscription(s, s.rpc, addr, i)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.addSubscriptionEntry(sub); err != nil {
+		return nil, err
+	}
+	return s.storeSubscription(sub.info)
+}
+
+// addSubscriptionEntry checks the subscription quota of the tenant, and adds a new
+// subscription, under the same lock so concurrent requests cannot exceed the quota
+func (s *subscriptionMGR) addSubscriptionEntry(sub *subscription) error {
+	s.entriesLock.Lock()
+	defer s.entriesLock.Unlock()
+	count := 0
+	for _, existing := range s.subscriptions {
+		if existing.info.Tenant == sub.info.Tenant {
+			count++
+		}
+	}
+	if err := s.conf.Quotas.Check(sub.info.Tenant, quotas.Subscriptions, count); err != nil {
+		return err
+	}
+	s.subscriptions[sub.info.ID] = sub
+	return nil
+}
+
+func (s *subscriptionMGR) removeSubscriptionEntry(id string) {
+	s.entriesLock.Lock()
+	delete(s.subscriptions, id)
+	s.entriesLock.Unlock()
+}
+
+// subscriptionList returns a snapshot of the subscriptions, to iterate without holding the lock
+func (s *subscriptionMGR) subscriptionList() []*subscription {
+	s.entriesLock.RLock()
+	defer s.entriesLock.RUnlock()
+	subs := make([]*subscription, 0, len(s.subscriptions))
+	for _, sub := range s.subscriptions {
+		subs = append(subs, sub)
+	}
+	return subs
+}
+
+// streamList returns a snapshot of the streams, to iterate without holding the lock
+func (s *subscriptionMGR) streamList() []*eventStream {
+	s.entriesLock.RLock()
+	defer s.entriesLock.RUnlock()
+	streams := make([]*eventStream, 0, len(s.streams))
+	for _, stream := range s.streams {
+		streams = append(streams, stream)
+	}
+	return streams
+}
+
+// newSubscriptionInfo builds the common parts of a new subscription
+func (s *subscriptionMGR) newSubscriptionInfo(ctx context.Context, streamID, initialBlock, name string) (*SubscriptionInfo, error) {
+	tenant := auth.GetTenant(ctx)
 	i := &SubscriptionInfo{
 		TimeSorted: messages.TimeSorted{
 			CreatedISO8601: time.Now().UTC().Format(time.RFC3339),
 		},
 		ID:     subIDPrefix + utils.UUIDv4(),
-		Event:  event,
 		Stream: streamID,
+		Tenant: tenant,
 	}
 	i.Path = SubPathPrefix + "/" + i.ID
 	// Set any user supplied a name for the subscription
@@ -173,19 +416,35 @@ func (s *subscriptionMGR) AddSubscription(ctx context.Context, addr *ethbinding.
 	if err := s.setInitialBlock(i, initialBlock); err != nil {
 		return nil, err
 	}
-	// Create it
-	sub, err := newSubscription(s, s.rpc, addr, i)
-	if err != nil {
-		return nil, err
-	}
-	s.subscriptions[sub.info.ID] = sub
-	return s.storeSubscription(sub.info)
+	return i, nil
 }
 
 func (s *subscriptionMGR) config() *SubscriptionManagerConf {
 	return s.conf
 }
 
+// batchSigner returns the signer for event batches, or nil if no signing key is configured
+func (s *subscriptionMGR) batchSigner() *batchSigner {
+	return s.signer
+}
+
+// catchupThrottle returns the throttle shared by all the subscriptions of a tenant
+// in catch-up mode, or nil if the tenant's catch-up rate is not limited
+func (s *subscriptionMGR) catchupThrottle(tenant string) *quotas.Throttle {
+	perSec := s.conf.Quotas.For(tenant).MaxCatchupBlocksPerSec
+	if perSec <= 0 {
+		return nil
+	}
+	s.throttleLock.Lock()
+	defer s.throttleLock.Unlock()
+	t, ok := s.throttles[tenant]
+	if !ok {
+		t = quotas.NewThrottle(perSec)
+		s.throttles[tenant] = t
+	}
+	return t
+}
+
 // ResetSubscription restarts the steam from the specified block
 func (s *subscriptionMGR) ResetSubscription(ctx context.Context, id, initialBlock string) error {
 	sub, err := s.subscriptionByID(id)
@@ -205,9 +464,86 @@ func (s *subscriptionMGR) resetSubscription(ctx context.Context, sub *subscripti
 	}
 	// Request a reset on the next poling cycle
 	sub.requestReset()
+	opsevents.Publish(opsevents.CheckpointReset, map[string]interface{}{
+		"subscription": sub.info.ID,
+		"stream":       sub.info.Stream,
+		"fromBlock":    sub.info.FromBlock,
+	})
 	return nil
 }
 
+// SubscriptionCheckpoint returns the current position of a subscription, and how far
+// it is behind the head of the chain
+func (s *subscriptionMGR) SubscriptionCheckpoint(ctx context.Context, id string) (*SubscriptionCheckpoint, error) {
+	sub, err := s.subscriptionByID(id)
+	if err != nil {
+		return nil, err
+	}
+	stream, err := s.streamByID(sub.info.Stream)
+	if err != nil {
+		return nil, err
+	}
+	cp := &SubscriptionCheckpoint{
+		ID:            sub.info.ID,
+		Stream:        sub.info.Stream,
+		Suspended:     stream.spec.Suspended,
+		LastDelivered: sub.lp.getLastDelivered(),
+	}
+	block, err := s.checkpointBlock(sub)
+	if err != nil {
+		return nil, err
+	}
+	if block.Sign() > 0 {
+		cp.Block = block.String()
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	chainHead := ethbinding.HexBigInt{}
+	if err := s.rpc.CallContext(ctx, &chainHead, "eth_blockNumber"); err != nil {
+		cp.ChainHeadError = errors.Errorf(errors.RPCCallReturnedError, "eth_blockNumber", err).Error()
+		return cp, nil
+	}
+	cp.ChainHead = chainHead.ToInt().String()
+	if cp.Block != "" {
+		cp.Lag = blockLag(chainHead.ToInt(), block)
+	}
+	return cp, nil
+}
+
+// SetSubscriptionCheckpoint moves a subscription to start from an explicit block when its stream
+// is next resumed. The stream must be suspended, so the change cannot race with the event poller.
+func (s *subscriptionMGR) SetSubscriptionCheckpoint(ctx context.Context, id, block string) (*SubscriptionCheckpoint, error) {
+	sub, err := s.subscriptionByID(id)
+	if err != nil {
+		return nil, err
+	}
+	stream, err := s.streamByID(sub.info.Stream)
+	if err != nil {
+		return nil, err
+	}
+	var newBlock big.Int
+	if _, ok := newBlock.SetString(block, 10); !ok || newBlock.Sign() <= 0 {
+		return nil, errors.Errorf(errors.EventStreamsCheckpointBadBlock, block)
+	}
+	if !stream.isSuspendedAndIdle() {
+		return nil, errors.Errorf(errors.EventStreamsCheckpointStreamActive, stream.spec.ID)
+	}
+	checkpoint, err := s.loadCheckpoint(sub.info.Stream)
+	if err != nil {
+		return nil, err
+	}
+	checkpoint[sub.info.ID] = &newBlock
+	if err := s.storeCheckpoint(sub.info.Stream, checkpoint); err != nil {
+		return nil, errors.Errorf(errors.EventStreamsCheckpointStoreFailed, err)
+	}
+	// A pending reset would discard the new checkpoint on resume
+	sub.resetRequested = false
+	sub.setCheckpointBlockHeight(&newBlock)
+	sub.markFilterStale(ctx, true)
+	return s.SubscriptionCheckpoint(ctx, id)
+}
+
 // DeleteSubscription deletes a subscription
 func (s *subscriptionMGR) DeleteSubscription(ctx context.Context, id string) error {
 	sub, err := s.subscriptionByID(id)
@@ -218,7 +554,8 @@ func (s *subscriptionMGR) DeleteSubscription(ctx context.Context, id string) err
 }
 
 func (s *subscriptionMGR) deleteSubscription(ctx context.Context, sub *subscription) error {
-	delete(s.subscriptions, sub.info.ID)
+	s.removeSubscriptionEntry(sub.info.ID)
+	s.leaveCheckpointGroup(sub.info.ID)
 	sub.unsubscribe(ctx, true)
 	if err := s.db.Delete(sub.info.ID); err != nil {
 		return err
@@ -245,8 +582,9 @@ func (s *subscriptionMGR) StreamByID(ctx context.Context, id string) (*StreamInf
 
 // Streams used externally to get list streams
 func (s *subscriptionMGR) Streams(ctx context.Context) []*StreamInfo {
-	l := make([]*StreamInfo, 0, len(s.subscriptions))
-	for _, stream := range s.streams {
+	streams := s.streamList()
+	l := make([]*StreamInfo, 0, len(streams))
+	for _, stream := range streams {
 		l = append(l, stream.spec)
 	}
 	return l
@@ -254,6 +592,8 @@ func (s *subscriptionMGR) Streams(ctx context.Context) []*StreamInfo {
 
 // AddStream adds a new stream
 func (s *subscriptionMGR) AddStream(ctx context.Context, spec *StreamInfo) (*StreamInfo, error) {
+	tenant := auth.GetTenant(ctx)
+	spec.Tenant = tenant
 	spec.ID = streamIDPrefix + utils.UUIDv4()
 	spec.CreatedISO8601 = time.Now().UTC().Format(time.RFC3339)
 	spec.Path = StreamPathPrefix + "/" + spec.ID
@@ -261,10 +601,31 @@ func (s *subscriptionMGR) AddStream(ctx context.Context, spec *StreamInfo) (*Str
 	if err != nil {
 		return nil, err
 	}
-	s.streams[stream.spec.ID] = stream
+	if err := s.addStreamEntry(stream); err != nil {
+		stream.stop()
+		return nil, err
+	}
 	return s.storeStream(stream.spec)
 }
 
+// addStreamEntry checks the stream quota of the tenant, and adds a new stream, under the
+// same lock so concurrent requests cannot exceed the quota
+func (s *subscriptionMGR) addStreamEntry(stream *eventStream) error {
+	s.entriesLock.Lock()
+	defer s.entriesLock.Unlock()
+	count := 0
+	for _, existing := range s.streams {
+		if existing.spec.Tenant == stream.spec.Tenant {
+			count++
+		}
+	}
+	if err := s.conf.Quotas.Check(stream.spec.Tenant, quotas.Streams, count); err != nil {
+		return err
+	}
+	s.streams[stream.spec.ID] = stream
+	return nil
+}
+
 // UpdateStream updates an existing stream
 func (s *subscriptionMGR) UpdateStream(ctx context.Context, id string, spec *StreamInfo) (*StreamInfo, error) {
 	stream, err := s.streamByID(id)
@@ -293,21 +654,32 @@ func (s *subscriptionMGR) DeleteStream(ctx context.Context, id string) error {
 		return err
 	}
 	// We have to clean up all the associated subs
-	for _, sub := range s.subscriptions {
-		if sub.info.Stream == stream.spec.ID {
-			s.deleteSubscription(ctx, sub)
-		}
+	for _, sub := range s.subscriptionsForStream(stream.spec.ID) {
+		s.deleteSubscription(ctx, sub)
 	}
+	s.entriesLock.Lock()
 	delete(s.streams, stream.spec.ID)
+	s.entriesLock.Unlock()
 	stream.stop()
 	if err = s.db.Delete(stream.spec.ID); err != nil {
 		return err
 	}
 	s.deleteCheckpoint(stream.spec.ID)
+	s.deliveryLock.Lock()
+	if s.deliveryCounts[stream.spec.ID] > 0 {
+		s.deleteDeliveries(stream.spec.ID, 0)
+	}
+	delete(s.deliveryCounts, stream.spec.ID)
+	s.deliveryLock.Unlock()
+	if stream.spillSequence > 0 {
+		s.deleteSpilledBatches(stream.spec.ID)
+	}
 	return nil
 }
 
 func (s *subscriptionMGR) subscriptionsForStream(id string) []*subscription {
+	s.entriesLock.RLock()
+	defer s.entriesLock.RUnlock()
 	subIDs := make([]*subscription, 0)
 	for _, sub := range s.subscriptions {
 		if sub.info.Stream == id {
@@ -319,13 +691,34 @@ func (s *subscriptionMGR) subscriptionsForStream(id string) []*subscription {
 
 // SuspendStream suspends a streamm from firing
 func (s *subscriptionMGR) SuspendStream(ctx context.Context, id string) error {
+	return s.SuspendStreamUntil(ctx, id, nil)
+}
+
+// SuspendStreamUntil suspends a stream, and resumes it automatically at the supplied time (if non-nil)
+func (s *subscriptionMGR) SuspendStreamUntil(ctx context.Context, id string, resumeAt *time.Time) error {
 	stream, err := s.streamByID(id)
 	if err != nil {
 		return err
 	}
-	stream.suspend()
+	if resumeAt != nil && !resumeAt.After(time.Now()) {
+		return errors.Errorf(errors.EventStreamsResumeAtInPast, resumeAt.Format(time.RFC3339))
+	}
+	return s.suspendStream(stream, resumeAt)
+}
+
+func (s *subscriptionMGR) suspendStream(stream *eventStream, resumeAt *time.Time) error {
+	if resumeAt != nil {
+		utc := resumeAt.UTC()
+		resumeAt = &utc
+	}
+	stream.suspend(resumeAt)
+	opsevents.Publish(opsevents.StreamSuspended, map[string]interface{}{
+		"stream":   stream.spec.ID,
+		"name":     stream.spec.Name,
+		"resumeAt": resumeAt,
+	})
 	// Persist the state change
-	_, err = s.storeStream(stream.spec)
+	_, err := s.storeStream(stream.spec)
 	return err
 }
 
@@ -335,17 +728,174 @@ func (s *subscriptionMGR) ResumeStream(ctx context.Context, id string) error {
 	if err != nil {
 		return err
 	}
-	if err = stream.resume(); err != nil {
+	return s.resumeStream(stream)
+}
+
+func (s *subscriptionMGR) resumeStream(stream *eventStream) error {
+	if err := stream.resume(); err != nil {
 		return err
 	}
+	opsevents.Publish(opsevents.StreamResumed, map[string]interface{}{
+		"stream": stream.spec.ID,
+		"name":   stream.spec.Name,
+	})
 	// Persist the state change
-	_, err = s.storeStream(stream.spec)
+	_, err := s.storeStream(stream.spec)
 	return err
 }
 
+// checkSchedules suspends streams entering one of their maintenance windows, and resumes
+// suspended streams once their resumeAt time has passed. A stream is only suspended once for
+// each window, so it can be resumed manually part way through.
+func (s *subscriptionMGR) checkSchedules(now time.Time) {
+	for _, stream := range s.streamList() {
+		suspendUntil, resume := stream.scheduledAction(now)
+		if suspendUntil != nil {
+			log.Infof("%s: Suspending for maintenance window until %s", stream.spec.ID, suspendUntil.UTC().Format(time.RFC3339))
+			if err := s.suspendStream(stream, suspendUntil); err != nil {
+				log.Errorf("%s: Failed to store suspended stream: %s", stream.spec.ID, err)
+			}
+		} else if resume {
+			log.Infof("%s: Resuming at scheduled time", stream.spec.ID)
+			if err := s.resumeStream(stream); err != nil {
+				// The poller can still be stopping if the stream was only just suspended, so we try again next time
+				log.Warnf("%s: Scheduled resume failed: %s", stream.spec.ID, err)
+			}
+		}
+	}
+}
+
+func (s *subscriptionMGR) streamScheduler(interval time.Duration) {
+	for {
+		select {
+		case <-s.schedulerStop:
+			return
+		case <-time.After(interval):
+			s.checkSchedules(time.Now())
+		}
+	}
+}
+
+// AddBackfill validates and starts a new backfill. The toBlock is the head of the chain
+// if it is not specified
+func (s *subscriptionMGR) AddBackfill(ctx context.Context, spec *BackfillInfo) (*BackfillInfo, error) {
+	if _, err := parseBackfillEvent(spec.Event); err != nil {
+		return nil, err
+	}
+	if err := s.validateBackfillTarget(spec); err != nil {
+		return nil, err
+	}
+	from := big.NewInt(0)
+	if spec.FromBlock != "" {
+		if _, ok := from.SetString(spec.FromBlock, 0); !ok || from.Sign() < 0 {
+			return nil, errors.Errorf(errors.BackfillBadBlock, "fromBlock", spec.FromBlock)
+		}
+	}
+	to := new(big.Int)
+	if spec.ToBlock == "" || spec.ToBlock == FromBlockLatest {
+		blockNumber := ethbinding.HexBigInt{}
+		if err := s.rpc.CallContext(ctx, &blockNumber, "eth_blockNumber"); err != nil {
+			return nil, errors.Errorf(errors.RPCCallReturnedError, "eth_blockNumber", err)
+		}
+		to.Set(blockNumber.ToInt())
+	} else if _, ok := to.SetString(spec.ToBlock, 0); !ok {
+		return nil, errors.Errorf(errors.BackfillBadBlock, "toBlock", spec.ToBlock)
+	}
+	if from.Cmp(to) > 0 {
+		return nil, errors.Errorf(errors.BackfillBadRange, from, to)
+	}
+	if spec.BatchSize == 0 {
+		spec.BatchSize = defaultBackfillBatchSize
+	} else if spec.BatchSize > MaxBatchSize {
+		spec.BatchSize = MaxBatchSize
+	}
+	spec.Tenant = auth.GetTenant(ctx)
+	spec.ID = backfillIDPrefix + utils.UUIDv4()
+	spec.CreatedISO8601 = time.Now().UTC().Format(time.RFC3339)
+	spec.Path = BackfillPathPrefix + "/" + spec.ID
+	spec.FromBlock = from.String()
+	spec.ToBlock = to.String()
+	spec.Status = BackfillStatusRunning
+	spec.Progress = BackfillProgress{NextBlock: spec.FromBlock}
+	bf, err := newBackfill(s, spec)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := s.storeBackfill(spec); err != nil {
+		return nil, err
+	}
+	s.backfills[spec.ID] = bf
+	bf.start()
+	return bf.snapshot(), nil
+}
+
+// Backfills used externally to list the backfills, with their progress
+func (s *subscriptionMGR) Backfills(ctx context.Context) []*BackfillInfo {
+	l := make([]*BackfillInfo, 0, len(s.backfills))
+	for _, bf := range s.backfills {
+		l = append(l, bf.snapshot())
+	}
+	return l
+}
+
+// BackfillByID used externally to get a backfill, with its progress
+func (s *subscriptionMGR) BackfillByID(ctx context.Context, id string) (*BackfillInfo, error) {
+	bf, err := s.backfillByID(id)
+	if err != nil {
+		return nil, err
+	}
+	return bf.snapshot(), nil
+}
+
+// ResumeBackfill restarts a failed backfill from the block it had reached
+func (s *subscriptionMGR) ResumeBackfill(ctx context.Context, id string) (*BackfillInfo, error) {
+	bf, err := s.backfillByID(id)
+	if err != nil {
+		return nil, err
+	}
+	if info := bf.snapshot(); info.Status != BackfillStatusFailed {
+		return nil, errors.Errorf(errors.BackfillNotFailed, id, info.Status)
+	}
+	bf.halt()
+	bf.update(func(info *BackfillInfo) {
+		info.Status = BackfillStatusRunning
+	})
+	bf.start()
+	return bf.snapshot(), nil
+}
+
+// DeleteBackfill stops a backfill if it is running, and deletes it
+func (s *subscriptionMGR) DeleteBackfill(ctx context.Context, id string) error {
+	bf, err := s.backfillByID(id)
+	if err != nil {
+		return err
+	}
+	bf.halt()
+	delete(s.backfills, id)
+	return s.db.Delete(id)
+}
+
+func (s *subscriptionMGR) storeBackfill(info *BackfillInfo) (*BackfillInfo, error) {
+	infoBytes, _ := json.MarshalIndent(info, "", "  ")
+	if err := s.db.Put(info.ID, infoBytes); err != nil {
+		return nil, errors.Errorf(errors.BackfillStoreFailed, err)
+	}
+	return info, nil
+}
+
+func (s *subscriptionMGR) backfillByID(id string) (*backfill, error) {
+	bf, exists := s.backfills[id]
+	if !exists {
+		return nil, errors.Errorf(errors.BackfillNotFound, id)
+	}
+	return bf, nil
+}
+
 // subscriptionByID used internally to lookup full objects
 func (s *subscriptionMGR) subscriptionByID(id string) (*subscription, error) {
+	s.entriesLock.RLock()
 	sub, exists := s.subscriptions[id]
+	s.entriesLock.RUnlock()
 	if !exists {
 		return nil, errors.Errorf(errors.EventStreamsSubscriptionNotFound, id)
 	}
@@ -354,7 +904,9 @@ func (s *subscriptionMGR) subscriptionByID(id string) (*subscription, error) {
 
 // streamByID used internally to lookup full objects
 func (s *subscriptionMGR) streamByID(id string) (*eventStream, error) {
+	s.entriesLock.RLock()
 	stream, exists := s.streams[id]
+	s.entriesLock.RUnlock()
 	if !exists {
 		return nil, errors.Errorf(errors.EventStreamsStreamNotFound, id)
 	}
@@ -364,7 +916,7 @@ func (s *subscriptionMGR) streamByID(id string) (*eventStream, error) {
 func (s *subscriptionMGR) loadCheckpoint(streamID string) (map[string]*big.Int, error) {
 	cpID := checkpointIDPrefix + streamID
 	b, err := s.db.Get(cpID)
-	if err == leveldb.ErrNotFound {
+	if err == kvstore.ErrorNotFound {
 		return make(map[string]*big.Int), nil
 	} else if err != nil {
 		return nil, err
@@ -391,11 +943,36 @@ func (s *subscriptionMGR) deleteCheckpoint(streamID string) {
 }
 
 func (s *subscriptionMGR) Init() (err error) {
-	if s.db, err = kvstore.NewLDBKeyValueStore(s.conf.EventLevelDBPath); err != nil {
+	if s.signer, err = newBatchSigner(&s.conf.BatchSigning); err != nil {
+		return err
+	}
+	if s.schemas, err = newSchemaRegistry(&s.conf.SchemaRegistry); err != nil {
+		return err
+	}
+	if s.db, err = kvstore.NewKeyValueStore(s.conf.EventLevelDBPath); err != nil {
 		return errors.Errorf(errors.EventStreamsDBLoad, s.conf.EventLevelDBPath, err)
 	}
+	kvstore.SetKeyPrefixes(s.db, map[string]string{
+		"streams":          streamIDPrefix,
+		"subscriptions":    subIDPrefix,
+		"checkpoints":      checkpointIDPrefix,
+		"backfills":        backfillIDPrefix,
+		"deliveries":       deliveryIDPrefix,
+		"invalidations":    invalidationIDPrefix,
+		"spilled":          spillIDPrefix,
+		"checkpointGroups": checkpointGroupIDPrefix,
+	})
+	s.deleteSpilledBatches("")
 	s.recoverStreams()
 	s.recoverSubscriptions()
+	s.recoverBackfills()
+	s.recoverDeliveryCounts()
+	s.recoverInvalidationHooks()
+	s.recoverCheckpointGroups()
+	s.startInvalidations()
+	s.schedulerStop = make(chan struct{})
+	go s.streamScheduler(streamSchedulerInterval)
+	go s.healthMonitor(time.Duration(s.conf.Health.CheckIntervalSec) * time.Second)
 	return nil
 }
 
@@ -416,7 +993,9 @@ func (s *subscriptionMGR) recoverStreams() {
 			if err != nil {
 				log.Errorf("Failed to recover stream '%s': %s", streamInfo.ID, err)
 			} else {
+				s.entriesLock.Lock()
 				s.streams[streamInfo.ID] = stream
+				s.entriesLock.Unlock()
 			}
 		}
 	}
@@ -439,7 +1018,36 @@ func (s *subscriptionMGR) recoverSubscriptions() {
 			if err != nil {
 				log.Errorf("Failed to recover subscription '%s': %s", subInfo.ID, err)
 			} else {
+				s.entriesLock.Lock()
 				s.subscriptions[subInfo.ID] = sub
+				s.entriesLock.Unlock()
+			}
+		}
+	}
+}
+
+func (s *subscriptionMGR) recoverBackfills() {
+	// Recover all the backfills, and resume those that were running
+	iBackfill := s.db.NewIterator()
+	defer iBackfill.Release()
+	for iBackfill.Next() {
+		k := iBackfill.Key()
+		if strings.HasPrefix(k, backfillIDPrefix) {
+			var info BackfillInfo
+			err := json.Unmarshal(iBackfill.Value(), &info)
+			if err != nil {
+				log.Errorf("Failed to recover backfill '%s': %s", string(iBackfill.Value()), err)
+				continue
+			}
+			bf, err := newBackfill(s, &info)
+			if err != nil {
+				log.Errorf("Failed to recover backfill '%s': %s", info.ID, err)
+				continue
+			}
+			s.backfills[info.ID] = bf
+			if info.Status == BackfillStatusRunning {
+				log.Infof("%s: Resuming backfill from block %s", info.ID, info.Progress.NextBlock)
+				bf.start()
 			}
 		}
 	}
@@ -447,9 +1055,16 @@ func (s *subscriptionMGR) recoverSubscriptions() {
 
 func (s *subscriptionMGR) Close() {
 	log.Infof("Event stream subscription manager shutting down")
-	for _, stream := range s.streams {
+	for _, stream := range s.streamList() {
 		stream.stop()
 	}
+	for _, bf := range s.backfills {
+		bf.halt()
+	}
+	s.stopInvalidations()
+	if !s.closed && s.schedulerStop != nil {
+		close(s.schedulerStop)
+	}
 	if !s.closed && s.db != nil {
 		s.db.Close()
 	}
@@ -27,8 +27,11 @@ import (
 
 	"github.com/julienschmidt/httprouter"
 	ethbinding "github.com/kaleido-io/ethbinding/pkg"
+	"github.com/kaleido-io/ethconnect/internal/auth"
+	"github.com/kaleido-io/ethconnect/internal/auth/authtest"
 	"github.com/kaleido-io/ethconnect/internal/eth"
 	"github.com/kaleido-io/ethconnect/internal/kvstore"
+	"github.com/kaleido-io/ethconnect/internal/quotas"
 	"github.com/spf13/cobra"
 	"github.com/stretchr/testify/assert"
 )
@@ -134,7 +137,7 @@ func TestActionAndSubscriptionLifecyle(t *testing.T) {
 	})
 	assert.NoError(err)
 
-	sub, err := sm.AddSubscription(ctx, nil, &ethbinding.ABIElementMarshaling{Name: "ping"}, stream.ID, "", subscriptionName)
+	sub, err := sm.AddSubscription(ctx, nil, &ethbinding.ABIElementMarshaling{Name: "ping"}, stream.ID, "", subscriptionName, nil)
 	assert.NoError(err)
 	assert.Equal(stream.ID, sub.Stream)
 
@@ -209,7 +212,7 @@ func TestActionChildCleanup(t *testing.T) {
 	})
 	assert.NoError(err)
 
-	sm.AddSubscription(ctx, nil, &ethbinding.ABIElementMarshaling{Name: "ping"}, stream.ID, "12345", "")
+	sm.AddSubscription(ctx, nil, &ethbinding.ABIElementMarshaling{Name: "ping"}, stream.ID, "12345", "", nil)
 	err = sm.DeleteStream(ctx, stream.ID)
 	assert.NoError(err)
 
@@ -238,7 +241,7 @@ func TestStreamAndSubscriptionErrors(t *testing.T) {
 	})
 	assert.NoError(err)
 
-	sub, err := sm.AddSubscription(ctx, nil, &ethbinding.ABIElementMarshaling{Name: "ping"}, stream.ID, "", subscriptionName)
+	sub, err := sm.AddSubscription(ctx, nil, &ethbinding.ABIElementMarshaling{Name: "ping"}, stream.ID, "", subscriptionName, nil)
 	assert.NoError(err)
 
 	err = sm.ResetSubscription(ctx, sub.ID, "badness")
@@ -278,11 +281,11 @@ func TestResetSubscriptionErrors(t *testing.T) {
 	err = sm.DeleteStream(ctx, "teststream")
 	assert.EqualError(err, "pop")
 
-	_, err = sm.AddSubscription(ctx, nil, &ethbinding.ABIElementMarshaling{Name: "any"}, "nope", "", "")
+	_, err = sm.AddSubscription(ctx, nil, &ethbinding.ABIElementMarshaling{Name: "any"}, "nope", "", "", nil)
 	assert.EqualError(err, "Stream with ID 'nope' not found")
-	_, err = sm.AddSubscription(ctx, nil, &ethbinding.ABIElementMarshaling{Name: "any"}, "teststream", "", "test")
+	_, err = sm.AddSubscription(ctx, nil, &ethbinding.ABIElementMarshaling{Name: "any"}, "teststream", "", "test", nil)
 	assert.EqualError(err, "Failed to store subscription: pop")
-	_, err = sm.AddSubscription(ctx, nil, &ethbinding.ABIElementMarshaling{Name: "any"}, "teststream", "!bad integer", "")
+	_, err = sm.AddSubscription(ctx, nil, &ethbinding.ABIElementMarshaling{Name: "any"}, "teststream", "!bad integer", "", nil)
 	assert.EqualError(err, "FromBlock cannot be parsed as a BigInt")
 	sm.subscriptions["testsub"] = &subscription{info: &SubscriptionInfo{}, rpc: sm.rpc}
 	err = sm.ResetSubscription(ctx, "nope", "0")
@@ -313,3 +316,265 @@ func TestRecoverErrors(t *testing.T) {
 	assert.Equal(0, len(sm.subscriptions))
 
 }
+
+func TestStreamMaintenanceWindowSchedule(t *testing.T) {
+	assert := assert.New(t)
+	dir := tempdir(t)
+	defer cleanup(t, dir)
+	sm := newTestSubscriptionManager()
+	sm.db, _ = kvstore.NewLDBKeyValueStore(path.Join(dir, "db"))
+	defer sm.db.Close()
+
+	ctx := context.Background()
+	_, err := sm.AddStream(ctx, &StreamInfo{
+		Type:               "webhook",
+		Webhook:            &webhookActionInfo{URL: "http://test.invalid"},
+		MaintenanceWindows: []*MaintenanceWindow{{Schedule: "bad"}},
+	})
+	assert.Regexp("Invalid maintenance window schedule", err)
+
+	spec, err := sm.AddStream(ctx, &StreamInfo{
+		Type:    "webhook",
+		Webhook: &webhookActionInfo{URL: "http://test.invalid"},
+	})
+	assert.NoError(err)
+	_, err = sm.UpdateStream(ctx, spec.ID, &StreamInfo{
+		MaintenanceWindows: []*MaintenanceWindow{{Schedule: "0 2 * * *"}},
+	})
+	assert.EqualError(err, "Maintenance window '0 2 * * *' must have a durationSec")
+	_, err = sm.UpdateStream(ctx, spec.ID, &StreamInfo{
+		MaintenanceWindows: []*MaintenanceWindow{
+			{Schedule: "0 2 * * *", DurationSec: 1800},
+			{Schedule: "15 2 * * *", DurationSec: 3600},
+		},
+	})
+	assert.NoError(err)
+	stream := sm.streams[spec.ID]
+
+	// Outside of the window nothing happens
+	sm.checkSchedules(time.Date(2021, 6, 5, 1, 59, 0, 0, time.UTC))
+	assert.False(stream.spec.Suspended)
+
+	// Entering the window suspends until the end of the latest overlapping window
+	sm.checkSchedules(time.Date(2021, 6, 5, 2, 20, 0, 0, time.UTC))
+	assert.True(stream.spec.Suspended)
+	assert.Equal("2021-06-05T03:15:00Z", stream.spec.ResumeAt.Format(time.RFC3339))
+	stored, _ := sm.db.Get(spec.ID)
+	assert.Contains(string(stored), `"resumeAt": "2021-06-05T03:15:00Z"`)
+
+	// A manual resume part way through the window is not overridden
+	for sm.ResumeStream(ctx, spec.ID) != nil {
+		time.Sleep(1 * time.Millisecond)
+	}
+	assert.Nil(stream.spec.ResumeAt)
+	sm.checkSchedules(time.Date(2021, 6, 5, 2, 30, 0, 0, time.UTC))
+	assert.False(stream.spec.Suspended)
+
+	// The next day's window suspends again, and the stream resumes at the end
+	sm.checkSchedules(time.Date(2021, 6, 6, 2, 0, 0, 0, time.UTC))
+	assert.True(stream.spec.Suspended)
+	for stream.spec.Suspended {
+		sm.checkSchedules(time.Date(2021, 6, 6, 3, 15, 0, 0, time.UTC))
+		time.Sleep(1 * time.Millisecond)
+	}
+	assert.Nil(stream.spec.ResumeAt)
+
+	sm.Close()
+}
+
+func TestSuspendStreamUntil(t *testing.T) {
+	assert := assert.New(t)
+	dir := tempdir(t)
+	defer cleanup(t, dir)
+	sm := newTestSubscriptionManager()
+	sm.db, _ = kvstore.NewLDBKeyValueStore(path.Join(dir, "db"))
+	defer sm.db.Close()
+
+	ctx := context.Background()
+	spec, err := sm.AddStream(ctx, &StreamInfo{
+		Type:    "webhook",
+		Webhook: &webhookActionInfo{URL: "http://test.invalid"},
+	})
+	assert.NoError(err)
+	stream := sm.streams[spec.ID]
+
+	past := time.Now().Add(-1 * time.Minute)
+	err = sm.SuspendStreamUntil(ctx, spec.ID, &past)
+	assert.Regexp("must be in the future", err)
+	err = sm.SuspendStreamUntil(ctx, "nope", nil)
+	assert.EqualError(err, "Stream with ID 'nope' not found")
+
+	resumeAt := time.Now().Add(1 * time.Hour)
+	err = sm.SuspendStreamUntil(ctx, spec.ID, &resumeAt)
+	assert.NoError(err)
+	assert.True(stream.spec.Suspended)
+	assert.Equal(time.UTC, stream.spec.ResumeAt.Location())
+
+	// Not resumed before the time
+	sm.checkSchedules(time.Now())
+	assert.True(stream.spec.Suspended)
+
+	for stream.spec.Suspended {
+		sm.checkSchedules(resumeAt)
+		time.Sleep(1 * time.Millisecond)
+	}
+	assert.Nil(stream.spec.ResumeAt)
+
+	// A plain suspend clears any previous resume time
+	err = sm.SuspendStreamUntil(ctx, spec.ID, &resumeAt)
+	assert.NoError(err)
+	err = sm.SuspendStream(ctx, spec.ID)
+	assert.NoError(err)
+	assert.Nil(stream.spec.ResumeAt)
+	sm.checkSchedules(resumeAt)
+	assert.True(stream.spec.Suspended)
+
+	sm.Close()
+}
+
+func TestStreamSchedulerStops(t *testing.T) {
+	sm := newTestSubscriptionManager()
+	sm.schedulerStop = make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		sm.streamScheduler(1 * time.Millisecond)
+		close(done)
+	}()
+	time.Sleep(5 * time.Millisecond)
+	sm.Close()
+	<-done
+}
+
+func TestStreamSchedulerConcurrentStreamChanges(t *testing.T) {
+	dir := tempdir(t)
+	defer cleanup(t, dir)
+	sm := newTestSubscriptionManager()
+	sm.db, _ = kvstore.NewLDBKeyValueStore(path.Join(dir, "db"))
+	defer sm.db.Close()
+
+	// The scheduler reads the streams and subscriptions while they are added and deleted
+	ctx := context.Background()
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < 20; i++ {
+			spec, err := sm.AddStream(ctx, &StreamInfo{
+				Type:               "webhook",
+				Webhook:            &webhookActionInfo{URL: "http://test.invalid"},
+				MaintenanceWindows: []*MaintenanceWindow{{Schedule: "* * * * *", DurationSec: 60}},
+			})
+			assert.NoError(t, err)
+			sm.AddSubscription(ctx, nil, &ethbinding.ABIElementMarshaling{Name: "ping"}, spec.ID, "0", "", nil)
+			sm.DeleteStream(ctx, spec.ID)
+		}
+		close(done)
+	}()
+	for running := true; running; {
+		select {
+		case <-done:
+			running = false
+		default:
+			sm.checkSchedules(time.Now())
+			sm.Subscriptions(ctx)
+		}
+	}
+	sm.Close()
+}
+
+type testTenantSecurityModule struct {
+	authtest.TestSecurityModule
+}
+
+func (sm *testTenantSecurityModule) Tenant(authCtx interface{}) string {
+	return "tenant1"
+}
+
+func TestTenantQuotas(t *testing.T) {
+	assert := assert.New(t)
+	sm := newTestSubscriptionManager()
+	sm.conf.Quotas = quotas.Conf{
+		Default: quotas.Limits{MaxStreams: 1, MaxSubscriptions: 1},
+		Tenants: map[string]*quotas.Limits{
+			"tenant1": {MaxStreams: 2, MaxCatchupBlocksPerSec: 100},
+		},
+	}
+
+	auth.RegisterSecurityModule(&testTenantSecurityModule{})
+	defer auth.RegisterSecurityModule(nil)
+	tenantCtx, _ := auth.WithAuthContext(context.Background(), "testat")
+	ctx := context.Background()
+
+	spec, err := sm.AddStream(ctx, &StreamInfo{
+		Type:    "webhook",
+		Webhook: &webhookActionInfo{URL: "http://test.invalid"},
+	})
+	assert.NoError(err)
+	assert.Equal("", spec.Tenant)
+	_, err = sm.AddStream(ctx, &StreamInfo{
+		Type:    "webhook",
+		Webhook: &webhookActionInfo{URL: "http://test.invalid"},
+	})
+	assert.EqualError(err, "Quota exceeded: the maximum number of streams for tenant '' is 1")
+	assert.IsType(&quotas.ExceededError{}, err)
+
+	// The tenant has its own count, and limit
+	for i := 0; i < 2; i++ {
+		spec, err = sm.AddStream(tenantCtx, &StreamInfo{
+			Type:    "webhook",
+			Tenant:  "ignored",
+			Webhook: &webhookActionInfo{URL: "http://test.invalid"},
+		})
+		assert.NoError(err)
+		assert.Equal("tenant1", spec.Tenant)
+	}
+	_, err = sm.AddStream(tenantCtx, &StreamInfo{
+		Type:    "webhook",
+		Webhook: &webhookActionInfo{URL: "http://test.invalid"},
+	})
+	assert.EqualError(err, "Quota exceeded: the maximum number of streams for tenant 'tenant1' is 2")
+
+	// Subscriptions are not limited for the tenant, but share a catch-up throttle
+	event := &ethbinding.ABIElementMarshaling{Name: "ping"}
+	sub1, err := sm.AddSubscription(tenantCtx, nil, event, spec.ID, "0", "", nil)
+	assert.NoError(err)
+	assert.Equal("tenant1", sub1.Tenant)
+	sub2, err := sm.AddSubscription(tenantCtx, nil, event, spec.ID, "0", "", nil)
+	assert.NoError(err)
+	assert.NotNil(sm.subscriptions[sub1.ID].catchupThrottle)
+	assert.Equal(sm.subscriptions[sub1.ID].catchupThrottle, sm.subscriptions[sub2.ID].catchupThrottle)
+	assert.Nil(sm.catchupThrottle(""))
+
+	_, err = sm.AddSubscription(ctx, nil, event, spec.ID, "0", "", nil)
+	assert.NoError(err)
+	_, err = sm.AddSubscription(ctx, nil, event, spec.ID, "0", "", nil)
+	assert.EqualError(err, "Quota exceeded: the maximum number of subscriptions for tenant '' is 1")
+}
+
+func TestTenantQuotasConcurrent(t *testing.T) {
+	dir := tempdir(t)
+	defer cleanup(t, dir)
+	sm := newTestSubscriptionManager()
+	sm.db, _ = kvstore.NewLDBKeyValueStore(path.Join(dir, "db"))
+	defer sm.db.Close()
+	sm.conf.Quotas = quotas.Conf{Default: quotas.Limits{MaxStreams: 1}}
+
+	// Requests in parallel cannot each see the count below the quota
+	results := make(chan error, 10)
+	for i := 0; i < 10; i++ {
+		go func() {
+			_, err := sm.AddStream(context.Background(), &StreamInfo{
+				Type:    "webhook",
+				Webhook: &webhookActionInfo{URL: "http://test.invalid"},
+			})
+			results <- err
+		}()
+	}
+	added := 0
+	for i := 0; i < 10; i++ {
+		if <-results == nil {
+			added++
+		}
+	}
+	assert.Equal(t, 1, added)
+	assert.Len(t, sm.Streams(context.Background()), 1)
+	sm.Close()
+}
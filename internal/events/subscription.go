@@ -16,8 +16,10 @@ package events
 
 import (
 	"context"
+	"fmt"
 	"math/big"
 	"strings"
+	"sync"
 	"time"
 
 	ethbinding "github.com/kaleido-io/ethbinding/pkg"
@@ -25,6 +27,7 @@ import (
 	"github.com/kaleido-io/ethconnect/internal/eth"
 	"github.com/kaleido-io/ethconnect/internal/ethbind"
 	"github.com/kaleido-io/ethconnect/internal/messages"
+	"github.com/kaleido-io/ethconnect/internal/quotas"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -44,14 +47,42 @@ type ethFilter struct {
 // SubscriptionInfo is the persisted data for the subscription
 type SubscriptionInfo struct {
 	messages.TimeSorted
-	ID        string                           `json:"id,omitempty"`
-	Path      string                           `json:"path"`
-	Summary   string                           `json:"-"`    // System generated name for the subscription
-	Name      string                           `json:"name"` // User provided name for the subscription, set to Summary if missing
-	Stream    string                           `json:"stream"`
-	Filter    persistedFilter                  `json:"filter"`
-	Event     *ethbinding.ABIElementMarshaling `json:"event"`
-	FromBlock string                           `json:"fromBlock,omitempty"`
+	ID          string                           `json:"id,omitempty"`
+	Path        string                           `json:"path"`
+	Summary     string                           `json:"-"`    // System generated name for the subscription
+	Name        string                           `json:"name"` // User provided name for the subscription, set to Summary if missing
+	Stream      string                           `json:"stream"`
+	Filter      persistedFilter                  `json:"filter"`
+	Type        string                           `json:"type,omitempty"`
+	Event       *ethbinding.ABIElementMarshaling `json:"event"`
+	ABI         ethbinding.ABIMarshaling         `json:"abi,omitempty"` // The functions and errors that decode reverted transactions
+	FromBlock   string                           `json:"fromBlock,omitempty"`
+	Tenant      string                           `json:"tenant,omitempty"`
+	Aggregation *AggregationInfo                 `json:"aggregation,omitempty"`
+	Schema      *SchemaInfo                      `json:"schema,omitempty"`
+	Suspended   bool                             `json:"suspended,omitempty"`
+	Health      *SubscriptionHealth              `json:"health,omitempty"` // Not persisted, only set on listings
+}
+
+// SubscriptionCheckpoint is the position of a subscription in the chain. Block is the
+// next block the subscription will read from, and Lag is the number of blocks it has yet
+// to read up to the head of the chain.
+type SubscriptionCheckpoint struct {
+	ID             string             `json:"id"`
+	Stream         string             `json:"stream"`
+	Suspended      bool               `json:"suspended"`
+	Block          string             `json:"block,omitempty"`
+	ChainHead      string             `json:"chainHead,omitempty"`
+	ChainHeadError string             `json:"chainHeadError,omitempty"`
+	Lag            int64              `json:"lag"`
+	LastDelivered  *DeliveredPosition `json:"lastDelivered,omitempty"`
+}
+
+// DeliveredPosition is the newest event from a subscription in a batch that was delivered
+type DeliveredPosition struct {
+	BlockNumber string    `json:"blockNumber"`
+	LogIndex    string    `json:"logIndex"`
+	Time        time.Time `json:"time"`
 }
 
 // subscription is the runtime that manages the subscription
@@ -59,15 +90,24 @@ type subscription struct {
 	info                *SubscriptionInfo
 	rpc                 eth.RPCClient
 	lp                  *logProcessor
+	reverted            *revertedTxnDecoder
+	kind                string // The type of subscriptions not to events, that read blocks or pending transactions
 	logName             string
 	filterID            ethbinding.HexBigInt
 	filteredOnce        bool
 	filterStale         bool
 	deleting            bool
 	resetRequested      bool
+	rewindTo            *big.Int
 	catchupBlock        *big.Int
 	catchupModeBlockGap int64
 	catchupModePageSize int64
+	catchupThrottle     *quotas.Throttle
+	catchupRange        int64 // set while the block range of catch-up queries is reduced
+	catchupSuccesses    int
+	healthLock          sync.Mutex
+	decodeErrors        int
+	lastError           string
 }
 
 func newSubscription(sm subscriptionManager, rpc eth.RPCClient, addr *ethbinding.Address, i *SubscriptionInfo) (*subscription, error) {
@@ -75,6 +115,12 @@ func newSubscription(sm subscriptionManager, rpc eth.RPCClient, addr *ethbinding
 	if err != nil {
 		return nil, err
 	}
+	if i.Type == SubscriptionTypeRevertedTransactions {
+		return newRevertedTxnSubscription(sm, rpc, stream, addr, i)
+	}
+	if i.Type == SubscriptionTypeBlocks || i.Type == SubscriptionTypePendingTransactions {
+		return newChainSubscription(sm, rpc, stream, addr, i)
+	}
 	event, err := ethbind.API.ABIElementMarshalingToABIEvent(i.Event)
 	if err != nil {
 		return nil, err
@@ -87,6 +133,7 @@ func newSubscription(sm subscriptionManager, rpc eth.RPCClient, addr *ethbinding
 		filterStale:         true,
 		catchupModeBlockGap: sm.config().CatchupModeBlockGap,
 		catchupModePageSize: sm.config().CatchupModePageSize,
+		catchupThrottle:     sm.catchupThrottle(i.Tenant),
 	}
 	f := &i.Filter
 	addrStr := "*"
@@ -103,6 +150,10 @@ func newSubscription(sm subscriptionManager, rpc eth.RPCClient, addr *ethbinding
 	if event == nil || event.Name == "" {
 		return nil, errors.Errorf(errors.EventStreamsSubscribeNoEvent)
 	}
+	if err := validateAggregation(i.Aggregation, event); err != nil {
+		return nil, err
+	}
+	s.lp.aggregator = newAggregator(i.Aggregation)
 	// For now we only support filtering on the event type
 	f.Topics = [][]ethbinding.Hash{{event.ID}}
 	log.Infof("Created subscription ID:%s name:%s topic:%s", i.ID, i.Name, event.ID)
@@ -122,6 +173,12 @@ func restoreSubscription(sm subscriptionManager, rpc eth.RPCClient, i *Subscript
 	if err != nil {
 		return nil, err
 	}
+	if i.Type == SubscriptionTypeRevertedTransactions {
+		return restoreRevertedTxnSubscription(sm, rpc, stream, i), nil
+	}
+	if i.Type == SubscriptionTypeBlocks || i.Type == SubscriptionTypePendingTransactions {
+		return restoreChainSubscription(sm, rpc, stream, i), nil
+	}
 	event, err := ethbind.API.ABIElementMarshalingToABIEvent(i.Event)
 	if err != nil {
 		return nil, err
@@ -134,7 +191,9 @@ func restoreSubscription(sm subscriptionManager, rpc eth.RPCClient, i *Subscript
 		filterStale:         true,
 		catchupModeBlockGap: sm.config().CatchupModeBlockGap,
 		catchupModePageSize: sm.config().CatchupModePageSize,
+		catchupThrottle:     sm.catchupThrottle(i.Tenant),
 	}
+	s.lp.aggregator = newAggregator(i.Aggregation)
 	return s, nil
 }
 
@@ -193,6 +252,17 @@ func (s *subscription) restartFilter(ctx context.Context, checkpoint *big.Int) e
 		since = s.catchupBlock
 	}
 
+	if s.scansBlocks() {
+		// Reverted transactions and blocks are found by scanning blocks, rather than with a filter
+		s.catchupBlock = new(big.Int).Set(since)
+		s.markFilterStale(ctx, false)
+		log.Infof("%s: scanning blocks from block %s", s.logName, since.String())
+		return nil
+	}
+	if s.kind == SubscriptionTypePendingTransactions {
+		return s.createPendingTxnFilter(ctx)
+	}
+
 	blockNumber := ethbinding.HexBigInt{}
 	err := s.rpc.CallContext(ctx, &blockNumber, "eth_blockNumber")
 	if err != nil {
@@ -200,8 +270,9 @@ func (s *subscription) restartFilter(ctx context.Context, checkpoint *big.Int) e
 	}
 
 	blockGap := new(big.Int).Sub(blockNumber.ToInt(), since).Int64()
-	log.Debugf("%s: restarting. Head=%s Position=%s Gap=%d (catchup threshold: %d)", s.logName, blockNumber.String(), since.String(), blockGap, s.catchupModeBlockGap)
-	if s.catchupModeBlockGap > 0 && blockGap > s.catchupModeBlockGap {
+	catchupBlockGap := s.catchupBlockGap()
+	log.Debugf("%s: restarting. Head=%s Position=%s Gap=%d (catchup threshold: %d)", s.logName, blockNumber.String(), since.String(), blockGap, catchupBlockGap)
+	if catchupBlockGap > 0 && blockGap > catchupBlockGap {
 		s.catchupBlock = since // note if we were already in catchup, this does not change anything
 		return nil
 	}
@@ -238,6 +309,18 @@ func (s *subscription) getEventTimestamp(ctx context.Context, l *logEntry) {
 }
 
 func (s *subscription) processCatchupBlocks(ctx context.Context) error {
+	pageSize := s.catchupPageSize()
+	if s.catchupThrottle != nil && !s.catchupThrottle.Allow(pageSize) {
+		// The tenant has used its catch-up rate, so we wait for a later poll
+		log.Debugf("%s: catchup mode throttled for tenant '%s'", s.logName, s.info.Tenant)
+		return nil
+	}
+	policy, limiter := s.catchupPolicy()
+	if limiter != nil && !limiter.Allow(1) {
+		// The stream has used its request rate, so we wait for a later poll
+		log.Debugf("%s: catchup mode throttled for stream", s.logName)
+		return nil
+	}
 	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
 	defer cancel()
 	var logs []*logEntry
@@ -245,13 +328,25 @@ func (s *subscription) processCatchupBlocks(ctx context.Context) error {
 	f := &ethFilter{}
 	f.persistedFilter = s.info.Filter
 	f.FromBlock.ToInt().Set(s.catchupBlock)
-	endBlock := new(big.Int).Add(s.catchupBlock, big.NewInt(s.catchupModePageSize-1))
+	endBlock := new(big.Int).Add(s.catchupBlock, big.NewInt(pageSize-1))
 	f.ToBlock = "0x" + endBlock.Text(16)
 
 	log.Infof("%s: catchup mode. Blocks %d -> %d", s.logName, s.catchupBlock.Int64(), endBlock.Int64())
 	if err := s.rpc.CallContext(ctx, &logs, "eth_getLogs", f); err != nil {
+		if isTooManyResultsError(err) && s.shrinkCatchupRange(pageSize, err.Error()) {
+			// The range is read again in smaller pieces on the next poll
+			return nil
+		}
 		return errors.Errorf(errors.RPCCallReturnedError, "eth_getLogs", err)
 	}
+	if policy.MaxLogsPerBatch > 0 && len(logs) > policy.MaxLogsPerBatch &&
+		s.shrinkCatchupRange(pageSize, fmt.Sprintf("%d events returned", len(logs))) {
+		return nil
+	}
+	s.catchupQuerySucceeded()
+	if reorged, err := s.checkReorg(ctx); err != nil || reorged {
+		return err
+	}
 	if len(logs) == 0 {
 		// We only want to catch up once - so see if we can update our HWM based on the fact
 		// we know these historical blocks are empty.
@@ -260,7 +355,7 @@ func (s *subscription) processCatchupBlocks(ctx context.Context) error {
 		s.processLogs(ctx, "eth_getLogs", logs)
 	}
 	s.catchupBlock = endBlock.Add(endBlock, big.NewInt(1))
-	return nil
+	return s.confirmEvents(ctx)
 }
 
 func (s *subscription) processLogs(ctx context.Context, rpcMethod string, logs []*logEntry) {
@@ -272,13 +367,60 @@ func (s *subscription) processLogs(ctx context.Context, rpcMethod string, logs [
 		if s.lp.stream.spec.Timestamps {
 			s.getEventTimestamp(context.Background(), logEntry)
 		}
-		if err := s.lp.processLogEntry(s.logName, logEntry, idx); err != nil {
+		err := s.processLogEntry(logEntry, idx)
+		if err != nil {
 			log.Errorf("Failed to process event: %s", err)
 		}
+		s.recordDecodeResult(err)
 	}
 }
 
+// processLogEntry passes a single log to the log processor, treating a crash while
+// decoding it as a failure of that log rather than of the event stream
+func (s *subscription) processLogEntry(entry *logEntry, idx int) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = errors.Errorf(errors.EventStreamsLogDecodePanic, s.logName, r)
+		}
+	}()
+	return s.lp.processLogEntry(s.logName, entry, idx)
+}
+
+// recordDecodeResult counts the consecutive logs that failed to decode, which is reset
+// as soon as one succeeds
+func (s *subscription) recordDecodeResult(err error) {
+	s.healthLock.Lock()
+	defer s.healthLock.Unlock()
+	if err != nil {
+		s.decodeErrors++
+		s.lastError = err.Error()
+	} else {
+		s.decodeErrors = 0
+	}
+}
+
+func (s *subscription) getDecodeErrors() (int, string) {
+	s.healthLock.Lock()
+	defer s.healthLock.Unlock()
+	return s.decodeErrors, s.lastError
+}
+
+func (s *subscription) clearDecodeErrors() {
+	s.healthLock.Lock()
+	defer s.healthLock.Unlock()
+	s.decodeErrors = 0
+	s.lastError = ""
+}
+
 func (s *subscription) processNewEvents(ctx context.Context) error {
+	switch {
+	case s.reverted != nil:
+		return s.processRevertedTxns(ctx)
+	case s.kind == SubscriptionTypeBlocks:
+		return s.processBlocks(ctx)
+	case s.kind == SubscriptionTypePendingTransactions:
+		return s.processPendingTxns(ctx)
+	}
 	if s.catchupBlock != nil {
 		return s.processCatchupBlocks(ctx)
 	}
@@ -296,9 +438,14 @@ func (s *subscription) processNewEvents(ctx context.Context) error {
 		}
 		return err
 	}
+	if reorged, err := s.checkReorg(ctx); err != nil || reorged {
+		// The logs are read again from the common ancestor, when the filter is recreated on the next poll
+		return err
+	}
 	s.processLogs(ctx, rpcMethod, logs)
 	s.filteredOnce = true
-	return nil
+	s.lp.markPolled()
+	return s.confirmEvents(ctx)
 }
 
 func (s *subscription) unsubscribe(ctx context.Context, deleting bool) (err error) {
@@ -316,6 +463,12 @@ func (s *subscription) requestReset() {
 	s.resetRequested = true
 }
 
+// scansBlocks is true for subscriptions that read each block, as there is no filter on the node
+// for what they deliver
+func (s *subscription) scansBlocks() bool {
+	return s.reverted != nil || s.kind == SubscriptionTypeBlocks
+}
+
 func (s *subscription) blockHWM() big.Int {
 	return s.lp.getBlockHWM()
 }
@@ -323,7 +476,7 @@ func (s *subscription) blockHWM() big.Int {
 func (s *subscription) markFilterStale(ctx context.Context, newFilterStale bool) {
 	log.Debugf("%s: Marking filter stale=%t, current sub filter stale=%t", s.logName, newFilterStale, s.filterStale)
 	// If unsubscribe is called multiple times, we might not have a filter
-	if newFilterStale && !s.filterStale {
+	if newFilterStale && !s.filterStale && !s.scansBlocks() {
 		var retval bool
 		ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
 		defer cancel()
@@ -333,5 +486,9 @@ func (s *subscription) markFilterStale(ctx context.Context, newFilterStale bool)
 		// Clear any catchup mode state. We will restart from the last checkpoint
 		s.catchupBlock = nil
 	}
+	if newFilterStale && s.scansBlocks() {
+		// There is no filter to uninstall, so we just restart the scan from the last checkpoint
+		s.catchupBlock = nil
+	}
 	s.filterStale = newFilterStale
 }
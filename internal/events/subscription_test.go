@@ -20,10 +20,12 @@ import (
 	"math/big"
 	"testing"
 
+	"github.com/Shopify/sarama"
 	ethbinding "github.com/kaleido-io/ethbinding/pkg"
 	"github.com/kaleido-io/ethconnect/internal/eth"
 	"github.com/kaleido-io/ethconnect/internal/ethbind"
 	"github.com/kaleido-io/ethconnect/internal/kvstore"
+	"github.com/kaleido-io/ethconnect/internal/quotas"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -33,9 +35,18 @@ type mockSubMgr struct {
 	subscription  *subscription
 	err           error
 	subscriptions []*subscription
+	signer        *batchSigner
+	deliveries    []*DeliveryRecord
+	invalidations []*CacheInvalidation
+	reactions     []*eventData
+	suspendedSubs []*subscription
+	conf          *SubscriptionManagerConf
 }
 
 func (m *mockSubMgr) config() *SubscriptionManagerConf {
+	if m.conf != nil {
+		return m.conf
+	}
 	return &SubscriptionManagerConf{}
 }
 
@@ -55,6 +66,36 @@ func (m *mockSubMgr) loadCheckpoint(string) (map[string]*big.Int, error) { retur
 
 func (m *mockSubMgr) storeCheckpoint(string, map[string]*big.Int) error { return nil }
 
+func (m *mockSubMgr) alignCheckpointGroups(string, map[string]*big.Int) {}
+
+func (m *mockSubMgr) catchupThrottle(string) *quotas.Throttle { return nil }
+
+func (m *mockSubMgr) batchSigner() *batchSigner { return m.signer }
+
+func (m *mockSubMgr) recordDelivery(rec *DeliveryRecord) { m.deliveries = append(m.deliveries, rec) }
+
+func (m *mockSubMgr) storeSpilledBatch(string, []*eventData) error { return m.err }
+
+func (m *mockSubMgr) loadSpilledBatch(string) ([]*eventData, error) { return nil, m.err }
+
+func (m *mockSubMgr) newKafkaProducer(*BackfillKafkaConf) (sarama.SyncProducer, error) {
+	return nil, m.err
+}
+
+func (m *mockSubMgr) invalidateCaches(address, event, blockNumber string) {
+	m.invalidations = append(m.invalidations, &CacheInvalidation{Address: address, Event: event, BlockNumber: blockNumber})
+}
+
+func (m *mockSubMgr) react(event *eventData) {
+	m.reactions = append(m.reactions, event)
+}
+
+func (m *mockSubMgr) suspendSubscription(ctx context.Context, sub *subscription) error {
+	sub.info.Suspended = true
+	m.suspendedSubs = append(m.suspendedSubs, sub)
+	return m.err
+}
+
 func newTestStream() *eventStream {
 	a, _ := newEventStream(newTestSubscriptionManager(), &StreamInfo{
 		ID:   "123",
@@ -270,6 +311,23 @@ func TestProcessCatchupBlocksFail(t *testing.T) {
 	assert.EqualError(err, "eth_getLogs returned: pop")
 }
 
+func TestProcessCatchupBlocksThrottled(t *testing.T) {
+	assert := assert.New(t)
+	s := &subscription{
+		info:                &SubscriptionInfo{Tenant: "tenant1"},
+		rpc:                 eth.NewMockRPCClientForSync(fmt.Errorf("pop"), nil),
+		catchupBlock:        big.NewInt(12345),
+		catchupModePageSize: 250,
+		catchupThrottle:     quotas.NewThrottle(1),
+	}
+	err := s.processCatchupBlocks(context.Background())
+	assert.EqualError(err, "eth_getLogs returned: pop")
+	// The next page is skipped until the throttle allows it, without calling the node
+	err = s.processCatchupBlocks(context.Background())
+	assert.NoError(err)
+	assert.Equal(int64(12345), s.catchupBlock.Int64())
+}
+
 func TestEventTimestampFail(t *testing.T) {
 	assert := assert.New(t)
 	stream := newTestStream()
@@ -15,23 +15,22 @@
 package events
 
 import (
-	"bytes"
-	"crypto/tls"
-	"encoding/json"
-	"io/ioutil"
+	"context"
 	"net"
-	"net/http"
 	"net/url"
 	"time"
 
 	"github.com/kaleido-io/ethconnect/internal/errors"
+	"github.com/kaleido-io/ethconnect/internal/tracing"
+	"github.com/kaleido-io/ethconnect/internal/webhook"
 
 	log "github.com/sirupsen/logrus"
 )
 
 type webhookAction struct {
-	es   *eventStream
-	spec *webhookActionInfo
+	es         *eventStream
+	spec       *webhookActionInfo
+	statusCode int
 }
 
 func newWebhookAction(es *eventStream, spec *webhookActionInfo) (*webhookAction, error) {
@@ -64,53 +63,29 @@ func (w *webhookAction) attemptBatch(batchNumber, attempt uint64, events []*even
 		log.Errorf(err.Error())
 		return err
 	}
-	// Set the timeout
-	var transport = &http.Transport{
-		Proxy: http.ProxyFromEnvironment,
-		DialContext: (&net.Dialer{
-			Timeout:   30 * time.Second,
-			KeepAlive: 30 * time.Second,
-			DualStack: true,
-		}).DialContext,
-		MaxIdleConns:          100,
-		IdleConnTimeout:       90 * time.Second,
-		TLSHandshakeTimeout:   10 * time.Second,
-		ExpectContinueTimeout: 1 * time.Second,
-	}
-	transport.TLSClientConfig = &tls.Config{
-		InsecureSkipVerify: w.spec.TLSkipHostVerify,
-	}
-	netClient := &http.Client{
-		Timeout:   time.Duration(w.spec.RequestTimeoutSec) * time.Second,
-		Transport: transport,
-	}
-	log.Infof("%s: POST --> %s [%s] (attempt=%d)", esID, u.String(), addr.String(), attempt)
-	reqBytes, err := json.Marshal(&events)
-	var req *http.Request
-	if err == nil {
-		req, err = http.NewRequest("POST", u.String(), bytes.NewReader(reqBytes))
-	}
+	sender := webhook.NewSender(esID, u.String(), w.spec.Headers, "", w.spec.TLSkipHostVerify, time.Duration(w.spec.RequestTimeoutSec)*time.Second)
+	log.Infof("%s: Delivering batch %d to %s [%s] (attempt=%d)", esID, batchNumber, u.Hostname(), addr.String(), attempt)
+	// Each attempt is a trace of its own, as a batch holds events from many transactions
+	ctx, span := tracing.Start(context.Background(), "eventstream webhook", tracing.SpanKindClient)
+	span.SetAttribute("ethconnect.eventstream", esID)
+	span.SetAttribute("ethconnect.batch_number", batchNumber)
+	span.SetAttribute("ethconnect.attempt", attempt)
+	span.SetAttribute("ethconnect.event_count", len(events))
+	w.statusCode = 0
+	reqBytes, sig, err := w.es.signBatch(events)
 	if err == nil {
-		var res *http.Response
-		req.Header.Set("Content-Type", "application/json")
-		for h, v := range w.spec.Headers {
-			req.Header.Set(h, v)
+		var headers map[string]string
+		if sig != nil {
+			headers = sig.headers(batchNumber)
 		}
-		res, err = netClient.Do(req)
-		if err == nil {
-			ok := (res.StatusCode >= 200 && res.StatusCode < 300)
-			log.Infof("%s: POST <-- %s [%d] ok=%t", esID, u.String(), res.StatusCode, ok)
-			if !ok || log.IsLevelEnabled(log.DebugLevel) {
-				bodyBytes, _ := ioutil.ReadAll(res.Body)
-				log.Infof("%s: Response body: %s", esID, string(bodyBytes))
-			}
-			if !ok {
-				err = errors.Errorf(errors.EventStreamsWebhookFailedHTTPStatus, esID, res.StatusCode)
-			}
-		}
-	}
-	if err != nil {
-		log.Errorf("%s: POST %s failed (attempt=%d): %s", esID, u.String(), attempt, err)
+		w.statusCode, err = sender.Post(ctx, reqBytes, headers)
 	}
+	span.SetAttribute("http.status_code", w.statusCode)
+	span.End(err)
 	return err
 }
+
+// responseCode is the HTTP status of the last attempt, or zero if no response was received
+func (w *webhookAction) responseCode() int {
+	return w.statusCode
+}
@@ -15,12 +15,15 @@
 package events
 
 import (
+	"time"
+
 	"github.com/kaleido-io/ethconnect/internal/errors"
 )
 
 type webSocketAction struct {
-	es   *eventStream
-	spec *webSocketActionInfo
+	es       *eventStream
+	spec     *webSocketActionInfo
+	lastSent time.Time
 }
 
 func newWebSocketAction(es *eventStream, spec *webSocketActionInfo) (*webSocketAction, error) {
@@ -54,10 +57,34 @@ func (w *webSocketAction) attemptBatch(batchNumber, attempt uint64, events []*ev
 		channel = sender
 	}
 
+	// Signed batches are sent in an envelope with the signature
+	var batch interface{} = events
+	if w.es.spec != nil && w.es.spec.SignBatches {
+		eventsBytes, sig, err := w.es.signBatch(events)
+		if err != nil {
+			return err
+		}
+		batch = &signedBatch{BatchNumber: batchNumber, Events: eventsBytes, Signature: sig}
+	}
+
+	// Hold back the batch if the consumers have a rate limit
+	if w.spec != nil && w.spec.MaxBatchesPerSec > 0 {
+		interval := time.Duration(float64(time.Second) / w.spec.MaxBatchesPerSec)
+		if wait := time.Until(w.lastSent.Add(interval)); wait > 0 {
+			select {
+			case <-time.After(wait):
+			case <-w.es.updateInterrupt:
+				return errors.Errorf(errors.EventStreamsWebSocketInterruptedSend)
+			case <-closing:
+				return errors.Errorf(errors.EventStreamsWebSocketInterruptedSend)
+			}
+		}
+	}
+
 	// Sent the batch of events
 	select {
-	case channel <- events:
-		break
+	case channel <- batch:
+		w.lastSent = time.Now()
 	case <-w.es.updateInterrupt:
 		return errors.Errorf(errors.EventStreamsWebSocketInterruptedSend)
 	case <-closing:
@@ -0,0 +1,498 @@
+// Copyright 2021 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package graphql
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/kaleido-io/ethconnect/internal/errors"
+)
+
+// Resolver returns the value of a field, from the value of the object it is selected on.
+// Fields of an object type return a struct or pointer that is passed to the resolvers of
+// the subfields, or a slice of them for a list. Scalar fields return a value that is
+// serialized to JSON as-is. Returning nil gives a null value
+type Resolver func(ctx context.Context, source interface{}, args map[string]interface{}) (interface{}, error)
+
+// Argument of a field. The type is a scalar type, String, Int, Float or Boolean, with
+// a trailing ! if the argument is required
+type Argument struct {
+	Name string
+	Type string
+}
+
+// Field of an object type. Object is set for fields that return an object type, or a list
+// of an object type, and the Type is the type as written in the schema, such as [Contract!]!
+type Field struct {
+	Name        string
+	Description string
+	Type        string
+	Object      *Object
+	Args        []*Argument
+	Resolve     Resolver
+}
+
+// Object is an object type in the schema
+type Object struct {
+	Name        string
+	Description string
+	Fields      []*Field
+}
+
+// Schema is a read-only GraphQL schema, executing queries against resolvers.
+// Only the subset of GraphQL needed to select related objects in a single round-trip
+// is supported: queries with arguments, variables, aliases, fragments, and the
+// @include and @skip directives. Mutations, subscriptions and introspection are not
+type Schema struct {
+	Query *Object
+}
+
+// Request is a GraphQL request, as POSTed over HTTP
+type Request struct {
+	Query         string                 `json:"query"`
+	OperationName string                 `json:"operationName,omitempty"`
+	Variables     map[string]interface{} `json:"variables,omitempty"`
+}
+
+// Error is an error in a GraphQL response. The path is set for errors resolving a field
+type Error struct {
+	Message string        `json:"message"`
+	Path    []interface{} `json:"path,omitempty"`
+}
+
+// Response is a GraphQL response. Data is nil if the request could not be executed
+type Response struct {
+	Data   *Result  `json:"data,omitempty"`
+	Errors []*Error `json:"errors,omitempty"`
+}
+
+// Result is the value of an object in a response, with the fields in the order they were selected
+type Result struct {
+	keys   []string
+	values map[string]interface{}
+}
+
+func newResult() *Result {
+	return &Result{
+		keys:   []string{},
+		values: make(map[string]interface{}),
+	}
+}
+
+func (r *Result) set(key string, value interface{}) {
+	if _, exists := r.values[key]; !exists {
+		r.keys = append(r.keys, key)
+	}
+	r.values[key] = value
+}
+
+// Get returns the value of a field in the result
+func (r *Result) Get(key string) interface{} {
+	return r.values[key]
+}
+
+// Keys returns the names of the fields in the result
+func (r *Result) Keys() []string {
+	return r.keys
+}
+
+// MarshalJSON serializes the fields in order
+func (r *Result) MarshalJSON() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, key := range r.keys {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		k, _ := json.Marshal(key)
+		buf.Write(k)
+		buf.WriteByte(':')
+		v, err := json.Marshal(r.values[key])
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(v)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+func (o *Object) field(name string) *Field {
+	for _, f := range o.Fields {
+		if f.Name == name {
+			return f
+		}
+	}
+	return nil
+}
+
+func (f *Field) arg(name string) *Argument {
+	for _, a := range f.Args {
+		if a.Name == name {
+			return a
+		}
+	}
+	return nil
+}
+
+type executor struct {
+	ctx       context.Context
+	doc       *document
+	variables map[string]interface{}
+	errors    []*Error
+}
+
+// Execute runs a query against the schema. Errors resolving individual fields are
+// returned in the response alongside the data, with the fields set to null
+func (s *Schema) Execute(ctx context.Context, req *Request) *Response {
+	if strings.TrimSpace(req.Query) == "" {
+		return ErrorResponse(errors.Errorf(errors.GraphQLMissingQuery))
+	}
+	doc, err := parse(req.Query)
+	if err != nil {
+		return ErrorResponse(err)
+	}
+	op, err := doc.operation(req.OperationName)
+	if err != nil {
+		return ErrorResponse(err)
+	}
+	e := &executor{
+		ctx: ctx,
+		doc: doc,
+	}
+	if e.variables, err = op.variableValues(req.Variables); err != nil {
+		return ErrorResponse(err)
+	}
+	data := e.selectionSet(s.Query, nil, op.selections, []interface{}{})
+	return &Response{Data: data, Errors: e.errors}
+}
+
+// ErrorResponse is the response to a request that failed before it could be executed
+func ErrorResponse(err error) *Response {
+	return &Response{Errors: []*Error{{Message: err.Error()}}}
+}
+
+func (d *document) operation(name string) (*operation, error) {
+	var op *operation
+	if name == "" {
+		if len(d.operations) > 1 {
+			return nil, errors.Errorf(errors.GraphQLOperationNameRequired)
+		}
+		op = d.operations[0]
+	} else {
+		for _, candidate := range d.operations {
+			if candidate.name == name {
+				op = candidate
+			}
+		}
+		if op == nil {
+			return nil, errors.Errorf(errors.GraphQLOperationNotFound, name)
+		}
+	}
+	if op.kind != "query" {
+		return nil, errors.Errorf(errors.GraphQLUnsupportedOperation, op.kind)
+	}
+	return op, nil
+}
+
+func (o *operation) variableValues(supplied map[string]interface{}) (map[string]interface{}, error) {
+	values := make(map[string]interface{})
+	for _, v := range o.variables {
+		value, isSupplied := supplied[v.name]
+		switch {
+		case isSupplied && (value != nil || !v.required):
+			values[v.name] = value
+		case v.hasDefault:
+			values[v.name] = v.defaultValue
+		case v.required:
+			return nil, errors.Errorf(errors.GraphQLMissingVariable, v.name, v.typeName)
+		default:
+			values[v.name] = nil
+		}
+	}
+	return values, nil
+}
+
+func (e *executor) addError(path []interface{}, err error) {
+	e.errors = append(e.errors, &Error{
+		Message: err.Error(),
+		Path:    path,
+	})
+}
+
+// withPath returns a copy of the path with an element added, as paths are kept in errors
+func withPath(path []interface{}, element interface{}) []interface{} {
+	newPath := make([]interface{}, len(path), len(path)+1)
+	copy(newPath, path)
+	return append(newPath, element)
+}
+
+func (e *executor) selectionSet(obj *Object, source interface{}, selections []*selection, path []interface{}) *Result {
+	result := newResult()
+	keys, fields := e.collectFields(obj, selections, map[string]bool{}, []string{}, make(map[string][]*selection), path)
+	for _, key := range keys {
+		result.set(key, e.field(obj, source, fields[key], withPath(path, key)))
+	}
+	return result
+}
+
+// collectFields flattens the fragments in a selection set, and groups the fields by the
+// key they are returned under, so the subfields of fields selected more than once are merged
+func (e *executor) collectFields(obj *Object, selections []*selection, visited map[string]bool, keys []string, fields map[string][]*selection, path []interface{}) ([]string, map[string][]*selection) {
+	for _, s := range selections {
+		if !e.included(s, path) {
+			continue
+		}
+		switch {
+		case s.fragmentName != "":
+			f, exists := e.doc.fragments[s.fragmentName]
+			if !exists {
+				e.addError(path, errors.Errorf(errors.GraphQLUnknownFragment, s.fragmentName))
+				continue
+			}
+			if visited[f.name] || f.typeCondition != obj.Name {
+				continue
+			}
+			visited[f.name] = true
+			keys, fields = e.collectFields(obj, f.selections, visited, keys, fields, path)
+		case s.inline:
+			if s.typeCondition != "" && s.typeCondition != obj.Name {
+				continue
+			}
+			keys, fields = e.collectFields(obj, s.selections, visited, keys, fields, path)
+		default:
+			key := s.responseKey()
+			if _, exists := fields[key]; !exists {
+				keys = append(keys, key)
+			}
+			fields[key] = append(fields[key], s)
+		}
+	}
+	return keys, fields
+}
+
+func (e *executor) included(s *selection, path []interface{}) bool {
+	for _, d := range s.directives {
+		if d.name != "skip" && d.name != "include" {
+			continue
+		}
+		value, err := e.value(d.args["if"])
+		if err != nil {
+			e.addError(path, err)
+			return false
+		}
+		if b, ok := value.(bool); ok && b == (d.name == "skip") {
+			return false
+		}
+	}
+	return true
+}
+
+func (e *executor) field(obj *Object, source interface{}, selections []*selection, path []interface{}) interface{} {
+	s := selections[0]
+	if s.name == "__typename" {
+		return obj.Name
+	}
+	f := obj.field(s.name)
+	if f == nil {
+		e.addError(path, errors.Errorf(errors.GraphQLUnknownField, s.name, obj.Name))
+		return nil
+	}
+	subSelections := []*selection{}
+	for _, s := range selections {
+		subSelections = append(subSelections, s.selections...)
+	}
+	if f.Object == nil && len(subSelections) > 0 {
+		e.addError(path, errors.Errorf(errors.GraphQLSelectionNotAllowed, s.name, f.Type))
+		return nil
+	}
+	if f.Object != nil && len(subSelections) == 0 {
+		e.addError(path, errors.Errorf(errors.GraphQLSelectionRequired, s.name, f.Type))
+		return nil
+	}
+	args, err := e.arguments(f, s)
+	if err != nil {
+		e.addError(path, err)
+		return nil
+	}
+	value, err := f.Resolve(e.ctx, source, args)
+	if err != nil {
+		e.addError(path, err)
+		return nil
+	}
+	if f.Object == nil || isNil(value) {
+		return value
+	}
+	v := reflect.ValueOf(value)
+	if v.Kind() == reflect.Slice {
+		list := make([]interface{}, v.Len())
+		for i := 0; i < v.Len(); i++ {
+			list[i] = e.selectionSet(f.Object, v.Index(i).Interface(), subSelections, withPath(path, i))
+		}
+		return list
+	}
+	return e.selectionSet(f.Object, value, subSelections, path)
+}
+
+func isNil(value interface{}) bool {
+	if value == nil {
+		return true
+	}
+	v := reflect.ValueOf(value)
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Map, reflect.Interface:
+		return v.IsNil()
+	}
+	return false
+}
+
+// arguments resolves the variables in the arguments of a field, and checks them against
+// the arguments of the field. Arguments not supplied, or supplied as null, are omitted
+func (e *executor) arguments(f *Field, s *selection) (map[string]interface{}, error) {
+	args := make(map[string]interface{})
+	for _, name := range s.argNames {
+		a := f.arg(name)
+		if a == nil {
+			return nil, errors.Errorf(errors.GraphQLUnknownArgument, name, f.Name)
+		}
+		value, err := e.value(s.args[name])
+		if err != nil {
+			return nil, err
+		}
+		if value == nil {
+			continue
+		}
+		if args[name], err = coerce(a.Type, value); err != nil {
+			return nil, errors.Errorf(errors.GraphQLInvalidArgument, name, f.Name, a.Type)
+		}
+	}
+	for _, a := range f.Args {
+		if _, supplied := args[a.Name]; !supplied && strings.HasSuffix(a.Type, "!") {
+			return nil, errors.Errorf(errors.GraphQLMissingArgument, f.Name, a.Name, a.Type)
+		}
+	}
+	return args, nil
+}
+
+// value substitutes the variables in a value from the query
+func (e *executor) value(v interface{}) (interface{}, error) {
+	switch v := v.(type) {
+	case variable:
+		value, declared := e.variables[string(v)]
+		if !declared {
+			return nil, errors.Errorf(errors.GraphQLUndefinedVariable, string(v))
+		}
+		return value, nil
+	case []interface{}:
+		list := make([]interface{}, len(v))
+		for i, item := range v {
+			var err error
+			if list[i], err = e.value(item); err != nil {
+				return nil, err
+			}
+		}
+		return list, nil
+	case map[string]interface{}:
+		obj := make(map[string]interface{})
+		for name, item := range v {
+			var err error
+			if obj[name], err = e.value(item); err != nil {
+				return nil, err
+			}
+		}
+		return obj, nil
+	}
+	return v, nil
+}
+
+// coerce converts a value to the scalar type of an argument. Numbers in variables
+// are float64, as decoded from JSON
+func coerce(typeName string, value interface{}) (interface{}, error) {
+	switch strings.TrimSuffix(typeName, "!") {
+	case "String", "ID":
+		switch v := value.(type) {
+		case string:
+			return v, nil
+		case int64:
+			return strconv.FormatInt(v, 10), nil
+		}
+	case "Int":
+		switch v := value.(type) {
+		case int64:
+			return v, nil
+		case float64:
+			if v == math.Trunc(v) {
+				return int64(v), nil
+			}
+		}
+	case "Float":
+		switch v := value.(type) {
+		case int64:
+			return float64(v), nil
+		case float64:
+			return v, nil
+		}
+	case "Boolean":
+		if b, ok := value.(bool); ok {
+			return b, nil
+		}
+	}
+	return nil, fmt.Errorf("invalid %s", typeName)
+}
+
+// SDL returns the schema in the GraphQL schema definition language, so clients can
+// generate types, and users can discover the fields available
+func (s *Schema) SDL() string {
+	var sb strings.Builder
+	objects := []*Object{s.Query}
+	seen := map[*Object]bool{s.Query: true}
+	for i := 0; i < len(objects); i++ {
+		obj := objects[i]
+		if i > 0 {
+			sb.WriteString("\n")
+		}
+		if obj.Description != "" {
+			sb.WriteString(fmt.Sprintf("%s\n", strconv.Quote(obj.Description)))
+		}
+		sb.WriteString(fmt.Sprintf("type %s {\n", obj.Name))
+		for _, f := range obj.Fields {
+			if f.Description != "" {
+				sb.WriteString(fmt.Sprintf("  %s\n", strconv.Quote(f.Description)))
+			}
+			args := make([]string, len(f.Args))
+			for i, a := range f.Args {
+				args[i] = fmt.Sprintf("%s: %s", a.Name, a.Type)
+			}
+			if len(args) > 0 {
+				sb.WriteString(fmt.Sprintf("  %s(%s): %s\n", f.Name, strings.Join(args, ", "), f.Type))
+			} else {
+				sb.WriteString(fmt.Sprintf("  %s: %s\n", f.Name, f.Type))
+			}
+			if f.Object != nil && !seen[f.Object] {
+				seen[f.Object] = true
+				objects = append(objects, f.Object)
+			}
+		}
+		sb.WriteString("}\n")
+	}
+	return sb.String()
+}
@@ -0,0 +1,242 @@
+// Copyright 2021 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package graphql
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type testAuthor struct {
+	Name  string
+	Books []*testBook
+}
+
+type testBook struct {
+	Title  string
+	Pages  int
+	Author *testAuthor
+}
+
+func newTestSchema() *Schema {
+	author := &testAuthor{Name: "Ada"}
+	author.Books = []*testBook{
+		{Title: "Engines", Pages: 120, Author: author},
+		{Title: "Notes", Pages: 40, Author: author},
+	}
+	authorType := &Object{Name: "Author"}
+	bookType := &Object{Name: "Book", Description: "A book"}
+	authorType.Fields = []*Field{
+		{Name: "name", Type: "String!", Resolve: func(ctx context.Context, source interface{}, args map[string]interface{}) (interface{}, error) {
+			return source.(*testAuthor).Name, nil
+		}},
+		{Name: "books", Type: "[Book!]!", Object: bookType, Args: []*Argument{{Name: "minPages", Type: "Int"}}, Resolve: func(ctx context.Context, source interface{}, args map[string]interface{}) (interface{}, error) {
+			books := []*testBook{}
+			for _, b := range source.(*testAuthor).Books {
+				if minPages, ok := args["minPages"]; !ok || int64(b.Pages) >= minPages.(int64) {
+					books = append(books, b)
+				}
+			}
+			return books, nil
+		}},
+	}
+	bookType.Fields = []*Field{
+		{Name: "title", Description: "The title", Type: "String!", Resolve: func(ctx context.Context, source interface{}, args map[string]interface{}) (interface{}, error) {
+			return source.(*testBook).Title, nil
+		}},
+		{Name: "pages", Type: "Int!", Resolve: func(ctx context.Context, source interface{}, args map[string]interface{}) (interface{}, error) {
+			return source.(*testBook).Pages, nil
+		}},
+		{Name: "author", Type: "Author!", Object: authorType, Resolve: func(ctx context.Context, source interface{}, args map[string]interface{}) (interface{}, error) {
+			return source.(*testBook).Author, nil
+		}},
+		{Name: "broken", Type: "String", Resolve: func(ctx context.Context, source interface{}, args map[string]interface{}) (interface{}, error) {
+			return nil, fmt.Errorf("pop")
+		}},
+	}
+	return &Schema{
+		Query: &Object{
+			Name: "Query",
+			Fields: []*Field{
+				{Name: "book", Type: "Book", Object: bookType, Args: []*Argument{{Name: "title", Type: "String!"}}, Resolve: func(ctx context.Context, source interface{}, args map[string]interface{}) (interface{}, error) {
+					for _, b := range author.Books {
+						if b.Title == args["title"] {
+							return b, nil
+						}
+					}
+					return (*testBook)(nil), nil
+				}},
+				{Name: "authors", Type: "[Author!]!", Object: authorType, Resolve: func(ctx context.Context, source interface{}, args map[string]interface{}) (interface{}, error) {
+					return []*testAuthor{author}, nil
+				}},
+			},
+		},
+	}
+}
+
+func testExecute(schema *Schema, req *Request) string {
+	b, _ := json.Marshal(schema.Execute(context.Background(), req))
+	return string(b)
+}
+
+func TestExecuteNestedSelections(t *testing.T) {
+	assert := assert.New(t)
+	schema := newTestSchema()
+
+	res := testExecute(schema, &Request{Query: `
+		# Comments and commas are ignored
+		query Books($minPages: Int = 0, $title: String!) {
+			authors { name, long: books(minPages: $minPages) { title } }
+			book(title: $title) { __typename ...BookFields author { name } }
+			missing: book(title: "None") { title }
+		}
+		fragment BookFields on Book { title pages }
+	`, Variables: map[string]interface{}{"minPages": float64(100), "title": "Notes"}})
+	assert.Equal(`{"data":{"authors":[{"name":"Ada","long":[{"title":"Engines"}]}],"book":{"__typename":"Book","title":"Notes","pages":40,"author":{"name":"Ada"}},"missing":null}}`, res)
+
+	res = testExecute(schema, &Request{Query: `{
+		book(title: "Engines") {
+			title @skip(if: true)
+			... on Book @include(if: false) { pages }
+			... { author { books { title } } }
+			author { name }
+		}
+	}`})
+	assert.Equal(`{"data":{"book":{"author":{"books":[{"title":"Engines"},{"title":"Notes"}],"name":"Ada"}}}}`, res)
+}
+
+func TestExecuteFieldErrors(t *testing.T) {
+	assert := assert.New(t)
+	schema := newTestSchema()
+
+	res := testExecute(schema, &Request{Query: `{ authors { books { broken title } } book(title: 1.5) { title } }`})
+	assert.Equal(`{"data":{"authors":[{"books":[{"broken":null,"title":"Engines"},{"broken":null,"title":"Notes"}]}],"book":null},"errors":[{"message":"pop","path":["authors",0,"books",0,"broken"]},{"message":"pop","path":["authors",0,"books",1,"broken"]},{"message":"Argument 'title' on field 'book' must be of type 'String!'","path":["book"]}]}`, res)
+
+	res = testExecute(schema, &Request{Query: `{ authors { unknown name { first } } book { title } books: authors }`})
+	assert.Equal(`{"data":{"authors":[{"unknown":null,"name":null}],"book":null,"books":null},"errors":[{"message":"Cannot query field 'unknown' on type 'Author'","path":["authors",0,"unknown"]},{"message":"Field 'name' of type 'String!' cannot have a selection of subfields","path":["authors",0,"name"]},{"message":"Field 'book' requires argument 'title' of type 'String!'","path":["book"]},{"message":"Field 'authors' of type '[Author!]!' must have a selection of subfields","path":["books"]}]}`, res)
+
+	res = testExecute(schema, &Request{Query: `{ book(title: $title, other: "x") { title } ...Missing }`})
+	assert.Equal(`{"data":{"book":null},"errors":[{"message":"Unknown fragment 'Missing'"},{"message":"Variable '$title' is not defined","path":["book"]}]}`, res)
+
+	res = testExecute(schema, &Request{Query: `{ book(other: "x") { title } }`})
+	assert.Equal(`{"data":{"book":null},"errors":[{"message":"Unknown argument 'other' on field 'book'","path":["book"]}]}`, res)
+}
+
+func TestExecuteRequestErrors(t *testing.T) {
+	assert := assert.New(t)
+	schema := newTestSchema()
+
+	for query, message := range map[string]string{
+		"  ":                                     "No GraphQL query was supplied",
+		"{ authors { name }":                     "Syntax error in GraphQL query at position 18: Expected a name, found end of query",
+		"{ }":                                    "Syntax error in GraphQL query at position 2: Empty selection set",
+		"{ a(b: \"c) }":                          "Syntax error in GraphQL query at position 7: Unterminated string",
+		"{ a(b: 1.x) }":                          "Syntax error in GraphQL query at position 9: Invalid number",
+		"{ a(b: \"\\q\") }":                      "Syntax error in GraphQL query at position 8: Invalid escape '\\q'",
+		"{ a ? }":                                "Syntax error in GraphQL query at position 4: Unexpected character '?'",
+		"type Query { a: String }":               "Syntax error in GraphQL query at position 0: Unexpected 'type'",
+		"fragment F on Book { title }":           "Syntax error in GraphQL query at position 0: No operations in query",
+		"mutation { a }":                         "GraphQL mutation operations are not supported, only queries",
+		"query A { a } query B { b }":            "An operationName is required, as the GraphQL query contains multiple operations",
+		"query ($title: String!) { book { a } }": "Variable '$title' of required type 'String!' was not provided",
+	} {
+		res := schema.Execute(context.Background(), &Request{Query: query})
+		assert.Nil(res.Data, query)
+		assert.Equal(1, len(res.Errors), query)
+		assert.Equal(message, res.Errors[0].Message, query)
+	}
+
+	res := schema.Execute(context.Background(), &Request{Query: "query A { a }", OperationName: "B"})
+	assert.Equal("GraphQL operation 'B' not found", res.Errors[0].Message)
+}
+
+func TestParseValues(t *testing.T) {
+	assert := assert.New(t)
+
+	doc, err := parse(`query Q($v: [Int!]! = [1, 2]) @dir { a(s: "a\"\\\/\b\f\n\r\t\u0041", b: """block "quoted" \"""""", i: -12, f: 1.5e3, t: true, n: null, e: ENUM, l: [$v], o: {k: false}) }`)
+	assert.NoError(err)
+	op := doc.operations[0]
+	assert.Equal("Q", op.name)
+	assert.Equal("[Int!]!", op.variables[0].typeName)
+	assert.True(op.variables[0].required)
+	assert.Equal([]interface{}{int64(1), int64(2)}, op.variables[0].defaultValue)
+	args := op.selections[0].args
+	assert.Equal("a\"\\/\b\f\n\r\tA", args["s"])
+	assert.Equal(`block "quoted" """`, args["b"])
+	assert.Equal(int64(-12), args["i"])
+	assert.Equal(1500.0, args["f"])
+	assert.Equal(true, args["t"])
+	assert.Nil(args["n"])
+	assert.Equal(enumValue("ENUM"), args["e"])
+	assert.Equal([]interface{}{variable("v")}, args["l"])
+	assert.Equal(map[string]interface{}{"k": false}, args["o"])
+	assert.Equal([]string{"s", "b", "i", "f", "t", "n", "e", "l", "o"}, op.selections[0].argNames)
+
+	_, err = parse(`query ($v: Int = $w) { a }`)
+	assert.EqualError(err, "Syntax error in GraphQL query at position 17: Unexpected '$'")
+	_, err = parse(`{ a(s: "\u00") }`)
+	assert.EqualError(err, "Syntax error in GraphQL query at position 8: Invalid unicode escape")
+	_, err = parse(`{ a(s: """open) }`)
+	assert.EqualError(err, "Syntax error in GraphQL query at position 7: Unterminated string")
+}
+
+func TestCoerceArguments(t *testing.T) {
+	assert := assert.New(t)
+
+	v, err := coerce("String", int64(5))
+	assert.NoError(err)
+	assert.Equal("5", v)
+	v, err = coerce("Int!", float64(5))
+	assert.NoError(err)
+	assert.Equal(int64(5), v)
+	_, err = coerce("Int", float64(5.5))
+	assert.Error(err)
+	v, err = coerce("Float", int64(5))
+	assert.NoError(err)
+	assert.Equal(5.0, v)
+	v, err = coerce("Boolean", true)
+	assert.NoError(err)
+	assert.Equal(true, v)
+	_, err = coerce("Boolean", "true")
+	assert.Error(err)
+}
+
+func TestSchemaSDL(t *testing.T) {
+	assert := assert.New(t)
+	schema := newTestSchema()
+	assert.Equal(`type Query {
+  book(title: String!): Book
+  authors: [Author!]!
+}
+
+"A book"
+type Book {
+  "The title"
+  title: String!
+  pages: Int!
+  author: Author!
+  broken: String
+}
+
+type Author {
+  name: String!
+  books(minPages: Int): [Book!]!
+}
+`, schema.SDL())
+}
@@ -0,0 +1,611 @@
+// Copyright 2021 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package graphql
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/kaleido-io/ethconnect/internal/errors"
+)
+
+type tokenKind int
+
+const (
+	tokenEOF tokenKind = iota
+	tokenPunctuator
+	tokenName
+	tokenInt
+	tokenFloat
+	tokenString
+)
+
+type token struct {
+	kind  tokenKind
+	value string
+	pos   int
+}
+
+func (t token) String() string {
+	if t.kind == tokenEOF {
+		return "end of query"
+	}
+	return fmt.Sprintf("'%s'", t.value)
+}
+
+// document is a parsed GraphQL query document
+type document struct {
+	operations []*operation
+	fragments  map[string]*fragment
+}
+
+type operation struct {
+	kind       string
+	name       string
+	variables  []*variableDefinition
+	selections []*selection
+}
+
+type variableDefinition struct {
+	name         string
+	typeName     string
+	required     bool
+	defaultValue interface{}
+	hasDefault   bool
+}
+
+type fragment struct {
+	name          string
+	typeCondition string
+	selections    []*selection
+}
+
+type directive struct {
+	name string
+	args map[string]interface{}
+}
+
+// selection is a field, a fragment spread (fragmentName set), or an inline fragment (inline set)
+type selection struct {
+	alias         string
+	name          string
+	args          map[string]interface{}
+	argNames      []string
+	directives    []*directive
+	selections    []*selection
+	fragmentName  string
+	inline        bool
+	typeCondition string
+}
+
+func (s *selection) responseKey() string {
+	if s.alias != "" {
+		return s.alias
+	}
+	return s.name
+}
+
+// variable is a reference to a variable in an argument value
+type variable string
+
+// enumValue is an unquoted name in an argument value
+type enumValue string
+
+type parser struct {
+	tokens []token
+	pos    int
+}
+
+func lex(query string) ([]token, error) {
+	tokens := []token{}
+	i := 0
+	for i < len(query) {
+		c := query[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == ',':
+			i++
+		case c == '#':
+			for i < len(query) && query[i] != '\n' && query[i] != '\r' {
+				i++
+			}
+		case strings.HasPrefix(query[i:], "\ufeff"):
+			i += len("\ufeff")
+		case strings.HasPrefix(query[i:], "..."):
+			tokens = append(tokens, token{tokenPunctuator, "...", i})
+			i += 3
+		case strings.ContainsRune("!$&()/:=@[]{}|", rune(c)):
+			tokens = append(tokens, token{tokenPunctuator, string(c), i})
+			i++
+		case c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z'):
+			start := i
+			for i < len(query) && isNameChar(query[i]) {
+				i++
+			}
+			tokens = append(tokens, token{tokenName, query[start:i], start})
+		case c == '-' || (c >= '0' && c <= '9'):
+			t, end, err := lexNumber(query, i)
+			if err != nil {
+				return nil, err
+			}
+			tokens = append(tokens, t)
+			i = end
+		case c == '"':
+			t, end, err := lexString(query, i)
+			if err != nil {
+				return nil, err
+			}
+			tokens = append(tokens, t)
+			i = end
+		default:
+			r, _ := utf8.DecodeRuneInString(query[i:])
+			return nil, errors.Errorf(errors.GraphQLSyntaxError, i, fmt.Sprintf("Unexpected character '%c'", r))
+		}
+	}
+	return append(tokens, token{tokenEOF, "", len(query)}), nil
+}
+
+func isNameChar(c byte) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9')
+}
+
+func isDigit(query string, i int) bool {
+	return i < len(query) && query[i] >= '0' && query[i] <= '9'
+}
+
+func lexNumber(query string, start int) (token, int, error) {
+	i := start
+	kind := tokenInt
+	if query[i] == '-' {
+		i++
+	}
+	if !isDigit(query, i) {
+		return token{}, i, errors.Errorf(errors.GraphQLSyntaxError, i, "Invalid number")
+	}
+	for isDigit(query, i) {
+		i++
+	}
+	if i < len(query) && query[i] == '.' {
+		kind = tokenFloat
+		i++
+		if !isDigit(query, i) {
+			return token{}, i, errors.Errorf(errors.GraphQLSyntaxError, i, "Invalid number")
+		}
+		for isDigit(query, i) {
+			i++
+		}
+	}
+	if i < len(query) && (query[i] == 'e' || query[i] == 'E') {
+		kind = tokenFloat
+		i++
+		if i < len(query) && (query[i] == '+' || query[i] == '-') {
+			i++
+		}
+		if !isDigit(query, i) {
+			return token{}, i, errors.Errorf(errors.GraphQLSyntaxError, i, "Invalid number")
+		}
+		for isDigit(query, i) {
+			i++
+		}
+	}
+	return token{kind, query[start:i], start}, i, nil
+}
+
+func lexString(query string, start int) (token, int, error) {
+	if strings.HasPrefix(query[start:], `"""`) {
+		// Block strings are taken as written, other than the escaped triple quote
+		end := start + 3
+		for end < len(query) {
+			if strings.HasPrefix(query[end:], `\"""`) {
+				end += 4
+				continue
+			}
+			if strings.HasPrefix(query[end:], `"""`) {
+				value := strings.ReplaceAll(query[start+3:end], `\"""`, `"""`)
+				return token{tokenString, value, start}, end + 3, nil
+			}
+			end++
+		}
+		return token{}, end, errors.Errorf(errors.GraphQLSyntaxError, start, "Unterminated string")
+	}
+	var sb strings.Builder
+	i := start + 1
+	for i < len(query) {
+		c := query[i]
+		switch {
+		case c == '"':
+			return token{tokenString, sb.String(), start}, i + 1, nil
+		case c == '\n' || c == '\r':
+			return token{}, i, errors.Errorf(errors.GraphQLSyntaxError, start, "Unterminated string")
+		case c == '\\' && i+1 < len(query):
+			switch e := query[i+1]; e {
+			case '"', '\\', '/':
+				sb.WriteByte(e)
+			case 'b':
+				sb.WriteByte('\b')
+			case 'f':
+				sb.WriteByte('\f')
+			case 'n':
+				sb.WriteByte('\n')
+			case 'r':
+				sb.WriteByte('\r')
+			case 't':
+				sb.WriteByte('\t')
+			case 'u':
+				if i+6 > len(query) {
+					return token{}, i, errors.Errorf(errors.GraphQLSyntaxError, i, "Invalid unicode escape")
+				}
+				r, err := strconv.ParseUint(query[i+2:i+6], 16, 32)
+				if err != nil {
+					return token{}, i, errors.Errorf(errors.GraphQLSyntaxError, i, "Invalid unicode escape")
+				}
+				sb.WriteRune(rune(r))
+				i += 4
+			default:
+				return token{}, i, errors.Errorf(errors.GraphQLSyntaxError, i, fmt.Sprintf("Invalid escape '\\%c'", e))
+			}
+			i += 2
+		default:
+			sb.WriteByte(c)
+			i++
+		}
+	}
+	return token{}, i, errors.Errorf(errors.GraphQLSyntaxError, start, "Unterminated string")
+}
+
+// parse parses a GraphQL query document. Type system definitions are not supported,
+// only operations and fragments
+func parse(query string) (*document, error) {
+	tokens, err := lex(query)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{tokens: tokens}
+	doc := &document{
+		fragments: make(map[string]*fragment),
+	}
+	for p.peek().kind != tokenEOF {
+		t := p.peek()
+		switch {
+		case p.is("{"):
+			selections, err := p.parseSelectionSet()
+			if err != nil {
+				return nil, err
+			}
+			doc.operations = append(doc.operations, &operation{kind: "query", selections: selections})
+		case t.kind == tokenName && (t.value == "query" || t.value == "mutation" || t.value == "subscription"):
+			op, err := p.parseOperation()
+			if err != nil {
+				return nil, err
+			}
+			doc.operations = append(doc.operations, op)
+		case t.kind == tokenName && t.value == "fragment":
+			f, err := p.parseFragment()
+			if err != nil {
+				return nil, err
+			}
+			doc.fragments[f.name] = f
+		default:
+			return nil, p.unexpected(t)
+		}
+	}
+	if len(doc.operations) == 0 {
+		return nil, errors.Errorf(errors.GraphQLSyntaxError, 0, "No operations in query")
+	}
+	return doc, nil
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *parser) next() token {
+	t := p.tokens[p.pos]
+	if t.kind != tokenEOF {
+		p.pos++
+	}
+	return t
+}
+
+func (p *parser) is(punctuator string) bool {
+	t := p.peek()
+	return t.kind == tokenPunctuator && t.value == punctuator
+}
+
+func (p *parser) isName(name string) bool {
+	t := p.peek()
+	return t.kind == tokenName && t.value == name
+}
+
+func (p *parser) unexpected(t token) error {
+	return errors.Errorf(errors.GraphQLSyntaxError, t.pos, fmt.Sprintf("Unexpected %s", t))
+}
+
+func (p *parser) expect(punctuator string) error {
+	if !p.is(punctuator) {
+		t := p.peek()
+		return errors.Errorf(errors.GraphQLSyntaxError, t.pos, fmt.Sprintf("Expected '%s', found %s", punctuator, t))
+	}
+	p.next()
+	return nil
+}
+
+func (p *parser) expectName() (string, error) {
+	t := p.next()
+	if t.kind != tokenName {
+		return "", errors.Errorf(errors.GraphQLSyntaxError, t.pos, fmt.Sprintf("Expected a name, found %s", t))
+	}
+	return t.value, nil
+}
+
+func (p *parser) parseOperation() (op *operation, err error) {
+	op = &operation{kind: p.next().value}
+	if p.peek().kind == tokenName {
+		op.name = p.next().value
+	}
+	if p.is("(") {
+		p.next()
+		for !p.is(")") {
+			v, err := p.parseVariableDefinition()
+			if err != nil {
+				return nil, err
+			}
+			op.variables = append(op.variables, v)
+		}
+		p.next()
+	}
+	if _, err = p.parseDirectives(); err != nil {
+		return nil, err
+	}
+	op.selections, err = p.parseSelectionSet()
+	return op, err
+}
+
+func (p *parser) parseVariableDefinition() (v *variableDefinition, err error) {
+	if err = p.expect("$"); err != nil {
+		return nil, err
+	}
+	v = &variableDefinition{}
+	if v.name, err = p.expectName(); err != nil {
+		return nil, err
+	}
+	if err = p.expect(":"); err != nil {
+		return nil, err
+	}
+	if v.typeName, v.required, err = p.parseType(); err != nil {
+		return nil, err
+	}
+	if p.is("=") {
+		p.next()
+		if v.defaultValue, err = p.parseValue(true); err != nil {
+			return nil, err
+		}
+		v.hasDefault = true
+	}
+	_, err = p.parseDirectives()
+	return v, err
+}
+
+// parseType returns the type as written, and whether it is non-null
+func (p *parser) parseType() (typeName string, required bool, err error) {
+	if p.is("[") {
+		p.next()
+		var inner string
+		if inner, _, err = p.parseType(); err != nil {
+			return "", false, err
+		}
+		if err = p.expect("]"); err != nil {
+			return "", false, err
+		}
+		typeName = "[" + inner + "]"
+	} else if typeName, err = p.expectName(); err != nil {
+		return "", false, err
+	}
+	if p.is("!") {
+		p.next()
+		return typeName + "!", true, nil
+	}
+	return typeName, false, nil
+}
+
+func (p *parser) parseFragment() (f *fragment, err error) {
+	p.next()
+	f = &fragment{}
+	if f.name, err = p.expectName(); err != nil {
+		return nil, err
+	}
+	if !p.isName("on") {
+		return nil, p.unexpected(p.peek())
+	}
+	p.next()
+	if f.typeCondition, err = p.expectName(); err != nil {
+		return nil, err
+	}
+	if _, err = p.parseDirectives(); err != nil {
+		return nil, err
+	}
+	f.selections, err = p.parseSelectionSet()
+	return f, err
+}
+
+func (p *parser) parseSelectionSet() ([]*selection, error) {
+	if err := p.expect("{"); err != nil {
+		return nil, err
+	}
+	selections := []*selection{}
+	for !p.is("}") {
+		s, err := p.parseSelection()
+		if err != nil {
+			return nil, err
+		}
+		selections = append(selections, s)
+	}
+	if len(selections) == 0 {
+		return nil, errors.Errorf(errors.GraphQLSyntaxError, p.peek().pos, "Empty selection set")
+	}
+	p.next()
+	return selections, nil
+}
+
+func (p *parser) parseSelection() (s *selection, err error) {
+	s = &selection{}
+	if p.is("...") {
+		p.next()
+		if p.peek().kind == tokenName && !p.isName("on") {
+			s.fragmentName = p.next().value
+			s.directives, err = p.parseDirectives()
+			return s, err
+		}
+		s.inline = true
+		if p.isName("on") {
+			p.next()
+			if s.typeCondition, err = p.expectName(); err != nil {
+				return nil, err
+			}
+		}
+		if s.directives, err = p.parseDirectives(); err != nil {
+			return nil, err
+		}
+		s.selections, err = p.parseSelectionSet()
+		return s, err
+	}
+	if s.name, err = p.expectName(); err != nil {
+		return nil, err
+	}
+	if p.is(":") {
+		p.next()
+		s.alias = s.name
+		if s.name, err = p.expectName(); err != nil {
+			return nil, err
+		}
+	}
+	if s.args, s.argNames, err = p.parseArguments(); err != nil {
+		return nil, err
+	}
+	if s.directives, err = p.parseDirectives(); err != nil {
+		return nil, err
+	}
+	if p.is("{") {
+		s.selections, err = p.parseSelectionSet()
+	}
+	return s, err
+}
+
+// parseArguments returns the arguments by name, and the names in the order they were written
+func (p *parser) parseArguments() (map[string]interface{}, []string, error) {
+	args := make(map[string]interface{})
+	names := []string{}
+	if !p.is("(") {
+		return args, names, nil
+	}
+	p.next()
+	for !p.is(")") {
+		name, err := p.expectName()
+		if err != nil {
+			return nil, nil, err
+		}
+		if err = p.expect(":"); err != nil {
+			return nil, nil, err
+		}
+		if args[name], err = p.parseValue(false); err != nil {
+			return nil, nil, err
+		}
+		names = append(names, name)
+	}
+	p.next()
+	return args, names, nil
+}
+
+func (p *parser) parseDirectives() ([]*directive, error) {
+	directives := []*directive{}
+	for p.is("@") {
+		p.next()
+		name, err := p.expectName()
+		if err != nil {
+			return nil, err
+		}
+		args, _, err := p.parseArguments()
+		if err != nil {
+			return nil, err
+		}
+		directives = append(directives, &directive{name: name, args: args})
+	}
+	return directives, nil
+}
+
+func (p *parser) parseValue(constant bool) (interface{}, error) {
+	t := p.next()
+	switch t.kind {
+	case tokenInt:
+		i, err := strconv.ParseInt(t.value, 10, 64)
+		if err != nil {
+			return nil, errors.Errorf(errors.GraphQLSyntaxError, t.pos, "Invalid integer")
+		}
+		return i, nil
+	case tokenFloat:
+		f, err := strconv.ParseFloat(t.value, 64)
+		if err != nil {
+			return nil, errors.Errorf(errors.GraphQLSyntaxError, t.pos, "Invalid number")
+		}
+		return f, nil
+	case tokenString:
+		return t.value, nil
+	case tokenName:
+		switch t.value {
+		case "true":
+			return true, nil
+		case "false":
+			return false, nil
+		case "null":
+			return nil, nil
+		}
+		return enumValue(t.value), nil
+	case tokenPunctuator:
+		switch {
+		case t.value == "$" && !constant:
+			name, err := p.expectName()
+			return variable(name), err
+		case t.value == "[":
+			list := []interface{}{}
+			for !p.is("]") {
+				v, err := p.parseValue(constant)
+				if err != nil {
+					return nil, err
+				}
+				list = append(list, v)
+			}
+			p.next()
+			return list, nil
+		case t.value == "{":
+			obj := make(map[string]interface{})
+			for !p.is("}") {
+				name, err := p.expectName()
+				if err != nil {
+					return nil, err
+				}
+				if err = p.expect(":"); err != nil {
+					return nil, err
+				}
+				if obj[name], err = p.parseValue(constant); err != nil {
+					return nil, err
+				}
+			}
+			p.next()
+			return obj, nil
+		}
+	}
+	return nil, p.unexpected(t)
+}
@@ -20,6 +20,7 @@ import (
 	"time"
 
 	"github.com/Shopify/sarama"
+	"github.com/kaleido-io/ethconnect/internal/opsevents"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -164,6 +165,11 @@ func (h *saramaKafkaConsumerGroupHandler) consumerGoRoutine() {
 		h.cg = nil
 
 		if !h.closed {
+			data := map[string]interface{}{"group": h.group, "topics": h.topics}
+			if err != nil {
+				data["error"] = err.Error()
+			}
+			opsevents.Publish(opsevents.KafkaReconnecting, data)
 			time.Sleep(h.reconnectDelay)
 		}
 	}
@@ -27,12 +27,17 @@ import (
 	"github.com/kaleido-io/ethconnect/internal/errors"
 	"github.com/kaleido-io/ethconnect/internal/eth"
 	"github.com/kaleido-io/ethconnect/internal/messages"
+	"github.com/kaleido-io/ethconnect/internal/metrics"
+	"github.com/kaleido-io/ethconnect/internal/tracing"
 	"github.com/kaleido-io/ethconnect/internal/tx"
 	"github.com/kaleido-io/ethconnect/internal/utils"
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 )
 
+// kafkaLagBuckets are the upper bounds in seconds of the consume and produce lag histograms
+var kafkaLagBuckets = []float64{0.01, 0.05, 0.1, 0.5, 1, 5, 10, 30, 60, 300}
+
 // KafkaBridgeConf defines the YAML config structure for a Kafka bridge instance
 type KafkaBridgeConf struct {
 	Kafka       KafkaCommonConf `json:"kafka"`
@@ -50,6 +55,8 @@ type KafkaBridge struct {
 	processor    tx.TxnProcessor
 	inFlight     map[string]*msgContext
 	inFlightCond *sync.Cond
+	consumeLag   *metrics.HistogramVec
+	produceLag   *metrics.HistogramVec
 }
 
 // Conf gets the config for this bridge
@@ -152,14 +159,18 @@ func (k *KafkaBridge) addInflightMsg(msg *sarama.ConsumerMessage, producer Kafka
 	// that needs Reply (and offset commit). So our caller must
 	// send a generic error reply (after dropping the lock).
 	if err = json.Unmarshal(msg.Value, &ctx.requestCommon); err != nil {
-		log.Errorf("Failed to unmarshal message headers: %s - Message=%s", err, string(msg.Value))
+		log.Errorf("Failed to unmarshal message headers: %s - Message=%s", err, utils.RedactJSON(msg.Value))
 		return
 	}
 	headers := &ctx.requestCommon.Headers
 	accessToken := ""
+	traceParent := ""
 	for _, header := range msg.Headers {
-		if string(header.Key) == messages.RecordHeaderAccessToken {
+		switch string(header.Key) {
+		case messages.RecordHeaderAccessToken:
 			accessToken = string(header.Value)
+		case messages.RecordHeaderTraceParent:
+			traceParent = string(header.Value)
 		}
 	}
 	authCtx, err := auth.WithAuthContext(context.Background(), accessToken)
@@ -168,7 +179,8 @@ func (k *KafkaBridge) addInflightMsg(msg *sarama.ConsumerMessage, producer Kafka
 		err = errors.Errorf(errors.Unauthorized)
 		return
 	}
-	ctx.ctx = authCtx
+	// Continue the trace of the request that produced the message
+	ctx.ctx = tracing.Extract(authCtx, traceParent)
 	if headers.ID == "" {
 		headers.ID = utils.UUIDv4()
 	}
@@ -245,6 +257,10 @@ func (c *msgContext) Headers() *messages.CommonHeaders {
 	return &c.requestCommon.Headers.CommonHeaders
 }
 
+func (c *msgContext) TimeReceived() time.Time {
+	return c.timeReceived
+}
+
 func (c *msgContext) Unmarshal(msg interface{}) (err error) {
 	if err = json.Unmarshal(c.saramaMsg.Value, msg); err != nil {
 		log.Errorf("Failed to parse message: %s - Message=%s", err, string(c.saramaMsg.Value))
@@ -323,6 +339,18 @@ func NewKafkaBridge(printYAML *bool) *KafkaBridge {
 		printYAML:    printYAML,
 		inFlight:     make(map[string]*msgContext),
 		inFlightCond: sync.NewCond(&sync.Mutex{}),
+		consumeLag: metrics.NewHistogramVec(
+			"ethconnect_kafka_consume_lag_seconds",
+			"Time from a request being written to Kafka to it being consumed by the bridge",
+			kafkaLagBuckets,
+			"topic",
+		),
+		produceLag: metrics.NewHistogramVec(
+			"ethconnect_kafka_produce_lag_seconds",
+			"Time from a reply being sent to it being acknowledged by Kafka",
+			kafkaLagBuckets,
+			"topic",
+		),
 	}
 	k.processor = tx.NewTxnProcessor(&k.conf.TxnProcessorConf, &k.conf.RPCConf)
 	k.kafka = NewKafkaCommon(&SaramaKafkaFactory{}, &k.conf.Kafka, k)
@@ -335,6 +363,10 @@ func (k *KafkaBridge) ConsumerMessagesLoop(consumer KafkaConsumer, producer Kafk
 	for msg := range consumer.Messages() {
 		k.inFlightCond.L.Lock()
 		log.Infof("Kafka consumer received message: Partition=%d Offset=%d", msg.Partition, msg.Offset)
+		// The timestamp is only set by brokers and producers from Kafka 0.10
+		if !msg.Timestamp.IsZero() {
+			k.consumeLag.Observe(time.Since(msg.Timestamp).Seconds(), msg.Topic)
+		}
 
 		// We cannot build up an infinite number of messages in memory
 		for len(k.inFlight) >= k.conf.MaxInFlight {
@@ -389,6 +421,7 @@ func (k *KafkaBridge) ProducerSuccessLoop(consumer KafkaConsumer, producer Kafka
 		reqOffset := msg.Metadata.(string)
 		if ctx, ok := k.inFlight[reqOffset]; ok {
 			log.Infof("Reply sent: %s", ctx)
+			k.produceLag.Observe(time.Since(ctx.replyTime).Seconds(), msg.Topic)
 			// While still holding the lock, add this to the completed list
 			k.setInFlightComplete(ctx, consumer)
 			// We've reduced the in-flight count - wake any waiting consumer go func
@@ -15,6 +15,7 @@
 package kafka
 
 import (
+	"context"
 	"crypto/tls"
 	"encoding/json"
 	"fmt"
@@ -24,10 +25,12 @@ import (
 	"time"
 
 	"github.com/Shopify/sarama"
+	"github.com/julienschmidt/httprouter"
 	"github.com/kaleido-io/ethconnect/internal/auth"
 	"github.com/kaleido-io/ethconnect/internal/auth/authtest"
 	"github.com/kaleido-io/ethconnect/internal/eth"
 	"github.com/kaleido-io/ethconnect/internal/messages"
+	"github.com/kaleido-io/ethconnect/internal/tracing"
 	"github.com/kaleido-io/ethconnect/internal/tx"
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
@@ -79,7 +82,13 @@ type testKafkaMsgProcessor struct {
 	rpc      eth.RPCClient
 }
 
-func (p *testKafkaMsgProcessor) ResolveAddress(from string) (resolvedFrom string, err error) {
+func (p *testKafkaMsgProcessor) SetEventABIResolver(resolver eth.EventABIResolver) {}
+
+func (p *testKafkaMsgProcessor) AddRoutes(router *httprouter.Router) {}
+
+func (p *testKafkaMsgProcessor) ContractStats(address string) *tx.ContractStats { return nil }
+
+func (p *testKafkaMsgProcessor) ResolveAddress(ctx context.Context, from string) (resolvedFrom string, err error) {
 	return from, nil
 }
 
@@ -240,12 +249,17 @@ func TestSingleMessageWithReply(t *testing.T) {
 				Key:   []byte(messages.RecordHeaderAccessToken),
 				Value: []byte("testat"),
 			},
+			{
+				Key:   []byte(messages.RecordHeaderTraceParent),
+				Value: []byte("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"),
+			},
 		},
 	}
 
 	// Get the message via the processor
 	msgContext1 := <-processor.messages
 	assert.Equal("testat", auth.GetAccessToken(msgContext1.Context()))
+	assert.Equal("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", tracing.TraceParent(msgContext1.Context()))
 	assert.Equal("verified", auth.GetAuthContext(msgContext1.Context()))
 	assert.NotEmpty(msgContext1.Headers().ID) // Generated one as not supplied
 	assert.Equal(msg1.Headers.MsgType, msgContext1.Headers().MsgType)
@@ -290,6 +304,52 @@ func TestSingleMessageWithReply(t *testing.T) {
 	auth.RegisterSecurityModule(nil)
 }
 
+func TestSingleMessageRecordsLag(t *testing.T) {
+	assert := assert.New(t)
+
+	k, processor, mockConsumer, mockProducer, wg := setupMocks()
+
+	msg1 := messages.RequestCommon{}
+	msg1.Headers.MsgType = "TestSingleMessageRecordsLag"
+	msg1bytes, _ := json.Marshal(&msg1)
+	requests := []*sarama.ConsumerMessage{
+		{
+			Topic:     "in-topic",
+			Partition: 5,
+			Offset:    500,
+			Value:     msg1bytes,
+			Timestamp: time.Now().Add(-2 * time.Second),
+		},
+		{
+			// No timestamp from brokers before Kafka 0.10
+			Topic:     "in-topic",
+			Partition: 5,
+			Offset:    501,
+			Value:     msg1bytes,
+		},
+	}
+
+	for _, request := range requests {
+		mockConsumer.MockMessages <- request
+		msgContext := <-processor.messages
+		go func() {
+			reply := messages.ReplyCommon{}
+			reply.Headers.MsgType = "TestReply"
+			msgContext.Reply(&reply)
+		}()
+		mockProducer.MockSuccesses <- <-mockProducer.MockInput
+	}
+
+	mockProducer.AsyncClose()
+	mockConsumer.Close()
+	wg.Wait()
+
+	consumeLag := k.consumeLag.Aggregate("topic")["in-topic"]
+	assert.Equal(uint64(1), consumeLag.Count)
+	assert.GreaterOrEqual(consumeLag.Sum, 2.0)
+	assert.Equal(uint64(2), k.produceLag.Aggregate("")[""].Count)
+}
+
 func TestSingleMessageWithNotAuthorizedReply(t *testing.T) {
 	assert := assert.New(t)
 	auth.RegisterSecurityModule(&authtest.TestSecurityModule{})
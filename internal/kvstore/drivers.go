@@ -0,0 +1,82 @@
+// Copyright 2021 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kvstore
+
+import (
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/kaleido-io/ethconnect/internal/errors"
+	"github.com/kaleido-io/ethconnect/pkg/plugins"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// LevelDBScheme is the connection string scheme for the built-in LevelDB driver
+	LevelDBScheme = "leveldb"
+	// MemoryScheme is the connection string scheme for the built-in in-memory driver
+	MemoryScheme = "memory"
+)
+
+var driverRegistry = struct {
+	sync.Mutex
+	drivers map[string]plugins.KVStoreDriver
+}{
+	drivers: map[string]plugins.KVStoreDriver{
+		LevelDBScheme: &levelDBDriver{},
+		MemoryScheme:  &memoryDriver{},
+	},
+}
+
+// RegisterDriver makes a KVStore driver available for connection strings with the supplied scheme
+func RegisterDriver(scheme string, driver plugins.KVStoreDriver) {
+	driverRegistry.Lock()
+	defer driverRegistry.Unlock()
+	log.Infof("Registered KVStore driver for '%s://' connection strings", scheme)
+	driverRegistry.drivers[strings.ToLower(scheme)] = driver
+}
+
+// NewKeyValueStore opens a KV store from a connection string, such as "leveldb:///data/events"
+// or "memory://". A connection string without a scheme is a LevelDB path
+func NewKeyValueStore(connStr string) (KVStore, error) {
+	if !strings.Contains(connStr, "://") {
+		return NewLDBKeyValueStore(connStr)
+	}
+	connURL, err := url.Parse(connStr)
+	if err != nil {
+		return nil, errors.Errorf(errors.KVStoreInvalidConnectionString, err)
+	}
+	driverRegistry.Lock()
+	driver, exists := driverRegistry.drivers[strings.ToLower(connURL.Scheme)]
+	driverRegistry.Unlock()
+	if !exists {
+		return nil, errors.Errorf(errors.KVStoreUnknownDriver, connURL.Scheme)
+	}
+	return driver.Open(connURL)
+}
+
+type levelDBDriver struct{}
+
+// Open supports both absolute "leveldb:///path" and relative "leveldb://path" URLs
+func (d *levelDBDriver) Open(connURL *url.URL) (KVStore, error) {
+	return NewLDBKeyValueStore(connURL.Host + connURL.Path)
+}
+
+type memoryDriver struct{}
+
+func (d *memoryDriver) Open(connURL *url.URL) (KVStore, error) {
+	return NewMemoryKeyValueStore(), nil
+}
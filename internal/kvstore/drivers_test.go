@@ -0,0 +1,159 @@
+// Copyright 2021 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kvstore
+
+import (
+	"fmt"
+	"net/url"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type testDriver struct {
+	openedURL *url.URL
+}
+
+func (d *testDriver) Open(connURL *url.URL) (KVStore, error) {
+	d.openedURL = connURL
+	return NewMockKV(nil), nil
+}
+
+func TestNewKeyValueStorePlainPath(t *testing.T) {
+	assert := assert.New(t)
+	dir := tempdir(t)
+	defer cleanup(t, dir)
+	kv, err := NewKeyValueStore(path.Join(dir, "db"))
+	assert.NoError(err)
+	assert.IsType(&levelDBKeyValueStore{}, kv)
+	kv.Close()
+}
+
+func TestNewKeyValueStoreLevelDBURL(t *testing.T) {
+	assert := assert.New(t)
+	dir := tempdir(t)
+	defer cleanup(t, dir)
+	kv, err := NewKeyValueStore("leveldb://" + path.Join(dir, "db"))
+	assert.NoError(err)
+	assert.Equal(path.Join(dir, "db"), kv.(*levelDBKeyValueStore).path)
+	kv.Close()
+}
+
+func TestNewKeyValueStoreUnknownScheme(t *testing.T) {
+	assert := assert.New(t)
+	_, err := NewKeyValueStore("unknown://somewhere")
+	assert.EqualError(err, "No KV store driver registered for scheme 'unknown'")
+}
+
+func TestNewKeyValueStoreBadURL(t *testing.T) {
+	assert := assert.New(t)
+	_, err := NewKeyValueStore("redis://bad host:1234")
+	assert.Regexp("Invalid KV store connection string", err)
+}
+
+func TestNewKeyValueStoreRegisteredDriver(t *testing.T) {
+	assert := assert.New(t)
+	driver := &testDriver{}
+	RegisterDriver("Test", driver)
+	defer func() {
+		driverRegistry.Lock()
+		delete(driverRegistry.drivers, "test")
+		driverRegistry.Unlock()
+	}()
+	kv, err := NewKeyValueStore("test://host:6379/0")
+	assert.NoError(err)
+	assert.IsType(&MockKV{}, kv)
+	assert.Equal("host:6379", driver.openedURL.Host)
+	assert.Equal("/0", driver.openedURL.Path)
+}
+
+func TestMemoryStorePutGetDelete(t *testing.T) {
+	assert := assert.New(t)
+	kv, err := NewKeyValueStore("memory://")
+	assert.NoError(err)
+	defer kv.Close()
+	_, err = kv.Get("things")
+	assert.Equal(ErrorNotFound, err)
+	err = kv.Put("things", []byte("stuff"))
+	assert.NoError(err)
+	err = kv.Put("things", []byte("more stuff"))
+	assert.NoError(err)
+	things, err := kv.Get("things")
+	assert.NoError(err)
+	assert.Equal("more stuff", string(things))
+	err = kv.Delete("things")
+	assert.NoError(err)
+	err = kv.Delete("things")
+	assert.NoError(err)
+	_, err = kv.Get("things")
+	assert.Equal(ErrorNotFound, err)
+	assert.Empty(kv.(*memoryKeyValueStore).keys)
+}
+
+func TestMemoryStoreIterate(t *testing.T) {
+	assert := assert.New(t)
+	kv := NewMemoryKeyValueStore()
+	for i := 99; i >= 0; i-- {
+		kv.Put(fmt.Sprintf("key_%.3d", i), []byte(fmt.Sprintf("val_%.3d", i)))
+	}
+	it := kv.NewIterator()
+	j := 0
+	for it.Next() {
+		assert.Equal(fmt.Sprintf("key_%.3d", j), it.Key())
+		assert.Equal([]byte(fmt.Sprintf("val_%.3d", j)), it.Value())
+		j++
+	}
+	assert.Equal(100, j)
+	assert.False(it.Next())
+	assert.Equal("", it.Key())
+	assert.Nil(it.Value())
+	assert.True(it.Prev())
+	assert.Equal("key_099", it.Key())
+	assert.True(it.Seek("key_050"))
+	assert.Equal("key_050", it.Key())
+	assert.True(it.Prev())
+	assert.Equal("key_049", it.Key())
+	it.Release()
+	assert.False(it.Next())
+}
+
+func TestMemoryStoreIterateRange(t *testing.T) {
+	assert := assert.New(t)
+	kv := NewMemoryKeyValueStore()
+	for i := 0; i < 10; i++ {
+		kv.Put(fmt.Sprintf("key_%.3d", i), []byte{})
+	}
+	it := kv.NewIteratorWithRange(&KVRange{Start: "key_003", Limit: "key_006"})
+	assert.True(it.Last())
+	assert.Equal("key_005", it.Key())
+	assert.True(it.Prev())
+	assert.True(it.Prev())
+	assert.Equal("key_003", it.Key())
+	assert.False(it.Prev())
+	assert.False(it.Prev())
+	assert.True(it.Last())
+	assert.Equal("key_005", it.Key())
+	assert.False(it.Seek("key_009"))
+	it.Release()
+
+	it = kv.NewIteratorWithRange(&KVRange{Start: "key_100"})
+	assert.False(it.Next())
+	assert.False(it.Last())
+}
+
+func TestMemoryStoreIteratorSemantics(t *testing.T) {
+	testIteratorSemantics(t, NewMemoryKeyValueStore())
+}
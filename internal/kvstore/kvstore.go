@@ -16,6 +16,7 @@ package kvstore
 
 import (
 	"github.com/kaleido-io/ethconnect/internal/errors"
+	"github.com/kaleido-io/ethconnect/pkg/plugins"
 	log "github.com/sirupsen/logrus"
 	"github.com/syndtr/goleveldb/leveldb"
 	"github.com/syndtr/goleveldb/leveldb/iterator"
@@ -23,32 +24,22 @@ import (
 )
 
 // ErrorNotFound signal error for not found
-var ErrorNotFound = leveldb.ErrNotFound
+var ErrorNotFound = plugins.ErrKVNotFound
 
 // KVIterator interface for key value iterators
-type KVIterator interface {
-	Key() string
-	Value() []byte
-	Next() bool
-	Prev() bool
-	Seek(string) bool
-	Last() bool
-	Release()
-}
+type KVIterator = plugins.KVIterator
+
+// KVRange a range of keys to iterate over
+type KVRange = plugins.KVRange
 
 // KVStore interface for key value stores
-type KVStore interface {
-	Put(key string, val []byte) error
-	Get(key string) ([]byte, error)
-	Delete(key string) error
-	NewIterator() KVIterator
-	NewIteratorWithRange(keyRange interface{}) KVIterator
-	Close()
-}
+type KVStore = plugins.KVStore
 
 type levelDBKeyValueStore struct {
-	path string
-	db   *leveldb.DB
+	name     string
+	path     string
+	db       *leveldb.DB
+	prefixes map[string]string
 }
 
 func (k *levelDBKeyValueStore) warnIfErr(op, key string, err error) {
@@ -66,6 +57,9 @@ func (k *levelDBKeyValueStore) Put(key string, val []byte) error {
 func (k *levelDBKeyValueStore) Get(key string) ([]byte, error) {
 	b, err := k.db.Get([]byte(key), nil)
 	k.warnIfErr("Get", key, err)
+	if err == leveldb.ErrNotFound {
+		err = ErrorNotFound
+	}
 	return b, err
 }
 
@@ -81,11 +75,16 @@ func (k *levelDBKeyValueStore) NewIterator() KVIterator {
 	}
 }
 
-func (k *levelDBKeyValueStore) NewIteratorWithRange(rng interface{}) KVIterator {
-	keyRange := rng.(*util.Range)
-
+func (k *levelDBKeyValueStore) NewIteratorWithRange(keyRange *KVRange) KVIterator {
+	ldbRange := &util.Range{}
+	if keyRange.Start != "" {
+		ldbRange.Start = []byte(keyRange.Start)
+	}
+	if keyRange.Limit != "" {
+		ldbRange.Limit = []byte(keyRange.Limit)
+	}
 	return &levelDBKeyIterator{
-		i: k.db.NewIterator(keyRange, nil),
+		i: k.db.NewIterator(ldbRange, nil),
 	}
 }
 
@@ -118,10 +117,11 @@ func (k *levelDBKeyIterator) Prev() bool {
 }
 
 func (k *levelDBKeyIterator) Release() {
-	k.i.Next()
+	k.i.Release()
 }
 
 func (k *levelDBKeyValueStore) Close() {
+	unregisterLevelDB(k)
 	k.db.Close()
 }
 
@@ -133,6 +133,7 @@ func NewLDBKeyValueStore(ldbPath string) (kv KVStore, err error) {
 	if store.db, err = leveldb.OpenFile(ldbPath, nil); err != nil {
 		return nil, errors.Errorf(errors.KVStoreDBLoad, ldbPath, err)
 	}
+	registerLevelDB(store)
 	kv = store
 	return
 }
@@ -72,6 +72,81 @@ func TestLevelDBIterate(t *testing.T) {
 	kv.Close()
 }
 
+// testIteratorSemantics checks the positioning of iterators at the boundaries, which
+// every KV store must implement the same as goleveldb
+func testIteratorSemantics(t *testing.T, kv KVStore) {
+	assert := assert.New(t)
+	defer kv.Close()
+	for i := 0; i < 10; i++ {
+		kv.Put(fmt.Sprintf("key_%.3d", i), []byte(fmt.Sprintf("val_%.3d", i)))
+	}
+
+	// A new iterator is before the first key
+	it := kv.NewIteratorWithRange(&KVRange{Start: "key_003", Limit: "key_006"})
+	assert.False(it.Prev())
+	assert.Equal("", it.Key())
+	assert.Nil(it.Value())
+	assert.True(it.Next())
+	assert.Equal("key_003", it.Key())
+	assert.Equal([]byte("val_003"), it.Value())
+	assert.False(it.Prev())
+	assert.Equal("", it.Key())
+	assert.True(it.Next())
+	assert.Equal("key_003", it.Key())
+
+	// Past the end, Next fails and Prev moves to the last key
+	assert.True(it.Last())
+	assert.Equal("key_005", it.Key())
+	assert.False(it.Next())
+	assert.Equal("", it.Key())
+	assert.False(it.Next())
+	assert.True(it.Prev())
+	assert.Equal("key_005", it.Key())
+
+	// Seek moves to the first key at or after the key, within the range
+	assert.True(it.Seek("key_004"))
+	assert.Equal("key_004", it.Key())
+	assert.True(it.Seek("key_0035"))
+	assert.Equal("key_004", it.Key())
+	assert.True(it.Seek("key_000"))
+	assert.Equal("key_003", it.Key())
+	assert.False(it.Seek("key_009"))
+	assert.Equal("", it.Key())
+	assert.True(it.Prev())
+	assert.Equal("key_005", it.Key())
+	it.Release()
+	assert.False(it.Next())
+	assert.False(it.Prev())
+
+	// Exhausting the keys backwards puts the iterator before the first key
+	it = kv.NewIterator()
+	assert.True(it.Seek("key_001"))
+	assert.True(it.Prev())
+	assert.Equal("key_000", it.Key())
+	assert.False(it.Prev())
+	assert.False(it.Prev())
+	assert.True(it.Next())
+	assert.Equal("key_000", it.Key())
+	it.Release()
+
+	// An empty range has no keys in either direction
+	it = kv.NewIteratorWithRange(&KVRange{Start: "key_100"})
+	assert.False(it.Prev())
+	assert.False(it.Next())
+	assert.False(it.Last())
+	assert.False(it.Prev())
+	assert.False(it.Seek("key_000"))
+	it.Release()
+}
+
+func TestLevelDBIteratorSemantics(t *testing.T) {
+	dir := tempdir(t)
+	defer cleanup(t, dir)
+	kv, err := NewLDBKeyValueStore(path.Join(dir, "db"))
+	assert.NoError(t, err)
+	testIteratorSemantics(t, kv)
+}
+
 func TestLevelDBBadPath(t *testing.T) {
 	assert := assert.New(t)
 	dir := tempdir(t)
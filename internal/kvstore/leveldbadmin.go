@@ -0,0 +1,219 @@
+// Copyright 2021 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kvstore
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/kaleido-io/ethconnect/internal/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+const (
+	backupBatchSize = 1000
+	// OtherKeysPrefixName is the name under which keys that do not match a named prefix are counted
+	OtherKeysPrefixName = "other"
+)
+
+// LevelDBStats reports the size and key counts of a LevelDB store
+type LevelDBStats struct {
+	Name      string           `json:"name"`
+	Path      string           `json:"path"`
+	SizeBytes int64            `json:"sizeBytes"`
+	Keys      int64            `json:"keys"`
+	Prefixes  map[string]int64 `json:"prefixes"`
+}
+
+// LevelDBAdmin provides maintenance operations on an open LevelDB store
+type LevelDBAdmin interface {
+	Name() string
+	Stats() (*LevelDBStats, error)
+	Compact() error
+	Backup(targetPath string) (*LevelDBStats, error)
+}
+
+var ldbRegistry = struct {
+	sync.Mutex
+	stores map[string]*levelDBKeyValueStore
+}{
+	stores: make(map[string]*levelDBKeyValueStore),
+}
+
+// registerLevelDB makes the store available for admin operations, by the base name of its
+// path where that is unique in this process, or otherwise by its full path
+func registerLevelDB(k *levelDBKeyValueStore) {
+	ldbRegistry.Lock()
+	defer ldbRegistry.Unlock()
+	k.name = filepath.Base(filepath.Clean(k.path))
+	if _, exists := ldbRegistry.stores[k.name]; exists {
+		k.name = k.path
+	}
+	ldbRegistry.stores[k.name] = k
+}
+
+func unregisterLevelDB(k *levelDBKeyValueStore) {
+	ldbRegistry.Lock()
+	defer ldbRegistry.Unlock()
+	if ldbRegistry.stores[k.name] == k {
+		delete(ldbRegistry.stores, k.name)
+	}
+}
+
+// LevelDBStores returns all open LevelDB stores, sorted by name
+func LevelDBStores() []LevelDBAdmin {
+	ldbRegistry.Lock()
+	defer ldbRegistry.Unlock()
+	names := make([]string, 0, len(ldbRegistry.stores))
+	for name := range ldbRegistry.stores {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	stores := make([]LevelDBAdmin, len(names))
+	for i, name := range names {
+		stores[i] = ldbRegistry.stores[name]
+	}
+	return stores
+}
+
+// GetLevelDBStore returns an open LevelDB store by name
+func GetLevelDBStore(name string) (LevelDBAdmin, error) {
+	ldbRegistry.Lock()
+	defer ldbRegistry.Unlock()
+	if store, exists := ldbRegistry.stores[name]; exists {
+		return store, nil
+	}
+	return nil, errors.Errorf(errors.LevelDBAdminUnknownStore, name)
+}
+
+// SetKeyPrefixes names the key prefixes used by the owner of a store, so that key
+// counts are reported per prefix. It has no effect on stores other than LevelDB
+func SetKeyPrefixes(kv KVStore, prefixes map[string]string) {
+	if k, ok := kv.(*levelDBKeyValueStore); ok {
+		k.prefixes = prefixes
+	}
+}
+
+func (k *levelDBKeyValueStore) Name() string {
+	return k.name
+}
+
+func (k *levelDBKeyValueStore) Stats() (*LevelDBStats, error) {
+	snapshot, err := k.db.GetSnapshot()
+	if err != nil {
+		return nil, err
+	}
+	defer snapshot.Release()
+	stats := k.newStats()
+	it := snapshot.NewIterator(nil, nil)
+	for it.Next() {
+		stats.countKey(string(it.Key()), k.prefixes)
+	}
+	it.Release()
+	if err := it.Error(); err != nil {
+		return nil, err
+	}
+	stats.SizeBytes, err = dirSize(k.path)
+	return stats, err
+}
+
+func (k *levelDBKeyValueStore) Compact() error {
+	log.Infof("LDB %s compacting", k.path)
+	if err := k.db.CompactRange(util.Range{}); err != nil {
+		return errors.Errorf(errors.LevelDBAdminCompactFailed, k.name, err)
+	}
+	return nil
+}
+
+// Backup copies a consistent snapshot of the store into a new LevelDB at the target path
+func (k *levelDBKeyValueStore) Backup(targetPath string) (*LevelDBStats, error) {
+	if _, err := os.Stat(targetPath); !os.IsNotExist(err) {
+		return nil, errors.Errorf(errors.LevelDBAdminBackupExists, targetPath)
+	}
+	snapshot, err := k.db.GetSnapshot()
+	if err != nil {
+		return nil, errors.Errorf(errors.LevelDBAdminBackupFailed, k.name, err)
+	}
+	defer snapshot.Release()
+	target, err := leveldb.OpenFile(targetPath, nil)
+	if err != nil {
+		return nil, errors.Errorf(errors.LevelDBAdminBackupFailed, k.name, err)
+	}
+	defer target.Close()
+
+	log.Infof("LDB %s backing up to %s", k.path, targetPath)
+	stats := k.newStats()
+	stats.Path = targetPath
+	batch := new(leveldb.Batch)
+	it := snapshot.NewIterator(nil, nil)
+	defer it.Release()
+	for it.Next() {
+		stats.countKey(string(it.Key()), k.prefixes)
+		batch.Put(it.Key(), it.Value())
+		if batch.Len() >= backupBatchSize {
+			if err = target.Write(batch, nil); err != nil {
+				return nil, errors.Errorf(errors.LevelDBAdminBackupFailed, k.name, err)
+			}
+			batch.Reset()
+		}
+	}
+	if err = it.Error(); err == nil {
+		err = target.Write(batch, nil)
+	}
+	if err != nil {
+		return nil, errors.Errorf(errors.LevelDBAdminBackupFailed, k.name, err)
+	}
+	stats.SizeBytes, _ = dirSize(targetPath)
+	log.Infof("LDB %s backed up %d keys to %s", k.path, stats.Keys, targetPath)
+	return stats, nil
+}
+
+func (k *levelDBKeyValueStore) newStats() *LevelDBStats {
+	stats := &LevelDBStats{
+		Name:     k.name,
+		Path:     k.path,
+		Prefixes: make(map[string]int64),
+	}
+	for name := range k.prefixes {
+		stats.Prefixes[name] = 0
+	}
+	return stats
+}
+
+func (s *LevelDBStats) countKey(key string, prefixes map[string]string) {
+	s.Keys++
+	for name, prefix := range prefixes {
+		if strings.HasPrefix(key, prefix) {
+			s.Prefixes[name]++
+			return
+		}
+	}
+	s.Prefixes[OtherKeysPrefixName]++
+}
+
+func dirSize(dir string) (size int64, err error) {
+	err = filepath.Walk(dir, func(_ string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			size += info.Size()
+		}
+		return err
+	})
+	return size, err
+}
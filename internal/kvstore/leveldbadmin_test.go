@@ -0,0 +1,97 @@
+// Copyright 2021 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kvstore
+
+import (
+	"fmt"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLevelDBAdminStatsCompactBackup(t *testing.T) {
+	assert := assert.New(t)
+	dir := tempdir(t)
+	defer cleanup(t, dir)
+	kv, err := NewLDBKeyValueStore(path.Join(dir, "admintest"))
+	assert.NoError(err)
+	defer kv.Close()
+	SetKeyPrefixes(kv, map[string]string{
+		"streams":     "es-",
+		"checkpoints": "cp-",
+	})
+	for i := 0; i < 1500; i++ {
+		kv.Put(fmt.Sprintf("es-%04d", i), []byte("stream"))
+	}
+	kv.Put("cp-1", []byte("checkpoint"))
+	kv.Put("unknown", []byte("other"))
+
+	store, err := GetLevelDBStore("admintest")
+	assert.NoError(err)
+	assert.Equal("admintest", store.Name())
+	assert.Contains(LevelDBStores(), store)
+
+	stats, err := store.Stats()
+	assert.NoError(err)
+	assert.Equal(int64(1502), stats.Keys)
+	assert.Equal(int64(1500), stats.Prefixes["streams"])
+	assert.Equal(int64(1), stats.Prefixes["checkpoints"])
+	assert.Equal(int64(1), stats.Prefixes[OtherKeysPrefixName])
+	assert.True(stats.SizeBytes > 0)
+
+	err = store.Compact()
+	assert.NoError(err)
+
+	backupPath := path.Join(dir, "backup")
+	backupStats, err := store.Backup(backupPath)
+	assert.NoError(err)
+	assert.Equal(int64(1502), backupStats.Keys)
+	assert.Equal(backupPath, backupStats.Path)
+
+	_, err = store.Backup(backupPath)
+	assert.Regexp("already exists", err)
+
+	backup, err := NewLDBKeyValueStore(backupPath)
+	assert.NoError(err)
+	val, err := backup.Get("es-1499")
+	assert.NoError(err)
+	assert.Equal("stream", string(val))
+	backup.Close()
+}
+
+func TestLevelDBAdminRegistry(t *testing.T) {
+	assert := assert.New(t)
+	dir := tempdir(t)
+	defer cleanup(t, dir)
+	kv1, err := NewLDBKeyValueStore(path.Join(dir, "a", "regtest"))
+	assert.NoError(err)
+	kv2, err := NewLDBKeyValueStore(path.Join(dir, "b", "regtest"))
+	assert.NoError(err)
+
+	_, err = GetLevelDBStore("regtest")
+	assert.NoError(err)
+	_, err = GetLevelDBStore(path.Join(dir, "b", "regtest"))
+	assert.NoError(err)
+
+	kv1.Close()
+	kv2.Close()
+	_, err = GetLevelDBStore("regtest")
+	assert.EqualError(err, "Unknown LevelDB store 'regtest'")
+}
+
+func TestSetKeyPrefixesMemStore(t *testing.T) {
+	SetKeyPrefixes(NewMockKV(nil), map[string]string{"a": "a"})
+}
@@ -14,10 +14,6 @@
 
 package kvstore
 
-import (
-	"github.com/syndtr/goleveldb/leveldb"
-)
-
 // MockKV simple memory K/V store for testing
 type MockKV struct {
 	KVS       map[string][]byte
@@ -36,7 +32,7 @@ func (m *MockKV) Put(key string, val []byte) error {
 func (m *MockKV) Get(key string) ([]byte, error) {
 	v, exists := m.KVS[key]
 	if m.LoadErr == nil && !exists {
-		return nil, leveldb.ErrNotFound
+		return nil, ErrorNotFound
 	}
 	return v, m.LoadErr
 }
@@ -53,7 +49,7 @@ func (m *MockKV) NewIterator() KVIterator {
 }
 
 // NewIterator for a new iterator
-func (m *MockKV) NewIteratorWithRange(rng interface{}) KVIterator {
+func (m *MockKV) NewIteratorWithRange(keyRange *KVRange) KVIterator {
 	return nil // not implemented in mock
 }
 
@@ -0,0 +1,156 @@
+// Copyright 2021 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kvstore
+
+import (
+	"sort"
+	"sync"
+)
+
+// memoryKeyValueStore is a non-persistent KV store, for development and
+// ephemeral deployments. Iterators operate on a point-in-time copy of the keys
+type memoryKeyValueStore struct {
+	mux  sync.Mutex
+	kvs  map[string][]byte
+	keys []string
+}
+
+// NewMemoryKeyValueStore constructs an empty in-memory KV store
+func NewMemoryKeyValueStore() KVStore {
+	return &memoryKeyValueStore{
+		kvs: make(map[string][]byte),
+	}
+}
+
+func (m *memoryKeyValueStore) Put(key string, val []byte) error {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	if _, exists := m.kvs[key]; !exists {
+		i := sort.SearchStrings(m.keys, key)
+		m.keys = append(m.keys, "")
+		copy(m.keys[i+1:], m.keys[i:])
+		m.keys[i] = key
+	}
+	m.kvs[key] = append([]byte{}, val...)
+	return nil
+}
+
+func (m *memoryKeyValueStore) Get(key string) ([]byte, error) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	val, exists := m.kvs[key]
+	if !exists {
+		return nil, ErrorNotFound
+	}
+	return val, nil
+}
+
+func (m *memoryKeyValueStore) Delete(key string) error {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	if _, exists := m.kvs[key]; exists {
+		i := sort.SearchStrings(m.keys, key)
+		m.keys = append(m.keys[:i], m.keys[i+1:]...)
+		delete(m.kvs, key)
+	}
+	return nil
+}
+
+func (m *memoryKeyValueStore) NewIterator() KVIterator {
+	return m.NewIteratorWithRange(&KVRange{})
+}
+
+func (m *memoryKeyValueStore) NewIteratorWithRange(keyRange *KVRange) KVIterator {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	start := 0
+	if keyRange.Start != "" {
+		start = sort.SearchStrings(m.keys, keyRange.Start)
+	}
+	end := len(m.keys)
+	if keyRange.Limit != "" {
+		end = sort.SearchStrings(m.keys, keyRange.Limit)
+	}
+	it := &memoryKeyIterator{pos: -1}
+	if start < end {
+		it.keys = make([]string, end-start)
+		copy(it.keys, m.keys[start:end])
+		it.vals = make([][]byte, len(it.keys))
+		for i, k := range it.keys {
+			it.vals[i] = m.kvs[k]
+		}
+	}
+	return it
+}
+
+func (m *memoryKeyValueStore) Close() {}
+
+// memoryKeyIterator follows the goleveldb iterator semantics. A position of -1 is before
+// the first key, where Prev fails and Next moves to the first key, and a position past
+// the last key is after the end, where Next fails and Prev moves to the last key.
+// A new iterator is before the first key
+type memoryKeyIterator struct {
+	keys []string
+	vals [][]byte
+	pos  int
+}
+
+func (i *memoryKeyIterator) valid() bool {
+	return i.pos >= 0 && i.pos < len(i.keys)
+}
+
+func (i *memoryKeyIterator) Key() string {
+	if !i.valid() {
+		return ""
+	}
+	return i.keys[i.pos]
+}
+
+func (i *memoryKeyIterator) Value() []byte {
+	if !i.valid() {
+		return nil
+	}
+	return i.vals[i.pos]
+}
+
+func (i *memoryKeyIterator) Next() bool {
+	if i.pos < len(i.keys) {
+		i.pos++
+	}
+	return i.valid()
+}
+
+func (i *memoryKeyIterator) Prev() bool {
+	if i.pos >= 0 {
+		i.pos--
+	}
+	return i.valid()
+}
+
+func (i *memoryKeyIterator) Seek(key string) bool {
+	i.pos = sort.SearchStrings(i.keys, key)
+	return i.valid()
+}
+
+func (i *memoryKeyIterator) Last() bool {
+	i.pos = len(i.keys) - 1
+	return i.valid()
+}
+
+func (i *memoryKeyIterator) Release() {
+	i.keys = nil
+	i.vals = nil
+	i.pos = -1
+}
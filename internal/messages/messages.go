@@ -34,21 +34,29 @@ const (
 	MsgTypeTransactionFailure = "TransactionFailure"
 	// RecordHeaderAccessToken - record header name for passing JWT token over messaging
 	RecordHeaderAccessToken = "fly-accesstoken"
+	// RecordHeaderTraceParent - record header name for passing the W3C trace context over messaging
+	RecordHeaderTraceParent = "traceparent"
 )
 
 // AsyncSentMsg is a standard response for async requests
 type AsyncSentMsg struct {
-	Sent    bool   `json:"sent"`
-	Request string `json:"id"`
-	Msg     string `json:"msg,omitempty"`
+	Sent            bool   `json:"sent"`
+	Request         string `json:"id"`
+	Msg             string `json:"msg,omitempty"`
+	ContractAddress string `json:"contractAddress,omitempty"` // The address of a CREATE2 deployment
 }
 
-// CommonHeaders are common to all messages
+// CommonHeaders are common to all messages.
+// Confirmations is the number of blocks, including the block containing the transaction,
+// that must be mined before the receipt is reported
 type CommonHeaders struct {
-	ID      string                 `json:"id,omitempty"`
-	MsgType string                 `json:"type"`
-	Account string                 `json:"account,omitempty"`
-	Context map[string]interface{} `json:"ctx,omitempty"`
+	ID            string                 `json:"id,omitempty"`
+	MsgType       string                 `json:"type"`
+	Account       string                 `json:"account,omitempty"`
+	Priority      string                 `json:"priority,omitempty"`
+	Sponsor       string                 `json:"sponsor,omitempty"`
+	Confirmations int64                  `json:"confirmations,omitempty"`
+	Context       map[string]interface{} `json:"ctx,omitempty"`
 }
 
 // RequestCommon is a common interface to all requests
@@ -102,37 +110,83 @@ func (r *TransactionReceipt) IsReceipt() *TransactionReceipt {
 // TODO - do Orion/Tessera support "unrestricted" private transactions?
 type TransactionCommon struct {
 	RequestCommon
-	Nonce          json.Number   `json:"nonce,omitempty"`
-	From           string        `json:"from"`
-	Value          json.Number   `json:"value"`
-	Gas            json.Number   `json:"gas"`
-	GasPrice       json.Number   `json:"gasPrice"`
-	Parameters     []interface{} `json:"params"`
-	PrivateFrom    string        `json:"privateFrom,omitempty"`
-	PrivateFor     []string      `json:"privateFor,omitempty"`
-	PrivacyGroupID string        `json:"privacyGroupId,omitempty"`
-}
-
-// SendTransaction message instructs the bridge to install a contract
+	Nonce                json.Number   `json:"nonce,omitempty"`
+	From                 string        `json:"from"`
+	Value                json.Number   `json:"value"`
+	Gas                  json.Number   `json:"gas"`
+	GasPrice             json.Number   `json:"gasPrice"`
+	MaxFeePerGas         json.Number   `json:"maxFeePerGas,omitempty"`
+	MaxPriorityFeePerGas json.Number   `json:"maxPriorityFeePerGas,omitempty"`
+	GasPriceStrategy     string        `json:"gasPriceStrategy,omitempty"`
+	Parameters           []interface{} `json:"params"`
+	PrivateFrom          string        `json:"privateFrom,omitempty"`
+	PrivateFor           []string      `json:"privateFor,omitempty"`
+	PrivacyGroupID       string        `json:"privacyGroupId,omitempty"`
+}
+
+// SendTransaction message instructs the bridge to install a contract.
+// Events optionally supplies the event definitions of the contract ABI, to decode the receipt logs,
+// and Errors the custom error definitions, to decode the reason if the transaction reverts.
+// Data can be supplied instead of Method/MethodName, as pre-encoded hex call data
 type SendTransaction struct {
 	TransactionCommon
 	To         string                           `json:"to"`
 	Method     *ethbinding.ABIElementMarshaling `json:"method,omitempty"`
 	MethodName string                           `json:"methodName,omitempty"`
+	Data       string                           `json:"data,omitempty"`
+	Events     ethbinding.ABIMarshaling         `json:"events,omitempty"`
+	Errors     ethbinding.ABIMarshaling         `json:"errors,omitempty"`
+}
+
+// CompilerOptions are the solc settings that affect the generated bytecode, so must
+// match those of an external build for the bytecode to be identical
+type CompilerOptions struct {
+	EVMVersion       string `json:"evmVersion,omitempty"`
+	OptimizerEnabled *bool  `json:"optimizerEnabled,omitempty"`
+	OptimizerRuns    int    `json:"optimizerRuns,omitempty"`
+	ViaIR            bool   `json:"viaIR,omitempty"`
+}
+
+// MethodAccess restricts the methods of a contract that are exposed through the generated REST API.
+// Hidden methods are omitted from the OpenAPI and cannot be invoked, and read-only methods can only be queried
+type MethodAccess struct {
+	HiddenMethods   []string `json:"hiddenMethods,omitempty"`
+	ReadOnlyMethods []string `json:"readOnlyMethods,omitempty"`
+}
+
+// StaticAnalysisFinding is an issue reported by the static analyzer. The severity is one of
+// high, medium, low or informational
+type StaticAnalysisFinding struct {
+	Check       string `json:"check"`
+	Severity    string `json:"severity"`
+	Confidence  string `json:"confidence,omitempty"`
+	Description string `json:"description,omitempty"`
+}
+
+// StaticAnalysis is the report of the static analyzer run on the Solidity source of a contract
+type StaticAnalysis struct {
+	Analyzer        string                   `json:"analyzer"`
+	AnalyzedISO8601 string                   `json:"analyzed"`
+	Findings        []*StaticAnalysisFinding `json:"findings"`
 }
 
 // DeployContract message instructs the bridge to install a contract
 type DeployContract struct {
 	TransactionCommon
-	Solidity        string                   `json:"solidity,omitempty"`
-	CompilerVersion string                   `json:"compilerVersion,omitempty"`
-	EVMVersion      string                   `json:"evmVersion,omitempty"`
-	ABI             ethbinding.ABIMarshaling `json:"abi,omitempty"`
-	DevDoc          string                   `json:"devDocs,omitempty"`
-	Compiled        []byte                   `json:"compiled,omitempty"`
-	ContractName    string                   `json:"contractName,omitempty"`
-	Description     string                   `json:"description,omitempty"`
-	RegisterAs      string                   `json:"registerAs,omitempty"`
+	CompilerOptions
+	MethodAccess
+	Solidity            string                   `json:"solidity,omitempty"`
+	CompilerVersion     string                   `json:"compilerVersion,omitempty"`
+	ABI                 ethbinding.ABIMarshaling `json:"abi,omitempty"`
+	DevDoc              string                   `json:"devDocs,omitempty"`
+	Compiled            []byte                   `json:"compiled,omitempty"`
+	ContractName        string                   `json:"contractName,omitempty"`
+	Description         string                   `json:"description,omitempty"`
+	RegisterAs          string                   `json:"registerAs,omitempty"`
+	RegisterEnvironment string                   `json:"registerEnvironment,omitempty"`
+	StaticAnalysis      *StaticAnalysis          `json:"staticAnalysis,omitempty"`
+	Salt                string                   `json:"salt,omitempty"`    // Deploys with CREATE2, to an address known in advance
+	Factory             string                   `json:"factory,omitempty"` // The CREATE2 factory, if not the default
 }
 
 // TransactionReceipt is sent when a transaction has been successfully mined
@@ -160,6 +214,37 @@ type TransactionReceipt struct {
 	TransactionIndexStr  string                `json:"transactionIndex"`
 	TransactionIndexHex  *ethbinding.HexUint   `json:"transactionIndexHex,omitempty"`
 	RegisterAs           string                `json:"registerAs,omitempty"`
+	RegisterEnvironment  string                `json:"registerEnvironment,omitempty"`
+	DecodedEvents        []*DecodedEvent       `json:"decodedEvents,omitempty"`
+	RevertReason         string                `json:"revertReason,omitempty"` // Decoded by replaying a transaction that failed
+	// The fees paid in wei, broken down into the base and priority fees on EIP-1559 chains.
+	// The cumulative fee is the total for all the transactions sent with the same request ID
+	EffectiveGasPriceStr string                `json:"effectiveGasPrice,omitempty"`
+	EffectiveGasPriceHex *ethbinding.HexBigInt `json:"effectiveGasPriceHex,omitempty"`
+	FeeStr               string                `json:"fee,omitempty"`
+	FeeHex               *ethbinding.HexBigInt `json:"feeHex,omitempty"`
+	BaseFeePerGasStr     string                `json:"baseFeePerGas,omitempty"`
+	BaseFeePerGasHex     *ethbinding.HexBigInt `json:"baseFeePerGasHex,omitempty"`
+	BaseFeeStr           string                `json:"baseFee,omitempty"`
+	BaseFeeHex           *ethbinding.HexBigInt `json:"baseFeeHex,omitempty"`
+	PriorityFeeStr       string                `json:"priorityFee,omitempty"`
+	PriorityFeeHex       *ethbinding.HexBigInt `json:"priorityFeeHex,omitempty"`
+	CumulativeFeeStr     string                `json:"cumulativeFee,omitempty"`
+	CumulativeFeeHex     *ethbinding.HexBigInt `json:"cumulativeFeeHex,omitempty"`
+	// The hashes of other transactions sent at the same nonce for the request, that were not mined
+	Replaced []string `json:"replaced,omitempty"`
+	// The confirmations the receipt waited for, and the blocks it was removed from by re-orgs while waiting
+	Confirmations string   `json:"confirmations,omitempty"`
+	ReorgedBlocks []string `json:"reorgedBlocks,omitempty"`
+}
+
+// DecodedEvent is a log from a transaction receipt, decoded against the ABI of the event
+type DecodedEvent struct {
+	Address   string                 `json:"address"`
+	Event     string                 `json:"event"`
+	Signature string                 `json:"signature"`
+	LogIndex  string                 `json:"logIndex"`
+	Data      map[string]interface{} `json:"data"`
 }
 
 // ErrorReply is
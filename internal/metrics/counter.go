@@ -0,0 +1,98 @@
+// Copyright 2021 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// CounterVec is a monotonically increasing count partitioned by a set of labels
+type CounterVec struct {
+	name       string
+	help       string
+	labelNames []string
+	mux        sync.Mutex
+	series     map[string]*counterSeries
+}
+
+type counterSeries struct {
+	labelValues []string
+	count       uint64
+}
+
+// NewCounterVec creates a counter, and registers it to be exposed on /metrics
+func NewCounterVec(name, help string, labelNames ...string) *CounterVec {
+	c := &CounterVec{
+		name:       name,
+		help:       help,
+		labelNames: labelNames,
+		series:     make(map[string]*counterSeries),
+	}
+	Register(c)
+	return c
+}
+
+// Name is the name of the metric
+func (c *CounterVec) Name() string {
+	return c.name
+}
+
+// Inc adds one to the series with the supplied label values, in the order of the label names
+func (c *CounterVec) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+// Add adds n to the series with the supplied label values, in the order of the label names
+func (c *CounterVec) Add(n uint64, labelValues ...string) {
+	key := strings.Join(labelValues, "\x00")
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	s, exists := c.series[key]
+	if !exists {
+		s = &counterSeries{labelValues: append([]string{}, labelValues...)}
+		c.series[key] = s
+	}
+	s.count += n
+}
+
+// Value returns the current count of the series with the supplied label values
+func (c *CounterVec) Value(labelValues ...string) uint64 {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	if s, exists := c.series[strings.Join(labelValues, "\x00")]; exists {
+		return s.count
+	}
+	return 0
+}
+
+// Write outputs the counter in the Prometheus text exposition format
+func (c *CounterVec) Write(w io.Writer) {
+	c.mux.Lock()
+	lines := make([]string, 0, len(c.series))
+	for _, s := range c.series {
+		lines = append(lines, fmt.Sprintf("%s%s %d\n", c.name, formatLabels(c.labelNames, s.labelValues), s.count))
+	}
+	c.mux.Unlock()
+	sort.Strings(lines)
+	fmt.Fprintf(w, "# HELP %s %s\n", c.name, c.help)
+	fmt.Fprintf(w, "# TYPE %s counter\n", c.name)
+	for _, line := range lines {
+		io.WriteString(w, line)
+	}
+}
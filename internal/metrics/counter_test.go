@@ -0,0 +1,43 @@
+// Copyright 2021 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metrics
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCounterWrite(t *testing.T) {
+	assert := assert.New(t)
+
+	c := NewCounterVec("test_events_total", "Test events", "result")
+	c.Inc("ok")
+	c.Inc("ok")
+	c.Add(5, "fail\"ed")
+
+	assert.Equal(uint64(2), c.Value("ok"))
+	assert.Equal(uint64(5), c.Value("fail\"ed"))
+	assert.Equal(uint64(0), c.Value("unknown"))
+
+	var buff bytes.Buffer
+	c.Write(&buff)
+	assert.Equal(`# HELP test_events_total Test events
+# TYPE test_events_total counter
+test_events_total{result="fail\"ed"} 5
+test_events_total{result="ok"} 2
+`, buff.String())
+}
@@ -0,0 +1,102 @@
+// Copyright 2021 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// GaugeVec is a value that can go up and down, partitioned by a set of labels
+type GaugeVec struct {
+	name       string
+	help       string
+	labelNames []string
+	mux        sync.Mutex
+	series     map[string]*gaugeSeries
+}
+
+type gaugeSeries struct {
+	labelValues []string
+	value       float64
+}
+
+// NewGaugeVec creates a gauge, and registers it to be exposed on /metrics
+func NewGaugeVec(name, help string, labelNames ...string) *GaugeVec {
+	g := &GaugeVec{
+		name:       name,
+		help:       help,
+		labelNames: labelNames,
+		series:     make(map[string]*gaugeSeries),
+	}
+	Register(g)
+	return g
+}
+
+// Name is the name of the metric
+func (g *GaugeVec) Name() string {
+	return g.name
+}
+
+// Set sets the series with the supplied label values, in the order of the label names
+func (g *GaugeVec) Set(v float64, labelValues ...string) {
+	key := strings.Join(labelValues, "\x00")
+	g.mux.Lock()
+	defer g.mux.Unlock()
+	s, exists := g.series[key]
+	if !exists {
+		s = &gaugeSeries{labelValues: append([]string{}, labelValues...)}
+		g.series[key] = s
+	}
+	s.value = v
+}
+
+// Value returns the current value of the series with the supplied label values
+func (g *GaugeVec) Value(labelValues ...string) float64 {
+	g.mux.Lock()
+	defer g.mux.Unlock()
+	if s, exists := g.series[strings.Join(labelValues, "\x00")]; exists {
+		return s.value
+	}
+	return 0
+}
+
+// Reset removes all the series, for gauges that are rebuilt from scratch each time
+// they are refreshed, so series for things that no longer exist are not left behind
+func (g *GaugeVec) Reset() {
+	g.mux.Lock()
+	defer g.mux.Unlock()
+	g.series = make(map[string]*gaugeSeries)
+}
+
+// Write outputs the gauge in the Prometheus text exposition format
+func (g *GaugeVec) Write(w io.Writer) {
+	g.mux.Lock()
+	lines := make([]string, 0, len(g.series))
+	for _, s := range g.series {
+		lines = append(lines, fmt.Sprintf("%s%s %s\n", g.name, formatLabels(g.labelNames, s.labelValues), strconv.FormatFloat(s.value, 'g', -1, 64)))
+	}
+	g.mux.Unlock()
+	sort.Strings(lines)
+	fmt.Fprintf(w, "# HELP %s %s\n", g.name, g.help)
+	fmt.Fprintf(w, "# TYPE %s gauge\n", g.name)
+	for _, line := range lines {
+		io.WriteString(w, line)
+	}
+}
@@ -0,0 +1,51 @@
+// Copyright 2021 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metrics
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGaugeWrite(t *testing.T) {
+	assert := assert.New(t)
+
+	g := NewGaugeVec("test_queue_depth", "Test queue depth", "queue")
+	g.Set(10, "a")
+	g.Set(2.5, "b")
+	g.Set(3, "a")
+
+	assert.Equal(float64(3), g.Value("a"))
+	assert.Equal(2.5, g.Value("b"))
+	assert.Equal(float64(0), g.Value("unknown"))
+
+	var buff bytes.Buffer
+	g.Write(&buff)
+	assert.Equal(`# HELP test_queue_depth Test queue depth
+# TYPE test_queue_depth gauge
+test_queue_depth{queue="a"} 3
+test_queue_depth{queue="b"} 2.5
+`, buff.String())
+
+	g.Reset()
+	assert.Equal(float64(0), g.Value("a"))
+	buff.Reset()
+	g.Write(&buff)
+	assert.Equal(`# HELP test_queue_depth Test queue depth
+# TYPE test_queue_depth gauge
+`, buff.String())
+}
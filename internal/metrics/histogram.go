@@ -0,0 +1,192 @@
+// Copyright 2021 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// HistogramVec is a histogram partitioned by a set of labels, with a fixed set of bucket upper bounds
+type HistogramVec struct {
+	name       string
+	help       string
+	buckets    []float64
+	labelNames []string
+	mux        sync.Mutex
+	series     map[string]*HistogramSnapshot
+}
+
+// HistogramSnapshot is a point in time copy of one series of a histogram.
+// Counts are per bucket (not cumulative), with a final entry for values above the highest bucket
+type HistogramSnapshot struct {
+	Labels  map[string]string
+	Buckets []float64
+	Counts  []uint64
+	Count   uint64
+	Sum     float64
+}
+
+// NewHistogramVec creates a histogram, and registers it to be exposed on /metrics
+func NewHistogramVec(name, help string, buckets []float64, labelNames ...string) *HistogramVec {
+	h := &HistogramVec{
+		name:       name,
+		help:       help,
+		buckets:    append([]float64{}, buckets...),
+		labelNames: labelNames,
+		series:     make(map[string]*HistogramSnapshot),
+	}
+	sort.Float64s(h.buckets)
+	Register(h)
+	return h
+}
+
+// Name is the name of the metric
+func (h *HistogramVec) Name() string {
+	return h.name
+}
+
+// Observe adds a value to the series with the supplied label values, in the order of the label names
+func (h *HistogramVec) Observe(v float64, labelValues ...string) {
+	key := strings.Join(labelValues, "\x00")
+	h.mux.Lock()
+	defer h.mux.Unlock()
+	s, exists := h.series[key]
+	if !exists {
+		s = h.newSnapshot()
+		for i, name := range h.labelNames {
+			s.Labels[name] = labelValues[i]
+		}
+		h.series[key] = s
+	}
+	idx := sort.SearchFloat64s(h.buckets, v)
+	s.Counts[idx]++
+	s.Count++
+	s.Sum += v
+}
+
+// Snapshot returns a copy of each series in the histogram
+func (h *HistogramVec) Snapshot() []*HistogramSnapshot {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+	snapshots := make([]*HistogramSnapshot, 0, len(h.series))
+	for _, s := range h.series {
+		c := h.newSnapshot()
+		c.Add(s)
+		for k, v := range s.Labels {
+			c.Labels[k] = v
+		}
+		snapshots = append(snapshots, c)
+	}
+	return snapshots
+}
+
+// Aggregate merges the series in the histogram by the value of a label, or
+// into a single series with the empty string as the key if label is empty
+func (h *HistogramVec) Aggregate(label string) map[string]*HistogramSnapshot {
+	aggregated := make(map[string]*HistogramSnapshot)
+	for _, s := range h.Snapshot() {
+		key := s.Labels[label]
+		a, exists := aggregated[key]
+		if !exists {
+			a = h.newSnapshot()
+			if label != "" {
+				a.Labels[label] = key
+			}
+			aggregated[key] = a
+		}
+		a.Add(s)
+	}
+	return aggregated
+}
+
+func (h *HistogramVec) newSnapshot() *HistogramSnapshot {
+	return &HistogramSnapshot{
+		Labels:  make(map[string]string),
+		Buckets: h.buckets,
+		Counts:  make([]uint64, len(h.buckets)+1),
+	}
+}
+
+// Write outputs the histogram in the Prometheus text exposition format
+func (h *HistogramVec) Write(w io.Writer) {
+	snapshots := h.Snapshot()
+	sort.Slice(snapshots, func(i, j int) bool {
+		return formatLabels(h.labelNames, snapshots[i].labelValues(h.labelNames)) < formatLabels(h.labelNames, snapshots[j].labelValues(h.labelNames))
+	})
+	fmt.Fprintf(w, "# HELP %s %s\n", h.name, h.help)
+	fmt.Fprintf(w, "# TYPE %s histogram\n", h.name)
+	bucketLabels := append(append([]string{}, h.labelNames...), "le")
+	for _, s := range snapshots {
+		labelValues := s.labelValues(h.labelNames)
+		var cumulative uint64
+		for i, count := range s.Counts {
+			cumulative += count
+			le := "+Inf"
+			if i < len(s.Buckets) {
+				le = strconv.FormatFloat(s.Buckets[i], 'g', -1, 64)
+			}
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(bucketLabels, append(labelValues, le)), cumulative)
+		}
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, formatLabels(h.labelNames, labelValues), strconv.FormatFloat(s.Sum, 'g', -1, 64))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, formatLabels(h.labelNames, labelValues), s.Count)
+	}
+}
+
+func (s *HistogramSnapshot) labelValues(names []string) []string {
+	values := make([]string, len(names))
+	for i, name := range names {
+		values[i] = s.Labels[name]
+	}
+	return values
+}
+
+// Add merges the counts of another snapshot with the same buckets into this one
+func (s *HistogramSnapshot) Add(other *HistogramSnapshot) {
+	for i, count := range other.Counts {
+		s.Counts[i] += count
+	}
+	s.Count += other.Count
+	s.Sum += other.Sum
+}
+
+// Quantile estimates the value at quantile q (0 to 1), by linear interpolation
+// within the bucket containing it, in the same way as Prometheus histogram_quantile().
+// Values above the highest bucket are reported as the highest bucket bound
+func (s *HistogramSnapshot) Quantile(q float64) float64 {
+	if s.Count == 0 || len(s.Buckets) == 0 {
+		return 0
+	}
+	rank := q * float64(s.Count)
+	var cumulative float64
+	for i, count := range s.Counts {
+		if i == len(s.Buckets) {
+			break
+		}
+		if cumulative+float64(count) >= rank && count > 0 {
+			lower := float64(0)
+			if i > 0 {
+				lower = s.Buckets[i-1]
+			}
+			return lower + (s.Buckets[i]-lower)*((rank-cumulative)/float64(count))
+		}
+		cumulative += float64(count)
+	}
+	return s.Buckets[len(s.Buckets)-1]
+}
@@ -0,0 +1,102 @@
+// Copyright 2021 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metrics
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHistogramWrite(t *testing.T) {
+	assert := assert.New(t)
+
+	h := NewHistogramVec("test_latency_seconds", "Test latency", []float64{5, 1}, "class")
+	h.Observe(0.5, "fast")
+	h.Observe(1, "fast")
+	h.Observe(3, "slow\"er")
+	h.Observe(10, "slow\"er")
+
+	var buff bytes.Buffer
+	h.Write(&buff)
+	assert.Equal(`# HELP test_latency_seconds Test latency
+# TYPE test_latency_seconds histogram
+test_latency_seconds_bucket{class="fast",le="1"} 2
+test_latency_seconds_bucket{class="fast",le="5"} 2
+test_latency_seconds_bucket{class="fast",le="+Inf"} 2
+test_latency_seconds_sum{class="fast"} 1.5
+test_latency_seconds_count{class="fast"} 2
+test_latency_seconds_bucket{class="slow\"er",le="1"} 0
+test_latency_seconds_bucket{class="slow\"er",le="5"} 1
+test_latency_seconds_bucket{class="slow\"er",le="+Inf"} 2
+test_latency_seconds_sum{class="slow\"er"} 13
+test_latency_seconds_count{class="slow\"er"} 2
+`, buff.String())
+}
+
+func TestHistogramQuantileAndAggregate(t *testing.T) {
+	assert := assert.New(t)
+
+	h := NewHistogramVec("test_quantile_seconds", "Test quantiles", []float64{1, 2, 4}, "a", "b")
+	for i := 0; i < 50; i++ {
+		h.Observe(0.5, "x", "1")
+		h.Observe(1.5, "y", "1")
+	}
+
+	byA := h.Aggregate("a")
+	assert.Len(byA, 2)
+	assert.Equal(uint64(50), byA["x"].Count)
+	assert.Equal(0.5, byA["x"].Quantile(0.5))
+	assert.Equal(1.5, byA["y"].Quantile(0.5))
+
+	byB := h.Aggregate("b")
+	assert.Len(byB, 1)
+	assert.Equal(uint64(100), byB["1"].Count)
+	assert.Equal(1.0, byB["1"].Quantile(0.5))
+	assert.Equal(1.9, byB["1"].Quantile(0.95))
+
+	all := h.Aggregate("")[""]
+	assert.Equal(uint64(100), all.Count)
+	assert.Equal(100.0, all.Sum)
+
+	h.Observe(100, "z", "2")
+	assert.Equal(4.0, h.Aggregate("a")["z"].Quantile(0.5))
+
+	empty := NewHistogramVec("test_empty", "Empty", []float64{1})
+	assert.Empty(empty.Aggregate(""))
+	assert.Equal(0.0, empty.newSnapshot().Quantile(0.5))
+}
+
+func TestMetricsEndpoint(t *testing.T) {
+	assert := assert.New(t)
+
+	h := NewHistogramVec("test_endpoint_seconds", "Test endpoint", []float64{1})
+	h.Observe(0.1)
+	router := &httprouter.Router{}
+	AddRoutes(router)
+
+	req := httptest.NewRequest("GET", "/metrics", nil)
+	res := httptest.NewRecorder()
+	router.ServeHTTP(res, req)
+	assert.Equal(200, res.Code)
+	assert.Equal("text/plain; version=0.0.4", res.Header().Get("Content-Type"))
+	body, _ := ioutil.ReadAll(res.Body)
+	assert.Contains(string(body), "test_endpoint_seconds_bucket{le=\"1\"} 1\n")
+	assert.Contains(string(body), "test_endpoint_seconds_count 1\n")
+}
@@ -0,0 +1,50 @@
+// Copyright 2021 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metrics
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// HTTPLatencyBuckets are the upper bounds in seconds of HTTP request latency histograms.
+// Requests that wait for a transaction receipt can take as long as the block period
+var HTTPLatencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60}
+
+// statusRecorder captures the status code written by a handler
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// InstrumentHandler wraps a handler to observe the latency of each request, labelled with
+// the method, the route pattern (rather than the path, to bound the number of series) and
+// the status code. The histogram must have the labels "method", "route" and "status"
+func InstrumentHandler(h *HistogramVec, route string, handler httprouter.Handle) httprouter.Handle {
+	return func(res http.ResponseWriter, req *http.Request, params httprouter.Params) {
+		started := time.Now()
+		rec := &statusRecorder{ResponseWriter: res, status: 200}
+		handler(rec, req, params)
+		h.Observe(time.Since(started).Seconds(), req.Method, route, strconv.Itoa(rec.status))
+	}
+}
@@ -0,0 +1,49 @@
+// Copyright 2021 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metrics
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInstrumentHandler(t *testing.T) {
+	assert := assert.New(t)
+
+	h := NewHistogramVec("test_http_seconds", "Test HTTP", HTTPLatencyBuckets, "method", "route", "status")
+	router := &httprouter.Router{}
+	router.GET("/things/:id", InstrumentHandler(h, "/things/:id", func(res http.ResponseWriter, req *http.Request, params httprouter.Params) {
+		if params.ByName("id") == "missing" {
+			res.WriteHeader(404)
+		}
+		res.Write([]byte("{}"))
+	}))
+
+	for _, path := range []string{"/things/1", "/things/2", "/things/missing"} {
+		res := httptest.NewRecorder()
+		router.ServeHTTP(res, httptest.NewRequest("GET", path, nil))
+	}
+
+	byStatus := h.Aggregate("status")
+	assert.Equal(uint64(2), byStatus["200"].Count)
+	assert.Equal(uint64(1), byStatus["404"].Count)
+	byRoute := h.Aggregate("route")
+	assert.Len(byRoute, 1)
+	assert.Equal(uint64(3), byRoute["/things/:id"].Count)
+}
@@ -0,0 +1,87 @@
+// Copyright 2021 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metrics
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/julienschmidt/httprouter"
+	log "github.com/sirupsen/logrus"
+)
+
+// Collector is a metric exposed on /metrics in the Prometheus text exposition format
+type Collector interface {
+	Name() string
+	Write(w io.Writer)
+}
+
+var (
+	registryLock sync.Mutex
+	registry     = make(map[string]Collector)
+)
+
+// Register adds a collector to the metrics exposed on /metrics, replacing any
+// existing collector with the same name
+func Register(c Collector) {
+	registryLock.Lock()
+	defer registryLock.Unlock()
+	registry[c.Name()] = c
+}
+
+// AddRoutes adds the Prometheus /metrics endpoint
+func AddRoutes(router *httprouter.Router) {
+	router.GET("/metrics", metricsHandler)
+}
+
+func metricsHandler(res http.ResponseWriter, req *http.Request, params httprouter.Params) {
+	log.Debugf("--> %s %s", req.Method, req.URL)
+
+	registryLock.Lock()
+	names := make([]string, 0, len(registry))
+	for name := range registry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var buff bytes.Buffer
+	for _, name := range names {
+		registry[name].Write(&buff)
+	}
+	registryLock.Unlock()
+
+	status := 200
+	log.Debugf("<-- %s %s [%d]", req.Method, req.URL, status)
+	res.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	res.WriteHeader(status)
+	res.Write(buff.Bytes())
+}
+
+var labelValueEscaper = strings.NewReplacer("\\", "\\\\", "\"", "\\\"", "\n", "\\n")
+
+// formatLabels builds the {name="value",...} label set for a series
+func formatLabels(names, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		pairs[i] = name + "=\"" + labelValueEscaper.Replace(values[i]) + "\""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
@@ -23,7 +23,9 @@ import (
 	"github.com/go-openapi/jsonreference"
 	"github.com/go-openapi/spec"
 	ethbinding "github.com/kaleido-io/ethbinding/pkg"
+	"github.com/kaleido-io/ethconnect/internal/ethbind"
 	"github.com/kaleido-io/ethconnect/internal/utils"
+	log "github.com/sirupsen/logrus"
 	"github.com/tidwall/gjson"
 )
 
@@ -38,13 +40,17 @@ type ABI2SwaggerConf struct {
 
 // ABI2Swagger is the main entry point for conversion
 type ABI2Swagger struct {
-	conf *ABI2SwaggerConf
+	conf     *ABI2SwaggerConf
+	hidden   map[string]bool
+	readOnly map[string]bool
+	errors   ethbinding.ABIMarshaling
 }
 
 const (
 	fireflyAppCredential   = "FireflyAppCredential"
 	inputSchemaNameSuffix  = "_inputs"
 	outputSchemaNameSuffix = "_outputs"
+	errorSchemaNameSuffix  = "_error"
 )
 
 // NewABI2Swagger constructor
@@ -58,6 +64,32 @@ func NewABI2Swagger(conf *ABI2SwaggerConf) *ABI2Swagger {
 	return c
 }
 
+// RestrictMethods omits the hidden methods from the generated OpenAPI, and only
+// generates the query (GET) operation for the read-only methods
+func (c *ABI2Swagger) RestrictMethods(hidden, readOnly []string) {
+	c.hidden = make(map[string]bool)
+	for _, name := range hidden {
+		c.hidden[name] = true
+	}
+	c.readOnly = make(map[string]bool)
+	for _, name := range readOnly {
+		c.readOnly[name] = true
+	}
+}
+
+// SetCustomErrors documents the custom errors of the ABI, which a method can revert with,
+// as the error responses of the generated OpenAPI
+func (c *ABI2Swagger) SetCustomErrors(errorABIs ethbinding.ABIMarshaling) {
+	c.errors = nil
+	for _, element := range errorABIs {
+		if _, err := ethbind.API.ABIArgumentsMarshalingToABIArguments(element.Inputs); err != nil {
+			log.Warnf("Invalid custom error '%s' in ABI: %s", element.Name, err)
+			continue
+		}
+		c.errors = append(c.errors, element)
+	}
+}
+
 // Gen4Instance generates OpenAPI for a single contract instance with an address
 func (c *ABI2Swagger) Gen4Instance(basePath, name string, abi *ethbinding.ABI, devdocsJSON string) *spec.Swagger {
 	return c.convert(basePath, name, abi, devdocsJSON, true, false, false)
@@ -120,6 +152,9 @@ func (c *ABI2Swagger) buildDefinitionsAndPaths(inst, factoryOnly, externalRegist
 			c.addRegisterPath(paths)
 		}
 		for _, method := range abi.Methods {
+			if c.hidden[method.RawName] {
+				continue
+			}
 			c.buildMethodDefinitionsAndPath(inst, defs, paths, method.Name, method, methodsDocs)
 		}
 		for _, event := range abi.Events {
@@ -143,6 +178,25 @@ func (c *ABI2Swagger) buildDefinitionsAndPaths(inst, factoryOnly, externalRegist
 		},
 	}
 	defs["error"] = errSchema
+	c.buildCustomErrorDefinitions(defs, devdocs.Get("errors"))
+}
+
+// buildCustomErrorDefinitions adds a definition for the arguments of each custom error
+func (c *ABI2Swagger) buildCustomErrorDefinitions(defs map[string]spec.Schema, devdocs gjson.Result) {
+	for _, element := range c.errors {
+		inputs, _ := ethbind.API.ABIArgumentsMarshalingToABIArguments(element.Inputs)
+		_, errorSig, _, errorDocs := c.getDeclaredIDDetails(true, element.Name, inputs, devdocs)
+		// The devdocs of an error are an array, as errors can be declared more than once
+		errorDocs = errorDocs.Get("0")
+		errorSchema := url.QueryEscape(element.Name) + errorSchemaNameSuffix
+		c.buildArgumentsDefinition(defs, errorSchema, inputs, errorDocs)
+		def := defs[errorSchema]
+		def.Description = errorSig
+		if details := errorDocs.Get("details").String(); details != "" {
+			def.Description += ": " + details
+		}
+		defs[errorSchema] = def
+	}
 }
 
 func (c *ABI2Swagger) getDeclaredIDDetails(inst bool, declaredID string, inputs ethbinding.ABIArguments, devdocs gjson.Result) (bool, string, string, gjson.Result) {
@@ -173,7 +227,8 @@ func (c *ABI2Swagger) getDeclaredIDDetails(inst bool, declaredID string, inputs
 func (c *ABI2Swagger) buildMethodDefinitionsAndPath(inst bool, defs map[string]spec.Schema, paths map[string]spec.PathItem, name string, method ethbinding.ABIMethod, devdocs gjson.Result) {
 
 	constructor, methodSig, path, methodDocs := c.getDeclaredIDDetails(inst, name, method.Inputs, devdocs)
-	if method.IsConstant() {
+	readOnly := !constructor && c.readOnly[method.RawName]
+	if method.IsConstant() || readOnly {
 		methodSig += " [read only]"
 	}
 
@@ -184,8 +239,10 @@ func (c *ABI2Swagger) buildMethodDefinitionsAndPath(inst bool, defs map[string]s
 	if !constructor {
 		pathItem.Get = c.buildGETPath(outputSchema, inst, name, method, methodSig, methodDocs)
 	}
-	c.buildArgumentsDefinition(defs, inputSchema, method.Inputs, methodDocs)
-	pathItem.Post = c.buildPOSTPath(inputSchema, outputSchema, inst, constructor, name, method, methodSig, methodDocs)
+	if !readOnly {
+		c.buildArgumentsDefinition(defs, inputSchema, method.Inputs, methodDocs)
+		pathItem.Post = c.buildPOSTPath(inputSchema, outputSchema, inst, constructor, name, method, methodSig, methodDocs)
+	}
 	paths[path] = pathItem
 
 	return
@@ -241,11 +298,11 @@ func (c *ABI2Swagger) addRegisterPath(paths map[string]spec.PathItem) {
 
 func (c *ABI2Swagger) buildEventDefinitionsAndPath(inst bool, defs map[string]spec.Schema, paths map[string]spec.PathItem, name string, event ethbinding.ABIEvent, devdocs gjson.Result) {
 	_, eventSig, path, eventDocs := c.getDeclaredIDDetails(inst, event.Name, event.Inputs, devdocs)
-	eventSig += " [event]"
 	pathItem := spec.PathItem{}
 	eventSchema := url.QueryEscape(name) + "_event"
 	c.buildArgumentsDefinition(defs, eventSchema, event.Inputs, eventDocs)
-	pathItem.Post = c.buildEventPOSTPath(eventSchema, inst, event, eventSig, eventDocs)
+	eventExample := exampleEventPayload(eventSig, defs[eventSchema].Example.(map[string]interface{}))
+	pathItem.Post = c.buildEventPOSTPath(eventSchema, inst, event, eventSig+" [event]", eventExample, eventDocs)
 	paths[path+"/subscribe"] = pathItem
 	return
 }
@@ -299,6 +356,54 @@ func (c *ABI2Swagger) getCommonParameters() map[string]spec.Parameter {
 			Type: "integer",
 		},
 	}
+	params["maxfeepergasParam"] = spec.Parameter{
+		ParamProps: spec.ParamProps{
+			Description:     fmt.Sprintf("EIP-1559 max fee per gas offered, instead of a gas price (header: x-%s-maxfeepergas)", utils.GetenvOrDefaultLowerCase("PREFIX_LONG", "firefly")),
+			Name:            fmt.Sprintf("%s-maxfeepergas", utils.GetenvOrDefaultLowerCase("PREFIX_SHORT", "fly")),
+			In:              "query",
+			Required:        false,
+			AllowEmptyValue: true,
+		},
+		SimpleSchema: spec.SimpleSchema{
+			Type: "integer",
+		},
+	}
+	params["maxpriorityfeepergasParam"] = spec.Parameter{
+		ParamProps: spec.ParamProps{
+			Description:     fmt.Sprintf("EIP-1559 max priority fee per gas offered, instead of a gas price (header: x-%s-maxpriorityfeepergas)", utils.GetenvOrDefaultLowerCase("PREFIX_LONG", "firefly")),
+			Name:            fmt.Sprintf("%s-maxpriorityfeepergas", utils.GetenvOrDefaultLowerCase("PREFIX_SHORT", "fly")),
+			In:              "query",
+			Required:        false,
+			AllowEmptyValue: true,
+		},
+		SimpleSchema: spec.SimpleSchema{
+			Type: "integer",
+		},
+	}
+	params["nonceParam"] = spec.Parameter{
+		ParamProps: spec.ParamProps{
+			Description:     fmt.Sprintf("Nonce to send the transaction with, instead of the next nonce of the sender (header: x-%s-nonce)", utils.GetenvOrDefaultLowerCase("PREFIX_LONG", "firefly")),
+			Name:            fmt.Sprintf("%s-nonce", utils.GetenvOrDefaultLowerCase("PREFIX_SHORT", "fly")),
+			In:              "query",
+			Required:        false,
+			AllowEmptyValue: true,
+		},
+		SimpleSchema: spec.SimpleSchema{
+			Type: "integer",
+		},
+	}
+	params["confirmationsParam"] = spec.Parameter{
+		ParamProps: spec.ParamProps{
+			Description:     fmt.Sprintf("Number of confirmations of the block containing the tx before it is reported as mined, where 1 is the block itself (header: x-%s-confirmations)", utils.GetenvOrDefaultLowerCase("PREFIX_LONG", "firefly")),
+			Name:            fmt.Sprintf("%s-confirmations", utils.GetenvOrDefaultLowerCase("PREFIX_SHORT", "fly")),
+			In:              "query",
+			Required:        false,
+			AllowEmptyValue: true,
+		},
+		SimpleSchema: spec.SimpleSchema{
+			Type: "integer",
+		},
+	}
 	params["syncParam"] = spec.Parameter{
 		ParamProps: spec.ParamProps{
 			Description:     fmt.Sprintf("Block the HTTP request until the tx is mined (does not store the receipt) (header: x-%s-sync)", utils.GetenvOrDefaultLowerCase("PREFIX_LONG", "firefly")),
@@ -374,7 +479,7 @@ func (c *ABI2Swagger) getCommonParameters() map[string]spec.Parameter {
 	}
 	params["blocknumberParam"] = spec.Parameter{
 		ParamProps: spec.ParamProps{
-			Description:     fmt.Sprintf("The target block number for eth_call requests. One of 'earliest/latest/pending', a number or a hex string (header: x-%s-blocknumber)", utils.GetenvOrDefaultLowerCase("PREFIX_LONG", "firefly")),
+			Description:     fmt.Sprintf("The target block number for eth_call requests. One of 'earliest/latest/safe/finalized/pending', a number or a hex string (header: x-%s-blocknumber)", utils.GetenvOrDefaultLowerCase("PREFIX_LONG", "firefly")),
 			Name:            fmt.Sprintf("%s-blocknumber", utils.GetenvOrDefaultLowerCase("PREFIX_SHORT", "fly")),
 			In:              "query",
 			Required:        false,
@@ -384,6 +489,30 @@ func (c *ABI2Swagger) getCommonParameters() map[string]spec.Parameter {
 			Type: "string",
 		},
 	}
+	params["blocktagParam"] = spec.Parameter{
+		ParamProps: spec.ParamProps{
+			Description:     fmt.Sprintf("The named block for eth_call requests, instead of a block number. One of 'earliest/latest/safe/finalized/pending' (header: x-%s-blocktag)", utils.GetenvOrDefaultLowerCase("PREFIX_LONG", "firefly")),
+			Name:            fmt.Sprintf("%s-blocktag", utils.GetenvOrDefaultLowerCase("PREFIX_SHORT", "fly")),
+			In:              "query",
+			Required:        false,
+			AllowEmptyValue: false,
+		},
+		SimpleSchema: spec.SimpleSchema{
+			Type: "string",
+		},
+	}
+	params["asofParam"] = spec.Parameter{
+		ParamProps: spec.ParamProps{
+			Description:     fmt.Sprintf("Query historical state on an archive node for eth_call requests. A block number, or an RFC3339 timestamp resolved to the last block mined at or before that time (header: x-%s-asof)", utils.GetenvOrDefaultLowerCase("PREFIX_LONG", "firefly")),
+			Name:            fmt.Sprintf("%s-asof", utils.GetenvOrDefaultLowerCase("PREFIX_SHORT", "fly")),
+			In:              "query",
+			Required:        false,
+			AllowEmptyValue: false,
+		},
+		SimpleSchema: spec.SimpleSchema{
+			Type: "string",
+		},
+	}
 	return params
 }
 
@@ -397,6 +526,8 @@ func (c *ABI2Swagger) addCommonParams(op *spec.Operation, isPOST bool, isConstru
 	valueParam, _ := spec.NewRef("#/parameters/valueParam")
 	gasParam, _ := spec.NewRef("#/parameters/gasParam")
 	gaspriceParam, _ := spec.NewRef("#/parameters/gaspriceParam")
+	maxfeepergasParam, _ := spec.NewRef("#/parameters/maxfeepergasParam")
+	maxpriorityfeepergasParam, _ := spec.NewRef("#/parameters/maxpriorityfeepergasParam")
 	syncParam, _ := spec.NewRef("#/parameters/syncParam")
 	callParam, _ := spec.NewRef("#/parameters/callParam")
 	privateFromParam, _ := spec.NewRef("#/parameters/privateFromParam")
@@ -404,6 +535,10 @@ func (c *ABI2Swagger) addCommonParams(op *spec.Operation, isPOST bool, isConstru
 	privacyGroupIDParam, _ := spec.NewRef("#/parameters/privacyGroupIdParam")
 	registerParam, _ := spec.NewRef("#/parameters/registerParam")
 	blocknumberParam, _ := spec.NewRef("#/parameters/blocknumberParam")
+	nonceParam, _ := spec.NewRef("#/parameters/nonceParam")
+	confirmationsParam, _ := spec.NewRef("#/parameters/confirmationsParam")
+	asofParam, _ := spec.NewRef("#/parameters/asofParam")
+	blocktagParam, _ := spec.NewRef("#/parameters/blocktagParam")
 	op.Parameters = append(op.Parameters, spec.Parameter{
 		Refable: spec.Refable{
 			Ref: fromParam,
@@ -424,6 +559,28 @@ func (c *ABI2Swagger) addCommonParams(op *spec.Operation, isPOST bool, isConstru
 			Ref: gaspriceParam,
 		},
 	})
+	op.Parameters = append(op.Parameters, spec.Parameter{
+		Refable: spec.Refable{
+			Ref: maxfeepergasParam,
+		},
+	})
+	op.Parameters = append(op.Parameters, spec.Parameter{
+		Refable: spec.Refable{
+			Ref: maxpriorityfeepergasParam,
+		},
+	})
+	if !isConstructor {
+		op.Parameters = append(op.Parameters, spec.Parameter{
+			Refable: spec.Refable{
+				Ref: asofParam,
+			},
+		})
+		op.Parameters = append(op.Parameters, spec.Parameter{
+			Refable: spec.Refable{
+				Ref: blocktagParam,
+			},
+		})
+	}
 	if isPOST {
 		op.Parameters = append(op.Parameters, spec.Parameter{
 			Refable: spec.Refable{
@@ -450,6 +607,16 @@ func (c *ABI2Swagger) addCommonParams(op *spec.Operation, isPOST bool, isConstru
 				Ref: blocknumberParam,
 			},
 		})
+		op.Parameters = append(op.Parameters, spec.Parameter{
+			Refable: spec.Refable{
+				Ref: nonceParam,
+			},
+		})
+		op.Parameters = append(op.Parameters, spec.Parameter{
+			Refable: spec.Refable{
+				Ref: confirmationsParam,
+			},
+		})
 		if c.conf.OrionPrivateAPI {
 			op.Parameters = append(op.Parameters, spec.Parameter{
 				Refable: spec.Refable{
@@ -508,7 +675,8 @@ func (c *ABI2Swagger) buildGETPath(outputSchema string, inst bool, name string,
 				Required:    true,
 			},
 			SimpleSchema: spec.SimpleSchema{
-				Type: "string",
+				Type:    "string",
+				Example: exampleQueryValue(exampleForArg(&input.Type, desc)),
 			},
 		})
 	}
@@ -523,6 +691,7 @@ func (c *ABI2Swagger) buildGETPath(outputSchema string, inst bool, name string,
 		},
 	}
 	c.addCommonParams(op, false, false)
+	c.addCustomErrorResponse(op)
 	return op
 }
 
@@ -568,10 +737,11 @@ func (c *ABI2Swagger) buildPOSTPath(inputSchema, outputSchema string, inst, cons
 		},
 	}
 	c.addCommonParams(op, true, constructor)
+	c.addCustomErrorResponse(op)
 	return op
 }
 
-func (c *ABI2Swagger) buildEventPOSTPath(eventSchema string, inst bool, event ethbinding.ABIEvent, eventSig string, devdocs gjson.Result) *spec.Operation {
+func (c *ABI2Swagger) buildEventPOSTPath(eventSchema string, inst bool, event ethbinding.ABIEvent, eventSig string, eventExample map[string]interface{}, devdocs gjson.Result) *spec.Operation {
 	parameters := make([]spec.Parameter, 0, 2)
 	id := event.Name + "_subscribe"
 	if !inst {
@@ -615,6 +785,11 @@ func (c *ABI2Swagger) buildEventPOSTPath(eventSchema string, inst bool, event et
 			},
 		},
 	})
+	responses := c.buildResponses(eventSchema, devdocs)
+	// The events are delivered over the stream with the data wrapped in details of the log
+	eventResponse := responses.StatusCodeResponses[200]
+	eventResponse.AddExample("application/json", eventExample)
+	responses.StatusCodeResponses[200] = eventResponse
 	op := &spec.Operation{
 		OperationProps: spec.OperationProps{
 			ID:          id,
@@ -622,7 +797,7 @@ func (c *ABI2Swagger) buildEventPOSTPath(eventSchema string, inst bool, event et
 			Description: devdocs.Get("details").String(),
 			Consumes:    []string{"application/json", "application/x-yaml"},
 			Produces:    []string{"application/json"},
-			Responses:   c.buildResponses(eventSchema, devdocs),
+			Responses:   responses,
 			Parameters:  parameters,
 		},
 	}
@@ -669,6 +844,35 @@ func (c *ABI2Swagger) buildResponses(outputSchema string, devdocs gjson.Result)
 	}
 }
 
+// addCustomErrorResponse documents the custom errors a method can revert with. The error
+// message is the name of the error, followed by its arguments as JSON
+func (c *ABI2Swagger) addCustomErrorResponse(op *spec.Operation) {
+	if len(c.errors) == 0 {
+		return
+	}
+	errRef, _ := jsonreference.New("#/definitions/error")
+	names := make([]string, 0, len(c.errors))
+	refs := make([]string, 0, len(c.errors))
+	for _, element := range c.errors {
+		names = append(names, element.Name)
+		refs = append(refs, "#/definitions/"+url.QueryEscape(element.Name)+errorSchemaNameSuffix)
+	}
+	response := spec.Response{
+		ResponseProps: spec.ResponseProps{
+			Description: fmt.Sprintf("error, including reverts with a custom error reported as 'Name({arguments})': %s", strings.Join(names, ", ")),
+			Schema: &spec.Schema{
+				SchemaProps: spec.SchemaProps{
+					Ref: spec.Ref{
+						Ref: errRef,
+					},
+				},
+			},
+		},
+	}
+	response.AddExtension("x-firefly-custom-errors", refs)
+	op.Responses.StatusCodeResponses[500] = response
+}
+
 func (c *ABI2Swagger) buildArgumentsDefinition(defs map[string]spec.Schema, name string, args ethbinding.ABIArguments, devdocs gjson.Result) {
 
 	s := spec.Schema{
@@ -677,7 +881,7 @@ func (c *ABI2Swagger) buildArgumentsDefinition(defs map[string]spec.Schema, name
 			Properties: make(map[string]spec.Schema),
 		},
 	}
-	defs[name] = s
+	example := make(map[string]interface{})
 	argType := ""
 	if strings.HasSuffix(name, inputSchemaNameSuffix) {
 		argType = "input"
@@ -697,7 +901,10 @@ func (c *ABI2Swagger) buildArgumentsDefinition(defs map[string]spec.Schema, name
 		}
 		argDocs := devdocs.Get("params." + arg.Name)
 		s.Properties[argName] = c.mapArgToSchema(arg, argDocs.String())
+		example[argName] = s.Properties[argName].Example
 	}
+	s.Example = example
+	defs[name] = s
 
 }
 
@@ -713,6 +920,9 @@ func (c *ABI2Swagger) mapArgToSchema(arg ethbinding.ABIArgument, desc string) sp
 			Description: arg.Type.String() + varDetails,
 			Type:        []string{"string"},
 		},
+		SwaggerSchemaProps: spec.SwaggerSchemaProps{
+			Example: exampleForArg(&arg.Type, desc),
+		},
 	}
 	c.mapTypeToSchema(&s, arg.Type)
 
@@ -753,7 +963,20 @@ func (c *ABI2Swagger) mapTypeToSchema(s *spec.Schema, t ethbinding.ABIType) {
 		c.mapTypeToSchema(s.Items.Schema, *t.Elem)
 		break
 	case ethbinding.TupleTy:
+		// Structs are objects keyed by the component names in the ABI, which can in turn
+		// be structs, or arrays of structs
 		s.Type = []string{"object"}
+		s.Properties = make(map[string]spec.Schema)
+		for i, elem := range t.TupleElems {
+			elemSchema := spec.Schema{
+				SchemaProps: spec.SchemaProps{
+					Description: elem.String(),
+					Type:        []string{"string"},
+				},
+			}
+			c.mapTypeToSchema(&elemSchema, *elem)
+			s.Properties[t.TupleRawNames[i]] = elemSchema
+		}
 		break
 	}
 
@@ -22,6 +22,7 @@ import (
 	"strings"
 	"testing"
 
+	ethbinding "github.com/kaleido-io/ethbinding/pkg"
 	"github.com/kaleido-io/ethconnect/internal/ethbind"
 	"github.com/stretchr/testify/assert"
 )
@@ -79,6 +80,32 @@ func TestABI2SwaggerERC20actoryOnlyNoAuthCustomScheme(t *testing.T) {
 	return
 }
 
+func TestABI2SwaggerERC20RestrictedMethods(t *testing.T) {
+	assert := assert.New(t)
+
+	c := NewABI2Swagger(&ABI2SwaggerConf{
+		ExternalHost:     "localhost:80",
+		ExternalRootPath: "/contracts",
+		ExternalSchemes:  []string{"http"},
+	})
+	c.RestrictMethods([]string{"approve", "transferFrom"}, []string{"transfer"})
+	abi, err := ethbind.API.JSON(strings.NewReader(erc20ABI))
+	assert.NoError(err)
+	swagger := c.Gen4Instance("/erc20", "erc20", &abi, erc20DevDocs)
+
+	_, exists := swagger.Paths.Paths["/approve"]
+	assert.False(exists)
+	_, exists = swagger.Paths.Paths["/transferFrom"]
+	assert.False(exists)
+	assert.Nil(swagger.Paths.Paths["/transfer"].Post)
+	assert.NotNil(swagger.Paths.Paths["/transfer"].Get)
+	assert.Equal("transfer(address,uint256) [read only]", swagger.Paths.Paths["/transfer"].Get.Summary)
+	_, exists = swagger.Definitions["transfer_inputs"]
+	assert.False(exists)
+	assert.NotNil(swagger.Paths.Paths["/increaseAllowance"].Post)
+	return
+}
+
 func TestABI2SwaggerLotsOfTypesInstance(t *testing.T) {
 	assert := assert.New(t)
 
@@ -148,3 +175,41 @@ func TestABI2SwaggerUnnamedInputsABI(t *testing.T) {
 	assert.NotNil(swagger.SecurityDefinitions)
 	return
 }
+
+func TestABI2SwaggerCustomErrors(t *testing.T) {
+	assert := assert.New(t)
+
+	c := NewABI2Swagger(&ABI2SwaggerConf{
+		ExternalHost:     "localhost:80",
+		ExternalRootPath: "/contracts",
+		ExternalSchemes:  []string{"http"},
+	})
+	var errorABIs ethbinding.ABIMarshaling
+	err := json.Unmarshal([]byte(`[
+		{"type":"error","name":"InsufficientBalance","inputs":[{"name":"available","type":"uint256"},{"name":"required","type":"uint256"}]},
+		{"type":"error","name":"Unauthorized","inputs":[]},
+		{"type":"error","name":"Bad","inputs":[{"name":"x","type":"badness"}]}
+	]`), &errorABIs)
+	assert.NoError(err)
+	c.SetCustomErrors(errorABIs)
+	abi, err := ethbind.API.JSON(strings.NewReader(erc20ABI))
+	assert.NoError(err)
+	devdocs := `{"errors":{"InsufficientBalance(uint256,uint256)":[{"details":"Not enough tokens to transfer","params":{"available":"The balance","required":"The amount to transfer"}}]}}`
+	swagger := c.Gen4Instance("/erc20", "erc20", &abi, devdocs)
+
+	errorDef := swagger.Definitions["InsufficientBalance_error"]
+	assert.Equal("InsufficientBalance(uint256,uint256): Not enough tokens to transfer", errorDef.Description)
+	assert.Equal("uint256: The balance", errorDef.Properties["available"].Description)
+	assert.Equal("Unauthorized()", swagger.Definitions["Unauthorized_error"].Description)
+	_, exists := swagger.Definitions["Bad_error"]
+	assert.False(exists)
+
+	errorResponse := swagger.Paths.Paths["/transfer"].Post.Responses.StatusCodeResponses[500]
+	assert.Regexp("InsufficientBalance, Unauthorized", errorResponse.Description)
+	assert.Equal("#/definitions/error", errorResponse.Schema.Ref.String())
+	assert.Equal([]string{"#/definitions/InsufficientBalance_error", "#/definitions/Unauthorized_error"}, errorResponse.Extensions["x-firefly-custom-errors"])
+	_, exists = swagger.Paths.Paths["/balanceOf"].Get.Responses.StatusCodeResponses[500]
+	assert.True(exists)
+	_, exists = swagger.Paths.Paths["/Transfer/subscribe"].Post.Responses.StatusCodeResponses[500]
+	assert.False(exists)
+}
@@ -0,0 +1,130 @@
+// Copyright 2021 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package openapi
+
+import (
+	"encoding/json"
+	"regexp"
+	"strconv"
+	"strings"
+
+	ethbinding "github.com/kaleido-io/ethbinding/pkg"
+)
+
+const (
+	exampleAddress   = "0x4a8f6b4fbd4b0c1d6c2e2b8b4a0b8e7d1f0c6a93"
+	exampleTxHash    = "0x1a8b3c5d7e9f0a2b4c6d8e0f1a3b5c7d9e1f2a4b6c8d0e2f4a6b8c0d2e4f6a8b"
+	exampleHexDigits = "0123456789abcdef"
+)
+
+// devdocExampleMatcher finds an example value in the NatSpec documentation of a parameter,
+// such as "The amount to transfer, e.g. 1000" or "The recipient. Example: 0x..."
+var devdocExampleMatcher = regexp.MustCompile("(?i)(?:\\be\\.g\\.|\\bexample:)\\s*[`'\"]?(\\[[^\\]]*\\]|\\{[^}]*\\}|[^`'\"\\s,;]+)")
+
+// ExampleForType generates a realistic example value for an ABI type, in the format
+// accepted by the REST Gateway. Numbers are strings, so that they are not truncated by
+// JSON parsers, and tuples are objects keyed by the field names. Also used to generate
+// the inputs of contract conformance checks
+func ExampleForType(t *ethbinding.ABIType) interface{} {
+	switch t.T {
+	case ethbinding.IntTy:
+		if t.Size <= 8 {
+			return "-10"
+		}
+		return "-1000"
+	case ethbinding.UintTy:
+		if t.Size <= 8 {
+			return "10"
+		}
+		return "1000"
+	case ethbinding.BoolTy:
+		return true
+	case ethbinding.AddressTy:
+		return exampleAddress
+	case ethbinding.StringTy:
+		return "example"
+	case ethbinding.BytesTy:
+		return "0x" + exampleHexDigits
+	case ethbinding.FixedBytesTy:
+		return "0x" + exampleHex(t.Size*2)
+	case ethbinding.SliceTy:
+		return []interface{}{ExampleForType(t.Elem)}
+	case ethbinding.ArrayTy:
+		arr := make([]interface{}, t.Size)
+		for i := range arr {
+			arr[i] = ExampleForType(t.Elem)
+		}
+		return arr
+	case ethbinding.TupleTy:
+		obj := make(map[string]interface{})
+		for i, elem := range t.TupleElems {
+			obj[t.TupleRawNames[i]] = ExampleForType(elem)
+		}
+		return obj
+	}
+	return nil
+}
+
+func exampleHex(length int) string {
+	hex := strings.Repeat(exampleHexDigits, length/len(exampleHexDigits)+1)
+	return hex[0:length]
+}
+
+// exampleForArg uses an example from the devdoc for the argument if there is one,
+// and otherwise generates one from the type
+func exampleForArg(t *ethbinding.ABIType, desc string) interface{} {
+	if groups := devdocExampleMatcher.FindStringSubmatch(desc); groups != nil {
+		example := strings.TrimRight(groups[1], ".)")
+		switch t.T {
+		case ethbinding.BoolTy:
+			if b, err := strconv.ParseBool(example); err == nil {
+				return b
+			}
+		case ethbinding.SliceTy, ethbinding.ArrayTy, ethbinding.TupleTy:
+			var v interface{}
+			if err := json.Unmarshal([]byte(example), &v); err == nil {
+				return v
+			}
+		default:
+			return example
+		}
+	}
+	return ExampleForType(t)
+}
+
+// exampleQueryValue formats an example for a query parameter, where complex types are passed as JSON
+func exampleQueryValue(example interface{}) string {
+	switch v := example.(type) {
+	case string:
+		return v
+	default:
+		b, _ := json.Marshal(v)
+		return string(b)
+	}
+}
+
+// exampleEventPayload is an example of the payload delivered for an event over an event stream
+func exampleEventPayload(eventSig string, data map[string]interface{}) map[string]interface{} {
+	return map[string]interface{}{
+		"address":          exampleAddress,
+		"blockNumber":      "1000",
+		"transactionIndex": "0x0",
+		"transactionHash":  exampleTxHash,
+		"data":             data,
+		"subId":            "sb-0d8a4f19-8b2a-4e63-6f2b-05c2d0f1a9c3",
+		"signature":        eventSig,
+		"logIndex":         "0",
+	}
+}
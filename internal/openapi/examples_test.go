@@ -0,0 +1,73 @@
+// Copyright 2021 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package openapi
+
+import (
+	"testing"
+
+	"github.com/kaleido-io/ethconnect/internal/ethbind"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExampleForType(t *testing.T) {
+	assert := assert.New(t)
+
+	for typeName, expected := range map[string]interface{}{
+		"uint8":      "10",
+		"uint256":    "1000",
+		"int8":       "-10",
+		"int64":      "-1000",
+		"bool":       true,
+		"address":    exampleAddress,
+		"string":     "example",
+		"bytes":      "0x0123456789abcdef",
+		"bytes4":     "0x01234567",
+		"bytes20":    "0x0123456789abcdef0123456789abcdef01234567",
+		"uint256[]":  []interface{}{"1000"},
+		"bool[2]":    []interface{}{true, true},
+		"address[1]": []interface{}{exampleAddress},
+	} {
+		abiType, err := ethbind.API.NewType(typeName, "")
+		assert.NoError(err)
+		assert.Equal(expected, ExampleForType(&abiType), typeName)
+	}
+}
+
+func TestExampleForArgFromDevdoc(t *testing.T) {
+	assert := assert.New(t)
+
+	uintType, _ := ethbind.API.NewType("uint256", "")
+	assert.Equal("250", exampleForArg(&uintType, "The amount to transfer, e.g. 250."))
+	assert.Equal("1000", exampleForArg(&uintType, "The amount to transfer"))
+
+	stringType, _ := ethbind.API.NewType("string", "")
+	assert.Equal("GBP", exampleForArg(&stringType, "ISO currency code. Example: `GBP`"))
+
+	boolType, _ := ethbind.API.NewType("bool", "")
+	assert.Equal(false, exampleForArg(&boolType, "Whether to notify, e.g. false"))
+	assert.Equal(true, exampleForArg(&boolType, "Whether to notify, e.g. never"))
+
+	arrayType, _ := ethbind.API.NewType("uint256[]", "")
+	assert.Equal([]interface{}{float64(1), float64(2)}, exampleForArg(&arrayType, "Values e.g. [1,2]"))
+	assert.Equal([]interface{}{"1000"}, exampleForArg(&arrayType, "Values e.g. some"))
+}
+
+func TestExampleQueryValue(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Equal("1000", exampleQueryValue("1000"))
+	assert.Equal("true", exampleQueryValue(true))
+	assert.Equal(`["1000"]`, exampleQueryValue([]interface{}{"1000"}))
+}
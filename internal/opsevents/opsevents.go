@@ -0,0 +1,102 @@
+// Copyright 2021 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package opsevents
+
+import (
+	"sync"
+	"time"
+
+	"github.com/kaleido-io/ethconnect/internal/utils"
+)
+
+// Types of operational event
+const (
+	// CircuitBreakerOpened asynchronous dispatch is being rejected, as the dispatcher is failing
+	CircuitBreakerOpened = "CircuitBreakerOpened"
+	// CircuitBreakerClosed asynchronous dispatch is accepted again
+	CircuitBreakerClosed = "CircuitBreakerClosed"
+	// StreamSuspended an event stream stopped delivering events
+	StreamSuspended = "StreamSuspended"
+	// StreamResumed a suspended event stream is delivering events again
+	StreamResumed = "StreamResumed"
+	// SubscriptionSuspended a subscription stopped polling for events, after repeated decode errors
+	SubscriptionSuspended = "SubscriptionSuspended"
+	// KafkaReconnecting a Kafka consumer ended, and is being reconnected
+	KafkaReconnecting = "KafkaReconnecting"
+	// RPCNodeUnavailable a JSON/RPC node failed
+	RPCNodeUnavailable = "RPCNodeUnavailable"
+	// RPCNodeAvailable a JSON/RPC node that failed is available again
+	RPCNodeAvailable = "RPCNodeAvailable"
+	// RPCFailover transactions are being sent to a different JSON/RPC node
+	RPCFailover = "RPCFailover"
+	// CheckpointReset a subscription was reset to start again from a block
+	CheckpointReset = "CheckpointReset"
+	// CheckpointRewound the checkpoint of a subscription moved back to an earlier block
+	CheckpointRewound = "CheckpointRewound"
+	// RegistryChanged a contract instance or ABI was stored in, or deleted from, the contract registry
+	RegistryChanged = "RegistryChanged"
+)
+
+// Event is an operational event of the gateway, for monitoring rather than for applications
+type Event struct {
+	ID        string                 `json:"id"`
+	Type      string                 `json:"type"`
+	Timestamp string                 `json:"timestamp"`
+	Data      map[string]interface{} `json:"data,omitempty"`
+}
+
+// Listener is called with each event published. It is called on the goroutine that
+// published the event, so must not block
+type Listener func(event *Event)
+
+var (
+	listenersLock sync.Mutex
+	listeners     = make(map[int]Listener)
+	nextListener  int
+)
+
+// AddListener registers a listener for the events published from now on, and returns a
+// function that removes it
+func AddListener(listener Listener) (remove func()) {
+	listenersLock.Lock()
+	defer listenersLock.Unlock()
+	id := nextListener
+	nextListener++
+	listeners[id] = listener
+	return func() {
+		listenersLock.Lock()
+		defer listenersLock.Unlock()
+		delete(listeners, id)
+	}
+}
+
+// Publish sends an event to all the listeners. When there are none the event is discarded,
+// so components can publish without knowing if anything is configured to receive them
+func Publish(eventType string, data map[string]interface{}) {
+	listenersLock.Lock()
+	defer listenersLock.Unlock()
+	if len(listeners) == 0 {
+		return
+	}
+	event := &Event{
+		ID:        utils.UUIDv4(),
+		Type:      eventType,
+		Timestamp: time.Now().UTC().Format(time.RFC3339Nano),
+		Data:      data,
+	}
+	for _, listener := range listeners {
+		listener(event)
+	}
+}
@@ -0,0 +1,46 @@
+// Copyright 2021 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package opsevents
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPublishToListeners(t *testing.T) {
+	assert := assert.New(t)
+
+	// Nothing is received with no listeners
+	Publish(RPCFailover, nil)
+
+	var received1, received2 []*Event
+	remove1 := AddListener(func(event *Event) { received1 = append(received1, event) })
+	remove2 := AddListener(func(event *Event) { received2 = append(received2, event) })
+	Publish(StreamSuspended, map[string]interface{}{"stream": "es-1"})
+	remove1()
+	Publish(StreamResumed, map[string]interface{}{"stream": "es-1"})
+	remove2()
+	Publish(StreamSuspended, nil)
+
+	assert.Len(received1, 1)
+	assert.Equal(StreamSuspended, received1[0].Type)
+	assert.Equal("es-1", received1[0].Data["stream"])
+	assert.NotEmpty(received1[0].ID)
+	assert.NotEmpty(received1[0].Timestamp)
+	assert.Len(received2, 2)
+	assert.Equal(received1[0], received2[0])
+	assert.Equal(StreamResumed, received2[1].Type)
+}
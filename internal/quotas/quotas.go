@@ -0,0 +1,145 @@
+// Copyright 2021 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package quotas
+
+import (
+	"sync"
+	"time"
+
+	"github.com/kaleido-io/ethconnect/internal/errors"
+)
+
+// Resource is a type of object created by a tenant that is subject to a quota
+type Resource string
+
+const (
+	// Streams is the number of event streams
+	Streams Resource = "streams"
+	// Subscriptions is the number of event subscriptions
+	Subscriptions Resource = "subscriptions"
+	// Contracts is the number of contract instances registered with the gateway
+	Contracts Resource = "contracts"
+)
+
+// Limits for a single tenant. Zero means unlimited
+type Limits struct {
+	MaxStreams             int `json:"maxStreams,omitempty"`
+	MaxSubscriptions       int `json:"maxSubscriptions,omitempty"`
+	MaxContracts           int `json:"maxContracts,omitempty"`
+	MaxCatchupBlocksPerSec int `json:"maxCatchupBlocksPerSec,omitempty"`
+}
+
+// Conf has the default limits for every tenant, and overrides for individual tenants.
+// Tenants are identified by the security module. When there is no security module,
+// or it does not identify tenants, all requests share the limits of the "" tenant
+type Conf struct {
+	Default Limits             `json:"default"`
+	Tenants map[string]*Limits `json:"tenants,omitempty"`
+}
+
+// ExceededError is returned when creating an object would take a tenant over its quota
+type ExceededError struct {
+	Tenant   string
+	Resource Resource
+	Limit    int
+}
+
+func (e *ExceededError) Error() string {
+	return errors.Errorf(errors.QuotaExceeded, e.Resource, e.Tenant, e.Limit).Error()
+}
+
+// For returns the limits that apply to the tenant
+func (c *Conf) For(tenant string) *Limits {
+	if l, ok := c.Tenants[tenant]; ok && l != nil {
+		return l
+	}
+	return &c.Default
+}
+
+// Check returns an ExceededError if the tenant already has as many of the resource as its quota allows
+func (c *Conf) Check(tenant string, resource Resource, current int) error {
+	l := c.For(tenant)
+	var limit int
+	switch resource {
+	case Streams:
+		limit = l.MaxStreams
+	case Subscriptions:
+		limit = l.MaxSubscriptions
+	case Contracts:
+		limit = l.MaxContracts
+	}
+	if limit > 0 && current >= limit {
+		return &ExceededError{Tenant: tenant, Resource: resource, Limit: limit}
+	}
+	return nil
+}
+
+// Throttle limits the average rate of work, such as the blocks read in catch-up mode,
+// across everything that shares it
+type Throttle struct {
+	mux     sync.Mutex
+	perSec  int
+	burst   time.Duration
+	next    time.Time
+	nowFunc func() time.Time
+}
+
+// NewThrottle constructor
+func NewThrottle(perSec int) *Throttle {
+	return &Throttle{
+		perSec:  perSec,
+		nowFunc: time.Now,
+	}
+}
+
+// NewBurstThrottle constructor for a throttle that allows up to burst units of work at once
+// after it has been idle, such as a second's worth of requests made together on each poll
+func NewBurstThrottle(perSec, burst int) *Throttle {
+	t := NewThrottle(perSec)
+	if burst > 1 {
+		t.burst = time.Duration(burst-1) * time.Second / time.Duration(perSec)
+	}
+	return t
+}
+
+// Allow returns true if the work can be done now, and reserves the time it takes at the
+// configured rate. If false is returned the caller should skip the work, and try again later
+func (t *Throttle) Allow(units int64) bool {
+	ok, _ := t.Reserve(units)
+	return ok
+}
+
+// Reserve is Allow, but also returns how long the caller must wait before the work would
+// be allowed when it is not allowed now
+func (t *Throttle) Reserve(units int64) (bool, time.Duration) {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	now := t.nowFunc()
+	if now.Add(t.burst).Before(t.next) {
+		return false, t.next.Sub(now.Add(t.burst))
+	}
+	if t.next.Before(now) {
+		t.next = now
+	}
+	t.next = t.next.Add(time.Duration(units) * time.Second / time.Duration(t.perSec))
+	return true, 0
+}
+
+// Idle returns true if the throttle has been unused long enough to allow a full burst
+func (t *Throttle) Idle() bool {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	return !t.next.After(t.nowFunc())
+}
@@ -0,0 +1,92 @@
+// Copyright 2021 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package quotas
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckDefaultAndTenantLimits(t *testing.T) {
+	assert := assert.New(t)
+
+	conf := &Conf{
+		Default: Limits{MaxStreams: 2, MaxSubscriptions: 10},
+		Tenants: map[string]*Limits{
+			"big": {MaxStreams: 5},
+		},
+	}
+	assert.NoError(conf.Check("small", Streams, 1))
+	err := conf.Check("small", Streams, 2)
+	assert.EqualError(err, "Quota exceeded: the maximum number of streams for tenant 'small' is 2")
+	assert.Equal(&ExceededError{Tenant: "small", Resource: Streams, Limit: 2}, err)
+	assert.EqualError(conf.Check("small", Subscriptions, 10), "Quota exceeded: the maximum number of subscriptions for tenant 'small' is 10")
+
+	assert.NoError(conf.Check("big", Streams, 4))
+	assert.Error(conf.Check("big", Streams, 5))
+	// Tenant overrides replace the defaults entirely
+	assert.NoError(conf.Check("big", Subscriptions, 1000))
+	assert.NoError(conf.Check("small", Contracts, 1000))
+}
+
+func TestThrottle(t *testing.T) {
+	assert := assert.New(t)
+
+	now := time.Unix(1000, 0)
+	th := NewThrottle(100)
+	th.nowFunc = func() time.Time { return now }
+
+	assert.True(th.Allow(250))
+	now = now.Add(2 * time.Second)
+	assert.False(th.Allow(250))
+	now = now.Add(500 * time.Millisecond)
+	assert.True(th.Allow(50))
+	assert.False(th.Allow(50))
+	now = now.Add(500 * time.Millisecond)
+	assert.True(th.Allow(50))
+}
+
+func TestBurstThrottle(t *testing.T) {
+	assert := assert.New(t)
+
+	now := time.Unix(1000, 0)
+	th := NewBurstThrottle(5, 5)
+	th.nowFunc = func() time.Time { return now }
+
+	for i := 0; i < 5; i++ {
+		assert.True(th.Allow(1))
+	}
+	assert.False(th.Allow(1))
+	now = now.Add(200 * time.Millisecond)
+	assert.True(th.Allow(1))
+	assert.False(th.Allow(1))
+
+	// Idle time does not build up beyond the burst
+	now = now.Add(time.Minute)
+	assert.True(th.Idle())
+	for i := 0; i < 5; i++ {
+		assert.True(th.Allow(1))
+	}
+	assert.False(th.Idle())
+	ok, wait := th.Reserve(1)
+	assert.False(ok)
+	assert.Equal(200*time.Millisecond, wait)
+	now = now.Add(150 * time.Millisecond)
+	ok, wait = th.Reserve(1)
+	assert.False(ok)
+	assert.Equal(50*time.Millisecond, wait)
+}
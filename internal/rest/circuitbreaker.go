@@ -0,0 +1,237 @@
+// Copyright 2021 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rest
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/kaleido-io/ethconnect/internal/auth"
+	"github.com/kaleido-io/ethconnect/internal/errors"
+	"github.com/kaleido-io/ethconnect/internal/opsevents"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	circuitBreakerClosed   = "closed"
+	circuitBreakerOpen     = "open"
+	circuitBreakerHalfOpen = "half-open"
+
+	defaultCircuitBreakerResetTimeoutMS = 30000
+)
+
+// CircuitBreakerConf configures the circuit breaker in front of the asynchronous dispatcher
+type CircuitBreakerConf struct {
+	// FailureThreshold is the number of consecutive dispatch failures that opens the breaker.
+	// Zero means the breaker only opens on a manual override
+	FailureThreshold int `json:"failureThreshold"`
+	// ResetTimeoutMS is how long the breaker stays open, before allowing a trial dispatch
+	ResetTimeoutMS int `json:"resetTimeout"`
+}
+
+// CircuitBreakerStatus is the state and metrics of the circuit breaker
+type CircuitBreakerStatus struct {
+	State               string     `json:"state"`
+	Override            string     `json:"override,omitempty"`
+	FailureThreshold    int        `json:"failureThreshold"`
+	ConsecutiveFailures int        `json:"consecutiveFailures"`
+	TotalSuccesses      uint64     `json:"totalSuccesses"`
+	TotalFailures       uint64     `json:"totalFailures"`
+	TotalRejected       uint64     `json:"totalRejected"`
+	TripCount           uint64     `json:"tripCount"`
+	LastTripped         *time.Time `json:"lastTripped,omitempty"`
+	LastFailure         string     `json:"lastFailure,omitempty"`
+}
+
+type circuitBreakerOverride struct {
+	Override string `json:"override"`
+}
+
+// circuitBreaker rejects asynchronous dispatch while the dispatcher (Kafka, or the
+// in-flight limit of the direct dispatcher) is failing, rather than queuing up work
+// behind it. After the reset timeout, a single probe dispatch is allowed through while
+// all others are still rejected, and its result determines whether the breaker closes or re-opens
+type circuitBreaker struct {
+	mux          sync.Mutex
+	conf         *CircuitBreakerConf
+	resetTimeout time.Duration
+	status       CircuitBreakerStatus
+	openedAt     time.Time
+	probing      bool
+}
+
+func newCircuitBreaker(conf *CircuitBreakerConf) *circuitBreaker {
+	resetTimeoutMS := conf.ResetTimeoutMS
+	if resetTimeoutMS <= 0 {
+		resetTimeoutMS = defaultCircuitBreakerResetTimeoutMS
+	}
+	return &circuitBreaker{
+		conf:         conf,
+		resetTimeout: time.Duration(resetTimeoutMS) * time.Millisecond,
+		status: CircuitBreakerStatus{
+			State:            circuitBreakerClosed,
+			FailureThreshold: conf.FailureThreshold,
+		},
+	}
+}
+
+// allow returns an error if the breaker is open, and the dispatch must be rejected
+func (cb *circuitBreaker) allow() error {
+	cb.mux.Lock()
+	defer cb.mux.Unlock()
+	switch cb.status.Override {
+	case circuitBreakerOpen:
+		cb.status.TotalRejected++
+		return errors.Errorf(errors.WebhooksCircuitBreakerOpen)
+	case circuitBreakerClosed:
+		return nil
+	}
+	if cb.status.State == circuitBreakerOpen {
+		if time.Since(cb.openedAt) < cb.resetTimeout {
+			cb.status.TotalRejected++
+			return errors.Errorf(errors.WebhooksCircuitBreakerOpen)
+		}
+		log.Infof("Circuit breaker half-open after %.2fs", cb.resetTimeout.Seconds())
+		cb.status.State = circuitBreakerHalfOpen
+	}
+	if cb.status.State == circuitBreakerHalfOpen {
+		if cb.probing {
+			cb.status.TotalRejected++
+			return errors.Errorf(errors.WebhooksCircuitBreakerOpen)
+		}
+		cb.probing = true
+	}
+	return nil
+}
+
+// record updates the breaker with the result of a dispatch. Only failures of the
+// dispatcher itself count, not rejection of invalid messages. A probe that is rejected
+// as invalid does not decide the state, so the next dispatch becomes the probe
+func (cb *circuitBreaker) record(status int, err error) {
+	cb.mux.Lock()
+	defer cb.mux.Unlock()
+	cb.probing = false
+	if err == nil {
+		cb.status.TotalSuccesses++
+		cb.status.ConsecutiveFailures = 0
+		if cb.status.State != circuitBreakerClosed {
+			log.Infof("Circuit breaker closed")
+			cb.status.State = circuitBreakerClosed
+			opsevents.Publish(opsevents.CircuitBreakerClosed, nil)
+		}
+		return
+	}
+	if status < 500 && status != 429 {
+		return
+	}
+	cb.status.TotalFailures++
+	cb.status.ConsecutiveFailures++
+	cb.status.LastFailure = err.Error()
+	if cb.status.State == circuitBreakerHalfOpen ||
+		(cb.status.State == circuitBreakerClosed && cb.conf.FailureThreshold > 0 && cb.status.ConsecutiveFailures >= cb.conf.FailureThreshold) {
+		cb.trip()
+	}
+}
+
+func (cb *circuitBreaker) trip() {
+	log.Warnf("Circuit breaker open after %d consecutive failures: %s", cb.status.ConsecutiveFailures, cb.status.LastFailure)
+	cb.openedAt = time.Now().UTC()
+	cb.status.State = circuitBreakerOpen
+	cb.status.TripCount++
+	trippedAt := cb.openedAt
+	cb.status.LastTripped = &trippedAt
+	opsevents.Publish(opsevents.CircuitBreakerOpened, map[string]interface{}{
+		"consecutiveFailures": cb.status.ConsecutiveFailures,
+		"lastFailure":         cb.status.LastFailure,
+	})
+}
+
+func (cb *circuitBreaker) setOverride(override string) error {
+	cb.mux.Lock()
+	defer cb.mux.Unlock()
+	switch override {
+	case circuitBreakerOpen, circuitBreakerClosed, "":
+	default:
+		return errors.Errorf(errors.WebhooksCircuitBreakerInvalidOverride, override)
+	}
+	log.Infof("Circuit breaker override set to '%s'", override)
+	cb.status.Override = override
+	if override == circuitBreakerClosed {
+		// Manually closing resets the automatic state
+		cb.status.State = circuitBreakerClosed
+		cb.status.ConsecutiveFailures = 0
+		cb.probing = false
+	}
+	return nil
+}
+
+func (cb *circuitBreaker) getStatus() *CircuitBreakerStatus {
+	cb.mux.Lock()
+	defer cb.mux.Unlock()
+	status := cb.status
+	if status.Override != "" {
+		status.State = status.Override
+	}
+	return &status
+}
+
+func (cb *circuitBreaker) addRoutes(router *httprouter.Router) {
+	router.GET("/status/circuitbreaker", cb.statusHandler)
+	router.PUT("/status/circuitbreaker", cb.overrideHandler)
+}
+
+func (cb *circuitBreaker) statusHandler(res http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	log.Infof("--> %s %s", req.Method, req.URL)
+	cb.reply(res, req, 200)
+}
+
+func (cb *circuitBreaker) overrideHandler(res http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	log.Infof("--> %s %s", req.Method, req.URL)
+	var body circuitBreakerOverride
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		cb.errReply(res, req, err, 400)
+		return
+	}
+	if err := auth.AuthAdmin(req.Context(), "circuitbreaker.override", body.Override); err != nil {
+		log.Errorf("Circuit breaker override not authorized: %s", err)
+		cb.errReply(res, req, errors.Errorf(errors.Unauthorized), 401)
+		return
+	}
+	if err := cb.setOverride(body.Override); err != nil {
+		cb.errReply(res, req, err, 400)
+		return
+	}
+	cb.reply(res, req, 200)
+}
+
+func (cb *circuitBreaker) errReply(res http.ResponseWriter, req *http.Request, err error, status int) {
+	log.Errorf("<-- %s %s [%d]: %s", req.Method, req.URL, status, err)
+	reply, _ := json.Marshal(&errMsg{Message: err.Error()})
+	res.Header().Set("Content-Type", "application/json")
+	res.WriteHeader(status)
+	res.Write(reply)
+}
+
+func (cb *circuitBreaker) reply(res http.ResponseWriter, req *http.Request, status int) {
+	log.Infof("<-- %s %s [%d]", req.Method, req.URL, status)
+	res.Header().Set("Content-Type", "application/json")
+	res.WriteHeader(status)
+	enc := json.NewEncoder(res)
+	enc.SetIndent("", "  ")
+	enc.Encode(cb.getStatus())
+}
@@ -0,0 +1,268 @@
+// Copyright 2021 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rest
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/kaleido-io/ethconnect/internal/auth"
+	"github.com/kaleido-io/ethconnect/internal/auth/authtest"
+	"github.com/kaleido-io/ethconnect/internal/messages"
+	"github.com/kaleido-io/ethconnect/internal/opsevents"
+	"github.com/stretchr/testify/assert"
+)
+
+type mockFailingHandler struct {
+	mockHandler
+	status int
+	err    error
+	calls  int
+}
+
+func (m *mockFailingHandler) sendWebhookMsg(ctx context.Context, key, msgID string, msg map[string]interface{}, ack bool) (msgAck string, statusCode int, err error) {
+	m.calls++
+	return "", m.status, m.err
+}
+
+func newTestCircuitBreakerWebhooks(conf *CircuitBreakerConf, handler webhooksHandler) (*webhooks, *httprouter.Router) {
+	w := newWebhooks(handler, nil, conf)
+	router := &httprouter.Router{}
+	w.addRoutes(router)
+	return w, router
+}
+
+func testSendTXMsg() map[string]interface{} {
+	return map[string]interface{}{
+		"headers": map[string]interface{}{
+			"type": messages.MsgTypeSendTransaction,
+		},
+		"from": "0x66c5fe653e7a9ebb628a6d40f0452d1e358baee8",
+	}
+}
+
+func getCircuitBreakerStatus(t *testing.T, router *httprouter.Router) *CircuitBreakerStatus {
+	req := httptest.NewRequest("GET", "/status/circuitbreaker", nil)
+	res := httptest.NewRecorder()
+	router.ServeHTTP(res, req)
+	assert.Equal(t, 200, res.Code)
+	var status CircuitBreakerStatus
+	json.NewDecoder(res.Body).Decode(&status)
+	return &status
+}
+
+func TestCircuitBreakerTripsAndResets(t *testing.T) {
+	assert := assert.New(t)
+	var opsEvents []string
+	defer opsevents.AddListener(func(event *opsevents.Event) { opsEvents = append(opsEvents, event.Type) })()
+
+	handler := &mockFailingHandler{status: 502, err: fmt.Errorf("pop")}
+	w, router := newTestCircuitBreakerWebhooks(&CircuitBreakerConf{
+		FailureThreshold: 2,
+		ResetTimeoutMS:   3600000,
+	}, handler)
+
+	_, status, err := w.processMsg(context.Background(), testSendTXMsg(), false)
+	assert.Equal(502, status)
+	assert.EqualError(err, "pop")
+	_, status, err = w.processMsg(context.Background(), testSendTXMsg(), false)
+	assert.Equal(502, status)
+	_, status, err = w.processMsg(context.Background(), testSendTXMsg(), false)
+	assert.Equal(503, status)
+	assert.Regexp("circuit breaker is open", err)
+	assert.Equal(2, handler.calls)
+
+	cbStatus := getCircuitBreakerStatus(t, router)
+	assert.Equal("open", cbStatus.State)
+	assert.Equal(2, cbStatus.ConsecutiveFailures)
+	assert.Equal(uint64(2), cbStatus.TotalFailures)
+	assert.Equal(uint64(1), cbStatus.TotalRejected)
+	assert.Equal(uint64(1), cbStatus.TripCount)
+	assert.Equal("pop", cbStatus.LastFailure)
+	assert.NotNil(cbStatus.LastTripped)
+
+	// Half-open after the reset timeout - a failure re-opens immediately
+	w.breaker.resetTimeout = 0
+	_, status, err = w.processMsg(context.Background(), testSendTXMsg(), false)
+	assert.Equal(502, status)
+	assert.Equal(uint64(2), getCircuitBreakerStatus(t, router).TripCount)
+
+	// ... and a success closes
+	handler.status = 200
+	handler.err = nil
+	_, status, err = w.processMsg(context.Background(), testSendTXMsg(), false)
+	assert.NoError(err)
+	assert.Equal(200, status)
+	cbStatus = getCircuitBreakerStatus(t, router)
+	assert.Equal("closed", cbStatus.State)
+	assert.Equal(0, cbStatus.ConsecutiveFailures)
+	assert.Equal(uint64(1), cbStatus.TotalSuccesses)
+	assert.Equal([]string{opsevents.CircuitBreakerOpened, opsevents.CircuitBreakerOpened, opsevents.CircuitBreakerClosed}, opsEvents)
+}
+
+func TestCircuitBreakerHalfOpenSingleProbe(t *testing.T) {
+	assert := assert.New(t)
+
+	cb := newCircuitBreaker(&CircuitBreakerConf{FailureThreshold: 1})
+	assert.NoError(cb.allow())
+	cb.record(502, fmt.Errorf("pop"))
+	assert.Regexp("circuit breaker is open", cb.allow())
+
+	// Only one probe is admitted while half-open
+	cb.resetTimeout = 0
+	assert.NoError(cb.allow())
+	assert.Regexp("circuit breaker is open", cb.allow())
+	assert.Regexp("circuit breaker is open", cb.allow())
+	assert.Equal(circuitBreakerHalfOpen, cb.getStatus().State)
+
+	// An invalid message does not decide the state, so the next dispatch probes
+	cb.record(400, fmt.Errorf("bad request"))
+	assert.Equal(circuitBreakerHalfOpen, cb.getStatus().State)
+	assert.NoError(cb.allow())
+	assert.Regexp("circuit breaker is open", cb.allow())
+
+	// A successful probe closes the breaker for everyone
+	cb.record(200, nil)
+	assert.Equal(circuitBreakerClosed, cb.getStatus().State)
+	assert.NoError(cb.allow())
+	assert.NoError(cb.allow())
+	assert.Equal(uint64(4), cb.getStatus().TotalRejected)
+}
+
+func TestCircuitBreakerIgnoresBadRequests(t *testing.T) {
+	assert := assert.New(t)
+
+	handler := &mockFailingHandler{status: 400, err: fmt.Errorf("pop")}
+	w, router := newTestCircuitBreakerWebhooks(&CircuitBreakerConf{
+		FailureThreshold: 1,
+	}, handler)
+
+	_, status, _ := w.processMsg(context.Background(), testSendTXMsg(), false)
+	assert.Equal(400, status)
+	_, status, _ = w.processMsg(context.Background(), testSendTXMsg(), false)
+	assert.Equal(400, status)
+
+	cbStatus := getCircuitBreakerStatus(t, router)
+	assert.Equal("closed", cbStatus.State)
+	assert.Equal(uint64(0), cbStatus.TotalFailures)
+}
+
+func TestCircuitBreakerManualOverride(t *testing.T) {
+	assert := assert.New(t)
+
+	handler := &mockFailingHandler{status: 429, err: fmt.Errorf("pop")}
+	w, router := newTestCircuitBreakerWebhooks(&CircuitBreakerConf{
+		FailureThreshold: 1,
+	}, handler)
+
+	setOverride := func(override string) int {
+		body, _ := json.Marshal(&circuitBreakerOverride{Override: override})
+		req := httptest.NewRequest("PUT", "/status/circuitbreaker", bytes.NewReader(body))
+		res := httptest.NewRecorder()
+		router.ServeHTTP(res, req)
+		return res.Code
+	}
+
+	// Force open
+	assert.Equal(200, setOverride("open"))
+	handler.status = 200
+	handler.err = nil
+	_, status, _ := w.processMsg(context.Background(), testSendTXMsg(), false)
+	assert.Equal(503, status)
+	cbStatus := getCircuitBreakerStatus(t, router)
+	assert.Equal("open", cbStatus.State)
+	assert.Equal("open", cbStatus.Override)
+
+	// Force closed, even while failing
+	assert.Equal(200, setOverride("closed"))
+	handler.status = 429
+	handler.err = fmt.Errorf("pop")
+	_, status, _ = w.processMsg(context.Background(), testSendTXMsg(), false)
+	assert.Equal(429, status)
+	_, status, _ = w.processMsg(context.Background(), testSendTXMsg(), false)
+	assert.Equal(429, status)
+	assert.Equal("closed", getCircuitBreakerStatus(t, router).State)
+
+	// Back to automatic control, where the failures have tripped the breaker
+	assert.Equal(200, setOverride(""))
+	cbStatus = getCircuitBreakerStatus(t, router)
+	assert.Equal("open", cbStatus.State)
+	assert.Empty(cbStatus.Override)
+}
+
+func TestCircuitBreakerBadOverride(t *testing.T) {
+	assert := assert.New(t)
+
+	_, router := newTestCircuitBreakerWebhooks(&CircuitBreakerConf{}, &mockHandler{})
+
+	req := httptest.NewRequest("PUT", "/status/circuitbreaker", bytes.NewReader([]byte(`{"override":"ajar"}`)))
+	res := httptest.NewRecorder()
+	router.ServeHTTP(res, req)
+	assert.Equal(400, res.Code)
+	var errReply errMsg
+	json.NewDecoder(res.Body).Decode(&errReply)
+	assert.Regexp("Invalid circuit breaker override 'ajar'", errReply.Message)
+
+	req = httptest.NewRequest("PUT", "/status/circuitbreaker", bytes.NewReader([]byte(`!json`)))
+	res = httptest.NewRecorder()
+	router.ServeHTTP(res, req)
+	assert.Equal(400, res.Code)
+}
+
+type testCircuitBreakerSecurityModule struct {
+	authtest.TestSecurityModule
+}
+
+func (sm *testCircuitBreakerSecurityModule) AuthAdmin(authCtx interface{}, operation string, args ...interface{}) error {
+	if operation == "circuitbreaker.override" && len(args) == 1 && args[0] == "closed" {
+		return nil
+	}
+	return fmt.Errorf("badness")
+}
+
+func TestCircuitBreakerOverrideAuthorization(t *testing.T) {
+	assert := assert.New(t)
+
+	_, router := newTestCircuitBreakerWebhooks(&CircuitBreakerConf{}, &mockHandler{})
+	auth.RegisterSecurityModule(&testCircuitBreakerSecurityModule{})
+	defer auth.RegisterSecurityModule(nil)
+
+	setOverride := func(ctx context.Context, override string) int {
+		body, _ := json.Marshal(&circuitBreakerOverride{Override: override})
+		req := httptest.NewRequest("PUT", "/status/circuitbreaker", bytes.NewReader(body)).WithContext(ctx)
+		res := httptest.NewRecorder()
+		router.ServeHTTP(res, req)
+		return res.Code
+	}
+
+	authCtx, _ := auth.WithAuthContext(context.Background(), "testat")
+	assert.Equal(401, setOverride(context.Background(), "closed"))
+	assert.Equal(401, setOverride(authCtx, "open"))
+	assert.Equal("closed", getCircuitBreakerStatus(t, router).State)
+	assert.Empty(getCircuitBreakerStatus(t, router).Override)
+	assert.Equal(200, setOverride(authCtx, "closed"))
+	assert.Equal("closed", getCircuitBreakerStatus(t, router).Override)
+}
+
+func TestCircuitBreakerDefaultResetTimeout(t *testing.T) {
+	cb := newCircuitBreaker(&CircuitBreakerConf{})
+	assert.Equal(t, 30*time.Second, cb.resetTimeout)
+}
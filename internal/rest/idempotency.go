@@ -0,0 +1,329 @@
+// Copyright 2021 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rest
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kaleido-io/ethconnect/internal/auth"
+	"github.com/kaleido-io/ethconnect/internal/errors"
+	"github.com/kaleido-io/ethconnect/internal/kvstore"
+	"github.com/kaleido-io/ethconnect/internal/utils"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// IdempotencyKeyHeader is the standard header for the idempotency key of a request
+	IdempotencyKeyHeader = "Idempotency-Key"
+	// IdempotentReplayedHeader is set on a response that was replayed from the dedupe table
+	IdempotentReplayedHeader = "Idempotent-Replayed"
+
+	defaultIdempotencyRetentionSec     = 24 * 60 * 60
+	defaultIdempotencyPurgeIntervalSec = 5 * 60
+	maxIdempotencyKeyLength            = 255
+	idempotencyPrefix                  = "idem/"
+	idempotencyPrefixEnd               = "idem0"
+)
+
+// IdempotencyConf configures de-duplication of POST requests that carry an idempotency key,
+// so a client that retries after a timeout does not submit the same transaction twice
+type IdempotencyConf struct {
+	Enabled bool `json:"enabled"`
+	// DB is a KV store connection string to persist the dedupe table. It is held in memory if not set
+	DB               string `json:"db,omitempty"`
+	RetentionSec     uint32 `json:"retentionSec,omitempty"`
+	PurgeIntervalSec uint32 `json:"purgeIntervalSec,omitempty"`
+}
+
+// idempotencyRecord is the stored response to the first request with an idempotency key.
+// The fingerprint detects a key being reused for a different request
+type idempotencyRecord struct {
+	Fingerprint string `json:"fingerprint"`
+	RequestID   string `json:"requestId,omitempty"`
+	Status      int    `json:"status"`
+	ContentType string `json:"contentType,omitempty"`
+	Body        []byte `json:"body,omitempty"`
+	Created     int64  `json:"created"`
+}
+
+// idempotency records the response to each successful POST with an idempotency key, and
+// replays it to later requests with the same key - rather than processing them again.
+// Keys are scoped to the tenant and principal of the request, and forgotten after the
+// retention period
+type idempotency struct {
+	conf     *IdempotencyConf
+	db       kvstore.KVStore
+	mux      sync.Mutex
+	inflight map[string]bool
+	ctx      context.Context
+	cancel   func()
+	done     chan struct{}
+}
+
+func newIdempotency(conf *IdempotencyConf) (i *idempotency, err error) {
+	if conf.RetentionSec == 0 {
+		conf.RetentionSec = defaultIdempotencyRetentionSec
+	}
+	if conf.PurgeIntervalSec == 0 {
+		conf.PurgeIntervalSec = defaultIdempotencyPurgeIntervalSec
+	}
+	i = &idempotency{
+		conf:     conf,
+		inflight: make(map[string]bool),
+		done:     make(chan struct{}),
+	}
+	if conf.DB != "" {
+		if i.db, err = kvstore.NewKeyValueStore(conf.DB); err != nil {
+			return nil, errors.Errorf(errors.RESTGatewayIdempotencyDBOpen, err)
+		}
+	} else {
+		i.db = kvstore.NewMemoryKeyValueStore()
+	}
+	i.ctx, i.cancel = context.WithCancel(context.Background())
+	return i, nil
+}
+
+func (i *idempotency) start() {
+	go i.run()
+}
+
+func (i *idempotency) close() {
+	i.cancel()
+	<-i.done
+	i.db.Close()
+}
+
+func (i *idempotency) run() {
+	defer close(i.done)
+	ticker := time.NewTicker(time.Duration(i.conf.PurgeIntervalSec) * time.Second)
+	defer ticker.Stop()
+	for {
+		i.purge()
+		select {
+		case <-ticker.C:
+		case <-i.ctx.Done():
+			log.Debugf("Idempotency key purger stopped")
+			return
+		}
+	}
+}
+
+func (i *idempotency) expired(record *idempotencyRecord) bool {
+	return time.Since(time.Unix(0, record.Created)) > time.Duration(i.conf.RetentionSec)*time.Second
+}
+
+// purge deletes the records that are older than the retention period
+func (i *idempotency) purge() {
+	var expired []string
+	it := i.db.NewIteratorWithRange(&kvstore.KVRange{Start: idempotencyPrefix, Limit: idempotencyPrefixEnd})
+	for it.Next() {
+		var record idempotencyRecord
+		if err := json.Unmarshal(it.Value(), &record); err != nil || i.expired(&record) {
+			expired = append(expired, it.Key())
+		}
+	}
+	it.Release()
+	for _, key := range expired {
+		if err := i.db.Delete(key); err != nil {
+			log.Warnf("Failed to purge idempotency key '%s': %s", key, err)
+		}
+	}
+	if len(expired) > 0 {
+		log.Debugf("Purged %d expired idempotency keys", len(expired))
+	}
+}
+
+// getIdempotencyKey returns the key from the Idempotency-Key header, or the fly-idempotency-key
+// query parameter or header
+func getIdempotencyKey(req *http.Request) string {
+	if key := req.Header.Get(IdempotencyKeyHeader); key != "" {
+		return key
+	}
+	if key := req.URL.Query().Get(utils.GetenvOrDefaultLowerCase("PREFIX_SHORT", "fly") + "-idempotency-key"); key != "" {
+		return key
+	}
+	return req.Header.Get("x-" + utils.GetenvOrDefaultLowerCase("PREFIX_LONG", "firefly") + "-idempotency-key")
+}
+
+// storeKey scopes the idempotency key to the tenant and principal of the request, so
+// keys chosen by different callers cannot collide
+func storeKey(ctx context.Context, key string) string {
+	return idempotencyPrefix + auth.GetTenant(ctx) + "/" + auth.GetPrincipal(ctx) + "/" + key
+}
+
+// fingerprint is a hash of the method, URL and body of a request
+func fingerprint(req *http.Request, body []byte) string {
+	h := sha256.New()
+	h.Write([]byte(req.Method + " " + req.URL.Path + "?" + req.URL.RawQuery + "\n"))
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func (i *idempotency) lookup(key string) *idempotencyRecord {
+	b, err := i.db.Get(key)
+	if err != nil {
+		if err != kvstore.ErrorNotFound {
+			log.Warnf("Failed to look up idempotency key '%s': %s", key, err)
+		}
+		return nil
+	}
+	var record idempotencyRecord
+	if err := json.Unmarshal(b, &record); err != nil || i.expired(&record) {
+		return nil
+	}
+	return &record
+}
+
+// begin claims a key for a request, returning the stored record if the key has already
+// been used. The boolean is false if a request with the same key is still being processed
+func (i *idempotency) begin(key string) (*idempotencyRecord, bool) {
+	i.mux.Lock()
+	defer i.mux.Unlock()
+	if i.inflight[key] {
+		return nil, false
+	}
+	if record := i.lookup(key); record != nil {
+		return record, true
+	}
+	i.inflight[key] = true
+	return nil, true
+}
+
+func (i *idempotency) end(key string, record *idempotencyRecord) {
+	i.mux.Lock()
+	defer i.mux.Unlock()
+	delete(i.inflight, key)
+	if record == nil {
+		return
+	}
+	b, _ := json.Marshal(record)
+	if err := i.db.Put(key, b); err != nil {
+		log.Errorf("Failed to store idempotency key '%s' for request %s: %s", key, record.RequestID, err)
+	}
+}
+
+// idempotencyResponseWriter keeps a copy of the response as it is written
+type idempotencyResponseWriter struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (w *idempotencyResponseWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *idempotencyResponseWriter) Write(b []byte) (int, error) {
+	w.body.Write(b)
+	return w.ResponseWriter.Write(b)
+}
+
+func sendIdempotencyError(res http.ResponseWriter, err error, status int) {
+	log.Errorf("Idempotency check failed: %s", err)
+	reply, _ := json.Marshal(&errMsg{Message: err.Error()})
+	res.Header().Set("Content-Type", "application/json")
+	res.WriteHeader(status)
+	res.Write(reply)
+}
+
+// newIdempotencyHandler de-duplicates POST requests with an idempotency key. Only successful
+// responses are stored, so a request that failed can be retried with the same key
+func (i *idempotency) newIdempotencyHandler(parent http.Handler) http.Handler {
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost {
+			parent.ServeHTTP(res, req)
+			return
+		}
+		idemKey := getIdempotencyKey(req)
+		if idemKey == "" {
+			parent.ServeHTTP(res, req)
+			return
+		}
+		if len(idemKey) > maxIdempotencyKeyLength || strings.ContainsAny(idemKey, "/\x00") {
+			sendIdempotencyError(res, errors.Errorf(errors.RESTGatewayIdempotencyKeyInvalid, maxIdempotencyKeyLength), 400)
+			return
+		}
+		var body []byte
+		if req.Body != nil {
+			var err error
+			if body, err = ioutil.ReadAll(req.Body); err != nil {
+				// A partial body must not be fingerprinted, or a retry of the full body would not match
+				sendIdempotencyError(res, errors.Errorf(errors.RESTGatewayIdempotencyBodyRead, err), 400)
+				return
+			}
+			req.Body = ioutil.NopCloser(bytes.NewReader(body))
+		}
+		fp := fingerprint(req, body)
+		key := storeKey(req.Context(), idemKey)
+
+		record, ok := i.begin(key)
+		if !ok {
+			sendIdempotencyError(res, errors.Errorf(errors.RESTGatewayIdempotencyKeyInFlight, idemKey), 409)
+			return
+		}
+		if record != nil {
+			if record.Fingerprint != fp {
+				sendIdempotencyError(res, errors.Errorf(errors.RESTGatewayIdempotencyKeyReused, idemKey), 422)
+				return
+			}
+			log.Infof("Replaying response to request %s for idempotency key '%s'", record.RequestID, idemKey)
+			if record.ContentType != "" {
+				res.Header().Set("Content-Type", record.ContentType)
+			}
+			res.Header().Set(IdempotentReplayedHeader, "true")
+			res.WriteHeader(record.Status)
+			res.Write(record.Body)
+			return
+		}
+
+		rw := &idempotencyResponseWriter{ResponseWriter: res, status: 200}
+		completed := false
+		defer func() {
+			// Release the key if the handler panics, so the request can be retried
+			if !completed {
+				i.end(key, nil)
+			}
+		}()
+		parent.ServeHTTP(rw, req)
+		completed = true
+
+		if rw.status < 200 || rw.status >= 300 {
+			i.end(key, nil)
+			return
+		}
+		var reply struct {
+			ID string `json:"id"`
+		}
+		json.Unmarshal(rw.body.Bytes(), &reply)
+		i.end(key, &idempotencyRecord{
+			Fingerprint: fp,
+			RequestID:   reply.ID,
+			Status:      rw.status,
+			ContentType: res.Header().Get("Content-Type"),
+			Body:        rw.body.Bytes(),
+			Created:     time.Now().UnixNano(),
+		})
+	})
+}
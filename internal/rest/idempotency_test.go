@@ -0,0 +1,293 @@
+// Copyright 2021 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rest
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/kaleido-io/ethconnect/internal/kvstore"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestIdempotencyServer(t *testing.T, conf *IdempotencyConf, status int, calls *int32) (*idempotency, *httptest.Server) {
+	i, err := newIdempotency(conf)
+	assert.NoError(t, err)
+	i.start()
+	router := httprouter.New()
+	handler := func(res http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+		n := atomic.AddInt32(calls, 1)
+		res.Header().Set("Content-Type", "application/json")
+		res.WriteHeader(status)
+		res.Write([]byte(fmt.Sprintf(`{"sent":true,"id":"req%d"}`, n)))
+	}
+	router.POST("/contracts/:address/:method", handler)
+	router.GET("/contracts/:address/:method", handler)
+	return i, httptest.NewServer(i.newIdempotencyHandler(router))
+}
+
+func postWithIdempotencyKey(t *testing.T, url, key, body string) (*http.Response, string) {
+	req, _ := http.NewRequest("POST", url, strings.NewReader(body))
+	if key != "" {
+		req.Header.Set("Idempotency-Key", key)
+	}
+	res, err := http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	b, _ := ioutil.ReadAll(res.Body)
+	return res, string(b)
+}
+
+func TestIdempotencyReplaysResponse(t *testing.T) {
+	assert := assert.New(t)
+	var calls int32
+	i, ts := newTestIdempotencyServer(t, &IdempotencyConf{}, 202, &calls)
+	defer ts.Close()
+	defer i.close()
+
+	res, body := postWithIdempotencyKey(t, ts.URL+"/contracts/mycontract/set", "key1", `{"x":1}`)
+	assert.Equal(202, res.StatusCode)
+	assert.Equal(`{"sent":true,"id":"req1"}`, body)
+	assert.Empty(res.Header.Get(IdempotentReplayedHeader))
+
+	res, body = postWithIdempotencyKey(t, ts.URL+"/contracts/mycontract/set", "key1", `{"x":1}`)
+	assert.Equal(202, res.StatusCode)
+	assert.Equal(`{"sent":true,"id":"req1"}`, body)
+	assert.Equal("application/json", res.Header.Get("Content-Type"))
+	assert.Equal("true", res.Header.Get(IdempotentReplayedHeader))
+	assert.Equal(int32(1), atomic.LoadInt32(&calls))
+
+	// A different key, or no key, is processed
+	_, body = postWithIdempotencyKey(t, ts.URL+"/contracts/mycontract/set", "key2", `{"x":1}`)
+	assert.Equal(`{"sent":true,"id":"req2"}`, body)
+	_, body = postWithIdempotencyKey(t, ts.URL+"/contracts/mycontract/set", "", `{"x":1}`)
+	assert.Equal(`{"sent":true,"id":"req3"}`, body)
+
+	record := i.lookup(idempotencyPrefix + "//key1")
+	assert.Equal("req1", record.RequestID)
+}
+
+func TestIdempotencyFlyParams(t *testing.T) {
+	assert := assert.New(t)
+	var calls int32
+	i, ts := newTestIdempotencyServer(t, &IdempotencyConf{}, 202, &calls)
+	defer ts.Close()
+	defer i.close()
+
+	postWithIdempotencyKey(t, ts.URL+"/contracts/mycontract/set?fly-idempotency-key=key1", "", `{}`)
+	req, _ := http.NewRequest("POST", ts.URL+"/contracts/mycontract/set?fly-idempotency-key=key1", strings.NewReader(`{}`))
+	res, _ := http.DefaultClient.Do(req)
+	assert.Equal("true", res.Header.Get(IdempotentReplayedHeader))
+
+	req, _ = http.NewRequest("POST", ts.URL+"/contracts/mycontract/set", strings.NewReader(`{}`))
+	req.Header.Set("x-firefly-idempotency-key", "key2")
+	http.DefaultClient.Do(req)
+	req, _ = http.NewRequest("POST", ts.URL+"/contracts/mycontract/set", strings.NewReader(`{}`))
+	req.Header.Set("x-firefly-idempotency-key", "key2")
+	res, _ = http.DefaultClient.Do(req)
+	assert.Equal("true", res.Header.Get(IdempotentReplayedHeader))
+	assert.Equal(int32(2), atomic.LoadInt32(&calls))
+}
+
+func TestIdempotencyKeyReusedForDifferentRequest(t *testing.T) {
+	assert := assert.New(t)
+	var calls int32
+	i, ts := newTestIdempotencyServer(t, &IdempotencyConf{}, 202, &calls)
+	defer ts.Close()
+	defer i.close()
+
+	postWithIdempotencyKey(t, ts.URL+"/contracts/mycontract/set", "key1", `{"x":1}`)
+	res, body := postWithIdempotencyKey(t, ts.URL+"/contracts/mycontract/set", "key1", `{"x":2}`)
+	assert.Equal(422, res.StatusCode)
+	assert.Regexp("Idempotency key 'key1' was previously used for a different request", body)
+	res, _ = postWithIdempotencyKey(t, ts.URL+"/contracts/othercontract/set", "key1", `{"x":1}`)
+	assert.Equal(422, res.StatusCode)
+	assert.Equal(int32(1), atomic.LoadInt32(&calls))
+}
+
+func TestIdempotencyFailuresNotStored(t *testing.T) {
+	assert := assert.New(t)
+	var calls int32
+	i, ts := newTestIdempotencyServer(t, &IdempotencyConf{}, 500, &calls)
+	defer ts.Close()
+	defer i.close()
+
+	res, _ := postWithIdempotencyKey(t, ts.URL+"/contracts/mycontract/set", "key1", `{}`)
+	assert.Equal(500, res.StatusCode)
+	res, _ = postWithIdempotencyKey(t, ts.URL+"/contracts/mycontract/set", "key1", `{}`)
+	assert.Equal(500, res.StatusCode)
+	assert.Empty(res.Header.Get(IdempotentReplayedHeader))
+	assert.Equal(int32(2), atomic.LoadInt32(&calls))
+}
+
+type idempotencyErrReader struct{}
+
+func (idempotencyErrReader) Read(p []byte) (int, error) {
+	return 0, fmt.Errorf("pop")
+}
+
+func TestIdempotencyBodyReadFailure(t *testing.T) {
+	assert := assert.New(t)
+	i, err := newIdempotency(&IdempotencyConf{})
+	assert.NoError(err)
+	i.start()
+	defer i.close()
+	called := false
+	handler := i.newIdempotencyHandler(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		called = true
+	}))
+
+	req := httptest.NewRequest("POST", "/contracts/mycontract/set", idempotencyErrReader{})
+	req.Header.Set("Idempotency-Key", "key1")
+	res := httptest.NewRecorder()
+	handler.ServeHTTP(res, req)
+	assert.Equal(400, res.Code)
+	assert.Regexp("Failed to read the body of the request: pop", res.Body.String())
+	assert.False(called)
+	assert.Nil(i.lookup(idempotencyPrefix + "//key1"))
+
+	// Nothing was stored against the key, so the retry is processed
+	req = httptest.NewRequest("POST", "/contracts/mycontract/set", strings.NewReader(`{}`))
+	req.Header.Set("Idempotency-Key", "key1")
+	res = httptest.NewRecorder()
+	handler.ServeHTTP(res, req)
+	assert.Equal(200, res.Code)
+	assert.True(called)
+}
+
+func TestIdempotencyIgnoresGET(t *testing.T) {
+	var calls int32
+	i, ts := newTestIdempotencyServer(t, &IdempotencyConf{}, 200, &calls)
+	defer ts.Close()
+	defer i.close()
+
+	for n := 0; n < 2; n++ {
+		req, _ := http.NewRequest("GET", ts.URL+"/contracts/mycontract/get", nil)
+		req.Header.Set("Idempotency-Key", "key1")
+		http.DefaultClient.Do(req)
+	}
+	assert.Equal(t, int32(2), atomic.LoadInt32(&calls))
+}
+
+func TestIdempotencyInvalidKey(t *testing.T) {
+	var calls int32
+	i, ts := newTestIdempotencyServer(t, &IdempotencyConf{}, 202, &calls)
+	defer ts.Close()
+	defer i.close()
+
+	res, body := postWithIdempotencyKey(t, ts.URL+"/contracts/mycontract/set", "a/b", `{}`)
+	assert.Equal(t, 400, res.StatusCode)
+	assert.Regexp(t, "Idempotency keys must be at most 255 characters", body)
+	res, _ = postWithIdempotencyKey(t, ts.URL+"/contracts/mycontract/set", strings.Repeat("a", 256), `{}`)
+	assert.Equal(t, 400, res.StatusCode)
+	assert.Equal(t, int32(0), atomic.LoadInt32(&calls))
+}
+
+func TestIdempotencyInFlight(t *testing.T) {
+	assert := assert.New(t)
+	i, err := newIdempotency(&IdempotencyConf{})
+	assert.NoError(err)
+	i.start()
+	defer i.close()
+
+	record, ok := i.begin("idem///key1")
+	assert.Nil(record)
+	assert.True(ok)
+	_, ok = i.begin("idem///key1")
+	assert.False(ok)
+
+	router := httprouter.New()
+	router.POST("/test", func(res http.ResponseWriter, req *http.Request, _ httprouter.Params) {})
+	ts := httptest.NewServer(i.newIdempotencyHandler(router))
+	defer ts.Close()
+	res, body := postWithIdempotencyKey(t, ts.URL+"/test", "key1", `{}`)
+	assert.Equal(409, res.StatusCode)
+	assert.Regexp("A request with idempotency key 'key1' is already being processed", body)
+
+	i.end("idem///key1", nil)
+	record, ok = i.begin("idem///key1")
+	assert.Nil(record)
+	assert.True(ok)
+}
+
+func TestIdempotencyPanicReleasesKey(t *testing.T) {
+	assert := assert.New(t)
+	i, _ := newIdempotency(&IdempotencyConf{})
+	i.start()
+	defer i.close()
+
+	handler := i.newIdempotencyHandler(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		panic("pop")
+	}))
+	req := httptest.NewRequest("POST", "/test", strings.NewReader(`{}`))
+	req.Header.Set("Idempotency-Key", "key1")
+	assert.Panics(func() {
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+	})
+	_, ok := i.begin("idem///key1")
+	assert.True(ok)
+}
+
+func TestIdempotencyPurge(t *testing.T) {
+	assert := assert.New(t)
+	dir, _ := ioutil.TempDir("", "idempotency")
+	defer os.RemoveAll(dir)
+	i, err := newIdempotency(&IdempotencyConf{DB: path.Join(dir, "db"), RetentionSec: 60})
+	assert.NoError(err)
+
+	old, _ := json.Marshal(&idempotencyRecord{Fingerprint: "abc", Created: time.Now().Add(-2 * time.Minute).UnixNano()})
+	recent, _ := json.Marshal(&idempotencyRecord{Fingerprint: "abc", Created: time.Now().UnixNano()})
+	i.db.Put("idem///old", old)
+	i.db.Put("idem///recent", recent)
+	i.db.Put("idem///bad", []byte("!json"))
+	i.db.Put("other", old)
+
+	assert.Nil(i.lookup("idem///old"))
+	assert.Nil(i.lookup("idem///bad"))
+	i.purge()
+	_, err = i.db.Get("idem///old")
+	assert.Equal(kvstore.ErrorNotFound, err)
+	_, err = i.db.Get("idem///bad")
+	assert.Equal(kvstore.ErrorNotFound, err)
+	assert.NotNil(i.lookup("idem///recent"))
+	_, err = i.db.Get("other")
+	assert.NoError(err)
+
+	i.start()
+	i.close()
+}
+
+func TestIdempotencyDBOpenFail(t *testing.T) {
+	_, err := newIdempotency(&IdempotencyConf{DB: "unknown://"})
+	assert.Regexp(t, "Failed to open the idempotency key store", err)
+}
+
+func TestIdempotencyStoreErrors(t *testing.T) {
+	i, _ := newIdempotency(&IdempotencyConf{})
+	i.start()
+	i.close()
+	i.db = kvstore.NewMockKV(fmt.Errorf("pop"))
+	assert.Nil(t, i.lookup("idem///key1"))
+	i.end("idem///key1", &idempotencyRecord{})
+}
@@ -0,0 +1,472 @@
+// Copyright 2021 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rest
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"reflect"
+	"strings"
+	"time"
+
+	lru "github.com/hashicorp/golang-lru"
+	ethbinding "github.com/kaleido-io/ethbinding/pkg"
+	"github.com/kaleido-io/ethconnect/internal/auth"
+	"github.com/kaleido-io/ethconnect/internal/errors"
+	"github.com/kaleido-io/ethconnect/internal/eth"
+	"github.com/kaleido-io/ethconnect/internal/ethbind"
+	"github.com/kaleido-io/ethconnect/internal/messages"
+	"github.com/kaleido-io/ethconnect/internal/tx"
+	"github.com/kaleido-io/ethconnect/internal/utils"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	defaultJSONRPCTxCacheSize = 1000
+
+	jsonrpcVersion        = "2.0"
+	jsonrpcParseError     = -32700
+	jsonrpcInvalidRequest = -32600
+	jsonrpcMethodNotFound = -32601
+	jsonrpcInvalidParams  = -32602
+	jsonrpcServerError    = -32000
+)
+
+// jsonrpcPassthroughMethods are the read-only methods that are passed straight through to the
+// node. Methods that submit or sign with keys held by the node, such as eth_sendRawTransaction,
+// eth_sign and eth_accounts, are not exposed, as they bypass the nonce management of ethconnect
+var jsonrpcPassthroughMethods = map[string]bool{
+	"eth_blockNumber":                         true,
+	"eth_call":                                true,
+	"eth_chainId":                             true,
+	"eth_estimateGas":                         true,
+	"eth_feeHistory":                          true,
+	"eth_gasPrice":                            true,
+	"eth_getBalance":                          true,
+	"eth_getBlockByHash":                      true,
+	"eth_getBlockByNumber":                    true,
+	"eth_getBlockTransactionCountByHash":      true,
+	"eth_getBlockTransactionCountByNumber":    true,
+	"eth_getCode":                             true,
+	"eth_getFilterChanges":                    true,
+	"eth_getFilterLogs":                       true,
+	"eth_getLogs":                             true,
+	"eth_getStorageAt":                        true,
+	"eth_getTransactionByBlockHashAndIndex":   true,
+	"eth_getTransactionByBlockNumberAndIndex": true,
+	"eth_getTransactionByHash":                true,
+	"eth_getTransactionCount":                 true,
+	"eth_getTransactionReceipt":               true,
+	"eth_getUncleByBlockHashAndIndex":         true,
+	"eth_getUncleByBlockNumberAndIndex":       true,
+	"eth_getUncleCountByBlockHash":            true,
+	"eth_getUncleCountByBlockNumber":          true,
+	"eth_maxPriorityFeePerGas":                true,
+	"eth_newBlockFilter":                      true,
+	"eth_newFilter":                           true,
+	"eth_protocolVersion":                     true,
+	"eth_syncing":                             true,
+	"eth_uninstallFilter":                     true,
+	"net_listening":                           true,
+	"net_peerCount":                           true,
+	"net_version":                             true,
+	"web3_clientVersion":                      true,
+	"web3_sha3":                               true,
+}
+
+// JSONRPCFacadeConf configures the optional listener that speaks standard Ethereum JSON-RPC,
+// so existing web3 libraries and tools can use ethconnect as their node
+type JSONRPCFacadeConf struct {
+	LocalAddr   string          `json:"localAddr"`
+	Port        int             `json:"port"`
+	TLS         utils.TLSConfig `json:"tls"`
+	TxCacheSize int             `json:"txCacheSize"`
+}
+
+type jsonrpcRequest struct {
+	JSONRPC string            `json:"jsonrpc"`
+	ID      json.RawMessage   `json:"id"`
+	Method  string            `json:"method"`
+	Params  []json.RawMessage `json:"params"`
+}
+
+type jsonrpcError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+type jsonrpcResponse struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id"`
+	Result  json.RawMessage `json:"result,omitempty"`
+	Error   *jsonrpcError   `json:"error,omitempty"`
+}
+
+// jsonrpcTxnArgs are the eth_sendTransaction arguments, with quantities hex encoded
+type jsonrpcTxnArgs struct {
+	From     string `json:"from"`
+	To       string `json:"to"`
+	Gas      string `json:"gas"`
+	GasPrice string `json:"gasPrice"`
+	Value    string `json:"value"`
+	Nonce    string `json:"nonce"`
+	Data     string `json:"data"`
+	Input    string `json:"input"`
+	// EIP-1559 dynamic fee transactions
+	MaxFeePerGas         string `json:"maxFeePerGas"`
+	MaxPriorityFeePerGas string `json:"maxPriorityFeePerGas"`
+}
+
+// jsonrpcFacade maps standard Ethereum JSON-RPC calls onto ethconnect. Transactions are
+// submitted through the transaction processor for signing and nonce management, with the
+// replies written to the receipt store. Other read-only calls are passed through to the node
+type jsonrpcFacade struct {
+	conf       *JSONRPCFacadeConf
+	processor  tx.TxnProcessor
+	rpc        eth.RPCClient
+	receipts   *receiptStore
+	txRequests *lru.Cache
+}
+
+func newJSONRPCFacade(conf *JSONRPCFacadeConf, processor tx.TxnProcessor, rpc eth.RPCClient, receipts *receiptStore) (f *jsonrpcFacade, err error) {
+	if conf.TxCacheSize <= 0 {
+		conf.TxCacheSize = defaultJSONRPCTxCacheSize
+	}
+	f = &jsonrpcFacade{
+		conf:      conf,
+		processor: processor,
+		rpc:       rpc,
+		receipts:  receipts,
+	}
+	// Maps transaction hashes to the ethconnect request IDs their replies are stored under
+	f.txRequests, err = lru.New(conf.TxCacheSize)
+	return
+}
+
+type jsonrpcSubmitResult struct {
+	txHash string
+	err    error
+}
+
+// jsonrpcTxnContext is the context for a transaction submitted via eth_sendTransaction.
+// It outlives the JSON-RPC request, which only waits until the transaction is submitted
+type jsonrpcTxnContext struct {
+	ctx          context.Context
+	f            *jsonrpcFacade
+	timeReceived time.Time
+	headers      *messages.CommonHeaders
+	msg          interface{}
+	submitted    chan *jsonrpcSubmitResult
+}
+
+func (t *jsonrpcTxnContext) Context() context.Context {
+	return t.ctx
+}
+
+func (t *jsonrpcTxnContext) Headers() *messages.CommonHeaders {
+	return t.headers
+}
+
+func (t *jsonrpcTxnContext) TimeReceived() time.Time {
+	return t.timeReceived
+}
+
+func (t *jsonrpcTxnContext) Unmarshal(msg interface{}) error {
+	if reflect.TypeOf(msg) != reflect.TypeOf(t.msg) {
+		log.Errorf("Type mismatch: %s != %s", reflect.TypeOf(msg), reflect.TypeOf(t.msg))
+		return errors.Errorf(errors.RESTGatewaySyncMsgTypeMismatch)
+	}
+	reflect.ValueOf(msg).Elem().Set(reflect.ValueOf(t.msg).Elem())
+	return nil
+}
+
+func (t *jsonrpcTxnContext) TxnSubmitted(txHash string) {
+	t.f.txRequests.Add(strings.ToLower(txHash), t.headers.ID)
+	t.notify(&jsonrpcSubmitResult{txHash: txHash})
+}
+
+func (t *jsonrpcTxnContext) notify(result *jsonrpcSubmitResult) {
+	select {
+	case t.submitted <- result:
+	default:
+		// Only the first outcome is returned to the JSON-RPC caller
+	}
+}
+
+func (t *jsonrpcTxnContext) SendErrorReply(status int, err error) {
+	t.SendErrorReplyWithTX(status, err, "")
+}
+
+func (t *jsonrpcTxnContext) SendErrorReplyWithGapFill(status int, err error, gapFillTxHash string, gapFillSucceeded bool) {
+	t.SendErrorReplyWithTX(status, err, "")
+}
+
+func (t *jsonrpcTxnContext) SendErrorReplyWithTX(status int, err error, txHash string) {
+	log.Warnf("Failed to process message %s: %s", t, err)
+	errMsg := messages.NewErrorReply(err, t.msg)
+	errMsg.TXHash = txHash
+	t.Reply(errMsg)
+	t.notify(&jsonrpcSubmitResult{err: err})
+}
+
+func (t *jsonrpcTxnContext) Reply(replyMessage messages.ReplyWithHeaders) {
+	replyHeaders := replyMessage.ReplyHeaders()
+	replyHeaders.ID = utils.UUIDv4()
+	replyHeaders.Context = t.headers.Context
+	replyHeaders.ReqID = t.headers.ID
+	replyHeaders.Received = t.timeReceived.UTC().Format(time.RFC3339Nano)
+	replyTime := time.Now().UTC()
+	replyHeaders.Elapsed = replyTime.Sub(t.timeReceived).Seconds()
+	msgBytes, _ := json.Marshal(&replyMessage)
+	t.f.receipts.processReply(msgBytes)
+}
+
+func (t *jsonrpcTxnContext) String() string {
+	return fmt.Sprintf("JSONRPCContext[%s/%s]", t.headers.MsgType, t.headers.ID)
+}
+
+func (f *jsonrpcFacade) ServeHTTP(res http.ResponseWriter, req *http.Request) {
+	log.Infof("--> %s %s", req.Method, req.URL)
+
+	if req.Method != http.MethodPost {
+		f.reply(res, req, 405, jsonrpcErrorResponse(nil, jsonrpcInvalidRequest, errors.Errorf(errors.JSONRPCFacadeMethodNotSupported, req.Method)))
+		return
+	}
+	// The listener accepts any client, so the body is limited to the same size as the REST gateway
+	body, err := ioutil.ReadAll(http.MaxBytesReader(res, req.Body, utils.MaxPayloadSize))
+	if err != nil && len(body) >= utils.MaxPayloadSize {
+		f.reply(res, req, 413, jsonrpcErrorResponse(nil, jsonrpcInvalidRequest, errors.Errorf(errors.JSONRPCFacadeRequestTooLarge, utils.MaxPayloadSize)))
+		return
+	} else if err != nil {
+		f.reply(res, req, 400, jsonrpcErrorResponse(nil, jsonrpcParseError, errors.Errorf(errors.JSONRPCFacadeParseError, err)))
+		return
+	}
+
+	body = bytes.TrimSpace(body)
+	if len(body) > 0 && body[0] == '[' {
+		var batch []json.RawMessage
+		if err := json.Unmarshal(body, &batch); err != nil {
+			f.reply(res, req, 200, jsonrpcErrorResponse(nil, jsonrpcParseError, errors.Errorf(errors.JSONRPCFacadeParseError, err)))
+			return
+		}
+		if len(batch) == 0 {
+			f.reply(res, req, 200, jsonrpcErrorResponse(nil, jsonrpcInvalidRequest, errors.Errorf(errors.JSONRPCFacadeEmptyBatch)))
+			return
+		}
+		responses := make([]*jsonrpcResponse, len(batch))
+		for i, rpcReq := range batch {
+			responses[i] = f.processRequest(req.Context(), rpcReq)
+		}
+		f.reply(res, req, 200, responses)
+		return
+	}
+
+	f.reply(res, req, 200, f.processRequest(req.Context(), body))
+}
+
+func (f *jsonrpcFacade) processRequest(ctx context.Context, body []byte) *jsonrpcResponse {
+	var rpcReq jsonrpcRequest
+	if err := json.Unmarshal(body, &rpcReq); err != nil {
+		return jsonrpcErrorResponse(nil, jsonrpcParseError, errors.Errorf(errors.JSONRPCFacadeParseError, err))
+	}
+	if rpcReq.Method == "" {
+		return jsonrpcErrorResponse(rpcReq.ID, jsonrpcInvalidRequest, errors.Errorf(errors.JSONRPCFacadeMissingMethod))
+	}
+	log.Debugf("JSON-RPC request %s %s", rpcReq.ID, rpcReq.Method)
+
+	var result interface{}
+	var code int
+	var err error
+	switch rpcReq.Method {
+	case "eth_sendTransaction":
+		result, code, err = f.sendTransaction(ctx, rpcReq.Params)
+	case "eth_getTransactionReceipt":
+		result, code, err = f.getTransactionReceipt(ctx, rpcReq.Params)
+	default:
+		result, code, err = f.passthrough(ctx, rpcReq.Method, rpcReq.Params)
+	}
+	if err != nil {
+		log.Errorf("JSON-RPC request %s %s failed: %s", rpcReq.ID, rpcReq.Method, err)
+		return jsonrpcErrorResponse(rpcReq.ID, code, err)
+	}
+
+	resultBytes, _ := json.Marshal(result)
+	return &jsonrpcResponse{
+		JSONRPC: jsonrpcVersion,
+		ID:      rpcReq.ID,
+		Result:  resultBytes,
+	}
+}
+
+// jsonrpcErrorResponse builds the response to a request that failed
+func jsonrpcErrorResponse(id json.RawMessage, code int, err error) *jsonrpcResponse {
+	return &jsonrpcResponse{
+		JSONRPC: jsonrpcVersion,
+		ID:      id,
+		Error: &jsonrpcError{
+			Code:    code,
+			Message: err.Error(),
+		},
+	}
+}
+
+func (f *jsonrpcFacade) reply(res http.ResponseWriter, req *http.Request, status int, result interface{}) {
+	log.Infof("<-- %s %s [%d]", req.Method, req.URL, status)
+	res.Header().Set("Content-Type", "application/json")
+	res.WriteHeader(status)
+	json.NewEncoder(res).Encode(result)
+}
+
+// jsonrpcQuantity converts a hex encoded JSON-RPC quantity to the decimal form used in ethconnect messages
+func jsonrpcQuantity(name, hexValue string) (json.Number, error) {
+	if hexValue == "" {
+		return "", nil
+	}
+	i, ok := new(big.Int).SetString(strings.TrimPrefix(strings.TrimPrefix(hexValue, "0x"), "0X"), 16)
+	if !ok {
+		return "", errors.Errorf(errors.JSONRPCFacadeInvalidQuantity, hexValue, name)
+	}
+	return json.Number(i.String()), nil
+}
+
+func (f *jsonrpcFacade) buildTxnMessage(args *jsonrpcTxnArgs) (msg interface{}, headers *messages.CommonHeaders, err error) {
+	common := messages.TransactionCommon{From: args.From}
+	if common.Nonce, err = jsonrpcQuantity("nonce", args.Nonce); err != nil {
+		return
+	}
+	if common.Value, err = jsonrpcQuantity("value", args.Value); err != nil {
+		return
+	}
+	if common.Gas, err = jsonrpcQuantity("gas", args.Gas); err != nil {
+		return
+	}
+	if common.GasPrice, err = jsonrpcQuantity("gasPrice", args.GasPrice); err != nil {
+		return
+	}
+	if common.MaxFeePerGas, err = jsonrpcQuantity("maxFeePerGas", args.MaxFeePerGas); err != nil {
+		return
+	}
+	if common.MaxPriorityFeePerGas, err = jsonrpcQuantity("maxPriorityFeePerGas", args.MaxPriorityFeePerGas); err != nil {
+		return
+	}
+	data := args.Data
+	if data == "" {
+		data = args.Input
+	}
+
+	if args.To == "" {
+		// A transaction without a "to" address is a contract deployment of the bytecode in the data
+		if data == "" {
+			err = errors.Errorf(errors.JSONRPCFacadeMissingDeployData)
+			return
+		}
+		deployMsg := &messages.DeployContract{TransactionCommon: common}
+		if deployMsg.Compiled, err = ethbind.API.HexDecode(data); err != nil {
+			err = errors.Errorf(errors.TransactionSendBadData, err)
+			return
+		}
+		deployMsg.ABI = ethbinding.ABIMarshaling{}
+		deployMsg.Headers.MsgType = messages.MsgTypeDeployContract
+		return deployMsg, &deployMsg.Headers.CommonHeaders, nil
+	}
+
+	sendMsg := &messages.SendTransaction{TransactionCommon: common, To: args.To, Data: data}
+	if sendMsg.Data == "" {
+		sendMsg.Data = "0x"
+	}
+	sendMsg.Headers.MsgType = messages.MsgTypeSendTransaction
+	return sendMsg, &sendMsg.Headers.CommonHeaders, nil
+}
+
+func (f *jsonrpcFacade) sendTransaction(ctx context.Context, params []json.RawMessage) (interface{}, int, error) {
+	var args jsonrpcTxnArgs
+	if len(params) < 1 {
+		return nil, jsonrpcInvalidParams, errors.Errorf(errors.JSONRPCFacadeInvalidParams, "eth_sendTransaction", "missing transaction")
+	}
+	if err := json.Unmarshal(params[0], &args); err != nil {
+		return nil, jsonrpcInvalidParams, errors.Errorf(errors.JSONRPCFacadeInvalidParams, "eth_sendTransaction", err)
+	}
+	msg, headers, err := f.buildTxnMessage(&args)
+	if err != nil {
+		return nil, jsonrpcInvalidParams, err
+	}
+	headers.ID = utils.UUIDv4()
+
+	txnContext := &jsonrpcTxnContext{
+		// The auth context of the request is needed to submit the transaction, but the
+		// transaction must not be cancelled when the request completes
+		ctx:          auth.Detach(ctx),
+		f:            f,
+		timeReceived: time.Now().UTC(),
+		headers:      headers,
+		msg:          msg,
+		submitted:    make(chan *jsonrpcSubmitResult, 1),
+	}
+	f.processor.OnMessage(txnContext)
+
+	select {
+	case result := <-txnContext.submitted:
+		if result.err != nil {
+			return nil, jsonrpcServerError, result.err
+		}
+		return result.txHash, 0, nil
+	case <-ctx.Done():
+		return nil, jsonrpcServerError, errors.Errorf(errors.JSONRPCFacadeSubmitInterrupted, ctx.Err())
+	}
+}
+
+func (f *jsonrpcFacade) getTransactionReceipt(ctx context.Context, params []json.RawMessage) (interface{}, int, error) {
+	var txHash string
+	if len(params) < 1 {
+		return nil, jsonrpcInvalidParams, errors.Errorf(errors.JSONRPCFacadeInvalidParams, "eth_getTransactionReceipt", "missing transaction hash")
+	}
+	if err := json.Unmarshal(params[0], &txHash); err != nil {
+		return nil, jsonrpcInvalidParams, errors.Errorf(errors.JSONRPCFacadeInvalidParams, "eth_getTransactionReceipt", err)
+	}
+
+	// For transactions we submitted, there is no need to query the node until
+	// the transaction processor has stored a reply in the receipt store
+	if requestID, ok := f.txRequests.Get(strings.ToLower(txHash)); ok {
+		receipt, err := f.receipts.persistence.GetReceipt(requestID.(string))
+		if err != nil {
+			return nil, jsonrpcServerError, err
+		}
+		if receipt == nil {
+			return nil, 0, nil
+		}
+	}
+	return f.passthrough(ctx, "eth_getTransactionReceipt", params)
+}
+
+func (f *jsonrpcFacade) passthrough(ctx context.Context, method string, params []json.RawMessage) (interface{}, int, error) {
+	if !jsonrpcPassthroughMethods[method] {
+		return nil, jsonrpcMethodNotFound, errors.Errorf(errors.JSONRPCFacadeMethodNotSupported, method)
+	}
+
+	args := make([]interface{}, len(params))
+	for i, param := range params {
+		args[i] = param
+	}
+	var result json.RawMessage
+	if err := f.rpc.CallContext(ctx, &result, method, args...); err != nil {
+		return nil, jsonrpcServerError, err
+	}
+	return result, 0, nil
+}
@@ -0,0 +1,396 @@
+// Copyright 2021 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rest
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/kaleido-io/ethconnect/internal/auth"
+	"github.com/kaleido-io/ethconnect/internal/auth/authtest"
+	"github.com/kaleido-io/ethconnect/internal/eth"
+	"github.com/kaleido-io/ethconnect/internal/ethbind"
+	"github.com/kaleido-io/ethconnect/internal/messages"
+	"github.com/kaleido-io/ethconnect/internal/tx"
+	"github.com/kaleido-io/ethconnect/internal/utils"
+	"github.com/stretchr/testify/assert"
+)
+
+const testJSONRPCTxHash = "0x6e710868fd2d0ac1f141ba3f0cd569e38ce1999d8f39518ee7633d2b9a7122af"
+
+type testJSONRPCProcessor struct {
+	onMessage func(tx.TxnContext)
+}
+
+func (p *testJSONRPCProcessor) ResolveAddress(ctx context.Context, from string) (string, error) {
+	return "", nil
+}
+func (p *testJSONRPCProcessor) OnMessage(ctx tx.TxnContext)                       { p.onMessage(ctx) }
+func (p *testJSONRPCProcessor) Init(eth.RPCClient)                                {}
+func (p *testJSONRPCProcessor) SetEventABIResolver(resolver eth.EventABIResolver) {}
+func (p *testJSONRPCProcessor) AddRoutes(router *httprouter.Router)               {}
+func (p *testJSONRPCProcessor) ContractStats(address string) *tx.ContractStats    { return nil }
+
+func newTestJSONRPCFacade(onMessage func(tx.TxnContext), rpc eth.RPCClient) (*jsonrpcFacade, *httptest.Server, *memoryReceipts) {
+	rsc := &ReceiptStoreConf{MaxDocs: 10}
+	r := newMemoryReceipts(rsc)
+	rs := newReceiptStore(rsc, r, nil)
+	f, _ := newJSONRPCFacade(&JSONRPCFacadeConf{}, &testJSONRPCProcessor{onMessage: onMessage}, rpc, rs)
+	return f, httptest.NewServer(f), r
+}
+
+func testJSONRPCCall(t *testing.T, ts *httptest.Server, body string) (int, map[string]interface{}) {
+	res, err := http.Post(ts.URL, "application/json", strings.NewReader(body))
+	assert.NoError(t, err)
+	var reply map[string]interface{}
+	json.NewDecoder(res.Body).Decode(&reply)
+	return res.StatusCode, reply
+}
+
+func testJSONRPCErrorCode(reply map[string]interface{}) float64 {
+	if errObj, ok := reply["error"].(map[string]interface{}); ok {
+		return errObj["code"].(float64)
+	}
+	return 0
+}
+
+func TestJSONRPCSendTransactionAndReceipt(t *testing.T) {
+	assert := assert.New(t)
+
+	var txnContext tx.TxnContext
+	var sendMsg messages.SendTransaction
+	rpc := eth.NewMockRPCClientForSync(nil, func(method string, res interface{}, args ...interface{}) {
+		*(res.(*json.RawMessage)) = json.RawMessage(`{"transactionHash":"` + testJSONRPCTxHash + `","status":"0x1"}`)
+	})
+	f, ts, r := newTestJSONRPCFacade(func(ctx tx.TxnContext) {
+		txnContext = ctx
+		assert.NoError(ctx.Unmarshal(&sendMsg))
+		ctx.(tx.TxnSubmittedListener).TxnSubmitted(testJSONRPCTxHash)
+	}, rpc)
+	defer ts.Close()
+
+	status, reply := testJSONRPCCall(t, ts, `{
+		"jsonrpc": "2.0",
+		"id": 1,
+		"method": "eth_sendTransaction",
+		"params": [{
+			"from": "0xba25be62a5c55d4ad1d5520268806a8730a4de5e",
+			"to": "0xd7fac2bce408ed7c6ded07a32038b1f79c2b27d3",
+			"gas": "0x1e8480",
+			"value": "0xa",
+			"data": "0xfeedbeef"
+		}]
+	}`)
+	assert.Equal(200, status)
+	assert.Equal(float64(1), reply["id"])
+	assert.Equal(testJSONRPCTxHash, reply["result"])
+	assert.Equal(messages.MsgTypeSendTransaction, sendMsg.Headers.MsgType)
+	assert.NotEmpty(sendMsg.Headers.ID)
+	assert.Equal("0xd7fac2bce408ed7c6ded07a32038b1f79c2b27d3", sendMsg.To)
+	assert.Equal("0xfeedbeef", sendMsg.Data)
+	assert.Equal("2000000", sendMsg.Gas.String())
+	assert.Equal("10", sendMsg.Value.String())
+
+	// Pending until the processor stores a reply, without querying the node
+	receiptReq := `{"jsonrpc":"2.0","id":2,"method":"eth_getTransactionReceipt","params":["` + testJSONRPCTxHash + `"]}`
+	status, reply = testJSONRPCCall(t, ts, receiptReq)
+	assert.Equal(200, status)
+	result, exists := reply["result"]
+	assert.True(exists)
+	assert.Nil(result)
+	assert.Equal("", rpc.MethodCapture)
+
+	txHash := ethbind.API.HexToHash(testJSONRPCTxHash)
+	replyMsg := &messages.TransactionReceipt{TransactionHash: &txHash}
+	replyMsg.Headers.MsgType = messages.MsgTypeTransactionSuccess
+	txnContext.Reply(replyMsg)
+	stored, _ := r.GetReceipt(sendMsg.Headers.ID)
+	assert.NotNil(stored)
+
+	status, reply = testJSONRPCCall(t, ts, receiptReq)
+	assert.Equal(200, status)
+	assert.Equal("eth_getTransactionReceipt", rpc.MethodCapture)
+	assert.Equal(testJSONRPCTxHash, reply["result"].(map[string]interface{})["transactionHash"])
+	assert.Equal(1, f.txRequests.Len())
+}
+
+func TestJSONRPCSendTransactionValueTransfer(t *testing.T) {
+	assert := assert.New(t)
+
+	var sendMsg messages.SendTransaction
+	_, ts, _ := newTestJSONRPCFacade(func(ctx tx.TxnContext) {
+		ctx.Unmarshal(&sendMsg)
+		ctx.(tx.TxnSubmittedListener).TxnSubmitted(testJSONRPCTxHash)
+	}, nil)
+	defer ts.Close()
+
+	_, reply := testJSONRPCCall(t, ts, `{"jsonrpc":"2.0","id":1,"method":"eth_sendTransaction","params":[{
+		"from": "0xba25be62a5c55d4ad1d5520268806a8730a4de5e",
+		"to": "0xd7fac2bce408ed7c6ded07a32038b1f79c2b27d3",
+		"value": "0x1"
+	}]}`)
+	assert.Equal(testJSONRPCTxHash, reply["result"])
+	assert.Equal("0x", sendMsg.Data)
+}
+
+func TestJSONRPCSendTransactionDynamicFees(t *testing.T) {
+	assert := assert.New(t)
+
+	var sendMsg messages.SendTransaction
+	_, ts, _ := newTestJSONRPCFacade(func(ctx tx.TxnContext) {
+		ctx.Unmarshal(&sendMsg)
+		ctx.(tx.TxnSubmittedListener).TxnSubmitted(testJSONRPCTxHash)
+	}, nil)
+	defer ts.Close()
+
+	_, reply := testJSONRPCCall(t, ts, `{"jsonrpc":"2.0","id":1,"method":"eth_sendTransaction","params":[{
+		"from": "0xba25be62a5c55d4ad1d5520268806a8730a4de5e",
+		"to": "0xd7fac2bce408ed7c6ded07a32038b1f79c2b27d3",
+		"maxFeePerGas": "0x3b9aca00",
+		"maxPriorityFeePerGas": "0x77359400"
+	}]}`)
+	assert.Equal(testJSONRPCTxHash, reply["result"])
+	assert.Empty(sendMsg.GasPrice)
+	assert.Equal("1000000000", sendMsg.MaxFeePerGas.String())
+	assert.Equal("2000000000", sendMsg.MaxPriorityFeePerGas.String())
+}
+
+func TestJSONRPCSendTransactionDeploy(t *testing.T) {
+	assert := assert.New(t)
+
+	var deployMsg messages.DeployContract
+	_, ts, _ := newTestJSONRPCFacade(func(ctx tx.TxnContext) {
+		assert.NoError(ctx.Unmarshal(&deployMsg))
+		ctx.(tx.TxnSubmittedListener).TxnSubmitted(testJSONRPCTxHash)
+	}, nil)
+	defer ts.Close()
+
+	_, reply := testJSONRPCCall(t, ts, `{"jsonrpc":"2.0","id":"abc","method":"eth_sendTransaction","params":[{
+		"from": "0xba25be62a5c55d4ad1d5520268806a8730a4de5e",
+		"input": "0x6080604052"
+	}]}`)
+	assert.Equal("abc", reply["id"])
+	assert.Equal(testJSONRPCTxHash, reply["result"])
+	assert.Equal(messages.MsgTypeDeployContract, deployMsg.Headers.MsgType)
+	assert.Equal([]byte{0x60, 0x80, 0x60, 0x40, 0x52}, deployMsg.Compiled)
+	assert.NotNil(deployMsg.ABI)
+}
+
+func TestJSONRPCSendTransactionBadParams(t *testing.T) {
+	assert := assert.New(t)
+
+	_, ts, _ := newTestJSONRPCFacade(func(ctx tx.TxnContext) {
+		assert.Fail("unexpected dispatch")
+	}, nil)
+	defer ts.Close()
+
+	for _, params := range []string{
+		`[]`,
+		`["not an object"]`,
+		`[{"from":"0xba25be62a5c55d4ad1d5520268806a8730a4de5e"}]`,
+		`[{"from":"0xba25be62a5c55d4ad1d5520268806a8730a4de5e","data":"badness"}]`,
+		`[{"to":"0xd7fac2bce408ed7c6ded07a32038b1f79c2b27d3","nonce":"0xzz"}]`,
+		`[{"to":"0xd7fac2bce408ed7c6ded07a32038b1f79c2b27d3","value":"0xzz"}]`,
+		`[{"to":"0xd7fac2bce408ed7c6ded07a32038b1f79c2b27d3","gas":"0xzz"}]`,
+		`[{"to":"0xd7fac2bce408ed7c6ded07a32038b1f79c2b27d3","gasPrice":"0xzz"}]`,
+		`[{"to":"0xd7fac2bce408ed7c6ded07a32038b1f79c2b27d3","maxFeePerGas":"0xzz"}]`,
+		`[{"to":"0xd7fac2bce408ed7c6ded07a32038b1f79c2b27d3","maxPriorityFeePerGas":"0xzz"}]`,
+	} {
+		_, reply := testJSONRPCCall(t, ts, `{"jsonrpc":"2.0","id":1,"method":"eth_sendTransaction","params":`+params+`}`)
+		assert.Equal(float64(jsonrpcInvalidParams), testJSONRPCErrorCode(reply), params)
+	}
+}
+
+func TestJSONRPCSendTransactionFailed(t *testing.T) {
+	assert := assert.New(t)
+
+	var sendMsg messages.SendTransaction
+	_, ts, r := newTestJSONRPCFacade(func(ctx tx.TxnContext) {
+		ctx.Unmarshal(&sendMsg)
+		ctx.SendErrorReplyWithGapFill(400, fmt.Errorf("pop"), "", false)
+	}, nil)
+	defer ts.Close()
+
+	_, reply := testJSONRPCCall(t, ts, `{"jsonrpc":"2.0","id":1,"method":"eth_sendTransaction","params":[{
+		"to": "0xd7fac2bce408ed7c6ded07a32038b1f79c2b27d3",
+		"data": "0xfeedbeef"
+	}]}`)
+	assert.Equal(float64(jsonrpcServerError), testJSONRPCErrorCode(reply))
+	assert.Equal("pop", reply["error"].(map[string]interface{})["message"])
+	stored, _ := r.GetReceipt(sendMsg.Headers.ID)
+	assert.Equal(messages.MsgTypeError, (*stored)["headers"].(map[string]interface{})["type"])
+}
+
+func TestJSONRPCSendTransactionRequestEnded(t *testing.T) {
+	assert := assert.New(t)
+
+	f, _, _ := newTestJSONRPCFacade(func(ctx tx.TxnContext) {}, nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, code, err := f.sendTransaction(ctx, []json.RawMessage{json.RawMessage(`{"to":"0xd7fac2bce408ed7c6ded07a32038b1f79c2b27d3"}`)})
+	assert.Equal(jsonrpcServerError, code)
+	assert.Regexp("Request ended before the transaction was submitted", err)
+}
+
+func TestJSONRPCGetTransactionReceiptBadParams(t *testing.T) {
+	assert := assert.New(t)
+
+	_, ts, _ := newTestJSONRPCFacade(nil, nil)
+	defer ts.Close()
+
+	_, reply := testJSONRPCCall(t, ts, `{"jsonrpc":"2.0","id":1,"method":"eth_getTransactionReceipt","params":[]}`)
+	assert.Equal(float64(jsonrpcInvalidParams), testJSONRPCErrorCode(reply))
+	_, reply = testJSONRPCCall(t, ts, `{"jsonrpc":"2.0","id":1,"method":"eth_getTransactionReceipt","params":[{}]}`)
+	assert.Equal(float64(jsonrpcInvalidParams), testJSONRPCErrorCode(reply))
+}
+
+func TestJSONRPCSendTransactionCarriesAuthContext(t *testing.T) {
+	assert := assert.New(t)
+	auth.RegisterSecurityModule(&authtest.TestSecurityModule{})
+	defer auth.RegisterSecurityModule(nil)
+
+	var txnContext tx.TxnContext
+	f, ts, _ := newTestJSONRPCFacade(func(ctx tx.TxnContext) {
+		txnContext = ctx
+		ctx.(tx.TxnSubmittedListener).TxnSubmitted(testJSONRPCTxHash)
+	}, nil)
+	defer ts.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	ctx, err := auth.WithAuthContext(ctx, "testat")
+	assert.NoError(err)
+	reply := f.processRequest(ctx, []byte(`{"jsonrpc":"2.0","id":1,"method":"eth_sendTransaction","params":[{"from":"0xba25be62a5c55d4ad1d5520268806a8730a4de5e","to":"0xd7fac2bce408ed7c6ded07a32038b1f79c2b27d3"}]}`))
+	assert.Nil(reply.Error)
+	cancel()
+
+	// The transaction is authorized as the caller, and outlives the request
+	assert.Equal("verified", auth.GetAuthContext(txnContext.Context()))
+	assert.NoError(auth.AuthRPC(txnContext.Context(), "testrpc"))
+	assert.NoError(txnContext.Context().Err())
+}
+
+func TestJSONRPCPassthrough(t *testing.T) {
+	assert := assert.New(t)
+
+	rpc := eth.NewMockRPCClientForSync(nil, func(method string, res interface{}, args ...interface{}) {
+		*(res.(*json.RawMessage)) = json.RawMessage(`"0x000000000000000000000000000000000000000000000000000000000000000c"`)
+	})
+	_, ts, _ := newTestJSONRPCFacade(nil, rpc)
+	defer ts.Close()
+
+	_, reply := testJSONRPCCall(t, ts, `{"jsonrpc":"2.0","id":1,"method":"eth_call","params":[{"to":"0xd7fac2bce408ed7c6ded07a32038b1f79c2b27d3","data":"0x6d4ce63c"},"latest"]}`)
+	assert.Equal("2.0", reply["jsonrpc"])
+	assert.Equal("0x000000000000000000000000000000000000000000000000000000000000000c", reply["result"])
+	assert.Equal("eth_call", rpc.MethodCapture)
+	assert.Len(rpc.ArgsCapture, 2)
+	assert.Equal(`"latest"`, string(rpc.ArgsCapture[1].(json.RawMessage)))
+
+	_, reply = testJSONRPCCall(t, ts, `{"jsonrpc":"2.0","id":2,"method":"admin_peers","params":[]}`)
+	assert.Equal(float64(jsonrpcMethodNotFound), testJSONRPCErrorCode(reply))
+
+	// Methods that use keys held by the node are not passed through
+	for _, method := range []string{"eth_sendRawTransaction", "eth_sign", "eth_signTransaction", "eth_accounts"} {
+		_, reply = testJSONRPCCall(t, ts, `{"jsonrpc":"2.0","id":3,"method":"`+method+`","params":[]}`)
+		assert.Equal(float64(jsonrpcMethodNotFound), testJSONRPCErrorCode(reply), method)
+	}
+	assert.Equal("eth_call", rpc.MethodCapture)
+}
+
+func TestJSONRPCPassthroughError(t *testing.T) {
+	assert := assert.New(t)
+
+	rpc := eth.NewMockRPCClientForSync(fmt.Errorf("pop"), nil)
+	_, ts, _ := newTestJSONRPCFacade(nil, rpc)
+	defer ts.Close()
+
+	_, reply := testJSONRPCCall(t, ts, `{"jsonrpc":"2.0","id":1,"method":"eth_getLogs","params":[{"fromBlock":"0x0"}]}`)
+	assert.Equal(float64(jsonrpcServerError), testJSONRPCErrorCode(reply))
+	assert.Equal("pop", reply["error"].(map[string]interface{})["message"])
+}
+
+func TestJSONRPCBatch(t *testing.T) {
+	assert := assert.New(t)
+
+	rpc := eth.NewMockRPCClientForSync(nil, func(method string, res interface{}, args ...interface{}) {
+		*(res.(*json.RawMessage)) = json.RawMessage(`"0x1"`)
+	})
+	_, ts, _ := newTestJSONRPCFacade(nil, rpc)
+	defer ts.Close()
+
+	res, err := http.Post(ts.URL, "application/json", strings.NewReader(`[
+		{"jsonrpc":"2.0","id":1,"method":"eth_chainId","params":[]},
+		{"jsonrpc":"2.0","id":2,"params":[]},
+		"badness"
+	]`))
+	assert.NoError(err)
+	var replies []map[string]interface{}
+	json.NewDecoder(res.Body).Decode(&replies)
+	assert.Len(replies, 3)
+	assert.Equal("0x1", replies[0]["result"])
+	assert.Equal(float64(jsonrpcInvalidRequest), testJSONRPCErrorCode(replies[1]))
+	assert.Equal(float64(jsonrpcParseError), testJSONRPCErrorCode(replies[2]))
+}
+
+func TestJSONRPCBadRequests(t *testing.T) {
+	assert := assert.New(t)
+
+	_, ts, _ := newTestJSONRPCFacade(nil, nil)
+	defer ts.Close()
+
+	_, reply := testJSONRPCCall(t, ts, `[]`)
+	assert.Equal(float64(jsonrpcInvalidRequest), testJSONRPCErrorCode(reply))
+	_, reply = testJSONRPCCall(t, ts, `[badness`)
+	assert.Equal(float64(jsonrpcParseError), testJSONRPCErrorCode(reply))
+	_, reply = testJSONRPCCall(t, ts, `{badness`)
+	assert.Equal(float64(jsonrpcParseError), testJSONRPCErrorCode(reply))
+
+	res, err := http.Get(ts.URL)
+	assert.NoError(err)
+	assert.Equal(405, res.StatusCode)
+}
+
+func TestJSONRPCRequestTooLarge(t *testing.T) {
+	assert := assert.New(t)
+
+	called := false
+	_, ts, _ := newTestJSONRPCFacade(func(tx.TxnContext) { called = true }, nil)
+	defer ts.Close()
+
+	body := `{"jsonrpc":"2.0","id":1,"method":"eth_sendTransaction","params":[{"data":"0x` + strings.Repeat("00", utils.MaxPayloadSize) + `"}]}`
+	status, reply := testJSONRPCCall(t, ts, body)
+	assert.Equal(413, status)
+	assert.Equal(float64(jsonrpcInvalidRequest), testJSONRPCErrorCode(reply))
+	assert.Regexp("exceeds the maximum size", reply["error"].(map[string]interface{})["message"])
+	assert.False(called)
+}
+
+func TestJSONRPCQuantity(t *testing.T) {
+	assert := assert.New(t)
+
+	v, err := jsonrpcQuantity("value", "0xDE0B6B3A7640000")
+	assert.NoError(err)
+	assert.Equal("1000000000000000000", v.String())
+	v, err = jsonrpcQuantity("value", "")
+	assert.NoError(err)
+	assert.Equal("", v.String())
+	_, err = jsonrpcQuantity("value", "0x")
+	assert.Regexp("Invalid hex quantity '0x' for value", err)
+}
@@ -0,0 +1,180 @@
+// Copyright 2021 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rest
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/websocket"
+	"github.com/julienschmidt/httprouter"
+	"github.com/kaleido-io/ethconnect/internal/errors"
+	"github.com/kaleido-io/ethconnect/internal/eth"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// JSONRPCProxyPath is the path of the JSON-RPC pass-through on the REST gateway
+	JSONRPCProxyPath = "/jsonrpc"
+)
+
+// JSONRPCProxyConf configures the pass-through of raw JSON-RPC calls to the node, on the
+// port of the REST gateway. Each allowed method is a full name, such as "eth_call", or
+// a prefix ending in "*", such as "eth_get*". The proxy is disabled if none are allowed
+type JSONRPCProxyConf struct {
+	AllowedMethods []string `json:"allowedMethods"`
+	MaxMessageSize int64    `json:"maxMessageSize,omitempty"`
+}
+
+// jsonrpcProxy passes an allow-list of JSON-RPC methods through to the node, over HTTP POST
+// or WebSocket. Each call runs with the auth context of the request that carried it,
+// so the security module authorizes every method in the same way as other RPC calls
+type jsonrpcProxy struct {
+	conf     *JSONRPCProxyConf
+	rpc      eth.RPCClient
+	upgrader *websocket.Upgrader
+}
+
+func newJSONRPCProxy(conf *JSONRPCProxyConf, rpc eth.RPCClient) *jsonrpcProxy {
+	return &jsonrpcProxy{
+		conf: conf,
+		rpc:  rpc,
+		upgrader: &websocket.Upgrader{
+			ReadBufferSize:  1024,
+			WriteBufferSize: 1024,
+		},
+	}
+}
+
+func (p *jsonrpcProxy) addRoutes(router *httprouter.Router) {
+	router.POST(JSONRPCProxyPath, p.serveHTTP)
+	router.GET(JSONRPCProxyPath, p.serveWebSocket)
+}
+
+// isAllowed checks a method against the allow-list
+func (p *jsonrpcProxy) isAllowed(method string) bool {
+	for _, allowed := range p.conf.AllowedMethods {
+		if strings.HasSuffix(allowed, "*") {
+			if strings.HasPrefix(method, strings.TrimSuffix(allowed, "*")) {
+				return true
+			}
+		} else if method == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *jsonrpcProxy) serveHTTP(res http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	log.Infof("--> %s %s", req.Method, req.URL)
+
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		p.reply(res, req, 400, jsonrpcErrorResponse(nil, jsonrpcParseError, errors.Errorf(errors.JSONRPCFacadeParseError, err)))
+		return
+	}
+	p.reply(res, req, 200, p.processBody(req.Context(), body))
+}
+
+// serveWebSocket upgrades the connection, then replies to each request (or batch) sent over it
+// in turn, until the client disconnects
+func (p *jsonrpcProxy) serveWebSocket(res http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	log.Infof("--> %s %s", req.Method, req.URL)
+
+	conn, err := p.upgrader.Upgrade(res, req, nil)
+	if err != nil {
+		log.Errorf("JSON-RPC WebSocket upgrade failed: %s", err)
+		return
+	}
+	defer conn.Close()
+	if p.conf.MaxMessageSize > 0 {
+		conn.SetReadLimit(p.conf.MaxMessageSize)
+	}
+	for {
+		_, body, err := conn.ReadMessage()
+		if err != nil {
+			log.Infof("JSON-RPC WebSocket closed: %s", err)
+			return
+		}
+		if err = conn.WriteJSON(p.processBody(req.Context(), body)); err != nil {
+			log.Errorf("JSON-RPC WebSocket send failed: %s", err)
+			return
+		}
+	}
+}
+
+// processBody handles a single request, or a batch
+func (p *jsonrpcProxy) processBody(ctx context.Context, body []byte) interface{} {
+	body = bytes.TrimSpace(body)
+	if len(body) == 0 || body[0] != '[' {
+		return p.processRequest(ctx, body)
+	}
+	var batch []json.RawMessage
+	if err := json.Unmarshal(body, &batch); err != nil {
+		return jsonrpcErrorResponse(nil, jsonrpcParseError, errors.Errorf(errors.JSONRPCFacadeParseError, err))
+	}
+	if len(batch) == 0 {
+		return jsonrpcErrorResponse(nil, jsonrpcInvalidRequest, errors.Errorf(errors.JSONRPCFacadeEmptyBatch))
+	}
+	responses := make([]*jsonrpcResponse, len(batch))
+	for i, rpcReq := range batch {
+		responses[i] = p.processRequest(ctx, rpcReq)
+	}
+	return responses
+}
+
+func (p *jsonrpcProxy) processRequest(ctx context.Context, body []byte) *jsonrpcResponse {
+	var rpcReq jsonrpcRequest
+	if err := json.Unmarshal(body, &rpcReq); err != nil {
+		return jsonrpcErrorResponse(nil, jsonrpcParseError, errors.Errorf(errors.JSONRPCFacadeParseError, err))
+	}
+	if rpcReq.Method == "" {
+		return jsonrpcErrorResponse(rpcReq.ID, jsonrpcInvalidRequest, errors.Errorf(errors.JSONRPCFacadeMissingMethod))
+	}
+	if !p.isAllowed(rpcReq.Method) {
+		log.Warnf("JSON-RPC proxy request %s %s is not allowed", rpcReq.ID, rpcReq.Method)
+		return jsonrpcErrorResponse(rpcReq.ID, jsonrpcMethodNotFound, errors.Errorf(errors.JSONRPCProxyMethodNotAllowed, rpcReq.Method))
+	}
+	log.Debugf("JSON-RPC proxy request %s %s", rpcReq.ID, rpcReq.Method)
+
+	args := make([]interface{}, len(rpcReq.Params))
+	for i, param := range rpcReq.Params {
+		args[i] = param
+	}
+	var result json.RawMessage
+	if err := p.rpc.CallContext(ctx, &result, rpcReq.Method, args...); err != nil {
+		log.Errorf("JSON-RPC proxy request %s %s failed: %s", rpcReq.ID, rpcReq.Method, err)
+		return jsonrpcErrorResponse(rpcReq.ID, jsonrpcServerError, err)
+	}
+	if result == nil {
+		result = json.RawMessage("null")
+	}
+	return &jsonrpcResponse{
+		JSONRPC: jsonrpcVersion,
+		ID:      rpcReq.ID,
+		Result:  result,
+	}
+}
+
+func (p *jsonrpcProxy) reply(res http.ResponseWriter, req *http.Request, status int, result interface{}) {
+	log.Infof("<-- %s %s [%d]", req.Method, req.URL, status)
+	res.Header().Set("Content-Type", "application/json")
+	res.WriteHeader(status)
+	json.NewEncoder(res).Encode(result)
+}
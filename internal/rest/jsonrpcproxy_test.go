@@ -0,0 +1,153 @@
+// Copyright 2021 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rest
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+	"github.com/julienschmidt/httprouter"
+	"github.com/kaleido-io/ethconnect/internal/auth"
+	"github.com/kaleido-io/ethconnect/internal/auth/authtest"
+	"github.com/kaleido-io/ethconnect/internal/eth"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestJSONRPCProxy(rpc eth.RPCClient) *httptest.Server {
+	var printYAML = false
+	g := NewRESTGateway(&printYAML)
+	router := &httprouter.Router{}
+	newJSONRPCProxy(&JSONRPCProxyConf{
+		AllowedMethods: []string{"eth_call", "eth_get*"},
+	}, rpc).addRoutes(router)
+	return httptest.NewServer(g.newAccessTokenContextHandler(router))
+}
+
+func testJSONRPCProxyCall(t *testing.T, ts *httptest.Server, body string) (int, map[string]interface{}) {
+	res, err := http.Post(ts.URL+JSONRPCProxyPath, "application/json", strings.NewReader(body))
+	assert.NoError(t, err)
+	var reply map[string]interface{}
+	json.NewDecoder(res.Body).Decode(&reply)
+	return res.StatusCode, reply
+}
+
+func TestJSONRPCProxyHTTP(t *testing.T) {
+	assert := assert.New(t)
+
+	rpc := eth.NewMockRPCClientForSync(nil, func(method string, res interface{}, args ...interface{}) {
+		*(res.(*json.RawMessage)) = json.RawMessage(`"0x1"`)
+	})
+	ts := newTestJSONRPCProxy(rpc)
+	defer ts.Close()
+
+	status, reply := testJSONRPCProxyCall(t, ts, `{"jsonrpc":"2.0","id":1,"method":"eth_call","params":[{"to":"0xaa"},"latest"]}`)
+	assert.Equal(200, status)
+	assert.Equal("0x1", reply["result"])
+	assert.Equal(float64(1), reply["id"])
+	assert.Equal("eth_call", rpc.MethodCapture)
+	assert.Equal(2, len(rpc.ArgsCapture))
+
+	status, reply = testJSONRPCProxyCall(t, ts, `{"jsonrpc":"2.0","id":2,"method":"eth_getLogs","params":[{}]}`)
+	assert.Equal(200, status)
+	assert.Equal("0x1", reply["result"])
+
+	status, reply = testJSONRPCProxyCall(t, ts, `{"jsonrpc":"2.0","id":3,"method":"eth_sendRawTransaction","params":["0x00"]}`)
+	assert.Equal(200, status)
+	assert.Equal(float64(jsonrpcMethodNotFound), testJSONRPCErrorCode(reply))
+	assert.Equal("Method 'eth_sendRawTransaction' is not allowed", reply["error"].(map[string]interface{})["message"])
+	assert.Equal("eth_getLogs", rpc.MethodCapture)
+
+	status, reply = testJSONRPCProxyCall(t, ts, `{"jsonrpc":"2.0","id":4}`)
+	assert.Equal(200, status)
+	assert.Equal(float64(jsonrpcInvalidRequest), testJSONRPCErrorCode(reply))
+
+	status, reply = testJSONRPCProxyCall(t, ts, `!json`)
+	assert.Equal(200, status)
+	assert.Equal(float64(jsonrpcParseError), testJSONRPCErrorCode(reply))
+
+	status, reply = testJSONRPCProxyCall(t, ts, `[]`)
+	assert.Equal(200, status)
+	assert.Equal(float64(jsonrpcInvalidRequest), testJSONRPCErrorCode(reply))
+
+	res, err := http.Post(ts.URL+JSONRPCProxyPath, "application/json", strings.NewReader(
+		`[{"jsonrpc":"2.0","id":5,"method":"eth_getBalance","params":["0xaa","latest"]},{"jsonrpc":"2.0","id":6,"method":"admin_peers"}]`))
+	assert.NoError(err)
+	var replies []map[string]interface{}
+	json.NewDecoder(res.Body).Decode(&replies)
+	assert.Equal(2, len(replies))
+	assert.Equal("0x1", replies[0]["result"])
+	assert.Equal(float64(jsonrpcMethodNotFound), testJSONRPCErrorCode(replies[1]))
+}
+
+func TestJSONRPCProxyNodeError(t *testing.T) {
+	assert := assert.New(t)
+
+	rpc := eth.NewMockRPCClientForSync(fmt.Errorf("pop"), nil)
+	ts := newTestJSONRPCProxy(rpc)
+	defer ts.Close()
+
+	status, reply := testJSONRPCProxyCall(t, ts, `{"jsonrpc":"2.0","id":1,"method":"eth_call","params":[]}`)
+	assert.Equal(200, status)
+	assert.Equal(float64(jsonrpcServerError), testJSONRPCErrorCode(reply))
+	assert.Equal("pop", reply["error"].(map[string]interface{})["message"])
+}
+
+func TestJSONRPCProxyWebSocket(t *testing.T) {
+	assert := assert.New(t)
+
+	rpc := eth.NewMockRPCClientForSync(nil, func(method string, res interface{}, args ...interface{}) {
+		*(res.(*json.RawMessage)) = json.RawMessage(`{"number":"0x10"}`)
+	})
+	ts := newTestJSONRPCProxy(rpc)
+	defer ts.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(ts.URL, "http")+JSONRPCProxyPath, nil)
+	assert.NoError(err)
+	defer conn.Close()
+
+	conn.WriteMessage(websocket.TextMessage, []byte(`{"jsonrpc":"2.0","id":"a","method":"eth_getBlockByNumber","params":["latest",false]}`))
+	var reply map[string]interface{}
+	assert.NoError(conn.ReadJSON(&reply))
+	assert.Equal("a", reply["id"])
+	assert.Equal("0x10", reply["result"].(map[string]interface{})["number"])
+
+	conn.WriteMessage(websocket.TextMessage, []byte(`[{"jsonrpc":"2.0","id":"b","method":"debug_traceTransaction","params":["0x00"]}]`))
+	var replies []map[string]interface{}
+	assert.NoError(conn.ReadJSON(&replies))
+	assert.Equal(1, len(replies))
+	assert.Equal(float64(jsonrpcMethodNotFound), testJSONRPCErrorCode(replies[0]))
+}
+
+func TestJSONRPCProxyUnauthorized(t *testing.T) {
+	assert := assert.New(t)
+	auth.RegisterSecurityModule(&authtest.TestSecurityModule{})
+	defer auth.RegisterSecurityModule(nil)
+
+	rpc := eth.NewMockRPCClientForSync(nil, nil)
+	ts := newTestJSONRPCProxy(rpc)
+	defer ts.Close()
+
+	status, _ := testJSONRPCProxyCall(t, ts, `{"jsonrpc":"2.0","id":1,"method":"eth_call","params":[]}`)
+	assert.Equal(401, status)
+	_, res, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(ts.URL, "http")+JSONRPCProxyPath, nil)
+	assert.Error(err)
+	assert.Equal(401, res.StatusCode)
+	assert.Empty(rpc.MethodCapture)
+}
@@ -0,0 +1,307 @@
+// Copyright 2021 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rest
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/kaleido-io/ethconnect/internal/auth"
+	"github.com/kaleido-io/ethconnect/internal/errors"
+	"github.com/kaleido-io/ethconnect/internal/kvstore"
+	"github.com/kaleido-io/ethconnect/internal/utils"
+	log "github.com/sirupsen/logrus"
+)
+
+// LevelDBAdminConf configures the LevelDB maintenance endpoints
+type LevelDBAdminConf struct {
+	// BackupPath is the directory that named file backups are written into
+	BackupPath string `json:"backupPath"`
+	// UploadURLs are the http(s) destinations that backup archives can be uploaded under, such as
+	// "https://bucket.s3.amazonaws.com/ethconnect/". Uploads to any other URL are rejected
+	UploadURLs []string `json:"uploadURLs,omitempty"`
+}
+
+type levelDBAdminRequest struct {
+	Name   string `json:"name"`
+	Target string `json:"target"`
+}
+
+// levelDBAdmin provides compaction, size reporting, and snapshot backup of all
+// the LevelDB stores open in this process (event streams, receipts, registry cache)
+type levelDBAdmin struct {
+	conf   *LevelDBAdminConf
+	client *http.Client
+}
+
+func newLevelDBAdmin(conf *LevelDBAdminConf) *levelDBAdmin {
+	return &levelDBAdmin{
+		conf:   conf,
+		client: &http.Client{Transport: utils.EgressTransport(nil)},
+	}
+}
+
+func (a *levelDBAdmin) addRoutes(router *httprouter.Router) {
+	router.GET("/admin/leveldb", a.statsHandler)
+	router.POST("/admin/leveldb/compact", a.compactHandler)
+	router.POST("/admin/leveldb/backup", a.backupHandler)
+}
+
+func (a *levelDBAdmin) statsHandler(res http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	log.Infof("--> %s %s", req.Method, req.URL)
+	stores := kvstore.LevelDBStores()
+	allStats := make([]*kvstore.LevelDBStats, 0, len(stores))
+	for _, store := range stores {
+		stats, err := store.Stats()
+		if err != nil {
+			a.errReply(res, req, err, 500)
+			return
+		}
+		allStats = append(allStats, stats)
+	}
+	a.reply(res, req, allStats)
+}
+
+func (a *levelDBAdmin) compactHandler(res http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	log.Infof("--> %s %s", req.Method, req.URL)
+	store, _, status, err := a.parseRequest(req)
+	if err != nil {
+		a.errReply(res, req, err, status)
+		return
+	}
+	if err = store.Compact(); err != nil {
+		a.errReply(res, req, err, 500)
+		return
+	}
+	stats, err := store.Stats()
+	if err != nil {
+		a.errReply(res, req, err, 500)
+		return
+	}
+	a.reply(res, req, stats)
+}
+
+func (a *levelDBAdmin) backupHandler(res http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	log.Infof("--> %s %s", req.Method, req.URL)
+	store, body, status, err := a.parseRequest(req)
+	if err != nil {
+		a.errReply(res, req, err, status)
+		return
+	}
+	if err = a.validateTarget(body.Target); err != nil {
+		a.errReply(res, req, err, 400)
+		return
+	}
+	if isURLTarget(body.Target) && !a.uploadAllowed(body.Target) {
+		a.errReply(res, req, errors.Errorf(errors.LevelDBAdminBackupURLNotAllowed, stripQuery(body.Target)), 403)
+		return
+	}
+	// Every store is exported in full, so the security module must authorize the backup
+	if err = auth.AuthAdmin(req.Context(), "leveldb.backup", store.Name(), stripQuery(body.Target)); err != nil {
+		log.Errorf("Backup of %s not authorized: %s", store.Name(), err)
+		a.errReply(res, req, errors.Errorf(errors.Unauthorized), 401)
+		return
+	}
+	var stats *kvstore.LevelDBStats
+	if isURLTarget(body.Target) {
+		stats, err = a.backupToURL(store, body.Target)
+	} else {
+		stats, err = store.Backup(filepath.Join(a.conf.BackupPath, body.Target))
+	}
+	if err != nil {
+		a.errReply(res, req, err, 500)
+		return
+	}
+	a.reply(res, req, stats)
+}
+
+func (a *levelDBAdmin) parseRequest(req *http.Request) (kvstore.LevelDBAdmin, *levelDBAdminRequest, int, error) {
+	var body levelDBAdminRequest
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		return nil, nil, 400, errors.Errorf(errors.LevelDBAdminInvalidRequest, err)
+	}
+	store, err := kvstore.GetLevelDBStore(body.Name)
+	if err != nil {
+		return nil, nil, 404, err
+	}
+	return store, &body, 200, nil
+}
+
+func isURLTarget(target string) bool {
+	return strings.HasPrefix(target, "http://") || strings.HasPrefix(target, "https://")
+}
+
+// validateTarget checks the target is a URL, or a simple name for a new LevelDB
+// directory within the configured backup path
+func (a *levelDBAdmin) validateTarget(target string) error {
+	if target == "" {
+		return errors.Errorf(errors.LevelDBAdminBackupTargetMissing)
+	}
+	if isURLTarget(target) {
+		return nil
+	}
+	if a.conf.BackupPath == "" {
+		return errors.Errorf(errors.LevelDBAdminBackupPathNotConfigured)
+	}
+	if target != filepath.Base(target) || target == "." || target == ".." {
+		return errors.Errorf(errors.LevelDBAdminBackupInvalidName, target)
+	}
+	return nil
+}
+
+// uploadAllowed checks the target URL is within one of the configured upload destinations,
+// comparing the scheme, host and port exactly and the cleaned path by prefix
+func (a *levelDBAdmin) uploadAllowed(target string) bool {
+	u, err := url.Parse(target)
+	if err != nil || u.User != nil {
+		return false
+	}
+	targetPath := path.Clean("/" + u.Path)
+	for _, allowed := range a.conf.UploadURLs {
+		au, err := url.Parse(allowed)
+		if err != nil || !strings.EqualFold(u.Scheme, au.Scheme) || !strings.EqualFold(u.Host, au.Host) {
+			continue
+		}
+		allowedPath := path.Clean("/" + au.Path)
+		if allowedPath == "/" || targetPath == allowedPath || strings.HasPrefix(targetPath, allowedPath+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// stripQuery removes any query string from a URL for logging and replies, as it might contain a signature
+func stripQuery(targetURL string) string {
+	return strings.SplitN(targetURL, "?", 2)[0]
+}
+
+// backupToURL archives the snapshot as a gzipped tar of the LevelDB directory, and uploads it with
+// an HTTP PUT - such as a pre-signed S3 URL
+func (a *levelDBAdmin) backupToURL(store kvstore.LevelDBAdmin, targetURL string) (*kvstore.LevelDBStats, error) {
+	tmpDir, err := ioutil.TempDir("", "ldbbackup")
+	if err != nil {
+		return nil, errors.Errorf(errors.LevelDBAdminBackupFailed, store.Name(), err)
+	}
+	defer os.RemoveAll(tmpDir)
+	backupDir := filepath.Join(tmpDir, filepath.Base(store.Name()))
+	stats, err := store.Backup(backupDir)
+	if err != nil {
+		return nil, err
+	}
+	archive, err := os.Create(backupDir + ".tar.gz")
+	if err == nil {
+		err = writeTarGz(archive, backupDir)
+		archive.Close()
+	}
+	if err != nil {
+		return nil, errors.Errorf(errors.LevelDBAdminBackupFailed, store.Name(), err)
+	}
+	if err = a.upload(backupDir+".tar.gz", targetURL); err != nil {
+		return nil, errors.Errorf(errors.LevelDBAdminBackupUploadFailed, err)
+	}
+	stats.Path = stripQuery(targetURL)
+	return stats, nil
+}
+
+func (a *levelDBAdmin) upload(archivePath, targetURL string) error {
+	archive, err := os.Open(archivePath)
+	if err != nil {
+		return err
+	}
+	defer archive.Close()
+	info, err := archive.Stat()
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("PUT", targetURL, archive)
+	if err != nil {
+		return err
+	}
+	// Set the length explicitly, as S3 does not accept chunked uploads
+	req.ContentLength = info.Size()
+	req.Header.Set("Content-Type", "application/gzip")
+	res, err := a.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return fmt.Errorf("%s", res.Status)
+	}
+	log.Infof("Uploaded backup archive of %d bytes [%d]", info.Size(), res.StatusCode)
+	return nil
+}
+
+func writeTarGz(w io.Writer, dir string) error {
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	base := filepath.Base(dir)
+	err := filepath.Walk(dir, func(file string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		relPath, _ := filepath.Rel(dir, file)
+		header, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return err
+		}
+		header.Name = filepath.ToSlash(filepath.Join(base, relPath))
+		if err = tw.WriteHeader(header); err != nil || info.IsDir() {
+			return err
+		}
+		f, err := os.Open(file)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(tw, f)
+		return err
+	})
+	if err == nil {
+		err = tw.Close()
+	}
+	if err == nil {
+		err = gz.Close()
+	}
+	return err
+}
+
+func (a *levelDBAdmin) reply(res http.ResponseWriter, req *http.Request, body interface{}) {
+	log.Infof("<-- %s %s [%d]", req.Method, req.URL, 200)
+	res.Header().Set("Content-Type", "application/json")
+	res.WriteHeader(200)
+	enc := json.NewEncoder(res)
+	enc.SetIndent("", "  ")
+	enc.Encode(body)
+}
+
+func (a *levelDBAdmin) errReply(res http.ResponseWriter, req *http.Request, err error, status int) {
+	log.Errorf("<-- %s %s [%d]: %s", req.Method, req.URL, status, err)
+	reply, _ := json.Marshal(&errMsg{Message: err.Error()})
+	res.Header().Set("Content-Type", "application/json")
+	res.WriteHeader(status)
+	res.Write(reply)
+}
@@ -0,0 +1,270 @@
+// Copyright 2021 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rest
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/kaleido-io/ethconnect/internal/auth"
+	"github.com/kaleido-io/ethconnect/internal/auth/authtest"
+	"github.com/kaleido-io/ethconnect/internal/kvstore"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestLevelDBAdmin(t *testing.T, backupPath string, uploadURLs ...string) (*httprouter.Router, kvstore.KVStore, string) {
+	dir, _ := ioutil.TempDir("", "ldbadmin")
+	kv, err := kvstore.NewLDBKeyValueStore(path.Join(dir, "ldbadmintest"))
+	assert.NoError(t, err)
+	kvstore.SetKeyPrefixes(kv, map[string]string{"receipts": "z"})
+	kv.Put("z1", []byte("receipt1"))
+	kv.Put("z2", []byte("receipt2"))
+	kv.Put("req1", []byte("z1"))
+	router := &httprouter.Router{}
+	newLevelDBAdmin(&LevelDBAdminConf{BackupPath: backupPath, UploadURLs: uploadURLs}).addRoutes(router)
+	return router, kv, dir
+}
+
+func testLevelDBAdminRequest(router *httprouter.Router, method, url, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, url, bytes.NewReader([]byte(body)))
+	res := httptest.NewRecorder()
+	router.ServeHTTP(res, req)
+	return res
+}
+
+func TestLevelDBAdminStatsAndCompact(t *testing.T) {
+	assert := assert.New(t)
+	router, kv, dir := newTestLevelDBAdmin(t, "")
+	defer os.RemoveAll(dir)
+	defer kv.Close()
+
+	res := testLevelDBAdminRequest(router, "GET", "/admin/leveldb", "")
+	assert.Equal(200, res.Code)
+	var allStats []*kvstore.LevelDBStats
+	json.NewDecoder(res.Body).Decode(&allStats)
+	var found *kvstore.LevelDBStats
+	for _, stats := range allStats {
+		if stats.Name == "ldbadmintest" {
+			found = stats
+		}
+	}
+	assert.NotNil(found)
+	assert.Equal(int64(3), found.Keys)
+	assert.Equal(int64(2), found.Prefixes["receipts"])
+	assert.Equal(int64(1), found.Prefixes["other"])
+
+	res = testLevelDBAdminRequest(router, "POST", "/admin/leveldb/compact", `{"name":"ldbadmintest"}`)
+	assert.Equal(200, res.Code)
+	var stats kvstore.LevelDBStats
+	json.NewDecoder(res.Body).Decode(&stats)
+	assert.Equal(int64(3), stats.Keys)
+
+	res = testLevelDBAdminRequest(router, "POST", "/admin/leveldb/compact", `{"name":"unknown"}`)
+	assert.Equal(404, res.Code)
+
+	res = testLevelDBAdminRequest(router, "POST", "/admin/leveldb/compact", `!json`)
+	assert.Equal(400, res.Code)
+}
+
+func TestLevelDBAdminBackupToFile(t *testing.T) {
+	assert := assert.New(t)
+	backupPath, _ := ioutil.TempDir("", "ldbbackups")
+	defer os.RemoveAll(backupPath)
+	router, kv, dir := newTestLevelDBAdmin(t, backupPath)
+	defer os.RemoveAll(dir)
+	defer kv.Close()
+
+	res := testLevelDBAdminRequest(router, "POST", "/admin/leveldb/backup", `{"name":"ldbadmintest","target":"backup1"}`)
+	assert.Equal(200, res.Code)
+	var stats kvstore.LevelDBStats
+	json.NewDecoder(res.Body).Decode(&stats)
+	assert.Equal(int64(3), stats.Keys)
+	assert.Equal(path.Join(backupPath, "backup1"), stats.Path)
+
+	res = testLevelDBAdminRequest(router, "POST", "/admin/leveldb/backup", `{"name":"ldbadmintest","target":"backup1"}`)
+	assert.Equal(500, res.Code)
+	assert.Regexp("already exists", res.Body.String())
+
+	res = testLevelDBAdminRequest(router, "POST", "/admin/leveldb/backup", `{"name":"ldbadmintest","target":"../backup2"}`)
+	assert.Equal(400, res.Code)
+	assert.Regexp("Invalid backup name", res.Body.String())
+
+	res = testLevelDBAdminRequest(router, "POST", "/admin/leveldb/backup", `{"name":"ldbadmintest"}`)
+	assert.Equal(400, res.Code)
+	assert.Regexp("Backup target must be", res.Body.String())
+}
+
+func TestLevelDBAdminBackupNoBackupPath(t *testing.T) {
+	assert := assert.New(t)
+	router, kv, dir := newTestLevelDBAdmin(t, "")
+	defer os.RemoveAll(dir)
+	defer kv.Close()
+
+	res := testLevelDBAdminRequest(router, "POST", "/admin/leveldb/backup", `{"name":"ldbadmintest","target":"backup1"}`)
+	assert.Equal(400, res.Code)
+	assert.Regexp("No backup path is configured", res.Body.String())
+}
+
+func TestLevelDBAdminBackupToURL(t *testing.T) {
+	assert := assert.New(t)
+
+	var uploaded []byte
+	var contentLength int64
+	server := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		assert.Equal("PUT", req.Method)
+		assert.Equal("application/gzip", req.Header.Get("Content-Type"))
+		contentLength = req.ContentLength
+		uploaded, _ = ioutil.ReadAll(req.Body)
+		res.WriteHeader(200)
+	}))
+	defer server.Close()
+
+	router, kv, dir := newTestLevelDBAdmin(t, "", server.URL+"/bucket/")
+	defer os.RemoveAll(dir)
+	defer kv.Close()
+
+	res := testLevelDBAdminRequest(router, "POST", "/admin/leveldb/backup", `{"name":"ldbadmintest","target":"`+server.URL+`/bucket/backup.tar.gz?X-Amz-Signature=secret"}`)
+	assert.Equal(200, res.Code)
+	var stats kvstore.LevelDBStats
+	json.NewDecoder(res.Body).Decode(&stats)
+	assert.Equal(int64(3), stats.Keys)
+	assert.Equal(server.URL+"/bucket/backup.tar.gz", stats.Path)
+	assert.Equal(int64(len(uploaded)), contentLength)
+
+	gz, err := gzip.NewReader(bytes.NewReader(uploaded))
+	assert.NoError(err)
+	tr := tar.NewReader(gz)
+	foundCurrent := false
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		assert.NoError(err)
+		assert.True(strings.HasPrefix(header.Name, "ldbadmintest"))
+		if header.Name == "ldbadmintest/CURRENT" {
+			foundCurrent = true
+		}
+	}
+	assert.True(foundCurrent)
+}
+
+func TestLevelDBAdminBackupToURLFails(t *testing.T) {
+	assert := assert.New(t)
+
+	server := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		res.WriteHeader(403)
+	}))
+	defer server.Close()
+
+	router, kv, dir := newTestLevelDBAdmin(t, "", server.URL)
+	defer os.RemoveAll(dir)
+	defer kv.Close()
+
+	res := testLevelDBAdminRequest(router, "POST", "/admin/leveldb/backup", `{"name":"ldbadmintest","target":"`+server.URL+`"}`)
+	assert.Equal(500, res.Code)
+	assert.Regexp("Failed to upload backup: 403", res.Body.String())
+}
+
+func TestLevelDBAdminBackupToURLNotAllowed(t *testing.T) {
+	assert := assert.New(t)
+
+	uploads := 0
+	server := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		uploads++
+		res.WriteHeader(200)
+	}))
+	defer server.Close()
+
+	router, kv, dir := newTestLevelDBAdmin(t, "", server.URL+"/bucket")
+	defer os.RemoveAll(dir)
+	defer kv.Close()
+
+	for _, target := range []string{
+		"https://attacker.example.com/bucket/backup.tar.gz",
+		server.URL + "/other/backup.tar.gz",
+		server.URL + "/bucket2/backup.tar.gz",
+		server.URL + "/bucket/../other/backup.tar.gz",
+		strings.Replace(server.URL, "http://", "http://user:pass@", 1) + "/bucket/backup.tar.gz",
+	} {
+		res := testLevelDBAdminRequest(router, "POST", "/admin/leveldb/backup", `{"name":"ldbadmintest","target":"`+target+`?sig=secret"}`)
+		assert.Equal(403, res.Code)
+		assert.Regexp("Backup uploads to .* are not allowed", res.Body.String())
+		assert.NotContains(res.Body.String(), "secret")
+	}
+	assert.Equal(0, uploads)
+
+	router, kv2, dir2 := newTestLevelDBAdmin(t, "")
+	defer os.RemoveAll(dir2)
+	defer kv2.Close()
+	res := testLevelDBAdminRequest(router, "POST", "/admin/leveldb/backup", `{"name":"ldbadmintest","target":"`+server.URL+`/bucket/backup.tar.gz"}`)
+	assert.Equal(403, res.Code)
+	assert.Equal(0, uploads)
+}
+
+type testLevelDBAdminSecurityModule struct {
+	authtest.TestSecurityModule
+}
+
+func (sm *testLevelDBAdminSecurityModule) AuthAdmin(authCtx interface{}, operation string, args ...interface{}) error {
+	if authCtx == "verified" && operation == "leveldb.backup" {
+		return nil
+	}
+	return fmt.Errorf("badness")
+}
+
+func TestLevelDBAdminBackupAuthorization(t *testing.T) {
+	assert := assert.New(t)
+	backupPath, _ := ioutil.TempDir("", "ldbbackups")
+	defer os.RemoveAll(backupPath)
+	router, kv, dir := newTestLevelDBAdmin(t, backupPath)
+	defer os.RemoveAll(dir)
+	defer kv.Close()
+
+	// A security module without the admin extension cannot authorize an export
+	auth.RegisterSecurityModule(&authtest.TestSecurityModule{})
+	defer auth.RegisterSecurityModule(nil)
+	authCtx, _ := auth.WithAuthContext(context.Background(), "testat")
+	req := httptest.NewRequest("POST", "/admin/leveldb/backup", strings.NewReader(`{"name":"ldbadmintest","target":"backup1"}`)).WithContext(authCtx)
+	res := httptest.NewRecorder()
+	router.ServeHTTP(res, req)
+	assert.Equal(401, res.Code)
+	_, err := os.Stat(path.Join(backupPath, "backup1"))
+	assert.True(os.IsNotExist(err))
+
+	auth.RegisterSecurityModule(&testLevelDBAdminSecurityModule{})
+	req = httptest.NewRequest("POST", "/admin/leveldb/backup", strings.NewReader(`{"name":"ldbadmintest","target":"backup1"}`))
+	res = httptest.NewRecorder()
+	router.ServeHTTP(res, req)
+	assert.Equal(401, res.Code)
+
+	req = httptest.NewRequest("POST", "/admin/leveldb/backup", strings.NewReader(`{"name":"ldbadmintest","target":"backup1"}`)).WithContext(authCtx)
+	res = httptest.NewRecorder()
+	router.ServeHTTP(res, req)
+	assert.Equal(200, res.Code)
+}
@@ -55,7 +55,7 @@ func (m *mockKVStore) Delete(key string) error {
 func (m *mockKVStore) NewIterator() kvstore.KVIterator {
 	return nil
 }
-func (m *mockKVStore) NewIteratorWithRange(keyRange interface{}) kvstore.KVIterator {
+func (m *mockKVStore) NewIteratorWithRange(keyRange *kvstore.KVRange) kvstore.KVIterator {
 	return nil
 }
 
@@ -131,6 +131,47 @@ func TestLevelDBReceiptsAddReceiptOK(t *testing.T) {
 	}
 }
 
+func TestLevelDBReceiptsUpdateReceiptOK(t *testing.T) {
+	assert := assert.New(t)
+
+	conf := &LevelDBReceiptStoreConf{
+		Path: path.Join(tmpdir, "update"),
+	}
+	r, err := newLevelDBReceipts(conf)
+	assert.NoError(err)
+	defer r.store.Close()
+
+	receipt := map[string]interface{}{"_id": "r1", "from": "addr1", "receivedAt": 1, "prop1": "value1"}
+	err = r.AddReceipt("r1", &receipt)
+	assert.NoError(err)
+
+	updated := map[string]interface{}{"_id": "r1", "from": "addr1", "receivedAt": 1, "prop1": "value2"}
+	err = r.UpdateReceipt("r1", &updated)
+	assert.NoError(err)
+
+	result, err := r.GetReceipt("r1")
+	assert.NoError(err)
+	assert.Equal("value2", (*result)["prop1"])
+	results, err := r.GetReceipts(0, 10, nil, 0, "addr1", "", "")
+	assert.NoError(err)
+	assert.Equal(1, len(*results))
+	assert.Equal("value2", (*results)[0]["prop1"])
+
+	err = r.UpdateReceipt("r2", &updated)
+	assert.EqualError(err, "Receipt not available")
+}
+
+func TestLevelDBReceiptsUpdateReceiptFailed(t *testing.T) {
+	assert := assert.New(t)
+
+	r := &levelDBReceipts{
+		store: &mockKVStore{err: fmt.Errorf("pop")},
+	}
+	receipt := make(map[string]interface{})
+	err := r.UpdateReceipt("r1", &receipt)
+	assert.EqualError(err, "Failed to retrieve the entry for the original key: r1. pop")
+}
+
 func TestLevelDBReceiptsAddReceiptFailed(t *testing.T) {
 	assert := assert.New(t)
 
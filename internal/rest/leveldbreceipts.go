@@ -27,7 +27,6 @@ import (
 	"github.com/kaleido-io/ethconnect/internal/kvstore"
 	"github.com/oklog/ulid/v2"
 	log "github.com/sirupsen/logrus"
-	"github.com/syndtr/goleveldb/leveldb/util"
 )
 
 type levelDBReceipts struct {
@@ -39,10 +38,16 @@ type levelDBReceipts struct {
 }
 
 func newLevelDBReceipts(conf *LevelDBReceiptStoreConf) (*levelDBReceipts, error) {
-	store, err := kvstore.NewLDBKeyValueStore(conf.Path)
+	store, err := kvstore.NewKeyValueStore(conf.Path)
 	if err != nil {
 		return nil, errors.Errorf(errors.ReceiptStoreLevelDBConnect, err)
 	}
+	kvstore.SetKeyPrefixes(store, map[string]string{
+		"receipts":        "z",
+		"fromIndex":       "from:",
+		"toIndex":         "to:",
+		"receivedAtIndex": "receivedAt:",
+	})
 	t := time.Unix(1000000, 0)
 	entropy := ulid.Monotonic(rand.New(rand.NewSource(t.UnixNano())), 0)
 
@@ -96,6 +101,19 @@ func (l *levelDBReceipts) AddReceipt(requestID string, receipt *map[string]inter
 	return err
 }
 
+// UpdateReceipt replaces the content of an existing receipt. The from, to and receivedAt
+// indexes are not rebuilt, so those fields are expected to be unchanged
+func (l *levelDBReceipts) UpdateReceipt(requestID string, receipt *map[string]interface{}) error {
+	val, err := l.store.Get(requestID)
+	if err == kvstore.ErrorNotFound {
+		return errors.Errorf(errors.ReceiptStoreFailedNotFound)
+	} else if err != nil {
+		return errors.Errorf(errors.LevelDBFailedRetriveOriginalKey, requestID, err)
+	}
+	b, _ := json.MarshalIndent(receipt, "", "  ")
+	return l.store.Put(string(val), b)
+}
+
 // GetReceipts Returns recent receipts with skip, limit and other query parameters
 func (l *levelDBReceipts) GetReceipts(skip, limit int, ids []string, sinceEpochMS int64, from, to, start string) (*[]map[string]interface{}, error) {
 	// the application of the parameters are implemented to match mongo queries:
@@ -146,8 +164,8 @@ func (l *levelDBReceipts) GetReceipts(skip, limit int, ids []string, sinceEpochM
 	var itr kvstore.KVIterator
 	if endKey != "" {
 		// We iterate in reverse order, so the end key is the start
-		itr = l.store.NewIteratorWithRange(&util.Range{
-			Start: []byte(endKey),
+		itr = l.store.NewIteratorWithRange(&kvstore.KVRange{
+			Start: endKey,
 		})
 	} else {
 		// create the iterator without a range
@@ -84,3 +84,17 @@ func (m *memoryReceipts) AddReceipt(requestID string, receipt *map[string]interf
 	m.receipts.PushFront(receipt)
 	return nil
 }
+
+func (m *memoryReceipts) UpdateReceipt(requestID string, receipt *map[string]interface{}) error {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	for curElem := m.receipts.Front(); curElem != nil; curElem = curElem.Next() {
+		r := *curElem.Value.(*map[string]interface{})
+		if id, exists := r["_id"]; exists && id == requestID {
+			curElem.Value = receipt
+			return nil
+		}
+	}
+	return errors.Errorf(errors.ReceiptStoreFailedNotFound)
+}
@@ -56,3 +56,21 @@ func TestMemReceiptsNoIDFilterImpl(t *testing.T) {
 	_, err := r.GetReceipts(0, 0, []string{"test"}, 0, "t", "t", "")
 	assert.EqualError(err, "Memory receipts do not support filtering")
 }
+
+func TestMemReceiptsUpdateReceipt(t *testing.T) {
+	assert := assert.New(t)
+
+	r := newMemoryReceipts(&ReceiptStoreConf{MaxDocs: 50})
+	receipt := map[string]interface{}{"_id": "r1", "key": "before"}
+	r.AddReceipt("r1", &receipt)
+
+	updated := map[string]interface{}{"_id": "r1", "key": "after"}
+	err := r.UpdateReceipt("r1", &updated)
+	assert.NoError(err)
+	result, _ := r.GetReceipt("r1")
+	assert.Equal("after", (*result)["key"])
+	assert.Equal(1, r.receipts.Len())
+
+	err = r.UpdateReceipt("r2", &updated)
+	assert.EqualError(err, "Receipt not available")
+}
@@ -80,6 +80,11 @@ func (m *mongoReceipts) AddReceipt(requestID string, receipt *map[string]interfa
 	return m.collection.Insert(*receipt)
 }
 
+// UpdateReceipt replaces an existing receipt
+func (m *mongoReceipts) UpdateReceipt(requestID string, receipt *map[string]interface{}) (err error) {
+	return m.collection.UpdateId(requestID, *receipt)
+}
+
 // GetReceipts Returns recent receipts with skip & limit
 func (m *mongoReceipts) GetReceipts(skip, limit int, ids []string, sinceEpochMS int64, from, to, start string) (*[]map[string]interface{}, error) {
 	filter := bson.M{}
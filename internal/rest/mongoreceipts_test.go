@@ -46,6 +46,9 @@ func (m *mockMongo) GetCollection(database string, collection string) MongoColle
 type mockCollection struct {
 	inserted       map[string]interface{}
 	insertErr      error
+	updatedID      interface{}
+	updated        map[string]interface{}
+	updateErr      error
 	collInfo       *mgo.CollectionInfo
 	collErr        error
 	ensureIndexErr error
@@ -58,6 +61,12 @@ func (m *mockCollection) Insert(payloads ...interface{}) error {
 	return m.insertErr
 }
 
+func (m *mockCollection) UpdateId(id interface{}, update interface{}) error {
+	m.updatedID = id
+	m.updated = update.(map[string]interface{})
+	return m.updateErr
+}
+
 func (m *mockCollection) Create(info *mgo.CollectionInfo) error {
 	m.collInfo = info
 	return m.collErr
@@ -212,6 +221,27 @@ func TestMongoReceiptsAddReceiptFailed(t *testing.T) {
 	assert.EqualError(err, "pop")
 }
 
+func TestMongoReceiptsUpdateReceipt(t *testing.T) {
+	assert := assert.New(t)
+
+	mgoMock := &mockMongo{}
+	r := &mongoReceipts{
+		conf: &MongoDBReceiptStoreConf{},
+		mgo:  mgoMock,
+	}
+
+	r.connect()
+	receipt := map[string]interface{}{"_id": "key"}
+	err := r.UpdateReceipt("key", &receipt)
+	assert.NoError(err)
+	assert.Equal("key", mgoMock.collection.updatedID)
+	assert.Equal(receipt, mgoMock.collection.updated)
+
+	mgoMock.collection.updateErr = fmt.Errorf("pop")
+	err = r.UpdateReceipt("key", &receipt)
+	assert.EqualError(err, "pop")
+}
+
 func TestMongoReceiptsGetReceiptsOK(t *testing.T) {
 	assert := assert.New(t)
 
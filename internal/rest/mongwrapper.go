@@ -35,6 +35,7 @@ type MongoDatabase interface {
 // MongoCollection is the subset of mgo that we use, allowing stubbing
 type MongoCollection interface {
 	Insert(...interface{}) error
+	UpdateId(id interface{}, update interface{}) error
 	Create(info *mgo.CollectionInfo) error
 	EnsureIndex(index mgo.Index) error
 	Find(query interface{}) MongoQuery
@@ -61,6 +62,10 @@ func (m *collWrapper) Insert(docs ...interface{}) error {
 	return m.coll.Insert(docs...)
 }
 
+func (m *collWrapper) UpdateId(id interface{}, update interface{}) error {
+	return m.coll.UpdateId(id, update)
+}
+
 func (m *collWrapper) Create(info *mgo.CollectionInfo) error {
 	return m.coll.Create(info)
 }
@@ -0,0 +1,153 @@
+// Copyright 2021 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rest
+
+import (
+	"context"
+	"encoding/json"
+	"net/url"
+	"time"
+
+	"github.com/kaleido-io/ethconnect/internal/errors"
+	"github.com/kaleido-io/ethconnect/internal/opsevents"
+	"github.com/kaleido-io/ethconnect/internal/webhook"
+	"github.com/kaleido-io/ethconnect/internal/ws"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	defaultOpsEventsTopic             = "ops"
+	defaultOpsEventsMaxQueued         = 1000
+	defaultOpsEventsWebhookTimeoutSec = 10
+)
+
+// OpsEventsConf configures the publishing of operational events, such as a stream being
+// suspended or a failover between JSON/RPC nodes, on a WebSocket topic and optionally to a
+// webhook. Types limits the events published, and is all events if empty
+type OpsEventsConf struct {
+	Enabled   bool           `json:"enabled"`
+	Topic     string         `json:"topic,omitempty"`
+	Types     []string       `json:"types,omitempty"`
+	MaxQueued int            `json:"maxQueued,omitempty"`
+	Webhook   OpsWebhookConf `json:"webhook,omitempty"`
+}
+
+// OpsWebhookConf is a URL each operational event is posted to. Delivery is attempted once,
+// as the events are for monitoring. If a secret is configured the body is signed in the
+// same way as receipt webhooks
+type OpsWebhookConf struct {
+	URL               string            `json:"url,omitempty"`
+	Headers           map[string]string `json:"headers,omitempty"`
+	TLSkipHostVerify  bool              `json:"tlsSkipHostVerify,omitempty"`
+	RequestTimeoutSec uint32            `json:"requestTimeoutSec,omitempty"`
+	Secret            string            `json:"secret,omitempty"`
+}
+
+// opsEventsPublisher listens for operational events from all components of the gateway,
+// and delivers them in order from a queue, so the components publishing them never block.
+// Events are dropped if the queue is full
+type opsEventsPublisher struct {
+	conf           *OpsEventsConf
+	broadcast      chan<- interface{}
+	sender         *webhook.Sender
+	types          map[string]bool
+	queue          chan *opsevents.Event
+	stop           chan struct{}
+	done           chan struct{}
+	removeListener func()
+}
+
+func newOpsEventsPublisher(conf *OpsEventsConf, wsChannels ws.WebSocketChannels) (*opsEventsPublisher, error) {
+	if conf.Topic == "" {
+		conf.Topic = defaultOpsEventsTopic
+	}
+	if conf.MaxQueued <= 0 {
+		conf.MaxQueued = defaultOpsEventsMaxQueued
+	}
+	p := &opsEventsPublisher{
+		conf:  conf,
+		types: make(map[string]bool),
+		queue: make(chan *opsevents.Event, conf.MaxQueued),
+		stop:  make(chan struct{}),
+		done:  make(chan struct{}),
+	}
+	for _, t := range conf.Types {
+		p.types[t] = true
+	}
+	if conf.Webhook.URL != "" {
+		if _, err := url.Parse(conf.Webhook.URL); err != nil {
+			return nil, errors.Errorf(errors.OpsEventsWebhookInvalidURL, err)
+		}
+		if conf.Webhook.RequestTimeoutSec == 0 {
+			conf.Webhook.RequestTimeoutSec = defaultOpsEventsWebhookTimeoutSec
+		}
+		w := &conf.Webhook
+		p.sender = webhook.NewSender("Operational events webhook", w.URL, w.Headers, w.Secret, w.TLSkipHostVerify, time.Duration(w.RequestTimeoutSec)*time.Second)
+	}
+	_, p.broadcast, _, _ = wsChannels.GetChannels(conf.Topic)
+	return p, nil
+}
+
+func (p *opsEventsPublisher) start() {
+	p.removeListener = opsevents.AddListener(p.enqueue)
+	go p.deliveryLoop()
+	log.Infof("Publishing operational events on WebSocket topic '%s'", p.conf.Topic)
+}
+
+func (p *opsEventsPublisher) close() {
+	p.removeListener()
+	close(p.stop)
+	<-p.done
+}
+
+// enqueue is the listener for events. It never blocks
+func (p *opsEventsPublisher) enqueue(event *opsevents.Event) {
+	if len(p.types) > 0 && !p.types[event.Type] {
+		return
+	}
+	select {
+	case p.queue <- event:
+	default:
+		log.Warnf("Operational event queue full (%d events). Dropped %s event %s", p.conf.MaxQueued, event.Type, event.ID)
+	}
+}
+
+func (p *opsEventsPublisher) deliveryLoop() {
+	defer close(p.done)
+	for {
+		select {
+		case <-p.stop:
+			return
+		case event := <-p.queue:
+			log.Debugf("Operational event %s: %s", event.ID, event.Type)
+			select {
+			case p.broadcast <- event:
+			case <-p.stop:
+				return
+			}
+			if p.sender != nil {
+				if err := p.post(event); err != nil {
+					log.Errorf("Failed to post operational event %s to webhook: %s", event.ID, err)
+				}
+			}
+		}
+	}
+}
+
+func (p *opsEventsPublisher) post(event *opsevents.Event) error {
+	reqBytes, _ := json.Marshal(event)
+	_, err := p.sender.Post(context.Background(), reqBytes, nil)
+	return err
+}
@@ -0,0 +1,113 @@
+// Copyright 2021 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rest
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/kaleido-io/ethconnect/internal/opsevents"
+	"github.com/stretchr/testify/assert"
+)
+
+type opsEventsTestWS struct {
+	topic     string
+	broadcast chan interface{}
+}
+
+func (m *opsEventsTestWS) GetChannels(topic string) (chan<- interface{}, chan<- interface{}, <-chan error, <-chan struct{}) {
+	m.topic = topic
+	return nil, m.broadcast, nil, nil
+}
+
+func (m *opsEventsTestWS) SendReply(message interface{}) {}
+
+func TestOpsEventsPublishToTopicAndWebhook(t *testing.T) {
+	assert := assert.New(t)
+
+	posted := make(chan *opsevents.Event, 1)
+	svr := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		assert.Equal("monitor", req.Header.Get("x-source"))
+		assert.Regexp("^sha256=[0-9a-f]{64}$", req.Header.Get(ReceiptWebhookSignatureHeader))
+		var event opsevents.Event
+		json.Unmarshal(body, &event)
+		posted <- &event
+		res.WriteHeader(204)
+	}))
+	defer svr.Close()
+
+	wsChannels := &opsEventsTestWS{broadcast: make(chan interface{})}
+	p, err := newOpsEventsPublisher(&OpsEventsConf{
+		Enabled: true,
+		Types:   []string{opsevents.RPCFailover},
+		Webhook: OpsWebhookConf{
+			URL:     svr.URL,
+			Headers: map[string]string{"x-source": "monitor"},
+			Secret:  "s3cret",
+		},
+	}, wsChannels)
+	assert.NoError(err)
+	assert.Equal("ops", wsChannels.topic)
+	p.start()
+	defer p.close()
+
+	// Events of other types are filtered out
+	opsevents.Publish(opsevents.StreamSuspended, nil)
+	opsevents.Publish(opsevents.RPCFailover, map[string]interface{}{"from": "node1", "to": "node2"})
+
+	broadcast := (<-wsChannels.broadcast).(*opsevents.Event)
+	assert.Equal(opsevents.RPCFailover, broadcast.Type)
+	assert.Equal("node2", broadcast.Data["to"])
+	webhook := <-posted
+	assert.Equal(broadcast.ID, webhook.ID)
+	assert.Equal("node1", webhook.Data["from"])
+}
+
+func TestOpsEventsQueueFullAndWebhookFailure(t *testing.T) {
+	assert := assert.New(t)
+
+	svr := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		res.WriteHeader(500)
+	}))
+	defer svr.Close()
+
+	wsChannels := &opsEventsTestWS{broadcast: make(chan interface{})}
+	p, err := newOpsEventsPublisher(&OpsEventsConf{
+		Topic:     "operations",
+		MaxQueued: 1,
+		Webhook:   OpsWebhookConf{URL: svr.URL},
+	}, wsChannels)
+	assert.NoError(err)
+	assert.Equal("operations", wsChannels.topic)
+
+	// Nothing is delivering, so the second event is dropped
+	p.enqueue(&opsevents.Event{ID: "1", Type: opsevents.KafkaReconnecting})
+	p.enqueue(&opsevents.Event{ID: "2", Type: opsevents.KafkaReconnecting})
+	assert.Len(p.queue, 1)
+
+	err = p.post(&opsevents.Event{ID: "3"})
+	assert.EqualError(err, "Operational events webhook: Failed with status=500")
+
+	_, err = newOpsEventsPublisher(&OpsEventsConf{Webhook: OpsWebhookConf{URL: ":bad"}}, wsChannels)
+	assert.Regexp("Invalid URL configured for the operational events webhook", err)
+
+	// Closing while an event waits for the WebSocket topic
+	p.start()
+	p.close()
+}
@@ -0,0 +1,253 @@
+// Copyright 2021 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rest
+
+import (
+	"encoding/json"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/kaleido-io/ethconnect/internal/auth"
+	"github.com/kaleido-io/ethconnect/internal/errors"
+	"github.com/kaleido-io/ethconnect/internal/events"
+	"github.com/kaleido-io/ethconnect/internal/quotas"
+	"github.com/kaleido-io/ethconnect/internal/utils"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// RouteClassSubmit is requests that submit transactions, or otherwise change state
+	RouteClassSubmit = "submit"
+	// RouteClassQuery is requests that only read, including GET requests and calls
+	RouteClassQuery = "query"
+	// RouteClassAdmin is requests to the administrative APIs, such as event streams
+	RouteClassAdmin = "admin"
+
+	defaultRateLimitMaxIdentities = 10000
+)
+
+// rateLimitAdminPaths are the path prefixes of the administrative APIs
+var rateLimitAdminPaths = []string{
+	"/admin",
+	"/aliases",
+	"/identities",
+	"/privacy",
+	"/receiptwebhooks",
+	"/registry/",
+	"/status/",
+	events.StreamPathPrefix,
+	events.SubPathPrefix,
+}
+
+// rateLimitExemptPaths are never limited, so health checks and metrics scrapes cannot fail
+var rateLimitExemptPaths = map[string]bool{
+	"/status":  true,
+	"/metrics": true,
+}
+
+// RateLimitConf configures token bucket rate limits on the REST gateway, for each identity
+// and class of route. Identities are the authenticated principal, or the tenant of the
+// security module, or the remote address of an unauthenticated request
+type RateLimitConf struct {
+	Enabled    bool                   `json:"enabled"`
+	Default    RateLimits             `json:"default"`
+	Identities map[string]*RateLimits `json:"identities,omitempty"`
+	// MaxIdentities bounds the identities whose usage is tracked at once. Once reached, new
+	// identities share one bucket for each class, with the default limits
+	MaxIdentities int `json:"maxIdentities,omitempty"`
+}
+
+// RateLimits are the limits of each class of route. A class without a rate is unlimited
+type RateLimits struct {
+	Submit RateLimit `json:"submit"`
+	Query  RateLimit `json:"query"`
+	Admin  RateLimit `json:"admin"`
+}
+
+// RateLimit is the sustained rate of requests, and the burst of requests allowed at once.
+// The burst defaults to the rate
+type RateLimit struct {
+	PerSec int `json:"perSec,omitempty"`
+	Burst  int `json:"burst,omitempty"`
+}
+
+// rateLimiter holds a token bucket for each identity and route class that has been used,
+// and an overflow bucket for each class shared by identities beyond MaxIdentities
+type rateLimiter struct {
+	conf     *RateLimitConf
+	mux      sync.Mutex
+	buckets  map[string]*quotas.Throttle
+	overflow map[string]*quotas.Throttle
+}
+
+func newRateLimiter(conf *RateLimitConf) *rateLimiter {
+	if conf.MaxIdentities <= 0 {
+		conf.MaxIdentities = defaultRateLimitMaxIdentities
+	}
+	return &rateLimiter{
+		conf:     conf,
+		buckets:  make(map[string]*quotas.Throttle),
+		overflow: make(map[string]*quotas.Throttle),
+	}
+}
+
+// routeClass classifies a request as an admin, query or submit request
+func routeClass(req *http.Request) string {
+	for _, prefix := range rateLimitAdminPaths {
+		if strings.HasPrefix(req.URL.Path, prefix) {
+			return RouteClassAdmin
+		}
+	}
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return RouteClassQuery
+	}
+	if strings.ToLower(getQueryOrHeader(req, "call")) == "true" {
+		return RouteClassQuery
+	}
+	return RouteClassSubmit
+}
+
+// getQueryOrHeader returns a fly- query parameter, or the equivalent x-firefly- header
+func getQueryOrHeader(req *http.Request, name string) string {
+	if v, ok := req.URL.Query()[utils.GetenvOrDefaultLowerCase("PREFIX_SHORT", "fly")+"-"+name]; ok {
+		if len(v) == 0 || v[0] == "" {
+			return "true"
+		}
+		return v[0]
+	}
+	return req.Header.Get("x-" + utils.GetenvOrDefaultLowerCase("PREFIX_LONG", "firefly") + "-" + name)
+}
+
+// rateLimitIdentity is the principal, tenant, or remote address the request is limited as
+func rateLimitIdentity(req *http.Request) string {
+	if principal := auth.GetPrincipal(req.Context()); principal != "" {
+		return principal
+	}
+	if tenant := auth.GetTenant(req.Context()); tenant != "" {
+		return tenant
+	}
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
+
+func (r *rateLimiter) limitFor(identity, class string) RateLimit {
+	limits := &r.conf.Default
+	if l, ok := r.conf.Identities[identity]; ok && l != nil {
+		limits = l
+	}
+	return limits.forClass(class)
+}
+
+func (limits *RateLimits) forClass(class string) RateLimit {
+	switch class {
+	case RouteClassAdmin:
+		return limits.Admin
+	case RouteClassQuery:
+		return limits.Query
+	default:
+		return limits.Submit
+	}
+}
+
+// bucket returns the token bucket of the identity for the class, or nil if it is unlimited
+func (r *rateLimiter) bucket(identity, class string) *quotas.Throttle {
+	limit := r.limitFor(identity, class)
+	if limit.PerSec <= 0 {
+		return nil
+	}
+	key := class + "/" + identity
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	if b := r.buckets[key]; b != nil {
+		return b
+	}
+	if len(r.buckets) >= r.conf.MaxIdentities {
+		r.evictIdle()
+		if len(r.buckets) >= r.conf.MaxIdentities {
+			return r.overflowBucket(class)
+		}
+	}
+	b := newRateLimitBucket(limit)
+	r.buckets[key] = b
+	return b
+}
+
+// overflowBucket returns the bucket shared by the identities of the class that cannot be
+// tracked, limited as the default. Must be called holding the lock
+func (r *rateLimiter) overflowBucket(class string) *quotas.Throttle {
+	b := r.overflow[class]
+	if b == nil {
+		limit := r.conf.Default.forClass(class)
+		if limit.PerSec <= 0 {
+			return nil
+		}
+		log.Warnf("Rate limiter tracking the maximum of %d buckets. New identities share the %s limit", r.conf.MaxIdentities, class)
+		b = newRateLimitBucket(limit)
+		r.overflow[class] = b
+	}
+	return b
+}
+
+func newRateLimitBucket(limit RateLimit) *quotas.Throttle {
+	burst := limit.Burst
+	if burst <= 0 {
+		burst = limit.PerSec
+	}
+	return quotas.NewBurstThrottle(limit.PerSec, burst)
+}
+
+// evictIdle forgets the buckets that are full, as a new bucket behaves the same
+func (r *rateLimiter) evictIdle() {
+	for key, b := range r.buckets {
+		if b.Idle() {
+			delete(r.buckets, key)
+		}
+	}
+	log.Debugf("Rate limiter tracking %d buckets after evicting idle buckets", len(r.buckets))
+}
+
+// newRateLimitHandler rejects requests over the limit of the identity with 429, and a
+// Retry-After header with the seconds until the request would be allowed
+func (r *rateLimiter) newRateLimitHandler(parent http.Handler) http.Handler {
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		if rateLimitExemptPaths[req.URL.Path] {
+			parent.ServeHTTP(res, req)
+			return
+		}
+		identity := rateLimitIdentity(req)
+		class := routeClass(req)
+		if b := r.bucket(identity, class); b != nil {
+			if ok, wait := b.Reserve(1); !ok {
+				retryAfter := int(math.Ceil(wait.Seconds()))
+				log.Warnf("Rate limit of %s requests exceeded by '%s': %s %s", class, identity, req.Method, req.URL.Path)
+				reply, _ := json.Marshal(&errMsg{Message: errors.Errorf(errors.RESTGatewayRateLimited, class, retryAfter).Error()})
+				res.Header().Set("Content-Type", "application/json")
+				res.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+				res.WriteHeader(http.StatusTooManyRequests)
+				res.Write(reply)
+				return
+			}
+		}
+		parent.ServeHTTP(res, req)
+	})
+}
@@ -0,0 +1,141 @@
+// Copyright 2021 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rest
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestRateLimitHandler(conf *RateLimitConf) (http.Handler, *int) {
+	calls := 0
+	r := newRateLimiter(conf)
+	return r.newRateLimitHandler(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		calls++
+		res.WriteHeader(200)
+	})), &calls
+}
+
+func sendRateLimitRequest(handler http.Handler, method, path, remoteAddr string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, nil)
+	req.RemoteAddr = remoteAddr
+	res := httptest.NewRecorder()
+	handler.ServeHTTP(res, req)
+	return res
+}
+
+func TestRouteClass(t *testing.T) {
+	assert := assert.New(t)
+	assert.Equal(RouteClassQuery, routeClass(httptest.NewRequest("GET", "/contracts/0x123/get", nil)))
+	assert.Equal(RouteClassQuery, routeClass(httptest.NewRequest("POST", "/contracts/0x123/get?fly-call", nil)))
+	callReq := httptest.NewRequest("POST", "/contracts/0x123/get", nil)
+	callReq.Header.Set("x-firefly-call", "true")
+	assert.Equal(RouteClassQuery, routeClass(callReq))
+	assert.Equal(RouteClassSubmit, routeClass(httptest.NewRequest("POST", "/contracts/0x123/set", nil)))
+	assert.Equal(RouteClassSubmit, routeClass(httptest.NewRequest("POST", "/abis/abc", nil)))
+	assert.Equal(RouteClassAdmin, routeClass(httptest.NewRequest("GET", "/eventstreams", nil)))
+	assert.Equal(RouteClassAdmin, routeClass(httptest.NewRequest("POST", "/admin/leveldb/compact", nil)))
+	assert.Equal(RouteClassAdmin, routeClass(httptest.NewRequest("GET", "/status/tx", nil)))
+	assert.Equal(RouteClassAdmin, routeClass(httptest.NewRequest("POST", "/registry/invalidate", nil)))
+}
+
+func TestRateLimitBurstAndRetryAfter(t *testing.T) {
+	assert := assert.New(t)
+	handler, calls := newTestRateLimitHandler(&RateLimitConf{
+		Default: RateLimits{Submit: RateLimit{PerSec: 1, Burst: 2}},
+	})
+
+	assert.Equal(200, sendRateLimitRequest(handler, "POST", "/contracts/0x123/set", "10.0.0.1:1234").Code)
+	assert.Equal(200, sendRateLimitRequest(handler, "POST", "/contracts/0x123/set", "10.0.0.1:5678").Code)
+	res := sendRateLimitRequest(handler, "POST", "/contracts/0x123/set", "10.0.0.1:1234")
+	assert.Equal(429, res.Code)
+	assert.Equal("1", res.Header().Get("Retry-After"))
+	assert.Equal("application/json", res.Header().Get("Content-Type"))
+	assert.Regexp("Rate limit exceeded for submit requests. Retry after 1 seconds", res.Body.String())
+	assert.Equal(2, *calls)
+
+	// Other identities, and other classes of route, have their own buckets
+	assert.Equal(200, sendRateLimitRequest(handler, "POST", "/contracts/0x123/set", "10.0.0.2:1234").Code)
+	for i := 0; i < 10; i++ {
+		assert.Equal(200, sendRateLimitRequest(handler, "GET", "/contracts/0x123/get", "10.0.0.1:1234").Code)
+	}
+}
+
+func TestRateLimitIdentityOverridesAndExemptPaths(t *testing.T) {
+	assert := assert.New(t)
+	handler, _ := newTestRateLimitHandler(&RateLimitConf{
+		Default: RateLimits{
+			Query: RateLimit{PerSec: 1},
+			Admin: RateLimit{PerSec: 1},
+		},
+		Identities: map[string]*RateLimits{
+			"10.0.0.9": {Query: RateLimit{PerSec: 100}},
+		},
+	})
+
+	assert.Equal(200, sendRateLimitRequest(handler, "GET", "/eventstreams", "10.0.0.1:1234").Code)
+	assert.Equal(429, sendRateLimitRequest(handler, "GET", "/subscriptions", "10.0.0.1:1234").Code)
+	for i := 0; i < 5; i++ {
+		assert.Equal(200, sendRateLimitRequest(handler, "GET", "/status", "10.0.0.1:1234").Code)
+	}
+
+	// The override replaces the defaults, so admin requests are unlimited for the identity
+	for i := 0; i < 50; i++ {
+		assert.Equal(200, sendRateLimitRequest(handler, "GET", "/contracts", "10.0.0.9:1234").Code)
+		assert.Equal(200, sendRateLimitRequest(handler, "GET", "/eventstreams", "10.0.0.9:1234").Code)
+	}
+}
+
+func TestRateLimitEvictsIdleBuckets(t *testing.T) {
+	assert := assert.New(t)
+	r := newRateLimiter(&RateLimitConf{
+		Default:       RateLimits{Submit: RateLimit{PerSec: 1}},
+		MaxIdentities: 2,
+	})
+	assert.Nil(r.bucket("a", RouteClassQuery))
+	assert.True(r.bucket("a", RouteClassSubmit).Allow(1))
+	r.bucket("b", RouteClassSubmit)
+	assert.Len(r.buckets, 2)
+	// The bucket of "b" is full so is evicted, while "a" has been used
+	r.bucket("c", RouteClassSubmit)
+	assert.Len(r.buckets, 2)
+	assert.NotNil(r.buckets["submit/a"])
+	assert.NotNil(r.buckets["submit/c"])
+}
+
+func TestRateLimitOverflowBucketShared(t *testing.T) {
+	assert := assert.New(t)
+	r := newRateLimiter(&RateLimitConf{
+		Default: RateLimits{Submit: RateLimit{PerSec: 1}},
+		Identities: map[string]*RateLimits{
+			"vip": {Submit: RateLimit{PerSec: 100}, Query: RateLimit{PerSec: 100}},
+		},
+		MaxIdentities: 1,
+	})
+	assert.True(r.bucket("a", RouteClassSubmit).Allow(1))
+	// Nothing is idle to evict, so new identities share the overflow bucket
+	b := r.bucket("b", RouteClassSubmit)
+	assert.NotNil(b)
+	assert.Equal(b, r.bucket("c", RouteClassSubmit))
+	assert.True(b.Allow(1))
+	assert.False(r.bucket("d", RouteClassSubmit).Allow(1))
+	assert.Len(r.buckets, 1)
+	assert.NotNil(r.buckets["submit/a"])
+	// The overflow bucket has the default limits, so is unlimited for queries
+	assert.Nil(r.bucket("vip", RouteClassQuery))
+}
@@ -0,0 +1,413 @@
+// Copyright 2021 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rest
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+	"sync"
+	"time"
+
+	ethbinding "github.com/kaleido-io/ethbinding/pkg"
+	"github.com/kaleido-io/ethconnect/internal/errors"
+	"github.com/kaleido-io/ethconnect/internal/eth"
+	"github.com/kaleido-io/ethconnect/internal/ethbind"
+	"github.com/kaleido-io/ethconnect/internal/kvstore"
+	"github.com/kaleido-io/ethconnect/internal/messages"
+	"github.com/kaleido-io/ethconnect/internal/metrics"
+	"github.com/kaleido-io/ethconnect/internal/utils"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	defaultReceiptReconcileIntervalSec = 60
+	defaultReceiptReconcileMaxAgeSec   = 24 * 60 * 60
+	receiptReconcileBackfillPageSize   = 100
+	pendingReceiptPrefix               = "pending/"
+	pendingReceiptPrefixEnd            = "pending0"
+
+	receiptReconciledMined    = "mined"
+	receiptReconciledReplaced = "replaced"
+	receiptReconciledExpired  = "expired"
+)
+
+// ReceiptReconcilerConf configures the background job that repairs receipts stored
+// before the outcome of their transaction was known
+type ReceiptReconcilerConf struct {
+	Enabled bool `json:"enabled"`
+	// PendingDB is a KV store connection string to persist the receipts being reconciled. It is held in memory if not set
+	PendingDB   string `json:"pendingDB,omitempty"`
+	IntervalSec uint32 `json:"intervalSec,omitempty"`
+	MaxAgeSec   uint32 `json:"maxAgeSec,omitempty"`
+}
+
+// pendingReceipt is a stored receipt whose transaction was submitted, but not known to be mined.
+// The sender and nonce are recorded once the node reports them, so a replacement can be detected
+// after the node has forgotten the transaction
+type pendingReceipt struct {
+	RequestID       string `json:"requestId"`
+	TransactionHash string `json:"transactionHash"`
+	From            string `json:"from,omitempty"`
+	Nonce           *int64 `json:"nonce,omitempty"`
+	Added           int64  `json:"added"`
+}
+
+type pendingTxInfo struct {
+	From  *ethbinding.Address   `json:"from"`
+	Nonce *ethbinding.HexUint64 `json:"nonce"`
+}
+
+// receiptReconciler periodically checks the chain for the outcome of transactions that had
+// a receipt stored as an error with a transaction hash - such as a timeout waiting for the
+// receipt, or a crash or re-org while waiting. The stored receipt is replaced once the
+// transaction is mined, or once its nonce is known to have been used by another transaction.
+type receiptReconciler struct {
+	conf       *ReceiptReconcilerConf
+	store      *receiptStore
+	rpc        eth.RPCClient
+	db         kvstore.KVStore
+	mux        sync.Mutex
+	reconciled *metrics.CounterVec
+	ctx        context.Context
+	cancel     func()
+	done       chan struct{}
+}
+
+func newReceiptReconciler(conf *ReceiptReconcilerConf, store *receiptStore, rpc eth.RPCClient) (r *receiptReconciler, err error) {
+	if conf.IntervalSec == 0 {
+		conf.IntervalSec = defaultReceiptReconcileIntervalSec
+	}
+	if conf.MaxAgeSec == 0 {
+		conf.MaxAgeSec = defaultReceiptReconcileMaxAgeSec
+	}
+	r = &receiptReconciler{
+		conf:  conf,
+		store: store,
+		rpc:   rpc,
+		reconciled: metrics.NewCounterVec(
+			"ethconnect_receipts_reconciled_total",
+			"Stored receipts resolved by the receipt reconciler, by result",
+			"result",
+		),
+		done: make(chan struct{}),
+	}
+	if conf.PendingDB != "" {
+		if r.db, err = kvstore.NewKeyValueStore(conf.PendingDB); err != nil {
+			return nil, errors.Errorf(errors.ReceiptReconcilerDBOpen, err)
+		}
+	} else {
+		r.db = kvstore.NewMemoryKeyValueStore()
+	}
+	r.ctx, r.cancel = context.WithCancel(context.Background())
+	return r, nil
+}
+
+func (r *receiptReconciler) start() {
+	go r.run()
+}
+
+func (r *receiptReconciler) close() {
+	r.cancel()
+	<-r.done
+	r.db.Close()
+}
+
+func (r *receiptReconciler) run() {
+	defer close(r.done)
+	r.backfill()
+	ticker := time.NewTicker(time.Duration(r.conf.IntervalSec) * time.Second)
+	defer ticker.Stop()
+	for {
+		r.reconcile()
+		select {
+		case <-ticker.C:
+		case <-r.ctx.Done():
+			log.Debugf("Receipt reconciler stopped")
+			return
+		}
+	}
+}
+
+// isPendingReceipt is true for an error receipt with a transaction hash, that has not already been reconciled
+func isPendingReceipt(receipt map[string]interface{}, headers map[string]interface{}) bool {
+	if reconciled, ok := receipt["reconciled"].(bool); ok && reconciled {
+		return false
+	}
+	return utils.GetMapString(headers, "type") == messages.MsgTypeError &&
+		utils.GetMapString(receipt, "transactionHash") != ""
+}
+
+// backfill tracks the pending receipts already in the store, within the maximum age, so receipts
+// stored before a restart (or before the reconciler was enabled) are reconciled
+func (r *receiptReconciler) backfill() {
+	if r.store.persistence == nil {
+		return
+	}
+	since := time.Now().Add(-time.Duration(r.conf.MaxAgeSec)*time.Second).UnixNano() / int64(time.Millisecond)
+	for skip := 0; r.ctx.Err() == nil; skip += receiptReconcileBackfillPageSize {
+		receipts, err := r.store.persistence.GetReceipts(skip, receiptReconcileBackfillPageSize, nil, since, "", "", "")
+		if err != nil {
+			log.Warnf("Unable to query the receipt store for pending receipts: %s", err)
+			return
+		}
+		for _, receipt := range *receipts {
+			r.track(receipt)
+		}
+		if len(*receipts) < receiptReconcileBackfillPageSize {
+			return
+		}
+	}
+}
+
+// track records a stored receipt to be reconciled, if it is pending
+func (r *receiptReconciler) track(receipt map[string]interface{}) {
+	headers := r.store.extractHeaders(receipt)
+	if headers == nil || !isPendingReceipt(receipt, headers) {
+		return
+	}
+	requestID := utils.GetMapString(headers, "requestId")
+	if requestID == "" {
+		return
+	}
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	key := pendingReceiptPrefix + requestID
+	if _, err := r.db.Get(key); err == nil {
+		return
+	}
+	p := &pendingReceipt{
+		RequestID:       requestID,
+		TransactionHash: utils.GetMapString(receipt, "transactionHash"),
+		Added:           receivedAtMS(receipt),
+	}
+	b, _ := json.Marshal(p)
+	if err := r.db.Put(key, b); err != nil {
+		log.Errorf("%s: Failed to track pending receipt for transaction %s: %s", requestID, p.TransactionHash, err)
+		return
+	}
+	log.Infof("%s: Tracking pending receipt for transaction %s", requestID, p.TransactionHash)
+}
+
+// receivedAtMS handles the receivedAt time as stored (int64), or as decoded from JSON (float64)
+func receivedAtMS(receipt map[string]interface{}) int64 {
+	switch v := receipt["receivedAt"].(type) {
+	case int64:
+		return v
+	case float64:
+		return int64(v)
+	default:
+		return time.Now().UnixNano() / int64(time.Millisecond)
+	}
+}
+
+func (r *receiptReconciler) update(p *pendingReceipt) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	b, _ := json.Marshal(p)
+	if err := r.db.Put(pendingReceiptPrefix+p.RequestID, b); err != nil {
+		log.Errorf("%s: Failed to update pending receipt: %s", p.RequestID, err)
+	}
+}
+
+func (r *receiptReconciler) untrack(requestID, result string) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	if err := r.db.Delete(pendingReceiptPrefix + requestID); err != nil {
+		log.Errorf("%s: Failed to remove pending receipt: %s", requestID, err)
+	}
+	r.reconciled.Inc(result)
+}
+
+func (r *receiptReconciler) pending() []*pendingReceipt {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	pending := []*pendingReceipt{}
+	it := r.db.NewIteratorWithRange(&kvstore.KVRange{Start: pendingReceiptPrefix, Limit: pendingReceiptPrefixEnd})
+	for it.Next() {
+		var p pendingReceipt
+		if err := json.Unmarshal(it.Value(), &p); err != nil {
+			log.Errorf("Failed to load pending receipt '%s': %s", it.Key(), err)
+			continue
+		}
+		pending = append(pending, &p)
+	}
+	it.Release()
+	return pending
+}
+
+// reconcile checks the chain for each pending receipt. Failures to query the node are
+// left to the next interval
+func (r *receiptReconciler) reconcile() {
+	for _, p := range r.pending() {
+		if r.ctx.Err() != nil {
+			return
+		}
+		if err := r.reconcileReceipt(p); err != nil {
+			log.Warnf("%s: Unable to reconcile receipt for transaction %s: %s", p.RequestID, p.TransactionHash, err)
+		}
+	}
+}
+
+func (r *receiptReconciler) reconcileReceipt(p *pendingReceipt) error {
+	tx := &eth.Txn{Hash: p.TransactionHash}
+	isMined, err := tx.GetTXReceipt(r.ctx, r.rpc)
+	if err != nil {
+		return err
+	}
+	if isMined {
+		return r.repair(p, receiptReconciledMined, func(existing map[string]interface{}) map[string]interface{} {
+			return minedReceipt(existing, p, &tx.Receipt)
+		})
+	}
+
+	replaced, err := r.checkReplaced(p)
+	if err != nil {
+		return err
+	}
+	if replaced {
+		return r.repair(p, receiptReconciledReplaced, func(existing map[string]interface{}) map[string]interface{} {
+			existing["errorMessage"] = errors.Errorf(errors.ReceiptReconcilerReplaced, p.TransactionHash, *p.Nonce, p.From).Error()
+			return existing
+		})
+	}
+
+	if time.Since(time.Unix(0, p.Added*int64(time.Millisecond))) > time.Duration(r.conf.MaxAgeSec)*time.Second {
+		log.Warnf("%s: Transaction %s is still pending after %ds. No longer reconciling", p.RequestID, p.TransactionHash, r.conf.MaxAgeSec)
+		r.untrack(p.RequestID, receiptReconciledExpired)
+	}
+	return nil
+}
+
+// checkReplaced looks the transaction up by hash. While the node knows the transaction it might
+// still be mined, so its sender and nonce are recorded. Once the node no longer knows it, it has
+// been replaced if the sender has mined a transaction with that nonce
+func (r *receiptReconciler) checkReplaced(p *pendingReceipt) (bool, error) {
+	ctx, cancel := context.WithTimeout(r.ctx, 30*time.Second)
+	defer cancel()
+
+	var info *pendingTxInfo
+	if err := r.rpc.CallContext(ctx, &info, "eth_getTransactionByHash", p.TransactionHash); err != nil {
+		return false, errors.Errorf(errors.RPCCallReturnedError, "eth_getTransactionByHash", err)
+	}
+	if info != nil && info.From != nil && info.Nonce != nil {
+		if p.Nonce == nil {
+			nonce := int64(*info.Nonce)
+			p.From = info.From.String()
+			p.Nonce = &nonce
+			r.update(p)
+		}
+		return false, nil
+	}
+	if p.Nonce == nil {
+		return false, nil
+	}
+	from := ethbind.API.HexToAddress(p.From)
+	txnCount, err := eth.GetTransactionCount(ctx, r.rpc, &from, "latest")
+	if err != nil {
+		return false, err
+	}
+	return txnCount > *p.Nonce, nil
+}
+
+// repair replaces the stored receipt, and delivers the replacement in the same way as a new receipt
+func (r *receiptReconciler) repair(p *pendingReceipt, result string, build func(existing map[string]interface{}) map[string]interface{}) error {
+	existing, err := r.store.persistence.GetReceipt(p.RequestID)
+	if err != nil {
+		return err
+	}
+	if existing == nil {
+		log.Warnf("%s: Pending receipt is no longer in the receipt store", p.RequestID)
+		r.untrack(p.RequestID, result)
+		return nil
+	}
+	repaired := build(*existing)
+	delete(repaired, "receiptPending")
+	repaired["reconciled"] = true
+	repaired["reconciledAt"] = time.Now().UnixNano() / int64(time.Millisecond)
+	stored := redactReceipt(repaired)
+	if err := r.store.persistence.UpdateReceipt(p.RequestID, &stored); err != nil {
+		return err
+	}
+	log.Infof("%s: Reconciled receipt for transaction %s: %s", p.RequestID, p.TransactionHash, result)
+
+	if r.store.smartContractGW != nil {
+		headers := r.store.extractHeaders(repaired)
+		if utils.GetMapString(headers, "type") == messages.MsgTypeTransactionSuccess && utils.GetMapString(repaired, "contractAddress") != "" {
+			var receipt messages.TransactionReceipt
+			b, _ := json.Marshal(repaired)
+			if err := json.Unmarshal(b, &receipt); err == nil {
+				if err = r.store.smartContractGW.PostDeploy(&receipt); err != nil {
+					log.Errorf("Failed to process receipt in smart contract gateway: %s", err)
+				}
+			}
+		}
+		r.store.smartContractGW.SendReply(repaired)
+	}
+	if r.store.webhooks != nil {
+		r.store.webhooks.dispatch(repaired)
+	}
+	r.untrack(p.RequestID, result)
+	return nil
+}
+
+// minedReceipt builds a transaction receipt in place of a stored error, keeping the
+// headers, ID and receivedAt time of the stored entry
+func minedReceipt(existing map[string]interface{}, p *pendingReceipt, receipt *eth.TxnReceipt) map[string]interface{} {
+	reply := &messages.TransactionReceipt{}
+	reply.BlockHash = receipt.BlockHash
+	if receipt.BlockNumber != nil {
+		reply.BlockNumberStr = receipt.BlockNumber.ToInt().Text(10)
+	}
+	reply.ContractAddress = receipt.ContractAddress
+	if receipt.CumulativeGasUsed != nil {
+		reply.CumulativeGasUsedStr = receipt.CumulativeGasUsed.ToInt().Text(10)
+	}
+	reply.From = receipt.From
+	if receipt.GasUsed != nil {
+		reply.GasUsedStr = receipt.GasUsed.ToInt().Text(10)
+	}
+	if p.Nonce != nil {
+		reply.NonceStr = strconv.FormatInt(*p.Nonce, 10)
+	}
+	if receipt.Status != nil {
+		reply.StatusStr = receipt.Status.ToInt().Text(10)
+	}
+	reply.To = receipt.To
+	reply.TransactionHash = receipt.TransactionHash
+	if receipt.TransactionIndex != nil {
+		reply.TransactionIndexStr = strconv.FormatUint(uint64(*receipt.TransactionIndex), 10)
+	}
+
+	var repaired map[string]interface{}
+	b, _ := json.Marshal(reply)
+	json.Unmarshal(b, &repaired)
+
+	headers := make(map[string]interface{})
+	if iHeaders, ok := existing["headers"].(map[string]interface{}); ok {
+		for k, v := range iHeaders {
+			headers[k] = v
+		}
+	}
+	if receipt.Status != nil && receipt.Status.ToInt().Int64() > 0 {
+		headers["type"] = messages.MsgTypeTransactionSuccess
+	} else {
+		headers["type"] = messages.MsgTypeTransactionFailure
+	}
+	repaired["headers"] = headers
+	repaired["_id"] = existing["_id"]
+	repaired["receivedAt"] = existing["receivedAt"]
+	return repaired
+}
@@ -0,0 +1,301 @@
+// Copyright 2021 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rest
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	ethbinding "github.com/kaleido-io/ethbinding/pkg"
+	"github.com/kaleido-io/ethconnect/internal/eth"
+	"github.com/kaleido-io/ethconnect/internal/ethbind"
+	"github.com/kaleido-io/ethconnect/internal/messages"
+	"github.com/kaleido-io/ethconnect/internal/utils"
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	testReconcileTxHash = "0x02587104e9879911bea3d5bf6ccd7e1a6cb9a03145b8a1141804cebd6aa67c5c"
+	testReconcileFrom   = "0xba25be62a5c55d4ad1d5520268806a8730a4de5e"
+)
+
+type testReconcileChain struct {
+	receipt    *eth.TxnReceipt
+	txInfo     *pendingTxInfo
+	txnCount   uint64
+	replies    []interface{}
+	postDeploy int
+}
+
+func newTestReceiptReconciler(t *testing.T, chain *testReconcileChain, rpcErr error) (*receiptReconciler, *levelDBReceipts, func()) {
+	dir, _ := ioutil.TempDir("", "reconciler")
+	persistence, err := newLevelDBReceipts(&LevelDBReceiptStoreConf{Path: path.Join(dir, "receipts")})
+	assert.NoError(t, err)
+	store := newReceiptStore(&ReceiptStoreConf{}, persistence, &mockContractGW{
+		replyCallback: func(message interface{}) { chain.replies = append(chain.replies, message) },
+	})
+	rpc := eth.NewMockRPCClientForSync(rpcErr, func(method string, res interface{}, args ...interface{}) {
+		switch method {
+		case "eth_getTransactionReceipt":
+			if chain.receipt != nil {
+				*(res.(*eth.TxnReceipt)) = *chain.receipt
+			}
+		case "eth_getTransactionByHash":
+			*(res.(**pendingTxInfo)) = chain.txInfo
+		case "eth_getTransactionCount":
+			*(res.(*ethbinding.HexUint64)) = ethbinding.HexUint64(chain.txnCount)
+		}
+	})
+	r, err := newReceiptReconciler(&ReceiptReconcilerConf{Enabled: true, PendingDB: path.Join(dir, "pending")}, store, rpc)
+	assert.NoError(t, err)
+	store.reconciler = r
+	return r, persistence, func() {
+		r.db.Close()
+		persistence.store.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func testTimedOutReply(requestID string) []byte {
+	replyMsg := &messages.ErrorReply{}
+	replyMsg.Headers.MsgType = messages.MsgTypeError
+	replyMsg.Headers.ID = utils.UUIDv4()
+	replyMsg.Headers.ReqID = requestID
+	replyMsg.ErrorMessage = "Timed out waiting for transaction receipt"
+	replyMsg.TXHash = testReconcileTxHash
+	b, _ := json.Marshal(replyMsg)
+	return b
+}
+
+func testMinedReceipt(status int64) *eth.TxnReceipt {
+	blockNumber := ethbinding.HexBigInt(*big.NewInt(12345))
+	gasUsed := ethbinding.HexBigInt(*big.NewInt(21000))
+	statusHex := ethbinding.HexBigInt(*big.NewInt(status))
+	txIndex := ethbinding.HexUint(3)
+	txHash := ethbind.API.HexToHash(testReconcileTxHash)
+	from := ethbind.API.HexToAddress(testReconcileFrom)
+	contractAddr := ethbind.API.HexToAddress("0x0123456789abcdef0123456789abcdef01234567")
+	return &eth.TxnReceipt{
+		BlockNumber:      &blockNumber,
+		GasUsed:          &gasUsed,
+		Status:           &statusHex,
+		TransactionIndex: &txIndex,
+		TransactionHash:  &txHash,
+		From:             &from,
+		ContractAddress:  &contractAddr,
+	}
+}
+
+func TestReceiptReconcilerMined(t *testing.T) {
+	assert := assert.New(t)
+	chain := &testReconcileChain{}
+	r, persistence, done := newTestReceiptReconciler(t, chain, nil)
+	defer done()
+
+	r.store.processReply(testTimedOutReply("req1"))
+	stored, _ := persistence.GetReceipt("req1")
+	assert.Equal(true, (*stored)["receiptPending"])
+	assert.Equal(1, len(r.pending()))
+
+	// Not yet mined, and still known to the node
+	from := ethbind.API.HexToAddress(testReconcileFrom)
+	nonce := ethbinding.HexUint64(5)
+	chain.txInfo = &pendingTxInfo{From: &from, Nonce: &nonce}
+	r.reconcile()
+	pending := r.pending()
+	assert.Equal(1, len(pending))
+	assert.Equal(int64(5), *pending[0].Nonce)
+
+	chain.receipt = testMinedReceipt(1)
+	r.reconcile()
+	assert.Empty(r.pending())
+	assert.Equal(uint64(1), r.reconciled.Value(receiptReconciledMined))
+
+	stored, _ = persistence.GetReceipt("req1")
+	repaired := *stored
+	headers := repaired["headers"].(map[string]interface{})
+	assert.Equal(messages.MsgTypeTransactionSuccess, headers["type"])
+	assert.Equal("req1", headers["requestId"])
+	assert.Equal("req1", repaired["_id"])
+	assert.Equal("12345", repaired["blockNumber"])
+	assert.Equal("21000", repaired["gasUsed"])
+	assert.Equal("5", repaired["nonce"])
+	assert.Equal("3", repaired["transactionIndex"])
+	assert.Equal(true, repaired["reconciled"])
+	assert.Nil(repaired["receiptPending"])
+	assert.Nil(repaired["errorMessage"])
+
+	// The repaired receipt is delivered in the same way as a new receipt
+	assert.Equal(2, len(chain.replies))
+	assert.Equal(true, chain.replies[1].(map[string]interface{})["reconciled"])
+
+	// A restart does not track the receipt again
+	r.backfill()
+	assert.Empty(r.pending())
+}
+
+func TestReceiptReconcilerMinedFailure(t *testing.T) {
+	assert := assert.New(t)
+	chain := &testReconcileChain{receipt: testMinedReceipt(0)}
+	r, persistence, done := newTestReceiptReconciler(t, chain, nil)
+	defer done()
+
+	r.store.processReply(testTimedOutReply("req1"))
+	r.reconcile()
+	assert.Empty(r.pending())
+
+	stored, _ := persistence.GetReceipt("req1")
+	headers := (*stored)["headers"].(map[string]interface{})
+	assert.Equal(messages.MsgTypeTransactionFailure, headers["type"])
+	assert.Equal("0", (*stored)["status"])
+}
+
+func TestReceiptReconcilerReplaced(t *testing.T) {
+	assert := assert.New(t)
+	from := ethbind.API.HexToAddress(testReconcileFrom)
+	nonce := ethbinding.HexUint64(5)
+	chain := &testReconcileChain{
+		txInfo:   &pendingTxInfo{From: &from, Nonce: &nonce},
+		txnCount: 5,
+	}
+	r, persistence, done := newTestReceiptReconciler(t, chain, nil)
+	defer done()
+
+	r.store.processReply(testTimedOutReply("req1"))
+	r.reconcile()
+
+	// The node has forgotten the transaction, but the nonce has not been used
+	chain.txInfo = nil
+	r.reconcile()
+	assert.Equal(1, len(r.pending()))
+
+	chain.txnCount = 6
+	r.reconcile()
+	assert.Empty(r.pending())
+	assert.Equal(uint64(1), r.reconciled.Value(receiptReconciledReplaced))
+
+	stored, _ := persistence.GetReceipt("req1")
+	headers := (*stored)["headers"].(map[string]interface{})
+	assert.Equal(messages.MsgTypeError, headers["type"])
+	assert.Equal(true, (*stored)["reconciled"])
+	assert.Nil((*stored)["receiptPending"])
+	assert.Equal("Transaction "+testReconcileTxHash+" was not mined, and nonce 5 of "+from.String()+" has been used by another transaction", (*stored)["errorMessage"])
+}
+
+func TestReceiptReconcilerBackfillAndExpiry(t *testing.T) {
+	assert := assert.New(t)
+	chain := &testReconcileChain{}
+	r, persistence, done := newTestReceiptReconciler(t, chain, nil)
+	defer done()
+
+	receivedAt := time.Now().Add(-1*time.Hour).UnixNano() / int64(time.Millisecond)
+	var receipt map[string]interface{}
+	json.Unmarshal(testTimedOutReply("req1"), &receipt)
+	receipt["receivedAt"] = receivedAt
+	receipt["_id"] = "req1"
+	assert.NoError(persistence.AddReceipt("req1", &receipt))
+	success := map[string]interface{}{
+		"_id":             "req2",
+		"receivedAt":      receivedAt,
+		"transactionHash": testReconcileTxHash,
+		"headers":         map[string]interface{}{"type": messages.MsgTypeTransactionSuccess, "requestId": "req2"},
+	}
+	assert.NoError(persistence.AddReceipt("req2", &success))
+
+	r.backfill()
+	pending := r.pending()
+	assert.Equal(1, len(pending))
+	assert.Equal("req1", pending[0].RequestID)
+	assert.Equal(receivedAt, pending[0].Added)
+
+	// The node does not know the transaction, so it is reconciled until it expires
+	r.reconcile()
+	assert.Equal(1, len(r.pending()))
+	r.conf.MaxAgeSec = 60
+	r.reconcile()
+	assert.Empty(r.pending())
+	assert.Equal(uint64(1), r.reconciled.Value(receiptReconciledExpired))
+}
+
+func TestReceiptReconcilerRPCError(t *testing.T) {
+	assert := assert.New(t)
+	chain := &testReconcileChain{}
+	r, _, done := newTestReceiptReconciler(t, chain, fmt.Errorf("pop"))
+	defer done()
+
+	r.store.processReply(testTimedOutReply("req1"))
+	r.reconcile()
+	assert.Equal(1, len(r.pending()))
+}
+
+func TestReceiptReconcilerNotInStore(t *testing.T) {
+	assert := assert.New(t)
+	chain := &testReconcileChain{receipt: testMinedReceipt(1)}
+	r, _, done := newTestReceiptReconciler(t, chain, nil)
+	defer done()
+
+	var receipt map[string]interface{}
+	json.Unmarshal(testTimedOutReply("req1"), &receipt)
+	r.track(receipt)
+	assert.Equal(1, len(r.pending()))
+	r.reconcile()
+	assert.Empty(r.pending())
+}
+
+func TestReceiptReconcilerUpdateFailRetries(t *testing.T) {
+	assert := assert.New(t)
+	existing := map[string]interface{}{}
+	store := newReceiptStore(&ReceiptStoreConf{}, &mockReceiptErrs{
+		getReceiptVal:    &existing,
+		updateReceiptErr: fmt.Errorf("pop"),
+	}, nil)
+	rpc := eth.NewMockRPCClientForSync(nil, func(method string, res interface{}, args ...interface{}) {
+		*(res.(*eth.TxnReceipt)) = *testMinedReceipt(1)
+	})
+	r, err := newReceiptReconciler(&ReceiptReconcilerConf{}, store, rpc)
+	assert.NoError(err)
+	defer r.db.Close()
+
+	var receipt map[string]interface{}
+	json.Unmarshal(testTimedOutReply("req1"), &receipt)
+	r.track(receipt)
+	r.reconcile()
+	assert.Equal(1, len(r.pending()))
+}
+
+func TestReceiptReconcilerStartClose(t *testing.T) {
+	assert := assert.New(t)
+	store := newReceiptStore(&ReceiptStoreConf{}, newMemoryReceipts(&ReceiptStoreConf{}), nil)
+	r, err := newReceiptReconciler(&ReceiptReconcilerConf{}, store, eth.NewMockRPCClientForSync(nil, nil))
+	assert.NoError(err)
+	assert.Equal(uint32(defaultReceiptReconcileIntervalSec), r.conf.IntervalSec)
+	assert.Equal(uint32(defaultReceiptReconcileMaxAgeSec), r.conf.MaxAgeSec)
+	r.start()
+	r.close()
+}
+
+func TestReceiptReconcilerBadPendingDB(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "reconciler")
+	defer os.RemoveAll(dir)
+	ioutil.WriteFile(path.Join(dir, "file"), []byte{}, 0644)
+	_, err := newReceiptReconciler(&ReceiptReconcilerConf{PendingDB: path.Join(dir, "file")}, &receiptStore{}, nil)
+	assert.Regexp(t, "Failed to open the pending receipts store", err)
+}
@@ -43,12 +43,15 @@ type ReceiptStorePersistence interface {
 	GetReceipts(skip, limit int, ids []string, sinceEpochMS int64, from, to, start string) (*[]map[string]interface{}, error)
 	GetReceipt(requestID string) (*map[string]interface{}, error)
 	AddReceipt(requestID string, receipt *map[string]interface{}) error
+	UpdateReceipt(requestID string, receipt *map[string]interface{}) error
 }
 
 type receiptStore struct {
 	conf            *ReceiptStoreConf
 	persistence     ReceiptStorePersistence
 	smartContractGW contracts.SmartContractGateway
+	webhooks        *receiptWebhooks
+	reconciler      *receiptReconciler
 }
 
 func newReceiptStore(conf *ReceiptStoreConf, persistence ReceiptStorePersistence, smartContractGW contracts.SmartContractGateway) *receiptStore {
@@ -85,21 +88,21 @@ func (r *receiptStore) processReply(msgBytes []byte) {
 	// Parse the reply as JSON
 	var parsedMsg map[string]interface{}
 	if err := json.Unmarshal(msgBytes, &parsedMsg); err != nil {
-		log.Errorf("Unable to unmarshal reply message '%s' as JSON: %s", string(msgBytes), err)
+		log.Errorf("Unable to unmarshal reply message '%s' as JSON: %s", utils.RedactJSON(msgBytes), err)
 		return
 	}
 
 	// Extract the headers
 	headers := r.extractHeaders(parsedMsg)
 	if headers == nil {
-		log.Errorf("Failed to extract request headers from '%+v'", parsedMsg)
+		log.Errorf("Failed to extract request headers from '%+v'", utils.Redact(parsedMsg))
 		return
 	}
 
 	// The one field we require is the original ID (as it's the key in MongoDB)
 	requestID := utils.GetMapString(headers, "requestId")
 	if requestID == "" {
-		log.Errorf("Failed to extract headers.requestId from '%+v'", parsedMsg)
+		log.Errorf("Failed to extract headers.requestId from '%+v'", utils.Redact(parsedMsg))
 		return
 	}
 	reqOffset := utils.GetMapString(headers, "reqOffset")
@@ -127,14 +130,44 @@ func (r *receiptStore) processReply(msgBytes []byte) {
 	parsedMsg["receivedAt"] = time.Now().UnixNano() / int64(time.Millisecond)
 	parsedMsg["_id"] = requestID
 
+	// An error with a transaction hash means the transaction was submitted, but the outcome is not
+	// known. The receipt is marked as pending, and replaced by the reconciler once the outcome is known
+	pending := r.reconciler != nil && isPendingReceipt(parsedMsg, headers)
+	if pending {
+		parsedMsg["receiptPending"] = true
+	}
+
 	// Insert the receipt into persistence - captures errors
 	if requestID != "" && r.persistence != nil {
 		r.writeReceipt(requestID, parsedMsg)
+		if pending {
+			r.reconciler.track(parsedMsg)
+		}
+	}
+
+	if r.webhooks != nil {
+		r.webhooks.dispatch(parsedMsg)
 	}
 
 }
 
+// redactReceipt returns the copy of a receipt to store, with the fields configured for redaction
+// masked. The original request carried by an error reply is redacted as well
+func redactReceipt(receipt map[string]interface{}) map[string]interface{} {
+	if !utils.RedactionEnabled() {
+		return receipt
+	}
+	redacted, _ := utils.Redact(receipt).(map[string]interface{})
+	if payload, ok := redacted["requestPayload"].(string); ok {
+		redacted["requestPayload"] = string(utils.RedactJSON([]byte(payload)))
+	}
+	return redacted
+}
+
 func (r *receiptStore) writeReceipt(requestID string, receipt map[string]interface{}) {
+	// The receipt is stored with sensitive fields redacted, but delivered intact to the
+	// application that is waiting for it
+	stored := redactReceipt(receipt)
 	startTime := time.Now()
 	delay := time.Duration(r.conf.RetryInitialDelayMS) * time.Millisecond
 	attempt := 0
@@ -147,9 +180,9 @@ func (r *receiptStore) writeReceipt(requestID string, receipt map[string]interfa
 			delay = time.Duration(float64(delay) * backoffFactor)
 		}
 		attempt++
-		err := r.persistence.AddReceipt(requestID, &receipt)
+		err := r.persistence.AddReceipt(requestID, &stored)
 		if err == nil {
-			log.Infof("%s: Inserted receipt into receipt store", receipt["_id"])
+			log.Infof("%s: Inserted receipt into receipt store", requestID)
 			break
 		}
 
@@ -159,13 +192,13 @@ func (r *receiptStore) writeReceipt(requestID string, receipt map[string]interfa
 		existing, qErr := r.persistence.GetReceipt(requestID)
 		if qErr == nil && existing != nil {
 			log.Warnf("%s: exiting   receipt: %+v", requestID, *existing)
-			log.Warnf("%s: duplicate receipt: %+v", requestID, receipt)
+			log.Warnf("%s: duplicate receipt: %+v", requestID, stored)
 			break
 		}
 
 		timeRetrying := time.Since(startTime)
 		if timeRetrying > retryTimeout {
-			log.Infof("%s: receipt: %+v", requestID, receipt)
+			log.Infof("%s: receipt: %+v", requestID, stored)
 			log.Panicf("%s: Failed to insert into receipt store after %.2fs: %s", requestID, timeRetrying.Seconds(), err)
 		}
 	}
@@ -38,6 +38,7 @@ type mockReceiptErrs struct {
 	getReceiptErr    error
 	addReceiptCalled bool
 	addReceiptErr    error
+	updateReceiptErr error
 }
 
 func (m *mockReceiptErrs) GetReceipts(skip, limit int, ids []string, sinceEpochMS int64, from, to, start string) (*[]map[string]interface{}, error) {
@@ -53,6 +54,10 @@ func (m *mockReceiptErrs) AddReceipt(requestID string, receipt *map[string]inter
 	return m.addReceiptErr
 }
 
+func (m *mockReceiptErrs) UpdateReceipt(requestID string, receipt *map[string]interface{}) error {
+	return m.updateReceiptErr
+}
+
 func newReceiptsErrTestServer(err error) (*receiptStore, *httptest.Server) {
 	r := newReceiptStore(&ReceiptStoreConf{
 		RetryTimeoutMS:      1,
@@ -254,6 +259,43 @@ func TestReplyProcessorWithErrorReply(t *testing.T) {
 	assert.Equal(replyMsg.OriginalMessage, front["requestPayload"])
 }
 
+func TestReplyProcessorRedactsStoredReceipt(t *testing.T) {
+	assert := assert.New(t)
+	err := utils.ConfigureRedaction(&utils.RedactionConf{Fields: []string{"email"}})
+	assert.NoError(err)
+	defer utils.ConfigureRedaction(nil)
+
+	var replied interface{}
+	r, p := newReceiptsTestStore(func(message interface{}) {
+		replied = message
+	})
+
+	replyMsg := &messages.ErrorReply{}
+	replyMsg.Headers.MsgType = messages.MsgTypeError
+	replyMsg.Headers.ID = utils.UUIDv4()
+	replyMsg.Headers.ReqID = utils.UUIDv4()
+	replyMsg.OriginalMessage = "{\"email\":\"someone@example.com\"}"
+	replyMsg.ErrorMessage = "pop"
+	replyMsgBytes, _ := json.Marshal(&replyMsg)
+	var parsedMsg map[string]interface{}
+	json.Unmarshal(replyMsgBytes, &parsedMsg)
+	parsedMsg["decodedEvents"] = []interface{}{map[string]interface{}{"email": "someone@example.com"}}
+	replyMsgBytes, _ = json.Marshal(&parsedMsg)
+
+	r.processReply(replyMsgBytes)
+
+	assert.Equal(1, p.receipts.Len())
+	front := *p.receipts.Front().Value.(*map[string]interface{})
+	assert.Equal(replyMsg.Headers.ReqID, front["_id"])
+	assert.Equal("{\"email\":\"***\"}", front["requestPayload"])
+	assert.Equal([]interface{}{map[string]interface{}{"email": "***"}}, front["decodedEvents"])
+
+	// The receipt is delivered intact
+	delivered := replied.(map[string]interface{})
+	assert.Equal(replyMsg.OriginalMessage, delivered["requestPayload"])
+	assert.Equal([]interface{}{map[string]interface{}{"email": "someone@example.com"}}, delivered["decodedEvents"])
+}
+
 func TestReplyProcessorMissingHeaders(t *testing.T) {
 	assert := assert.New(t)
 
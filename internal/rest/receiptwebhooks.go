@@ -0,0 +1,379 @@
+// Copyright 2021 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rest
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/kaleido-io/ethconnect/internal/errors"
+	"github.com/kaleido-io/ethconnect/internal/kvstore"
+	"github.com/kaleido-io/ethconnect/internal/utils"
+	"github.com/kaleido-io/ethconnect/internal/webhook"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	defaultReceiptWebhookMaxQueued      = 1000
+	defaultReceiptWebhookRequestTimeout = 30
+	defaultReceiptWebhookRetryTimeout   = 120
+	receiptWebhookInitialRetryDelay     = 1 * time.Second
+	receiptWebhookBackoffFactor         = 2.0
+	receiptWebhookDLQPrefix             = "dlq/"
+	// ReceiptWebhookSignatureHeader is the header containing the HMAC-SHA256 signature of the body
+	ReceiptWebhookSignatureHeader = webhook.SignatureHeader
+)
+
+// ReceiptWebhooksConf configures the destinations that receipts are posted to
+type ReceiptWebhooksConf struct {
+	DLQPath      string                `json:"dlqPath"`
+	Destinations []*ReceiptWebhookConf `json:"destinations"`
+}
+
+// ReceiptWebhookConf is a single destination for receipts, optionally filtered
+// to the receipts for a set of contracts, or a set of senders
+type ReceiptWebhookConf struct {
+	Name              string            `json:"name"`
+	URL               string            `json:"url"`
+	Headers           map[string]string `json:"headers,omitempty"`
+	TLSkipHostVerify  bool              `json:"tlsSkipHostVerify,omitempty"`
+	RequestTimeoutSec uint32            `json:"requestTimeoutSec,omitempty"`
+	RetryTimeoutSec   uint32            `json:"retryTimeoutSec,omitempty"`
+	MaxQueued         int               `json:"maxQueued,omitempty"`
+	Secret            string            `json:"secret,omitempty"`
+	Contracts         []string          `json:"contracts,omitempty"`
+	From              []string          `json:"from,omitempty"`
+}
+
+// ReceiptWebhookStatus is the delivery status of a destination
+type ReceiptWebhookStatus struct {
+	Name       string     `json:"name"`
+	URL        string     `json:"url"`
+	Queued     int        `json:"queued"`
+	Delivered  uint64     `json:"delivered"`
+	Failed     uint64     `json:"failed"`
+	DeadLetter int        `json:"deadLetter"`
+	LastError  string     `json:"lastError,omitempty"`
+	LastErrAt  *time.Time `json:"lastErrorTime,omitempty"`
+}
+
+// ReceiptWebhookDLQEntry is a receipt that could not be delivered to a destination
+type ReceiptWebhookDLQEntry struct {
+	ID      string                 `json:"id"`
+	Failed  time.Time              `json:"failed"`
+	Error   string                 `json:"error"`
+	Receipt map[string]interface{} `json:"receipt"`
+}
+
+// receiptWebhooks posts every receipt stored by the receipt store to the configured
+// destinations. Each destination has its own queue, so a slow or failing destination
+// does not hold up the others, or the receipt store. Delivery, signing and retry are
+// shared with event stream webhooks. Receipts that cannot be delivered before the retry
+// timeout, or that overflow the queue, go to a dead letter queue (DLQ) from which they
+// can be redelivered.
+type receiptWebhooks struct {
+	conf         *ReceiptWebhooksConf
+	dlq          kvstore.KVStore
+	destinations map[string]*receiptWebhook
+	ordered      []*receiptWebhook
+	stop         chan struct{}
+	wg           sync.WaitGroup
+}
+
+type receiptWebhook struct {
+	rw            *receiptWebhooks
+	conf          *ReceiptWebhookConf
+	sender        *webhook.Sender
+	backoff       *webhook.Backoff
+	queue         chan map[string]interface{}
+	contracts     map[string]bool
+	from          map[string]bool
+	mux           sync.Mutex
+	delivered     uint64
+	failed        uint64
+	lastError     string
+	lastErrorTime *time.Time
+}
+
+func newReceiptWebhooks(conf *ReceiptWebhooksConf) (rw *receiptWebhooks, err error) {
+	rw = &receiptWebhooks{
+		conf:         conf,
+		destinations: make(map[string]*receiptWebhook),
+		stop:         make(chan struct{}),
+	}
+	for i, dc := range conf.Destinations {
+		if dc.Name == "" {
+			dc.Name = fmt.Sprintf("webhook%d", i)
+		}
+		if dc.URL == "" {
+			return nil, errors.Errorf(errors.ReceiptWebhookNoURL, dc.Name)
+		}
+		if _, err := url.Parse(dc.URL); err != nil {
+			return nil, errors.Errorf(errors.ReceiptWebhookInvalidURL, dc.Name)
+		}
+		if _, exists := rw.destinations[dc.Name]; exists {
+			return nil, errors.Errorf(errors.ReceiptWebhookDuplicateName, dc.Name)
+		}
+		if dc.RequestTimeoutSec == 0 {
+			dc.RequestTimeoutSec = defaultReceiptWebhookRequestTimeout
+		}
+		if dc.RetryTimeoutSec == 0 {
+			dc.RetryTimeoutSec = defaultReceiptWebhookRetryTimeout
+		}
+		if dc.MaxQueued <= 0 {
+			dc.MaxQueued = defaultReceiptWebhookMaxQueued
+		}
+		d := &receiptWebhook{
+			rw:     rw,
+			conf:   dc,
+			sender: webhook.NewSender(dc.Name, dc.URL, dc.Headers, dc.Secret, dc.TLSkipHostVerify, time.Duration(dc.RequestTimeoutSec)*time.Second),
+			backoff: &webhook.Backoff{
+				InitialDelay: receiptWebhookInitialRetryDelay,
+				Factor:       receiptWebhookBackoffFactor,
+			},
+			queue:     make(chan map[string]interface{}, dc.MaxQueued),
+			contracts: lowerCaseSet(dc.Contracts),
+			from:      lowerCaseSet(dc.From),
+		}
+		rw.destinations[dc.Name] = d
+		rw.ordered = append(rw.ordered, d)
+	}
+	if conf.DLQPath != "" {
+		if rw.dlq, err = kvstore.NewKeyValueStore(conf.DLQPath); err != nil {
+			return nil, errors.Errorf(errors.ReceiptWebhookDLQOpen, err)
+		}
+	} else {
+		rw.dlq = kvstore.NewMemoryKeyValueStore()
+	}
+	return rw, nil
+}
+
+func lowerCaseSet(values []string) map[string]bool {
+	set := make(map[string]bool)
+	for _, v := range values {
+		set[strings.ToLower(v)] = true
+	}
+	return set
+}
+
+func (rw *receiptWebhooks) start() {
+	for _, d := range rw.ordered {
+		rw.wg.Add(1)
+		go d.deliveryLoop()
+	}
+}
+
+func (rw *receiptWebhooks) close() {
+	close(rw.stop)
+	rw.wg.Wait()
+	rw.dlq.Close()
+}
+
+// dispatch queues a receipt for each destination whose filters match it. It never blocks.
+func (rw *receiptWebhooks) dispatch(receipt map[string]interface{}) {
+	for _, d := range rw.ordered {
+		if !d.matches(receipt) {
+			continue
+		}
+		select {
+		case d.queue <- receipt:
+		default:
+			d.deadLetter(receipt, errors.Errorf(errors.ReceiptWebhookQueueFull, d.conf.Name, d.conf.MaxQueued))
+		}
+	}
+}
+
+func (d *receiptWebhook) matches(receipt map[string]interface{}) bool {
+	if len(d.contracts) > 0 {
+		// the values are not checked with utils.GetMapString, as "to" is null for a deploy
+		to, _ := receipt["to"].(string)
+		contractAddr, _ := receipt["contractAddress"].(string)
+		to, contractAddr = strings.ToLower(to), strings.ToLower(contractAddr)
+		if !d.contracts[to] && !d.contracts[contractAddr] {
+			return false
+		}
+	}
+	if len(d.from) > 0 {
+		from, _ := receipt["from"].(string)
+		if !d.from[strings.ToLower(from)] {
+			return false
+		}
+	}
+	return true
+}
+
+func (d *receiptWebhook) deliveryLoop() {
+	defer d.rw.wg.Done()
+	for {
+		select {
+		case <-d.rw.stop:
+			return
+		case receipt := <-d.queue:
+			if err := d.deliverWithRetry(receipt); err != nil {
+				d.deadLetter(receipt, err)
+			}
+		}
+	}
+}
+
+// deliverWithRetry posts the receipt, with exponential backoff retry up to the retry timeout
+func (d *receiptWebhook) deliverWithRetry(receipt map[string]interface{}) error {
+	reqBytes, _ := json.Marshal(receipt)
+	_, err := d.backoff.Retry(d.conf.Name, time.Duration(d.conf.RetryTimeoutSec)*time.Second, d.rw.stop, nil, func(attempt uint64) error {
+		return d.attemptDelivery(attempt, reqBytes)
+	})
+	return err
+}
+
+func (d *receiptWebhook) attemptDelivery(attempt uint64, reqBytes []byte) error {
+	log.Infof("%s: Delivering receipt (attempt=%d)", d.conf.Name, attempt)
+	_, err := d.sender.Post(context.Background(), reqBytes, nil)
+	d.mux.Lock()
+	defer d.mux.Unlock()
+	if err != nil {
+		now := time.Now().UTC()
+		d.failed++
+		d.lastError = err.Error()
+		d.lastErrorTime = &now
+		return err
+	}
+	d.delivered++
+	return nil
+}
+
+func (d *receiptWebhook) dlqPrefix() string {
+	return receiptWebhookDLQPrefix + d.conf.Name + "/"
+}
+
+func (d *receiptWebhook) dlqRange() *kvstore.KVRange {
+	prefix := d.dlqPrefix()
+	return &kvstore.KVRange{Start: prefix, Limit: prefix[0:len(prefix)-1] + "0"}
+}
+
+func (d *receiptWebhook) deadLetter(receipt map[string]interface{}, err error) {
+	now := time.Now().UTC()
+	entry := &ReceiptWebhookDLQEntry{
+		ID:      fmt.Sprintf("%020d-%s", now.UnixNano(), utils.GetMapString(receipt, "_id")),
+		Failed:  now,
+		Error:   err.Error(),
+		Receipt: receipt,
+	}
+	log.Errorf("%s: Moving receipt %s to dead letter queue: %s", d.conf.Name, entry.ID, err)
+	b, _ := json.Marshal(entry)
+	if err := d.rw.dlq.Put(d.dlqPrefix()+entry.ID, b); err != nil {
+		log.Errorf("%s: Failed to write receipt %s to dead letter queue: %s", d.conf.Name, entry.ID, err)
+	}
+}
+
+func (d *receiptWebhook) deadLetters() []*ReceiptWebhookDLQEntry {
+	entries := make([]*ReceiptWebhookDLQEntry, 0)
+	it := d.rw.dlq.NewIteratorWithRange(d.dlqRange())
+	defer it.Release()
+	for it.Next() {
+		var entry ReceiptWebhookDLQEntry
+		if err := json.Unmarshal(it.Value(), &entry); err != nil {
+			log.Errorf("%s: Failed to parse dead letter queue entry '%s': %s", d.conf.Name, it.Key(), err)
+			continue
+		}
+		entries = append(entries, &entry)
+	}
+	return entries
+}
+
+// redeliver moves entries from the DLQ back onto the delivery queue, up to the space available
+func (d *receiptWebhook) redeliver() (count int) {
+	for _, entry := range d.deadLetters() {
+		select {
+		case d.queue <- entry.Receipt:
+			d.rw.dlq.Delete(d.dlqPrefix() + entry.ID)
+			count++
+		default:
+			return count
+		}
+	}
+	return count
+}
+
+func (d *receiptWebhook) status() *ReceiptWebhookStatus {
+	d.mux.Lock()
+	defer d.mux.Unlock()
+	return &ReceiptWebhookStatus{
+		Name:       d.conf.Name,
+		URL:        d.conf.URL,
+		Queued:     len(d.queue),
+		Delivered:  d.delivered,
+		Failed:     d.failed,
+		DeadLetter: len(d.deadLetters()),
+		LastError:  d.lastError,
+		LastErrAt:  d.lastErrorTime,
+	}
+}
+
+func (rw *receiptWebhooks) addRoutes(router *httprouter.Router) {
+	router.GET("/receiptwebhooks", rw.listHandler)
+	router.GET("/receiptwebhooks/:name/dlq", rw.dlqHandler)
+	router.POST("/receiptwebhooks/:name/dlq/redeliver", rw.redeliverHandler)
+}
+
+func (rw *receiptWebhooks) destination(res http.ResponseWriter, req *http.Request, params httprouter.Params) *receiptWebhook {
+	d, exists := rw.destinations[params.ByName("name")]
+	if !exists {
+		sendRESTError(res, req, errors.Errorf(errors.ReceiptWebhookNotFound, params.ByName("name")), 404)
+	}
+	return d
+}
+
+func (rw *receiptWebhooks) listHandler(res http.ResponseWriter, req *http.Request, params httprouter.Params) {
+	log.Infof("--> %s %s", req.Method, req.URL)
+	statuses := make([]*ReceiptWebhookStatus, 0, len(rw.ordered))
+	for _, d := range rw.ordered {
+		statuses = append(statuses, d.status())
+	}
+	rw.reply(res, req, statuses)
+}
+
+func (rw *receiptWebhooks) dlqHandler(res http.ResponseWriter, req *http.Request, params httprouter.Params) {
+	log.Infof("--> %s %s", req.Method, req.URL)
+	if d := rw.destination(res, req, params); d != nil {
+		rw.reply(res, req, d.deadLetters())
+	}
+}
+
+func (rw *receiptWebhooks) redeliverHandler(res http.ResponseWriter, req *http.Request, params httprouter.Params) {
+	log.Infof("--> %s %s", req.Method, req.URL)
+	if d := rw.destination(res, req, params); d != nil {
+		count := d.redeliver()
+		rw.reply(res, req, map[string]int{
+			"redelivered": count,
+			"remaining":   len(d.deadLetters()),
+		})
+	}
+}
+
+func (rw *receiptWebhooks) reply(res http.ResponseWriter, req *http.Request, body interface{}) {
+	log.Infof("<-- %s %s [%d]", req.Method, req.URL, 200)
+	res.Header().Set("Content-Type", "application/json")
+	res.WriteHeader(200)
+	enc := json.NewEncoder(res)
+	enc.SetIndent("", "  ")
+	enc.Encode(body)
+}
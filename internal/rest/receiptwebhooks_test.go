@@ -0,0 +1,261 @@
+// Copyright 2021 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rest
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/stretchr/testify/assert"
+)
+
+const testReceiptWebhookContract = "0x112dd80dd5c598d16b557a6b70f0ca92adc09d41"
+
+func testReceipt(id, from, to string) map[string]interface{} {
+	return map[string]interface{}{
+		"_id":             id,
+		"headers":         map[string]interface{}{"requestId": id, "type": "TransactionSuccess"},
+		"from":            from,
+		"to":              to,
+		"transactionHash": "0x" + id,
+	}
+}
+
+func TestReceiptWebhooksDeliverFilteredAndSigned(t *testing.T) {
+	assert := assert.New(t)
+
+	received := make(chan map[string]interface{}, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		mac := hmac.New(sha256.New, []byte("s3cret"))
+		mac.Write(body)
+		assert.Equal("sha256="+hex.EncodeToString(mac.Sum(nil)), req.Header.Get(ReceiptWebhookSignatureHeader))
+		assert.Equal("value1", req.Header.Get("x-custom"))
+		var receipt map[string]interface{}
+		json.Unmarshal(body, &receipt)
+		received <- receipt
+		res.WriteHeader(204)
+	}))
+	defer server.Close()
+
+	rw, err := newReceiptWebhooks(&ReceiptWebhooksConf{
+		Destinations: []*ReceiptWebhookConf{
+			{
+				URL:       server.URL,
+				Secret:    "s3cret",
+				Headers:   map[string]string{"x-custom": "value1"},
+				Contracts: []string{"0x112DD80DD5C598D16B557A6B70F0CA92ADC09D41"},
+			},
+		},
+	})
+	assert.NoError(err)
+	rw.start()
+	defer rw.close()
+
+	rs := newReceiptStore(&ReceiptStoreConf{}, newMemoryReceipts(&ReceiptStoreConf{}), nil)
+	rs.webhooks = rw
+	deploy := testReceipt("req0", "0xaaaa", "")
+	deploy["to"] = nil
+	deployBytes, _ := json.Marshal(deploy)
+	rs.processReply(deployBytes)
+	rw.dispatch(testReceipt("req1", "0xaaaa", testReceiptWebhookContract))
+
+	receipt := <-received
+	assert.Equal("req1", receipt["_id"])
+	assert.Empty(received)
+
+	for rw.ordered[0].status().Delivered == 0 {
+		time.Sleep(1 * time.Millisecond)
+	}
+	status := rw.ordered[0].status()
+	assert.Equal("webhook0", status.Name)
+	assert.Equal(uint64(1), status.Delivered)
+	assert.Equal(0, status.DeadLetter)
+}
+
+func TestReceiptWebhooksFilterFrom(t *testing.T) {
+	assert := assert.New(t)
+
+	rw, err := newReceiptWebhooks(&ReceiptWebhooksConf{
+		Destinations: []*ReceiptWebhookConf{
+			{Name: "senders", URL: "http://localhost", From: []string{"0xAAAA"}},
+		},
+	})
+	assert.NoError(err)
+	d := rw.destinations["senders"]
+	assert.True(d.matches(testReceipt("req1", "0xaaaa", testReceiptWebhookContract)))
+	assert.False(d.matches(testReceipt("req2", "0xbbbb", testReceiptWebhookContract)))
+	assert.False(d.matches(map[string]interface{}{"from": nil}))
+}
+
+func TestReceiptWebhooksRetryThenDeadLetterAndRedeliver(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, _ := ioutil.TempDir("", "receiptdlq")
+	defer os.RemoveAll(dir)
+
+	fail := true
+	attempts := make(chan bool, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		attempts <- true
+		if fail {
+			res.WriteHeader(500)
+		} else {
+			res.WriteHeader(200)
+		}
+	}))
+	defer server.Close()
+
+	rw, err := newReceiptWebhooks(&ReceiptWebhooksConf{
+		DLQPath: path.Join(dir, "dlq"),
+		Destinations: []*ReceiptWebhookConf{
+			{Name: "hook1", URL: server.URL, RetryTimeoutSec: 1},
+		},
+	})
+	assert.NoError(err)
+	d := rw.destinations["hook1"]
+	d.backoff.InitialDelay = 100 * time.Millisecond
+	rw.start()
+	defer rw.close()
+
+	router := &httprouter.Router{}
+	rw.addRoutes(router)
+
+	rw.dispatch(testReceipt("req1", "0xaaaa", testReceiptWebhookContract))
+	for len(d.deadLetters()) == 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Greater(len(attempts), 1)
+
+	req := httptest.NewRequest("GET", "/receiptwebhooks", nil)
+	res := httptest.NewRecorder()
+	router.ServeHTTP(res, req)
+	assert.Equal(200, res.Code)
+	var statuses []*ReceiptWebhookStatus
+	json.NewDecoder(res.Body).Decode(&statuses)
+	assert.Len(statuses, 1)
+	assert.Equal(1, statuses[0].DeadLetter)
+	assert.Equal("hook1: Failed with status=500", statuses[0].LastError)
+	assert.NotNil(statuses[0].LastErrAt)
+
+	req = httptest.NewRequest("GET", "/receiptwebhooks/hook1/dlq", nil)
+	res = httptest.NewRecorder()
+	router.ServeHTTP(res, req)
+	assert.Equal(200, res.Code)
+	var entries []*ReceiptWebhookDLQEntry
+	json.NewDecoder(res.Body).Decode(&entries)
+	assert.Len(entries, 1)
+	assert.Equal("req1", entries[0].Receipt["_id"])
+	assert.Equal("hook1: Failed with status=500", entries[0].Error)
+
+	fail = false
+	for len(attempts) > 0 {
+		<-attempts
+	}
+	req = httptest.NewRequest("POST", "/receiptwebhooks/hook1/dlq/redeliver", nil)
+	res = httptest.NewRecorder()
+	router.ServeHTTP(res, req)
+	assert.Equal(200, res.Code)
+	var result map[string]int
+	json.NewDecoder(res.Body).Decode(&result)
+	assert.Equal(1, result["redelivered"])
+	assert.Equal(0, result["remaining"])
+	<-attempts
+	for d.status().Delivered == 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Empty(d.deadLetters())
+}
+
+func TestReceiptWebhooksQueueFull(t *testing.T) {
+	assert := assert.New(t)
+
+	rw, err := newReceiptWebhooks(&ReceiptWebhooksConf{
+		Destinations: []*ReceiptWebhookConf{
+			{Name: "hook1", URL: "http://localhost", MaxQueued: 1},
+		},
+	})
+	assert.NoError(err)
+	rw.dispatch(testReceipt("req1", "0xaaaa", testReceiptWebhookContract))
+	rw.dispatch(testReceipt("req2", "0xaaaa", testReceiptWebhookContract))
+	entries := rw.destinations["hook1"].deadLetters()
+	assert.Len(entries, 1)
+	assert.Equal("req2", entries[0].Receipt["_id"])
+	assert.Equal("hook1: Delivery queue full (1 receipts)", entries[0].Error)
+	assert.Equal(0, rw.destinations["hook1"].redeliver())
+}
+
+func TestReceiptWebhooksNotFound(t *testing.T) {
+	assert := assert.New(t)
+
+	rw, err := newReceiptWebhooks(&ReceiptWebhooksConf{
+		Destinations: []*ReceiptWebhookConf{{URL: "http://localhost"}},
+	})
+	assert.NoError(err)
+	router := &httprouter.Router{}
+	rw.addRoutes(router)
+
+	req := httptest.NewRequest("GET", "/receiptwebhooks/unknown/dlq", nil)
+	res := httptest.NewRecorder()
+	router.ServeHTTP(res, req)
+	assert.Equal(404, res.Code)
+
+	req = httptest.NewRequest("POST", "/receiptwebhooks/unknown/dlq/redeliver", nil)
+	res = httptest.NewRecorder()
+	router.ServeHTTP(res, req)
+	assert.Equal(404, res.Code)
+}
+
+func TestReceiptWebhooksBadConf(t *testing.T) {
+	assert := assert.New(t)
+
+	_, err := newReceiptWebhooks(&ReceiptWebhooksConf{
+		Destinations: []*ReceiptWebhookConf{{Name: "hook1"}},
+	})
+	assert.EqualError(err, "No URL configured for receipt webhook 'hook1'")
+
+	_, err = newReceiptWebhooks(&ReceiptWebhooksConf{
+		Destinations: []*ReceiptWebhookConf{{URL: ":badurl"}},
+	})
+	assert.EqualError(err, "Invalid URL configured for receipt webhook 'webhook0'")
+
+	_, err = newReceiptWebhooks(&ReceiptWebhooksConf{
+		Destinations: []*ReceiptWebhookConf{
+			{Name: "hook1", URL: "http://localhost"},
+			{Name: "hook1", URL: "http://localhost"},
+		},
+	})
+	assert.EqualError(err, "Duplicate receipt webhook name 'hook1'")
+
+	dir, _ := ioutil.TempDir("", "receiptdlq")
+	defer os.RemoveAll(dir)
+	badPath := path.Join(dir, "file")
+	ioutil.WriteFile(badPath, []byte{}, 0644)
+	_, err = newReceiptWebhooks(&ReceiptWebhooksConf{
+		DLQPath:      badPath,
+		Destinations: []*ReceiptWebhookConf{{URL: "http://localhost"}},
+	})
+	assert.Regexp("Failed to open receipt webhook dead letter queue", err)
+}
@@ -0,0 +1,282 @@
+// Copyright 2021 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rest
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kaleido-io/ethconnect/internal/errors"
+	"github.com/kaleido-io/ethconnect/internal/eth"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// RecordedEntryRequest is an entry for a REST request, with the RPC calls made while processing it
+	RecordedEntryRequest = "request"
+	// RecordedEntryRPC is an entry for an RPC call made outside of a REST request, such as
+	// the submission of an async transaction, or the receipt once it is mined
+	RecordedEntryRPC = "rpc"
+
+	defaultRecordingMaxBodyBytes = 65536
+)
+
+// RecordingConf configures capture of the REST requests to the gateway, and the resulting
+// JSON/RPC calls to the node, to a file that can be replayed against another environment
+type RecordingConf struct {
+	Path         string   `json:"path"`
+	MaxBodyBytes int      `json:"maxBodyBytes,omitempty"`
+	ExcludePaths []string `json:"excludePaths,omitempty"`
+}
+
+// RecordedEntry is a single line of a recording file
+type RecordedEntry struct {
+	Seq      int64              `json:"seq"`
+	Time     time.Time          `json:"time"`
+	Type     string             `json:"type"`
+	Request  *RecordedRequest   `json:"request,omitempty"`
+	Response *RecordedResponse  `json:"response,omitempty"`
+	RPC      []*RecordedRPCCall `json:"rpc,omitempty"`
+}
+
+// RecordedRequest is an inbound REST request. Credentials are not recorded
+type RecordedRequest struct {
+	Method  string            `json:"method"`
+	URL     string            `json:"url"`
+	Headers map[string]string `json:"headers,omitempty"`
+	Body    []byte            `json:"body,omitempty"`
+}
+
+// RecordedResponse is the reply to a REST request, with the body truncated to maxBodyBytes
+type RecordedResponse struct {
+	Status     int    `json:"status"`
+	Body       string `json:"body,omitempty"`
+	Truncated  bool   `json:"truncated,omitempty"`
+	DurationMS int64  `json:"durationMS"`
+}
+
+// RecordedRPCCall is a JSON/RPC call made to the node
+type RecordedRPCCall struct {
+	Method string          `json:"method"`
+	Args   []interface{}   `json:"args,omitempty"`
+	Result json.RawMessage `json:"result,omitempty"`
+	Error  string          `json:"error,omitempty"`
+}
+
+// recordedOutOfBandMethods are the RPC calls recorded when they are not made while
+// processing a REST request. Other calls, such as polling, are too frequent to be useful
+var recordedOutOfBandMethods = map[string]bool{
+	"eth_sendTransaction":       true,
+	"eth_sendRawTransaction":    true,
+	"eea_sendRawTransaction":    true,
+	"eth_getTransactionReceipt": true,
+}
+
+// recordedHeaderExclusions are not recorded, as they hold credentials or are set by the HTTP client
+var recordedHeaderExclusions = map[string]bool{
+	"Authorization":   true,
+	"Cookie":          true,
+	"Accept-Encoding": true,
+}
+
+type recordingContextKey struct{}
+
+// rpcCollector gathers the RPC calls made while processing a single REST request
+type rpcCollector struct {
+	mux   sync.Mutex
+	calls []*RecordedRPCCall
+}
+
+func (c *rpcCollector) add(call *RecordedRPCCall) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	c.calls = append(c.calls, call)
+}
+
+// recorder writes entries as newline delimited JSON to the recording file
+type recorder struct {
+	conf *RecordingConf
+	mux  sync.Mutex
+	file *os.File
+	enc  *json.Encoder
+	seq  int64
+}
+
+func newRecorder(conf *RecordingConf) (*recorder, error) {
+	file, err := os.OpenFile(conf.Path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, errors.Errorf(errors.RESTGatewayRecordingOpen, conf.Path, err)
+	}
+	if conf.MaxBodyBytes <= 0 {
+		conf.MaxBodyBytes = defaultRecordingMaxBodyBytes
+	}
+	log.Infof("Recording REST requests and RPC calls to '%s'", conf.Path)
+	return &recorder{
+		conf: conf,
+		file: file,
+		enc:  json.NewEncoder(file),
+	}, nil
+}
+
+func (r *recorder) write(entry *RecordedEntry) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	r.seq++
+	entry.Seq = r.seq
+	if err := r.enc.Encode(entry); err != nil {
+		log.Errorf("Failed to write entry %d to recording: %s", entry.Seq, err)
+	}
+}
+
+func (r *recorder) excluded(req *http.Request) bool {
+	if strings.EqualFold(req.Header.Get("Upgrade"), "websocket") {
+		return true
+	}
+	for _, prefix := range r.conf.ExcludePaths {
+		if strings.HasPrefix(req.URL.Path, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// recordingResponseWriter keeps a copy of the response as it is written
+type recordingResponseWriter struct {
+	http.ResponseWriter
+	status    int
+	body      bytes.Buffer
+	max       int
+	truncated bool
+}
+
+func (w *recordingResponseWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *recordingResponseWriter) Write(b []byte) (int, error) {
+	if remaining := w.max - w.body.Len(); remaining < len(b) {
+		w.body.Write(b[0:remaining])
+		w.truncated = true
+	} else {
+		w.body.Write(b)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// newRecordingHandler records each request, and the RPC calls made with its context
+func (r *recorder) newRecordingHandler(parent http.Handler) http.Handler {
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		if r.excluded(req) {
+			parent.ServeHTTP(res, req)
+			return
+		}
+		entry := &RecordedEntry{
+			Time: time.Now().UTC(),
+			Type: RecordedEntryRequest,
+			Request: &RecordedRequest{
+				Method:  req.Method,
+				URL:     req.URL.RequestURI(),
+				Headers: make(map[string]string),
+			},
+		}
+		for name, values := range req.Header {
+			if !recordedHeaderExclusions[name] {
+				entry.Request.Headers[name] = strings.Join(values, ",")
+			}
+		}
+		if req.Body != nil {
+			entry.Request.Body, _ = ioutil.ReadAll(req.Body)
+			req.Body = ioutil.NopCloser(bytes.NewReader(entry.Request.Body))
+		}
+
+		collector := &rpcCollector{}
+		rw := &recordingResponseWriter{ResponseWriter: res, status: 200, max: r.conf.MaxBodyBytes}
+		parent.ServeHTTP(rw, req.WithContext(context.WithValue(req.Context(), recordingContextKey{}, collector)))
+
+		entry.Response = &RecordedResponse{
+			Status:     rw.status,
+			Body:       rw.body.String(),
+			Truncated:  rw.truncated,
+			DurationMS: time.Since(entry.Time).Milliseconds(),
+		}
+		collector.mux.Lock()
+		entry.RPC = collector.calls
+		collector.mux.Unlock()
+		r.write(entry)
+	})
+}
+
+func (r *recorder) close() {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	r.file.Close()
+}
+
+// recordOutOfBand checks if a call made outside of a REST request should be recorded.
+// Receipts are only recorded once the transaction is mined
+func recordOutOfBand(call *RecordedRPCCall) bool {
+	if !recordedOutOfBandMethods[call.Method] {
+		return false
+	}
+	if call.Error != "" || call.Method != "eth_getTransactionReceipt" {
+		return true
+	}
+	var receipt struct {
+		BlockNumber *string `json:"blockNumber"`
+	}
+	json.Unmarshal(call.Result, &receipt)
+	return receipt.BlockNumber != nil
+}
+
+// recordingRPC wraps the RPC client to record the calls to the node
+type recordingRPC struct {
+	r   *recorder
+	rpc eth.RPCClient
+}
+
+func (r *recorder) wrapRPC(rpc eth.RPCClient) eth.RPCClient {
+	return &recordingRPC{r: r, rpc: rpc}
+}
+
+func (w *recordingRPC) CallContext(ctx context.Context, result interface{}, method string, args ...interface{}) error {
+	err := w.rpc.CallContext(ctx, result, method, args...)
+	call := &RecordedRPCCall{
+		Method: method,
+		Args:   args,
+	}
+	if err != nil {
+		call.Error = err.Error()
+	} else {
+		call.Result, _ = json.Marshal(result)
+	}
+	if collector, ok := ctx.Value(recordingContextKey{}).(*rpcCollector); ok {
+		collector.add(call)
+	} else if recordOutOfBand(call) {
+		w.r.write(&RecordedEntry{
+			Time: time.Now().UTC(),
+			Type: RecordedEntryRPC,
+			RPC:  []*RecordedRPCCall{call},
+		})
+	}
+	return err
+}
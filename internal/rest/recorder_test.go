@@ -0,0 +1,226 @@
+// Copyright 2021 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rest
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/kaleido-io/ethconnect/internal/eth"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestRecorder(t *testing.T, conf *RecordingConf) (*recorder, string) {
+	dir, _ := ioutil.TempDir("", "recorder")
+	conf.Path = path.Join(dir, "recording.ndjson")
+	r, err := newRecorder(conf)
+	assert.NoError(t, err)
+	return r, dir
+}
+
+func readTestRecording(t *testing.T, r *recorder) []*RecordedEntry {
+	f, err := os.Open(r.conf.Path)
+	assert.NoError(t, err)
+	defer f.Close()
+	entries := []*RecordedEntry{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var entry RecordedEntry
+		assert.NoError(t, json.Unmarshal(scanner.Bytes(), &entry))
+		entries = append(entries, &entry)
+	}
+	return entries
+}
+
+func TestRecordRequestWithRPCCalls(t *testing.T) {
+	assert := assert.New(t)
+	r, dir := newTestRecorder(t, &RecordingConf{})
+	defer os.RemoveAll(dir)
+	defer r.close()
+
+	rpc := r.wrapRPC(eth.NewMockRPCClientForSync(nil, func(method string, res interface{}, args ...interface{}) {
+		*(res.(*string)) = "0x12345"
+	}))
+	router := httprouter.New()
+	router.POST("/contracts/:address/set", func(res http.ResponseWriter, req *http.Request, params httprouter.Params) {
+		var blockNumber string
+		rpc.CallContext(req.Context(), &blockNumber, "eth_blockNumber")
+		res.Header().Set("Content-Type", "application/json")
+		res.WriteHeader(202)
+		res.Write([]byte(fmt.Sprintf(`{"blockNumber":"%s"}`, blockNumber)))
+	})
+	ts := httptest.NewServer(r.newRecordingHandler(router))
+	defer ts.Close()
+
+	req, _ := http.NewRequest("POST", ts.URL+"/contracts/0x0123456789abcdef0123456789abcdef01234567/set?fly-sync=true", strings.NewReader(`{"x":1}`))
+	req.Header.Set("Authorization", "Bearer secret")
+	req.Header.Set("Content-Type", "application/json")
+	res, err := http.DefaultClient.Do(req)
+	assert.NoError(err)
+	assert.Equal(202, res.StatusCode)
+	b, _ := ioutil.ReadAll(res.Body)
+	assert.Equal(`{"blockNumber":"0x12345"}`, string(b))
+
+	entries := readTestRecording(t, r)
+	assert.Equal(1, len(entries))
+	entry := entries[0]
+	assert.Equal(int64(1), entry.Seq)
+	assert.Equal(RecordedEntryRequest, entry.Type)
+	assert.Equal("POST", entry.Request.Method)
+	assert.Equal("/contracts/0x0123456789abcdef0123456789abcdef01234567/set?fly-sync=true", entry.Request.URL)
+	assert.Equal(`{"x":1}`, string(entry.Request.Body))
+	assert.Equal("application/json", entry.Request.Headers["Content-Type"])
+	assert.Empty(entry.Request.Headers["Authorization"])
+	assert.Equal(202, entry.Response.Status)
+	assert.Equal(`{"blockNumber":"0x12345"}`, entry.Response.Body)
+	assert.False(entry.Response.Truncated)
+	assert.Equal(1, len(entry.RPC))
+	assert.Equal("eth_blockNumber", entry.RPC[0].Method)
+	assert.Equal(`"0x12345"`, string(entry.RPC[0].Result))
+}
+
+func TestRecordTruncatesResponse(t *testing.T) {
+	assert := assert.New(t)
+	r, dir := newTestRecorder(t, &RecordingConf{MaxBodyBytes: 5})
+	defer os.RemoveAll(dir)
+	defer r.close()
+
+	ts := httptest.NewServer(r.newRecordingHandler(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		res.Write([]byte("0123456789"))
+	})))
+	defer ts.Close()
+
+	res, err := http.Get(ts.URL + "/receipts")
+	assert.NoError(err)
+	b, _ := ioutil.ReadAll(res.Body)
+	assert.Equal("0123456789", string(b))
+
+	entries := readTestRecording(t, r)
+	assert.Equal(1, len(entries))
+	assert.Equal(200, entries[0].Response.Status)
+	assert.Equal("01234", entries[0].Response.Body)
+	assert.True(entries[0].Response.Truncated)
+}
+
+func TestRecordExcludedPaths(t *testing.T) {
+	assert := assert.New(t)
+	r, dir := newTestRecorder(t, &RecordingConf{ExcludePaths: []string{"/status"}})
+	defer os.RemoveAll(dir)
+	defer r.close()
+
+	ts := httptest.NewServer(r.newRecordingHandler(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		res.WriteHeader(204)
+	})))
+	defer ts.Close()
+
+	res, err := http.Get(ts.URL + "/status")
+	assert.NoError(err)
+	assert.Equal(204, res.StatusCode)
+
+	req, _ := http.NewRequest("GET", ts.URL+"/ws", nil)
+	req.Header.Set("Upgrade", "websocket")
+	res, err = http.DefaultClient.Do(req)
+	assert.NoError(err)
+	assert.Equal(204, res.StatusCode)
+
+	assert.Equal(0, len(readTestRecording(t, r)))
+}
+
+func TestRecordOutOfBandRPC(t *testing.T) {
+	assert := assert.New(t)
+	r, dir := newTestRecorder(t, &RecordingConf{})
+	defer os.RemoveAll(dir)
+	defer r.close()
+
+	mined := false
+	rpc := r.wrapRPC(eth.NewMockRPCClientForSync(nil, func(method string, res interface{}, args ...interface{}) {
+		switch method {
+		case "eth_getTransactionReceipt":
+			if mined {
+				*(res.(*json.RawMessage)) = json.RawMessage(`{"blockNumber":"0x1","status":"0x1"}`)
+			} else {
+				*(res.(*json.RawMessage)) = json.RawMessage(`null`)
+			}
+		case "eth_sendTransaction":
+			*(res.(*string)) = "0xabcd"
+		}
+	}))
+
+	var txHash string
+	var receipt json.RawMessage
+	var gasPrice string
+	ctx := context.Background()
+	assert.NoError(rpc.CallContext(ctx, &txHash, "eth_sendTransaction", map[string]interface{}{"from": "0x1"}))
+	assert.NoError(rpc.CallContext(ctx, &gasPrice, "eth_gasPrice"))
+	assert.NoError(rpc.CallContext(ctx, &receipt, "eth_getTransactionReceipt", txHash))
+	mined = true
+	assert.NoError(rpc.CallContext(ctx, &receipt, "eth_getTransactionReceipt", txHash))
+
+	entries := readTestRecording(t, r)
+	assert.Equal(2, len(entries))
+	assert.Equal(RecordedEntryRPC, entries[0].Type)
+	assert.Equal("eth_sendTransaction", entries[0].RPC[0].Method)
+	assert.Equal(`"0xabcd"`, string(entries[0].RPC[0].Result))
+	assert.Equal("eth_getTransactionReceipt", entries[1].RPC[0].Method)
+	assert.Equal([]interface{}{"0xabcd"}, entries[1].RPC[0].Args)
+	assert.Equal(int64(2), entries[1].Seq)
+}
+
+func TestRecordOutOfBandRPCError(t *testing.T) {
+	assert := assert.New(t)
+	r, dir := newTestRecorder(t, &RecordingConf{})
+	defer os.RemoveAll(dir)
+	defer r.close()
+
+	rpc := r.wrapRPC(eth.NewMockRPCClientForSync(fmt.Errorf("pop"), nil))
+	var txHash string
+	err := rpc.CallContext(context.Background(), &txHash, "eth_sendRawTransaction", "0x00")
+	assert.EqualError(err, "pop")
+
+	entries := readTestRecording(t, r)
+	assert.Equal(1, len(entries))
+	assert.Equal("pop", entries[0].RPC[0].Error)
+	assert.Empty(entries[0].RPC[0].Result)
+}
+
+func TestNewRecorderBadPath(t *testing.T) {
+	assert := assert.New(t)
+	dir, _ := ioutil.TempDir("", "recorder")
+	defer os.RemoveAll(dir)
+	_, err := newRecorder(&RecordingConf{Path: path.Join(dir, "missing", "recording.ndjson")})
+	assert.Regexp("Failed to open recording file", err)
+}
+
+func TestStartWithBadRecordingPath(t *testing.T) {
+	assert := assert.New(t)
+	dir, _ := ioutil.TempDir("", "recorder")
+	defer os.RemoveAll(dir)
+
+	var printYAML = false
+	g := NewRESTGateway(&printYAML)
+	g.conf.Recording.Path = path.Join(dir, "missing", "recording.ndjson")
+	err := g.Start()
+	assert.Regexp("Failed to open recording file", err)
+}
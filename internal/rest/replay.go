@@ -0,0 +1,237 @@
+// Copyright 2021 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rest
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"reflect"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/kaleido-io/ethconnect/internal/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// DefaultReplayIgnoreFields differ on every run, or between chains, so are not compared
+var DefaultReplayIgnoreFields = []string{
+	"id", "_id", "msgId", "requestId", "transactionHash", "blockHash", "blockNumber",
+	"transactionIndex", "contractAddress", "receivedAt", "timeReceived", "timeElapsed",
+	"cumulativeGasUsed", "gasUsed", "nonce", "created",
+}
+
+// ReplayConf configures a replay of a recording against a (new) gateway
+type ReplayConf struct {
+	File          string   `json:"file"`
+	TargetURL     string   `json:"targetURL"`
+	AccessToken   string   `json:"accessToken,omitempty"`
+	CompareBodies bool     `json:"compareBodies,omitempty"`
+	IgnoreFields  []string `json:"ignoreFields,omitempty"`
+	TimeoutSec    int      `json:"timeoutSec,omitempty"`
+}
+
+// ReplayResult is the outcome of replaying a single recorded request
+type ReplayResult struct {
+	Seq            int64  `json:"seq"`
+	Method         string `json:"method"`
+	URL            string `json:"url"`
+	RecordedStatus int    `json:"recordedStatus"`
+	Status         int    `json:"status"`
+	Match          bool   `json:"match"`
+	Mismatch       string `json:"mismatch,omitempty"`
+}
+
+// ReplayReport summarizes a replay
+type ReplayReport struct {
+	Total      int               `json:"total"`
+	Matched    int               `json:"matched"`
+	Mismatched int               `json:"mismatched"`
+	Addresses  map[string]string `json:"addresses,omitempty"`
+	Results    []*ReplayResult   `json:"results"`
+}
+
+var replayAddressRegexp = regexp.MustCompile(`^(0x)?[0-9a-fA-F]{40}$`)
+
+type replayer struct {
+	conf      *ReplayConf
+	client    *http.Client
+	ignore    map[string]bool
+	addresses map[string]string
+}
+
+// Replay re-executes the REST requests in a recording against the target gateway in order,
+// and compares the responses to those recorded. Contracts deployed during the replay get new
+// addresses, so the recorded addresses are replaced with the new ones in subsequent requests.
+func Replay(conf *ReplayConf) (*ReplayReport, error) {
+	if conf.TargetURL == "" {
+		return nil, errors.Errorf(errors.ReplayNoTarget)
+	}
+	if conf.TimeoutSec <= 0 {
+		conf.TimeoutSec = 120
+	}
+	if conf.IgnoreFields == nil {
+		conf.IgnoreFields = DefaultReplayIgnoreFields
+	}
+	file, err := os.Open(conf.File)
+	if err != nil {
+		return nil, errors.Errorf(errors.ReplayReadFailed, conf.File, err)
+	}
+	defer file.Close()
+
+	r := &replayer{
+		conf:      conf,
+		client:    &http.Client{Timeout: time.Duration(conf.TimeoutSec) * time.Second},
+		ignore:    make(map[string]bool),
+		addresses: make(map[string]string),
+	}
+	for _, f := range conf.IgnoreFields {
+		r.ignore[f] = true
+	}
+
+	report := &ReplayReport{
+		Addresses: r.addresses,
+		Results:   []*ReplayResult{},
+	}
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 1024*1024), 64*1024*1024)
+	line := 0
+	for scanner.Scan() {
+		line++
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		var entry RecordedEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return nil, errors.Errorf(errors.ReplayBadEntry, line, err)
+		}
+		if entry.Type != RecordedEntryRequest || entry.Request == nil || entry.Response == nil {
+			continue
+		}
+		result := r.replayEntry(&entry)
+		report.Results = append(report.Results, result)
+		report.Total++
+		if result.Match {
+			report.Matched++
+		} else {
+			report.Mismatched++
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, errors.Errorf(errors.ReplayReadFailed, conf.File, err)
+	}
+	return report, nil
+}
+
+// substitute replaces recorded contract addresses with the ones deployed during the replay
+func (r *replayer) substitute(s string) string {
+	for recorded, replayed := range r.addresses {
+		s = regexp.MustCompile("(?i)"+recorded).ReplaceAllString(s, replayed)
+	}
+	return s
+}
+
+func (r *replayer) replayEntry(entry *RecordedEntry) *ReplayResult {
+	url := r.substitute(entry.Request.URL)
+	result := &ReplayResult{
+		Seq:            entry.Seq,
+		Method:         entry.Request.Method,
+		URL:            url,
+		RecordedStatus: entry.Response.Status,
+	}
+	body := []byte(r.substitute(string(entry.Request.Body)))
+	req, err := http.NewRequest(entry.Request.Method, strings.TrimSuffix(r.conf.TargetURL, "/")+url, bytes.NewReader(body))
+	if err != nil {
+		result.Mismatch = err.Error()
+		return result
+	}
+	for name, value := range entry.Request.Headers {
+		req.Header.Set(name, value)
+	}
+	if r.conf.AccessToken != "" {
+		req.Header.Set("Authorization", "Bearer "+r.conf.AccessToken)
+	}
+	log.Infof("Replaying %d: %s %s", entry.Seq, req.Method, url)
+	res, err := r.client.Do(req)
+	if err != nil {
+		result.Mismatch = err.Error()
+		return result
+	}
+	defer res.Body.Close()
+	resBody, _ := ioutil.ReadAll(res.Body)
+	result.Status = res.StatusCode
+
+	var recordedJSON, replayedJSON interface{}
+	recordedIsJSON := json.Unmarshal([]byte(entry.Response.Body), &recordedJSON) == nil
+	replayedIsJSON := json.Unmarshal(resBody, &replayedJSON) == nil
+	if recordedIsJSON && replayedIsJSON {
+		r.mapAddresses(recordedJSON, replayedJSON)
+	}
+
+	switch {
+	case result.Status != result.RecordedStatus:
+		result.Mismatch = errors.Errorf(errors.ReplayStatusMismatch, result.RecordedStatus, result.Status).Error()
+	case r.conf.CompareBodies && !entry.Response.Truncated && recordedIsJSON:
+		if !replayedIsJSON || !reflect.DeepEqual(r.stripIgnored(recordedJSON), r.stripIgnored(replayedJSON)) {
+			result.Mismatch = errors.Errorf(errors.ReplayBodyMismatch).Error()
+		}
+	}
+	result.Match = result.Mismatch == ""
+	return result
+}
+
+// mapAddresses records the new address of a contract deployed in the replay
+func (r *replayer) mapAddresses(recorded, replayed interface{}) {
+	recordedMap, ok1 := recorded.(map[string]interface{})
+	replayedMap, ok2 := replayed.(map[string]interface{})
+	if !ok1 || !ok2 {
+		return
+	}
+	recordedAddr, _ := recordedMap["contractAddress"].(string)
+	replayedAddr, _ := replayedMap["contractAddress"].(string)
+	if replayAddressRegexp.MatchString(recordedAddr) && replayAddressRegexp.MatchString(replayedAddr) {
+		recordedAddr = strings.ToLower(strings.TrimPrefix(recordedAddr, "0x"))
+		replayedAddr = strings.ToLower(strings.TrimPrefix(replayedAddr, "0x"))
+		if recordedAddr != replayedAddr {
+			log.Infof("Contract 0x%s from the recording is 0x%s in the replay", recordedAddr, replayedAddr)
+			r.addresses[recordedAddr] = replayedAddr
+		}
+	}
+}
+
+func (r *replayer) stripIgnored(v interface{}) interface{} {
+	switch vt := v.(type) {
+	case map[string]interface{}:
+		stripped := make(map[string]interface{})
+		for k, child := range vt {
+			if !r.ignore[k] {
+				stripped[k] = r.stripIgnored(child)
+			}
+		}
+		return stripped
+	case []interface{}:
+		stripped := make([]interface{}, len(vt))
+		for i, child := range vt {
+			stripped[i] = r.stripIgnored(child)
+		}
+		return stripped
+	default:
+		return v
+	}
+}
@@ -0,0 +1,184 @@
+// Copyright 2021 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rest
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	testReplayRecordedAddr = "0x0123456789abcdef0123456789abcdef01234567"
+	testReplayNewAddr      = "0xfedcba9876543210fedcba9876543210fedcba98"
+)
+
+func writeTestRecording(t *testing.T, entries ...*RecordedEntry) (string, string) {
+	dir, _ := ioutil.TempDir("", "replay")
+	file := path.Join(dir, "recording.ndjson")
+	f, err := os.Create(file)
+	assert.NoError(t, err)
+	enc := json.NewEncoder(f)
+	for _, entry := range entries {
+		enc.Encode(entry)
+	}
+	f.Close()
+	return dir, file
+}
+
+func newTestReplayTarget(t *testing.T, headers map[string]string) *httptest.Server {
+	router := httprouter.New()
+	router.POST("/abis/:abi", func(res http.ResponseWriter, req *http.Request, params httprouter.Params) {
+		headers["Authorization"] = req.Header.Get("Authorization")
+		res.Header().Set("Content-Type", "application/json")
+		res.WriteHeader(200)
+		res.Write([]byte(`{"contractAddress":"` + testReplayNewAddr + `","transactionHash":"0x22"}`))
+	})
+	router.GET("/contracts/:address/get", func(res http.ResponseWriter, req *http.Request, params httprouter.Params) {
+		if strings.TrimPrefix(params.ByName("address"), "0x") != strings.TrimPrefix(testReplayNewAddr, "0x") {
+			res.WriteHeader(404)
+			return
+		}
+		res.Header().Set("Content-Type", "application/json")
+		res.WriteHeader(200)
+		res.Write([]byte(`{"output":"42","id":"new"}`))
+	})
+	return httptest.NewServer(router)
+}
+
+func TestReplayMatchesWithNewAddresses(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, file := writeTestRecording(t,
+		&RecordedEntry{Seq: 1, Type: RecordedEntryRequest,
+			Request:  &RecordedRequest{Method: "POST", URL: "/abis/abc123?fly-sync=true", Body: []byte(`{}`)},
+			Response: &RecordedResponse{Status: 200, Body: `{"contractAddress":"` + testReplayRecordedAddr + `","transactionHash":"0x11"}`},
+		},
+		&RecordedEntry{Seq: 2, Type: RecordedEntryRPC,
+			RPC: []*RecordedRPCCall{{Method: "eth_getTransactionReceipt"}},
+		},
+		&RecordedEntry{Seq: 3, Type: RecordedEntryRequest,
+			Request:  &RecordedRequest{Method: "GET", URL: "/contracts/0123456789ABCDEF0123456789abcdef01234567/get"},
+			Response: &RecordedResponse{Status: 200, Body: `{"output":"42","id":"old"}`},
+		},
+	)
+	defer os.RemoveAll(dir)
+
+	headers := make(map[string]string)
+	ts := newTestReplayTarget(t, headers)
+	defer ts.Close()
+
+	report, err := Replay(&ReplayConf{
+		File:          file,
+		TargetURL:     ts.URL + "/",
+		AccessToken:   "testat",
+		CompareBodies: true,
+	})
+	assert.NoError(err)
+	assert.Equal(2, report.Total)
+	assert.Equal(2, report.Matched)
+	assert.Equal(0, report.Mismatched)
+	assert.Equal("/contracts/fedcba9876543210fedcba9876543210fedcba98/get", report.Results[1].URL)
+	assert.Equal("fedcba9876543210fedcba9876543210fedcba98", report.Addresses["0123456789abcdef0123456789abcdef01234567"])
+	assert.Equal("Bearer testat", headers["Authorization"])
+}
+
+func TestReplayMismatches(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, file := writeTestRecording(t,
+		&RecordedEntry{Seq: 1, Type: RecordedEntryRequest,
+			Request:  &RecordedRequest{Method: "GET", URL: "/contracts/" + testReplayRecordedAddr + "/get"},
+			Response: &RecordedResponse{Status: 200, Body: `{"output":"42"}`},
+		},
+		&RecordedEntry{Seq: 2, Type: RecordedEntryRequest,
+			Request:  &RecordedRequest{Method: "GET", URL: "/contracts/" + testReplayNewAddr + "/get"},
+			Response: &RecordedResponse{Status: 200, Body: `{"output":"43"}`},
+		},
+		&RecordedEntry{Seq: 3, Type: RecordedEntryRequest,
+			Request:  &RecordedRequest{Method: "GET", URL: "/contracts/" + testReplayNewAddr + "/get"},
+			Response: &RecordedResponse{Status: 200, Body: `{"output":"43"}`, Truncated: true},
+		},
+	)
+	defer os.RemoveAll(dir)
+
+	ts := newTestReplayTarget(t, make(map[string]string))
+	defer ts.Close()
+
+	report, err := Replay(&ReplayConf{
+		File:          file,
+		TargetURL:     ts.URL,
+		CompareBodies: true,
+	})
+	assert.NoError(err)
+	assert.Equal(3, report.Total)
+	assert.Equal(1, report.Matched)
+	assert.Equal(2, report.Mismatched)
+	assert.Equal(404, report.Results[0].Status)
+	assert.Equal("Expected status 200, received 404", report.Results[0].Mismatch)
+	assert.Equal("Response body does not match the recording", report.Results[1].Mismatch)
+	assert.True(report.Results[2].Match)
+}
+
+func TestReplayRequestFailure(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, file := writeTestRecording(t,
+		&RecordedEntry{Seq: 1, Type: RecordedEntryRequest,
+			Request:  &RecordedRequest{Method: "GET", URL: "/status"},
+			Response: &RecordedResponse{Status: 200},
+		},
+	)
+	defer os.RemoveAll(dir)
+
+	report, err := Replay(&ReplayConf{
+		File:      file,
+		TargetURL: "http://localhost:0",
+	})
+	assert.NoError(err)
+	assert.Equal(1, report.Mismatched)
+	assert.NotEmpty(report.Results[0].Mismatch)
+}
+
+func TestReplayNoTarget(t *testing.T) {
+	assert := assert.New(t)
+	_, err := Replay(&ReplayConf{File: "recording.ndjson"})
+	assert.EqualError(err, "A target URL is required to replay a recording")
+}
+
+func TestReplayMissingFile(t *testing.T) {
+	assert := assert.New(t)
+	_, err := Replay(&ReplayConf{File: "/tmp/does/not/exist.ndjson", TargetURL: "http://localhost:0"})
+	assert.Regexp("Failed to read recording", err)
+}
+
+func TestReplayBadEntry(t *testing.T) {
+	assert := assert.New(t)
+	dir, _ := ioutil.TempDir("", "replay")
+	defer os.RemoveAll(dir)
+	file := path.Join(dir, "recording.ndjson")
+	ioutil.WriteFile(file, []byte("{\"seq\":1,\"type\":\"rpc\"}\n\n!bad\n"), 0644)
+
+	_, err := Replay(&ReplayConf{File: file, TargetURL: "http://localhost:0"})
+	assert.Regexp("Invalid entry at line 3 of the recording", err)
+}
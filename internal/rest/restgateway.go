@@ -32,6 +32,8 @@ import (
 	"github.com/kaleido-io/ethconnect/internal/eth"
 	"github.com/kaleido-io/ethconnect/internal/kafka"
 	"github.com/kaleido-io/ethconnect/internal/messages"
+	"github.com/kaleido-io/ethconnect/internal/metrics"
+	"github.com/kaleido-io/ethconnect/internal/tracing"
 	"github.com/kaleido-io/ethconnect/internal/tx"
 	"github.com/kaleido-io/ethconnect/internal/utils"
 	"github.com/kaleido-io/ethconnect/internal/ws"
@@ -72,12 +74,24 @@ type LevelDBReceiptStoreConf struct {
 
 // RESTGatewayConf defines the YAML config structure for a webhooks bridge instance
 type RESTGatewayConf struct {
-	Kafka    kafka.KafkaCommonConf              `json:"kafka"`
-	MongoDB  MongoDBReceiptStoreConf            `json:"mongodb"`
-	LevelDB  LevelDBReceiptStoreConf            `json:"leveldb"`
-	MemStore ReceiptStoreConf                   `json:"memstore"`
-	OpenAPI  contracts.SmartContractGatewayConf `json:"openapi"`
-	HTTP     struct {
+	Kafka             kafka.KafkaCommonConf              `json:"kafka"`
+	MongoDB           MongoDBReceiptStoreConf            `json:"mongodb"`
+	LevelDB           LevelDBReceiptStoreConf            `json:"leveldb"`
+	MemStore          ReceiptStoreConf                   `json:"memstore"`
+	OpenAPI           contracts.SmartContractGatewayConf `json:"openapi"`
+	WS                ws.WebSocketServerConf             `json:"ws"`
+	CircuitBreaker    CircuitBreakerConf                 `json:"circuitBreaker"`
+	LevelDBAdmin      LevelDBAdminConf                   `json:"leveldbAdmin"`
+	JSONRPC           JSONRPCFacadeConf                  `json:"jsonrpc"`
+	JSONRPCProxy      JSONRPCProxyConf                   `json:"jsonrpcProxy"`
+	ReceiptWebhooks   ReceiptWebhooksConf                `json:"receiptWebhooks"`
+	ReceiptReconciler ReceiptReconcilerConf              `json:"receiptReconciler"`
+	Recording         RecordingConf                      `json:"recording"`
+	SignatureAuth     auth.EthSignatureAuthConf          `json:"signatureAuth"`
+	OpsEvents         OpsEventsConf                      `json:"opsEvents"`
+	Idempotency       IdempotencyConf                    `json:"idempotency"`
+	RateLimit         RateLimitConf                      `json:"rateLimit"`
+	HTTP              struct {
 		LocalAddr string          `json:"localAddr"`
 		Port      int             `json:"port"`
 		TLS       utils.TLSConfig `json:"tls"`
@@ -99,6 +113,8 @@ type RESTGateway struct {
 	webhooks        *webhooks
 	smartContractGW contracts.SmartContractGateway
 	ws              ws.WebSocketServer
+	jsonrpcSrv      *http.Server
+	sigAuth         *auth.EthSignatureVerifier
 }
 
 // Conf gets the config for this bridge
@@ -123,10 +139,23 @@ func (g *RESTGateway) ValidateConf() (err error) {
 	if g.conf.LevelDB.QueryLimit < 1 {
 		g.conf.LevelDB.QueryLimit = 100
 	}
-	if g.conf.OpenAPI.StoragePath != "" && g.conf.RPC.URL == "" {
+	if g.conf.OpenAPI.Enabled() && g.conf.RPC.URL == "" {
 		err = errors.Errorf(errors.ConfigRESTGatewayRequiredRPC)
 		return
 	}
+	if g.conf.JSONRPC.Port > 0 && g.conf.RPC.URL == "" {
+		err = errors.Errorf(errors.ConfigRESTGatewayRequiredRPCForJSONRPC)
+		return
+	}
+	if len(g.conf.JSONRPCProxy.AllowedMethods) > 0 && g.conf.RPC.URL == "" {
+		err = errors.Errorf(errors.ConfigRESTGatewayRequiredRPCForJSONRPCProxy)
+		return
+	}
+	if g.conf.SignatureAuth.Enabled {
+		if g.sigAuth, err = auth.NewEthSignatureVerifier(&g.conf.SignatureAuth); err != nil {
+			return
+		}
+	}
 	return
 }
 
@@ -138,8 +167,8 @@ func NewRESTGateway(printYAML *bool) (g *RESTGateway) {
 		pendingMsgs: make(map[string]bool),
 		successMsgs: make(map[string]*sarama.ProducerMessage),
 		failedMsgs:  make(map[string]error),
-		ws:          ws.NewWebSocketServer(),
 	}
+	g.ws = ws.NewWebSocketServer(&g.conf.WS)
 	return
 }
 
@@ -179,6 +208,9 @@ func (g *RESTGateway) CobraInit(cmdName string) (cmd *cobra.Command) {
 	cmd.Flags().IntVarP(&g.conf.MaxInFlight, "maxinflight", "m", utils.DefInt("WEBHOOKS_MAX_INFLIGHT", 0), "Maximum messages to hold in-flight")
 	cmd.Flags().StringVarP(&g.conf.HTTP.LocalAddr, "listen-addr", "L", os.Getenv("WEBHOOKS_LISTEN_ADDR"), "Local address to listen on")
 	cmd.Flags().IntVarP(&g.conf.HTTP.Port, "listen-port", "l", utils.DefInt("WEBHOOKS_LISTEN_PORT", 8080), "Port to listen on")
+	cmd.Flags().StringVarP(&g.conf.WorkQueue.LevelDB, "workqueue-leveldb", "W", os.Getenv("WEBHOOKS_WORKQUEUE_LEVELDB"), "LevelDB path to persist async messages when running without Kafka")
+	cmd.Flags().StringVarP(&g.conf.Recording.Path, "record-file", "N", os.Getenv("WEBHOOKS_RECORD_FILE"), "File to record REST requests and RPC calls to, for replay testing")
+	cmd.Flags().IntVarP(&g.conf.JSONRPC.Port, "jsonrpc-listen-port", "O", utils.DefInt("JSONRPC_LISTEN_PORT", 0), "Port for the Ethereum JSON-RPC listener (disabled if not set)")
 	cmd.Flags().StringVarP(&g.conf.MongoDB.URL, "mongodb-url", "M", os.Getenv("MONGODB_URL"), "MongoDB URL for a receipt store")
 	cmd.Flags().StringVarP(&g.conf.MongoDB.Database, "mongodb-database", "D", os.Getenv("MONGODB_DATABASE"), "MongoDB receipt store database")
 	cmd.Flags().StringVarP(&g.conf.MongoDB.Collection, "mongodb-receipt-collection", "R", os.Getenv("MONGODB_COLLECTION"), "MongoDB receipt store collection")
@@ -223,6 +255,26 @@ func (g *RESTGateway) DispatchMsgAsync(ctx context.Context, msg map[string]inter
 func (g *RESTGateway) newAccessTokenContextHandler(parent http.Handler) http.Handler {
 	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
 
+		// Requests signed by an Ethereum key are authenticated as the principal of the signing address
+		if g.sigAuth != nil && auth.IsSignedRequest(req) {
+			principal, err := g.sigAuth.Verify(req)
+			var authCtx context.Context
+			if err == nil {
+				authCtx, err = auth.WithPrincipal(req.Context(), principal)
+			}
+			if err != nil {
+				log.Errorf("Error authenticating signed request: %s", err)
+				g.sendError(res, "Unauthorized", 401)
+				return
+			}
+			parent.ServeHTTP(res, req.WithContext(authCtx))
+			return
+		} else if g.sigAuth != nil && g.sigAuth.Required() {
+			log.Errorf("Error authenticating request: %s", errors.Errorf(errors.EthSignatureAuthRequired))
+			g.sendError(res, "Unauthorized", 401)
+			return
+		}
+
 		// Extract an access token from bearer token (only - no support for query params)
 		accessToken := ""
 		hSplit := strings.SplitN(req.Header.Get("Authorization"), " ", 2)
@@ -230,7 +282,12 @@ func (g *RESTGateway) newAccessTokenContextHandler(parent http.Handler) http.Han
 			accessToken = hSplit[1]
 		}
 		authCtx, err := auth.WithAuthContext(req.Context(), accessToken)
-		if err != nil {
+		if err != nil && accessToken == "" && req.URL.Path == "/ws" {
+			// Browsers cannot set headers on WebSocket upgrades, so the WebSocket
+			// server requires an "auth" message as the first message instead
+			parent.ServeHTTP(res, req)
+			return
+		} else if err != nil {
 			log.Errorf("Error getting auth context: %s", err)
 			g.sendError(res, "Unauthorized", 401)
 			return
@@ -240,6 +297,23 @@ func (g *RESTGateway) newAccessTokenContextHandler(parent http.Handler) http.Han
 	})
 }
 
+func (g *RESTGateway) newJSONRPCServer(processor tx.TxnProcessor, rpcClient eth.RPCClient) (*http.Server, error) {
+	tlsConfig, err := utils.CreateTLSConfiguration(&g.conf.JSONRPC.TLS)
+	if err != nil {
+		return nil, err
+	}
+	facade, err := newJSONRPCFacade(&g.conf.JSONRPC, processor, rpcClient, g.receipts)
+	if err != nil {
+		return nil, err
+	}
+	return &http.Server{
+		Addr:           fmt.Sprintf("%s:%d", g.conf.JSONRPC.LocalAddr, g.conf.JSONRPC.Port),
+		TLSConfig:      tlsConfig,
+		Handler:        tracing.NewHTTPHandler(g.newAccessTokenContextHandler(facade)),
+		MaxHeaderBytes: MaxHeaderSize,
+	}, nil
+}
+
 // Start kicks off the HTTP listener and router
 func (g *RESTGateway) Start() (err error) {
 
@@ -256,20 +330,44 @@ func (g *RESTGateway) Start() (err error) {
 
 	router := httprouter.New()
 
+	var rec *recorder
+	if g.conf.Recording.Path != "" {
+		if rec, err = newRecorder(&g.conf.Recording); err != nil {
+			return
+		}
+		defer rec.close()
+	}
+
 	var processor tx.TxnProcessor
 	var rpcClient eth.RPCClient
-	if g.conf.RPC.URL != "" || g.conf.OpenAPI.StoragePath != "" {
+	if g.conf.RPC.URL != "" || g.conf.OpenAPI.Enabled() {
 		rpcClient, err = eth.RPCConnect(&g.conf.RPC)
 		if err != nil {
 			return err
 		}
+		if rec != nil {
+			rpcClient = rec.wrapRPC(rpcClient)
+		}
 		processor = tx.NewTxnProcessor(&g.conf.TxnProcessorConf, &g.conf.RPCConf)
 		processor.Init(rpcClient)
+		processor.AddRoutes(router)
 	}
 
 	g.ws.AddRoutes(router)
+	metrics.AddRoutes(router)
+	if g.conf.OpsEvents.Enabled {
+		opsEvents, err := newOpsEventsPublisher(&g.conf.OpsEvents, g.ws)
+		if err != nil {
+			return err
+		}
+		opsEvents.start()
+		defer opsEvents.close()
+	}
+	if len(g.conf.JSONRPCProxy.AllowedMethods) > 0 && rpcClient != nil {
+		newJSONRPCProxy(&g.conf.JSONRPCProxy, rpcClient).addRoutes(router)
+	}
 
-	if g.conf.OpenAPI.StoragePath != "" {
+	if g.conf.OpenAPI.Enabled() {
 		g.smartContractGW, err = contracts.NewSmartContractGateway(&g.conf.OpenAPI, &g.conf.TxnProcessorConf, rpcClient, processor, g, g.ws)
 		if err != nil {
 			return err
@@ -301,27 +399,69 @@ func (g *RESTGateway) Start() (err error) {
 	}
 
 	router.GET("/status", g.statusHandler)
+	newLevelDBAdmin(&g.conf.LevelDBAdmin).addRoutes(router)
 	g.receipts = newReceiptStore(receiptStoreConf, receiptStorePersistence, g.smartContractGW)
 	g.receipts.addRoutes(router)
+	if len(g.conf.ReceiptWebhooks.Destinations) > 0 {
+		if g.receipts.webhooks, err = newReceiptWebhooks(&g.conf.ReceiptWebhooks); err != nil {
+			return
+		}
+		g.receipts.webhooks.addRoutes(router)
+		g.receipts.webhooks.start()
+		defer g.receipts.webhooks.close()
+	}
+	if g.conf.ReceiptReconciler.Enabled && rpcClient != nil {
+		if g.receipts.reconciler, err = newReceiptReconciler(&g.conf.ReceiptReconciler, g.receipts, rpcClient); err != nil {
+			return
+		}
+		g.receipts.reconciler.start()
+		defer g.receipts.reconciler.close()
+	}
 	if len(g.conf.Kafka.Brokers) > 0 {
 		wk := newWebhooksKafka(&g.conf.Kafka, g.receipts)
-		g.webhooks = newWebhooks(wk, g.smartContractGW)
+		g.webhooks = newWebhooks(wk, g.smartContractGW, &g.conf.CircuitBreaker)
 	} else {
 		wd := newWebhooksDirect(&g.conf.WebhooksDirectConf, processor, g.receipts)
-		g.webhooks = newWebhooks(wd, g.smartContractGW)
+		if err = wd.openWorkQueue(); err != nil {
+			return
+		}
+		g.webhooks = newWebhooks(wd, g.smartContractGW, &g.conf.CircuitBreaker)
 	}
 	g.webhooks.addRoutes(router)
 
+	if g.conf.JSONRPC.Port > 0 {
+		if g.jsonrpcSrv, err = g.newJSONRPCServer(processor, rpcClient); err != nil {
+			return
+		}
+	}
+
+	var handler http.Handler = router
+	if g.conf.Idempotency.Enabled {
+		idem, err := newIdempotency(&g.conf.Idempotency)
+		if err != nil {
+			return err
+		}
+		idem.start()
+		defer idem.close()
+		handler = idem.newIdempotencyHandler(handler)
+	}
+	if rec != nil {
+		handler = rec.newRecordingHandler(handler)
+	}
+	if g.conf.RateLimit.Enabled {
+		// Limited requests are rejected before they are recorded, or claim an idempotency key
+		handler = newRateLimiter(&g.conf.RateLimit).newRateLimitHandler(handler)
+	}
 	g.srv = &http.Server{
 		Addr:           fmt.Sprintf("%s:%d", g.conf.HTTP.LocalAddr, g.conf.HTTP.Port),
 		TLSConfig:      tlsConfig,
-		Handler:        g.newAccessTokenContextHandler(router),
+		Handler:        tracing.NewHTTPHandler(g.newAccessTokenContextHandler(handler)),
 		MaxHeaderBytes: MaxHeaderSize,
 	}
 
 	readyToListen := make(chan bool)
 	gwDone := make(chan error)
-	svrDone := make(chan error)
+	svrDone := make(chan error, 2) // HTTP and JSON-RPC listeners
 
 	go func() {
 		<-readyToListen
@@ -332,6 +472,17 @@ func (g *RESTGateway) Start() (err error) {
 		}
 		svrDone <- err
 	}()
+	if g.jsonrpcSrv != nil {
+		go func() {
+			<-readyToListen
+			log.Printf("JSON-RPC server listening on %s", g.jsonrpcSrv.Addr)
+			err := g.jsonrpcSrv.ListenAndServe()
+			if err != nil {
+				log.Errorf("JSON-RPC listening ended with: %s", err)
+			}
+			svrDone <- err
+		}()
+	}
 	go func() {
 		err := g.webhooks.run()
 		if err != nil {
@@ -342,7 +493,7 @@ func (g *RESTGateway) Start() (err error) {
 	for !g.webhooks.isInitialized() {
 		time.Sleep(250 * time.Millisecond)
 	}
-	readyToListen <- true
+	close(readyToListen)
 
 	// Clean up on SIGINT
 	signals := make(chan os.Signal, 1)
@@ -364,6 +515,9 @@ func (g *RESTGateway) Start() (err error) {
 	log.Infof("Shutting down HTTP server")
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	g.srv.Shutdown(ctx)
+	if g.jsonrpcSrv != nil {
+		g.jsonrpcSrv.Shutdown(ctx)
+	}
 	defer cancel()
 
 	return
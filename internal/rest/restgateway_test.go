@@ -21,6 +21,7 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"strings"
 	"sync"
 	"testing"
 	"time"
@@ -28,6 +29,7 @@ import (
 	"github.com/julienschmidt/httprouter"
 	"github.com/kaleido-io/ethconnect/internal/auth"
 	"github.com/kaleido-io/ethconnect/internal/auth/authtest"
+	"github.com/kaleido-io/ethconnect/internal/ethbind"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -61,6 +63,63 @@ func TestValidateConfInvalidOpenAPIArgs(t *testing.T) {
 	assert.EqualError(err, "RPC URL and Storage Path must be supplied to enable the Open API REST Gateway")
 }
 
+func TestValidateConfJSONRPCRequiresRPC(t *testing.T) {
+	assert := assert.New(t)
+	var printYAML = false
+	g := NewRESTGateway(&printYAML)
+	g.conf.JSONRPC.Port = 8545
+	err := g.ValidateConf()
+	assert.EqualError(err, "RPC URL must be supplied to enable the JSON-RPC listener")
+}
+
+func TestValidateConfJSONRPCProxyRequiresRPC(t *testing.T) {
+	assert := assert.New(t)
+	var printYAML = false
+	g := NewRESTGateway(&printYAML)
+	g.conf.JSONRPCProxy.AllowedMethods = []string{"eth_call"}
+	err := g.ValidateConf()
+	assert.EqualError(err, "RPC URL must be supplied to enable the JSON-RPC proxy")
+}
+
+func TestStartStopJSONRPCListener(t *testing.T) {
+	assert := assert.New(t)
+
+	router := &httprouter.Router{}
+	fakeRPC := httptest.NewServer(router)
+
+	var printYAML = false
+	g := NewRESTGateway(&printYAML)
+	g.conf.HTTP.Port = lastPort
+	g.conf.HTTP.LocalAddr = "127.0.0.1"
+	g.conf.JSONRPC.Port = lastPort + 1
+	g.conf.JSONRPC.LocalAddr = "127.0.0.1"
+	g.conf.RPC.URL = fakeRPC.URL
+	g.conf.MaxInFlight = 10
+	lastPort += 2
+	var err error
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		err = g.Start()
+		wg.Done()
+	}()
+
+	var resp *http.Response
+	for i := 0; i < 5; i++ {
+		time.Sleep(200 * time.Millisecond)
+		resp, err = http.Get(fmt.Sprintf("http://127.0.0.1:%d/", g.conf.JSONRPC.Port))
+		if err == nil {
+			break
+		}
+	}
+	assert.NoError(err)
+	assert.Equal(405, resp.StatusCode)
+
+	g.jsonrpcSrv.Close()
+	wg.Wait()
+	assert.EqualError(err, "http: Server closed")
+}
+
 func TestStartStatusStopNoKafkaWebhooksAccessToken(t *testing.T) {
 	assert := assert.New(t)
 
@@ -164,6 +223,81 @@ func TestStartStatusStopNoKafkaWebhooksMissingToken(t *testing.T) {
 
 }
 
+func TestAccessTokenHandlerWebSocketDeferredAuth(t *testing.T) {
+	assert := assert.New(t)
+
+	auth.RegisterSecurityModule(&authtest.TestSecurityModule{})
+
+	var printYAML = false
+	g := NewRESTGateway(&printYAML)
+	called := false
+	h := g.newAccessTokenContextHandler(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		called = true
+		assert.Nil(auth.GetAuthContext(req.Context()))
+	}))
+
+	res := httptest.NewRecorder()
+	h.ServeHTTP(res, httptest.NewRequest(http.MethodGet, "/ws", nil))
+	assert.True(called)
+
+	called = false
+	res = httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/ws", nil)
+	req.Header.Set("Authorization", "bearer badtoken")
+	h.ServeHTTP(res, req)
+	assert.False(called)
+	assert.Equal(401, res.Code)
+
+	auth.RegisterSecurityModule(nil)
+}
+
+func TestAccessTokenHandlerSignedRequests(t *testing.T) {
+	assert := assert.New(t)
+
+	key, _ := ethbind.API.GenerateKey()
+	var printYAML = false
+	g := NewRESTGateway(&printYAML)
+	g.conf.SignatureAuth = auth.EthSignatureAuthConf{
+		Enabled:    true,
+		Principals: map[string]string{ethbind.API.PubkeyToAddress(key.PublicKey).Hex(): "machine1"},
+	}
+	assert.NoError(g.ValidateConf())
+	var principal string
+	h := g.newAccessTokenContextHandler(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		principal = auth.GetPrincipal(req.Context())
+	}))
+	send := func(req *http.Request) int {
+		principal = ""
+		res := httptest.NewRecorder()
+		h.ServeHTTP(res, req)
+		return res.Code
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/contracts/token/transfer", strings.NewReader(`{"amount":10}`))
+	assert.NoError(auth.SignRequest(req, key, time.Now()))
+	assert.Equal(200, send(req))
+	assert.Equal("machine1", principal)
+
+	// A replayed signature is rejected
+	assert.Equal(401, send(req))
+
+	// Unsigned requests are accepted unless signatures are required, as there is no security module
+	assert.Equal(200, send(httptest.NewRequest(http.MethodGet, "/status", nil)))
+	assert.Equal("", principal)
+	g.conf.SignatureAuth.Required = true
+	assert.Equal(401, send(httptest.NewRequest(http.MethodGet, "/status", nil)))
+
+	// A security module must accept principals, to be combined with signature authentication
+	auth.RegisterSecurityModule(&authtest.TestSecurityModule{})
+	req = httptest.NewRequest(http.MethodGet, "/status", nil)
+	assert.NoError(auth.SignRequest(req, key, time.Now()))
+	assert.Equal(401, send(req))
+	auth.RegisterSecurityModule(nil)
+
+	g.conf.SignatureAuth.Principals = map[string]string{"bad": "machine1"}
+	assert.Regexp("Invalid address 'bad'", g.ValidateConf())
+}
+
 func TestStartWithKafkaWebhooks(t *testing.T) {
 	assert := assert.New(t)
 
@@ -323,7 +457,7 @@ func TestDispatchMsgAsyncPassesThroughToWebhooks(t *testing.T) {
 	var printYAML = true
 	g := NewRESTGateway(&printYAML)
 	fakeHandler := &mockHandler{}
-	g.webhooks = newWebhooks(fakeHandler, nil)
+	g.webhooks = newWebhooks(fakeHandler, nil, &CircuitBreakerConf{})
 
 	var fakeMsg map[string]interface{}
 	_, err := g.DispatchMsgAsync(context.Background(), fakeMsg, true)
@@ -23,6 +23,7 @@ import (
 	"github.com/julienschmidt/httprouter"
 	"github.com/kaleido-io/ethconnect/internal/contracts"
 	"github.com/kaleido-io/ethconnect/internal/errors"
+	"github.com/kaleido-io/ethconnect/internal/eth"
 	"github.com/kaleido-io/ethconnect/internal/messages"
 	"github.com/kaleido-io/ethconnect/internal/utils"
 	log "github.com/sirupsen/logrus"
@@ -38,12 +39,14 @@ type webhooksHandler interface {
 type webhooks struct {
 	smartContractGW contracts.SmartContractGateway
 	handler         webhooksHandler
+	breaker         *circuitBreaker
 }
 
-func newWebhooks(handler webhooksHandler, smartContractGW contracts.SmartContractGateway) *webhooks {
+func newWebhooks(handler webhooksHandler, smartContractGW contracts.SmartContractGateway, cbConf *CircuitBreakerConf) *webhooks {
 	return &webhooks{
 		handler:         handler,
 		smartContractGW: smartContractGW,
+		breaker:         newCircuitBreaker(cbConf),
 	}
 }
 
@@ -75,6 +78,7 @@ func (w *webhooks) addRoutes(router *httprouter.Router) {
 	router.POST("/", w.webhookHandlerNoAck) // Default on base URL
 	router.POST("/hook", w.webhookHandlerWithAck)
 	router.POST("/fasthook", w.webhookHandlerNoAck)
+	w.breaker.addRoutes(router)
 }
 
 func (w *webhooks) webhookHandlerWithAck(res http.ResponseWriter, req *http.Request, _ httprouter.Params) {
@@ -116,6 +120,11 @@ func (w *webhooks) processMsg(ctx context.Context, msg map[string]interface{}, a
 	var key string
 	switch msgType {
 	case messages.MsgTypeDeployContract, messages.MsgTypeSendTransaction:
+		// Sponsored transactions are sent from the sponsor, so are ordered by the sponsor
+		if sponsor, ok := headers.(map[string]interface{})["sponsor"].(string); ok && sponsor != "" {
+			key = sponsor
+			break
+		}
 		from, exists := msg["from"]
 		if !exists || reflect.TypeOf(from).Kind() != reflect.String {
 			return nil, 400, errors.Errorf(errors.WebhooksInvalidMsgFromMissing)
@@ -130,45 +139,59 @@ func (w *webhooks) processMsg(ctx context.Context, msg map[string]interface{}, a
 	msgID := utils.UUIDv4()
 	headers.(map[string]interface{})["id"] = msgID
 
+	var create2Address string
 	if w.smartContractGW != nil && msgType == messages.MsgTypeDeployContract {
 		var err error
-		if msg, err = w.contractGWHandler(msg); err != nil {
+		if msg, create2Address, err = w.contractGWHandler(msg); err != nil {
 			return nil, 500, err
 		}
 	}
 
+	// Reject up-front if the dispatcher is failing
+	if err := w.breaker.allow(); err != nil {
+		return nil, 503, err
+	}
+
 	// Pass to the handler
 	log.Infof("Webhook accepted message. MsgID: %s Type: %s", msgID, msgType)
 	msgAck, status, err := w.handler.sendWebhookMsg(ctx, key, msgID, msg, ack)
+	w.breaker.record(status, err)
 	if err != nil {
 		return nil, status, err
 	}
 	return &messages.AsyncSentMsg{
-		Sent:    true,
-		Request: msgID,
-		Msg:     msgAck,
+		Sent:            true,
+		Request:         msgID,
+		Msg:             msgAck,
+		ContractAddress: create2Address,
 	}, 200, nil
 }
 
-func (w *webhooks) contractGWHandler(msg map[string]interface{}) (map[string]interface{}, error) {
+func (w *webhooks) contractGWHandler(msg map[string]interface{}) (map[string]interface{}, string, error) {
 	// We have to fully parse, then re-serialize, the message in the case of a contract deployment
 	// where we are performing OpenAPI gateway processing
 	msgBytes, _ := json.Marshal(&msg)
 	var deployMsg messages.DeployContract
 	if err := json.Unmarshal(msgBytes, &deployMsg); err != nil {
-		return nil, err
+		return nil, "", err
 	}
 
 	// Call the GW handler
 	if err := w.smartContractGW.PreDeploy(&deployMsg); err != nil {
-		return nil, err
+		return nil, "", err
+	}
+
+	// A CREATE2 deployment has its address in the reply, before it is mined
+	create2Address, err := eth.PreviewCREATE2Address(&deployMsg)
+	if err != nil {
+		return nil, "", err
 	}
 
 	// Now send the message back to a generic map
 	msgBytes, _ = json.Marshal(&deployMsg)
 	var newMsg map[string]interface{}
 	json.Unmarshal(msgBytes, &newMsg)
-	return newMsg, nil
+	return newMsg, create2Address, nil
 }
 
 func (w *webhooks) run() error {
@@ -98,6 +98,7 @@ func TestWebhookHandlerContractGWSuccess(t *testing.T) {
 	w := &webhooks{
 		smartContractGW: &mockContractGW{},
 		handler:         &mockHandler{},
+		breaker:         newCircuitBreaker(&CircuitBreakerConf{}),
 	}
 	rec := httptest.NewRecorder()
 	w.webhookHandler(rec, req, false)
@@ -140,7 +141,7 @@ func TestContractGWHandlerUnmarshalFail(t *testing.T) {
 		},
 		handler: &mockHandler{},
 	}
-	_, err := w.contractGWHandler(map[string]interface{}{
+	_, _, err := w.contractGWHandler(map[string]interface{}{
 		"bad json": map[bool]bool{true: false},
 	})
 	assert.EqualError(err, "unexpected end of JSON input")
@@ -24,6 +24,7 @@ import (
 	"github.com/kaleido-io/ethconnect/internal/errors"
 	"github.com/kaleido-io/ethconnect/internal/eth"
 	"github.com/kaleido-io/ethconnect/internal/messages"
+	"github.com/kaleido-io/ethconnect/internal/tracing"
 	"github.com/kaleido-io/ethconnect/internal/tx"
 	"github.com/kaleido-io/ethconnect/internal/utils"
 	log "github.com/sirupsen/logrus"
@@ -31,7 +32,8 @@ import (
 
 // WebhooksDirectConf defines the YAML structore for a Webhooks direct to RPC bridge
 type WebhooksDirectConf struct {
-	MaxInFlight int `json:"maxInFlight"`
+	MaxInFlight int           `json:"maxInFlight"`
+	WorkQueue   WorkQueueConf `json:"workQueue"`
 	tx.TxnProcessorConf
 	eth.RPCConf
 }
@@ -44,6 +46,7 @@ type webhooksDirect struct {
 	processor     tx.TxnProcessor
 	inFlightMutex sync.Mutex
 	inFlight      map[string]*msgContext
+	queue         *workQueue
 	stopChan      chan error
 }
 
@@ -65,6 +68,7 @@ type msgContext struct {
 	msgID        string
 	msg          map[string]interface{}
 	headers      *messages.CommonHeaders
+	queued       *workQueueEntry
 }
 
 func (t *msgContext) Context() context.Context {
@@ -75,6 +79,10 @@ func (t *msgContext) Headers() *messages.CommonHeaders {
 	return t.headers
 }
 
+func (t *msgContext) TimeReceived() time.Time {
+	return t.timeReceived
+}
+
 func (t *msgContext) Unmarshal(msg interface{}) error {
 	msgBytes, err := json.Marshal(t.msg)
 	if err != nil {
@@ -112,6 +120,9 @@ func (t *msgContext) Reply(replyMessage messages.ReplyWithHeaders) {
 	replyHeaders.Elapsed = replyTime.Sub(t.timeReceived).Seconds()
 	msgBytes, _ := json.Marshal(&replyMessage)
 	t.w.receipts.processReply(msgBytes)
+	if t.queued != nil {
+		t.w.queue.remove(t.queued)
+	}
 	delete(t.w.inFlight, t.msgID)
 }
 
@@ -138,11 +149,12 @@ func (w *webhooksDirect) sendWebhookMsg(ctx context.Context, key, msgID string,
 	}
 	if err != nil {
 		w.inFlightMutex.Unlock()
-		log.Errorf("Unable to unmarshal headers from map payload: %+v: %s", msg, err)
+		log.Errorf("Unable to unmarshal headers from map payload: %+v: %s", utils.Redact(msg), err)
 		return "", 400, errors.Errorf(errors.WebhooksDirectBadHeaders)
 	}
 	msgContext := &msgContext{
-		ctx:          context.Background(),
+		// The message outlives the request, so only the trace of the request is carried over
+		ctx:          tracing.Extract(context.Background(), tracing.TraceParent(ctx)),
 		w:            w,
 		timeReceived: time.Now().UTC(),
 		key:          key,
@@ -150,6 +162,20 @@ func (w *webhooksDirect) sendWebhookMsg(ctx context.Context, key, msgID string,
 		msg:          msg,
 		headers:      &headers,
 	}
+	if w.queue != nil {
+		msgContext.queued = &workQueueEntry{
+			Key:      key,
+			MsgID:    msgID,
+			Received: msgContext.timeReceived,
+			Attempts: 1,
+			Msg:      msg,
+		}
+		if err = w.queue.put(msgContext.queued); err != nil {
+			w.inFlightMutex.Unlock()
+			log.Errorf("Failed to dispatch message from '%s': %s", key, err)
+			return "", 500, err
+		}
+	}
 	w.inFlight[msgID] = msgContext
 	w.inFlightMutex.Unlock()
 
@@ -170,10 +196,64 @@ func validateWebhooksDirectConf(conf *WebhooksDirectConf) error {
 	if conf.MaxInFlight <= 0 {
 		conf.MaxInFlight = 10
 	}
+	if conf.WorkQueue.MaxRetries <= 0 {
+		conf.WorkQueue.MaxRetries = defaultWorkQueueRetries
+	}
 	return nil
 }
 
+// openWorkQueue opens the persistent work queue, if one is configured
+func (w *webhooksDirect) openWorkQueue() (err error) {
+	if w.conf.WorkQueue.LevelDB != "" {
+		w.queue, err = newWorkQueue(&w.conf.WorkQueue)
+	}
+	return err
+}
+
+// recoverWorkQueue re-dispatches messages that were accepted, but did not have
+// a reply written to the receipt store before the last shutdown. Each message is
+// dispatched at most MaxRetries more times, before an error reply is stored instead.
+func (w *webhooksDirect) recoverWorkQueue() {
+	entries := w.queue.pending()
+	if len(entries) > 0 {
+		log.Infof("Recovering %d messages from work queue", len(entries))
+	}
+	for _, e := range entries {
+		var headers messages.CommonHeaders
+		headerBytes, _ := json.Marshal(e.Msg["headers"])
+		json.Unmarshal(headerBytes, &headers)
+		msgContext := &msgContext{
+			ctx:          context.Background(),
+			w:            w,
+			timeReceived: e.Received,
+			key:          e.Key,
+			msgID:        e.MsgID,
+			msg:          e.Msg,
+			headers:      &headers,
+			queued:       e,
+		}
+		w.inFlightMutex.Lock()
+		w.inFlight[e.MsgID] = msgContext
+		w.inFlightMutex.Unlock()
+
+		if e.Attempts > w.conf.WorkQueue.MaxRetries {
+			msgContext.SendErrorReply(500, errors.Errorf(errors.WebhooksDirectWorkQueueRetriesExceeded, e.Attempts))
+			continue
+		}
+		e.Attempts++
+		if err := w.queue.put(e); err != nil {
+			log.Errorf("Failed to update attempts for message %s: %s", e.MsgID, err)
+		}
+		log.Infof("Re-dispatching message %s (attempt %d)", e.MsgID, e.Attempts)
+		w.processor.OnMessage(msgContext)
+	}
+}
+
 func (w *webhooksDirect) run() error {
+	if w.queue != nil {
+		w.recoverWorkQueue()
+		defer w.queue.close()
+	}
 	w.initialized = true
 	return <-w.stopChan
 }
@@ -22,11 +22,16 @@ import (
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path"
 	"testing"
+	"time"
 
 	"github.com/julienschmidt/httprouter"
 	"github.com/kaleido-io/ethconnect/internal/eth"
+	"github.com/kaleido-io/ethconnect/internal/kvstore"
 	"github.com/kaleido-io/ethconnect/internal/messages"
+	"github.com/kaleido-io/ethconnect/internal/tracing"
 	"github.com/kaleido-io/ethconnect/internal/tx"
 
 	"github.com/stretchr/testify/assert"
@@ -36,12 +41,18 @@ type mockProcessor struct {
 	capturedCtx *msgContext
 }
 
-func (p *mockProcessor) ResolveAddress(from string) (string, error) { return "", nil }
+func (p *mockProcessor) ResolveAddress(ctx context.Context, from string) (string, error) {
+	return "", nil
+}
 func (p *mockProcessor) OnMessage(ctx tx.TxnContext) {
 	p.capturedCtx = ctx.(*msgContext)
 }
 func (p *mockProcessor) Init(eth.RPCClient) {}
 
+func (p *mockProcessor) SetEventABIResolver(resolver eth.EventABIResolver) {}
+func (p *mockProcessor) AddRoutes(router *httprouter.Router)               {}
+func (p *mockProcessor) ContractStats(address string) *tx.ContractStats    { return nil }
+
 func newTestWebhooksDirect(maxMsgs int) (*webhooksDirect, *memoryReceipts, *mockProcessor) {
 	rsc := &ReceiptStoreConf{}
 	r := newMemoryReceipts(rsc)
@@ -58,7 +69,7 @@ func newTestWebhooksDirect(maxMsgs int) (*webhooksDirect, *memoryReceipts, *mock
 func newTestWebhooksDirectServer(maxMsgs int) (*webhooksDirect, *httptest.Server, *memoryReceipts, *mockProcessor) {
 	wd, r, p := newTestWebhooksDirect(maxMsgs)
 	router := &httprouter.Router{}
-	wh := newWebhooks(wd, nil)
+	wh := newWebhooks(wd, nil, &CircuitBreakerConf{})
 	wh.addRoutes(router)
 	ts := httptest.NewServer(router)
 	return wd, ts, r, p
@@ -114,6 +125,26 @@ func TestWebhooksDirectSubmitSendTransaction(t *testing.T) {
 	assert.Equal("0xd912641Eb51a311A1C6BD32c1ED200C2a5abD7FE", reconstructed.From)
 }
 
+func TestWebhooksDirectCarriesTrace(t *testing.T) {
+	assert := assert.New(t)
+
+	wd, _, p := newTestWebhooksDirect(1)
+	router := &httprouter.Router{}
+	newWebhooks(wd, nil, &CircuitBreakerConf{}).addRoutes(router)
+	ts := httptest.NewServer(tracing.NewHTTPHandler(router))
+	defer ts.Close()
+
+	msg := newTestMsg()
+	msgBytes, _ := json.Marshal(&msg)
+	req, _ := http.NewRequest("POST", fmt.Sprintf("%s/hook", ts.URL), bytes.NewReader(msgBytes))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	resp, err := http.DefaultClient.Do(req)
+	assert.NoError(err)
+	assert.Equal(200, resp.StatusCode)
+	assert.Equal("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", tracing.TraceParent(p.capturedCtx.Context()))
+}
+
 func TestWebhooksDirectMsgLimit(t *testing.T) {
 	assert := assert.New(t)
 
@@ -172,3 +203,118 @@ func TestWebhooksDirectUnmarshalBadMsg(t *testing.T) {
 	err := ctx.Unmarshal(nil)
 	assert.EqualError(err, "json: unsupported type: map[bool]string")
 }
+
+func newTestWebhooksDirectWithQueue(dir string) (*webhooksDirect, *memoryReceipts, *mockProcessor) {
+	wd, r, p := newTestWebhooksDirect(10)
+	wd.conf.WorkQueue = WorkQueueConf{
+		LevelDB:    path.Join(dir, "workqueue"),
+		MaxRetries: 1,
+	}
+	return wd, r, p
+}
+
+func TestWebhooksDirectWorkQueueRecovery(t *testing.T) {
+	assert := assert.New(t)
+	dir, _ := ioutil.TempDir("", "workqueue")
+	defer os.RemoveAll(dir)
+
+	// Accept a message, then stop before it completes
+	wd, _, p := newTestWebhooksDirectWithQueue(dir)
+	err := wd.openWorkQueue()
+	assert.NoError(err)
+	msg := newTestMsg()
+	msgBytes, _ := json.Marshal(&msg)
+	var msgMap map[string]interface{}
+	json.Unmarshal(msgBytes, &msgMap)
+	msgMap["headers"].(map[string]interface{})["id"] = "msg1"
+	_, status, err := wd.sendWebhookMsg(context.Background(), "key1", "msg1", msgMap, false)
+	assert.NoError(err)
+	assert.Equal(200, status)
+	assert.Equal(1, p.capturedCtx.queued.Attempts)
+	wd.queue.close()
+
+	// On restart the message is dispatched again
+	wd, r, p := newTestWebhooksDirectWithQueue(dir)
+	err = wd.openWorkQueue()
+	assert.NoError(err)
+	go wd.run()
+	for !wd.isInitialized() {
+		time.Sleep(1 * time.Millisecond)
+	}
+	assert.NotNil(p.capturedCtx)
+	assert.Equal("msg1", p.capturedCtx.msgID)
+	assert.Equal("key1", p.capturedCtx.key)
+	assert.Equal("msg1", p.capturedCtx.Headers().ID)
+	assert.Equal(2, p.capturedCtx.queued.Attempts)
+	assert.Len(wd.inFlight, 1)
+
+	// Once the reply is stored, the message is removed from the queue
+	p.capturedCtx.SendErrorReply(500, fmt.Errorf("pop"))
+	receipt, _ := r.GetReceipt("msg1")
+	assert.NotNil(receipt)
+	assert.Empty(wd.queue.pending())
+	assert.Empty(wd.inFlight)
+	wd.stopChan <- nil
+}
+
+func TestWebhooksDirectWorkQueueRetriesExceeded(t *testing.T) {
+	assert := assert.New(t)
+	dir, _ := ioutil.TempDir("", "workqueue")
+	defer os.RemoveAll(dir)
+
+	wd, r, p := newTestWebhooksDirectWithQueue(dir)
+	err := wd.openWorkQueue()
+	assert.NoError(err)
+	defer wd.queue.close()
+	msg := newTestMsg()
+	msgBytes, _ := json.Marshal(&msg)
+	var msgMap map[string]interface{}
+	json.Unmarshal(msgBytes, &msgMap)
+	msgMap["headers"].(map[string]interface{})["id"] = "msg1"
+	err = wd.queue.put(&workQueueEntry{
+		MsgID:    "msg1",
+		Received: time.Now().UTC(),
+		Attempts: 2,
+		Msg:      msgMap,
+	})
+	assert.NoError(err)
+	wd.queue.store.Put("wq/bad", []byte("!json"))
+
+	wd.recoverWorkQueue()
+	assert.Nil(p.capturedCtx)
+	receipt, _ := r.GetReceipt("msg1")
+	assert.NotNil(receipt)
+	assert.Equal("Message did not complete after 2 dispatch attempts", (*receipt)["errorMessage"])
+	assert.Empty(wd.queue.pending())
+	assert.Empty(wd.inFlight)
+}
+
+func TestWebhooksDirectWorkQueuePersistFail(t *testing.T) {
+	assert := assert.New(t)
+	wd, _, p := newTestWebhooksDirect(1)
+	wd.queue = &workQueue{
+		conf:  &wd.conf.WorkQueue,
+		store: kvstore.NewMockKV(fmt.Errorf("pop")),
+	}
+	msgMap := map[string]interface{}{
+		"headers": map[string]interface{}{"type": "SendTransaction"},
+	}
+	_, statusCode, err := wd.sendWebhookMsg(context.Background(), "", "msg1", msgMap, false)
+	assert.Equal(500, statusCode)
+	assert.EqualError(err, "Failed to persist message to work queue: pop")
+	assert.Nil(p.capturedCtx)
+	assert.Empty(wd.inFlight)
+}
+
+func TestWebhooksDirectWorkQueueOpenFail(t *testing.T) {
+	assert := assert.New(t)
+	dir, _ := ioutil.TempDir("", "workqueue")
+	defer os.RemoveAll(dir)
+	badPath := path.Join(dir, "file")
+	ioutil.WriteFile(badPath, []byte{}, 0644)
+
+	wd, _, _ := newTestWebhooksDirect(1)
+	wd.conf.WorkQueue.LevelDB = badPath
+	err := wd.openWorkQueue()
+	assert.Regexp("Failed to open work queue", err)
+}
@@ -0,0 +1,111 @@
+// Copyright 2021 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rest
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/kaleido-io/ethconnect/internal/errors"
+	"github.com/kaleido-io/ethconnect/internal/kvstore"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	workQueuePrefix         = "wq/"
+	workQueuePrefixEnd      = "wq0"
+	defaultWorkQueueRetries = 5
+)
+
+// WorkQueueConf configures persistence of the messages dispatched by the
+// webhooks direct to RPC bridge, so they survive a restart
+type WorkQueueConf struct {
+	LevelDB    string `json:"leveldb"`
+	MaxRetries int    `json:"maxRetries"`
+}
+
+// workQueueEntry is the persisted form of an accepted message, held until
+// the reply has been written to the receipt store
+type workQueueEntry struct {
+	Key      string                 `json:"key"`
+	MsgID    string                 `json:"msgId"`
+	Received time.Time              `json:"received"`
+	Attempts int                    `json:"attempts"`
+	Msg      map[string]interface{} `json:"msg"`
+}
+
+// workQueue is a LevelDB backed queue, ordered by the time messages were received
+type workQueue struct {
+	conf  *WorkQueueConf
+	store kvstore.KVStore
+}
+
+func newWorkQueue(conf *WorkQueueConf) (*workQueue, error) {
+	store, err := kvstore.NewKeyValueStore(conf.LevelDB)
+	if err != nil {
+		return nil, errors.Errorf(errors.WebhooksDirectWorkQueueOpen, err)
+	}
+	kvstore.SetKeyPrefixes(store, map[string]string{
+		"workQueue": workQueuePrefix,
+	})
+	return &workQueue{
+		conf:  conf,
+		store: store,
+	}, nil
+}
+
+func (q *workQueue) entryKey(e *workQueueEntry) string {
+	return fmt.Sprintf("%s%020d/%s", workQueuePrefix, e.Received.UnixNano(), e.MsgID)
+}
+
+// put writes the entry, which must complete before the message is acknowledged
+// for the at-least-once guarantee
+func (q *workQueue) put(e *workQueueEntry) error {
+	b, _ := json.Marshal(e)
+	if err := q.store.Put(q.entryKey(e), b); err != nil {
+		return errors.Errorf(errors.WebhooksDirectWorkQueuePersist, err)
+	}
+	return nil
+}
+
+// remove is called once the reply is in the receipt store. Failure means
+// a redelivery after restart, so is logged rather than returned
+func (q *workQueue) remove(e *workQueueEntry) {
+	if err := q.store.Delete(q.entryKey(e)); err != nil {
+		log.Errorf("Failed to remove message %s from work queue: %s", e.MsgID, err)
+	}
+}
+
+// pending returns all the entries left in the queue, in the order received
+func (q *workQueue) pending() []*workQueueEntry {
+	entries := make([]*workQueueEntry, 0)
+	it := q.store.NewIteratorWithRange(&kvstore.KVRange{Start: workQueuePrefix, Limit: workQueuePrefixEnd})
+	defer it.Release()
+	for it.Next() {
+		var e workQueueEntry
+		if err := json.Unmarshal(it.Value(), &e); err != nil {
+			log.Errorf("Discarding unparsable work queue entry %s: %s", it.Key(), err)
+			q.store.Delete(it.Key())
+			continue
+		}
+		entries = append(entries, &e)
+	}
+	return entries
+}
+
+func (q *workQueue) close() {
+	q.store.Close()
+}
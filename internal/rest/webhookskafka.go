@@ -25,6 +25,8 @@ import (
 	"github.com/kaleido-io/ethconnect/internal/errors"
 	"github.com/kaleido-io/ethconnect/internal/kafka"
 	"github.com/kaleido-io/ethconnect/internal/messages"
+	"github.com/kaleido-io/ethconnect/internal/tracing"
+	"github.com/kaleido-io/ethconnect/internal/utils"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -143,7 +145,7 @@ func (w *webhooksKafka) sendWebhookMsg(ctx context.Context, key, msgID string, m
 		w.setMsgPending(msgID)
 	}
 
-	log.Debugf("Message payload: %s", payloadToForward)
+	log.Debugf("Message payload: %s", utils.RedactJSON(payloadToForward))
 	sentMsg := &sarama.ProducerMessage{
 		Topic:    w.kafka.Conf().TopicOut,
 		Key:      sarama.StringEncoder(key),
@@ -159,6 +161,13 @@ func (w *webhooksKafka) sendWebhookMsg(ctx context.Context, key, msgID string, m
 			},
 		}
 	}
+	// The trace of the request continues in the bridge that processes the message
+	if traceParent := tracing.TraceParent(ctx); traceParent != "" {
+		sentMsg.Headers = append(sentMsg.Headers, sarama.RecordHeader{
+			Key:   []byte(messages.RecordHeaderTraceParent),
+			Value: []byte(traceParent),
+		})
+	}
 	w.kafka.Producer().Input() <- sentMsg
 
 	msgAck := ""
@@ -107,7 +107,7 @@ func newTestWebhooks() (*webhooks, *webhooksKafka, *testKafkaCommon, *httptest.S
 	k := newTestKafkaComon()
 	wk := newWebhooksKafkaBase(r)
 	wk.kafka = k
-	w := newWebhooks(wk, nil)
+	w := newWebhooks(wk, nil, &CircuitBreakerConf{})
 	router := &httprouter.Router{}
 	w.addRoutes(router)
 	ts := httptest.NewUnstartedServer(router)
@@ -444,6 +444,28 @@ func TestWebhookHandlerYAMLMissingTo(t *testing.T) {
 	assert.Equal(0, len(replyMsgs))
 }
 
+func TestWebhookHandlerYAMLSponsoredWithoutFrom(t *testing.T) {
+
+	assert := assert.New(t)
+
+	msg := "" +
+		"headers:\n" +
+		"  type: SendTransaction\n" +
+		"  sponsor: gas1\n" +
+		"to: '0x4b098809E68C88e26442491c57866b7D4852216c'\n" +
+		"method:\n" +
+		"  name: set\n" +
+		"\n"
+
+	resp, replyMsgs := sendTestTransaction(assert, []byte(msg), "application/x-yaml", nil, true)
+	assertSentResp(assert, resp, true)
+	assert.Equal(1, len(replyMsgs))
+
+	forwardedMessage := messages.SendTransaction{}
+	json.Unmarshal(replyMsgs[0], &forwardedMessage)
+	assert.Equal("gas1", forwardedMessage.Headers.Sponsor)
+}
+
 func TestWebhookHandlerBadYAML(t *testing.T) {
 
 	assert := assert.New(t)
@@ -0,0 +1,260 @@
+// Copyright 2021 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tracing
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/kaleido-io/ethconnect/internal/errors"
+	"github.com/kaleido-io/ethconnect/internal/utils"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	defaultBatchSize       = 512
+	defaultQueueSize       = 2048
+	defaultFlushIntervalMS = 5000
+	exportTimeout          = 30 * time.Second
+	otlpStatusCodeError    = 2
+)
+
+// exporter sends ended spans in batches to the OTLP/HTTP traces endpoint of a collector
+type exporter struct {
+	conf        *Conf
+	serviceName string
+	client      *http.Client
+	queue       chan *Span
+	stop        chan struct{}
+	done        chan struct{}
+}
+
+func newExporter(conf *Conf, serviceName string) *exporter {
+	if conf.BatchSize <= 0 {
+		conf.BatchSize = defaultBatchSize
+	}
+	if conf.QueueSize <= 0 {
+		conf.QueueSize = defaultQueueSize
+	}
+	if conf.FlushIntervalMS <= 0 {
+		conf.FlushIntervalMS = defaultFlushIntervalMS
+	}
+	return &exporter{
+		conf:        conf,
+		serviceName: serviceName,
+		client: &http.Client{
+			Timeout:   exportTimeout,
+			Transport: utils.EgressTransport(nil),
+		},
+		queue: make(chan *Span, conf.QueueSize),
+		stop:  make(chan struct{}),
+		done:  make(chan struct{}),
+	}
+}
+
+func (e *exporter) start() {
+	go e.exportLoop()
+}
+
+// close stops the exporter, after sending the spans that are queued
+func (e *exporter) close() {
+	close(e.stop)
+	<-e.done
+}
+
+// add queues an ended span for export. It never blocks
+func (e *exporter) add(s *Span) {
+	select {
+	case e.queue <- s:
+	default:
+		log.Warnf("Tracing queue full (%d spans). Dropped span '%s'", e.conf.QueueSize, s.name)
+	}
+}
+
+func (e *exporter) exportLoop() {
+	defer close(e.done)
+	ticker := time.NewTicker(time.Duration(e.conf.FlushIntervalMS) * time.Millisecond)
+	defer ticker.Stop()
+	batch := make([]*Span, 0, e.conf.BatchSize)
+	for {
+		select {
+		case s := <-e.queue:
+			if batch = append(batch, s); len(batch) >= e.conf.BatchSize {
+				e.export(batch)
+				batch = batch[:0]
+			}
+		case <-ticker.C:
+			if len(batch) > 0 {
+				e.export(batch)
+				batch = batch[:0]
+			}
+		case <-e.stop:
+			for len(e.queue) > 0 {
+				batch = append(batch, <-e.queue)
+			}
+			if len(batch) > 0 {
+				e.export(batch)
+			}
+			return
+		}
+	}
+}
+
+// export sends a batch of spans. Failures are logged, and the spans discarded, as tracing
+// must never hold up the processing of transactions
+func (e *exporter) export(batch []*Span) {
+	body, _ := json.Marshal(e.otlpRequest(batch))
+	err := e.post(body)
+	if err != nil {
+		log.Errorf("%s", errors.Errorf(errors.TracingExportFailed, len(batch), err))
+		return
+	}
+	log.Debugf("Exported %d spans to %s", len(batch), e.conf.Endpoint)
+}
+
+func (e *exporter) post(body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, e.conf.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for h, v := range e.conf.Headers {
+		req.Header.Set(h, v)
+	}
+	res, err := e.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		resBody, _ := ioutil.ReadAll(res.Body)
+		return fmt.Errorf("[%d] %s", res.StatusCode, resBody)
+	}
+	return nil
+}
+
+type otlpAnyValue struct {
+	StringValue *string  `json:"stringValue,omitempty"`
+	BoolValue   *bool    `json:"boolValue,omitempty"`
+	IntValue    *string  `json:"intValue,omitempty"`
+	DoubleValue *float64 `json:"doubleValue,omitempty"`
+}
+
+type otlpKeyValue struct {
+	Key   string       `json:"key"`
+	Value otlpAnyValue `json:"value"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpSpan struct {
+	TraceID           string         `json:"traceId"`
+	SpanID            string         `json:"spanId"`
+	ParentSpanID      string         `json:"parentSpanId,omitempty"`
+	Name              string         `json:"name"`
+	Kind              SpanKind       `json:"kind"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+	Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+	Status            otlpStatus     `json:"status"`
+}
+
+type otlpScopeSpans struct {
+	Scope struct {
+		Name string `json:"name"`
+	} `json:"scope"`
+	Spans []*otlpSpan `json:"spans"`
+}
+
+type otlpResourceSpans struct {
+	Resource struct {
+		Attributes []otlpKeyValue `json:"attributes"`
+	} `json:"resource"`
+	ScopeSpans []*otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpTraceRequest struct {
+	ResourceSpans []*otlpResourceSpans `json:"resourceSpans"`
+}
+
+func (e *exporter) otlpRequest(batch []*Span) *otlpTraceRequest {
+	scopeSpans := &otlpScopeSpans{Spans: make([]*otlpSpan, len(batch))}
+	scopeSpans.Scope.Name = defaultServiceName
+	for i, s := range batch {
+		scopeSpans.Spans[i] = s.otlpSpan()
+	}
+	resourceSpans := &otlpResourceSpans{ScopeSpans: []*otlpScopeSpans{scopeSpans}}
+	resourceSpans.Resource.Attributes = []otlpKeyValue{otlpAttribute("service.name", e.serviceName)}
+	return &otlpTraceRequest{ResourceSpans: []*otlpResourceSpans{resourceSpans}}
+}
+
+func (s *Span) otlpSpan() *otlpSpan {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	o := &otlpSpan{
+		TraceID:           hex.EncodeToString(s.sc.TraceID[:]),
+		SpanID:            hex.EncodeToString(s.sc.SpanID[:]),
+		Name:              s.name,
+		Kind:              s.kind,
+		StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+		EndTimeUnixNano:   strconv.FormatInt(s.end.UnixNano(), 10),
+		Attributes:        make([]otlpKeyValue, len(s.attributes)),
+	}
+	if s.parentID != [8]byte{} {
+		o.ParentSpanID = hex.EncodeToString(s.parentID[:])
+	}
+	for i, a := range s.attributes {
+		o.Attributes[i] = otlpAttribute(a.key, a.value)
+	}
+	if s.errMsg != "" {
+		o.Status = otlpStatus{Code: otlpStatusCodeError, Message: s.errMsg}
+	}
+	return o
+}
+
+// otlpAttribute encodes an attribute with the OTLP JSON mapping, where 64 bit integers are strings
+func otlpAttribute(key string, value interface{}) otlpKeyValue {
+	kv := otlpKeyValue{Key: key}
+	switch v := value.(type) {
+	case bool:
+		kv.Value.BoolValue = &v
+	case int:
+		i := strconv.FormatInt(int64(v), 10)
+		kv.Value.IntValue = &i
+	case int64:
+		i := strconv.FormatInt(v, 10)
+		kv.Value.IntValue = &i
+	case uint64:
+		i := strconv.FormatUint(v, 10)
+		kv.Value.IntValue = &i
+	case float64:
+		kv.Value.DoubleValue = &v
+	case string:
+		kv.Value.StringValue = &v
+	default:
+		str := fmt.Sprintf("%v", v)
+		kv.Value.StringValue = &str
+	}
+	return kv
+}
@@ -0,0 +1,133 @@
+// Copyright 2021 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tracing
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestCollector(t *testing.T, status int) (*httptest.Server, chan map[string]interface{}) {
+	requests := make(chan map[string]interface{}, 10)
+	svr := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		assert.Equal(t, "application/json", req.Header.Get("Content-Type"))
+		assert.Equal(t, "secret", req.Header.Get("x-api-key"))
+		body, _ := ioutil.ReadAll(req.Body)
+		var otlpReq map[string]interface{}
+		assert.NoError(t, json.Unmarshal(body, &otlpReq))
+		requests <- otlpReq
+		res.WriteHeader(status)
+	}))
+	return svr, requests
+}
+
+func exportedSpans(otlpReq map[string]interface{}) []interface{} {
+	resourceSpans := otlpReq["resourceSpans"].([]interface{})[0].(map[string]interface{})
+	return resourceSpans["scopeSpans"].([]interface{})[0].(map[string]interface{})["spans"].([]interface{})
+}
+
+func TestExportSpansOTLP(t *testing.T) {
+	assert := assert.New(t)
+	svr, requests := newTestCollector(t, 200)
+	defer svr.Close()
+
+	assert.NoError(Configure(&Conf{
+		Enabled:     true,
+		ServiceName: "gateway1",
+		Endpoint:    svr.URL + "/v1/traces",
+		Headers:     map[string]string{"x-api-key": "secret"},
+		BatchSize:   2,
+	}))
+	defer Configure(nil)
+
+	ctx, parent := Start(Extract(context.Background(), testTraceParent), "parent", SpanKindServer)
+	_, child := Start(ctx, "child", SpanKindClient)
+	child.SetAttribute("str", "value")
+	child.SetAttribute("bool", true)
+	child.SetAttribute("int", 42)
+	child.SetAttribute("int64", int64(43))
+	child.SetAttribute("uint64", uint64(44))
+	child.SetAttribute("float", 1.5)
+	child.SetAttribute("other", []string{"a"})
+	child.End(fmt.Errorf("pop"))
+	parent.End(nil)
+
+	otlpReq := <-requests
+	resource := otlpReq["resourceSpans"].([]interface{})[0].(map[string]interface{})["resource"]
+	assert.Equal(map[string]interface{}{
+		"attributes": []interface{}{
+			map[string]interface{}{"key": "service.name", "value": map[string]interface{}{"stringValue": "gateway1"}},
+		},
+	}, resource)
+
+	spans := exportedSpans(otlpReq)
+	assert.Len(spans, 2)
+	exportedChild := spans[0].(map[string]interface{})
+	assert.Equal("child", exportedChild["name"])
+	assert.Equal(float64(SpanKindClient), exportedChild["kind"])
+	assert.Equal("4bf92f3577b34da6a3ce929d0e0e4736", exportedChild["traceId"])
+	assert.Equal(fmt.Sprintf("%x", parent.Context().SpanID), exportedChild["parentSpanId"])
+	assert.Equal(map[string]interface{}{"code": float64(2), "message": "pop"}, exportedChild["status"])
+	assert.Equal([]interface{}{
+		map[string]interface{}{"key": "str", "value": map[string]interface{}{"stringValue": "value"}},
+		map[string]interface{}{"key": "bool", "value": map[string]interface{}{"boolValue": true}},
+		map[string]interface{}{"key": "int", "value": map[string]interface{}{"intValue": "42"}},
+		map[string]interface{}{"key": "int64", "value": map[string]interface{}{"intValue": "43"}},
+		map[string]interface{}{"key": "uint64", "value": map[string]interface{}{"intValue": "44"}},
+		map[string]interface{}{"key": "float", "value": map[string]interface{}{"doubleValue": 1.5}},
+		map[string]interface{}{"key": "other", "value": map[string]interface{}{"stringValue": "[a]"}},
+	}, exportedChild["attributes"])
+	assert.Regexp("^[0-9]+$", exportedChild["startTimeUnixNano"])
+
+	exportedParent := spans[1].(map[string]interface{})
+	assert.Equal("00f067aa0ba902b7", exportedParent["parentSpanId"])
+	assert.Equal(map[string]interface{}{}, exportedParent["status"])
+}
+
+func TestExportFlushOnClose(t *testing.T) {
+	assert := assert.New(t)
+	svr, requests := newTestCollector(t, 500)
+	defer svr.Close()
+
+	assert.NoError(Configure(&Conf{
+		Enabled:         true,
+		Endpoint:        svr.URL,
+		Headers:         map[string]string{"x-api-key": "secret"},
+		FlushIntervalMS: 60000,
+	}))
+	_, span := Start(context.Background(), "span", SpanKindInternal)
+	span.End(nil)
+
+	// The queued span is exported when the tracer is replaced, and the failure logged
+	assert.NoError(Configure(nil))
+	assert.Len(exportedSpans(<-requests), 1)
+}
+
+func TestExportQueueFull(t *testing.T) {
+	e := newExporter(&Conf{QueueSize: 1, Endpoint: "http://localhost:0"}, "test")
+	e.add(&Span{name: "span1"})
+	e.add(&Span{name: "span2"})
+	assert.Len(t, e.queue, 1)
+	assert.Regexp(t, "connect", e.post([]byte("{}")))
+	e.conf.Endpoint = "!bad://"
+	assert.Error(t, e.post([]byte("{}")))
+}
@@ -0,0 +1,62 @@
+// Copyright 2021 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tracing
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// statusRecorder captures the status code written by a handler
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// NewHTTPHandler wraps a handler with a server span for each request, that continues the
+// trace of the traceparent header of the caller. The span is named by the method and the
+// first segment of the path, to bound the number of span names. WebSocket upgrades are not
+// traced, as the connection outlives the request
+func NewHTTPHandler(parent http.Handler) http.Handler {
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		ctx := Extract(req.Context(), req.Header.Get(TraceParentHeader))
+		if !Enabled() || req.Header.Get("Upgrade") != "" {
+			parent.ServeHTTP(res, req.WithContext(ctx))
+			return
+		}
+		ctx, span := Start(ctx, req.Method+" "+routeName(req.URL.Path), SpanKindServer)
+		span.SetAttribute("http.method", req.Method)
+		span.SetAttribute("http.target", req.URL.Path)
+		rec := &statusRecorder{ResponseWriter: res, status: 200}
+		parent.ServeHTTP(rec, req.WithContext(ctx))
+		span.SetAttribute("http.status_code", rec.status)
+		var err error
+		if rec.status >= 500 {
+			err = fmt.Errorf("HTTP status %d", rec.status)
+		}
+		span.End(err)
+	})
+}
+
+func routeName(path string) string {
+	segments := strings.SplitN(strings.TrimPrefix(path, "/"), "/", 2)
+	return "/" + segments[0]
+}
@@ -0,0 +1,67 @@
+// Copyright 2021 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tracing
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHTTPHandlerServerSpan(t *testing.T) {
+	assert := assert.New(t)
+	assert.NoError(Configure(&Conf{Enabled: true, Endpoint: "http://localhost:4318/v1/traces"}))
+	defer Configure(nil)
+
+	var span *Span
+	handler := NewHTTPHandler(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		span = SpanFromContext(req.Context())
+		res.WriteHeader(503)
+	}))
+	req := httptest.NewRequest("POST", "/contracts/0x123/set", nil)
+	req.Header.Set(TraceParentHeader, testTraceParent)
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	assert.NotNil(span)
+	assert.Equal("POST /contracts", span.name)
+	assert.Equal(SpanKindServer, span.kind)
+	assert.Equal("00f067aa0ba902b7", fmt.Sprintf("%x", span.parentID))
+	assert.Equal("HTTP status 503", span.errMsg)
+	assert.True(span.ended)
+	assert.Equal([]attribute{
+		{key: "http.method", value: "POST"},
+		{key: "http.target", value: "/contracts/0x123/set"},
+		{key: "http.status_code", value: 503},
+	}, span.attributes)
+}
+
+func TestHTTPHandlerUntraced(t *testing.T) {
+	assert := assert.New(t)
+	assert.NoError(Configure(nil))
+
+	var traceParent string
+	handler := NewHTTPHandler(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		traceParent = TraceParent(req.Context())
+		assert.Nil(SpanFromContext(req.Context()))
+	}))
+	req := httptest.NewRequest("GET", "/ws", nil)
+	req.Header.Set(TraceParentHeader, testTraceParent)
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	assert.Equal(testTraceParent, traceParent)
+	assert.Equal("/", routeName("/"))
+}
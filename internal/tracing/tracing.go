@@ -0,0 +1,342 @@
+// Copyright 2021 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tracing
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kaleido-io/ethconnect/internal/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// TraceParentHeader is the W3C trace context header, propagated on HTTP requests and Kafka messages
+	TraceParentHeader = "traceparent"
+
+	defaultServiceName = "ethconnect"
+)
+
+// SpanKind is the OpenTelemetry kind of a span
+type SpanKind int
+
+const (
+	// SpanKindInternal is an operation within the process
+	SpanKindInternal SpanKind = 1
+	// SpanKindServer is the handling of an inbound request
+	SpanKindServer SpanKind = 2
+	// SpanKindClient is an outbound request, such as a JSON/RPC call to the node
+	SpanKindClient SpanKind = 3
+	// SpanKindProducer is the sending of a message
+	SpanKindProducer SpanKind = 4
+	// SpanKindConsumer is the processing of a received message
+	SpanKindConsumer SpanKind = 5
+)
+
+// Conf configures the export of spans to an OpenTelemetry collector, over OTLP/HTTP with
+// the JSON encoding. The trace context of inbound requests is propagated whether or not
+// spans are exported
+type Conf struct {
+	Enabled     bool              `json:"enabled"`
+	ServiceName string            `json:"serviceName,omitempty"`
+	Endpoint    string            `json:"endpoint"`
+	Headers     map[string]string `json:"headers,omitempty"`
+	// SampleRatio is the ratio of new traces that are sampled, defaulting to all traces.
+	// Traces started by a caller follow the sampling decision of the caller
+	SampleRatio     *float64 `json:"sampleRatio,omitempty"`
+	BatchSize       int      `json:"batchSize,omitempty"`
+	QueueSize       int      `json:"queueSize,omitempty"`
+	FlushIntervalMS int      `json:"flushInterval,omitempty"`
+}
+
+// SpanContext identifies a span within a trace, as carried by a traceparent header
+type SpanContext struct {
+	TraceID [16]byte
+	SpanID  [8]byte
+	Sampled bool
+}
+
+// IsValid is true if the trace and span IDs are set
+func (sc SpanContext) IsValid() bool {
+	return sc.TraceID != [16]byte{} && sc.SpanID != [8]byte{}
+}
+
+// TraceParent formats the span context as a W3C traceparent header
+func (sc SpanContext) TraceParent() string {
+	flags := "00"
+	if sc.Sampled {
+		flags = "01"
+	}
+	return fmt.Sprintf("00-%s-%s-%s", hex.EncodeToString(sc.TraceID[:]), hex.EncodeToString(sc.SpanID[:]), flags)
+}
+
+// ParseTraceParent parses a W3C traceparent header, returning false if it is not valid
+func ParseTraceParent(traceParent string) (sc SpanContext, ok bool) {
+	parts := strings.Split(strings.TrimSpace(traceParent), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return sc, false
+	}
+	// Version 00 has exactly four fields, while later versions may add more
+	if parts[0] == "00" && len(parts) != 4 {
+		return sc, false
+	}
+	if _, err := hex.Decode(sc.TraceID[:], []byte(parts[1])); err != nil {
+		return sc, false
+	}
+	if _, err := hex.Decode(sc.SpanID[:], []byte(parts[2])); err != nil {
+		return sc, false
+	}
+	flags, err := hex.DecodeString(parts[3])
+	if err != nil {
+		return sc, false
+	}
+	sc.Sampled = flags[0]&0x01 != 0
+	return sc, sc.IsValid()
+}
+
+type attribute struct {
+	key   string
+	value interface{}
+}
+
+// Span is a timed operation within a trace. All methods can be called on a nil span,
+// which is returned when tracing is disabled
+type Span struct {
+	tracer     *tracer
+	name       string
+	kind       SpanKind
+	sc         SpanContext
+	parentID   [8]byte
+	start      time.Time
+	end        time.Time
+	mux        sync.Mutex
+	attributes []attribute
+	errMsg     string
+	ended      bool
+}
+
+// Context is the span context of the span, or an empty context for a nil span
+func (s *Span) Context() SpanContext {
+	if s == nil {
+		return SpanContext{}
+	}
+	return s.sc
+}
+
+// SetAttribute records a string, bool, integer or float attribute on the span
+func (s *Span) SetAttribute(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	for i, a := range s.attributes {
+		if a.key == key {
+			s.attributes[i].value = value
+			return
+		}
+	}
+	s.attributes = append(s.attributes, attribute{key: key, value: value})
+}
+
+// SetError marks the span as failed
+func (s *Span) SetError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.mux.Lock()
+	s.errMsg = err.Error()
+	s.mux.Unlock()
+}
+
+// End completes the span, marking it as failed if an error is supplied. Only the
+// first call has any effect
+func (s *Span) End(err error) {
+	if s == nil {
+		return
+	}
+	s.SetError(err)
+	s.mux.Lock()
+	if s.ended {
+		s.mux.Unlock()
+		return
+	}
+	s.ended = true
+	s.end = time.Now()
+	s.mux.Unlock()
+	if s.sc.Sampled {
+		s.tracer.exporter.add(s)
+	}
+}
+
+type tracer struct {
+	serviceName string
+	sampleRatio float64
+	exporter    *exporter
+}
+
+var tracing struct {
+	mux    sync.RWMutex
+	tracer *tracer
+}
+
+// Configure sets the tracer of the process. A nil or disabled configuration stops the export
+// of spans, after flushing any spans that have ended
+func Configure(conf *Conf) error {
+	var t *tracer
+	if conf != nil && conf.Enabled {
+		u, err := url.Parse(conf.Endpoint)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return errors.Errorf(errors.TracingInvalidEndpoint, conf.Endpoint)
+		}
+		t = &tracer{
+			serviceName: conf.ServiceName,
+			sampleRatio: 1,
+		}
+		if t.serviceName == "" {
+			t.serviceName = defaultServiceName
+		}
+		if conf.SampleRatio != nil {
+			if *conf.SampleRatio < 0 || *conf.SampleRatio > 1 {
+				return errors.Errorf(errors.TracingInvalidSampleRatio, *conf.SampleRatio)
+			}
+			t.sampleRatio = *conf.SampleRatio
+		}
+		t.exporter = newExporter(conf, t.serviceName)
+		t.exporter.start()
+		log.Infof("Tracing enabled: service=%s endpoint=%s sampleRatio=%v", t.serviceName, conf.Endpoint, t.sampleRatio)
+	}
+	tracing.mux.Lock()
+	previous := tracing.tracer
+	tracing.tracer = t
+	tracing.mux.Unlock()
+	if previous != nil {
+		previous.exporter.close()
+	}
+	return nil
+}
+
+func currentTracer() *tracer {
+	tracing.mux.RLock()
+	defer tracing.mux.RUnlock()
+	return tracing.tracer
+}
+
+// Enabled is true if spans are being exported
+func Enabled() bool {
+	return currentTracer() != nil
+}
+
+type spanContextKey struct{}
+type remoteParentContextKey struct{}
+
+// SpanFromContext returns the active span of the context, or nil
+func SpanFromContext(ctx context.Context) *Span {
+	if ctx == nil {
+		return nil
+	}
+	s, _ := ctx.Value(spanContextKey{}).(*Span)
+	return s
+}
+
+// parentFromContext returns the span context of the active span, or of the remote caller
+func parentFromContext(ctx context.Context) (SpanContext, bool) {
+	if s := SpanFromContext(ctx); s != nil {
+		return s.sc, true
+	}
+	if ctx != nil {
+		if sc, ok := ctx.Value(remoteParentContextKey{}).(SpanContext); ok {
+			return sc, true
+		}
+	}
+	return SpanContext{}, false
+}
+
+// Extract adds the trace context of a traceparent header to the context, as the parent of
+// the spans started from it. An invalid header is ignored, starting a new trace
+func Extract(ctx context.Context, traceParent string) context.Context {
+	if traceParent == "" {
+		return ctx
+	}
+	sc, ok := ParseTraceParent(traceParent)
+	if !ok {
+		log.Debugf("Ignoring invalid traceparent '%s'", traceParent)
+		return ctx
+	}
+	return context.WithValue(ctx, remoteParentContextKey{}, sc)
+}
+
+// TraceParent is the traceparent header to propagate the trace of the context, or an empty
+// string if the context is not part of a trace
+func TraceParent(ctx context.Context) string {
+	if sc, ok := parentFromContext(ctx); ok {
+		return sc.TraceParent()
+	}
+	return ""
+}
+
+// Inject sets the traceparent header of an outbound HTTP request
+func Inject(ctx context.Context, header http.Header) {
+	if traceParent := TraceParent(ctx); traceParent != "" {
+		header.Set(TraceParentHeader, traceParent)
+	}
+}
+
+// Start begins a span that is a child of the active span of the context, or of the remote
+// caller, returning a context with the new span active. When tracing is disabled the context
+// is returned unchanged, with a nil span
+func Start(ctx context.Context, name string, kind SpanKind) (context.Context, *Span) {
+	t := currentTracer()
+	if t == nil {
+		return ctx, nil
+	}
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	s := &Span{
+		tracer: t,
+		name:   name,
+		kind:   kind,
+		start:  time.Now(),
+	}
+	if parent, ok := parentFromContext(ctx); ok {
+		s.sc.TraceID = parent.TraceID
+		s.sc.Sampled = parent.Sampled
+		s.parentID = parent.SpanID
+	} else {
+		rand.Read(s.sc.TraceID[:])
+		s.sc.Sampled = t.sample(s.sc.TraceID)
+	}
+	rand.Read(s.sc.SpanID[:])
+	return context.WithValue(ctx, spanContextKey{}, s), s
+}
+
+// sample makes the sampling decision of a new trace from its ID, so the same trace is
+// sampled consistently by any process with the same ratio
+func (t *tracer) sample(traceID [16]byte) bool {
+	if t.sampleRatio >= 1 {
+		return true
+	}
+	bound := uint64(t.sampleRatio * (1 << 63))
+	return binary.BigEndian.Uint64(traceID[8:])>>1 < bound
+}
@@ -0,0 +1,145 @@
+// Copyright 2021 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testTraceParent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+
+func TestParseTraceParent(t *testing.T) {
+	assert := assert.New(t)
+
+	sc, ok := ParseTraceParent(testTraceParent)
+	assert.True(ok)
+	assert.True(sc.Sampled)
+	assert.Equal(testTraceParent, sc.TraceParent())
+
+	sc, ok = ParseTraceParent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00")
+	assert.True(ok)
+	assert.False(sc.Sampled)
+
+	// Later versions can add fields
+	_, ok = ParseTraceParent("01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra")
+	assert.True(ok)
+
+	for _, bad := range []string{
+		"",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra",
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01",
+		"00-zzf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-zzf067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-zz",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7",
+	} {
+		_, ok = ParseTraceParent(bad)
+		assert.False(ok, bad)
+	}
+}
+
+func TestTracingDisabledPropagates(t *testing.T) {
+	assert := assert.New(t)
+	assert.NoError(Configure(nil))
+	assert.False(Enabled())
+
+	ctx, span := Start(context.Background(), "test", SpanKindInternal)
+	assert.Nil(span)
+	span.SetAttribute("key", "value")
+	span.End(fmt.Errorf("pop"))
+	assert.False(span.Context().IsValid())
+	assert.Equal("", TraceParent(ctx))
+
+	// The trace of the caller is still passed on
+	ctx = Extract(context.Background(), testTraceParent)
+	assert.Equal(testTraceParent, TraceParent(ctx))
+	header := http.Header{}
+	Inject(ctx, header)
+	assert.Equal(testTraceParent, header.Get(TraceParentHeader))
+
+	assert.Equal(context.Background(), Extract(context.Background(), "bad"))
+	assert.Equal(context.Background(), Extract(context.Background(), ""))
+	Inject(context.Background(), header)
+}
+
+func TestConfigureBadConf(t *testing.T) {
+	assert := assert.New(t)
+	err := Configure(&Conf{Enabled: true, Endpoint: "not a url"})
+	assert.EqualError(err, "Invalid tracing endpoint 'not a url'")
+	ratio := 1.5
+	err = Configure(&Conf{Enabled: true, Endpoint: "http://localhost:4318/v1/traces", SampleRatio: &ratio})
+	assert.EqualError(err, "Invalid tracing sample ratio 1.5. Must be between 0 and 1")
+	assert.False(Enabled())
+}
+
+func TestStartChildSpans(t *testing.T) {
+	assert := assert.New(t)
+	assert.NoError(Configure(&Conf{Enabled: true, Endpoint: "http://localhost:4318/v1/traces"}))
+	defer Configure(nil)
+
+	ctx := Extract(context.Background(), testTraceParent)
+	ctx, parent := Start(ctx, "parent", SpanKindServer)
+	assert.NotNil(parent)
+	assert.Equal(parent, SpanFromContext(ctx))
+	assert.Equal("4bf92f3577b34da6a3ce929d0e0e4736", fmt.Sprintf("%x", parent.Context().TraceID))
+	assert.Equal("00f067aa0ba902b7", fmt.Sprintf("%x", parent.parentID))
+	assert.True(parent.Context().Sampled)
+
+	_, child := Start(ctx, "child", SpanKindClient)
+	assert.Equal(parent.Context().TraceID, child.Context().TraceID)
+	assert.Equal(parent.Context().SpanID, child.parentID)
+	assert.NotEqual(parent.Context().SpanID, child.Context().SpanID)
+	assert.Regexp("^00-4bf92f3577b34da6a3ce929d0e0e4736-[0-9a-f]{16}-01$", TraceParent(ctx))
+
+	child.SetAttribute("a", 1)
+	child.SetAttribute("a", 2)
+	child.End(fmt.Errorf("pop"))
+	child.End(nil)
+	assert.Len(child.attributes, 1)
+	assert.Equal(2, child.attributes[0].value)
+	assert.Equal("pop", child.errMsg)
+
+	// New traces get new IDs
+	_, root := Start(context.Background(), "root", SpanKindInternal)
+	assert.NotEqual(parent.Context().TraceID, root.Context().TraceID)
+	assert.Equal([8]byte{}, root.parentID)
+}
+
+func TestSampleRatio(t *testing.T) {
+	assert := assert.New(t)
+	never := 0.0
+	assert.NoError(Configure(&Conf{Enabled: true, Endpoint: "http://localhost:4318/v1/traces", SampleRatio: &never}))
+	defer Configure(nil)
+
+	ctx, span := Start(context.Background(), "root", SpanKindInternal)
+	assert.False(span.Context().Sampled)
+	assert.Regexp("-00$", TraceParent(ctx))
+	span.End(nil)
+
+	// The decision of the caller is followed
+	_, span = Start(Extract(context.Background(), testTraceParent), "child", SpanKindInternal)
+	assert.True(span.Context().Sampled)
+
+	half := &tracer{sampleRatio: 0.5}
+	assert.True(half.sample([16]byte{8: 0x3f}))
+	assert.False(half.sample([16]byte{8: 0x80}))
+}
@@ -0,0 +1,397 @@
+// Copyright 2021 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tx
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/kaleido-io/ethconnect/internal/auth"
+	"github.com/kaleido-io/ethconnect/internal/errors"
+	"github.com/kaleido-io/ethconnect/internal/kvstore"
+	"github.com/kaleido-io/ethconnect/internal/utils"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	aliasPrefix    = "aliases/"
+	aliasPrefixEnd = "aliases0"
+	// AliasAnyTenant entitles every tenant to an alias
+	AliasAnyTenant = "*"
+)
+
+var (
+	aliasNameMatcher    = regexp.MustCompile(`^[a-z][a-z0-9._-]{0,63}$`)
+	aliasAddressMatcher = regexp.MustCompile(`^(0x)?[0-9a-f]{40}$`)
+)
+
+// IdentityAliasesConf configures the human-friendly names that can be used in place of a from address
+type IdentityAliasesConf struct {
+	// DB is a KV store connection string to persist registered aliases. They are held in memory if not set
+	DB      string           `json:"db"`
+	Aliases []*IdentityAlias `json:"aliases"`
+}
+
+// IdentityAlias maps a name to a signing address, or to an external signer reference such as
+// an HD wallet. The tenant that registered it, and the listed tenants, are entitled to send
+// from it - unless the security module implements an alias policy
+type IdentityAlias struct {
+	Name        string   `json:"name"`
+	Address     string   `json:"address,omitempty"`
+	Signer      string   `json:"signer,omitempty"`
+	Description string   `json:"description,omitempty"`
+	Owner       string   `json:"owner,omitempty"`
+	Tenants     []string `json:"tenants,omitempty"`
+	Created     string   `json:"created,omitempty"`
+	Updated     string   `json:"updated,omitempty"`
+}
+
+type aliasRequest struct {
+	Name        string   `json:"name"`
+	Address     string   `json:"address"`
+	Signer      string   `json:"signer"`
+	Description string   `json:"description"`
+	Tenants     []string `json:"tenants"`
+}
+
+// IsAliasName returns true if the string could be the name of an identity alias,
+// rather than an address, an HD wallet reference, or a local keystore account
+func IsAliasName(s string) bool {
+	return aliasNameMatcher.MatchString(s) && !aliasAddressMatcher.MatchString(s) && IsHDWalletRequest(s) == nil && IsKeystoreRequest(s) == nil
+}
+
+// aliasManager maintains the identity aliases, and resolves them for entitled callers
+type aliasManager struct {
+	conf    *IdentityAliasesConf
+	db      kvstore.KVStore
+	mux     sync.Mutex
+	aliases map[string]*IdentityAlias
+}
+
+func newAliasManager(conf *IdentityAliasesConf) *aliasManager {
+	return &aliasManager{
+		conf:    conf,
+		aliases: make(map[string]*IdentityAlias),
+	}
+}
+
+func (am *aliasManager) init() (err error) {
+	if am.conf.DB != "" {
+		if am.db, err = kvstore.NewKeyValueStore(am.conf.DB); err != nil {
+			return err
+		}
+	} else {
+		am.db = kvstore.NewMemoryKeyValueStore()
+	}
+
+	am.mux.Lock()
+	defer am.mux.Unlock()
+	it := am.db.NewIteratorWithRange(&kvstore.KVRange{Start: aliasPrefix, Limit: aliasPrefixEnd})
+	for it.Next() {
+		var alias IdentityAlias
+		if err := json.Unmarshal(it.Value(), &alias); err != nil {
+			log.Errorf("Failed to load alias '%s': %s", it.Key(), err)
+			continue
+		}
+		am.aliases[alias.Name] = &alias
+	}
+	it.Release()
+	// Aliases in the config are only added if they have not been registered already
+	for _, alias := range am.conf.Aliases {
+		alias.Name = strings.ToLower(alias.Name)
+		if _, exists := am.aliases[alias.Name]; !exists {
+			if err = validateAlias(alias); err != nil {
+				return err
+			}
+			am.aliases[alias.Name] = alias
+		}
+	}
+	return nil
+}
+
+// validateAlias checks the name and target of an alias, and normalizes the address
+// to lower case with a 0x prefix
+func validateAlias(alias *IdentityAlias) error {
+	if !IsAliasName(alias.Name) {
+		return errors.Errorf(errors.IdentityAliasInvalidName, alias.Name)
+	}
+	if (alias.Address == "") == (alias.Signer == "") {
+		return errors.Errorf(errors.IdentityAliasInvalidTarget, alias.Name)
+	}
+	if alias.Address != "" {
+		addr, err := utils.StrToAddress("address", alias.Address)
+		if err != nil {
+			return errors.Errorf(errors.IdentityAliasInvalidAddress, alias.Address, alias.Name)
+		}
+		alias.Address = strings.ToLower(addr.Hex())
+	} else if IsHDWalletRequest(alias.Signer) == nil && IsKeystoreRequest(alias.Signer) == nil {
+		return errors.Errorf(errors.IdentityAliasInvalidSigner, alias.Signer, alias.Name)
+	}
+	return nil
+}
+
+// entitled checks the caller can send transactions from the alias
+func (am *aliasManager) entitled(ctx context.Context, alias *IdentityAlias) error {
+	if hasPolicy, err := auth.AuthAlias(ctx, alias.Name); hasPolicy {
+		if err != nil {
+			return errors.Errorf(errors.IdentityAliasNotEntitled, alias.Name, err)
+		}
+		return nil
+	}
+	tenant := auth.GetTenant(ctx)
+	if tenant == alias.Owner {
+		return nil
+	}
+	for _, entitled := range alias.Tenants {
+		if entitled == AliasAnyTenant || entitled == tenant {
+			return nil
+		}
+	}
+	return errors.Errorf(errors.IdentityAliasTenantNotEntitled, tenant, alias.Name)
+}
+
+// resolve maps an alias name to the address or signer reference it stands for, if the caller
+// is entitled to it. Addresses and HD wallet references are returned unchanged
+func (am *aliasManager) resolve(ctx context.Context, from string) (string, error) {
+	name := strings.ToLower(from)
+	if !IsAliasName(name) {
+		return from, nil
+	}
+	alias, err := am.get(ctx, name)
+	if err != nil {
+		return "", err
+	}
+	if alias.Address != "" {
+		return alias.Address, nil
+	}
+	return alias.Signer, nil
+}
+
+func (am *aliasManager) lookup(name string) (*IdentityAlias, bool) {
+	am.mux.Lock()
+	defer am.mux.Unlock()
+	alias, exists := am.aliases[strings.ToLower(name)]
+	return alias, exists
+}
+
+func (am *aliasManager) get(ctx context.Context, name string) (*IdentityAlias, error) {
+	alias, exists := am.lookup(name)
+	if !exists {
+		return nil, errors.Errorf(errors.IdentityAliasNotFound, name)
+	}
+	if err := am.entitled(ctx, alias); err != nil {
+		return nil, err
+	}
+	return alias, nil
+}
+
+// list returns the aliases the caller is entitled to
+func (am *aliasManager) list(ctx context.Context) []*IdentityAlias {
+	am.mux.Lock()
+	all := make([]*IdentityAlias, 0, len(am.aliases))
+	for _, alias := range am.aliases {
+		all = append(all, alias)
+	}
+	am.mux.Unlock()
+	aliases := []*IdentityAlias{}
+	for _, alias := range all {
+		if am.entitled(ctx, alias) == nil {
+			aliases = append(aliases, alias)
+		}
+	}
+	sort.Slice(aliases, func(i, j int) bool { return aliases[i].Name < aliases[j].Name })
+	return aliases
+}
+
+// storeAlias must be called holding the mutex
+func (am *aliasManager) storeAlias(alias *IdentityAlias) error {
+	alias.Updated = time.Now().UTC().Format(time.RFC3339)
+	if alias.Created == "" {
+		alias.Created = alias.Updated
+	}
+	b, _ := json.Marshal(alias)
+	if err := am.db.Put(aliasPrefix+alias.Name, b); err != nil {
+		return errors.Errorf(errors.IdentityAliasStoreFailed, alias.Name, err)
+	}
+	am.aliases[alias.Name] = alias
+	return nil
+}
+
+func (am *aliasManager) addAlias(ctx context.Context, req *aliasRequest) (*IdentityAlias, int, error) {
+	alias := &IdentityAlias{
+		Name:        strings.ToLower(req.Name),
+		Address:     req.Address,
+		Signer:      req.Signer,
+		Description: req.Description,
+		Owner:       auth.GetTenant(ctx),
+		Tenants:     req.Tenants,
+	}
+	if err := validateAlias(alias); err != nil {
+		return nil, 400, err
+	}
+	am.mux.Lock()
+	defer am.mux.Unlock()
+	if _, exists := am.aliases[alias.Name]; exists {
+		return nil, 409, errors.Errorf(errors.IdentityAliasExists, alias.Name)
+	}
+	if err := am.storeAlias(alias); err != nil {
+		return nil, 500, err
+	}
+	log.Infof("Registered alias '%s' for %s%s", alias.Name, alias.Address, alias.Signer)
+	return alias, 201, nil
+}
+
+// ownedAlias must be called holding the mutex. Only the tenant that registered an alias can change it
+func (am *aliasManager) ownedAlias(ctx context.Context, name string) (*IdentityAlias, int, error) {
+	existing, exists := am.aliases[name]
+	if !exists {
+		return nil, 404, errors.Errorf(errors.IdentityAliasNotFound, name)
+	}
+	if tenant := auth.GetTenant(ctx); tenant != existing.Owner {
+		return nil, 403, errors.Errorf(errors.IdentityAliasNotOwner, tenant, name)
+	}
+	return existing, 200, nil
+}
+
+func (am *aliasManager) updateAlias(ctx context.Context, name string, req *aliasRequest) (*IdentityAlias, int, error) {
+	name = strings.ToLower(name)
+	am.mux.Lock()
+	defer am.mux.Unlock()
+	existing, status, err := am.ownedAlias(ctx, name)
+	if err != nil {
+		return nil, status, err
+	}
+	updated := &IdentityAlias{
+		Name:        name,
+		Address:     req.Address,
+		Signer:      req.Signer,
+		Description: req.Description,
+		Owner:       existing.Owner,
+		Tenants:     req.Tenants,
+		Created:     existing.Created,
+	}
+	if err := validateAlias(updated); err != nil {
+		return nil, 400, err
+	}
+	if err := am.storeAlias(updated); err != nil {
+		return nil, 500, err
+	}
+	log.Infof("Updated alias '%s' for %s%s", updated.Name, updated.Address, updated.Signer)
+	return updated, 200, nil
+}
+
+func (am *aliasManager) deleteAlias(ctx context.Context, name string) (int, error) {
+	name = strings.ToLower(name)
+	am.mux.Lock()
+	defer am.mux.Unlock()
+	if _, status, err := am.ownedAlias(ctx, name); err != nil {
+		return status, err
+	}
+	if err := am.db.Delete(aliasPrefix + name); err != nil {
+		return 500, errors.Errorf(errors.IdentityAliasStoreFailed, name, err)
+	}
+	delete(am.aliases, name)
+	log.Infof("Deleted alias '%s'", name)
+	return 204, nil
+}
+
+func (am *aliasManager) addRoutes(router *httprouter.Router) {
+	router.GET("/aliases", am.listHandler)
+	router.POST("/aliases", am.addHandler)
+	router.GET("/aliases/:name", am.getHandler)
+	router.PUT("/aliases/:name", am.updateHandler)
+	router.DELETE("/aliases/:name", am.deleteHandler)
+}
+
+func (am *aliasManager) listHandler(res http.ResponseWriter, req *http.Request, params httprouter.Params) {
+	log.Infof("--> %s %s", req.Method, req.URL)
+	am.reply(res, req, 200, am.list(req.Context()))
+}
+
+func (am *aliasManager) getHandler(res http.ResponseWriter, req *http.Request, params httprouter.Params) {
+	log.Infof("--> %s %s", req.Method, req.URL)
+	alias, err := am.get(req.Context(), params.ByName("name"))
+	if err != nil {
+		// Aliases the caller is not entitled to are not disclosed
+		am.errReply(res, req, err, 404)
+		return
+	}
+	am.reply(res, req, 200, alias)
+}
+
+func (am *aliasManager) addHandler(res http.ResponseWriter, req *http.Request, params httprouter.Params) {
+	log.Infof("--> %s %s", req.Method, req.URL)
+	var aliasReq aliasRequest
+	if err := json.NewDecoder(req.Body).Decode(&aliasReq); err != nil {
+		am.errReply(res, req, errors.Errorf(errors.IdentityAliasInvalidRequest, err), 400)
+		return
+	}
+	alias, status, err := am.addAlias(req.Context(), &aliasReq)
+	if err != nil {
+		am.errReply(res, req, err, status)
+		return
+	}
+	am.reply(res, req, status, alias)
+}
+
+func (am *aliasManager) updateHandler(res http.ResponseWriter, req *http.Request, params httprouter.Params) {
+	log.Infof("--> %s %s", req.Method, req.URL)
+	var aliasReq aliasRequest
+	if err := json.NewDecoder(req.Body).Decode(&aliasReq); err != nil {
+		am.errReply(res, req, errors.Errorf(errors.IdentityAliasInvalidRequest, err), 400)
+		return
+	}
+	alias, status, err := am.updateAlias(req.Context(), params.ByName("name"), &aliasReq)
+	if err != nil {
+		am.errReply(res, req, err, status)
+		return
+	}
+	am.reply(res, req, status, alias)
+}
+
+func (am *aliasManager) deleteHandler(res http.ResponseWriter, req *http.Request, params httprouter.Params) {
+	log.Infof("--> %s %s", req.Method, req.URL)
+	status, err := am.deleteAlias(req.Context(), params.ByName("name"))
+	if err != nil {
+		am.errReply(res, req, err, status)
+		return
+	}
+	log.Infof("<-- %s %s [%d]", req.Method, req.URL, status)
+	res.WriteHeader(status)
+}
+
+func (am *aliasManager) reply(res http.ResponseWriter, req *http.Request, status int, body interface{}) {
+	log.Infof("<-- %s %s [%d]", req.Method, req.URL, status)
+	res.Header().Set("Content-Type", "application/json")
+	res.WriteHeader(status)
+	enc := json.NewEncoder(res)
+	enc.SetIndent("", "  ")
+	enc.Encode(body)
+}
+
+func (am *aliasManager) errReply(res http.ResponseWriter, req *http.Request, err error, status int) {
+	log.Errorf("<-- %s %s [%d]: %s", req.Method, req.URL, status, err)
+	reply, _ := json.Marshal(&errMsg{Message: err.Error()})
+	res.Header().Set("Content-Type", "application/json")
+	res.WriteHeader(status)
+	res.Write(reply)
+}
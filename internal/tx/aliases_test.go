@@ -0,0 +1,353 @@
+// Copyright 2021 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tx
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/kaleido-io/ethconnect/internal/auth"
+	"github.com/kaleido-io/ethconnect/internal/auth/authtest"
+	"github.com/kaleido-io/ethconnect/internal/eth"
+	"github.com/kaleido-io/ethconnect/internal/kvstore"
+	"github.com/stretchr/testify/assert"
+)
+
+const testAliasAddr = "0x2b8c0ecc76d0759a8f50b2e14a6881367d805832"
+
+type testAliasTenantSecurityModule struct {
+	authtest.TestSecurityModule
+	tenant string
+}
+
+func (sm *testAliasTenantSecurityModule) Tenant(authCtx interface{}) string {
+	return sm.tenant
+}
+
+type testAliasPolicySecurityModule struct {
+	authtest.TestSecurityModule
+}
+
+func (sm *testAliasPolicySecurityModule) AuthAlias(authCtx interface{}, alias string) error {
+	if alias == "treasury-ops" {
+		return nil
+	}
+	return fmt.Errorf("badness")
+}
+
+func newTestAliasManager(t *testing.T, conf *IdentityAliasesConf) (*aliasManager, *httprouter.Router) {
+	am := newAliasManager(conf)
+	assert.NoError(t, am.init())
+	router := &httprouter.Router{}
+	am.addRoutes(router)
+	return am, router
+}
+
+func testAliasRequest(router *httprouter.Router, method, path, body string) (int, string) {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	res := httptest.NewRecorder()
+	router.ServeHTTP(res, req)
+	return res.Code, res.Body.String()
+}
+
+func TestIsAliasName(t *testing.T) {
+	assert := assert.New(t)
+	assert.True(IsAliasName("treasury-ops"))
+	assert.True(IsAliasName("a.b_c-1"))
+	assert.False(IsAliasName("Treasury"))
+	assert.False(IsAliasName("1treasury"))
+	assert.False(IsAliasName("treasury ops"))
+	assert.False(IsAliasName("a" + strings.Repeat("b", 64)))
+	assert.False(IsAliasName(strings.TrimPrefix(testAliasAddr, "0x")[1:] + "a"))
+	assert.False(IsAliasName("hd-testinst-testwallet-1234"))
+}
+
+func TestAliasesAddGetUpdateDelete(t *testing.T) {
+	assert := assert.New(t)
+	am, router := newTestAliasManager(t, &IdentityAliasesConf{})
+
+	status, body := testAliasRequest(router, "POST", "/aliases", `{"name":"Treasury-Ops","address":"`+strings.ToUpper(testAliasAddr[2:])+`","description":"Treasury"}`)
+	assert.Equal(201, status)
+	assert.Regexp(`"name": "treasury-ops"`, body)
+	assert.Regexp(`"address": "`+testAliasAddr+`"`, body)
+	assert.Regexp(`"created": "`, body)
+
+	status, body = testAliasRequest(router, "POST", "/aliases", `{"name":"treasury-ops","address":"`+testAliasAddr+`"}`)
+	assert.Equal(409, status)
+	assert.Regexp("Alias 'treasury-ops' is already registered", body)
+
+	status, body = testAliasRequest(router, "GET", "/aliases/treasury-ops", "")
+	assert.Equal(200, status)
+	assert.Regexp(`"description": "Treasury"`, body)
+
+	status, body = testAliasRequest(router, "PUT", "/aliases/treasury-ops", `{"signer":"hd-testinst-testwallet-1"}`)
+	assert.Equal(200, status)
+	assert.Regexp(`"signer": "hd-testinst-testwallet-1"`, body)
+	assert.NotRegexp(`"address"`, body)
+
+	from, err := am.resolve(context.Background(), "Treasury-Ops")
+	assert.NoError(err)
+	assert.Equal("hd-testinst-testwallet-1", from)
+
+	status, body = testAliasRequest(router, "GET", "/aliases", "")
+	assert.Equal(200, status)
+	assert.Regexp(`"name": "treasury-ops"`, body)
+
+	status, _ = testAliasRequest(router, "DELETE", "/aliases/treasury-ops", "")
+	assert.Equal(204, status)
+	status, body = testAliasRequest(router, "DELETE", "/aliases/treasury-ops", "")
+	assert.Equal(404, status)
+	assert.Regexp("No alias registered with name 'treasury-ops'", body)
+	status, _ = testAliasRequest(router, "GET", "/aliases/treasury-ops", "")
+	assert.Equal(404, status)
+	status, body = testAliasRequest(router, "GET", "/aliases", "")
+	assert.Equal(200, status)
+	assert.Equal("[]\n", body)
+}
+
+func TestAliasesBadRequests(t *testing.T) {
+	assert := assert.New(t)
+	_, router := newTestAliasManager(t, &IdentityAliasesConf{
+		Aliases: []*IdentityAlias{{Name: "payroll", Address: testAliasAddr}},
+	})
+
+	status, body := testAliasRequest(router, "POST", "/aliases", `!json`)
+	assert.Equal(400, status)
+	assert.Regexp("Invalid alias request", body)
+	status, body = testAliasRequest(router, "POST", "/aliases", `{"name":"hd-a-b-1","address":"`+testAliasAddr+`"}`)
+	assert.Equal(400, status)
+	assert.Regexp("Invalid alias name 'hd-a-b-1'", body)
+	status, body = testAliasRequest(router, "POST", "/aliases", `{"name":"ops"}`)
+	assert.Equal(400, status)
+	assert.Regexp("Alias 'ops' must have exactly one of an 'address' or a 'signer'", body)
+	status, body = testAliasRequest(router, "POST", "/aliases", `{"name":"ops","address":"`+testAliasAddr+`","signer":"hd-a-b-1"}`)
+	assert.Equal(400, status)
+	status, body = testAliasRequest(router, "POST", "/aliases", `{"name":"ops","address":"0x1234"}`)
+	assert.Equal(400, status)
+	assert.Regexp("Invalid address '0x1234' for alias 'ops'", body)
+	status, body = testAliasRequest(router, "POST", "/aliases", `{"name":"ops","signer":"vault-key1"}`)
+	assert.Equal(400, status)
+	assert.Regexp("Invalid signer 'vault-key1' for alias 'ops'", body)
+
+	status, body = testAliasRequest(router, "PUT", "/aliases/payroll", `!json`)
+	assert.Equal(400, status)
+	assert.Regexp("Invalid alias request", body)
+	status, _ = testAliasRequest(router, "PUT", "/aliases/payroll", `{}`)
+	assert.Equal(400, status)
+	status, _ = testAliasRequest(router, "PUT", "/aliases/unknown", `{"address":"`+testAliasAddr+`"}`)
+	assert.Equal(404, status)
+}
+
+func TestAliasesStoreFailure(t *testing.T) {
+	assert := assert.New(t)
+	am, router := newTestAliasManager(t, &IdentityAliasesConf{
+		Aliases: []*IdentityAlias{{Name: "payroll", Address: testAliasAddr}},
+	})
+	am.db = kvstore.NewMockKV(fmt.Errorf("pop"))
+
+	status, body := testAliasRequest(router, "POST", "/aliases", `{"name":"ops","address":"`+testAliasAddr+`"}`)
+	assert.Equal(500, status)
+	assert.Regexp("Failed to store alias 'ops': pop", body)
+	status, _ = testAliasRequest(router, "PUT", "/aliases/payroll", `{"signer":"hd-a-b-1"}`)
+	assert.Equal(500, status)
+	status, _ = testAliasRequest(router, "DELETE", "/aliases/payroll", "")
+	assert.Equal(500, status)
+
+	from, err := am.resolve(context.Background(), "payroll")
+	assert.NoError(err)
+	assert.Equal(testAliasAddr, from)
+}
+
+func TestAliasesInitPersisted(t *testing.T) {
+	assert := assert.New(t)
+	dir, _ := ioutil.TempDir("", "aliases")
+	defer os.RemoveAll(dir)
+	conf := &IdentityAliasesConf{
+		DB:      path.Join(dir, "db"),
+		Aliases: []*IdentityAlias{{Name: "Payroll", Address: testFromAddr}},
+	}
+	am, _ := newTestAliasManager(t, conf)
+	_, status, err := am.updateAlias(context.Background(), "payroll", &aliasRequest{Address: testAliasAddr})
+	assert.NoError(err)
+	assert.Equal(200, status)
+	am.db.Put(aliasPrefix+"bad", []byte("!json"))
+
+	// Registered aliases take precedence over the config after a restart
+	am.db.Close()
+	am, _ = newTestAliasManager(t, conf)
+	defer am.db.Close()
+	from, err := am.resolve(context.Background(), "payroll")
+	assert.NoError(err)
+	assert.Equal(testAliasAddr, from)
+}
+
+func TestAliasesInitFail(t *testing.T) {
+	assert := assert.New(t)
+	dir, _ := ioutil.TempDir("", "aliases")
+	defer os.RemoveAll(dir)
+	ioutil.WriteFile(path.Join(dir, "file"), []byte{}, 0644)
+
+	am := newAliasManager(&IdentityAliasesConf{DB: path.Join(dir, "file")})
+	assert.Error(am.init())
+
+	am = newAliasManager(&IdentityAliasesConf{
+		Aliases: []*IdentityAlias{{Name: "payroll", Address: "bad"}},
+	})
+	assert.EqualError(am.init(), "Invalid address 'bad' for alias 'payroll'")
+}
+
+func TestAliasesResolvePassThrough(t *testing.T) {
+	assert := assert.New(t)
+	am, _ := newTestAliasManager(t, &IdentityAliasesConf{})
+
+	for _, from := range []string{testFromAddr, testAliasAddr[2:], "hd-testinst-testwallet-1234", ""} {
+		resolved, err := am.resolve(context.Background(), from)
+		assert.NoError(err)
+		assert.Equal(from, resolved)
+	}
+	_, err := am.resolve(context.Background(), "unknown")
+	assert.EqualError(err, "No alias registered with name 'unknown'")
+}
+
+func TestAliasesTenantPolicy(t *testing.T) {
+	assert := assert.New(t)
+	sm := &testAliasTenantSecurityModule{tenant: "tenant1"}
+	auth.RegisterSecurityModule(sm)
+	defer auth.RegisterSecurityModule(nil)
+	ctx, _ := auth.WithAuthContext(context.Background(), "testat")
+
+	am, _ := newTestAliasManager(t, &IdentityAliasesConf{
+		Aliases: []*IdentityAlias{{Name: "shared", Address: testFromAddr, Tenants: []string{AliasAnyTenant}}},
+	})
+	_, status, err := am.addAlias(ctx, &aliasRequest{Name: "treasury-ops", Address: testAliasAddr, Tenants: []string{"tenant2"}})
+	assert.NoError(err)
+	assert.Equal(201, status)
+	_, _, err = am.addAlias(ctx, &aliasRequest{Name: "private", Address: testAliasAddr})
+	assert.NoError(err)
+
+	sm.tenant = "tenant2"
+	from, err := am.resolve(ctx, "treasury-ops")
+	assert.NoError(err)
+	assert.Equal(testAliasAddr, from)
+	_, err = am.resolve(ctx, "private")
+	assert.EqualError(err, "Tenant 'tenant2' is not entitled to send transactions from alias 'private'")
+	aliases := am.list(ctx)
+	assert.Equal(2, len(aliases))
+	assert.Equal("shared", aliases[0].Name)
+	assert.Equal("treasury-ops", aliases[1].Name)
+
+	// Only the owner can change an alias
+	_, status, err = am.updateAlias(ctx, "treasury-ops", &aliasRequest{Address: testFromAddr})
+	assert.Equal(403, status)
+	assert.EqualError(err, "Tenant 'tenant2' is not the owner of alias 'treasury-ops'")
+	status, err = am.deleteAlias(ctx, "treasury-ops")
+	assert.Equal(403, status)
+
+	sm.tenant = "tenant1"
+	alias, _, err := am.updateAlias(ctx, "treasury-ops", &aliasRequest{Address: testFromAddr})
+	assert.NoError(err)
+	assert.Equal("tenant1", alias.Owner)
+	status, err = am.deleteAlias(ctx, "treasury-ops")
+	assert.NoError(err)
+	assert.Equal(204, status)
+}
+
+func TestAliasesSecurityModulePolicy(t *testing.T) {
+	assert := assert.New(t)
+	auth.RegisterSecurityModule(&testAliasPolicySecurityModule{})
+	defer auth.RegisterSecurityModule(nil)
+	ctx, _ := auth.WithAuthContext(context.Background(), "testat")
+
+	am, _ := newTestAliasManager(t, &IdentityAliasesConf{
+		Aliases: []*IdentityAlias{
+			{Name: "treasury-ops", Address: testAliasAddr},
+			{Name: "payroll", Address: testFromAddr, Tenants: []string{AliasAnyTenant}},
+		},
+	})
+
+	from, err := am.resolve(ctx, "treasury-ops")
+	assert.NoError(err)
+	assert.Equal(testAliasAddr, from)
+	_, err = am.resolve(ctx, "payroll")
+	assert.EqualError(err, "Not entitled to send transactions from alias 'payroll': badness")
+	assert.Equal(1, len(am.list(ctx)))
+}
+
+func TestOnSendTransactionMessageAlias(t *testing.T) {
+	assert := assert.New(t)
+
+	txnProcessor := NewTxnProcessor(&TxnProcessorConf{
+		MaxTXWaitTime: 1,
+		IdentityAliasesConf: IdentityAliasesConf{
+			Aliases: []*IdentityAlias{{Name: "treasury-ops", Address: testAliasAddr}},
+		},
+	}, &eth.RPCConf{}).(*txnProcessor)
+	testTxnContext := &testTxnContext{}
+	testTxnContext.jsonMsg = "{" +
+		"  \"headers\":{\"type\": \"SendTransaction\"}," +
+		"  \"from\":\"treasury-ops\"," +
+		"  \"gas\":\"123\"," +
+		"  \"gasPrice\":\"2\"," +
+		"  \"method\":{\"name\":\"test\"}" +
+		"}"
+	testRPC := goodMessageRPC()
+	txnProcessor.Init(testRPC)
+
+	txnProcessor.OnMessage(testTxnContext)
+	for inMap := false; !inMap; _, inMap = txnProcessor.inflightTxns[testAliasAddr] {
+		time.Sleep(1 * time.Millisecond)
+	}
+	txnWG := &txnProcessor.inflightTxns[testAliasAddr].txnsInFlight[0].wg
+	txnWG.Wait()
+	assert.Equal(0, len(testTxnContext.errorReplies))
+	assert.Equal("eth_sendTransaction", testRPC.calls[0])
+	sendTX := testRPC.params[0][0].(*eth.SendTXArgs)
+	assert.Equal(testAliasAddr, strings.ToLower(sendTX.From))
+
+	from, err := txnProcessor.ResolveAddress(context.Background(), "treasury-ops")
+	assert.NoError(err)
+	assert.Equal(testAliasAddr, from)
+}
+
+func TestOnSendTransactionMessageUnknownAlias(t *testing.T) {
+	assert := assert.New(t)
+
+	txnProcessor := NewTxnProcessor(&TxnProcessorConf{}, &eth.RPCConf{}).(*txnProcessor)
+	testTxnContext := &testTxnContext{}
+	testTxnContext.jsonMsg = "{" +
+		"  \"headers\":{\"type\": \"SendTransaction\"}," +
+		"  \"from\":\"treasury-ops\"," +
+		"  \"method\":{\"name\":\"test\"}" +
+		"}"
+	testRPC := &testRPC{}
+	txnProcessor.Init(testRPC)
+
+	txnProcessor.OnMessage(testTxnContext)
+	assert.Equal(1, len(testTxnContext.errorReplies))
+	assert.Equal(400, testTxnContext.errorReplies[0].status)
+	assert.EqualError(testTxnContext.errorReplies[0].err, "No alias registered with name 'treasury-ops'")
+	assert.Empty(testRPC.calls)
+
+	_, err := txnProcessor.ResolveAddress(context.Background(), "treasury-ops")
+	assert.EqualError(err, "No alias registered with name 'treasury-ops'")
+}
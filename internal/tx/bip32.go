@@ -0,0 +1,210 @@
+// Copyright 2021 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tx
+
+import (
+	"crypto/ecdsa"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/binary"
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/kaleido-io/ethconnect/internal/errors"
+	"github.com/kaleido-io/ethconnect/internal/ethbind"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+const (
+	bip32HardenedOffset = uint32(0x80000000)
+	bip39SeedIterations = 2048
+	bip39SeedLength     = 64
+)
+
+var (
+	bip39WordIndexOnce sync.Once
+	bip39WordIndex     map[string]int64
+)
+
+// extendedKey is a BIP-32 extended private key
+type extendedKey struct {
+	key       *ecdsa.PrivateKey
+	chainCode []byte
+}
+
+// bip39Seed returns the seed for a BIP-39 mnemonic and passphrase. Every word must be in the
+// English wordlist, and the checksum in the last word must match the entropy of the others. Only
+// ASCII passphrases are accepted, as Unicode normalization is not available
+func bip39Seed(mnemonic, passphrase string) ([]byte, error) {
+	words := strings.Fields(strings.ToLower(mnemonic))
+	switch len(words) {
+	case 12, 15, 18, 21, 24:
+	default:
+		return nil, errors.Errorf(errors.KeystoreInvalidMnemonic, fmt.Sprintf("expected 12, 15, 18, 21 or 24 words, found %d", len(words)))
+	}
+	for _, c := range passphrase {
+		if c > 0x7f {
+			return nil, errors.Errorf(errors.KeystoreInvalidMnemonic, "only ASCII passphrases are supported")
+		}
+	}
+	if err := bip39CheckMnemonic(words); err != nil {
+		return nil, err
+	}
+	return pbkdf2.Key([]byte(strings.Join(words, " ")), []byte("mnemonic"+passphrase), bip39SeedIterations, bip39SeedLength, sha512.New), nil
+}
+
+// bip39CheckMnemonic checks the words are in the English wordlist, and verifies the checksum.
+// Each word holds 11 bits, and the last len(words)/3 bits are the leading bits of the
+// SHA-256 hash of the entropy before them. The words are not included in the errors
+func bip39CheckMnemonic(words []string) error {
+	bip39WordIndexOnce.Do(func() {
+		bip39WordIndex = make(map[string]int64)
+		for i, word := range strings.Fields(bip39EnglishWordlist) {
+			bip39WordIndex[word] = int64(i)
+		}
+	})
+	bits := new(big.Int)
+	for i, word := range words {
+		index, ok := bip39WordIndex[word]
+		if !ok {
+			return errors.Errorf(errors.KeystoreInvalidMnemonic, fmt.Sprintf("word %d is not in the English wordlist", i+1))
+		}
+		bits.Lsh(bits, 11).Or(bits, big.NewInt(index))
+	}
+	checksumBits := uint(len(words) / 3)
+	checksumMask := big.NewInt(int64(1)<<checksumBits - 1)
+	checksum := new(big.Int).And(bits, checksumMask)
+	entropy := new(big.Int).Rsh(bits, checksumBits).FillBytes(make([]byte, checksumBits*4))
+	hash := sha256.Sum256(entropy)
+	if uint64(hash[0]>>(8-checksumBits)) != checksum.Uint64() {
+		return errors.Errorf(errors.KeystoreInvalidMnemonic, "the checksum does not match")
+	}
+	return nil
+}
+
+// privateKey parses a 32 byte secp256k1 private key. This fails for zero, and for values
+// not less than the order of the curve, which BIP-32 requires to be rejected
+func privateKey(b []byte) (*ecdsa.PrivateKey, error) {
+	return ethbind.API.HexToECDSA(fmt.Sprintf("%064x", new(big.Int).SetBytes(b)))
+}
+
+func bip32MasterKey(seed []byte) (*extendedKey, error) {
+	mac := hmac.New(sha512.New, []byte("Bitcoin seed"))
+	mac.Write(seed)
+	i := mac.Sum(nil)
+	key, err := privateKey(i[:32])
+	if err != nil {
+		return nil, errors.Errorf(errors.KeystoreDerivationFailed, "m", err)
+	}
+	return &extendedKey{key: key, chainCode: i[32:]}, nil
+}
+
+// compressedPublicKey is the SEC1 compressed encoding of the public key
+func compressedPublicKey(key *ecdsa.PrivateKey) []byte {
+	b := make([]byte, 33)
+	b[0] = 0x02 + byte(key.PublicKey.Y.Bit(0))
+	key.PublicKey.X.FillBytes(b[1:])
+	return b
+}
+
+// child derives a child private key, hardened if the index is at or above the hardened offset
+func (k *extendedKey) child(index uint32) (*extendedKey, error) {
+	data := make([]byte, 0, 37)
+	if index >= bip32HardenedOffset {
+		data = append(data, 0x00)
+		data = append(data, k.key.D.FillBytes(make([]byte, 32))...)
+	} else {
+		data = append(data, compressedPublicKey(k.key)...)
+	}
+	data = append(data, 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(data[len(data)-4:], index)
+
+	mac := hmac.New(sha512.New, k.chainCode)
+	mac.Write(data)
+	i := mac.Sum(nil)
+	n := k.key.Curve.Params().N
+	il := new(big.Int).SetBytes(i[:32])
+	if il.Cmp(n) >= 0 {
+		return nil, fmt.Errorf("invalid key at index %d", index)
+	}
+	childKey := il.Add(il, k.key.D)
+	childKey.Mod(childKey, n)
+	key, err := privateKey(childKey.Bytes())
+	if err != nil {
+		return nil, fmt.Errorf("invalid key at index %d: %s", index, err)
+	}
+	return &extendedKey{key: key, chainCode: i[32:]}, nil
+}
+
+// parseDerivationPath parses a BIP-32 path such as m/44'/60'/0'/0/1, where ' or h marks a
+// hardened index
+func parseDerivationPath(path string) ([]uint32, error) {
+	segments := strings.Split(path, "/")
+	if len(segments) < 2 || segments[0] != "m" {
+		return nil, errors.Errorf(errors.KeystoreInvalidPath, path)
+	}
+	indexes := make([]uint32, 0, len(segments)-1)
+	for _, segment := range segments[1:] {
+		hardened := strings.HasSuffix(segment, "'") || strings.HasSuffix(segment, "h")
+		if hardened {
+			segment = segment[0 : len(segment)-1]
+		}
+		index, err := strconv.ParseUint(segment, 10, 32)
+		if err != nil || uint32(index) >= bip32HardenedOffset {
+			return nil, errors.Errorf(errors.KeystoreInvalidPath, path)
+		}
+		if hardened {
+			index += uint64(bip32HardenedOffset)
+		}
+		indexes = append(indexes, uint32(index))
+	}
+	return indexes, nil
+}
+
+// formatDerivationPath is the canonical form of a parsed path, with ' marking hardened indexes
+func formatDerivationPath(indexes []uint32) string {
+	path := &strings.Builder{}
+	path.WriteString("m")
+	for _, index := range indexes {
+		if index >= bip32HardenedOffset {
+			fmt.Fprintf(path, "/%d'", index-bip32HardenedOffset)
+		} else {
+			fmt.Fprintf(path, "/%d", index)
+		}
+	}
+	return path.String()
+}
+
+// derivePrivateKey derives the private key at a path from a BIP-39 seed
+func derivePrivateKey(seed []byte, path string) (*ecdsa.PrivateKey, error) {
+	indexes, err := parseDerivationPath(path)
+	if err != nil {
+		return nil, err
+	}
+	k, err := bip32MasterKey(seed)
+	if err != nil {
+		return nil, err
+	}
+	for _, index := range indexes {
+		if k, err = k.child(index); err != nil {
+			return nil, errors.Errorf(errors.KeystoreDerivationFailed, path, err)
+		}
+	}
+	return k.key, nil
+}
@@ -0,0 +1,97 @@
+// Copyright 2021 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tx
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBIP39Seed(t *testing.T) {
+	assert := assert.New(t)
+
+	// Published BIP-39 test vector
+	seed, err := bip39Seed(strings.Repeat("abandon ", 11)+"about\n", "TREZOR")
+	assert.NoError(err)
+	assert.Equal("c55257c360c07c72029aebc1b53c05ed0362ada38ead3e3e9efa3708e53495531f09a6987599d18264c1e1c92f2cf141630c7a3c4ab7c81b2f001698e7463b04", hex.EncodeToString(seed))
+
+	_, err = bip39Seed("abandon about", "")
+	assert.Regexp("Invalid keystore mnemonic: expected 12, 15, 18, 21 or 24 words, found 2", err)
+	_, err = bip39Seed(strings.Repeat("abandon ", 11)+"about", "pässword")
+	assert.Regexp("only ASCII", err)
+
+	// Mnemonics of each length, which have checksums of 4 to 8 bits. Words are not case sensitive
+	seed, err = bip39Seed("Legal winner thank year wave sausage worth useful legal winner thank yellow", "TREZOR")
+	assert.NoError(err)
+	assert.Equal("2e8905819b8723fe2c1d161860e5ee1830318dbf49a83bd451cfb8440c28bd6fa457fe1296106559a3c80937a1c1069be3a3a5bd381ee6260e8d9739fce1f607", hex.EncodeToString(seed))
+	for _, mnemonic := range []string{
+		strings.Repeat("abandon ", 14) + "address",
+		"letter advice cage absurd amount doctor acoustic avoid letter advice cage absurd amount doctor acoustic avoid letter always",
+		strings.Repeat("abandon ", 20) + "admit",
+		strings.Repeat("abandon ", 23) + "art",
+	} {
+		_, err = bip39Seed(mnemonic, "")
+		assert.NoError(err, mnemonic)
+		_, err = bip39Seed("zoo"+mnemonic[strings.Index(mnemonic, " "):], "")
+		assert.Regexp("the checksum does not match", err, mnemonic)
+	}
+
+	_, err = bip39Seed(strings.Repeat("abandon ", 12), "")
+	assert.EqualError(err, "Invalid keystore mnemonic: the checksum does not match")
+	_, err = bip39Seed(strings.Repeat("abandon ", 11)+"bitcoin", "")
+	assert.EqualError(err, "Invalid keystore mnemonic: word 12 is not in the English wordlist")
+}
+
+func TestBIP39Wordlist(t *testing.T) {
+	hash := sha256.Sum256([]byte(bip39EnglishWordlist))
+	assert.Equal(t, "2f5eed53a4727b4bf8880d8f3f199efc90e58503646d9ff8eff3a2ed3b24dbda", hex.EncodeToString(hash[:]))
+	assert.Equal(t, 2048, len(strings.Fields(bip39EnglishWordlist)))
+}
+
+func TestBIP32DerivePrivateKey(t *testing.T) {
+	assert := assert.New(t)
+
+	// Published BIP-32 test vector 1, with hardened and normal derivation
+	seed, _ := hex.DecodeString("000102030405060708090a0b0c0d0e0f")
+	master, err := bip32MasterKey(seed)
+	assert.NoError(err)
+	assert.Equal("e8f32e723decf4051aefac8e2c93c9c5b214313817cdb01a1494b917c8436b35", hex.EncodeToString(master.key.D.FillBytes(make([]byte, 32))))
+	key, err := derivePrivateKey(seed, "m/0h")
+	assert.NoError(err)
+	assert.Equal("edb2e14f9ee77d26dd93b4ecede8d16ed408ce149b6cd80b0715a2d911a0afea", hex.EncodeToString(key.D.FillBytes(make([]byte, 32))))
+	key, err = derivePrivateKey(seed, "m/0'/1")
+	assert.NoError(err)
+	assert.Equal("3c6cb8d0f6a264c91ea8b5030fadaa8e538b020f0a387421a12de9319dc93368", hex.EncodeToString(key.D.FillBytes(make([]byte, 32))))
+}
+
+func TestParseDerivationPath(t *testing.T) {
+	assert := assert.New(t)
+
+	indexes, err := parseDerivationPath("m/44h/60'/0'/0/1")
+	assert.NoError(err)
+	assert.Equal([]uint32{0x8000002c, 0x8000003c, 0x80000000, 0, 1}, indexes)
+	assert.Equal("m/44'/60'/0'/0/1", formatDerivationPath(indexes))
+
+	for _, path := range []string{"m", "n/0", "m/", "m/x", "m/-1", "m/2147483648", "m/0''"} {
+		_, err = parseDerivationPath(path)
+		assert.Regexp("Invalid derivation path", err, path)
+	}
+	_, err = derivePrivateKey(nil, "m/x")
+	assert.Regexp("Invalid derivation path", err)
+}
@@ -0,0 +1,165 @@
+// Copyright 2021 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tx
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/kaleido-io/ethconnect/internal/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// ChainProfilePublicL1 is a public layer 1 chain, such as Ethereum mainnet, with blocks every
+	// ~12s, a competitive fee market, and re-orgs of the newest blocks
+	ChainProfilePublicL1 = "publicL1"
+	// ChainProfilePrivateIBFT is a private chain with BFT consensus, such as IBFT or QBFT, with fast
+	// blocks, immediate finality, and often free gas
+	ChainProfilePrivateIBFT = "privateIBFT"
+	// ChainProfileL2Rollup is a layer 2 rollup, with fast blocks from a sequencer, and little
+	// competition for block space so tips can be kept low
+	ChainProfileL2Rollup = "l2Rollup"
+)
+
+// ChainProfileConf selects a profile of defaults suited to the kind of chain transactions are sent
+// to, as the same timings behave poorly on fast private chains and slow public chains alike.
+// Each of the settings of the profile can be overridden. Settings configured elsewhere, such as
+// in feeEstimation, take precedence over the profile
+type ChainProfileConf struct {
+	Name                 string      `json:"name,omitempty"`
+	DynamicFees          *bool       `json:"dynamicFees,omitempty"`
+	MinPriorityFeePerGas json.Number `json:"minPriorityFeePerGas,omitempty"`
+	MaxPriorityFeePerGas json.Number `json:"maxPriorityFeePerGas,omitempty"`
+	GasPriceCeiling      json.Number `json:"gasPriceCeiling,omitempty"`
+	Confirmations        int64       `json:"confirmations,omitempty"`
+	ReceiptPollMinMS     int         `json:"receiptPollMin,omitempty"`
+	ReceiptPollMaxMS     int         `json:"receiptPollMax,omitempty"`
+}
+
+func profileBool(b bool) *bool {
+	return &b
+}
+
+// chainProfiles are the built-in profiles. Confirmations is the default number of blocks a receipt
+// waits for, when the request does not specify one
+var chainProfiles = map[string]ChainProfileConf{
+	ChainProfilePublicL1: {
+		DynamicFees:          profileBool(true),
+		MinPriorityFeePerGas: "1000000000", // 1 gwei
+		Confirmations:        12,
+		ReceiptPollMinMS:     2000,
+		ReceiptPollMaxMS:     15000,
+	},
+	ChainProfilePrivateIBFT: {
+		DynamicFees:      profileBool(false),
+		Confirmations:    1,
+		ReceiptPollMinMS: 100,
+		ReceiptPollMaxMS: 2000,
+	},
+	ChainProfileL2Rollup: {
+		DynamicFees:          profileBool(true),
+		MaxPriorityFeePerGas: "100000000", // 0.1 gwei
+		Confirmations:        1,
+		ReceiptPollMinMS:     250,
+		ReceiptPollMaxMS:     5000,
+	},
+}
+
+// resolveChainProfile merges the overrides in the configuration over the named profile, returning
+// the settings in effect. With no profile, only the overrides apply
+func resolveChainProfile(conf *ChainProfileConf) (*ChainProfileConf, error) {
+	resolved := ChainProfileConf{}
+	if conf.Name != "" {
+		profile, ok := chainProfiles[conf.Name]
+		if !ok {
+			return nil, errors.Errorf(errors.TransactionChainProfileUnknown, conf.Name)
+		}
+		resolved = profile
+		resolved.Name = conf.Name
+	}
+	if conf.DynamicFees != nil {
+		resolved.DynamicFees = conf.DynamicFees
+	}
+	if conf.MinPriorityFeePerGas != "" {
+		resolved.MinPriorityFeePerGas = conf.MinPriorityFeePerGas
+	}
+	if conf.MaxPriorityFeePerGas != "" {
+		resolved.MaxPriorityFeePerGas = conf.MaxPriorityFeePerGas
+	}
+	if conf.GasPriceCeiling != "" {
+		resolved.GasPriceCeiling = conf.GasPriceCeiling
+	}
+	if conf.Confirmations > 0 {
+		resolved.Confirmations = conf.Confirmations
+	}
+	if conf.ReceiptPollMinMS > 0 {
+		resolved.ReceiptPollMinMS = conf.ReceiptPollMinMS
+	}
+	if conf.ReceiptPollMaxMS > 0 {
+		resolved.ReceiptPollMaxMS = conf.ReceiptPollMaxMS
+	}
+	if resolved.ReceiptPollMinMS > 0 && resolved.ReceiptPollMaxMS > 0 && resolved.ReceiptPollMinMS > resolved.ReceiptPollMaxMS {
+		return nil, errors.Errorf(errors.TransactionChainProfileBadPolling, resolved.ReceiptPollMinMS, resolved.ReceiptPollMaxMS)
+	}
+	return &resolved, nil
+}
+
+// applyChainProfile fills in the fee estimation and gas price settings that are not configured
+// from the chain profile, and returns the tracker for the receipt polling intervals of the profile
+func applyChainProfile(conf *TxnProcessorConf) TxnDelayTracker {
+	profile, err := resolveChainProfile(&conf.ChainProfile)
+	if err != nil {
+		log.Errorf("Ignoring the chain profile: %s", err)
+		return NewTxnDelayTracker()
+	}
+	if profile.Name != "" {
+		log.Infof("Using chain profile '%s'", profile.Name)
+	}
+	fees := &conf.FeeEstimation
+	if profile.DynamicFees != nil && *profile.DynamicFees {
+		fees.DynamicFees = true
+	}
+	if fees.MinPriorityFeePerGas == "" {
+		fees.MinPriorityFeePerGas = profile.MinPriorityFeePerGas
+	}
+	if fees.MaxPriorityFeePerGas == "" {
+		fees.MaxPriorityFeePerGas = profile.MaxPriorityFeePerGas
+	}
+	if conf.GasPrice.Ceiling == "" {
+		conf.GasPrice.Ceiling = profile.GasPriceCeiling
+	}
+	conf.ChainProfile = *profile
+
+	minDelay, maxDelay := MinDelay, MaxDelay
+	if profile.ReceiptPollMinMS > 0 {
+		minDelay = time.Duration(profile.ReceiptPollMinMS) * time.Millisecond
+	}
+	if profile.ReceiptPollMaxMS > 0 {
+		maxDelay = time.Duration(profile.ReceiptPollMaxMS) * time.Millisecond
+	}
+	if minDelay > maxDelay {
+		maxDelay = minDelay
+	}
+	return newTxnDelayTrackerWithBounds(minDelay, maxDelay)
+}
+
+// defaultConfirmations returns the confirmations a receipt waits for, when none are requested
+func (p *txnProcessor) defaultConfirmations(requested int64) int64 {
+	if requested == 0 {
+		return p.conf.ChainProfile.Confirmations
+	}
+	return requested
+}
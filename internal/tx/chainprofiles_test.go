@@ -0,0 +1,123 @@
+// Copyright 2021 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tx
+
+import (
+	"testing"
+	"time"
+
+	"github.com/kaleido-io/ethconnect/internal/eth"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestResolveChainProfile(t *testing.T) {
+	assert := assert.New(t)
+
+	profile, err := resolveChainProfile(&ChainProfileConf{Name: ChainProfileL2Rollup})
+	assert.NoError(err)
+	assert.Equal(ChainProfileL2Rollup, profile.Name)
+	assert.True(*profile.DynamicFees)
+	assert.Equal("100000000", profile.MaxPriorityFeePerGas.String())
+	assert.Equal(int64(1), profile.Confirmations)
+
+	profile, err = resolveChainProfile(&ChainProfileConf{
+		Name:                 ChainProfilePublicL1,
+		DynamicFees:          profileBool(false),
+		MinPriorityFeePerGas: "2000000000",
+		MaxPriorityFeePerGas: "5000000000",
+		Confirmations:        6,
+		ReceiptPollMinMS:     1000,
+		ReceiptPollMaxMS:     20000,
+	})
+	assert.NoError(err)
+	assert.False(*profile.DynamicFees)
+	assert.Equal("2000000000", profile.MinPriorityFeePerGas.String())
+	assert.Equal("5000000000", profile.MaxPriorityFeePerGas.String())
+	assert.Equal(int64(6), profile.Confirmations)
+	assert.Equal(1000, profile.ReceiptPollMinMS)
+	assert.Equal(20000, profile.ReceiptPollMaxMS)
+
+	// The built-in profiles are not changed by overrides
+	assert.True(*chainProfiles[ChainProfilePublicL1].DynamicFees)
+	assert.Equal(int64(12), chainProfiles[ChainProfilePublicL1].Confirmations)
+
+	// Overrides alone, with no profile
+	profile, err = resolveChainProfile(&ChainProfileConf{Confirmations: 3})
+	assert.NoError(err)
+	assert.Empty(profile.Name)
+	assert.Nil(profile.DynamicFees)
+	assert.Equal(int64(3), profile.Confirmations)
+
+	_, err = resolveChainProfile(&ChainProfileConf{Name: "mainnet"})
+	assert.EqualError(err, "Unknown chain profile 'mainnet'. Valid profiles are publicL1, privateIBFT and l2Rollup")
+
+	_, err = resolveChainProfile(&ChainProfileConf{Name: ChainProfilePrivateIBFT, ReceiptPollMinMS: 5000})
+	assert.EqualError(err, "The minimum receipt polling interval 5000ms is greater than the maximum 2000ms")
+}
+
+func TestApplyChainProfile(t *testing.T) {
+	assert := assert.New(t)
+
+	conf := &TxnProcessorConf{ChainProfile: ChainProfileConf{Name: ChainProfilePublicL1}}
+	delayer := applyChainProfile(conf).(*txnDelayTracker)
+	assert.True(conf.FeeEstimation.DynamicFees)
+	assert.Equal("1000000000", conf.FeeEstimation.MinPriorityFeePerGas.String())
+	assert.Empty(conf.FeeEstimation.MaxPriorityFeePerGas)
+	assert.Equal(2*time.Second, delayer.minDelay)
+	assert.Equal(15*time.Second, delayer.maxDelay)
+	assert.Equal(2*time.Second, delayer.GetInitialDelay())
+	assert.Equal(15*time.Second, delayer.GetRetryDelay(15*time.Second, 100))
+
+	// Fee settings configured for the estimator take precedence over the profile
+	conf = &TxnProcessorConf{
+		ChainProfile:  ChainProfileConf{Name: ChainProfilePrivateIBFT},
+		FeeEstimation: eth.FeeEstimationConf{DynamicFees: true, MinPriorityFeePerGas: "10"},
+		GasPrice:      eth.GasPriceConf{Ceiling: "20"},
+	}
+	conf.ChainProfile.GasPriceCeiling = "30"
+	delayer = applyChainProfile(conf).(*txnDelayTracker)
+	assert.True(conf.FeeEstimation.DynamicFees)
+	assert.Equal("10", conf.FeeEstimation.MinPriorityFeePerGas.String())
+	assert.Equal("20", conf.GasPrice.Ceiling.String())
+	assert.Equal(100*time.Millisecond, delayer.minDelay)
+	assert.Equal(2*time.Second, delayer.maxDelay)
+
+	conf = &TxnProcessorConf{ChainProfile: ChainProfileConf{ReceiptPollMinMS: 30000, GasPriceCeiling: "30"}}
+	delayer = applyChainProfile(conf).(*txnDelayTracker)
+	assert.Equal("30", conf.GasPrice.Ceiling.String())
+	assert.Equal(30*time.Second, delayer.minDelay)
+	assert.Equal(30*time.Second, delayer.maxDelay)
+
+	// An invalid profile is ignored, keeping the defaults
+	conf = &TxnProcessorConf{ChainProfile: ChainProfileConf{Name: "mainnet"}}
+	delayer = applyChainProfile(conf).(*txnDelayTracker)
+	assert.False(conf.FeeEstimation.DynamicFees)
+	assert.Equal(MinDelay, delayer.minDelay)
+	assert.Equal(MaxDelay, delayer.maxDelay)
+}
+
+func TestChainProfileDefaultConfirmations(t *testing.T) {
+	assert := assert.New(t)
+
+	p := NewTxnProcessor(&TxnProcessorConf{
+		ChainProfile: ChainProfileConf{Name: ChainProfilePublicL1},
+	}, &eth.RPCConf{}).(*txnProcessor)
+	assert.Equal(int64(12), p.defaultConfirmations(0))
+	assert.Equal(int64(3), p.defaultConfirmations(3))
+	assert.True(p.conf.FeeEstimation.DynamicFees)
+
+	p = NewTxnProcessor(&TxnProcessorConf{}, &eth.RPCConf{}).(*txnProcessor)
+	assert.Equal(int64(0), p.defaultConfirmations(0))
+}
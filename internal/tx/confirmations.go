@@ -0,0 +1,111 @@
+// Copyright 2021 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tx
+
+import (
+	"context"
+	"math/big"
+	"time"
+
+	ethbinding "github.com/kaleido-io/ethbinding/pkg"
+	"github.com/kaleido-io/ethconnect/internal/errors"
+	"github.com/kaleido-io/ethconnect/internal/eth"
+	log "github.com/sirupsen/logrus"
+)
+
+// confirmationDepth is the number of confirmations of a block, where the block itself is the first
+func confirmationDepth(head, blockNumber *big.Int) int64 {
+	depth := new(big.Int).Sub(head, blockNumber)
+	return depth.Int64() + 1
+}
+
+// checkConfirmations reads the head of the chain, and the receipt of the transaction as it is
+// now, which is nil if the transaction is not in a block
+func (p *txnProcessor) checkConfirmations(ctx context.Context, tx *eth.Txn) (head *big.Int, receipt *eth.TxnReceipt, err error) {
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	var blockNumber ethbinding.HexBigInt
+	if err = p.rpc.CallContext(ctx, &blockNumber, "eth_blockNumber"); err != nil {
+		return nil, nil, errors.Errorf(errors.RPCCallReturnedError, "eth_blockNumber", err)
+	}
+	if err = p.rpc.CallContext(ctx, &receipt, "eth_getTransactionReceipt", tx.Hash); err != nil {
+		return nil, nil, errors.Errorf(errors.RPCCallReturnedError, "eth_getTransactionReceipt", err)
+	}
+	if receipt != nil && (receipt.BlockNumber == nil || receipt.BlockHash == nil) {
+		receipt = nil
+	}
+	return blockNumber.ToInt(), receipt, nil
+}
+
+// waitForConfirmations waits until the block containing a mined transaction has the number of
+// confirmations requested. The receipt is checked on each poll, so if a re-org moves the transaction
+// to another block the count restarts from that block, and if a re-org removes it we wait for it to
+// be mined again. The hashes of the blocks the transaction was removed from are returned, along
+// with an error if it is not confirmed within the maximum wait time
+func (p *txnProcessor) waitForConfirmations(inflight *inflightTxn, tx *eth.Txn, confirmations int64, initialWaitDelay time.Duration) (reorged []string, err error) {
+	waitStart := time.Now().UTC()
+	var blockHash ethbinding.Hash
+	if tx.Receipt.BlockHash != nil {
+		blockHash = *tx.Receipt.BlockHash
+	}
+	blockNumber := tx.Receipt.BlockNumber.ToInt()
+	mined := true
+	for retries := 0; ; retries++ {
+		head, receipt, checkErr := p.checkConfirmations(inflight.txnContext.Context(), tx)
+		if checkErr != nil {
+			// As when waiting for the receipt, we keep trying on connectivity errors until the timeout
+			log.Infof("Failed to check confirmations for %s (retries=%d): %s", inflight, retries, checkErr)
+		} else {
+			if mined && receipt != nil && blockHash == (ethbinding.Hash{}) {
+				blockHash = *receipt.BlockHash
+			}
+			if mined && (receipt == nil || *receipt.BlockHash != blockHash) {
+				log.Warnf("Transaction %s removed from block %s (%s) by a chain re-org", tx.Hash, blockNumber.String(), blockHash.String())
+				reorged = append(reorged, blockHash.String())
+				mined = false
+			}
+			if !mined && receipt != nil {
+				// Mined again in a new block, so we refresh the receipt we report
+				if _, err := tx.GetTXReceipt(inflight.txnContext.Context(), p.rpc); err != nil {
+					log.Infof("Failed to get receipt for %s in new block %s: %s", inflight, receipt.BlockHash.String(), err)
+				} else {
+					log.Infof("Transaction %s mined again in block %s (%s)", tx.Hash, receipt.BlockNumber.ToInt().String(), receipt.BlockHash.String())
+					blockHash = *receipt.BlockHash
+					blockNumber = receipt.BlockNumber.ToInt()
+					mined = true
+				}
+			}
+			if mined {
+				depth := confirmationDepth(head, blockNumber)
+				if depth >= confirmations {
+					log.Infof("Transaction %s in block %s has %d confirmations after %.2fs", tx.Hash, blockNumber.String(), depth, time.Now().UTC().Sub(waitStart).Seconds())
+					return reorged, nil
+				}
+				log.Debugf("Transaction %s in block %s has %d of %d confirmations (retries=%d)", tx.Hash, blockNumber.String(), depth, confirmations, retries)
+			}
+		}
+
+		if time.Now().UTC().Sub(waitStart) > p.maxTXWaitTime {
+			if !mined {
+				return reorged, errors.Errorf(errors.TransactionReorgedOut, blockHash.String())
+			}
+			return reorged, errors.Errorf(errors.TransactionConfirmationTimeout, blockNumber.String(), confirmations)
+		}
+		p.inflightTxnsLock.Lock()
+		delayBeforeRetry := p.inflightTxnDelayer.GetRetryDelay(initialWaitDelay, retries+1)
+		p.inflightTxnsLock.Unlock()
+		time.Sleep(delayBeforeRetry)
+	}
+}
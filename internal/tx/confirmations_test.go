@@ -0,0 +1,264 @@
+// Copyright 2021 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tx
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	ethbinding "github.com/kaleido-io/ethbinding/pkg"
+	"github.com/kaleido-io/ethconnect/internal/eth"
+	"github.com/kaleido-io/ethconnect/internal/ethbind"
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	testConfirmBlockA = "0x6e710868fd2d0ac1f141ba3f0cd569e38ce1999d8f39518ee7633d2b9a7122af"
+	testConfirmBlockB = "0x1e5ea8cf3ab1bb8a3e5cc2e1cd1c7f4b0b8e6b8b4f0d2a1e84a4f5a0fd1e1b2c"
+)
+
+// testChain scripts the head of the chain, and the block containing the transaction, for each poll
+type testChain struct {
+	mux     sync.Mutex
+	polls   []testChainPoll
+	pollIdx int
+}
+
+type testChainPoll struct {
+	head        int64
+	blockNumber int64
+	blockHash   string
+}
+
+func (c *testChain) current() testChainPoll {
+	if c.pollIdx >= len(c.polls) {
+		return c.polls[len(c.polls)-1]
+	}
+	return c.polls[c.pollIdx]
+}
+
+func (c *testChain) rpc() *eth.MockRPCClient {
+	return eth.NewMockRPCClientForSync(nil, func(method string, res interface{}, args ...interface{}) {
+		c.mux.Lock()
+		defer c.mux.Unlock()
+		poll := c.current()
+		switch method {
+		case "eth_blockNumber":
+			json.Unmarshal([]byte(fmt.Sprintf(`"0x%x"`, poll.head)), res)
+		case "eth_getTransactionReceipt":
+			if poll.blockHash == "" {
+				json.Unmarshal([]byte(`null`), res)
+			} else {
+				json.Unmarshal([]byte(fmt.Sprintf(`{"blockNumber":"0x%x","blockHash":"%s","status":"0x1"}`, poll.blockNumber, poll.blockHash)), res)
+			}
+			if _, isPoll := res.(**eth.TxnReceipt); isPoll {
+				c.pollIdx++
+			}
+		}
+	})
+}
+
+func newTestConfirmationsProcessor(chain *testChain) (*txnProcessor, *eth.Txn, *inflightTxn) {
+	p := NewTxnProcessor(&TxnProcessorConf{
+		MaxTXWaitTime: 1,
+	}, &eth.RPCConf{}).(*txnProcessor)
+	p.Init(chain.rpc())
+	p.maxTXWaitTime = 250 * time.Millisecond
+	blockHash := ethbind.API.HexToHash(testConfirmBlockA)
+	blockNumber := ethbinding.HexBigInt(*big.NewInt(10))
+	tx := &eth.Txn{Hash: "0xac18e98664e160305cdb77e75e5eae32e55447e94ad8ceb0123729589ed09f8b"}
+	tx.Receipt.BlockHash = &blockHash
+	tx.Receipt.BlockNumber = &blockNumber
+	inflight := &inflightTxn{txnContext: &testTxnContext{jsonMsg: goodSendTxnJSON}}
+	return p, tx, inflight
+}
+
+func TestConfirmationDepth(t *testing.T) {
+	assert := assert.New(t)
+	assert.Equal(int64(1), confirmationDepth(big.NewInt(10), big.NewInt(10)))
+	assert.Equal(int64(3), confirmationDepth(big.NewInt(12), big.NewInt(10)))
+	assert.Equal(int64(0), confirmationDepth(big.NewInt(9), big.NewInt(10)))
+}
+
+func TestWaitForConfirmationsConfirmed(t *testing.T) {
+	assert := assert.New(t)
+	chain := &testChain{polls: []testChainPoll{
+		{head: 10, blockNumber: 10, blockHash: testConfirmBlockA},
+		{head: 11, blockNumber: 10, blockHash: testConfirmBlockA},
+		{head: 12, blockNumber: 10, blockHash: testConfirmBlockA},
+	}}
+	p, tx, inflight := newTestConfirmationsProcessor(chain)
+
+	reorged, err := p.waitForConfirmations(inflight, tx, 3, 1*time.Millisecond)
+	assert.NoError(err)
+	assert.Empty(reorged)
+	assert.Equal(3, chain.pollIdx)
+}
+
+func TestWaitForConfirmationsMinedAgain(t *testing.T) {
+	assert := assert.New(t)
+	chain := &testChain{polls: []testChainPoll{
+		{head: 10, blockNumber: 10, blockHash: testConfirmBlockA},
+		{head: 11},
+		{head: 12, blockNumber: 12, blockHash: testConfirmBlockB},
+		{head: 13, blockNumber: 12, blockHash: testConfirmBlockB},
+	}}
+	p, tx, inflight := newTestConfirmationsProcessor(chain)
+
+	reorged, err := p.waitForConfirmations(inflight, tx, 2, 1*time.Millisecond)
+	assert.NoError(err)
+	assert.Equal([]string{testConfirmBlockA}, reorged)
+	assert.Equal(testConfirmBlockB, tx.Receipt.BlockHash.String())
+	assert.Equal(int64(12), tx.Receipt.BlockNumber.ToInt().Int64())
+}
+
+func TestWaitForConfirmationsMovedBlock(t *testing.T) {
+	assert := assert.New(t)
+	chain := &testChain{polls: []testChainPoll{
+		{head: 11, blockNumber: 11, blockHash: testConfirmBlockB},
+		{head: 12, blockNumber: 11, blockHash: testConfirmBlockB},
+	}}
+	p, tx, inflight := newTestConfirmationsProcessor(chain)
+
+	reorged, err := p.waitForConfirmations(inflight, tx, 2, 1*time.Millisecond)
+	assert.NoError(err)
+	assert.Equal([]string{testConfirmBlockA}, reorged)
+	assert.Equal(testConfirmBlockB, tx.Receipt.BlockHash.String())
+}
+
+func TestWaitForConfirmationsReorgedOut(t *testing.T) {
+	assert := assert.New(t)
+	chain := &testChain{polls: []testChainPoll{
+		{head: 11},
+	}}
+	p, tx, inflight := newTestConfirmationsProcessor(chain)
+
+	reorged, err := p.waitForConfirmations(inflight, tx, 2, 1*time.Millisecond)
+	assert.EqualError(err, "Transaction was removed from block "+testConfirmBlockA+" by a chain re-org, and not mined again before the timeout")
+	assert.Equal([]string{testConfirmBlockA}, reorged)
+}
+
+func TestWaitForConfirmationsTimeout(t *testing.T) {
+	assert := assert.New(t)
+	chain := &testChain{polls: []testChainPoll{
+		{head: 10, blockNumber: 10, blockHash: testConfirmBlockA},
+	}}
+	p, tx, inflight := newTestConfirmationsProcessor(chain)
+
+	reorged, err := p.waitForConfirmations(inflight, tx, 5, 1*time.Millisecond)
+	assert.EqualError(err, "Transaction mined in block 10 did not reach 5 confirmations before the timeout")
+	assert.Empty(reorged)
+}
+
+func TestWaitForConfirmationsNoBlockHash(t *testing.T) {
+	assert := assert.New(t)
+	chain := &testChain{polls: []testChainPoll{
+		{head: 11, blockNumber: 10, blockHash: testConfirmBlockA},
+	}}
+	p, tx, inflight := newTestConfirmationsProcessor(chain)
+	tx.Receipt.BlockHash = nil
+
+	reorged, err := p.waitForConfirmations(inflight, tx, 2, 1*time.Millisecond)
+	assert.NoError(err)
+	assert.Empty(reorged)
+}
+
+func TestWaitForConfirmationsRPCErrors(t *testing.T) {
+	assert := assert.New(t)
+	p, tx, inflight := newTestConfirmationsProcessor(&testChain{})
+	rpc := eth.NewMockRPCClientForSync(fmt.Errorf("pop"), nil)
+	p.rpc = rpc
+
+	_, _, err := p.checkConfirmations(inflight.txnContext.Context(), tx)
+	assert.EqualError(err, "eth_blockNumber returned: pop")
+
+	reorged, err := p.waitForConfirmations(inflight, tx, 2, 1*time.Millisecond)
+	assert.EqualError(err, "Transaction mined in block 10 did not reach 2 confirmations before the timeout")
+	assert.Empty(reorged)
+}
+
+func TestCheckConfirmationsReceiptError(t *testing.T) {
+	assert := assert.New(t)
+	p, tx, inflight := newTestConfirmationsProcessor(&testChain{})
+	p.rpc = &testRPC{
+		ethBlockNumberResult:        10,
+		ethGetTransactionReceiptErr: fmt.Errorf("pop"),
+	}
+
+	_, _, err := p.checkConfirmations(inflight.txnContext.Context(), tx)
+	assert.EqualError(err, "eth_getTransactionReceipt returned: pop")
+}
+
+func TestOnSendTransactionMessageConfirmed(t *testing.T) {
+	assert := assert.New(t)
+
+	txnProcessor := NewTxnProcessor(&TxnProcessorConf{
+		MaxTXWaitTime: 1,
+	}, &eth.RPCConf{}).(*txnProcessor)
+	testTxnContext := &testTxnContext{}
+	testTxnContext.jsonMsg = strings.Replace(goodSendTxnJSON, `"type": "SendTransaction"`, `"type": "SendTransaction", "confirmations": 3`, 1)
+	testRPC := goodMessageRPC()
+	testRPC.ethBlockNumberResult = 12347
+	txnProcessor.Init(testRPC)
+	txnProcessor.maxTXWaitTime = 250 * time.Millisecond
+
+	txnProcessor.OnMessage(testTxnContext)
+	for inMap := false; !inMap; _, inMap = txnProcessor.inflightTxns[strings.ToLower(testFromAddr)] {
+		time.Sleep(1 * time.Millisecond)
+	}
+	txnWG := &txnProcessor.inflightTxns[strings.ToLower(testFromAddr)].txnsInFlight[0].wg
+	txnWG.Wait()
+	assert.Equal(0, len(testTxnContext.errorReplies))
+
+	assert.Equal("eth_blockNumber", testRPC.calls[2])
+	replyMsg := testTxnContext.replies[0]
+	assert.Equal("TransactionSuccess", replyMsg.ReplyHeaders().MsgType)
+	replyMsgBytes, _ := json.Marshal(&replyMsg)
+	var replyMsgMap map[string]interface{}
+	json.Unmarshal(replyMsgBytes, &replyMsgMap)
+	assert.Equal("3", replyMsgMap["confirmations"])
+	assert.Nil(replyMsgMap["reorgedBlocks"])
+}
+
+func TestOnSendTransactionMessageUnconfirmed(t *testing.T) {
+	assert := assert.New(t)
+
+	txnProcessor := NewTxnProcessor(&TxnProcessorConf{
+		MaxTXWaitTime: 1,
+	}, &eth.RPCConf{}).(*txnProcessor)
+	testTxnContext := &testTxnContext{}
+	testTxnContext.jsonMsg = strings.Replace(goodSendTxnJSON, `"type": "SendTransaction"`, `"type": "SendTransaction", "confirmations": 10`, 1)
+	testRPC := goodMessageRPC()
+	testRPC.ethBlockNumberResult = 12346
+	txnProcessor.Init(testRPC)
+	txnProcessor.maxTXWaitTime = 250 * time.Millisecond
+
+	txnProcessor.OnMessage(testTxnContext)
+	for inMap := false; !inMap; _, inMap = txnProcessor.inflightTxns[strings.ToLower(testFromAddr)] {
+		time.Sleep(1 * time.Millisecond)
+	}
+	txnWG := &txnProcessor.inflightTxns[strings.ToLower(testFromAddr)].txnsInFlight[0].wg
+	txnWG.Wait()
+	assert.Equal(0, len(testTxnContext.replies))
+	assert.Equal(1, len(testTxnContext.errorReplies))
+	assert.Equal(408, testTxnContext.errorReplies[0].status)
+	assert.Regexp("did not reach 10 confirmations", testTxnContext.errorReplies[0].err)
+	assert.Equal(testRPC.ethSendTransactionResult, testTxnContext.errorReplies[0].txHash)
+}
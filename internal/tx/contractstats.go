@@ -0,0 +1,223 @@
+// Copyright 2021 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tx
+
+import (
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kaleido-io/ethconnect/internal/eth"
+	"github.com/kaleido-io/ethconnect/internal/metrics"
+)
+
+const (
+	defaultContractStatsWindowSec  = 3600
+	defaultContractStatsMaxSamples = 1000
+
+	contractOutcomeSuccess  = "success"
+	contractOutcomeReverted = "reverted"
+	contractOutcomeFailed   = "failed"
+)
+
+// contractGasBuckets are the upper bounds of the gas used histogram, from a simple
+// transfer up to a large part of a typical block gas limit
+var contractGasBuckets = []float64{21000, 50000, 100000, 200000, 500000, 1000000, 2000000, 5000000, 10000000}
+
+// ContractStatsConf enables the tracking of the transactions sent to each contract method
+type ContractStatsConf struct {
+	Enabled    bool `json:"enabled"`
+	WindowSec  int  `json:"windowSec,omitempty"`
+	MaxSamples int  `json:"maxSamples,omitempty"`
+}
+
+// GasUsedStats are percentiles of the gas used by the mined transactions of a method
+type GasUsedStats struct {
+	P50 uint64 `json:"p50"`
+	P90 uint64 `json:"p90"`
+	P99 uint64 `json:"p99"`
+}
+
+// ContractMethodStats summarizes the transactions sent to a method within the window
+type ContractMethodStats struct {
+	Invocations  int           `json:"invocations"`
+	Succeeded    int           `json:"succeeded"`
+	Reverted     int           `json:"reverted"`
+	Failed       int           `json:"failed"`
+	SuccessRatio float64       `json:"successRatio"`
+	GasUsed      *GasUsedStats `json:"gasUsed,omitempty"`
+}
+
+// ContractStats is returned on /contracts/:address/stats
+type ContractStats struct {
+	Address   string                          `json:"address"`
+	WindowSec int                             `json:"windowSec"`
+	Methods   map[string]*ContractMethodStats `json:"methods"`
+}
+
+type contractInvocation struct {
+	time    time.Time
+	outcome string
+	gasUsed uint64
+}
+
+// contractStats keeps the most recent invocations of each method of each contract, to
+// summarize over a rolling window. The totals are also exposed as Prometheus metrics.
+type contractStats struct {
+	conf        *ContractStatsConf
+	window      time.Duration
+	lock        sync.Mutex
+	invocations map[string]map[string][]*contractInvocation
+	outcomes    *metrics.CounterVec
+	gasUsed     *metrics.HistogramVec
+}
+
+func newContractStats(conf *ContractStatsConf) *contractStats {
+	if !conf.Enabled {
+		return nil
+	}
+	if conf.WindowSec <= 0 {
+		conf.WindowSec = defaultContractStatsWindowSec
+	}
+	if conf.MaxSamples <= 0 {
+		conf.MaxSamples = defaultContractStatsMaxSamples
+	}
+	return &contractStats{
+		conf:        conf,
+		window:      time.Duration(conf.WindowSec) * time.Second,
+		invocations: make(map[string]map[string][]*contractInvocation),
+		outcomes: metrics.NewCounterVec(
+			"ethconnect_contract_invocations_total",
+			"Transactions sent to contract methods, by outcome",
+			"contract", "method", "outcome",
+		),
+		gasUsed: metrics.NewHistogramVec(
+			"ethconnect_contract_gas_used",
+			"Gas used by mined transactions sent to contract methods",
+			contractGasBuckets,
+			"contract", "method",
+		),
+	}
+}
+
+// record adds an invocation of a method, if the transaction is to a contract method.
+// The gas used is only recorded for mined transactions
+func (s *contractStats) record(tx *eth.Txn, outcome string) {
+	if s == nil || tx == nil || tx.EthTX == nil || tx.EthTX.To() == nil || tx.MethodName == "" {
+		return
+	}
+	contract := strings.ToLower(tx.EthTX.To().Hex())
+	invocation := &contractInvocation{
+		time:    time.Now().UTC(),
+		outcome: outcome,
+	}
+	if outcome != contractOutcomeFailed && tx.Receipt.GasUsed != nil {
+		invocation.gasUsed = tx.Receipt.GasUsed.ToInt().Uint64()
+		s.gasUsed.Observe(float64(invocation.gasUsed), contract, tx.MethodName)
+	}
+	s.outcomes.Inc(contract, tx.MethodName, outcome)
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	methods, exists := s.invocations[contract]
+	if !exists {
+		methods = make(map[string][]*contractInvocation)
+		s.invocations[contract] = methods
+	}
+	samples := append(inWindow(methods[tx.MethodName], invocation.time.Add(-s.window)), invocation)
+	if len(samples) > s.conf.MaxSamples {
+		samples = samples[len(samples)-s.conf.MaxSamples:]
+	}
+	methods[tx.MethodName] = samples
+}
+
+// inWindow trims the invocations before the cutoff, which are in time order
+func inWindow(samples []*contractInvocation, cutoff time.Time) []*contractInvocation {
+	start := sort.Search(len(samples), func(i int) bool { return samples[i].time.After(cutoff) })
+	return samples[start:]
+}
+
+// gasPercentile returns the nearest-rank percentile of sorted values
+func gasPercentile(sorted []uint64, p float64) uint64 {
+	rank := int(math.Ceil(p*float64(len(sorted)))) - 1
+	if rank < 0 {
+		rank = 0
+	}
+	return sorted[rank]
+}
+
+// stats summarizes the invocations of a contract within the window, discarding older ones
+func (s *contractStats) stats(address string) *ContractStats {
+	address = strings.ToLower(address)
+	result := &ContractStats{
+		Address:   address,
+		WindowSec: s.conf.WindowSec,
+		Methods:   make(map[string]*ContractMethodStats),
+	}
+	cutoff := time.Now().UTC().Add(-s.window)
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	methods := s.invocations[address]
+	for method, samples := range methods {
+		samples = inWindow(samples, cutoff)
+		if len(samples) == 0 {
+			delete(methods, method)
+			continue
+		}
+		methods[method] = samples
+
+		ms := &ContractMethodStats{Invocations: len(samples)}
+		var gasUsed []uint64
+		for _, invocation := range samples {
+			switch invocation.outcome {
+			case contractOutcomeSuccess:
+				ms.Succeeded++
+			case contractOutcomeReverted:
+				ms.Reverted++
+			default:
+				ms.Failed++
+			}
+			if invocation.gasUsed > 0 {
+				gasUsed = append(gasUsed, invocation.gasUsed)
+			}
+		}
+		ms.SuccessRatio = float64(ms.Succeeded) / float64(ms.Invocations)
+		if len(gasUsed) > 0 {
+			sort.Slice(gasUsed, func(i, j int) bool { return gasUsed[i] < gasUsed[j] })
+			ms.GasUsed = &GasUsedStats{
+				P50: gasPercentile(gasUsed, 0.5),
+				P90: gasPercentile(gasUsed, 0.9),
+				P99: gasPercentile(gasUsed, 0.99),
+			}
+		}
+		result.Methods[method] = ms
+	}
+	if methods != nil && len(methods) == 0 {
+		delete(s.invocations, address)
+	}
+	return result
+}
+
+// ContractStats returns the invocations of the methods of a contract over the rolling window,
+// or nil if contract stats are not enabled
+func (p *txnProcessor) ContractStats(address string) *ContractStats {
+	if p.contractStats == nil {
+		return nil
+	}
+	return p.contractStats.stats(address)
+}
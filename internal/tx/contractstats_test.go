@@ -0,0 +1,153 @@
+// Copyright 2021 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tx
+
+import (
+	"fmt"
+	"math/big"
+	"testing"
+	"time"
+
+	ethbinding "github.com/kaleido-io/ethbinding/pkg"
+	"github.com/kaleido-io/ethconnect/internal/eth"
+	"github.com/kaleido-io/ethconnect/internal/ethbind"
+	"github.com/stretchr/testify/assert"
+)
+
+const testStatsContract = "0x2b8c0ecc76d0759a8f50b2e14a6881367d805832"
+
+func newTestStatsTxn(method string, gasUsed int64) *eth.Txn {
+	tx := &eth.Txn{
+		MethodName: method,
+		EthTX:      ethbind.API.NewTransaction(0, ethbind.API.HexToAddress(testStatsContract), big.NewInt(0), 0, big.NewInt(0), []byte{}),
+	}
+	if gasUsed > 0 {
+		tx.Receipt.GasUsed = (*ethbinding.HexBigInt)(big.NewInt(gasUsed))
+	}
+	return tx
+}
+
+func TestContractStatsDisabled(t *testing.T) {
+	assert := assert.New(t)
+
+	s := newContractStats(&ContractStatsConf{})
+	assert.Nil(s)
+	s.record(newTestStatsTxn("set", 1000), contractOutcomeSuccess)
+
+	p := NewTxnProcessor(&TxnProcessorConf{}, &eth.RPCConf{})
+	assert.Nil(p.ContractStats(testStatsContract))
+}
+
+func TestContractStatsSummary(t *testing.T) {
+	assert := assert.New(t)
+
+	p := NewTxnProcessor(&TxnProcessorConf{
+		ContractStats: ContractStatsConf{Enabled: true},
+	}, &eth.RPCConf{}).(*txnProcessor)
+	s := p.contractStats
+	assert.Equal(defaultContractStatsWindowSec, s.conf.WindowSec)
+	assert.Equal(defaultContractStatsMaxSamples, s.conf.MaxSamples)
+
+	for i := int64(1); i <= 100; i++ {
+		s.record(newTestStatsTxn("set", i*1000), contractOutcomeSuccess)
+	}
+	s.record(newTestStatsTxn("set", 500000), contractOutcomeReverted)
+	s.record(newTestStatsTxn("set", 0), contractOutcomeFailed)
+	s.record(newTestStatsTxn("get", 30000), contractOutcomeSuccess)
+
+	// Deploys and transfers without a method are not recorded
+	s.record(newTestStatsTxn("", 21000), contractOutcomeSuccess)
+	s.record(&eth.Txn{MethodName: "constructor", EthTX: ethbind.API.NewContractCreation(0, big.NewInt(0), 0, big.NewInt(0), []byte{})}, contractOutcomeSuccess)
+
+	stats := p.ContractStats("0x2B8C0ECC76D0759A8F50B2E14A6881367D805832")
+	assert.Equal(testStatsContract, stats.Address)
+	assert.Equal(3600, stats.WindowSec)
+	assert.Equal(2, len(stats.Methods))
+
+	set := stats.Methods["set"]
+	assert.Equal(102, set.Invocations)
+	assert.Equal(100, set.Succeeded)
+	assert.Equal(1, set.Reverted)
+	assert.Equal(1, set.Failed)
+	assert.InDelta(0.98, set.SuccessRatio, 0.01)
+	assert.Equal(uint64(51000), set.GasUsed.P50)
+	assert.Equal(uint64(91000), set.GasUsed.P90)
+	assert.Equal(uint64(100000), set.GasUsed.P99)
+
+	get := stats.Methods["get"]
+	assert.Equal(1, get.Invocations)
+	assert.Equal(float64(1), get.SuccessRatio)
+	assert.Equal(uint64(30000), get.GasUsed.P99)
+
+	assert.Equal(uint64(100), s.outcomes.Value(testStatsContract, "set", contractOutcomeSuccess))
+	assert.Equal(uint64(1), s.outcomes.Value(testStatsContract, "set", contractOutcomeFailed))
+	assert.Equal(uint64(101), s.gasUsed.Aggregate("method")["set"].Count)
+
+	assert.Empty(p.ContractStats("0x0000000000000000000000000000000000000000").Methods)
+}
+
+func TestContractStatsWindow(t *testing.T) {
+	assert := assert.New(t)
+
+	s := newContractStats(&ContractStatsConf{Enabled: true, MaxSamples: 3})
+	for i := 0; i < 5; i++ {
+		s.record(newTestStatsTxn(fmt.Sprintf("m%d", i%2), 1000), contractOutcomeSuccess)
+	}
+	assert.Equal(3, len(s.invocations[testStatsContract]["m0"]))
+	assert.Equal(2, len(s.invocations[testStatsContract]["m1"]))
+
+	// Invocations outside of the window are discarded
+	for _, invocation := range s.invocations[testStatsContract]["m0"][0:2] {
+		invocation.time = invocation.time.Add(-2 * time.Hour)
+	}
+	for _, invocation := range s.invocations[testStatsContract]["m1"] {
+		invocation.time = invocation.time.Add(-2 * time.Hour)
+	}
+	stats := s.stats(testStatsContract)
+	assert.Equal(1, len(stats.Methods))
+	assert.Equal(1, stats.Methods["m0"].Invocations)
+
+	s.invocations[testStatsContract]["m0"][0].time = time.Now().Add(-2 * time.Hour)
+	assert.Empty(s.stats(testStatsContract).Methods)
+	assert.Empty(s.invocations)
+}
+
+func TestOnSendTransactionMessageRecordsContractStats(t *testing.T) {
+	assert := assert.New(t)
+
+	p := NewTxnProcessor(&TxnProcessorConf{
+		MaxTXWaitTime: 1,
+		ContractStats: ContractStatsConf{Enabled: true},
+	}, &eth.RPCConf{}).(*txnProcessor)
+	testRPC := goodMessageRPC()
+	p.Init(testRPC)
+
+	testTxnContext := &testTxnContext{}
+	testTxnContext.jsonMsg = "{" +
+		"  \"headers\":{\"type\": \"SendTransaction\"}," +
+		"  \"from\":\"" + testFromAddr + "\"," +
+		"  \"to\":\"" + testStatsContract + "\"," +
+		"  \"gas\":\"123\"," +
+		"  \"method\":{\"name\":\"set\"}" +
+		"}"
+	p.OnMessage(testTxnContext)
+	for len(testTxnContext.replies) == 0 && len(testTxnContext.errorReplies) == 0 {
+		time.Sleep(1 * time.Millisecond)
+	}
+
+	stats := p.ContractStats(testStatsContract)
+	assert.Equal(1, stats.Methods["set"].Succeeded)
+	assert.Equal(uint64(345678), stats.Methods["set"].GasUsed.P50)
+}
@@ -0,0 +1,402 @@
+// Copyright 2021 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tx
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/kaleido-io/ethconnect/internal/errors"
+	"github.com/kaleido-io/ethconnect/internal/eth"
+	"github.com/kaleido-io/ethconnect/internal/ethbind"
+	"github.com/kaleido-io/ethconnect/internal/kvstore"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// KeystoreAccountsPath is the REST path to create and list the accounts of the local keystore
+	KeystoreAccountsPath     = "/keystore/accounts"
+	keystoreAccountPrefix    = "keystore/accounts/"
+	keystoreAccountPrefixEnd = "keystore/accounts0"
+	defaultKeystoreBasePath  = "m/44'/60'/0'/0"
+)
+
+var (
+	keystoreIndexMatcher = regexp.MustCompile(`^local-(\d+)$`)
+	keystorePathMatcher  = regexp.MustCompile(`^m(/\d+['h]?)+$`)
+)
+
+// LocalKeystoreConf configures the built-in HD wallet, which derives signing keys (BIP-32/44)
+// from the seed of a BIP-39 mnemonic. The mnemonic and optional passphrase are read from files,
+// so they can be mounted as secrets
+type LocalKeystoreConf struct {
+	MnemonicFile   string `json:"mnemonicFile"`
+	PassphraseFile string `json:"passphraseFile,omitempty"`
+	// BasePath is the path that 'local-<index>' accounts are derived under. Defaults to m/44'/60'/0'/0
+	BasePath string `json:"basePath,omitempty"`
+	ChainID  string `json:"chainID"`
+	// DB is a KV store connection string to persist created accounts. They are held in memory if not set
+	DB string `json:"db,omitempty"`
+}
+
+// KeystoreRequest is extracted from a 'from' of the form 'local-<index>', which is an index
+// under the base path, or a full derivation path such as m/44'/60'/0'/0/1
+type KeystoreRequest struct {
+	Index string
+	Path  string
+}
+
+// KeystoreAccount is an account created in the local keystore. The address of an account
+// can be used as a 'from' to sign with its key, in the same way as the index or path
+type KeystoreAccount struct {
+	Address     string  `json:"address"`
+	Path        string  `json:"path"`
+	Index       *uint32 `json:"index,omitempty"`
+	Description string  `json:"description,omitempty"`
+	Created     string  `json:"created"`
+}
+
+type keystoreAccountRequest struct {
+	Index       *uint32 `json:"index"`
+	Path        string  `json:"path"`
+	Description string  `json:"description"`
+}
+
+// IsKeystoreRequest validates a from address to see if it is a local keystore signing request
+func IsKeystoreRequest(from string) *KeystoreRequest {
+	if match := keystoreIndexMatcher.FindStringSubmatch(from); match != nil {
+		return &KeystoreRequest{Index: match[1]}
+	}
+	if keystorePathMatcher.MatchString(from) {
+		return &KeystoreRequest{Path: from}
+	}
+	return nil
+}
+
+// keystoreSigner signs in the same way as the remote HD wallet, with a locally derived key
+type keystoreSigner struct {
+	hdwalletSigner
+}
+
+func (s *keystoreSigner) Type() string {
+	return "Local HD Wallet"
+}
+
+// localKeystore holds the seed in memory, and the signers derived from it by path
+type localKeystore struct {
+	conf      *LocalKeystoreConf
+	db        kvstore.KVStore
+	seed      []byte
+	chainID   big.Int
+	mux       sync.Mutex
+	signers   map[string]*keystoreSigner
+	accounts  map[string]*KeystoreAccount
+	byAddress map[string]*KeystoreAccount
+}
+
+func newLocalKeystore(conf *LocalKeystoreConf) *localKeystore {
+	if conf.BasePath == "" {
+		conf.BasePath = defaultKeystoreBasePath
+	}
+	ks := &localKeystore{
+		conf:      conf,
+		signers:   make(map[string]*keystoreSigner),
+		accounts:  make(map[string]*KeystoreAccount),
+		byAddress: make(map[string]*KeystoreAccount),
+	}
+	ks.chainID.SetString(conf.ChainID, 0)
+	return ks
+}
+
+func (ks *localKeystore) enabled() bool {
+	return ks.seed != nil
+}
+
+func (ks *localKeystore) init() (err error) {
+	if ks.conf.MnemonicFile == "" {
+		return nil
+	}
+	if _, err = parseDerivationPath(ks.conf.BasePath); err != nil {
+		return err
+	}
+	mnemonic, err := ioutil.ReadFile(ks.conf.MnemonicFile)
+	if err != nil {
+		return errors.Errorf(errors.KeystoreLoadFailed, err)
+	}
+	var passphrase []byte
+	if ks.conf.PassphraseFile != "" {
+		if passphrase, err = ioutil.ReadFile(ks.conf.PassphraseFile); err != nil {
+			return errors.Errorf(errors.KeystoreLoadFailed, err)
+		}
+	}
+	seed, err := bip39Seed(string(mnemonic), strings.TrimRight(string(passphrase), "\r\n"))
+	if err != nil {
+		return err
+	}
+	if ks.conf.DB != "" {
+		if ks.db, err = kvstore.NewKeyValueStore(ks.conf.DB); err != nil {
+			return err
+		}
+	} else {
+		ks.db = kvstore.NewMemoryKeyValueStore()
+	}
+
+	ks.mux.Lock()
+	defer ks.mux.Unlock()
+	ks.seed = seed
+	it := ks.db.NewIteratorWithRange(&kvstore.KVRange{Start: keystoreAccountPrefix, Limit: keystoreAccountPrefixEnd})
+	defer it.Release()
+	for it.Next() {
+		var account KeystoreAccount
+		if err := json.Unmarshal(it.Value(), &account); err != nil {
+			log.Errorf("Failed to load keystore account '%s': %s", it.Key(), err)
+			continue
+		}
+		// Accounts stored against a different mnemonic would sign from the wrong address
+		signer, err := ks.signerForPath(account.Path)
+		if err == nil && strings.ToLower(signer.Address()) != account.Address {
+			err = errors.Errorf(errors.KeystoreAccountMismatch, account.Path, strings.ToLower(signer.Address()), account.Address)
+		}
+		if err != nil {
+			log.Errorf("Failed to load keystore account '%s': %s", it.Key(), err)
+			continue
+		}
+		ks.accounts[account.Path] = &account
+		ks.byAddress[account.Address] = &account
+	}
+	log.Infof("Local keystore loaded with %d accounts", len(ks.accounts))
+	return nil
+}
+
+// signerForPath must be called holding the mutex. Derived keys are cached, as every
+// transaction from the account needs one
+func (ks *localKeystore) signerForPath(path string) (*keystoreSigner, error) {
+	if signer, ok := ks.signers[path]; ok {
+		return signer, nil
+	}
+	key, err := derivePrivateKey(ks.seed, path)
+	if err != nil {
+		return nil, err
+	}
+	signer := &keystoreSigner{hdwalletSigner{
+		address: ethbind.API.PubkeyToAddress(key.PublicKey),
+		key:     key,
+		chainID: &ks.chainID,
+	}}
+	ks.signers[path] = signer
+	return signer, nil
+}
+
+// canonicalPath resolves an index against the base path, and normalizes the hardened markers,
+// so that each key has one path in the cache of signers and the created accounts
+func (ks *localKeystore) canonicalPath(request *KeystoreRequest) (string, error) {
+	path := request.Path
+	if path == "" {
+		path = ks.conf.BasePath + "/" + request.Index
+	}
+	indexes, err := parseDerivationPath(path)
+	if err != nil {
+		return "", err
+	}
+	return formatDerivationPath(indexes), nil
+}
+
+// SignerFor returns the signer for the index or path in the request. Accounts do not need
+// to be created before they are used, as every key is derived from the seed
+func (ks *localKeystore) SignerFor(request *KeystoreRequest) (eth.TXSigner, error) {
+	if !ks.enabled() {
+		return nil, errors.Errorf(errors.KeystoreNotConfigured)
+	}
+	path, err := ks.canonicalPath(request)
+	if err != nil {
+		return nil, err
+	}
+	ks.mux.Lock()
+	defer ks.mux.Unlock()
+	signer, err := ks.signerForPath(path)
+	if err != nil {
+		return nil, err
+	}
+	return signer, nil
+}
+
+// signerForAddress returns the signer for the address of a created account, or nil if the
+// address is not one of the keystore accounts
+func (ks *localKeystore) signerForAddress(from string) eth.TXSigner {
+	if !ks.enabled() {
+		return nil
+	}
+	address := "0x" + strings.TrimPrefix(strings.ToLower(from), "0x")
+	ks.mux.Lock()
+	defer ks.mux.Unlock()
+	account, ok := ks.byAddress[address]
+	if !ok {
+		return nil
+	}
+	signer, err := ks.signerForPath(account.Path)
+	if err != nil {
+		return nil
+	}
+	return signer
+}
+
+// nextIndex must be called holding the mutex. It is one after the highest index of the
+// accounts created under the base path
+func (ks *localKeystore) nextIndex() uint32 {
+	next := uint32(0)
+	for _, account := range ks.accounts {
+		if account.Index != nil && *account.Index >= next {
+			next = *account.Index + 1
+		}
+	}
+	return next
+}
+
+func (ks *localKeystore) createAccount(req *keystoreAccountRequest) (*KeystoreAccount, int, error) {
+	if !ks.enabled() {
+		return nil, 405, errors.Errorf(errors.KeystoreNotConfigured)
+	}
+	ks.mux.Lock()
+	defer ks.mux.Unlock()
+	account := &KeystoreAccount{
+		Path:        req.Path,
+		Index:       req.Index,
+		Description: req.Description,
+	}
+	if account.Path != "" && account.Index != nil {
+		return nil, 400, errors.Errorf(errors.KeystoreInvalidRequest, "only one of 'index' and 'path' can be supplied")
+	}
+	request := &KeystoreRequest{Path: account.Path}
+	if account.Path == "" {
+		if account.Index == nil {
+			next := ks.nextIndex()
+			account.Index = &next
+		}
+		request = &KeystoreRequest{Index: strconv.FormatUint(uint64(*account.Index), 10)}
+	}
+	var err error
+	if account.Path, err = ks.canonicalPath(request); err != nil {
+		return nil, 400, err
+	}
+	if _, exists := ks.accounts[account.Path]; exists {
+		return nil, 409, errors.Errorf(errors.KeystoreAccountExists, account.Path)
+	}
+	signer, err := ks.signerForPath(account.Path)
+	if err != nil {
+		return nil, 400, err
+	}
+	account.Address = strings.ToLower(signer.Address())
+	account.Created = time.Now().UTC().Format(time.RFC3339)
+	b, _ := json.Marshal(account)
+	if err := ks.db.Put(keystoreAccountPrefix+account.Address, b); err != nil {
+		return nil, 500, errors.Errorf(errors.KeystoreStoreFailed, account.Path, err)
+	}
+	ks.accounts[account.Path] = account
+	ks.byAddress[account.Address] = account
+	log.Infof("Created keystore account %s at %s", account.Address, account.Path)
+	return account, 201, nil
+}
+
+func (ks *localKeystore) list() []*KeystoreAccount {
+	ks.mux.Lock()
+	defer ks.mux.Unlock()
+	accounts := make([]*KeystoreAccount, 0, len(ks.accounts))
+	for _, account := range ks.accounts {
+		accounts = append(accounts, account)
+	}
+	sort.Slice(accounts, func(i, j int) bool {
+		return accounts[i].Created+accounts[i].Path < accounts[j].Created+accounts[j].Path
+	})
+	return accounts
+}
+
+func (ks *localKeystore) get(address string) (*KeystoreAccount, error) {
+	address = "0x" + strings.TrimPrefix(strings.ToLower(address), "0x")
+	ks.mux.Lock()
+	defer ks.mux.Unlock()
+	account, ok := ks.byAddress[address]
+	if !ok {
+		return nil, errors.Errorf(errors.KeystoreAccountNotFound, address)
+	}
+	return account, nil
+}
+
+func (ks *localKeystore) addRoutes(router *httprouter.Router) {
+	router.GET(KeystoreAccountsPath, ks.listHandler)
+	router.POST(KeystoreAccountsPath, ks.createHandler)
+	router.GET(KeystoreAccountsPath+"/:address", ks.getHandler)
+}
+
+func (ks *localKeystore) listHandler(res http.ResponseWriter, req *http.Request, params httprouter.Params) {
+	log.Infof("--> %s %s", req.Method, req.URL)
+	if !ks.enabled() {
+		ks.errReply(res, req, errors.Errorf(errors.KeystoreNotConfigured), 405)
+		return
+	}
+	ks.reply(res, req, 200, ks.list())
+}
+
+func (ks *localKeystore) getHandler(res http.ResponseWriter, req *http.Request, params httprouter.Params) {
+	log.Infof("--> %s %s", req.Method, req.URL)
+	account, err := ks.get(params.ByName("address"))
+	if err != nil {
+		ks.errReply(res, req, err, 404)
+		return
+	}
+	ks.reply(res, req, 200, account)
+}
+
+func (ks *localKeystore) createHandler(res http.ResponseWriter, req *http.Request, params httprouter.Params) {
+	log.Infof("--> %s %s", req.Method, req.URL)
+	var accountReq keystoreAccountRequest
+	if req.ContentLength != 0 {
+		if err := json.NewDecoder(req.Body).Decode(&accountReq); err != nil {
+			ks.errReply(res, req, errors.Errorf(errors.KeystoreInvalidRequest, err), 400)
+			return
+		}
+	}
+	account, status, err := ks.createAccount(&accountReq)
+	if err != nil {
+		ks.errReply(res, req, err, status)
+		return
+	}
+	ks.reply(res, req, status, account)
+}
+
+func (ks *localKeystore) reply(res http.ResponseWriter, req *http.Request, status int, body interface{}) {
+	log.Infof("<-- %s %s [%d]", req.Method, req.URL, status)
+	res.Header().Set("Content-Type", "application/json")
+	res.WriteHeader(status)
+	enc := json.NewEncoder(res)
+	enc.SetIndent("", "  ")
+	enc.Encode(body)
+}
+
+func (ks *localKeystore) errReply(res http.ResponseWriter, req *http.Request, err error, status int) {
+	log.Errorf("<-- %s %s [%d]: %s", req.Method, req.URL, status, err)
+	reply, _ := json.Marshal(&errMsg{Message: err.Error()})
+	res.Header().Set("Content-Type", "application/json")
+	res.WriteHeader(status)
+	res.Write(reply)
+}
@@ -0,0 +1,230 @@
+// Copyright 2021 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tx
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/kaleido-io/ethconnect/internal/ethbind"
+	"github.com/stretchr/testify/assert"
+)
+
+// The well-known development mnemonic, and the first two addresses derived from it
+const (
+	testKeystoreMnemonic = "test test test test test test test test test test test junk"
+	testKeystoreAddr0    = "0xf39fd6e51aad88f6f4ce6ab8827279cfffb92266"
+	testKeystoreAddr1    = "0x70997970c51812dc3a010c7d01b50e0d17dc79c8"
+)
+
+func newTestKeystore(t *testing.T, dir string, conf *LocalKeystoreConf) (*localKeystore, *httprouter.Router) {
+	conf.MnemonicFile = path.Join(dir, "mnemonic")
+	ioutil.WriteFile(conf.MnemonicFile, []byte(testKeystoreMnemonic+"\n"), 0600)
+	conf.ChainID = "1337"
+	ks := newLocalKeystore(conf)
+	assert.NoError(t, ks.init())
+	router := &httprouter.Router{}
+	ks.addRoutes(router)
+	return ks, router
+}
+
+func TestIsKeystoreRequest(t *testing.T) {
+	assert := assert.New(t)
+	assert.Equal(&KeystoreRequest{Index: "12"}, IsKeystoreRequest("local-12"))
+	assert.Equal(&KeystoreRequest{Path: "m/44'/60'/0'/0/1"}, IsKeystoreRequest("m/44'/60'/0'/0/1"))
+	assert.Nil(IsKeystoreRequest("local-"))
+	assert.Nil(IsKeystoreRequest("local-x"))
+	assert.Nil(IsKeystoreRequest("m/"))
+	assert.Nil(IsKeystoreRequest(testKeystoreAddr0))
+	assert.False(IsAliasName("local-1"))
+	assert.True(IsAliasName("local"))
+}
+
+func TestKeystoreSignerFor(t *testing.T) {
+	assert := assert.New(t)
+	dir, _ := ioutil.TempDir("", "keystore")
+	defer os.RemoveAll(dir)
+	ks, _ := newTestKeystore(t, dir, &LocalKeystoreConf{})
+
+	signer, err := ks.SignerFor(&KeystoreRequest{Index: "0"})
+	assert.NoError(err)
+	assert.Equal("Local HD Wallet", signer.Type())
+	assert.Equal(ethbind.API.HexToAddress(testKeystoreAddr0).Hex(), signer.Address())
+	signer, err = ks.SignerFor(&KeystoreRequest{Path: "m/44h/60h/0h/0/1"})
+	assert.NoError(err)
+	assert.Equal(ethbind.API.HexToAddress(testKeystoreAddr1).Hex(), signer.Address())
+	// The same key is cached under the canonical path
+	assert.Equal(signer, ks.signers["m/44'/60'/0'/0/1"])
+
+	tx := ethbind.API.NewContractCreation(0, big.NewInt(0), 21000, big.NewInt(0), []byte{})
+	signed, err := signer.Sign(tx)
+	assert.NoError(err)
+	assert.NotEmpty(signed)
+
+	_, err = ks.SignerFor(&KeystoreRequest{Path: "m/2147483648"})
+	assert.Regexp("Invalid derivation path", err)
+}
+
+func TestKeystoreNotConfigured(t *testing.T) {
+	assert := assert.New(t)
+	ks := newLocalKeystore(&LocalKeystoreConf{})
+	assert.NoError(ks.init())
+	router := &httprouter.Router{}
+	ks.addRoutes(router)
+
+	_, err := ks.SignerFor(&KeystoreRequest{Index: "0"})
+	assert.EqualError(err, "The local HD wallet keystore is not configured")
+	assert.Nil(ks.signerForAddress(testKeystoreAddr0))
+	status, _ := testAliasRequest(router, "POST", KeystoreAccountsPath, `{}`)
+	assert.Equal(405, status)
+	status, _ = testAliasRequest(router, "GET", KeystoreAccountsPath, "")
+	assert.Equal(405, status)
+
+	p := &txnProcessor{keystore: ks, remoteSigners: newRemoteSigners(&RemoteSignersConf{})}
+	_, err = p.ResolveAddress(context.Background(), "local-0")
+	assert.EqualError(err, "The local HD wallet keystore is not configured")
+}
+
+func TestKeystoreInitFail(t *testing.T) {
+	assert := assert.New(t)
+	dir, _ := ioutil.TempDir("", "keystore")
+	defer os.RemoveAll(dir)
+
+	ks := newLocalKeystore(&LocalKeystoreConf{MnemonicFile: path.Join(dir, "missing")})
+	assert.Regexp("Failed to load the keystore mnemonic", ks.init())
+
+	ioutil.WriteFile(path.Join(dir, "mnemonic"), []byte("too short"), 0600)
+	ks = newLocalKeystore(&LocalKeystoreConf{MnemonicFile: path.Join(dir, "mnemonic"), PassphraseFile: path.Join(dir, "missing")})
+	assert.Regexp("Failed to load the keystore mnemonic", ks.init())
+	ks = newLocalKeystore(&LocalKeystoreConf{MnemonicFile: path.Join(dir, "mnemonic")})
+	assert.Regexp("Invalid keystore mnemonic", ks.init())
+	ks = newLocalKeystore(&LocalKeystoreConf{MnemonicFile: path.Join(dir, "mnemonic"), BasePath: "44/60"})
+	assert.Regexp("Invalid derivation path '44/60'", ks.init())
+
+	ioutil.WriteFile(path.Join(dir, "mnemonic"), []byte(testKeystoreMnemonic), 0600)
+	ioutil.WriteFile(path.Join(dir, "db"), []byte{}, 0644)
+	ks = newLocalKeystore(&LocalKeystoreConf{MnemonicFile: path.Join(dir, "mnemonic"), DB: path.Join(dir, "db")})
+	assert.Error(ks.init())
+}
+
+func TestKeystoreAccountsAPI(t *testing.T) {
+	assert := assert.New(t)
+	dir, _ := ioutil.TempDir("", "keystore")
+	defer os.RemoveAll(dir)
+	_, router := newTestKeystore(t, dir, &LocalKeystoreConf{})
+
+	status, body := testAliasRequest(router, "POST", KeystoreAccountsPath, "")
+	assert.Equal(201, status)
+	var account KeystoreAccount
+	json.Unmarshal([]byte(body), &account)
+	assert.Equal(testKeystoreAddr0, account.Address)
+	assert.Equal("m/44'/60'/0'/0/0", account.Path)
+	assert.Equal(uint32(0), *account.Index)
+
+	status, body = testAliasRequest(router, "POST", KeystoreAccountsPath, `{"description":"second"}`)
+	assert.Equal(201, status)
+	json.Unmarshal([]byte(body), &account)
+	assert.Equal(testKeystoreAddr1, account.Address)
+	assert.Equal("second", account.Description)
+
+	status, body = testAliasRequest(router, "POST", KeystoreAccountsPath, `{"path":"m/44h/60h/0h/0/1"}`)
+	assert.Equal(409, status)
+	assert.Regexp("An account already exists for derivation path 'm/44'/60'/0'/0/1'", body)
+	status, body = testAliasRequest(router, "POST", KeystoreAccountsPath, `{"path":"m/1/2","index":1}`)
+	assert.Equal(400, status)
+	assert.Regexp("only one of 'index' and 'path'", body)
+	status, body = testAliasRequest(router, "POST", KeystoreAccountsPath, `{"path":"44/60"}`)
+	assert.Equal(400, status)
+	assert.Regexp("Invalid derivation path", body)
+	status, body = testAliasRequest(router, "POST", KeystoreAccountsPath, `!json`)
+	assert.Equal(400, status)
+	assert.Regexp("Invalid keystore account request", body)
+
+	status, body = testAliasRequest(router, "POST", KeystoreAccountsPath, `{"path":"m/44'/60'/1'/0/0"}`)
+	assert.Equal(201, status)
+	var pathAccount KeystoreAccount
+	json.Unmarshal([]byte(body), &pathAccount)
+	assert.Nil(pathAccount.Index)
+
+	var accounts []*KeystoreAccount
+	status, body = testAliasRequest(router, "GET", KeystoreAccountsPath, "")
+	assert.Equal(200, status)
+	json.Unmarshal([]byte(body), &accounts)
+	assert.Equal(3, len(accounts))
+
+	status, body = testAliasRequest(router, "GET", KeystoreAccountsPath+"/"+testKeystoreAddr1[2:], "")
+	assert.Equal(200, status)
+	json.Unmarshal([]byte(body), &account)
+	assert.Equal("second", account.Description)
+	status, _ = testAliasRequest(router, "GET", KeystoreAccountsPath+"/"+testAliasAddr, "")
+	assert.Equal(404, status)
+}
+
+func TestKeystoreResolveSigner(t *testing.T) {
+	assert := assert.New(t)
+	dir, _ := ioutil.TempDir("", "keystore")
+	defer os.RemoveAll(dir)
+	ks, _ := newTestKeystore(t, dir, &LocalKeystoreConf{})
+	p := &txnProcessor{keystore: ks, remoteSigners: newRemoteSigners(&RemoteSignersConf{}), aliases: newAliasManager(&IdentityAliasesConf{
+		Aliases: []*IdentityAlias{{Name: "treasury", Signer: "local-1", Tenants: []string{AliasAnyTenant}}},
+	})}
+	assert.NoError(p.aliases.init())
+
+	from, err := p.ResolveAddress(context.Background(), "local-0")
+	assert.NoError(err)
+	assert.Equal(ethbind.API.HexToAddress(testKeystoreAddr0).Hex(), from)
+	from, err = p.ResolveAddress(context.Background(), "treasury")
+	assert.NoError(err)
+	assert.Equal(ethbind.API.HexToAddress(testKeystoreAddr1).Hex(), from)
+
+	// Addresses are only signed locally once an account has been created for them
+	signer, err := p.resolveSigner(testKeystoreAddr0)
+	assert.NoError(err)
+	assert.Nil(signer)
+	_, _, err = ks.createAccount(&keystoreAccountRequest{})
+	assert.NoError(err)
+	signer, err = p.resolveSigner(testKeystoreAddr0[2:])
+	assert.NoError(err)
+	assert.Equal("Local HD Wallet", signer.Type())
+}
+
+func TestKeystoreInitPersisted(t *testing.T) {
+	assert := assert.New(t)
+	dir, _ := ioutil.TempDir("", "keystore")
+	defer os.RemoveAll(dir)
+	conf := &LocalKeystoreConf{DB: path.Join(dir, "db")}
+	ks, _ := newTestKeystore(t, dir, conf)
+	_, _, err := ks.createAccount(&keystoreAccountRequest{})
+	assert.NoError(err)
+	ks.db.Put(keystoreAccountPrefix+"bad", []byte("!json"))
+	ks.db.Put(keystoreAccountPrefix+"other", []byte(`{"address":"`+testAliasAddr+`","path":"m/44'/60'/0'/0/7"}`))
+
+	// Accounts are reloaded after a restart, apart from those of a different mnemonic
+	ks.db.Close()
+	ks, _ = newTestKeystore(t, dir, conf)
+	defer ks.db.Close()
+	assert.Equal(1, len(ks.list()))
+	assert.NotNil(ks.signerForAddress(testKeystoreAddr0))
+	assert.Nil(ks.signerForAddress(testAliasAddr))
+	_, status, err := ks.createAccount(&keystoreAccountRequest{})
+	assert.NoError(err)
+	assert.Equal(201, status)
+}
@@ -0,0 +1,143 @@
+// Copyright 2021 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tx
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/kaleido-io/ethconnect/internal/utils"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	kmsKeySpecSecp256k1 = "ECC_SECG_P256K1"
+)
+
+// KMSSignerConf configures signing with AWS KMS asymmetric keys with the ECC_SECG_P256K1 key
+// spec. If no credentials are configured, those available to the process are used, as for the AWS SDKs
+type KMSSignerConf struct {
+	Region          string `json:"region"`
+	Endpoint        string `json:"endpoint,omitempty"`
+	KeyID           string `json:"keyID"`
+	AccessKeyID     string `json:"accessKeyID,omitempty"`
+	SecretAccessKey string `json:"secretAccessKey,omitempty"`
+	SessionToken    string `json:"sessionToken,omitempty"`
+}
+
+// kmsClient calls the KMS JSON API directly, with Signature Version 4 request signing
+type kmsClient struct {
+	conf        *KMSSignerConf
+	endpoint    string
+	credentials *utils.AWSCredentialsProvider
+	client      *http.Client
+	now         func() time.Time
+}
+
+type kmsKey struct {
+	kms   *kmsClient
+	keyID string
+}
+
+func newKMSClient(conf *KMSSignerConf) *kmsClient {
+	k := &kmsClient{
+		conf:        conf,
+		endpoint:    conf.Endpoint,
+		credentials: utils.NewAWSCredentialsProvider(conf.AccessKeyID, conf.SecretAccessKey, conf.SessionToken),
+		client:      &http.Client{Transport: utils.EgressTransport(nil)},
+		now:         time.Now,
+	}
+	if k.endpoint == "" {
+		k.endpoint = fmt.Sprintf("https://kms.%s.amazonaws.com/", conf.Region)
+	}
+	return k
+}
+
+func (k *kmsClient) key(keyID string) *kmsKey {
+	return &kmsKey{kms: k, keyID: keyID}
+}
+
+// call invokes a KMS action, such as Sign, decoding the JSON response into the result
+func (k *kmsClient) call(action string, body, result interface{}) error {
+	creds, err := k.credentials.Credentials()
+	if err != nil {
+		return err
+	}
+	bodyBytes, _ := json.Marshal(body)
+	req, err := http.NewRequest("POST", k.endpoint, bytes.NewReader(bodyBytes))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	req.Header.Set("X-Amz-Target", "TrentService."+action)
+	utils.SignAWSRequest(req, bodyBytes, "kms", k.conf.Region, creds, k.now())
+	log.Infof("KMS %s -->", action)
+	res, err := k.client.Do(req)
+	if err != nil {
+		log.Errorf("KMS %s <-- !Failed: %s", action, err)
+		return err
+	}
+	defer res.Body.Close()
+	log.Infof("KMS %s <-- [%d]", action, res.StatusCode)
+	resBody, _ := ioutil.ReadAll(res.Body)
+	if res.StatusCode != 200 {
+		var kmsErr struct {
+			Type    string `json:"__type"`
+			Message string `json:"message"`
+		}
+		json.Unmarshal(resBody, &kmsErr)
+		return fmt.Errorf("[%d] %s %s", res.StatusCode, kmsErr.Type, kmsErr.Message)
+	}
+	return json.Unmarshal(resBody, result)
+}
+
+func (k *kmsKey) service() string {
+	return "AWS KMS"
+}
+
+func (k *kmsKey) name() string {
+	return k.keyID
+}
+
+func (k *kmsKey) publicKey() ([]byte, error) {
+	var res struct {
+		KeySpec   string `json:"KeySpec"`
+		PublicKey []byte `json:"PublicKey"`
+	}
+	if err := k.kms.call("GetPublicKey", map[string]string{"KeyId": k.keyID}, &res); err != nil {
+		return nil, err
+	}
+	if res.KeySpec != kmsKeySpecSecp256k1 {
+		return nil, fmt.Errorf("key spec is '%s', not %s", res.KeySpec, kmsKeySpecSecp256k1)
+	}
+	return res.PublicKey, nil
+}
+
+func (k *kmsKey) signDigest(digest []byte) ([]byte, error) {
+	var res struct {
+		Signature []byte `json:"Signature"`
+	}
+	err := k.kms.call("Sign", map[string]interface{}{
+		"KeyId":            k.keyID,
+		"Message":          digest,
+		"MessageType":      "DIGEST",
+		"SigningAlgorithm": "ECDSA_SHA_256",
+	}, &res)
+	return res.Signature, err
+}
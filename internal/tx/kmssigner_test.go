@@ -0,0 +1,142 @@
+// Copyright 2021 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tx
+
+import (
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/kaleido-io/ethconnect/internal/ethbind"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestKMSServer(t *testing.T, keySpec string) *httptest.Server {
+	key := newTestRemoteKey("alias/key1")
+	return httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		assert.Equal(t, "application/x-amz-json-1.1", req.Header.Get("Content-Type"))
+		assert.Regexp(t, "^AWS4-HMAC-SHA256 Credential=AKID/[0-9]{8}/eu-west-1/kms/aws4_request, SignedHeaders=content-type;host;x-amz-date;x-amz-security-token;x-amz-target, Signature=", req.Header.Get("Authorization"))
+		assert.Equal(t, "token1", req.Header.Get("X-Amz-Security-Token"))
+		var body struct {
+			KeyID            string `json:"KeyId"`
+			Message          []byte
+			MessageType      string
+			SigningAlgorithm string
+		}
+		json.NewDecoder(req.Body).Decode(&body)
+		res.Header().Set("Content-Type", "application/x-amz-json-1.1")
+		if body.KeyID != "alias/key1" {
+			res.WriteHeader(400)
+			res.Write([]byte(`{"__type":"NotFoundException","message":"Alias is not found."}`))
+			return
+		}
+		switch req.Header.Get("X-Amz-Target") {
+		case "TrentService.GetPublicKey":
+			json.NewEncoder(res).Encode(map[string]interface{}{
+				"KeyId":     body.KeyID,
+				"KeySpec":   keySpec,
+				"PublicKey": testSPKI(&key.key.PublicKey),
+			})
+		case "TrentService.Sign":
+			assert.Equal(t, "DIGEST", body.MessageType)
+			assert.Equal(t, "ECDSA_SHA_256", body.SigningAlgorithm)
+			json.NewEncoder(res).Encode(map[string]interface{}{
+				"KeyId":     body.KeyID,
+				"Signature": testSignDigest(key.key, body.Message, true),
+			})
+		default:
+			res.WriteHeader(400)
+			res.Write([]byte(`!json`))
+		}
+	}))
+}
+
+func newTestKMSSigners(t *testing.T, endpoint string) *remoteSigners {
+	rs := newRemoteSigners(&RemoteSignersConf{
+		ChainID: "1337",
+		Signers: []*RemoteSignerConf{{
+			From: "^0x(f39f).*$",
+			KMS: &KMSSignerConf{
+				Region:          "eu-west-1",
+				Endpoint:        endpoint,
+				KeyID:           "alias/key1",
+				AccessKeyID:     "AKID",
+				SecretAccessKey: "secret",
+				SessionToken:    "token1",
+			},
+		}},
+	})
+	assert.NoError(t, rs.init())
+	return rs
+}
+
+func TestKMSSignerSign(t *testing.T) {
+	assert := assert.New(t)
+	server := newTestKMSServer(t, kmsKeySpecSecp256k1)
+	defer server.Close()
+	rs := newTestKMSSigners(t, server.URL)
+
+	s, err := rs.signerFor(testKeystoreAddr0)
+	assert.NoError(err)
+	assert.Equal("AWS KMS", s.Type())
+	tx := ethbind.API.NewTransaction(0, ethbind.API.HexToAddress(testAliasAddr), big.NewInt(0), 21000, big.NewInt(0), []byte{})
+	signed, err := s.Sign(tx)
+	assert.NoError(err)
+	assert.Equal(s.Address(), testRemoteSignedSender(t, s.(*remoteSigner), signed))
+}
+
+func TestKMSSignerErrors(t *testing.T) {
+	assert := assert.New(t)
+	server := newTestKMSServer(t, "ECC_NIST_P256")
+	defer server.Close()
+	rs := newTestKMSSigners(t, server.URL)
+
+	_, err := rs.signerFor(testKeystoreAddr0)
+	assert.EqualError(err, "Failed to get the public key of AWS KMS key 'alias/key1': key spec is 'ECC_NIST_P256', not ECC_SECG_P256K1")
+
+	kms := rs.matchers[0].newKey(testKeystoreAddr0, nil).(*kmsKey)
+	kms.keyID = "alias/missing"
+	_, err = kms.signDigest(make([]byte, 32))
+	assert.EqualError(err, "[400] NotFoundException Alias is not found.")
+	err = kms.kms.call("Unknown", map[string]string{"KeyId": "alias/key1"}, nil)
+	assert.Regexp("\\[400\\]", err)
+
+	kms.kms.endpoint = "http://localhost:0"
+	_, err = kms.publicKey()
+	assert.Error(err)
+	kms.kms.endpoint = "!bad\x00url"
+	_, err = kms.publicKey()
+	assert.Error(err)
+}
+
+func TestKMSClientDefaults(t *testing.T) {
+	assert := assert.New(t)
+	os.Setenv("AWS_ACCESS_KEY_ID", "AKIDENV")
+	os.Setenv("AWS_SECRET_ACCESS_KEY", "secretenv")
+	defer os.Unsetenv("AWS_ACCESS_KEY_ID")
+	defer os.Unsetenv("AWS_SECRET_ACCESS_KEY")
+
+	kms := newKMSClient(&KMSSignerConf{Region: "us-east-2"})
+	assert.Equal("https://kms.us-east-2.amazonaws.com/", kms.endpoint)
+	creds, err := kms.credentials.Credentials()
+	assert.NoError(err)
+	assert.Equal("AKIDENV", creds.AccessKeyID)
+	assert.Equal("secretenv", creds.SecretAccessKey)
+	assert.True(strings.HasSuffix(kms.key("alias/key1").name(), "key1"))
+}
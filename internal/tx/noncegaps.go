@@ -0,0 +1,287 @@
+// Copyright 2021 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tx
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	ethbinding "github.com/kaleido-io/ethbinding/pkg"
+	"github.com/kaleido-io/ethconnect/internal/errors"
+	"github.com/kaleido-io/ethconnect/internal/eth"
+	"github.com/kaleido-io/ethconnect/internal/utils"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// NonceGapsPath is the admin path that fills the nonce gaps blocking the queue of an address
+	NonceGapsPath = "/admin/nonces/:address/fill-gaps"
+)
+
+// NonceGapFillRequest is the optional body of a request to fill nonce gaps. Without a body the
+// gaps below the highest nonce in-flight are filled. Nonces lists the nonces to fill explicitly,
+// and UpTo fills every nonce from the pending count up to (not including) the one supplied, which
+// covers transactions queued in the node by another client
+type NonceGapFillRequest struct {
+	Nonces []json.Number `json:"nonces,omitempty"`
+	UpTo   json.Number   `json:"upTo,omitempty"`
+}
+
+// NonceGapFillResult is the outcome of a request to fill nonce gaps
+type NonceGapFillResult struct {
+	Address      string          `json:"address"`
+	MinedCount   string          `json:"minedCount"`
+	PendingCount string          `json:"pendingCount"`
+	Gaps         []*NonceGapFill `json:"gaps"`
+}
+
+// NonceGapFill is the no-op transaction sent to fill one nonce gap
+type NonceGapFill struct {
+	Nonce           string `json:"nonce"`
+	TransactionHash string `json:"transactionHash,omitempty"`
+	Error           string `json:"error,omitempty"`
+}
+
+// checkSuppliedNonce validates a nonce supplied with a transaction against those allocated to
+// the address, so that it does not collide with a transaction in-flight. When the nonce manager
+// is enabled it records the nonce as in-flight. Must be called holding the inflight lock
+func (p *txnProcessor) checkSuppliedNonce(ctx context.Context, inflight *inflightTxn, inflightForAddr *inflightTxnState, addr *ethbinding.Address) error {
+	for _, alreadyInflight := range inflightForAddr.txnsInFlight {
+		if !alreadyInflight.nodeAssignNonce && alreadyInflight.nonce == inflight.nonce {
+			return errors.Errorf(errors.TransactionSendNonceInFlight, inflight.nonce, inflight.from)
+		}
+	}
+	if p.conf.NonceManagerConf.Enabled {
+		if err := p.nonces.reserve(ctx, inflight.rpc, inflight.signer, inflight.from, addr, inflight.nonce); err != nil {
+			return err
+		}
+		inflight.managedNonce = true
+	}
+	// Nonces we assign afterwards must not collide with the one supplied
+	if inflightForAddr.highestNonce >= 0 && inflight.nonce > inflightForAddr.highestNonce {
+		inflightForAddr.highestNonce = inflight.nonce
+	}
+	return nil
+}
+
+// reserve records a nonce supplied by the caller as in-flight. It can be the next nonce, or a
+// gap left by a transaction that failed to send. Nonces that are in-flight, already used, or
+// that would leave a gap, are rejected
+func (n *nonceManager) reserve(ctx context.Context, rpc eth.RPCClient, signer eth.TXSigner, from string, addr *ethbinding.Address, nonce int64) error {
+	s, err := n.lockAndTrack(ctx, rpc, signer, from, addr)
+	if err != nil {
+		return err
+	}
+	defer n.lock.Unlock()
+	if _, inflight := s.inflight[nonce]; inflight {
+		return errors.Errorf(errors.TransactionSendNonceInFlight, nonce, from)
+	}
+	switch {
+	case nonce == s.next:
+		s.next++
+	case nonce > s.next:
+		return errors.Errorf(errors.TransactionSendNonceGap, nonce, from, s.next)
+	default:
+		idx := sort.Search(len(s.released), func(i int) bool { return s.released[i] >= nonce })
+		if idx == len(s.released) || s.released[idx] != nonce {
+			return errors.Errorf(errors.TransactionSendNonceUsed, nonce, from, s.next)
+		}
+		s.released = append(s.released[0:idx], s.released[idx+1:]...)
+	}
+	log.Infof("Nonce manager reserved supplied nonce %d for %s", nonce, from)
+	s.inflight[nonce] = time.Now()
+	return nil
+}
+
+// filled records that a gap-fill transaction was sent for a nonce, so it is not assigned again
+func (n *nonceManager) filled(from string, nonce int64) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	s, exists := n.signers[from]
+	if !exists {
+		return
+	}
+	released := make([]int64, 0, len(s.released))
+	for _, r := range s.released {
+		if r != nonce {
+			released = append(released, r)
+		}
+	}
+	s.released = released
+	if nonce >= s.next {
+		s.next = nonce + 1
+	}
+}
+
+// gapFillSender returns the RPC client and signer for the gap-fill transactions of an address,
+// from a transaction in-flight if there is one
+func (p *txnProcessor) gapFillSender(ctx context.Context, from string) (rpc eth.RPCClient, signer eth.TXSigner, inflightNonces map[int64]bool, err error) {
+	inflightNonces = make(map[int64]bool)
+	p.inflightTxnsLock.Lock()
+	if inflightForAddr, exists := p.inflightTxns[from]; exists {
+		for _, inflight := range inflightForAddr.txnsInFlight {
+			if !inflight.nodeAssignNonce {
+				inflightNonces[inflight.nonce] = true
+			}
+			rpc, signer = inflight.rpc, inflight.signer
+		}
+	}
+	p.inflightTxnsLock.Unlock()
+
+	p.nonces.lock.Lock()
+	if s, exists := p.nonces.signers[from]; exists {
+		for nonce := range s.inflight {
+			inflightNonces[nonce] = true
+		}
+		if rpc == nil {
+			rpc, signer = s.rpc, s.signer
+		}
+	}
+	p.nonces.lock.Unlock()
+
+	if rpc == nil {
+		rpc = p.rpc
+		if p.addressBook != nil {
+			rpc, err = p.addressBook.lookup(ctx, from)
+		}
+	}
+	return rpc, signer, inflightNonces, err
+}
+
+// gapFillNonces parses the nonces, and the nonce to fill up to, from a gap-fill request
+func (body *NonceGapFillRequest) gapFillNonces() (nonces []int64, upTo int64, err error) {
+	for _, n := range body.Nonces {
+		nonce, err := n.Int64()
+		if err != nil || nonce < 0 {
+			return nil, -1, errors.Errorf(errors.TransactionNonceFillGapsInvalid, "nonce '"+n.String()+"'")
+		}
+		nonces = append(nonces, nonce)
+	}
+	upTo = -1
+	if body.UpTo != "" {
+		if upTo, err = body.UpTo.Int64(); err != nil {
+			return nil, -1, errors.Errorf(errors.TransactionNonceFillGapsInvalid, "upTo '"+body.UpTo.String()+"'")
+		}
+	}
+	return nonces, upTo, nil
+}
+
+// fillNonceGaps sends a transaction that transfers nothing to the address itself, for each nonce
+// gap that is blocking the transactions queued after it in the node
+func (p *txnProcessor) fillNonceGaps(ctx context.Context, from string, nonces []int64, upTo int64) (*NonceGapFillResult, error) {
+	addr, err := utils.StrToAddress("address", from)
+	if err != nil {
+		return nil, err
+	}
+	rpc, signer, inflightNonces, err := p.gapFillSender(ctx, from)
+	if err != nil {
+		return nil, err
+	}
+	mined, err := eth.GetTransactionCount(ctx, rpc, &addr, "latest")
+	if err != nil {
+		return nil, err
+	}
+	pending, err := eth.GetTransactionCount(ctx, rpc, &addr, "pending")
+	if err != nil {
+		return nil, err
+	}
+
+	if len(nonces) == 0 {
+		// The gaps are the nonces below the highest in-flight that are not in-flight. The node
+		// has every nonce below its pending count, so a gap can only be above it
+		for nonce := range inflightNonces {
+			if nonce > upTo {
+				upTo = nonce
+			}
+		}
+		for nonce := pending; nonce < upTo; nonce++ {
+			if !inflightNonces[nonce] {
+				nonces = append(nonces, nonce)
+			}
+		}
+	}
+	sort.Slice(nonces, func(i, j int) bool { return nonces[i] < nonces[j] })
+
+	result := &NonceGapFillResult{
+		Address:      from,
+		MinedCount:   strconv.FormatInt(mined, 10),
+		PendingCount: strconv.FormatInt(pending, 10),
+		Gaps:         []*NonceGapFill{},
+	}
+	for _, nonce := range nonces {
+		gap := &NonceGapFill{Nonce: strconv.FormatInt(nonce, 10)}
+		result.Gaps = append(result.Gaps, gap)
+		if nonce < mined {
+			gap.Error = errors.Errorf(errors.TransactionNonceFillGapsMined, nonce).Error()
+			continue
+		}
+		tx, err := eth.NewNilTX(from, nonce, signer)
+		if err == nil {
+			err = tx.Send(ctx, rpc)
+		}
+		if err != nil {
+			log.Warnf("Submission of gap-fill TX for nonce %d of %s failed: %s", nonce, from, err)
+			gap.Error = err.Error()
+			continue
+		}
+		log.Infof("Submission of gap-fill TX '%s' for nonce %d of %s completed", tx.Hash, nonce, from)
+		gap.TransactionHash = tx.Hash
+		p.filledNonce(from, nonce)
+	}
+	return result, nil
+}
+
+// filledNonce makes sure the nonces we assign after a gap is filled do not collide with it
+func (p *txnProcessor) filledNonce(from string, nonce int64) {
+	p.inflightTxnsLock.Lock()
+	if inflightForAddr, exists := p.inflightTxns[from]; exists && inflightForAddr.highestNonce >= 0 && nonce > inflightForAddr.highestNonce {
+		inflightForAddr.highestNonce = nonce
+	}
+	p.inflightTxnsLock.Unlock()
+	p.nonces.filled(from, nonce)
+}
+
+func (p *txnProcessor) fillNonceGapsHandler(res http.ResponseWriter, req *http.Request, params httprouter.Params) {
+	log.Infof("--> %s %s", req.Method, req.URL)
+
+	from, err := p.queueAddress(params)
+	if err != nil {
+		queueErrReply(res, req, err, 400)
+		return
+	}
+	var body NonceGapFillRequest
+	if req.ContentLength != 0 {
+		if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+			queueErrReply(res, req, errors.Errorf(errors.TransactionNonceFillGapsInvalid, err), 400)
+			return
+		}
+	}
+	nonces, upTo, err := body.gapFillNonces()
+	if err != nil {
+		queueErrReply(res, req, err, 400)
+		return
+	}
+	result, err := p.fillNonceGaps(req.Context(), from, nonces, upTo)
+	if err != nil {
+		queueErrReply(res, req, err, 500)
+		return
+	}
+	queueReply(res, req, 200, result)
+}
@@ -0,0 +1,300 @@
+// Copyright 2021 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tx
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	ethbinding "github.com/kaleido-io/ethbinding/pkg"
+	"github.com/kaleido-io/ethconnect/internal/eth"
+	"github.com/kaleido-io/ethconnect/internal/ethbind"
+	"github.com/stretchr/testify/assert"
+)
+
+const testGapFillTxnHash = "0xac18e98664e160305cdb77e75e5eae32e55447e94ad8ceb0123729589ed09f8b"
+
+func newTestGapFillRPC(mined, pending uint64) *eth.MockRPCClient {
+	return eth.NewMockRPCClientForSync(nil, func(method string, res interface{}, args ...interface{}) {
+		switch method {
+		case "eth_getTransactionCount":
+			if args[1] == "latest" {
+				*(res.(*ethbinding.HexUint64)) = ethbinding.HexUint64(mined)
+			} else {
+				*(res.(*ethbinding.HexUint64)) = ethbinding.HexUint64(pending)
+			}
+		case "eth_sendTransaction":
+			*(res.(*string)) = testGapFillTxnHash
+		}
+	})
+}
+
+func newTestGapFillProcessor() (*txnProcessor, *httprouter.Router) {
+	p := NewTxnProcessor(&TxnProcessorConf{
+		NonceManagerConf: NonceManagerConf{Enabled: true},
+	}, &eth.RPCConf{}).(*txnProcessor)
+	p.Init(&testRPC{})
+	router := &httprouter.Router{}
+	p.AddRoutes(router)
+	return p, router
+}
+
+func TestNonceManagerReserve(t *testing.T) {
+	assert := assert.New(t)
+
+	n := newNonceManager(&NonceManagerConf{Enabled: true}, false)
+	from := strings.ToLower(testFromAddr)
+	addr := ethbind.API.HexToAddress(testFromAddr)
+	rpc := newTestNonceRPC(5, 5)
+	s := newTestSignerNonces(n, rpc, 8, 7)
+	s.released = []int64{5, 6}
+	ctx := context.Background()
+
+	err := n.reserve(ctx, rpc, nil, from, &addr, 7)
+	assert.Regexp("Nonce 7 is already in-flight", err)
+	err = n.reserve(ctx, rpc, nil, from, &addr, 4)
+	assert.Regexp("Nonce 4 has already been used .* The next nonce is 8", err)
+	err = n.reserve(ctx, rpc, nil, from, &addr, 9)
+	assert.Regexp("Nonce 9 would leave a gap .* The next nonce is 8", err)
+
+	assert.NoError(n.reserve(ctx, rpc, nil, from, &addr, 8))
+	assert.NoError(n.reserve(ctx, rpc, nil, from, &addr, 6))
+	state := n.state(from)
+	assert.Equal("9", state.Next)
+	assert.Equal([]string{"6", "7", "8"}, state.InFlight)
+	assert.Equal([]string{"5"}, state.Gaps)
+
+	// The next assigned nonce fills the remaining gap
+	nonce, err := n.assign(ctx, rpc, nil, from, &addr)
+	assert.NoError(err)
+	assert.Equal(int64(5), nonce)
+}
+
+func TestNonceManagerReserveUntracked(t *testing.T) {
+	assert := assert.New(t)
+
+	n := newNonceManager(&NonceManagerConf{Enabled: true}, false)
+	from := strings.ToLower(testFromAddr)
+	addr := ethbind.API.HexToAddress(testFromAddr)
+	ctx := context.Background()
+
+	assert.NoError(n.reserve(ctx, newTestNonceRPC(3, 4), nil, from, &addr, 4))
+	assert.Equal("5", n.state(from).Next)
+
+	n.release(from, 4, true)
+	err := n.reserve(ctx, eth.NewMockRPCClientForSync(fmt.Errorf("pop"), nil), nil, from, &addr, 4)
+	assert.EqualError(err, "eth_getTransactionCount returned: pop")
+}
+
+func TestNonceManagerFilled(t *testing.T) {
+	assert := assert.New(t)
+
+	n := newNonceManager(&NonceManagerConf{Enabled: true}, false)
+	from := strings.ToLower(testFromAddr)
+	s := newTestSignerNonces(n, newTestNonceRPC(5, 5), 8, 7)
+	s.released = []int64{5, 6}
+
+	n.filled(from, 6)
+	n.filled(from, 10)
+	state := n.state(from)
+	assert.Equal([]string{"5"}, state.Gaps)
+	assert.Equal("11", state.Next)
+
+	// Untracked addresses are ignored
+	n.filled("0x0000000000000000000000000000000000000001", 1)
+}
+
+func TestCheckSuppliedNonce(t *testing.T) {
+	assert := assert.New(t)
+
+	p := NewTxnProcessor(&TxnProcessorConf{}, &eth.RPCConf{}).(*txnProcessor)
+	addr := ethbind.API.HexToAddress(testFromAddr)
+	ctx := context.Background()
+	inflightForAddr := &inflightTxnState{
+		highestNonce: 10,
+		txnsInFlight: []*inflightTxn{
+			{nonce: 10},
+			{nonce: 11, nodeAssignNonce: true},
+		},
+	}
+
+	err := p.checkSuppliedNonce(ctx, &inflightTxn{from: testFromAddr, nonce: 10}, inflightForAddr, &addr)
+	assert.Regexp("Nonce 10 is already in-flight", err)
+
+	assert.NoError(p.checkSuppliedNonce(ctx, &inflightTxn{from: testFromAddr, nonce: 11}, inflightForAddr, &addr))
+	assert.Equal(int64(11), inflightForAddr.highestNonce)
+	assert.NoError(p.checkSuppliedNonce(ctx, &inflightTxn{from: testFromAddr, nonce: 3}, inflightForAddr, &addr))
+	assert.Equal(int64(11), inflightForAddr.highestNonce)
+
+	// The highest nonce is left to be found from the node, if we have not assigned one
+	inflightForAddr = &inflightTxnState{highestNonce: -1}
+	assert.NoError(p.checkSuppliedNonce(ctx, &inflightTxn{from: testFromAddr, nonce: 12}, inflightForAddr, &addr))
+	assert.Equal(int64(-1), inflightForAddr.highestNonce)
+}
+
+func TestCheckSuppliedNonceManaged(t *testing.T) {
+	assert := assert.New(t)
+
+	p, _ := newTestGapFillProcessor()
+	addr := ethbind.API.HexToAddress(testFromAddr)
+	from := strings.ToLower(testFromAddr)
+	rpc := newTestNonceRPC(5, 5)
+	newTestSignerNonces(p.nonces, rpc, 6, 5)
+
+	inflight := &inflightTxn{from: from, nonce: 7, rpc: rpc}
+	err := p.checkSuppliedNonce(context.Background(), inflight, &inflightTxnState{highestNonce: -1}, &addr)
+	assert.Regexp("Nonce 7 would leave a gap", err)
+	assert.False(inflight.managedNonce)
+
+	inflight.nonce = 6
+	assert.NoError(p.checkSuppliedNonce(context.Background(), inflight, &inflightTxnState{highestNonce: -1}, &addr))
+	assert.True(inflight.managedNonce)
+	assert.Equal([]string{"5", "6"}, p.nonces.state(from).InFlight)
+}
+
+func TestOnSendTransactionMessageSuppliedNonceInFlight(t *testing.T) {
+	assert := assert.New(t)
+
+	txnProcessor := NewTxnProcessor(&TxnProcessorConf{
+		MaxTXWaitTime:    1,
+		NonceManagerConf: NonceManagerConf{Enabled: true},
+	}, &eth.RPCConf{}).(*txnProcessor)
+	testTxnContext := &testTxnContext{}
+	testTxnContext.jsonMsg = strings.Replace(goodSendTxnJSON, `"from":`, `"nonce":"5","from":`, 1)
+	testRPC := &testRPC{
+		ethGetTransactionCountResult: 4,
+	}
+	txnProcessor.Init(testRPC)
+
+	txnProcessor.OnMessage(testTxnContext)
+	for len(testTxnContext.errorReplies) == 0 {
+		time.Sleep(1 * time.Millisecond)
+	}
+	assert.Regexp("Nonce 5 would leave a gap .* The next nonce is 4", testTxnContext.errorReplies[0].err)
+	assert.EqualValues([]string{"eth_getTransactionCount"}, testRPC.calls)
+	assert.Empty(txnProcessor.inflightTxns[strings.ToLower(testFromAddr)].txnsInFlight)
+}
+
+func TestFillNonceGapsHandler(t *testing.T) {
+	assert := assert.New(t)
+
+	p, router := newTestGapFillProcessor()
+	from := strings.ToLower(testFromAddr)
+	rpc := newTestGapFillRPC(5, 5)
+	s := newTestSignerNonces(p.nonces, rpc, 9, 7, 8)
+
+	status, body := testQueueRequest(router, "POST", "/admin/nonces/"+testFromAddr+"/fill-gaps", "")
+	assert.Equal(200, status)
+	var result NonceGapFillResult
+	assert.NoError(json.Unmarshal([]byte(body), &result))
+	assert.Equal(from, result.Address)
+	assert.Equal("5", result.MinedCount)
+	assert.Equal("5", result.PendingCount)
+	assert.Equal(2, len(result.Gaps))
+	assert.Equal("5", result.Gaps[0].Nonce)
+	assert.Equal(testGapFillTxnHash, result.Gaps[0].TransactionHash)
+	assert.Equal("6", result.Gaps[1].Nonce)
+	assert.Equal("eth_sendTransaction", rpc.MethodCapture)
+	sendTX := rpc.ArgsCapture[0].(*eth.SendTXArgs)
+	assert.Equal(uint64(6), uint64(*sendTX.Nonce))
+	assert.Equal(from, strings.ToLower(sendTX.To))
+
+	// With the gaps filled, the node has every nonce up to the highest in-flight
+	rpc = newTestGapFillRPC(5, 9)
+	s.rpc = rpc
+	status, body = testQueueRequest(router, "POST", "/admin/nonces/"+testFromAddr+"/fill-gaps", "")
+	assert.Equal(200, status)
+	var noGaps NonceGapFillResult
+	assert.NoError(json.Unmarshal([]byte(body), &noGaps))
+	assert.Empty(noGaps.Gaps)
+
+	status, body = testQueueRequest(router, "POST", "/admin/nonces/"+testFromAddr+"/fill-gaps", `{"upTo":"11"}`)
+	assert.Equal(200, status)
+	var upTo NonceGapFillResult
+	assert.NoError(json.Unmarshal([]byte(body), &upTo))
+	assert.Equal(2, len(upTo.Gaps))
+	assert.Equal("9", upTo.Gaps[0].Nonce)
+	assert.Equal("10", upTo.Gaps[1].Nonce)
+	assert.Equal("11", p.nonces.state(from).Next)
+
+	status, body = testQueueRequest(router, "POST", "/admin/nonces/"+testFromAddr+"/fill-gaps", `{"nonces":["12","3"]}`)
+	assert.Equal(200, status)
+	var explicit NonceGapFillResult
+	assert.NoError(json.Unmarshal([]byte(body), &explicit))
+	assert.Equal("3", explicit.Gaps[0].Nonce)
+	assert.Equal("Nonce 3 has already been mined", explicit.Gaps[0].Error)
+	assert.Empty(explicit.Gaps[0].TransactionHash)
+	assert.Equal("12", explicit.Gaps[1].Nonce)
+	assert.Equal(testGapFillTxnHash, explicit.Gaps[1].TransactionHash)
+	assert.Equal("13", p.nonces.state(from).Next)
+}
+
+func TestFillNonceGapsHandlerInflight(t *testing.T) {
+	assert := assert.New(t)
+
+	p, router := newTestGapFillProcessor()
+	from := strings.ToLower(testFromAddr)
+	rpc := &failSendRPC{MockRPCClient: newTestGapFillRPC(5, 5)}
+	p.inflightTxns[from] = &inflightTxnState{
+		highestNonce: 7,
+		txnsInFlight: []*inflightTxn{{from: from, nonce: 7, rpc: rpc}},
+	}
+
+	status, body := testQueueRequest(router, "POST", "/admin/nonces/"+testFromAddr+"/fill-gaps", "")
+	assert.Equal(200, status)
+	var result NonceGapFillResult
+	assert.NoError(json.Unmarshal([]byte(body), &result))
+	assert.Equal(2, len(result.Gaps))
+	assert.Equal("pop", result.Gaps[0].Error)
+	assert.Equal("pop", result.Gaps[1].Error)
+	assert.Equal(int64(7), p.inflightTxns[from].highestNonce)
+
+	p.inflightTxns[from].txnsInFlight[0].rpc = newTestGapFillRPC(5, 5)
+	status, _ = testQueueRequest(router, "POST", "/admin/nonces/"+testFromAddr+"/fill-gaps", `{"nonces":["9"]}`)
+	assert.Equal(200, status)
+	assert.Equal(int64(9), p.inflightTxns[from].highestNonce)
+}
+
+func TestFillNonceGapsHandlerErrors(t *testing.T) {
+	assert := assert.New(t)
+
+	p, router := newTestGapFillProcessor()
+
+	status, body := testQueueRequest(router, "POST", "/admin/nonces/badness/fill-gaps", "")
+	assert.Equal(400, status)
+	assert.Regexp("address", body)
+
+	status, body = testQueueRequest(router, "POST", "/admin/nonces/"+testFromAddr+"/fill-gaps", "!json")
+	assert.Equal(400, status)
+	assert.Regexp("Invalid gap-fill request", body)
+
+	status, body = testQueueRequest(router, "POST", "/admin/nonces/"+testFromAddr+"/fill-gaps", `{"nonces":["-1"]}`)
+	assert.Equal(400, status)
+	assert.Regexp("Invalid gap-fill request: nonce '-1'", body)
+
+	status, body = testQueueRequest(router, "POST", "/admin/nonces/"+testFromAddr+"/fill-gaps", `{"upTo":"1.5"}`)
+	assert.Equal(400, status)
+	assert.Regexp("Invalid gap-fill request: upTo '1.5'", body)
+
+	p.rpc = eth.NewMockRPCClientForSync(fmt.Errorf("pop"), nil)
+	status, body = testQueueRequest(router, "POST", "/admin/nonces/"+testFromAddr+"/fill-gaps", "")
+	assert.Equal(500, status)
+	assert.Regexp("eth_getTransactionCount returned: pop", body)
+}
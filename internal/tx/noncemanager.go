@@ -0,0 +1,396 @@
+// Copyright 2021 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tx
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	ethbinding "github.com/kaleido-io/ethbinding/pkg"
+	"github.com/kaleido-io/ethconnect/internal/errors"
+	"github.com/kaleido-io/ethconnect/internal/eth"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	defaultNonceReconcileIntervalSec = 30
+	defaultNonceStuckTimeoutSec      = 300
+)
+
+// NonceManagerConf configures the built-in nonce manager. When enabled, ethconnect assigns
+// the nonce of every transaction it sends (other than private transactions using the Orion
+// APIs), rather than deferring to the node for node-signed transactions
+type NonceManagerConf struct {
+	Enabled              bool `json:"enabled"`
+	ReconcileIntervalSec int  `json:"reconcileIntervalSec,omitempty"`
+	StuckTimeoutSec      int  `json:"stuckTimeoutSec,omitempty"`
+}
+
+// NonceState is the nonce state of a signing address, returned on /identities/:address/nonces.
+// Gaps are nonces that were assigned, but never sent, so will be reused by the next transactions.
+// MinedCount and PendingCount are the transaction counts reported by the node at the last
+// reconciliation.
+type NonceState struct {
+	Address      string     `json:"address"`
+	Next         string     `json:"next"`
+	InFlight     []string   `json:"inflight"`
+	Gaps         []string   `json:"gaps"`
+	Stuck        string     `json:"stuck,omitempty"`
+	MinedCount   string     `json:"minedCount,omitempty"`
+	PendingCount string     `json:"pendingCount,omitempty"`
+	Reconciled   *time.Time `json:"reconciled,omitempty"`
+}
+
+// signerNonces is the nonce state of one address
+type signerNonces struct {
+	addr       ethbinding.Address
+	rpc        eth.RPCClient
+	signer     eth.TXSigner
+	next       int64
+	inflight   map[int64]time.Time // assigned nonces, with the time they were assigned
+	released   []int64             // nonces below next that were never sent, lowest first
+	stuck      int64               // the in-flight nonce the node is stuck on, or -1
+	mined      int64
+	pending    int64
+	reconciled time.Time
+}
+
+// nonceManager assigns nonces for each signing address, from its own record of the nonces
+// in-flight. The node is only asked for the transaction count the first time an address is
+// used, including after a restart, and when reconciling. Reconciliation detects gaps that
+// would block the transactions after them, and transactions stuck in the node's pool.
+type nonceManager struct {
+	conf           *NonceManagerConf
+	attemptGapFill bool
+	lock           sync.Mutex
+	signers        map[string]*signerNonces
+	ctx            context.Context
+	cancel         func()
+	done           chan struct{}
+}
+
+func newNonceManager(conf *NonceManagerConf, attemptGapFill bool) *nonceManager {
+	if conf.ReconcileIntervalSec <= 0 {
+		conf.ReconcileIntervalSec = defaultNonceReconcileIntervalSec
+	}
+	if conf.StuckTimeoutSec <= 0 {
+		conf.StuckTimeoutSec = defaultNonceStuckTimeoutSec
+	}
+	n := &nonceManager{
+		conf:           conf,
+		attemptGapFill: attemptGapFill,
+		signers:        make(map[string]*signerNonces),
+	}
+	n.ctx, n.cancel = context.WithCancel(context.Background())
+	return n
+}
+
+func (n *nonceManager) start() {
+	if n.conf.Enabled {
+		n.done = make(chan struct{})
+		go n.reconcileLoop(time.Duration(n.conf.ReconcileIntervalSec) * time.Second)
+	}
+}
+
+// close stops reconciliation, waiting for any reconciliation in progress to finish
+func (n *nonceManager) close() {
+	n.cancel()
+	if n.done != nil {
+		<-n.done
+	}
+}
+
+// assign returns the next nonce for an address. Nonces released after failing to send are
+// reused first, lowest first, so the gap they left is filled by a real transaction
+func (n *nonceManager) assign(ctx context.Context, rpc eth.RPCClient, signer eth.TXSigner, from string, addr *ethbinding.Address) (int64, error) {
+	s, err := n.lockAndTrack(ctx, rpc, signer, from, addr)
+	if err != nil {
+		return 0, err
+	}
+	defer n.lock.Unlock()
+	var nonce int64
+	if len(s.released) > 0 {
+		nonce = s.released[0]
+		s.released = s.released[1:]
+		log.Infof("Nonce manager reusing nonce %d for %s", nonce, from)
+	} else {
+		nonce = s.next
+		s.next++
+	}
+	s.inflight[nonce] = time.Now()
+	return nonce, nil
+}
+
+// lockAndTrack returns the state of an address, starting to track it if nothing is in-flight.
+// The node is queried without holding the lock. Unless an error is returned, the lock is held
+// on return and the caller must release it
+func (n *nonceManager) lockAndTrack(ctx context.Context, rpc eth.RPCClient, signer eth.TXSigner, from string, addr *ethbinding.Address) (*signerNonces, error) {
+	n.lock.Lock()
+	for {
+		if s, exists := n.signers[from]; exists {
+			s.rpc = rpc
+			s.signer = signer
+			return s, nil
+		}
+		// Nothing is in-flight for the address, so the node is the source of truth.
+		// This is how we recover after a restart.
+		n.lock.Unlock()
+		count, err := eth.GetTransactionCount(ctx, rpc, addr, "pending")
+		if err != nil {
+			return nil, err
+		}
+		n.lock.Lock()
+		// Another transaction might have started tracking the address while we queried the node
+		if _, exists := n.signers[from]; !exists {
+			n.signers[from] = &signerNonces{
+				addr:     *addr,
+				next:     count,
+				inflight: make(map[int64]time.Time),
+				stuck:    -1,
+			}
+			log.Infof("Nonce manager tracking %s from nonce %d", from, count)
+		}
+	}
+}
+
+// release is called when a nonce is no longer in-flight. If it was not used, because the
+// transaction failed to send, it is reused by the next transaction
+func (n *nonceManager) release(from string, nonce int64, used bool) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	s, exists := n.signers[from]
+	if !exists {
+		return
+	}
+	if _, inflight := s.inflight[nonce]; !inflight {
+		return
+	}
+	delete(s.inflight, nonce)
+	if s.stuck == nonce {
+		s.stuck = -1
+	}
+	if !used {
+		s.released = append(s.released, nonce)
+		sort.Slice(s.released, func(i, j int) bool { return s.released[i] < s.released[j] })
+		// Released nonces at the top of the range are simply assigned again next
+		for len(s.released) > 0 && s.released[len(s.released)-1] == s.next-1 {
+			s.released = s.released[:len(s.released)-1]
+			s.next--
+		}
+	}
+	if len(s.inflight) == 0 && len(s.released) == 0 {
+		// Nothing to track, so we ask the node again next time the address is used
+		delete(n.signers, from)
+	}
+}
+
+func (n *nonceManager) reconcileLoop(interval time.Duration) {
+	defer close(n.done)
+	for {
+		select {
+		case <-time.After(interval):
+			n.reconcileAll(time.Now())
+		case <-n.ctx.Done():
+			log.Debugf("Nonce manager reconciliation stopped")
+			return
+		}
+	}
+}
+
+func (n *nonceManager) reconcileAll(now time.Time) {
+	n.lock.Lock()
+	addrs := make([]string, 0, len(n.signers))
+	for from := range n.signers {
+		addrs = append(addrs, from)
+	}
+	n.lock.Unlock()
+	for _, from := range addrs {
+		if err := n.reconcile(from, now); err != nil {
+			log.Warnf("Nonce manager failed to reconcile %s: %s", from, err)
+		}
+	}
+}
+
+// reconcile compares the nonces of an address with the transaction counts of the node:
+//   - Nonces below the mined count are no longer needed
+//   - A pending count above our next nonce means transactions were sent by another client
+//   - A pending count equal to the mined count, below our lowest in-flight nonce, is a gap left
+//     by transactions the node no longer has. These nonces are filled with gap-fill transactions
+//     if configured, otherwise they are reused by the next transactions
+//   - The in-flight nonce at the mined count is stuck if it has been pending for the stuck timeout
+func (n *nonceManager) reconcile(from string, now time.Time) error {
+	n.lock.Lock()
+	s, exists := n.signers[from]
+	if !exists {
+		n.lock.Unlock()
+		return nil
+	}
+	rpc, signer, addr := s.rpc, s.signer, s.addr
+	n.lock.Unlock()
+
+	ctx := n.ctx
+	mined, err := eth.GetTransactionCount(ctx, rpc, &addr, "latest")
+	if err != nil {
+		return err
+	}
+	pending, err := eth.GetTransactionCount(ctx, rpc, &addr, "pending")
+	if err != nil {
+		return err
+	}
+
+	// The state might have been released while we queried the node, in which case
+	// the node is the source of truth the next time the address is used
+	n.lock.Lock()
+	if s, exists = n.signers[from]; !exists {
+		n.lock.Unlock()
+		return nil
+	}
+	s.mined, s.pending, s.reconciled = mined, pending, now
+	released := make([]int64, 0, len(s.released))
+	for _, nonce := range s.released {
+		if nonce >= mined {
+			released = append(released, nonce)
+		}
+	}
+	s.released = released
+	if pending > s.next {
+		log.Warnf("Nonce manager for %s advanced from %d to %d, for transactions sent by another client", from, s.next, pending)
+		s.next = pending
+	}
+	lowest := s.next
+	for nonce := range s.inflight {
+		if nonce < lowest {
+			lowest = nonce
+		}
+	}
+	var gaps []int64
+	if pending == mined && mined < lowest {
+		known := make(map[int64]bool, len(s.released))
+		for _, nonce := range s.released {
+			known[nonce] = true
+		}
+		for nonce := mined; nonce < lowest; nonce++ {
+			if !known[nonce] {
+				gaps = append(gaps, nonce)
+			}
+		}
+	}
+	s.stuck = -1
+	if assigned, inflight := s.inflight[mined]; inflight && pending > mined && now.Sub(assigned) > time.Duration(n.conf.StuckTimeoutSec)*time.Second {
+		log.Warnf("Nonce manager for %s stuck at nonce %d, pending for %.0fs", from, mined, now.Sub(assigned).Seconds())
+		s.stuck = mined
+	}
+	n.lock.Unlock()
+
+	for _, nonce := range gaps {
+		log.Warnf("Nonce manager detected gap at nonce %d for %s. Lowest in-flight nonce=%d", nonce, from, lowest)
+		if n.attemptGapFill && n.fillGap(ctx, rpc, signer, from, nonce) {
+			continue
+		}
+		n.releaseGap(from, nonce)
+	}
+	return nil
+}
+
+// releaseGap records a gap nonce to be reused by the next transaction, unless the state of the
+// address changed while the gap was being filled, so that the nonce is now in-flight or was
+// already released. If the state was released entirely, the node's pending count includes the gap
+func (n *nonceManager) releaseGap(from string, nonce int64) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	s, exists := n.signers[from]
+	if !exists || nonce >= s.next {
+		return
+	}
+	if _, inflight := s.inflight[nonce]; inflight {
+		return
+	}
+	idx := sort.Search(len(s.released), func(i int) bool { return s.released[i] >= nonce })
+	if idx < len(s.released) && s.released[idx] == nonce {
+		return
+	}
+	s.released = append(s.released, nonce)
+	sort.Slice(s.released, func(i, j int) bool { return s.released[i] < s.released[j] })
+}
+
+func (n *nonceManager) fillGap(ctx context.Context, rpc eth.RPCClient, signer eth.TXSigner, from string, nonce int64) bool {
+	tx, err := eth.NewNilTX(from, nonce, signer)
+	if err == nil {
+		err = tx.Send(ctx, rpc)
+	}
+	if err != nil {
+		log.Warnf("Submission of gap-fill TX for nonce %d of %s failed: %s", nonce, from, err)
+		return false
+	}
+	log.Infof("Submission of gap-fill TX '%s' for nonce %d of %s completed", tx.Hash, nonce, from)
+	return true
+}
+
+func (n *nonceManager) state(from string) *NonceState {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	s, exists := n.signers[from]
+	if !exists {
+		return nil
+	}
+	state := &NonceState{
+		Address:  from,
+		Next:     strconv.FormatInt(s.next, 10),
+		InFlight: []string{},
+		Gaps:     []string{},
+	}
+	inflight := make([]int64, 0, len(s.inflight))
+	for nonce := range s.inflight {
+		inflight = append(inflight, nonce)
+	}
+	sort.Slice(inflight, func(i, j int) bool { return inflight[i] < inflight[j] })
+	for _, nonce := range inflight {
+		state.InFlight = append(state.InFlight, strconv.FormatInt(nonce, 10))
+	}
+	for _, nonce := range s.released {
+		state.Gaps = append(state.Gaps, strconv.FormatInt(nonce, 10))
+	}
+	if s.stuck >= 0 {
+		state.Stuck = strconv.FormatInt(s.stuck, 10)
+	}
+	if !s.reconciled.IsZero() {
+		reconciled := s.reconciled.UTC()
+		state.Reconciled = &reconciled
+		state.MinedCount = strconv.FormatInt(s.mined, 10)
+		state.PendingCount = strconv.FormatInt(s.pending, 10)
+	}
+	return state
+}
+
+func (p *txnProcessor) nonceStateHandler(res http.ResponseWriter, req *http.Request, params httprouter.Params) {
+	log.Infof("--> %s %s", req.Method, req.URL)
+
+	from, err := p.queueAddress(params)
+	if err != nil {
+		queueErrReply(res, req, err, 400)
+		return
+	}
+	state := p.nonces.state(from)
+	if state == nil {
+		queueErrReply(res, req, errors.Errorf(errors.TransactionNonceStateNotFound, from), 404)
+		return
+	}
+	queueReply(res, req, 200, state)
+}
@@ -0,0 +1,401 @@
+// Copyright 2021 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tx
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	ethbinding "github.com/kaleido-io/ethbinding/pkg"
+	"github.com/kaleido-io/ethconnect/internal/eth"
+	"github.com/kaleido-io/ethconnect/internal/ethbind"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestNonceRPC(mined, pending uint64) *eth.MockRPCClient {
+	return eth.NewMockRPCClientForSync(nil, func(method string, res interface{}, args ...interface{}) {
+		if method == "eth_getTransactionCount" {
+			if args[1] == "latest" {
+				*(res.(*ethbinding.HexUint64)) = ethbinding.HexUint64(mined)
+			} else {
+				*(res.(*ethbinding.HexUint64)) = ethbinding.HexUint64(pending)
+			}
+		}
+	})
+}
+
+func newTestSignerNonces(n *nonceManager, rpc eth.RPCClient, next int64, inflight ...int64) *signerNonces {
+	from := strings.ToLower(testFromAddr)
+	s := &signerNonces{
+		addr:     ethbind.API.HexToAddress(testFromAddr),
+		rpc:      rpc,
+		next:     next,
+		inflight: make(map[int64]time.Time),
+		stuck:    -1,
+	}
+	for _, nonce := range inflight {
+		s.inflight[nonce] = time.Now()
+	}
+	n.signers[from] = s
+	return s
+}
+
+func TestNonceManagerAssignRelease(t *testing.T) {
+	assert := assert.New(t)
+
+	n := newNonceManager(&NonceManagerConf{Enabled: true}, false)
+	assert.Equal(defaultNonceReconcileIntervalSec, n.conf.ReconcileIntervalSec)
+	assert.Equal(defaultNonceStuckTimeoutSec, n.conf.StuckTimeoutSec)
+	rpc := newTestNonceRPC(10, 10)
+	from := strings.ToLower(testFromAddr)
+	addr := ethbind.API.HexToAddress(testFromAddr)
+	ctx := context.Background()
+
+	for i := int64(10); i < 13; i++ {
+		nonce, err := n.assign(ctx, rpc, nil, from, &addr)
+		assert.NoError(err)
+		assert.Equal(i, nonce)
+	}
+
+	// A nonce that was not sent is reused before the next one
+	n.release(from, 11, false)
+	assert.Equal([]string{"10", "12"}, n.state(from).InFlight)
+	assert.Equal([]string{"11"}, n.state(from).Gaps)
+	nonce, err := n.assign(ctx, rpc, nil, from, &addr)
+	assert.NoError(err)
+	assert.Equal(int64(11), nonce)
+	assert.Equal([]string{"10", "11", "12"}, n.state(from).InFlight)
+
+	// Unused nonces at the top of the range are collapsed back into the next nonce
+	n.release(from, 12, false)
+	n.release(from, 11, false)
+	assert.Equal("11", n.state(from).Next)
+	assert.Empty(n.state(from).Gaps)
+
+	// Releasing an unknown nonce, or address, is ignored
+	n.release(from, 99, false)
+	n.release("0xabc", 10, true)
+
+	// Once nothing is tracked, the node is asked again next time
+	n.release(from, 10, true)
+	assert.Nil(n.state(from))
+}
+
+func TestNonceManagerAssignFail(t *testing.T) {
+	assert := assert.New(t)
+
+	n := newNonceManager(&NonceManagerConf{Enabled: true}, false)
+	rpc := eth.NewMockRPCClientForSync(fmt.Errorf("pop"), nil)
+	addr := ethbind.API.HexToAddress(testFromAddr)
+
+	_, err := n.assign(context.Background(), rpc, nil, strings.ToLower(testFromAddr), &addr)
+	assert.Regexp("pop", err)
+	assert.Empty(n.signers)
+}
+
+func TestNonceManagerReconcileGap(t *testing.T) {
+	assert := assert.New(t)
+
+	n := newNonceManager(&NonceManagerConf{Enabled: true}, false)
+	from := strings.ToLower(testFromAddr)
+	s := newTestSignerNonces(n, newTestNonceRPC(5, 5), 8, 7)
+	s.released = []int64{3, 6}
+
+	// The node has lost nonce 5, so nonces 5 and 6 must be reused to unblock nonce 7
+	n.reconcileAll(time.Now())
+	state := n.state(from)
+	assert.Equal([]string{"5", "6"}, state.Gaps)
+	assert.Equal("5", state.MinedCount)
+	assert.Equal("5", state.PendingCount)
+	assert.NotNil(state.Reconciled)
+	assert.Empty(state.Stuck)
+
+	// Reconciling an address that is no longer tracked is a no-op
+	assert.NoError(n.reconcile("0xabc", time.Now()))
+}
+
+func TestNonceManagerReconcileStateReplacedDuringQuery(t *testing.T) {
+	assert := assert.New(t)
+
+	n := newNonceManager(&NonceManagerConf{Enabled: true}, false)
+	from := strings.ToLower(testFromAddr)
+	var replacement *signerNonces
+	rpc := eth.NewMockRPCClientForSync(nil, func(method string, res interface{}, args ...interface{}) {
+		*(res.(*ethbinding.HexUint64)) = ethbinding.HexUint64(5)
+		if args[1] == "latest" {
+			// The address is released, and tracked again by a new transaction, while we query the node
+			n.release(from, 7, true)
+			replacement = newTestSignerNonces(n, nil, 6, 5)
+		}
+	})
+	s := newTestSignerNonces(n, rpc, 8, 7)
+
+	assert.NoError(n.reconcile(from, time.Now()))
+	assert.True(s.reconciled.IsZero())
+	assert.False(replacement.reconciled.IsZero())
+	assert.Equal([]string{"5"}, n.state(from).InFlight)
+	assert.Empty(n.state(from).Gaps)
+}
+
+func TestNonceManagerReconcileStateReleasedDuringQuery(t *testing.T) {
+	assert := assert.New(t)
+
+	n := newNonceManager(&NonceManagerConf{Enabled: true}, false)
+	from := strings.ToLower(testFromAddr)
+	rpc := eth.NewMockRPCClientForSync(nil, func(method string, res interface{}, args ...interface{}) {
+		*(res.(*ethbinding.HexUint64)) = ethbinding.HexUint64(5)
+		n.release(from, 7, true)
+	})
+	newTestSignerNonces(n, rpc, 8, 7)
+
+	assert.NoError(n.reconcile(from, time.Now()))
+	assert.Nil(n.state(from))
+}
+
+func TestNonceManagerReleaseGap(t *testing.T) {
+	assert := assert.New(t)
+
+	n := newNonceManager(&NonceManagerConf{Enabled: true}, false)
+	from := strings.ToLower(testFromAddr)
+	s := newTestSignerNonces(n, nil, 8, 6)
+	s.released = []int64{3}
+
+	n.releaseGap(from, 6)
+	n.releaseGap(from, 3)
+	n.releaseGap(from, 8)
+	n.releaseGap(from, 5)
+	n.releaseGap("0xabc", 1)
+	assert.Equal([]string{"3", "5"}, n.state(from).Gaps)
+}
+
+func TestNonceManagerClose(t *testing.T) {
+	n := newNonceManager(&NonceManagerConf{Enabled: true, ReconcileIntervalSec: 3600}, false)
+	n.start()
+	n.close()
+	<-n.done
+
+	// Closing a nonce manager that was never started does not block
+	n = newNonceManager(&NonceManagerConf{}, false)
+	n.start()
+	n.close()
+	assert.Nil(t, n.done)
+}
+
+func TestNonceManagerReconcileGapFill(t *testing.T) {
+	assert := assert.New(t)
+
+	n := newNonceManager(&NonceManagerConf{Enabled: true}, true)
+	from := strings.ToLower(testFromAddr)
+	rpc := newTestNonceRPC(5, 5)
+	newTestSignerNonces(n, rpc, 8, 7)
+
+	err := n.reconcile(from, time.Now())
+	assert.NoError(err)
+	assert.Empty(n.state(from).Gaps)
+	assert.Equal("eth_sendTransaction", rpc.MethodCapture)
+}
+
+func TestNonceManagerReconcileGapFillFail(t *testing.T) {
+	assert := assert.New(t)
+
+	n := newNonceManager(&NonceManagerConf{Enabled: true}, true)
+	from := strings.ToLower(testFromAddr)
+	newTestSignerNonces(n, &failSendRPC{MockRPCClient: newTestNonceRPC(5, 5)}, 7, 6)
+
+	err := n.reconcile(from, time.Now())
+	assert.NoError(err)
+	assert.Equal([]string{"5"}, n.state(from).Gaps)
+}
+
+type failSendRPC struct {
+	*eth.MockRPCClient
+}
+
+func (r *failSendRPC) CallContext(ctx context.Context, result interface{}, method string, args ...interface{}) error {
+	if method == "eth_sendTransaction" {
+		return fmt.Errorf("pop")
+	}
+	return r.MockRPCClient.CallContext(ctx, result, method, args...)
+}
+
+func TestNonceManagerReconcileStuckAndAdvance(t *testing.T) {
+	assert := assert.New(t)
+
+	n := newNonceManager(&NonceManagerConf{Enabled: true, StuckTimeoutSec: 60}, false)
+	from := strings.ToLower(testFromAddr)
+	s := newTestSignerNonces(n, newTestNonceRPC(5, 9), 6, 5)
+
+	// Not stuck until the timeout
+	n.reconcileAll(time.Now())
+	assert.Empty(n.state(from).Stuck)
+	// Another client has sent transactions up to nonce 8
+	assert.Equal("9", n.state(from).Next)
+
+	n.reconcileAll(time.Now().Add(2 * time.Minute))
+	assert.Equal("5", n.state(from).Stuck)
+	assert.Empty(n.state(from).Gaps)
+
+	// Releasing the stuck nonce clears it
+	s.inflight[6] = time.Now()
+	n.release(from, 5, true)
+	assert.Empty(n.state(from).Stuck)
+}
+
+func TestNonceManagerReconcileFail(t *testing.T) {
+	assert := assert.New(t)
+
+	n := newNonceManager(&NonceManagerConf{Enabled: true}, false)
+	from := strings.ToLower(testFromAddr)
+	newTestSignerNonces(n, eth.NewMockRPCClientForSync(fmt.Errorf("pop"), nil), 6, 5)
+
+	err := n.reconcile(from, time.Now())
+	assert.Regexp("pop", err)
+	n.reconcileAll(time.Now())
+	assert.Nil(n.state(from).Reconciled)
+
+	n.signers[from].rpc = &failPendingRPC{}
+	err = n.reconcile(from, time.Now())
+	assert.Regexp("pop", err)
+}
+
+type failPendingRPC struct{}
+
+func (r *failPendingRPC) CallContext(ctx context.Context, result interface{}, method string, args ...interface{}) error {
+	if args[1] == "pending" {
+		return fmt.Errorf("pop")
+	}
+	return nil
+}
+
+func TestNonceStateHandler(t *testing.T) {
+	assert := assert.New(t)
+
+	p := NewTxnProcessor(&TxnProcessorConf{
+		NonceManagerConf: NonceManagerConf{Enabled: true},
+	}, &eth.RPCConf{}).(*txnProcessor)
+	p.Init(&testRPC{})
+	router := &httprouter.Router{}
+	p.AddRoutes(router)
+
+	status, body := testQueueRequest(router, "GET", "/identities/"+testFromAddr+"/nonces", "")
+	assert.Equal(404, status)
+	assert.Regexp("No nonces are being managed for address", body)
+
+	status, body = testQueueRequest(router, "GET", "/identities/badness/nonces", "")
+	assert.Equal(400, status)
+	assert.Regexp("address", body)
+
+	newTestSignerNonces(p.nonces, &testRPC{}, 12, 10, 11)
+	status, body = testQueueRequest(router, "GET", "/identities/"+testFromAddr+"/nonces", "")
+	assert.Equal(200, status)
+	var state NonceState
+	assert.NoError(json.Unmarshal([]byte(body), &state))
+	assert.Equal(strings.ToLower(testFromAddr), state.Address)
+	assert.Equal("12", state.Next)
+	assert.Equal([]string{"10", "11"}, state.InFlight)
+	assert.Empty(state.Gaps)
+	assert.Nil(state.Reconciled)
+}
+
+func TestOnSendTransactionMessageManagedNonceReleased(t *testing.T) {
+	assert := assert.New(t)
+
+	txnProcessor := NewTxnProcessor(&TxnProcessorConf{
+		MaxTXWaitTime:    1,
+		NonceManagerConf: NonceManagerConf{Enabled: true},
+	}, &eth.RPCConf{}).(*txnProcessor)
+	testTxnContext := &testTxnContext{}
+	testTxnContext.jsonMsg = goodSendTxnJSON
+	testRPC := &testRPC{
+		ethSendTransactionErr:        fmt.Errorf("pop"),
+		ethGetTransactionCountResult: 42,
+	}
+	txnProcessor.Init(testRPC)
+
+	txnProcessor.OnMessage(testTxnContext)
+	for len(testTxnContext.errorReplies) == 0 {
+		time.Sleep(1 * time.Millisecond)
+	}
+
+	// The node-signed transaction had its nonce assigned by the nonce manager,
+	// which released it after the send failed
+	assert.Equal("pop", testTxnContext.errorReplies[0].err.Error())
+	assert.EqualValues([]string{"eth_getTransactionCount", "eth_sendTransaction"}, testRPC.calls)
+	sendTX := testRPC.params[1][0].(*eth.SendTXArgs)
+	assert.Equal(uint64(42), uint64(*sendTX.Nonce))
+	assert.Nil(txnProcessor.nonces.state(strings.ToLower(testFromAddr)))
+}
+
+// lockCheckRPC records whether the in-flight or nonce manager locks are held while the node is
+// asked for the transaction count
+type lockCheckRPC struct {
+	*testRPC
+	p      *txnProcessor
+	locked bool
+}
+
+func lockAvailable(l *sync.Mutex) bool {
+	acquired := make(chan struct{})
+	go func() {
+		l.Lock()
+		l.Unlock()
+		close(acquired)
+	}()
+	select {
+	case <-acquired:
+		return true
+	case <-time.After(1 * time.Second):
+		return false
+	}
+}
+
+func (r *lockCheckRPC) CallContext(ctx context.Context, result interface{}, method string, args ...interface{}) error {
+	if method == "eth_getTransactionCount" {
+		r.locked = !lockAvailable(r.p.inflightTxnsLock) || !lockAvailable(&r.p.nonces.lock)
+	}
+	return r.testRPC.CallContext(ctx, result, method, args...)
+}
+
+func TestOnSendTransactionMessageManagedNonceQueriedWithoutLocks(t *testing.T) {
+	assert := assert.New(t)
+
+	txnProcessor := NewTxnProcessor(&TxnProcessorConf{
+		MaxTXWaitTime:    1,
+		NonceManagerConf: NonceManagerConf{Enabled: true},
+	}, &eth.RPCConf{}).(*txnProcessor)
+	testTxnContext := &testTxnContext{}
+	testTxnContext.jsonMsg = goodSendTxnJSON
+	rpc := &lockCheckRPC{
+		testRPC: &testRPC{
+			ethSendTransactionErr:        fmt.Errorf("pop"),
+			ethGetTransactionCountResult: 42,
+		},
+		p: txnProcessor,
+	}
+	txnProcessor.Init(rpc)
+
+	txnProcessor.OnMessage(testTxnContext)
+	for len(testTxnContext.errorReplies) == 0 {
+		time.Sleep(1 * time.Millisecond)
+	}
+	assert.Equal("eth_getTransactionCount", rpc.calls[0])
+	assert.False(rpc.locked)
+}
@@ -0,0 +1,420 @@
+// Copyright 2021 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tx
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/kaleido-io/ethconnect/internal/errors"
+	"github.com/kaleido-io/ethconnect/internal/kvstore"
+	"github.com/kaleido-io/ethconnect/internal/utils"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	ptmRequestTimeout   = 10 * time.Second
+	enclaveKeyByteLen   = 32
+	privacyKeyPrefix    = "keys/"
+	privacyKeyPrefixEnd = "keys0"
+)
+
+// PrivacyConf configures health checking of the private transaction manager (Orion/Tessera)
+// that the node uses, and the enclave public keys known to the bridge
+type PrivacyConf struct {
+	PTMURL string          `json:"ptmURL"`
+	TLS    utils.TLSConfig `json:"tls"`
+	// KeysDB is a KV store connection string to persist rotated keys. They are held in memory if not set
+	KeysDB string        `json:"keysDB"`
+	Keys   []*PrivacyKey `json:"keys"`
+}
+
+// PrivacyKey is an enclave public key known to the bridge. Its name can be used in place of
+// the key in privateFrom/privateFor, and keys it was rotated from continue to resolve to it.
+// Local keys belong to the PTM of this node, so are checked for availability on /status/privacy
+type PrivacyKey struct {
+	Name         string   `json:"name"`
+	Key          string   `json:"key"`
+	Local        bool     `json:"local,omitempty"`
+	PreviousKeys []string `json:"previousKeys,omitempty"`
+	Updated      string   `json:"updated,omitempty"`
+}
+
+// PrivacyKeyStatus is a key with its availability in the PTM. Availability is only
+// reported for local keys, when the PTM supports listing its keys
+type PrivacyKeyStatus struct {
+	*PrivacyKey
+	Available *bool `json:"available,omitempty"`
+}
+
+// PTMStatus reports reachability of the private transaction manager
+type PTMStatus struct {
+	URL       string `json:"url"`
+	Reachable bool   `json:"reachable"`
+	Error     string `json:"error,omitempty"`
+}
+
+// PrivacyStatus is returned on /status/privacy
+type PrivacyStatus struct {
+	OK   bool                `json:"ok"`
+	PTM  *PTMStatus          `json:"ptm,omitempty"`
+	Keys []*PrivacyKeyStatus `json:"keys"`
+}
+
+type privacyKeyRequest struct {
+	Name  string `json:"name"`
+	Key   string `json:"key"`
+	Local bool   `json:"local"`
+}
+
+type ptmKeysResponse struct {
+	Keys []struct {
+		Key string `json:"key"`
+	} `json:"keys"`
+}
+
+type errMsg struct {
+	Message string `json:"error"`
+}
+
+// privacyManager checks the health of the PTM, and maintains the known enclave keys
+type privacyManager struct {
+	conf     *PrivacyConf
+	client   *http.Client
+	db       kvstore.KVStore
+	mux      sync.Mutex
+	keys     map[string]*PrivacyKey
+	resolved map[string]string
+}
+
+func newPrivacyManager(conf *PrivacyConf) *privacyManager {
+	return &privacyManager{
+		conf:     conf,
+		client:   &http.Client{Transport: utils.EgressTransport(nil)},
+		keys:     make(map[string]*PrivacyKey),
+		resolved: make(map[string]string),
+	}
+}
+
+func (pm *privacyManager) init() (err error) {
+	pm.conf.PTMURL = strings.TrimSuffix(pm.conf.PTMURL, "/")
+	if pm.conf.TLS.Enabled {
+		tlsConfig, err := utils.CreateTLSConfiguration(&pm.conf.TLS)
+		if err != nil {
+			return err
+		}
+		pm.client.Transport = utils.EgressTransport(&http.Transport{TLSClientConfig: tlsConfig})
+	}
+	if pm.conf.KeysDB != "" {
+		if pm.db, err = kvstore.NewKeyValueStore(pm.conf.KeysDB); err != nil {
+			return err
+		}
+	} else {
+		pm.db = kvstore.NewMemoryKeyValueStore()
+	}
+
+	pm.mux.Lock()
+	defer pm.mux.Unlock()
+	it := pm.db.NewIteratorWithRange(&kvstore.KVRange{Start: privacyKeyPrefix, Limit: privacyKeyPrefixEnd})
+	for it.Next() {
+		var key PrivacyKey
+		if err := json.Unmarshal(it.Value(), &key); err != nil {
+			log.Errorf("Failed to load enclave key '%s': %s", it.Key(), err)
+			continue
+		}
+		pm.keys[key.Name] = &key
+	}
+	it.Release()
+	// Keys in the config are only added if they have not been registered (or rotated) already
+	for _, key := range pm.conf.Keys {
+		if _, exists := pm.keys[key.Name]; !exists {
+			if err = validateEnclaveKey(key.Key); err != nil {
+				return err
+			}
+			pm.keys[key.Name] = key
+		}
+	}
+	pm.buildResolved()
+	return nil
+}
+
+func validateEnclaveKey(key string) error {
+	b, err := base64.StdEncoding.DecodeString(key)
+	if err != nil || len(b) != enclaveKeyByteLen {
+		return errors.Errorf(errors.PrivacyKeyInvalid, key)
+	}
+	return nil
+}
+
+// buildResolved must be called holding the mutex
+func (pm *privacyManager) buildResolved() {
+	pm.resolved = make(map[string]string)
+	for _, key := range pm.keys {
+		for _, previous := range key.PreviousKeys {
+			pm.resolved[previous] = key.Key
+		}
+	}
+	// Names take precedence over previous keys
+	for name, key := range pm.keys {
+		pm.resolved[name] = key.Key
+	}
+}
+
+// resolveKey maps a key name, or a key that has since been rotated, to the current key.
+// Anything else is returned unchanged
+func (pm *privacyManager) resolveKey(nameOrKey string) string {
+	pm.mux.Lock()
+	defer pm.mux.Unlock()
+	if key, exists := pm.resolved[nameOrKey]; exists {
+		return key
+	}
+	return nameOrKey
+}
+
+// storeKey must be called holding the mutex
+func (pm *privacyManager) storeKey(key *PrivacyKey) error {
+	key.Updated = time.Now().UTC().Format(time.RFC3339)
+	b, _ := json.Marshal(key)
+	if err := pm.db.Put(privacyKeyPrefix+key.Name, b); err != nil {
+		return errors.Errorf(errors.PrivacyKeyStoreFailed, key.Name, err)
+	}
+	pm.keys[key.Name] = key
+	pm.buildResolved()
+	return nil
+}
+
+func (pm *privacyManager) listKeys() []*PrivacyKey {
+	pm.mux.Lock()
+	defer pm.mux.Unlock()
+	keys := make([]*PrivacyKey, 0, len(pm.keys))
+	for _, key := range pm.keys {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].Name < keys[j].Name })
+	return keys
+}
+
+func (pm *privacyManager) addKey(req *privacyKeyRequest) (*PrivacyKey, int, error) {
+	if req.Name == "" || req.Key == "" {
+		return nil, 400, errors.Errorf(errors.PrivacyKeyMissingFields)
+	}
+	if err := validateEnclaveKey(req.Key); err != nil {
+		return nil, 400, err
+	}
+	pm.mux.Lock()
+	defer pm.mux.Unlock()
+	if _, exists := pm.keys[req.Name]; exists {
+		return nil, 409, errors.Errorf(errors.PrivacyKeyExists, req.Name)
+	}
+	key := &PrivacyKey{
+		Name:  req.Name,
+		Key:   req.Key,
+		Local: req.Local,
+	}
+	if err := pm.storeKey(key); err != nil {
+		return nil, 500, err
+	}
+	log.Infof("Registered enclave key '%s': %s", key.Name, key.Key)
+	return key, 201, nil
+}
+
+func (pm *privacyManager) rotateKey(name string, req *privacyKeyRequest) (*PrivacyKey, int, error) {
+	if req.Key == "" {
+		return nil, 400, errors.Errorf(errors.PrivacyKeyMissingFields)
+	}
+	if err := validateEnclaveKey(req.Key); err != nil {
+		return nil, 400, err
+	}
+	pm.mux.Lock()
+	defer pm.mux.Unlock()
+	existing, exists := pm.keys[name]
+	if !exists {
+		return nil, 404, errors.Errorf(errors.PrivacyKeyNotFound, name)
+	}
+	if existing.Key == req.Key {
+		return existing, 200, nil
+	}
+	rotated := &PrivacyKey{
+		Name:         name,
+		Key:          req.Key,
+		Local:        existing.Local,
+		PreviousKeys: append([]string{existing.Key}, existing.PreviousKeys...),
+	}
+	if err := pm.storeKey(rotated); err != nil {
+		return nil, 500, err
+	}
+	log.Infof("Rotated enclave key '%s' from %s to %s", name, existing.Key, rotated.Key)
+	return rotated, 200, nil
+}
+
+// upcheck uses the /upcheck API supported by both Orion and Tessera
+func (pm *privacyManager) upcheck(ctx context.Context) error {
+	res, err := pm.ptmRequest(ctx, "/upcheck")
+	if err != nil {
+		return errors.Errorf(errors.PrivacyPTMUnreachable, pm.conf.PTMURL, err)
+	}
+	res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return errors.Errorf(errors.PrivacyPTMUnreachable, pm.conf.PTMURL, errors.Errorf(errors.PrivacyPTMBadStatus, res.StatusCode))
+	}
+	return nil
+}
+
+// ptmKeys uses the Tessera /keys API to list the keys of the PTM. Returns nil if
+// the PTM does not support listing its keys
+func (pm *privacyManager) ptmKeys(ctx context.Context) map[string]bool {
+	res, err := pm.ptmRequest(ctx, "/keys")
+	if err != nil {
+		return nil
+	}
+	defer res.Body.Close()
+	var keysRes ptmKeysResponse
+	body, _ := ioutil.ReadAll(res.Body)
+	if res.StatusCode != 200 || json.Unmarshal(body, &keysRes) != nil {
+		log.Debugf("Unable to list PTM keys [%d]: %s", res.StatusCode, body)
+		return nil
+	}
+	keys := make(map[string]bool)
+	for _, k := range keysRes.Keys {
+		keys[k.Key] = true
+	}
+	return keys
+}
+
+func (pm *privacyManager) ptmRequest(ctx context.Context, path string) (*http.Response, error) {
+	ctx, cancel := context.WithTimeout(ctx, ptmRequestTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, pm.conf.PTMURL+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := pm.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	// Read the body before the context is cancelled
+	body, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	res.Body = ioutil.NopCloser(bytes.NewReader(body))
+	return res, nil
+}
+
+func (pm *privacyManager) status(ctx context.Context) *PrivacyStatus {
+	status := &PrivacyStatus{OK: true}
+	var ptmKeys map[string]bool
+	if pm.conf.PTMURL != "" {
+		status.PTM = &PTMStatus{URL: pm.conf.PTMURL, Reachable: true}
+		if err := pm.upcheck(ctx); err != nil {
+			status.OK = false
+			status.PTM.Reachable = false
+			status.PTM.Error = err.Error()
+		} else {
+			ptmKeys = pm.ptmKeys(ctx)
+		}
+	}
+	for _, key := range pm.listKeys() {
+		keyStatus := &PrivacyKeyStatus{PrivacyKey: key}
+		if key.Local && ptmKeys != nil {
+			available := ptmKeys[key.Key]
+			keyStatus.Available = &available
+			if !available {
+				status.OK = false
+			}
+		}
+		status.Keys = append(status.Keys, keyStatus)
+	}
+	if status.Keys == nil {
+		status.Keys = []*PrivacyKeyStatus{}
+	}
+	return status
+}
+
+func (pm *privacyManager) addRoutes(router *httprouter.Router) {
+	router.GET("/status/privacy", pm.statusHandler)
+	router.GET("/privacy/keys", pm.listKeysHandler)
+	router.POST("/privacy/keys", pm.addKeyHandler)
+	router.PUT("/privacy/keys/:name", pm.rotateKeyHandler)
+}
+
+func (pm *privacyManager) statusHandler(res http.ResponseWriter, req *http.Request, params httprouter.Params) {
+	log.Infof("--> %s %s", req.Method, req.URL)
+	status := pm.status(req.Context())
+	code := 200
+	if !status.OK {
+		code = 503
+	}
+	pm.reply(res, req, code, status)
+}
+
+func (pm *privacyManager) listKeysHandler(res http.ResponseWriter, req *http.Request, params httprouter.Params) {
+	log.Infof("--> %s %s", req.Method, req.URL)
+	pm.reply(res, req, 200, pm.listKeys())
+}
+
+func (pm *privacyManager) addKeyHandler(res http.ResponseWriter, req *http.Request, params httprouter.Params) {
+	log.Infof("--> %s %s", req.Method, req.URL)
+	var keyReq privacyKeyRequest
+	if err := json.NewDecoder(req.Body).Decode(&keyReq); err != nil {
+		pm.errReply(res, req, errors.Errorf(errors.PrivacyInvalidRequest, err), 400)
+		return
+	}
+	key, status, err := pm.addKey(&keyReq)
+	if err != nil {
+		pm.errReply(res, req, err, status)
+		return
+	}
+	pm.reply(res, req, status, key)
+}
+
+func (pm *privacyManager) rotateKeyHandler(res http.ResponseWriter, req *http.Request, params httprouter.Params) {
+	log.Infof("--> %s %s", req.Method, req.URL)
+	var keyReq privacyKeyRequest
+	if err := json.NewDecoder(req.Body).Decode(&keyReq); err != nil {
+		pm.errReply(res, req, errors.Errorf(errors.PrivacyInvalidRequest, err), 400)
+		return
+	}
+	key, status, err := pm.rotateKey(params.ByName("name"), &keyReq)
+	if err != nil {
+		pm.errReply(res, req, err, status)
+		return
+	}
+	pm.reply(res, req, status, key)
+}
+
+func (pm *privacyManager) reply(res http.ResponseWriter, req *http.Request, status int, body interface{}) {
+	log.Infof("<-- %s %s [%d]", req.Method, req.URL, status)
+	res.Header().Set("Content-Type", "application/json")
+	res.WriteHeader(status)
+	enc := json.NewEncoder(res)
+	enc.SetIndent("", "  ")
+	enc.Encode(body)
+}
+
+func (pm *privacyManager) errReply(res http.ResponseWriter, req *http.Request, err error, status int) {
+	log.Errorf("<-- %s %s [%d]: %s", req.Method, req.URL, status, err)
+	reply, _ := json.Marshal(&errMsg{Message: err.Error()})
+	res.Header().Set("Content-Type", "application/json")
+	res.WriteHeader(status)
+	res.Write(reply)
+}
@@ -0,0 +1,322 @@
+// Copyright 2021 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tx
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/kaleido-io/ethconnect/internal/eth"
+	"github.com/kaleido-io/ethconnect/internal/kvstore"
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	testEnclaveKey1 = "jO6dpqnMhmnrCHqUumyK09+18diF7quq/rROGs2HFWI="
+	testEnclaveKey2 = "2QiZG7rYPzRvRsioEn6oYUff1DOvPA22EZr0+/o3RUg="
+	testEnclaveKey3 = "oD76ZRgu6py/WKrsXbtF9P2Mf1mxVxzqficE1Uiw6S8="
+)
+
+func newTestPrivacyManager(t *testing.T, conf *PrivacyConf) (*privacyManager, *httprouter.Router) {
+	pm := newPrivacyManager(conf)
+	assert.NoError(t, pm.init())
+	router := &httprouter.Router{}
+	pm.addRoutes(router)
+	return pm, router
+}
+
+func testPrivacyRequest(router *httprouter.Router, method, path, body string) (int, map[string]interface{}) {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	res := httptest.NewRecorder()
+	router.ServeHTTP(res, req)
+	var reply map[string]interface{}
+	json.NewDecoder(res.Body).Decode(&reply)
+	return res.Code, reply
+}
+
+func newTestPTM(keys string) *httptest.Server {
+	router := &httprouter.Router{}
+	router.GET("/upcheck", func(res http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+		res.Write([]byte("I'm up!"))
+	})
+	if keys != "" {
+		router.GET("/keys", func(res http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+			res.Write([]byte(keys))
+		})
+	}
+	return httptest.NewServer(router)
+}
+
+func TestPrivacyKeysAddListRotate(t *testing.T) {
+	assert := assert.New(t)
+
+	pm, router := newTestPrivacyManager(t, &PrivacyConf{
+		Keys: []*PrivacyKey{{Name: "node1", Key: testEnclaveKey1, Local: true}},
+	})
+
+	status, reply := testPrivacyRequest(router, "POST", "/privacy/keys", `{"name":"partyB","key":"`+testEnclaveKey2+`"}`)
+	assert.Equal(201, status)
+	assert.Equal("partyB", reply["name"])
+	assert.NotEmpty(reply["updated"])
+
+	status, reply = testPrivacyRequest(router, "POST", "/privacy/keys", `{"name":"partyB","key":"`+testEnclaveKey2+`"}`)
+	assert.Equal(409, status)
+	assert.Equal("Enclave key 'partyB' is already registered", reply["error"])
+
+	assert.Equal(testEnclaveKey1, pm.resolveKey("node1"))
+	assert.Equal(testEnclaveKey2, pm.resolveKey("partyB"))
+	assert.Equal(testEnclaveKey3, pm.resolveKey(testEnclaveKey3))
+
+	status, reply = testPrivacyRequest(router, "PUT", "/privacy/keys/partyB", `{"key":"`+testEnclaveKey3+`"}`)
+	assert.Equal(200, status)
+	assert.Equal(testEnclaveKey3, reply["key"])
+	assert.Equal([]interface{}{testEnclaveKey2}, reply["previousKeys"])
+	assert.Equal(testEnclaveKey3, pm.resolveKey("partyB"))
+	assert.Equal(testEnclaveKey3, pm.resolveKey(testEnclaveKey2))
+
+	// Rotating to the same key is a no-op
+	status, reply = testPrivacyRequest(router, "PUT", "/privacy/keys/partyB", `{"key":"`+testEnclaveKey3+`"}`)
+	assert.Equal(200, status)
+	assert.Len(reply["previousKeys"], 1)
+
+	req := httptest.NewRequest("GET", "/privacy/keys", nil)
+	res := httptest.NewRecorder()
+	router.ServeHTTP(res, req)
+	assert.Equal(200, res.Code)
+	var keys []*PrivacyKey
+	json.NewDecoder(res.Body).Decode(&keys)
+	assert.Len(keys, 2)
+	assert.Equal("node1", keys[0].Name)
+	assert.True(keys[0].Local)
+	assert.Equal("partyB", keys[1].Name)
+}
+
+func TestPrivacyKeysBadRequests(t *testing.T) {
+	assert := assert.New(t)
+
+	_, router := newTestPrivacyManager(t, &PrivacyConf{})
+
+	status, reply := testPrivacyRequest(router, "POST", "/privacy/keys", `!json`)
+	assert.Equal(400, status)
+	assert.Regexp("Invalid enclave key request", reply["error"])
+	status, reply = testPrivacyRequest(router, "POST", "/privacy/keys", `{"name":"partyB"}`)
+	assert.Equal(400, status)
+	assert.Equal("A name and key must be supplied", reply["error"])
+	status, reply = testPrivacyRequest(router, "POST", "/privacy/keys", `{"name":"partyB","key":"badness"}`)
+	assert.Equal(400, status)
+	assert.Regexp("Invalid enclave public key 'badness'", reply["error"])
+
+	status, reply = testPrivacyRequest(router, "PUT", "/privacy/keys/partyB", `!json`)
+	assert.Equal(400, status)
+	status, reply = testPrivacyRequest(router, "PUT", "/privacy/keys/partyB", `{}`)
+	assert.Equal(400, status)
+	status, reply = testPrivacyRequest(router, "PUT", "/privacy/keys/partyB", `{"key":"dG9vc2hvcnQ="}`)
+	assert.Equal(400, status)
+	status, reply = testPrivacyRequest(router, "PUT", "/privacy/keys/partyB", `{"key":"`+testEnclaveKey2+`"}`)
+	assert.Equal(404, status)
+	assert.Equal("No enclave key registered with name 'partyB'", reply["error"])
+}
+
+func TestPrivacyKeysStoreFailure(t *testing.T) {
+	assert := assert.New(t)
+
+	pm, router := newTestPrivacyManager(t, &PrivacyConf{
+		Keys: []*PrivacyKey{{Name: "node1", Key: testEnclaveKey1}},
+	})
+	pm.db = kvstore.NewMockKV(fmt.Errorf("pop"))
+
+	status, reply := testPrivacyRequest(router, "POST", "/privacy/keys", `{"name":"partyB","key":"`+testEnclaveKey2+`"}`)
+	assert.Equal(500, status)
+	assert.Equal("Failed to store enclave key 'partyB': pop", reply["error"])
+	status, _ = testPrivacyRequest(router, "PUT", "/privacy/keys/node1", `{"key":"`+testEnclaveKey2+`"}`)
+	assert.Equal(500, status)
+	assert.Equal(testEnclaveKey1, pm.resolveKey("node1"))
+}
+
+func TestPrivacyKeysPersisted(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, _ := ioutil.TempDir("", "privacy")
+	defer os.RemoveAll(dir)
+	conf := &PrivacyConf{
+		KeysDB: path.Join(dir, "keys"),
+		Keys:   []*PrivacyKey{{Name: "node1", Key: testEnclaveKey1}},
+	}
+	pm, router := newTestPrivacyManager(t, conf)
+	status, _ := testPrivacyRequest(router, "PUT", "/privacy/keys/node1", `{"key":"`+testEnclaveKey2+`"}`)
+	assert.Equal(200, status)
+	pm.db.Close()
+
+	// The rotated key takes precedence over the config on restart
+	pm, _ = newTestPrivacyManager(t, conf)
+	defer pm.db.Close()
+	assert.Equal(testEnclaveKey2, pm.resolveKey("node1"))
+	assert.Equal(testEnclaveKey2, pm.resolveKey(testEnclaveKey1))
+}
+
+func TestPrivacyInitErrors(t *testing.T) {
+	assert := assert.New(t)
+
+	err := newPrivacyManager(&PrivacyConf{
+		Keys: []*PrivacyKey{{Name: "node1", Key: "badness"}},
+	}).init()
+	assert.Regexp("Invalid enclave public key", err)
+
+	err = newPrivacyManager(&PrivacyConf{
+		KeysDB: "unknown://",
+	}).init()
+	assert.Regexp("unknown", err)
+
+	conf := &PrivacyConf{}
+	conf.TLS.Enabled = true
+	conf.TLS.CACertsFile = "/does/not/exist"
+	err = newPrivacyManager(conf).init()
+	assert.Error(err)
+}
+
+func TestPrivacyStatusHealthy(t *testing.T) {
+	assert := assert.New(t)
+
+	ptm := newTestPTM(`{"keys":[{"key":"` + testEnclaveKey1 + `"}]}`)
+	defer ptm.Close()
+	_, router := newTestPrivacyManager(t, &PrivacyConf{
+		PTMURL: ptm.URL + "/",
+		Keys: []*PrivacyKey{
+			{Name: "node1", Key: testEnclaveKey1, Local: true},
+			{Name: "partyB", Key: testEnclaveKey2},
+		},
+	})
+
+	status, reply := testPrivacyRequest(router, "GET", "/status/privacy", "")
+	assert.Equal(200, status)
+	assert.Equal(true, reply["ok"])
+	assert.Equal(ptm.URL, reply["ptm"].(map[string]interface{})["url"])
+	assert.Equal(true, reply["ptm"].(map[string]interface{})["reachable"])
+	keys := reply["keys"].([]interface{})
+	assert.Equal(true, keys[0].(map[string]interface{})["available"])
+	_, exists := keys[1].(map[string]interface{})["available"]
+	assert.False(exists)
+}
+
+func TestPrivacyStatusLocalKeyUnavailable(t *testing.T) {
+	assert := assert.New(t)
+
+	ptm := newTestPTM(`{"keys":[{"key":"` + testEnclaveKey2 + `"}]}`)
+	defer ptm.Close()
+	_, router := newTestPrivacyManager(t, &PrivacyConf{
+		PTMURL: ptm.URL,
+		Keys:   []*PrivacyKey{{Name: "node1", Key: testEnclaveKey1, Local: true}},
+	})
+
+	status, reply := testPrivacyRequest(router, "GET", "/status/privacy", "")
+	assert.Equal(503, status)
+	assert.Equal(false, reply["ok"])
+	assert.Equal(false, reply["keys"].([]interface{})[0].(map[string]interface{})["available"])
+}
+
+func TestPrivacyStatusKeysNotListable(t *testing.T) {
+	assert := assert.New(t)
+
+	ptm := newTestPTM("")
+	defer ptm.Close()
+	_, router := newTestPrivacyManager(t, &PrivacyConf{
+		PTMURL: ptm.URL,
+		Keys:   []*PrivacyKey{{Name: "node1", Key: testEnclaveKey1, Local: true}},
+	})
+
+	status, reply := testPrivacyRequest(router, "GET", "/status/privacy", "")
+	assert.Equal(200, status)
+	_, exists := reply["keys"].([]interface{})[0].(map[string]interface{})["available"]
+	assert.False(exists)
+}
+
+func TestPrivacyStatusPTMDown(t *testing.T) {
+	assert := assert.New(t)
+
+	ptm := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		res.WriteHeader(500)
+	}))
+	_, router := newTestPrivacyManager(t, &PrivacyConf{PTMURL: ptm.URL})
+
+	status, reply := testPrivacyRequest(router, "GET", "/status/privacy", "")
+	assert.Equal(503, status)
+	assert.Regexp("unreachable: Private transaction manager returned status 500", reply["ptm"].(map[string]interface{})["error"])
+	assert.Empty(reply["keys"])
+
+	ptm.Close()
+	status, reply = testPrivacyRequest(router, "GET", "/status/privacy", "")
+	assert.Equal(503, status)
+	assert.Equal(false, reply["ptm"].(map[string]interface{})["reachable"])
+}
+
+func TestPrivacyStatusNoPTM(t *testing.T) {
+	assert := assert.New(t)
+
+	pm, _ := newTestPrivacyManager(t, &PrivacyConf{})
+	status := pm.status(context.Background())
+	assert.True(status.OK)
+	assert.Nil(status.PTM)
+	assert.Empty(status.Keys)
+}
+
+func TestOnSendTransactionMessageResolvesKeysAndReportsPTMDown(t *testing.T) {
+	assert := assert.New(t)
+
+	ptm := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {}))
+	ptm.Close()
+	txnProcessor := NewTxnProcessor(&TxnProcessorConf{
+		MaxTXWaitTime: 1,
+		PrivacyConf: PrivacyConf{
+			PTMURL: ptm.URL,
+			Keys: []*PrivacyKey{
+				{Name: "node1", Key: testEnclaveKey1, Local: true},
+				{Name: "partyB", Key: testEnclaveKey2},
+			},
+		},
+	}, &eth.RPCConf{}).(*txnProcessor)
+	testTxnContext := &testTxnContext{}
+	testTxnContext.jsonMsg = "{" +
+		"  \"headers\":{\"type\": \"SendTransaction\"}," +
+		"  \"from\":\"" + testFromAddr + "\"," +
+		"  \"gas\":\"123\"," +
+		"  \"method\":{\"name\":\"test\"}," +
+		"  \"privateFrom\":\"node1\"," +
+		"  \"privateFor\":[\"partyB\",\"" + testEnclaveKey3 + "\"]" +
+		"}"
+	testRPC := &testRPC{
+		ethSendTransactionErr: fmt.Errorf("pop"),
+	}
+	txnProcessor.Init(testRPC)
+
+	txnProcessor.OnMessage(testTxnContext)
+	for len(testTxnContext.errorReplies) == 0 {
+		time.Sleep(1 * time.Millisecond)
+	}
+
+	assert.Regexp("pop \\(Private transaction manager at .* is unreachable", testTxnContext.errorReplies[0].err.Error())
+	sendTX := testRPC.params[len(testRPC.params)-1][0].(*eth.SendTXArgs)
+	assert.Equal(testEnclaveKey1, sendTX.PrivateFrom)
+	assert.Equal([]string{testEnclaveKey2, testEnclaveKey3}, sendTX.PrivateFor)
+}
@@ -0,0 +1,112 @@
+// Copyright 2021 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tx
+
+import (
+	"math/big"
+	"sync"
+
+	ethbinding "github.com/kaleido-io/ethbinding/pkg"
+	"github.com/kaleido-io/ethconnect/internal/eth"
+	"github.com/kaleido-io/ethconnect/internal/messages"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	defaultReceiptFeesMaxRequests = 10000
+)
+
+// ReceiptFeesConf adds the fees paid to transaction receipts. This costs up to two
+// extra JSON/RPC calls for each receipt, to get the base fee of the block, and the
+// gas price from nodes that do not return the effectiveGasPrice in receipts
+type ReceiptFeesConf struct {
+	Enabled     bool `json:"enabled"`
+	MaxRequests int  `json:"maxRequests,omitempty"`
+}
+
+// requestFees keeps a running total of the fees paid for each request ID, so a request
+// that is sent more than once, such as when it is redelivered, is charged for each
+// transaction. Only the most recent requests are remembered.
+type requestFees struct {
+	conf   *ReceiptFeesConf
+	lock   sync.Mutex
+	totals map[string]*big.Int
+	order  []string
+}
+
+func newRequestFees(conf *ReceiptFeesConf) *requestFees {
+	if conf.MaxRequests <= 0 {
+		conf.MaxRequests = defaultReceiptFeesMaxRequests
+	}
+	return &requestFees{
+		conf:   conf,
+		totals: make(map[string]*big.Int),
+	}
+}
+
+// add records the fee of a transaction sent for a request, and returns the total
+func (r *requestFees) add(requestID string, fee *big.Int) *big.Int {
+	if requestID == "" {
+		return fee
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	total, exists := r.totals[requestID]
+	if !exists {
+		if len(r.order) >= r.conf.MaxRequests {
+			delete(r.totals, r.order[0])
+			r.order = r.order[1:]
+		}
+		total = new(big.Int)
+		r.totals[requestID] = total
+		r.order = append(r.order, requestID)
+	}
+	total.Add(total, fee)
+	return new(big.Int).Set(total)
+}
+
+// addReceiptFees adds the fees to the reply. A failure to get the fees is logged, and
+// the receipt is sent without them
+func (p *txnProcessor) addReceiptFees(inflight *inflightTxn, tx *eth.Txn, reply *messages.TransactionReceipt) {
+	fees, err := tx.GetFees(inflight.txnContext.Context(), p.rpc)
+	if err != nil {
+		log.Warnf("Failed to get the fees for %s: %s", tx.Hash, err)
+		return
+	}
+	cumulativeFee := p.requestFees.add(inflight.txnContext.Headers().ID, fees.Fee)
+	reply.EffectiveGasPriceStr = fees.EffectiveGasPrice.Text(10)
+	reply.FeeStr = fees.Fee.Text(10)
+	reply.CumulativeFeeStr = cumulativeFee.Text(10)
+	if fees.BaseFeePerGas != nil {
+		reply.BaseFeePerGasStr = fees.BaseFeePerGas.Text(10)
+		reply.BaseFeeStr = fees.BaseFee.Text(10)
+		reply.PriorityFeeStr = fees.PriorityFee.Text(10)
+	}
+	if p.conf.HexValuesInReceipt {
+		reply.EffectiveGasPriceHex = hexBigInt(fees.EffectiveGasPrice)
+		reply.FeeHex = hexBigInt(fees.Fee)
+		reply.CumulativeFeeHex = hexBigInt(cumulativeFee)
+		if fees.BaseFeePerGas != nil {
+			reply.BaseFeePerGasHex = hexBigInt(fees.BaseFeePerGas)
+			reply.BaseFeeHex = hexBigInt(fees.BaseFee)
+			reply.PriorityFeeHex = hexBigInt(fees.PriorityFee)
+		}
+	}
+}
+
+func hexBigInt(i *big.Int) *ethbinding.HexBigInt {
+	h := ethbinding.HexBigInt(*i)
+	return &h
+}
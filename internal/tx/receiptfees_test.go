@@ -0,0 +1,130 @@
+// Copyright 2021 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tx
+
+import (
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+
+	ethbinding "github.com/kaleido-io/ethbinding/pkg"
+	"github.com/kaleido-io/ethconnect/internal/eth"
+	"github.com/kaleido-io/ethconnect/internal/messages"
+	"github.com/stretchr/testify/assert"
+)
+
+var goodSendTxnWithIDJSON = "{" +
+	"  \"headers\":{\"type\": \"SendTransaction\", \"id\": \"request1\"}," +
+	"  \"from\":\"" + testFromAddr + "\"," +
+	"  \"gas\":\"123\"," +
+	"  \"method\":{\"name\":\"test\"}" +
+	"}"
+
+func sendTestReceiptFeesTxn(t *testing.T, p *txnProcessor) *messages.TransactionReceipt {
+	testTxnContext := &testTxnContext{}
+	testTxnContext.jsonMsg = goodSendTxnWithIDJSON
+	p.OnMessage(testTxnContext)
+	for len(testTxnContext.replies) == 0 && len(testTxnContext.errorReplies) == 0 {
+		time.Sleep(1 * time.Millisecond)
+	}
+	assert.Empty(t, testTxnContext.errorReplies)
+	return testTxnContext.replies[0].IsReceipt()
+}
+
+func TestRequestFeesEviction(t *testing.T) {
+	assert := assert.New(t)
+
+	r := newRequestFees(&ReceiptFeesConf{})
+	assert.Equal(defaultReceiptFeesMaxRequests, r.conf.MaxRequests)
+
+	r = newRequestFees(&ReceiptFeesConf{MaxRequests: 2})
+	assert.Equal(int64(10), r.add("", big.NewInt(10)).Int64())
+	assert.Equal(int64(10), r.add("req1", big.NewInt(10)).Int64())
+	assert.Equal(int64(30), r.add("req1", big.NewInt(20)).Int64())
+	r.add("req2", big.NewInt(5))
+	r.add("req3", big.NewInt(5))
+	assert.Equal([]string{"req2", "req3"}, r.order)
+
+	// The oldest request was forgotten
+	assert.Equal(int64(7), r.add("req1", big.NewInt(7)).Int64())
+}
+
+func TestOnSendTransactionMessageReceiptFees(t *testing.T) {
+	assert := assert.New(t)
+
+	p := NewTxnProcessor(&TxnProcessorConf{
+		MaxTXWaitTime:      1,
+		HexValuesInReceipt: true,
+		ReceiptFees:        ReceiptFeesConf{Enabled: true},
+	}, &eth.RPCConf{}).(*txnProcessor)
+	testRPC := goodMessageRPC()
+	testRPC.ethGetTransactionReceiptResult.EffectiveGasPrice = (*ethbinding.HexBigInt)(big.NewInt(1500))
+	testRPC.ethGetBlockByHashResult = map[string]interface{}{
+		"baseFeePerGas": "0x3e8",
+	}
+	p.Init(testRPC)
+
+	// gasUsed is 345678
+	receipt := sendTestReceiptFeesTxn(t, p)
+	assert.Equal("1500", receipt.EffectiveGasPriceStr)
+	assert.Equal("518517000", receipt.FeeStr)
+	assert.Equal("1000", receipt.BaseFeePerGasStr)
+	assert.Equal("345678000", receipt.BaseFeeStr)
+	assert.Equal("172839000", receipt.PriorityFeeStr)
+	assert.Equal("518517000", receipt.CumulativeFeeStr)
+	assert.Equal(int64(518517000), receipt.FeeHex.ToInt().Int64())
+	assert.Equal(int64(1000), receipt.BaseFeePerGasHex.ToInt().Int64())
+	assert.Contains(testRPC.calls, "eth_getBlockByHash")
+
+	// Sending the same request again adds to the cumulative fee
+	receipt = sendTestReceiptFeesTxn(t, p)
+	assert.Equal("518517000", receipt.FeeStr)
+	assert.Equal("1037034000", receipt.CumulativeFeeStr)
+	assert.Equal(int64(1037034000), receipt.CumulativeFeeHex.ToInt().Int64())
+}
+
+func TestOnSendTransactionMessageReceiptFeesFail(t *testing.T) {
+	assert := assert.New(t)
+
+	p := NewTxnProcessor(&TxnProcessorConf{
+		MaxTXWaitTime: 1,
+		ReceiptFees:   ReceiptFeesConf{Enabled: true},
+	}, &eth.RPCConf{}).(*txnProcessor)
+	testRPC := goodMessageRPC()
+	testRPC.ethGetTransactionReceiptResult.GasUsed = nil
+	p.Init(testRPC)
+
+	// The receipt is sent without the fees
+	receipt := sendTestReceiptFeesTxn(t, p)
+	assert.Empty(receipt.FeeStr)
+	assert.Empty(receipt.CumulativeFeeStr)
+	assert.NotContains(strings.Join(testRPC.calls, ","), "eth_getBlockByHash")
+}
+
+func TestOnSendTransactionMessageReceiptFeesDisabled(t *testing.T) {
+	assert := assert.New(t)
+
+	p := NewTxnProcessor(&TxnProcessorConf{
+		MaxTXWaitTime: 1,
+	}, &eth.RPCConf{}).(*txnProcessor)
+	testRPC := goodMessageRPC()
+	testRPC.ethGetTransactionReceiptResult.EffectiveGasPrice = (*ethbinding.HexBigInt)(big.NewInt(1500))
+	p.Init(testRPC)
+
+	receipt := sendTestReceiptFeesTxn(t, p)
+	assert.Empty(receipt.EffectiveGasPriceStr)
+	assert.Empty(receipt.FeeStr)
+}
@@ -0,0 +1,262 @@
+// Copyright 2021 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tx
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	ethbinding "github.com/kaleido-io/ethbinding/pkg"
+	"github.com/kaleido-io/ethconnect/internal/errors"
+	"github.com/kaleido-io/ethconnect/internal/eth"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	defaultReceiptPollerWorkers       = 4
+	defaultReceiptPollerBatchSize     = 100
+	defaultReceiptPollerMinIntervalMS = 250
+	defaultReceiptPollerMaxIntervalMS = 5000
+	receiptPollerBlockTimeSamples     = 10
+	receiptPollerCallTimeout          = 30 * time.Second
+)
+
+// ReceiptPollerConf configures a shared poller that fetches the receipts of all in-flight
+// transactions in JSON/RPC batches, rather than each transaction polling the node on its own.
+// The interval between polls follows the recent block times of the chain, within the
+// min and max intervals (in milliseconds)
+type ReceiptPollerConf struct {
+	Enabled       bool `json:"enabled"`
+	Workers       int  `json:"workers,omitempty"`
+	BatchSize     int  `json:"batchSize,omitempty"`
+	MinIntervalMS int  `json:"minInterval,omitempty"`
+	MaxIntervalMS int  `json:"maxInterval,omitempty"`
+}
+
+// receiptRequest is a transaction waiting for the next poll. The receipt is held on the
+// request until the poll completes, as the waiter might have given up
+type receiptRequest struct {
+	hash    string
+	receipt eth.TxnReceipt
+	isMined bool
+	err     error
+	done    chan struct{}
+}
+
+// receiptPoller collects the transactions waiting for a receipt, and on each poll sends
+// eth_getTransactionReceipt for all of them in batches, across a pool of workers. The block
+// number is fetched in the same batch, and the average time between blocks is used to
+// schedule the next poll for just after the next block is expected
+type receiptPoller struct {
+	conf          *ReceiptPollerConf
+	rpc           eth.RPCClient
+	minInterval   time.Duration
+	maxInterval   time.Duration
+	mux           sync.Mutex
+	queued        []*receiptRequest
+	lastBlock     uint64
+	lastBlockTime time.Time
+	blockTime     time.Duration
+	ctx           context.Context
+	cancel        func()
+	done          chan struct{}
+}
+
+func newReceiptPoller(conf *ReceiptPollerConf, rpc eth.RPCClient) *receiptPoller {
+	if conf.Workers <= 0 {
+		conf.Workers = defaultReceiptPollerWorkers
+	}
+	if conf.BatchSize <= 0 {
+		conf.BatchSize = defaultReceiptPollerBatchSize
+	}
+	if conf.MinIntervalMS <= 0 {
+		conf.MinIntervalMS = defaultReceiptPollerMinIntervalMS
+	}
+	if conf.MaxIntervalMS < conf.MinIntervalMS {
+		conf.MaxIntervalMS = defaultReceiptPollerMaxIntervalMS
+		if conf.MaxIntervalMS < conf.MinIntervalMS {
+			conf.MaxIntervalMS = conf.MinIntervalMS
+		}
+	}
+	r := &receiptPoller{
+		conf:        conf,
+		rpc:         rpc,
+		minInterval: time.Duration(conf.MinIntervalMS) * time.Millisecond,
+		maxInterval: time.Duration(conf.MaxIntervalMS) * time.Millisecond,
+		done:        make(chan struct{}),
+	}
+	r.ctx, r.cancel = context.WithCancel(context.Background())
+	return r
+}
+
+func (r *receiptPoller) start() {
+	go r.run()
+}
+
+func (r *receiptPoller) close() {
+	r.cancel()
+	<-r.done
+}
+
+func (r *receiptPoller) run() {
+	defer close(r.done)
+	for {
+		select {
+		case <-time.After(r.interval()):
+			r.pollQueued()
+		case <-r.ctx.Done():
+			log.Debugf("Receipt poller stopped")
+			r.failQueued()
+			return
+		}
+	}
+}
+
+// poll waits for the next poll of the node, and returns whether the transaction was mined.
+// The receipt is set on the transaction if the poll completes
+func (r *receiptPoller) poll(ctx context.Context, tx *eth.Txn) (bool, error) {
+	req := &receiptRequest{
+		hash: tx.Hash,
+		done: make(chan struct{}),
+	}
+	r.mux.Lock()
+	r.queued = append(r.queued, req)
+	r.mux.Unlock()
+	select {
+	case <-req.done:
+	case <-ctx.Done():
+		return false, errors.Errorf(errors.RPCCallReturnedError, "eth_getTransactionReceipt", ctx.Err())
+	}
+	if req.err != nil {
+		return false, req.err
+	}
+	tx.Receipt = req.receipt
+	return req.isMined, nil
+}
+
+// interval is the time until just after the next block is expected, within the min and max
+// intervals. The min interval is used until the block time is known, and once a block is overdue
+func (r *receiptPoller) interval() time.Duration {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	if r.blockTime == 0 {
+		return r.minInterval
+	}
+	wait := time.Until(r.lastBlockTime.Add(r.blockTime))
+	if wait < r.minInterval {
+		return r.minInterval
+	}
+	if wait > r.maxInterval {
+		return r.maxInterval
+	}
+	return wait
+}
+
+// observeBlock updates the moving average of the time between blocks when a new block is seen
+func (r *receiptPoller) observeBlock(blockNumber uint64, at time.Time) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	if blockNumber <= r.lastBlock {
+		return
+	}
+	if r.lastBlock > 0 {
+		perBlock := at.Sub(r.lastBlockTime) / time.Duration(blockNumber-r.lastBlock)
+		if r.blockTime == 0 {
+			r.blockTime = perBlock
+		} else {
+			r.blockTime = (r.blockTime*(receiptPollerBlockTimeSamples-1) + perBlock) / receiptPollerBlockTimeSamples
+		}
+		log.Debugf("Block %d seen, average block time %.2fs", blockNumber, r.blockTime.Seconds())
+	}
+	r.lastBlock = blockNumber
+	r.lastBlockTime = at
+}
+
+func (r *receiptPoller) failQueued() {
+	r.mux.Lock()
+	queued := r.queued
+	r.queued = nil
+	r.mux.Unlock()
+	for _, req := range queued {
+		req.err = errors.Errorf(errors.TransactionReceiptPollerStopped)
+		close(req.done)
+	}
+}
+
+// pollQueued fetches the receipts of all the transactions queued since the last poll, in
+// batches of up to batchSize sent concurrently by the workers
+func (r *receiptPoller) pollQueued() {
+	r.mux.Lock()
+	queued := r.queued
+	r.queued = nil
+	r.mux.Unlock()
+	if len(queued) == 0 {
+		return
+	}
+
+	var blockNumber ethbinding.HexBigInt
+	blockNumberCall := &eth.RPCBatchElem{Method: "eth_blockNumber", Result: &blockNumber}
+	slots := make(chan struct{}, r.conf.Workers)
+	var wg sync.WaitGroup
+	for start := 0; start < len(queued); start += r.conf.BatchSize {
+		end := start + r.conf.BatchSize
+		if end > len(queued) {
+			end = len(queued)
+		}
+		batch := make([]*eth.RPCBatchElem, 0, end-start+1)
+		for _, req := range queued[start:end] {
+			batch = append(batch, &eth.RPCBatchElem{
+				Method: "eth_getTransactionReceipt",
+				Args:   []interface{}{req.hash},
+				Result: &req.receipt,
+			})
+		}
+		if start == 0 {
+			batch = append(batch, blockNumberCall)
+		}
+		wg.Add(1)
+		slots <- struct{}{}
+		go func(reqs []*receiptRequest, batch []*eth.RPCBatchElem) {
+			defer wg.Done()
+			defer func() { <-slots }()
+			r.pollBatch(reqs, batch)
+		}(queued[start:end], batch)
+	}
+	wg.Wait()
+	log.Debugf("Polled receipts for %d transactions", len(queued))
+
+	if blockNumberCall.Error == nil && blockNumber.ToInt().Sign() > 0 {
+		r.observeBlock(blockNumber.ToInt().Uint64(), time.Now())
+	}
+}
+
+func (r *receiptPoller) pollBatch(reqs []*receiptRequest, batch []*eth.RPCBatchElem) {
+	ctx, cancel := context.WithTimeout(r.ctx, receiptPollerCallTimeout)
+	defer cancel()
+	batchErr := eth.BatchCall(ctx, r.rpc, batch)
+	for i, req := range reqs {
+		err := batchErr
+		if err == nil {
+			err = batch[i].Error
+		}
+		if err != nil {
+			req.err = errors.Errorf(errors.RPCCallReturnedError, "eth_getTransactionReceipt", err)
+		} else {
+			req.isMined = req.receipt.BlockNumber != nil && req.receipt.BlockNumber.ToInt().Uint64() > 0
+		}
+		close(req.done)
+	}
+}
@@ -0,0 +1,238 @@
+// Copyright 2021 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tx
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	ethbinding "github.com/kaleido-io/ethbinding/pkg"
+	"github.com/kaleido-io/ethconnect/internal/eth"
+	"github.com/stretchr/testify/assert"
+)
+
+// testBatchRPC mines every transaction whose hash does not start with 0xfail, and
+// counts the batches it is sent
+type testBatchRPC struct {
+	mux       sync.Mutex
+	batches   []int
+	block     int64
+	batchErr  error
+	callCount int
+}
+
+func (r *testBatchRPC) CallContext(ctx context.Context, result interface{}, method string, args ...interface{}) error {
+	r.mux.Lock()
+	r.callCount++
+	r.mux.Unlock()
+	return fmt.Errorf("unexpected call to %s", method)
+}
+
+func (r *testBatchRPC) BatchCallContext(ctx context.Context, batch []*eth.RPCBatchElem) error {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	r.batches = append(r.batches, len(batch))
+	if r.batchErr != nil {
+		return r.batchErr
+	}
+	for _, elem := range batch {
+		switch elem.Method {
+		case "eth_blockNumber":
+			*(elem.Result.(*ethbinding.HexBigInt)) = ethbinding.HexBigInt(*big.NewInt(r.block))
+		case "eth_getTransactionReceipt":
+			hash := elem.Args[0].(string)
+			if strings.HasPrefix(hash, "0xfail") {
+				elem.Error = fmt.Errorf("pop")
+			} else if hash != "0xpending" {
+				blockNumber := ethbinding.HexBigInt(*big.NewInt(r.block))
+				elem.Result.(*eth.TxnReceipt).BlockNumber = &blockNumber
+			}
+		}
+	}
+	return nil
+}
+
+func TestReceiptPollerBatches(t *testing.T) {
+	assert := assert.New(t)
+	rpc := &testBatchRPC{block: 100}
+	r := newReceiptPoller(&ReceiptPollerConf{BatchSize: 100, MinIntervalMS: 10}, rpc)
+	r.start()
+
+	var wg sync.WaitGroup
+	results := make([]bool, 250)
+	errs := make([]error, 250)
+	for i := 0; i < 250; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			hash := fmt.Sprintf("0x%064x", i)
+			if i == 42 {
+				hash = "0xfail"
+			} else if i == 43 {
+				hash = "0xpending"
+			}
+			tx := &eth.Txn{Hash: hash}
+			results[i], errs[i] = r.poll(context.Background(), tx)
+			if results[i] {
+				assert.Equal(int64(100), tx.Receipt.BlockNumber.ToInt().Int64())
+			}
+		}(i)
+	}
+	wg.Wait()
+	r.close()
+
+	for i := 0; i < 250; i++ {
+		switch i {
+		case 42:
+			assert.Regexp("eth_getTransactionReceipt.*pop", errs[i])
+		case 43:
+			assert.NoError(errs[i])
+			assert.False(results[i])
+		default:
+			assert.NoError(errs[i])
+			assert.True(results[i])
+		}
+	}
+	// No batch is larger than the batch size, plus the block number
+	rpc.mux.Lock()
+	defer rpc.mux.Unlock()
+	assert.True(len(rpc.batches) >= 3)
+	for _, size := range rpc.batches {
+		assert.True(size <= 101)
+	}
+	assert.Equal(0, rpc.callCount)
+	assert.Equal(uint64(100), r.lastBlock)
+}
+
+func TestReceiptPollerBatchFailure(t *testing.T) {
+	rpc := &testBatchRPC{block: 100, batchErr: fmt.Errorf("pop")}
+	r := newReceiptPoller(&ReceiptPollerConf{MinIntervalMS: 1}, rpc)
+	r.start()
+	defer r.close()
+
+	isMined, err := r.poll(context.Background(), &eth.Txn{Hash: "0x12345"})
+	assert.False(t, isMined)
+	assert.Regexp(t, "eth_getTransactionReceipt.*pop", err)
+	assert.Equal(t, uint64(0), r.lastBlock)
+}
+
+func TestReceiptPollerContextDone(t *testing.T) {
+	r := newReceiptPoller(&ReceiptPollerConf{}, &testBatchRPC{})
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := r.poll(ctx, &eth.Txn{Hash: "0x12345"})
+	assert.Regexp(t, "eth_getTransactionReceipt.*canceled", err)
+}
+
+func TestReceiptPollerStopped(t *testing.T) {
+	r := newReceiptPoller(&ReceiptPollerConf{MinIntervalMS: 60000}, &testBatchRPC{})
+	r.start()
+	go func() {
+		for {
+			r.mux.Lock()
+			queued := len(r.queued)
+			r.mux.Unlock()
+			if queued > 0 {
+				r.close()
+				return
+			}
+			time.Sleep(1 * time.Millisecond)
+		}
+	}()
+	_, err := r.poll(context.Background(), &eth.Txn{Hash: "0x12345"})
+	assert.Regexp(t, "The receipt poller stopped", err)
+}
+
+func TestReceiptPollerAdaptiveInterval(t *testing.T) {
+	assert := assert.New(t)
+	r := newReceiptPoller(&ReceiptPollerConf{MinIntervalMS: 100, MaxIntervalMS: 10000}, &testBatchRPC{})
+	assert.Equal(100*time.Millisecond, r.interval())
+
+	now := time.Now()
+	r.observeBlock(10, now.Add(-10*time.Second))
+	assert.Equal(100*time.Millisecond, r.interval())
+	r.observeBlock(12, now.Add(-6*time.Second))
+	assert.Equal(2*time.Second, r.blockTime)
+	// The last block was 6s ago, with 2s blocks it is overdue
+	assert.Equal(100*time.Millisecond, r.interval())
+
+	// A block just seen schedules the next poll for when the next block is due
+	r.observeBlock(13, now)
+	assert.Equal((2*time.Second*9+6*time.Second)/10, r.blockTime)
+	interval := r.interval()
+	assert.True(interval > 2*time.Second && interval <= 2400*time.Millisecond)
+
+	// Old and repeated blocks are ignored
+	r.observeBlock(13, now.Add(time.Second))
+	r.observeBlock(5, now.Add(time.Second))
+	assert.Equal(uint64(13), r.lastBlock)
+	assert.Equal(now, r.lastBlockTime)
+
+	// Capped at the max interval
+	r.blockTime = time.Minute
+	assert.Equal(10*time.Second, r.interval())
+}
+
+func TestReceiptPollerDefaults(t *testing.T) {
+	conf := &ReceiptPollerConf{MinIntervalMS: 10000}
+	newReceiptPoller(conf, &testBatchRPC{})
+	assert.Equal(t, defaultReceiptPollerWorkers, conf.Workers)
+	assert.Equal(t, defaultReceiptPollerBatchSize, conf.BatchSize)
+	assert.Equal(t, 10000, conf.MaxIntervalMS)
+
+	conf = &ReceiptPollerConf{}
+	newReceiptPoller(conf, &testBatchRPC{})
+	assert.Equal(t, defaultReceiptPollerMinIntervalMS, conf.MinIntervalMS)
+	assert.Equal(t, defaultReceiptPollerMaxIntervalMS, conf.MaxIntervalMS)
+}
+
+func TestOnDeployContractMessageGoodTxnMinedReceiptPoller(t *testing.T) {
+	assert := assert.New(t)
+
+	txnProcessor := NewTxnProcessor(&TxnProcessorConf{
+		MaxTXWaitTime: 1,
+		ReceiptPoller: ReceiptPollerConf{Enabled: true, MinIntervalMS: 1},
+	}, &eth.RPCConf{}).(*txnProcessor)
+	testTxnContext := &testTxnContext{}
+	testTxnContext.jsonMsg = goodDeployTxnJSON
+
+	testRPC := goodMessageRPC()
+	txnProcessor.Init(testRPC)
+	defer txnProcessor.receiptPoller.close()
+	txnProcessor.maxTXWaitTime = 250 * time.Millisecond
+
+	txnProcessor.OnMessage(testTxnContext)
+	txnWG := &txnProcessor.inflightTxns[strings.ToLower(testFromAddr)].txnsInFlight[0].wg
+	txnWG.Wait()
+	assert.Equal(0, len(testTxnContext.errorReplies))
+
+	// The test RPC cannot send batches, so the calls are made one at a time
+	assert.Equal("eth_sendTransaction", testRPC.calls[0])
+	assert.Equal("eth_getTransactionReceipt", testRPC.calls[1])
+	assert.Equal("eth_blockNumber", testRPC.calls[2])
+
+	replyMsgBytes, _ := json.Marshal(testTxnContext.replies[0])
+	var replyMsgMap map[string]interface{}
+	json.Unmarshal(replyMsgBytes, &replyMsgMap)
+	assert.Equal("TransactionSuccess", testTxnContext.replies[0].ReplyHeaders().MsgType)
+	assert.Equal("12345", replyMsgMap["blockNumber"])
+	assert.Equal("0x28a62cb478a3c3d4daad84f1148ea16cd1a66f37", replyMsgMap["contractAddress"])
+}
@@ -0,0 +1,244 @@
+// Copyright 2021 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tx
+
+import (
+	"bytes"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"fmt"
+	"math/big"
+	"regexp"
+	"strings"
+	"sync"
+
+	ethbinding "github.com/kaleido-io/ethbinding/pkg"
+	"github.com/kaleido-io/ethconnect/internal/errors"
+	"github.com/kaleido-io/ethconnect/internal/eth"
+	"github.com/kaleido-io/ethconnect/internal/ethbind"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	oidECPublicKey = asn1.ObjectIdentifier{1, 2, 840, 10045, 2, 1}
+	oidSecp256k1   = asn1.ObjectIdentifier{1, 3, 132, 0, 10}
+	secp256k1N, _  = new(big.Int).SetString("fffffffffffffffffffffffffffffffebaaedce6af48a03bbfd25e8cd0364141", 16)
+	secp256k1HalfN = new(big.Int).Rsh(secp256k1N, 1)
+)
+
+// RemoteSignersConf configures signing with keys held by an external service, so the private
+// keys never touch ethconnect. Each signer applies to the from addresses that match its pattern
+type RemoteSignersConf struct {
+	ChainID string              `json:"chainID"`
+	Signers []*RemoteSignerConf `json:"signers"`
+}
+
+// RemoteSignerConf is a regular expression matched against the lower case 0x prefixed from
+// address, and exactly one of the services that holds the keys. The key name or ID can use
+// the submatches of the pattern, such as $1
+type RemoteSignerConf struct {
+	From  string           `json:"from"`
+	Vault *VaultSignerConf `json:"vault,omitempty"`
+	KMS   *KMSSignerConf   `json:"kms,omitempty"`
+}
+
+// remoteKey is a secp256k1 key held by an external service, which signs digests
+type remoteKey interface {
+	service() string
+	name() string
+	// publicKey returns the DER encoded SubjectPublicKeyInfo of the key
+	publicKey() ([]byte, error)
+	// signDigest returns the DER encoded ECDSA signature of the digest
+	signDigest(digest []byte) ([]byte, error)
+}
+
+type remoteSignerMatcher struct {
+	conf    *RemoteSignerConf
+	pattern *regexp.Regexp
+	newKey  func(from string, match []int) remoteKey
+}
+
+// remoteSigners resolves the signer for a from address, caching the signer of each
+// address once the public key of its remote key has been checked
+type remoteSigners struct {
+	conf     *RemoteSignersConf
+	chainID  big.Int
+	matchers []*remoteSignerMatcher
+	mux      sync.Mutex
+	signers  map[string]*remoteSigner
+}
+
+type remoteSigner struct {
+	address ethbinding.Address
+	key     remoteKey
+	chainID *big.Int
+}
+
+type ecdsaSignature struct {
+	R, S *big.Int
+}
+
+type subjectPublicKeyInfo struct {
+	Algorithm pkix.AlgorithmIdentifier
+	PublicKey asn1.BitString
+}
+
+func newRemoteSigners(conf *RemoteSignersConf) *remoteSigners {
+	rs := &remoteSigners{
+		conf:    conf,
+		signers: make(map[string]*remoteSigner),
+	}
+	rs.chainID.SetString(conf.ChainID, 0)
+	return rs
+}
+
+func (rs *remoteSigners) init() error {
+	for _, signerConf := range rs.conf.Signers {
+		pattern, err := regexp.Compile(signerConf.From)
+		if err != nil {
+			return errors.Errorf(errors.RemoteSignerInvalidPattern, signerConf.From, err)
+		}
+		matcher := &remoteSignerMatcher{conf: signerConf, pattern: pattern}
+		switch {
+		case signerConf.Vault != nil && signerConf.KMS == nil:
+			vault, err := newVaultClient(signerConf.Vault)
+			if err != nil {
+				return err
+			}
+			matcher.newKey = func(from string, match []int) remoteKey {
+				return vault.key(string(pattern.ExpandString(nil, vault.conf.Key, from, match)))
+			}
+		case signerConf.KMS != nil && signerConf.Vault == nil:
+			kms := newKMSClient(signerConf.KMS)
+			if _, err := kms.credentials.Credentials(); err != nil {
+				return errors.Errorf(errors.RemoteSignerMissingCredentials, signerConf.KMS.KeyID, err)
+			}
+			matcher.newKey = func(from string, match []int) remoteKey {
+				return kms.key(string(pattern.ExpandString(nil, kms.conf.KeyID, from, match)))
+			}
+		default:
+			return errors.Errorf(errors.RemoteSignerInvalidConfig, signerConf.From)
+		}
+		rs.matchers = append(rs.matchers, matcher)
+	}
+	return nil
+}
+
+// signerFor returns the signer for the first pattern that matches the address, or nil if
+// none match. The address of the remote key must be the from address
+func (rs *remoteSigners) signerFor(from string) (eth.TXSigner, error) {
+	if len(rs.matchers) == 0 || !aliasAddressMatcher.MatchString(strings.ToLower(from)) {
+		return nil, nil
+	}
+	address := "0x" + strings.TrimPrefix(strings.ToLower(from), "0x")
+	rs.mux.Lock()
+	defer rs.mux.Unlock()
+	if signer, ok := rs.signers[address]; ok {
+		return signer, nil
+	}
+	for _, matcher := range rs.matchers {
+		match := matcher.pattern.FindStringSubmatchIndex(address)
+		if match == nil {
+			continue
+		}
+		key := matcher.newKey(address, match)
+		keyAddress, err := remoteKeyAddress(key)
+		if err != nil {
+			return nil, err
+		}
+		if strings.ToLower(keyAddress.Hex()) != address {
+			return nil, errors.Errorf(errors.RemoteSignerAddressMismatch, key.service(), key.name(), keyAddress.Hex(), address)
+		}
+		log.Infof("Signing for %s with %s key '%s'", address, key.service(), key.name())
+		signer := &remoteSigner{
+			address: keyAddress,
+			key:     key,
+			chainID: &rs.chainID,
+		}
+		rs.signers[address] = signer
+		return signer, nil
+	}
+	return nil, nil
+}
+
+func validSignatureValue(v *big.Int) bool {
+	return v != nil && v.Sign() > 0 && v.Cmp(secp256k1N) < 0
+}
+
+// remoteKeyAddress is the ethereum address of the uncompressed secp256k1 public key of a remote key
+func remoteKeyAddress(key remoteKey) (address ethbinding.Address, err error) {
+	der, err := key.publicKey()
+	if err != nil {
+		return address, errors.Errorf(errors.RemoteSignerPublicKeyFailed, key.service(), key.name(), err)
+	}
+	var spki subjectPublicKeyInfo
+	if _, err := asn1.Unmarshal(der, &spki); err != nil {
+		return address, errors.Errorf(errors.RemoteSignerInvalidPublicKey, key.service(), key.name(), err)
+	}
+	var curve asn1.ObjectIdentifier
+	asn1.Unmarshal(spki.Algorithm.Parameters.FullBytes, &curve)
+	if !spki.Algorithm.Algorithm.Equal(oidECPublicKey) || !curve.Equal(oidSecp256k1) {
+		return address, errors.Errorf(errors.RemoteSignerInvalidPublicKey, key.service(), key.name(), fmt.Sprintf("algorithm %s %s", spki.Algorithm.Algorithm, curve))
+	}
+	point := spki.PublicKey.RightAlign()
+	if len(point) != 65 || point[0] != 0x04 {
+		return address, errors.Errorf(errors.RemoteSignerInvalidPublicKey, key.service(), key.name(), "not an uncompressed point")
+	}
+	return ethbind.API.HexToAddress(fmt.Sprintf("%x", ethbind.Keccak256(point[1:])[12:])), nil
+}
+
+func (s *remoteSigner) Type() string {
+	return s.key.service()
+}
+
+func (s *remoteSigner) Address() string {
+	return s.address.String()
+}
+
+// Sign has the remote key sign the EIP-155 hash of the transaction. The services return the
+// R and S of the signature without the recovery ID, which is found by checking which of the
+// two candidates recovers to the address of the key
+func (s *remoteSigner) Sign(tx *ethbinding.Transaction) ([]byte, error) {
+	ethSigner := ethbind.API.NewEIP155Signer(s.chainID)
+	digest := ethSigner.Hash(tx)
+	der, err := s.key.signDigest(digest[:])
+	if err != nil {
+		return nil, errors.Errorf(errors.RemoteSignerSignFailed, s.key.service(), s.key.name(), err)
+	}
+	var sig ecdsaSignature
+	if _, err := asn1.Unmarshal(der, &sig); err != nil || !validSignatureValue(sig.R) || !validSignatureValue(sig.S) {
+		return nil, errors.Errorf(errors.RemoteSignerInvalidSignature, s.key.service(), s.key.name(), "not an ASN.1 ECDSA signature")
+	}
+	// Ethereum only accepts the lower of the two valid S values (EIP-2)
+	if sig.S.Cmp(secp256k1HalfN) > 0 {
+		sig.S.Sub(secp256k1N, sig.S)
+	}
+	rs := make([]byte, 65)
+	sig.R.FillBytes(rs[0:32])
+	sig.S.FillBytes(rs[32:64])
+	for v := byte(0); v < 2; v++ {
+		rs[64] = v
+		signedTX, err := tx.WithSignature(ethSigner, rs)
+		if err != nil {
+			continue
+		}
+		if sender, err := ethSigner.Sender(signedTX); err == nil && sender == s.address {
+			signedRLP := new(bytes.Buffer)
+			signedTX.EncodeRLP(signedRLP)
+			return signedRLP.Bytes(), nil
+		}
+	}
+	return nil, errors.Errorf(errors.RemoteSignerInvalidSignature, s.key.service(), s.key.name(), "does not recover to "+s.address.Hex())
+}
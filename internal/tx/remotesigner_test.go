@@ -0,0 +1,253 @@
+// Copyright 2021 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tx
+
+import (
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"fmt"
+	"math/big"
+	"regexp"
+	"testing"
+
+	ethbinding "github.com/kaleido-io/ethbinding/pkg"
+	"github.com/kaleido-io/ethconnect/internal/ethbind"
+	"github.com/kaleido-io/ethconnect/internal/utils"
+	"github.com/stretchr/testify/assert"
+)
+
+// The private key of the first account of the well-known development mnemonic
+const testRemoteKeyHex = "ac0974bec39a17e36ba4a6b4d238ff944bacb478cbed5efcae784d7bf4f2ff80"
+
+type testRemoteKey struct {
+	key       *ecdsa.PrivateKey
+	keyName   string
+	highS     bool
+	signature []byte
+	err       error
+}
+
+func newTestRemoteKey(name string) *testRemoteKey {
+	key, _ := ethbind.API.HexToECDSA(testRemoteKeyHex)
+	return &testRemoteKey{key: key, keyName: name}
+}
+
+func testSPKI(key *ecdsa.PublicKey) []byte {
+	curve, _ := asn1.Marshal(oidSecp256k1)
+	point := make([]byte, 65)
+	point[0] = 0x04
+	key.X.FillBytes(point[1:33])
+	key.Y.FillBytes(point[33:65])
+	der, _ := asn1.Marshal(subjectPublicKeyInfo{
+		Algorithm: pkix.AlgorithmIdentifier{Algorithm: oidECPublicKey, Parameters: asn1.RawValue{FullBytes: curve}},
+		PublicKey: asn1.BitString{Bytes: point, BitLength: 520},
+	})
+	return der
+}
+
+// testSignDigest signs as the remote services do, with random nonces and no recovery ID
+func testSignDigest(key *ecdsa.PrivateKey, digest []byte, highS bool) []byte {
+	der, _ := ecdsa.SignASN1(rand.Reader, key, digest)
+	var sig ecdsaSignature
+	asn1.Unmarshal(der, &sig)
+	if highS == (sig.S.Cmp(secp256k1HalfN) <= 0) {
+		sig.S.Sub(secp256k1N, sig.S)
+	}
+	der, _ = asn1.Marshal(sig)
+	return der
+}
+
+func (k *testRemoteKey) service() string { return "Test" }
+
+func (k *testRemoteKey) name() string { return k.keyName }
+
+func (k *testRemoteKey) publicKey() ([]byte, error) {
+	return testSPKI(&k.key.PublicKey), k.err
+}
+
+func (k *testRemoteKey) signDigest(digest []byte) ([]byte, error) {
+	if k.signature != nil || k.err != nil {
+		return k.signature, k.err
+	}
+	return testSignDigest(k.key, digest, k.highS), nil
+}
+
+func newTestRemoteSigners(key remoteKey, patterns ...string) *remoteSigners {
+	rs := newRemoteSigners(&RemoteSignersConf{ChainID: "1337"})
+	for _, pattern := range patterns {
+		rs.matchers = append(rs.matchers, &remoteSignerMatcher{
+			pattern: regexp.MustCompile(pattern),
+			newKey:  func(from string, match []int) remoteKey { return key },
+		})
+	}
+	return rs
+}
+
+func testRemoteSignedSender(t *testing.T, signer *remoteSigner, signed []byte) string {
+	var tx ethbinding.Transaction
+	assert.NoError(t, tx.UnmarshalBinary(signed))
+	sender, err := ethbind.API.NewEIP155Signer(signer.chainID).Sender(&tx)
+	assert.NoError(t, err)
+	return sender.Hex()
+}
+
+func TestRemoteSignerSign(t *testing.T) {
+	assert := assert.New(t)
+	key := newTestRemoteKey("key1")
+	rs := newTestRemoteSigners(key, "^0xf39fd6e51aad88f6f4ce6ab8827279cfffb92266$")
+
+	s, err := rs.signerFor("F39FD6E51AAD88F6F4CE6AB8827279CFFFB92266")
+	assert.NoError(err)
+	signer := s.(*remoteSigner)
+	assert.Equal("Test", signer.Type())
+	assert.Equal(ethbind.API.HexToAddress(testKeystoreAddr0).Hex(), signer.Address())
+	cached, _ := rs.signerFor(testKeystoreAddr0)
+	assert.Equal(s, cached)
+
+	to := ethbind.API.HexToAddress(testAliasAddr)
+	for i := 0; i < 10; i++ {
+		// Both the high and low S signatures are normalized, for either recovery ID
+		key.highS = i%2 == 0
+		tx := ethbind.API.NewTransaction(uint64(i), to, big.NewInt(0), 21000, big.NewInt(0), []byte{})
+		signed, err := signer.Sign(tx)
+		assert.NoError(err)
+		assert.Equal(signer.Address(), testRemoteSignedSender(t, signer, signed))
+	}
+}
+
+func TestRemoteSignerSignFail(t *testing.T) {
+	assert := assert.New(t)
+	key := newTestRemoteKey("key1")
+	rs := newTestRemoteSigners(key, "^0x")
+	s, err := rs.signerFor(testKeystoreAddr0)
+	assert.NoError(err)
+	tx := ethbind.API.NewTransaction(0, ethbind.API.HexToAddress(testAliasAddr), big.NewInt(0), 21000, big.NewInt(0), []byte{})
+
+	key.err = fmt.Errorf("pop")
+	_, err = s.Sign(tx)
+	assert.EqualError(err, "Failed to sign with Test key 'key1': pop")
+
+	key.err = nil
+	key.signature = []byte("!asn1")
+	_, err = s.Sign(tx)
+	assert.EqualError(err, "Invalid signature from Test key 'key1': not an ASN.1 ECDSA signature")
+
+	key.signature, _ = asn1.Marshal(ecdsaSignature{R: big.NewInt(1), S: secp256k1N})
+	_, err = s.Sign(tx)
+	assert.Regexp("not an ASN.1 ECDSA signature", err)
+
+	other, _ := ethbind.API.HexToECDSA(fmt.Sprintf("%064x", 12345))
+	key.signature = testSignDigest(other, make([]byte, 32), false)
+	_, err = s.Sign(tx)
+	assert.Regexp("Invalid signature from Test key 'key1': does not recover to 0xf39Fd6e51aad88F6F4ce6aB8827279cffFb92266", err)
+}
+
+func TestRemoteSignerNoMatch(t *testing.T) {
+	assert := assert.New(t)
+	rs := newTestRemoteSigners(newTestRemoteKey("key1"), "^0x0000")
+
+	s, err := rs.signerFor(testKeystoreAddr0)
+	assert.NoError(err)
+	assert.Nil(s)
+	s, err = rs.signerFor("hd-u01234abcd-u01234abcd-1")
+	assert.NoError(err)
+	assert.Nil(s)
+	s, err = newRemoteSigners(&RemoteSignersConf{}).signerFor(testKeystoreAddr0)
+	assert.NoError(err)
+	assert.Nil(s)
+}
+
+func TestRemoteSignerAddressMismatch(t *testing.T) {
+	assert := assert.New(t)
+	key := newTestRemoteKey("key1")
+	rs := newTestRemoteSigners(key, "^0x")
+
+	_, err := rs.signerFor(testAliasAddr)
+	assert.EqualError(err, "Test key 'key1' has address 0xf39Fd6e51aad88F6F4ce6aB8827279cffFb92266, which does not match "+testAliasAddr)
+
+	key.err = fmt.Errorf("pop")
+	_, err = rs.signerFor(testKeystoreAddr0)
+	assert.EqualError(err, "Failed to get the public key of Test key 'key1': pop")
+}
+
+func TestRemoteKeyAddressInvalid(t *testing.T) {
+	assert := assert.New(t)
+	key := newTestRemoteKey("key1")
+	bad := &testPublicKey{testRemoteKey: key}
+
+	bad.der = []byte("!asn1")
+	_, err := remoteKeyAddress(bad)
+	assert.Regexp("The public key of Test key 'key1' is not a secp256k1 key", err)
+
+	p256, _ := asn1.Marshal(asn1.ObjectIdentifier{1, 2, 840, 10045, 3, 1, 7})
+	bad.der, _ = asn1.Marshal(subjectPublicKeyInfo{
+		Algorithm: pkix.AlgorithmIdentifier{Algorithm: oidECPublicKey, Parameters: asn1.RawValue{FullBytes: p256}},
+		PublicKey: asn1.BitString{Bytes: make([]byte, 65), BitLength: 520},
+	})
+	_, err = remoteKeyAddress(bad)
+	assert.Regexp("not a secp256k1 key: algorithm 1.2.840.10045.2.1 1.2.840.10045.3.1.7", err)
+
+	curve, _ := asn1.Marshal(oidSecp256k1)
+	bad.der, _ = asn1.Marshal(subjectPublicKeyInfo{
+		Algorithm: pkix.AlgorithmIdentifier{Algorithm: oidECPublicKey, Parameters: asn1.RawValue{FullBytes: curve}},
+		PublicKey: asn1.BitString{Bytes: make([]byte, 33), BitLength: 264},
+	})
+	_, err = remoteKeyAddress(bad)
+	assert.Regexp("not an uncompressed point", err)
+}
+
+type testPublicKey struct {
+	*testRemoteKey
+	der []byte
+}
+
+func (k *testPublicKey) publicKey() ([]byte, error) {
+	return k.der, nil
+}
+
+func TestRemoteSignersInit(t *testing.T) {
+	assert := assert.New(t)
+
+	rs := newRemoteSigners(&RemoteSignersConf{Signers: []*RemoteSignerConf{{From: "["}}})
+	assert.Regexp("Invalid from pattern '\\[' for remote signer", rs.init())
+
+	rs = newRemoteSigners(&RemoteSignersConf{Signers: []*RemoteSignerConf{{From: "^0x"}}})
+	assert.EqualError(rs.init(), "Remote signer for '^0x' must configure exactly one of 'vault' or 'kms'")
+	rs = newRemoteSigners(&RemoteSignersConf{Signers: []*RemoteSignerConf{{From: "^0x", Vault: &VaultSignerConf{}, KMS: &KMSSignerConf{}}}})
+	assert.Regexp("exactly one of 'vault' or 'kms'", rs.init())
+
+	rs = newRemoteSigners(&RemoteSignersConf{Signers: []*RemoteSignerConf{{From: "^0x", Vault: &VaultSignerConf{TokenFile: "/missing"}}}})
+	assert.Regexp("Failed to load the Vault token from '/missing'", rs.init())
+	rs = newRemoteSigners(&RemoteSignersConf{Signers: []*RemoteSignerConf{{From: "^0x", Vault: &VaultSignerConf{TLS: utils.TLSConfig{Enabled: true, CACertsFile: "/missing"}}}}})
+	assert.Error(rs.init())
+
+	rs = newRemoteSigners(&RemoteSignersConf{Signers: []*RemoteSignerConf{{From: "^0x", KMS: &KMSSignerConf{KeyID: "alias/key1", AccessKeyID: "AKID"}}}})
+	assert.Regexp("No AWS credentials for KMS key 'alias/key1'", rs.init())
+
+	rs = newRemoteSigners(&RemoteSignersConf{Signers: []*RemoteSignerConf{
+		{From: "^0x(f39f.*)$", Vault: &VaultSignerConf{URL: "http://vault", Key: "eth-$1"}},
+		{From: "^0x", KMS: &KMSSignerConf{Region: "us-east-1", KeyID: "alias/$0", AccessKeyID: "AKID", SecretAccessKey: "secret"}},
+	}})
+	assert.NoError(rs.init())
+	assert.Equal(2, len(rs.matchers))
+	match := rs.matchers[0].pattern.FindStringSubmatchIndex(testKeystoreAddr0)
+	assert.Equal("eth-"+testKeystoreAddr0[2:], rs.matchers[0].newKey(testKeystoreAddr0, match).name())
+	match = rs.matchers[1].pattern.FindStringSubmatchIndex(testKeystoreAddr0)
+	kms := rs.matchers[1].newKey(testKeystoreAddr0, match)
+	assert.Equal("alias/0x", kms.name())
+	assert.Equal("AWS KMS", kms.service())
+}
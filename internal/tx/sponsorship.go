@@ -0,0 +1,202 @@
+// Copyright 2021 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tx
+
+import (
+	"context"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/kaleido-io/ethconnect/internal/auth"
+	"github.com/kaleido-io/ethconnect/internal/errors"
+	"github.com/kaleido-io/ethconnect/internal/eth"
+	"github.com/kaleido-io/ethconnect/internal/kvstore"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	sponsoredUsagePrefix    = "sponsored/"
+	sponsoredUsagePrefixEnd = "sponsored0"
+	// SponsorAnyTenant entitles every tenant to a sponsor
+	SponsorAnyTenant = "*"
+)
+
+// SponsorshipConf configures the identities whose gas is used to send the transactions of entitled callers
+type SponsorshipConf struct {
+	// UsageDB is a KV store connection string to persist the sponsored gas usage. It is held in memory if not set
+	UsageDB  string     `json:"usageDB"`
+	Sponsors []*Sponsor `json:"sponsors"`
+}
+
+// Sponsor is an identity that sends transactions on behalf of callers, requested by name with fly-sponsor.
+// The tenants are entitled to it, unless the security module implements a sponsorship policy
+type Sponsor struct {
+	Name    string   `json:"name"`
+	From    string   `json:"from"`
+	Tenants []string `json:"tenants,omitempty"`
+}
+
+// SponsoredUsage is the gas used by a sponsor for the transactions of a tenant, for chargeback
+type SponsoredUsage struct {
+	Tenant       string `json:"tenant"`
+	Sponsor      string `json:"sponsor"`
+	Transactions int64  `json:"transactions"`
+	GasUsed      string `json:"gasUsed"`
+	Cost         string `json:"cost"`
+	Updated      string `json:"updated"`
+}
+
+type sponsorship struct {
+	conf     *SponsorshipConf
+	db       kvstore.KVStore
+	mux      sync.Mutex
+	sponsors map[string]*Sponsor
+}
+
+func newSponsorship(conf *SponsorshipConf) *sponsorship {
+	return &sponsorship{
+		conf:     conf,
+		sponsors: make(map[string]*Sponsor),
+	}
+}
+
+// init only enables the sponsors once the usage store is available, so no gas is sponsored without being recorded
+func (s *sponsorship) init() (err error) {
+	for _, sponsor := range s.conf.Sponsors {
+		if sponsor.Name == "" || sponsor.From == "" {
+			return errors.Errorf(errors.SponsorshipInvalidSponsor)
+		}
+	}
+	if s.conf.UsageDB != "" {
+		if s.db, err = kvstore.NewKeyValueStore(s.conf.UsageDB); err != nil {
+			return err
+		}
+	} else {
+		s.db = kvstore.NewMemoryKeyValueStore()
+	}
+	for _, sponsor := range s.conf.Sponsors {
+		s.sponsors[sponsor.Name] = sponsor
+	}
+	return nil
+}
+
+// sponsorFor checks the caller is entitled to the named sponsor, and returns the identity to send from
+func (s *sponsorship) sponsorFor(ctx context.Context, name string) (string, error) {
+	sponsor, exists := s.sponsors[name]
+	if !exists {
+		return "", errors.Errorf(errors.SponsorshipUnknownSponsor, name)
+	}
+	if hasPolicy, err := auth.AuthSponsorship(ctx, name); hasPolicy {
+		if err != nil {
+			return "", errors.Errorf(errors.SponsorshipNotEntitled, name, err)
+		}
+		return sponsor.From, nil
+	}
+	tenant := auth.GetTenant(ctx)
+	for _, entitled := range sponsor.Tenants {
+		if entitled == SponsorAnyTenant || entitled == tenant {
+			return sponsor.From, nil
+		}
+	}
+	return "", errors.Errorf(errors.SponsorshipTenantNotEntitled, tenant, name)
+}
+
+// recordUsage adds the gas used by a mined transaction to the total for the tenant and sponsor.
+// Gas is used whether or not the transaction succeeded
+func (s *sponsorship) recordUsage(tenant, sponsor string, tx *eth.Txn) {
+	if tx.Receipt.GasUsed == nil {
+		return
+	}
+	gasUsed := tx.Receipt.GasUsed.ToInt()
+	cost := new(big.Int).Mul(gasUsed, tx.EthTX.GasPrice())
+
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	key := sponsoredUsagePrefix + sponsor + "/" + tenant
+	usage := &SponsoredUsage{
+		Tenant:  tenant,
+		Sponsor: sponsor,
+		GasUsed: "0",
+		Cost:    "0",
+	}
+	if b, err := s.db.Get(key); err == nil {
+		json.Unmarshal(b, usage)
+	}
+	usage.Transactions++
+	usage.GasUsed = addDecimal(usage.GasUsed, gasUsed)
+	usage.Cost = addDecimal(usage.Cost, cost)
+	usage.Updated = time.Now().UTC().Format(time.RFC3339)
+	b, _ := json.Marshal(usage)
+	if err := s.db.Put(key, b); err != nil {
+		log.Errorf("Failed to record sponsored gas usage of %s for tenant '%s' by sponsor '%s': %s", gasUsed, tenant, sponsor, err)
+	}
+}
+
+func addDecimal(total string, value *big.Int) string {
+	t, ok := new(big.Int).SetString(total, 10)
+	if !ok {
+		t = new(big.Int)
+	}
+	return t.Add(t, value).String()
+}
+
+func (s *sponsorship) usage(tenant string) []*SponsoredUsage {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	usage := []*SponsoredUsage{}
+	if s.db == nil {
+		return usage
+	}
+	it := s.db.NewIteratorWithRange(&kvstore.KVRange{Start: sponsoredUsagePrefix, Limit: sponsoredUsagePrefixEnd})
+	for it.Next() {
+		var u SponsoredUsage
+		if err := json.Unmarshal(it.Value(), &u); err != nil {
+			log.Errorf("Failed to load sponsored gas usage '%s': %s", it.Key(), err)
+			continue
+		}
+		if tenant == "" || u.Tenant == tenant {
+			usage = append(usage, &u)
+		}
+	}
+	it.Release()
+	sort.Slice(usage, func(i, j int) bool {
+		if usage[i].Sponsor != usage[j].Sponsor {
+			return usage[i].Sponsor < usage[j].Sponsor
+		}
+		return usage[i].Tenant < usage[j].Tenant
+	})
+	return usage
+}
+
+func (s *sponsorship) addRoutes(router *httprouter.Router) {
+	router.GET("/status/sponsorship", s.usageHandler)
+}
+
+func (s *sponsorship) usageHandler(res http.ResponseWriter, req *http.Request, params httprouter.Params) {
+	log.Infof("--> %s %s", req.Method, req.URL)
+	usage := s.usage(req.URL.Query().Get("tenant"))
+	status := 200
+	log.Infof("<-- %s %s [%d]", req.Method, req.URL, status)
+	res.Header().Set("Content-Type", "application/json")
+	res.WriteHeader(status)
+	enc := json.NewEncoder(res)
+	enc.SetIndent("", "  ")
+	enc.Encode(usage)
+}
@@ -0,0 +1,247 @@
+// Copyright 2021 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tx
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	ethbinding "github.com/kaleido-io/ethbinding/pkg"
+	"github.com/kaleido-io/ethconnect/internal/auth"
+	"github.com/kaleido-io/ethconnect/internal/auth/authtest"
+	"github.com/kaleido-io/ethconnect/internal/eth"
+	"github.com/kaleido-io/ethconnect/internal/ethbind"
+	"github.com/stretchr/testify/assert"
+)
+
+const testSponsorAddr = "0x2b8c0ECc76d0759a8F50b2E14A6881367D805832"
+
+type testSponsorshipSecurityModule struct {
+	authtest.TestSecurityModule
+}
+
+func (sm *testSponsorshipSecurityModule) AuthSponsorship(authCtx interface{}, sponsor string) error {
+	if sponsor == "gas1" {
+		return nil
+	}
+	return fmt.Errorf("badness")
+}
+
+func (sm *testSponsorshipSecurityModule) Tenant(authCtx interface{}) string {
+	return "tenant1"
+}
+
+func newTestSponsorship(t *testing.T, conf *SponsorshipConf) *sponsorship {
+	s := newSponsorship(conf)
+	assert.NoError(t, s.init())
+	return s
+}
+
+func newTestSponsoredTxn(gasUsed, gasPrice int64) *eth.Txn {
+	used := ethbinding.HexBigInt(*big.NewInt(gasUsed))
+	to := ethbind.API.HexToAddress(testFromAddr)
+	return &eth.Txn{
+		EthTX:   ethbind.API.NewTransaction(0, to, big.NewInt(0), 100000, big.NewInt(gasPrice), []byte{}),
+		Receipt: eth.TxnReceipt{GasUsed: &used},
+	}
+}
+
+func TestSponsorshipInitBadSponsor(t *testing.T) {
+	assert := assert.New(t)
+	s := newSponsorship(&SponsorshipConf{
+		Sponsors: []*Sponsor{{Name: "gas1"}},
+	})
+	err := s.init()
+	assert.EqualError(err, "Each sponsor must be configured with a name and a from address")
+	assert.Empty(s.usage(""))
+	_, err = s.sponsorFor(context.Background(), "gas1")
+	assert.EqualError(err, "Unknown sponsor 'gas1'")
+}
+
+func TestSponsorshipInitBadDB(t *testing.T) {
+	assert := assert.New(t)
+	dir, _ := ioutil.TempDir("", "sponsorship")
+	defer os.RemoveAll(dir)
+	ioutil.WriteFile(path.Join(dir, "file"), []byte{}, 0644)
+	s := newSponsorship(&SponsorshipConf{
+		UsageDB:  path.Join(dir, "file"),
+		Sponsors: []*Sponsor{{Name: "gas1", From: testSponsorAddr, Tenants: []string{SponsorAnyTenant}}},
+	})
+	err := s.init()
+	assert.Error(err)
+	_, err = s.sponsorFor(context.Background(), "gas1")
+	assert.EqualError(err, "Unknown sponsor 'gas1'")
+}
+
+func TestSponsorshipTenantPolicy(t *testing.T) {
+	assert := assert.New(t)
+	s := newTestSponsorship(t, &SponsorshipConf{
+		Sponsors: []*Sponsor{
+			{Name: "gas1", From: testSponsorAddr, Tenants: []string{SponsorAnyTenant}},
+			{Name: "gas2", From: testFromAddr, Tenants: []string{"tenant1"}},
+		},
+	})
+
+	from, err := s.sponsorFor(context.Background(), "gas1")
+	assert.NoError(err)
+	assert.Equal(testSponsorAddr, from)
+
+	_, err = s.sponsorFor(context.Background(), "gas2")
+	assert.EqualError(err, "Tenant '' is not entitled to use the gas of sponsor 'gas2'")
+
+	_, err = s.sponsorFor(context.Background(), "gas3")
+	assert.EqualError(err, "Unknown sponsor 'gas3'")
+}
+
+func TestSponsorshipSecurityModulePolicy(t *testing.T) {
+	assert := assert.New(t)
+	auth.RegisterSecurityModule(&testSponsorshipSecurityModule{})
+	defer auth.RegisterSecurityModule(nil)
+
+	s := newTestSponsorship(t, &SponsorshipConf{
+		Sponsors: []*Sponsor{
+			{Name: "gas1", From: testSponsorAddr},
+			{Name: "gas2", From: testFromAddr, Tenants: []string{SponsorAnyTenant}},
+		},
+	})
+	ctx, _ := auth.WithAuthContext(context.Background(), "testat")
+
+	from, err := s.sponsorFor(ctx, "gas1")
+	assert.NoError(err)
+	assert.Equal(testSponsorAddr, from)
+
+	_, err = s.sponsorFor(ctx, "gas2")
+	assert.EqualError(err, "Not entitled to use the gas of sponsor 'gas2': badness")
+}
+
+func TestSponsorshipRecordUsage(t *testing.T) {
+	assert := assert.New(t)
+	dir, _ := ioutil.TempDir("", "sponsorship")
+	defer os.RemoveAll(dir)
+	conf := &SponsorshipConf{UsageDB: path.Join(dir, "db")}
+	s := newTestSponsorship(t, conf)
+
+	s.recordUsage("tenant1", "gas1", newTestSponsoredTxn(21000, 10))
+	s.recordUsage("tenant1", "gas1", newTestSponsoredTxn(50000, 20))
+	s.recordUsage("tenant2", "gas1", newTestSponsoredTxn(30000, 1))
+	s.recordUsage("tenant1", "gas1", &eth.Txn{})
+
+	usage := s.usage("")
+	assert.Equal(2, len(usage))
+	assert.Equal("tenant1", usage[0].Tenant)
+	assert.Equal("gas1", usage[0].Sponsor)
+	assert.Equal(int64(2), usage[0].Transactions)
+	assert.Equal("71000", usage[0].GasUsed)
+	assert.Equal("1210000", usage[0].Cost)
+	assert.NotEmpty(usage[0].Updated)
+	assert.Equal("tenant2", usage[1].Tenant)
+
+	// Usage is persisted across restarts
+	s.db.Close()
+	s = newTestSponsorship(t, conf)
+	defer s.db.Close()
+	usage = s.usage("tenant2")
+	assert.Equal(1, len(usage))
+	assert.Equal("30000", usage[0].GasUsed)
+	assert.Equal("30000", usage[0].Cost)
+}
+
+func TestSponsorshipStatusHandler(t *testing.T) {
+	assert := assert.New(t)
+	rpc := &testRPC{}
+	p, router := newTestQueueProcessor(rpc)
+	p.sponsorship.recordUsage("tenant1", "gas1", newTestSponsoredTxn(21000, 10))
+
+	status, body := testQueueRequest(router, "GET", "/status/sponsorship?tenant=tenant1", "")
+	assert.Equal(200, status)
+	assert.Regexp(`"gasUsed": "21000"`, body)
+	assert.Regexp(`"cost": "210000"`, body)
+
+	status, body = testQueueRequest(router, "GET", "/status/sponsorship?tenant=tenant2", "")
+	assert.Equal(200, status)
+	assert.Equal("[]\n", body)
+}
+
+func TestOnSendTransactionMessageSponsored(t *testing.T) {
+	assert := assert.New(t)
+
+	txnProcessor := NewTxnProcessor(&TxnProcessorConf{
+		MaxTXWaitTime: 1,
+		SponsorshipConf: SponsorshipConf{
+			Sponsors: []*Sponsor{{Name: "gas1", From: testSponsorAddr, Tenants: []string{SponsorAnyTenant}}},
+		},
+	}, &eth.RPCConf{}).(*txnProcessor)
+	testTxnContext := &testTxnContext{}
+	testTxnContext.jsonMsg = "{" +
+		"  \"headers\":{\"type\": \"SendTransaction\", \"sponsor\": \"gas1\"}," +
+		"  \"from\":\"" + testFromAddr + "\"," +
+		"  \"gas\":\"123\"," +
+		"  \"gasPrice\":\"2\"," +
+		"  \"method\":{\"name\":\"test\"}" +
+		"}"
+	testRPC := goodMessageRPC()
+	txnProcessor.Init(testRPC)
+
+	txnProcessor.OnMessage(testTxnContext)
+	sponsorAddr := strings.ToLower(testSponsorAddr)
+	for inMap := false; !inMap; _, inMap = txnProcessor.inflightTxns[sponsorAddr] {
+		time.Sleep(1 * time.Millisecond)
+	}
+	txnWG := &txnProcessor.inflightTxns[sponsorAddr].txnsInFlight[0].wg
+	txnWG.Wait()
+	assert.Equal(0, len(testTxnContext.errorReplies))
+	assert.Equal(1, len(testTxnContext.replies))
+
+	assert.Equal("eth_sendTransaction", testRPC.calls[0])
+	sendTX := testRPC.params[0][0].(*eth.SendTXArgs)
+	assert.Equal(testSponsorAddr, sendTX.From)
+
+	usage := txnProcessor.sponsorship.usage("")
+	assert.Equal(1, len(usage))
+	assert.Equal("gas1", usage[0].Sponsor)
+	assert.Equal("345678", usage[0].GasUsed)
+	assert.Equal("691356", usage[0].Cost)
+}
+
+func TestOnSendTransactionMessageSponsorNotEntitled(t *testing.T) {
+	assert := assert.New(t)
+
+	txnProcessor := NewTxnProcessor(&TxnProcessorConf{
+		SponsorshipConf: SponsorshipConf{
+			Sponsors: []*Sponsor{{Name: "gas1", From: testSponsorAddr, Tenants: []string{"tenant1"}}},
+		},
+	}, &eth.RPCConf{}).(*txnProcessor)
+	testTxnContext := &testTxnContext{}
+	testTxnContext.jsonMsg = "{" +
+		"  \"headers\":{\"type\": \"SendTransaction\", \"sponsor\": \"gas1\"}," +
+		"  \"from\":\"" + testFromAddr + "\"," +
+		"  \"method\":{\"name\":\"test\"}" +
+		"}"
+	testRPC := &testRPC{}
+	txnProcessor.Init(testRPC)
+
+	txnProcessor.OnMessage(testTxnContext)
+	assert.Equal(1, len(testTxnContext.errorReplies))
+	assert.Equal(400, testTxnContext.errorReplies[0].status)
+	assert.EqualError(testTxnContext.errorReplies[0].err, "Tenant '' is not entitled to use the gas of sponsor 'gas1'")
+	assert.Empty(testRPC.calls)
+}
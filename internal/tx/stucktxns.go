@@ -0,0 +1,145 @@
+// Copyright 2021 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tx
+
+import (
+	"encoding/json"
+	"math/big"
+	"time"
+
+	"github.com/kaleido-io/ethconnect/internal/errors"
+	"github.com/kaleido-io/ethconnect/internal/eth"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	defaultStuckTxnDeadlineSec = 60
+	defaultStuckTxnMaxBumps    = 3
+	// cancelTxnGas is the gas of a transfer of nothing to the sender, which cancels a transaction
+	cancelTxnGas = 21000
+)
+
+// StuckTxnConf is the policy for transactions that are not mined within a deadline of being sent.
+// Each is replaced at the same nonce with a higher gas price, up to maxBumps times, and then
+// optionally cancelled by a transfer of nothing to the sender at the same nonce
+type StuckTxnConf struct {
+	Enabled     bool        `json:"enabled"`
+	DeadlineSec int         `json:"deadlineSec,omitempty"`
+	BumpPercent int         `json:"bumpPercent,omitempty"`
+	MaxBumps    int         `json:"maxBumps,omitempty"`
+	MaxGasPrice json.Number `json:"maxGasPrice,omitempty"`
+	Cancel      bool        `json:"cancel,omitempty"`
+}
+
+type stuckTxnPolicy struct {
+	conf        *StuckTxnConf
+	deadline    time.Duration
+	maxGasPrice *big.Int
+}
+
+func newStuckTxnPolicy(conf *StuckTxnConf) *stuckTxnPolicy {
+	if !conf.Enabled {
+		return nil
+	}
+	if conf.DeadlineSec <= 0 {
+		conf.DeadlineSec = defaultStuckTxnDeadlineSec
+	}
+	if conf.BumpPercent < defaultGasPriceBumpPercent {
+		conf.BumpPercent = defaultGasPriceBumpPercent
+	}
+	if conf.MaxBumps <= 0 {
+		conf.MaxBumps = defaultStuckTxnMaxBumps
+	}
+	return &stuckTxnPolicy{
+		conf:     conf,
+		deadline: time.Duration(conf.DeadlineSec) * time.Second,
+	}
+}
+
+func (s *stuckTxnPolicy) init() error {
+	if s == nil || s.conf.MaxGasPrice == "" {
+		return nil
+	}
+	maxGasPrice, ok := new(big.Int).SetString(s.conf.MaxGasPrice.String(), 0)
+	if !ok || maxGasPrice.Sign() <= 0 {
+		return errors.Errorf(errors.TransactionStuckBadMaxGasPrice, s.conf.MaxGasPrice)
+	}
+	s.maxGasPrice = maxGasPrice
+	return nil
+}
+
+// nextGasPrice returns the gas price to replace a transaction with, or nil if the maximum has been reached
+func (s *stuckTxnPolicy) nextGasPrice(tx *eth.Txn) *big.Int {
+	oldGasPrice := replacedGasPrice(tx)
+	gasPrice := bumpGasPrice(oldGasPrice, s.conf.BumpPercent)
+	if s.maxGasPrice != nil && gasPrice.Cmp(s.maxGasPrice) > 0 {
+		gasPrice = new(big.Int).Set(s.maxGasPrice)
+	}
+	if gasPrice.Cmp(oldGasPrice) <= 0 {
+		return nil
+	}
+	return gasPrice
+}
+
+// checkStuck is called while waiting for the receipt of a transaction. Once the transaction has not
+// been mined for the deadline, it is replaced with a higher gas price. After the maximum number of
+// bumps it is cancelled, if configured, and the requester receives an error once the cancellation is
+// mined. The deadline restarts after each replacement, and after a failed attempt.
+func (p *txnProcessor) checkStuck(inflight *inflightTxn) {
+	s := p.stuckTxns
+	if s == nil {
+		return
+	}
+	p.inflightTxnsLock.Lock()
+	tx := inflight.tx
+	stuck := !inflight.cancelled && time.Now().UTC().Sub(inflight.sent) > s.deadline
+	bumps := inflight.bumps
+	if stuck {
+		inflight.sent = time.Now().UTC()
+	}
+	p.inflightTxnsLock.Unlock()
+	if !stuck {
+		return
+	}
+
+	gasPrice := s.nextGasPrice(tx)
+	cancel := bumps >= s.conf.MaxBumps
+	switch {
+	case gasPrice == nil:
+		log.Warnf("Transaction %s stuck at nonce %d for %s. Gas price at maximum %s", tx.Hash, inflight.nonce, inflight.from, s.maxGasPrice)
+		return
+	case cancel && !s.conf.Cancel:
+		log.Warnf("Transaction %s stuck at nonce %d for %s after %d bumps", tx.Hash, inflight.nonce, inflight.from, bumps)
+		return
+	}
+	log.Infof("Transaction %s stuck at nonce %d for %s (bumps=%d cancel=%t)", tx.Hash, inflight.nonce, inflight.from, bumps, cancel)
+	if _, err := p.replaceInFlight(inflight.txnContext.Context(), inflight, gasPrice, s.conf.BumpPercent, cancel); err != nil {
+		log.Warnf("Failed to replace stuck transaction %s: %s", tx.Hash, err)
+	}
+}
+
+// getReplacedReceipt returns the first of the replaced transactions for a request that has been mined
+func (p *txnProcessor) getReplacedReceipt(inflight *inflightTxn, replaced []*eth.Txn) *eth.Txn {
+	for _, tx := range replaced {
+		isMined, err := tx.GetTXReceipt(inflight.txnContext.Context(), p.rpc)
+		if err != nil {
+			log.Infof("Failed to get receipt for replaced transaction %s: %s", tx.Hash, err)
+		} else if isMined {
+			log.Infof("Replaced transaction %s mined for %s", tx.Hash, inflight)
+			return tx
+		}
+	}
+	return nil
+}
@@ -0,0 +1,218 @@
+// Copyright 2021 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tx
+
+import (
+	"context"
+	"fmt"
+	"math/big"
+	"sync"
+	"testing"
+	"time"
+
+	ethbinding "github.com/kaleido-io/ethbinding/pkg"
+	"github.com/kaleido-io/ethconnect/internal/eth"
+	"github.com/kaleido-io/ethconnect/internal/ethbind"
+	"github.com/stretchr/testify/assert"
+)
+
+// stuckTestRPC returns a receipt only for the mined hash, once the given number of
+// replacements have been sent
+type stuckTestRPC struct {
+	lock      sync.Mutex
+	sent      []*eth.SendTXArgs
+	minedHash string
+	mineAfter int
+}
+
+func stuckTestHash(i int) string {
+	return fmt.Sprintf("0x%064x", i)
+}
+
+func (r *stuckTestRPC) CallContext(ctx context.Context, result interface{}, method string, args ...interface{}) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	switch method {
+	case "eth_sendTransaction":
+		r.sent = append(r.sent, args[0].(*eth.SendTXArgs))
+		*(result.(*string)) = stuckTestHash(len(r.sent))
+	case "eth_getTransactionReceipt":
+		if args[0].(string) == r.minedHash && len(r.sent) >= r.mineAfter {
+			blockNumber := ethbinding.HexBigInt(*big.NewInt(12345))
+			status := ethbinding.HexBigInt(*big.NewInt(1))
+			txHash := ethbind.API.HexToHash(r.minedHash)
+			*(result.(*eth.TxnReceipt)) = eth.TxnReceipt{
+				BlockNumber:     &blockNumber,
+				Status:          &status,
+				TransactionHash: &txHash,
+			}
+		}
+	default:
+		panic(fmt.Errorf("method unknown to test: %s", method))
+	}
+	return nil
+}
+
+func newTestStuckTxnProcessor(conf *StuckTxnConf, rpc eth.RPCClient) *txnProcessor {
+	conf.Enabled = true
+	p := NewTxnProcessor(&TxnProcessorConf{
+		StuckTxns: *conf,
+	}, &eth.RPCConf{}).(*txnProcessor)
+	p.Init(rpc)
+	p.maxTXWaitTime = 1 * time.Second
+	p.stuckTxns.deadline = 10 * time.Millisecond
+	return p
+}
+
+func TestNewStuckTxnPolicy(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Nil(newStuckTxnPolicy(&StuckTxnConf{}))
+	assert.NoError(newStuckTxnPolicy(&StuckTxnConf{}).init())
+
+	s := newStuckTxnPolicy(&StuckTxnConf{Enabled: true, BumpPercent: 5})
+	assert.Equal(60*time.Second, s.deadline)
+	assert.Equal(defaultGasPriceBumpPercent, s.conf.BumpPercent)
+	assert.Equal(defaultStuckTxnMaxBumps, s.conf.MaxBumps)
+	assert.NoError(s.init())
+	assert.Nil(s.maxGasPrice)
+
+	s = newStuckTxnPolicy(&StuckTxnConf{Enabled: true, MaxGasPrice: "0x3e8"})
+	assert.NoError(s.init())
+	assert.Equal(int64(1000), s.maxGasPrice.Int64())
+
+	s = newStuckTxnPolicy(&StuckTxnConf{Enabled: true, MaxGasPrice: "lots"})
+	assert.Regexp("Invalid stuck transactions maxGasPrice 'lots'", s.init())
+}
+
+func TestStuckTxnBumpedOriginalMined(t *testing.T) {
+	assert := assert.New(t)
+	rpc := &stuckTestRPC{minedHash: testQueueTxHash, mineAfter: 2}
+	p := newTestStuckTxnProcessor(&StuckTxnConf{BumpPercent: 20, MaxBumps: 5}, rpc)
+	inflight := addTestQueuedTxn(p, nil, 1, 10, true)
+	inflight.rpc = rpc
+
+	inflight.wg.Add(1)
+	p.waitForCompletion(inflight, 10*time.Millisecond)
+
+	// Bumped twice, before the original transaction was mined
+	assert.Equal(2, len(rpc.sent))
+	assert.Equal(int64(1200), rpc.sent[0].GasPrice.ToInt().Int64())
+	assert.Equal(int64(1440), rpc.sent[1].GasPrice.ToInt().Int64())
+	assert.Equal(uint64(10), uint64(*rpc.sent[1].Nonce))
+	assert.Equal(2, inflight.bumps)
+
+	txnContext := inflight.txnContext.(*testTxnContext)
+	assert.Empty(txnContext.errorReplies)
+	receipt := txnContext.replies[0].IsReceipt()
+	assert.Equal(testQueueTxHash, receipt.TransactionHash.String())
+	assert.Equal([]string{stuckTestHash(1), stuckTestHash(2)}, receipt.Replaced)
+}
+
+func TestStuckTxnCancelled(t *testing.T) {
+	assert := assert.New(t)
+	rpc := &stuckTestRPC{minedHash: stuckTestHash(2)}
+	p := newTestStuckTxnProcessor(&StuckTxnConf{MaxBumps: 1, Cancel: true}, rpc)
+	inflight := addTestQueuedTxn(p, nil, 1, 10, true)
+	inflight.rpc = rpc
+
+	inflight.wg.Add(1)
+	p.waitForCompletion(inflight, 10*time.Millisecond)
+
+	assert.Equal(2, len(rpc.sent))
+	bump, cancel := rpc.sent[0], rpc.sent[1]
+	assert.Equal("0x2b8c0ECc76d0759a8F50b2E14A6881367D805832", bump.To)
+	assert.Equal(int64(1100), bump.GasPrice.ToInt().Int64())
+	assert.Equal(testFromAddr, cancel.To)
+	assert.Equal(int64(1210), cancel.GasPrice.ToInt().Int64())
+	assert.Equal(int64(0), cancel.Value.ToInt().Int64())
+	assert.Equal(uint64(cancelTxnGas), uint64(*cancel.Gas))
+	assert.Equal(uint64(10), uint64(*cancel.Nonce))
+
+	txnContext := inflight.txnContext.(*testTxnContext)
+	assert.Equal(1, len(txnContext.errorReplies))
+	assert.Equal(410, txnContext.errorReplies[0].status)
+	assert.Regexp("not mined after 1 gas price bumps, and was cancelled", txnContext.errorReplies[0].err)
+	assert.Equal(stuckTestHash(2), txnContext.errorReplies[0].txHash)
+
+	queued := inflight.queuedTxn()
+	assert.Equal(QueuedTxnStatusCancelling, queued.Status)
+	assert.Equal([]string{testQueueTxHash, stuckTestHash(1)}, queued.Replaced)
+}
+
+func TestStuckTxnMaxGasPrice(t *testing.T) {
+	assert := assert.New(t)
+	rpc := &stuckTestRPC{}
+	p := newTestStuckTxnProcessor(&StuckTxnConf{MaxGasPrice: "1050", Cancel: true}, rpc)
+	p.maxTXWaitTime = 200 * time.Millisecond
+	inflight := addTestQueuedTxn(p, nil, 1, 10, true)
+	inflight.rpc = rpc
+
+	inflight.wg.Add(1)
+	p.waitForCompletion(inflight, 10*time.Millisecond)
+
+	// Bumped once to the maximum, then left to time out
+	assert.Equal(1, len(rpc.sent))
+	assert.Equal(int64(1050), rpc.sent[0].GasPrice.ToInt().Int64())
+	txnContext := inflight.txnContext.(*testTxnContext)
+	assert.Equal(408, txnContext.errorReplies[0].status)
+}
+
+func TestStuckTxnMaxBumpsNoCancel(t *testing.T) {
+	assert := assert.New(t)
+	rpc := &stuckTestRPC{}
+	p := newTestStuckTxnProcessor(&StuckTxnConf{MaxBumps: 1}, rpc)
+	p.maxTXWaitTime = 200 * time.Millisecond
+	inflight := addTestQueuedTxn(p, nil, 1, 10, true)
+	inflight.rpc = rpc
+
+	inflight.wg.Add(1)
+	p.waitForCompletion(inflight, 10*time.Millisecond)
+
+	assert.Equal(1, len(rpc.sent))
+	assert.False(inflight.cancelled)
+	txnContext := inflight.txnContext.(*testTxnContext)
+	assert.Equal(408, txnContext.errorReplies[0].status)
+}
+
+func TestStuckTxnNotReplaceable(t *testing.T) {
+	assert := assert.New(t)
+	rpc := &stuckTestRPC{}
+	p := newTestStuckTxnProcessor(&StuckTxnConf{}, rpc)
+	inflight := addTestQueuedTxn(p, nil, 1, 10, true)
+	inflight.rpc = rpc
+	inflight.nodeAssignNonce = true
+
+	p.checkStuck(inflight)
+	assert.Empty(rpc.sent)
+	assert.Zero(inflight.bumps)
+
+	// The deadline restarts after a failed attempt
+	p.stuckTxns.deadline = 1 * time.Minute
+	inflight.nodeAssignNonce = false
+	p.checkStuck(inflight)
+	assert.Empty(rpc.sent)
+}
+
+func TestStuckTxnDisabled(t *testing.T) {
+	assert := assert.New(t)
+	rpc := &stuckTestRPC{}
+	p, _ := newTestQueueProcessor(&testRPC{})
+	inflight := addTestQueuedTxn(p, nil, 1, 10, true)
+	inflight.rpc = rpc
+
+	p.checkStuck(inflight)
+	assert.Empty(rpc.sent)
+}
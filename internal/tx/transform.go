@@ -0,0 +1,203 @@
+// Copyright 2021 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tx
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"time"
+
+	"github.com/kaleido-io/ethconnect/internal/auth"
+	"github.com/kaleido-io/ethconnect/internal/errors"
+	"github.com/kaleido-io/ethconnect/internal/messages"
+	"github.com/kaleido-io/ethconnect/internal/utils"
+	"github.com/kaleido-io/ethconnect/pkg/plugins"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	defaultTransformTimeoutMS = 10000
+)
+
+var messageTransformer plugins.MessageTransformer
+
+// RegisterMessageTransformer is the plug point to register a transformer plugin
+func RegisterMessageTransformer(t plugins.MessageTransformer) {
+	messageTransformer = t
+}
+
+// TransformConf configures webhooks to enrich, modify or reject messages. They are invoked
+// after any MessageTransformer plugin
+type TransformConf struct {
+	RequestURL string            `json:"requestURL,omitempty"`
+	ReplyURL   string            `json:"replyURL,omitempty"`
+	Headers    map[string]string `json:"headers,omitempty"`
+	TimeoutMS  int               `json:"timeout,omitempty"`
+}
+
+type transformHooks struct {
+	conf   *TransformConf
+	client *http.Client
+}
+
+func newTransformHooks(conf *TransformConf) *transformHooks {
+	if conf.TimeoutMS <= 0 {
+		conf.TimeoutMS = defaultTransformTimeoutMS
+	}
+	return &transformHooks{
+		conf: conf,
+		client: &http.Client{
+			Timeout:   time.Duration(conf.TimeoutMS) * time.Millisecond,
+			Transport: utils.EgressTransport(nil),
+		},
+	}
+}
+
+// callWebhook posts the message to the webhook. A 200 response with a JSON object replaces
+// the message, a 204 leaves it unchanged, and any other status rejects it
+func (h *transformHooks) callWebhook(ctx context.Context, url string, msg map[string]interface{}) error {
+	body, _ := json.Marshal(msg)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return errors.Errorf(errors.TransformWebhookFailed, url, err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for name, value := range h.conf.Headers {
+		req.Header.Set(name, value)
+	}
+	res, err := h.client.Do(req)
+	if err != nil {
+		return errors.Errorf(errors.TransformWebhookFailed, url, err)
+	}
+	defer res.Body.Close()
+	resBody, _ := ioutil.ReadAll(res.Body)
+	log.Debugf("Transformation webhook %s [%d]", url, res.StatusCode)
+	switch res.StatusCode {
+	case 204:
+		return nil
+	case 200:
+		var transformed map[string]interface{}
+		if err := json.Unmarshal(resBody, &transformed); err != nil {
+			return errors.Errorf(errors.TransformWebhookFailed, url, err)
+		}
+		for k := range msg {
+			delete(msg, k)
+		}
+		for k, v := range transformed {
+			msg[k] = v
+		}
+		return nil
+	default:
+		var errBody struct {
+			Message string `json:"error"`
+		}
+		if json.Unmarshal(resBody, &errBody); errBody.Message == "" {
+			errBody.Message = string(resBody)
+		}
+		return errors.Errorf(errors.TransformWebhookRejected, url, res.StatusCode, errBody.Message)
+	}
+}
+
+// transformRequest runs the request hooks over a deploy or send transaction message,
+// and updates the message in place with the result
+func (h *transformHooks) transformRequest(ctx context.Context, msg interface{}) error {
+	if messageTransformer == nil && h.conf.RequestURL == "" {
+		return nil
+	}
+	var msgMap map[string]interface{}
+	msgBytes, _ := json.Marshal(msg)
+	json.Unmarshal(msgBytes, &msgMap)
+	if messageTransformer != nil {
+		if err := messageTransformer.TransformRequest(auth.GetAuthContext(ctx), msgMap); err != nil {
+			return errors.Errorf(errors.TransformRequestRejected, err)
+		}
+	}
+	if h.conf.RequestURL != "" {
+		if err := h.callWebhook(ctx, h.conf.RequestURL, msgMap); err != nil {
+			return err
+		}
+	}
+	// Reset the message, so fields removed by the hooks are removed
+	msgVal := reflect.ValueOf(msg).Elem()
+	msgVal.Set(reflect.Zero(msgVal.Type()))
+	msgBytes, _ = json.Marshal(msgMap)
+	if err := json.Unmarshal(msgBytes, msg); err != nil {
+		return errors.Errorf(errors.TransformRequestRejected, err)
+	}
+	return nil
+}
+
+// transformReply runs the reply hooks, returning the original reply if they fail
+func (h *transformHooks) transformReply(ctx context.Context, reply messages.ReplyWithHeaders) messages.ReplyWithHeaders {
+	var replyMap map[string]interface{}
+	replyBytes, _ := json.Marshal(reply)
+	json.Unmarshal(replyBytes, &replyMap)
+	if messageTransformer != nil {
+		if err := messageTransformer.TransformReply(auth.GetAuthContext(ctx), replyMap); err != nil {
+			log.Errorf("Reply transformation failed: %s", err)
+			return reply
+		}
+	}
+	if h.conf.ReplyURL != "" {
+		if err := h.callWebhook(ctx, h.conf.ReplyURL, replyMap); err != nil {
+			log.Errorf("Reply transformation failed: %s", err)
+			return reply
+		}
+	}
+	return &transformedReply{ReplyWithHeaders: reply, fields: replyMap}
+}
+
+// wrap returns a context that transforms the replies sent to the supplied context
+func (h *transformHooks) wrap(txnContext TxnContext) TxnContext {
+	if messageTransformer == nil && h.conf.ReplyURL == "" {
+		return txnContext
+	}
+	return &transformedTxnContext{TxnContext: txnContext, hooks: h}
+}
+
+type transformedTxnContext struct {
+	TxnContext
+	hooks *transformHooks
+}
+
+func (t *transformedTxnContext) Reply(replyMsg messages.ReplyWithHeaders) {
+	t.TxnContext.Reply(t.hooks.transformReply(t.Context(), replyMsg))
+}
+
+func (t *transformedTxnContext) TxnSubmitted(txHash string) {
+	if listener, ok := t.TxnContext.(TxnSubmittedListener); ok {
+		listener.TxnSubmitted(txHash)
+	}
+}
+
+// transformedReply serializes the transformed fields of a reply, with the headers
+// that are set on the original reply when it is sent
+type transformedReply struct {
+	messages.ReplyWithHeaders
+	fields map[string]interface{}
+}
+
+func (r *transformedReply) MarshalJSON() ([]byte, error) {
+	fields := make(map[string]interface{}, len(r.fields)+1)
+	for k, v := range r.fields {
+		fields[k] = v
+	}
+	fields["headers"] = r.ReplyHeaders()
+	return json.Marshal(fields)
+}
@@ -0,0 +1,236 @@
+// Copyright 2021 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tx
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kaleido-io/ethconnect/internal/eth"
+	"github.com/kaleido-io/ethconnect/internal/messages"
+	"github.com/stretchr/testify/assert"
+)
+
+type testMessageTransformer struct {
+	requestErr error
+	replyErr   error
+}
+
+func (m *testMessageTransformer) TransformRequest(authCtx interface{}, msg map[string]interface{}) error {
+	if m.requestErr != nil {
+		return m.requestErr
+	}
+	msg["gas"] = "456"
+	headers := msg["headers"].(map[string]interface{})
+	headers["context"] = map[string]interface{}{"org": "acme"}
+	return nil
+}
+
+func (m *testMessageTransformer) TransformReply(authCtx interface{}, reply map[string]interface{}) error {
+	if m.replyErr != nil {
+		return m.replyErr
+	}
+	reply["org"] = "acme"
+	return nil
+}
+
+func runTestTransformedSend(t *testing.T, conf *TxnProcessorConf, txnContext TxnContext) *testRPC {
+	conf.MaxTXWaitTime = 1
+	txnProcessor := NewTxnProcessor(conf, &eth.RPCConf{}).(*txnProcessor)
+	testRPC := goodMessageRPC()
+	txnProcessor.Init(testRPC)
+
+	txnProcessor.OnMessage(txnContext)
+	for inMap := false; !inMap; _, inMap = txnProcessor.inflightTxns[strings.ToLower(testFromAddr)] {
+		time.Sleep(1 * time.Millisecond)
+	}
+	txnWG := &txnProcessor.inflightTxns[strings.ToLower(testFromAddr)].txnsInFlight[0].wg
+	txnWG.Wait()
+	return testRPC
+}
+
+func sentTransaction(testRPC *testRPC) string {
+	for i, call := range testRPC.calls {
+		if call == "eth_sendTransaction" {
+			b, _ := json.Marshal(testRPC.params[i])
+			return string(b)
+		}
+	}
+	return ""
+}
+
+func TestTransformPluginRequestAndReply(t *testing.T) {
+	assert := assert.New(t)
+	RegisterMessageTransformer(&testMessageTransformer{})
+	defer RegisterMessageTransformer(nil)
+
+	testTxnContext := &testSubmittedTxnContext{}
+	testTxnContext.jsonMsg = goodSendTxnJSON
+	testRPC := runTestTransformedSend(t, &TxnProcessorConf{}, testTxnContext)
+
+	assert.Equal(0, len(testTxnContext.errorReplies))
+	assert.Regexp(`"gas":"0x1c8"`, sentTransaction(testRPC))
+	assert.NotEmpty(testTxnContext.submittedTxHash)
+
+	assert.Equal(1, len(testTxnContext.replies))
+	reply := testTxnContext.replies[0]
+	assert.NotNil(reply.IsReceipt())
+	reply.ReplyHeaders().ID = "reply1"
+	replyBytes, _ := json.Marshal(reply)
+	var replyMap map[string]interface{}
+	json.Unmarshal(replyBytes, &replyMap)
+	assert.Equal("acme", replyMap["org"])
+	assert.Equal("reply1", replyMap["headers"].(map[string]interface{})["id"])
+	assert.Equal("0xe2215336b09f9b5b82e36e1144ed64f40a42e61b68fdaca82549fd98b8531a89", replyMap["transactionHash"])
+}
+
+func TestTransformPluginRejectsRequest(t *testing.T) {
+	assert := assert.New(t)
+	RegisterMessageTransformer(&testMessageTransformer{requestErr: fmt.Errorf("pop")})
+	defer RegisterMessageTransformer(nil)
+
+	txnProcessor := NewTxnProcessor(&TxnProcessorConf{}, &eth.RPCConf{}).(*txnProcessor)
+	testTxnContext := &testTxnContext{}
+	testTxnContext.jsonMsg = goodSendTxnJSON
+	txnProcessor.OnMessage(testTxnContext)
+
+	assert.Equal(1, len(testTxnContext.errorReplies))
+	assert.Equal(400, testTxnContext.errorReplies[0].status)
+	assert.EqualError(testTxnContext.errorReplies[0].err, "Message rejected by transformation hook: pop")
+}
+
+func TestTransformPluginReplyFailure(t *testing.T) {
+	assert := assert.New(t)
+	RegisterMessageTransformer(&testMessageTransformer{replyErr: fmt.Errorf("pop")})
+	defer RegisterMessageTransformer(nil)
+
+	testTxnContext := &testTxnContext{}
+	testTxnContext.jsonMsg = goodSendTxnJSON
+	runTestTransformedSend(t, &TxnProcessorConf{}, testTxnContext)
+
+	assert.Equal(1, len(testTxnContext.replies))
+	_, transformed := testTxnContext.replies[0].(*transformedReply)
+	assert.False(transformed)
+}
+
+func TestTransformWebhooks(t *testing.T) {
+	assert := assert.New(t)
+
+	var requestBody map[string]interface{}
+	var authHeader string
+	svr := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		authHeader = req.Header.Get("Authorization")
+		body, _ := ioutil.ReadAll(req.Body)
+		switch req.URL.Path {
+		case "/request":
+			json.Unmarshal(body, &requestBody)
+			requestBody["gas"] = "789"
+			b, _ := json.Marshal(requestBody)
+			res.WriteHeader(200)
+			res.Write(b)
+		case "/reply":
+			res.WriteHeader(204)
+		}
+	}))
+	defer svr.Close()
+
+	testTxnContext := &testTxnContext{}
+	testTxnContext.jsonMsg = goodSendTxnJSON
+	testRPC := runTestTransformedSend(t, &TxnProcessorConf{
+		TransformConf: TransformConf{
+			RequestURL: svr.URL + "/request",
+			ReplyURL:   svr.URL + "/reply",
+			Headers:    map[string]string{"Authorization": "Bearer hooks"},
+		},
+	}, testTxnContext)
+
+	assert.Equal(0, len(testTxnContext.errorReplies))
+	assert.Equal("SendTransaction", requestBody["headers"].(map[string]interface{})["type"])
+	assert.Regexp(`"gas":"0x315"`, sentTransaction(testRPC))
+	assert.Equal("Bearer hooks", authHeader)
+	assert.Equal(1, len(testTxnContext.replies))
+	replyBytes, _ := json.Marshal(testTxnContext.replies[0])
+	assert.Regexp(`"transactionHash":"0xe2215336b09f9b5b82e36e1144ed64f40a42e61b68fdaca82549fd98b8531a89"`, string(replyBytes))
+}
+
+func TestTransformWebhookRejects(t *testing.T) {
+	assert := assert.New(t)
+
+	svr := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		res.WriteHeader(422)
+		if req.URL.Path == "/json" {
+			res.Write([]byte(`{"error":"missing cost centre"}`))
+		} else {
+			res.Write([]byte(`bad request`))
+		}
+	}))
+	defer svr.Close()
+
+	h := newTransformHooks(&TransformConf{RequestURL: svr.URL + "/json"})
+	msg := &messages.SendTransaction{}
+	err := h.transformRequest(context.Background(), msg)
+	assert.Regexp(`Transformation webhook '.*/json' rejected the message \[422\]: missing cost centre`, err)
+
+	h = newTransformHooks(&TransformConf{RequestURL: svr.URL + "/text"})
+	err = h.transformRequest(context.Background(), msg)
+	assert.Regexp(`\[422\]: bad request`, err)
+}
+
+func TestTransformWebhookFailures(t *testing.T) {
+	assert := assert.New(t)
+
+	svr := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		res.WriteHeader(200)
+		res.Write([]byte(`!json`))
+	}))
+	defer svr.Close()
+
+	h := newTransformHooks(&TransformConf{RequestURL: svr.URL, ReplyURL: svr.URL})
+	assert.Equal(defaultTransformTimeoutMS, h.conf.TimeoutMS)
+	msg := &messages.SendTransaction{}
+	err := h.transformRequest(context.Background(), msg)
+	assert.Regexp("Transformation webhook .* failed", err)
+
+	reply := &messages.TransactionReceipt{}
+	assert.Equal(reply, h.transformReply(context.Background(), reply))
+
+	h = newTransformHooks(&TransformConf{RequestURL: "!://bad"})
+	err = h.transformRequest(context.Background(), msg)
+	assert.Regexp("Transformation webhook .* failed", err)
+
+	svr.Close()
+	h = newTransformHooks(&TransformConf{RequestURL: svr.URL})
+	err = h.transformRequest(context.Background(), msg)
+	assert.Regexp("Transformation webhook .* failed", err)
+}
+
+func TestTransformNoHooks(t *testing.T) {
+	assert := assert.New(t)
+
+	h := newTransformHooks(&TransformConf{})
+	testTxnContext := &testTxnContext{}
+	assert.Equal(testTxnContext, h.wrap(testTxnContext))
+	msg := &messages.SendTransaction{}
+	msg.From = testFromAddr
+	assert.NoError(h.transformRequest(context.Background(), msg))
+	assert.Equal(testFromAddr, msg.From)
+}
@@ -16,6 +16,7 @@ package tx
 
 import (
 	"context"
+	"time"
 
 	"github.com/kaleido-io/ethconnect/internal/messages"
 )
@@ -26,6 +27,8 @@ type TxnContext interface {
 	Context() context.Context
 	// Get the headers of the message
 	Headers() *messages.CommonHeaders
+	// Get the time the message was accepted by the bridge
+	TimeReceived() time.Time
 	// Unmarshal the supplied message into a give type
 	Unmarshal(msg interface{}) error
 	// Send an error reply
@@ -40,3 +43,9 @@ type TxnContext interface {
 	// Get a string summary
 	String() string
 }
+
+// TxnSubmittedListener can optionally be implemented by a TxnContext that needs the
+// transaction hash as soon as the transaction is accepted by the node, before it is mined
+type TxnSubmittedListener interface {
+	TxnSubmitted(txHash string)
+}
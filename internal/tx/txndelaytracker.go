@@ -58,6 +58,8 @@ type TxnDelayTracker interface {
 }
 
 type txnDelayTracker struct {
+	minDelay    time.Duration
+	maxDelay    time.Duration
 	count       uint64
 	window      int
 	values      []float64
@@ -76,11 +78,11 @@ func (d *txnDelayTracker) GetInitialDelay() (delay time.Duration) {
 		log.Debugf("Sending tracer at count=%d delay=%.2fs", d.count, delay.Seconds())
 		delay = delay / TracerDivisor
 	}
-	if delay < MinDelay {
-		delay = MinDelay
+	if delay < d.minDelay {
+		delay = d.minDelay
 	}
-	if delay > MaxDelay {
-		delay = MaxDelay
+	if delay > d.maxDelay {
+		delay = d.maxDelay
 	}
 	return delay
 }
@@ -91,8 +93,8 @@ func (d *txnDelayTracker) GetRetryDelay(initialDelay time.Duration, retry int) (
 	for i := 0; i < retry; i++ {
 		millis = millis * Factor
 		delay = time.Duration(millis) * time.Millisecond
-		if delay > MaxDelay {
-			delay = MaxDelay
+		if delay > d.maxDelay {
+			delay = d.maxDelay
 			break
 		}
 	}
@@ -164,8 +166,16 @@ func (d *txnDelayTracker) reset() {
 
 // NewTxnDelayTracker - constructs a new tracker
 func NewTxnDelayTracker() TxnDelayTracker {
+	return newTxnDelayTrackerWithBounds(MinDelay, MaxDelay)
+}
+
+// newTxnDelayTrackerWithBounds constructs a tracker with the minimum and maximum delays of
+// a chain profile, as block times range from sub-second to tens of seconds
+func newTxnDelayTrackerWithBounds(minDelay, maxDelay time.Duration) TxnDelayTracker {
 	d := &txnDelayTracker{
-		window: Window,
+		window:   Window,
+		minDelay: minDelay,
+		maxDelay: maxDelay,
 	}
 	d.reset()
 	return d
@@ -0,0 +1,112 @@
+// Copyright 2021 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tx
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/kaleido-io/ethconnect/internal/metrics"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	defaultPriorityClass = "default"
+)
+
+// txnLatencyBuckets are the upper bounds in seconds of the confirmation latency histogram,
+// from sub-second (private chains with fast block periods) to many minutes (congested public chains)
+var txnLatencyBuckets = []float64{0.5, 1, 2, 5, 10, 15, 30, 60, 120, 300, 600}
+
+// TxnLatencyStats summarizes the time from acceptance to mined receipt, in seconds
+type TxnLatencyStats struct {
+	Count uint64  `json:"count"`
+	P50   float64 `json:"p50"`
+	P95   float64 `json:"p95"`
+}
+
+// TxnStatus is returned on /status/tx
+type TxnStatus struct {
+	TxnLatencyStats
+	ByPriority map[string]*TxnLatencyStats `json:"byPriority"`
+	BySigner   map[string]*TxnLatencyStats `json:"bySigner"`
+}
+
+// txnLatencyTracker records the time from REST/Kafka acceptance of each transaction to its
+// mined receipt, segmented by priority class and signing address
+type txnLatencyTracker struct {
+	histogram *metrics.HistogramVec
+}
+
+func newTxnLatencyTracker() *txnLatencyTracker {
+	return &txnLatencyTracker{
+		histogram: metrics.NewHistogramVec(
+			"ethconnect_tx_confirmation_seconds",
+			"Time from acceptance of a transaction to its mined receipt",
+			txnLatencyBuckets,
+			"priority", "signer",
+		),
+	}
+}
+
+func (t *txnLatencyTracker) recordMined(priority, signer string, received time.Time) {
+	if received.IsZero() {
+		return
+	}
+	if priority == "" {
+		priority = defaultPriorityClass
+	}
+	latency := time.Now().UTC().Sub(received)
+	t.histogram.Observe(latency.Seconds(), priority, signer)
+}
+
+func latencyStats(s *metrics.HistogramSnapshot) *TxnLatencyStats {
+	return &TxnLatencyStats{
+		Count: s.Count,
+		P50:   s.Quantile(0.5),
+		P95:   s.Quantile(0.95),
+	}
+}
+
+func (t *txnLatencyTracker) status() *TxnStatus {
+	status := &TxnStatus{
+		ByPriority: make(map[string]*TxnLatencyStats),
+		BySigner:   make(map[string]*TxnLatencyStats),
+	}
+	if overall, exists := t.histogram.Aggregate("")[""]; exists {
+		status.TxnLatencyStats = *latencyStats(overall)
+	}
+	for priority, s := range t.histogram.Aggregate("priority") {
+		status.ByPriority[priority] = latencyStats(s)
+	}
+	for signer, s := range t.histogram.Aggregate("signer") {
+		status.BySigner[signer] = latencyStats(s)
+	}
+	return status
+}
+
+func (t *txnLatencyTracker) statusHandler(res http.ResponseWriter, req *http.Request, params httprouter.Params) {
+	log.Infof("--> %s %s", req.Method, req.URL)
+
+	status := 200
+	log.Infof("<-- %s %s [%d]", req.Method, req.URL, status)
+	res.Header().Set("Content-Type", "application/json")
+	res.WriteHeader(status)
+	enc := json.NewEncoder(res)
+	enc.SetIndent("", "  ")
+	enc.Encode(t.status())
+}
@@ -0,0 +1,112 @@
+// Copyright 2021 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tx
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/kaleido-io/ethconnect/internal/eth"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTxnLatencyTrackerStatus(t *testing.T) {
+	assert := assert.New(t)
+
+	tracker := newTxnLatencyTracker()
+	now := time.Now().UTC()
+	tracker.recordMined("", "0xaaaa", now.Add(-1500*time.Millisecond))
+	tracker.recordMined("high", "0xaaaa", now.Add(-300*time.Millisecond))
+	tracker.recordMined("high", "0xbbbb", now.Add(-20*time.Second))
+	tracker.recordMined("high", "0xbbbb", time.Time{})
+
+	status := tracker.status()
+	assert.Equal(uint64(3), status.Count)
+	assert.Greater(status.P95, status.P50)
+	assert.Len(status.ByPriority, 2)
+	assert.Equal(uint64(1), status.ByPriority[defaultPriorityClass].Count)
+	assert.Equal(uint64(2), status.ByPriority["high"].Count)
+	assert.Len(status.BySigner, 2)
+	assert.Equal(uint64(2), status.BySigner["0xaaaa"].Count)
+	assert.Equal(uint64(1), status.BySigner["0xbbbb"].Count)
+	assert.True(status.BySigner["0xbbbb"].P50 > 15 && status.BySigner["0xbbbb"].P50 <= 30)
+}
+
+func TestTxnLatencyTrackerStatusEmpty(t *testing.T) {
+	assert := assert.New(t)
+
+	status := newTxnLatencyTracker().status()
+	assert.Equal(uint64(0), status.Count)
+	assert.Empty(status.ByPriority)
+	assert.Empty(status.BySigner)
+}
+
+func TestTxnStatusEndpoint(t *testing.T) {
+	assert := assert.New(t)
+
+	txnProcessor := NewTxnProcessor(&TxnProcessorConf{}, &eth.RPCConf{}).(*txnProcessor)
+	txnProcessor.latencyTracker.recordMined("low", "0xaaaa", time.Now().UTC().Add(-1*time.Second))
+	router := &httprouter.Router{}
+	txnProcessor.AddRoutes(router)
+
+	req := httptest.NewRequest("GET", "/status/tx", nil)
+	res := httptest.NewRecorder()
+	router.ServeHTTP(res, req)
+	assert.Equal(200, res.Code)
+	var status map[string]interface{}
+	json.NewDecoder(res.Body).Decode(&status)
+	assert.Equal(float64(1), status["count"])
+	assert.NotNil(status["p50"])
+	assert.NotNil(status["p95"])
+	assert.NotNil(status["byPriority"].(map[string]interface{})["low"])
+	assert.NotNil(status["bySigner"].(map[string]interface{})["0xaaaa"])
+}
+
+func TestOnSendTransactionMessageRecordsLatency(t *testing.T) {
+	assert := assert.New(t)
+
+	txnProcessor := NewTxnProcessor(&TxnProcessorConf{
+		MaxTXWaitTime: 1,
+	}, &eth.RPCConf{}).(*txnProcessor)
+	testTxnContext := &testTxnContext{
+		timeReceived: time.Now().UTC(),
+	}
+	testTxnContext.jsonMsg = "{" +
+		"  \"headers\":{\"type\": \"SendTransaction\", \"priority\": \"urgent\"}," +
+		"  \"from\":\"" + testFromAddr + "\"," +
+		"  \"gas\":\"123\"," +
+		"  \"method\":{\"name\":\"test\"}" +
+		"}"
+
+	testRPC := goodMessageRPC()
+	txnProcessor.Init(testRPC)
+
+	txnProcessor.OnMessage(testTxnContext)
+	for inMap := false; !inMap; _, inMap = txnProcessor.inflightTxns[strings.ToLower(testFromAddr)] {
+		time.Sleep(1 * time.Millisecond)
+	}
+	txnWG := &txnProcessor.inflightTxns[strings.ToLower(testFromAddr)].txnsInFlight[0].wg
+	txnWG.Wait()
+	assert.Equal(0, len(testTxnContext.errorReplies))
+
+	status := txnProcessor.latencyTracker.status()
+	assert.Equal(uint64(1), status.Count)
+	assert.Equal(uint64(1), status.ByPriority["urgent"].Count)
+	assert.Equal(uint64(1), status.BySigner[strings.ToLower(testFromAddr)].Count)
+}
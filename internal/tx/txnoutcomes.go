@@ -0,0 +1,66 @@
+// Copyright 2021 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tx
+
+import (
+	"github.com/kaleido-io/ethconnect/internal/metrics"
+)
+
+const (
+	txnFailedSend        = "send"
+	txnFailedReverted    = "reverted"
+	txnFailedTimeout     = "timeout"
+	txnFailedDropped     = "dropped"
+	txnFailedCancelled   = "cancelled"
+	txnFailedUnconfirmed = "unconfirmed"
+)
+
+// txnOutcomes counts the transactions submitted to the node, and how each one completed.
+// A transaction that fails to send is counted as failed, but not as submitted
+type txnOutcomes struct {
+	submitted *metrics.CounterVec
+	confirmed *metrics.CounterVec
+	failed    *metrics.CounterVec
+}
+
+func newTxnOutcomes() *txnOutcomes {
+	return &txnOutcomes{
+		submitted: metrics.NewCounterVec(
+			"ethconnect_tx_submitted_total",
+			"Transactions accepted by the node",
+		),
+		confirmed: metrics.NewCounterVec(
+			"ethconnect_tx_confirmed_total",
+			"Transactions mined with a success status",
+		),
+		failed: metrics.NewCounterVec(
+			"ethconnect_tx_failed_total",
+			"Transactions that failed to send, reverted, or were not mined, by reason",
+			"reason",
+		),
+	}
+}
+
+func (o *txnOutcomes) recordSubmitted() {
+	o.submitted.Inc()
+}
+
+func (o *txnOutcomes) recordConfirmed() {
+	o.confirmed.Inc()
+}
+
+func (o *txnOutcomes) recordFailed(reason string) {
+	o.failed.Inc(reason)
+}
@@ -0,0 +1,92 @@
+// Copyright 2021 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tx
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kaleido-io/ethconnect/internal/eth"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOnSendTransactionMessageRecordsOutcomes(t *testing.T) {
+	assert := assert.New(t)
+
+	txnProcessor := NewTxnProcessor(&TxnProcessorConf{
+		MaxTXWaitTime: 1,
+	}, &eth.RPCConf{}).(*txnProcessor)
+	testTxnContext := &testTxnContext{}
+	testTxnContext.jsonMsg = "{" +
+		"  \"headers\":{\"type\": \"SendTransaction\"}," +
+		"  \"from\":\"" + testFromAddr + "\"," +
+		"  \"gas\":\"123\"," +
+		"  \"method\":{\"name\":\"test\"}" +
+		"}"
+
+	testRPC := goodMessageRPC()
+	txnProcessor.Init(testRPC)
+
+	txnProcessor.OnMessage(testTxnContext)
+	for inMap := false; !inMap; _, inMap = txnProcessor.inflightTxns[strings.ToLower(testFromAddr)] {
+		time.Sleep(1 * time.Millisecond)
+	}
+	txnWG := &txnProcessor.inflightTxns[strings.ToLower(testFromAddr)].txnsInFlight[0].wg
+	txnWG.Wait()
+
+	assert.Equal(uint64(1), txnProcessor.outcomes.submitted.Value())
+	assert.Equal(uint64(1), txnProcessor.outcomes.confirmed.Value())
+	assert.Equal(uint64(0), txnProcessor.outcomes.failed.Value(txnFailedReverted))
+}
+
+func TestOnSendTransactionMessageRecordsSendFailure(t *testing.T) {
+	assert := assert.New(t)
+
+	txnProcessor := NewTxnProcessor(&TxnProcessorConf{
+		MaxTXWaitTime: 5000,
+	}, &eth.RPCConf{}).(*txnProcessor)
+	testTxnContext := &testTxnContext{}
+	testTxnContext.jsonMsg = "{" +
+		"  \"headers\":{\"type\": \"SendTransaction\"}," +
+		"  \"from\":\"" + testFromAddr + "\"," +
+		"  \"gas\":\"123\"," +
+		"  \"method\":{\"name\":\"test\"}" +
+		"}"
+	txnProcessor.Init(&testRPC{
+		ethSendTransactionErr: fmt.Errorf("fizzle"),
+	})
+
+	txnProcessor.OnMessage(testTxnContext)
+	for len(testTxnContext.errorReplies) == 0 {
+		time.Sleep(1 * time.Millisecond)
+	}
+
+	assert.Equal(uint64(0), txnProcessor.outcomes.submitted.Value())
+	assert.Equal(uint64(1), txnProcessor.outcomes.failed.Value(txnFailedSend))
+}
+
+func TestTxnOutcomesFailedReasons(t *testing.T) {
+	assert := assert.New(t)
+
+	outcomes := newTxnOutcomes()
+	outcomes.recordFailed(txnFailedReverted)
+	outcomes.recordFailed(txnFailedTimeout)
+	outcomes.recordFailed(txnFailedTimeout)
+	assert.Equal(uint64(1), outcomes.failed.Value(txnFailedReverted))
+	assert.Equal(uint64(2), outcomes.failed.Value(txnFailedTimeout))
+	assert.Equal(uint64(0), outcomes.failed.Value(txnFailedDropped))
+}
@@ -15,6 +15,7 @@
 package tx
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"strconv"
@@ -22,9 +23,11 @@ import (
 	"sync"
 	"time"
 
+	"github.com/julienschmidt/httprouter"
 	"github.com/spf13/cobra"
 
 	ethbinding "github.com/kaleido-io/ethbinding/pkg"
+	"github.com/kaleido-io/ethconnect/internal/auth"
 	"github.com/kaleido-io/ethconnect/internal/errors"
 	"github.com/kaleido-io/ethconnect/internal/eth"
 	"github.com/kaleido-io/ethconnect/internal/messages"
@@ -41,7 +44,10 @@ const (
 type TxnProcessor interface {
 	OnMessage(TxnContext)
 	Init(eth.RPCClient)
-	ResolveAddress(from string) (resolvedFrom string, err error)
+	ResolveAddress(ctx context.Context, from string) (resolvedFrom string, err error)
+	SetEventABIResolver(resolver eth.EventABIResolver)
+	AddRoutes(router *httprouter.Router)
+	ContractStats(address string) *ContractStats
 }
 
 var highestID = 1000000
@@ -57,10 +63,20 @@ type inflightTxn struct {
 	tx               *eth.Txn
 	wg               sync.WaitGroup
 	registerAs       string // passed from request to reply
+	registerEnv      string // passed from request to reply
 	rpc              eth.RPCClient
 	signer           eth.TXSigner
 	gapFillSucceeded bool
 	gapFillTxHash    string
+	managedNonce     bool // assigned by the nonce manager
+	added            time.Time
+	bumps            int        // number of times replaced with a higher gas price
+	replaced         []*eth.Txn // earlier transactions sent at the same nonce, any of which might be mined
+	sent             time.Time  // when the current transaction was sent
+	cancelled        bool       // replaced by a cancellation
+	dropped          bool       // removed from the queue by an operator
+	sponsor          string     // the sponsor whose gas is used, if any
+	tenant           string     // the tenant of the caller, for sponsored transactions
 }
 
 func (i *inflightTxn) nonceNumber() json.Number {
@@ -77,14 +93,29 @@ func (i *inflightTxn) String() string {
 
 // TxnProcessorConf configuration for the message processor
 type TxnProcessorConf struct {
-	AlwaysManageNonce  bool            `json:"alwaysManageNonce"`
-	AttemptGapFill     bool            `json:"attemptGapFill"`
-	MaxTXWaitTime      int             `json:"maxTXWaitTime"`
-	SendConcurrency    int             `json:"sendConcurrency"`
-	OrionPrivateAPIS   bool            `json:"orionPrivateAPIs"`
-	HexValuesInReceipt bool            `json:"hexValuesInReceipt"`
-	AddressBookConf    AddressBookConf `json:"addressBook"`
-	HDWalletConf       HDWalletConf    `json:"hdWallet"`
+	AlwaysManageNonce   bool                  `json:"alwaysManageNonce"`
+	AttemptGapFill      bool                  `json:"attemptGapFill"`
+	MaxTXWaitTime       int                   `json:"maxTXWaitTime"`
+	SendConcurrency     int                   `json:"sendConcurrency"`
+	OrionPrivateAPIS    bool                  `json:"orionPrivateAPIs"`
+	HexValuesInReceipt  bool                  `json:"hexValuesInReceipt"`
+	AddressBookConf     AddressBookConf       `json:"addressBook"`
+	HDWalletConf        HDWalletConf          `json:"hdWallet"`
+	LocalKeystoreConf   LocalKeystoreConf     `json:"keystore"`
+	RemoteSigners       RemoteSignersConf     `json:"remoteSigners"`
+	GasEstimation       eth.GasEstimationConf `json:"gasEstimation"`
+	FeeEstimation       eth.FeeEstimationConf `json:"feeEstimation"`
+	GasPrice            eth.GasPriceConf      `json:"gasPrice"`
+	PrivacyConf         PrivacyConf           `json:"privacy"`
+	TransformConf       TransformConf         `json:"transform"`
+	SponsorshipConf     SponsorshipConf       `json:"sponsorship"`
+	IdentityAliasesConf IdentityAliasesConf   `json:"identityAliases"`
+	NonceManagerConf    NonceManagerConf      `json:"nonceManager"`
+	ReceiptFees         ReceiptFeesConf       `json:"receiptFees"`
+	StuckTxns           StuckTxnConf          `json:"stuckTransactions"`
+	ContractStats       ContractStatsConf     `json:"contractStats"`
+	ChainProfile        ChainProfileConf      `json:"chainProfile"`
+	ReceiptPoller       ReceiptPollerConf     `json:"receiptPoller"`
 }
 
 type inflightTxnState struct {
@@ -97,12 +128,28 @@ type txnProcessor struct {
 	inflightTxnsLock   *sync.Mutex
 	inflightTxns       map[string]*inflightTxnState
 	inflightTxnDelayer TxnDelayTracker
+	latencyTracker     *txnLatencyTracker
+	outcomes           *txnOutcomes
+	privacy            *privacyManager
 	rpc                eth.RPCClient
 	addressBook        AddressBook
 	hdwallet           HDWallet
+	keystore           *localKeystore
+	remoteSigners      *remoteSigners
 	conf               *TxnProcessorConf
 	rpcConf            *eth.RPCConf
 	concurrencySlots   chan bool
+	transform          *transformHooks
+	sponsorship        *sponsorship
+	aliases            *aliasManager
+	eventABIResolver   eth.EventABIResolver
+	fees               *eth.FeeEstimator
+	gasPrices          *eth.GasPriceOracle
+	nonces             *nonceManager
+	requestFees        *requestFees
+	stuckTxns          *stuckTxnPolicy
+	contractStats      *contractStats
+	receiptPoller      *receiptPoller
 }
 
 // NewTxnProcessor constructor for message procss
@@ -110,13 +157,29 @@ func NewTxnProcessor(conf *TxnProcessorConf, rpcConf *eth.RPCConf) TxnProcessor
 	if conf.SendConcurrency == 0 {
 		conf.SendConcurrency = defaultSendConcurrency
 	}
+	// The chain profile fills in the fee settings, so is applied before the fee estimator is built
+	delayer := applyChainProfile(conf)
 	p := &txnProcessor{
 		inflightTxnsLock:   &sync.Mutex{},
 		inflightTxns:       make(map[string]*inflightTxnState),
-		inflightTxnDelayer: NewTxnDelayTracker(),
+		inflightTxnDelayer: delayer,
+		latencyTracker:     newTxnLatencyTracker(),
+		outcomes:           newTxnOutcomes(),
+		privacy:            newPrivacyManager(&conf.PrivacyConf),
 		conf:               conf,
 		rpcConf:            rpcConf,
 		concurrencySlots:   make(chan bool, conf.SendConcurrency),
+		transform:          newTransformHooks(&conf.TransformConf),
+		sponsorship:        newSponsorship(&conf.SponsorshipConf),
+		aliases:            newAliasManager(&conf.IdentityAliasesConf),
+		keystore:           newLocalKeystore(&conf.LocalKeystoreConf),
+		remoteSigners:      newRemoteSigners(&conf.RemoteSigners),
+		fees:               eth.NewFeeEstimator(&conf.FeeEstimation),
+		gasPrices:          eth.NewGasPriceOracle(&conf.GasPrice),
+		nonces:             newNonceManager(&conf.NonceManagerConf, conf.AttemptGapFill),
+		requestFees:        newRequestFees(&conf.ReceiptFees),
+		stuckTxns:          newStuckTxnPolicy(&conf.StuckTxns),
+		contractStats:      newContractStats(&conf.ContractStats),
 	}
 	return p
 }
@@ -130,6 +193,29 @@ func (p *txnProcessor) Init(rpc eth.RPCClient) {
 	if p.conf.HDWalletConf.URLTemplate != "" {
 		p.hdwallet = newHDWallet(&p.conf.HDWalletConf)
 	}
+	if err := p.keystore.init(); err != nil {
+		log.Errorf("Failed to initialize the local keystore: %s", err)
+	}
+	if err := p.remoteSigners.init(); err != nil {
+		log.Errorf("Failed to initialize remote signers: %s", err)
+	}
+	if err := p.privacy.init(); err != nil {
+		log.Errorf("Failed to initialize enclave keys: %s", err)
+	}
+	if err := p.sponsorship.init(); err != nil {
+		log.Errorf("Failed to initialize gas sponsors: %s", err)
+	}
+	if err := p.aliases.init(); err != nil {
+		log.Errorf("Failed to initialize identity aliases: %s", err)
+	}
+	if err := p.stuckTxns.init(); err != nil {
+		log.Errorf("Failed to initialize the stuck transaction policy: %s", err)
+	}
+	p.nonces.start()
+	if p.conf.ReceiptPoller.Enabled {
+		p.receiptPoller = newReceiptPoller(&p.conf.ReceiptPoller, rpc)
+		p.receiptPoller.start()
+	}
 }
 
 // CobraInitTxnProcessor sets the standard command-line parameters for the txnprocessor
@@ -150,12 +236,16 @@ func (p *txnProcessor) OnMessage(txnContext TxnContext) {
 	var unmarshalErr error
 	headers := txnContext.Headers()
 	log.Debugf("Processing %+v", headers)
+	txnContext = p.transform.wrap(traceTxn(txnContext))
 	switch headers.MsgType {
 	case messages.MsgTypeDeployContract:
 		var deployContractMsg messages.DeployContract
 		if unmarshalErr = txnContext.Unmarshal(&deployContractMsg); unmarshalErr != nil {
 			break
 		}
+		if unmarshalErr = p.transform.transformRequest(txnContext.Context(), &deployContractMsg); unmarshalErr != nil {
+			break
+		}
 		p.OnDeployContractMessage(txnContext, &deployContractMsg)
 		break
 	case messages.MsgTypeSendTransaction:
@@ -163,6 +253,9 @@ func (p *txnProcessor) OnMessage(txnContext TxnContext) {
 		if unmarshalErr = txnContext.Unmarshal(&sendTransactionMsg); unmarshalErr != nil {
 			break
 		}
+		if unmarshalErr = p.transform.transformRequest(txnContext.Context(), &sendTransactionMsg); unmarshalErr != nil {
+			break
+		}
 		p.OnSendTransactionMessage(txnContext, &sendTransactionMsg)
 		break
 	default:
@@ -175,7 +268,31 @@ func (p *txnProcessor) OnMessage(txnContext TxnContext) {
 
 }
 
-func (p *txnProcessor) ResolveAddress(from string) (resolvedFrom string, err error) {
+// SetEventABIResolver sets the lookup of registered ABIs, used to decode logs in receipts
+// that were emitted by contracts other than the one invoked
+func (p *txnProcessor) SetEventABIResolver(resolver eth.EventABIResolver) {
+	p.eventABIResolver = resolver
+}
+
+// AddRoutes adds the transaction status endpoint, reporting confirmation latencies,
+// and the queue of in-flight transactions and nonce state for each signing address
+func (p *txnProcessor) AddRoutes(router *httprouter.Router) {
+	router.GET("/status/tx", p.latencyTracker.statusHandler)
+	router.GET("/identities/:address/queue", p.queueHandler)
+	router.POST("/identities/:address/queue/:id/bump", p.bumpHandler)
+	router.DELETE("/identities/:address/queue/:id", p.dropHandler)
+	router.GET("/identities/:address/nonces", p.nonceStateHandler)
+	router.POST(NonceGapsPath, p.fillNonceGapsHandler)
+	p.privacy.addRoutes(router)
+	p.sponsorship.addRoutes(router)
+	p.aliases.addRoutes(router)
+	p.keystore.addRoutes(router)
+}
+
+func (p *txnProcessor) ResolveAddress(ctx context.Context, from string) (resolvedFrom string, err error) {
+	if from, err = p.aliases.resolve(ctx, from); err != nil {
+		return
+	}
 	signer, err := p.resolveSigner(from)
 	if signer != nil {
 		resolvedFrom = signer.Address()
@@ -194,6 +311,14 @@ func (p *txnProcessor) resolveSigner(from string) (signer eth.TXSigner, err erro
 		if signer, err = p.hdwallet.SignerFor(hdWalletRequest); err != nil {
 			return
 		}
+	} else if keystoreRequest := IsKeystoreRequest(from); keystoreRequest != nil {
+		if signer, err = p.keystore.SignerFor(keystoreRequest); err != nil {
+			return
+		}
+	} else if keystoreSigner := p.keystore.signerForAddress(from); keystoreSigner != nil {
+		signer = keystoreSigner
+	} else if signer, err = p.remoteSigners.signerFor(from); err != nil {
+		return
 	}
 	return
 }
@@ -207,6 +332,21 @@ func (p *txnProcessor) addInflightWrapper(txnContext TxnContext, msg *messages.T
 
 	inflight = &inflightTxn{
 		txnContext: txnContext,
+		added:      time.Now().UTC(),
+	}
+
+	// A sponsored transaction is sent from the sponsor, so its gas is used rather than that of the caller
+	if sponsor := txnContext.Headers().Sponsor; sponsor != "" {
+		if msg.From, err = p.sponsorship.sponsorFor(txnContext.Context(), sponsor); err != nil {
+			return nil, err
+		}
+		inflight.sponsor = sponsor
+		inflight.tenant = auth.GetTenant(txnContext.Context())
+	}
+
+	// An alias is sent from the address or signer it maps to, if the caller is entitled to it
+	if msg.From, err = p.aliases.resolve(txnContext.Context(), msg.From); err != nil {
+		return nil, err
 	}
 
 	// Use the correct RPC for sending transactions
@@ -228,6 +368,14 @@ func (p *txnProcessor) addInflightWrapper(txnContext TxnContext, msg *messages.T
 	}
 	inflight.from = strings.ToLower(from.Hex())
 
+	// Resolve enclave key names (and rotated keys) to the current keys
+	if msg.PrivateFrom != "" {
+		msg.PrivateFrom = p.privacy.resolveKey(msg.PrivateFrom)
+	}
+	for i, privateFor := range msg.PrivateFor {
+		msg.PrivateFor[i] = p.privacy.resolveKey(privateFor)
+	}
+
 	// Need to resolve privateFrom/privateFor to a privacyGroupID for Orion
 	if p.conf.OrionPrivateAPIS {
 		if msg.PrivacyGroupID != "" && len(msg.PrivateFor) > 0 {
@@ -242,7 +390,18 @@ func (p *txnProcessor) addInflightWrapper(txnContext TxnContext, msg *messages.T
 		}
 	}
 
-	nodeAssignNonce := inflight.signer == nil && !p.conf.AlwaysManageNonce
+	nodeAssignNonce := inflight.signer == nil && !p.conf.AlwaysManageNonce && !p.conf.NonceManagerConf.Enabled
+
+	// The nonce manager tracks the nonces of each address across transactions, including
+	// those released after failing to send, and reconciles them with the node.
+	// It has its own lock, and might query the node, so is called before we take ours
+	orionPrivate := p.conf.OrionPrivateAPIS && (len(msg.PrivateFor) > 0 || msg.PrivacyGroupID != "")
+	if p.conf.NonceManagerConf.Enabled && msg.Nonce == "" && !orionPrivate {
+		if inflight.nonce, err = p.nonces.assign(txnContext.Context(), inflight.rpc, inflight.signer, inflight.from, &from); err != nil {
+			return
+		}
+		inflight.managedNonce = true
+	}
 
 	// Hold the lock just while we're adding it to the map and dealing with nonce checking.
 	p.inflightTxnsLock.Lock()
@@ -257,7 +416,8 @@ func (p *txnProcessor) addInflightWrapper(txnContext TxnContext, msg *messages.T
 	inflightForAddr, exists := p.inflightTxns[inflight.from]
 	// Add the inflight transaction to our tracking structure
 	if !exists {
-		p.inflightTxns[inflight.from] = &inflightTxnState{}
+		// The highest nonce is only known once one is assigned by us, rather than supplied
+		p.inflightTxns[inflight.from] = &inflightTxnState{highestNonce: -1}
 		inflightForAddr = p.inflightTxns[inflight.from]
 		inflightForAddr.txnsInFlight = []*inflightTxn{}
 	}
@@ -277,10 +437,16 @@ func (p *txnProcessor) addInflightWrapper(txnContext TxnContext, msg *messages.T
 	fromNode := false
 	if suppliedNonce != "" {
 		if inflight.nonce, err = suppliedNonce.Int64(); err != nil {
+			p.inflightTxnsLock.Unlock()
 			err = errors.Errorf(errors.TransactionSendBadNonce, err)
 			return
 		}
-	} else if p.conf.OrionPrivateAPIS && (len(msg.PrivateFor) > 0 || msg.PrivacyGroupID != "") {
+		// Supplied nonces are checked against the nonces already allocated to the address
+		if err = p.checkSuppliedNonce(txnContext.Context(), inflight, inflightForAddr, &from); err != nil {
+			p.inflightTxnsLock.Unlock()
+			return
+		}
+	} else if orionPrivate {
 		// If are using orion private transactions, then we need the private TX
 		// group ID and nonce (the public transaction will be submitted by the pantheon node)
 		// Note: We do not have highestNonce calculation for in-flight private transactions,
@@ -290,6 +456,8 @@ func (p *txnProcessor) addInflightWrapper(txnContext TxnContext, msg *messages.T
 			return
 		}
 		fromNode = true
+	} else if inflight.managedNonce {
+		// Already assigned by the nonce manager, before taking the lock
 	} else if highestNonce >= 0 {
 		// If we found a nonce in-flight in memory, store & return one higher.
 		inflight.nonce = highestNonce + 1
@@ -367,6 +535,11 @@ func (p *txnProcessor) cancelInFlight(inflight *inflightTxn, submitted bool) {
 		log.Warnf("Potential nonce gap. Nonce %d failed to send. Nonce %d in-flight", inflight.nonce, highestNonce)
 		p.submitGapFillTX(inflight)
 	}
+
+	// Nonces that were neither sent, nor filled, are reused by the nonce manager
+	if inflight.managedNonce {
+		p.nonces.release(inflight.from, inflight.nonce, submitted || inflight.gapFillSucceeded)
+	}
 }
 
 // submitGapFillTX attempts to send a zero gas, no data, transfer of zero ether transaction
@@ -400,21 +573,40 @@ func (p *txnProcessor) waitForCompletion(inflight *inflightTxn, initialWaitDelay
 	replyWaitStart := time.Now().UTC()
 	time.Sleep(initialWaitDelay)
 
-	var isMined, timedOut bool
+	var isMined, timedOut, dropped bool
+	var tx *eth.Txn
+	var replaced []*eth.Txn
 	var err error
 	var retries int
 	var elapsed time.Duration
 	for !isMined && !timedOut {
 
-		if isMined, err = inflight.tx.GetTXReceipt(inflight.txnContext.Context(), p.rpc); err != nil {
+		// The transaction is replaced if it is bumped, and we stop if it is dropped
+		p.inflightTxnsLock.Lock()
+		tx = inflight.tx
+		replaced = inflight.replaced
+		dropped = inflight.dropped
+		p.inflightTxnsLock.Unlock()
+		if dropped {
+			break
+		}
+
+		if isMined, err = p.getTXReceipt(inflight.txnContext.Context(), tx); err != nil {
 			// We wait even on connectivity errors, as we've submitted the transaction and
 			// we want to provide a receipt if connectivity resumes within the timeout
 			log.Infof("Failed to get receipt for %s (retries=%d): %s", inflight, retries, err)
+		} else if !isMined && len(replaced) > 0 {
+			// A replaced transaction can be mined before its replacement
+			if minedTx := p.getReplacedReceipt(inflight, replaced); minedTx != nil {
+				tx, isMined = minedTx, true
+			}
 		}
 
 		elapsed = time.Now().UTC().Sub(replyWaitStart)
 		timedOut = elapsed > p.maxTXWaitTime
 		if !isMined && !timedOut {
+			p.checkStuck(inflight)
+
 			// Need to have the inflight lock to calculate the delay, but not
 			// while we're waiting
 			p.inflightTxnsLock.Lock()
@@ -422,26 +614,65 @@ func (p *txnProcessor) waitForCompletion(inflight *inflightTxn, initialWaitDelay
 			p.inflightTxnsLock.Unlock()
 
 			log.Debugf("Receipt not available after %.2fs (retries=%d): %s", elapsed.Seconds(), retries, inflight)
-			time.Sleep(delayBeforeRetry)
+			if p.receiptPoller == nil || err != nil {
+				// The shared poller has already waited for the next block
+				time.Sleep(delayBeforeRetry)
+			}
 			retries++
 		}
 	}
 
-	if timedOut {
+	p.inflightTxnsLock.Lock()
+	cancelled := isMined && inflight.cancelled && tx == inflight.tx
+	replacedHashes := inflight.replacedHashes(tx)
+	bumps := inflight.bumps
+	p.inflightTxnsLock.Unlock()
+
+	// The receipt is only reported once the block has the confirmations requested, if more than the block itself
+	confirmations := p.defaultConfirmations(inflight.txnContext.Headers().Confirmations)
+	var reorged []string
+	var unconfirmed error
+	if isMined && !cancelled && confirmations > 1 {
+		reorged, unconfirmed = p.waitForConfirmations(inflight, tx, confirmations, initialWaitDelay)
+	}
+
+	if dropped {
+		p.outcomes.recordFailed(txnFailedDropped)
+		inflight.txnContext.SendErrorReplyWithTX(410, errors.Errorf(errors.TransactionQueueDropped), tx.Hash)
+	} else if cancelled {
+		p.outcomes.recordFailed(txnFailedCancelled)
+		inflight.txnContext.SendErrorReplyWithTX(410, errors.Errorf(errors.TransactionStuckCancelled, bumps), tx.Hash)
+	} else if unconfirmed != nil {
+		p.outcomes.recordFailed(txnFailedUnconfirmed)
+		inflight.txnContext.SendErrorReplyWithTX(408, unconfirmed, tx.Hash)
+	} else if timedOut {
+		p.outcomes.recordFailed(txnFailedTimeout)
 		if err != nil {
-			inflight.txnContext.SendErrorReplyWithTX(500, errors.Errorf(errors.TransactionSendReceiptCheckError, retries, err), inflight.tx.Hash)
+			inflight.txnContext.SendErrorReplyWithTX(500, errors.Errorf(errors.TransactionSendReceiptCheckError, retries, err), tx.Hash)
 		} else {
-			inflight.txnContext.SendErrorReplyWithTX(408, errors.Errorf(errors.TransactionSendReceiptCheckTimeout), inflight.tx.Hash)
+			inflight.txnContext.SendErrorReplyWithTX(408, errors.Errorf(errors.TransactionSendReceiptCheckTimeout), tx.Hash)
 		}
 	} else {
 		// Update the stats
 		p.inflightTxnsLock.Lock()
 		p.inflightTxnDelayer.ReportSuccess(elapsed)
 		p.inflightTxnsLock.Unlock()
+		p.latencyTracker.recordMined(inflight.txnContext.Headers().Priority, inflight.from, inflight.txnContext.TimeReceived())
 
-		receipt := inflight.tx.Receipt
+		if inflight.sponsor != "" {
+			p.sponsorship.recordUsage(inflight.tenant, inflight.sponsor, tx)
+		}
+
+		receipt := tx.Receipt
 		isSuccess := (receipt.Status != nil && receipt.Status.ToInt().Int64() > 0)
-		log.Infof("Receipt for %s obtained after %.2fs Success=%t", inflight.tx.Hash, elapsed.Seconds(), isSuccess)
+		log.Infof("Receipt for %s obtained after %.2fs Success=%t", tx.Hash, elapsed.Seconds(), isSuccess)
+		if isSuccess {
+			p.outcomes.recordConfirmed()
+			p.contractStats.record(tx, contractOutcomeSuccess)
+		} else {
+			p.outcomes.recordFailed(txnFailedReverted)
+			p.contractStats.record(tx, contractOutcomeReverted)
+		}
 
 		// Build our reply
 		var reply messages.TransactionReceipt
@@ -458,7 +689,12 @@ func (p *txnProcessor) waitForCompletion(inflight *inflightTxn, initialWaitDelay
 			reply.BlockNumberStr = receipt.BlockNumber.ToInt().Text(10)
 		}
 		reply.ContractAddress = receipt.ContractAddress
+		if isSuccess && tx.CREATE2Address != nil {
+			// The factory created the contract, so it is registered at the address it was deployed to
+			reply.ContractAddress = tx.CREATE2Address
+		}
 		reply.RegisterAs = inflight.registerAs
+		reply.RegisterEnvironment = inflight.registerEnv
 		if p.conf.HexValuesInReceipt {
 			reply.CumulativeGasUsedHex = receipt.CumulativeGasUsed
 		}
@@ -485,12 +721,26 @@ func (p *txnProcessor) waitForCompletion(inflight *inflightTxn, initialWaitDelay
 		}
 		reply.To = receipt.To
 		reply.TransactionHash = receipt.TransactionHash
+		reply.Replaced = replacedHashes
+		if confirmations > 0 {
+			reply.Confirmations = strconv.FormatInt(confirmations, 10)
+		}
+		reply.ReorgedBlocks = reorged
 		if p.conf.HexValuesInReceipt {
 			reply.TransactionIndexHex = receipt.TransactionIndex
 		}
 		if receipt.TransactionIndex != nil {
 			reply.TransactionIndexStr = strconv.FormatUint(uint64(*receipt.TransactionIndex), 10)
 		}
+		reply.DecodedEvents = tx.DecodeLogs(p.eventABIResolver)
+		if !isSuccess && receipt.Status != nil && len(tx.PrivateFor) == 0 && tx.PrivacyGroupID == "" {
+			// Replay the transaction to find out why it reverted - not possible for private transactions
+			errorABIResolver, _ := p.eventABIResolver.(eth.ErrorABIResolver)
+			reply.RevertReason = tx.RevertReason(inflight.txnContext.Context(), p.rpc, errorABIResolver)
+		}
+		if p.conf.ReceiptFees.Enabled {
+			p.addReceiptFees(inflight, tx, &reply)
+		}
 
 		inflight.txnContext.Reply(&reply)
 	}
@@ -500,12 +750,24 @@ func (p *txnProcessor) waitForCompletion(inflight *inflightTxn, initialWaitDelay
 	inflight.wg.Done()
 }
 
+// getTXReceipt gets the receipt through the shared receipt poller if enabled, which waits
+// for its next poll. Private transactions need a second call, so are always fetched directly
+func (p *txnProcessor) getTXReceipt(ctx context.Context, tx *eth.Txn) (bool, error) {
+	if p.receiptPoller != nil && tx.PrivacyGroupID == "" {
+		return p.receiptPoller.poll(ctx, tx)
+	}
+	return tx.GetTXReceipt(ctx, p.rpc)
+}
+
 // addInflight adds a transaction to the inflight list, and kick off
 // a goroutine to check for its completion and send the result
 func (p *txnProcessor) trackMining(inflight *inflightTxn, tx *eth.Txn) {
 
 	// Kick off the goroutine to track it to completion
+	p.inflightTxnsLock.Lock()
 	inflight.tx = tx
+	inflight.sent = time.Now().UTC()
+	p.inflightTxnsLock.Unlock()
 	inflight.wg.Add(1)
 	go p.waitForCompletion(inflight, inflight.initialWaitDelay)
 
@@ -519,6 +781,7 @@ func (p *txnProcessor) OnDeployContractMessage(txnContext TxnContext, msg *messa
 		return
 	}
 	inflight.registerAs = msg.RegisterAs
+	inflight.registerEnv = msg.RegisterEnvironment
 	msg.Nonce = inflight.nonceNumber()
 
 	tx, err := eth.NewContractDeployTxn(msg, inflight.signer)
@@ -554,6 +817,9 @@ func (p *txnProcessor) sendTransactionCommon(txnContext TxnContext, inflight *in
 	tx.OrionPrivateAPIS = p.conf.OrionPrivateAPIS
 	tx.PrivacyGroupID = inflight.privacyGroupID
 	tx.NodeAssignNonce = inflight.nodeAssignNonce
+	tx.GasEstimation = &p.conf.GasEstimation
+	tx.Fees = p.fees
+	tx.GasPrices = p.gasPrices
 
 	if p.conf.SendConcurrency > 1 {
 		// The above must happen synchronously for each partition in Kafka - as it is where we assign the nonce.
@@ -571,11 +837,23 @@ func (p *txnProcessor) sendAndTrackMining(txnContext TxnContext, inflight *infli
 	if p.conf.SendConcurrency > 1 {
 		<-p.concurrencySlots // return our slot as soon as send is complete, to let an awaiting send go
 	}
+	if err != nil && p.conf.PrivacyConf.PTMURL != "" && (len(tx.PrivateFor) > 0 || tx.PrivacyGroupID != "") {
+		// PTM outages otherwise surface as errors from the node that do not identify the cause
+		if ptmErr := p.privacy.upcheck(txnContext.Context()); ptmErr != nil {
+			err = errors.Errorf(errors.TransactionSendPTMUnavailable, err, ptmErr)
+		}
+	}
 	if err != nil {
+		p.outcomes.recordFailed(txnFailedSend)
+		p.contractStats.record(tx, contractOutcomeFailed)
 		p.cancelInFlight(inflight, false /* not confirmed as submitted, as send failed */)
 		txnContext.SendErrorReplyWithGapFill(400, err, inflight.gapFillTxHash, inflight.gapFillSucceeded)
 		return
 	}
+	p.outcomes.recordSubmitted()
+	if listener, ok := txnContext.(TxnSubmittedListener); ok {
+		listener.TxnSubmitted(tx.Hash)
+	}
 
 	p.trackMining(inflight, tx)
 }
@@ -50,6 +50,7 @@ type errorReply struct {
 type testTxnContext struct {
 	jsonMsg      string
 	badMsgType   string
+	timeReceived time.Time
 	replies      []messages.ReplyWithHeaders
 	errorReplies []*errorReply
 }
@@ -70,6 +71,9 @@ type testRPC struct {
 	privFindPrivacyGroupErr        error
 	ethEstimateGasResult           ethbinding.HexUint64
 	ethEstimateGasErr              error
+	ethGetBlockByHashResult        map[string]interface{}
+	ethBlockNumberResult           int64
+	ethCallResult                  string
 	condLock                       sync.Mutex
 	calls                          []string
 	params                         [][]interface{}
@@ -147,14 +151,28 @@ func (r *testRPC) CallContext(ctx context.Context, result interface{}, method st
 	} else if method == "priv_findPrivacyGroup" {
 		reflect.ValueOf(result).Elem().Set(reflect.ValueOf(r.privFindPrivacyGroupResult))
 		return r.privFindPrivacyGroupErr
-	} else if method == "eth_getTransactionReceipt" {
-		reflect.ValueOf(result).Elem().Set(reflect.ValueOf(r.ethGetTransactionReceiptResult))
+	} else if method == "eth_getTransactionReceipt" || method == "priv_getTransactionReceipt" {
+		if receipt, ok := result.(**eth.TxnReceipt); ok {
+			receiptCopy := r.ethGetTransactionReceiptResult
+			*receipt = &receiptCopy
+		} else {
+			reflect.ValueOf(result).Elem().Set(reflect.ValueOf(r.ethGetTransactionReceiptResult))
+		}
 		return r.ethGetTransactionReceiptErr
+	} else if method == "eth_blockNumber" {
+		reflect.ValueOf(result).Elem().Set(reflect.ValueOf(ethbinding.HexBigInt(*big.NewInt(r.ethBlockNumberResult))))
+		return nil
 	} else if method == "eth_estimateGas" {
 		reflect.ValueOf(result).Elem().Set(reflect.ValueOf(&r.ethEstimateGasResult))
 		return r.ethEstimateGasErr
 	} else if method == "eth_call" {
+		if r.ethCallResult != "" {
+			reflect.ValueOf(result).Elem().Set(reflect.ValueOf(r.ethCallResult))
+		}
 		return nil
+	} else if method == "eth_getBlockByHash" {
+		b, _ := json.Marshal(r.ethGetBlockByHashResult)
+		return json.Unmarshal(b, result)
 	}
 	panic(fmt.Errorf("method unknown to test: %s", method))
 }
@@ -178,6 +196,10 @@ func (c *testTxnContext) Headers() *messages.CommonHeaders {
 	return &commonMsg.Headers.CommonHeaders
 }
 
+func (c *testTxnContext) TimeReceived() time.Time {
+	return c.timeReceived
+}
+
 func (c *testTxnContext) Unmarshal(msg interface{}) error {
 	log.Infof("Unmarshaling test message: %s", c.jsonMsg)
 	return json.Unmarshal([]byte(c.jsonMsg), msg)
@@ -366,6 +388,47 @@ func TestOnDeployContractMessageGoodTxnMined(t *testing.T) {
 	assert.Equal("456789", replyMsgMap["transactionIndex"])
 }
 
+func TestOnDeployContractMessageCREATE2TxnMined(t *testing.T) {
+	assert := assert.New(t)
+
+	txnProcessor := NewTxnProcessor(&TxnProcessorConf{
+		MaxTXWaitTime: 1,
+	}, &eth.RPCConf{}).(*txnProcessor)
+	testTxnContext := &testTxnContext{}
+	testTxnContext.jsonMsg = "{" +
+		"  \"headers\":{\"type\": \"DeployContract\"}," +
+		"  \"compiled\":\"AA==\"," +
+		"  \"abi\":[]," +
+		"  \"salt\":\"0x00\"," +
+		"  \"factory\":\"0x0000000000000000000000000000000000000000\"," +
+		"  \"from\":\"" + testFromAddr + "\"," +
+		"  \"nonce\":\"123\"," +
+		"  \"gas\":\"123\"" +
+		"}"
+
+	testRPC := goodMessageRPC()
+	txnProcessor.Init(testRPC)                          // configured in seconds for real world
+	txnProcessor.maxTXWaitTime = 250 * time.Millisecond // ... but fail asap for this test
+
+	txnProcessor.OnMessage(testTxnContext)
+	for inMap := false; !inMap; _, inMap = txnProcessor.inflightTxns[strings.ToLower(testFromAddr)] {
+		time.Sleep(1 * time.Millisecond)
+	}
+	txnWG := &txnProcessor.inflightTxns[strings.ToLower(testFromAddr)].txnsInFlight[0].wg
+
+	txnWG.Wait()
+	assert.Equal(0, len(testTxnContext.errorReplies))
+
+	replyMsg := testTxnContext.replies[0]
+	assert.Equal("TransactionSuccess", replyMsg.ReplyHeaders().MsgType)
+	replyMsgBytes, _ := json.Marshal(&replyMsg)
+	var replyMsgMap map[string]interface{}
+	json.Unmarshal(replyMsgBytes, &replyMsgMap)
+
+	// The address the factory created the contract at replaces the one in the receipt
+	assert.Equal("0x4d1a2e2bb4f88f0250f26ffff098b0b30b26bf38", replyMsgMap["contractAddress"])
+}
+
 func TestOnDeployContractMessageGoodTxnMinedHDWallet(t *testing.T) {
 	assert := assert.New(t)
 
@@ -710,6 +773,126 @@ func TestOnSendTransactionMessageTxnTimeout(t *testing.T) {
 
 }
 
+type testEventABIResolver struct {
+	lookups []string
+}
+
+func (r *testEventABIResolver) ResolveEventABIs(addr *ethbinding.Address) []*ethbinding.ABIEvent {
+	r.lookups = append(r.lookups, addr.String())
+	return nil
+}
+
+func TestOnSendTransactionMessageDecodedEvents(t *testing.T) {
+	assert := assert.New(t)
+
+	txnProcessor := NewTxnProcessor(&TxnProcessorConf{
+		MaxTXWaitTime: 1,
+	}, &eth.RPCConf{}).(*txnProcessor)
+	resolver := &testEventABIResolver{}
+	txnProcessor.SetEventABIResolver(resolver)
+	testTxnContext := &testTxnContext{}
+	testTxnContext.jsonMsg = "{" +
+		"  \"headers\":{\"type\": \"SendTransaction\"}," +
+		"  \"from\":\"" + testFromAddr + "\"," +
+		"  \"gas\":\"123\"," +
+		"  \"method\":{\"name\":\"test\"}," +
+		"  \"events\":[{\"type\":\"event\",\"name\":\"Changed\",\"inputs\":[{\"name\":\"value\",\"type\":\"uint256\",\"indexed\":true}]}]" +
+		"}"
+
+	testRPC := goodMessageRPC()
+	changedTopic := ethbind.API.HexToHash(ethbind.API.HexEncode(ethbind.Keccak256([]byte("Changed(uint256)"))))
+	otherTopic := ethbind.API.HexToHash("0x0000000000000000000000000000000000000000000000000000000000000001")
+	valueTopic := ethbind.API.HexToHash("0x000000000000000000000000000000000000000000000000000000000000000c")
+	logAddr := ethbind.API.HexToAddress("0xD7FAC2bCe408Ed7C6ded07a32038b1F79C2b27d3")
+	testRPC.ethGetTransactionReceiptResult.Logs = []*eth.TxnLog{
+		{Address: &logAddr, Topics: []*ethbinding.Hash{&changedTopic, &valueTopic}, Data: "0x"},
+		{Address: &logAddr, Topics: []*ethbinding.Hash{&otherTopic}, Data: "0x"},
+	}
+	txnProcessor.Init(testRPC)
+
+	txnProcessor.OnMessage(testTxnContext)
+	for inMap := false; !inMap; _, inMap = txnProcessor.inflightTxns[strings.ToLower(testFromAddr)] {
+		time.Sleep(1 * time.Millisecond)
+	}
+	txnWG := &txnProcessor.inflightTxns[strings.ToLower(testFromAddr)].txnsInFlight[0].wg
+	txnWG.Wait()
+	assert.Equal(0, len(testTxnContext.errorReplies))
+
+	receipt := testTxnContext.replies[0].IsReceipt()
+	assert.Len(receipt.DecodedEvents, 1)
+	assert.Equal("Changed", receipt.DecodedEvents[0].Event)
+	assert.Equal("Changed(uint256)", receipt.DecodedEvents[0].Signature)
+	assert.Equal("0xD7FAC2bCe408Ed7C6ded07a32038b1F79C2b27d3", receipt.DecodedEvents[0].Address)
+	assert.Equal("12", receipt.DecodedEvents[0].Data["value"])
+	assert.Equal([]string{"0xD7FAC2bCe408Ed7C6ded07a32038b1F79C2b27d3"}, resolver.lookups)
+}
+
+func TestOnSendTransactionMessageRevertReason(t *testing.T) {
+	assert := assert.New(t)
+
+	txnProcessor := NewTxnProcessor(&TxnProcessorConf{
+		MaxTXWaitTime: 1,
+	}, &eth.RPCConf{}).(*txnProcessor)
+	testTxnContext := &testTxnContext{}
+	testTxnContext.jsonMsg = "{" +
+		"  \"headers\":{\"type\": \"SendTransaction\"}," +
+		"  \"from\":\"" + testFromAddr + "\"," +
+		"  \"gas\":\"123\"," +
+		"  \"method\":{\"name\":\"test\"}," +
+		"  \"errors\":[{\"type\":\"error\",\"name\":\"Unauthorized\",\"inputs\":[]}]" +
+		"}"
+
+	testRPC := goodMessageRPC()
+	failStatus := ethbinding.HexBigInt(*big.NewInt(0))
+	testRPC.ethGetTransactionReceiptResult.Status = &failStatus
+	testRPC.ethCallResult = ethbind.API.HexEncode(ethbind.Keccak256([]byte("Unauthorized()"))[0:4])
+	txnProcessor.Init(testRPC)
+
+	txnProcessor.OnMessage(testTxnContext)
+	for inMap := false; !inMap; _, inMap = txnProcessor.inflightTxns[strings.ToLower(testFromAddr)] {
+		time.Sleep(1 * time.Millisecond)
+	}
+	txnWG := &txnProcessor.inflightTxns[strings.ToLower(testFromAddr)].txnsInFlight[0].wg
+	txnWG.Wait()
+	assert.Equal(0, len(testTxnContext.errorReplies))
+
+	receipt := testTxnContext.replies[0].IsReceipt()
+	assert.Equal(messages.MsgTypeTransactionFailure, receipt.Headers.MsgType)
+	assert.Equal("Unauthorized()", receipt.RevertReason)
+	assert.Equal("eth_call", testRPC.calls[len(testRPC.calls)-1])
+}
+
+type testSubmittedTxnContext struct {
+	testTxnContext
+	submittedTxHash string
+}
+
+func (c *testSubmittedTxnContext) TxnSubmitted(txHash string) {
+	c.submittedTxHash = txHash
+}
+
+func TestOnSendTransactionMessageNotifiesSubmitted(t *testing.T) {
+	assert := assert.New(t)
+
+	txnProcessor := NewTxnProcessor(&TxnProcessorConf{
+		MaxTXWaitTime: 1,
+	}, &eth.RPCConf{}).(*txnProcessor)
+	testTxnContext := &testSubmittedTxnContext{}
+	testTxnContext.jsonMsg = goodSendTxnJSON
+
+	testRPC := goodMessageRPC()
+	txnProcessor.Init(testRPC)
+
+	txnProcessor.OnMessage(testTxnContext)
+	for inMap := false; !inMap; _, inMap = txnProcessor.inflightTxns[strings.ToLower(testFromAddr)] {
+		time.Sleep(1 * time.Millisecond)
+	}
+	txnWG := &txnProcessor.inflightTxns[strings.ToLower(testFromAddr)].txnsInFlight[0].wg
+	txnWG.Wait()
+	assert.Equal(0, len(testTxnContext.errorReplies))
+	assert.Equal("0xe2215336b09f9b5b82e36e1144ed64f40a42e61b68fdaca82549fd98b8531a89", testTxnContext.submittedTxHash)
+}
+
 func TestOnSendTransactionMessageFailedTxn(t *testing.T) {
 	assert := assert.New(t)
 
@@ -1256,7 +1439,7 @@ func TestResolveAddressNonHDWallet(t *testing.T) {
 	testRPC := goodMessageRPC()
 	txnProcessor.Init(testRPC)
 
-	from, err := txnProcessor.ResolveAddress(testFromAddr)
+	from, err := txnProcessor.ResolveAddress(context.Background(), testFromAddr)
 	assert.NoError(err)
 	assert.Equal(testFromAddr, from)
 }
@@ -1285,7 +1468,7 @@ func TestResolveAddressHDWalletSuccess(t *testing.T) {
 	testRPC := goodMessageRPC()
 	txnProcessor.Init(testRPC)
 
-	from, err := txnProcessor.ResolveAddress("hd-testinst-testwallet-1234")
+	from, err := txnProcessor.ResolveAddress(context.Background(), "hd-testinst-testwallet-1234")
 	assert.NoError(err)
 	assert.Equal(addr.String(), from)
 }
@@ -1297,6 +1480,6 @@ func TestResolveAddressHDWalletFail(t *testing.T) {
 		MaxTXWaitTime: 1,
 	}, &eth.RPCConf{}).(*txnProcessor)
 
-	_, err := txnProcessor.ResolveAddress("hd-testinst-testwallet-1234")
+	_, err := txnProcessor.ResolveAddress(context.Background(), "hd-testinst-testwallet-1234")
 	assert.EqualError(err, "No HD Wallet Configuration")
 }
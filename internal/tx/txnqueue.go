@@ -0,0 +1,321 @@
+// Copyright 2021 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tx
+
+import (
+	"context"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/kaleido-io/ethconnect/internal/errors"
+	"github.com/kaleido-io/ethconnect/internal/eth"
+	"github.com/kaleido-io/ethconnect/internal/ethbind"
+	"github.com/kaleido-io/ethconnect/internal/utils"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// QueuedTxnStatusSending is a transaction that has been assigned a nonce, but is not yet accepted by the node
+	QueuedTxnStatusSending = "sending"
+	// QueuedTxnStatusPending is a transaction accepted by the node, that is waiting to be mined
+	QueuedTxnStatusPending = "pending"
+	// QueuedTxnStatusCancelling is a transaction that has been replaced by a cancellation, which is waiting to be mined
+	QueuedTxnStatusCancelling = "cancelling"
+	// defaultGasPriceBumpPercent is the minimum increase most nodes require to replace a pending transaction
+	defaultGasPriceBumpPercent = 10
+)
+
+// QueuedTxn is a transaction in-flight for a signing address, returned on /identities/:address/queue
+type QueuedTxn struct {
+	ID        string  `json:"id"`
+	RequestID string  `json:"requestId,omitempty"`
+	Nonce     string  `json:"nonce,omitempty"`
+	Hash      string  `json:"hash,omitempty"`
+	GasPrice  string  `json:"gasPrice,omitempty"`
+	AgeSec    float64 `json:"ageSec"`
+	Status    string  `json:"status"`
+	Bumps     int     `json:"bumps,omitempty"`
+	// Replaced are the hashes of earlier transactions sent for the request, that were replaced by this one
+	Replaced []string `json:"replaced,omitempty"`
+	// MaxFeePerGas and MaxPriorityFeePerGas are set in place of the gas price for EIP-1559 transactions
+	MaxFeePerGas         string `json:"maxFeePerGas,omitempty"`
+	MaxPriorityFeePerGas string `json:"maxPriorityFeePerGas,omitempty"`
+}
+
+// queuedTxn must be called holding the inflight lock
+func (i *inflightTxn) queuedTxn() *QueuedTxn {
+	q := &QueuedTxn{
+		ID:        strconv.Itoa(i.id),
+		RequestID: i.txnContext.Headers().ID,
+		AgeSec:    time.Now().UTC().Sub(i.added).Seconds(),
+		Status:    QueuedTxnStatusSending,
+		Bumps:     i.bumps,
+	}
+	if !i.nodeAssignNonce {
+		q.Nonce = strconv.FormatInt(i.nonce, 10)
+	}
+	if i.tx != nil {
+		q.Status = QueuedTxnStatusPending
+		if i.cancelled {
+			q.Status = QueuedTxnStatusCancelling
+		}
+		q.Hash = i.tx.Hash
+		for _, replaced := range i.replaced {
+			q.Replaced = append(q.Replaced, replaced.Hash)
+		}
+		if i.tx.MaxFeePerGas != nil {
+			q.MaxFeePerGas = i.tx.MaxFeePerGas.String()
+			q.MaxPriorityFeePerGas = i.tx.MaxPriorityFeePerGas.String()
+		} else {
+			q.GasPrice = i.tx.EthTX.GasPrice().String()
+		}
+	}
+	return q
+}
+
+// lookupInFlight must be called holding the inflight lock
+func (p *txnProcessor) lookupInFlight(from, id string) *inflightTxn {
+	if inflightForAddr, exists := p.inflightTxns[from]; exists {
+		for _, inflight := range inflightForAddr.txnsInFlight {
+			if strconv.Itoa(inflight.id) == id {
+				return inflight
+			}
+		}
+	}
+	return nil
+}
+
+func (p *txnProcessor) queueAddress(params httprouter.Params) (string, error) {
+	addr, err := utils.StrToAddress("address", params.ByName("address"))
+	if err != nil {
+		return "", err
+	}
+	return strings.ToLower(addr.Hex()), nil
+}
+
+// replacedGasPrice is the gas price a replacement transaction must exceed. For an EIP-1559
+// transaction this is the max fee
+func replacedGasPrice(tx *eth.Txn) *big.Int {
+	if tx.MaxFeePerGas != nil {
+		return tx.MaxFeePerGas
+	}
+	return tx.EthTX.GasPrice()
+}
+
+// bumpGasPrice raises a gas price by a percentage
+func bumpGasPrice(gasPrice *big.Int, percent int) *big.Int {
+	bumped := new(big.Int).Mul(gasPrice, big.NewInt(int64(100+percent)))
+	return bumped.Div(bumped, big.NewInt(100))
+}
+
+// bumpInFlight replaces a pending transaction with a copy at the same nonce, with a higher gas price.
+// For an EIP-1559 transaction the gas price is the new max fee, and the priority fee is also raised.
+// The receipt is then tracked for the replacement.
+func (p *txnProcessor) bumpInFlight(ctx context.Context, inflight *inflightTxn, gasPrice *big.Int) (*QueuedTxn, error) {
+	return p.replaceInFlight(ctx, inflight, gasPrice, defaultGasPriceBumpPercent, false)
+}
+
+// replaceInFlight sends a replacement for a pending transaction at the same nonce, which is either a
+// copy with a higher gas price, or a cancellation that transfers nothing to the sender. The replaced
+// transaction is remembered, as it can still be mined in place of the replacement.
+func (p *txnProcessor) replaceInFlight(ctx context.Context, inflight *inflightTxn, gasPrice *big.Int, bumpPercent int, cancel bool) (*QueuedTxn, error) {
+	p.inflightTxnsLock.Lock()
+	tx := inflight.tx
+	p.inflightTxnsLock.Unlock()
+	if tx == nil {
+		return nil, errors.Errorf(errors.TransactionQueueNotSubmitted, inflight.id)
+	}
+	if inflight.nodeAssignNonce {
+		return nil, errors.Errorf(errors.TransactionQueueNodeAssignedNonce, inflight.id)
+	}
+	if tx.PrivacyGroupID != "" || len(tx.PrivateFor) > 0 {
+		return nil, errors.Errorf(errors.TransactionQueuePrivate, inflight.id)
+	}
+
+	oldGasPrice := replacedGasPrice(tx)
+	if gasPrice == nil {
+		gasPrice = bumpGasPrice(oldGasPrice, bumpPercent)
+	}
+	if gasPrice.Cmp(oldGasPrice) <= 0 {
+		return nil, errors.Errorf(errors.TransactionQueueBumpGasPrice, oldGasPrice.String())
+	}
+
+	replacement := *tx
+	replacement.Hash = ""
+	replacement.Receipt = eth.TxnReceipt{}
+	if tx.MaxFeePerGas != nil {
+		replacement.MaxFeePerGas = gasPrice
+		replacement.MaxPriorityFeePerGas = bumpGasPrice(tx.MaxPriorityFeePerGas, bumpPercent)
+		if replacement.MaxPriorityFeePerGas.Cmp(gasPrice) > 0 {
+			replacement.MaxPriorityFeePerGas = new(big.Int).Set(gasPrice)
+		}
+	}
+	legacyGasPrice := gasPrice
+	if tx.MaxFeePerGas != nil {
+		legacyGasPrice = tx.EthTX.GasPrice()
+	}
+	if cancel {
+		replacement.MethodName = ""
+		replacement.Events = nil
+		replacement.EthTX = ethbind.API.NewTransaction(tx.EthTX.Nonce(), tx.From, big.NewInt(0), cancelTxnGas, legacyGasPrice, []byte{})
+	} else if to := tx.EthTX.To(); to != nil {
+		replacement.EthTX = ethbind.API.NewTransaction(tx.EthTX.Nonce(), *to, tx.EthTX.Value(), tx.EthTX.Gas(), legacyGasPrice, tx.EthTX.Data())
+	} else {
+		replacement.EthTX = ethbind.API.NewContractCreation(tx.EthTX.Nonce(), tx.EthTX.Value(), tx.EthTX.Gas(), legacyGasPrice, tx.EthTX.Data())
+	}
+	if err := replacement.Send(ctx, inflight.rpc); err != nil {
+		return nil, err
+	}
+	log.Infof("In-flight %d replaced. nonce=%d addr=%s gasPrice=%s hash=%s replaced=%s cancel=%t", inflight.id, inflight.nonce, inflight.from, gasPrice, replacement.Hash, tx.Hash, cancel)
+
+	p.inflightTxnsLock.Lock()
+	defer p.inflightTxnsLock.Unlock()
+	inflight.replaced = append(inflight.replaced, tx)
+	inflight.tx = &replacement
+	inflight.sent = time.Now().UTC()
+	if cancel {
+		inflight.cancelled = true
+	} else {
+		inflight.bumps++
+	}
+	return inflight.queuedTxn(), nil
+}
+
+// replacedHashes returns the hashes of the transactions sent for a request, other than the one
+// that was mined. Must be called holding the inflight lock
+func (i *inflightTxn) replacedHashes(mined *eth.Txn) []string {
+	var hashes []string
+	for _, tx := range append(i.replaced, i.tx) {
+		if tx != mined {
+			hashes = append(hashes, tx.Hash)
+		}
+	}
+	return hashes
+}
+
+func (p *txnProcessor) queueHandler(res http.ResponseWriter, req *http.Request, params httprouter.Params) {
+	log.Infof("--> %s %s", req.Method, req.URL)
+
+	from, err := p.queueAddress(params)
+	if err != nil {
+		queueErrReply(res, req, err, 400)
+		return
+	}
+	queue := []*QueuedTxn{}
+	p.inflightTxnsLock.Lock()
+	if inflightForAddr, exists := p.inflightTxns[from]; exists {
+		for _, inflight := range inflightForAddr.txnsInFlight {
+			queue = append(queue, inflight.queuedTxn())
+		}
+	}
+	p.inflightTxnsLock.Unlock()
+	sort.Slice(queue, func(i, j int) bool {
+		ni, _ := strconv.ParseInt(queue[i].Nonce, 10, 64)
+		nj, _ := strconv.ParseInt(queue[j].Nonce, 10, 64)
+		return ni < nj
+	})
+	queueReply(res, req, 200, queue)
+}
+
+func (p *txnProcessor) bumpHandler(res http.ResponseWriter, req *http.Request, params httprouter.Params) {
+	log.Infof("--> %s %s", req.Method, req.URL)
+
+	from, err := p.queueAddress(params)
+	if err != nil {
+		queueErrReply(res, req, err, 400)
+		return
+	}
+	var body struct {
+		GasPrice json.Number `json:"gasPrice"`
+	}
+	var gasPrice *big.Int
+	if req.ContentLength != 0 {
+		if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+			queueErrReply(res, req, errors.Errorf(errors.TransactionQueueInvalidRequest, err), 400)
+			return
+		}
+	}
+	if body.GasPrice != "" {
+		var ok bool
+		if gasPrice, ok = new(big.Int).SetString(body.GasPrice.String(), 0); !ok {
+			queueErrReply(res, req, errors.Errorf(errors.TransactionQueueBadGasPrice, body.GasPrice), 400)
+			return
+		}
+	}
+
+	p.inflightTxnsLock.Lock()
+	inflight := p.lookupInFlight(from, params.ByName("id"))
+	p.inflightTxnsLock.Unlock()
+	if inflight == nil {
+		queueErrReply(res, req, errors.Errorf(errors.TransactionQueueNotFound, params.ByName("id"), from), 404)
+		return
+	}
+	queued, err := p.bumpInFlight(req.Context(), inflight, gasPrice)
+	if err != nil {
+		queueErrReply(res, req, err, 409)
+		return
+	}
+	queueReply(res, req, 200, queued)
+}
+
+func (p *txnProcessor) dropHandler(res http.ResponseWriter, req *http.Request, params httprouter.Params) {
+	log.Infof("--> %s %s", req.Method, req.URL)
+
+	from, err := p.queueAddress(params)
+	if err != nil {
+		queueErrReply(res, req, err, 400)
+		return
+	}
+	p.inflightTxnsLock.Lock()
+	inflight := p.lookupInFlight(from, params.ByName("id"))
+	if inflight != nil {
+		inflight.dropped = true
+	}
+	p.inflightTxnsLock.Unlock()
+	if inflight == nil {
+		queueErrReply(res, req, errors.Errorf(errors.TransactionQueueNotFound, params.ByName("id"), from), 404)
+		return
+	}
+	// The nonce has been used (or is about to be) so no gap-fill is attempted. The goroutine
+	// waiting for the receipt stops on its next poll, and replies to the requester with an error.
+	p.cancelInFlight(inflight, true)
+
+	status := 204
+	log.Infof("<-- %s %s [%d]", req.Method, req.URL, status)
+	res.Header().Set("Content-Type", "application/json")
+	res.WriteHeader(status)
+}
+
+func queueReply(res http.ResponseWriter, req *http.Request, status int, body interface{}) {
+	log.Infof("<-- %s %s [%d]", req.Method, req.URL, status)
+	res.Header().Set("Content-Type", "application/json")
+	res.WriteHeader(status)
+	enc := json.NewEncoder(res)
+	enc.SetIndent("", "  ")
+	enc.Encode(body)
+}
+
+func queueErrReply(res http.ResponseWriter, req *http.Request, err error, status int) {
+	log.Errorf("<-- %s %s [%d]: %s", req.Method, req.URL, status, err)
+	res.Header().Set("Content-Type", "application/json")
+	res.WriteHeader(status)
+	json.NewEncoder(res).Encode(&errMsg{Message: err.Error()})
+}
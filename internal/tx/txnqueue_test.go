@@ -0,0 +1,303 @@
+// Copyright 2021 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tx
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/kaleido-io/ethconnect/internal/eth"
+	"github.com/kaleido-io/ethconnect/internal/ethbind"
+	"github.com/stretchr/testify/assert"
+)
+
+const testQueueTxHash = "0xac18e98664e160305cdb77e75e5eae32e55447e94ad8ceb0123729589ed09f8b"
+
+func newTestQueueProcessor(rpc *testRPC) (*txnProcessor, *httprouter.Router) {
+	p := NewTxnProcessor(&TxnProcessorConf{}, &eth.RPCConf{}).(*txnProcessor)
+	p.Init(rpc)
+	router := &httprouter.Router{}
+	p.AddRoutes(router)
+	return p, router
+}
+
+func addTestQueuedTxn(p *txnProcessor, rpc *testRPC, id int, nonce int64, submitted bool) *inflightTxn {
+	from := strings.ToLower(testFromAddr)
+	inflight := &inflightTxn{
+		id:         id,
+		from:       from,
+		nonce:      nonce,
+		txnContext: &testTxnContext{jsonMsg: goodSendTxnJSON},
+		added:      time.Now().UTC().Add(-5 * time.Second),
+		rpc:        rpc,
+	}
+	if submitted {
+		to := ethbind.API.HexToAddress("0x2b8c0ECc76d0759a8F50b2E14A6881367D805832")
+		inflight.tx = &eth.Txn{
+			From:  ethbind.API.HexToAddress(testFromAddr),
+			EthTX: ethbind.API.NewTransaction(uint64(nonce), to, big.NewInt(0), 21000, big.NewInt(1000), []byte{}),
+			Hash:  testQueueTxHash,
+		}
+	}
+	inflightForAddr, exists := p.inflightTxns[from]
+	if !exists {
+		inflightForAddr = &inflightTxnState{}
+		p.inflightTxns[from] = inflightForAddr
+	}
+	inflightForAddr.txnsInFlight = append(inflightForAddr.txnsInFlight, inflight)
+	return inflight
+}
+
+func testQueueRequest(router *httprouter.Router, method, path, body string) (int, string) {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	res := httptest.NewRecorder()
+	router.ServeHTTP(res, req)
+	return res.Code, res.Body.String()
+}
+
+func TestQueueListEmpty(t *testing.T) {
+	assert := assert.New(t)
+	_, router := newTestQueueProcessor(&testRPC{})
+
+	status, body := testQueueRequest(router, "GET", "/identities/"+testFromAddr+"/queue", "")
+	assert.Equal(200, status)
+	var queue []*QueuedTxn
+	assert.NoError(json.Unmarshal([]byte(body), &queue))
+	assert.Empty(queue)
+}
+
+func TestQueueListInFlight(t *testing.T) {
+	assert := assert.New(t)
+	rpc := &testRPC{}
+	p, router := newTestQueueProcessor(rpc)
+	addTestQueuedTxn(p, rpc, 2, 11, false)
+	addTestQueuedTxn(p, rpc, 1, 10, true)
+
+	status, body := testQueueRequest(router, "GET", "/identities/"+testFromAddr+"/queue", "")
+	assert.Equal(200, status)
+	var queue []*QueuedTxn
+	assert.NoError(json.Unmarshal([]byte(body), &queue))
+	assert.Equal(2, len(queue))
+
+	assert.Equal("1", queue[0].ID)
+	assert.Equal("10", queue[0].Nonce)
+	assert.Equal(QueuedTxnStatusPending, queue[0].Status)
+	assert.Equal(testQueueTxHash, queue[0].Hash)
+	assert.Equal("1000", queue[0].GasPrice)
+	assert.True(queue[0].AgeSec >= 5)
+
+	assert.Equal("2", queue[1].ID)
+	assert.Equal("11", queue[1].Nonce)
+	assert.Equal(QueuedTxnStatusSending, queue[1].Status)
+	assert.Empty(queue[1].Hash)
+}
+
+func TestQueueBadAddress(t *testing.T) {
+	assert := assert.New(t)
+	_, router := newTestQueueProcessor(&testRPC{})
+
+	status, body := testQueueRequest(router, "GET", "/identities/badness/queue", "")
+	assert.Equal(400, status)
+	assert.Regexp("address", body)
+
+	status, _ = testQueueRequest(router, "POST", "/identities/badness/queue/1/bump", "")
+	assert.Equal(400, status)
+
+	status, _ = testQueueRequest(router, "DELETE", "/identities/badness/queue/1", "")
+	assert.Equal(400, status)
+}
+
+func TestQueueBumpDefaultGasPrice(t *testing.T) {
+	assert := assert.New(t)
+	newHash := "0xf2e1d49cbe8d1e6a0e08c2d9a1a5e0a0d43a1c2b34e1f7b3a9e5a0c7f8e9d0a1"
+	rpc := &testRPC{ethSendTransactionResult: newHash}
+	p, router := newTestQueueProcessor(rpc)
+	inflight := addTestQueuedTxn(p, rpc, 1, 10, true)
+
+	status, body := testQueueRequest(router, "POST", "/identities/"+testFromAddr+"/queue/1/bump", "")
+	assert.Equal(200, status)
+	var queued QueuedTxn
+	assert.NoError(json.Unmarshal([]byte(body), &queued))
+	assert.Equal(newHash, queued.Hash)
+	assert.Equal("1100", queued.GasPrice)
+	assert.Equal(1, queued.Bumps)
+
+	assert.Equal([]string{"eth_sendTransaction"}, rpc.calls)
+	sendTX := rpc.params[0][0].(*eth.SendTXArgs)
+	assert.Equal(uint64(10), uint64(*sendTX.Nonce))
+	assert.Equal(int64(1100), sendTX.GasPrice.ToInt().Int64())
+	assert.Equal(newHash, inflight.tx.Hash)
+	assert.Equal(testQueueTxHash, inflight.replaced[0].Hash)
+	assert.Equal([]string{testQueueTxHash}, queued.Replaced)
+}
+
+func TestQueueBumpDynamicFees(t *testing.T) {
+	assert := assert.New(t)
+	rpc := &testRPC{ethSendTransactionResult: testQueueTxHash}
+	p, router := newTestQueueProcessor(rpc)
+	inflight := addTestQueuedTxn(p, rpc, 1, 10, true)
+	inflight.tx.MaxFeePerGas = big.NewInt(2000)
+	inflight.tx.MaxPriorityFeePerGas = big.NewInt(100)
+
+	status, body := testQueueRequest(router, "GET", "/identities/"+testFromAddr+"/queue", "")
+	assert.Equal(200, status)
+	var queue []*QueuedTxn
+	assert.NoError(json.Unmarshal([]byte(body), &queue))
+	assert.Empty(queue[0].GasPrice)
+	assert.Equal("2000", queue[0].MaxFeePerGas)
+	assert.Equal("100", queue[0].MaxPriorityFeePerGas)
+
+	status, body = testQueueRequest(router, "POST", "/identities/"+testFromAddr+"/queue/1/bump", "")
+	assert.Equal(200, status)
+	var queued QueuedTxn
+	assert.NoError(json.Unmarshal([]byte(body), &queued))
+	assert.Equal("2200", queued.MaxFeePerGas)
+	assert.Equal("110", queued.MaxPriorityFeePerGas)
+
+	sendTX := rpc.params[0][0].(*eth.SendTXArgs)
+	assert.Nil(sendTX.GasPrice)
+	assert.Equal(int64(2200), sendTX.MaxFeePerGas.ToInt().Int64())
+	assert.Equal(int64(110), sendTX.MaxPriorityFeePerGas.ToInt().Int64())
+
+	status, body = testQueueRequest(router, "POST", "/identities/"+testFromAddr+"/queue/1/bump", `{"gasPrice":"2201"}`)
+	assert.Equal(200, status)
+	assert.NoError(json.Unmarshal([]byte(body), &queued))
+	assert.Equal("2201", queued.MaxFeePerGas)
+	assert.Equal("121", queued.MaxPriorityFeePerGas)
+}
+
+func TestQueueBumpExplicitGasPrice(t *testing.T) {
+	assert := assert.New(t)
+	rpc := &testRPC{ethSendTransactionResult: testQueueTxHash}
+	p, router := newTestQueueProcessor(rpc)
+	addTestQueuedTxn(p, rpc, 1, 10, true)
+
+	status, body := testQueueRequest(router, "POST", "/identities/"+testFromAddr+"/queue/1/bump", `{"gasPrice":"5000"}`)
+	assert.Equal(200, status)
+	var queued QueuedTxn
+	assert.NoError(json.Unmarshal([]byte(body), &queued))
+	assert.Equal("5000", queued.GasPrice)
+
+	status, body = testQueueRequest(router, "POST", "/identities/"+testFromAddr+"/queue/1/bump", `{"gasPrice":5000}`)
+	assert.Equal(409, status)
+	assert.Regexp("Gas price of the replacement transaction must be higher than 5000", body)
+}
+
+func TestQueueBumpBadRequests(t *testing.T) {
+	assert := assert.New(t)
+	rpc := &testRPC{}
+	p, router := newTestQueueProcessor(rpc)
+	addTestQueuedTxn(p, rpc, 1, 10, true)
+	addTestQueuedTxn(p, rpc, 2, 11, false)
+
+	status, body := testQueueRequest(router, "POST", "/identities/"+testFromAddr+"/queue/1/bump", `{!json`)
+	assert.Equal(400, status)
+	assert.Regexp("Invalid transaction queue request", body)
+
+	status, body = testQueueRequest(router, "POST", "/identities/"+testFromAddr+"/queue/1/bump", `{"gasPrice":"1.5"}`)
+	assert.Equal(400, status)
+	assert.Regexp("Invalid gas price '1.5'", body)
+
+	status, body = testQueueRequest(router, "POST", "/identities/"+testFromAddr+"/queue/99/bump", "")
+	assert.Equal(404, status)
+	assert.Regexp("No transaction with ID '99' is in-flight", body)
+
+	status, body = testQueueRequest(router, "POST", "/identities/"+testFromAddr+"/queue/2/bump", "")
+	assert.Equal(409, status)
+	assert.Regexp("Transaction 2 has not yet been submitted to the node", body)
+
+	status, body = testQueueRequest(router, "POST", "/identities/"+testFromAddr+"/queue/1/bump", `{"gasPrice":"999"}`)
+	assert.Equal(409, status)
+	assert.Regexp("must be higher than 1000", body)
+	assert.Empty(rpc.calls)
+}
+
+func TestQueueBumpNotReplaceable(t *testing.T) {
+	assert := assert.New(t)
+	rpc := &testRPC{}
+	p, router := newTestQueueProcessor(rpc)
+	nan := addTestQueuedTxn(p, rpc, 1, 0, true)
+	nan.nodeAssignNonce = true
+	private := addTestQueuedTxn(p, rpc, 2, 11, true)
+	private.tx.PrivateFor = []string{testEnclaveKey1}
+
+	status, body := testQueueRequest(router, "POST", "/identities/"+testFromAddr+"/queue/1/bump", "")
+	assert.Equal(409, status)
+	assert.Regexp("Transaction 1 was assigned a nonce by the node", body)
+
+	status, body = testQueueRequest(router, "POST", "/identities/"+testFromAddr+"/queue/2/bump", "")
+	assert.Equal(409, status)
+	assert.Regexp("Transaction 2 is a private transaction", body)
+}
+
+func TestQueueBumpSendFail(t *testing.T) {
+	assert := assert.New(t)
+	rpc := &testRPC{ethSendTransactionErr: fmt.Errorf("replacement transaction underpriced")}
+	p, router := newTestQueueProcessor(rpc)
+	inflight := addTestQueuedTxn(p, rpc, 1, 10, true)
+
+	status, body := testQueueRequest(router, "POST", "/identities/"+testFromAddr+"/queue/1/bump", "")
+	assert.Equal(409, status)
+	assert.Regexp("replacement transaction underpriced", body)
+	assert.Equal(0, inflight.bumps)
+	assert.Equal(testQueueTxHash, inflight.tx.Hash)
+}
+
+func TestQueueDrop(t *testing.T) {
+	assert := assert.New(t)
+	rpc := &testRPC{}
+	p, router := newTestQueueProcessor(rpc)
+	inflight := addTestQueuedTxn(p, rpc, 1, 10, true)
+	addTestQueuedTxn(p, rpc, 2, 11, true)
+
+	status, _ := testQueueRequest(router, "DELETE", "/identities/"+testFromAddr+"/queue/1", "")
+	assert.Equal(204, status)
+	assert.True(inflight.dropped)
+
+	status, body := testQueueRequest(router, "GET", "/identities/"+testFromAddr+"/queue", "")
+	assert.Equal(200, status)
+	var queue []*QueuedTxn
+	assert.NoError(json.Unmarshal([]byte(body), &queue))
+	assert.Equal(1, len(queue))
+	assert.Equal("2", queue[0].ID)
+
+	status, body = testQueueRequest(router, "DELETE", "/identities/"+testFromAddr+"/queue/1", "")
+	assert.Equal(404, status)
+	assert.Regexp("No transaction with ID '1' is in-flight", body)
+}
+
+func TestWaitForCompletionDropped(t *testing.T) {
+	assert := assert.New(t)
+	rpc := &testRPC{}
+	p, _ := newTestQueueProcessor(rpc)
+	inflight := addTestQueuedTxn(p, rpc, 1, 10, true)
+	inflight.dropped = true
+
+	inflight.wg.Add(1)
+	p.waitForCompletion(inflight, 0)
+
+	txnContext := inflight.txnContext.(*testTxnContext)
+	assert.Equal(1, len(txnContext.errorReplies))
+	assert.Equal(410, txnContext.errorReplies[0].status)
+	assert.Regexp("dropped from the queue", txnContext.errorReplies[0].err.Error())
+	assert.Equal(testQueueTxHash, txnContext.errorReplies[0].txHash)
+	assert.Empty(rpc.calls)
+}
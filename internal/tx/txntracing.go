@@ -0,0 +1,81 @@
+// Copyright 2021 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tx
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/kaleido-io/ethconnect/internal/messages"
+	"github.com/kaleido-io/ethconnect/internal/tracing"
+)
+
+// traceTxn returns a context with a span that lasts from the message being accepted by
+// the processor until the reply is sent, which for a transaction is when it is mined.
+// The calls to the node made with the context of the message are child spans
+func traceTxn(txnContext TxnContext) TxnContext {
+	if !tracing.Enabled() {
+		return txnContext
+	}
+	headers := txnContext.Headers()
+	ctx, span := tracing.Start(txnContext.Context(), headers.MsgType, tracing.SpanKindInternal)
+	span.SetAttribute("ethconnect.request_id", headers.ID)
+	span.SetAttribute("ethconnect.msg_type", headers.MsgType)
+	return &tracedTxnContext{TxnContext: txnContext, ctx: ctx, span: span}
+}
+
+type tracedTxnContext struct {
+	TxnContext
+	ctx  context.Context
+	span *tracing.Span
+}
+
+func (t *tracedTxnContext) Context() context.Context {
+	return t.ctx
+}
+
+func (t *tracedTxnContext) SendErrorReply(status int, err error) {
+	t.TxnContext.SendErrorReply(status, err)
+	t.span.End(err)
+}
+
+func (t *tracedTxnContext) SendErrorReplyWithTX(status int, err error, txHash string) {
+	t.span.SetAttribute("eth.tx_hash", txHash)
+	t.TxnContext.SendErrorReplyWithTX(status, err, txHash)
+	t.span.End(err)
+}
+
+func (t *tracedTxnContext) SendErrorReplyWithGapFill(status int, err error, gapFillTxHash string, gapFillSucceeded bool) {
+	t.TxnContext.SendErrorReplyWithGapFill(status, err, gapFillTxHash, gapFillSucceeded)
+	t.span.End(err)
+}
+
+func (t *tracedTxnContext) Reply(replyMsg messages.ReplyWithHeaders) {
+	replyType := replyMsg.ReplyHeaders().MsgType
+	t.span.SetAttribute("ethconnect.reply_type", replyType)
+	t.TxnContext.Reply(replyMsg)
+	var err error
+	if replyType == messages.MsgTypeTransactionFailure {
+		err = fmt.Errorf("transaction reverted")
+	}
+	t.span.End(err)
+}
+
+func (t *tracedTxnContext) TxnSubmitted(txHash string) {
+	t.span.SetAttribute("eth.tx_hash", txHash)
+	if listener, ok := t.TxnContext.(TxnSubmittedListener); ok {
+		listener.TxnSubmitted(txHash)
+	}
+}
@@ -0,0 +1,85 @@
+// Copyright 2021 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tx
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kaleido-io/ethconnect/internal/eth"
+	"github.com/kaleido-io/ethconnect/internal/messages"
+	"github.com/kaleido-io/ethconnect/internal/tracing"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTraceTxnDisabled(t *testing.T) {
+	assert := assert.New(t)
+	assert.NoError(tracing.Configure(nil))
+	txnContext := &testTxnContext{jsonMsg: goodSendTxnJSON}
+	assert.Equal(txnContext, traceTxn(txnContext))
+}
+
+func TestTraceTxnSpanEndsOnReply(t *testing.T) {
+	assert := assert.New(t)
+	assert.NoError(tracing.Configure(&tracing.Conf{Enabled: true, Endpoint: "http://localhost:4318/v1/traces"}))
+	defer tracing.Configure(nil)
+
+	txnContext := &testSubmittedTxnContext{}
+	txnContext.jsonMsg = goodSendTxnJSON
+	traced := traceTxn(txnContext).(*tracedTxnContext)
+	span := tracing.SpanFromContext(traced.Context())
+	assert.Equal(span, traced.span)
+
+	traced.TxnSubmitted("0x12345")
+	assert.Equal("0x12345", txnContext.submittedTxHash)
+	reply := &messages.TransactionReceipt{}
+	reply.Headers.MsgType = messages.MsgTypeTransactionFailure
+	traced.Reply(reply)
+	assert.Len(txnContext.replies, 1)
+
+	// Error replies after the span has ended are still passed on
+	traced.SendErrorReply(500, fmt.Errorf("pop"))
+	traced.SendErrorReplyWithTX(500, fmt.Errorf("pop"), "0x12345")
+	traced.SendErrorReplyWithGapFill(500, fmt.Errorf("pop"), "", false)
+	assert.Len(txnContext.errorReplies, 3)
+}
+
+func TestOnSendTransactionMessageTraced(t *testing.T) {
+	assert := assert.New(t)
+	assert.NoError(tracing.Configure(&tracing.Conf{Enabled: true, Endpoint: "http://localhost:4318/v1/traces"}))
+	defer tracing.Configure(nil)
+
+	txnProcessor := NewTxnProcessor(&TxnProcessorConf{
+		MaxTXWaitTime: 1,
+	}, &eth.RPCConf{}).(*txnProcessor)
+	testTxnContext := &testSubmittedTxnContext{}
+	testTxnContext.jsonMsg = goodSendTxnJSON
+
+	testRPC := goodMessageRPC()
+	txnProcessor.Init(testRPC)
+
+	txnProcessor.OnMessage(testTxnContext)
+	for inMap := false; !inMap; _, inMap = txnProcessor.inflightTxns[strings.ToLower(testFromAddr)] {
+		time.Sleep(1 * time.Millisecond)
+	}
+	inflight := txnProcessor.inflightTxns[strings.ToLower(testFromAddr)].txnsInFlight[0]
+	inflight.wg.Wait()
+	assert.NotNil(tracing.SpanFromContext(inflight.txnContext.Context()))
+	assert.Equal(0, len(testTxnContext.errorReplies))
+	assert.Equal(messages.MsgTypeTransactionSuccess, testTxnContext.replies[0].ReplyHeaders().MsgType)
+	assert.Equal("0xe2215336b09f9b5b82e36e1144ed64f40a42e61b68fdaca82549fd98b8531a89", testTxnContext.submittedTxHash)
+}
@@ -0,0 +1,143 @@
+// Copyright 2021 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tx
+
+import (
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"strings"
+
+	"github.com/kaleido-io/ethconnect/internal/errors"
+	"github.com/kaleido-io/ethconnect/internal/utils"
+)
+
+const defaultVaultMount = "transit"
+
+// VaultSignerConf configures signing with a HashiCorp Vault transit secrets engine, or a plugin
+// with the same API, that supports secp256k1 keys. The token is read from a file if tokenFile
+// is set, so it can be mounted as a secret
+type VaultSignerConf struct {
+	URL       string          `json:"url"`
+	Mount     string          `json:"mount,omitempty"`
+	Key       string          `json:"key"`
+	Token     string          `json:"token,omitempty"`
+	TokenFile string          `json:"tokenFile,omitempty"`
+	Namespace string          `json:"namespace,omitempty"`
+	TLS       utils.TLSConfig `json:"tls"`
+}
+
+type vaultClient struct {
+	conf *VaultSignerConf
+	hr   *utils.HTTPRequester
+}
+
+type vaultKey struct {
+	vault   *vaultClient
+	keyName string
+}
+
+func newVaultClient(conf *VaultSignerConf) (*vaultClient, error) {
+	if conf.Mount == "" {
+		conf.Mount = defaultVaultMount
+	}
+	token := conf.Token
+	if conf.TokenFile != "" {
+		b, err := ioutil.ReadFile(conf.TokenFile)
+		if err != nil {
+			return nil, errors.Errorf(errors.RemoteSignerTokenLoad, conf.TokenFile, err)
+		}
+		token = strings.TrimSpace(string(b))
+	}
+	headers := map[string][]string{"X-Vault-Token": {token}}
+	if conf.Namespace != "" {
+		headers["X-Vault-Namespace"] = []string{conf.Namespace}
+	}
+	hr := utils.NewHTTPRequester("Vault", &utils.HTTPRequesterConf{Headers: headers})
+	if err := hr.ConfigureAuth(&conf.TLS, nil); err != nil {
+		return nil, err
+	}
+	return &vaultClient{conf: conf, hr: hr}, nil
+}
+
+func (v *vaultClient) key(keyName string) *vaultKey {
+	return &vaultKey{vault: v, keyName: keyName}
+}
+
+func (v *vaultClient) url(op, keyName string) string {
+	return fmt.Sprintf("%s/v1/%s/%s/%s", strings.TrimSuffix(v.conf.URL, "/"), v.conf.Mount, op, url.PathEscape(keyName))
+}
+
+// do returns the data of a Vault response, which is not found for a 404
+func (v *vaultClient) do(method, url string, body map[string]interface{}) (map[string]interface{}, error) {
+	res, err := v.hr.DoRequest(method, url, body)
+	if err != nil {
+		return nil, err
+	}
+	if res == nil {
+		return nil, fmt.Errorf("not found")
+	}
+	data, ok := res["data"].(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("no data in response")
+	}
+	return data, nil
+}
+
+func (k *vaultKey) service() string {
+	return "Vault"
+}
+
+func (k *vaultKey) name() string {
+	return k.keyName
+}
+
+// publicKey reads the PEM public key of the latest version of the key
+func (k *vaultKey) publicKey() ([]byte, error) {
+	data, err := k.vault.do("GET", k.vault.url("keys", k.keyName), nil)
+	if err != nil {
+		return nil, err
+	}
+	latest, _ := data["latest_version"].(float64)
+	keys, _ := data["keys"].(map[string]interface{})
+	version, _ := keys[fmt.Sprintf("%d", int64(latest))].(map[string]interface{})
+	pemKey, _ := version["public_key"].(string)
+	block, _ := pem.Decode([]byte(pemKey))
+	if block == nil {
+		return nil, fmt.Errorf("no PEM public key for version %d", int64(latest))
+	}
+	return block.Bytes, nil
+}
+
+// signDigest signs with the latest version of the key. The signature is prefixed with the
+// version of the key, as in vault:v1:<base64>
+func (k *vaultKey) signDigest(digest []byte) ([]byte, error) {
+	data, err := k.vault.do("POST", k.vault.url("sign", k.keyName), map[string]interface{}{
+		"input":                base64.StdEncoding.EncodeToString(digest),
+		"prehashed":            true,
+		"marshaling_algorithm": "asn1",
+	})
+	if err != nil {
+		return nil, err
+	}
+	signature, _ := data["signature"].(string)
+	parts := strings.Split(signature, ":")
+	if len(parts) != 3 || parts[0] != "vault" {
+		return nil, fmt.Errorf("unexpected signature format '%s'", signature)
+	}
+	return base64.StdEncoding.DecodeString(parts[2])
+}
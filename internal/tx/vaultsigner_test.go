@@ -0,0 +1,166 @@
+// Copyright 2021 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tx
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/kaleido-io/ethconnect/internal/ethbind"
+	"github.com/stretchr/testify/assert"
+)
+
+type testVaultServer struct {
+	*httptest.Server
+	signature string
+	keys      map[string]interface{}
+}
+
+func newTestVaultServer(t *testing.T) *testVaultServer {
+	key := newTestRemoteKey("key1")
+	vs := &testVaultServer{
+		keys: map[string]interface{}{
+			"1": map[string]interface{}{
+				"public_key": string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: testSPKI(&key.key.PublicKey)})),
+			},
+		},
+	}
+	router := &httprouter.Router{}
+	router.GET("/v1/eth-transit/keys/:key", func(res http.ResponseWriter, req *http.Request, params httprouter.Params) {
+		assert.Equal(t, "token1", req.Header.Get("X-Vault-Token"))
+		assert.Equal(t, "ns1", req.Header.Get("X-Vault-Namespace"))
+		if params.ByName("key") != "eth-f39f" {
+			res.WriteHeader(404)
+			return
+		}
+		json.NewEncoder(res).Encode(map[string]interface{}{
+			"data": map[string]interface{}{
+				"name":           params.ByName("key"),
+				"type":           "ecdsa-secp256k1",
+				"latest_version": 1,
+				"keys":           vs.keys,
+			},
+		})
+	})
+	router.POST("/v1/eth-transit/sign/:key", func(res http.ResponseWriter, req *http.Request, params httprouter.Params) {
+		var body struct {
+			Input               string `json:"input"`
+			Prehashed           bool   `json:"prehashed"`
+			MarshalingAlgorithm string `json:"marshaling_algorithm"`
+		}
+		json.NewDecoder(req.Body).Decode(&body)
+		assert.True(t, body.Prehashed)
+		assert.Equal(t, "asn1", body.MarshalingAlgorithm)
+		digest, _ := base64.StdEncoding.DecodeString(body.Input)
+		signature := vs.signature
+		if signature == "" {
+			signature = "vault:v1:" + base64.StdEncoding.EncodeToString(testSignDigest(key.key, digest, false))
+		}
+		json.NewEncoder(res).Encode(map[string]interface{}{
+			"data": map[string]interface{}{
+				"signature": signature,
+			},
+		})
+	})
+	vs.Server = httptest.NewServer(router)
+	return vs
+}
+
+func newTestVaultSigners(t *testing.T, vs *testVaultServer, dir string) *remoteSigners {
+	tokenFile := path.Join(dir, "token")
+	ioutil.WriteFile(tokenFile, []byte("token1\n"), 0600)
+	rs := newRemoteSigners(&RemoteSignersConf{
+		ChainID: "1337",
+		Signers: []*RemoteSignerConf{{
+			From: "^0x(f39f|0000).*$",
+			Vault: &VaultSignerConf{
+				URL:       vs.URL + "/",
+				Mount:     "eth-transit",
+				Key:       "eth-$1",
+				TokenFile: tokenFile,
+				Namespace: "ns1",
+			},
+		}},
+	})
+	assert.NoError(t, rs.init())
+	return rs
+}
+
+func TestVaultSignerSign(t *testing.T) {
+	assert := assert.New(t)
+	dir, _ := ioutil.TempDir("", "vault")
+	defer os.RemoveAll(dir)
+	vs := newTestVaultServer(t)
+	defer vs.Close()
+	rs := newTestVaultSigners(t, vs, dir)
+
+	s, err := rs.signerFor(testKeystoreAddr0)
+	assert.NoError(err)
+	assert.Equal("Vault", s.Type())
+	tx := ethbind.API.NewTransaction(0, ethbind.API.HexToAddress(testAliasAddr), big.NewInt(0), 21000, big.NewInt(0), []byte{})
+	signed, err := s.Sign(tx)
+	assert.NoError(err)
+	assert.Equal(s.Address(), testRemoteSignedSender(t, s.(*remoteSigner), signed))
+
+	vs.signature = "v1:abcd"
+	_, err = s.Sign(tx)
+	assert.EqualError(err, "Failed to sign with Vault key 'eth-f39f': unexpected signature format 'v1:abcd'")
+}
+
+func TestVaultSignerErrors(t *testing.T) {
+	assert := assert.New(t)
+	dir, _ := ioutil.TempDir("", "vault")
+	defer os.RemoveAll(dir)
+	vs := newTestVaultServer(t)
+	defer vs.Close()
+	rs := newTestVaultSigners(t, vs, dir)
+
+	_, err := rs.signerFor("0x0000d6e51aad88f6f4ce6ab8827279cfffb92266")
+	assert.EqualError(err, "Failed to get the public key of Vault key 'eth-0000': not found")
+
+	vs.keys = map[string]interface{}{}
+	_, err = rs.signerFor(testKeystoreAddr0)
+	assert.EqualError(err, "Failed to get the public key of Vault key 'eth-f39f': no PEM public key for version 1")
+
+	vault := rs.matchers[0].newKey(testKeystoreAddr0, nil).(*vaultKey)
+	_, err = vault.vault.do("GET", vs.URL+"/v1/sys/health", nil)
+	assert.EqualError(err, "not found")
+	vault.vault.conf.URL = "http://localhost:0"
+	_, err = vault.signDigest(make([]byte, 32))
+	assert.Error(err)
+}
+
+func TestVaultSignerNoData(t *testing.T) {
+	assert := assert.New(t)
+	server := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		res.Write([]byte(`{}`))
+	}))
+	defer server.Close()
+
+	vault, err := newVaultClient(&VaultSignerConf{URL: server.URL, Token: "token1"})
+	assert.NoError(err)
+	assert.Equal("transit", vault.conf.Mount)
+	_, err = vault.key("key1").publicKey()
+	assert.EqualError(err, "no data in response")
+}
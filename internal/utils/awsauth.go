@@ -0,0 +1,472 @@
+// Copyright 2021 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package utils
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kaleido-io/ethconnect/internal/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	awsSigV4Algorithm = "AWS4-HMAC-SHA256"
+	// AWSTimeFormat is the format of the X-Amz-Date header of a signed request
+	AWSTimeFormat = "20060102T150405Z"
+	// awsCredentialsRefreshMargin is how long before they expire temporary credentials are refreshed
+	awsCredentialsRefreshMargin = 5 * time.Minute
+	awsMetadataTimeout          = 2 * time.Second
+	defaultAWSIMDSEndpoint      = "http://169.254.169.254"
+	defaultAWSECSEndpoint       = "http://169.254.170.2"
+)
+
+// AWSCredentials are the keys that sign AWS requests. Temporary credentials have a session
+// token, and an expiry if it is known
+type AWSCredentials struct {
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+	Expiry          time.Time
+}
+
+// AWSCredentialsProvider resolves credentials in the same order as the AWS SDKs: the configured
+// keys, the AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and AWS_SESSION_TOKEN environment variables,
+// the shared credentials file, a web identity token (IAM roles for service accounts), the container
+// credentials endpoint, and the role of the EC2 instance. The shared credentials file is read again
+// whenever it changes, so a session token rotated by another process is picked up, and temporary
+// credentials from the other sources are fetched again before they expire
+type AWSCredentialsProvider struct {
+	static         *AWSCredentials
+	client         *http.Client
+	metadataClient *http.Client
+	stsEndpoint    string
+	imdsEndpoint   string
+	ecsEndpoint    string
+	now            func() time.Time
+	mux            sync.Mutex
+	cached         *AWSCredentials
+	fileCached     *AWSCredentials
+	fileModified   time.Time
+}
+
+type awsMetadataCredentials struct {
+	Code            string `json:"Code"`
+	AccessKeyID     string `json:"AccessKeyId"`
+	SecretAccessKey string `json:"SecretAccessKey"`
+	Token           string `json:"Token"`
+	Expiration      string `json:"Expiration"`
+}
+
+type awsAssumeRoleWithWebIdentityResponse struct {
+	Credentials struct {
+		AccessKeyID     string    `xml:"AccessKeyId"`
+		SecretAccessKey string    `xml:"SecretAccessKey"`
+		SessionToken    string    `xml:"SessionToken"`
+		Expiration      time.Time `xml:"Expiration"`
+	} `xml:"AssumeRoleWithWebIdentityResult>Credentials"`
+}
+
+// NewAWSCredentialsProvider returns a provider of the configured keys, or of the credentials
+// available to the process if no keys are configured
+func NewAWSCredentialsProvider(accessKeyID, secretAccessKey, sessionToken string) *AWSCredentialsProvider {
+	p := &AWSCredentialsProvider{
+		client: &http.Client{Transport: EgressTransport(nil)},
+		// The metadata endpoints are link local, so they are called directly rather than through a proxy
+		metadataClient: &http.Client{Timeout: awsMetadataTimeout},
+		imdsEndpoint:   defaultAWSIMDSEndpoint,
+		ecsEndpoint:    defaultAWSECSEndpoint,
+		now:            time.Now,
+	}
+	if accessKeyID != "" || secretAccessKey != "" {
+		p.static = &AWSCredentials{
+			AccessKeyID:     accessKeyID,
+			SecretAccessKey: secretAccessKey,
+			SessionToken:    sessionToken,
+		}
+	}
+	if endpoint := os.Getenv("AWS_EC2_METADATA_SERVICE_ENDPOINT"); endpoint != "" {
+		p.imdsEndpoint = strings.TrimSuffix(endpoint, "/")
+	}
+	if region := os.Getenv("AWS_REGION"); region != "" {
+		p.stsEndpoint = fmt.Sprintf("https://sts.%s.amazonaws.com/", region)
+	} else {
+		p.stsEndpoint = "https://sts.amazonaws.com/"
+	}
+	return p
+}
+
+// Credentials returns the credentials to sign a request with
+func (p *AWSCredentialsProvider) Credentials() (*AWSCredentials, error) {
+	if p.static != nil {
+		if p.static.AccessKeyID == "" || p.static.SecretAccessKey == "" {
+			return nil, errors.Errorf(errors.AWSCredentialsUnavailable)
+		}
+		return p.static, nil
+	}
+	if accessKeyID, secretAccessKey := os.Getenv("AWS_ACCESS_KEY_ID"), os.Getenv("AWS_SECRET_ACCESS_KEY"); accessKeyID != "" && secretAccessKey != "" {
+		return &AWSCredentials{
+			AccessKeyID:     accessKeyID,
+			SecretAccessKey: secretAccessKey,
+			SessionToken:    os.Getenv("AWS_SESSION_TOKEN"),
+		}, nil
+	}
+
+	p.mux.Lock()
+	defer p.mux.Unlock()
+	if creds, ok, err := p.sharedFileCredentials(); ok || err != nil {
+		return creds, err
+	}
+	if p.cached != nil && p.now().Add(awsCredentialsRefreshMargin).Before(p.cached.Expiry) {
+		return p.cached, nil
+	}
+	creds, source, err := p.fetchTemporaryCredentials()
+	if err != nil {
+		// Credentials that have not yet expired are used until the refresh succeeds
+		if p.cached != nil && p.now().Before(p.cached.Expiry) {
+			log.Warnf("Failed to refresh AWS credentials, which expire at %s: %s", p.cached.Expiry, err)
+			return p.cached, nil
+		}
+		return nil, err
+	}
+	log.Infof("AWS credentials from %s expire at %s", source, creds.Expiry)
+	p.cached = creds
+	return creds, nil
+}
+
+// sharedFileCredentials reads the profile in AWS_PROFILE, or the default profile, from the shared
+// credentials file if it exists. The file is only parsed again when it is modified
+func (p *AWSCredentialsProvider) sharedFileCredentials() (*AWSCredentials, bool, error) {
+	filename := os.Getenv("AWS_SHARED_CREDENTIALS_FILE")
+	if filename == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, false, nil
+		}
+		filename = filepath.Join(home, ".aws", "credentials")
+	}
+	info, err := os.Stat(filename)
+	if err != nil {
+		return nil, false, nil
+	}
+	if p.fileCached != nil && info.ModTime().Equal(p.fileModified) {
+		return p.fileCached, true, nil
+	}
+	profile := os.Getenv("AWS_PROFILE")
+	if profile == "" {
+		profile = "default"
+	}
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, false, errors.Errorf(errors.AWSCredentialsRequestFailed, filename, err)
+	}
+	defer f.Close()
+	creds := &AWSCredentials{}
+	section := ""
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";"):
+		case strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]"):
+			section = strings.TrimSpace(line[1 : len(line)-1])
+		case section == profile:
+			kv := strings.SplitN(line, "=", 2)
+			if len(kv) != 2 {
+				continue
+			}
+			value := strings.TrimSpace(kv[1])
+			switch strings.ToLower(strings.TrimSpace(kv[0])) {
+			case "aws_access_key_id":
+				creds.AccessKeyID = value
+			case "aws_secret_access_key":
+				creds.SecretAccessKey = value
+			case "aws_session_token":
+				creds.SessionToken = value
+			}
+		}
+	}
+	if creds.AccessKeyID == "" || creds.SecretAccessKey == "" {
+		return nil, false, nil
+	}
+	log.Infof("AWS credentials from profile '%s' of %s", profile, filename)
+	p.fileCached = creds
+	p.fileModified = info.ModTime()
+	return creds, true, nil
+}
+
+// fetchTemporaryCredentials obtains credentials from a web identity token, the container
+// credentials endpoint, or the instance metadata service, in that order
+func (p *AWSCredentialsProvider) fetchTemporaryCredentials() (*AWSCredentials, string, error) {
+	if tokenFile, roleARN := os.Getenv("AWS_WEB_IDENTITY_TOKEN_FILE"), os.Getenv("AWS_ROLE_ARN"); tokenFile != "" && roleARN != "" {
+		creds, err := p.assumeRoleWithWebIdentity(tokenFile, roleARN)
+		return creds, "web identity", err
+	}
+	if containerURI := p.containerCredentialsURI(); containerURI != "" {
+		creds, err := p.containerCredentials(containerURI)
+		return creds, "container", err
+	}
+	if !strings.EqualFold(os.Getenv("AWS_EC2_METADATA_DISABLED"), "true") {
+		creds, err := p.instanceCredentials()
+		return creds, "instance role", err
+	}
+	return nil, "", errors.Errorf(errors.AWSCredentialsUnavailable)
+}
+
+// assumeRoleWithWebIdentity exchanges the token in the file, which Kubernetes rotates, for
+// credentials of the role. The request is not signed
+func (p *AWSCredentialsProvider) assumeRoleWithWebIdentity(tokenFile, roleARN string) (*AWSCredentials, error) {
+	token, err := ioutil.ReadFile(tokenFile)
+	if err != nil {
+		return nil, errors.Errorf(errors.AWSCredentialsRequestFailed, tokenFile, err)
+	}
+	sessionName := os.Getenv("AWS_ROLE_SESSION_NAME")
+	if sessionName == "" {
+		sessionName = fmt.Sprintf("ethconnect-%d", p.now().UnixNano())
+	}
+	form := url.Values{}
+	form.Set("Action", "AssumeRoleWithWebIdentity")
+	form.Set("Version", "2011-06-15")
+	form.Set("RoleArn", roleARN)
+	form.Set("RoleSessionName", sessionName)
+	form.Set("WebIdentityToken", strings.TrimSpace(string(token)))
+	req, err := http.NewRequest(http.MethodPost, p.stsEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, errors.Errorf(errors.AWSCredentialsRequestFailed, p.stsEndpoint, err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resBody, err := p.doCredentialsRequest(p.client, req)
+	if err != nil {
+		return nil, err
+	}
+	var res awsAssumeRoleWithWebIdentityResponse
+	if err := xml.Unmarshal(resBody, &res); err != nil || res.Credentials.AccessKeyID == "" {
+		return nil, errors.Errorf(errors.AWSCredentialsResponseInvalid, p.stsEndpoint)
+	}
+	return &AWSCredentials{
+		AccessKeyID:     res.Credentials.AccessKeyID,
+		SecretAccessKey: res.Credentials.SecretAccessKey,
+		SessionToken:    res.Credentials.SessionToken,
+		Expiry:          res.Credentials.Expiration,
+	}, nil
+}
+
+func (p *AWSCredentialsProvider) containerCredentialsURI() string {
+	if relativeURI := os.Getenv("AWS_CONTAINER_CREDENTIALS_RELATIVE_URI"); relativeURI != "" {
+		return p.ecsEndpoint + relativeURI
+	}
+	return os.Getenv("AWS_CONTAINER_CREDENTIALS_FULL_URI")
+}
+
+// containerCredentials calls the credentials endpoint of ECS tasks and EKS pod identities
+func (p *AWSCredentialsProvider) containerCredentials(containerURI string) (*AWSCredentials, error) {
+	req, err := http.NewRequest(http.MethodGet, containerURI, nil)
+	if err != nil {
+		return nil, errors.Errorf(errors.AWSCredentialsRequestFailed, containerURI, err)
+	}
+	authToken := os.Getenv("AWS_CONTAINER_AUTHORIZATION_TOKEN")
+	if tokenFile := os.Getenv("AWS_CONTAINER_AUTHORIZATION_TOKEN_FILE"); tokenFile != "" {
+		token, err := ioutil.ReadFile(tokenFile)
+		if err != nil {
+			return nil, errors.Errorf(errors.AWSCredentialsRequestFailed, tokenFile, err)
+		}
+		authToken = strings.TrimSpace(string(token))
+	}
+	if authToken != "" {
+		req.Header.Set("Authorization", authToken)
+	}
+	resBody, err := p.doCredentialsRequest(p.metadataClient, req)
+	if err != nil {
+		return nil, err
+	}
+	return parseAWSMetadataCredentials(containerURI, resBody)
+}
+
+// instanceCredentials reads the credentials of the role of the EC2 instance, with a session
+// token for the instance metadata service (IMDSv2)
+func (p *AWSCredentialsProvider) instanceCredentials() (*AWSCredentials, error) {
+	tokenURL := p.imdsEndpoint + "/latest/api/token"
+	req, _ := http.NewRequest(http.MethodPut, tokenURL, nil)
+	req.Header.Set("X-aws-ec2-metadata-token-ttl-seconds", "21600")
+	token, err := p.doCredentialsRequest(p.metadataClient, req)
+	if err != nil {
+		return nil, err
+	}
+	rolesURL := p.imdsEndpoint + "/latest/meta-data/iam/security-credentials/"
+	req, _ = http.NewRequest(http.MethodGet, rolesURL, nil)
+	req.Header.Set("X-aws-ec2-metadata-token", string(token))
+	roles, err := p.doCredentialsRequest(p.metadataClient, req)
+	if err != nil {
+		return nil, err
+	}
+	role := strings.TrimSpace(strings.SplitN(string(roles), "\n", 2)[0])
+	if role == "" {
+		return nil, errors.Errorf(errors.AWSCredentialsResponseInvalid, rolesURL)
+	}
+	roleURL := rolesURL + url.PathEscape(role)
+	req, _ = http.NewRequest(http.MethodGet, roleURL, nil)
+	req.Header.Set("X-aws-ec2-metadata-token", string(token))
+	resBody, err := p.doCredentialsRequest(p.metadataClient, req)
+	if err != nil {
+		return nil, err
+	}
+	return parseAWSMetadataCredentials(roleURL, resBody)
+}
+
+func (p *AWSCredentialsProvider) doCredentialsRequest(client *http.Client, req *http.Request) ([]byte, error) {
+	log.Debugf("%s %s (AWS credentials) -->", req.Method, req.URL)
+	res, err := client.Do(req)
+	if err != nil {
+		log.Errorf("%s %s (AWS credentials) <-- !Failed: %s", req.Method, req.URL, err)
+		return nil, errors.Errorf(errors.AWSCredentialsRequestFailed, req.URL, err)
+	}
+	defer res.Body.Close()
+	log.Debugf("%s %s (AWS credentials) <-- [%d]", req.Method, req.URL, res.StatusCode)
+	resBody, _ := ioutil.ReadAll(res.Body)
+	if res.StatusCode != http.StatusOK {
+		return nil, errors.Errorf(errors.AWSCredentialsRequestFailed, req.URL, fmt.Sprintf("[%d]", res.StatusCode))
+	}
+	return resBody, nil
+}
+
+func parseAWSMetadataCredentials(source string, resBody []byte) (*AWSCredentials, error) {
+	var res awsMetadataCredentials
+	if err := json.Unmarshal(resBody, &res); err != nil || res.AccessKeyID == "" || (res.Code != "" && res.Code != "Success") {
+		return nil, errors.Errorf(errors.AWSCredentialsResponseInvalid, source)
+	}
+	creds := &AWSCredentials{
+		AccessKeyID:     res.AccessKeyID,
+		SecretAccessKey: res.SecretAccessKey,
+		SessionToken:    res.Token,
+	}
+	if res.Expiration != "" {
+		expiry, err := time.Parse(time.RFC3339, res.Expiration)
+		if err != nil {
+			return nil, errors.Errorf(errors.AWSCredentialsResponseInvalid, source)
+		}
+		creds.Expiry = expiry
+	}
+	return creds, nil
+}
+
+// SignAWSRequest adds the Signature Version 4 authorization to a request, signing the host and
+// every header set on the request. The path is encoded once, as S3 expects, which for the other
+// services is the same as encoding it twice for paths of unreserved characters, such as "/".
+// S3 requests also carry the hash of the payload in the X-Amz-Content-Sha256 header
+func SignAWSRequest(req *http.Request, body []byte, service, region string, creds *AWSCredentials, now time.Time) {
+	amzDate := now.UTC().Format(AWSTimeFormat)
+	date := amzDate[0:8]
+	payloadHash := sha256Hex(body)
+	req.Header.Set("X-Amz-Date", amzDate)
+	if service == "s3" {
+		req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	}
+	if creds.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", creds.SessionToken)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	canonicalHeaders := &strings.Builder{}
+	for _, name := range names {
+		fmt.Fprintf(canonicalHeaders, "%s:%s\n", name, headers[name])
+	}
+	signedHeaders := strings.Join(names, ";")
+	path := req.URL.Path
+	if path == "" {
+		path = "/"
+	}
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		AWSURIEncode(path, false),
+		awsCanonicalQuery(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := fmt.Sprintf("%s/%s/%s/aws4_request", date, region, service)
+	stringToSign := strings.Join([]string{
+		awsSigV4Algorithm,
+		amzDate,
+		scope,
+		sha256Hex([]byte(canonicalRequest)),
+	}, "\n")
+	signingKey := hmacSHA256([]byte("AWS4"+creds.SecretAccessKey), date)
+	signingKey = hmacSHA256(signingKey, region)
+	signingKey = hmacSHA256(signingKey, service)
+	signingKey = hmacSHA256(signingKey, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(signingKey, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		awsSigV4Algorithm, creds.AccessKeyID, scope, signedHeaders, signature))
+}
+
+func awsCanonicalQuery(query url.Values) string {
+	pairs := make([]string, 0, len(query))
+	for name, values := range query {
+		for _, v := range values {
+			pairs = append(pairs, AWSURIEncode(name, true)+"="+AWSURIEncode(v, true))
+		}
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, "&")
+}
+
+// AWSURIEncode encodes every byte other than the unreserved characters, and '/' unless encodeSlash is set
+func AWSURIEncode(s string, encodeSlash bool) string {
+	var encoded strings.Builder
+	for _, b := range []byte(s) {
+		if (b >= 'A' && b <= 'Z') || (b >= 'a' && b <= 'z') || (b >= '0' && b <= '9') ||
+			b == '-' || b == '_' || b == '.' || b == '~' || (b == '/' && !encodeSlash) {
+			encoded.WriteByte(b)
+		} else {
+			fmt.Fprintf(&encoded, "%%%02X", b)
+		}
+	}
+	return encoded.String()
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+func sha256Hex(data []byte) string {
+	digest := sha256.Sum256(data)
+	return hex.EncodeToString(digest[:])
+}
@@ -0,0 +1,272 @@
+// Copyright 2021 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package utils
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/kaleido-io/ethconnect/internal/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// EgressConf controls the outbound HTTP calls the gateway makes to services other than
+// the Ethereum node, such as webhooks and remote registries. When no proxies are configured
+// the standard HTTP_PROXY, HTTPS_PROXY and NO_PROXY environment variables are used.
+// Hosts are matched exactly, as "*.example.com" for any subdomain, as a CIDR range for IP
+// addresses, or as "*" for all hosts
+type EgressConf struct {
+	HTTPProxy    string                   `json:"httpProxy,omitempty"`
+	HTTPSProxy   string                   `json:"httpsProxy,omitempty"`
+	NoProxy      []string                 `json:"noProxy,omitempty"`
+	AllowedHosts []string                 `json:"allowedHosts,omitempty"`
+	Destinations []*EgressDestinationConf `json:"destinations,omitempty"`
+}
+
+// EgressDestinationConf overrides the CAs trusted for the TLS connections to a host,
+// such as a service with a certificate from a private CA
+type EgressDestinationConf struct {
+	Host        string `json:"host"`
+	CACertsFile string `json:"caCertsFile"`
+}
+
+type egressPolicy struct {
+	httpProxy    *url.URL
+	httpsProxy   *url.URL
+	noProxy      []hostMatcher
+	allowedHosts []hostMatcher
+	rootCAs      map[string]*x509.CertPool
+}
+
+type hostMatcher func(host string) bool
+
+var egress struct {
+	mux    sync.RWMutex
+	policy *egressPolicy
+}
+
+// ConfigureEgress sets the egress policy for the process, which applies to all the HTTP
+// clients created with EgressTransport, including those created before it is called.
+// A nil configuration removes the policy
+func ConfigureEgress(conf *EgressConf) error {
+	var policy *egressPolicy
+	if conf != nil {
+		var err error
+		if policy, err = newEgressPolicy(conf); err != nil {
+			return err
+		}
+		log.Infof("Egress policy: allowedHosts=%v noProxy=%v destinations=%d", conf.AllowedHosts, conf.NoProxy, len(conf.Destinations))
+	}
+	egress.mux.Lock()
+	egress.policy = policy
+	egress.mux.Unlock()
+	return nil
+}
+
+func currentEgressPolicy() *egressPolicy {
+	egress.mux.RLock()
+	defer egress.mux.RUnlock()
+	return egress.policy
+}
+
+func newEgressPolicy(conf *EgressConf) (p *egressPolicy, err error) {
+	p = &egressPolicy{
+		rootCAs: make(map[string]*x509.CertPool),
+	}
+	if p.httpProxy, err = parseProxyURL(conf.HTTPProxy); err != nil {
+		return nil, err
+	}
+	if p.httpsProxy, err = parseProxyURL(conf.HTTPSProxy); err != nil {
+		return nil, err
+	}
+	if p.httpsProxy == nil {
+		p.httpsProxy = p.httpProxy
+	}
+	if p.noProxy, err = parseHostMatchers(conf.NoProxy); err != nil {
+		return nil, err
+	}
+	if p.allowedHosts, err = parseHostMatchers(conf.AllowedHosts); err != nil {
+		return nil, err
+	}
+	for _, dest := range conf.Destinations {
+		caCerts, err := ioutil.ReadFile(dest.CACertsFile)
+		if err != nil {
+			return nil, errors.Errorf(errors.EgressCACertsLoadFailed, dest.Host, dest.CACertsFile, err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caCerts) {
+			return nil, errors.Errorf(errors.EgressCACertsLoadFailed, dest.Host, dest.CACertsFile, "no PEM certificates")
+		}
+		p.rootCAs[normalizeHost(dest.Host)] = pool
+	}
+	return p, nil
+}
+
+func parseProxyURL(proxy string) (*url.URL, error) {
+	if proxy == "" {
+		return nil, nil
+	}
+	u, err := url.Parse(proxy)
+	if err != nil {
+		return nil, errors.Errorf(errors.EgressInvalidProxy, proxy, err)
+	}
+	if u.Host == "" {
+		return nil, errors.Errorf(errors.EgressInvalidProxy, proxy, "no host")
+	}
+	return u, nil
+}
+
+func parseHostMatchers(patterns []string) ([]hostMatcher, error) {
+	matchers := make([]hostMatcher, 0, len(patterns))
+	for _, pattern := range patterns {
+		pattern = strings.ToLower(strings.TrimSpace(pattern))
+		switch {
+		case pattern == "*":
+			matchers = append(matchers, func(host string) bool { return true })
+		case strings.HasPrefix(pattern, "*."):
+			suffix := pattern[1:]
+			matchers = append(matchers, func(host string) bool { return strings.HasSuffix(host, suffix) })
+		case strings.Contains(pattern, "/"):
+			_, ipNet, err := net.ParseCIDR(pattern)
+			if err != nil {
+				return nil, errors.Errorf(errors.EgressInvalidHostPattern, pattern)
+			}
+			matchers = append(matchers, func(host string) bool {
+				ip := net.ParseIP(host)
+				return ip != nil && ipNet.Contains(ip)
+			})
+		case pattern == "" || strings.Contains(pattern, "*") || (strings.Contains(pattern, ":") && net.ParseIP(pattern) == nil):
+			return nil, errors.Errorf(errors.EgressInvalidHostPattern, pattern)
+		default:
+			exact := normalizeHost(pattern)
+			matchers = append(matchers, func(host string) bool { return host == exact })
+		}
+	}
+	return matchers, nil
+}
+
+// normalizeHost lower-cases names, and puts IP addresses in their canonical form
+func normalizeHost(host string) string {
+	if ip := net.ParseIP(host); ip != nil {
+		return ip.String()
+	}
+	return strings.ToLower(host)
+}
+
+func matchesHost(matchers []hostMatcher, host string) bool {
+	for _, m := range matchers {
+		if m(host) {
+			return true
+		}
+	}
+	return false
+}
+
+// allowed is true for all hosts if no allowlist is configured
+func (p *egressPolicy) allowed(host string) bool {
+	return len(p.allowedHosts) == 0 || matchesHost(p.allowedHosts, host)
+}
+
+func (p *egressPolicy) proxy(req *http.Request) (*url.URL, error) {
+	if p.httpProxy == nil && p.httpsProxy == nil {
+		return http.ProxyFromEnvironment(req)
+	}
+	if matchesHost(p.noProxy, normalizeHost(req.URL.Hostname())) {
+		return nil, nil
+	}
+	if req.URL.Scheme == "https" {
+		return p.httpsProxy, nil
+	}
+	return p.httpProxy, nil
+}
+
+// egressTransport applies the egress policy to each request, including each redirect,
+// using a copy of the base transport for each set of TLS overrides
+type egressTransport struct {
+	base       *http.Transport
+	mux        sync.Mutex
+	policy     *egressPolicy
+	transports map[string]*http.Transport
+}
+
+// EgressTransport wraps the transport of an outbound HTTP client, to apply the egress
+// policy of the process. A nil base uses the defaults of the standard library
+func EgressTransport(base *http.Transport) http.RoundTripper {
+	if base == nil {
+		base = http.DefaultTransport.(*http.Transport).Clone()
+	}
+	return &egressTransport{base: base}
+}
+
+func (t *egressTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	policy := currentEgressPolicy()
+	if policy == nil {
+		return t.base.RoundTrip(req)
+	}
+	host := normalizeHost(req.URL.Hostname())
+	if !policy.allowed(host) {
+		log.Errorf("%s %s blocked by egress allowlist", req.Method, req.URL)
+		return nil, errors.Errorf(errors.EgressHostNotAllowed, host)
+	}
+	return t.transportFor(policy, host).RoundTrip(req)
+}
+
+func (t *egressTransport) transportFor(policy *egressPolicy, host string) *http.Transport {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	if t.policy != policy {
+		// The policy has been reconfigured, so the idle connections of the old one are released
+		for _, transport := range t.transports {
+			transport.CloseIdleConnections()
+		}
+		t.policy = policy
+		t.transports = make(map[string]*http.Transport)
+	}
+	rootCAs, override := policy.rootCAs[host]
+	if !override {
+		host = ""
+	}
+	transport, ok := t.transports[host]
+	if !ok {
+		transport = t.base.Clone()
+		transport.Proxy = policy.proxy
+		if override {
+			tlsConfig := &tls.Config{}
+			if transport.TLSClientConfig != nil {
+				tlsConfig = transport.TLSClientConfig.Clone()
+			}
+			tlsConfig.RootCAs = rootCAs
+			transport.TLSClientConfig = tlsConfig
+		}
+		t.transports[host] = transport
+	}
+	return transport
+}
+
+// CloseIdleConnections is called by http.Client.CloseIdleConnections
+func (t *egressTransport) CloseIdleConnections() {
+	t.base.CloseIdleConnections()
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	for _, transport := range t.transports {
+		transport.CloseIdleConnections()
+	}
+}
@@ -0,0 +1,211 @@
+// Copyright 2021 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package utils
+
+import (
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestEgressServer(tls bool) *httptest.Server {
+	handler := http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		res.Write([]byte(req.Host + req.URL.Path))
+	})
+	if tls {
+		return httptest.NewTLSServer(handler)
+	}
+	return httptest.NewServer(handler)
+}
+
+func testEgressGet(client *http.Client, url string) (string, error) {
+	res, err := client.Get(url)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+	b, _ := ioutil.ReadAll(res.Body)
+	return string(b), nil
+}
+
+func TestEgressNoPolicy(t *testing.T) {
+	assert := assert.New(t)
+	server := newTestEgressServer(false)
+	defer server.Close()
+
+	client := &http.Client{Transport: EgressTransport(nil)}
+	body, err := testEgressGet(client, server.URL+"/path1")
+	assert.NoError(err)
+	assert.Equal(server.Listener.Addr().String()+"/path1", body)
+	client.CloseIdleConnections()
+}
+
+func TestEgressAllowlist(t *testing.T) {
+	assert := assert.New(t)
+	server := newTestEgressServer(false)
+	defer server.Close()
+	defer ConfigureEgress(nil)
+
+	client := &http.Client{Transport: EgressTransport(&http.Transport{})}
+	err := ConfigureEgress(&EgressConf{AllowedHosts: []string{"*.example.com", "10.0.0.0/8", "localhost"}})
+	assert.NoError(err)
+	_, err = testEgressGet(client, server.URL)
+	assert.Regexp("Outbound requests to '127.0.0.1' are not permitted by the egress allowlist", err)
+
+	// The policy is reconfigured for existing clients
+	err = ConfigureEgress(&EgressConf{AllowedHosts: []string{"*.example.com", " 127.0.0.0/8 "}})
+	assert.NoError(err)
+	_, err = testEgressGet(client, server.URL)
+	assert.NoError(err)
+	err = ConfigureEgress(&EgressConf{AllowedHosts: []string{"127.0.0.1"}})
+	assert.NoError(err)
+	_, err = testEgressGet(client, server.URL)
+	assert.NoError(err)
+	client.CloseIdleConnections()
+
+	policy := currentEgressPolicy()
+	assert.False(policy.allowed("example.com"))
+	err = ConfigureEgress(&EgressConf{AllowedHosts: []string{"*.Example.com", "::1", "*"}})
+	assert.NoError(err)
+	policy = currentEgressPolicy()
+	assert.True(policy.allowed("api.example.com"))
+	assert.True(policy.allowed(normalizeHost("0:0::1")))
+	assert.True(policy.allowed("anything"))
+}
+
+func TestEgressRedirectBlocked(t *testing.T) {
+	assert := assert.New(t)
+	defer ConfigureEgress(nil)
+	server := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		http.Redirect(res, req, "http://blocked.example.com/", http.StatusFound)
+	}))
+	defer server.Close()
+
+	err := ConfigureEgress(&EgressConf{AllowedHosts: []string{"127.0.0.1"}})
+	assert.NoError(err)
+	client := &http.Client{Transport: EgressTransport(nil)}
+	_, err = testEgressGet(client, server.URL)
+	assert.Regexp("'blocked.example.com' are not permitted", err)
+}
+
+func TestEgressProxy(t *testing.T) {
+	assert := assert.New(t)
+	defer ConfigureEgress(nil)
+	proxy := newTestEgressServer(false)
+	defer proxy.Close()
+	server := newTestEgressServer(false)
+	defer server.Close()
+
+	err := ConfigureEgress(&EgressConf{
+		HTTPProxy: proxy.URL,
+		NoProxy:   []string{"127.0.0.1"},
+	})
+	assert.NoError(err)
+	client := &http.Client{Transport: EgressTransport(nil)}
+
+	// The proxy receives the request for the host
+	body, err := testEgressGet(client, "http://service.example.com/path1")
+	assert.NoError(err)
+	assert.Equal("service.example.com/path1", body)
+
+	// Hosts excluded from the proxy are called directly
+	body, err = testEgressGet(client, server.URL+"/path2")
+	assert.NoError(err)
+	assert.Equal(server.Listener.Addr().String()+"/path2", body)
+
+	policy := currentEgressPolicy()
+	req, _ := http.NewRequest("GET", "https://service.example.com", nil)
+	u, err := policy.proxy(req)
+	assert.NoError(err)
+	assert.Equal(proxy.URL, u.String())
+
+	err = ConfigureEgress(&EgressConf{HTTPSProxy: "https://proxy.example.com:3128"})
+	assert.NoError(err)
+	policy = currentEgressPolicy()
+	u, _ = policy.proxy(req)
+	assert.Equal("https://proxy.example.com:3128", u.String())
+	req, _ = http.NewRequest("GET", "http://service.example.com", nil)
+	u, _ = policy.proxy(req)
+	assert.Nil(u)
+}
+
+func TestEgressProxyFromEnvironment(t *testing.T) {
+	assert := assert.New(t)
+
+	policy, err := newEgressPolicy(&EgressConf{})
+	assert.NoError(err)
+	req, _ := http.NewRequest("GET", "http://localhost", nil)
+	u, err := policy.proxy(req)
+	assert.NoError(err)
+	assert.Nil(u)
+}
+
+func TestEgressDestinationCA(t *testing.T) {
+	assert := assert.New(t)
+	defer ConfigureEgress(nil)
+	server := newTestEgressServer(true)
+	defer server.Close()
+	dir, _ := ioutil.TempDir("", "egress")
+	defer os.RemoveAll(dir)
+	caFile := path.Join(dir, "ca.pem")
+	ioutil.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}), 0644)
+
+	client := &http.Client{Transport: EgressTransport(nil)}
+	err := ConfigureEgress(&EgressConf{})
+	assert.NoError(err)
+	_, err = testEgressGet(client, server.URL)
+	assert.Regexp("certificate", err)
+
+	err = ConfigureEgress(&EgressConf{
+		Destinations: []*EgressDestinationConf{{Host: "127.0.0.1", CACertsFile: caFile}},
+	})
+	assert.NoError(err)
+	body, err := testEgressGet(client, server.URL+"/path1")
+	assert.NoError(err)
+	assert.Equal(server.Listener.Addr().String()+"/path1", body)
+	client.CloseIdleConnections()
+}
+
+func TestEgressConfigErrors(t *testing.T) {
+	assert := assert.New(t)
+	dir, _ := ioutil.TempDir("", "egress")
+	defer os.RemoveAll(dir)
+	badFile := path.Join(dir, "bad.pem")
+	ioutil.WriteFile(badFile, []byte("not PEM"), 0644)
+
+	err := ConfigureEgress(&EgressConf{HTTPProxy: ":bad"})
+	assert.Regexp("Invalid egress proxy URL ':bad'", err)
+	err = ConfigureEgress(&EgressConf{HTTPSProxy: "proxy.example.com"})
+	assert.EqualError(err, "Invalid egress proxy URL 'proxy.example.com': no host")
+	err = ConfigureEgress(&EgressConf{NoProxy: []string{"10.0.0.0/33"}})
+	assert.EqualError(err, "Invalid egress host pattern '10.0.0.0/33'")
+	err = ConfigureEgress(&EgressConf{AllowedHosts: []string{"api.*.com"}})
+	assert.EqualError(err, "Invalid egress host pattern 'api.*.com'")
+	err = ConfigureEgress(&EgressConf{AllowedHosts: []string{"example.com:443"}})
+	assert.Regexp("Invalid egress host pattern", err)
+	err = ConfigureEgress(&EgressConf{AllowedHosts: []string{""}})
+	assert.Regexp("Invalid egress host pattern", err)
+	err = ConfigureEgress(&EgressConf{Destinations: []*EgressDestinationConf{{Host: "a", CACertsFile: path.Join(dir, "missing")}}})
+	assert.Regexp("Failed to load the CA certificates for 'a'", err)
+	err = ConfigureEgress(&EgressConf{Destinations: []*EgressDestinationConf{{Host: "a", CACertsFile: badFile}}})
+	assert.Regexp("no PEM certificates", err)
+	assert.Nil(currentEgressPolicy())
+}
@@ -27,9 +27,11 @@ import (
 
 // HTTPRequester performs common HTTP request logging/processing for utilities
 type HTTPRequester struct {
-	name   string
-	client *http.Client
-	conf   *HTTPRequesterConf
+	name        string
+	client      *http.Client
+	transport   *http.Transport
+	conf        *HTTPRequesterConf
+	tokenSource *oauth2TokenSource
 }
 
 // HTTPRequesterConf configuration for making HTTP reuqests
@@ -39,42 +41,95 @@ type HTTPRequesterConf struct {
 
 // NewHTTPRequester constructor
 func NewHTTPRequester(name string, conf *HTTPRequesterConf) *HTTPRequester {
+	transport := &http.Transport{
+		MaxIdleConns: 1,
+	}
 	return &HTTPRequester{
-		name: name,
-		conf: conf,
+		name:      name,
+		conf:      conf,
+		transport: transport,
 		client: &http.Client{
-			Transport: &http.Transport{
-				MaxIdleConns: 1,
-			},
+			Transport: EgressTransport(transport),
 		},
 	}
 }
 
-// DoRequest performs a single HTTP request processing the response as JSON
-func (hr *HTTPRequester) DoRequest(method, url string, bodyMap map[string]interface{}) (map[string]interface{}, error) {
-	log.Infof("%s %s -->", method, url)
-	var body io.Reader
-	if bodyMap != nil {
-		bodyBytes, ehr := json.Marshal(bodyMap)
-		if ehr != nil {
-			return nil, errors.Errorf(errors.HTTPRequesterSerializeFailed, ehr)
+// ConfigureAuth enables TLS (including mutual TLS with a client certificate) for requests,
+// and OAuth2 client credentials tokens if a token URL is configured. The token endpoint
+// is called with the same TLS configuration
+func (hr *HTTPRequester) ConfigureAuth(tlsConf *TLSConfig, oauth2Conf *OAuth2Conf) error {
+	if tlsConf != nil && tlsConf.Enabled {
+		tlsConfig, err := CreateTLSConfiguration(tlsConf)
+		if err != nil {
+			return err
 		}
+		hr.transport.TLSClientConfig = tlsConfig
+	}
+	if oauth2Conf != nil && oauth2Conf.TokenURL != "" {
+		hr.tokenSource = newOAuth2TokenSource(oauth2Conf, hr.client)
+	}
+	return nil
+}
+
+func (hr *HTTPRequester) sendRequest(method, url string, bodyBytes []byte) (*http.Response, error) {
+	var body io.Reader
+	if bodyBytes != nil {
 		body = bytes.NewReader(bodyBytes)
 	}
 	req, _ := http.NewRequest(method, url, body)
 	req.Header = http.Header{}
-	if hr.conf.Headers != nil {
-		req.Header = hr.conf.Headers
+	for k, v := range hr.conf.Headers {
+		req.Header[k] = v
 	}
 	req.Header.Add("content-type", "application/json")
+	if hr.tokenSource != nil {
+		authHeader, err := hr.tokenSource.authHeader()
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Authorization", authHeader)
+	}
 	res, ehr := hr.client.Do(req)
 	if ehr != nil {
 		log.Errorf("%s %s <-- !Failed: %s", method, url, ehr)
 		return nil, errors.Errorf(errors.HTTPRequesterNonStatusError, hr.name)
 	}
+	return res, nil
+}
+
+// DoRequest performs a single HTTP request processing the response as JSON
+func (hr *HTTPRequester) DoRequest(method, url string, bodyMap map[string]interface{}) (map[string]interface{}, error) {
+	jsonBody, _, err := hr.DoRequestWithStatus(method, url, bodyMap)
+	return jsonBody, err
+}
+
+// DoRequestWithStatus performs a single HTTP request as DoRequest, and also returns the status
+// code of the response, so a caller can tell a rejection such as a conflict from other failures.
+// The status is zero if no response was received
+func (hr *HTTPRequester) DoRequestWithStatus(method, url string, bodyMap map[string]interface{}) (map[string]interface{}, int, error) {
+	log.Infof("%s %s -->", method, url)
+	var bodyBytes []byte
+	if bodyMap != nil {
+		var ehr error
+		if bodyBytes, ehr = json.Marshal(bodyMap); ehr != nil {
+			return nil, 0, errors.Errorf(errors.HTTPRequesterSerializeFailed, ehr)
+		}
+	}
+	res, ehr := hr.sendRequest(method, url, bodyBytes)
+	if ehr == nil && res.StatusCode == 401 && hr.tokenSource != nil {
+		// The token might have been revoked before its expiry, so retry once with a new one
+		log.Infof("%s %s <-- [%d] retrying with new token", method, url, res.StatusCode)
+		res.Body.Close()
+		hr.tokenSource.invalidate()
+		res, ehr = hr.sendRequest(method, url, bodyBytes)
+	}
+	if ehr != nil {
+		return nil, 0, ehr
+	}
+	defer res.Body.Close()
 	log.Infof("%s %s <-- [%d]", method, url, res.StatusCode)
 	if res.StatusCode == 404 {
-		return nil, nil
+		return nil, res.StatusCode, nil
 	}
 	var jsonBody map[string]interface{}
 	if res.StatusCode == 204 {
@@ -83,17 +138,17 @@ func (hr *HTTPRequester) DoRequest(method, url string, bodyMap map[string]interf
 		resBody, _ := ioutil.ReadAll(res.Body)
 		if err := json.Unmarshal(resBody, &jsonBody); err != nil {
 			log.Errorf("%s %s <-- [%d] !Failed to read body: %s", method, url, res.StatusCode, ehr)
-			return nil, errors.Errorf(errors.HTTPRequesterStatusErrorNoData, hr.name, res.StatusCode)
+			return nil, res.StatusCode, errors.Errorf(errors.HTTPRequesterStatusErrorNoData, hr.name, res.StatusCode)
 		}
 		if res.StatusCode < 200 || res.StatusCode >= 300 {
 			log.Errorf("%s %s <-- [%d]: %+v", method, url, res.StatusCode, jsonBody)
 			if ehrMsg, ok := jsonBody["errorMessage"]; ok {
-				return nil, errors.Errorf(errors.HTTPRequesterStatusErrorWithData, hr.name, res.StatusCode, ehrMsg)
+				return nil, res.StatusCode, errors.Errorf(errors.HTTPRequesterStatusErrorWithData, hr.name, res.StatusCode, ehrMsg)
 			}
-			return nil, errors.Errorf(errors.HTTPRequesterStatusError, hr.name)
+			return nil, res.StatusCode, errors.Errorf(errors.HTTPRequesterStatusError, hr.name)
 		}
 	}
-	return jsonBody, nil
+	return jsonBody, res.StatusCode, nil
 }
 
 // GetResponseString returns a string from a response map, asserting its existencer
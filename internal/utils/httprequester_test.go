@@ -187,3 +187,38 @@ func TestHTTPRequesterGetResponseStringVariants(t *testing.T) {
 	assert.EqualError(err, "'nil-value' empty (or null) in unit test response")
 
 }
+
+func TestHTTPRequesterConfigureAuthTLS(t *testing.T) {
+	assert := assert.New(t)
+
+	router := &httprouter.Router{}
+	router.GET("/", func(res http.ResponseWriter, req *http.Request, parms httprouter.Params) {
+		res.WriteHeader(200)
+		res.Write([]byte("{\"some\":\"data\"}"))
+	})
+	server := httptest.NewTLSServer(router)
+	defer server.Close()
+
+	hr := NewHTTPRequester("unit test", &HTTPRequesterConf{})
+	err := hr.ConfigureAuth(&TLSConfig{
+		Enabled:            true,
+		InsecureSkipVerify: true,
+	}, &OAuth2Conf{})
+	assert.NoError(err)
+	assert.Nil(hr.tokenSource)
+
+	res, err := hr.DoRequest("GET", server.URL, nil)
+	assert.NoError(err)
+	assert.Equal("data", res["some"])
+}
+
+func TestHTTPRequesterConfigureAuthBadTLS(t *testing.T) {
+	assert := assert.New(t)
+
+	hr := NewHTTPRequester("unit test", &HTTPRequesterConf{})
+	err := hr.ConfigureAuth(&TLSConfig{
+		Enabled:         true,
+		ClientCertsFile: "/some/cert.pem",
+	}, nil)
+	assert.Regexp("Client private key and certificate must both be provided for mutual auth", err)
+}
@@ -0,0 +1,132 @@
+// Copyright 2021 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package utils
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kaleido-io/ethconnect/internal/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	defaultOAuth2ExpiryMarginSec = 30
+)
+
+// OAuth2Conf configures token acquisition using the OAuth2 client credentials grant
+type OAuth2Conf struct {
+	TokenURL        string   `json:"tokenURL"`
+	ClientID        string   `json:"clientID"`
+	ClientSecret    string   `json:"clientSecret"`
+	Scopes          []string `json:"scopes"`
+	Audience        string   `json:"audience"`
+	ExpiryMarginSec *int     `json:"expiryMarginSec,omitempty"`
+}
+
+type oauth2TokenResponse struct {
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+	ExpiresIn   int64  `json:"expires_in"`
+}
+
+// oauth2TokenSource caches a client credentials token, and fetches a new one
+// when the cached token is within the expiry margin, or has been rejected
+type oauth2TokenSource struct {
+	conf         *OAuth2Conf
+	client       *http.Client
+	expiryMargin time.Duration
+	mux          sync.Mutex
+	token        string
+	tokenType    string
+	expiry       time.Time
+}
+
+func newOAuth2TokenSource(conf *OAuth2Conf, client *http.Client) *oauth2TokenSource {
+	expiryMarginSec := defaultOAuth2ExpiryMarginSec
+	if conf.ExpiryMarginSec != nil {
+		expiryMarginSec = *conf.ExpiryMarginSec
+	}
+	return &oauth2TokenSource{
+		conf:         conf,
+		client:       client,
+		expiryMargin: time.Duration(expiryMarginSec) * time.Second,
+	}
+}
+
+// authHeader returns the Authorization header value, using the cached token if still valid
+func (ts *oauth2TokenSource) authHeader() (string, error) {
+	ts.mux.Lock()
+	defer ts.mux.Unlock()
+	if ts.token == "" || (!ts.expiry.IsZero() && time.Now().Add(ts.expiryMargin).After(ts.expiry)) {
+		if err := ts.fetchToken(); err != nil {
+			return "", err
+		}
+	}
+	return ts.tokenType + " " + ts.token, nil
+}
+
+// invalidate discards the cached token, after it was rejected by the server
+func (ts *oauth2TokenSource) invalidate() {
+	ts.mux.Lock()
+	defer ts.mux.Unlock()
+	ts.token = ""
+}
+
+func (ts *oauth2TokenSource) fetchToken() error {
+	form := url.Values{}
+	form.Set("grant_type", "client_credentials")
+	if len(ts.conf.Scopes) > 0 {
+		form.Set("scope", strings.Join(ts.conf.Scopes, " "))
+	}
+	if ts.conf.Audience != "" {
+		form.Set("audience", ts.conf.Audience)
+	}
+	req, err := http.NewRequest("POST", ts.conf.TokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return errors.Errorf(errors.OAuth2TokenRequestFailed, ts.conf.TokenURL, err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(url.QueryEscape(ts.conf.ClientID), url.QueryEscape(ts.conf.ClientSecret))
+	log.Infof("POST %s (OAuth2 token) -->", ts.conf.TokenURL)
+	res, err := ts.client.Do(req)
+	if err != nil {
+		log.Errorf("POST %s (OAuth2 token) <-- !Failed: %s", ts.conf.TokenURL, err)
+		return errors.Errorf(errors.OAuth2TokenRequestFailed, ts.conf.TokenURL, err)
+	}
+	defer res.Body.Close()
+	log.Infof("POST %s (OAuth2 token) <-- [%d]", ts.conf.TokenURL, res.StatusCode)
+	resBody, _ := ioutil.ReadAll(res.Body)
+	var tokenRes oauth2TokenResponse
+	if res.StatusCode < 200 || res.StatusCode >= 300 || json.Unmarshal(resBody, &tokenRes) != nil || tokenRes.AccessToken == "" {
+		return errors.Errorf(errors.OAuth2TokenResponseInvalid, ts.conf.TokenURL, res.StatusCode)
+	}
+	ts.token = tokenRes.AccessToken
+	// The token type is case insensitive, but many servers only accept "Bearer"
+	ts.tokenType = "Bearer"
+	if tokenRes.TokenType != "" && !strings.EqualFold(tokenRes.TokenType, "bearer") {
+		ts.tokenType = tokenRes.TokenType
+	}
+	ts.expiry = time.Time{}
+	if tokenRes.ExpiresIn > 0 {
+		ts.expiry = time.Now().Add(time.Duration(tokenRes.ExpiresIn) * time.Second)
+	}
+	return nil
+}
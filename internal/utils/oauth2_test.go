@@ -0,0 +1,156 @@
+// Copyright 2021 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package utils
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestOAuth2Server(t *testing.T, expiresIn int, tokenCount *int, revoked map[string]bool) *httptest.Server {
+	router := &httprouter.Router{}
+	router.POST("/token", func(res http.ResponseWriter, req *http.Request, parms httprouter.Params) {
+		clientID, clientSecret, ok := req.BasicAuth()
+		assert.True(t, ok)
+		assert.Equal(t, "client1", clientID)
+		assert.Equal(t, "secret1", clientSecret)
+		req.ParseForm()
+		assert.Equal(t, "client_credentials", req.PostForm.Get("grant_type"))
+		assert.Equal(t, "registry.read registry.write", req.PostForm.Get("scope"))
+		*tokenCount++
+		res.WriteHeader(200)
+		fmt.Fprintf(res, `{"access_token":"token%d","token_type":"bearer","expires_in":%d}`, *tokenCount, expiresIn)
+	})
+	router.GET("/api", func(res http.ResponseWriter, req *http.Request, parms httprouter.Params) {
+		authHeader := req.Header.Get("Authorization")
+		if revoked[authHeader] {
+			res.WriteHeader(401)
+			res.Write([]byte(`{"errorMessage":"revoked"}`))
+			return
+		}
+		res.WriteHeader(200)
+		fmt.Fprintf(res, `{"auth":"%s"}`, authHeader)
+	})
+	return httptest.NewServer(router)
+}
+
+func newTestOAuth2Conf(server *httptest.Server) *OAuth2Conf {
+	return &OAuth2Conf{
+		TokenURL:     server.URL + "/token",
+		ClientID:     "client1",
+		ClientSecret: "secret1",
+		Scopes:       []string{"registry.read", "registry.write"},
+	}
+}
+
+func TestOAuth2TokenCached(t *testing.T) {
+	assert := assert.New(t)
+
+	tokenCount := 0
+	server := newTestOAuth2Server(t, 3600, &tokenCount, map[string]bool{})
+	defer server.Close()
+
+	hr := NewHTTPRequester("unit test", &HTTPRequesterConf{})
+	err := hr.ConfigureAuth(&TLSConfig{}, newTestOAuth2Conf(server))
+	assert.NoError(err)
+
+	for i := 0; i < 2; i++ {
+		res, err := hr.DoRequest("GET", server.URL+"/api", nil)
+		assert.NoError(err)
+		assert.Equal("Bearer token1", res["auth"])
+	}
+	assert.Equal(1, tokenCount)
+}
+
+func TestOAuth2TokenRefreshedBeforeExpiry(t *testing.T) {
+	assert := assert.New(t)
+
+	tokenCount := 0
+	server := newTestOAuth2Server(t, 10, &tokenCount, map[string]bool{})
+	defer server.Close()
+
+	hr := NewHTTPRequester("unit test", &HTTPRequesterConf{})
+	// The token expires within the default margin, so is fetched for every request
+	err := hr.ConfigureAuth(nil, newTestOAuth2Conf(server))
+	assert.NoError(err)
+
+	res, err := hr.DoRequest("GET", server.URL+"/api", nil)
+	assert.NoError(err)
+	assert.Equal("Bearer token1", res["auth"])
+	res, err = hr.DoRequest("GET", server.URL+"/api", nil)
+	assert.NoError(err)
+	assert.Equal("Bearer token2", res["auth"])
+}
+
+func TestOAuth2TokenRevokedRetry(t *testing.T) {
+	assert := assert.New(t)
+
+	tokenCount := 0
+	server := newTestOAuth2Server(t, 3600, &tokenCount, map[string]bool{"Bearer token1": true})
+	defer server.Close()
+
+	hr := NewHTTPRequester("unit test", &HTTPRequesterConf{
+		Headers: map[string][]string{"X-Custom": {"value"}},
+	})
+	err := hr.ConfigureAuth(nil, newTestOAuth2Conf(server))
+	assert.NoError(err)
+
+	res, err := hr.DoRequest("GET", server.URL+"/api", nil)
+	assert.NoError(err)
+	assert.Equal("Bearer token2", res["auth"])
+	assert.Equal(2, tokenCount)
+	assert.Equal(map[string][]string{"X-Custom": {"value"}}, hr.conf.Headers)
+}
+
+func TestOAuth2TokenRejected(t *testing.T) {
+	assert := assert.New(t)
+
+	router := &httprouter.Router{}
+	router.POST("/token", func(res http.ResponseWriter, req *http.Request, parms httprouter.Params) {
+		res.WriteHeader(401)
+		res.Write([]byte(`{"error":"invalid_client"}`))
+	})
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	hr := NewHTTPRequester("unit test", &HTTPRequesterConf{})
+	hr.ConfigureAuth(nil, newTestOAuth2Conf(server))
+
+	_, err := hr.DoRequest("GET", server.URL+"/api", nil)
+	assert.Regexp("No OAuth2 access token returned by .*/token \\[401\\]", err)
+}
+
+func TestOAuth2TokenRequestFailed(t *testing.T) {
+	assert := assert.New(t)
+
+	hr := NewHTTPRequester("unit test", &HTTPRequesterConf{})
+	hr.ConfigureAuth(nil, &OAuth2Conf{TokenURL: "http://localhost:0/token"})
+
+	_, err := hr.DoRequest("GET", "http://localhost:0/api", nil)
+	assert.Regexp("Failed to obtain OAuth2 token from http://localhost:0/token", err)
+}
+
+func TestOAuth2TokenBadURL(t *testing.T) {
+	assert := assert.New(t)
+
+	ts := newOAuth2TokenSource(&OAuth2Conf{TokenURL: "! a URL\x7f"}, http.DefaultClient)
+	_, err := ts.authHeader()
+	assert.Regexp("Failed to obtain OAuth2 token", err)
+}
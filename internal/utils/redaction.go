@@ -0,0 +1,240 @@
+// Copyright 2021 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package utils
+
+import (
+	"encoding/json"
+	"strings"
+	"sync"
+
+	"github.com/kaleido-io/ethconnect/internal/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+const defaultRedactionMask = "***"
+
+// RedactionConf masks the values of sensitive fields, such as personal data passed to contract
+// methods, in the logs, audit records and stored receipts of the gateway. The transactions sent
+// to the chain are not affected. A field without a "." is matched by name at any depth, and a
+// field with a "." is a path from the root, where "*" matches any name. Names are matched
+// ignoring case, and arrays are matched through, so "decodedEvents.data.email" matches the
+// email of every decoded event. The parameters of a method are matched by the names of its inputs
+type RedactionConf struct {
+	Fields []string `json:"fields,omitempty"`
+	Mask   string   `json:"mask,omitempty"`
+}
+
+type redactionPolicy struct {
+	names map[string]bool
+	paths [][]string
+	mask  string
+}
+
+var redaction struct {
+	mux    sync.RWMutex
+	policy *redactionPolicy
+}
+
+// ConfigureRedaction sets the redaction policy for the process. A nil configuration, or one
+// with no fields, removes the policy
+func ConfigureRedaction(conf *RedactionConf) error {
+	var policy *redactionPolicy
+	if conf != nil && len(conf.Fields) > 0 {
+		policy = &redactionPolicy{
+			names: make(map[string]bool),
+			mask:  conf.Mask,
+		}
+		if policy.mask == "" {
+			policy.mask = defaultRedactionMask
+		}
+		for _, field := range conf.Fields {
+			segments := strings.Split(strings.ToLower(field), ".")
+			for _, segment := range segments {
+				if segment == "" {
+					return errors.Errorf(errors.RedactionInvalidField, field)
+				}
+			}
+			if len(segments) == 1 {
+				policy.names[segments[0]] = true
+			} else {
+				policy.paths = append(policy.paths, segments)
+			}
+		}
+		log.Infof("Redacting %d fields from logs, audit records and stored receipts", len(conf.Fields))
+	}
+	redaction.mux.Lock()
+	redaction.policy = policy
+	redaction.mux.Unlock()
+	return nil
+}
+
+func currentRedactionPolicy() *redactionPolicy {
+	redaction.mux.RLock()
+	defer redaction.mux.RUnlock()
+	return redaction.policy
+}
+
+// RedactionEnabled is true if any fields are configured to be redacted
+func RedactionEnabled() bool {
+	return currentRedactionPolicy() != nil
+}
+
+// Redact returns a copy of a value with the configured fields masked. Values other than the
+// generic maps and arrays parsed from JSON are converted through JSON. The value itself is
+// returned if redaction is not configured
+func Redact(value interface{}) interface{} {
+	p := currentRedactionPolicy()
+	if p == nil || value == nil {
+		return value
+	}
+	switch value.(type) {
+	case map[string]interface{}, []interface{}:
+	default:
+		b, err := json.Marshal(value)
+		if err != nil {
+			return value
+		}
+		var generic interface{}
+		if err := json.Unmarshal(b, &generic); err != nil {
+			return value
+		}
+		value = generic
+	}
+	return p.redact(value, nil)
+}
+
+// RedactJSON masks the configured fields in a JSON payload. Payloads that are not JSON are
+// returned unchanged
+func RedactJSON(payload []byte) []byte {
+	if !RedactionEnabled() {
+		return payload
+	}
+	var generic interface{}
+	if err := json.Unmarshal(payload, &generic); err != nil {
+		return payload
+	}
+	redacted, _ := json.Marshal(Redact(generic))
+	return redacted
+}
+
+// RedactParams masks the parameters of a method that are configured to be redacted, using the
+// names of its inputs in order
+func RedactParams(names []string, params []interface{}) []interface{} {
+	p := currentRedactionPolicy()
+	if p == nil || params == nil {
+		return params
+	}
+	return p.redactParams(names, params, nil)
+}
+
+// RedactParam masks a single parameter of a method, if its name is configured to be redacted
+func RedactParam(name string, value interface{}) interface{} {
+	p := currentRedactionPolicy()
+	if p == nil {
+		return value
+	}
+	path := []string{strings.ToLower(name)}
+	if p.matches(path) {
+		return p.mask
+	}
+	return p.redact(value, path)
+}
+
+func (p *redactionPolicy) matches(path []string) bool {
+	if len(path) > 0 && p.names[path[len(path)-1]] {
+		return true
+	}
+	for _, match := range p.paths {
+		if len(match) != len(path) {
+			continue
+		}
+		matched := true
+		for i, segment := range match {
+			if segment != "*" && segment != path[i] {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *redactionPolicy) redact(value interface{}, path []string) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		redacted := make(map[string]interface{}, len(v))
+		for name, child := range v {
+			childPath := append(append([]string{}, path...), strings.ToLower(name))
+			if p.matches(childPath) {
+				redacted[name] = p.mask
+			} else {
+				redacted[name] = p.redact(child, childPath)
+			}
+		}
+		// The positional parameters of a message are matched by the inputs of its method
+		if params, ok := v["params"].([]interface{}); ok && !p.matches(append(append([]string{}, path...), "params")) {
+			if names := methodInputNames(v["method"]); names != nil {
+				redacted["params"] = p.redactParams(names, params, append(append([]string{}, path...), "params"))
+			}
+		}
+		return redacted
+	case []interface{}:
+		redacted := make([]interface{}, len(v))
+		for i, child := range v {
+			redacted[i] = p.redact(child, path)
+		}
+		return redacted
+	}
+	return value
+}
+
+func (p *redactionPolicy) redactParams(names []string, params []interface{}, path []string) []interface{} {
+	redacted := make([]interface{}, len(params))
+	for i, param := range params {
+		if i >= len(names) || names[i] == "" {
+			redacted[i] = p.redact(param, path)
+			continue
+		}
+		paramPath := append(append([]string{}, path...), strings.ToLower(names[i]))
+		if p.matches(paramPath) {
+			redacted[i] = p.mask
+		} else {
+			redacted[i] = p.redact(param, paramPath)
+		}
+	}
+	return redacted
+}
+
+// methodInputNames returns the names of the inputs of a method in the ABI JSON format
+func methodInputNames(method interface{}) []string {
+	m, ok := method.(map[string]interface{})
+	if !ok {
+		return nil
+	}
+	inputs, ok := m["inputs"].([]interface{})
+	if !ok {
+		return nil
+	}
+	names := make([]string, len(inputs))
+	for i, input := range inputs {
+		if inputMap, ok := input.(map[string]interface{}); ok {
+			names[i], _ = inputMap["name"].(string)
+		}
+	}
+	return names
+}
@@ -0,0 +1,119 @@
+// Copyright 2021 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package utils
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRedactionDisabled(t *testing.T) {
+	assert := assert.New(t)
+	assert.NoError(ConfigureRedaction(&RedactionConf{}))
+	assert.False(RedactionEnabled())
+
+	value := map[string]interface{}{"email": "someone@example.com"}
+	assert.Equal(value, Redact(value))
+	assert.Equal([]byte(`{"email":"someone@example.com"}`), RedactJSON([]byte(`{"email":"someone@example.com"}`)))
+	assert.Equal([]interface{}{"a"}, RedactParams([]string{"email"}, []interface{}{"a"}))
+	assert.Equal("a", RedactParam("email", "a"))
+}
+
+func TestRedactionBadField(t *testing.T) {
+	assert := assert.New(t)
+	err := ConfigureRedaction(&RedactionConf{Fields: []string{"data..email"}})
+	assert.EqualError(err, "Invalid redaction field 'data..email'")
+	assert.False(RedactionEnabled())
+}
+
+func TestRedactionNamesAndPaths(t *testing.T) {
+	assert := assert.New(t)
+	err := ConfigureRedaction(&RedactionConf{Fields: []string{"Email", "events.data.ssn", "*.secret"}})
+	assert.NoError(err)
+	defer ConfigureRedaction(nil)
+	assert.True(RedactionEnabled())
+
+	value := map[string]interface{}{
+		"headers": map[string]interface{}{"id": "123", "secret": "abc"},
+		"email":   "top@example.com",
+		"events": []interface{}{
+			map[string]interface{}{"data": map[string]interface{}{"ssn": "111", "EMAIL": "nested@example.com", "amount": "10"}},
+			map[string]interface{}{"data": map[string]interface{}{"ssn": "222"}},
+		},
+		"ssn":    "333",
+		"secret": "def",
+	}
+	redacted := Redact(value)
+	assert.Equal(map[string]interface{}{
+		"headers": map[string]interface{}{"id": "123", "secret": "***"},
+		"email":   "***",
+		"events": []interface{}{
+			map[string]interface{}{"data": map[string]interface{}{"ssn": "***", "EMAIL": "***", "amount": "10"}},
+			map[string]interface{}{"data": map[string]interface{}{"ssn": "***"}},
+		},
+		"ssn":    "333",
+		"secret": "def",
+	}, redacted)
+	// The original is unchanged
+	assert.Equal("top@example.com", value["email"])
+}
+
+func TestRedactionMessageParams(t *testing.T) {
+	assert := assert.New(t)
+	err := ConfigureRedaction(&RedactionConf{Fields: []string{"email"}, Mask: "<redacted>"})
+	assert.NoError(err)
+	defer ConfigureRedaction(nil)
+
+	type testMsg struct {
+		Method map[string]interface{} `json:"method"`
+		Params []interface{}          `json:"params"`
+	}
+	msg := &testMsg{
+		Method: map[string]interface{}{
+			"name": "register",
+			"inputs": []interface{}{
+				map[string]interface{}{"name": "id", "type": "uint256"},
+				map[string]interface{}{"name": "email", "type": "string"},
+			},
+		},
+		Params: []interface{}{"1", "someone@example.com", "extra"},
+	}
+	redacted := Redact(msg).(map[string]interface{})
+	assert.Equal([]interface{}{"1", "<redacted>", "extra"}, redacted["params"])
+
+	b := RedactJSON([]byte(`{"method":{"inputs":[{"name":"email"}]},"params":["someone@example.com"]}`))
+	var parsed map[string]interface{}
+	assert.NoError(json.Unmarshal(b, &parsed))
+	assert.Equal([]interface{}{"<redacted>"}, parsed["params"])
+
+	assert.Equal([]byte("not json"), RedactJSON([]byte("not json")))
+	assert.Equal([]interface{}{"1", "<redacted>"}, RedactParams([]string{"id", "email"}, []interface{}{"1", "someone@example.com"}))
+	assert.Equal("<redacted>", RedactParam("Email", "someone@example.com"))
+	assert.Equal(map[string]interface{}{"email": "<redacted>"}, RedactParam("person", map[string]interface{}{"email": "a"}))
+}
+
+func TestRedactionUnserializable(t *testing.T) {
+	assert := assert.New(t)
+	err := ConfigureRedaction(&RedactionConf{Fields: []string{"email"}})
+	assert.NoError(err)
+	defer ConfigureRedaction(nil)
+
+	ch := make(chan bool)
+	assert.Equal(ch, Redact(ch))
+	assert.Nil(Redact(nil))
+	assert.Equal("value", Redact("value"))
+}
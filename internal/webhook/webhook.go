@@ -0,0 +1,184 @@
+// Copyright 2021 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/kaleido-io/ethconnect/internal/errors"
+	"github.com/kaleido-io/ethconnect/internal/tracing"
+	"github.com/kaleido-io/ethconnect/internal/utils"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// SignatureHeader is the header containing the HMAC-SHA256 signature of the body of a
+	// webhook, when the destination has a secret. It is also checked on webhooks received
+	SignatureHeader = "X-Ethconnect-Signature"
+)
+
+// Sign returns the HMAC-SHA256 signature of a body, in the form "sha256=<hex>"
+func Sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Verify checks a signature in the form returned by Sign, in constant time
+func Verify(secret string, body []byte, signature string) bool {
+	return hmac.Equal([]byte(Sign(secret, body)), []byte(signature))
+}
+
+// Sender posts JSON bodies to a webhook. Each call to Post is a single attempt, and
+// Backoff.Retry is used to retry
+type Sender struct {
+	Name    string
+	URL     string
+	Headers map[string]string
+	Secret  string
+	client  *http.Client
+}
+
+// NewSender returns a sender with its own HTTP client, subject to the egress policy
+func NewSender(name, url string, headers map[string]string, secret string, tlsSkipHostVerify bool, timeout time.Duration) *Sender {
+	return &Sender{
+		Name:    name,
+		URL:     url,
+		Headers: headers,
+		Secret:  secret,
+		client: &http.Client{
+			Timeout: timeout,
+			Transport: utils.EgressTransport(&http.Transport{
+				Proxy: http.ProxyFromEnvironment,
+				DialContext: (&net.Dialer{
+					Timeout:   30 * time.Second,
+					KeepAlive: 30 * time.Second,
+				}).DialContext,
+				MaxIdleConns:          100,
+				IdleConnTimeout:       90 * time.Second,
+				TLSHandshakeTimeout:   10 * time.Second,
+				ExpectContinueTimeout: 1 * time.Second,
+				TLSClientConfig:       &tls.Config{InsecureSkipVerify: tlsSkipHostVerify},
+			}),
+		},
+	}
+}
+
+// Post sends a body, signing it if the sender has a secret. Any headers are set after the
+// configured headers. The trace of the context is propagated. The status is zero if no
+// response was received, and a status outside of 2xx is returned as an error
+func (s *Sender) Post(ctx context.Context, body []byte, headers map[string]string) (status int, err error) {
+	req, err := http.NewRequest("POST", s.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	tracing.Inject(ctx, req.Header)
+	for h, v := range s.Headers {
+		req.Header.Set(h, v)
+	}
+	for h, v := range headers {
+		req.Header.Set(h, v)
+	}
+	if s.Secret != "" {
+		req.Header.Set(SignatureHeader, Sign(s.Secret, body))
+	}
+	log.Infof("%s: POST --> %s", s.Name, s.URL)
+	res, err := s.client.Do(req.WithContext(ctx))
+	if err != nil {
+		log.Errorf("%s: POST %s failed: %s", s.Name, s.URL, err)
+		return 0, err
+	}
+	defer res.Body.Close()
+	ok := res.StatusCode >= 200 && res.StatusCode < 300
+	log.Infof("%s: POST <-- %s [%d] ok=%t", s.Name, s.URL, res.StatusCode, ok)
+	if !ok || log.IsLevelEnabled(log.DebugLevel) {
+		bodyBytes, _ := ioutil.ReadAll(res.Body)
+		log.Infof("%s: Response body: %s", s.Name, string(bodyBytes))
+	}
+	if !ok {
+		return res.StatusCode, errors.Errorf(errors.WebhookFailedHTTPStatus, s.Name, res.StatusCode)
+	}
+	return res.StatusCode, nil
+}
+
+// Backoff is the exponential backoff between the attempts of a delivery. The delay starts at
+// InitialDelay, and is multiplied by Factor after each attempt up to MaxDelay, if set. Jitter
+// is the fraction of each delay that is randomized. MaxRetries limits the attempts, if set
+type Backoff struct {
+	InitialDelay time.Duration
+	MaxDelay     time.Duration
+	Factor       float64
+	Jitter       float64
+	MaxRetries   uint64
+}
+
+// Wait is the time to wait before the next attempt, with the jitter applied
+func (b *Backoff) Wait(delay time.Duration) time.Duration {
+	if b.Jitter > 0 {
+		return time.Duration(float64(delay) * (1 - b.Jitter*rand.Float64()))
+	}
+	return delay
+}
+
+// Next backs off the delay, up to the maximum
+func (b *Backoff) Next(delay time.Duration) time.Duration {
+	delay = time.Duration(float64(delay) * b.Factor)
+	if b.MaxDelay > 0 && delay > b.MaxDelay {
+		delay = b.MaxDelay
+	}
+	return delay
+}
+
+// Exhausted is true once an attempt is past the maximum number of retries
+func (b *Backoff) Exhausted(attempt uint64) bool {
+	return b.MaxRetries > 0 && attempt > b.MaxRetries
+}
+
+// Retry makes attempts until one succeeds, the timeout passes, or the retries are exhausted,
+// returning the number of attempts and the error of the last. It stops waiting to retry if
+// interrupt is closed, and stops before an attempt if stopped returns true
+func (b *Backoff) Retry(name string, timeout time.Duration, interrupt <-chan struct{}, stopped func() bool, attempt func(attempt uint64) error) (attempts uint64, err error) {
+	endTime := time.Now().Add(timeout)
+	delay := b.InitialDelay
+	for stopped == nil || !stopped() {
+		if attempts > 0 {
+			wait := b.Wait(delay)
+			log.Infof("%s: Waiting %.2fs before re-attempting delivery", name, wait.Seconds())
+			select {
+			case <-interrupt:
+				log.Infof("%s: Interrupted while waiting to re-attempt delivery", name)
+				return attempts, err
+			case <-time.After(wait):
+			}
+			delay = b.Next(delay)
+		}
+		attempts++
+		if err = attempt(attempts); err == nil || time.Until(endTime) < 0 || b.Exhausted(attempts) {
+			break
+		}
+	}
+	return attempts, err
+}
@@ -0,0 +1,161 @@
+// Copyright 2021 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package webhook
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSignAndVerify(t *testing.T) {
+	assert := assert.New(t)
+	mac := hmac.New(sha256.New, []byte("s3cret"))
+	mac.Write([]byte("body"))
+	sig := Sign("s3cret", []byte("body"))
+	assert.Equal("sha256="+hex.EncodeToString(mac.Sum(nil)), sig)
+	assert.True(Verify("s3cret", []byte("body"), sig))
+	assert.False(Verify("wrong", []byte("body"), sig))
+	assert.False(Verify("s3cret", []byte("body"), "sha256=00"))
+}
+
+func TestSenderPost(t *testing.T) {
+	assert := assert.New(t)
+	status := 200
+	server := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		assert.Equal(`{"a":1}`, string(body))
+		assert.Equal("application/json", req.Header.Get("Content-Type"))
+		assert.Equal("value1", req.Header.Get("x-custom"))
+		assert.Equal("value2", req.Header.Get("x-extra"))
+		assert.True(Verify("s3cret", body, req.Header.Get(SignatureHeader)))
+		res.WriteHeader(status)
+		res.Write([]byte(`{}`))
+	}))
+	defer server.Close()
+
+	s := NewSender("hook1", server.URL, map[string]string{"x-custom": "value1"}, "s3cret", false, 5*time.Second)
+	code, err := s.Post(context.Background(), []byte(`{"a":1}`), map[string]string{"x-extra": "value2"})
+	assert.NoError(err)
+	assert.Equal(200, code)
+
+	status = 500
+	code, err = s.Post(context.Background(), []byte(`{"a":1}`), map[string]string{"x-extra": "value2"})
+	assert.EqualError(err, "hook1: Failed with status=500")
+	assert.Equal(500, code)
+}
+
+func TestSenderPostUnsigned(t *testing.T) {
+	assert := assert.New(t)
+	server := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		assert.Empty(req.Header.Get(SignatureHeader))
+		res.WriteHeader(204)
+	}))
+	defer server.Close()
+
+	s := NewSender("hook1", server.URL, nil, "", false, 5*time.Second)
+	code, err := s.Post(context.Background(), []byte(`{}`), nil)
+	assert.NoError(err)
+	assert.Equal(204, code)
+}
+
+func TestSenderPostFailures(t *testing.T) {
+	assert := assert.New(t)
+	s := NewSender("hook1", ":bad", nil, "", false, 5*time.Second)
+	code, err := s.Post(context.Background(), []byte(`{}`), nil)
+	assert.Error(err)
+	assert.Zero(code)
+
+	server := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {}))
+	server.Close()
+	s = NewSender("hook1", server.URL, nil, "", false, 5*time.Second)
+	code, err = s.Post(context.Background(), []byte(`{}`), nil)
+	assert.Error(err)
+	assert.Zero(code)
+}
+
+func TestBackoff(t *testing.T) {
+	assert := assert.New(t)
+	b := &Backoff{InitialDelay: 10 * time.Millisecond, Factor: 3}
+	assert.Equal(30*time.Millisecond, b.Next(10*time.Millisecond))
+	assert.Equal(10*time.Millisecond, b.Wait(10*time.Millisecond))
+	assert.False(b.Exhausted(100))
+
+	b = &Backoff{InitialDelay: 10 * time.Millisecond, MaxDelay: 25 * time.Millisecond, Factor: 3, Jitter: 0.5, MaxRetries: 2}
+	assert.Equal(25*time.Millisecond, b.Next(10*time.Millisecond))
+	for i := 0; i < 10; i++ {
+		wait := b.Wait(10 * time.Millisecond)
+		assert.True(wait >= 5*time.Millisecond && wait <= 10*time.Millisecond)
+	}
+	assert.False(b.Exhausted(2))
+	assert.True(b.Exhausted(3))
+}
+
+func TestBackoffRetry(t *testing.T) {
+	assert := assert.New(t)
+	b := &Backoff{InitialDelay: 1 * time.Millisecond, Factor: 2}
+
+	// Succeeds on the third attempt
+	attempts, err := b.Retry("test", time.Minute, nil, nil, func(attempt uint64) error {
+		if attempt < 3 {
+			return fmt.Errorf("pop")
+		}
+		return nil
+	})
+	assert.NoError(err)
+	assert.Equal(uint64(3), attempts)
+
+	// Gives up after the timeout
+	attempts, err = b.Retry("test", 5*time.Millisecond, nil, nil, func(attempt uint64) error {
+		return fmt.Errorf("pop%d", attempt)
+	})
+	assert.EqualError(err, fmt.Sprintf("pop%d", attempts))
+
+	// Gives up once the retries are exhausted
+	b.MaxRetries = 2
+	attempts, err = b.Retry("test", time.Minute, nil, nil, func(attempt uint64) error {
+		return fmt.Errorf("pop")
+	})
+	assert.EqualError(err, "pop")
+	assert.Equal(uint64(3), attempts)
+}
+
+func TestBackoffRetryInterruptedOrStopped(t *testing.T) {
+	assert := assert.New(t)
+	b := &Backoff{InitialDelay: time.Minute, Factor: 2}
+
+	interrupt := make(chan struct{})
+	close(interrupt)
+	attempts, err := b.Retry("test", time.Hour, interrupt, nil, func(attempt uint64) error {
+		return fmt.Errorf("pop")
+	})
+	assert.EqualError(err, "pop")
+	assert.Equal(uint64(1), attempts)
+
+	attempts, err = b.Retry("test", time.Hour, nil, func() bool { return true }, func(attempt uint64) error {
+		return fmt.Errorf("pop")
+	})
+	assert.NoError(err)
+	assert.Zero(attempts)
+}
@@ -0,0 +1,150 @@
+// Copyright 2021 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ws
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"math"
+	"sort"
+
+	"github.com/kaleido-io/ethconnect/internal/errors"
+)
+
+const (
+	// EncodingJSON is the default encoding of payloads as JSON text frames
+	EncodingJSON = "json"
+	// EncodingMsgPack encodes payloads as MessagePack binary frames
+	EncodingMsgPack = "msgpack"
+)
+
+// JSONOnlyPayload is implemented by payloads that are signed over their JSON encoding, such as
+// signed event batches. These are always sent as JSON text frames, even on connections that
+// negotiated MessagePack, as re-encoding them would invalidate the signature
+type JSONOnlyPayload interface {
+	JSONOnly() bool
+}
+
+// requiresJSON returns true if a payload, or the payload of a topic frame, must be sent as JSON
+func requiresJSON(payload interface{}) bool {
+	if frame, ok := payload.(*webSocketTopicFrame); ok {
+		payload = frame.Payload
+	}
+	jo, ok := payload.(JSONOnlyPayload)
+	return ok && jo.JSONOnly()
+}
+
+// marshalMsgPack encodes any JSON serializable value as MessagePack.
+// The value is first serialized using its JSON marshaling, so the field names
+// and formatting (such as numbers held as strings) match the JSON payloads exactly.
+func marshalMsgPack(v interface{}) ([]byte, error) {
+	jsonBytes, err := json.Marshal(v)
+	if err != nil {
+		return nil, errors.Errorf(errors.WebSocketMsgPackEncodeFailed, err)
+	}
+	dec := json.NewDecoder(bytes.NewReader(jsonBytes))
+	dec.UseNumber()
+	var generic interface{}
+	if err = dec.Decode(&generic); err != nil {
+		return nil, errors.Errorf(errors.WebSocketMsgPackEncodeFailed, err)
+	}
+	buf := &bytes.Buffer{}
+	writeMsgPackValue(buf, generic)
+	return buf.Bytes(), nil
+}
+
+func writeMsgPackValue(buf *bytes.Buffer, v interface{}) {
+	switch tv := v.(type) {
+	case nil:
+		buf.WriteByte(0xc0)
+	case bool:
+		if tv {
+			buf.WriteByte(0xc3)
+		} else {
+			buf.WriteByte(0xc2)
+		}
+	case json.Number:
+		writeMsgPackNumber(buf, tv)
+	case string:
+		writeMsgPackString(buf, tv)
+	case []interface{}:
+		writeMsgPackHeader(buf, len(tv), 0x90, 0x0f, 0xdc, 0xdd)
+		for _, e := range tv {
+			writeMsgPackValue(buf, e)
+		}
+	case map[string]interface{}:
+		// Sort the keys for a deterministic encoding
+		keys := make([]string, 0, len(tv))
+		for k := range tv {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		writeMsgPackHeader(buf, len(keys), 0x80, 0x0f, 0xde, 0xdf)
+		for _, k := range keys {
+			writeMsgPackString(buf, k)
+			writeMsgPackValue(buf, tv[k])
+		}
+	}
+}
+
+func writeMsgPackHeader(buf *bytes.Buffer, l int, fixPrefix byte, fixMax int, prefix16, prefix32 byte) {
+	switch {
+	case l <= fixMax:
+		buf.WriteByte(fixPrefix | byte(l))
+	case l <= math.MaxUint16:
+		buf.WriteByte(prefix16)
+		binary.Write(buf, binary.BigEndian, uint16(l))
+	default:
+		buf.WriteByte(prefix32)
+		binary.Write(buf, binary.BigEndian, uint32(l))
+	}
+}
+
+func writeMsgPackString(buf *bytes.Buffer, s string) {
+	l := len(s)
+	switch {
+	case l <= 31:
+		buf.WriteByte(0xa0 | byte(l))
+	case l <= math.MaxUint8:
+		buf.WriteByte(0xd9)
+		buf.WriteByte(byte(l))
+	default:
+		writeMsgPackHeader(buf, l, 0, -1, 0xda, 0xdb)
+	}
+	buf.WriteString(s)
+}
+
+func writeMsgPackNumber(buf *bytes.Buffer, n json.Number) {
+	if i, err := n.Int64(); err == nil {
+		switch {
+		case i >= 0 && i <= 127:
+			buf.WriteByte(byte(i))
+		case i < 0 && i >= -32:
+			buf.WriteByte(byte(int8(i)))
+		case i >= 0:
+			buf.WriteByte(0xcf)
+			binary.Write(buf, binary.BigEndian, uint64(i))
+		default:
+			buf.WriteByte(0xd3)
+			binary.Write(buf, binary.BigEndian, i)
+		}
+		return
+	}
+	// Anything that does not fit in an int64 is encoded as a double
+	f, _ := n.Float64()
+	buf.WriteByte(0xcb)
+	binary.Write(buf, binary.BigEndian, math.Float64bits(f))
+}
@@ -0,0 +1,99 @@
+// Copyright 2021 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ws
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMarshalMsgPackScalars(t *testing.T) {
+	assert := assert.New(t)
+
+	b, err := marshalMsgPack(nil)
+	assert.NoError(err)
+	assert.Equal([]byte{0xc0}, b)
+
+	b, err = marshalMsgPack(true)
+	assert.NoError(err)
+	assert.Equal([]byte{0xc3}, b)
+
+	b, err = marshalMsgPack(false)
+	assert.NoError(err)
+	assert.Equal([]byte{0xc2}, b)
+
+	b, err = marshalMsgPack(5)
+	assert.NoError(err)
+	assert.Equal([]byte{0x05}, b)
+
+	b, err = marshalMsgPack(-1)
+	assert.NoError(err)
+	assert.Equal([]byte{0xff}, b)
+
+	b, err = marshalMsgPack(256)
+	assert.NoError(err)
+	assert.Equal([]byte{0xcf, 0, 0, 0, 0, 0, 0, 0x01, 0x00}, b)
+
+	b, err = marshalMsgPack(-256)
+	assert.NoError(err)
+	assert.Equal([]byte{0xd3, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x00}, b)
+
+	b, err = marshalMsgPack(1.5)
+	assert.NoError(err)
+	assert.Equal([]byte{0xcb, 0x3f, 0xf8, 0, 0, 0, 0, 0, 0}, b)
+
+	b, err = marshalMsgPack("abc")
+	assert.NoError(err)
+	assert.Equal([]byte{0xa3, 'a', 'b', 'c'}, b)
+
+	b, err = marshalMsgPack(strings.Repeat("a", 32))
+	assert.NoError(err)
+	assert.Equal([]byte{0xd9, 32}, b[0:2])
+	assert.Len(b, 34)
+
+	b, err = marshalMsgPack(strings.Repeat("a", 256))
+	assert.NoError(err)
+	assert.Equal([]byte{0xda, 0x01, 0x00}, b[0:3])
+	assert.Len(b, 259)
+}
+
+func TestMarshalMsgPackObjects(t *testing.T) {
+	assert := assert.New(t)
+
+	b, err := marshalMsgPack(map[string]interface{}{
+		"b": []string{"x"},
+		"a": 1,
+	})
+	assert.NoError(err)
+	assert.Equal([]byte{
+		0x82,
+		0xa1, 'a', 0x01,
+		0xa1, 'b', 0x91, 0xa1, 'x',
+	}, b)
+
+	b, err = marshalMsgPack(make([]int, 16))
+	assert.NoError(err)
+	assert.Equal([]byte{0xdc, 0x00, 0x10}, b[0:3])
+	assert.Len(b, 19)
+}
+
+func TestMarshalMsgPackBadJSON(t *testing.T) {
+	assert := assert.New(t)
+
+	_, err := marshalMsgPack(map[bool]bool{false: true})
+	assert.Regexp("Failed to encode MessagePack payload", err)
+}
@@ -15,7 +15,9 @@
 package ws
 
 import (
+	"context"
 	"reflect"
+	"sort"
 	"strings"
 	"sync"
 	"time"
@@ -23,47 +25,158 @@ import (
 	ws "github.com/gorilla/websocket"
 	log "github.com/sirupsen/logrus"
 
+	"github.com/kaleido-io/ethconnect/internal/auth"
 	"github.com/kaleido-io/ethconnect/internal/errors"
 	"github.com/kaleido-io/ethconnect/internal/utils"
 )
 
+// Control frames are limited to 125 bytes, including the 2 byte close code
+const maxCloseReasonLen = 123
+
 type webSocketConnection struct {
-	id        string
-	server    *webSocketServer
-	conn      *ws.Conn
-	mux       sync.Mutex
-	closed    bool
-	topics    map[string]*webSocketTopic
-	broadcast chan interface{}
-	newTopic  chan bool
-	receive   chan error
-	closing   chan struct{}
+	id            string
+	server        *webSocketServer
+	conn          *ws.Conn
+	encoding      string
+	mux           sync.Mutex
+	closed        bool
+	authCtx       context.Context
+	authenticated bool
+	authTimer     *time.Timer
+	topics        map[string]*webSocketTopic
+	subscriptions map[string]*topicSubscription
+	broadcast     chan interface{}
+	newTopic      chan bool
+	receive       chan error
+	closing       chan struct{}
+	stats         connectionStats
+}
+
+type connectionStats struct {
+	connected        time.Time
+	lastActivity     time.Time
+	lastPong         time.Time
+	listeningReplies bool
+	messagesSent     uint64
+	messagesReceived uint64
+	pingsSent        uint64
+	pongsReceived    uint64
+}
+
+// ConnectionStats is the serializable set of statistics for a connection
+type ConnectionStats struct {
+	ID                  string               `json:"id"`
+	RemoteAddr          string               `json:"remoteAddr"`
+	Encoding            string               `json:"encoding"`
+	Authenticated       bool                 `json:"authenticated"`
+	Topics              []string             `json:"topics"`
+	ListeningReplies    bool                 `json:"listeningReplies"`
+	ConnectedISO8601    string               `json:"connected"`
+	LastActivityISO8601 string               `json:"lastActivity"`
+	LastPongISO8601     string               `json:"lastPong,omitempty"`
+	MessagesSent        uint64               `json:"messagesSent"`
+	MessagesReceived    uint64               `json:"messagesReceived"`
+	PingsSent           uint64               `json:"pingsSent"`
+	PongsReceived       uint64               `json:"pongsReceived"`
+	Subscriptions       []*SubscriptionStats `json:"subscriptions,omitempty"`
+	connected           time.Time
+}
+
+// SubscriptionStats is the serializable delivery state of a subscribed topic
+type SubscriptionStats struct {
+	Topic string `json:"topic"`
+	Sent  uint64 `json:"sent"`
+	Acked uint64 `json:"acked"`
 }
 
 type webSocketCommandMessage struct {
-	Type    string `json:"type,omitempty"`
-	Topic   string `json:"topic,omitempty"`
-	Message string `json:"message,omitempty"`
+	Type     string `json:"type,omitempty"`
+	Topic    string `json:"topic,omitempty"`
+	Sequence uint64 `json:"sequence,omitempty"`
+	Message  string `json:"message,omitempty"`
+	Token    string `json:"token,omitempty"`
+}
+
+// topicSubscription tracks delivery on a topic subscribed with a "subscribe" message.
+// Many topics can be multiplexed on one connection this way, so each message is framed
+// with its topic and a sequence number, which the client must return in its ack or error
+type topicSubscription struct {
+	sent  uint64
+	acked uint64
+}
+
+// webSocketTopicFrame is sent on subscribed topics, with a type of "subscribed", "unsubscribed",
+// "message" (which must be acknowledged), "broadcast" or "error"
+type webSocketTopicFrame struct {
+	Type     string      `json:"type"`
+	Topic    string      `json:"topic"`
+	Sequence uint64      `json:"sequence,omitempty"`
+	Payload  interface{} `json:"payload,omitempty"`
+	Message  string      `json:"message,omitempty"`
+}
+
+type webSocketAuthReply struct {
+	Type    string `json:"type"`
+	Expires string `json:"expires,omitempty"`
 }
 
-func newConnection(server *webSocketServer, conn *ws.Conn) *webSocketConnection {
+func newConnection(server *webSocketServer, conn *ws.Conn, ctx context.Context) *webSocketConnection {
 	wsc := &webSocketConnection{
-		id:        utils.UUIDv4(),
-		server:    server,
-		conn:      conn,
-		newTopic:  make(chan bool),
-		topics:    make(map[string]*webSocketTopic),
-		broadcast: make(chan interface{}),
-		receive:   make(chan error),
-		closing:   make(chan struct{}),
+		id:            utils.UUIDv4(),
+		server:        server,
+		conn:          conn,
+		encoding:      EncodingJSON,
+		authCtx:       ctx,
+		newTopic:      make(chan bool),
+		topics:        make(map[string]*webSocketTopic),
+		subscriptions: make(map[string]*topicSubscription),
+		broadcast:     make(chan interface{}),
+		receive:       make(chan error),
+		closing:       make(chan struct{}),
+	}
+	if conn.Subprotocol() == EncodingMsgPack {
+		wsc.encoding = EncodingMsgPack
+	}
+	wsc.stats.connected = time.Now().UTC()
+	wsc.stats.lastActivity = wsc.stats.connected
+	if maxMessageSize := server.conf.MaxMessageSize; maxMessageSize > 0 {
+		conn.SetReadLimit(maxMessageSize)
+	}
+	pingInterval, pongTimeout := server.pingInterval(), server.pongTimeout()
+	if pingInterval > 0 {
+		// Each pong extends the read deadline, so a connection that is silently
+		// dropped by an intermediary is detected and closed
+		readTimeout := pingInterval + pongTimeout
+		conn.SetReadDeadline(time.Now().Add(readTimeout))
+		conn.SetPongHandler(func(string) error {
+			wsc.mux.Lock()
+			wsc.stats.pongsReceived++
+			wsc.stats.lastPong = time.Now().UTC()
+			wsc.mux.Unlock()
+			return conn.SetReadDeadline(time.Now().Add(readTimeout))
+		})
+	}
+	// Connections that did not supply a token on the upgrade request must
+	// send an "auth" message before any other command
+	wsc.authenticated = !auth.IsSecurityModuleEnabled() || auth.GetAuthContext(ctx) != nil
+	if wsc.authenticated {
+		wsc.scheduleTokenExpiry()
+	} else {
+		wsc.authTimer = time.AfterFunc(server.authTimeout, func() {
+			wsc.closeWithReason(ws.ClosePolicyViolation, errors.Errorf(errors.WebSocketAuthTimeout, server.authTimeout.Seconds()))
+		})
 	}
 	go wsc.listen()
 	go wsc.sender()
+	go wsc.keepalive(pingInterval, server.idleTimeout())
 	return wsc
 }
 
 func (c *webSocketConnection) close() {
 	c.mux.Lock()
+	if c.authTimer != nil {
+		c.authTimer.Stop()
+	}
 	if !c.closed {
 		c.closed = true
 		c.conn.Close()
@@ -78,15 +191,176 @@ func (c *webSocketConnection) close() {
 	log.Infof("WS/%s: Disconnected", c.id)
 }
 
+// closeWithReason sends a close frame with a reason to the client, before closing
+func (c *webSocketConnection) closeWithReason(code int, err error) {
+	log.Errorf("WS/%s: Closing: %s", c.id, err)
+	reason := err.Error()
+	if len(reason) > maxCloseReasonLen {
+		reason = reason[0:maxCloseReasonLen]
+	}
+	c.conn.WriteControl(ws.CloseMessage, ws.FormatCloseMessage(code, reason), time.Now().Add(time.Second))
+	c.close()
+}
+
+// scheduleTokenExpiry closes the connection when the token expires, if the security
+// module reports an expiry. Must be called with the lock held, or before the connection is shared
+func (c *webSocketConnection) scheduleTokenExpiry() {
+	if c.authTimer != nil {
+		c.authTimer.Stop()
+		c.authTimer = nil
+	}
+	if expiry, ok := auth.GetTokenExpiry(c.authCtx); ok {
+		c.authTimer = time.AfterFunc(time.Until(expiry), func() {
+			c.closeWithReason(ws.ClosePolicyViolation, errors.Errorf(errors.WebSocketAuthExpired))
+		})
+	}
+}
+
+// authenticate verifies a token supplied in an "auth" message. This is used both for the
+// first message on connections that did not authenticate on upgrade, and to refresh a token
+// before it expires on a connection that is already authenticated, for the same principal and tenant
+func (c *webSocketConnection) authenticate(token string) error {
+	authCtx, err := auth.WithAuthContext(context.Background(), token)
+	if err != nil {
+		return err
+	}
+	c.mux.Lock()
+	// A refreshed token must be for the same caller, so the connection cannot change identity
+	if c.authenticated && auth.GetAuthContext(c.authCtx) != nil &&
+		(auth.GetSubject(authCtx) != auth.GetSubject(c.authCtx) || auth.GetTenant(authCtx) != auth.GetTenant(c.authCtx)) {
+		c.mux.Unlock()
+		return errors.Errorf(errors.WebSocketAuthIdentityChanged)
+	}
+	c.authCtx = authCtx
+	c.authenticated = true
+	c.scheduleTokenExpiry()
+	c.mux.Unlock()
+
+	reply := &webSocketAuthReply{Type: "authenticated"}
+	if expiry, ok := auth.GetTokenExpiry(authCtx); ok {
+		reply.Expires = expiry.UTC().Format(time.RFC3339)
+	}
+	c.sendFrame(reply)
+	return nil
+}
+
+// sendFrame queues a protocol message to the client, from outside the sender
+func (c *webSocketConnection) sendFrame(frame interface{}) {
+	select {
+	case c.broadcast <- frame:
+	case <-c.closing:
+	}
+}
+
+// keepalive sends pings at the configured interval, and closes connections that
+// have not sent or received any message within the idle timeout
+func (c *webSocketConnection) keepalive(pingInterval, idleTimeout time.Duration) {
+	tick := pingInterval
+	if tick <= 0 || (idleTimeout > 0 && idleTimeout < tick) {
+		tick = idleTimeout
+	}
+	if tick <= 0 {
+		return
+	}
+	ticker := time.NewTicker(tick)
+	defer ticker.Stop()
+	lastPing := time.Now()
+	for {
+		select {
+		case <-ticker.C:
+		case <-c.closing:
+			return
+		}
+		if idleTimeout > 0 {
+			c.mux.Lock()
+			idle := time.Since(c.stats.lastActivity)
+			c.mux.Unlock()
+			if idle >= idleTimeout {
+				c.closeWithReason(ws.CloseGoingAway, errors.Errorf(errors.WebSocketIdleTimeout, idle.Seconds()))
+				return
+			}
+		}
+		if pingInterval > 0 && time.Since(lastPing) >= pingInterval {
+			lastPing = time.Now()
+			if err := c.conn.WriteControl(ws.PingMessage, []byte{}, lastPing.Add(c.server.writeTimeout())); err != nil {
+				log.Errorf("WS/%s: Ping failed: %s", c.id, err)
+				c.close()
+				return
+			}
+			c.mux.Lock()
+			c.stats.pingsSent++
+			c.mux.Unlock()
+		}
+	}
+}
+
+func (c *webSocketConnection) recordActivity(sent bool) {
+	c.mux.Lock()
+	c.stats.lastActivity = time.Now().UTC()
+	if sent {
+		c.stats.messagesSent++
+	} else {
+		c.stats.messagesReceived++
+	}
+	c.mux.Unlock()
+}
+
+func (c *webSocketConnection) getStats() *ConnectionStats {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	stats := &ConnectionStats{
+		ID:                  c.id,
+		RemoteAddr:          c.conn.RemoteAddr().String(),
+		Encoding:            c.encoding,
+		Authenticated:       c.authenticated,
+		Topics:              make([]string, 0, len(c.topics)),
+		ListeningReplies:    c.stats.listeningReplies,
+		ConnectedISO8601:    c.stats.connected.Format(time.RFC3339Nano),
+		LastActivityISO8601: c.stats.lastActivity.Format(time.RFC3339Nano),
+		MessagesSent:        c.stats.messagesSent,
+		MessagesReceived:    c.stats.messagesReceived,
+		PingsSent:           c.stats.pingsSent,
+		PongsReceived:       c.stats.pongsReceived,
+		connected:           c.stats.connected,
+	}
+	if !c.stats.lastPong.IsZero() {
+		stats.LastPongISO8601 = c.stats.lastPong.Format(time.RFC3339Nano)
+	}
+	for topic := range c.topics {
+		stats.Topics = append(stats.Topics, topic)
+	}
+	sort.Strings(stats.Topics)
+	for topic, sub := range c.subscriptions {
+		stats.Subscriptions = append(stats.Subscriptions, &SubscriptionStats{
+			Topic: topic,
+			Sent:  sub.sent,
+			Acked: sub.acked,
+		})
+	}
+	sort.Slice(stats.Subscriptions, func(i, j int) bool {
+		return stats.Subscriptions[i].Topic < stats.Subscriptions[j].Topic
+	})
+	return stats
+}
+
+func (c *webSocketConnection) isAuthenticated() bool {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	return c.authenticated
+}
+
 func (c *webSocketConnection) sender() {
 	defer c.close()
+	var topics []string
 	buildCases := func() []reflect.SelectCase {
 		c.mux.Lock()
 		defer c.mux.Unlock()
+		topics = make([]string, 0, len(c.topics))
 		cases := make([]reflect.SelectCase, len(c.topics)+3)
 		i := 0
 		for _, t := range c.topics {
 			cases[i] = reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(t.senderChannel)}
+			topics = append(topics, t.topic)
 			i++
 		}
 		cases[i] = reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(c.broadcast)}
@@ -105,33 +379,132 @@ func (c *webSocketConnection) sender() {
 		}
 
 		if chosen == len(cases)-1 {
-			// Addition of a new topic
+			// Addition or removal of a topic
 			cases = buildCases()
 		} else {
 			// Message from one of the existing topics
-			c.conn.WriteJSON(value.Interface())
+			payload := value.Interface()
+			if chosen < len(topics) {
+				payload = c.deliveryFrame(topics[chosen], payload)
+			}
+			if err := c.write(payload); err != nil {
+				log.Errorf("WS/%s: Send failed: %s", c.id, err)
+			}
+		}
+	}
+}
+
+// deliveryFrame wraps a message that requires acknowledgement with its topic and the
+// next sequence number, if the topic was subscribed rather than listened to
+func (c *webSocketConnection) deliveryFrame(topic string, message interface{}) interface{} {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	sub, subscribed := c.subscriptions[topic]
+	if !subscribed {
+		return message
+	}
+	sub.sent++
+	return &webSocketTopicFrame{Type: "message", Topic: topic, Sequence: sub.sent, Payload: message}
+}
+
+// broadcastFrame wraps a broadcast message with its topic, if the topic was subscribed
+func (c *webSocketConnection) broadcastFrame(topic string, message interface{}) interface{} {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	if _, subscribed := c.subscriptions[topic]; !subscribed {
+		return message
+	}
+	return &webSocketTopicFrame{Type: "broadcast", Topic: topic, Payload: message}
+}
+
+// write sends a payload using the encoding negotiated on connection
+func (c *webSocketConnection) write(payload interface{}) (err error) {
+	if writeTimeout := c.server.writeTimeout(); writeTimeout > 0 {
+		c.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+	}
+	if c.encoding == EncodingMsgPack && !requiresJSON(payload) {
+		var b []byte
+		if b, err = marshalMsgPack(payload); err == nil {
+			err = c.conn.WriteMessage(ws.BinaryMessage, b)
 		}
+	} else {
+		err = c.conn.WriteJSON(payload)
+	}
+	if err == nil {
+		c.recordActivity(true)
 	}
+	return err
 }
 
-func (c *webSocketConnection) listenTopic(t *webSocketTopic) {
+func (c *webSocketConnection) listenTopic(t *webSocketTopic, subscribe bool) {
 	c.mux.Lock()
 	c.topics[t.topic] = t
+	if _, subscribed := c.subscriptions[t.topic]; subscribe && !subscribed {
+		c.subscriptions[t.topic] = &topicSubscription{}
+	}
+	c.mux.Unlock()
 	c.server.ListenOnTopic(c, t.topic)
+	if subscribe {
+		c.sendFrame(&webSocketTopicFrame{Type: "subscribed", Topic: t.topic})
+	}
+	select {
+	case c.newTopic <- true:
+	case <-c.closing:
+	}
+}
+
+func (c *webSocketConnection) unlistenTopic(t *webSocketTopic) {
+	c.mux.Lock()
+	sub := c.subscriptions[t.topic]
+	delete(c.topics, t.topic)
+	delete(c.subscriptions, t.topic)
 	c.mux.Unlock()
+	c.server.UnlistenOnTopic(c, t.topic)
 	select {
 	case c.newTopic <- true:
 	case <-c.closing:
+		return
 	}
+	if sub != nil && sub.sent > sub.acked {
+		// Fail the message awaiting our acknowledgement, so only the sender waiting on it redelivers
+		c.handleAckOrError(t, errors.Errorf(errors.WebSocketUnsubscribedInflight, t.topic))
+	}
+	c.sendFrame(&webSocketTopicFrame{Type: "unsubscribed", Topic: t.topic})
+}
+
+// checkSequence verifies an ack or error on a subscribed topic is for the message awaiting
+// acknowledgement. Otherwise the client is sent an error, and the response is discarded
+func (c *webSocketConnection) checkSequence(t *webSocketTopic, sequence uint64) bool {
+	var err error
+	c.mux.Lock()
+	if sub, subscribed := c.subscriptions[t.topic]; subscribed {
+		if sub.sent == sub.acked {
+			err = errors.Errorf(errors.WebSocketNoMessageInflight, t.topic)
+		} else if sequence != sub.sent {
+			err = errors.Errorf(errors.WebSocketAckSequenceMismatch, sequence, sub.sent, t.topic)
+		} else {
+			sub.acked = sequence
+		}
+	}
+	c.mux.Unlock()
+	if err != nil {
+		log.Errorf("WS/%s: Discarding response: %s", c.id, err)
+		c.sendFrame(&webSocketTopicFrame{Type: "error", Topic: t.topic, Sequence: sequence, Message: err.Error()})
+		return false
+	}
+	return true
 }
 
 func (c *webSocketConnection) listenReplies() {
+	c.mux.Lock()
+	c.stats.listeningReplies = true
+	c.mux.Unlock()
 	c.server.ListenForReplies(c)
 }
 
 func (c *webSocketConnection) listen() {
 	defer c.close()
-	log.Infof("WS/%s: Connected", c.id)
+	log.Infof("WS/%s: Connected (encoding=%s)", c.id, c.encoding)
 	for {
 		var msg webSocketCommandMessage
 		err := c.conn.ReadJSON(&msg)
@@ -139,18 +512,40 @@ func (c *webSocketConnection) listen() {
 			log.Errorf("WS/%s: Error: %s", c.id, err)
 			return
 		}
-		log.Debugf("WS/%s: Received: %+v", c.id, msg)
+		log.Debugf("WS/%s: Received: type=%s topic=%s", c.id, msg.Type, msg.Topic)
+		c.recordActivity(false)
+
+		msgType := strings.ToLower(msg.Type)
+		if msgType == "auth" {
+			if err := c.authenticate(msg.Token); err != nil {
+				c.closeWithReason(ws.ClosePolicyViolation, errors.Errorf(errors.WebSocketAuthFailed, err))
+				return
+			}
+			continue
+		}
+		if !c.isAuthenticated() {
+			c.closeWithReason(ws.ClosePolicyViolation, errors.Errorf(errors.WebSocketAuthRequired, msg.Type))
+			return
+		}
 
 		t := c.server.getTopic(msg.Topic)
-		switch strings.ToLower(msg.Type) {
+		switch msgType {
 		case "listen":
-			c.listenTopic(t)
+			c.listenTopic(t, false)
+		case "subscribe":
+			c.listenTopic(t, true)
+		case "unsubscribe":
+			c.unlistenTopic(t)
 		case "listenreplies":
 			c.listenReplies()
 		case "ack":
-			c.handleAckOrError(t, nil)
+			if c.checkSequence(t, msg.Sequence) {
+				c.handleAckOrError(t, nil)
+			}
 		case "error":
-			c.handleAckOrError(t, errors.Errorf(errors.EventStreamsWebSocketErrorFromClient, msg.Message))
+			if c.checkSequence(t, msg.Sequence) {
+				c.handleAckOrError(t, errors.Errorf(errors.EventStreamsWebSocketErrorFromClient, msg.Message))
+			}
 		default:
 			log.Errorf("WS/%s: Unexpected message type: %+v", c.id, msg)
 		}
@@ -15,8 +15,10 @@
 package ws
 
 import (
+	"encoding/json"
 	"net/http"
 	"reflect"
+	"sort"
 	"sync"
 	"time"
 
@@ -25,6 +27,22 @@ import (
 	log "github.com/sirupsen/logrus"
 )
 
+const (
+	defaultPingIntervalMS = 30000
+	defaultPongTimeoutMS  = 10000
+	defaultWriteTimeoutMS = 10000
+)
+
+// WebSocketServerConf configuration for keepalive and limits on WebSocket connections.
+// Set PingIntervalMS, WriteTimeoutMS or IdleTimeoutSec to a negative value to disable
+type WebSocketServerConf struct {
+	PingIntervalMS int   `json:"pingInterval,omitempty"`
+	PongTimeoutMS  int   `json:"pongTimeout,omitempty"`
+	WriteTimeoutMS int   `json:"writeTimeout,omitempty"`
+	MaxMessageSize int64 `json:"maxMessageSize,omitempty"`
+	IdleTimeoutSec int   `json:"idleTimeout,omitempty"`
+}
+
 // WebSocketChannels is provided to allow us to do a blocking send to a namespace that will complete once a client connects on it
 // We also provide a channel to listen on for closing of the connection, to allow a select to wake on a blocking send
 type WebSocketChannels interface {
@@ -40,7 +58,9 @@ type WebSocketServer interface {
 }
 
 type webSocketServer struct {
+	conf              *WebSocketServerConf
 	processingTimeout time.Duration
+	authTimeout       time.Duration
 	mux               sync.Mutex
 	topics            map[string]*webSocketTopic
 	topicMap          map[string]map[string]*webSocketConnection
@@ -59,9 +79,12 @@ type webSocketTopic struct {
 	closingChannel   chan struct{}
 }
 
-// NewWebSocketServer create a new server with a simplified interface
-func NewWebSocketServer() WebSocketServer {
+// NewWebSocketServer create a new server with a simplified interface.
+// The configuration is read as each connection is established, so can be
+// updated after the server is constructed
+func NewWebSocketServer(conf *WebSocketServerConf) WebSocketServer {
 	s := &webSocketServer{
+		conf:              conf,
 		connections:       make(map[string]*webSocketConnection),
 		topics:            make(map[string]*webSocketTopic),
 		topicMap:          make(map[string]map[string]*webSocketConnection),
@@ -69,9 +92,12 @@ func NewWebSocketServer() WebSocketServer {
 		newTopic:          make(chan bool),
 		replyChannel:      make(chan interface{}),
 		processingTimeout: 30 * time.Second,
+		authTimeout:       30 * time.Second,
 		upgrader: &websocket.Upgrader{
 			ReadBufferSize:  1024,
 			WriteBufferSize: 1024,
+			// Clients can negotiate a binary encoding using the WebSocket sub-protocol
+			Subprotocols: []string{EncodingMsgPack, EncodingJSON},
 		},
 	}
 	go s.processBroadcasts()
@@ -87,10 +113,66 @@ func (s *webSocketServer) handler(w http.ResponseWriter, r *http.Request, p http
 	}
 	s.mux.Lock()
 	defer s.mux.Unlock()
-	c := newConnection(s, conn)
+	c := newConnection(s, conn, r.Context())
 	s.connections[c.id] = c
 }
 
+// durationOrDefault converts a configured millisecond value, where zero means the default and negative means disabled
+func durationOrDefault(ms, defaultMS int) time.Duration {
+	if ms == 0 {
+		ms = defaultMS
+	}
+	if ms < 0 {
+		return 0
+	}
+	return time.Duration(ms) * time.Millisecond
+}
+
+func (s *webSocketServer) pingInterval() time.Duration {
+	return durationOrDefault(s.conf.PingIntervalMS, defaultPingIntervalMS)
+}
+
+func (s *webSocketServer) pongTimeout() time.Duration {
+	return durationOrDefault(s.conf.PongTimeoutMS, defaultPongTimeoutMS)
+}
+
+func (s *webSocketServer) writeTimeout() time.Duration {
+	return durationOrDefault(s.conf.WriteTimeoutMS, defaultWriteTimeoutMS)
+}
+
+func (s *webSocketServer) idleTimeout() time.Duration {
+	if s.conf.IdleTimeoutSec <= 0 {
+		return 0
+	}
+	return time.Duration(s.conf.IdleTimeoutSec) * time.Second
+}
+
+func (s *webSocketServer) connectionsHandler(res http.ResponseWriter, req *http.Request, params httprouter.Params) {
+	log.Infof("--> %s %s", req.Method, req.URL)
+
+	s.mux.Lock()
+	stats := make([]*ConnectionStats, 0, len(s.connections))
+	for _, c := range s.connections {
+		stats = append(stats, c.getStats())
+	}
+	s.mux.Unlock()
+	// The formatted times do not sort as strings, as RFC3339Nano drops trailing zeros
+	sort.Slice(stats, func(i, j int) bool {
+		if !stats[i].connected.Equal(stats[j].connected) {
+			return stats[i].connected.Before(stats[j].connected)
+		}
+		return stats[i].ID < stats[j].ID
+	})
+
+	status := 200
+	log.Infof("<-- %s %s [%d]", req.Method, req.URL, status)
+	res.Header().Set("Content-Type", "application/json")
+	res.WriteHeader(status)
+	enc := json.NewEncoder(res)
+	enc.SetIndent("", "  ")
+	enc.Encode(stats)
+}
+
 func (s *webSocketServer) cycleTopic(t *webSocketTopic) {
 	s.mux.Lock()
 	defer s.mux.Unlock()
@@ -113,6 +195,7 @@ func (s *webSocketServer) connectionClosed(c *webSocketConnection) {
 
 func (s *webSocketServer) AddRoutes(r *httprouter.Router) {
 	r.GET("/ws", s.handler)
+	r.GET("/status/ws", s.connectionsHandler)
 }
 
 func (s *webSocketServer) Close() {
@@ -123,7 +206,6 @@ func (s *webSocketServer) Close() {
 
 func (s *webSocketServer) getTopic(topic string) *webSocketTopic {
 	s.mux.Lock()
-	defer s.mux.Unlock()
 	t, exists := s.topics[topic]
 	if !exists {
 		t = &webSocketTopic{
@@ -135,7 +217,11 @@ func (s *webSocketServer) getTopic(topic string) *webSocketTopic {
 		}
 		s.topics[topic] = t
 		s.topicMap[topic] = make(map[string]*webSocketConnection)
-		// Signal to the broadcaster that a new topic has been added
+	}
+	s.mux.Unlock()
+	if !exists {
+		// Signal to the broadcaster that a new topic has been added, outside the lock
+		// as the broadcaster takes it to rebuild its topics
 		s.newTopic <- true
 	}
 	return t
@@ -147,10 +233,18 @@ func (s *webSocketServer) GetChannels(topic string) (chan<- interface{}, chan<-
 }
 
 func (s *webSocketServer) ListenOnTopic(c *webSocketConnection, topic string) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
 	// Track that this connection is interested in this topic
 	s.topicMap[topic][c.id] = c
 }
 
+func (s *webSocketServer) UnlistenOnTopic(c *webSocketConnection, topic string) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	delete(s.topicMap[topic], c.id)
+}
+
 func (s *webSocketServer) ListenForReplies(c *webSocketConnection) {
 	s.replyMap[c.id] = c
 }
@@ -162,6 +256,8 @@ func (s *webSocketServer) SendReply(message interface{}) {
 func (s *webSocketServer) processBroadcasts() {
 	var topics []string
 	buildCases := func() []reflect.SelectCase {
+		s.mux.Lock()
+		defer s.mux.Unlock()
 		topics = make([]string, len(s.topics))
 		cases := make([]reflect.SelectCase, len(s.topics)+1)
 		i := 0
@@ -186,9 +282,17 @@ func (s *webSocketServer) processBroadcasts() {
 			cases = buildCases()
 		} else {
 			// Message on one of the existing topics
-			// Gather all connections interested in this topic and send to them
+			// Gather all connections interested in this topic under the lock, and send to them
 			topic := topics[chosen]
-			s.broadcastToConnections(s.topicMap[topic], value.Interface())
+			s.mux.Lock()
+			connections := make([]*webSocketConnection, 0, len(s.topicMap[topic]))
+			for _, c := range s.topicMap[topic] {
+				connections = append(connections, c)
+			}
+			s.mux.Unlock()
+			for _, c := range connections {
+				c.broadcast <- c.broadcastFrame(topic, value.Interface())
+			}
 		}
 	}
 }
@@ -15,21 +15,26 @@
 package ws
 
 import (
+	"encoding/json"
+	"fmt"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"strings"
 	"sync"
 	"testing"
 	"time"
 
 	ws "github.com/gorilla/websocket"
 	"github.com/julienschmidt/httprouter"
+	"github.com/kaleido-io/ethconnect/internal/auth"
+	"github.com/kaleido-io/ethconnect/internal/auth/authtest"
 
 	"github.com/stretchr/testify/assert"
 )
 
 func newTestWebSocketServer() (*webSocketServer, *httptest.Server) {
-	s := NewWebSocketServer().(*webSocketServer)
+	s := NewWebSocketServer(&WebSocketServerConf{}).(*webSocketServer)
 	r := &httprouter.Router{}
 	s.AddRoutes(r)
 	ts := httptest.NewServer(r)
@@ -350,3 +355,730 @@ func TestSendReply(t *testing.T) {
 	c.ReadJSON(&val)
 	assert.Equal("Hello World", val)
 }
+
+func TestConnectMsgPackEncoding(t *testing.T) {
+	assert := assert.New(t)
+
+	w, ts := newTestWebSocketServer()
+	defer ts.Close()
+
+	u, _ := url.Parse(ts.URL)
+	u.Scheme = "ws"
+	u.Path = "/ws"
+	dialer := &ws.Dialer{
+		Subprotocols: []string{EncodingMsgPack},
+	}
+	c, res, err := dialer.Dial(u.String(), nil)
+	assert.NoError(err)
+	assert.Equal(EncodingMsgPack, res.Header.Get("Sec-WebSocket-Protocol"))
+
+	c.WriteJSON(&webSocketCommandMessage{
+		Type: "listen",
+	})
+
+	s, _, r, _ := w.GetChannels("")
+
+	s <- map[string]string{"hello": "world"}
+
+	msgType, b, err := c.ReadMessage()
+	assert.NoError(err)
+	assert.Equal(ws.BinaryMessage, msgType)
+	assert.Equal([]byte{0x81, 0xa5, 'h', 'e', 'l', 'l', 'o', 0xa5, 'w', 'o', 'r', 'l', 'd'}, b)
+
+	c.WriteJSON(&webSocketCommandMessage{
+		Type: "ack",
+	})
+	err = <-r
+	assert.NoError(err)
+
+	w.Close()
+}
+
+type testSignedPayload struct {
+	Signed json.RawMessage `json:"signed"`
+}
+
+func (p *testSignedPayload) JSONOnly() bool {
+	return true
+}
+
+func TestConnectMsgPackEncodingJSONOnlyPayload(t *testing.T) {
+	assert := assert.New(t)
+
+	w, ts := newTestWebSocketServer()
+	defer ts.Close()
+
+	u, _ := url.Parse(ts.URL)
+	u.Scheme = "ws"
+	u.Path = "/ws"
+	dialer := &ws.Dialer{
+		Subprotocols: []string{EncodingMsgPack},
+	}
+	c, _, err := dialer.Dial(u.String(), nil)
+	assert.NoError(err)
+
+	c.WriteJSON(&webSocketCommandMessage{
+		Type: "listen",
+	})
+
+	s, _, r, _ := w.GetChannels("")
+
+	// The signed bytes are sent exactly as they are, in a text frame
+	s <- &testSignedPayload{Signed: json.RawMessage(`[{"a":1}]`)}
+
+	msgType, b, err := c.ReadMessage()
+	assert.NoError(err)
+	assert.Equal(ws.TextMessage, msgType)
+	assert.Equal(`{"signed":[{"a":1}]}`+"\n", string(b))
+
+	c.WriteJSON(&webSocketCommandMessage{
+		Type: "ack",
+	})
+	err = <-r
+	assert.NoError(err)
+
+	w.Close()
+}
+
+func TestRequiresJSON(t *testing.T) {
+	assert := assert.New(t)
+	assert.True(requiresJSON(&testSignedPayload{}))
+	assert.True(requiresJSON(&webSocketTopicFrame{Payload: &testSignedPayload{}}))
+	assert.False(requiresJSON(map[string]string{}))
+	assert.False(requiresJSON(&webSocketTopicFrame{Payload: "hello"}))
+}
+
+type testExpiringSecurityModule struct {
+	authtest.TestSecurityModule
+	expiry time.Duration
+}
+
+func (sm *testExpiringSecurityModule) TokenExpiry(authCtx interface{}) time.Time {
+	return time.Now().Add(sm.expiry)
+}
+
+func dialTestWebSocketServer(t *testing.T, ts *httptest.Server) *ws.Conn {
+	u, _ := url.Parse(ts.URL)
+	u.Scheme = "ws"
+	u.Path = "/ws"
+	c, _, err := ws.DefaultDialer.Dial(u.String(), nil)
+	assert.NoError(t, err)
+	return c
+}
+
+func TestAuthFirstMessage(t *testing.T) {
+	assert := assert.New(t)
+
+	auth.RegisterSecurityModule(&authtest.TestSecurityModule{})
+	defer auth.RegisterSecurityModule(nil)
+
+	w, ts := newTestWebSocketServer()
+	defer ts.Close()
+
+	c := dialTestWebSocketServer(t, ts)
+
+	c.WriteJSON(&webSocketCommandMessage{
+		Type:  "auth",
+		Token: "testat",
+	})
+
+	var authReply webSocketAuthReply
+	err := c.ReadJSON(&authReply)
+	assert.NoError(err)
+	assert.Equal("authenticated", authReply.Type)
+	assert.Empty(authReply.Expires)
+
+	c.WriteJSON(&webSocketCommandMessage{
+		Type: "listen",
+	})
+
+	s, _, r, _ := w.GetChannels("")
+
+	s <- "Hello World"
+
+	var val string
+	c.ReadJSON(&val)
+	assert.Equal("Hello World", val)
+
+	c.WriteJSON(&webSocketCommandMessage{
+		Type: "ack",
+	})
+	err = <-r
+	assert.NoError(err)
+
+	w.Close()
+}
+
+func TestAuthRequiredBeforeCommands(t *testing.T) {
+	assert := assert.New(t)
+
+	auth.RegisterSecurityModule(&authtest.TestSecurityModule{})
+	defer auth.RegisterSecurityModule(nil)
+
+	w, ts := newTestWebSocketServer()
+	defer ts.Close()
+
+	c := dialTestWebSocketServer(t, ts)
+
+	c.WriteJSON(&webSocketCommandMessage{
+		Type: "listen",
+	})
+
+	_, _, err := c.ReadMessage()
+	assert.Regexp("Authentication required before 'listen' message", err)
+
+	w.Close()
+}
+
+func TestAuthBadToken(t *testing.T) {
+	assert := assert.New(t)
+
+	auth.RegisterSecurityModule(&authtest.TestSecurityModule{})
+	defer auth.RegisterSecurityModule(nil)
+
+	w, ts := newTestWebSocketServer()
+	defer ts.Close()
+
+	c := dialTestWebSocketServer(t, ts)
+
+	c.WriteJSON(&webSocketCommandMessage{
+		Type:  "auth",
+		Token: "badtoken",
+	})
+
+	_, _, err := c.ReadMessage()
+	assert.Regexp("Authentication failed: badness", err)
+
+	w.Close()
+}
+
+func TestAuthTimeout(t *testing.T) {
+	assert := assert.New(t)
+
+	auth.RegisterSecurityModule(&authtest.TestSecurityModule{})
+	defer auth.RegisterSecurityModule(nil)
+
+	w, ts := newTestWebSocketServer()
+	w.authTimeout = 10 * time.Millisecond
+	defer ts.Close()
+
+	c := dialTestWebSocketServer(t, ts)
+
+	_, _, err := c.ReadMessage()
+	assert.Regexp("No authentication received", err)
+
+	w.Close()
+}
+
+func TestAuthRefreshBeforeExpiry(t *testing.T) {
+	assert := assert.New(t)
+
+	sm := &testExpiringSecurityModule{expiry: 1 * time.Second}
+	auth.RegisterSecurityModule(sm)
+	defer auth.RegisterSecurityModule(nil)
+
+	w, ts := newTestWebSocketServer()
+	defer ts.Close()
+
+	c := dialTestWebSocketServer(t, ts)
+
+	c.WriteJSON(&webSocketCommandMessage{
+		Type:  "auth",
+		Token: "testat",
+	})
+	var authReply webSocketAuthReply
+	err := c.ReadJSON(&authReply)
+	assert.NoError(err)
+	assert.Equal("authenticated", authReply.Type)
+	assert.NotEmpty(authReply.Expires)
+
+	// Refresh with a token that expires almost immediately
+	sm.expiry = 50 * time.Millisecond
+	c.WriteJSON(&webSocketCommandMessage{
+		Type:  "auth",
+		Token: "testat",
+	})
+	err = c.ReadJSON(&authReply)
+	assert.NoError(err)
+	assert.Equal("authenticated", authReply.Type)
+
+	_, _, err = c.ReadMessage()
+	assert.Regexp("Authentication token expired", err)
+
+	w.Close()
+}
+
+// testIdentitySecurityModule accepts tokens of the form <principal>@<tenant>
+type testIdentitySecurityModule struct {
+	authtest.TestSecurityModule
+}
+
+func (sm *testIdentitySecurityModule) VerifyToken(tok string) (interface{}, error) {
+	if !strings.Contains(tok, "@") {
+		return nil, fmt.Errorf("badness")
+	}
+	return tok, nil
+}
+
+func (sm *testIdentitySecurityModule) Subject(authCtx interface{}) string {
+	return strings.SplitN(authCtx.(string), "@", 2)[0]
+}
+
+func (sm *testIdentitySecurityModule) Tenant(authCtx interface{}) string {
+	return strings.SplitN(authCtx.(string), "@", 2)[1]
+}
+
+func TestAuthRefreshIdentityChanged(t *testing.T) {
+	assert := assert.New(t)
+
+	auth.RegisterSecurityModule(&testIdentitySecurityModule{})
+	defer auth.RegisterSecurityModule(nil)
+
+	w, ts := newTestWebSocketServer()
+	defer ts.Close()
+
+	for _, refresh := range []string{"user2@tenant1", "user1@tenant2"} {
+		c := dialTestWebSocketServer(t, ts)
+
+		// The same principal and tenant can refresh
+		for _, token := range []string{"user1@tenant1", "user1@tenant1"} {
+			c.WriteJSON(&webSocketCommandMessage{
+				Type:  "auth",
+				Token: token,
+			})
+			var authReply webSocketAuthReply
+			err := c.ReadJSON(&authReply)
+			assert.NoError(err)
+			assert.Equal("authenticated", authReply.Type)
+		}
+
+		c.WriteJSON(&webSocketCommandMessage{
+			Type:  "auth",
+			Token: refresh,
+		})
+		_, _, err := c.ReadMessage()
+		assert.Regexp("Authentication failed: Token is for a different principal or tenant", err)
+	}
+
+	w.Close()
+}
+
+func TestConnectionStats(t *testing.T) {
+	assert := assert.New(t)
+
+	w, ts := newTestWebSocketServer()
+	defer ts.Close()
+
+	c := dialTestWebSocketServer(t, ts)
+
+	c.WriteJSON(&webSocketCommandMessage{
+		Type:  "listen",
+		Topic: "topic1",
+	})
+	c.WriteJSON(&webSocketCommandMessage{
+		Type: "listenreplies",
+	})
+
+	s, _, r, _ := w.GetChannels("topic1")
+	s <- "Hello World"
+	var val string
+	c.ReadJSON(&val)
+	c.WriteJSON(&webSocketCommandMessage{
+		Type:  "ack",
+		Topic: "topic1",
+	})
+	<-r
+
+	res, err := http.Get(ts.URL + "/status/ws")
+	assert.NoError(err)
+	assert.Equal(200, res.StatusCode)
+	var stats []*ConnectionStats
+	err = json.NewDecoder(res.Body).Decode(&stats)
+	assert.NoError(err)
+	assert.Len(stats, 1)
+	assert.Equal([]string{"topic1"}, stats[0].Topics)
+	assert.True(stats[0].ListeningReplies)
+	assert.True(stats[0].Authenticated)
+	assert.Equal(EncodingJSON, stats[0].Encoding)
+	assert.Equal(uint64(1), stats[0].MessagesSent)
+	assert.Equal(uint64(3), stats[0].MessagesReceived)
+	assert.NotEmpty(stats[0].ConnectedISO8601)
+	assert.NotEmpty(stats[0].LastActivityISO8601)
+
+	w.Close()
+}
+
+func TestConnectionStatsOrder(t *testing.T) {
+	assert := assert.New(t)
+
+	w, ts := newTestWebSocketServer()
+	defer ts.Close()
+
+	c1 := dialTestWebSocketServer(t, ts)
+	defer c1.Close()
+	c2 := dialTestWebSocketServer(t, ts)
+	defer c2.Close()
+	for i := 0; i < 100; i++ {
+		w.mux.Lock()
+		count := len(w.connections)
+		w.mux.Unlock()
+		if count == 2 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// A whole second formats as "...:00Z", which sorts after "...:00.5Z" as a string
+	base := time.Date(2021, 1, 1, 12, 0, 0, 0, time.UTC)
+	connected := []time.Time{base.Add(500 * time.Millisecond), base}
+	ids := make([]string, 0, 2)
+	w.mux.Lock()
+	i := 0
+	for id, c := range w.connections {
+		c.mux.Lock()
+		c.stats.connected = connected[i]
+		c.mux.Unlock()
+		ids = append([]string{id}, ids...)
+		i++
+	}
+	w.mux.Unlock()
+
+	res, err := http.Get(ts.URL + "/status/ws")
+	assert.NoError(err)
+	var stats []*ConnectionStats
+	err = json.NewDecoder(res.Body).Decode(&stats)
+	assert.NoError(err)
+	assert.Len(stats, 2)
+	assert.Equal(ids, []string{stats[0].ID, stats[1].ID})
+	assert.Equal("2021-01-01T12:00:00Z", stats[0].ConnectedISO8601)
+	assert.Equal("2021-01-01T12:00:00.5Z", stats[1].ConnectedISO8601)
+
+	w.Close()
+}
+
+func TestPingPong(t *testing.T) {
+	assert := assert.New(t)
+
+	w, ts := newTestWebSocketServer()
+	w.conf.PingIntervalMS = 10
+	defer ts.Close()
+
+	c := dialTestWebSocketServer(t, ts)
+	// Reading processes pings, and responds with pongs
+	go c.ReadMessage()
+
+	var stats *ConnectionStats
+	for i := 0; i < 100; i++ {
+		time.Sleep(10 * time.Millisecond)
+		w.mux.Lock()
+		for _, wsc := range w.connections {
+			stats = wsc.getStats()
+		}
+		w.mux.Unlock()
+		if stats != nil && stats.PongsReceived > 0 {
+			break
+		}
+	}
+	assert.True(stats.PingsSent > 0)
+	assert.True(stats.PongsReceived > 0)
+	assert.NotEmpty(stats.LastPongISO8601)
+
+	w.Close()
+}
+
+func TestPongTimeout(t *testing.T) {
+	assert := assert.New(t)
+
+	w, ts := newTestWebSocketServer()
+	w.conf.PingIntervalMS = 10
+	w.conf.PongTimeoutMS = 10
+	defer ts.Close()
+
+	c := dialTestWebSocketServer(t, ts)
+	// Ignore pings, so the server never receives a pong
+	c.SetPingHandler(func(string) error { return nil })
+
+	_, _, err := c.ReadMessage()
+	assert.Error(err)
+
+	w.Close()
+}
+
+func TestIdleTimeout(t *testing.T) {
+	assert := assert.New(t)
+
+	w, ts := newTestWebSocketServer()
+	w.conf.PingIntervalMS = -1
+	w.conf.IdleTimeoutSec = 1
+	defer ts.Close()
+
+	c := dialTestWebSocketServer(t, ts)
+
+	_, _, err := c.ReadMessage()
+	assert.Regexp("Connection idle", err)
+
+	w.Close()
+}
+
+func TestMaxMessageSize(t *testing.T) {
+	assert := assert.New(t)
+
+	w, ts := newTestWebSocketServer()
+	w.conf.MaxMessageSize = 10
+	defer ts.Close()
+
+	c := dialTestWebSocketServer(t, ts)
+
+	c.WriteJSON(&webSocketCommandMessage{
+		Type:  "listen",
+		Topic: "a topic name that exceeds the limit",
+	})
+
+	_, _, err := c.ReadMessage()
+	assert.Error(err)
+
+	w.Close()
+}
+
+func TestDurationOrDefault(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Equal(5*time.Millisecond, durationOrDefault(0, 5))
+	assert.Equal(10*time.Millisecond, durationOrDefault(10, 5))
+	assert.Equal(time.Duration(0), durationOrDefault(-1, 5))
+}
+
+func TestSubscribeMultiplexedTopics(t *testing.T) {
+	assert := assert.New(t)
+
+	w, ts := newTestWebSocketServer()
+	defer ts.Close()
+
+	c := dialTestWebSocketServer(t, ts)
+
+	var frame webSocketTopicFrame
+	for _, topic := range []string{"topic1", "topic2"} {
+		c.WriteJSON(&webSocketCommandMessage{
+			Type:  "subscribe",
+			Topic: topic,
+		})
+		c.ReadJSON(&frame)
+		assert.Equal("subscribed", frame.Type)
+		assert.Equal(topic, frame.Topic)
+	}
+
+	s1, _, r1, _ := w.GetChannels("topic1")
+	s2, _, r2, _ := w.GetChannels("topic2")
+
+	s1 <- "Hello Number 1"
+	c.ReadJSON(&frame)
+	assert.Equal("message", frame.Type)
+	assert.Equal("topic1", frame.Topic)
+	assert.Equal(uint64(1), frame.Sequence)
+	assert.Equal("Hello Number 1", frame.Payload)
+
+	s2 <- "Hello Number 2"
+	frame = webSocketTopicFrame{}
+	c.ReadJSON(&frame)
+	assert.Equal("message", frame.Type)
+	assert.Equal("topic2", frame.Topic)
+	assert.Equal(uint64(1), frame.Sequence)
+	assert.Equal("Hello Number 2", frame.Payload)
+
+	c.WriteJSON(&webSocketCommandMessage{
+		Type:     "ack",
+		Topic:    "topic2",
+		Sequence: 1,
+	})
+	assert.NoError(<-r2)
+
+	c.WriteJSON(&webSocketCommandMessage{
+		Type:     "error",
+		Topic:    "topic1",
+		Sequence: 1,
+		Message:  "Panic!",
+	})
+	assert.EqualError(<-r1, "Error received from WebSocket client: Panic!")
+
+	s1 <- "Hello Again"
+	frame = webSocketTopicFrame{}
+	c.ReadJSON(&frame)
+	assert.Equal("topic1", frame.Topic)
+	assert.Equal(uint64(2), frame.Sequence)
+
+	c.WriteJSON(&webSocketCommandMessage{
+		Type:     "ack",
+		Topic:    "topic1",
+		Sequence: 2,
+	})
+	assert.NoError(<-r1)
+
+	w.Close()
+}
+
+func TestSubscribeAckSequenceMismatch(t *testing.T) {
+	assert := assert.New(t)
+
+	w, ts := newTestWebSocketServer()
+	defer ts.Close()
+
+	c := dialTestWebSocketServer(t, ts)
+
+	var frame webSocketTopicFrame
+	c.WriteJSON(&webSocketCommandMessage{
+		Type:  "subscribe",
+		Topic: "topic1",
+	})
+	c.ReadJSON(&frame)
+
+	c.WriteJSON(&webSocketCommandMessage{
+		Type:     "ack",
+		Topic:    "topic1",
+		Sequence: 1,
+	})
+	frame = webSocketTopicFrame{}
+	c.ReadJSON(&frame)
+	assert.Equal("error", frame.Type)
+	assert.Equal("No message awaiting acknowledgment on topic 'topic1'", frame.Message)
+
+	s, _, r, _ := w.GetChannels("topic1")
+	s <- "Hello World"
+	frame = webSocketTopicFrame{}
+	c.ReadJSON(&frame)
+	assert.Equal(uint64(1), frame.Sequence)
+
+	c.WriteJSON(&webSocketCommandMessage{
+		Type:     "ack",
+		Topic:    "topic1",
+		Sequence: 5,
+	})
+	frame = webSocketTopicFrame{}
+	c.ReadJSON(&frame)
+	assert.Equal("error", frame.Type)
+	assert.Equal(uint64(5), frame.Sequence)
+	assert.Equal("Sequence 5 does not match sequence 1 awaiting acknowledgment on topic 'topic1'", frame.Message)
+
+	c.WriteJSON(&webSocketCommandMessage{
+		Type:     "ack",
+		Topic:    "topic1",
+		Sequence: 1,
+	})
+	assert.NoError(<-r)
+
+	w.Close()
+}
+
+func TestUnsubscribeRedeliversUnacked(t *testing.T) {
+	assert := assert.New(t)
+
+	w, ts := newTestWebSocketServer()
+	defer ts.Close()
+
+	c := dialTestWebSocketServer(t, ts)
+
+	var frame webSocketTopicFrame
+	c.WriteJSON(&webSocketCommandMessage{
+		Type:  "subscribe",
+		Topic: "topic1",
+	})
+	c.ReadJSON(&frame)
+
+	s, _, r, closing := w.GetChannels("topic1")
+	s <- "Hello World"
+	c.ReadJSON(&frame)
+	assert.Equal("message", frame.Type)
+
+	// A second connection on the same topic must not be disturbed by the unsubscribe
+	c2 := dialTestWebSocketServer(t, ts)
+	c2.WriteJSON(&webSocketCommandMessage{
+		Type:  "subscribe",
+		Topic: "topic1",
+	})
+	frame = webSocketTopicFrame{}
+	c2.ReadJSON(&frame)
+	assert.Equal("subscribed", frame.Type)
+
+	c.WriteJSON(&webSocketCommandMessage{
+		Type:  "unsubscribe",
+		Topic: "topic1",
+	})
+	err := <-r
+	assert.EqualError(err, "Unsubscribed from topic 'topic1' before acknowledging the message in flight")
+	select {
+	case <-closing:
+		assert.Fail("topic closing channel was cycled")
+	default:
+	}
+
+	frame = webSocketTopicFrame{}
+	c.ReadJSON(&frame)
+	assert.Equal("unsubscribed", frame.Type)
+	assert.Equal("topic1", frame.Topic)
+
+	// The redelivery goes to the remaining connection
+	s <- "Hello World"
+	frame = webSocketTopicFrame{}
+	c2.ReadJSON(&frame)
+	assert.Equal("message", frame.Type)
+	assert.Equal(uint64(1), frame.Sequence)
+	c2.WriteJSON(&webSocketCommandMessage{
+		Type:     "ack",
+		Topic:    "topic1",
+		Sequence: 1,
+	})
+	assert.NoError(<-r)
+
+	w.mux.Lock()
+	assert.Len(w.topicMap["topic1"], 1)
+	w.mux.Unlock()
+
+	w.Close()
+}
+
+func TestSubscribeBroadcastAndStats(t *testing.T) {
+	assert := assert.New(t)
+
+	w, ts := newTestWebSocketServer()
+	defer ts.Close()
+
+	c := dialTestWebSocketServer(t, ts)
+
+	var frame webSocketTopicFrame
+	c.WriteJSON(&webSocketCommandMessage{
+		Type:  "subscribe",
+		Topic: "topic1",
+	})
+	c.ReadJSON(&frame)
+
+	s, b, r, _ := w.GetChannels("topic1")
+	b <- "Hello Everyone"
+	frame = webSocketTopicFrame{}
+	c.ReadJSON(&frame)
+	assert.Equal("broadcast", frame.Type)
+	assert.Equal("topic1", frame.Topic)
+	assert.Zero(frame.Sequence)
+	assert.Equal("Hello Everyone", frame.Payload)
+
+	s <- "Hello World"
+	c.ReadJSON(&frame)
+	c.WriteJSON(&webSocketCommandMessage{
+		Type:     "ack",
+		Topic:    "topic1",
+		Sequence: 1,
+	})
+	<-r
+	s <- "Hello Again"
+	c.ReadJSON(&frame)
+
+	res, err := http.Get(ts.URL + "/status/ws")
+	assert.NoError(err)
+	var stats []*ConnectionStats
+	err = json.NewDecoder(res.Body).Decode(&stats)
+	assert.NoError(err)
+	assert.Len(stats, 1)
+	assert.Equal([]*SubscriptionStats{
+		{Topic: "topic1", Sent: 2, Acked: 1},
+	}, stats[0].Subscriptions)
+
+	w.Close()
+}
@@ -0,0 +1,252 @@
+// Copyright 2021 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package client is a Go client for the REST APIs of an ethconnect gateway - the contract
+// registry, event streams and subscriptions, and transaction submission with helpers to
+// wait for receipts. Typed bindings for an individual contract can be generated on top of
+// it with GenerateBindings, or with the "ethconnect clientgen" command.
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/kaleido-io/ethconnect/internal/errors"
+)
+
+const (
+	defaultTimeoutSec          = 120
+	defaultReceiptPollInterval = 250 * time.Millisecond
+	defaultFlyPrefix           = "firefly"
+	defaultReceiptPath         = "/replies"
+)
+
+// ClientConf configures a client of an ethconnect gateway
+type ClientConf struct {
+	URL             string            `json:"url"`
+	AccessToken     string            `json:"accessToken,omitempty"`
+	Username        string            `json:"username,omitempty"`
+	Password        string            `json:"password,omitempty"`
+	Headers         map[string]string `json:"headers,omitempty"`
+	TimeoutSec      int               `json:"timeoutSec,omitempty"`
+	PollIntervalMS  int               `json:"pollIntervalMS,omitempty"`  // Interval between queries for a receipt, when waiting for one
+	HeaderPrefix    string            `json:"headerPrefix,omitempty"`    // The long prefix of the gateway, defaulting to "firefly" for x-firefly-* headers
+	HTTPClient      *http.Client      `json:"-"`                         // Optional client, such as one configured for mutual TLS
+	ReceiptEndpoint string            `json:"receiptEndpoint,omitempty"` // Path of the receipt store, defaulting to /replies
+}
+
+// Client is the interface to the REST APIs of an ethconnect gateway. Every method accepts
+// a context, which cancels the request (and any wait for a receipt) when done
+type Client interface {
+	// Registry
+	AddABI(ctx context.Context, req *AddABIRequest) (*ABIInfo, error)
+	ListABIs(ctx context.Context) ([]*ABIInfo, error)
+	GetABIInfo(ctx context.Context, abiID string) (*ABIInfo, error)
+	GetABI(ctx context.Context, abiID string) (ABI, error)
+	DeleteABI(ctx context.Context, abiID string) error
+	RegisterContract(ctx context.Context, abiID, address string, opts *RegisterOptions) (*ContractInfo, error)
+	ListContracts(ctx context.Context) ([]*ContractInfo, error)
+	GetContract(ctx context.Context, addressOrName string) (*ContractInfo, error)
+	GetContractABI(ctx context.Context, addressOrName string) (ABI, error)
+	DeleteContract(ctx context.Context, addressOrName string) error
+
+	// Event streams and subscriptions
+	CreateStream(ctx context.Context, stream *Stream) (*Stream, error)
+	UpdateStream(ctx context.Context, id string, stream *Stream) (*Stream, error)
+	ListStreams(ctx context.Context) ([]*Stream, error)
+	GetStream(ctx context.Context, id string) (*Stream, error)
+	DeleteStream(ctx context.Context, id string) error
+	SuspendStream(ctx context.Context, id string) error
+	ResumeStream(ctx context.Context, id string) error
+	Subscribe(ctx context.Context, contract, event string, req *SubscribeRequest) (*Subscription, error)
+	ListSubscriptions(ctx context.Context) ([]*Subscription, error)
+	GetSubscription(ctx context.Context, id string) (*Subscription, error)
+	DeleteSubscription(ctx context.Context, id string) error
+	ResetSubscription(ctx context.Context, id, fromBlock string) error
+	SuspendSubscription(ctx context.Context, id string) error
+	ResumeSubscription(ctx context.Context, id string) error
+
+	// Transactions
+	Deploy(ctx context.Context, abiID string, params map[string]interface{}, opts *TxOptions) (*AsyncSent, error)
+	DeployAndWait(ctx context.Context, abiID string, params map[string]interface{}, opts *TxOptions) (*Receipt, error)
+	Invoke(ctx context.Context, contract, method string, params map[string]interface{}, opts *TxOptions) (*AsyncSent, error)
+	InvokeSync(ctx context.Context, contract, method string, params map[string]interface{}, opts *TxOptions) (*Receipt, error)
+	InvokeAndWait(ctx context.Context, contract, method string, params map[string]interface{}, opts *TxOptions) (*Receipt, error)
+	Call(ctx context.Context, contract, method string, params map[string]interface{}, opts *CallOptions) (map[string]interface{}, error)
+	GetReceipt(ctx context.Context, id string) (*Receipt, error)
+	WaitForReceipt(ctx context.Context, id string) (*Receipt, error)
+}
+
+// APIError is returned when the gateway responds with a non-success status. Message
+// and Code are read from the JSON error body, if there is one
+type APIError struct {
+	StatusCode int
+	Message    string
+	Code       string
+	body       []byte
+}
+
+func (e *APIError) Error() string {
+	return errors.Errorf(errors.ClientRequestFailed, e.StatusCode, e.Message).Error()
+}
+
+// IsNotFound returns true if the error is a 404 from the gateway
+func IsNotFound(err error) bool {
+	apiErr, ok := err.(*APIError)
+	return ok && apiErr.StatusCode == http.StatusNotFound
+}
+
+type errorBody struct {
+	Message string `json:"error"`
+	Code    string `json:"code,omitempty"`
+}
+
+type client struct {
+	conf         *ClientConf
+	baseURL      string
+	httpClient   *http.Client
+	pollInterval time.Duration
+	headerPrefix string
+	receiptPath  string
+}
+
+// NewClient constructs a client for the gateway at the configured URL
+func NewClient(conf *ClientConf) (Client, error) {
+	if conf.URL == "" {
+		return nil, errors.Errorf(errors.ClientNoURL)
+	}
+	baseURL := strings.TrimSuffix(conf.URL, "/")
+	if u, err := url.Parse(baseURL); err != nil || u.Scheme == "" || u.Host == "" || u.RawQuery != "" {
+		return nil, errors.Errorf(errors.ClientBadURL, conf.URL)
+	}
+	c := &client{
+		conf:         conf,
+		baseURL:      baseURL,
+		httpClient:   conf.HTTPClient,
+		pollInterval: defaultReceiptPollInterval,
+		headerPrefix: defaultFlyPrefix,
+		receiptPath:  defaultReceiptPath,
+	}
+	if c.httpClient == nil {
+		timeoutSec := conf.TimeoutSec
+		if timeoutSec <= 0 {
+			timeoutSec = defaultTimeoutSec
+		}
+		c.httpClient = &http.Client{Timeout: time.Duration(timeoutSec) * time.Second}
+	}
+	if conf.PollIntervalMS > 0 {
+		c.pollInterval = time.Duration(conf.PollIntervalMS) * time.Millisecond
+	}
+	if conf.HeaderPrefix != "" {
+		c.headerPrefix = strings.ToLower(conf.HeaderPrefix)
+	}
+	if conf.ReceiptEndpoint != "" {
+		c.receiptPath = "/" + strings.Trim(conf.ReceiptEndpoint, "/")
+	}
+	return c, nil
+}
+
+// flyHeader returns the name of the header for an option, such as x-firefly-from
+func (c *client) flyHeader(name string) string {
+	return "x-" + c.headerPrefix + "-" + name
+}
+
+// url appends a path, with its segments already escaped, to the base URL of the gateway
+func (c *client) url(path string, query url.Values) string {
+	u := c.baseURL + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	return u
+}
+
+// do sends a request with an optional JSON body, and decodes a JSON response into result
+// (if not nil). Any status other than 2xx is returned as an APIError
+func (c *client) do(ctx context.Context, method, path string, query url.Values, headers map[string]string, body, result interface{}) (int, error) {
+	var reader io.Reader
+	contentType := ""
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return 0, errors.Errorf(errors.ClientRequestSerialize, err)
+		}
+		reader = bytes.NewReader(b)
+		contentType = "application/json"
+	}
+	return c.doRaw(ctx, method, path, query, headers, reader, contentType, result)
+}
+
+func (c *client) doRaw(ctx context.Context, method, path string, query url.Values, headers map[string]string, body io.Reader, contentType string, result interface{}) (int, error) {
+	req, err := http.NewRequestWithContext(ctx, method, c.url(path, query), body)
+	if err != nil {
+		return 0, errors.Errorf(errors.ClientRequestSerialize, err)
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	req.Header.Set("Accept", "application/json")
+	for k, v := range c.conf.Headers {
+		req.Header.Set(k, v)
+	}
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	if c.conf.AccessToken != "" {
+		req.Header.Set("Authorization", "Bearer "+c.conf.AccessToken)
+	} else if c.conf.Username != "" {
+		req.SetBasicAuth(c.conf.Username, c.conf.Password)
+	}
+
+	res, err := c.httpClient.Do(req)
+	if err != nil {
+		return 0, errors.Errorf(errors.ClientRequestError, method, path, err)
+	}
+	defer res.Body.Close()
+	resBody, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return res.StatusCode, errors.Errorf(errors.ClientRequestError, method, path, err)
+	}
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		apiErr := &APIError{StatusCode: res.StatusCode, body: resBody}
+		var errBody errorBody
+		if json.Unmarshal(resBody, &errBody) == nil && errBody.Message != "" {
+			apiErr.Message = errBody.Message
+			apiErr.Code = errBody.Code
+		} else {
+			apiErr.Message = strings.TrimSpace(string(resBody))
+		}
+		if apiErr.Message == "" {
+			apiErr.Message = http.StatusText(res.StatusCode)
+		}
+		return res.StatusCode, apiErr
+	}
+	if result != nil && len(resBody) > 0 {
+		if err := json.Unmarshal(resBody, result); err != nil {
+			return res.StatusCode, errors.Errorf(errors.ClientResponseParse, method, path, err)
+		}
+	}
+	return res.StatusCode, nil
+}
+
+// pathEscape escapes a single segment of a path, such as an ID or registered name
+func pathEscape(segment string) string {
+	return url.PathEscape(segment)
+}
@@ -0,0 +1,119 @@
+// Copyright 2021 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestClient(t *testing.T, handler http.HandlerFunc) (Client, func()) {
+	server := httptest.NewServer(handler)
+	c, err := NewClient(&ClientConf{
+		URL:            server.URL + "/",
+		AccessToken:    "token1",
+		Headers:        map[string]string{"x-custom": "value1"},
+		PollIntervalMS: 1,
+	})
+	assert.NoError(t, err)
+	return c, server.Close
+}
+
+func TestNewClientNoURL(t *testing.T) {
+	_, err := NewClient(&ClientConf{})
+	assert.Regexp(t, "No URL specified", err)
+}
+
+func TestNewClientBadURL(t *testing.T) {
+	_, err := NewClient(&ClientConf{URL: "not a url"})
+	assert.Regexp(t, "Invalid URL", err)
+}
+
+func TestClientSendsCredentialsAndHeaders(t *testing.T) {
+	assert := assert.New(t)
+	c, done := newTestClient(t, func(res http.ResponseWriter, req *http.Request) {
+		assert.Equal("/abis", req.URL.Path)
+		assert.Equal("Bearer token1", req.Header.Get("Authorization"))
+		assert.Equal("value1", req.Header.Get("x-custom"))
+		res.Write([]byte(`[{"id":"abi1","name":"simple"}]`))
+	})
+	defer done()
+
+	abis, err := c.ListABIs(context.Background())
+	assert.NoError(err)
+	assert.Equal("abi1", abis[0].ID)
+}
+
+func TestClientBasicAuth(t *testing.T) {
+	assert := assert.New(t)
+	server := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		username, password, ok := req.BasicAuth()
+		assert.True(ok)
+		assert.Equal("user1", username)
+		assert.Equal("pass1", password)
+		res.WriteHeader(204)
+	}))
+	defer server.Close()
+	c, _ := NewClient(&ClientConf{URL: server.URL, Username: "user1", Password: "pass1"})
+
+	err := c.DeleteABI(context.Background(), "abi1")
+	assert.NoError(err)
+}
+
+func TestClientErrorStatus(t *testing.T) {
+	assert := assert.New(t)
+	c, done := newTestClient(t, func(res http.ResponseWriter, req *http.Request) {
+		res.WriteHeader(404)
+		res.Write([]byte(`{"error":"No ABI found with ID abi1"}`))
+	})
+	defer done()
+
+	_, err := c.GetABIInfo(context.Background(), "abi1")
+	assert.Regexp("Request failed with status 404: No ABI found with ID abi1", err)
+	assert.True(IsNotFound(err))
+}
+
+func TestClientErrorStatusNoBody(t *testing.T) {
+	assert := assert.New(t)
+	c, done := newTestClient(t, func(res http.ResponseWriter, req *http.Request) {
+		res.WriteHeader(503)
+	})
+	defer done()
+
+	_, err := c.GetABIInfo(context.Background(), "abi1")
+	assert.Regexp("Request failed with status 503: Service Unavailable", err)
+	assert.False(IsNotFound(err))
+}
+
+func TestClientBadResponse(t *testing.T) {
+	assert := assert.New(t)
+	c, done := newTestClient(t, func(res http.ResponseWriter, req *http.Request) {
+		res.Write([]byte(`!json`))
+	})
+	defer done()
+
+	_, err := c.ListStreams(context.Background())
+	assert.Regexp("Invalid response to GET /eventstreams", err)
+}
+
+func TestClientRequestFails(t *testing.T) {
+	c, _ := NewClient(&ClientConf{URL: "http://localhost:0"})
+	_, err := c.ListContracts(context.Background())
+	assert.Regexp(t, "GET /contracts failed", err)
+}
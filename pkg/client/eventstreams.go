@@ -0,0 +1,186 @@
+// Copyright 2021 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"context"
+	"net/http"
+	"strings"
+)
+
+const (
+	streamsPath = "/eventstreams"
+	subsPath    = "/subscriptions"
+)
+
+// StreamWebhook delivers the batches of a stream to a webhook
+type StreamWebhook struct {
+	URL               string            `json:"url,omitempty"`
+	Headers           map[string]string `json:"headers,omitempty"`
+	TLSkipHostVerify  bool              `json:"tlsSkipHostVerify,omitempty"`
+	RequestTimeoutSec uint32            `json:"requestTimeoutSec,omitempty"`
+}
+
+// StreamWebSocket delivers the batches of a stream to the consumers of a WebSocket topic
+type StreamWebSocket struct {
+	Topic              string  `json:"topic,omitempty"`
+	DistributionMode   string  `json:"distributionMode,omitempty"`
+	MaxInFlightBatches int     `json:"maxInFlightBatches,omitempty"`
+	MaxBatchesPerSec   float64 `json:"maxBatchesPerSec,omitempty"`
+}
+
+// Stream is an event stream, that delivers the events of its subscriptions in batches.
+// The less common options, such as Kafka delivery, retry and dead letter policies, are
+// passed through as JSON objects with the same fields as the REST API
+type Stream struct {
+	ID                   string                 `json:"id,omitempty"`
+	Name                 string                 `json:"name,omitempty"`
+	Path                 string                 `json:"path,omitempty"`
+	Created              string                 `json:"created,omitempty"`
+	Suspended            bool                   `json:"suspended,omitempty"`
+	Type                 string                 `json:"type,omitempty"`
+	BatchSize            uint64                 `json:"batchSize,omitempty"`
+	BatchTimeoutMS       uint64                 `json:"batchTimeoutMS,omitempty"`
+	ErrorHandling        string                 `json:"errorHandling,omitempty"`
+	RetryTimeoutSec      uint64                 `json:"retryTimeoutSec,omitempty"`
+	BlockedRetryDelaySec uint64                 `json:"blockedReryDelaySec,omitempty"`
+	Webhook              *StreamWebhook         `json:"webhook,omitempty"`
+	WebSocket            *StreamWebSocket       `json:"websocket,omitempty"`
+	Kafka                map[string]interface{} `json:"kafka,omitempty"`
+	Timestamps           bool                   `json:"timestamps,omitempty"`
+	Confirmations        uint64                 `json:"confirmations,omitempty"`
+	ReorgDepth           uint64                 `json:"reorgDepth,omitempty"`
+	Retry                map[string]interface{} `json:"retry,omitempty"`
+	DeadLetter           map[string]interface{} `json:"deadLetter,omitempty"`
+}
+
+// Subscription is a subscription to the events of a contract (or all contracts with the ABI),
+// or to blocks or pending transactions, delivered through a stream
+type Subscription struct {
+	ID        string                 `json:"id,omitempty"`
+	Path      string                 `json:"path,omitempty"`
+	Name      string                 `json:"name,omitempty"`
+	Stream    string                 `json:"stream"`
+	Created   string                 `json:"created,omitempty"`
+	Type      string                 `json:"type,omitempty"`
+	Event     *ABIElement            `json:"event,omitempty"`
+	Filter    map[string]interface{} `json:"filter,omitempty"`
+	FromBlock string                 `json:"fromBlock,omitempty"`
+	Suspended bool                   `json:"suspended,omitempty"`
+}
+
+// SubscribeRequest subscribes to an event on a stream. FromBlock is a block number, or
+// "latest" (the default) to only receive new events
+type SubscribeRequest struct {
+	Stream      string                 `json:"stream"`
+	FromBlock   string                 `json:"fromBlock,omitempty"`
+	Name        string                 `json:"name,omitempty"`
+	Aggregation map[string]interface{} `json:"aggregation,omitempty"`
+}
+
+func (c *client) CreateStream(ctx context.Context, stream *Stream) (*Stream, error) {
+	var created Stream
+	if _, err := c.do(ctx, http.MethodPost, streamsPath, nil, nil, stream, &created); err != nil {
+		return nil, err
+	}
+	return &created, nil
+}
+
+func (c *client) UpdateStream(ctx context.Context, id string, stream *Stream) (*Stream, error) {
+	var updated Stream
+	if _, err := c.do(ctx, http.MethodPatch, streamsPath+"/"+pathEscape(id), nil, nil, stream, &updated); err != nil {
+		return nil, err
+	}
+	return &updated, nil
+}
+
+func (c *client) ListStreams(ctx context.Context) ([]*Stream, error) {
+	var streams []*Stream
+	_, err := c.do(ctx, http.MethodGet, streamsPath, nil, nil, nil, &streams)
+	return streams, err
+}
+
+func (c *client) GetStream(ctx context.Context, id string) (*Stream, error) {
+	var stream Stream
+	if _, err := c.do(ctx, http.MethodGet, streamsPath+"/"+pathEscape(id), nil, nil, nil, &stream); err != nil {
+		return nil, err
+	}
+	return &stream, nil
+}
+
+func (c *client) DeleteStream(ctx context.Context, id string) error {
+	_, err := c.do(ctx, http.MethodDelete, streamsPath+"/"+pathEscape(id), nil, nil, nil, nil)
+	return err
+}
+
+func (c *client) SuspendStream(ctx context.Context, id string) error {
+	_, err := c.do(ctx, http.MethodPost, streamsPath+"/"+pathEscape(id)+"/suspend", nil, nil, nil, nil)
+	return err
+}
+
+func (c *client) ResumeStream(ctx context.Context, id string) error {
+	_, err := c.do(ctx, http.MethodPost, streamsPath+"/"+pathEscape(id)+"/resume", nil, nil, nil, nil)
+	return err
+}
+
+// Subscribe subscribes to an event of a contract instance, by address or registered name.
+// A path starting with /abis/ID subscribes to the event on every contract with that ABI
+func (c *client) Subscribe(ctx context.Context, contract, event string, subReq *SubscribeRequest) (*Subscription, error) {
+	path := contractPath(contract)
+	if strings.HasPrefix(contract, "/abis/") {
+		path = contract
+	}
+	var sub Subscription
+	if _, err := c.do(ctx, http.MethodPost, path+"/"+pathEscape(event)+"/subscribe", nil, nil, subReq, &sub); err != nil {
+		return nil, err
+	}
+	return &sub, nil
+}
+
+func (c *client) ListSubscriptions(ctx context.Context) ([]*Subscription, error) {
+	var subs []*Subscription
+	_, err := c.do(ctx, http.MethodGet, subsPath, nil, nil, nil, &subs)
+	return subs, err
+}
+
+func (c *client) GetSubscription(ctx context.Context, id string) (*Subscription, error) {
+	var sub Subscription
+	if _, err := c.do(ctx, http.MethodGet, subsPath+"/"+pathEscape(id), nil, nil, nil, &sub); err != nil {
+		return nil, err
+	}
+	return &sub, nil
+}
+
+func (c *client) DeleteSubscription(ctx context.Context, id string) error {
+	_, err := c.do(ctx, http.MethodDelete, subsPath+"/"+pathEscape(id), nil, nil, nil, nil)
+	return err
+}
+
+// ResetSubscription re-reads the events of a subscription from a block number
+func (c *client) ResetSubscription(ctx context.Context, id, fromBlock string) error {
+	body := map[string]string{"fromBlock": fromBlock}
+	_, err := c.do(ctx, http.MethodPost, subsPath+"/"+pathEscape(id)+"/reset", nil, nil, body, nil)
+	return err
+}
+
+func (c *client) SuspendSubscription(ctx context.Context, id string) error {
+	_, err := c.do(ctx, http.MethodPost, subsPath+"/"+pathEscape(id)+"/suspend", nil, nil, nil, nil)
+	return err
+}
+
+func (c *client) ResumeSubscription(ctx context.Context, id string) error {
+	_, err := c.do(ctx, http.MethodPost, subsPath+"/"+pathEscape(id)+"/resume", nil, nil, nil, nil)
+	return err
+}
@@ -0,0 +1,173 @@
+// Copyright 2021 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStreams(t *testing.T) {
+	assert := assert.New(t)
+	var calls []string
+	c, done := newTestClient(t, func(res http.ResponseWriter, req *http.Request) {
+		calls = append(calls, req.Method+" "+req.URL.Path)
+		switch req.Method + " " + req.URL.Path {
+		case "POST /eventstreams":
+			var stream Stream
+			json.NewDecoder(req.Body).Decode(&stream)
+			assert.Equal("webhook", stream.Type)
+			assert.Equal("http://localhost/hook", stream.Webhook.URL)
+			stream.ID = "es-1"
+			json.NewEncoder(res).Encode(&stream)
+		case "PATCH /eventstreams/es-1":
+			res.Write([]byte(`{"id":"es-1","batchSize":50}`))
+		case "GET /eventstreams":
+			res.Write([]byte(`[{"id":"es-1"}]`))
+		case "GET /eventstreams/es-1":
+			res.Write([]byte(`{"id":"es-1","suspended":true}`))
+		default:
+			res.WriteHeader(204)
+		}
+	})
+	defer done()
+
+	ctx := context.Background()
+	stream, err := c.CreateStream(ctx, &Stream{
+		Name:    "stream1",
+		Type:    "webhook",
+		Webhook: &StreamWebhook{URL: "http://localhost/hook"},
+	})
+	assert.NoError(err)
+	assert.Equal("es-1", stream.ID)
+	stream, err = c.UpdateStream(ctx, "es-1", &Stream{BatchSize: 50})
+	assert.NoError(err)
+	assert.Equal(uint64(50), stream.BatchSize)
+	streams, err := c.ListStreams(ctx)
+	assert.NoError(err)
+	assert.Len(streams, 1)
+	stream, err = c.GetStream(ctx, "es-1")
+	assert.NoError(err)
+	assert.True(stream.Suspended)
+	assert.NoError(c.SuspendStream(ctx, "es-1"))
+	assert.NoError(c.ResumeStream(ctx, "es-1"))
+	assert.NoError(c.DeleteStream(ctx, "es-1"))
+	assert.Equal([]string{
+		"POST /eventstreams",
+		"PATCH /eventstreams/es-1",
+		"GET /eventstreams",
+		"GET /eventstreams/es-1",
+		"POST /eventstreams/es-1/suspend",
+		"POST /eventstreams/es-1/resume",
+		"DELETE /eventstreams/es-1",
+	}, calls)
+}
+
+func TestStreamNotFound(t *testing.T) {
+	c, done := newTestClient(t, func(res http.ResponseWriter, req *http.Request) {
+		res.WriteHeader(404)
+		res.Write([]byte(`{"error":"Stream with ID 'es-1' not found"}`))
+	})
+	defer done()
+
+	_, err := c.GetStream(context.Background(), "es-1")
+	assert.Regexp(t, "Stream with ID 'es-1' not found", err)
+}
+
+func TestSubscribe(t *testing.T) {
+	assert := assert.New(t)
+	c, done := newTestClient(t, func(res http.ResponseWriter, req *http.Request) {
+		assert.Equal("POST", req.Method)
+		var subReq SubscribeRequest
+		json.NewDecoder(req.Body).Decode(&subReq)
+		assert.Equal("es-1", subReq.Stream)
+		assert.Equal("0", subReq.FromBlock)
+		switch req.URL.Path {
+		case "/contracts/0x0123456789abcdef0123456789abcdef01234567/Changed/subscribe":
+			res.Write([]byte(`{"id":"sb-1","stream":"es-1","event":{"type":"event","name":"Changed"}}`))
+		case "/abis/abi1/Changed/subscribe":
+			res.Write([]byte(`{"id":"sb-2","stream":"es-1"}`))
+		default:
+			res.WriteHeader(404)
+		}
+	})
+	defer done()
+
+	ctx := context.Background()
+	sub, err := c.Subscribe(ctx, "0x0123456789abcdef0123456789abcdef01234567", "Changed", &SubscribeRequest{Stream: "es-1", FromBlock: "0"})
+	assert.NoError(err)
+	assert.Equal("sb-1", sub.ID)
+	assert.Equal("Changed", sub.Event.Name)
+	sub, err = c.Subscribe(ctx, "/abis/abi1", "Changed", &SubscribeRequest{Stream: "es-1", FromBlock: "0"})
+	assert.NoError(err)
+	assert.Equal("sb-2", sub.ID)
+}
+
+func TestSubscribeFail(t *testing.T) {
+	c, done := newTestClient(t, func(res http.ResponseWriter, req *http.Request) {
+		res.WriteHeader(400)
+		res.Write([]byte(`{"error":"Must supply a 'stream' parameter in the body or query"}`))
+	})
+	defer done()
+
+	_, err := c.Subscribe(context.Background(), "mycontract", "Changed", &SubscribeRequest{})
+	assert.Regexp(t, "Must supply a 'stream'", err)
+}
+
+func TestSubscriptions(t *testing.T) {
+	assert := assert.New(t)
+	var calls []string
+	c, done := newTestClient(t, func(res http.ResponseWriter, req *http.Request) {
+		calls = append(calls, req.Method+" "+req.URL.Path)
+		switch req.Method + " " + req.URL.Path {
+		case "GET /subscriptions":
+			res.Write([]byte(`[{"id":"sb-1","stream":"es-1"}]`))
+		case "GET /subscriptions/sb-1":
+			res.Write([]byte(`{"id":"sb-1","stream":"es-1","fromBlock":"10"}`))
+		case "POST /subscriptions/sb-1/reset":
+			var body map[string]string
+			json.NewDecoder(req.Body).Decode(&body)
+			assert.Equal("5", body["fromBlock"])
+			res.WriteHeader(204)
+		default:
+			res.WriteHeader(204)
+		}
+	})
+	defer done()
+
+	ctx := context.Background()
+	subs, err := c.ListSubscriptions(ctx)
+	assert.NoError(err)
+	assert.Len(subs, 1)
+	sub, err := c.GetSubscription(ctx, "sb-1")
+	assert.NoError(err)
+	assert.Equal("10", sub.FromBlock)
+	assert.NoError(c.ResetSubscription(ctx, "sb-1", "5"))
+	assert.NoError(c.SuspendSubscription(ctx, "sb-1"))
+	assert.NoError(c.ResumeSubscription(ctx, "sb-1"))
+	assert.NoError(c.DeleteSubscription(ctx, "sb-1"))
+	assert.Equal([]string{
+		"GET /subscriptions",
+		"GET /subscriptions/sb-1",
+		"POST /subscriptions/sb-1/reset",
+		"POST /subscriptions/sb-1/suspend",
+		"POST /subscriptions/sb-1/resume",
+		"DELETE /subscriptions/sb-1",
+	}, calls)
+}
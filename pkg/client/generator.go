@@ -0,0 +1,249 @@
+// Copyright 2021 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"go/format"
+	"go/token"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/kaleido-io/ethconnect/internal/errors"
+)
+
+// BindingsConf configures the Go package generated for a contract
+type BindingsConf struct {
+	Package string `json:"package"`
+	Type    string `json:"type"`
+}
+
+var (
+	goIdentifier  = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+	solidityInt   = regexp.MustCompile(`^u?int[0-9]*$`)
+	solidityBytes = regexp.MustCompile(`^bytes[0-9]*$`)
+)
+
+type bindingParam struct {
+	abiName string // The name of the input in the JSON payload of the request
+	goName  string
+	goType  string
+}
+
+// GenerateBindings generates the source of a Go package with a typed wrapper around a Client
+// for a contract. Each function of the ABI has a method with typed parameters - read-only
+// functions are called, and the others are sent as transactions either asynchronously or
+// waiting for the receipt. Each event has a method to subscribe to it on a stream.
+//
+// Integers are passed as *big.Int and sent as decimal strings, so no precision is lost.
+// Addresses, strings and bytes are strings, and arrays and tuples are passed as they are
+// to the JSON payload. Only the first of any overloaded functions is bound, as the gateway
+// resolves methods by name.
+func GenerateBindings(conf *BindingsConf, abi ABI) ([]byte, error) {
+	if !goIdentifier.MatchString(conf.Package) {
+		return nil, errors.Errorf(errors.ClientGenBadIdentifier, "package", conf.Package)
+	}
+	if !goIdentifier.MatchString(conf.Type) {
+		return nil, errors.Errorf(errors.ClientGenBadIdentifier, "type", conf.Type)
+	}
+	typeName := exportedName(conf.Type)
+
+	var body strings.Builder
+	usesBigInt := false
+	writeParams := func(params []*bindingParam) {
+		for _, p := range params {
+			fmt.Fprintf(&body, ", %s %s", p.goName, p.goType)
+			if p.goType == "*big.Int" {
+				usesBigInt = true
+			}
+		}
+	}
+	writePayload := func(params []*bindingParam) {
+		body.WriteString("map[string]interface{}{")
+		for _, p := range params {
+			value := p.goName
+			if p.goType == "*big.Int" {
+				value = "bigIntParam(" + p.goName + ")"
+			}
+			fmt.Fprintf(&body, "%s: %s, ", strconv.Quote(p.abiName), value)
+		}
+		body.WriteString("}")
+	}
+
+	abiBytes, _ := json.Marshal(abi)
+	abiLiteral := "`" + string(abiBytes) + "`"
+	if strings.Contains(string(abiBytes), "`") {
+		abiLiteral = strconv.Quote(string(abiBytes))
+	}
+	fmt.Fprintf(&body, "// %sABI is the ABI the bindings were generated from\n", typeName)
+	fmt.Fprintf(&body, "const %sABI = %s\n\n", typeName, abiLiteral)
+	fmt.Fprintf(&body, "// %s is a typed client for a %s contract instance\n", typeName, typeName)
+	fmt.Fprintf(&body, "type %s struct {\n\tclient   client.Client\n\tcontract string\n}\n\n", typeName)
+	fmt.Fprintf(&body, "// New%s returns a client for the contract at an address, or registered name\n", typeName)
+	fmt.Fprintf(&body, "func New%s(c client.Client, contract string) *%s {\n\treturn &%s{client: c, contract: contract}\n}\n\n", typeName, typeName, typeName)
+	fmt.Fprintf(&body, "// Contract returns the address or registered name of the contract\n")
+	fmt.Fprintf(&body, "func (x *%s) Contract() string {\n\treturn x.contract\n}\n\n", typeName)
+
+	var constructor *ABIElement
+	for _, e := range abi {
+		if e.Type == "constructor" {
+			constructor = e
+		}
+	}
+	var ctorParams []*bindingParam
+	if constructor != nil {
+		ctorParams = bindingParams(constructor.Inputs)
+	}
+	fmt.Fprintf(&body, "// Deploy%s deploys a new instance from the ABI uploaded to the gateway with abiID\n", typeName)
+	fmt.Fprintf(&body, "func Deploy%s(ctx context.Context, c client.Client, abiID string", typeName)
+	writeParams(ctorParams)
+	body.WriteString(", opts *client.TxOptions) (*client.AsyncSent, error) {\n\treturn c.Deploy(ctx, abiID, ")
+	writePayload(ctorParams)
+	body.WriteString(", opts)\n}\n\n")
+
+	bound := map[string]bool{"Contract": true}
+	for _, e := range abi {
+		if e.Name == "" || (e.Type != "function" && e.Type != "event") {
+			continue
+		}
+		methodName := exportedName(e.Name)
+		if e.Type == "event" {
+			methodName = "Subscribe" + methodName
+		}
+		if bound[methodName] {
+			continue
+		}
+		bound[methodName] = true
+		if e.Type == "function" && !e.IsReadOnly() {
+			bound[methodName+"AndWait"] = true
+		}
+
+		switch {
+		case e.Type == "event":
+			fmt.Fprintf(&body, "// %s subscribes to the %s event of the contract on a stream\n", methodName, e.Name)
+			fmt.Fprintf(&body, "func (x *%s) %s(ctx context.Context, req *client.SubscribeRequest) (*client.Subscription, error) {\n", typeName, methodName)
+			fmt.Fprintf(&body, "\treturn x.client.Subscribe(ctx, x.contract, %s, req)\n}\n\n", strconv.Quote(e.Name))
+		case e.IsReadOnly():
+			params := bindingParams(e.Inputs)
+			fmt.Fprintf(&body, "// %s calls the read-only %s function, and returns the outputs by name\n", methodName, e.Name)
+			fmt.Fprintf(&body, "func (x *%s) %s(ctx context.Context", typeName, methodName)
+			writeParams(params)
+			fmt.Fprintf(&body, ", opts *client.CallOptions) (map[string]interface{}, error) {\n\treturn x.client.Call(ctx, x.contract, %s, ", strconv.Quote(e.Name))
+			writePayload(params)
+			body.WriteString(", opts)\n}\n\n")
+		default:
+			params := bindingParams(e.Inputs)
+			fmt.Fprintf(&body, "// %s sends a transaction to the %s function asynchronously\n", methodName, e.Name)
+			fmt.Fprintf(&body, "func (x *%s) %s(ctx context.Context", typeName, methodName)
+			writeParams(params)
+			fmt.Fprintf(&body, ", opts *client.TxOptions) (*client.AsyncSent, error) {\n\treturn x.client.Invoke(ctx, x.contract, %s, ", strconv.Quote(e.Name))
+			writePayload(params)
+			body.WriteString(", opts)\n}\n\n")
+			fmt.Fprintf(&body, "// %sAndWait sends a transaction to the %s function, and waits for the receipt\n", methodName, e.Name)
+			fmt.Fprintf(&body, "func (x *%s) %sAndWait(ctx context.Context", typeName, methodName)
+			writeParams(params)
+			fmt.Fprintf(&body, ", opts *client.TxOptions) (*client.Receipt, error) {\n\treturn x.client.InvokeAndWait(ctx, x.contract, %s, ", strconv.Quote(e.Name))
+			writePayload(params)
+			body.WriteString(", opts)\n}\n\n")
+		}
+	}
+
+	var src strings.Builder
+	src.WriteString("// Code generated by ethconnect clientgen. DO NOT EDIT.\n\n")
+	fmt.Fprintf(&src, "package %s\n\n", conf.Package)
+	src.WriteString("import (\n\t\"context\"\n")
+	if usesBigInt {
+		src.WriteString("\t\"math/big\"\n")
+	}
+	src.WriteString("\n\t\"github.com/kaleido-io/ethconnect/pkg/client\"\n)\n\n")
+	src.WriteString(body.String())
+	if usesBigInt {
+		src.WriteString("// bigIntParam sends an integer as a decimal string, as JSON numbers lose precision\n")
+		src.WriteString("func bigIntParam(i *big.Int) interface{} {\n\tif i == nil {\n\t\treturn nil\n\t}\n\treturn i.String()\n}\n")
+	}
+
+	formatted, err := format.Source([]byte(src.String()))
+	if err != nil {
+		return nil, errors.Errorf(errors.ClientGenFormat, err)
+	}
+	return formatted, nil
+}
+
+// bindingParams names the inputs of a function as Go parameters. Unnamed inputs are sent
+// as input, input1, input2... as the gateway expects
+func bindingParams(inputs []*ABIParam) []*bindingParam {
+	params := make([]*bindingParam, len(inputs))
+	// The names of the other parameters, the receiver and the imported packages are reserved
+	used := map[string]bool{"ctx": true, "opts": true, "x": true, "c": true, "abiID": true, "client": true, "context": true, "big": true}
+	for i, input := range inputs {
+		abiName := input.Name
+		if abiName == "" {
+			abiName = "input"
+			if i != 0 {
+				abiName += strconv.Itoa(i)
+			}
+		}
+		goName := unexportedName(abiName)
+		if !goIdentifier.MatchString(goName) || token.IsKeyword(goName) || used[goName] {
+			goName += "Arg" + strconv.Itoa(i)
+		}
+		used[goName] = true
+		params[i] = &bindingParam{
+			abiName: abiName,
+			goName:  goName,
+			goType:  goTypeFor(input.Type),
+		}
+	}
+	return params
+}
+
+func goTypeFor(solidityType string) string {
+	switch {
+	case solidityType == "address", solidityType == "string":
+		return "string"
+	case solidityType == "bool":
+		return "bool"
+	case solidityInt.MatchString(solidityType):
+		return "*big.Int"
+	case solidityBytes.MatchString(solidityType):
+		return "string"
+	default:
+		// Arrays and tuples
+		return "interface{}"
+	}
+}
+
+func exportedName(name string) string {
+	name = strings.TrimLeft(name, "_")
+	if name == "" {
+		return "X"
+	}
+	r := []rune(name)
+	r[0] = unicode.ToUpper(r[0])
+	return string(r)
+}
+
+func unexportedName(name string) string {
+	name = strings.TrimLeft(name, "_")
+	if name == "" {
+		return "arg"
+	}
+	r := []rune(name)
+	r[0] = unicode.ToLower(r[0])
+	return string(r)
+}
@@ -0,0 +1,95 @@
+// Copyright 2021 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"encoding/json"
+	"go/parser"
+	"go/token"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testERC20ABI = `[
+	{"type":"constructor","inputs":[{"name":"name","type":"string"},{"name":"supply","type":"uint256"}]},
+	{"type":"function","name":"balanceOf","stateMutability":"view","inputs":[{"name":"account","type":"address"}],"outputs":[{"name":"","type":"uint256"}]},
+	{"type":"function","name":"transfer","stateMutability":"nonpayable","inputs":[{"name":"to","type":"address"},{"name":"amount","type":"uint256"}],"outputs":[{"name":"","type":"bool"}]},
+	{"type":"function","name":"transfer","stateMutability":"nonpayable","inputs":[{"name":"to","type":"address"},{"name":"amount","type":"uint256"},{"name":"data","type":"bytes"}]},
+	{"type":"function","name":"setFlags","inputs":[{"name":"","type":"bool"},{"name":"type","type":"bytes32"},{"name":"ids","type":"uint256[]"}]},
+	{"type":"function","name":"contract","constant":true,"inputs":[]},
+	{"type":"event","name":"Transfer","inputs":[{"name":"from","type":"address","indexed":true},{"name":"to","type":"address","indexed":true},{"name":"value","type":"uint256"}]},
+	{"type":"error","name":"InsufficientBalance","inputs":[]}
+]`
+
+func TestGenerateBindings(t *testing.T) {
+	assert := assert.New(t)
+
+	var abi ABI
+	assert.NoError(json.Unmarshal([]byte(testERC20ABI), &abi))
+	src, err := GenerateBindings(&BindingsConf{Package: "erc20", Type: "token"}, abi)
+	assert.NoError(err)
+
+	_, err = parser.ParseFile(token.NewFileSet(), "erc20.go", src, 0)
+	assert.NoError(err)
+	s := string(src)
+	assert.Contains(s, "// Code generated by ethconnect clientgen. DO NOT EDIT.")
+	assert.Contains(s, "package erc20")
+	assert.Contains(s, `"math/big"`)
+	assert.Contains(s, "const TokenABI = `[{\"type\":\"constructor\"")
+	assert.Contains(s, "func NewToken(c client.Client, contract string) *Token {")
+	assert.Contains(s, "func DeployToken(ctx context.Context, c client.Client, abiID string, name string, supply *big.Int, opts *client.TxOptions) (*client.AsyncSent, error) {")
+	assert.Contains(s, `return c.Deploy(ctx, abiID, map[string]interface{}{"name": name, "supply": bigIntParam(supply)}, opts)`)
+	assert.Contains(s, "func (x *Token) BalanceOf(ctx context.Context, account string, opts *client.CallOptions) (map[string]interface{}, error) {")
+	assert.Contains(s, `return x.client.Call(ctx, x.contract, "balanceOf", map[string]interface{}{"account": account}, opts)`)
+	assert.Contains(s, "func (x *Token) Transfer(ctx context.Context, to string, amount *big.Int, opts *client.TxOptions) (*client.AsyncSent, error) {")
+	assert.Contains(s, "func (x *Token) TransferAndWait(ctx context.Context, to string, amount *big.Int, opts *client.TxOptions) (*client.Receipt, error) {")
+	assert.NotContains(s, "data string")
+	assert.Contains(s, "func (x *Token) SetFlags(ctx context.Context, input bool, typeArg1 string, ids interface{}, opts *client.TxOptions) (*client.AsyncSent, error) {")
+	assert.Contains(s, `map[string]interface{}{"input": input, "type": typeArg1, "ids": ids}`)
+	assert.NotContains(s, "func (x *Token) Contract(ctx")
+	assert.Contains(s, "func (x *Token) SubscribeTransfer(ctx context.Context, req *client.SubscribeRequest) (*client.Subscription, error) {")
+	assert.NotContains(s, "InsufficientBalance(")
+}
+
+func TestGenerateBindingsNoIntegers(t *testing.T) {
+	assert := assert.New(t)
+
+	src, err := GenerateBindings(&BindingsConf{Package: "simple", Type: "Simple"}, ABI{
+		{Type: "function", Name: "setName", Inputs: []*ABIParam{{Name: "_name", Type: "string"}}},
+	})
+	assert.NoError(err)
+	s := string(src)
+	assert.NotContains(s, "math/big")
+	assert.NotContains(s, "bigIntParam")
+	assert.Contains(s, "func DeploySimple(ctx context.Context, c client.Client, abiID string, opts *client.TxOptions)")
+	assert.Contains(s, `func (x *Simple) SetName(ctx context.Context, name string, opts *client.TxOptions)`)
+	assert.Contains(s, `map[string]interface{}{"_name": name}`)
+}
+
+func TestGenerateBindingsBadNames(t *testing.T) {
+	_, err := GenerateBindings(&BindingsConf{Package: "my-package", Type: "Simple"}, ABI{})
+	assert.Regexp(t, "Invalid package name 'my-package'", err)
+
+	_, err = GenerateBindings(&BindingsConf{Package: "simple", Type: ""}, ABI{})
+	assert.Regexp(t, "Invalid type name ''", err)
+}
+
+func TestGenerateBindingsFormatFail(t *testing.T) {
+	_, err := GenerateBindings(&BindingsConf{Package: "simple", Type: "Simple"}, ABI{
+		{Type: "function", Name: "bad name"},
+	})
+	assert.Regexp(t, "Failed to format generated bindings", err)
+}
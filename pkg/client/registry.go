@@ -0,0 +1,222 @@
+// Copyright 2021 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/kaleido-io/ethconnect/internal/errors"
+)
+
+// ABIParam is an input or output of an ABI function or event
+type ABIParam struct {
+	Name         string      `json:"name"`
+	Type         string      `json:"type"`
+	InternalType string      `json:"internalType,omitempty"`
+	Indexed      bool        `json:"indexed,omitempty"`
+	Components   []*ABIParam `json:"components,omitempty"`
+}
+
+// ABIElement is a function, event, error or constructor of an ABI
+type ABIElement struct {
+	Type            string      `json:"type"`
+	Name            string      `json:"name,omitempty"`
+	Inputs          []*ABIParam `json:"inputs,omitempty"`
+	Outputs         []*ABIParam `json:"outputs,omitempty"`
+	StateMutability string      `json:"stateMutability,omitempty"`
+	Constant        bool        `json:"constant,omitempty"`
+	Payable         bool        `json:"payable,omitempty"`
+	Anonymous       bool        `json:"anonymous,omitempty"`
+}
+
+// ABI is the JSON ABI of a contract
+type ABI []*ABIElement
+
+// IsReadOnly returns true for a function that does not modify the state of the chain,
+// which is called rather than sent as a transaction
+func (e *ABIElement) IsReadOnly() bool {
+	return e.Constant || e.StateMutability == "view" || e.StateMutability == "pure"
+}
+
+// ABIInfo is an ABI (a contract factory) uploaded to the gateway, that instances are deployed from
+type ABIInfo struct {
+	ID              string `json:"id"`
+	Name            string `json:"name"`
+	Description     string `json:"description"`
+	Path            string `json:"path"`
+	Deployable      bool   `json:"deployable"`
+	OpenAPI         string `json:"openapi"`
+	CompilerVersion string `json:"compilerVersion"`
+	Created         string `json:"created,omitempty"`
+}
+
+// ContractInfo is a contract instance registered with the gateway
+type ContractInfo struct {
+	Address        string `json:"address"`
+	Path           string `json:"path"`
+	ABI            string `json:"abi"`
+	OpenAPI        string `json:"openapi"`
+	RegisteredAs   string `json:"registeredAs"`
+	Environment    string `json:"environment,omitempty"`
+	Implementation string `json:"implementation,omitempty"`
+	Created        string `json:"created,omitempty"`
+}
+
+// AddABIRequest uploads either a pre-compiled ABI and bytecode, or Solidity source files
+// that the gateway compiles. With more than one contract in the source, Contract selects one
+type AddABIRequest struct {
+	ABI      ABI               `json:"abi,omitempty"`
+	Bytecode string            `json:"bytecode,omitempty"`
+	Files    map[string][]byte `json:"-"`
+	Source   string            `json:"source,omitempty"`   // The file to compile, within the uploaded files
+	Contract string            `json:"contract,omitempty"` // The contract within the compiled source
+	Compiler string            `json:"compiler,omitempty"` // Solidity version, such as 0.8
+	EVM      string            `json:"evm,omitempty"`
+}
+
+// RegisterOptions are the options for registering an existing contract instance against an ABI
+type RegisterOptions struct {
+	RegisterAs  string // A friendly name to address the contract by
+	Environment string // The environment the name is registered in
+	DetectProxy bool   // Bind a proxy to the ABI of its implementation
+}
+
+func (c *client) AddABI(ctx context.Context, abiReq *AddABIRequest) (*ABIInfo, error) {
+	var body bytes.Buffer
+	w := multipart.NewWriter(&body)
+	if abiReq.ABI != nil {
+		abiBytes, _ := json.Marshal(abiReq.ABI)
+		w.WriteField("abi", string(abiBytes))
+	}
+	fields := map[string]string{
+		"bytecode": abiReq.Bytecode,
+		"source":   abiReq.Source,
+		"contract": abiReq.Contract,
+		"compiler": abiReq.Compiler,
+		"evm":      abiReq.EVM,
+	}
+	for _, name := range []string{"bytecode", "source", "contract", "compiler", "evm"} {
+		if fields[name] != "" {
+			w.WriteField(name, fields[name])
+		}
+	}
+	// Sorted so the upload is deterministic
+	fileNames := make([]string, 0, len(abiReq.Files))
+	for name := range abiReq.Files {
+		fileNames = append(fileNames, name)
+	}
+	sort.Strings(fileNames)
+	for _, name := range fileNames {
+		fw, err := w.CreateFormFile("files", name)
+		if err != nil {
+			return nil, errors.Errorf(errors.ClientRequestSerialize, err)
+		}
+		fw.Write(abiReq.Files[name])
+	}
+	if err := w.Close(); err != nil {
+		return nil, errors.Errorf(errors.ClientRequestSerialize, err)
+	}
+	var info ABIInfo
+	if _, err := c.doRaw(ctx, http.MethodPost, "/abis", nil, nil, &body, w.FormDataContentType(), &info); err != nil {
+		return nil, err
+	}
+	return &info, nil
+}
+
+func (c *client) ListABIs(ctx context.Context) ([]*ABIInfo, error) {
+	var abis []*ABIInfo
+	_, err := c.do(ctx, http.MethodGet, "/abis", nil, nil, nil, &abis)
+	return abis, err
+}
+
+func (c *client) GetABIInfo(ctx context.Context, abiID string) (*ABIInfo, error) {
+	var info ABIInfo
+	if _, err := c.do(ctx, http.MethodGet, "/abis/"+pathEscape(abiID), nil, nil, nil, &info); err != nil {
+		return nil, err
+	}
+	return &info, nil
+}
+
+func (c *client) GetABI(ctx context.Context, abiID string) (ABI, error) {
+	var abi ABI
+	_, err := c.do(ctx, http.MethodGet, "/abis/"+pathEscape(abiID), url.Values{"abi": []string{"true"}}, nil, nil, &abi)
+	return abi, err
+}
+
+func (c *client) DeleteABI(ctx context.Context, abiID string) error {
+	_, err := c.do(ctx, http.MethodDelete, "/abis/"+pathEscape(abiID), nil, nil, nil, nil)
+	return err
+}
+
+func (c *client) RegisterContract(ctx context.Context, abiID, address string, opts *RegisterOptions) (*ContractInfo, error) {
+	headers := map[string]string{}
+	if opts != nil {
+		if opts.RegisterAs != "" {
+			headers[c.flyHeader("register")] = opts.RegisterAs
+		}
+		if opts.Environment != "" {
+			headers[c.flyHeader("environment")] = opts.Environment
+		}
+		if opts.DetectProxy {
+			headers[c.flyHeader("detectproxy")] = "true"
+		}
+	}
+	var info ContractInfo
+	if _, err := c.do(ctx, http.MethodPost, "/abis/"+pathEscape(abiID)+"/"+pathEscape(address), nil, headers, nil, &info); err != nil {
+		return nil, err
+	}
+	return &info, nil
+}
+
+func (c *client) ListContracts(ctx context.Context) ([]*ContractInfo, error) {
+	var contracts []*ContractInfo
+	_, err := c.do(ctx, http.MethodGet, "/contracts", nil, nil, nil, &contracts)
+	return contracts, err
+}
+
+func (c *client) GetContract(ctx context.Context, addressOrName string) (*ContractInfo, error) {
+	var info ContractInfo
+	if _, err := c.do(ctx, http.MethodGet, contractPath(addressOrName), nil, nil, nil, &info); err != nil {
+		return nil, err
+	}
+	return &info, nil
+}
+
+func (c *client) GetContractABI(ctx context.Context, addressOrName string) (ABI, error) {
+	var abi ABI
+	_, err := c.do(ctx, http.MethodGet, contractPath(addressOrName), url.Values{"abi": []string{"true"}}, nil, nil, &abi)
+	return abi, err
+}
+
+func (c *client) DeleteContract(ctx context.Context, addressOrName string) error {
+	_, err := c.do(ctx, http.MethodDelete, contractPath(addressOrName), nil, nil, nil, nil)
+	return err
+}
+
+// contractPath is the path of a contract instance by address or registered name.
+// A full path of a remote registry instance, such as /instances/xyz, is used as is
+func contractPath(addressOrName string) string {
+	if strings.HasPrefix(addressOrName, "/") {
+		return addressOrName
+	}
+	return "/contracts/" + pathEscape(addressOrName)
+}
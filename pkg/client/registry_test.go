@@ -0,0 +1,179 @@
+// Copyright 2021 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAddABIPrecompiled(t *testing.T) {
+	assert := assert.New(t)
+	c, done := newTestClient(t, func(res http.ResponseWriter, req *http.Request) {
+		assert.Equal("POST", req.Method)
+		assert.Equal("/abis", req.URL.Path)
+		assert.NoError(req.ParseMultipartForm(1024 * 1024))
+		assert.Equal(`[{"type":"function","name":"set"}]`, req.FormValue("abi"))
+		assert.Equal("0x1234", req.FormValue("bytecode"))
+		assert.Empty(req.FormValue("contract"))
+		res.Write([]byte(`{"id":"abi1","deployable":true}`))
+	})
+	defer done()
+
+	info, err := c.AddABI(context.Background(), &AddABIRequest{
+		ABI:      ABI{{Type: "function", Name: "set"}},
+		Bytecode: "0x1234",
+	})
+	assert.NoError(err)
+	assert.Equal("abi1", info.ID)
+	assert.True(info.Deployable)
+}
+
+func TestAddABISolidity(t *testing.T) {
+	assert := assert.New(t)
+	c, done := newTestClient(t, func(res http.ResponseWriter, req *http.Request) {
+		assert.NoError(req.ParseMultipartForm(1024 * 1024))
+		assert.Equal("simple.sol", req.FormValue("source"))
+		assert.Equal("Simple", req.FormValue("contract"))
+		assert.Equal("0.8", req.FormValue("compiler"))
+		files := req.MultipartForm.File["files"]
+		assert.Len(files, 1)
+		assert.Equal("simple.sol", files[0].Filename)
+		f, _ := files[0].Open()
+		b, _ := ioutil.ReadAll(f)
+		assert.Equal("contract Simple {}", string(b))
+		res.Write([]byte(`{"id":"abi1"}`))
+	})
+	defer done()
+
+	_, err := c.AddABI(context.Background(), &AddABIRequest{
+		Files:    map[string][]byte{"simple.sol": []byte("contract Simple {}")},
+		Source:   "simple.sol",
+		Contract: "Simple",
+		Compiler: "0.8",
+	})
+	assert.NoError(err)
+}
+
+func TestAddABIFail(t *testing.T) {
+	c, done := newTestClient(t, func(res http.ResponseWriter, req *http.Request) {
+		res.WriteHeader(400)
+		res.Write([]byte(`{"error":"Solidity compilation failed"}`))
+	})
+	defer done()
+
+	_, err := c.AddABI(context.Background(), &AddABIRequest{})
+	assert.Regexp(t, "Solidity compilation failed", err)
+}
+
+func TestGetABI(t *testing.T) {
+	assert := assert.New(t)
+	c, done := newTestClient(t, func(res http.ResponseWriter, req *http.Request) {
+		assert.Equal("/abis/abi1", req.URL.Path)
+		assert.Equal("true", req.URL.Query().Get("abi"))
+		res.Write([]byte(`[{"type":"function","name":"get","stateMutability":"view","outputs":[{"name":"x","type":"uint256"}]}]`))
+	})
+	defer done()
+
+	abi, err := c.GetABI(context.Background(), "abi1")
+	assert.NoError(err)
+	assert.Equal("get", abi[0].Name)
+	assert.True(abi[0].IsReadOnly())
+}
+
+func TestGetABIInfo(t *testing.T) {
+	assert := assert.New(t)
+	c, done := newTestClient(t, func(res http.ResponseWriter, req *http.Request) {
+		assert.Equal("/abis/abi1", req.URL.Path)
+		assert.Empty(req.URL.RawQuery)
+		res.Write([]byte(`{"id":"abi1","name":"simple"}`))
+	})
+	defer done()
+
+	info, err := c.GetABIInfo(context.Background(), "abi1")
+	assert.NoError(err)
+	assert.Equal("simple", info.Name)
+}
+
+func TestRegisterContract(t *testing.T) {
+	assert := assert.New(t)
+	c, done := newTestClient(t, func(res http.ResponseWriter, req *http.Request) {
+		assert.Equal("POST", req.Method)
+		assert.Equal("/abis/abi1/0x0123456789abcdef0123456789abcdef01234567", req.URL.Path)
+		assert.Equal("mycontract", req.Header.Get("x-firefly-register"))
+		assert.Equal("prod", req.Header.Get("x-firefly-environment"))
+		assert.Equal("true", req.Header.Get("x-firefly-detectproxy"))
+		res.WriteHeader(201)
+		res.Write([]byte(`{"address":"0123456789abcdef0123456789abcdef01234567","registeredAs":"mycontract"}`))
+	})
+	defer done()
+
+	info, err := c.RegisterContract(context.Background(), "abi1", "0x0123456789abcdef0123456789abcdef01234567", &RegisterOptions{
+		RegisterAs:  "mycontract",
+		Environment: "prod",
+		DetectProxy: true,
+	})
+	assert.NoError(err)
+	assert.Equal("mycontract", info.RegisteredAs)
+}
+
+func TestRegisterContractFail(t *testing.T) {
+	c, done := newTestClient(t, func(res http.ResponseWriter, req *http.Request) {
+		res.WriteHeader(404)
+	})
+	defer done()
+
+	_, err := c.RegisterContract(context.Background(), "abi1", "bad", nil)
+	assert.True(t, IsNotFound(err))
+}
+
+func TestContracts(t *testing.T) {
+	assert := assert.New(t)
+	c, done := newTestClient(t, func(res http.ResponseWriter, req *http.Request) {
+		switch req.Method + " " + req.URL.EscapedPath() {
+		case "GET /contracts":
+			res.Write([]byte(`[{"address":"0123456789abcdef0123456789abcdef01234567"}]`))
+		case "GET /contracts/my%20contract":
+			if req.URL.Query().Get("abi") == "true" {
+				res.Write([]byte(`[{"type":"event","name":"Changed"}]`))
+			} else {
+				res.Write([]byte(`{"registeredAs":"my contract"}`))
+			}
+		case "DELETE /instances/remote1":
+			res.WriteHeader(204)
+		default:
+			res.WriteHeader(404)
+		}
+	})
+	defer done()
+
+	ctx := context.Background()
+	contracts, err := c.ListContracts(ctx)
+	assert.NoError(err)
+	assert.Len(contracts, 1)
+	info, err := c.GetContract(ctx, "my contract")
+	assert.NoError(err)
+	assert.Equal("my contract", info.RegisteredAs)
+	abi, err := c.GetContractABI(ctx, "my contract")
+	assert.NoError(err)
+	assert.Equal("Changed", abi[0].Name)
+	assert.NoError(c.DeleteContract(ctx, "/instances/remote1"))
+	_, err = c.GetContract(ctx, "unknown")
+	assert.True(IsNotFound(err))
+}
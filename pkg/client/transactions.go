@@ -0,0 +1,292 @@
+// Copyright 2021 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/kaleido-io/ethconnect/internal/errors"
+)
+
+const (
+	// ReceiptTypeSuccess is the type of the receipt of a transaction that was mined successfully
+	ReceiptTypeSuccess = "TransactionSuccess"
+	// ReceiptTypeFailure is the type of the receipt of a transaction that was mined, but reverted
+	ReceiptTypeFailure = "TransactionFailure"
+	// ReceiptTypeError is the type of the reply to a transaction that could not be submitted
+	ReceiptTypeError = "Error"
+)
+
+// TxOptions are the options of a transaction, sent as x-firefly-* headers. All are optional,
+// and Value is in wei
+type TxOptions struct {
+	From                 string
+	Value                string
+	Gas                  string
+	GasPrice             string
+	MaxFeePerGas         string
+	MaxPriorityFeePerGas string
+	Nonce                string
+	Priority             string
+	Confirmations        int64
+	PrivateFrom          string
+	PrivateFor           []string
+	PrivacyGroupID       string
+	RegisterAs           string // For a deployment, registers the new contract with a friendly name
+	IdempotencyKey       string // Set to a unique value per transaction, so a retry does not submit it twice
+}
+
+// CallOptions are the options of a read-only call. Only one of BlockNumber, BlockTag and
+// AsOf can be set, and without any the call is made at the latest block
+type CallOptions struct {
+	From        string
+	BlockNumber string
+	BlockTag    string
+	AsOf        string
+}
+
+// AsyncSent is the acknowledgement of a transaction accepted for asynchronous submission.
+// The ID is used to query the receipt
+type AsyncSent struct {
+	Sent bool   `json:"sent"`
+	ID   string `json:"id"`
+	Msg  string `json:"msg,omitempty"`
+}
+
+// ReceiptHeaders are the headers of a reply in the receipt store
+type ReceiptHeaders struct {
+	ID            string                 `json:"id,omitempty"`
+	Type          string                 `json:"type"`
+	RequestID     string                 `json:"requestId,omitempty"`
+	TimeReceived  string                 `json:"timeReceived,omitempty"`
+	TimeElapsed   float64                `json:"timeElapsed,omitempty"`
+	Confirmations int64                  `json:"confirmations,omitempty"`
+	Context       map[string]interface{} `json:"ctx,omitempty"`
+}
+
+// Receipt is the reply to a transaction - the receipt of a mined transaction, or the error
+// that prevented it being submitted
+type Receipt struct {
+	Headers           ReceiptHeaders           `json:"headers"`
+	TransactionHash   string                   `json:"transactionHash,omitempty"`
+	BlockHash         string                   `json:"blockHash,omitempty"`
+	BlockNumber       string                   `json:"blockNumber,omitempty"`
+	TransactionIndex  string                   `json:"transactionIndex,omitempty"`
+	From              string                   `json:"from,omitempty"`
+	To                string                   `json:"to,omitempty"`
+	ContractAddress   string                   `json:"contractAddress,omitempty"`
+	GasUsed           string                   `json:"gasUsed,omitempty"`
+	CumulativeGasUsed string                   `json:"cumulativeGasUsed,omitempty"`
+	Nonce             string                   `json:"nonce,omitempty"`
+	Status            string                   `json:"status,omitempty"`
+	RevertReason      string                   `json:"revertReason,omitempty"`
+	ErrorMessage      string                   `json:"errorMessage,omitempty"`
+	DecodedEvents     []map[string]interface{} `json:"decodedEvents,omitempty"`
+	RegisterAs        string                   `json:"registerAs,omitempty"`
+}
+
+// Succeeded returns true if the transaction was mined successfully
+func (r *Receipt) Succeeded() bool {
+	return r.Headers.Type == ReceiptTypeSuccess
+}
+
+// err returns the failure of a receipt that did not succeed, as an error
+func (r *Receipt) err() error {
+	if r.Succeeded() {
+		return nil
+	}
+	reason := r.ErrorMessage
+	if reason == "" {
+		reason = r.RevertReason
+	}
+	if reason == "" {
+		reason = r.Headers.Type
+	}
+	return errors.Errorf(errors.ClientTransactionFailed, r.Headers.RequestID, reason)
+}
+
+func (c *client) txHeaders(opts *TxOptions, sync bool) map[string]string {
+	headers := map[string]string{}
+	if sync {
+		headers[c.flyHeader("sync")] = "true"
+	}
+	if opts == nil {
+		return headers
+	}
+	values := map[string]string{
+		"from":                 opts.From,
+		"ethvalue":             opts.Value,
+		"gas":                  opts.Gas,
+		"gasprice":             opts.GasPrice,
+		"maxfeepergas":         opts.MaxFeePerGas,
+		"maxpriorityfeepergas": opts.MaxPriorityFeePerGas,
+		"nonce":                opts.Nonce,
+		"priority":             opts.Priority,
+		"privatefrom":          opts.PrivateFrom,
+		"privatefor":           strings.Join(opts.PrivateFor, ","),
+		"privacygroupid":       opts.PrivacyGroupID,
+		"register":             opts.RegisterAs,
+	}
+	if opts.Confirmations > 0 {
+		values["confirmations"] = strconv.FormatInt(opts.Confirmations, 10)
+	}
+	for name, v := range values {
+		if v != "" {
+			headers[c.flyHeader(name)] = v
+		}
+	}
+	if opts.IdempotencyKey != "" {
+		headers["Idempotency-Key"] = opts.IdempotencyKey
+	}
+	return headers
+}
+
+func (c *client) callHeaders(opts *CallOptions) map[string]string {
+	headers := map[string]string{}
+	if opts == nil {
+		return headers
+	}
+	values := map[string]string{
+		"from":        opts.From,
+		"blocknumber": opts.BlockNumber,
+		"blocktag":    opts.BlockTag,
+		"asof":        opts.AsOf,
+	}
+	for name, v := range values {
+		if v != "" {
+			headers[c.flyHeader(name)] = v
+		}
+	}
+	return headers
+}
+
+// send posts a transaction asynchronously, returning the ID to query the receipt with
+func (c *client) send(ctx context.Context, path string, params map[string]interface{}, opts *TxOptions) (*AsyncSent, error) {
+	if params == nil {
+		params = map[string]interface{}{}
+	}
+	var sent AsyncSent
+	if _, err := c.do(ctx, http.MethodPost, path, nil, c.txHeaders(opts, false), params, &sent); err != nil {
+		return nil, err
+	}
+	return &sent, nil
+}
+
+// sendSync posts a transaction and waits in the request for the receipt. The gateway replies
+// with a 500 and the receipt when the transaction fails, which is returned with the error
+func (c *client) sendSync(ctx context.Context, path string, params map[string]interface{}, opts *TxOptions) (*Receipt, error) {
+	if params == nil {
+		params = map[string]interface{}{}
+	}
+	var receipt Receipt
+	_, err := c.do(ctx, http.MethodPost, path, nil, c.txHeaders(opts, true), params, &receipt)
+	if apiErr, ok := err.(*APIError); ok && len(apiErr.body) > 0 {
+		if json.Unmarshal(apiErr.body, &receipt) == nil && receipt.Headers.Type != "" {
+			return &receipt, receipt.err()
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &receipt, receipt.err()
+}
+
+// Deploy deploys a new instance of an uploaded ABI, with the constructor parameters by name
+func (c *client) Deploy(ctx context.Context, abiID string, params map[string]interface{}, opts *TxOptions) (*AsyncSent, error) {
+	return c.send(ctx, "/abis/"+pathEscape(abiID), params, opts)
+}
+
+// DeployAndWait deploys a new instance of an uploaded ABI, and waits for the receipt - which
+// has the address of the contract
+func (c *client) DeployAndWait(ctx context.Context, abiID string, params map[string]interface{}, opts *TxOptions) (*Receipt, error) {
+	sent, err := c.Deploy(ctx, abiID, params, opts)
+	if err != nil {
+		return nil, err
+	}
+	return c.WaitForReceipt(ctx, sent.ID)
+}
+
+// Invoke submits a transaction to a method of a contract asynchronously, with the parameters by name
+func (c *client) Invoke(ctx context.Context, contract, method string, params map[string]interface{}, opts *TxOptions) (*AsyncSent, error) {
+	return c.send(ctx, contractPath(contract)+"/"+pathEscape(method), params, opts)
+}
+
+// InvokeSync submits a transaction to a method of a contract, holding the request open in the
+// gateway until the receipt is available
+func (c *client) InvokeSync(ctx context.Context, contract, method string, params map[string]interface{}, opts *TxOptions) (*Receipt, error) {
+	return c.sendSync(ctx, contractPath(contract)+"/"+pathEscape(method), params, opts)
+}
+
+// InvokeAndWait submits a transaction asynchronously, then polls the receipt store until the
+// receipt is available. Unlike InvokeSync this does not need a connection held open for the
+// time it takes to mine the transaction
+func (c *client) InvokeAndWait(ctx context.Context, contract, method string, params map[string]interface{}, opts *TxOptions) (*Receipt, error) {
+	sent, err := c.Invoke(ctx, contract, method, params, opts)
+	if err != nil {
+		return nil, err
+	}
+	return c.WaitForReceipt(ctx, sent.ID)
+}
+
+// Call calls a read-only method of a contract, and returns the outputs by name
+func (c *client) Call(ctx context.Context, contract, method string, params map[string]interface{}, opts *CallOptions) (map[string]interface{}, error) {
+	if params == nil {
+		params = map[string]interface{}{}
+	}
+	headers := c.callHeaders(opts)
+	headers[c.flyHeader("call")] = "true"
+	var outputs map[string]interface{}
+	if _, err := c.do(ctx, http.MethodPost, contractPath(contract)+"/"+pathEscape(method), nil, headers, params, &outputs); err != nil {
+		return nil, err
+	}
+	return outputs, nil
+}
+
+// GetReceipt queries the receipt store for the reply to a transaction. An APIError with a
+// 404 status is returned if there is no reply yet (see IsNotFound)
+func (c *client) GetReceipt(ctx context.Context, id string) (*Receipt, error) {
+	var receipt Receipt
+	if _, err := c.do(ctx, http.MethodGet, c.receiptPath+"/"+pathEscape(id), nil, nil, nil, &receipt); err != nil {
+		return nil, err
+	}
+	return &receipt, nil
+}
+
+// WaitForReceipt polls the receipt store until the reply to a transaction is available, or the
+// context is done. A receipt that is not a success is returned along with an error
+func (c *client) WaitForReceipt(ctx context.Context, id string) (*Receipt, error) {
+	for {
+		receipt, err := c.GetReceipt(ctx, id)
+		if err == nil {
+			return receipt, receipt.err()
+		}
+		if ctx.Err() != nil {
+			return nil, errors.Errorf(errors.ClientReceiptWaitTimeout, id)
+		}
+		if !IsNotFound(err) {
+			return nil, err
+		}
+		select {
+		case <-ctx.Done():
+			return nil, errors.Errorf(errors.ClientReceiptWaitTimeout, id)
+		case <-time.After(c.pollInterval):
+		}
+	}
+}
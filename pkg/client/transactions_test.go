@@ -0,0 +1,252 @@
+// Copyright 2021 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInvoke(t *testing.T) {
+	assert := assert.New(t)
+	c, done := newTestClient(t, func(res http.ResponseWriter, req *http.Request) {
+		assert.Equal("POST", req.Method)
+		assert.Equal("/contracts/mycontract/set", req.URL.Path)
+		assert.Equal("0xaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa", req.Header.Get("x-firefly-from"))
+		assert.Equal("100", req.Header.Get("x-firefly-ethvalue"))
+		assert.Equal("3", req.Header.Get("x-firefly-confirmations"))
+		assert.Equal("a,b", req.Header.Get("x-firefly-privatefor"))
+		assert.Equal("order-1", req.Header.Get("Idempotency-Key"))
+		assert.Empty(req.Header.Get("x-firefly-sync"))
+		assert.Empty(req.Header.Get("x-firefly-gas"))
+		var body map[string]interface{}
+		json.NewDecoder(req.Body).Decode(&body)
+		assert.Equal("12345", body["x"])
+		res.WriteHeader(202)
+		res.Write([]byte(`{"sent":true,"id":"req1"}`))
+	})
+	defer done()
+
+	sent, err := c.Invoke(context.Background(), "mycontract", "set", map[string]interface{}{"x": "12345"}, &TxOptions{
+		From:           "0xaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa",
+		Value:          "100",
+		Confirmations:  3,
+		PrivateFor:     []string{"a", "b"},
+		IdempotencyKey: "order-1",
+	})
+	assert.NoError(err)
+	assert.True(sent.Sent)
+	assert.Equal("req1", sent.ID)
+}
+
+func TestInvokeFail(t *testing.T) {
+	c, done := newTestClient(t, func(res http.ResponseWriter, req *http.Request) {
+		res.WriteHeader(400)
+		res.Write([]byte(`{"error":"Parameter 'x' of method 'set' was not specified in body or query parameters"}`))
+	})
+	defer done()
+
+	_, err := c.Invoke(context.Background(), "mycontract", "set", nil, nil)
+	assert.Regexp(t, "Parameter 'x'", err)
+}
+
+func TestInvokeSync(t *testing.T) {
+	assert := assert.New(t)
+	c, done := newTestClient(t, func(res http.ResponseWriter, req *http.Request) {
+		assert.Equal("true", req.Header.Get("x-firefly-sync"))
+		res.Write([]byte(`{"headers":{"type":"TransactionSuccess","requestId":"req1"},"transactionHash":"0x11","blockNumber":"10","status":"1"}`))
+	})
+	defer done()
+
+	receipt, err := c.InvokeSync(context.Background(), "mycontract", "set", nil, nil)
+	assert.NoError(err)
+	assert.True(receipt.Succeeded())
+	assert.Equal("0x11", receipt.TransactionHash)
+	assert.Equal("10", receipt.BlockNumber)
+}
+
+func TestInvokeSyncFailureReceipt(t *testing.T) {
+	assert := assert.New(t)
+	c, done := newTestClient(t, func(res http.ResponseWriter, req *http.Request) {
+		res.WriteHeader(500)
+		res.Write([]byte(`{"headers":{"type":"TransactionFailure","requestId":"req1"},"transactionHash":"0x11","status":"0","revertReason":"not allowed"}`))
+	})
+	defer done()
+
+	receipt, err := c.InvokeSync(context.Background(), "mycontract", "set", nil, nil)
+	assert.Regexp("Transaction req1 failed: not allowed", err)
+	assert.Equal("0x11", receipt.TransactionHash)
+}
+
+func TestInvokeSyncError(t *testing.T) {
+	c, done := newTestClient(t, func(res http.ResponseWriter, req *http.Request) {
+		res.WriteHeader(500)
+		res.Write([]byte(`{"error":"nonce too low"}`))
+	})
+	defer done()
+
+	receipt, err := c.InvokeSync(context.Background(), "mycontract", "set", nil, nil)
+	assert.Regexp(t, "Request failed with status 500: nonce too low", err)
+	assert.Nil(t, receipt)
+}
+
+func TestInvokeAndWait(t *testing.T) {
+	assert := assert.New(t)
+	var polls int32
+	c, done := newTestClient(t, func(res http.ResponseWriter, req *http.Request) {
+		switch req.Method + " " + req.URL.Path {
+		case "POST /contracts/mycontract/set":
+			res.WriteHeader(202)
+			res.Write([]byte(`{"sent":true,"id":"req1"}`))
+		case "GET /replies/req1":
+			if atomic.AddInt32(&polls, 1) < 3 {
+				res.WriteHeader(404)
+				res.Write([]byte(`{"error":"Receipt not available"}`))
+				return
+			}
+			res.Write([]byte(`{"headers":{"type":"TransactionSuccess","requestId":"req1"},"transactionHash":"0x11"}`))
+		}
+	})
+	defer done()
+
+	receipt, err := c.InvokeAndWait(context.Background(), "mycontract", "set", nil, nil)
+	assert.NoError(err)
+	assert.Equal("0x11", receipt.TransactionHash)
+	assert.Equal(int32(3), atomic.LoadInt32(&polls))
+}
+
+func TestInvokeAndWaitSendFail(t *testing.T) {
+	c, done := newTestClient(t, func(res http.ResponseWriter, req *http.Request) {
+		res.WriteHeader(500)
+	})
+	defer done()
+
+	_, err := c.InvokeAndWait(context.Background(), "mycontract", "set", nil, nil)
+	assert.Regexp(t, "status 500", err)
+}
+
+func TestWaitForReceiptError(t *testing.T) {
+	c, done := newTestClient(t, func(res http.ResponseWriter, req *http.Request) {
+		res.Write([]byte(`{"headers":{"type":"Error","requestId":"req1"},"errorMessage":"insufficient funds"}`))
+	})
+	defer done()
+
+	receipt, err := c.WaitForReceipt(context.Background(), "req1")
+	assert.Regexp(t, "Transaction req1 failed: insufficient funds", err)
+	assert.False(t, receipt.Succeeded())
+}
+
+func TestWaitForReceiptTimeout(t *testing.T) {
+	c, done := newTestClient(t, func(res http.ResponseWriter, req *http.Request) {
+		res.WriteHeader(404)
+	})
+	defer done()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err := c.WaitForReceipt(ctx, "req1")
+	assert.Regexp(t, "Timed out waiting for the receipt of request req1", err)
+}
+
+func TestWaitForReceiptFail(t *testing.T) {
+	c, done := newTestClient(t, func(res http.ResponseWriter, req *http.Request) {
+		res.WriteHeader(401)
+	})
+	defer done()
+
+	_, err := c.WaitForReceipt(context.Background(), "req1")
+	assert.Regexp(t, "status 401", err)
+}
+
+func TestDeployAndWait(t *testing.T) {
+	assert := assert.New(t)
+	c, done := newTestClient(t, func(res http.ResponseWriter, req *http.Request) {
+		switch req.Method + " " + req.URL.Path {
+		case "POST /abis/abi1":
+			assert.Equal("mycontract", req.Header.Get("x-firefly-register"))
+			res.WriteHeader(202)
+			res.Write([]byte(`{"sent":true,"id":"req1"}`))
+		case "GET /replies/req1":
+			res.Write([]byte(`{"headers":{"type":"TransactionSuccess","requestId":"req1"},"contractAddress":"0x0123456789abcdef0123456789abcdef01234567"}`))
+		}
+	})
+	defer done()
+
+	receipt, err := c.DeployAndWait(context.Background(), "abi1", map[string]interface{}{"initial": "1"}, &TxOptions{RegisterAs: "mycontract"})
+	assert.NoError(err)
+	assert.Equal("0x0123456789abcdef0123456789abcdef01234567", receipt.ContractAddress)
+}
+
+func TestDeployAndWaitFail(t *testing.T) {
+	c, done := newTestClient(t, func(res http.ResponseWriter, req *http.Request) {
+		res.WriteHeader(404)
+	})
+	defer done()
+
+	_, err := c.DeployAndWait(context.Background(), "abi1", nil, nil)
+	assert.True(t, IsNotFound(err))
+}
+
+func TestCall(t *testing.T) {
+	assert := assert.New(t)
+	c, done := newTestClient(t, func(res http.ResponseWriter, req *http.Request) {
+		assert.Equal("/contracts/mycontract/get", req.URL.Path)
+		assert.Equal("true", req.Header.Get("x-firefly-call"))
+		assert.Equal("finalized", req.Header.Get("x-firefly-blocktag"))
+		res.Write([]byte(`{"output":"12345"}`))
+	})
+	defer done()
+
+	outputs, err := c.Call(context.Background(), "mycontract", "get", nil, &CallOptions{BlockTag: "finalized"})
+	assert.NoError(err)
+	assert.Equal("12345", outputs["output"])
+}
+
+func TestCallFail(t *testing.T) {
+	c, done := newTestClient(t, func(res http.ResponseWriter, req *http.Request) {
+		res.WriteHeader(500)
+		res.Write([]byte(`{"error":"execution reverted"}`))
+	})
+	defer done()
+
+	_, err := c.Call(context.Background(), "mycontract", "get", nil, nil)
+	assert.Regexp(t, "execution reverted", err)
+}
+
+func TestHeaderPrefixAndReceiptEndpoint(t *testing.T) {
+	assert := assert.New(t)
+	server := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		switch req.Method + " " + req.URL.Path {
+		case "POST /contracts/mycontract/set":
+			assert.Equal("0xaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa", req.Header.Get("x-kaleido-from"))
+			res.WriteHeader(202)
+			res.Write([]byte(`{"sent":true,"id":"req1"}`))
+		case "GET /receipts/req1":
+			res.Write([]byte(`{"headers":{"type":"TransactionSuccess"}}`))
+		}
+	}))
+	defer server.Close()
+	c, _ := NewClient(&ClientConf{URL: server.URL, HeaderPrefix: "Kaleido", ReceiptEndpoint: "receipts/"})
+
+	_, err := c.InvokeAndWait(context.Background(), "mycontract", "set", nil, &TxOptions{From: "0xaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"})
+	assert.NoError(err)
+}
@@ -0,0 +1,60 @@
+// Copyright 2021 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package plugins
+
+import (
+	"errors"
+	"net/url"
+)
+
+// ErrKVNotFound must be returned by KVStore.Get when the key does not exist
+var ErrKVNotFound = errors.New("not found")
+
+// KVIterator iterates over keys in lexicographical order
+type KVIterator interface {
+	Key() string
+	Value() []byte
+	Next() bool
+	Prev() bool
+	Seek(string) bool
+	Last() bool
+	Release()
+}
+
+// KVRange restricts an iterator to keys >= Start and < Limit. Empty values are unbounded
+type KVRange struct {
+	Start string
+	Limit string
+}
+
+// KVStore is a key/value store, with ordered iteration, used for event streams, receipts and caches
+type KVStore interface {
+	Put(key string, val []byte) error
+	Get(key string) ([]byte, error)
+	Delete(key string) error
+	NewIterator() KVIterator
+	NewIteratorWithRange(keyRange *KVRange) KVIterator
+	Close()
+}
+
+// KVStoreDriver is a code plug-point for alternative key/value storage backends, that can be
+// implemented using a go plugin module.
+//  Build your plugin with a "KVStoreDriver" export that implements this interface,
+//  and configure the dynamic load path of your module against a connection URL scheme.
+//  Stores are then configured with connection strings such as "redis://host:6379/0"
+type KVStoreDriver interface {
+	// Open connects to the store described by the connection URL
+	Open(connURL *url.URL) (KVStore, error)
+}
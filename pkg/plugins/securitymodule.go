@@ -14,6 +14,8 @@
 
 package plugins
 
+import "time"
+
 // EventOperation enumerates operation types on events
 type EventOperation int
 
@@ -36,3 +38,59 @@ type SecurityModule interface {
 	// AuthReadAsyncReplyByUUID - Authorization plugpoint for getting an individual reply by UUID (containing an individual receipt/error)
 	AuthReadAsyncReplyByUUID(authCtx interface{}) error
 }
+
+// SecurityModuleTokenExpiry is an optional extension a SecurityModule can implement, to report
+// when a token verified by VerifyToken expires. Long-lived connections (such as WebSockets)
+// are closed on expiry, unless the client refreshes the token beforehand.
+type SecurityModuleTokenExpiry interface {
+	// TokenExpiry - returns the expiry of the token that produced the supplied auth context, or a zero time if it does not expire
+	TokenExpiry(authCtx interface{}) time.Time
+}
+
+// SecurityModuleTenant is an optional extension a SecurityModule can implement, to identify
+// the tenant that owns a token. Quotas on the event streams, subscriptions and contracts
+// created through the REST gateway are applied per tenant.
+type SecurityModuleTenant interface {
+	// Tenant - returns the tenant for the supplied auth context, or an empty string if it is not known
+	Tenant(authCtx interface{}) string
+}
+
+// SecurityModuleSubject is an optional extension a SecurityModule can implement, to identify
+// the principal a token was issued to. Long-lived connections (such as WebSockets) only accept
+// a refreshed token for the same principal and tenant as the token it replaces.
+type SecurityModuleSubject interface {
+	// Subject - returns the principal for the supplied auth context, or an empty string if it is not known
+	Subject(authCtx interface{}) string
+}
+
+// SecurityModuleSponsorship is an optional extension a SecurityModule can implement, to decide
+// which callers are entitled to have their transactions sent from a gas sponsor identity.
+// When implemented, it replaces the tenants configured on each sponsor as the policy.
+type SecurityModuleSponsorship interface {
+	// AuthSponsorship - Authorization plugpoint for sending a transaction using the gas of the named sponsor
+	AuthSponsorship(authCtx interface{}, sponsor string) error
+}
+
+// SecurityModuleAliases is an optional extension a SecurityModule can implement, to decide
+// which callers are entitled to send transactions from an identity alias.
+// When implemented, it replaces the owner and tenants of each alias as the policy.
+type SecurityModuleAliases interface {
+	// AuthAlias - Authorization plugpoint for sending a transaction from the identity of the named alias
+	AuthAlias(authCtx interface{}, alias string) error
+}
+
+// SecurityModulePrincipal is an optional extension a SecurityModule can implement, to accept
+// callers that ethconnect authenticates without a token - such as by the Ethereum address that
+// signed the request. It must be implemented for signature authentication to be combined with a module.
+type SecurityModulePrincipal interface {
+	// VerifyPrincipal - Authentication plugpoint for a named principal. Returns a context object to store that will be returned to authorization points
+	VerifyPrincipal(principal string) (interface{}, error)
+}
+
+// SecurityModuleAdmin is an optional extension a SecurityModule can implement, to decide which
+// callers are entitled to perform administrative operations, such as exporting a backup of the
+// LevelDB stores. When a SecurityModule is configured without it, these operations are rejected.
+type SecurityModuleAdmin interface {
+	// AuthAdmin - Authorization plugpoint for an administrative operation, such as "leveldb.backup"
+	AuthAdmin(authCtx interface{}, operation string, args ...interface{}) error
+}
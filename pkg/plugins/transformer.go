@@ -0,0 +1,30 @@
+// Copyright 2021 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package plugins
+
+// MessageTransformer is a code plug-point that can be implemented using a go plugin module,
+// to enrich, modify or reject messages without changing ethconnect itself.
+//  Build your plugin with a "MessageTransformer" export that implements this interface,
+//  and configure the dynamic load path of your module in the configuration.
+type MessageTransformer interface {
+
+	// TransformRequest - invoked before a transaction is submitted, or a contract deployed, with the JSON message.
+	// The message can be modified in place, and returning an error rejects the message with that error
+	TransformRequest(authCtx interface{}, msg map[string]interface{}) error
+	// TransformReply - invoked with the JSON reply once the receipt for a transaction has been processed, before
+	// it is delivered or stored. The reply can be modified in place, except for the headers set by ethconnect.
+	// Returning an error logs it, and the original reply is delivered
+	TransformReply(authCtx interface{}, reply map[string]interface{}) error
+}